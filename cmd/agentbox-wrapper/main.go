@@ -0,0 +1,109 @@
+//go:build linux
+
+// agentbox-wrapper is the entrypoint of wrapped execution pods (executions.wrapper). It runs the
+// command, forwarding signals to it, then writes the command's exit code and resource usage to
+// the result file and prints them as the last line of the pod's log, where the server reads
+// them. It exits with the command's exit code.
+//
+// Usage: agentbox-wrapper [--result-file path] -- command [args...]
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/execwrapper"
+)
+
+// forwardedSignals are passed on to the command (e.g. the soft timeout signal, sent to PID 1)
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+func main() {
+	resultFile := flag.String("result-file", "", "file the result is written to as JSON")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: agentbox-wrapper [--result-file path] -- command [args...]")
+		os.Exit(2)
+	}
+	os.Exit(run(flag.Args(), *resultFile))
+}
+
+// run runs the command, reports its result and returns its exit code
+func run(args []string, resultFile string) int {
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	result := &execwrapper.Result{StartedAt: time.Now().UTC()}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		result.ExitCode = 127
+		if errors.Is(err, os.ErrPermission) {
+			result.ExitCode = 126
+		}
+		result.Error = err.Error()
+		fmt.Fprintf(os.Stderr, "agentbox-wrapper: %v\n", err)
+	} else {
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case sig := <-signals:
+					_ = cmd.Process.Signal(sig)
+				case <-done:
+					return
+				}
+			}
+		}()
+		_ = cmd.Wait()
+		close(done)
+		recordUsage(result, cmd.ProcessState)
+	}
+	result.FinishedAt = time.Now().UTC()
+
+	footer, err := execwrapper.Footer(result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agentbox-wrapper: %v\n", err)
+		return result.ExitCode
+	}
+	if resultFile != "" {
+		if err := writeResultFile(resultFile, result); err != nil {
+			fmt.Fprintf(os.Stderr, "agentbox-wrapper: failed to write result file: %v\n", err)
+		}
+	}
+	_, _ = os.Stdout.Write(footer)
+	return result.ExitCode
+}
+
+// writeResultFile writes the result to path as JSON
+func writeResultFile(path string, result *execwrapper.Result) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// recordUsage sets the exit code and resource usage of the finished command
+func recordUsage(result *execwrapper.Result, state *os.ProcessState) {
+	result.ExitCode = state.ExitCode()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.ExitCode = 128 + int(status.Signal())
+		result.Signal = status.Signal().String()
+	}
+	result.CPUSeconds = (state.UserTime() + state.SystemTime()).Seconds()
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports it in KiB
+		result.MaxMemoryBytes = usage.Maxrss * 1024
+	}
+}
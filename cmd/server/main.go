@@ -5,8 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,18 +18,30 @@ import (
 	"github.com/sciffer/agentbox/internal/logger"
 	"github.com/sciffer/agentbox/pkg/api"
 	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/clientip"
 	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/exports"
 	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/logship"
 	"github.com/sciffer/agentbox/pkg/metrics"
+	"github.com/sciffer/agentbox/pkg/notify"
 	"github.com/sciffer/agentbox/pkg/orchestrator"
 	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/preferences"
 	"github.com/sciffer/agentbox/pkg/proxy"
+	"github.com/sciffer/agentbox/pkg/recording"
+	"github.com/sciffer/agentbox/pkg/registry"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/storage"
+	"github.com/sciffer/agentbox/pkg/teams"
+	"github.com/sciffer/agentbox/pkg/tracing"
 	"github.com/sciffer/agentbox/pkg/users"
 	"github.com/sciffer/agentbox/pkg/validator"
 )
 
 var (
-	configPath = flag.String("config", "config/config.yaml", "path to configuration file")
+	configPath     = flag.String("config", "config/config.yaml", "path to configuration file")
+	validateConfig = flag.Bool("validate-config", false, "load and validate the configuration, print the effective configuration (secrets redacted) and exit")
 )
 
 func main() {
@@ -45,6 +59,9 @@ func run() error {
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
+	if *validateConfig {
+		return printEffectiveConfig(*configPath, cfg)
+	}
 
 	// Initialize logger
 	log, err := logger.New(cfg.Server.LogLevel)
@@ -57,6 +74,28 @@ func run() error {
 	}()
 
 	log.Info("starting agentbox server", zap.String("version", "1.0.0"))
+	if len(cfg.DefaultedKeys) > 0 {
+		log.Info("config settings using defaults", zap.String("config", *configPath), zap.Strings("keys", cfg.DefaultedKeys))
+	}
+
+	// Initialize tracing (no-op unless tracing.enabled)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "1.0.0")
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Warn("failed to flush traces", zap.Error(err))
+		}
+	}()
+	if cfg.Tracing.Enabled {
+		log.Info("tracing enabled",
+			zap.String("endpoint", cfg.Tracing.Endpoint),
+			zap.Float64("sample_ratio", cfg.Tracing.SampleRatio),
+		)
+	}
 
 	// Initialize database
 	db, err := database.NewDB(log.Logger)
@@ -68,6 +107,7 @@ func run() error {
 
 	// Initialize user service
 	userService := users.NewService(db, log.Logger)
+	userService.SetPasswordPolicy(cfg.Auth.PasswordPolicy)
 
 	// Ensure default admin user exists
 	ctx := context.Background()
@@ -77,66 +117,228 @@ func run() error {
 
 	// Initialize auth service
 	authService := auth.NewService(db, userService, log.Logger)
+	signingKeys, err := auth.SigningKeysFromConfig(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	if len(signingKeys) > 0 {
+		if err := authService.SetSigningKeys(signingKeys); err != nil {
+			return fmt.Errorf("invalid JWT signing keys: %w", err)
+		}
+		log.Info("JWT signing keys loaded", zap.String("signing_key", signingKeys[0].ID), zap.Int("keys", len(signingKeys)))
+	} else if cfg.Auth.InsecureDevMode {
+		log.Warn("no JWT secret configured: insecure dev mode signs tokens with a random key that changes on every restart")
+	} else {
+		return fmt.Errorf("no JWT secret configured: set AGENTBOX_JWT_SECRET (at least %d characters) or auth.jwt_keys, "+
+			"or enable auth.insecure_dev_mode for local development", config.MinJWTSecretLength)
+	}
+	authService.SetAPIKeyLifecycle(
+		time.Duration(cfg.Auth.APIKeyRotationGraceHours)*time.Hour,
+		time.Duration(cfg.Auth.APIKeyExpiryWarningDays)*24*time.Hour,
+	)
+	authService.SetEnvironmentTokenMaxTTL(time.Duration(cfg.Auth.EnvironmentTokens.MaxTTLSeconds) * time.Second)
+	authService.SetLoginLockout(cfg.Auth.LoginLockout)
+	if cfg.Auth.OIDC.Enabled {
+		authService.SetOIDC(auth.NewOIDCProvider(cfg.Auth.OIDC, nil), !cfg.Auth.DisablePasswordLogin)
+		log.Info("single sign-on enabled",
+			zap.String("issuer", cfg.Auth.OIDC.IssuerURL),
+			zap.Bool("password_login", !cfg.Auth.DisablePasswordLogin),
+		)
+	}
+	apiKeyNotifierCtx, stopAPIKeyNotifier := context.WithCancel(ctx)
+	defer stopAPIKeyNotifier()
+	go authService.RunAPIKeyExpiryNotifier(apiKeyNotifierCtx, time.Hour)
 
 	// Initialize permission service
 	permissionService := permissions.NewService(db, log.Logger)
 
-	// Initialize Kubernetes client
-	k8sClient, err := k8s.NewClient(cfg.Kubernetes.Kubeconfig)
-	if err != nil {
-		return fmt.Errorf("failed to create kubernetes client: %w", err)
-	}
+	// Initialize team service
+	teamService := teams.NewService(db, log.Logger)
+
+	// Initialize role service (capabilities of built-in and custom roles)
+	roleService := roles.NewService(db, log.Logger)
 
-	// Verify Kubernetes connectivity
-	if err := k8sClient.HealthCheck(ctx); err != nil {
-		return fmt.Errorf("kubernetes health check failed: %w", err)
+	// Initialize preferences service (user preferences and their organization defaults)
+	preferenceService := preferences.NewService(db, cfg, log.Logger)
+
+	// Chaos testing: inject faults into Kubernetes API calls (never in production)
+	var faults *k8s.FaultInjector
+	if cfg.Kubernetes.InsecureFaultInjection {
+		faults = k8s.NewFaultInjector(time.Now().UnixNano())
+		log.Warn("kubernetes fault injection is enabled: super admins can make API calls fail via /api/v1/admin/faults; never enable this in production")
 	}
 
-	version, err := k8sClient.GetServerVersion(ctx)
+	// Initialize Kubernetes clients (one per configured cluster)
+	clusters, err := buildClusters(ctx, cfg, faults, log)
 	if err != nil {
-		log.Warn("failed to get kubernetes version", zap.Error(err))
-	} else {
-		log.Info("connected to kubernetes", zap.String("version", version))
+		return err
 	}
 
 	// Initialize validator
-	val := validator.New(
-		10000,              // max CPU: 10 cores
-		10*1024*1024*1024,  // max Memory: 10Gi
-		100*1024*1024*1024, // max Storage: 100Gi
-		cfg.Timeouts.MaxTimeout,
-	)
+	val := validator.New(0, 0, 0, 0) // limits are applied from the resources/timeouts config below
+	if err := val.SetLimits(cfg.Resources.MaxCPU, cfg.Resources.MaxMemory, cfg.Resources.MaxStorage, cfg.Timeouts.MaxTimeout); err != nil {
+		return fmt.Errorf("invalid resource limits: %w", err)
+	}
+	val.SetAllowedRegistries(cfg.Images.AllowedRegistries)
+	val.SetMaxExecFilesBytes(cfg.Executions.MaxFilesBytes)
+	val.SetRelaxedEnvNames(cfg.Resources.RelaxedEnvNames)
+
+	// Initialize the artifact storage shared by recordings, snapshots, archives and exports
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	presignExpiry := time.Duration(cfg.Storage.PresignExpirySeconds) * time.Second
 
 	// Initialize orchestrator
-	orch := orchestrator.New(k8sClient, cfg, log, db)
+	orch := orchestrator.NewWithClusters(clusters, cfg, log, db, orchestrator.WithStorage(store))
+	orch.SetCallbackTokenIssuer(authService)
+	orch.SetPreferences(preferenceService)
+	orch.SetLogSinkFactory(logship.NewSink)
+
+	// Email critical events to the users who opted in (notifications.email)
+	notifier := notify.NewService(cfg.Notifications.Email, userService, preferenceService, log.Logger)
+	notifier.SetRoleService(roleService)
+	notifier.Start(ctx, clusters, db)
+	defer notifier.Stop()
+	orch.SetCriticalNotifier(notifier)
+	if cfg.Auth.EnvironmentTokens.InjectIntoPods {
+		orch.SetEnvironmentTokenIssuer(authService)
+	}
 
-	// Initialize WebSocket proxy
-	var k8sInterface k8s.ClientInterface = k8sClient
-	proxyHandler := proxy.NewProxy(k8sInterface, log)
+	// Port forwarding to environments (its limits are hot-reloaded)
+	portForwarder := proxy.NewPortForwarder(log, nil, cfg.PortForward)
+
+	// Hot-reload tunable settings when the config file changes or on SIGHUP
+	configStore := config.NewStore(*configPath, cfg)
+	reloadConfig := func(trigger string) {
+		newCfg, err := configStore.Reload()
+		if err != nil {
+			log.Error("config reload failed; keeping previous configuration",
+				zap.String("trigger", trigger),
+				zap.Int64("reload_failures", configStore.Status().ReloadFailures),
+				zap.Error(err),
+			)
+			return
+		}
+		orch.UpdateConfig(newCfg)
+		preferenceService.UpdateConfig(newCfg)
+		portForwarder.UpdateConfig(newCfg.PortForward)
+		if err := val.SetLimits(newCfg.Resources.MaxCPU, newCfg.Resources.MaxMemory, newCfg.Resources.MaxStorage, newCfg.Timeouts.MaxTimeout); err != nil {
+			log.Error("invalid resource limits in reloaded config; keeping previous limits", zap.Error(err))
+		}
+		val.SetMaxExecFilesBytes(newCfg.Executions.MaxFilesBytes)
+		val.SetRelaxedEnvNames(newCfg.Resources.RelaxedEnvNames)
+		status := configStore.Status()
+		log.Info("configuration reloaded",
+			zap.String("trigger", trigger),
+			zap.Int64("reload_count", status.ReloadCount),
+			zap.Strings("pending_restart", status.PendingRestart),
+		)
+	}
+	configWatchCtx, stopConfigWatch := context.WithCancel(ctx)
+	defer stopConfigWatch()
+	go configStore.Watch(configWatchCtx, 5*time.Second, func() { reloadConfig("file_change") })
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-configWatchCtx.Done():
+				return
+			case <-hup:
+				reloadConfig("sighup")
+			}
+		}
+	}()
+
+	// Initialize WebSocket proxy (sessions use the attached environment's cluster)
+	proxyHandler := proxy.NewProxy(clusters.Default(), log)
 
 	// Initialize metrics collector
-	metricsCollector := metrics.NewCollector(db, orch, k8sClient, log.Logger)
+	metricsCollector := metrics.NewCollector(db, orch, clusters, log.Logger)
 	go metricsCollector.Start(ctx)
 	defer metricsCollector.Stop()
 
 	// Initialize all handlers
-	handler := api.NewHandler(orch, val, log, permissionService)
+	handler := api.NewHandler(orch, val, log, permissionService, teamService)
+	recordingService, err := recording.NewService(db, cfg.Recording, store, presignExpiry, log.Logger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize session recording: %w", err)
+	}
+	handler.SetRecordingService(recordingService)
+	handler.SetStorage(store, presignExpiry)
+	handler.SetRegistryClient(registry.NewClient(cfg.Images, log.Logger))
+	var externalURL *url.URL
+	if cfg.Server.ExternalURL != "" {
+		if externalURL, err = url.Parse(cfg.Server.ExternalURL); err != nil {
+			return fmt.Errorf("invalid external URL: %w", err)
+		}
+	}
+	handler.SetExternalURL(externalURL, cfg.Server.WSScheme)
+	handler.SetPreferencesService(preferenceService)
+	handler.SetBadgeSigner(authService)
+	handler.SetCallbackVerifier(authService)
+	handler.SetConfigStore(configStore)
 	authHandler := api.NewAuthHandler(authService, userService, log)
+	authHandler.SetPreferencesService(preferenceService)
 	userHandler := api.NewUserHandler(userService, authService, log)
+	userHandler.SetRoleService(roleService)
+	userHandler.SetOrchestrator(orch)
 	apiKeyHandler := api.NewAPIKeyHandler(authService, permissionService, log)
 	metricsHandler := api.NewMetricsHandler(db, log)
+	metricsHandler.SetOrchestrator(orch)
 	permissionHandler := api.NewPermissionHandler(permissionService, userService, log)
+	teamHandler := api.NewTeamHandler(teamService, userService, log)
+	teamHandler.SetOrchestrator(orch)
+	envTokenHandler := api.NewEnvironmentTokenHandler(authService, permissionService, orch, log)
+	configHandler := api.NewConfigHandler(configStore, log)
+	roleHandler := api.NewRoleHandler(roleService, log)
+	auditHandler := api.NewAuditHandler(db, log)
+	exportService, err := exports.NewService(db, cfg.Exports, store, log.Logger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize data exports: %w", err)
+	}
+	exportService.Start(ctx)
+	defer exportService.Stop()
+	exportJobHandler := api.NewExportJobHandler(exportService, log)
+	preferencesHandler := api.NewPreferencesHandler(preferenceService, log)
+	var faultHandler *api.FaultHandler
+	if faults != nil {
+		faultHandler = api.NewFaultHandler(faults, log)
+	}
+
+	clientIPResolver, err := clientip.NewResolver(cfg.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
 
 	// Create router with full configuration
 	routerConfig := &api.RouterConfig{
-		Handler:           handler,
-		AuthHandler:       authHandler,
-		UserHandler:       userHandler,
-		APIKeyHandler:     apiKeyHandler,
-		MetricsHandler:    metricsHandler,
-		PermissionHandler: permissionHandler,
-		ProxyHandler:      proxyHandler,
-		AuthService:       authService,
+		Handler:              handler,
+		AuthHandler:          authHandler,
+		UserHandler:          userHandler,
+		APIKeyHandler:        apiKeyHandler,
+		MetricsHandler:       metricsHandler,
+		PermissionHandler:    permissionHandler,
+		TeamHandler:          teamHandler,
+		EnvTokenHandler:      envTokenHandler,
+		ConfigHandler:        configHandler,
+		RoleHandler:          roleHandler,
+		AuditHandler:         auditHandler,
+		ExportJobHandler:     exportJobHandler,
+		PreferencesHandler:   preferencesHandler,
+		NotificationHandler:  api.NewNotificationHandler(notifier, log),
+		ImpersonationHandler: api.NewImpersonationHandler(authService, log),
+		FaultHandler:         faultHandler,
+		ProxyHandler:         proxyHandler,
+		PortForwarder:        portForwarder,
+		AuthService:          authService,
+		RoleService:          roleService,
+		BodyLimits:           cfg.Server.BodyLimits,
+		DisableCompression:   cfg.Server.DisableCompression,
+		ClientIP:             clientIPResolver,
 	}
 	router := api.NewRouter(routerConfig)
 
@@ -181,3 +383,64 @@ func run() error {
 	log.Info("server stopped")
 	return nil
 }
+
+// buildClusters creates a Kubernetes client for every configured cluster. The default cluster
+// must be reachable at startup; other clusters that are down are marked unreachable so their
+// environments are reported as degraded until they recover.
+// printEffectiveConfig prints the loaded configuration with secrets redacted, for -validate-config
+func printEffectiveConfig(path string, cfg *config.Config) error {
+	out, err := cfg.RedactedYAML()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# %s is valid; effective configuration (secrets redacted):\n%s", path, out)
+	if len(cfg.DefaultedKeys) > 0 {
+		fmt.Printf("# settings using defaults: %s\n", strings.Join(cfg.DefaultedKeys, ", "))
+	}
+	return nil
+}
+
+func buildClusters(ctx context.Context, cfg *config.Config, faults *k8s.FaultInjector, log *logger.Logger) (*k8s.Clusters, error) {
+	defaultName := cfg.Kubernetes.EffectiveDefaultCluster()
+	opts := k8s.ClientOptions{QPS: cfg.Kubernetes.QPS, Burst: cfg.Kubernetes.Burst}
+	retry := k8s.RetryPolicy{
+		MaxAttempts:    cfg.Kubernetes.Retry.MaxAttempts,
+		InitialBackoff: time.Duration(cfg.Kubernetes.Retry.InitialBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(cfg.Kubernetes.Retry.MaxBackoffMs) * time.Millisecond,
+	}
+	clients := make(map[string]k8s.ClientInterface)
+	for _, cc := range cfg.Kubernetes.EffectiveClusters() {
+		client, err := k8s.NewClientWithOptions(cc.Kubeconfig, cc.Context, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client for cluster %q: %w", cc.Name, err)
+		}
+		var base k8s.ClientInterface = client
+		if faults != nil {
+			base = k8s.WithFaults(client, faults)
+		}
+		clients[cc.Name] = k8s.WithTracing(k8s.WithRetry(base, retry, log.With(zap.String("cluster", cc.Name))), cc.Name)
+	}
+
+	clusters, err := k8s.NewClusters(defaultName, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range clusters.Names() {
+		if err := clusters.CheckHealth(ctx, name); err != nil {
+			if name == defaultName {
+				return nil, fmt.Errorf("kubernetes health check failed for default cluster %q: %w", name, err)
+			}
+			log.Warn("kubernetes cluster unreachable", zap.String("cluster", name), zap.Error(err))
+			continue
+		}
+		client, _ := clusters.Get(name)
+		version, err := client.GetServerVersion(ctx)
+		if err != nil {
+			log.Warn("failed to get kubernetes version", zap.String("cluster", name), zap.Error(err))
+		} else {
+			log.Info("connected to kubernetes", zap.String("cluster", name), zap.String("version", version))
+		}
+	}
+	return clusters, nil
+}
@@ -1,11 +1,27 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/mail"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	// Time zone names in preferences must resolve on hosts without a zoneinfo database
+	_ "time/tzdata"
 
+	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // Config holds all application configuration
@@ -17,14 +33,678 @@ type Config struct {
 	Timeouts       TimeoutConfig        `yaml:"timeouts"`
 	Pool           PoolConfig           `yaml:"pool"`
 	Reconciliation ReconciliationConfig `yaml:"reconciliation"`
+	Retention      RetentionConfig      `yaml:"retention"`
+	CommandPolicy  CommandPolicyConfig  `yaml:"command_policy"`
+	Executions     ExecutionConfig      `yaml:"executions"`
+	ExecSecurity   ExecSecurityConfig   `yaml:"execution_security"`
+	Idle           IdleConfig           `yaml:"idle"`
+	Recording      RecordingConfig      `yaml:"recording"`
+	Snapshots      SnapshotConfig       `yaml:"snapshots"`
+	Storage        StorageConfig        `yaml:"storage"`
+	Guardrails     GuardrailsConfig     `yaml:"guardrails"`
+	Reservations   ReservationsConfig   `yaml:"reservations"`
+	Network        NetworkConfig        `yaml:"network"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	Images         ImagesConfig         `yaml:"images"`
+	Exports        ExportConfig         `yaml:"exports"`
+	Preferences    PreferencesConfig    `yaml:"preferences"`
+	Notifications  NotificationsConfig  `yaml:"notifications"`
+	PortForward    PortForwardConfig    `yaml:"port_forward"`
+	Builds         BuildsConfig         `yaml:"builds"`
+	LogShipping    LogShippingConfig    `yaml:"log_shipping"`
+
+	// DefaultedKeys lists the settings (dotted YAML paths) that neither the config file nor an
+	// environment variable set, so they kept their default value; the server logs them at startup
+	DefaultedKeys []string `yaml:"-"`
+}
+
+// ImagesConfig holds the container image policy and the registry settings used to inspect
+// images
+type ImagesConfig struct {
+	// AllowedRegistries enables allowlist mode when non-empty: environments, execution image
+	// overrides and image inspection may only use images under these prefixes. A prefix is a
+	// registry host ("ghcr.io") optionally followed by a repository path ("ghcr.io/myorg");
+	// Docker Hub images are matched as "docker.io/library/python".
+	AllowedRegistries []string `yaml:"allowed_registries"`
+	// InspectCacheSeconds is how long image inspection results are cached (default: 300, 0 = off)
+	InspectCacheSeconds int `yaml:"inspect_cache_seconds"`
+	// Registries are the credentials used to query private registries
+	Registries []RegistryCredentialConfig `yaml:"registries"`
+}
+
+// RegistryCredentialConfig holds the credentials for one registry. Password may also be a
+// personal access token (GHCR) or an access token (Docker Hub).
+type RegistryCredentialConfig struct {
+	// Host is the registry host as written in image references, e.g. "ghcr.io" or
+	// "registry.example.com:5000" ("docker.io" for Docker Hub)
+	Host     string `yaml:"host" json:"host"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// ExportConfig holds the data export settings. Exports copy executions, environment events and
+// audit log entries created in a time range to an S3-compatible bucket or a webhook as
+// newline-delimited JSON, in batches. On-demand exports only need a sink; Enabled also exports
+// the previous UTC day every night.
+type ExportConfig struct {
+	// Enabled runs the nightly export of the previous UTC day
+	Enabled bool `yaml:"enabled"`
+	// DailyAt is the UTC time of day (HH:MM) the nightly export starts (default: 02:00)
+	DailyAt string `yaml:"daily_at"`
+	// Datasets are exported when an export does not name its own (default: all of executions,
+	// environment_events and audit_log)
+	Datasets []string `yaml:"datasets"`
+	// Sink is where exports are written: "s3", "webhook" or "storage" (the storage backend)
+	// ("" disables exports)
+	Sink    string              `yaml:"sink"`
+	S3      ExportS3Config      `yaml:"s3"`
+	Webhook ExportWebhookConfig `yaml:"webhook"`
+	// BatchSize is the maximum number of records per batch (object or webhook request)
+	// (default: 1000)
+	BatchSize int `yaml:"batch_size"`
+	// MaxBatchBytes ends a batch early once its encoded records reach this size (default: 8 MiB)
+	MaxBatchBytes int64 `yaml:"max_batch_bytes"`
+	// MaxAttempts is how many times a job is run before it is marked failed (default: 5)
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoffMs is the delay before a failed job is retried; it doubles on every retry,
+	// up to an hour (default: 60000)
+	InitialBackoffMs int `yaml:"initial_backoff_ms"`
+	// TimeoutSeconds bounds writing one batch (default: 60)
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
+// ExportS3Config is an S3-compatible bucket exports are uploaded to, one object per batch
+type ExportS3Config struct {
+	// Endpoint is the S3 API URL (default: https://s3.<region>.amazonaws.com)
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Prefix is prepended to object keys, e.g. "agentbox/"
+	Prefix          string `yaml:"prefix"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// PathStyle addresses the bucket as <endpoint>/<bucket> instead of <bucket>.<endpoint>
+	// (needed by most S3-compatible servers such as MinIO)
+	PathStyle bool `yaml:"path_style"`
+}
+
+// ExportWebhookConfig is a webhook exports are POSTed to, one request per batch
+type ExportWebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Secret signs every request like execution callbacks (X-AgentBox-Signature)
+	Secret string `yaml:"secret"`
+}
+
+// Export datasets and sinks
+const (
+	ExportDatasetExecutions        = "executions"
+	ExportDatasetEnvironmentEvents = "environment_events"
+	ExportDatasetAuditLog          = "audit_log"
+
+	ExportSinkS3      = "s3"
+	ExportSinkWebhook = "webhook"
+	// ExportSinkStorage writes exports to the storage backend, under exports/
+	ExportSinkStorage = "storage"
+)
+
+// ExportDatasets lists every export dataset
+var ExportDatasets = []string{ExportDatasetExecutions, ExportDatasetEnvironmentEvents, ExportDatasetAuditLog}
+
+// TracingConfig holds the OpenTelemetry tracing settings. Spans are exported over OTLP/HTTP;
+// tracing is disabled by default.
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the OTLP/HTTP collector address as host:port (default: localhost:4318)
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over plain HTTP instead of HTTPS
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is the fraction of new traces recorded (0-1); requests carrying a sampled
+	// traceparent header are always recorded
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// ServiceName is reported as the service.name resource attribute (default: agentbox)
+	ServiceName string `yaml:"service_name"`
+}
+
+// RecordingConfig holds the attach session recording settings. Recording is opt-in per
+// environment (record_sessions); recordings are asciicast v2 files.
+type RecordingConfig struct {
+	// Directory is where recordings are stored (default: ./recordings)
+	Directory string `yaml:"directory"`
+	// MaxBytes caps the size of one recording; the rest of the session is not recorded
+	MaxBytes int64 `yaml:"max_bytes"`
+	// RedactPatterns are regular expressions; matching text is replaced with [REDACTED] before a
+	// recording is written
+	RedactPatterns []string `yaml:"redact_patterns"`
+}
+
+// SnapshotConfig holds the workspace snapshot settings. Snapshots are opt-in per environment
+// (workspace_snapshots): a directory of the main pod is archived periodically and restored
+// when the main pod has to be recreated. Snapshots are tar files indexed in the database.
+type SnapshotConfig struct {
+	// Directory is where snapshots are stored (default: ./snapshots)
+	Directory string `yaml:"directory"`
+	// MaxBytes caps the size of one snapshot; larger workspaces fail to snapshot (default: 1 GiB)
+	MaxBytes int64 `yaml:"max_bytes"`
+	// DefaultIntervalSeconds is how often environments without their own interval are
+	// snapshotted (default: 3600)
+	DefaultIntervalSeconds int `yaml:"default_interval_seconds"`
+	// DefaultKeep is how many snapshots of an environment are kept when it sets none (default: 3)
+	DefaultKeep int `yaml:"default_keep"`
+}
+
+// StorageConfig holds the artifact storage settings. With a backend, session recordings,
+// workspace snapshots, stored environment archives and exports (with the storage sink) share
+// it, each under its own key prefix (recordings/, snapshots/, archives/, exports/); without
+// one, recordings and snapshots are files in their own directories and archives cannot be
+// stored.
+type StorageConfig struct {
+	// Backend is "local" (a directory) or "s3" (an S3-compatible bucket); "" keeps the
+	// per-feature directories
+	Backend string `yaml:"backend"`
+	// Directory is where the local backend stores objects (default: ./storage)
+	Directory string         `yaml:"directory"`
+	S3        ExportS3Config `yaml:"s3"`
+	// PresignExpirySeconds is how long the download URLs handed out by the s3 backend are
+	// valid (default: 900, at most 7 days)
+	PresignExpirySeconds int `yaml:"presign_expiry_seconds"`
+}
+
+// Storage backends
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+// ReservationsConfig holds the capacity reservation settings. A reservation holds cluster
+// capacity for a time window with placeholder pods, created shortly before the window starts
+// and replaced one by one by the environments created with the reservation.
+type ReservationsConfig struct {
+	// MaxEnvironmentsPerUser caps the unused environments a user (or a team) holds in open
+	// reservations (0 = unlimited; default: 50)
+	MaxEnvironmentsPerUser int `yaml:"max_environments_per_user"`
+	// LeadTimeSeconds is how long before the window the placeholder pods are created and the
+	// reservation can be used (default: 300)
+	LeadTimeSeconds int `yaml:"lead_time_seconds"`
+	// MaxDurationHours caps the length of a reservation window (default: 24)
+	MaxDurationHours int `yaml:"max_duration_hours"`
+	// MaxAdvanceDays is how far ahead a window may start (default: 30)
+	MaxAdvanceDays int `yaml:"max_advance_days"`
+	// PlaceholderImage is the image of the placeholder pods; it must run /pause
+	// (default: registry.k8s.io/pause:3.9)
+	PlaceholderImage string `yaml:"placeholder_image"`
+	// PlaceholderPriorityClass is the PriorityClass of the placeholder pods, created by cluster
+	// admins. A class below the environments' lets the scheduler preempt placeholders for
+	// environment pods (empty = the cluster default).
+	PlaceholderPriorityClass string `yaml:"placeholder_priority_class"`
+}
+
+// NetworkConfig holds the named network policies environments can pick with
+// isolation.network_preset instead of spelling out CIDRs and flags
+type NetworkConfig struct {
+	// Presets by name. The defaults (no-network, internet-only, cluster-only and unrestricted)
+	// can be redefined; a preset given here replaces the default of the same name as a whole.
+	Presets map[string]NetworkPresetConfig `yaml:"presets"`
+}
+
+// NetworkPresetConfig is a named network policy; its fields mean what they mean in an
+// environment's isolation.network_policy
+type NetworkPresetConfig struct {
+	Description          string   `yaml:"description" json:"description"`
+	AllowInternet        bool     `yaml:"allow_internet" json:"allow_internet"`
+	AllowedEgressCIDRs   []string `yaml:"allowed_egress_cidrs" json:"allowed_egress_cidrs"`
+	AllowedIngressPorts  []int32  `yaml:"allowed_ingress_ports" json:"allowed_ingress_ports"`
+	AllowClusterInternal bool     `yaml:"allow_cluster_internal" json:"allow_cluster_internal"`
+}
+
+// DefaultNetworkPresets returns the built-in network presets
+func DefaultNetworkPresets() map[string]NetworkPresetConfig {
+	return map[string]NetworkPresetConfig{
+		"no-network": {
+			Description: "No traffic in or out except DNS (the default without a network policy)",
+		},
+		"internet-only": {
+			Description:   "Outbound traffic to any address; no traffic from other pods",
+			AllowInternet: true,
+		},
+		"cluster-only": {
+			Description:          "Traffic to and from pods in the cluster; no other outbound traffic",
+			AllowClusterInternal: true,
+		},
+		"unrestricted": {
+			Description:          "Outbound traffic to any address and traffic from pods in the cluster",
+			AllowInternet:        true,
+			AllowClusterInternal: true,
+		},
+	}
+}
+
+// GuardrailsConfig bounds how hard AgentBox may push the cluster: how many namespaces it
+// manages and how fast it creates environments. Creations over a limit fail with a 429.
+type GuardrailsConfig struct {
+	// MaxNamespaces caps the namespaces AgentBox manages, one per environment (0 = unlimited)
+	MaxNamespaces int `yaml:"max_namespaces"`
+	// MaxEnvironmentsPerHour caps environment creations over a sliding hour, counted per
+	// replica (0 = unlimited)
+	MaxEnvironmentsPerHour int `yaml:"max_environments_per_hour"`
+	// NamespaceDeleteBatchSize is how many namespaces bulk operations delete at once (default: 10)
+	NamespaceDeleteBatchSize int `yaml:"namespace_delete_batch_size"`
+	// NamespaceDeleteBatchIntervalMs is the pause between namespace deletion batches (default: 1000)
+	NamespaceDeleteBatchIntervalMs int `yaml:"namespace_delete_batch_interval_ms"`
+}
+
+// minSnapshotIntervalSeconds is the shortest accepted snapshot interval
+const minSnapshotIntervalSeconds = 60
+
+// minRecordingBytes is the smallest accepted recording.max_bytes
+const minRecordingBytes = 1024
+
+// DefaultRecordingRedactPatterns mask common credentials typed or printed in a session
+var DefaultRecordingRedactPatterns = []string{
+	`(?i)(password|passwd|secret|token|api[_-]?key)\s*[=:]\s*\S+`,
+	`AKIA[0-9A-Z]{16}`,
+	`(ak|aet)_[A-Za-z0-9_-]{16,}`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+}
+
+// IdleConfig holds the idle reaper settings. Environments without activity (exec, run, logs
+// access, attach) for their idle timeout are terminated; environments labeled keep=true are exempt.
+type IdleConfig struct {
+	// TimeoutSeconds is the default idle timeout (0 = only environments with their own
+	// idle_timeout are reaped)
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	// WarningSeconds is how long before termination the idle warning is emitted (default: 3600)
+	WarningSeconds int `yaml:"warning_seconds"`
+	// IntervalSeconds is how often the idle reaper runs (default: 300)
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// WebhookURL receives a POST for idle warnings and terminations (optional)
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// PreferencesConfig holds the defaults of user preferences. Unset preferences fall back to the
+// organization defaults set by admins through the API, and those to these settings.
+type PreferencesConfig struct {
+	// DefaultProfile is the resource profile of environments created without resources ("" = none)
+	DefaultProfile string `yaml:"default_profile"`
+	// NotifyOnEnvironmentFailed sends a notification when an environment fails (default: true)
+	NotifyOnEnvironmentFailed bool `yaml:"notify_on_environment_failed"`
+	// NotifyOnExecutionFailed sends a notification when an execution fails (default: false)
+	NotifyOnExecutionFailed bool `yaml:"notify_on_execution_failed"`
+	// EmailCriticalAlerts emails critical events (notifications.email) (default: false)
+	EmailCriticalAlerts bool `yaml:"email_critical_alerts"`
+	// Timezone is the IANA time zone notifications are localized to (default: UTC)
+	Timezone string `yaml:"timezone"`
+}
+
+// NotificationsConfig holds the notification settings. Failure notifications are POSTed to the
+// webhook for the users whose preferences ask for them.
+type NotificationsConfig struct {
+	// WebhookURL receives a POST for every notification ("" disables notifications)
+	WebhookURL string `yaml:"webhook_url"`
+	// Email sends critical events to the users who opted in (email_critical_alerts)
+	Email EmailConfig `yaml:"email"`
+}
+
+// EmailConfig holds the SMTP settings of critical event emails and their limits. Critical events
+// are environments failing after their last retry, clusters failing their health check and
+// database error spikes.
+type EmailConfig struct {
+	// Enabled turns on critical event emails (default: false)
+	Enabled bool `yaml:"enabled"`
+	// Host and Port are the SMTP server (default port: 587)
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// Username and Password authenticate with PLAIN auth ("" = no auth)
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// From is the sender address
+	From string `yaml:"from"`
+	// TLS is "starttls" (default), "tls" (implicit TLS, usually port 465) or "none"
+	TLS string `yaml:"tls"`
+	// CooldownMinutes is how long the same event is not emailed again to the same user
+	// (default: 60)
+	CooldownMinutes int `yaml:"cooldown_minutes"`
+	// MaxPerHour caps the emails sent per hour; the rest are dropped (default: 30)
+	MaxPerHour int `yaml:"max_per_hour"`
+	// ClusterUnhealthyMinutes is how long a cluster fails its health check before it is
+	// reported (default: 5)
+	ClusterUnhealthyMinutes int `yaml:"cluster_unhealthy_minutes"`
+	// DBErrorThreshold database errors within DBErrorWindowMinutes are reported as a spike
+	// (defaults: 20 errors in 5 minutes)
+	DBErrorThreshold     int `yaml:"db_error_threshold"`
+	DBErrorWindowMinutes int `yaml:"db_error_window_minutes"`
+}
+
+// PortForwardConfig holds the limits of port forwarding to environments (GET
+// /environments/{id}/port-forward)
+type PortForwardConfig struct {
+	// AllowedPorts are the pod ports that may be forwarded, as single ports ("8888") or inclusive
+	// ranges ("8000-8999"); empty disables port forwarding (default: 1024-65535)
+	AllowedPorts []string `yaml:"allowed_ports"`
+	// IdleTimeoutSeconds closes forwarded connections without traffic in either direction for
+	// this long (default: 300, 0 = never)
+	IdleTimeoutSeconds int `yaml:"idle_timeout_seconds"`
+	// MaxPerEnvironment caps the connections forwarded to one environment at a time (default: 8)
+	MaxPerEnvironment int `yaml:"max_per_environment"`
+}
+
+// BuildsConfig holds the settings of image builds: environments created with a build section
+// have their image built by a Kaniko pod in Namespace (on the environment's cluster), pushed to
+// Registry and run by digest. Built images are labeled agentbox.io/environment-id and
+// agentbox.io/built-at so a registry cleanup job can garbage collect them.
+type BuildsConfig struct {
+	// Enabled accepts environments with a build section
+	Enabled bool `yaml:"enabled"`
+	// Namespace is where build pods run; it is created when missing (default: agentbox-builds)
+	Namespace string `yaml:"namespace"`
+	// Registry is the repository built images are pushed to, tagged with the environment ID,
+	// e.g. "registry.internal:5000/agentbox/builds" (required when enabled)
+	Registry string `yaml:"registry"`
+	// InsecureRegistry pushes to Registry over plain HTTP
+	InsecureRegistry bool `yaml:"insecure_registry"`
+	// PushSecret is a kubernetes.io/dockerconfigjson secret in Namespace holding the credentials
+	// for Registry ("" = push without credentials)
+	PushSecret string `yaml:"push_secret"`
+	// BuilderImage is the Kaniko executor image; it must be a debug variant, which has a shell
+	// (default: gcr.io/kaniko-project/executor:v1.23.2-debug)
+	BuilderImage string `yaml:"builder_image"`
+	// CPU, Memory and Storage are the requests and limits of a build pod (default: 2000m, 4Gi, 20Gi)
+	CPU     string `yaml:"cpu"`
+	Memory  string `yaml:"memory"`
+	Storage string `yaml:"storage"`
+	// TimeoutSeconds limits one build; it is added to the startup timeout of built environments
+	// (default: 1800)
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
+// LogShippingConfig holds the log shipping settings. Environments with a log_shipping section
+// (or all of them, when Enabled is set) have their main pod's log followed and pushed in batches
+// to Loki, an S3-compatible bucket or a webhook; the log is followed again whenever the pod is
+// recreated.
+type LogShippingConfig struct {
+	// Enabled ships the log of every environment without its own log_shipping section to
+	// DefaultSink with DefaultCredentials
+	Enabled            bool   `yaml:"enabled"`
+	DefaultSink        string `yaml:"default_sink"`
+	DefaultCredentials string `yaml:"default_credentials"`
+	// Credentials are the endpoints and secrets environments refer to by name
+	Credentials map[string]LogShippingCredentials `yaml:"credentials"`
+	// BatchLines and BatchBytes end a batch once it holds this many lines or bytes (default:
+	// 1000 lines, 1 MiB)
+	BatchLines int `yaml:"batch_lines"`
+	BatchBytes int `yaml:"batch_bytes"`
+	// FlushIntervalMs pushes a batch that has not filled up after this long (default: 2000)
+	FlushIntervalMs int `yaml:"flush_interval_ms"`
+	// MaxAttempts is how many times a batch is pushed before it is dropped (default: 5); the log
+	// is not read further meanwhile, so a slow sink holds the follower back instead of buffering
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoffMs is the delay before a failed push is retried; it doubles on every retry
+	// (default: 1000)
+	InitialBackoffMs int `yaml:"initial_backoff_ms"`
+	// TimeoutSeconds bounds one push (default: 30)
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
+// LogShippingCredentials is a log shipping endpoint: URL for the loki and webhook sinks, S3 for
+// the s3 sink
+type LogShippingCredentials struct {
+	// URL is the Loki push URL (e.g. http://loki:3100/loki/api/v1/push) or the webhook URL
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Username and Password authenticate to Loki with basic auth; TenantID is sent to it as
+	// X-Scope-OrgID
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	TenantID string `yaml:"tenant_id"`
+	// Secret signs webhook requests like execution callbacks (X-AgentBox-Signature)
+	Secret string         `yaml:"secret"`
+	S3     ExportS3Config `yaml:"s3"`
+}
+
+// Log shipping sinks
+const (
+	LogSinkLoki    = "loki"
+	LogSinkS3      = "s3"
+	LogSinkWebhook = "webhook"
+)
+
+// CheckSink reports whether the credentials can be used with a sink
+func (c LogShippingCredentials) CheckSink(sink string) error {
+	switch sink {
+	case LogSinkLoki, LogSinkWebhook:
+		if c.URL == "" {
+			return fmt.Errorf("the %s sink needs a url", sink)
+		}
+	case LogSinkS3:
+		if c.S3.Bucket == "" || c.S3.Region == "" {
+			return fmt.Errorf("the s3 sink needs an s3 bucket and region")
+		}
+	default:
+		return fmt.Errorf("unknown sink %q (want loki, s3 or webhook)", sink)
+	}
+	return nil
+}
+
+// AllowsPort reports whether port is one of the allowed ports (ranges that fail to parse allow
+// nothing; the configuration is validated at load)
+func (c *PortForwardConfig) AllowsPort(port int) bool {
+	for _, r := range c.AllowedPorts {
+		low, high, err := ParsePortRange(r)
+		if err == nil && port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePortRange parses a port ("8888") or an inclusive port range ("8000-8999")
+func ParsePortRange(s string) (low, high int, err error) {
+	lowStr, highStr, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if low, err = strconv.Atoi(lowStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	high = low
+	if isRange {
+		if high, err = strconv.Atoi(highStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q: ports must be between 1 and 65535, low first", s)
+	}
+	return low, high, nil
+}
+
+// ExecutionConfig holds limits applied to command executions
+type ExecutionConfig struct {
+	// MaxOutputBytes caps the stdout (and, separately, stderr) kept per execution; output beyond it
+	// is dropped from the middle, keeping the first and last half
+	MaxOutputBytes int64 `yaml:"max_output_bytes"`
+	// MaxQueueDepth caps the synchronous execs waiting for their turn in one environment with
+	// exec_mode "serialized"; further requests are rejected with 429 (default: 32)
+	MaxQueueDepth int `yaml:"max_queue_depth"`
+	// Callbacks restricts where execution results may be pushed (the callback_url of a run request)
+	Callbacks ExecutionCallbackConfig `yaml:"callbacks"`
+	// WorkingDir is the directory in the pod the input files of a run request are written to; it
+	// becomes the command's working directory (default: /workspace)
+	WorkingDir string `yaml:"working_dir"`
+	// MaxFilesBytes caps the total size of a run request's input files; 0 disables input files
+	// (default: 32 KiB). The files arrive base64-encoded, so body_limits.exec must hold them.
+	MaxFilesBytes int64 `yaml:"max_files_bytes"`
+	// SoftTimeoutPercent is the share of an execution's timeout after which its command is sent
+	// SoftTimeoutSignal, so it can checkpoint before it is killed at the timeout; 0 disables the
+	// warning (default: 90)
+	SoftTimeoutPercent int `yaml:"soft_timeout_percent"`
+	// SoftTimeoutSignal is the signal sent at the soft timeout, without the SIG prefix (default: TERM)
+	SoftTimeoutSignal string `yaml:"soft_timeout_signal"`
+	// Wrapper runs the commands of execution pods under the exec wrapper, which reports their
+	// exit code, CPU time and peak memory
+	Wrapper ExecWrapperConfig `yaml:"wrapper"`
+}
+
+// ExecWrapperConfig is where execution pods get the exec wrapper binary (cmd/agentbox-wrapper)
+// from: copied out of Image by an init container, or mounted from ConfigMap. Environments whose
+// image cannot run it set isolation.disable_exec_wrapper.
+type ExecWrapperConfig struct {
+	// Enabled wraps the commands of ephemeral execution pods (default: false)
+	Enabled bool `yaml:"enabled"`
+	// Image holds the wrapper binary at Path and a cp command, e.g. the agentbox server image
+	Image string `yaml:"image"`
+	// Path is the wrapper binary in Image (default: /app/agentbox-wrapper)
+	Path string `yaml:"path"`
+	// ConfigMap holds the binary under ConfigMapKey (instead of Image); a ConfigMap holds at most
+	// 1 MiB
+	ConfigMap    string `yaml:"config_map"`
+	ConfigMapKey string `yaml:"config_map_key"`
+}
+
+// Execution input file and soft timeout defaults
+const (
+	DefaultExecWorkingDir         = "/workspace"
+	DefaultExecMaxFilesBytes      = 32 << 10
+	DefaultExecSoftTimeoutPercent = 90
+	DefaultExecSoftTimeoutSignal  = "TERM"
+)
+
+// softTimeoutSignals are the signals that may be sent at the soft timeout: ones a workload can
+// catch (KILL and STOP cannot be)
+var softTimeoutSignals = []string{"HUP", "INT", "QUIT", "TERM", "USR1", "USR2"}
+
+// ExecSecurityConfig is the stricter security context ephemeral execution pods run with,
+// whatever the environment's main pod needs. It is applied on top of the environment's (and the
+// execution's) security context, unless the environment sets exec_inherit_security_context.
+type ExecSecurityConfig struct {
+	// Enabled applies these settings to execution pods (default: true)
+	Enabled bool `yaml:"enabled"`
+	// DropCapabilities are dropped from execution containers; capabilities the environment adds
+	// are not granted (default: ALL)
+	DropCapabilities []string `yaml:"drop_capabilities"`
+	// RunAsNonRoot refuses to run execution containers as root (default: true)
+	RunAsNonRoot bool `yaml:"run_as_non_root"`
+	// RunAsUser is the UID used with run_as_non_root when the environment sets none, or root
+	// (default: 65534, nobody)
+	RunAsUser int64 `yaml:"run_as_user"`
+	// ReadOnlyRootFilesystem mounts the container's root filesystem read-only (default: true)
+	ReadOnlyRootFilesystem bool `yaml:"read_only_root_filesystem"`
+	// ScratchPath gets a writable emptyDir when the root filesystem is read-only, as does the
+	// execution working directory (default: /tmp)
+	ScratchPath string `yaml:"scratch_path"`
+	// SeccompProfile is the seccomp profile type: RuntimeDefault or Unconfined ("" leaves the
+	// environment's) (default: RuntimeDefault)
+	SeccompProfile string `yaml:"seccomp_profile"`
+}
+
+// ExecutionCallbackConfig restricts execution callback URLs, which the server POSTs to on behalf
+// of any user: without these limits a callback could reach services inside the cluster.
+type ExecutionCallbackConfig struct {
+	// AllowedSchemes are the accepted URL schemes (default: https)
+	AllowedSchemes []string `yaml:"allowed_schemes"`
+	// AllowedHosts enables allowlist mode when non-empty: only these hosts may be called back.
+	// "*.example.com" matches any subdomain of example.com.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// AllowPrivateNetworks permits callbacks to loopback, private, link-local and other internal
+	// addresses, which are blocked by default
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"`
+	// MaxAttempts is how many times a delivery is tried before it is marked failed (default: 5)
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoffMs is the delay before the first retry; it doubles on every retry (default: 1000)
+	InitialBackoffMs int `yaml:"initial_backoff_ms"`
+	// TimeoutSeconds bounds one delivery attempt (default: 10)
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
+// minExecutionOutputBytes is the smallest accepted executions.max_output_bytes
+const minExecutionOutputBytes = 1024
+
+// CommandPolicyConfig is the server-wide exec command policy applied to non-admin users;
+// environments can add their own rules on top
+type CommandPolicyConfig struct {
+	// DenyPatterns are regular expressions; commands matching any of them are rejected
+	DenyPatterns []string `yaml:"deny_patterns"`
+	// AllowedBinaries enables allowlist mode when non-empty: only these programs may be run
+	AllowedBinaries []string `yaml:"allowed_binaries"`
+	// MaxArgLength is the maximum length of a single command argument in bytes (0 = unlimited)
+	MaxArgLength int `yaml:"max_arg_length"`
+}
+
+// DefaultCommandDenyPatterns reject commands that are almost always an attack on the host or
+// the sandbox rather than legitimate work
+var DefaultCommandDenyPatterns = []string{
+	`docker\.sock`,
+	`(^|[\s;&|(/])rm\s+(-\S*\s+)*(--\s+)?/+\*?(\s|[;&|)]|$)`,
+	`:\(\)\s*\{\s*:\s*\|\s*:?\s*&\s*\}`,
+	`(^|[\s;&|(/])mkfs(\.\w+)?(\s|$)`,
+	`(^|[\s;&|(/])dd\s.*\bof=/dev/`,
+	`base64\s+(-\S+\s+)*(-d|-D|--decode)\b.*\|\s*(\S*/)?(ba|da|z|k)?sh\b`,
+}
+
+// RetentionConfig holds execution history and environment event retention settings
+type RetentionConfig struct {
+	// KeepLastPerEnvironment keeps only the newest N finished executions per environment (0 = unlimited)
+	KeepLastPerEnvironment int `yaml:"keep_last_per_environment"`
+	// MaxAgeDays deletes finished executions older than this many days (0 = unlimited)
+	MaxAgeDays int `yaml:"max_age_days"`
+	// IntervalSeconds is how often the retention janitor runs (default: 3600)
+	IntervalSeconds int `yaml:"interval_seconds"`
+	// Events limits the reconciliation and lifecycle events kept per environment
+	Events EventRetentionConfig `yaml:"events"`
 }
 
+// EventRetentionConfig holds environment event retention settings. The newest failure event of a
+// failed environment is kept regardless, so the cause of the failure stays visible.
+type EventRetentionConfig struct {
+	// MaxPerEnvironment keeps only the newest N events per environment (0 = unlimited)
+	MaxPerEnvironment int `yaml:"max_per_environment"`
+	// MaxAgeDays deletes events older than this many days (0 = unlimited)
+	MaxAgeDays int `yaml:"max_age_days"`
+}
+
+// DefaultReconciliationMaxRetries is the number of reconciliation attempts when max_retries is unset or 0
+const DefaultReconciliationMaxRetries = 5
+
 // ReconciliationConfig holds reconciliation loop settings
 type ReconciliationConfig struct {
 	// IntervalSeconds is how often the reconciliation loop runs (default: 60)
 	IntervalSeconds int `yaml:"interval_seconds"`
-	// MaxRetries is the maximum number of reconciliation attempts for a failed/pending environment before marking as failed (default: 5)
+	// MaxRetries is the maximum number of reconciliation attempts for a failed/pending environment before marking as failed;
+	// 0 means the default (5), a negative value unlimited attempts
 	MaxRetries int `yaml:"max_retries"`
+	// OrphanGC deletes namespaces left behind by environments that no longer exist
+	OrphanGC OrphanGCConfig `yaml:"orphan_gc"`
+	// CacheSyncIntervalSeconds is how often the in-memory environment cache is refreshed from
+	// database changes made by other replicas; 0 disables it (default: 5, needs a database)
+	CacheSyncIntervalSeconds int `yaml:"cache_sync_interval_seconds"`
+	// PodWatch keeps the status of environments' main pods current from a watch on the pods
+	// AgentBox manages, so reading an environment does not call the Kubernetes API; without
+	// permission to watch pods it falls back to StatusCacheSeconds (default: true)
+	PodWatch bool `yaml:"pod_watch"`
+	// StatusCacheSeconds is how long a main pod status read from the Kubernetes API is reused by
+	// environment reads while the pod watch is off or unavailable; 0 reads it every time (default: 10)
+	StatusCacheSeconds int `yaml:"status_cache_seconds"`
+}
+
+// EffectiveMaxRetries returns the number of reconciliation attempts an environment gets:
+// MaxRetries, DefaultReconciliationMaxRetries when it is 0, or -1 (unlimited) when it is negative
+func (r ReconciliationConfig) EffectiveMaxRetries() int {
+	switch {
+	case r.MaxRetries < 0:
+		return -1
+	case r.MaxRetries == 0:
+		return DefaultReconciliationMaxRetries
+	}
+	return r.MaxRetries
+}
+
+// OrphanGCConfig controls the orphaned namespace collector run by the reconciliation loop. It
+// needs a database: without one every namespace would look orphaned after a restart.
+type OrphanGCConfig struct {
+	// Enabled turns the collector on (default: true)
+	Enabled bool `yaml:"enabled"`
+	// DryRun only logs and audits the orphans found, without deleting them
+	DryRun bool `yaml:"dry_run"`
+	// MinAgeSeconds leaves namespaces younger than this alone, so environments still being
+	// created are never collected (default: 3600)
+	MinAgeSeconds int `yaml:"min_age_seconds"`
 }
 
 // ServerConfig holds HTTP server configuration
@@ -32,6 +712,64 @@ type ServerConfig struct {
 	Port     int    `yaml:"port"`
 	Host     string `yaml:"host"`
 	LogLevel string `yaml:"log_level"`
+	// PublicURL is the base URL pods use to reach the API (e.g. http://agentbox-api.agentbox.svc:8080);
+	// exposed to workloads as AGENTBOX_API_URL. Empty disables the variable.
+	PublicURL string `yaml:"public_url"`
+	// ExternalURL is the base URL clients reach the API at (e.g. https://agentbox.example.com);
+	// environment URLs in responses are built from it. Empty uses the request's host (and the
+	// X-Forwarded-Proto/Host headers of trusted proxies).
+	ExternalURL string `yaml:"external_url"`
+	// WSScheme overrides the scheme of attach URLs ("ws" or "wss"); empty follows the http(s)
+	// scheme of the base URL
+	WSScheme string `yaml:"ws_scheme"`
+	// BodyLimits caps request body sizes per route group
+	BodyLimits BodyLimitsConfig `yaml:"body_limits"`
+	// DisableCompression turns off gzip compression of responses (e.g. when a proxy already compresses)
+	DisableCompression bool `yaml:"disable_compression"`
+	// TrustedProxies are the CIDRs (or single addresses) of the proxies in front of the server,
+	// e.g. the ingress. Only requests from them may set the client address with X-Forwarded-For or
+	// X-Real-IP; empty means the peer address is always the client.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// BodyLimitsConfig holds the maximum request body size, in bytes, for each group of routes.
+// Gzip-encoded bodies are limited by their decompressed size.
+type BodyLimitsConfig struct {
+	// Environments applies to creating and updating environments (default: 1 MiB)
+	Environments int64 `yaml:"environments"`
+	// Import applies to environment import (default: 4 MiB)
+	Import int64 `yaml:"import"`
+	// Exec applies to exec and run requests (default: 64 KiB)
+	Exec int64 `yaml:"exec"`
+	// Default applies to every other route: auth, users, teams, permissions, API keys (default: 8 KiB)
+	Default int64 `yaml:"default"`
+}
+
+// Default request body limits
+const (
+	DefaultEnvironmentsBodyLimit = 1 << 20
+	DefaultImportBodyLimit       = 4 << 20
+	DefaultExecBodyLimit         = 64 << 10
+	DefaultBodyLimit             = 8 << 10
+)
+
+// minBodyLimit is the smallest accepted body limit
+const minBodyLimit = 1024
+
+// WithDefaults returns the limits with unset (zero) values replaced by the defaults
+func (b BodyLimitsConfig) WithDefaults() BodyLimitsConfig {
+	orDefault := func(v, def int64) int64 {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+	return BodyLimitsConfig{
+		Environments: orDefault(b.Environments, DefaultEnvironmentsBodyLimit),
+		Import:       orDefault(b.Import, DefaultImportBodyLimit),
+		Exec:         orDefault(b.Exec, DefaultExecBodyLimit),
+		Default:      orDefault(b.Default, DefaultBodyLimit),
+	}
 }
 
 // KubernetesConfig holds Kubernetes connection configuration
@@ -39,6 +777,94 @@ type KubernetesConfig struct {
 	Kubeconfig      string `yaml:"kubeconfig"`
 	NamespacePrefix string `yaml:"namespace_prefix"`
 	RuntimeClass    string `yaml:"runtime_class"`
+	// Clusters lists named clusters environments can be scheduled on. When empty, a single
+	// cluster named "default" is built from Kubeconfig.
+	Clusters []ClusterConfig `yaml:"clusters"`
+	// DefaultCluster is used for environments that do not request a cluster (default: first cluster)
+	DefaultCluster string `yaml:"default_cluster"`
+	// QPS and Burst are the client-side API rate limits per cluster (default: 50 and 100)
+	QPS   float32 `yaml:"qps"`
+	Burst int     `yaml:"burst"`
+	// Retry controls retries of API calls that fail with transient errors
+	Retry KubernetesRetryConfig `yaml:"retry"`
+	// PriorityClasses controls the PriorityClass of environment and execution pods
+	PriorityClasses PriorityClassesConfig `yaml:"priority_classes"`
+	// ServiceAccounts controls the ServiceAccounts environments may run their pods with
+	ServiceAccounts ServiceAccountsConfig `yaml:"service_accounts"`
+	// InsecureFaultInjection wraps the clients in a fault injector that super admins control
+	// through /admin/faults, for chaos testing. Never enable it in production.
+	InsecureFaultInjection bool `yaml:"insecure_fault_injection"`
+}
+
+// PriorityClassesConfig holds the PriorityClasses pods may run with. The classes themselves are
+// created by cluster admins; agentbox only references them.
+type PriorityClassesConfig struct {
+	// Allowed lists the class names environments and executions may request with
+	// isolation.priority_class_name (empty = requests are rejected)
+	Allowed []string `yaml:"allowed"`
+	// Main, Standby and Ephemeral are the classes of each pod type when the environment or
+	// execution requests none (empty = the cluster default)
+	Main      string `yaml:"main"`
+	Standby   string `yaml:"standby"`
+	Ephemeral string `yaml:"ephemeral"`
+}
+
+// ServiceAccountsConfig holds the ServiceAccounts environments may request with
+// isolation.service_account. agentbox creates them in the environment's namespace; granting them
+// cloud IAM roles is done through the allowed annotations.
+type ServiceAccountsConfig struct {
+	// Enabled lets environments request a ServiceAccount (default: true)
+	Enabled bool `yaml:"enabled"`
+	// AllowedAnnotations lists the annotations environments may set on their ServiceAccount
+	// (empty = none)
+	AllowedAnnotations []AllowedAnnotation `yaml:"allowed_annotations"`
+}
+
+// AllowedAnnotation allows a ServiceAccount annotation key with the values matching ValuePattern
+type AllowedAnnotation struct {
+	Key string `yaml:"key"`
+	// ValuePattern is a regular expression the whole value must match (e.g.
+	// ^arn:aws:iam::123456789012:role/agentbox-.+$)
+	ValuePattern string `yaml:"value_pattern"`
+}
+
+// KubernetesRetryConfig holds the retry policy for Kubernetes API calls
+type KubernetesRetryConfig struct {
+	// MaxAttempts is the total number of attempts per call, including the first (default: 3, 1 disables retries)
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoffMs is the delay before the first retry; it doubles after every attempt (default: 200)
+	InitialBackoffMs int `yaml:"initial_backoff_ms"`
+	// MaxBackoffMs caps the delay between attempts (default: 5000)
+	MaxBackoffMs int `yaml:"max_backoff_ms"`
+}
+
+// ClusterConfig describes how to connect to one Kubernetes cluster
+type ClusterConfig struct {
+	Name string `yaml:"name"`
+	// Kubeconfig is the kubeconfig path; empty uses in-cluster config
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Context selects a kubeconfig context; empty uses the kubeconfig's current context
+	Context string `yaml:"context"`
+}
+
+// defaultClusterName is the name of the implicit cluster built from the top-level kubeconfig
+const defaultClusterName = "default"
+
+// EffectiveClusters returns the configured clusters, or a single "default" cluster built from
+// the top-level kubeconfig when none are listed
+func (k KubernetesConfig) EffectiveClusters() []ClusterConfig {
+	if len(k.Clusters) > 0 {
+		return k.Clusters
+	}
+	return []ClusterConfig{{Name: defaultClusterName, Kubeconfig: k.Kubeconfig}}
+}
+
+// EffectiveDefaultCluster returns the name of the cluster used when a request does not pick one
+func (k KubernetesConfig) EffectiveDefaultCluster() string {
+	if k.DefaultCluster != "" {
+		return k.DefaultCluster
+	}
+	return k.EffectiveClusters()[0].Name
 }
 
 // PoolConfig holds standby pod pool configuration
@@ -57,8 +883,121 @@ type PoolConfig struct {
 
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	Secret  string `yaml:"secret"`
+	Enabled bool `yaml:"enabled"`
+	// Secret is the JWT signing secret (AGENTBOX_JWT_SECRET, or AGENTBOX_AUTH_SECRET), used when
+	// JWTKeys is empty
+	Secret string `yaml:"secret"`
+	// JWTKeys is the JWT signing key set, for rotating the secret without invalidating every
+	// session: the first key signs new tokens, the others are only accepted until they retire
+	JWTKeys []JWTKeyConfig `yaml:"jwt_keys"`
+	// InsecureDevMode lets the server start without a JWT secret, signing with a random key
+	// generated at startup (sessions do not survive restarts). Never use in production.
+	InsecureDevMode bool `yaml:"insecure_dev_mode"`
+	// APIKeyRotationGraceHours is how long a rotated API key keeps working (default: 24)
+	APIKeyRotationGraceHours int `yaml:"api_key_rotation_grace_hours"`
+	// APIKeyExpiryWarningDays reports keys expiring within this many days (default: 7)
+	APIKeyExpiryWarningDays int `yaml:"api_key_expiry_warning_days"`
+	// DisablePasswordLogin rejects username/password logins (requires OIDC to be enabled)
+	DisablePasswordLogin bool `yaml:"disable_password_login"`
+	// OIDC configures single sign-on through an OpenID Connect provider
+	OIDC OIDCConfig `yaml:"oidc"`
+	// EnvironmentTokens configures short-lived tokens scoped to a single environment
+	EnvironmentTokens EnvironmentTokenConfig `yaml:"environment_tokens"`
+	// PasswordPolicy is the policy passwords of local users must satisfy
+	PasswordPolicy PasswordPolicyConfig `yaml:"password_policy"`
+	// LoginLockout throttles failed password logins
+	LoginLockout LoginLockoutConfig `yaml:"login_lockout"`
+}
+
+// PasswordPolicyConfig is the policy passwords of local users must satisfy when they are set
+type PasswordPolicyConfig struct {
+	// MinLength is the minimum number of characters (default: 8)
+	MinLength        int  `yaml:"min_length"`
+	RequireUppercase bool `yaml:"require_uppercase"`
+	RequireLowercase bool `yaml:"require_lowercase"`
+	RequireDigit     bool `yaml:"require_digit"`
+	RequireSymbol    bool `yaml:"require_symbol"`
+	// RejectCommon rejects well-known passwords and the user's own username (default: true)
+	RejectCommon bool `yaml:"reject_common"`
+}
+
+// LoginLockoutConfig throttles failed password logins per username and per client address.
+// Each failure blocks further attempts for an exponentially growing delay; MaxFailures
+// consecutive failures lock the username (or address) out for LockoutSeconds.
+type LoginLockoutConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxFailures is the number of consecutive failures that lock a username out (default: 5)
+	MaxFailures int `yaml:"max_failures"`
+	// MaxFailuresPerIP is the number of failures that lock a client address out; addresses are
+	// shared by users behind NAT, so it is higher (default: 20, 0 disables per-address tracking)
+	MaxFailuresPerIP int `yaml:"max_failures_per_ip"`
+	// BaseDelayMs is the delay after the first failure, doubled after each further one (default: 1000)
+	BaseDelayMs int `yaml:"base_delay_ms"`
+	// LockoutSeconds is how long a lockout lasts; failures older than this are forgotten (default: 900)
+	LockoutSeconds int `yaml:"lockout_seconds"`
+}
+
+// JWTKeyConfig is one JWT signing key; its ID is written to the kid header of the tokens it signs
+type JWTKeyConfig struct {
+	ID     string `yaml:"id" json:"id"`
+	Secret string `yaml:"secret" json:"secret"`
+	// RetireAt (RFC 3339) is when the key stops being accepted; empty keeps it until it is
+	// removed. The first key signs new tokens and must not retire.
+	RetireAt string `yaml:"retire_at,omitempty" json:"retire_at,omitempty"`
+}
+
+// MinJWTSecretLength is the minimum length of a JWT signing secret
+const MinJWTSecretLength = 32
+
+// InsecureDefaultJWTSecret is the placeholder secret of old sample configs; it is always rejected
+const InsecureDefaultJWTSecret = "change-me-in-production"
+
+// defaultJWTKeyID is the ID of the key built from auth.secret
+const defaultJWTKeyID = "default"
+
+// EffectiveJWTKeys returns the configured key set, or a single "default" key built from Secret
+// when none is listed (nil when no secret is configured at all)
+func (a AuthConfig) EffectiveJWTKeys() []JWTKeyConfig {
+	if len(a.JWTKeys) > 0 {
+		return a.JWTKeys
+	}
+	if a.Secret == "" {
+		return nil
+	}
+	return []JWTKeyConfig{{ID: defaultJWTKeyID, Secret: a.Secret}}
+}
+
+// EnvironmentTokenConfig holds the settings of environment-scoped API tokens
+type EnvironmentTokenConfig struct {
+	// MaxTTLSeconds caps the lifetime of environment tokens (default: 86400)
+	MaxTTLSeconds int `yaml:"max_ttl_seconds"`
+	// InjectIntoPods gives main pods an editor token for their environment as AGENTBOX_TOKEN, valid
+	// until the environment is deleted
+	InjectIntoPods bool `yaml:"inject_into_pods"`
+}
+
+// OIDCConfig holds OpenID Connect single sign-on settings
+type OIDCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// IssuerURL is the provider's issuer; its /.well-known/openid-configuration is used for discovery
+	IssuerURL    string `yaml:"issuer_url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is this server's callback URL (.../api/v1/auth/oidc/callback) as registered with the provider
+	RedirectURL string `yaml:"redirect_url"`
+	// Scopes requested in addition to "openid" (default: email, profile)
+	Scopes []string `yaml:"scopes"`
+	// GroupsClaim is the ID token claim holding the user's groups (default: groups)
+	GroupsClaim string `yaml:"groups_claim"`
+	// RoleMapping maps group names to agentbox roles (user, admin); the most privileged match
+	// wins and is re-applied on every login. Users without a matching group get DefaultRole.
+	// Local (password) accounts linked by email are promoted by the mapping but never demoted.
+	RoleMapping map[string]string `yaml:"role_mapping"`
+	// DefaultRole is the role of users none of whose groups are mapped (default: user)
+	DefaultRole string `yaml:"default_role"`
+	// PostLoginRedirectURL, when set, receives the issued token in its URL fragment
+	// (#token=...&expires_at=...) instead of the callback responding with JSON
+	PostLoginRedirectURL string `yaml:"post_login_redirect_url"`
 }
 
 // ResourceConfig holds default resource limits
@@ -67,6 +1006,26 @@ type ResourceConfig struct {
 	DefaultMemoryLimit     string `yaml:"default_memory_limit"`
 	DefaultStorageLimit    string `yaml:"default_storage_limit"`
 	MaxEnvironmentsPerUser int    `yaml:"max_environments_per_user"`
+	// MaxCPU, MaxMemory and MaxStorage are the largest resources a request may ask for
+	MaxCPU     string `yaml:"max_cpu"`
+	MaxMemory  string `yaml:"max_memory"`
+	MaxStorage string `yaml:"max_storage"`
+	// CapacityCheck rejects environments no node can fit (422) and warns when the cluster is
+	// currently too full to schedule them
+	CapacityCheck bool `yaml:"capacity_check"`
+	// RelaxedEnvNames accepts environment variable names with '.' and '-', as Kubernetes does;
+	// by default names must be C identifiers (letters, digits and '_'), which every shell can read
+	RelaxedEnvNames bool `yaml:"relaxed_env_names"`
+	// Profiles are named resource sizes users can pick as their default profile; environments
+	// created without resources get the resources of their creator's default profile
+	Profiles map[string]ResourceProfileConfig `yaml:"profiles"`
+}
+
+// ResourceProfileConfig is a named set of environment resources
+type ResourceProfileConfig struct {
+	CPU     string `yaml:"cpu"`
+	Memory  string `yaml:"memory"`
+	Storage string `yaml:"storage"`
 }
 
 // TimeoutConfig holds timeout settings
@@ -74,9 +1033,16 @@ type TimeoutConfig struct {
 	DefaultTimeout int `yaml:"default_timeout"`
 	MaxTimeout     int `yaml:"max_timeout"`
 	StartupTimeout int `yaml:"startup_timeout"`
+	// NamespaceTerminationTimeout is how long provisioning waits for a namespace of the same name
+	// that is still being deleted before it fails, in seconds (0 = fail right away)
+	NamespaceTerminationTimeout int `yaml:"namespace_termination_timeout"`
+	// MaxTerminationGracePeriod caps the lifecycle.termination_grace_period_seconds environments
+	// may request, in seconds
+	MaxTerminationGracePeriod int `yaml:"max_termination_grace_period"`
 }
 
-// Load loads configuration from file and environment variables
+// Load loads configuration from file and environment variables. Unknown keys in the file and
+// invalid settings are all reported together in a *ValidationError.
 func Load(configPath string) (*Config, error) {
 	cfg := &Config{}
 
@@ -84,23 +1050,42 @@ func Load(configPath string) (*Config, error) {
 	setDefaults(cfg)
 
 	// Load from file if provided
+	var problems []string
+	fileKeys := make(map[string]bool)
 	if configPath != "" {
 		data, err := os.ReadFile(configPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read config file: %w", err)
 		}
 
-		if err := yaml.Unmarshal(data, cfg); err != nil {
-			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", configPath, err)
+		}
+		if doc.Kind != 0 { // an empty file keeps the defaults
+			problems = checkKeys(&doc, reflect.TypeOf(*cfg), "", fileKeys)
+			if err := doc.Decode(cfg); err != nil {
+				return nil, fmt.Errorf("failed to parse config file %s: %w", configPath, err)
+			}
 		}
 	}
 
 	// Override with environment variables
-	overrideFromEnv(cfg)
+	beforeEnv := make(map[string]string)
+	flatten(reflect.ValueOf(*cfg), "", beforeEnv)
+	problems = append(problems, overrideFromEnv(cfg)...)
+	cfg.DefaultedKeys = defaultedKeys(cfg, fileKeys, beforeEnv)
+
+	// Store the number of reconciliation attempts actually used, so it is what the startup log
+	// and --validate-config report
+	cfg.Reconciliation.MaxRetries = cfg.Reconciliation.EffectiveMaxRetries()
 
 	// Validate configuration
-	if err := validate(cfg); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
+	for _, err := range validate(cfg) {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Path: configPath, Problems: problems}
 	}
 
 	return cfg, nil
@@ -111,20 +1096,45 @@ func setDefaults(cfg *Config) {
 	cfg.Server.Port = 8080
 	cfg.Server.Host = "0.0.0.0"
 	cfg.Server.LogLevel = "info"
+	cfg.Server.BodyLimits = BodyLimitsConfig{}.WithDefaults()
 
 	cfg.Kubernetes.NamespacePrefix = "agentbox-"
 	cfg.Kubernetes.RuntimeClass = "gvisor"
+	cfg.Kubernetes.QPS = 50
+	cfg.Kubernetes.Burst = 100
+	cfg.Kubernetes.Retry.MaxAttempts = 3
+	cfg.Kubernetes.Retry.InitialBackoffMs = 200
+	cfg.Kubernetes.Retry.MaxBackoffMs = 5000
+	cfg.Kubernetes.ServiceAccounts.Enabled = true
 
 	cfg.Auth.Enabled = true
+	cfg.Auth.APIKeyRotationGraceHours = 24
+	cfg.Auth.APIKeyExpiryWarningDays = 7
+	cfg.Auth.EnvironmentTokens.MaxTTLSeconds = 86400
+	cfg.Auth.PasswordPolicy.MinLength = 8
+	cfg.Auth.PasswordPolicy.RejectCommon = true
+	cfg.Auth.LoginLockout.Enabled = true
+	cfg.Auth.LoginLockout.MaxFailures = 5
+	cfg.Auth.LoginLockout.MaxFailuresPerIP = 20
+	cfg.Auth.LoginLockout.BaseDelayMs = 1000
+	cfg.Auth.LoginLockout.LockoutSeconds = 900
+	cfg.Auth.OIDC.Scopes = []string{"email", "profile"}
+	cfg.Auth.OIDC.GroupsClaim = "groups"
+	cfg.Auth.OIDC.DefaultRole = "user"
 
 	cfg.Resources.DefaultCPULimit = "1000m"
 	cfg.Resources.DefaultMemoryLimit = "1Gi"
 	cfg.Resources.DefaultStorageLimit = "5Gi"
 	cfg.Resources.MaxEnvironmentsPerUser = 100
+	cfg.Resources.MaxCPU = "10000m"
+	cfg.Resources.MaxMemory = "10Gi"
+	cfg.Resources.MaxStorage = "100Gi"
 
 	cfg.Timeouts.DefaultTimeout = 3600
 	cfg.Timeouts.MaxTimeout = 86400
 	cfg.Timeouts.StartupTimeout = 120 // 2 minutes to allow for image pulls
+	cfg.Timeouts.NamespaceTerminationTimeout = 120
+	cfg.Timeouts.MaxTerminationGracePeriod = 300
 
 	// Pool defaults (disabled by default)
 	cfg.Pool.Enabled = false
@@ -135,18 +1145,156 @@ func setDefaults(cfg *Config) {
 
 	// Reconciliation defaults
 	cfg.Reconciliation.IntervalSeconds = 60
-	cfg.Reconciliation.MaxRetries = 5
+	cfg.Reconciliation.MaxRetries = DefaultReconciliationMaxRetries
+	cfg.Reconciliation.OrphanGC.Enabled = true
+	cfg.Reconciliation.OrphanGC.MinAgeSeconds = 3600
+	cfg.Reconciliation.CacheSyncIntervalSeconds = 5
+	cfg.Reconciliation.PodWatch = true
+	cfg.Reconciliation.StatusCacheSeconds = 10
+
+	// Retention defaults (keep everything)
+	cfg.Retention.KeepLastPerEnvironment = 0
+	cfg.Retention.MaxAgeDays = 0
+	cfg.Retention.IntervalSeconds = 3600
+
+	// Command policy defaults (deny well-known destructive commands, no allowlist)
+	cfg.CommandPolicy.DenyPatterns = append([]string{}, DefaultCommandDenyPatterns...)
+	cfg.CommandPolicy.MaxArgLength = 0
+
+	cfg.Executions.MaxOutputBytes = 1024 * 1024 // 1 MiB
+	cfg.Executions.MaxQueueDepth = 32
+	cfg.Executions.Callbacks.AllowedSchemes = []string{"https"}
+	cfg.Executions.Callbacks.MaxAttempts = 5
+	cfg.Executions.Callbacks.InitialBackoffMs = 1000
+	cfg.Executions.Callbacks.TimeoutSeconds = 10
+	cfg.Executions.WorkingDir = DefaultExecWorkingDir
+	cfg.Executions.MaxFilesBytes = DefaultExecMaxFilesBytes
+	cfg.Executions.SoftTimeoutPercent = DefaultExecSoftTimeoutPercent
+	cfg.Executions.SoftTimeoutSignal = DefaultExecSoftTimeoutSignal
+	cfg.Executions.Wrapper.Path = "/app/agentbox-wrapper"
+	cfg.Executions.Wrapper.ConfigMapKey = "agentbox-wrapper"
+
+	// Execution pod security defaults (drop all capabilities, non-root, read-only root filesystem)
+	cfg.ExecSecurity.Enabled = true
+	cfg.ExecSecurity.DropCapabilities = []string{"ALL"}
+	cfg.ExecSecurity.RunAsNonRoot = true
+	cfg.ExecSecurity.RunAsUser = 65534
+	cfg.ExecSecurity.ReadOnlyRootFilesystem = true
+	cfg.ExecSecurity.ScratchPath = "/tmp"
+	cfg.ExecSecurity.SeccompProfile = "RuntimeDefault"
+
+	// Idle reaper defaults (no server-wide idle timeout)
+	cfg.Idle.TimeoutSeconds = 0
+	cfg.Idle.WarningSeconds = 3600
+	cfg.Idle.IntervalSeconds = 300
+
+	// Session recording defaults (recording is opt-in per environment)
+	cfg.Recording.Directory = "./recordings"
+	cfg.Recording.MaxBytes = 10 * 1024 * 1024 // 10 MiB
+	cfg.Recording.RedactPatterns = append([]string{}, DefaultRecordingRedactPatterns...)
+	cfg.Snapshots.Directory = "./snapshots"
+	cfg.Snapshots.MaxBytes = 1 << 30 // 1 GiB
+	cfg.Snapshots.DefaultIntervalSeconds = 3600
+	cfg.Snapshots.DefaultKeep = 3
+
+	// Storage defaults (no backend: recordings and snapshots keep their own directories)
+	cfg.Storage.Directory = "./storage"
+	cfg.Storage.PresignExpirySeconds = 900
+
+	// Guardrail defaults (no limits; bulk namespace deletions are paced)
+	cfg.Guardrails.NamespaceDeleteBatchSize = 10
+	cfg.Guardrails.NamespaceDeleteBatchIntervalMs = 1000
+
+	// Reservation defaults
+	cfg.Reservations.MaxEnvironmentsPerUser = 50
+	cfg.Reservations.LeadTimeSeconds = 300
+	cfg.Reservations.MaxDurationHours = 24
+	cfg.Reservations.MaxAdvanceDays = 30
+	cfg.Reservations.PlaceholderImage = "registry.k8s.io/pause:3.9"
+
+	// Network presets (the built-in ones; the config file may redefine or add presets)
+	cfg.Network.Presets = DefaultNetworkPresets()
+
+	// Tracing defaults (disabled)
+	cfg.Tracing.Endpoint = "localhost:4318"
+	cfg.Tracing.SampleRatio = 1
+	cfg.Tracing.ServiceName = "agentbox"
+
+	// Image defaults (every registry allowed)
+	cfg.Images.InspectCacheSeconds = 300
+
+	// Export defaults (no sink, so exports are off)
+	cfg.Exports.DailyAt = "02:00"
+	cfg.Exports.Datasets = append([]string{}, ExportDatasets...)
+	cfg.Exports.BatchSize = 1000
+	cfg.Exports.MaxBatchBytes = 8 * 1024 * 1024 // 8 MiB
+	cfg.Exports.MaxAttempts = 5
+	cfg.Exports.InitialBackoffMs = 60000
+	cfg.Exports.TimeoutSeconds = 60
+
+	// Preference defaults (failed environments are notified, failed executions are not)
+	cfg.Preferences.NotifyOnEnvironmentFailed = true
+	cfg.Preferences.Timezone = "UTC"
+	cfg.Notifications.Email.Port = 587
+	cfg.Notifications.Email.TLS = "starttls"
+	cfg.Notifications.Email.CooldownMinutes = 60
+	cfg.Notifications.Email.MaxPerHour = 30
+	cfg.Notifications.Email.ClusterUnhealthyMinutes = 5
+	cfg.Notifications.Email.DBErrorThreshold = 20
+	cfg.Notifications.Email.DBErrorWindowMinutes = 5
+
+	// Port forwarding defaults (unprivileged ports)
+	cfg.PortForward.AllowedPorts = []string{"1024-65535"}
+	cfg.PortForward.IdleTimeoutSeconds = 300
+	cfg.PortForward.MaxPerEnvironment = 8
+
+	// Build defaults (disabled: there is no registry to push to)
+	cfg.Builds.Namespace = "agentbox-builds"
+	cfg.Builds.BuilderImage = "gcr.io/kaniko-project/executor:v1.23.2-debug"
+	cfg.Builds.CPU = "2000m"
+	cfg.Builds.Memory = "4Gi"
+	cfg.Builds.Storage = "20Gi"
+	cfg.Builds.TimeoutSeconds = 1800
+
+	// Log shipping defaults (only environments with a log_shipping section ship their log)
+	cfg.LogShipping.BatchLines = 1000
+	cfg.LogShipping.BatchBytes = 1024 * 1024
+	cfg.LogShipping.FlushIntervalMs = 2000
+	cfg.LogShipping.MaxAttempts = 5
+	cfg.LogShipping.InitialBackoffMs = 1000
+	cfg.LogShipping.TimeoutSeconds = 30
 }
 
-// overrideFromEnv overrides config with environment variables
-func overrideFromEnv(cfg *Config) {
+// overrideFromEnv overrides config with environment variables. It returns the variables that
+// could not be parsed.
+func overrideFromEnv(cfg *Config) []string {
+	var problems []string
 	overrideServerFromEnv(&cfg.Server)
 	overrideKubernetesFromEnv(&cfg.Kubernetes)
-	overrideAuthFromEnv(&cfg.Auth)
+	problems = append(problems, overrideAuthFromEnv(&cfg.Auth)...)
 	overrideResourcesFromEnv(&cfg.Resources)
 	overrideTimeoutsFromEnv(&cfg.Timeouts)
 	overridePoolFromEnv(&cfg.Pool)
 	overrideReconciliationFromEnv(&cfg.Reconciliation)
+	overrideRetentionFromEnv(&cfg.Retention)
+	overrideCommandPolicyFromEnv(&cfg.CommandPolicy)
+	overrideExecutionsFromEnv(&cfg.Executions)
+	overrideExecSecurityFromEnv(&cfg.ExecSecurity)
+	overrideIdleFromEnv(&cfg.Idle)
+	overrideRecordingFromEnv(&cfg.Recording)
+	overrideSnapshotsFromEnv(&cfg.Snapshots)
+	overrideStorageFromEnv(&cfg.Storage)
+	overrideGuardrailsFromEnv(&cfg.Guardrails)
+	overrideReservationsFromEnv(&cfg.Reservations)
+	overrideTracingFromEnv(&cfg.Tracing)
+	overrideImagesFromEnv(&cfg.Images)
+	overrideExportsFromEnv(&cfg.Exports)
+	overridePreferencesFromEnv(&cfg.Preferences)
+	overrideNotificationsFromEnv(&cfg.Notifications)
+	overridePortForwardFromEnv(&cfg.PortForward)
+	overrideBuildsFromEnv(&cfg.Builds)
+	overrideLogShippingFromEnv(&cfg.LogShipping)
+	return problems
 }
 
 // overrideServerFromEnv overrides server config from environment variables
@@ -162,6 +1310,33 @@ func overrideServerFromEnv(cfg *ServerConfig) {
 	if v := os.Getenv("AGENTBOX_LOG_LEVEL"); v != "" {
 		cfg.LogLevel = v
 	}
+	if v := os.Getenv("AGENTBOX_PUBLIC_URL"); v != "" {
+		cfg.PublicURL = v
+	}
+	if v := os.Getenv("AGENTBOX_EXTERNAL_URL"); v != "" {
+		cfg.ExternalURL = v
+	}
+	if v := os.Getenv("AGENTBOX_WS_SCHEME"); v != "" {
+		cfg.WSScheme = v
+	}
+	if v := os.Getenv("AGENTBOX_DISABLE_COMPRESSION"); v != "" {
+		cfg.DisableCompression = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_TRUSTED_PROXIES"); v != "" {
+		cfg.TrustedProxies = strings.Split(v, ",")
+	}
+	for env, limit := range map[string]*int64{
+		"AGENTBOX_BODY_LIMIT_ENVIRONMENTS": &cfg.BodyLimits.Environments,
+		"AGENTBOX_BODY_LIMIT_IMPORT":       &cfg.BodyLimits.Import,
+		"AGENTBOX_BODY_LIMIT_EXEC":         &cfg.BodyLimits.Exec,
+		"AGENTBOX_BODY_LIMIT_DEFAULT":      &cfg.BodyLimits.Default,
+	} {
+		if v := os.Getenv(env); v != "" {
+			if val, err := strconv.ParseInt(v, 10, 64); err == nil {
+				*limit = val
+			}
+		}
+	}
 }
 
 // overrideKubernetesFromEnv overrides Kubernetes config from environment variables
@@ -175,16 +1350,139 @@ func overrideKubernetesFromEnv(cfg *KubernetesConfig) {
 	if v := os.Getenv("AGENTBOX_RUNTIME_CLASS"); v != "" {
 		cfg.RuntimeClass = v
 	}
+	if v := os.Getenv("AGENTBOX_DEFAULT_CLUSTER"); v != "" {
+		cfg.DefaultCluster = v
+	}
+	if v := os.Getenv("AGENTBOX_K8S_QPS"); v != "" {
+		if val, err := strconv.ParseFloat(v, 32); err == nil {
+			cfg.QPS = float32(val)
+		}
+	}
+	if v := os.Getenv("AGENTBOX_K8S_BURST"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.Burst = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_INSECURE_FAULT_INJECTION"); v != "" {
+		cfg.InsecureFaultInjection = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_K8S_RETRY_MAX_ATTEMPTS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.Retry.MaxAttempts = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_SERVICE_ACCOUNTS_ENABLED"); v != "" {
+		cfg.ServiceAccounts.Enabled = v == "true"
+	}
 }
 
-// overrideAuthFromEnv overrides auth config from environment variables
-func overrideAuthFromEnv(cfg *AuthConfig) {
+// overrideAuthFromEnv overrides auth config from environment variables. It returns the variables
+// that could not be parsed.
+func overrideAuthFromEnv(cfg *AuthConfig) []string {
+	var problems []string
 	if v := os.Getenv("AGENTBOX_AUTH_ENABLED"); v != "" {
 		cfg.Enabled = v == "true"
 	}
-	if v := os.Getenv("AGENTBOX_AUTH_SECRET"); v != "" {
+	// AGENTBOX_JWT_SECRET has always been the signing secret, so it wins when both are set
+	if v := os.Getenv("AGENTBOX_JWT_SECRET"); v != "" {
+		cfg.Secret = v
+	} else if v := os.Getenv("AGENTBOX_AUTH_SECRET"); v != "" {
 		cfg.Secret = v
 	}
+	if v := os.Getenv("AGENTBOX_JWT_KEYS"); v != "" {
+		// A JSON array of {"id", "secret", "retire_at"} objects
+		// A typo must not silently fall back to the other secrets or to no signing key at all
+		var keys []JWTKeyConfig
+		if err := json.Unmarshal([]byte(v), &keys); err != nil {
+			problems = append(problems, fmt.Sprintf(
+				`AGENTBOX_JWT_KEYS must be a JSON array of {"id", "secret", "retire_at"} objects: %v`, err))
+		} else {
+			cfg.JWTKeys = keys
+		}
+	}
+	if v := os.Getenv("AGENTBOX_INSECURE_DEV_MODE"); v != "" {
+		cfg.InsecureDevMode = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_API_KEY_ROTATION_GRACE_HOURS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.APIKeyRotationGraceHours = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_API_KEY_EXPIRY_WARNING_DAYS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val > 0 {
+			cfg.APIKeyExpiryWarningDays = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_ENV_TOKEN_MAX_TTL_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.EnvironmentTokens.MaxTTLSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_ENV_TOKEN_INJECT"); v != "" {
+		cfg.EnvironmentTokens.InjectIntoPods = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_PASSWORD_MIN_LENGTH"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.PasswordPolicy.MinLength = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_PASSWORD_REQUIRE_CLASSES"); v != "" {
+		// Comma-separated character classes: upper, lower, digit, symbol
+		cfg.PasswordPolicy.RequireUppercase, cfg.PasswordPolicy.RequireLowercase = false, false
+		cfg.PasswordPolicy.RequireDigit, cfg.PasswordPolicy.RequireSymbol = false, false
+		for _, class := range strings.Split(v, ",") {
+			switch strings.TrimSpace(class) {
+			case "upper":
+				cfg.PasswordPolicy.RequireUppercase = true
+			case "lower":
+				cfg.PasswordPolicy.RequireLowercase = true
+			case "digit":
+				cfg.PasswordPolicy.RequireDigit = true
+			case "symbol":
+				cfg.PasswordPolicy.RequireSymbol = true
+			}
+		}
+	}
+	if v := os.Getenv("AGENTBOX_PASSWORD_REJECT_COMMON"); v != "" {
+		cfg.PasswordPolicy.RejectCommon = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_LOGIN_LOCKOUT_ENABLED"); v != "" {
+		cfg.LoginLockout.Enabled = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_LOGIN_LOCKOUT_MAX_FAILURES"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.LoginLockout.MaxFailures = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_LOGIN_LOCKOUT_MAX_FAILURES_PER_IP"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.LoginLockout.MaxFailuresPerIP = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_LOGIN_LOCKOUT_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.LoginLockout.LockoutSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_DISABLE_PASSWORD_LOGIN"); v != "" {
+		cfg.DisablePasswordLogin = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_OIDC_ENABLED"); v != "" {
+		cfg.OIDC.Enabled = v == "true"
+	}
+	if v := os.Getenv("AGENTBOX_OIDC_ISSUER_URL"); v != "" {
+		cfg.OIDC.IssuerURL = v
+	}
+	if v := os.Getenv("AGENTBOX_OIDC_CLIENT_ID"); v != "" {
+		cfg.OIDC.ClientID = v
+	}
+	if v := os.Getenv("AGENTBOX_OIDC_CLIENT_SECRET"); v != "" {
+		cfg.OIDC.ClientSecret = v
+	}
+	if v := os.Getenv("AGENTBOX_OIDC_REDIRECT_URL"); v != "" {
+		cfg.OIDC.RedirectURL = v
+	}
+	return problems
 }
 
 // overrideResourcesFromEnv overrides resources config from environment variables
@@ -203,6 +1501,25 @@ func overrideResourcesFromEnv(cfg *ResourceConfig) {
 			cfg.MaxEnvironmentsPerUser = val
 		}
 	}
+	if v := os.Getenv("AGENTBOX_MAX_CPU"); v != "" {
+		cfg.MaxCPU = v
+	}
+	if v := os.Getenv("AGENTBOX_MAX_MEMORY"); v != "" {
+		cfg.MaxMemory = v
+	}
+	if v := os.Getenv("AGENTBOX_MAX_STORAGE"); v != "" {
+		cfg.MaxStorage = v
+	}
+	if v := os.Getenv("AGENTBOX_CAPACITY_CHECK"); v != "" {
+		if val, err := strconv.ParseBool(v); err == nil {
+			cfg.CapacityCheck = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_RELAXED_ENV_NAMES"); v != "" {
+		if val, err := strconv.ParseBool(v); err == nil {
+			cfg.RelaxedEnvNames = val
+		}
+	}
 }
 
 // overrideTimeoutsFromEnv overrides timeouts config from environment variables
@@ -222,6 +1539,16 @@ func overrideTimeoutsFromEnv(cfg *TimeoutConfig) {
 			cfg.StartupTimeout = val
 		}
 	}
+	if v := os.Getenv("AGENTBOX_NAMESPACE_TERMINATION_TIMEOUT"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.NamespaceTerminationTimeout = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_MAX_TERMINATION_GRACE_PERIOD"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.MaxTerminationGracePeriod = val
+		}
+	}
 }
 
 // overridePoolFromEnv overrides pool config from environment variables
@@ -253,36 +1580,1264 @@ func overrideReconciliationFromEnv(cfg *ReconciliationConfig) {
 		}
 	}
 	if v := os.Getenv("AGENTBOX_RECONCILIATION_MAX_RETRIES"); v != "" {
-		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+		if val, err := strconv.Atoi(v); err == nil {
 			cfg.MaxRetries = val
 		}
 	}
-}
-
-// validate checks if the configuration is valid
-func validate(cfg *Config) error {
-	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
-		return fmt.Errorf("invalid port: %d", cfg.Server.Port)
+	if v := os.Getenv("AGENTBOX_ORPHAN_GC_ENABLED"); v != "" {
+		if val, err := strconv.ParseBool(v); err == nil {
+			cfg.OrphanGC.Enabled = val
+		}
 	}
-
-	if cfg.Kubernetes.NamespacePrefix == "" {
-		return fmt.Errorf("namespace prefix cannot be empty")
+	if v := os.Getenv("AGENTBOX_ORPHAN_GC_DRY_RUN"); v != "" {
+		if val, err := strconv.ParseBool(v); err == nil {
+			cfg.OrphanGC.DryRun = val
+		}
 	}
-
-	if cfg.Auth.Enabled && cfg.Auth.Secret == "" {
-		return fmt.Errorf("auth secret is required when auth is enabled")
+	if v := os.Getenv("AGENTBOX_ORPHAN_GC_MIN_AGE_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.OrphanGC.MinAgeSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_CACHE_SYNC_INTERVAL_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.CacheSyncIntervalSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_POD_WATCH"); v != "" {
+		if val, err := strconv.ParseBool(v); err == nil {
+			cfg.PodWatch = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_STATUS_CACHE_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.StatusCacheSeconds = val
+		}
+	}
+}
+
+// overrideRetentionFromEnv overrides retention config from environment variables
+func overrideRetentionFromEnv(cfg *RetentionConfig) {
+	if v := os.Getenv("AGENTBOX_RETENTION_KEEP_LAST_PER_ENVIRONMENT"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.KeepLastPerEnvironment = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_RETENTION_MAX_AGE_DAYS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.MaxAgeDays = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_RETENTION_INTERVAL_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val > 0 {
+			cfg.IntervalSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_RETENTION_EVENTS_MAX_PER_ENVIRONMENT"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.Events.MaxPerEnvironment = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_RETENTION_EVENTS_MAX_AGE_DAYS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.Events.MaxAgeDays = val
+		}
+	}
+}
+
+// overrideCommandPolicyFromEnv overrides command policy config from environment variables
+func overrideCommandPolicyFromEnv(cfg *CommandPolicyConfig) {
+	if v := os.Getenv("AGENTBOX_COMMAND_ALLOWED_BINARIES"); v != "" {
+		cfg.AllowedBinaries = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AGENTBOX_COMMAND_MAX_ARG_LENGTH"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.MaxArgLength = val
+		}
+	}
+}
+
+// overrideExecutionsFromEnv overrides execution config from environment variables
+func overrideExecutionsFromEnv(cfg *ExecutionConfig) {
+	if v := os.Getenv("AGENTBOX_MAX_EXECUTION_OUTPUT_BYTES"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxOutputBytes = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_MAX_QUEUE_DEPTH"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.MaxQueueDepth = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_CALLBACK_ALLOWED_HOSTS"); v != "" {
+		cfg.Callbacks.AllowedHosts = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_CALLBACK_ALLOW_PRIVATE_NETWORKS"); v != "" {
+		cfg.Callbacks.AllowPrivateNetworks = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_WORKING_DIR"); v != "" {
+		cfg.WorkingDir = v
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_MAX_FILES_BYTES"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxFilesBytes = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_SOFT_TIMEOUT_PERCENT"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.SoftTimeoutPercent = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_SOFT_TIMEOUT_SIGNAL"); v != "" {
+		cfg.SoftTimeoutSignal = v
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_WRAPPER_ENABLED"); v != "" {
+		cfg.Wrapper.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_WRAPPER_IMAGE"); v != "" {
+		cfg.Wrapper.Image = v
+	}
+	if v := os.Getenv("AGENTBOX_EXEC_WRAPPER_CONFIG_MAP"); v != "" {
+		cfg.Wrapper.ConfigMap = v
+	}
+}
+
+// overrideIdleFromEnv overrides idle reaper config from environment variables
+func overrideIdleFromEnv(cfg *IdleConfig) {
+	if v := os.Getenv("AGENTBOX_IDLE_TIMEOUT_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.TimeoutSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_IDLE_WARNING_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.WarningSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_IDLE_WEBHOOK_URL"); v != "" {
+		cfg.WebhookURL = v
+	}
+}
+
+// overrideExecSecurityFromEnv overrides execution pod security config from environment variables
+func overrideExecSecurityFromEnv(cfg *ExecSecurityConfig) {
+	if v := os.Getenv("AGENTBOX_EXECUTION_SECURITY_ENABLED"); v != "" {
+		cfg.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_EXECUTION_SECURITY_SCRATCH_PATH"); v != "" {
+		cfg.ScratchPath = v
+	}
+}
+
+// overrideRecordingFromEnv overrides session recording config from environment variables
+func overrideRecordingFromEnv(cfg *RecordingConfig) {
+	if v := os.Getenv("AGENTBOX_RECORDING_DIR"); v != "" {
+		cfg.Directory = v
+	}
+	if v := os.Getenv("AGENTBOX_RECORDING_MAX_BYTES"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxBytes = val
+		}
+	}
+}
+
+// overrideSnapshotsFromEnv overrides workspace snapshot config from environment variables
+func overrideSnapshotsFromEnv(cfg *SnapshotConfig) {
+	if v := os.Getenv("AGENTBOX_SNAPSHOT_DIR"); v != "" {
+		cfg.Directory = v
+	}
+	if v := os.Getenv("AGENTBOX_SNAPSHOT_MAX_BYTES"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxBytes = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_SNAPSHOT_INTERVAL_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.DefaultIntervalSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_SNAPSHOT_KEEP"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.DefaultKeep = val
+		}
+	}
+}
+
+// overrideStorageFromEnv overrides artifact storage config from environment variables
+func overrideStorageFromEnv(cfg *StorageConfig) {
+	if v := os.Getenv("AGENTBOX_STORAGE_BACKEND"); v != "" {
+		cfg.Backend = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_DIR"); v != "" {
+		cfg.Directory = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_S3_ENDPOINT"); v != "" {
+		cfg.S3.Endpoint = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_S3_BUCKET"); v != "" {
+		cfg.S3.Bucket = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_S3_REGION"); v != "" {
+		cfg.S3.Region = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_S3_ACCESS_KEY_ID"); v != "" {
+		cfg.S3.AccessKeyID = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_S3_SECRET_ACCESS_KEY"); v != "" {
+		cfg.S3.SecretAccessKey = v
+	}
+	if v := os.Getenv("AGENTBOX_STORAGE_PRESIGN_EXPIRY_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.PresignExpirySeconds = val
+		}
+	}
+}
+
+// overrideReservationsFromEnv overrides reservation config from environment variables
+func overrideReservationsFromEnv(cfg *ReservationsConfig) {
+	if v := os.Getenv("AGENTBOX_RESERVATIONS_MAX_ENVIRONMENTS_PER_USER"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.MaxEnvironmentsPerUser = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_RESERVATIONS_PLACEHOLDER_IMAGE"); v != "" {
+		cfg.PlaceholderImage = v
+	}
+	if v := os.Getenv("AGENTBOX_RESERVATIONS_PLACEHOLDER_PRIORITY_CLASS"); v != "" {
+		cfg.PlaceholderPriorityClass = v
+	}
+}
+
+// overrideGuardrailsFromEnv overrides guardrail config from environment variables
+func overrideGuardrailsFromEnv(cfg *GuardrailsConfig) {
+	if v := os.Getenv("AGENTBOX_MAX_NAMESPACES"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.MaxNamespaces = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_MAX_ENVIRONMENTS_PER_HOUR"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.MaxEnvironmentsPerHour = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_NAMESPACE_DELETE_BATCH_SIZE"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.NamespaceDeleteBatchSize = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_NAMESPACE_DELETE_BATCH_INTERVAL_MS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.NamespaceDeleteBatchIntervalMs = val
+		}
+	}
+}
+
+// overrideTracingFromEnv overrides tracing config from environment variables
+func overrideTracingFromEnv(cfg *TracingConfig) {
+	if v := os.Getenv("AGENTBOX_TRACING_ENABLED"); v != "" {
+		cfg.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_TRACING_ENDPOINT"); v != "" {
+		cfg.Endpoint = v
+	}
+	if v := os.Getenv("AGENTBOX_TRACING_INSECURE"); v != "" {
+		cfg.Insecure = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_TRACING_SAMPLE_RATIO"); v != "" {
+		if val, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.SampleRatio = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_TRACING_SERVICE_NAME"); v != "" {
+		cfg.ServiceName = v
+	}
+}
+
+// overrideImagesFromEnv overrides image config from environment variables
+func overrideImagesFromEnv(cfg *ImagesConfig) {
+	if v := os.Getenv("AGENTBOX_IMAGE_ALLOWED_REGISTRIES"); v != "" {
+		cfg.AllowedRegistries = strings.Split(v, ",")
+	}
+	if v := os.Getenv("AGENTBOX_IMAGE_INSPECT_CACHE_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.InspectCacheSeconds = val
+		}
+	}
+}
+
+// overrideExportsFromEnv overrides export config from environment variables
+func overrideExportsFromEnv(cfg *ExportConfig) {
+	if v := os.Getenv("AGENTBOX_EXPORTS_ENABLED"); v != "" {
+		cfg.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_EXPORTS_SINK"); v != "" {
+		cfg.Sink = v
+	}
+	if v := os.Getenv("AGENTBOX_EXPORTS_S3_ACCESS_KEY_ID"); v != "" {
+		cfg.S3.AccessKeyID = v
+	}
+	if v := os.Getenv("AGENTBOX_EXPORTS_S3_SECRET_ACCESS_KEY"); v != "" {
+		cfg.S3.SecretAccessKey = v
+	}
+	if v := os.Getenv("AGENTBOX_EXPORTS_WEBHOOK_URL"); v != "" {
+		cfg.Webhook.URL = v
+	}
+	if v := os.Getenv("AGENTBOX_EXPORTS_WEBHOOK_SECRET"); v != "" {
+		cfg.Webhook.Secret = v
+	}
+}
+
+// overridePreferencesFromEnv overrides preference defaults from environment variables
+func overridePreferencesFromEnv(cfg *PreferencesConfig) {
+	if v := os.Getenv("AGENTBOX_PREFERENCES_DEFAULT_PROFILE"); v != "" {
+		cfg.DefaultProfile = v
+	}
+	if v := os.Getenv("AGENTBOX_PREFERENCES_NOTIFY_ON_ENVIRONMENT_FAILED"); v != "" {
+		cfg.NotifyOnEnvironmentFailed = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_PREFERENCES_NOTIFY_ON_EXECUTION_FAILED"); v != "" {
+		cfg.NotifyOnExecutionFailed = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_PREFERENCES_EMAIL_CRITICAL_ALERTS"); v != "" {
+		cfg.EmailCriticalAlerts = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_PREFERENCES_TIMEZONE"); v != "" {
+		cfg.Timezone = v
+	}
+}
+
+// overrideNotificationsFromEnv overrides notification config from environment variables
+func overrideNotificationsFromEnv(cfg *NotificationsConfig) {
+	if v := os.Getenv("AGENTBOX_NOTIFICATIONS_WEBHOOK_URL"); v != "" {
+		cfg.WebhookURL = v
+	}
+	if v := os.Getenv("AGENTBOX_EMAIL_NOTIFICATIONS_ENABLED"); v != "" {
+		cfg.Email.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_SMTP_HOST"); v != "" {
+		cfg.Email.Host = v
+	}
+	if v := os.Getenv("AGENTBOX_SMTP_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err == nil {
+			cfg.Email.Port = port
+		}
+	}
+	if v := os.Getenv("AGENTBOX_SMTP_USERNAME"); v != "" {
+		cfg.Email.Username = v
+	}
+	if v := os.Getenv("AGENTBOX_SMTP_PASSWORD"); v != "" {
+		cfg.Email.Password = v
+	}
+	if v := os.Getenv("AGENTBOX_SMTP_FROM"); v != "" {
+		cfg.Email.From = v
+	}
+	if v := os.Getenv("AGENTBOX_SMTP_TLS"); v != "" {
+		cfg.Email.TLS = v
+	}
+}
+
+// overridePortForwardFromEnv overrides port forwarding config from environment variables
+func overridePortForwardFromEnv(cfg *PortForwardConfig) {
+	if v, ok := os.LookupEnv("AGENTBOX_PORT_FORWARD_ALLOWED_PORTS"); ok {
+		// Set but empty disables port forwarding
+		cfg.AllowedPorts = nil
+		if v != "" {
+			cfg.AllowedPorts = strings.Split(v, ",")
+		}
+	}
+	if v := os.Getenv("AGENTBOX_PORT_FORWARD_IDLE_TIMEOUT_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil && val >= 0 {
+			cfg.IdleTimeoutSeconds = val
+		}
+	}
+	if v := os.Getenv("AGENTBOX_PORT_FORWARD_MAX_PER_ENVIRONMENT"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.MaxPerEnvironment = val
+		}
+	}
+}
+
+// overrideBuildsFromEnv overrides image build config from environment variables
+func overrideBuildsFromEnv(cfg *BuildsConfig) {
+	if v := os.Getenv("AGENTBOX_BUILDS_ENABLED"); v != "" {
+		cfg.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_BUILDS_NAMESPACE"); v != "" {
+		cfg.Namespace = v
+	}
+	if v := os.Getenv("AGENTBOX_BUILDS_REGISTRY"); v != "" {
+		cfg.Registry = v
+	}
+	if v := os.Getenv("AGENTBOX_BUILDS_PUSH_SECRET"); v != "" {
+		cfg.PushSecret = v
+	}
+	if v := os.Getenv("AGENTBOX_BUILDS_TIMEOUT_SECONDS"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			cfg.TimeoutSeconds = val
+		}
+	}
+}
+
+// overrideLogShippingFromEnv overrides log shipping config from environment variables
+func overrideLogShippingFromEnv(cfg *LogShippingConfig) {
+	if v := os.Getenv("AGENTBOX_LOG_SHIPPING_ENABLED"); v != "" {
+		cfg.Enabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("AGENTBOX_LOG_SHIPPING_DEFAULT_SINK"); v != "" {
+		cfg.DefaultSink = v
+	}
+	if v := os.Getenv("AGENTBOX_LOG_SHIPPING_DEFAULT_CREDENTIALS"); v != "" {
+		cfg.DefaultCredentials = v
+	}
+}
+
+// validate checks the configuration and returns every problem found
+func validate(cfg *Config) []error {
+	var problems []error
+
+	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
+		problems = append(problems, fmt.Errorf("invalid port: %d", cfg.Server.Port))
+	}
+	if cfg.Server.Host == "" {
+		problems = append(problems, fmt.Errorf("server host is required (0.0.0.0 listens on every interface)"))
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(cfg.Server.LogLevel)); err != nil {
+		problems = append(problems, fmt.Errorf("server log_level must be debug, info, warn or error, got %q", cfg.Server.LogLevel))
+	}
+
+	if cfg.Server.PublicURL != "" {
+		u, err := url.Parse(cfg.Server.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid public_url %q: must be an absolute http(s) URL", cfg.Server.PublicURL))
+		}
+	}
+	if cfg.Server.ExternalURL != "" {
+		u, err := url.Parse(cfg.Server.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			problems = append(problems, fmt.Errorf("invalid external_url %q: must be an absolute http(s) URL without query", cfg.Server.ExternalURL))
+		}
+	}
+	if ws := cfg.Server.WSScheme; ws != "" && ws != "ws" && ws != "wss" {
+		problems = append(problems, fmt.Errorf("invalid ws_scheme %q: must be ws or wss", ws))
+	}
+
+	for _, proxy := range cfg.Server.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if _, err := netip.ParsePrefix(proxy); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(proxy); err != nil {
+			problems = append(problems, fmt.Errorf("invalid server trusted_proxies entry %q: must be a CIDR or an IP address", proxy))
+		}
+	}
+
+	limits := cfg.Server.BodyLimits
+	for _, l := range []struct {
+		name  string
+		value int64
+	}{
+		{"environments", limits.Environments},
+		{"import", limits.Import},
+		{"exec", limits.Exec},
+		{"default", limits.Default},
+	} {
+		if l.value < minBodyLimit {
+			problems = append(problems, fmt.Errorf("server body_limits.%s must be at least %d bytes, got %d", l.name, minBodyLimit, l.value))
+		}
+	}
+
+	if err := validateNamespacePrefix(cfg.Kubernetes.NamespacePrefix); err != nil {
+		problems = append(problems, err)
 	}
 
+	if err := validateClusters(&cfg.Kubernetes); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Kubernetes.QPS <= 0 || cfg.Kubernetes.Burst <= 0 {
+		problems = append(problems, fmt.Errorf("kubernetes qps and burst must be positive, got %v and %d", cfg.Kubernetes.QPS, cfg.Kubernetes.Burst))
+	}
+	for _, name := range cfg.Kubernetes.PriorityClasses.Allowed {
+		if name == "" {
+			problems = append(problems, fmt.Errorf("kubernetes priority_classes allowed must not contain empty names"))
+			break
+		}
+	}
+	for i, allowed := range cfg.Kubernetes.ServiceAccounts.AllowedAnnotations {
+		if allowed.Key == "" || allowed.ValuePattern == "" {
+			problems = append(problems, fmt.Errorf("kubernetes service_accounts allowed_annotations[%d] needs a key and a value_pattern", i))
+			continue
+		}
+		if _, err := regexp.Compile(allowed.ValuePattern); err != nil {
+			problems = append(problems, fmt.Errorf("kubernetes service_accounts allowed_annotations[%d] value_pattern is invalid: %w", i, err))
+		}
+	}
+	if cfg.Kubernetes.Retry.MaxAttempts < 1 {
+		problems = append(problems, fmt.Errorf("kubernetes retry max_attempts must be at least 1, got %d", cfg.Kubernetes.Retry.MaxAttempts))
+	}
+	if cfg.Kubernetes.Retry.InitialBackoffMs < 0 || cfg.Kubernetes.Retry.MaxBackoffMs < cfg.Kubernetes.Retry.InitialBackoffMs {
+		problems = append(problems, fmt.Errorf("kubernetes retry backoff must satisfy 0 <= initial_backoff_ms <= max_backoff_ms"))
+	}
+
+	if err := validateJWTKeys(&cfg.Auth); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Auth.APIKeyRotationGraceHours < 0 {
+		problems = append(problems, fmt.Errorf("auth api_key_rotation_grace_hours must be >= 0, got %d", cfg.Auth.APIKeyRotationGraceHours))
+	}
+	if cfg.Auth.EnvironmentTokens.MaxTTLSeconds < 60 {
+		problems = append(problems, fmt.Errorf("auth environment_tokens.max_ttl_seconds must be at least 60, got %d", cfg.Auth.EnvironmentTokens.MaxTTLSeconds))
+	}
+	if cfg.Auth.APIKeyExpiryWarningDays < 1 {
+		problems = append(problems, fmt.Errorf("auth api_key_expiry_warning_days must be at least 1, got %d", cfg.Auth.APIKeyExpiryWarningDays))
+	}
+	if err := validateLoginSecurity(&cfg.Auth); err != nil {
+		problems = append(problems, err)
+	}
+
+	if err := validateOIDC(&cfg.Auth); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Resources.MaxCPU == "" || cfg.Resources.MaxMemory == "" || cfg.Resources.MaxStorage == "" {
+		problems = append(problems, fmt.Errorf("resources max_cpu, max_memory and max_storage cannot be empty"))
+	}
+	if cfg.Resources.DefaultCPULimit == "" || cfg.Resources.DefaultMemoryLimit == "" || cfg.Resources.DefaultStorageLimit == "" {
+		problems = append(problems, fmt.Errorf("resources default_cpu_limit, default_memory_limit and default_storage_limit cannot be empty"))
+	}
+	if cfg.Resources.MaxEnvironmentsPerUser < 0 {
+		problems = append(problems, fmt.Errorf("resources max_environments_per_user must be >= 0, got %d", cfg.Resources.MaxEnvironmentsPerUser))
+	}
+
+	for _, t := range []struct {
+		name  string
+		value int
+	}{
+		{"default_timeout", cfg.Timeouts.DefaultTimeout},
+		{"max_timeout", cfg.Timeouts.MaxTimeout},
+		{"startup_timeout", cfg.Timeouts.StartupTimeout},
+	} {
+		if t.value < 1 {
+			problems = append(problems, fmt.Errorf("timeouts %s must be at least 1 second, got %d", t.name, t.value))
+		}
+	}
+	if cfg.Timeouts.NamespaceTerminationTimeout < 0 {
+		problems = append(problems, fmt.Errorf("timeouts namespace_termination_timeout must be >= 0, got %d", cfg.Timeouts.NamespaceTerminationTimeout))
+	}
+	if cfg.Timeouts.MaxTerminationGracePeriod < 0 {
+		problems = append(problems, fmt.Errorf("timeouts max_termination_grace_period must be >= 0, got %d", cfg.Timeouts.MaxTerminationGracePeriod))
+	}
 	if cfg.Timeouts.MaxTimeout < cfg.Timeouts.DefaultTimeout {
-		return fmt.Errorf("max timeout cannot be less than default timeout")
+		problems = append(problems, fmt.Errorf("max timeout cannot be less than default timeout"))
+	}
+
+	if cfg.Pool.Enabled {
+		if cfg.Pool.Size < 1 {
+			problems = append(problems, fmt.Errorf("pool size must be at least 1 when the pool is enabled, got %d", cfg.Pool.Size))
+		}
+		if cfg.Pool.DefaultImage == "" || cfg.Pool.DefaultCPU == "" || cfg.Pool.DefaultMemory == "" {
+			problems = append(problems, fmt.Errorf("pool default_image, default_cpu and default_memory are required when the pool is enabled"))
+		}
 	}
 
 	if cfg.Reconciliation.IntervalSeconds < 10 {
-		return fmt.Errorf("reconciliation interval_seconds must be at least 10, got %d", cfg.Reconciliation.IntervalSeconds)
+		problems = append(problems, fmt.Errorf("reconciliation interval_seconds must be at least 10, got %d", cfg.Reconciliation.IntervalSeconds))
+	}
+	if cfg.Reconciliation.OrphanGC.MinAgeSeconds < 0 {
+		problems = append(problems, fmt.Errorf("reconciliation orphan_gc min_age_seconds must be >= 0, got %d", cfg.Reconciliation.OrphanGC.MinAgeSeconds))
+	}
+	if cfg.Reconciliation.CacheSyncIntervalSeconds < 0 {
+		problems = append(problems, fmt.Errorf("reconciliation cache_sync_interval_seconds must be >= 0, got %d", cfg.Reconciliation.CacheSyncIntervalSeconds))
+	}
+	if cfg.Reconciliation.StatusCacheSeconds < 0 {
+		problems = append(problems, fmt.Errorf("reconciliation status_cache_seconds must be >= 0, got %d", cfg.Reconciliation.StatusCacheSeconds))
+	}
+
+	if cfg.Retention.KeepLastPerEnvironment < 0 {
+		problems = append(problems, fmt.Errorf("retention keep_last_per_environment must be >= 0, got %d", cfg.Retention.KeepLastPerEnvironment))
+	}
+	if cfg.Retention.MaxAgeDays < 0 {
+		problems = append(problems, fmt.Errorf("retention max_age_days must be >= 0, got %d", cfg.Retention.MaxAgeDays))
+	}
+	if cfg.Retention.Events.MaxPerEnvironment < 0 {
+		problems = append(problems, fmt.Errorf("retention events.max_per_environment must be >= 0, got %d", cfg.Retention.Events.MaxPerEnvironment))
+	}
+	if cfg.Retention.Events.MaxAgeDays < 0 {
+		problems = append(problems, fmt.Errorf("retention events.max_age_days must be >= 0, got %d", cfg.Retention.Events.MaxAgeDays))
+	}
+	if cfg.Retention.IntervalSeconds < 60 {
+		problems = append(problems, fmt.Errorf("retention interval_seconds must be at least 60, got %d", cfg.Retention.IntervalSeconds))
+	}
+
+	for i, p := range cfg.CommandPolicy.DenyPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			problems = append(problems, fmt.Errorf("command_policy deny_patterns[%d] is not a valid regular expression: %w", i, err))
+		}
+	}
+	if cfg.CommandPolicy.MaxArgLength < 0 {
+		problems = append(problems, fmt.Errorf("command_policy max_arg_length must be >= 0, got %d", cfg.CommandPolicy.MaxArgLength))
+	}
+
+	if cfg.Executions.MaxOutputBytes < minExecutionOutputBytes {
+		problems = append(problems, fmt.Errorf("executions max_output_bytes must be at least %d, got %d", minExecutionOutputBytes, cfg.Executions.MaxOutputBytes))
+	}
+	if cfg.Executions.MaxQueueDepth < 1 {
+		problems = append(problems, fmt.Errorf("executions max_queue_depth must be at least 1, got %d", cfg.Executions.MaxQueueDepth))
+	}
+	if err := validateExecutionCallbacks(&cfg.Executions.Callbacks); err != nil {
+		problems = append(problems, err)
+	}
+	if wd := cfg.Executions.WorkingDir; !path.IsAbs(wd) || path.Clean(wd) != wd || wd == "/" {
+		problems = append(problems, fmt.Errorf("executions working_dir must be a clean absolute path other than /, got %q", wd))
+	}
+	if cfg.Executions.MaxFilesBytes < 0 {
+		problems = append(problems, fmt.Errorf("executions max_files_bytes must be >= 0, got %d", cfg.Executions.MaxFilesBytes))
+	}
+	if p := cfg.Executions.SoftTimeoutPercent; p < 0 || p > 99 {
+		problems = append(problems, fmt.Errorf("executions soft_timeout_percent must be between 0 and 99, got %d", p))
+	}
+	if !slices.Contains(softTimeoutSignals, cfg.Executions.SoftTimeoutSignal) {
+		problems = append(problems, fmt.Errorf("executions soft_timeout_signal must be one of %s, got %q",
+			strings.Join(softTimeoutSignals, ", "), cfg.Executions.SoftTimeoutSignal))
+	}
+	if w := cfg.Executions.Wrapper; w.Enabled {
+		switch {
+		case (w.Image == "") == (w.ConfigMap == ""):
+			problems = append(problems, fmt.Errorf("executions wrapper needs exactly one of image and config_map"))
+		case w.Image != "" && !path.IsAbs(w.Path):
+			problems = append(problems, fmt.Errorf("executions wrapper path must be absolute, got %q", w.Path))
+		case w.ConfigMap != "" && w.ConfigMapKey == "":
+			problems = append(problems, fmt.Errorf("executions wrapper config_map_key is required with config_map"))
+		}
+	}
+
+	if cfg.Idle.TimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("idle timeout_seconds must be >= 0, got %d", cfg.Idle.TimeoutSeconds))
+	}
+	if cfg.Idle.WarningSeconds < 0 {
+		problems = append(problems, fmt.Errorf("idle warning_seconds must be >= 0, got %d", cfg.Idle.WarningSeconds))
+	}
+	if cfg.Idle.IntervalSeconds < 10 {
+		problems = append(problems, fmt.Errorf("idle interval_seconds must be at least 10, got %d", cfg.Idle.IntervalSeconds))
+	}
+	if cfg.Idle.WebhookURL != "" {
+		u, err := url.Parse(cfg.Idle.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid idle webhook_url %q: must be an absolute http(s) URL", cfg.Idle.WebhookURL))
+		}
+	}
+
+	problems = append(problems, validateExecSecurity(&cfg.ExecSecurity)...)
+
+	if cfg.Recording.Directory == "" {
+		problems = append(problems, fmt.Errorf("recording directory must not be empty"))
+	}
+	if cfg.Recording.MaxBytes < minRecordingBytes {
+		problems = append(problems, fmt.Errorf("recording max_bytes must be at least %d, got %d", minRecordingBytes, cfg.Recording.MaxBytes))
+	}
+	for i, p := range cfg.Recording.RedactPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			problems = append(problems, fmt.Errorf("recording redact_patterns[%d] is not a valid regular expression: %w", i, err))
+		}
+	}
+
+	if cfg.Snapshots.Directory == "" {
+		problems = append(problems, fmt.Errorf("snapshots directory must not be empty"))
+	}
+	if cfg.Snapshots.MaxBytes < minRecordingBytes {
+		problems = append(problems, fmt.Errorf("snapshots max_bytes must be at least %d, got %d", minRecordingBytes, cfg.Snapshots.MaxBytes))
+	}
+	if cfg.Snapshots.DefaultIntervalSeconds < minSnapshotIntervalSeconds {
+		problems = append(problems, fmt.Errorf("snapshots default_interval_seconds must be at least %d, got %d",
+			minSnapshotIntervalSeconds, cfg.Snapshots.DefaultIntervalSeconds))
+	}
+	if cfg.Snapshots.DefaultKeep < 1 {
+		problems = append(problems, fmt.Errorf("snapshots default_keep must be at least 1, got %d", cfg.Snapshots.DefaultKeep))
+	}
+
+	if cfg.Guardrails.MaxNamespaces < 0 {
+		problems = append(problems, fmt.Errorf("guardrails max_namespaces must not be negative, got %d", cfg.Guardrails.MaxNamespaces))
+	}
+	if cfg.Guardrails.MaxEnvironmentsPerHour < 0 {
+		problems = append(problems, fmt.Errorf("guardrails max_environments_per_hour must not be negative, got %d",
+			cfg.Guardrails.MaxEnvironmentsPerHour))
+	}
+	if cfg.Guardrails.NamespaceDeleteBatchSize < 1 {
+		problems = append(problems, fmt.Errorf("guardrails namespace_delete_batch_size must be at least 1, got %d",
+			cfg.Guardrails.NamespaceDeleteBatchSize))
+	}
+	if cfg.Guardrails.NamespaceDeleteBatchIntervalMs < 0 {
+		problems = append(problems, fmt.Errorf("guardrails namespace_delete_batch_interval_ms must not be negative, got %d",
+			cfg.Guardrails.NamespaceDeleteBatchIntervalMs))
+	}
+
+	if cfg.Reservations.MaxEnvironmentsPerUser < 0 {
+		problems = append(problems, fmt.Errorf("reservations max_environments_per_user must not be negative, got %d",
+			cfg.Reservations.MaxEnvironmentsPerUser))
+	}
+	if cfg.Reservations.LeadTimeSeconds < 0 {
+		problems = append(problems, fmt.Errorf("reservations lead_time_seconds must not be negative, got %d", cfg.Reservations.LeadTimeSeconds))
+	}
+	if cfg.Reservations.MaxDurationHours < 1 {
+		problems = append(problems, fmt.Errorf("reservations max_duration_hours must be at least 1, got %d", cfg.Reservations.MaxDurationHours))
+	}
+	if cfg.Reservations.MaxAdvanceDays < 1 {
+		problems = append(problems, fmt.Errorf("reservations max_advance_days must be at least 1, got %d", cfg.Reservations.MaxAdvanceDays))
+	}
+	if cfg.Reservations.PlaceholderImage == "" {
+		problems = append(problems, fmt.Errorf("reservations placeholder_image must not be empty"))
+	}
+
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		problems = append(problems, fmt.Errorf("tracing sample_ratio must be between 0 and 1, got %g", cfg.Tracing.SampleRatio))
+	}
+	if cfg.Tracing.Enabled {
+		if cfg.Tracing.Endpoint == "" || strings.Contains(cfg.Tracing.Endpoint, "://") {
+			problems = append(problems, fmt.Errorf("invalid tracing endpoint %q: must be host:port", cfg.Tracing.Endpoint))
+		}
+		if cfg.Tracing.ServiceName == "" {
+			problems = append(problems, fmt.Errorf("tracing service_name must not be empty"))
+		}
+	}
+
+	if err := validateImages(&cfg.Images); err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, validateNetworkPresets(&cfg.Network)...)
+
+	problems = append(problems, validateStorage(&cfg.Storage)...)
+	problems = append(problems, validateExports(&cfg.Exports)...)
+	if cfg.Exports.Sink == ExportSinkStorage && cfg.Storage.Backend == "" {
+		problems = append(problems, fmt.Errorf("exports storage sink requires a storage backend"))
+	}
+	problems = append(problems, validateProfiles(&cfg.Resources, &cfg.Preferences)...)
+
+	if _, err := LoadTimezone(cfg.Preferences.Timezone); err != nil {
+		problems = append(problems, fmt.Errorf("invalid preferences timezone: %w", err))
+	}
+	if cfg.Notifications.WebhookURL != "" {
+		u, err := url.Parse(cfg.Notifications.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid notifications webhook_url %q: must be an absolute http(s) URL", cfg.Notifications.WebhookURL))
+		}
+	}
+	problems = append(problems, validateEmail(&cfg.Notifications.Email)...)
+
+	for _, r := range cfg.PortForward.AllowedPorts {
+		if _, _, err := ParsePortRange(r); err != nil {
+			problems = append(problems, fmt.Errorf("port_forward allowed_ports: %w", err))
+		}
+	}
+	if cfg.PortForward.IdleTimeoutSeconds < 0 {
+		problems = append(problems, fmt.Errorf("port_forward idle_timeout_seconds must be >= 0, got %d", cfg.PortForward.IdleTimeoutSeconds))
+	}
+	if cfg.PortForward.MaxPerEnvironment < 1 {
+		problems = append(problems, fmt.Errorf("port_forward max_per_environment must be at least 1, got %d", cfg.PortForward.MaxPerEnvironment))
+	}
+	problems = append(problems, validateBuilds(&cfg.Builds)...)
+	problems = append(problems, validateLogShipping(&cfg.LogShipping)...)
+
+	return problems
+}
+
+// validateBuilds checks the build settings; they are only required when builds are enabled
+func validateBuilds(cfg *BuildsConfig) []error {
+	if !cfg.Enabled {
+		return nil
+	}
+	var problems []error
+	if cfg.Registry == "" {
+		problems = append(problems, fmt.Errorf("builds registry is required when builds are enabled"))
+	} else if strings.Contains(cfg.Registry, "://") || strings.ContainsAny(cfg.Registry, "@ ") {
+		problems = append(problems, fmt.Errorf("builds registry must be a repository such as registry.internal:5000/agentbox/builds, got %q", cfg.Registry))
+	}
+	for _, msg := range validation.IsDNS1123Label(cfg.Namespace) {
+		problems = append(problems, fmt.Errorf("builds namespace %q: %s", cfg.Namespace, msg))
+	}
+	if cfg.BuilderImage == "" {
+		problems = append(problems, fmt.Errorf("builds builder_image is required when builds are enabled"))
+	}
+	for _, q := range []struct{ name, value string }{{"cpu", cfg.CPU}, {"memory", cfg.Memory}, {"storage", cfg.Storage}} {
+		if _, err := resource.ParseQuantity(q.value); err != nil {
+			problems = append(problems, fmt.Errorf("builds %s must be a Kubernetes quantity, got %q", q.name, q.value))
+		}
+	}
+	if cfg.TimeoutSeconds < 1 {
+		problems = append(problems, fmt.Errorf("builds timeout_seconds must be at least 1, got %d", cfg.TimeoutSeconds))
+	}
+	return problems
+}
+
+// validateLogShipping checks the log shipping credentials and, when every environment ships its
+// log, the default sink
+func validateLogShipping(cfg *LogShippingConfig) []error {
+	var problems []error
+	names := make([]string, 0, len(cfg.Credentials))
+	for name := range cfg.Credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		creds := cfg.Credentials[name]
+		if creds.URL != "" {
+			if u, err := url.Parse(creds.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Errorf("log_shipping credentials %q: url must be an http(s) URL, got %q", name, creds.URL))
+			}
+		}
+		if creds.URL == "" && creds.S3.Bucket == "" {
+			problems = append(problems, fmt.Errorf("log_shipping credentials %q: a url or an s3 bucket is required", name))
+		}
+	}
+	if cfg.Enabled {
+		creds, ok := cfg.Credentials[cfg.DefaultCredentials]
+		if !ok {
+			problems = append(problems, fmt.Errorf("log_shipping default_credentials %q is not one of the credentials", cfg.DefaultCredentials))
+		} else if err := creds.CheckSink(cfg.DefaultSink); err != nil {
+			problems = append(problems, fmt.Errorf("log_shipping default_sink: %w", err))
+		}
 	}
-	if cfg.Reconciliation.MaxRetries < 0 {
-		return fmt.Errorf("reconciliation max_retries must be >= 0, got %d", cfg.Reconciliation.MaxRetries)
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"batch_lines", cfg.BatchLines},
+		{"batch_bytes", cfg.BatchBytes},
+		{"flush_interval_ms", cfg.FlushIntervalMs},
+		{"max_attempts", cfg.MaxAttempts},
+		{"initial_backoff_ms", cfg.InitialBackoffMs},
+		{"timeout_seconds", cfg.TimeoutSeconds},
+	} {
+		if v.value < 1 {
+			problems = append(problems, fmt.Errorf("log_shipping %s must be at least 1, got %d", v.name, v.value))
+		}
 	}
+	return problems
+}
 
+// validateProfiles checks the resource profiles and that the default profile is one of them
+func validateProfiles(resources *ResourceConfig, prefs *PreferencesConfig) []error {
+	var problems []error
+	names := make([]string, 0, len(resources.Profiles))
+	for name := range resources.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := resources.Profiles[name]
+		if name == "" {
+			problems = append(problems, fmt.Errorf("resources profiles cannot have an empty name"))
+		}
+		if p.CPU == "" || p.Memory == "" || p.Storage == "" {
+			problems = append(problems, fmt.Errorf("resources profile %q must set cpu, memory and storage", name))
+		}
+	}
+	if prefs.DefaultProfile != "" {
+		if _, ok := resources.Profiles[prefs.DefaultProfile]; !ok {
+			problems = append(problems, fmt.Errorf("preferences default_profile %q is not one of the resources profiles", prefs.DefaultProfile))
+		}
+	}
+	return problems
+}
+
+// LoadTimezone returns the location of an IANA time zone name such as "Europe/Berlin" or "UTC".
+// "Local" and "" are rejected: the server's own zone means nothing to users.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("%q is not an IANA time zone name", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// capabilityName matches Linux capability names as written in Kubernetes (without CAP_)
+var capabilityName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// validateExecSecurity checks the execution pod security defaults
+func validateExecSecurity(cfg *ExecSecurityConfig) []error {
+	var problems []error
+	for _, c := range cfg.DropCapabilities {
+		if !capabilityName.MatchString(c) {
+			problems = append(problems, fmt.Errorf("execution_security drop_capabilities: invalid capability %q (expected e.g. ALL or NET_RAW)", c))
+		}
+	}
+	if cfg.RunAsNonRoot && cfg.RunAsUser < 1 {
+		problems = append(problems, fmt.Errorf("execution_security run_as_user must be a non-root UID with run_as_non_root, got %d", cfg.RunAsUser))
+	}
+	if sp := cfg.ScratchPath; !path.IsAbs(sp) || path.Clean(sp) != sp || sp == "/" {
+		problems = append(problems, fmt.Errorf("execution_security scratch_path must be a clean absolute path other than /, got %q", sp))
+	}
+	switch cfg.SeccompProfile {
+	case "", "RuntimeDefault", "Unconfined":
+	default:
+		problems = append(problems, fmt.Errorf("execution_security seccomp_profile must be RuntimeDefault or Unconfined, got %q", cfg.SeccompProfile))
+	}
+	return problems
+}
+
+// validateEmail checks the SMTP settings of critical event emails and their limits
+func validateEmail(cfg *EmailConfig) []error {
+	var problems []error
+	switch cfg.TLS {
+	case "starttls", "tls", "none":
+	default:
+		problems = append(problems, fmt.Errorf("notifications email tls must be starttls, tls or none, got %q", cfg.TLS))
+	}
+	if cfg.CooldownMinutes < 0 {
+		problems = append(problems, fmt.Errorf("notifications email cooldown_minutes must be >= 0, got %d", cfg.CooldownMinutes))
+	}
+	if cfg.MaxPerHour < 1 {
+		problems = append(problems, fmt.Errorf("notifications email max_per_hour must be at least 1, got %d", cfg.MaxPerHour))
+	}
+	if cfg.ClusterUnhealthyMinutes < 1 {
+		problems = append(problems, fmt.Errorf("notifications email cluster_unhealthy_minutes must be at least 1, got %d", cfg.ClusterUnhealthyMinutes))
+	}
+	if cfg.DBErrorThreshold < 1 || cfg.DBErrorWindowMinutes < 1 {
+		problems = append(problems, fmt.Errorf("notifications email db_error_threshold and db_error_window_minutes must be at least 1"))
+	}
+	if !cfg.Enabled {
+		return problems
+	}
+	if cfg.Host == "" {
+		problems = append(problems, fmt.Errorf("notifications email host is required when email notifications are enabled"))
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Errorf("notifications email port must be between 1 and 65535, got %d", cfg.Port))
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		problems = append(problems, fmt.Errorf("invalid notifications email from %q: %w", cfg.From, err))
+	}
+	if cfg.Password != "" && cfg.Username == "" {
+		problems = append(problems, fmt.Errorf("notifications email password is set without a username"))
+	}
+	return problems
+}
+
+// validateExports checks the export schedule, datasets, limits and sink
+func validateExports(cfg *ExportConfig) []error {
+	var problems []error
+	if _, err := time.Parse("15:04", cfg.DailyAt); err != nil {
+		problems = append(problems, fmt.Errorf("exports daily_at must be a UTC time of day as HH:MM, got %q", cfg.DailyAt))
+	}
+	if len(cfg.Datasets) == 0 {
+		problems = append(problems, fmt.Errorf("exports datasets must not be empty"))
+	}
+	for _, d := range cfg.Datasets {
+		if !ValidExportDataset(d) {
+			problems = append(problems, fmt.Errorf("exports datasets: unknown dataset %q (expected one of %s)", d, strings.Join(ExportDatasets, ", ")))
+		}
+	}
+	if cfg.BatchSize < 1 {
+		problems = append(problems, fmt.Errorf("exports batch_size must be at least 1, got %d", cfg.BatchSize))
+	}
+	if cfg.MaxBatchBytes < minExportBatchBytes {
+		problems = append(problems, fmt.Errorf("exports max_batch_bytes must be at least %d, got %d", minExportBatchBytes, cfg.MaxBatchBytes))
+	}
+	if cfg.MaxAttempts < 1 {
+		problems = append(problems, fmt.Errorf("exports max_attempts must be at least 1, got %d", cfg.MaxAttempts))
+	}
+	if cfg.InitialBackoffMs < 0 {
+		problems = append(problems, fmt.Errorf("exports initial_backoff_ms must be >= 0, got %d", cfg.InitialBackoffMs))
+	}
+	if cfg.TimeoutSeconds < 1 {
+		problems = append(problems, fmt.Errorf("exports timeout_seconds must be at least 1, got %d", cfg.TimeoutSeconds))
+	}
+
+	switch cfg.Sink {
+	case "":
+		if cfg.Enabled {
+			problems = append(problems, fmt.Errorf("exports sink is required when nightly exports are enabled"))
+		}
+	case ExportSinkS3:
+		problems = append(problems, validateS3("exports", "the s3 sink", &cfg.S3)...)
+	case ExportSinkStorage:
+		// Checked against the storage settings by validate
+	case ExportSinkWebhook:
+		u, err := url.Parse(cfg.Webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid exports webhook url %q: must be an absolute http(s) URL", cfg.Webhook.URL))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("exports sink must be s3, webhook or storage, got %q", cfg.Sink))
+	}
+	return problems
+}
+
+// validateS3 checks the bucket settings of a section (e.g. "exports") using them for what
+func validateS3(section, what string, cfg *ExportS3Config) []error {
+	var problems []error
+	if cfg.Bucket == "" || cfg.Region == "" {
+		problems = append(problems, fmt.Errorf("%s s3 bucket and region are required with %s", section, what))
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		problems = append(problems, fmt.Errorf("%s s3 access_key_id and secret_access_key are required with %s", section, what))
+	}
+	if cfg.Endpoint != "" {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problems = append(problems, fmt.Errorf("invalid %s s3 endpoint %q: must be an absolute http(s) URL without path", section, cfg.Endpoint))
+		}
+	}
+	return problems
+}
+
+// maxPresignExpirySeconds is the longest validity of a presigned URL (7 days)
+const maxPresignExpirySeconds = 7 * 24 * 3600
+
+// validateStorage checks the artifact storage settings
+func validateStorage(cfg *StorageConfig) []error {
+	var problems []error
+	switch cfg.Backend {
+	case "":
+	case StorageBackendLocal:
+		if cfg.Directory == "" {
+			problems = append(problems, fmt.Errorf("storage directory is required with the local backend"))
+		}
+	case StorageBackendS3:
+		problems = append(problems, validateS3("storage", "the s3 backend", &cfg.S3)...)
+	default:
+		problems = append(problems, fmt.Errorf("storage backend must be local or s3, got %q", cfg.Backend))
+	}
+	if cfg.PresignExpirySeconds < 1 || cfg.PresignExpirySeconds > maxPresignExpirySeconds {
+		problems = append(problems, fmt.Errorf("storage presign_expiry_seconds must be between 1 and %d, got %d",
+			maxPresignExpirySeconds, cfg.PresignExpirySeconds))
+	}
+	return problems
+}
+
+// minExportBatchBytes is the smallest accepted exports.max_batch_bytes
+const minExportBatchBytes = 1024
+
+// ValidExportDataset reports whether name is an export dataset
+func ValidExportDataset(name string) bool {
+	for _, d := range ExportDatasets {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateImages checks the image allowlist and the registry credentials
+func validateImages(cfg *ImagesConfig) error {
+	for i, prefix := range cfg.AllowedRegistries {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" || strings.Contains(prefix, "://") || strings.ContainsAny(prefix, "@ ") {
+			return fmt.Errorf("images allowed_registries[%d] %q must be a registry host, optionally followed by a repository path", i, prefix)
+		}
+	}
+	if cfg.InspectCacheSeconds < 0 {
+		return fmt.Errorf("images inspect_cache_seconds must be >= 0, got %d", cfg.InspectCacheSeconds)
+	}
+	hosts := make(map[string]bool, len(cfg.Registries))
+	for i, reg := range cfg.Registries {
+		if reg.Host == "" || strings.ContainsAny(reg.Host, "/ ") {
+			return fmt.Errorf("images registries[%d] host %q must be a registry host such as ghcr.io", i, reg.Host)
+		}
+		if hosts[reg.Host] {
+			return fmt.Errorf("images registries: duplicate host %q", reg.Host)
+		}
+		hosts[reg.Host] = true
+		if reg.Password == "" {
+			return fmt.Errorf("images registries[%d] (%s): password must not be empty", i, reg.Host)
+		}
+	}
 	return nil
 }
+
+// networkPresetName is the format of network preset names, e.g. "internet-only"
+var networkPresetName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// validateNetworkPresets checks the names, CIDRs and ports of the network presets
+func validateNetworkPresets(cfg *NetworkConfig) []error {
+	var problems []error
+	names := make([]string, 0, len(cfg.Presets))
+	for name := range cfg.Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		preset := cfg.Presets[name]
+		if !networkPresetName.MatchString(name) {
+			problems = append(problems, fmt.Errorf("network presets: invalid name %q (lowercase letters, digits and '-')", name))
+		}
+		for i, cidr := range preset.AllowedEgressCIDRs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				problems = append(problems, fmt.Errorf("network preset %q allowed_egress_cidrs[%d]: invalid CIDR %q", name, i, cidr))
+			}
+		}
+		for i, port := range preset.AllowedIngressPorts {
+			if port < 1 || port > 65535 {
+				problems = append(problems, fmt.Errorf("network preset %q allowed_ingress_ports[%d]: port must be between 1 and 65535, got %d", name, i, port))
+			}
+		}
+	}
+	return problems
+}
+
+// validateExecutionCallbacks checks the execution callback restrictions
+func validateExecutionCallbacks(cfg *ExecutionCallbackConfig) error {
+	if len(cfg.AllowedSchemes) == 0 {
+		return fmt.Errorf("executions callbacks.allowed_schemes must not be empty")
+	}
+	for _, scheme := range cfg.AllowedSchemes {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("executions callbacks.allowed_schemes: unsupported scheme %q (use http or https)", scheme)
+		}
+	}
+	for i, host := range cfg.AllowedHosts {
+		if strings.TrimSpace(host) == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("executions callbacks.allowed_hosts[%d] %q must be a host name or *.domain", i, host)
+		}
+	}
+	if cfg.MaxAttempts < 1 {
+		return fmt.Errorf("executions callbacks.max_attempts must be at least 1, got %d", cfg.MaxAttempts)
+	}
+	if cfg.InitialBackoffMs < 0 {
+		return fmt.Errorf("executions callbacks.initial_backoff_ms must be >= 0, got %d", cfg.InitialBackoffMs)
+	}
+	if cfg.TimeoutSeconds < 1 {
+		return fmt.Errorf("executions callbacks.timeout_seconds must be at least 1, got %d", cfg.TimeoutSeconds)
+	}
+	return nil
+}
+
+// validateJWTKeys checks the JWT signing secret or key set: secrets must be long enough and not
+// the old sample secret, key IDs unique and the signing (first) key must not retire
+func validateJWTKeys(cfg *AuthConfig) error {
+	keys := cfg.EffectiveJWTKeys()
+	if len(keys) == 0 {
+		if cfg.Enabled && !cfg.InsecureDevMode {
+			return fmt.Errorf("auth secret is required when auth is enabled (set AGENTBOX_JWT_SECRET or auth.jwt_keys)")
+		}
+		return nil
+	}
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if key.ID == "" {
+			return fmt.Errorf("auth.jwt_keys[%d] id is required", i)
+		}
+		if seen[key.ID] {
+			return fmt.Errorf("auth.jwt_keys id %q is used more than once", key.ID)
+		}
+		seen[key.ID] = true
+		if key.Secret == InsecureDefaultJWTSecret {
+			return fmt.Errorf("auth secret of key %q is the insecure sample secret; generate one, e.g. with openssl rand -base64 48", key.ID)
+		}
+		if len(key.Secret) < MinJWTSecretLength {
+			return fmt.Errorf("auth secret of key %q must be at least %d characters", key.ID, MinJWTSecretLength)
+		}
+		if key.RetireAt == "" {
+			continue
+		}
+		if i == 0 {
+			return fmt.Errorf("auth.jwt_keys[0] signs new tokens and cannot have retire_at")
+		}
+		if _, err := time.Parse(time.RFC3339, key.RetireAt); err != nil {
+			return fmt.Errorf("auth.jwt_keys[%d] retire_at must be an RFC 3339 time: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateLoginSecurity checks the password policy and login lockout settings
+func validateLoginSecurity(cfg *AuthConfig) error {
+	if cfg.PasswordPolicy.MinLength < 1 || cfg.PasswordPolicy.MinLength > 128 {
+		return fmt.Errorf("auth password_policy.min_length must be between 1 and 128, got %d", cfg.PasswordPolicy.MinLength)
+	}
+	lockout := cfg.LoginLockout
+	if !lockout.Enabled {
+		return nil
+	}
+	if lockout.MaxFailures < 1 {
+		return fmt.Errorf("auth login_lockout.max_failures must be at least 1, got %d", lockout.MaxFailures)
+	}
+	if lockout.MaxFailuresPerIP < 0 {
+		return fmt.Errorf("auth login_lockout.max_failures_per_ip must be >= 0, got %d", lockout.MaxFailuresPerIP)
+	}
+	if lockout.BaseDelayMs < 0 {
+		return fmt.Errorf("auth login_lockout.base_delay_ms must be >= 0, got %d", lockout.BaseDelayMs)
+	}
+	if lockout.LockoutSeconds < 1 {
+		return fmt.Errorf("auth login_lockout.lockout_seconds must be at least 1, got %d", lockout.LockoutSeconds)
+	}
+	return nil
+}
+
+// validateOIDC checks the single sign-on settings and that some way to log in remains
+func validateOIDC(cfg *AuthConfig) error {
+	if cfg.DisablePasswordLogin && !cfg.OIDC.Enabled {
+		return fmt.Errorf("auth.disable_password_login requires auth.oidc to be enabled")
+	}
+	if !cfg.OIDC.Enabled {
+		return nil
+	}
+	oidc := cfg.OIDC
+	if oidc.IssuerURL == "" || oidc.ClientID == "" || oidc.RedirectURL == "" {
+		return fmt.Errorf("auth.oidc issuer_url, client_id and redirect_url are required when oidc is enabled")
+	}
+	for _, raw := range []string{oidc.IssuerURL, oidc.RedirectURL} {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid auth.oidc URL %q: must be an absolute http(s) URL", raw)
+		}
+	}
+	validRole := func(role string) bool { return role == "user" || role == "admin" }
+	if !validRole(oidc.DefaultRole) {
+		return fmt.Errorf("auth.oidc default_role must be user or admin, got %q", oidc.DefaultRole)
+	}
+	for group, role := range oidc.RoleMapping {
+		if !validRole(role) {
+			return fmt.Errorf("auth.oidc role_mapping[%q] must be user or admin, got %q", group, role)
+		}
+	}
+	return nil
+}
+
+// maxNamespacePrefixLength leaves room in the 63-character namespace name for the hash that
+// keeps shortened names unique
+const maxNamespacePrefixLength = 54
+
+// namespacePrefixPattern matches the start of a DNS-1123 label: lowercase alphanumerics and '-',
+// starting with an alphanumeric
+var namespacePrefixPattern = regexp.MustCompile(`^[a-z0-9][-a-z0-9]*$`)
+
+// validateNamespacePrefix checks that environment namespaces built from the prefix are valid
+// Kubernetes namespace names
+func validateNamespacePrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("namespace prefix cannot be empty")
+	}
+	if len(prefix) > maxNamespacePrefixLength {
+		return fmt.Errorf("kubernetes namespace_prefix %q is %d characters; the maximum is %d", prefix, len(prefix), maxNamespacePrefixLength)
+	}
+	if !namespacePrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("kubernetes namespace_prefix %q must consist of lowercase letters, digits and '-', and start with a letter or digit", prefix)
+	}
+	return nil
+}
+
+// validateClusters checks cluster names are set and unique and that the default cluster exists
+func validateClusters(cfg *KubernetesConfig) error {
+	seen := make(map[string]bool)
+	for i, c := range cfg.Clusters {
+		if c.Name == "" {
+			return fmt.Errorf("kubernetes clusters[%d]: name is required", i)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("kubernetes clusters: duplicate cluster name %q", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	defaultName := cfg.EffectiveDefaultCluster()
+	for _, c := range cfg.EffectiveClusters() {
+		if c.Name == defaultName {
+			return nil
+		}
+	}
+	return fmt.Errorf("kubernetes default_cluster %q is not a configured cluster", defaultName)
+}
@@ -0,0 +1,364 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// ========== Hot Reload ==========
+
+// HotReloadableSections are the top-level config sections applied without a restart
+var HotReloadableSections = []string{"timeouts", "pool", "reconciliation", "retention", "resources", "command_policy", "executions", "execution_security", "idle", "preferences", "notifications", "port_forward", "network", "reservations"}
+
+// redactedValue replaces secrets in the effective config report
+const redactedValue = "[REDACTED]"
+
+// watchSettleDelay lets a burst of file events (editors often truncate, write and rename) settle
+// before the config file is compared and reloaded
+const watchSettleDelay = 200 * time.Millisecond
+
+// Store holds the effective configuration. Reload re-parses the config file and atomically
+// swaps in the hot-reloadable sections; restart-only settings (listen address, kubernetes,
+// auth) keep their startup values and are reported by Status as pending restart when they
+// differ on disk.
+type Store struct {
+	path    string
+	startup *Config
+	current atomic.Pointer[Config]
+
+	// mu serializes reloads and guards the fields below
+	mu             sync.Mutex
+	reloadCount    int64
+	reloadFailures int64
+	lastReloadAt   *time.Time
+	lastError      string
+	pendingRestart []string
+	checksum       [sha256.Size]byte
+}
+
+// ReloadStatus describes the reload history of a Store
+type ReloadStatus struct {
+	ConfigPath     string     `json:"config_path,omitempty"`
+	ReloadCount    int64      `json:"reload_count"`
+	ReloadFailures int64      `json:"reload_failures"`
+	LastReloadAt   *time.Time `json:"last_reload_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	PendingRestart []string   `json:"pending_restart"`
+	HotReloadable  []string   `json:"hot_reloadable"`
+}
+
+// NewStore creates a store for cfg, which was loaded from path ("" when no file is used)
+func NewStore(path string, cfg *Config) *Store {
+	s := &Store{path: path, startup: cfg, pendingRestart: []string{}}
+	s.current.Store(cfg)
+	if data, err := os.ReadFile(path); err == nil {
+		s.checksum = sha256.Sum256(data)
+	}
+	return s
+}
+
+// Current returns the effective configuration. Callers must treat it as read-only and should
+// call Current on each use rather than caching the result, so reloads take effect.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Reload re-reads the config file and applies its hot-reloadable sections. An invalid file is
+// rejected as a whole and the previous configuration stays in effect.
+func (s *Store) Reload() (*Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" {
+		return nil, fmt.Errorf("no config file to reload")
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		s.reloadFailures++
+		s.lastError = err.Error()
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	// Remember the content even if it is invalid so Watch does not retry until it changes again
+	s.checksum = sha256.Sum256(data)
+	loaded, err := Load(s.path)
+	if err != nil {
+		s.reloadFailures++
+		s.lastError = err.Error()
+		return nil, err
+	}
+
+	next := *s.startup
+	next.Timeouts = loaded.Timeouts
+	next.Pool = loaded.Pool
+	next.Reconciliation = loaded.Reconciliation
+	next.Retention = loaded.Retention
+	next.Resources = loaded.Resources
+	next.CommandPolicy = loaded.CommandPolicy
+	next.Executions = loaded.Executions
+	next.ExecSecurity = loaded.ExecSecurity
+	next.Idle = loaded.Idle
+	next.Preferences = loaded.Preferences
+	next.Notifications = loaded.Notifications
+	// The notifier keeps the SMTP settings it started with
+	next.Notifications.Email = s.startup.Notifications.Email
+	next.PortForward = loaded.PortForward
+	next.Network = loaded.Network
+	next.Reservations = loaded.Reservations
+	s.current.Store(&next)
+
+	now := time.Now()
+	s.reloadCount++
+	s.lastReloadAt = &now
+	s.lastError = ""
+	s.pendingRestart = restartOnlyChanges(s.startup, loaded)
+	return &next, nil
+}
+
+// Changed reports whether the config file content differs from what was last loaded
+func (s *Store) Changed() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sha256.Sum256(data) != s.checksum, nil
+}
+
+// Watch calls onChange when the content of the config file changes, until ctx is cancelled.
+// It watches the file's directory with fsnotify so atomic renames (editors, Kubernetes ConfigMap
+// symlink swaps) are seen too; when the watcher cannot be set up it polls every interval instead.
+func (s *Store) Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	if s.path == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.poll(ctx, interval, onChange)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(s.path)); err != nil {
+		s.poll(ctx, interval, onChange)
+		return
+	}
+
+	settle := time.NewTimer(watchSettleDelay)
+	settle.Stop()
+	defer settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-watcher.Events:
+			if !ok {
+				s.poll(ctx, interval, onChange)
+				return
+			}
+			settle.Reset(watchSettleDelay)
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				s.poll(ctx, interval, onChange)
+				return
+			}
+		case <-settle.C:
+			s.notifyIfChanged(onChange)
+		}
+	}
+}
+
+// poll compares the config file every interval; it is the fallback of Watch
+func (s *Store) poll(ctx context.Context, interval time.Duration, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.notifyIfChanged(onChange)
+	}
+}
+
+func (s *Store) notifyIfChanged(onChange func()) {
+	if changed, err := s.Changed(); err == nil && changed {
+		onChange()
+	}
+}
+
+// Status returns the reload counters and the restart-only settings changed on disk
+func (s *Store) Status() ReloadStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ReloadStatus{
+		ConfigPath:     s.path,
+		ReloadCount:    s.reloadCount,
+		ReloadFailures: s.reloadFailures,
+		LastReloadAt:   s.lastReloadAt,
+		LastError:      s.lastError,
+		PendingRestart: append([]string{}, s.pendingRestart...),
+		HotReloadable:  HotReloadableSections,
+	}
+}
+
+// restartOnlyChanges lists the restart-only settings that differ between the running and the
+// loaded configuration
+func restartOnlyChanges(running, loaded *Config) []string {
+	checks := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"server.host", running.Server.Host, loaded.Server.Host},
+		{"server.port", running.Server.Port, loaded.Server.Port},
+		{"server.log_level", running.Server.LogLevel, loaded.Server.LogLevel},
+		{"server.public_url", running.Server.PublicURL, loaded.Server.PublicURL},
+		{"server.external_url", running.Server.ExternalURL, loaded.Server.ExternalURL},
+		{"server.ws_scheme", running.Server.WSScheme, loaded.Server.WSScheme},
+		{"server.body_limits", running.Server.BodyLimits, loaded.Server.BodyLimits},
+		{"server.disable_compression", running.Server.DisableCompression, loaded.Server.DisableCompression},
+		{"server.trusted_proxies", running.Server.TrustedProxies, loaded.Server.TrustedProxies},
+		{"kubernetes.kubeconfig", running.Kubernetes.Kubeconfig, loaded.Kubernetes.Kubeconfig},
+		{"kubernetes.namespace_prefix", running.Kubernetes.NamespacePrefix, loaded.Kubernetes.NamespacePrefix},
+		{"kubernetes.runtime_class", running.Kubernetes.RuntimeClass, loaded.Kubernetes.RuntimeClass},
+		{"kubernetes.clusters", running.Kubernetes.Clusters, loaded.Kubernetes.Clusters},
+		{"kubernetes.default_cluster", running.Kubernetes.DefaultCluster, loaded.Kubernetes.DefaultCluster},
+		{"kubernetes.qps", running.Kubernetes.QPS, loaded.Kubernetes.QPS},
+		{"kubernetes.burst", running.Kubernetes.Burst, loaded.Kubernetes.Burst},
+		{"kubernetes.retry", running.Kubernetes.Retry, loaded.Kubernetes.Retry},
+		{"kubernetes.priority_classes", running.Kubernetes.PriorityClasses, loaded.Kubernetes.PriorityClasses},
+		{"kubernetes.service_accounts", running.Kubernetes.ServiceAccounts, loaded.Kubernetes.ServiceAccounts},
+		{"kubernetes.insecure_fault_injection", running.Kubernetes.InsecureFaultInjection, loaded.Kubernetes.InsecureFaultInjection},
+		{"auth.enabled", running.Auth.Enabled, loaded.Auth.Enabled},
+		{"auth.secret", running.Auth.Secret, loaded.Auth.Secret},
+		{"auth.jwt_keys", running.Auth.JWTKeys, loaded.Auth.JWTKeys},
+		{"auth.insecure_dev_mode", running.Auth.InsecureDevMode, loaded.Auth.InsecureDevMode},
+		{"auth.api_key_rotation_grace_hours", running.Auth.APIKeyRotationGraceHours, loaded.Auth.APIKeyRotationGraceHours},
+		{"auth.api_key_expiry_warning_days", running.Auth.APIKeyExpiryWarningDays, loaded.Auth.APIKeyExpiryWarningDays},
+		{"auth.disable_password_login", running.Auth.DisablePasswordLogin, loaded.Auth.DisablePasswordLogin},
+		{"auth.oidc", running.Auth.OIDC, loaded.Auth.OIDC},
+		{"auth.environment_tokens", running.Auth.EnvironmentTokens, loaded.Auth.EnvironmentTokens},
+		{"recording", running.Recording, loaded.Recording},
+		{"storage", running.Storage, loaded.Storage},
+		{"tracing", running.Tracing, loaded.Tracing},
+		{"images", running.Images, loaded.Images},
+		{"exports", running.Exports, loaded.Exports},
+		{"notifications.email", running.Notifications.Email, loaded.Notifications.Email},
+	}
+	changed := []string{}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.a, c.b) {
+			changed = append(changed, c.name)
+		}
+	}
+	return changed
+}
+
+// Redacted returns the configuration keyed by its YAML field names with secrets replaced
+func (c *Config) Redacted() (map[string]interface{}, error) {
+	data, err := c.RedactedYAML()
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return out, nil
+}
+
+// RedactedYAML returns the configuration as YAML with secrets replaced
+func (c *Config) RedactedYAML() ([]byte, error) {
+	cp := *c
+	if cp.Auth.Secret != "" {
+		cp.Auth.Secret = redactedValue
+	}
+	if len(cp.Auth.JWTKeys) > 0 {
+		keys := make([]JWTKeyConfig, len(cp.Auth.JWTKeys))
+		for i, key := range cp.Auth.JWTKeys {
+			key.Secret = redactedValue
+			keys[i] = key
+		}
+		cp.Auth.JWTKeys = keys
+	}
+	if cp.Auth.OIDC.ClientSecret != "" {
+		cp.Auth.OIDC.ClientSecret = redactedValue
+	}
+	if len(cp.Images.Registries) > 0 {
+		registries := make([]RegistryCredentialConfig, len(cp.Images.Registries))
+		for i, reg := range cp.Images.Registries {
+			reg.Password = redactedValue
+			registries[i] = reg
+		}
+		cp.Images.Registries = registries
+	}
+	// Webhook URLs (Slack, Teams, ...) embed their credential in the path
+	if cp.Idle.WebhookURL != "" {
+		cp.Idle.WebhookURL = redactedValue
+	}
+	if cp.Notifications.WebhookURL != "" {
+		cp.Notifications.WebhookURL = redactedValue
+	}
+	if cp.Notifications.Email.Password != "" {
+		cp.Notifications.Email.Password = redactedValue
+	}
+	if cp.Exports.S3.SecretAccessKey != "" {
+		cp.Exports.S3.SecretAccessKey = redactedValue
+	}
+	if cp.Storage.S3.SecretAccessKey != "" {
+		cp.Storage.S3.SecretAccessKey = redactedValue
+	}
+	if cp.Exports.Webhook.Secret != "" {
+		cp.Exports.Webhook.Secret = redactedValue
+	}
+	if len(cp.Exports.Webhook.Headers) > 0 {
+		// Webhook headers usually carry credentials (e.g. Authorization)
+		headers := make(map[string]string, len(cp.Exports.Webhook.Headers))
+		for name := range cp.Exports.Webhook.Headers {
+			headers[name] = redactedValue
+		}
+		cp.Exports.Webhook.Headers = headers
+	}
+	if len(cp.LogShipping.Credentials) > 0 {
+		credentials := make(map[string]LogShippingCredentials, len(cp.LogShipping.Credentials))
+		for name, creds := range cp.LogShipping.Credentials {
+			if creds.Password != "" {
+				creds.Password = redactedValue
+			}
+			if creds.Secret != "" {
+				creds.Secret = redactedValue
+			}
+			if creds.S3.SecretAccessKey != "" {
+				creds.S3.SecretAccessKey = redactedValue
+			}
+			if len(creds.Headers) > 0 {
+				headers := make(map[string]string, len(creds.Headers))
+				for header := range creds.Headers {
+					headers[header] = redactedValue
+				}
+				creds.Headers = headers
+			}
+			credentials[name] = creds
+		}
+		cp.LogShipping.Credentials = credentials
+	}
+	data, err := yaml.Marshal(&cp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return data, nil
+}
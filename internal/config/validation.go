@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ========== Validation Report ==========
+
+// ValidationError reports every problem found in a configuration at once, so a broken config
+// file can be fixed in one go
+type ValidationError struct {
+	// Path is the config file ("" when only defaults and environment variables were used)
+	Path     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration")
+	if e.Path != "" {
+		fmt.Fprintf(&b, " in %s", e.Path)
+	}
+	if len(e.Problems) == 1 {
+		b.WriteString(": " + e.Problems[0])
+		return b.String()
+	}
+	fmt.Fprintf(&b, " (%d problems):", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  - " + p)
+	}
+	return b.String()
+}
+
+// yamlKey returns the YAML key of a struct field ("" for fields not read from YAML)
+func yamlKey(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// checkKeys walks a parsed config document against the Config struct, recording the path of
+// every key it sets in set and returning a problem for each key Config does not have (typos
+// would otherwise silently leave the setting at its default)
+func checkKeys(node *yaml.Node, t reflect.Type, prefix string, set map[string]bool) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.DocumentNode && len(node.Content) > 0:
+		return checkKeys(node.Content[0], t, prefix, set)
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		var problems []string
+		for i, item := range node.Content {
+			problems = append(problems, checkKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i), set)...)
+		}
+		return problems
+	case node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct:
+		// Scalars and maps are leaves; type mismatches are reported by the decoder
+		return nil
+	}
+
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := yamlKey(t.Field(i)); key != "" {
+			fields[key] = t.Field(i)
+		}
+	}
+	var problems []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, value := node.Content[i], node.Content[i+1]
+		path := keyNode.Value
+		if prefix != "" {
+			path = prefix + "." + keyNode.Value
+		}
+		field, ok := fields[keyNode.Value]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown key (line %d)", path, keyNode.Line))
+			continue
+		}
+		set[path] = true
+		problems = append(problems, checkKeys(value, field.Type, path, set)...)
+	}
+	return problems
+}
+
+// flatten returns the settings of v keyed by their dotted YAML path; structs are expanded, every
+// other value (including slices and maps) is one setting
+func flatten(v reflect.Value, prefix string, out map[string]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if f := v.Field(i); f.Kind() == reflect.Struct {
+			flatten(f, key, out)
+		} else {
+			out[key] = fmt.Sprintf("%v", f.Interface())
+		}
+	}
+}
+
+// defaultedKeys returns the settings left at their default: neither set in the config file
+// (fileKeys) nor changed by an environment variable (beforeEnv holds the values before the
+// environment was applied)
+func defaultedKeys(cfg *Config, fileKeys map[string]bool, beforeEnv map[string]string) []string {
+	after := make(map[string]string, len(beforeEnv))
+	flatten(reflect.ValueOf(*cfg), "", after)
+	var keys []string
+	for key, value := range after {
+		if !fileKeys[key] && beforeEnv[key] == value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+)
+
+// GetActivity handles GET /environments/{id}/activity
+// Returns the environment's activity feed, newest first: ?limit= (default 100, max 1000),
+// ?page_token= for the next page and ?since= (RFC3339) for only the items newer than it
+func (h *Handler) GetActivity(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionViewer, "insufficient permissions to read this environment"); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	opts := orchestrator.ActivityFeedOptions{PageToken: query.Get("page_token")}
+	if value := query.Get("limit"); value != "" {
+		if l, err := strconv.Atoi(value); err == nil && l > 0 {
+			opts.Limit = l
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid since timestamp (expected RFC3339)", err)
+			return
+		}
+		opts.Since = &since
+	}
+
+	resp, err := h.orchestrator.ActivityFeed(r.Context(), envID, opts)
+	if err != nil {
+		h.respondServiceError(w, "failed to get activity", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// ListEvents handles GET /environments/{id}/events
+// Returns the environment's reconciliation and lifecycle events, newest first: ?limit= (default
+// 100, max 1000), ?page_token= for the next page, and ?since= and ?until= (RFC3339) for only
+// the events newer than since and not newer than until
+func (h *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionViewer, "insufficient permissions to read this environment"); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	opts := orchestrator.EventListOptions{PageToken: query.Get("page_token")}
+	if value := query.Get("limit"); value != "" {
+		if l, err := strconv.Atoi(value); err == nil && l > 0 {
+			opts.Limit = l
+		}
+	}
+	for name, target := range map[string]**time.Time{"since": &opts.Since, "until": &opts.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				h.respondError(w, http.StatusBadRequest, "invalid "+name+" timestamp (expected RFC3339)", err)
+				return
+			}
+			*target = &t
+		}
+	}
+
+	resp, err := h.orchestrator.ListEvents(r.Context(), envID, opts)
+	if err != nil {
+		h.respondServiceError(w, "failed to list events", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
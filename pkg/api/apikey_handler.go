@@ -2,16 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
 	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/auth"
-	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
@@ -32,6 +36,7 @@ func NewAPIKeyHandler(authService *auth.Service, permissionService *permissions.
 }
 
 // ListAPIKeys handles GET /api/v1/api-keys
+// Lists the current user's keys; with api_keys.manage, ?user_id= lists another user's keys
 func (h *APIKeyHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -40,8 +45,12 @@ func (h *APIKeyHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
+	ownerID, ok := h.keyOwner(w, r, user)
+	if !ok {
+		return
+	}
 
-	keys, err := h.authService.ListAPIKeys(ctx, user.ID)
+	keys, err := h.authService.ListAPIKeys(ctx, ownerID)
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, "failed to list API keys", err)
 		return
@@ -52,14 +61,23 @@ func (h *APIKeyHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// maxAPIKeyNameLength is the longest API key name accepted, in characters
+const maxAPIKeyNameLength = 100
+
 // CreateAPIKeyRequest is the request body for creating an API key
 type CreateAPIKeyRequestBody struct {
+	// Name identifies the key in listings, e.g. "ci-deploy"
+	Name        string `json:"name,omitempty"`
 	Description string `json:"description"`
-	ExpiresIn   *int   `json:"expires_in"` // Days until expiration
-	Permissions []struct {
+	// AllowedCIDRs restricts the client addresses the key works from (CIDRs or single addresses)
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+	ExpiresIn    *int     `json:"expires_in"` // Days until expiration
+	Permissions  []struct {
 		EnvironmentID string `json:"environment_id"`
 		Permission    string `json:"permission"`
 	} `json:"permissions,omitempty"`
+	// ReadOnly keys can only read, whatever the permissions of their user
+	ReadOnly bool `json:"read_only,omitempty"`
 }
 
 // CreateAPIKey handles POST /api/v1/api-keys
@@ -71,22 +89,35 @@ func (h *APIKeyHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
-
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 8*1024)
+	// A key would outlive the impersonation session
+	if rejectImpersonated(w, r, "create API keys") {
+		return
+	}
 
 	var req CreateAPIKeyRequestBody
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
 
+	req.Name = strings.TrimSpace(req.Name)
+	if utf8.RuneCountInString(req.Name) > maxAPIKeyNameLength {
+		h.respondError(w, http.StatusBadRequest, fmt.Sprintf("name must be at most %d characters", maxAPIKeyNameLength), nil)
+		return
+	}
+	allowedCIDRs, err := auth.ParseAllowedCIDRs(req.AllowedCIDRs)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid allowed_cidrs", err)
+		return
+	}
+
 	// Validate permissions if provided
 	var permReqs []auth.APIKeyPermissionRequest
 	if len(req.Permissions) > 0 {
-		// Super admins can grant any permission
-		isSuperAdmin := user.Role == users.RoleSuperAdmin
+		// Users with environments.write_all can grant any permission
+		canGrantAny := roles.Has(ctx, user, roles.CapEnvironmentsWriteAll)
 
 		for _, p := range req.Permissions {
 			// Validate permission level
@@ -95,8 +126,8 @@ func (h *APIKeyHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// For non-super-admins, verify they have at least the permission they're trying to grant
-			if !isSuperAdmin {
+			// Otherwise verify they have at least the permission they're trying to grant
+			if !canGrantAny {
 				userPerm, err := h.permissionService.GetUserPermission(ctx, user.ID, p.EnvironmentID)
 				if err != nil {
 					h.respondError(w, http.StatusInternalServerError, "failed to check user permissions", err)
@@ -131,10 +162,13 @@ func (h *APIKeyHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	createReq := &auth.CreateAPIKeyRequest{
-		UserID:      user.ID,
-		Description: req.Description,
-		ExpiresAt:   expiresAt,
-		Permissions: permReqs,
+		UserID:       user.ID,
+		Name:         req.Name,
+		Description:  req.Description,
+		AllowedCIDRs: allowedCIDRs,
+		ExpiresAt:    expiresAt,
+		Permissions:  permReqs,
+		ReadOnly:     req.ReadOnly,
 	}
 
 	apiKey, err := h.authService.CreateAPIKey(ctx, createReq)
@@ -173,13 +207,17 @@ func (h *APIKeyHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
 	h.logger.Info("API key created",
 		zap.String("user_id", user.ID),
 		zap.String("key_id", apiKey.ID),
+		zap.String("key_prefix", apiKey.KeyPrefix),
 		zap.Int("permissions_count", len(permReqs)),
+		zap.Int("allowed_cidrs", len(allowedCIDRs)),
+		zap.Bool("read_only", apiKey.ReadOnly),
 	)
 
 	h.respondJSON(w, http.StatusCreated, apiKey)
 }
 
 // RevokeAPIKey handles DELETE /api/v1/api-keys/{id}
+// With api_keys.manage, ?user_id= revokes another user's key
 func (h *APIKeyHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
@@ -190,20 +228,73 @@ func (h *APIKeyHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
+	ownerID, ok := h.keyOwner(w, r, user)
+	if !ok {
+		return
+	}
 
-	if err := h.authService.RevokeAPIKey(ctx, keyID, user.ID); err != nil {
+	if err := h.authService.RevokeAPIKey(ctx, keyID, ownerID); err != nil {
 		h.respondError(w, http.StatusNotFound, "failed to revoke API key", err)
 		return
 	}
 
 	h.logger.Info("API key revoked",
-		zap.String("user_id", user.ID),
+		zap.String("user_id", ownerID),
 		zap.String("key_id", keyID),
+		zap.String("revoked_by", user.ID),
 	)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// RotateAPIKey handles POST /api/v1/api-keys/{id}/rotate
+// Creates a replacement key with the same permissions; the old key keeps working for the grace period.
+func (h *APIKeyHandler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	keyID := mux.Vars(r)["id"]
+
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if rejectImpersonated(w, r, "rotate API keys") {
+		return
+	}
+
+	apiKey, err := h.authService.RotateAPIKey(ctx, keyID, user.ID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if apierrors.KindOf(err) != nil {
+			status = apierrors.HTTPStatus(err)
+		}
+		h.respondError(w, status, "failed to rotate API key", err)
+		return
+	}
+
+	h.logger.Info("API key rotated",
+		zap.String("user_id", user.ID),
+		zap.String("old_key_id", keyID),
+		zap.String("key_id", apiKey.ID),
+	)
+
+	h.respondJSON(w, http.StatusCreated, apiKey)
+}
+
+// keyOwner returns the user whose keys the request is about: the current user, or the user in
+// ?user_id= for users with api_keys.manage
+func (h *APIKeyHandler) keyOwner(w http.ResponseWriter, r *http.Request, user *users.User) (string, bool) {
+	ownerID := r.URL.Query().Get("user_id")
+	if ownerID == "" || ownerID == user.ID {
+		return user.ID, true
+	}
+	if !roles.Has(r.Context(), user, roles.CapAPIKeysManage) {
+		h.respondError(w, http.StatusForbidden, "api_keys.manage capability required to manage other users' API keys", nil)
+		return "", false
+	}
+	return ownerID, true
+}
+
 // Helper methods
 func (h *APIKeyHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -224,11 +315,7 @@ func (h *APIKeyHandler) respondError(w http.ResponseWriter, status int, message
 		}
 	}
 
-	errResp := models.ErrorResponse{
-		Error:   message,
-		Message: errMsg,
-		Code:    status,
-	}
+	errResp := newErrorResponse(status, message, errMsg, err)
 
 	h.respondJSON(w, status, errResp)
 }
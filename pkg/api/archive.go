@@ -0,0 +1,344 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// ArchivesPrefix is the key prefix of stored environment archives in the storage backend:
+// archives/<environment>/<timestamp>.zip
+const ArchivesPrefix = "archives/"
+
+var (
+	errArchiveStorageNotConfigured = apierrors.New(apierrors.Unavailable, apierrors.CodeStorageNotConfigured,
+		"stored archives require a storage backend")
+	errArchiveNotFound = apierrors.New(apierrors.NotFound, apierrors.CodeArchiveNotFound, "archive not found")
+)
+
+// GetEnvironmentArchive handles GET /environments/{id}/archive
+// Streams a zip of the environment's state (see orchestrator.WriteEnvironmentArchive) plus
+// manifest.json. With ?include_artifacts=true the environment's session recordings are added
+// under artifacts/sessions/, which needs editor permission like reading them directly. With
+// ?store=true the archive is written to the storage backend instead and described in the
+// response (see ListStoredArchives).
+func (h *Handler) GetEnvironmentArchive(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, err := h.orchestrator.GetEnvironment(r.Context(), envID); err != nil {
+		h.respondServiceError(w, "environment not found", err)
+		return
+	}
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionViewer, "insufficient permissions to read this environment"); !ok {
+		return
+	}
+	h.writeEnvironmentArchive(w, r, envID, false)
+}
+
+// ArchiveAndDeleteEnvironment handles POST /environments/{id}/archive
+// Streams the same archive as GET, then deletes the environment once the archive is complete
+// (?force=true deletes it like DELETE with force). The outcome is recorded in manifest.json,
+// which is written last; needs owner permission. With ?store=true the environment is deleted
+// once the archive is stored, and the response (not the manifest) records the deletion.
+func (h *Handler) ArchiveAndDeleteEnvironment(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, err := h.orchestrator.GetEnvironment(r.Context(), envID); err != nil {
+		h.respondServiceError(w, "environment not found", err)
+		return
+	}
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionOwner, "insufficient permissions to delete this environment"); !ok {
+		return
+	}
+	h.writeEnvironmentArchive(w, r, envID, true)
+}
+
+// writeEnvironmentArchive streams the archive of an environment, deleting the environment
+// afterwards when del is set. Once streaming has started errors can no longer be reported in
+// the status: the archive is cut short, which clients see as a corrupt zip.
+func (h *Handler) writeEnvironmentArchive(w http.ResponseWriter, r *http.Request, envID string, del bool) {
+	ctx := r.Context()
+	includeArtifacts := r.URL.Query().Get("include_artifacts") == "true"
+	if includeArtifacts {
+		if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+			return
+		}
+	}
+	if r.URL.Query().Get("store") == "true" {
+		h.storeEnvironmentArchive(w, r, envID, del, includeArtifacts)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+envID+`.zip"`)
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	log := h.logger.With(zap.String("environment_id", envID))
+
+	manifest, err := h.writeArchiveContents(ctx, zw, envID, includeArtifacts)
+	if err != nil {
+		log.Warn("failed to write environment archive", zap.Error(err))
+		return
+	}
+
+	if del {
+		if err := h.deleteArchivedEnvironment(r, envID); err != nil {
+			manifest.Warnings = append(manifest.Warnings, "delete: "+err.Error())
+		} else {
+			manifest.Deleted = true
+		}
+	}
+
+	if err := orchestrator.WriteArchiveJSON(zw, "manifest.json", manifest); err != nil {
+		log.Warn("failed to write environment archive", zap.Error(err))
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Warn("failed to finish environment archive", zap.Error(err))
+	}
+}
+
+// writeArchiveContents writes everything but the manifest into the archive
+func (h *Handler) writeArchiveContents(ctx context.Context, zw *zip.Writer, envID string, includeArtifacts bool) (*models.ArchiveManifest, error) {
+	manifest, err := h.orchestrator.WriteEnvironmentArchive(ctx, envID, zw)
+	if err != nil {
+		return nil, err
+	}
+	if includeArtifacts {
+		if err := h.writeArchiveSessions(ctx, zw, envID, manifest); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// deleteArchivedEnvironment deletes an environment once its archive is complete (?force=true
+// deletes it like DELETE with force)
+func (h *Handler) deleteArchivedEnvironment(r *http.Request, envID string) error {
+	ctx := r.Context()
+	force := r.URL.Query().Get("force") == "true"
+	if err := h.orchestrator.DeleteEnvironment(ctx, envID, force); err != nil {
+		return err
+	}
+	h.orchestrator.EnvironmentDeleted(ctx, envID, getUserIDFromContext(ctx), force)
+	h.logger.Info("environment archived and deleted", zap.String("environment_id", envID), zap.Bool("force", force))
+	return nil
+}
+
+// archiveStore returns the view of the storage backend holding stored archives, or nil
+func (h *Handler) archiveStore() storage.Backend {
+	if h.storage == nil {
+		return nil
+	}
+	return storage.WithPrefix(h.storage, ArchivesPrefix)
+}
+
+// storeEnvironmentArchive streams the archive of an environment into the storage backend and
+// responds with its description, deleting the environment afterwards when del is set
+func (h *Handler) storeEnvironmentArchive(w http.ResponseWriter, r *http.Request, envID string, del, includeArtifacts bool) {
+	ctx := r.Context()
+	store := h.archiveStore()
+	if store == nil {
+		h.respondServiceError(w, "failed to store environment archive", errArchiveStorageNotConfigured)
+		return
+	}
+	now := time.Now().UTC()
+	archive := &models.StoredArchive{
+		Name:          now.Format("20060102T150405.000Z") + ".zip",
+		EnvironmentID: envID,
+		CreatedAt:     now,
+	}
+	key := envID + "/" + archive.Name
+
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := store.Put(ctx, key, pr, "application/zip")
+		// Fails the writes to the pipe when Put gave up before the end of the archive
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+	out := &countingWriter{w: pw}
+	zw := zip.NewWriter(out)
+	manifest, err := h.writeArchiveContents(ctx, zw, envID, includeArtifacts)
+	if err == nil {
+		err = orchestrator.WriteArchiveJSON(zw, "manifest.json", manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	pw.CloseWithError(err)
+	if putErr := <-uploaded; err == nil {
+		err = putErr
+	}
+	if err != nil {
+		h.respondServiceError(w, "failed to store environment archive", err)
+		return
+	}
+	archive.SizeBytes = out.n
+
+	if del {
+		if err := h.deleteArchivedEnvironment(r, envID); err != nil {
+			h.respondServiceError(w, "archive stored as "+archive.Name+" but the environment could not be deleted", err)
+			return
+		}
+		archive.Deleted = true
+	}
+	archive.DownloadURL = h.archiveDownloadURL(ctx, store, key)
+	h.respondJSON(w, http.StatusCreated, archive)
+}
+
+// archiveDownloadURL returns a presigned URL of a stored archive, or "" when the backend hands
+// out none
+func (h *Handler) archiveDownloadURL(ctx context.Context, store storage.Backend, key string) string {
+	url, err := store.PresignGet(ctx, key, h.presignExpiry)
+	if err != nil {
+		if !errors.Is(err, storage.ErrPresignNotSupported) {
+			h.logger.Warn("failed to presign stored archive", zap.String("key", key), zap.Error(err))
+		}
+		return ""
+	}
+	return url
+}
+
+// ListStoredArchives handles GET /environments/{id}/archives
+// Returns the environment's stored archives, newest first, with presigned download URLs when
+// the storage backend hands them out. Archives outlive their environment.
+func (h *Handler) ListStoredArchives(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionViewer, "insufficient permissions to read this environment"); !ok {
+		return
+	}
+	store := h.archiveStore()
+	if store == nil {
+		h.respondServiceError(w, "failed to list stored archives", errArchiveStorageNotConfigured)
+		return
+	}
+
+	objects, err := store.List(ctx, envID+"/")
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list stored archives", err)
+		return
+	}
+	archives := make([]*models.StoredArchive, 0, len(objects))
+	// Names are timestamps: listed in key order, the newest is last
+	for i := len(objects) - 1; i >= 0; i-- {
+		object := objects[i]
+		archives = append(archives, &models.StoredArchive{
+			Name:          strings.TrimPrefix(object.Key, envID+"/"),
+			EnvironmentID: envID,
+			SizeBytes:     object.Size,
+			CreatedAt:     object.LastModified.UTC(),
+			DownloadURL:   h.archiveDownloadURL(ctx, store, object.Key),
+		})
+	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"archives": archives,
+		"total":    len(archives),
+	})
+}
+
+// GetStoredArchive handles GET /environments/{id}/archives/{name}
+// Redirects to a presigned URL of the archive when the storage backend hands them out, and
+// streams the archive otherwise
+func (h *Handler) GetStoredArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID, name := mux.Vars(r)["id"], mux.Vars(r)["name"]
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionViewer, "insufficient permissions to read this environment"); !ok {
+		return
+	}
+	store := h.archiveStore()
+	if store == nil {
+		h.respondServiceError(w, "failed to get stored archive", errArchiveStorageNotConfigured)
+		return
+	}
+	key := envID + "/" + name
+	if !strings.HasSuffix(name, ".zip") || storage.CheckKey(key) != nil {
+		h.respondServiceError(w, "failed to get stored archive", errArchiveNotFound)
+		return
+	}
+
+	// Listed rather than opened, so a redirect does not start a download
+	objects, err := store.List(ctx, key)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get stored archive", err)
+		return
+	}
+	if len(objects) == 0 || objects[0].Key != key {
+		h.respondServiceError(w, "failed to get stored archive", errArchiveNotFound)
+		return
+	}
+	if url := h.archiveDownloadURL(ctx, store, key); url != "" {
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	f, err := store.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		err = errArchiveNotFound
+	}
+	if err != nil {
+		h.respondServiceError(w, "failed to get stored archive", err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+envID+"-"+name+`"`)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		h.logger.Warn("failed to stream stored archive", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeArchiveSessions copies the environment's session recordings into the archive
+func (h *Handler) writeArchiveSessions(ctx context.Context, zw *zip.Writer, envID string, manifest *models.ArchiveManifest) error {
+	if h.recordings == nil {
+		return nil
+	}
+	recordings, err := h.recordings.List(ctx, envID)
+	if err != nil {
+		manifest.Warnings = append(manifest.Warnings, "sessions: "+err.Error())
+		return nil
+	}
+	for _, rec := range recordings {
+		_, f, err := h.recordings.Open(ctx, rec.ID)
+		if err != nil {
+			manifest.Warnings = append(manifest.Warnings, "session "+rec.ID+": "+err.Error())
+			continue
+		}
+		dst, err := orchestrator.CreateArchiveFile(zw, "artifacts/sessions/"+rec.ID+".cast")
+		if err == nil {
+			_, err = io.Copy(dst, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		manifest.Sessions++
+	}
+	return nil
+}
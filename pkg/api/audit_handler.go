@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// AuditHandler exposes the audit log
+type AuditHandler struct {
+	db     *database.DB
+	logger *logger.Logger
+}
+
+// NewAuditHandler creates a new audit handler
+func NewAuditHandler(db *database.DB, log *logger.Logger) *AuditHandler {
+	return &AuditHandler{
+		db:     db,
+		logger: log,
+	}
+}
+
+// ListAuditLog handles GET /api/v1/admin/audit-log (audit.read)
+// Returns audit log entries newest first, filtered by ?action=, ?actor_id=, ?impersonator_id=,
+// ?resource_type= and ?resource_id= (at most ?limit=, default 100, max 1000)
+func (h *AuditHandler) ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !hasCapability(ctx, roles.CapAuditRead) {
+		h.respondError(w, http.StatusForbidden, "audit.read capability required", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		Action:         query.Get("action"),
+		ActorID:        query.Get("actor_id"),
+		ImpersonatorID: query.Get("impersonator_id"),
+		ResourceType:   query.Get("resource_type"),
+		ResourceID:     query.Get("resource_id"),
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			h.respondError(w, http.StatusBadRequest, "invalid limit (expected a positive integer)", err)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := h.db.ListAuditEntries(ctx, filter)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list audit log", err)
+		return
+	}
+	if entries == nil {
+		entries = []*models.AuditEntry{}
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"total":   len(entries),
+	})
+}
+
+// Helper methods
+func (h *AuditHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *AuditHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
@@ -2,21 +2,32 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/sciffer/agentbox/internal/logger"
 	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/impersonation"
 	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/preferences"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
 // AuthHandler handles authentication endpoints
 type AuthHandler struct {
-	authService *auth.Service
-	userService *users.Service
-	logger      *logger.Logger
+	authService        *auth.Service
+	userService        *users.Service
+	preferencesService *preferences.Service
+	logger             *logger.Logger
 }
 
 // NewAuthHandler creates a new auth handler
@@ -28,16 +39,29 @@ func NewAuthHandler(authService *auth.Service, userService *users.Service, log *
 	}
 }
 
+// SetPreferencesService includes the user's preferences in GET /auth/me
+func (h *AuthHandler) SetPreferencesService(preferencesService *preferences.Service) {
+	h.preferencesService = preferencesService
+}
+
+// meResponse is the body of GET /auth/me: the user, their preferences and, while impersonating
+// them, the impersonation session
+type meResponse struct {
+	*users.User
+	Preferences   *models.PreferencesResponse `json:"preferences,omitempty"`
+	Impersonation *auth.ImpersonationSession  `json:"impersonation,omitempty"`
+	// ReadOnly is set when the request was made with a read-only API key
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
 // Login handles POST /api/v1/auth/login
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context() // ctx is used in authService.Login
 
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 4*1024) // 4KB limit
-
 	var req auth.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
@@ -49,7 +73,18 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authenticate
+	req.ClientIP = clientip.FromRequest(r)
 	resp, err := h.authService.Login(ctx, &req)
+	if errors.Is(err, auth.ErrPasswordLoginDisabled) {
+		h.respondError(w, http.StatusForbidden, "authentication failed", err)
+		return
+	}
+	var locked *auth.LoginLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+		h.respondError(w, http.StatusTooManyRequests, "authentication failed", err)
+		return
+	}
 	if err != nil {
 		h.respondError(w, http.StatusUnauthorized, "authentication failed", err)
 		return
@@ -63,6 +98,94 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusOK, resp)
 }
 
+// oidcStateCookie holds the signed SSO login state between the login redirect and the callback
+const oidcStateCookie = "agentbox_oidc_state"
+
+// OIDCLogin handles GET /api/v1/auth/oidc/login
+// Redirects the browser to the identity provider
+func (h *AuthHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.OIDCEnabled() {
+		h.respondError(w, http.StatusNotFound, "single sign-on is not configured", nil)
+		return
+	}
+
+	authURL, stateToken, err := h.authService.BeginOIDCLogin(r.Context())
+	if err != nil {
+		h.respondError(w, http.StatusBadGateway, "failed to start single sign-on", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateToken,
+		Path:     "/api/v1/auth/oidc",
+		MaxAge:   int(auth.OIDCStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback handles GET /api/v1/auth/oidc/callback
+// Completes the provider login and issues an agentbox token: as JSON (like /auth/login), or by
+// redirecting to the configured post-login URL with the token in the URL fragment
+func (h *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if !h.authService.OIDCEnabled() {
+		h.respondError(w, http.StatusNotFound, "single sign-on is not configured", nil)
+		return
+	}
+	// The state cookie is single-use
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/v1/auth/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		h.respondError(w, http.StatusUnauthorized, "authentication failed",
+			fmt.Errorf("identity provider returned %s: %s", providerErr, query.Get("error_description")))
+		return
+	}
+	var stateToken string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		stateToken = cookie.Value
+	}
+
+	resp, err := h.authService.CompleteOIDCLogin(r.Context(), query.Get("code"), query.Get("state"), stateToken)
+	if err != nil {
+		h.respondError(w, http.StatusUnauthorized, "authentication failed", err)
+		return
+	}
+
+	h.logger.Info("user logged in via single sign-on",
+		zap.String("username", resp.User.Username),
+		zap.String("user_id", resp.User.ID),
+	)
+
+	if target := h.authService.PostLoginRedirectURL(); target != "" {
+		fragment := url.Values{
+			"token":      {resp.Token},
+			"expires_at": {resp.ExpiresAt.UTC().Format(time.RFC3339)},
+		}
+		http.Redirect(w, r, target+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// isHTTPS reports whether the client reached the server over HTTPS: directly, or through a
+// trusted proxy that says so in X-Forwarded-Proto (the header is ignored from anyone else)
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return clientip.ViaTrustedProxy(r) && strings.EqualFold(firstForwardedValue(r, "X-Forwarded-Proto"), "https")
+}
+
 // Logout handles POST /api/v1/auth/logout
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	// For JWT, logout is handled client-side by discarding the token
@@ -80,7 +203,24 @@ func (h *AuthHandler) GetMe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.respondJSON(w, http.StatusOK, user)
+	resp := meResponse{User: user, ReadOnly: auth.IsReadOnly(ctx)}
+	if h.preferencesService != nil {
+		// The user is returned without preferences rather than failing the request
+		prefs, err := h.preferencesService.Get(ctx, user.ID)
+		if err != nil {
+			h.logger.Warn("failed to get preferences", zap.String("user_id", user.ID), zap.Error(err))
+		}
+		resp.Preferences = prefs
+	}
+	if imp, ok := impersonation.FromContext(ctx); ok {
+		session, err := h.authService.GetImpersonationSession(ctx, imp.SessionID)
+		if err != nil {
+			h.logger.Warn("failed to get impersonation session", zap.String("session_id", imp.SessionID), zap.Error(err))
+		}
+		resp.Impersonation = session
+	}
+
+	h.respondJSON(w, http.StatusOK, resp)
 }
 
 // ChangePassword handles POST /api/v1/auth/change-password
@@ -92,9 +232,9 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
-
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 4*1024)
+	if rejectImpersonated(w, r, "change the password") {
+		return
+	}
 
 	var req struct {
 		CurrentPassword string `json:"current_password"`
@@ -102,7 +242,8 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
@@ -113,11 +254,6 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.NewPassword) < 8 {
-		h.respondError(w, http.StatusBadRequest, "new password must be at least 8 characters", nil)
-		return
-	}
-
 	// Verify current password
 	_, passwordHash, err := h.userService.GetUserWithPassword(ctx, user.Username)
 	if err != nil {
@@ -130,6 +266,12 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.userService.CheckPassword("new_password", user.Username, req.NewPassword); err != nil {
+		h.logger.Debug("new password does not satisfy the password policy", zap.Error(err))
+		h.respondJSON(w, http.StatusBadRequest, newValidationErrorResponse("new password does not satisfy the password policy", err))
+		return
+	}
+
 	// Update password
 	if err := h.userService.UpdatePassword(ctx, user.ID, req.NewPassword); err != nil {
 		h.respondError(w, http.StatusInternalServerError, "failed to update password", err)
@@ -139,7 +281,7 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusOK, models.ErrorResponse{
 		Error:   "success",
 		Message: "password changed successfully",
-		Code:    http.StatusOK,
+		Status:  http.StatusOK,
 	})
 }
 
@@ -163,11 +305,7 @@ func (h *AuthHandler) respondError(w http.ResponseWriter, status int, message st
 		}
 	}
 
-	errResp := models.ErrorResponse{
-		Error:   message,
-		Message: errMsg,
-		Code:    status,
-	}
+	errResp := newErrorResponse(status, message, errMsg, err)
 
 	h.respondJSON(w, status, errResp)
 }
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/permissions"
+)
+
+// SetBadgeSigner enables status badges: signed URLs that show an environment's status without
+// credentials, e.g. embedded in another tool. authService keeps the per-environment secrets.
+func (h *Handler) SetBadgeSigner(authService *auth.Service) {
+	h.badges = authService
+}
+
+// EnvironmentBadge is the JSON status badge of an environment
+type EnvironmentBadge struct {
+	EnvironmentID string                   `json:"environment_id"`
+	Name          string                   `json:"name"`
+	Status        models.EnvironmentStatus `json:"status"`
+	StartedAt     *time.Time               `json:"started_at,omitempty"`
+	// UptimeSeconds is how long a running environment has been running
+	UptimeSeconds int64 `json:"uptime_seconds,omitempty"`
+}
+
+// BadgeURLResponse is the response of the badge URL endpoints
+type BadgeURLResponse struct {
+	BadgeURL string `json:"badge_url"`
+	SVGURL   string `json:"svg_url"`
+}
+
+// GetEnvironmentBadge handles GET /api/v1/environments/{id}/badge?sig=...[&format=svg]
+// Needs no credentials: the sig parameter authorizes the request. Only the environment's name,
+// status and uptime are shown.
+func (h *Handler) GetEnvironmentBadge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+	if h.badges == nil {
+		h.respondError(w, http.StatusNotFound, "status badges are not enabled", nil)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "svg" {
+		h.respondError(w, http.StatusBadRequest, "invalid format (expected json or svg)", nil)
+		return
+	}
+
+	valid, err := h.badges.VerifyBadgeSignature(ctx, envID, r.URL.Query().Get("sig"))
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to verify badge signature", err)
+		return
+	}
+	if !valid {
+		h.respondServiceError(w, "invalid badge signature",
+			apierrors.New(apierrors.Forbidden, apierrors.CodeBadgeSignatureInvalid, "invalid or revoked badge signature"))
+		return
+	}
+
+	env, err := h.orchestrator.GetEnvironment(ctx, envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get environment", err)
+		return
+	}
+	badge := &EnvironmentBadge{
+		EnvironmentID: env.ID,
+		Name:          env.Name,
+		Status:        env.Status,
+		StartedAt:     env.StartedAt,
+	}
+	if env.Status == models.StatusRunning && env.StartedAt != nil {
+		badge.UptimeSeconds = int64(time.Since(*env.StartedAt).Seconds())
+	}
+
+	// Embedders poll the badge; it must not be cached
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(badgeSVG(env.Name, string(env.Status)))); err != nil {
+			h.logger.Warn("failed to write badge", zap.Error(err))
+		}
+		return
+	}
+	h.respondJSON(w, http.StatusOK, badge)
+}
+
+// GetEnvironmentBadgeURL handles GET /api/v1/environments/{id}/badge/url (editors)
+// Returns the signed badge URLs of the environment
+func (h *Handler) GetEnvironmentBadgeURL(w http.ResponseWriter, r *http.Request) {
+	h.respondBadgeURL(w, r, false)
+}
+
+// RotateEnvironmentBadge handles POST /api/v1/environments/{id}/badge/rotate (editors)
+// Replaces the environment's badge secret, revoking the badge URLs handed out before, and returns
+// the new URLs
+func (h *Handler) RotateEnvironmentBadge(w http.ResponseWriter, r *http.Request) {
+	h.respondBadgeURL(w, r, true)
+}
+
+// respondBadgeURL responds with the environment's signed badge URLs, after rotating its secret
+// when rotate is set
+func (h *Handler) respondBadgeURL(w http.ResponseWriter, r *http.Request, rotate bool) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+	if h.badges == nil {
+		h.respondError(w, http.StatusNotFound, "status badges are not enabled", nil)
+		return
+	}
+	if _, err := h.orchestrator.GetEnvironment(ctx, envID); err != nil {
+		h.respondServiceError(w, "failed to get environment", err)
+		return
+	}
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionEditor, "insufficient permissions to share this environment's badge"); !ok {
+		return
+	}
+
+	sign := h.badges.BadgeSignature
+	if rotate {
+		sign = h.badges.RotateBadgeSecret
+	}
+	sig, err := sign(ctx, envID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to sign badge URL", err)
+		return
+	}
+	if rotate {
+		h.logger.Info("badge secret rotated", zap.String("environment_id", envID))
+	}
+
+	apiBase, _ := h.baseURLs(r)
+	badgeURL := apiBase + "/api/v1/environments/" + url.PathEscape(envID) + "/badge?sig=" + url.QueryEscape(sig)
+	h.respondJSON(w, http.StatusOK, &BadgeURLResponse{
+		BadgeURL: badgeURL,
+		SVGURL:   badgeURL + "&format=svg",
+	})
+}
+
+// badgeColors are the SVG badge colors per environment status
+var badgeColors = map[string]string{
+	string(models.StatusRunning):     "#4c1",
+	string(models.StatusPending):     "#dfb317",
+	string(models.StatusDegraded):    "#fe7d37",
+	string(models.StatusFailed):      "#e05d44",
+	string(models.StatusTerminating): "#9f9f9f",
+	string(models.StatusTerminated):  "#9f9f9f",
+}
+
+// badgeSVG renders a flat two-part badge: the environment's name and its status
+func badgeSVG(name, status string) string {
+	color, ok := badgeColors[status]
+	if !ok {
+		color = "#9f9f9f"
+	}
+	if utf8.RuneCountInString(name) > 40 {
+		name = string([]rune(name)[:40])
+	}
+	// Approximate text widths (7px per character plus padding)
+	left, right := 7*utf8.RuneCountInString(name)+10, 7*utf8.RuneCountInString(status)+10
+	name, status = html.EscapeString(name), html.EscapeString(status)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">`+
+		`<rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="14">%[4]s</text><text x="%[8]d" y="14">%[5]s</text></g></svg>`,
+		left+right, left, right, name, status, color, left/2, left+right/2)
+}
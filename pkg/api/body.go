@@ -0,0 +1,107 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sciffer/agentbox/internal/config"
+)
+
+// bodyLimitMiddleware caps request bodies at the limit of the matched route's group and
+// decompresses gzip-encoded bodies, applying the limit to the decompressed size. Handlers see a
+// body that fails with *http.MaxBytesError once the limit is exceeded (see requestBodyError).
+func bodyLimitMiddleware(limits config.BodyLimitsConfig) mux.MiddlewareFunc {
+	limits = limits.WithDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := routeBodyLimit(r, limits)
+			if r.ContentLength > limit {
+				// Declared too large: reject without reading it
+				status, message := requestBodyError(&http.MaxBytesError{Limit: limit}, "")
+				writeErrorResponse(w, status, message, nil)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+			switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+			case "", "identity":
+			case "gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					status, message := requestBodyError(err, "invalid gzip request body")
+					writeErrorResponse(w, status, message, err)
+					return
+				}
+				r.Body = http.MaxBytesReader(w, gzipBody{Reader: zr, compressed: r.Body}, limit)
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
+			default:
+				writeErrorResponse(w, http.StatusUnsupportedMediaType,
+					fmt.Sprintf("unsupported Content-Encoding %q (only gzip is accepted)", encoding), nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeBodyLimit returns the body limit for the route group r matched
+func routeBodyLimit(r *http.Request, limits config.BodyLimitsConfig) int64 {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return limits.Default
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return limits.Default
+	}
+	switch strings.TrimPrefix(template, "/api/v1") {
+	case "/environments", "/environments/{id}", "/environments/{id}/labels", "/environment-groups", "/environment-groups/{id}":
+		return limits.Environments
+	case "/environments/import":
+		return limits.Import
+	case "/environments/{id}/exec", "/environments/{id}/run", "/environments/{id}/pipelines":
+		return limits.Exec
+	}
+	return limits.Default
+}
+
+// gzipBody is a decompressing request body; closing it closes the compressed body too
+type gzipBody struct {
+	*gzip.Reader
+	compressed io.Closer
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.compressed.Close()
+}
+
+// requestBodyError returns the status and message for an error reading or decoding a request
+// body: 413 naming the limit when the body is too large, 400 with message otherwise
+func requestBodyError(err error, message string) (int, string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large: the limit for this endpoint is %d bytes", tooLarge.Limit)
+	}
+	return http.StatusBadRequest, message
+}
+
+// writeErrorResponse writes an ErrorResponse from middleware that has no handler to report through
+func writeErrorResponse(w http.ResponseWriter, status int, message string, err error) {
+	errMsg := message
+	if err != nil {
+		errMsg = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(newErrorResponse(status, message, errMsg, err))
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// minCompressBytes is the smallest response worth compressing; shorter ones are sent as is
+const minCompressBytes = 1024
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// compressionMiddleware gzips responses for clients that send Accept-Encoding: gzip. WebSocket
+// upgrades, Server-Sent Events streams and responses that are already encoded are passed through.
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether compressing it is
+// worthwhile: the body reaches minCompressBytes (compress) or the handler finishes or flushes
+// first (compress only if large enough; streams are never compressed).
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool // handler called WriteHeader (recorded, not yet sent)
+	decided     bool // headers sent; gz is set when compressing
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader || g.decided {
+		return
+	}
+	g.wroteHeader = true
+	g.status = status
+	// Informational, no-content and not-modified responses have no body to compress
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		g.start(false)
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.decided {
+		if !g.compressible() {
+			g.start(false)
+		} else {
+			g.buf = append(g.buf, p...)
+			if len(g.buf) < minCompressBytes {
+				return len(p), nil
+			}
+			g.start(true)
+			return len(p), nil
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// compressible reports whether the response headers set so far allow compression
+func (g *gzipResponseWriter) compressible() bool {
+	h := g.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	return !strings.HasPrefix(h.Get("Content-Type"), "text/event-stream")
+}
+
+// start sends the headers and any buffered body, compressed or not
+func (g *gzipResponseWriter) start(compress bool) {
+	g.decided = true
+	h := g.ResponseWriter.Header()
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzipWriterPool.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) > 0 {
+		buf := g.buf
+		g.buf = nil
+		if g.gz != nil {
+			_, _ = g.gz.Write(buf)
+		} else {
+			_, _ = g.ResponseWriter.Write(buf)
+		}
+	}
+}
+
+// Flush sends what has been written so far. A response flushed before reaching
+// minCompressBytes is a stream and is sent uncompressed.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.start(false)
+	}
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets handlers that take over the connection do so when no response was started
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := g.ResponseWriter.(http.Hijacker); ok && !g.decided {
+		g.decided = true
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Close finishes the response: it sends a short buffered body uncompressed and completes the
+// gzip stream of a compressed one
+func (g *gzipResponseWriter) Close() {
+	if !g.decided {
+		if !g.wroteHeader && len(g.buf) == 0 {
+			// Nothing written: let net/http send its default empty 200
+			return
+		}
+		g.start(false)
+	}
+	if g.gz != nil {
+		_ = g.gz.Close()
+		gzipWriterPool.Put(g.gz)
+		g.gz = nil
+	}
+}
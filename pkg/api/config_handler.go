@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// ConfigHandler exposes the effective server configuration to administrators
+type ConfigHandler struct {
+	store  *config.Store
+	logger *logger.Logger
+}
+
+// NewConfigHandler creates a new config handler
+func NewConfigHandler(store *config.Store, log *logger.Logger) *ConfigHandler {
+	return &ConfigHandler{
+		store:  store,
+		logger: log,
+	}
+}
+
+// ConfigResponse is the effective configuration (secrets redacted) plus its reload status
+type ConfigResponse struct {
+	Config map[string]interface{} `json:"config"`
+	config.ReloadStatus
+}
+
+// GetConfig handles GET /api/v1/admin/config (audit.read)
+func (h *ConfigHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(r.Context(), user, roles.CapAuditRead) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	effective, err := h.store.Current().Redacted()
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to read configuration", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, ConfigResponse{
+		Config:       effective,
+		ReloadStatus: h.store.Status(),
+	})
+}
+
+// Helper methods
+func (h *ConfigHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *ConfigHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// EnvironmentTokenHandler handles the environment-scoped token endpoints
+type EnvironmentTokenHandler struct {
+	authService       *auth.Service
+	permissionService *permissions.Service
+	orchestrator      *orchestrator.Orchestrator
+	logger            *logger.Logger
+}
+
+// NewEnvironmentTokenHandler creates a new environment token handler
+func NewEnvironmentTokenHandler(
+	authService *auth.Service, permissionService *permissions.Service,
+	orch *orchestrator.Orchestrator, log *logger.Logger,
+) *EnvironmentTokenHandler {
+	return &EnvironmentTokenHandler{
+		authService:       authService,
+		permissionService: permissionService,
+		orchestrator:      orch,
+		logger:            log,
+	}
+}
+
+// CreateEnvironmentTokenRequest is the request body for creating an environment token
+type CreateEnvironmentTokenRequest struct {
+	// Permission is viewer, editor or owner (default: editor); it cannot exceed the caller's own
+	Permission  string `json:"permission"`
+	Description string `json:"description,omitempty"`
+	// TTLSeconds is the token lifetime (default and cap: auth.environment_tokens.max_ttl_seconds)
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+// CreateToken handles POST /api/v1/environments/{id}/tokens
+func (h *EnvironmentTokenHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+	// A token would outlive the impersonation session
+	if rejectImpersonated(w, r, "create environment tokens") {
+		return
+	}
+
+	var req CreateEnvironmentTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Permission == "" {
+		req.Permission = permissions.PermissionEditor
+	}
+	if !permissions.ValidatePermission(req.Permission) {
+		h.respondError(w, http.StatusBadRequest, "invalid permission level: "+req.Permission, nil)
+		return
+	}
+	if req.TTLSeconds < 0 {
+		h.respondError(w, http.StatusBadRequest, "ttl_seconds must not be negative", nil)
+		return
+	}
+
+	// Tokens can only be given permissions their creator holds
+	user, ok := h.requireAccess(w, r, envID, req.Permission)
+	if !ok {
+		return
+	}
+
+	token, err := h.authService.CreateEnvironmentToken(ctx, envID, user.ID, req.Permission, req.Description,
+		time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		h.respondServiceError(w, "failed to create environment token", err)
+		return
+	}
+
+	h.logger.Info("environment token created",
+		zap.String("environment_id", envID),
+		zap.String("token_id", token.ID),
+		zap.String("user_id", user.ID),
+		zap.String("permission", token.Permission),
+	)
+
+	h.respondJSON(w, http.StatusCreated, token)
+}
+
+// ListTokens handles GET /api/v1/environments/{id}/tokens
+func (h *EnvironmentTokenHandler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireAccess(w, r, envID, permissions.PermissionEditor); !ok {
+		return
+	}
+
+	tokens, err := h.authService.ListEnvironmentTokens(r.Context(), envID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list environment tokens", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+		"total":  len(tokens),
+	})
+}
+
+// RevokeToken handles DELETE /api/v1/environments/{id}/tokens/{tokenId}
+func (h *EnvironmentTokenHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	envID := vars["id"]
+	if _, ok := h.requireAccess(w, r, envID, permissions.PermissionEditor); !ok {
+		return
+	}
+
+	if err := h.authService.RevokeEnvironmentToken(r.Context(), envID, vars["tokenId"]); err != nil {
+		h.respondServiceError(w, "failed to revoke environment token", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireAccess checks that the environment exists and that the current user owns it or holds
+// at least the required permission on it. Environment tokens cannot manage tokens.
+func (h *EnvironmentTokenHandler) requireAccess(w http.ResponseWriter, r *http.Request, envID, required string) (*users.User, bool) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok || user == nil {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return nil, false
+	}
+	if _, scoped := auth.GetEnvironmentScopeFromContext(ctx); scoped {
+		h.respondError(w, http.StatusForbidden, "environment tokens cannot manage tokens", nil)
+		return nil, false
+	}
+
+	env, err := h.orchestrator.GetEnvironment(ctx, envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get environment", err)
+		return nil, false
+	}
+	if env.UserID == user.ID {
+		return user, true
+	}
+	allowed, err := h.permissionService.CheckAccess(ctx, user, envID, required)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
+		return nil, false
+	}
+	if !allowed {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions on this environment", nil)
+		return nil, false
+	}
+	return user, true
+}
+
+func (h *EnvironmentTokenHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *EnvironmentTokenHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil && status >= 400 && status < 500 {
+		errMsg = err.Error()
+	}
+
+	h.respondJSON(w, status, newErrorResponse(status, message, errMsg, err))
+}
+
+func (h *EnvironmentTokenHandler) respondServiceError(w http.ResponseWriter, message string, err error) {
+	status := apierrors.HTTPStatus(err)
+	if status < http.StatusInternalServerError {
+		if msg := apierrors.MessageOf(err); msg != "" {
+			message = msg
+		}
+	}
+	h.respondError(w, status, message, err)
+}
+
+// environmentScopeMiddleware restricts requests authenticated with an environment token to the
+// routes of that token's environment (and its executions), at the token's permission level:
+// reads need viewer, changes, attaching and port forwarding need editor and deleting the environment
+// (including archive-then-delete) needs owner.
+func environmentScopeMiddleware(orch *orchestrator.Orchestrator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope, ok := auth.GetEnvironmentScopeFromContext(r.Context())
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !scopeAllows(r, orch, scope) {
+				writeErrorResponse(w, http.StatusForbidden, "this token is limited to environment "+scope.EnvironmentID, nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// scopeAllows reports whether an environment-scoped request may use the route it matched
+func scopeAllows(r *http.Request, orch *orchestrator.Orchestrator, scope *auth.EnvironmentScope) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	template = strings.TrimPrefix(template, "/api/v1")
+	id := mux.Vars(r)["id"]
+
+	var envID string
+	switch {
+	case template == "/environments/{id}" || strings.HasPrefix(template, "/environments/{id}/"):
+		envID = id
+	case template == "/executions/{id}" || strings.HasPrefix(template, "/executions/{id}/"):
+		exec, err := orch.GetExecution(r.Context(), id)
+		if err != nil {
+			// Unknown executions are reported as such by the handler
+			return apierrors.KindOf(err) == apierrors.NotFound
+		}
+		envID = exec.EnvironmentID
+	case template == "/pipelines/{id}":
+		pipeline, err := orch.GetPipeline(r.Context(), id)
+		if err != nil {
+			// Unknown pipelines are reported as such by the handler
+			return apierrors.KindOf(err) == apierrors.NotFound
+		}
+		envID = pipeline.EnvironmentID
+	default:
+		return false
+	}
+
+	required := permissions.PermissionEditor
+	switch {
+	case template == "/environments/{id}/attach", template == "/environments/{id}/port-forward":
+		// An interactive shell, or a service in the pod, can change the environment
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		required = permissions.PermissionViewer
+	case r.Method == http.MethodDelete && template == "/environments/{id}",
+		r.Method == http.MethodPost && template == "/environments/{id}/archive":
+		required = permissions.PermissionOwner
+	}
+	return permissions.CheckScopedAccess(scope.EnvironmentID, scope.Permission, envID, required)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// WaitForEnvironment handles GET /environments/{id}/wait?timeout=60
+// Long-polls until the environment is running or failed (or is being deleted), or timeout seconds
+// pass: 200 with the environment once it settled, otherwise 202 with its current state. With
+// ?stream=true or Accept: text/event-stream, every status change is sent as a Server-Sent Event.
+func (h *Handler) WaitForEnvironment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+
+	wait, err := environmentWaitSeconds(r, "timeout", orchestrator.DefaultEnvironmentWaitSeconds)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid timeout", err)
+		return
+	}
+
+	if r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.streamEnvironmentStatus(w, r, envID, wait)
+		return
+	}
+
+	// Allow the response to outlive the server's default write timeout (best effort)
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 30*time.Second))
+
+	env, settled, err := h.orchestrator.WaitForEnvironment(ctx, envID, wait)
+	if err != nil {
+		if ctx.Err() != nil {
+			h.logger.Info("client disconnected while waiting for environment", zap.String("environment_id", envID))
+			return
+		}
+		h.respondError(w, http.StatusNotFound, "environment not found", err)
+		return
+	}
+
+	h.setEnvironmentURLs(r, env)
+	if !settled {
+		h.respondJSON(w, http.StatusAccepted, env)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, env)
+}
+
+// streamEnvironmentStatus sends the environment as a "status" event now and after every status
+// change until it settles; a "timeout" event ends the stream when wait elapses first and an
+// "error" event when the environment is deleted
+func (h *Handler) streamEnvironmentStatus(w http.ResponseWriter, r *http.Request, envID string, wait time.Duration) {
+	ctx := r.Context()
+
+	// Watch before the first read so a change in between is not missed
+	changed, release := h.orchestrator.WatchEnvironmentStatus(envID)
+	defer release()
+
+	// Fail fast with a regular JSON error before switching to SSE
+	env, err := h.orchestrator.GetEnvironment(ctx, envID)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "environment not found", err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.logger.Error("streaming not supported")
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Set up SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx buffering
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	//nolint:errcheck // Not supported by every ResponseWriter (e.g. httptest), streaming still works
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 30*time.Second))
+
+	sendEvent := func(event string, data interface{}) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			h.logger.Warn("failed to marshal environment event", zap.Error(err))
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var last models.EnvironmentStatus
+	for {
+		if env.Status != last {
+			h.setEnvironmentURLs(r, env)
+			sendEvent("status", env)
+			last = env.Status
+		}
+		if env.Status.IsSettled() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			sendEvent("timeout", map[string]interface{}{"status": env.Status})
+			return
+		case <-changed:
+		}
+
+		if env, err = h.orchestrator.GetEnvironment(ctx, envID); err != nil {
+			sendEvent("error", map[string]string{"error": "environment not found"})
+			return
+		}
+	}
+}
+
+// environmentWaitSeconds parses how long to wait for an environment from the named query
+// parameter (def when absent), between 0 and orchestrator.MaxEnvironmentWaitSeconds
+func environmentWaitSeconds(r *http.Request, name string, def int) (time.Duration, error) {
+	seconds := def
+	if v := r.URL.Query().Get(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be an integer", name)
+		}
+		seconds = n
+	}
+	if seconds < 0 || seconds > orchestrator.MaxEnvironmentWaitSeconds {
+		return 0, fmt.Errorf("%s must be between 0 and %d", name, orchestrator.MaxEnvironmentWaitSeconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
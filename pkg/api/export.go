@@ -0,0 +1,273 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// maxImportDocuments limits the number of environment documents in one import request
+const maxImportDocuments = 100
+
+// ExportEnvironment handles GET /environments/{id}/export
+// Returns the environment's definition as a CreateEnvironmentRequest document: YAML by default,
+// JSON with ?format=json or Accept: application/json
+func (h *Handler) ExportEnvironment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+
+	env, err := h.orchestrator.GetEnvironment(ctx, envID)
+	if err != nil {
+		h.respondServiceError(w, "environment not found", err)
+		return
+	}
+	spec := orchestrator.EnvironmentSpec(env)
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "application/json") {
+		format = "json"
+	}
+	switch format {
+	case "json":
+		h.respondJSON(w, http.StatusOK, spec)
+	case "", "yaml":
+		data, err := specToYAML(spec)
+		if err != nil {
+			h.respondError(w, http.StatusInternalServerError, "failed to encode environment", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(data); err != nil {
+			h.logger.Error("failed to write YAML response", zap.Error(err))
+		}
+	default:
+		h.respondError(w, http.StatusBadRequest, "format must be yaml or json", nil)
+	}
+}
+
+// ImportEnvironments handles POST /environments/import
+// The body holds one or more environment documents (YAML, multi-document YAML, or JSON; a
+// document may also be a list). Each is applied by (user, name): created if missing, patched
+// if its spec changed, left alone otherwise. With ?dry_run=true nothing is changed.
+func (h *Handler) ImportEnvironments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	defer r.Body.Close()
+	// Read the body first: the YAML decoder does not preserve the size limit error
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		status, message := requestBodyError(err, "failed to read request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	docs, err := decodeEnvironmentDocuments(bytes.NewReader(body))
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		return
+	}
+	if len(docs) == 0 {
+		h.respondError(w, http.StatusBadRequest, "request body contains no environment documents", nil)
+		return
+	}
+	if len(docs) > maxImportDocuments {
+		h.respondError(w, http.StatusBadRequest, fmt.Sprintf("at most %d environment documents can be imported at once", maxImportDocuments), nil)
+		return
+	}
+
+	userID := getUserIDFromContext(ctx)
+	resp := models.ImportEnvironmentsResponse{DryRun: dryRun, Results: make([]models.ApplyResult, 0, len(docs))}
+	for i, doc := range docs {
+		result := models.ApplyResult{Index: i}
+		var spec models.CreateEnvironmentRequest
+		if err := decodeStrict(doc, &spec); err != nil {
+			result.Action = models.ApplyError
+			result.Error = "invalid environment document: " + err.Error()
+		} else {
+			result = h.applyEnvironmentSpec(ctx, &spec, userID, dryRun)
+			result.Index = i
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	h.logger.Info("environments imported",
+		zap.String("user_id", userID),
+		zap.Int("documents", len(docs)),
+		zap.Bool("dry_run", dryRun),
+	)
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// applyEnvironmentSpec creates or updates the user's environment named spec.Name to match spec
+func (h *Handler) applyEnvironmentSpec(ctx context.Context, spec *models.CreateEnvironmentRequest, userID string, dryRun bool) models.ApplyResult {
+	result := models.ApplyResult{Name: spec.Name, Action: models.ApplyError}
+
+	if err := h.orchestrator.ExpandNetworkPreset(spec.Isolation); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := h.validator.ValidateCreateRequest(spec); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if spec.CommandPolicy != nil && spec.CommandPolicy.Unrestricted {
+		if !hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+			result.Error = "only admins can make an environment unrestricted"
+			return result
+		}
+	}
+	if spec.Isolation != nil && spec.Isolation.ExecInheritSecurityContext && !hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		result.Error = "only admins can set isolation.exec_inherit_security_context"
+		return result
+	}
+	if err := privilegedSecurityContextError(ctx, spec.Isolation); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	existing, err := h.orchestrator.FindEnvironmentByName(ctx, userID, spec.Name)
+	if errors.Is(err, apierrors.NotFound) {
+		if spec.TeamID != "" {
+			if err := h.teamCreateError(ctx, spec.TeamID); err != nil {
+				result.Error = err.Error()
+				return result
+			}
+		}
+		result.Action = models.ApplyCreated
+		if dryRun {
+			return result
+		}
+		env, err := h.orchestrator.CreateEnvironment(ctx, spec, userID)
+		if err != nil {
+			result.Action = models.ApplyError
+			result.Error = err.Error()
+			return result
+		}
+		result.EnvironmentID = env.ID
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.EnvironmentID = existing.ID
+
+	if h.permissionService != nil {
+		user, ok := auth.GetUserFromContext(ctx)
+		if !ok || user == nil {
+			result.Error = "not authenticated"
+			return result
+		}
+		allowed, err := h.permissionService.CheckAccess(ctx, user, existing.ID, permissions.PermissionEditor)
+		if err != nil || !allowed {
+			result.Error = "insufficient permissions to edit this environment"
+			return result
+		}
+	}
+
+	patch, changes, err := orchestrator.PlanEnvironmentUpdate(existing, spec)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(changes) == 0 {
+		result.Action = models.ApplyUnchanged
+		return result
+	}
+	result.Action = models.ApplyUpdated
+	result.Changes = changes
+	if dryRun {
+		return result
+	}
+	if _, err := h.orchestrator.UpdateEnvironment(ctx, existing.ID, patch); err != nil {
+		result.Action = models.ApplyError
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// decodeEnvironmentDocuments splits a YAML (or JSON) stream into environment documents; a
+// document holding a list contributes each of its items
+func decodeEnvironmentDocuments(body io.Reader) ([]interface{}, error) {
+	var docs []interface{}
+	decoder := yaml.NewDecoder(body)
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch v := doc.(type) {
+		case nil:
+			// Empty document (e.g. a trailing "---")
+		case []interface{}:
+			docs = append(docs, v...)
+		default:
+			docs = append(docs, v)
+		}
+	}
+}
+
+// decodeStrict converts a decoded YAML document into out via its JSON form, rejecting unknown
+// fields so typos (or runtime fields such as status) are reported instead of silently ignored
+func decodeStrict(doc interface{}, out interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// specToYAML renders v as YAML using its JSON field names and order
+func specToYAML(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML: parse it into a node tree (keeping key order) and re-emit it in block style
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&node)
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// clearYAMLStyle resets the flow and quoting styles inherited from JSON
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
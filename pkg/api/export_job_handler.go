@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/exports"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// ExportJobHandler handles data export endpoints
+type ExportJobHandler struct {
+	exportService *exports.Service
+	logger        *logger.Logger
+}
+
+// NewExportJobHandler creates a new export job handler
+func NewExportJobHandler(exportService *exports.Service, log *logger.Logger) *ExportJobHandler {
+	return &ExportJobHandler{
+		exportService: exportService,
+		logger:        log,
+	}
+}
+
+// CreateExport handles POST /api/v1/admin/exports (audit.read and environments.read_all)
+// Starts an export of the records created in [from, to); returns 202 with the pending job.
+func (h *ExportJobHandler) CreateExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	// Exports copy the audit log and every environment's executions out of the platform
+	if !roles.Has(ctx, user, roles.CapAuditRead) || !roles.Has(ctx, user, roles.CapEnvironmentsReadAll) {
+		h.respondError(w, http.StatusForbidden, "audit.read and environments.read_all capabilities required", nil)
+		return
+	}
+
+	var req models.CreateExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	job, err := h.exportService.CreateJob(ctx, &req, user.ID)
+	if err != nil {
+		h.respondExportError(w, "failed to create export", err)
+		return
+	}
+
+	h.logger.Info("export requested",
+		zap.String("job_id", job.ID),
+		zap.String("created_by", user.ID),
+	)
+
+	h.respondJSON(w, http.StatusAccepted, job)
+}
+
+// ListExports handles GET /api/v1/admin/exports (audit.read)
+// Returns export jobs newest first, filtered by ?status= (at most ?limit=, default 50, max 500)
+func (h *ExportJobHandler) ListExports(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !hasCapability(ctx, roles.CapAuditRead) {
+		h.respondError(w, http.StatusForbidden, "audit.read capability required", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	status := models.ExportJobStatus(query.Get("status"))
+	switch status {
+	case "", models.ExportJobPending, models.ExportJobRunning, models.ExportJobSucceeded, models.ExportJobFailed:
+	default:
+		h.respondError(w, http.StatusBadRequest, "invalid status (expected pending, running, succeeded or failed)", nil)
+		return
+	}
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			h.respondError(w, http.StatusBadRequest, "invalid limit (expected a positive integer)", err)
+			return
+		}
+		limit = n
+	}
+
+	jobs, err := h.exportService.ListJobs(ctx, status, limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list exports", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"exports":    jobs,
+		"total":      len(jobs),
+		"configured": h.exportService.Configured(),
+	})
+}
+
+// GetExport handles GET /api/v1/admin/exports/{id} (audit.read)
+func (h *ExportJobHandler) GetExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !hasCapability(ctx, roles.CapAuditRead) {
+		h.respondError(w, http.StatusForbidden, "audit.read capability required", nil)
+		return
+	}
+
+	job, err := h.exportService.GetJob(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		h.respondExportError(w, "failed to get export", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, job)
+}
+
+// RetryExport handles POST /api/v1/admin/exports/{id}/retry (audit.read and environments.read_all)
+// Re-queues a failed export; it continues from its last checkpoint.
+func (h *ExportJobHandler) RetryExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, user, roles.CapAuditRead) || !roles.Has(ctx, user, roles.CapEnvironmentsReadAll) {
+		h.respondError(w, http.StatusForbidden, "audit.read and environments.read_all capabilities required", nil)
+		return
+	}
+
+	job, err := h.exportService.RetryJob(ctx, mux.Vars(r)["id"], user.ID)
+	if err != nil {
+		h.respondExportError(w, "failed to retry export", err)
+		return
+	}
+	h.respondJSON(w, http.StatusAccepted, job)
+}
+
+// respondExportError maps export service errors to HTTP status codes
+func (h *ExportJobHandler) respondExportError(w http.ResponseWriter, message string, err error) {
+	if apierrors.KindOf(err) != nil {
+		h.respondError(w, apierrors.HTTPStatus(err), err.Error(), err)
+		return
+	}
+	h.respondError(w, http.StatusInternalServerError, message, err)
+}
+
+// Helper methods
+func (h *ExportJobHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *ExportJobHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
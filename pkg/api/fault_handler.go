@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/impersonation"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// FaultHandler lets super admins inject faults into Kubernetes API calls for chaos testing. It
+// is only registered when kubernetes.insecure_fault_injection is enabled.
+type FaultHandler struct {
+	faults *k8s.FaultInjector
+	logger *logger.Logger
+}
+
+// NewFaultHandler creates a new fault handler
+func NewFaultHandler(faults *k8s.FaultInjector, log *logger.Logger) *FaultHandler {
+	return &FaultHandler{
+		faults: faults,
+		logger: log,
+	}
+}
+
+// FaultsResponse lists the active faults
+type FaultsResponse struct {
+	Faults []k8s.Fault `json:"faults"`
+}
+
+// ListFaults handles GET /api/v1/admin/faults (super admins)
+func (h *FaultHandler) ListFaults(w http.ResponseWriter, r *http.Request) {
+	if !h.requireSuperAdmin(w, r) {
+		return
+	}
+	h.respondJSON(w, http.StatusOK, FaultsResponse{Faults: h.faults.List()})
+}
+
+// SetFault handles PUT /api/v1/admin/faults (super admins)
+// Adds a fault, replacing the active fault of the same method
+func (h *FaultHandler) SetFault(w http.ResponseWriter, r *http.Request) {
+	if !h.requireSuperAdmin(w, r) {
+		return
+	}
+
+	var fault k8s.Fault
+	if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := h.faults.Set(fault); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid fault", err)
+		return
+	}
+
+	user, _ := auth.GetUserFromContext(r.Context())
+	h.logger.Warn("kubernetes fault injection changed",
+		zap.String("user_id", user.ID),
+		zap.String("method", fault.Method),
+		zap.Int("latency_ms", fault.LatencyMs),
+		zap.Float64("error_rate", fault.ErrorRate),
+		zap.String("error", fault.Error),
+	)
+	h.respondJSON(w, http.StatusOK, FaultsResponse{Faults: h.faults.List()})
+}
+
+// DeleteFault handles DELETE /api/v1/admin/faults/{method} (super admins)
+func (h *FaultHandler) DeleteFault(w http.ResponseWriter, r *http.Request) {
+	if !h.requireSuperAdmin(w, r) {
+		return
+	}
+	method := mux.Vars(r)["method"]
+	if !h.faults.Remove(method) {
+		h.respondError(w, http.StatusNotFound, "no fault for method "+method, nil)
+		return
+	}
+	h.logger.Warn("kubernetes fault removed", zap.String("method", method))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ClearFaults handles DELETE /api/v1/admin/faults (super admins)
+func (h *FaultHandler) ClearFaults(w http.ResponseWriter, r *http.Request) {
+	if !h.requireSuperAdmin(w, r) {
+		return
+	}
+	h.faults.Clear()
+	h.logger.Warn("kubernetes faults cleared")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *FaultHandler) requireSuperAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return false
+	}
+	if _, impersonated := impersonation.FromContext(r.Context()); impersonated || user.Role != users.RoleSuperAdmin {
+		h.respondError(w, http.StatusForbidden, "super admin role required", nil)
+		return false
+	}
+	return true
+}
+
+func (h *FaultHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *FaultHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil && status >= 400 && status < 500 {
+		errMsg = err.Error()
+	}
+
+	h.respondJSON(w, status, newErrorResponse(status, message, errMsg, err))
+}
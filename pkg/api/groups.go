@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// CreateEnvironmentGroup handles POST /environment-groups
+// Creates a group and `replicas` environments from its template. Replicas that cannot be created
+// (e.g. the team quota is exhausted) are listed in the response's errors; the group is still created.
+func (h *Handler) CreateEnvironmentGroup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req models.CreateEnvironmentGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	// Replicas are named after the group, so validate the template under that name
+	req.Template.Name = req.Name
+	if !h.expandNetworkPreset(w, req.Template.Isolation) {
+		return
+	}
+	if err := h.validator.ValidateCreateRequest(&req.Template); err != nil {
+		h.respondValidationError(w, "validation failed", err)
+		return
+	}
+	if !h.checkUnrestrictedPolicy(w, r, req.Template.CommandPolicy) || !h.checkExecSecurityInherit(w, r, req.Template.Isolation) ||
+		!h.checkPrivilegedSecurityContext(w, r, req.Template.Isolation) ||
+		!h.checkReadinessCommand(w, r, "", req.Template.CommandPolicy, req.Template.ReadinessCheck) {
+		return
+	}
+	if req.Template.TeamID != "" && !h.checkTeamCreate(w, r, req.Template.TeamID) {
+		return
+	}
+
+	userID := getUserIDFromContext(ctx)
+	group, err := h.orchestrator.CreateEnvironmentGroup(ctx, &req, userID, h.replicaAdmission(req.Template.TeamID))
+	if err != nil {
+		h.respondServiceError(w, "failed to create environment group", err)
+		return
+	}
+
+	h.logger.Info("environment group created",
+		zap.String("group_id", group.ID),
+		zap.String("user_id", userID),
+		zap.Int("replicas", group.Replicas),
+	)
+	h.respondJSON(w, http.StatusCreated, group)
+}
+
+// ListEnvironmentGroups handles GET /environment-groups
+func (h *Handler) ListEnvironmentGroups(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.orchestrator.ListEnvironmentGroups(r.Context())
+	if err != nil {
+		h.respondServiceError(w, "failed to list environment groups", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// GetEnvironmentGroup handles GET /environment-groups/{id}
+// Returns the group with replica counts per status and the IDs of its environments
+func (h *Handler) GetEnvironmentGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := h.orchestrator.GetEnvironmentGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.respondServiceError(w, "failed to get environment group", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, group)
+}
+
+// UpdateEnvironmentGroup handles PATCH /environment-groups/{id}
+// Request body: {"replicas": N} scales the group up or down
+func (h *Handler) UpdateEnvironmentGroup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	groupID := mux.Vars(r)["id"]
+
+	var req models.UpdateEnvironmentGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+	if req.Replicas == nil {
+		h.respondError(w, http.StatusBadRequest, "replicas is required", nil)
+		return
+	}
+
+	group, ok := h.requireGroupEdit(w, r, groupID)
+	if !ok {
+		return
+	}
+
+	group, err := h.orchestrator.ScaleEnvironmentGroup(ctx, groupID, *req.Replicas, h.replicaAdmission(group.TeamID))
+	if err != nil {
+		h.respondServiceError(w, "failed to scale environment group", err)
+		return
+	}
+
+	h.logger.Info("environment group scaled",
+		zap.String("group_id", groupID),
+		zap.Int("replicas", group.Replicas),
+	)
+	h.respondJSON(w, http.StatusOK, group)
+}
+
+// DeleteEnvironmentGroup handles DELETE /environment-groups/{id}
+// Deletes every environment of the group (with ?force=true, immediately) and then the group
+func (h *Handler) DeleteEnvironmentGroup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	groupID := mux.Vars(r)["id"]
+	force := r.URL.Query().Get("force") == "true"
+
+	if _, ok := h.requireGroupEdit(w, r, groupID); !ok {
+		return
+	}
+
+	if err := h.orchestrator.DeleteEnvironmentGroup(ctx, groupID, force); err != nil {
+		h.respondServiceError(w, "failed to delete environment group", err)
+		return
+	}
+
+	h.logger.Info("environment group deleted",
+		zap.String("group_id", groupID),
+		zap.Bool("force", force),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replicaAdmission checks the team quota before each replica of a team's group is created
+func (h *Handler) replicaAdmission(teamID string) orchestrator.ReplicaAdmission {
+	if teamID == "" || h.teamService == nil {
+		return nil
+	}
+	return func(ctx context.Context) error {
+		return h.teamService.CheckQuota(ctx, teamID)
+	}
+}
+
+// requireGroupEdit loads the group and checks that the user may change it: its creator, an
+// admin, or for a team's group an editor of the team. Writes the error response when not.
+func (h *Handler) requireGroupEdit(w http.ResponseWriter, r *http.Request, groupID string) (*models.EnvironmentGroup, bool) {
+	ctx := r.Context()
+	group, err := h.orchestrator.GetEnvironmentGroup(ctx, groupID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get environment group", err)
+		return nil, false
+	}
+	if h.permissionService == nil {
+		return group, true
+	}
+
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok || user == nil {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return nil, false
+	}
+	if roles.HasAny(ctx, user, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) || user.ID == group.UserID {
+		return group, true
+	}
+	if group.TeamID != "" {
+		allowed, err := h.permissionService.CheckTeamAccess(ctx, user, group.TeamID, permissions.PermissionEditor)
+		if err != nil {
+			h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
+			return nil, false
+		}
+		if allowed {
+			return group, true
+		}
+	}
+	h.respondError(w, http.StatusForbidden, "insufficient permissions to change this environment group", nil)
+	return nil, false
+}
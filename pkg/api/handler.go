@@ -4,21 +4,33 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/k8s"
 	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/orchestrator"
 	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/preferences"
+	"github.com/sciffer/agentbox/pkg/recording"
+	"github.com/sciffer/agentbox/pkg/registry"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/storage"
+	"github.com/sciffer/agentbox/pkg/teams"
 	"github.com/sciffer/agentbox/pkg/users"
 	"github.com/sciffer/agentbox/pkg/validator"
 )
@@ -29,21 +41,102 @@ type Handler struct {
 	validator         *validator.Validator
 	logger            *logger.Logger
 	permissionService *permissions.Service
+	teamService       *teams.Service
+	recordings        *recording.Service
+	registry          *registry.Client
+	// storage is the shared storage backend stored archives are written to (nil disables them)
+	storage       storage.Backend
+	presignExpiry time.Duration
+	// preferences supplies the default resource profile of environments created without resources
+	preferences *preferences.Service
+	// externalURL and wsScheme build the environment URLs in responses (see setEnvironmentURLs)
+	externalURL *url.URL
+	wsScheme    string
+	// badges keeps the secrets status badge URLs are signed with (nil: badges disabled)
+	badges *auth.Service
+	// callbacks validates the callback tokens executions report results with (nil: reports disabled)
+	callbacks *auth.Service
+	// configStore reports the config reload counters on /metrics (nil: not exported)
+	configStore *config.Store
 }
 
 // NewHandler creates a new API handler
-func NewHandler(orch *orchestrator.Orchestrator, val *validator.Validator, log *logger.Logger, permissionService *permissions.Service) *Handler {
+func NewHandler(
+	orch *orchestrator.Orchestrator, val *validator.Validator, log *logger.Logger,
+	permissionService *permissions.Service, teamService *teams.Service,
+) *Handler {
 	return &Handler{
 		orchestrator:      orch,
 		validator:         val,
 		logger:            log,
 		permissionService: permissionService,
+		teamService:       teamService,
 	}
 }
 
+// SetRecordingService enables recording of attach sessions for environments that opt in
+func (h *Handler) SetRecordingService(recordings *recording.Service) {
+	h.recordings = recordings
+}
+
+// SetStorage enables stored archives in the shared storage backend; presignExpiry is the
+// validity of their download URLs
+func (h *Handler) SetStorage(store storage.Backend, presignExpiry time.Duration) {
+	h.storage = store
+	h.presignExpiry = presignExpiry
+}
+
+// SetConfigStore exports the config reload counters of store on /metrics
+func (h *Handler) SetConfigStore(store *config.Store) {
+	h.configStore = store
+}
+
+// SetRegistryClient enables image inspection through the given registry client
+func (h *Handler) SetRegistryClient(client *registry.Client) {
+	h.registry = client
+}
+
+// SetPreferencesService gives environments created without resources the resources of their
+// creator's default profile
+func (h *Handler) SetPreferencesService(preferencesService *preferences.Service) {
+	h.preferences = preferencesService
+}
+
+// applyDefaultProfile fills the resources of a create request that sets none from the default
+// profile of the user creating it; requests without a default profile are left to validation
+func (h *Handler) applyDefaultProfile(ctx context.Context, req *models.CreateEnvironmentRequest, userID string) {
+	if h.preferences == nil || req.Resources != (models.ResourceSpec{}) {
+		return
+	}
+	prefs, err := h.preferences.Effective(ctx, userID)
+	if err != nil {
+		h.logger.Warn("failed to get preferences", zap.String("user_id", userID), zap.Error(err))
+		return
+	}
+	if prefs.DefaultProfile == "" {
+		return
+	}
+	if spec, ok := h.preferences.Profile(prefs.DefaultProfile); ok {
+		req.Resources = spec
+	}
+}
+
+// SetExternalURL sets the base URL clients reach the API at (nil derives it from each request)
+// and the scheme of attach URLs ("" follows the base URL: ws for http, wss for https)
+func (h *Handler) SetExternalURL(externalURL *url.URL, wsScheme string) {
+	h.externalURL = externalURL
+	h.wsScheme = wsScheme
+}
+
 // requireEnvEdit checks that the current user can edit the environment (super admin, env admin/editor, or owner).
 // When permissionService is nil (e.g. unit tests without auth), the check is skipped and the request is allowed.
 func (h *Handler) requireEnvEdit(w http.ResponseWriter, r *http.Request, envID string) (*users.User, bool) {
+	return h.requireEnvPermission(w, r, envID, permissions.PermissionEditor, "insufficient permissions to edit this environment")
+}
+
+// requireEnvPermission checks that the current user has at least the required permission on the
+// environment, responding with denied as the error otherwise. Skipped when permissionService is nil.
+func (h *Handler) requireEnvPermission(w http.ResponseWriter, r *http.Request, envID, required, denied string) (*users.User, bool) {
 	if h.permissionService == nil {
 		return nil, true
 	}
@@ -53,45 +146,65 @@ func (h *Handler) requireEnvEdit(w http.ResponseWriter, r *http.Request, envID s
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return nil, false
 	}
-	allowed, err := h.permissionService.CheckAccess(ctx, user, envID, permissions.PermissionEditor)
+	allowed, err := h.permissionService.CheckAccess(ctx, user, envID, required)
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
 		return nil, false
 	}
 	if !allowed {
-		h.respondError(w, http.StatusForbidden, "insufficient permissions to edit this environment", nil)
+		h.respondError(w, http.StatusForbidden, denied, nil)
 		return nil, false
 	}
 	return user, true
 }
 
 // CreateEnvironment handles POST /environments
+// With ?wait_seconds=N the response is held until the environment is running or failed, for at
+// most N seconds; the environment is returned in whatever state it reached
 func (h *Handler) CreateEnvironment(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Limit request body size to prevent abuse
-	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // 1MB limit
-
 	var req models.CreateEnvironmentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
 
+	// Get user ID from context (set by auth middleware)
+	userID := getUserIDFromContext(ctx)
+	h.applyDefaultProfile(ctx, &req, userID)
+	if !h.expandNetworkPreset(w, req.Isolation) {
+		return
+	}
+
 	// Validate request
 	if err := h.validator.ValidateCreateRequest(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "validation failed", err)
+		h.respondValidationError(w, "validation failed", err)
 		return
 	}
 
-	// Get user ID from context (set by auth middleware)
-	userID := getUserIDFromContext(ctx)
+	// ?wait_seconds= holds the response until the environment settles (see WaitForEnvironment)
+	wait, err := environmentWaitSeconds(r, "wait_seconds", 0)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid wait_seconds", err)
+		return
+	}
+
+	if !h.checkUnrestrictedPolicy(w, r, req.CommandPolicy) || !h.checkExecSecurityInherit(w, r, req.Isolation) ||
+		!h.checkPrivilegedSecurityContext(w, r, req.Isolation) || !h.checkReadinessCommand(w, r, "", req.CommandPolicy, req.ReadinessCheck) {
+		return
+	}
+
+	if req.TeamID != "" && !h.checkTeamCreate(w, r, req.TeamID) {
+		return
+	}
 
 	// Create environment
 	env, err := h.orchestrator.CreateEnvironment(ctx, &req, userID)
 	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, "failed to create environment", err)
+		h.respondServiceError(w, "failed to create environment", err)
 		return
 	}
 
@@ -100,9 +213,63 @@ func (h *Handler) CreateEnvironment(w http.ResponseWriter, r *http.Request) {
 		zap.String("user_id", userID),
 	)
 
+	if wait > 0 {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 30*time.Second))
+		waited, _, err := h.orchestrator.WaitForEnvironment(ctx, env.ID, wait)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Client went away; the environment keeps provisioning
+				h.logger.Info("client disconnected while waiting for environment", zap.String("environment_id", env.ID))
+				return
+			}
+			h.respondError(w, http.StatusNotFound, "environment not found", err)
+			return
+		}
+		waited.SchedulingWarning = env.SchedulingWarning
+		env = waited
+	}
+
+	h.setEnvironmentURLs(r, env)
 	h.respondJSON(w, http.StatusCreated, env)
 }
 
+// checkTeamCreate verifies that an environment can be created in the team: the team exists,
+// the user is an editor of it and the team's environment quota is not exhausted
+func (h *Handler) checkTeamCreate(w http.ResponseWriter, r *http.Request, teamID string) bool {
+	if err := h.teamCreateError(r.Context(), teamID); err != nil {
+		h.respondServiceError(w, "failed to check team", err)
+		return false
+	}
+	return true
+}
+
+// teamCreateError is checkTeamCreate without writing a response
+func (h *Handler) teamCreateError(ctx context.Context, teamID string) error {
+	if h.teamService == nil {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "teams are not enabled")
+	}
+
+	if _, err := h.teamService.GetTeam(ctx, teamID); err != nil {
+		return err
+	}
+
+	if h.permissionService != nil {
+		user, ok := auth.GetUserFromContext(ctx)
+		if !ok || user == nil {
+			return apierrors.New(apierrors.Unauthorized, "", "not authenticated")
+		}
+		allowed, err := h.permissionService.CheckTeamAccess(ctx, user, teamID, permissions.PermissionEditor)
+		if err != nil {
+			return fmt.Errorf("failed to check permissions: %w", err)
+		}
+		if !allowed {
+			return apierrors.New(apierrors.Forbidden, "", "insufficient permissions to create environments in this team")
+		}
+	}
+
+	return h.teamService.CheckQuota(ctx, teamID)
+}
+
 // GetEnvironment handles GET /environments/{id}
 func (h *Handler) GetEnvironment(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -115,6 +282,7 @@ func (h *Handler) GetEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.setEnvironmentURLs(r, env)
 	h.respondJSON(w, http.StatusOK, env)
 }
 
@@ -147,25 +315,37 @@ func (h *Handler) ListEnvironments(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	resp, err := h.orchestrator.ListEnvironments(ctx, status, labelSelector, limit, offset)
+	resp, err := h.orchestrator.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{
+		Status:        status,
+		LabelSelector: labelSelector,
+		TeamID:        query.Get("team"),
+		GroupID:       query.Get("group"),
+		UserID:        query.Get("user_id"),
+		Limit:         limit,
+		Offset:        offset,
+		PageToken:     query.Get("page_token"),
+		Sort:          query.Get("sort"),
+		Metadata:      metadataFilter(query),
+	})
 	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, "failed to list environments", err)
+		h.respondServiceError(w, "failed to list environments", err)
 		return
 	}
 
+	for i := range resp.Environments {
+		h.setEnvironmentURLs(r, &resp.Environments[i])
+	}
 	h.respondJSON(w, http.StatusOK, resp)
 }
 
 // ExecuteCommand handles POST /environments/{id}/exec
 // Request body must be JSON: {"command": ["cmd", "arg1", ...], "timeout": 300}
+// With ?stream=true or Accept: text/event-stream, output is streamed as Server-Sent Events
 func (h *Handler) ExecuteCommand(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	envID := vars["id"]
 
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 64*1024) // 64KB limit for exec requests
-
 	if r.Body == nil || r.ContentLength == 0 {
 		h.respondError(w, http.StatusBadRequest, "request body is required (JSON: {\"command\": [\"cmd\", \"arg1\", ...], \"timeout\": 300})", nil)
 		return
@@ -173,35 +353,235 @@ func (h *Handler) ExecuteCommand(w http.ResponseWriter, r *http.Request) {
 
 	var req models.ExecRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body: must be JSON with \"command\" array", err)
+		status, message := requestBodyError(err, "invalid request body: must be JSON with \"command\" array")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
 
 	// Validate request
 	if err := h.validator.ValidateExecRequest(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, err.Error(), err)
+		h.respondValidationError(w, err.Error(), err)
+		return
+	}
+
+	if !h.checkCommandPolicy(w, r, envID, req.Command) {
+		return
+	}
+
+	// Stream output as Server-Sent Events when requested
+	if r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.streamExec(w, r, envID, &req)
 		return
 	}
 
 	// Execute command
 	resp, err := h.orchestrator.ExecuteCommand(ctx, envID, req.Command, req.Timeout)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.respondError(w, http.StatusNotFound, "environment not found", err)
+		if ctx.Err() != nil {
+			// Client went away; the orchestrator has stopped the command
+			h.logger.Info("client disconnected during exec",
+				zap.String("environment_id", envID),
+				zap.String("user_id", getUserIDFromContext(ctx)),
+			)
 			return
 		}
-		if strings.Contains(err.Error(), "not running") {
-			h.respondError(w, http.StatusBadRequest, "environment is not running", err)
-			return
+		var queueErr *orchestrator.ExecQueueError
+		if errors.As(err, &queueErr) {
+			w.Header().Set("X-Exec-Queue-Ahead", strconv.Itoa(queueErr.Ahead))
+			w.Header().Set("X-Exec-Queue-Length", strconv.Itoa(queueErr.Queued))
 		}
-		h.respondError(w, http.StatusInternalServerError, "failed to execute command", err)
+		h.respondServiceError(w, "failed to execute command", err)
 		return
 	}
 
 	h.respondJSON(w, http.StatusOK, resp)
 }
 
+// checkCommandPolicy rejects a command that violates the environment's command policy (403).
+// Admins are exempt.
+func (h *Handler) checkCommandPolicy(w http.ResponseWriter, r *http.Request, envID string, command []string) bool {
+	ctx := r.Context()
+	if hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		return true
+	}
+	if err := h.orchestrator.CheckCommandPolicy(ctx, envID, command, getUserIDFromContext(ctx)); err != nil {
+		h.respondServiceError(w, "failed to check command policy", err)
+		return false
+	}
+	return true
+}
+
+// checkReadinessCommand rejects a readiness check whose command violates policy, the command
+// policy of the environment it will run in (403). Admins are exempt, as for exec.
+func (h *Handler) checkReadinessCommand(w http.ResponseWriter, r *http.Request, envID string, policy *models.CommandPolicy, check *models.ReadinessCheck) bool {
+	ctx := r.Context()
+	if hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		return true
+	}
+	if err := h.orchestrator.CheckReadinessCommand(ctx, envID, policy, check, getUserIDFromContext(ctx)); err != nil {
+		h.respondServiceError(w, "readiness check command rejected", err)
+		return false
+	}
+	return true
+}
+
+// checkUnrestrictedPolicy allows only admins to turn off command checks for an environment
+func (h *Handler) checkUnrestrictedPolicy(w http.ResponseWriter, r *http.Request, policy *models.CommandPolicy) bool {
+	if policy == nil || !policy.Unrestricted {
+		return true
+	}
+	if hasCapability(r.Context(), roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		return true
+	}
+	h.respondError(w, http.StatusForbidden, "only admins can make an environment unrestricted", nil)
+	return false
+}
+
+// expandNetworkPreset resolves isolation.network_preset into isolation.network_policy, so the
+// resulting policy is validated like an explicit one
+func (h *Handler) expandNetworkPreset(w http.ResponseWriter, isolation *models.IsolationConfig) bool {
+	if err := h.orchestrator.ExpandNetworkPreset(isolation); err != nil {
+		h.respondServiceError(w, "validation failed", err)
+		return false
+	}
+	return true
+}
+
+// checkExecSecurityInherit allows only admins to exempt an environment's execution pods from
+// the execution_security defaults
+func (h *Handler) checkExecSecurityInherit(w http.ResponseWriter, r *http.Request, isolation *models.IsolationConfig) bool {
+	if isolation == nil || !isolation.ExecInheritSecurityContext {
+		return true
+	}
+	if hasCapability(r.Context(), roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		return true
+	}
+	h.respondError(w, http.StatusForbidden, "only admins can set isolation.exec_inherit_security_context", nil)
+	return false
+}
+
+// checkPrivilegedSecurityContext allows only admins to grant a pod more than the container
+// runtime's defaults (extra capabilities or an unconfined seccomp profile)
+func (h *Handler) checkPrivilegedSecurityContext(w http.ResponseWriter, r *http.Request, isolation *models.IsolationConfig) bool {
+	if err := privilegedSecurityContextError(r.Context(), isolation); err != nil {
+		h.respondError(w, http.StatusForbidden, err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+// privilegedSecurityContextError reports a privileged isolation.security_context setting the
+// caller may not make
+func privilegedSecurityContextError(ctx context.Context, isolation *models.IsolationConfig) error {
+	if isolation == nil {
+		return nil
+	}
+	setting := isolation.SecurityContext.PrivilegedSetting()
+	if setting == "" || hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		return nil
+	}
+	return fmt.Errorf("only admins can set isolation.security_context.%s", setting)
+}
+
+// streamExec runs a command in the environment's main pod and streams stdout/stderr as SSE events
+// ("stdout"/"stderr" per line), ending with an "exit" event carrying the exit code and duration.
+// Client disconnect cancels the remote exec.
+func (h *Handler) streamExec(w http.ResponseWriter, r *http.Request, envID string, req *models.ExecRequest) {
+	ctx := r.Context()
+
+	// Fail fast with a regular JSON error before switching to SSE
+	env, err := h.orchestrator.GetEnvironment(ctx, envID)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "environment not found", err)
+		return
+	}
+	if env.Status == models.StatusDegraded {
+		h.respondServiceError(w, "", apierrors.New(apierrors.Unavailable, apierrors.CodeEnvironmentDegraded, "environment is degraded"))
+		return
+	}
+	if env.Status != models.StatusRunning {
+		h.respondServiceError(w, "", orchestrator.EnvironmentNotRunningError(env))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.logger.Error("streaming not supported")
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Set up SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx buffering
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Long-running commands must not be cut off by the server's write timeout
+	//nolint:errcheck // Not supported by every ResponseWriter (e.g. httptest), streaming still works
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var mu sync.Mutex
+	sendEvent := func(event string, data interface{}) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			h.logger.Warn("failed to marshal exec event", zap.Error(err))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	// One pipe + reader goroutine per stream; lines are forwarded as they are produced
+	var wg sync.WaitGroup
+	pipeStream := func(stream string) *io.PipeWriter {
+		pr, pw := io.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader := bufio.NewReader(pr)
+			for {
+				line, err := reader.ReadString('\n')
+				if line != "" {
+					sendEvent(stream, models.LogEntry{
+						Timestamp: time.Now(),
+						Stream:    stream,
+						Message:   strings.TrimSuffix(line, "\n"),
+					})
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		return pw
+	}
+	stdoutW := pipeStream("stdout")
+	stderrW := pipeStream("stderr")
+
+	resp, err := h.orchestrator.ExecuteCommandStream(ctx, envID, req.Command, req.Timeout, stdoutW, stderrW)
+	stdoutW.Close()
+	stderrW.Close()
+	wg.Wait()
+
+	if err != nil {
+		h.logger.Error("streaming exec failed", zap.String("environment_id", envID), zap.Error(err))
+		sendEvent("error", map[string]string{"error": fmt.Sprintf("failed to execute command: %v", err)})
+		return
+	}
+
+	sendEvent("exit", map[string]interface{}{
+		"exit_code":   resp.ExitCode,
+		"duration_ms": resp.DurationMs,
+		"timed_out":   resp.TimedOut,
+	})
+}
+
 // SubmitExecution handles POST /environments/{id}/run
 // This queues an async execution that creates a new isolated pod using the environment's configuration
 // Returns immediately with execution ID for polling
@@ -210,12 +590,10 @@ func (h *Handler) SubmitExecution(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	envID := vars["id"]
 
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 64*1024) // 64KB limit
-
 	var req models.EphemeralExecRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
@@ -223,9 +601,24 @@ func (h *Handler) SubmitExecution(w http.ResponseWriter, r *http.Request) {
 	// Set environment ID from URL path
 	req.EnvironmentID = envID
 
-	// Validate required fields
-	if len(req.Command) == 0 {
-		h.respondError(w, http.StatusBadRequest, "command is required", nil)
+	// Validate the command and any image, resource or isolation overrides
+	if err := h.validator.ValidateEphemeralExecRequest(&req); err != nil {
+		h.respondValidationError(w, "validation failed", err)
+		return
+	}
+
+	// wait_seconds may also be given as a query parameter
+	if waitStr := r.URL.Query().Get("wait_seconds"); waitStr != "" {
+		wait, err := strconv.Atoi(waitStr)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid wait_seconds", err)
+			return
+		}
+		req.WaitSeconds = wait
+	}
+	if req.WaitSeconds < 0 || req.WaitSeconds > orchestrator.MaxExecutionWaitSeconds {
+		h.respondError(w, http.StatusBadRequest, "invalid wait_seconds",
+			fmt.Errorf("wait_seconds must be between 0 and %d", orchestrator.MaxExecutionWaitSeconds))
 		return
 	}
 
@@ -238,7 +631,24 @@ func (h *Handler) SubmitExecution(w http.ResponseWriter, r *http.Request) {
 		Command:       req.Command,
 		Timeout:       req.Timeout,
 		Env:           req.Env,
+		Image:         req.Image,
+		Resources:     req.Resources,
+		Isolation:     req.Isolation,
+
+		CallbackURL:     req.CallbackURL,
+		CallbackHeaders: req.CallbackHeaders,
+		CallbackSecret:  req.CallbackSecret,
+
+		Files: req.Files,
+
+		Cache:    req.Cache,
+		CacheTTL: req.CacheTTL,
+
+		SkipSoftTimeout: req.SkipSoftTimeout,
+
+		Metadata: req.Metadata,
 	}
+	orchReq.SkipCommandPolicy = hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin)
 
 	h.logger.Info("submitting execution",
 		zap.String("environment_id", envID),
@@ -248,13 +658,12 @@ func (h *Handler) SubmitExecution(w http.ResponseWriter, r *http.Request) {
 
 	exec, err := h.orchestrator.SubmitExecution(ctx, orchReq, userID)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.respondError(w, http.StatusNotFound, "environment not found", err)
-		} else if strings.Contains(err.Error(), "not running") {
-			h.respondError(w, http.StatusBadRequest, "environment is not running", err)
-		} else {
-			h.respondError(w, http.StatusInternalServerError, "failed to submit execution", err)
-		}
+		h.respondServiceError(w, "failed to submit execution", err)
+		return
+	}
+
+	if req.WaitSeconds > 0 {
+		h.waitForExecution(w, r, exec, time.Duration(req.WaitSeconds)*time.Second)
 		return
 	}
 
@@ -264,88 +673,370 @@ func (h *Handler) SubmitExecution(w http.ResponseWriter, r *http.Request) {
 		EnvironmentID: exec.EnvironmentID,
 		Status:        exec.Status,
 		CreatedAt:     exec.CreatedAt,
+		Metadata:      exec.Metadata,
+	}
+
+	h.respondJSON(w, http.StatusAccepted, resp)
+}
+
+// waitForExecution long-polls a submitted execution: 200 with the full result if it finishes
+// within wait, otherwise 202 with its current status
+func (h *Handler) waitForExecution(w http.ResponseWriter, r *http.Request, submitted *models.Execution, wait time.Duration) {
+	// Allow the response to outlive the server's default write timeout (best effort: not every
+	// ResponseWriter supports deadlines, in which case the default applies)
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 30*time.Second))
+
+	exec, done, err := h.orchestrator.WaitForExecution(r.Context(), submitted.ID, wait)
+	if err != nil {
+		if r.Context().Err() != nil {
+			// Client went away; the execution keeps running and can be polled later
+			h.logger.Info("client disconnected while waiting for execution", zap.String("exec_id", submitted.ID))
+			return
+		}
+		h.respondError(w, http.StatusInternalServerError, "failed to get execution", err)
+		return
+	}
+
+	if !done {
+		h.respondJSON(w, http.StatusAccepted, models.ExecutionResponse{
+			ID:            exec.ID,
+			EnvironmentID: exec.EnvironmentID,
+			Status:        exec.Status,
+			CreatedAt:     exec.CreatedAt,
+			StartedAt:     exec.StartedAt,
+			Metadata:      exec.Metadata,
+		})
+		return
+	}
+	h.respondJSON(w, http.StatusOK, models.NewExecutionResponse(exec))
+}
+
+// GetExecution handles GET /executions/{id}
+// Returns the current status and result of an execution
+func (h *Handler) GetExecution(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	execID := vars["id"]
+
+	exec, err := h.orchestrator.GetExecution(ctx, execID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get execution", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, models.NewExecutionResponse(exec))
+}
+
+// ListExecutions handles GET /environments/{id}/executions
+// Returns list of executions for an environment
+func (h *Handler) ListExecutions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	envID := vars["id"]
+
+	// Parse limit parameter
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	offset := 0
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	opts := orchestrator.ListExecutionsOptions{
+		Limit:     limit,
+		Offset:    offset,
+		PageToken: r.URL.Query().Get("page_token"),
+	}
+	if !h.parseExecutionFilters(w, r, &opts) {
+		return
+	}
+
+	resp, err := h.orchestrator.ListExecutionsWithOptions(ctx, envID, opts)
+	if err != nil {
+		h.respondServiceError(w, "failed to list executions", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// parseExecutionFilters reads the filters of GET /environments/{id}/executions into opts:
+// command_contains, exit_code, status, created_after/created_before (RFC3339), user_id
+// (admins only) and metadata.<key>. Responds with an error and returns false when one is invalid.
+func (h *Handler) parseExecutionFilters(w http.ResponseWriter, r *http.Request, opts *orchestrator.ListExecutionsOptions) bool {
+	query := r.URL.Query()
+	opts.CommandContains = query.Get("command_contains")
+
+	if value := query.Get("exit_code"); value != "" {
+		exitCode, err := strconv.Atoi(value)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid exit_code (expected an integer)", err)
+			return false
+		}
+		opts.ExitCode = &exitCode
+	}
+
+	if value := query.Get("status"); value != "" {
+		switch status := models.ExecutionStatus(value); status {
+		case models.ExecutionStatusPending, models.ExecutionStatusQueued, models.ExecutionStatusRunning,
+			models.ExecutionStatusCompleted, models.ExecutionStatusFailed, models.ExecutionStatusCanceled:
+			opts.Status = status
+		default:
+			h.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid status %q", value), nil)
+			return false
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dest **time.Time
+	}{{"created_after", &opts.CreatedAfter}, {"created_before", &opts.CreatedBefore}} {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s timestamp (expected RFC3339)", p.name), err)
+			return false
+		}
+		*p.dest = &t
+	}
+
+	if userID := query.Get("user_id"); userID != "" {
+		if !hasCapability(r.Context(), roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin) {
+			h.respondError(w, http.StatusForbidden, "only users with environments.read_all or platform.admin can filter executions by user_id", nil)
+			return false
+		}
+		opts.UserID = userID
+	}
+
+	opts.Metadata = metadataFilter(query)
+	return true
+}
+
+// metadataFilter returns the metadata.<key>=<value> query parameters as exact-match metadata
+// filters (nil when there are none)
+func metadataFilter(query url.Values) map[string]string {
+	var filter map[string]string
+	for name, values := range query {
+		key, ok := strings.CutPrefix(name, "metadata.")
+		if !ok || key == "" || len(values) == 0 {
+			continue
+		}
+		if filter == nil {
+			filter = make(map[string]string)
+		}
+		filter[key] = values[0]
+	}
+	return filter
+}
+
+// PurgeExecutions handles DELETE /environments/{id}/executions?before=<RFC3339 timestamp>
+// Deletes finished executions created before the given time; running executions are kept
+func (h *Handler) PurgeExecutions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	envID := vars["id"]
+
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	beforeStr := r.URL.Query().Get("before")
+	if beforeStr == "" {
+		h.respondError(w, http.StatusBadRequest, "before query parameter is required (RFC3339 timestamp)", nil)
+		return
+	}
+	before, err := time.Parse(time.RFC3339, beforeStr)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid before timestamp (expected RFC3339)", err)
+		return
+	}
+
+	deleted, err := h.orchestrator.PurgeExecutions(ctx, envID, before)
+	if err != nil {
+		h.respondServiceError(w, "failed to purge executions", err)
+		return
+	}
+	h.orchestrator.ExecutionsPurged(ctx, envID, getUserIDFromContext(ctx), before, deleted)
+
+	h.respondJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// GetExecutionStats handles GET /environments/{id}/stats
+// Optional query parameters from/to (RFC3339) limit the executions to those created in [from, to)
+func (h *Handler) GetExecutionStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	envID := vars["id"]
+
+	query := r.URL.Query()
+	var from, to *time.Time
+	for _, p := range []struct {
+		name string
+		dest **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s timestamp (expected RFC3339)", p.name), err)
+			return
+		}
+		*p.dest = &t
+	}
+	if from != nil && to != nil && !from.Before(*to) {
+		h.respondError(w, http.StatusBadRequest, "from must be before to", nil)
+		return
+	}
+
+	stats, err := h.orchestrator.GetExecutionStats(ctx, envID, from, to)
+	if err != nil {
+		h.respondServiceError(w, "failed to get execution stats", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, stats)
+}
+
+// GetExecQueue handles GET /environments/{id}/exec/queue
+// Returns the environment's exec mode and how many synchronous execs are running and queued
+func (h *Handler) GetExecQueue(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+
+	stats, err := h.orchestrator.ExecQueueStats(r.Context(), envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get exec queue", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, stats)
+}
+
+// CancelExecution handles DELETE /executions/{id}
+// Cancels a pending or running execution
+func (h *Handler) CancelExecution(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	execID := vars["id"]
+
+	if err := h.orchestrator.CancelExecution(ctx, execID); err != nil {
+		h.respondServiceError(w, "failed to cancel execution", err)
+		return
 	}
 
-	h.respondJSON(w, http.StatusAccepted, resp)
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "canceled"})
 }
 
-// GetExecution handles GET /executions/{id}
-// Returns the current status and result of an execution
-func (h *Handler) GetExecution(w http.ResponseWriter, r *http.Request) {
+// UpdateExecution handles PATCH /executions/{id}
+// Replaces the execution's metadata (whoever can edit its environment)
+func (h *Handler) UpdateExecution(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	execID := vars["id"]
 
 	exec, err := h.orchestrator.GetExecution(ctx, execID)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.respondError(w, http.StatusNotFound, "execution not found", err)
-		} else {
-			h.respondError(w, http.StatusInternalServerError, "failed to get execution", err)
-		}
+		h.respondServiceError(w, "failed to get execution", err)
+		return
+	}
+	if _, ok := h.requireEnvEdit(w, r, exec.EnvironmentID); !ok {
 		return
 	}
 
-	resp := models.ExecutionResponse{
-		ID:            exec.ID,
-		EnvironmentID: exec.EnvironmentID,
-		Status:        exec.Status,
-		CreatedAt:     exec.CreatedAt,
-		StartedAt:     exec.StartedAt,
-		CompletedAt:   exec.CompletedAt,
-		ExitCode:      exec.ExitCode,
-		Stdout:        exec.Stdout,
-		Stderr:        exec.Stderr,
-		Error:         exec.Error,
-		DurationMs:    exec.DurationMs,
+	var patch models.UpdateExecutionRequest
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
 	}
+	defer r.Body.Close()
 
-	h.respondJSON(w, http.StatusOK, resp)
+	if patch.Metadata != nil {
+		if err := h.validator.ValidateMetadata(*patch.Metadata); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+	}
+
+	exec, err = h.orchestrator.UpdateExecution(ctx, execID, &patch)
+	if err != nil {
+		h.respondServiceError(w, "failed to update execution", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, models.NewExecutionResponse(exec))
 }
 
-// ListExecutions handles GET /environments/{id}/executions
-// Returns list of executions for an environment
-func (h *Handler) ListExecutions(w http.ResponseWriter, r *http.Request) {
+// CancelAllExecutions handles POST /environments/{id}/executions/cancel-all
+// Cancels the environment's unfinished executions (whoever can edit the environment); ?status=
+// limits it to some of pending, queued and running (comma-separated or repeated)
+func (h *Handler) CancelAllExecutions(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	vars := mux.Vars(r)
-	envID := vars["id"]
+	envID := mux.Vars(r)["id"]
 
-	// Parse limit parameter
-	limit := 100
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	var statuses []models.ExecutionStatus
+	for _, value := range r.URL.Query()["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				statuses = append(statuses, models.ExecutionStatus(status))
+			}
 		}
 	}
 
-	resp, err := h.orchestrator.ListExecutions(ctx, envID, limit)
+	result, err := h.orchestrator.CancelAllExecutions(ctx, envID, getUserIDFromContext(ctx), statuses)
 	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, "failed to list executions", err)
+		h.respondServiceError(w, "failed to cancel executions", err)
 		return
 	}
 
-	h.respondJSON(w, http.StatusOK, resp)
+	h.respondJSON(w, http.StatusOK, result)
 }
 
-// CancelExecution handles DELETE /executions/{id}
-// Cancels a pending or running execution
-func (h *Handler) CancelExecution(w http.ResponseWriter, r *http.Request) {
+// RequeueExecution handles POST /executions/{id}/requeue
+// Submits a failed or canceled execution again (whoever can edit its environment)
+func (h *Handler) RequeueExecution(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	vars := mux.Vars(r)
-	execID := vars["id"]
+	execID := mux.Vars(r)["id"]
 
-	if err := h.orchestrator.CancelExecution(ctx, execID); err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.respondError(w, http.StatusNotFound, "execution not found", err)
-		} else if strings.Contains(err.Error(), "cannot be canceled") {
-			h.respondError(w, http.StatusBadRequest, err.Error(), nil)
-		} else {
-			h.respondError(w, http.StatusInternalServerError, "failed to cancel execution", err)
-		}
+	exec, err := h.orchestrator.GetExecution(ctx, execID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get execution", err)
+		return
+	}
+	if _, ok := h.requireEnvEdit(w, r, exec.EnvironmentID); !ok {
 		return
 	}
 
-	h.respondJSON(w, http.StatusOK, map[string]string{"status": "canceled"})
+	requeued, err := h.orchestrator.RequeueExecution(ctx, execID, getUserIDFromContext(ctx),
+		hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin))
+	if err != nil {
+		h.respondServiceError(w, "failed to requeue execution", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusAccepted, models.ExecutionResponse{
+		ID:            requeued.ID,
+		EnvironmentID: requeued.EnvironmentID,
+		Status:        requeued.Status,
+		CreatedAt:     requeued.CreatedAt,
+		RequeuedFrom:  requeued.RequeuedFrom,
+		Metadata:      requeued.Metadata,
+	})
 }
 
 // UpdateEnvironment handles PATCH /environments/{id} (super admins, environment admins, and owners can edit)
@@ -358,24 +1049,124 @@ func (h *Handler) UpdateEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
 	var patch models.UpdateEnvironmentRequest
 	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
 
-	env, err := h.orchestrator.UpdateEnvironment(ctx, envID, &patch)
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.respondError(w, http.StatusNotFound, "environment not found", err)
+	if patch.Image != nil {
+		if err := h.validator.ValidateImage(*patch.Image); err != nil {
+			h.respondValidationError(w, "validation failed", err)
 			return
 		}
-		h.respondError(w, http.StatusInternalServerError, "failed to update environment", err)
+	}
+
+	if patch.CommandPolicy != nil {
+		if err := h.validator.ValidateCommandPolicy(patch.CommandPolicy); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+		if !h.checkUnrestrictedPolicy(w, r, patch.CommandPolicy) {
+			return
+		}
+	}
+	if !patch.ReadinessCheck.IsEmpty() {
+		if err := h.validator.ValidateReadinessCheck(patch.ReadinessCheck); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+		// The check runs under the policy the patch sets, or else the environment's current one
+		policy := patch.CommandPolicy
+		if policy == nil {
+			current, err := h.orchestrator.GetEnvironment(ctx, envID)
+			if err != nil {
+				h.respondServiceError(w, "failed to get environment", err)
+				return
+			}
+			policy = current.CommandPolicy
+		}
+		if !h.checkReadinessCommand(w, r, envID, policy, patch.ReadinessCheck) {
+			return
+		}
+	}
+	if !patch.Lifecycle.IsEmpty() {
+		if err := h.validator.ValidateLifecycle(patch.Lifecycle); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+	}
+	if !patch.Affinity.IsEmpty() {
+		if err := h.validator.ValidateAffinity(patch.Affinity); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+	}
+	if patch.Isolation != nil {
+		if !h.expandNetworkPreset(w, patch.Isolation) {
+			return
+		}
+		if err := h.validator.ValidateIsolation(patch.Isolation); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+		if !h.checkExecSecurityInherit(w, r, patch.Isolation) || !h.checkPrivilegedSecurityContext(w, r, patch.Isolation) {
+			return
+		}
+	}
+	if patch.Metadata != nil {
+		if err := h.validator.ValidateMetadata(*patch.Metadata); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+	}
+	if patch.WorkspaceSnapshots != nil {
+		if err := h.validator.ValidateWorkspaceSnapshots(patch.WorkspaceSnapshots); err != nil {
+			h.respondValidationError(w, "validation failed", err)
+			return
+		}
+	}
+
+	env, err := h.orchestrator.UpdateEnvironment(ctx, envID, &patch)
+	if err != nil {
+		h.respondServiceError(w, "failed to update environment", err)
+		return
+	}
+	h.orchestrator.EnvironmentUpdated(ctx, envID, getUserIDFromContext(ctx), &patch)
+
+	h.setEnvironmentURLs(r, env)
+	h.respondJSON(w, http.StatusOK, env)
+}
+
+// UpdateEnvironmentLabels handles POST /environments/{id}/labels
+// Adds and removes labels without replacing the others (PATCH replaces the whole map)
+func (h *Handler) UpdateEnvironmentLabels(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	var req models.UpdateLabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := h.validator.ValidateLabelsUpdate(&req); err != nil {
+		h.respondValidationError(w, "validation failed", err)
 		return
 	}
 
+	env, err := h.orchestrator.UpdateEnvironmentLabels(r.Context(), envID, &req)
+	if err != nil {
+		h.respondServiceError(w, "failed to update labels", err)
+		return
+	}
+	h.setEnvironmentURLs(r, env)
 	h.respondJSON(w, http.StatusOK, env)
 }
 
@@ -390,17 +1181,86 @@ func (h *Handler) RetryReconciliation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.orchestrator.RetryReconciliation(ctx, envID); err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.respondError(w, http.StatusNotFound, "environment not found", err)
-			return
-		}
-		h.respondError(w, http.StatusInternalServerError, "failed to retry reconciliation", err)
+		h.respondServiceError(w, "failed to retry reconciliation", err)
 		return
 	}
 
 	h.respondJSON(w, http.StatusAccepted, map[string]string{"status": "retry_triggered"})
 }
 
+// RefreshStandbyPool handles POST /environments/{id}/pool/refresh
+// Replaces the idle standby pods (e.g. after an image tag was re-pushed) and re-enables a drained pool
+func (h *Handler) RefreshStandbyPool(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	result, err := h.orchestrator.RefreshStandbyPool(r.Context(), envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to refresh standby pool", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, result)
+}
+
+// DrainStandbyPool handles POST /environments/{id}/pool/drain
+// Deletes the idle standby pods and stops replenishing the pool until it is refreshed
+func (h *Handler) DrainStandbyPool(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	result, err := h.orchestrator.DrainStandbyPool(r.Context(), envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to drain standby pool", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, result)
+}
+
+// CordonEnvironment handles POST /environments/{id}/cordon
+// New execs and executions are rejected with 423 Locked until uncordoned; running ones finish
+func (h *Handler) CordonEnvironment(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	var req models.CordonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	env, err := h.orchestrator.CordonEnvironment(r.Context(), envID, req.Reason)
+	if err != nil {
+		h.respondServiceError(w, "failed to cordon environment", err)
+		return
+	}
+	h.setEnvironmentURLs(r, env)
+	h.respondJSON(w, http.StatusOK, env)
+}
+
+// UncordonEnvironment handles POST /environments/{id}/uncordon
+func (h *Handler) UncordonEnvironment(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	env, err := h.orchestrator.UncordonEnvironment(r.Context(), envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to uncordon environment", err)
+		return
+	}
+	h.setEnvironmentURLs(r, env)
+	h.respondJSON(w, http.StatusOK, env)
+}
+
 // DeleteEnvironment handles DELETE /environments/{id}
 func (h *Handler) DeleteEnvironment(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -410,13 +1270,10 @@ func (h *Handler) DeleteEnvironment(w http.ResponseWriter, r *http.Request) {
 	force := r.URL.Query().Get("force") == "true"
 
 	if err := h.orchestrator.DeleteEnvironment(ctx, envID, force); err != nil {
-		if strings.Contains(err.Error(), "environment not found") {
-			h.respondError(w, http.StatusNotFound, "environment not found", err)
-			return
-		}
-		h.respondError(w, http.StatusInternalServerError, "failed to delete environment", err)
+		h.respondServiceError(w, "failed to delete environment", err)
 		return
 	}
+	h.orchestrator.EnvironmentDeleted(ctx, envID, getUserIDFromContext(ctx), force)
 
 	h.logger.Info("environment deleted",
 		zap.String("environment_id", envID),
@@ -473,14 +1330,25 @@ func (h *Handler) GetLogs(w http.ResponseWriter, r *http.Request) {
 	follow := query.Get("follow") == "true"
 	includeTimestamps := query.Get("timestamps") != "false"
 
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		h.respondValidationError(w, "invalid log search parameters", err)
+		return
+	}
+
 	// If follow=true, stream logs using Server-Sent Events (SSE)
 	if follow {
-		h.streamLogs(w, r, ctx, envID, tailLines, includeTimestamps)
+		h.streamLogs(w, r, ctx, envID, tailLines, includeTimestamps, filter)
 		return
 	}
 
-	// Get logs (non-streaming)
-	logsResp, err := h.orchestrator.GetLogs(ctx, envID, tailLines)
+	// Get logs (non-streaming); searches scan the pod log instead of loading it whole
+	var logsResp *models.LogsResponse
+	if filter.IsZero() {
+		logsResp, err = h.orchestrator.GetLogs(ctx, envID, tailLines)
+	} else {
+		logsResp, err = h.orchestrator.SearchLogs(ctx, envID, tailLines, filter)
+	}
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, "failed to get logs", err)
 		return
@@ -497,8 +1365,54 @@ func (h *Handler) GetLogs(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusOK, logsResp)
 }
 
-// streamLogs streams logs using Server-Sent Events (SSE)
-func (h *Handler) streamLogs(w http.ResponseWriter, r *http.Request, ctx context.Context, envID string, tailLines *int64, includeTimestamps bool) {
+// parseLogFilter reads the log search query parameters: grep, regex, since and until (RFC 3339),
+// stream (comma-separated) and before/after context line counts
+func parseLogFilter(query url.Values) (*orchestrator.LogFilter, error) {
+	filter := &orchestrator.LogFilter{
+		Grep:  query.Get("grep"),
+		Regex: query.Get("regex") == "true",
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", p.name)
+			}
+			*p.dst = t
+		}
+	}
+	if v := query.Get("stream"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				filter.Streams = append(filter.Streams, s)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"before", &filter.Before}, {"after", &filter.After}} {
+		if v := query.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an integer", p.name)
+			}
+			*p.dst = n
+		}
+	}
+	if err := filter.Compile(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// streamLogs streams logs using Server-Sent Events (SSE), applying the log search filter to
+// each line as it arrives
+func (h *Handler) streamLogs(w http.ResponseWriter, r *http.Request, ctx context.Context, envID string, tailLines *int64,
+	includeTimestamps bool, filter *orchestrator.LogFilter) {
 	// Set up SSE headers
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -539,9 +1453,27 @@ func (h *Handler) streamLogs(w http.ResponseWriter, r *http.Request, ctx context
 		return
 	}
 
-	// Stream logs line by line
+	emit := func(logEntry models.LogEntry) {
+		if !includeTimestamps {
+			logEntry.Timestamp = time.Time{}
+		}
+
+		// Format as JSON
+		logJSON, err := json.Marshal(logEntry)
+		if err != nil {
+			h.logger.Warn("failed to marshal log entry", zap.Error(err))
+			return
+		}
+
+		// Send as SSE event
+		fmt.Fprintf(w, "data: %s\n\n", string(logJSON))
+		flusher.Flush()
+	}
+	matcher := orchestrator.NewLogMatcher(filter)
+
+	// Stream logs line by line; lines without a Kubernetes timestamp reuse the previous line's time
 	scanner := bufio.NewScanner(logsStream)
-	now := time.Now()
+	last := time.Now()
 
 	for scanner.Scan() {
 		// Check if context was canceled (client disconnected)
@@ -556,38 +1488,16 @@ func (h *Handler) streamLogs(w http.ResponseWriter, r *http.Request, ctx context
 			continue
 		}
 
-		// Create log entry
-		logEntry := models.LogEntry{
-			Timestamp: now,
-			Stream:    "stdout",
-			Message:   line,
-		}
-
-		// Format as JSON
-		logJSON, err := json.Marshal(logEntry)
-		if err != nil {
-			h.logger.Warn("failed to marshal log entry", zap.Error(err))
-			continue
+		ts, message, ok := k8s.ParseLogLine(line)
+		if ok {
+			last = ts
 		}
-
-		// Send as SSE event
-		if !includeTimestamps {
-			// Create log entry without timestamp
-			logEntry = models.LogEntry{
-				Timestamp: time.Time{},
-				Stream:    "stdout",
-				Message:   line,
-			}
-			logJSON, err = json.Marshal(logEntry)
-			if err != nil {
-				h.logger.Warn("failed to marshal log entry", zap.Error(err))
-				continue
-			}
+		// Nothing later can match once the stream is past the until filter
+		if !filter.Until.IsZero() && last.After(filter.Until) {
+			return
 		}
-		fmt.Fprintf(w, "data: %s\n\n", string(logJSON))
 
-		flusher.Flush()
-		now = time.Now() // Update timestamp for next line
+		matcher.Push(models.LogEntry{Timestamp: last, Stream: orchestrator.LogStreamStdout, Message: message}, emit)
 	}
 
 	if err := scanner.Err(); err != nil && err != io.EOF {
@@ -620,13 +1530,65 @@ func (h *Handler) respondError(w http.ResponseWriter, status int, message string
 		errMsg = err.Error()
 	}
 
-	errResp := models.ErrorResponse{
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
+
+// respondServiceError writes the response for an error returned by the orchestrator or a
+// service. Errors with an apierrors kind are reported with the kind's status and code and
+// their own message; any other error is a 500 reported as message.
+func (h *Handler) respondServiceError(w http.ResponseWriter, message string, err error) {
+	status := apierrors.HTTPStatus(err)
+	if status < http.StatusInternalServerError {
+		if msg := apierrors.MessageOf(err); msg != "" {
+			message = msg
+		}
+	}
+	h.respondError(w, status, message, err)
+}
+
+// newErrorResponse builds an error body. The code comes from err's apierrors kind when it has
+// one (and the status matches), otherwise from the status.
+func newErrorResponse(status int, message, errMsg string, err error) models.ErrorResponse {
+	code := apierrors.StatusCode(status)
+	if err != nil && apierrors.HTTPStatus(err) == status {
+		if c := apierrors.CodeOf(err); c != "" {
+			code = c
+		}
+	}
+	return models.ErrorResponse{
 		Error:   message,
 		Message: errMsg,
-		Code:    status,
+		Code:    code,
+		Status:  status,
 	}
+}
 
-	h.respondJSON(w, status, errResp)
+// respondValidationError writes a 400 response, listing each invalid field in details
+func (h *Handler) respondValidationError(w http.ResponseWriter, message string, err error) {
+	h.logger.Debug(message, zap.Error(err))
+	h.respondJSON(w, http.StatusBadRequest, newValidationErrorResponse(message, err))
+}
+
+// newValidationErrorResponse builds the body of a 400 response, listing each invalid field of
+// err (validator.ValidationErrors) in details
+func newValidationErrorResponse(message string, err error) models.ErrorResponse {
+	errResp := models.ErrorResponse{
+		Error:   message,
+		Message: err.Error(),
+		Code:    apierrors.ValidationFailed.Code(),
+		Status:  http.StatusBadRequest,
+	}
+
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		errResp.Details = make([]models.ErrorDetail, len(verrs))
+		for i, ve := range verrs {
+			errResp.Details[i] = models.ErrorDetail{Field: ve.Field, Code: ve.Code, Message: ve.Message}
+		}
+	}
+	return errResp
 }
 
 func getUserIDFromContext(ctx context.Context) string {
@@ -638,13 +1600,48 @@ func getUserIDFromContext(ctx context.Context) string {
 	return "anonymous"
 }
 
+// GetNamespaceGC handles GET /admin/namespace-gc (environments.read_all or platform.admin)
+// Returns the orphaned namespace collector's configuration and its latest report
+func (h *Handler) GetNamespaceGC(w http.ResponseWriter, r *http.Request) {
+	if !hasCapability(r.Context(), roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, h.orchestrator.NamespaceGCStatus())
+}
+
+// RunNamespaceGC handles POST /admin/namespace-gc (environments.write_all or platform.admin)
+// Runs an orphaned namespace collection pass now; ?dry_run=true only reports the orphans
+func (h *Handler) RunNamespaceGC(w http.ResponseWriter, r *http.Request) {
+	if !hasCapability(r.Context(), roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid dry_run (expected true or false)", err)
+			return
+		}
+	}
+
+	report, err := h.orchestrator.CollectOrphanNamespaces(r.Context(), dryRun)
+	if err != nil {
+		h.respondServiceError(w, "failed to collect orphaned namespaces", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, report)
+}
+
 // GetPoolStatus handles GET /pool/status
 // Returns the current standby pod pool status
 func (h *Handler) GetPoolStatus(w http.ResponseWriter, r *http.Request) {
 	status := h.orchestrator.GetPoolStatus()
 
 	resp := map[string]interface{}{
-		"pools": status,
+		"pools":   status,
+		"drained": h.orchestrator.DrainedPools(),
 		"total": func() int {
 			total := 0
 			for _, count := range status {
@@ -656,3 +1653,11 @@ func (h *Handler) GetPoolStatus(w http.ResponseWriter, r *http.Request) {
 
 	h.respondJSON(w, http.StatusOK, resp)
 }
+
+// ListNetworkPresets handles GET /policies/network: the network presets environments can pick
+// with isolation.network_preset and the rules each one results in
+func (h *Handler) ListNetworkPresets(w http.ResponseWriter, r *http.Request) {
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"presets": h.orchestrator.NetworkPresets(),
+	})
+}
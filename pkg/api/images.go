@@ -0,0 +1,56 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/registry"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// InspectImage handles GET /images/inspect?image=...
+// Returns the digest, size, platforms, creation date and entrypoint/cmd of an image as reported
+// by its registry, without pulling it. Images outside the image allowlist are rejected before
+// the registry is contacted, so the endpoint cannot be used to probe disallowed registries.
+func (h *Handler) InspectImage(w http.ResponseWriter, r *http.Request) {
+	if h.registry == nil {
+		h.respondError(w, http.StatusServiceUnavailable, "image inspection is not enabled", nil)
+		return
+	}
+
+	image := r.URL.Query().Get("image")
+	if image == "" {
+		h.respondValidationError(w, "validation failed", validator.ValidationErrors{
+			{Field: "image", Code: validator.CodeRequired, Message: "image query parameter is required"},
+		})
+		return
+	}
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		h.respondValidationError(w, "validation failed", validator.ValidationErrors{
+			{Field: "image", Code: validator.CodeInvalidFormat, Message: err.Error()},
+		})
+		return
+	}
+	if !h.validator.ImageAllowed(ref) {
+		h.respondServiceError(w, "image not allowed", apierrors.New(apierrors.Forbidden, apierrors.CodeImageNotAllowed,
+			"image %s is not from an allowed registry", ref.Name()))
+		return
+	}
+
+	info, err := h.registry.Inspect(r.Context(), ref)
+	if err != nil {
+		if retryAfter := registry.RetryAfter(err); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		h.respondServiceError(w, "failed to inspect image", err)
+		return
+	}
+
+	h.logger.Debug("image inspected", zap.String("image", info.Image), zap.String("digest", info.Digest))
+	h.respondJSON(w, http.StatusOK, info)
+}
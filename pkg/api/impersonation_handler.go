@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/impersonation"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// ImpersonationHandler handles the endpoints super admins impersonate users with
+type ImpersonationHandler struct {
+	authService *auth.Service
+	logger      *logger.Logger
+}
+
+// NewImpersonationHandler creates a new impersonation handler
+func NewImpersonationHandler(authService *auth.Service, log *logger.Logger) *ImpersonationHandler {
+	return &ImpersonationHandler{
+		authService: authService,
+		logger:      log,
+	}
+}
+
+// StartImpersonationRequest is the (optional) request body for starting an impersonation
+type StartImpersonationRequest struct {
+	// Reason is recorded with the session and in the audit log, e.g. a support ticket
+	Reason string `json:"reason,omitempty"`
+	// TTLSeconds is the token lifetime (default 900, at most 3600)
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+// StartImpersonation handles POST /api/v1/admin/impersonate/{user_id} (super admins)
+// Returns a short-lived token that authenticates as the user
+func (h *ImpersonationHandler) StartImpersonation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	admin, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+
+	var req StartImpersonationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	resp, err := h.authService.StartImpersonation(ctx, admin, mux.Vars(r)["user_id"], req.Reason,
+		time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		h.respondServiceError(w, "failed to start impersonation", err)
+		return
+	}
+
+	h.logger.Info("impersonation started",
+		zap.String("session_id", resp.Session.ID),
+		zap.String("admin_id", admin.ID),
+		zap.String("user_id", resp.User.ID),
+	)
+
+	h.respondJSON(w, http.StatusCreated, resp)
+}
+
+// ListImpersonations handles GET /api/v1/admin/impersonations (super admins)
+// Lists sessions newest first; ?active=true leaves out expired and revoked ones (at most ?limit=,
+// default 100, max 1000)
+func (h *ImpersonationHandler) ListImpersonations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !h.requireSuperAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	activeOnly := false
+	if v := query.Get("active"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, "invalid active (expected true or false)", err)
+			return
+		}
+		activeOnly = parsed
+	}
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			h.respondError(w, http.StatusBadRequest, "invalid limit (expected a positive integer)", err)
+			return
+		}
+		limit = parsed
+	}
+
+	sessions, err := h.authService.ListImpersonationSessions(ctx, activeOnly, limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list impersonation sessions", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+		"total":    len(sessions),
+	})
+}
+
+// RevokeImpersonation handles DELETE /api/v1/admin/impersonations/{id}
+// Super admins revoke any session; an impersonated request may end its own session
+func (h *ImpersonationHandler) RevokeImpersonation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sessionID := mux.Vars(r)["id"]
+
+	actorID := ""
+	if imp, ok := impersonation.FromContext(ctx); ok {
+		if imp.SessionID != sessionID {
+			h.respondServiceError(w, "cannot revoke other sessions while impersonating",
+				apierrors.New(apierrors.Forbidden, apierrors.CodeImpersonationForbidden, "cannot revoke other sessions while impersonating"))
+			return
+		}
+		actorID = imp.AdminID
+	} else {
+		if !h.requireSuperAdmin(w, r) {
+			return
+		}
+		admin, _ := auth.GetUserFromContext(ctx)
+		actorID = admin.ID
+	}
+
+	if err := h.authService.RevokeImpersonation(ctx, sessionID, actorID); err != nil {
+		h.respondServiceError(w, "failed to revoke impersonation session", err)
+		return
+	}
+
+	h.logger.Info("impersonation revoked",
+		zap.String("session_id", sessionID),
+		zap.String("revoked_by", actorID),
+	)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireSuperAdmin checks that the request is made by a super admin (in person)
+func (h *ImpersonationHandler) requireSuperAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return false
+	}
+	if _, impersonated := impersonation.FromContext(r.Context()); impersonated || user.Role != users.RoleSuperAdmin {
+		h.respondError(w, http.StatusForbidden, "super admin role required", nil)
+		return false
+	}
+	return true
+}
+
+func (h *ImpersonationHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *ImpersonationHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil && status >= 400 && status < 500 {
+		errMsg = err.Error()
+	}
+
+	h.respondJSON(w, status, newErrorResponse(status, message, errMsg, err))
+}
+
+func (h *ImpersonationHandler) respondServiceError(w http.ResponseWriter, message string, err error) {
+	status := apierrors.HTTPStatus(err)
+	if status < http.StatusInternalServerError {
+		if msg := apierrors.MessageOf(err); msg != "" {
+			message = msg
+		}
+	}
+	h.respondError(w, status, message, err)
+}
+
+// rejectImpersonated answers 403 to requests made while impersonating a user that would change
+// the user's credentials or account (what must stay the user's own doing) and reports whether
+// it did
+func rejectImpersonated(w http.ResponseWriter, r *http.Request, action string) bool {
+	if _, ok := impersonation.FromContext(r.Context()); !ok {
+		return false
+	}
+	err := apierrors.New(apierrors.Forbidden, apierrors.CodeImpersonationForbidden, "cannot %s while impersonating", action)
+	writeErrorResponse(w, http.StatusForbidden, apierrors.MessageOf(err), err)
+	return true
+}
@@ -2,22 +2,28 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
 	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/auth"
 	"github.com/sciffer/agentbox/pkg/database"
 	"github.com/sciffer/agentbox/pkg/metrics"
-	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/roles"
 )
 
 // MetricsHandler handles metrics endpoints
 type MetricsHandler struct {
 	db     *database.DB
 	logger *logger.Logger
+	// orchestrator reports the guardrail status in the summary (optional)
+	orchestrator *orchestrator.Orchestrator
 }
 
 // NewMetricsHandler creates a new metrics handler
@@ -28,13 +34,18 @@ func NewMetricsHandler(db *database.DB, log *logger.Logger) *MetricsHandler {
 	}
 }
 
+// SetOrchestrator adds the guardrail status to the metrics summary
+func (h *MetricsHandler) SetOrchestrator(orch *orchestrator.Orchestrator) {
+	h.orchestrator = orch
+}
+
 // GetGlobalMetrics handles GET /api/v1/metrics/global
 func (h *MetricsHandler) GetGlobalMetrics(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	// Parse query parameters
 	query := r.URL.Query()
-	metricType := query.Get("type") // running_sandboxes, cpu_usage, memory_usage, start_time
+	metricType := query.Get("type") // running_sandboxes, cpu_usage, memory_usage, start_time, executions_purged
 	startStr := query.Get("start")
 	endStr := query.Get("end")
 
@@ -121,6 +132,135 @@ func (h *MetricsHandler) GetEnvironmentMetrics(w http.ResponseWriter, r *http.Re
 	})
 }
 
+// GetEnvironmentMetricsHistory handles GET /api/v1/environments/{id}/metrics/history
+func (h *MetricsHandler) GetEnvironmentMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	from, to, step, err := parseHistoryRange(r)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid history range", err)
+		return
+	}
+
+	history, err := metrics.GetHistory(r.Context(), h.db, mux.Vars(r)["id"], from, to, step)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get metrics history", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, history)
+}
+
+// GetMetricsSummary handles GET /api/v1/metrics/summary (metrics.read): the global series and the
+// environments using the most CPU over the range
+func (h *MetricsHandler) GetMetricsSummary(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok || user == nil {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(r.Context(), user, roles.CapMetricsRead) {
+		h.respondError(w, http.StatusForbidden, "metrics.read capability required", nil)
+		return
+	}
+
+	from, to, step, err := parseHistoryRange(r)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid history range", err)
+		return
+	}
+	limit := 10
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	history, err := metrics.GetHistory(r.Context(), h.db, "", from, to, step)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get metrics history", err)
+		return
+	}
+	top, err := metrics.TopEnvironments(r.Context(), h.db, from, to, limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get environment usage", err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"history":          history,
+		"top_environments": top,
+	}
+	if h.orchestrator != nil {
+		resp["guardrails"] = h.orchestrator.GuardrailStatus()
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// GetChurnReport handles GET /api/v1/metrics/churn (metrics.read): namespaces created and
+// deleted per hour and pods created per node between from and to (default: the last 24 hours)
+func (h *MetricsHandler) GetChurnReport(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.GetUserFromContext(r.Context())
+	if !ok || user == nil {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(r.Context(), user, roles.CapMetricsRead) {
+		h.respondError(w, http.StatusForbidden, "metrics.read capability required", nil)
+		return
+	}
+
+	from, to, _, err := parseHistoryRange(r)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid churn range", err)
+		return
+	}
+	report, err := metrics.GetChurnReport(r.Context(), h.db, from, to)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get churn report", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, report)
+}
+
+// parseHistoryRange reads the from and to (RFC 3339, default: the last 24 hours) and step
+// (a duration such as 5m, or seconds) query parameters
+func parseHistoryRange(r *http.Request) (time.Time, time.Time, time.Duration, error) {
+	query := r.URL.Query()
+	to := time.Now().UTC()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("to must be an RFC 3339 timestamp")
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("from must be an RFC 3339 timestamp")
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("from must be before to")
+	}
+
+	var step time.Duration
+	if v := query.Get("step"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			step = time.Duration(seconds) * time.Second
+		} else if d, err := time.ParseDuration(v); err == nil {
+			step = d
+		} else {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("step must be a duration (e.g. 5m) or a number of seconds")
+		}
+		if step <= 0 {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("step must be positive")
+		}
+	}
+	return from, to, step, nil
+}
+
 // Helper methods
 func (h *MetricsHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -141,11 +281,7 @@ func (h *MetricsHandler) respondError(w http.ResponseWriter, status int, message
 		}
 	}
 
-	errResp := models.ErrorResponse{
-		Error:   message,
-		Message: errMsg,
-		Code:    status,
-	}
+	errResp := newErrorResponse(status, message, errMsg, err)
 
 	h.respondJSON(w, status, errResp)
 }
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/mail"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/notify"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// NotificationHandler handles the critical event email endpoints
+type NotificationHandler struct {
+	notifier *notify.Service
+	logger   *logger.Logger
+}
+
+// NewNotificationHandler creates a new notification handler
+func NewNotificationHandler(notifier *notify.Service, log *logger.Logger) *NotificationHandler {
+	return &NotificationHandler{
+		notifier: notifier,
+		logger:   log,
+	}
+}
+
+// TestEmailRequest is the request to send a test email
+type TestEmailRequest struct {
+	// To is the recipient; defaults to the caller's email address
+	To string `json:"to,omitempty"`
+}
+
+// TestEmailResponse reports a sent test email
+type TestEmailResponse struct {
+	To string `json:"to"`
+}
+
+// SendTestEmail handles POST /api/v1/admin/notifications/email/test (users.manage)
+// Sends a test email through the configured SMTP server; returns 503 when email notifications
+// are not configured and 502 when the SMTP server fails.
+func (h *NotificationHandler) SendTestEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, user, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "users.manage capability required", nil)
+		return
+	}
+
+	var req TestEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	to := req.To
+	if to == "" && user.Email != nil {
+		to = *user.Email
+	}
+	if to == "" {
+		h.respondError(w, http.StatusBadRequest, "to is required (you have no email address)", nil)
+		return
+	}
+	if _, err := mail.ParseAddress(to); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid to address", err)
+		return
+	}
+
+	if err := h.notifier.SendTest(ctx, to); err != nil {
+		if apierrors.KindOf(err) != nil {
+			h.respondError(w, apierrors.HTTPStatus(err), err.Error(), err)
+			return
+		}
+		h.respondError(w, http.StatusInternalServerError, "failed to send test email", err)
+		return
+	}
+
+	h.logger.Info("test email sent", zap.String("to", to), zap.String("requested_by", user.ID))
+	h.respondJSON(w, http.StatusOK, TestEmailResponse{To: to})
+}
+
+// Helper methods
+func (h *NotificationHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *NotificationHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// DeleteEnvironments handles DELETE /environments?label=run-id%3Dabc123&status=failed
+// Deletes every environment matching the ListEnvironments filters (label, status, team, group;
+// at least one is required). ?dry_run=true only returns the matching IDs; otherwise
+// confirm=true is required and the environments are deleted in the background: 202 with an
+// operation to poll at GET /operations/{id}. Non-admins only match environments they own.
+func (h *Handler) DeleteEnvironments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	var dryRun, confirm bool
+	for name, dst := range map[string]*bool{"dry_run": &dryRun, "confirm": &confirm} {
+		if v := query.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				h.respondError(w, http.StatusBadRequest, "invalid "+name+" (expected true or false)", err)
+				return
+			}
+			*dst = b
+		}
+	}
+	if !dryRun && !confirm {
+		h.respondError(w, http.StatusBadRequest, "confirm=true is required to delete environments (or dry_run=true to list them)", nil)
+		return
+	}
+
+	opts := orchestrator.ListEnvironmentsOptions{
+		LabelSelector: query.Get("label"),
+		TeamID:        query.Get("team"),
+		GroupID:       query.Get("group"),
+	}
+	if statusStr := query.Get("status"); statusStr != "" {
+		s := models.EnvironmentStatus(statusStr)
+		opts.Status = &s
+	}
+	if opts.Status == nil && opts.LabelSelector == "" && opts.TeamID == "" && opts.GroupID == "" {
+		h.respondError(w, http.StatusBadRequest, "a label, status, team or group filter is required", nil)
+		return
+	}
+
+	envs, err := h.orchestrator.MatchEnvironments(ctx, opts)
+	if err != nil {
+		h.respondServiceError(w, "failed to list environments", err)
+		return
+	}
+	envIDs, ok := h.deletableEnvironments(w, r, envs)
+	if !ok {
+		return
+	}
+
+	if dryRun {
+		h.respondJSON(w, http.StatusOK, models.BulkDeleteDryRunResponse{DryRun: true, EnvironmentIDs: envIDs, Total: len(envIDs)})
+		return
+	}
+
+	userID := getUserIDFromContext(ctx)
+	force := query.Get("force") == "true"
+	op, err := h.orchestrator.DeleteEnvironments(ctx, envIDs, force, userID)
+	if err != nil {
+		h.respondServiceError(w, "failed to delete environments", err)
+		return
+	}
+
+	h.logger.Info("bulk delete accepted",
+		zap.String("operation_id", op.ID),
+		zap.String("user_id", userID),
+		zap.Int("environments", len(envIDs)),
+		zap.Bool("force", force),
+	)
+	h.respondJSON(w, http.StatusAccepted, op)
+}
+
+// deletableEnvironments returns the IDs of the environments the current user may delete: all
+// of them for admins (or without auth), otherwise those the user owns
+func (h *Handler) deletableEnvironments(w http.ResponseWriter, r *http.Request, envs []models.Environment) ([]string, bool) {
+	ctx := r.Context()
+	var user *users.User
+	if h.permissionService != nil {
+		u, ok := auth.GetUserFromContext(ctx)
+		if !ok || u == nil {
+			h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+			return nil, false
+		}
+		if !roles.HasAny(ctx, u, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) {
+			user = u
+		}
+	}
+
+	envIDs := make([]string, 0, len(envs))
+	for _, env := range envs {
+		if user != nil {
+			allowed, err := h.permissionService.CheckAccess(ctx, user, env.ID, permissions.PermissionOwner)
+			if err != nil {
+				h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
+				return nil, false
+			}
+			if !allowed {
+				continue
+			}
+		}
+		envIDs = append(envIDs, env.ID)
+	}
+	return envIDs, true
+}
+
+// GetOperation handles GET /operations/{id}
+// Returns the operation's progress and per-environment results. Non-admins only see their own.
+func (h *Handler) GetOperation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	op, err := h.orchestrator.GetOperation(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		h.respondServiceError(w, "failed to get operation", err)
+		return
+	}
+	if user, ok := auth.GetUserFromContext(ctx); ok && user != nil && !roles.HasAny(ctx, user, roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin) && op.UserID != user.ID {
+		h.respondError(w, http.StatusNotFound, "operation not found", nil)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, op)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// TransferEnvironmentOwnership handles POST /environments/{id}/transfer-ownership
+// Request body: {"user_id": "<new owner>"}. Only the environment's owner and users with
+// environments.write_all can transfer it; the previous owner's owner grant moves to the new owner.
+func (h *Handler) TransferEnvironmentOwnership(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+
+	var req models.TransferOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+	if req.UserID == "" {
+		h.respondError(w, http.StatusBadRequest, "user_id is required", nil)
+		return
+	}
+
+	env, err := h.orchestrator.GetEnvironment(ctx, envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get environment", err)
+		return
+	}
+
+	// Without authentication (permissionService is nil) the check is skipped, as in requireEnvEdit
+	var actorID string
+	user, ok := auth.GetUserFromContext(ctx)
+	if ok && user != nil {
+		actorID = user.ID
+		if _, scoped := auth.GetEnvironmentScopeFromContext(ctx); scoped {
+			h.respondError(w, http.StatusForbidden, "environment tokens cannot transfer ownership", nil)
+			return
+		}
+		if env.UserID != user.ID && !roles.Has(ctx, user, roles.CapEnvironmentsWriteAll) {
+			h.respondError(w, http.StatusForbidden, "only the environment's owner or an admin can transfer ownership", nil)
+			return
+		}
+	} else if h.permissionService != nil {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+
+	updated, err := h.orchestrator.TransferEnvironmentOwnership(ctx, envID, req.UserID, actorID)
+	if err != nil {
+		h.respondServiceError(w, "failed to transfer ownership", err)
+		return
+	}
+
+	h.setEnvironmentURLs(r, updated)
+	h.respondJSON(w, http.StatusOK, updated)
+}
@@ -9,8 +9,8 @@ import (
 
 	"github.com/sciffer/agentbox/internal/logger"
 	"github.com/sciffer/agentbox/pkg/auth"
-	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
@@ -36,14 +36,14 @@ func (h *PermissionHandler) ListUserPermissions(w http.ResponseWriter, r *http.R
 	vars := mux.Vars(r)
 	targetUserID := vars["id"]
 
-	// Check permissions - users can view their own, admins can view any
+	// Check permissions - users can view their own, user managers can view any
 	currentUser, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if currentUser.ID != targetUserID && currentUser.Role != users.RoleSuperAdmin && currentUser.Role != users.RoleAdmin {
+	if currentUser.ID != targetUserID && !roles.Has(ctx, currentUser, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
@@ -71,14 +71,14 @@ func (h *PermissionHandler) GrantPermission(w http.ResponseWriter, r *http.Reque
 	vars := mux.Vars(r)
 	targetUserID := vars["id"]
 
-	// Check permissions - only admins can grant permissions
+	// Check permissions - only user managers can grant permissions
 	currentUser, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if currentUser.Role != users.RoleSuperAdmin && currentUser.Role != users.RoleAdmin {
+	if !roles.Has(ctx, currentUser, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
@@ -91,10 +91,10 @@ func (h *PermissionHandler) GrantPermission(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Parse request
-	r.Body = http.MaxBytesReader(w, r.Body, 4*1024)
 	var req GrantPermissionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
@@ -139,23 +139,23 @@ func (h *PermissionHandler) UpdatePermission(w http.ResponseWriter, r *http.Requ
 	targetUserID := vars["id"]
 	environmentID := vars["envId"]
 
-	// Check permissions - only admins can update permissions
+	// Check permissions - only user managers can update permissions
 	currentUser, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if currentUser.Role != users.RoleSuperAdmin && currentUser.Role != users.RoleAdmin {
+	if !roles.Has(ctx, currentUser, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
 
 	// Parse request
-	r.Body = http.MaxBytesReader(w, r.Body, 4*1024)
 	var req UpdatePermissionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
@@ -189,14 +189,14 @@ func (h *PermissionHandler) RevokePermission(w http.ResponseWriter, r *http.Requ
 	targetUserID := vars["id"]
 	environmentID := vars["envId"]
 
-	// Check permissions - only admins can revoke permissions
+	// Check permissions - only user managers can revoke permissions
 	currentUser, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if currentUser.Role != users.RoleSuperAdmin && currentUser.Role != users.RoleAdmin {
+	if !roles.Has(ctx, currentUser, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
@@ -263,11 +263,7 @@ func (h *PermissionHandler) respondError(w http.ResponseWriter, status int, mess
 		}
 	}
 
-	errResp := models.ErrorResponse{
-		Error:   message,
-		Message: errMsg,
-		Code:    status,
-	}
+	errResp := newErrorResponse(status, message, errMsg, err)
 
 	h.respondJSON(w, status, errResp)
 }
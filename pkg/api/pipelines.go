@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// SubmitPipeline handles POST /environments/{id}/pipelines
+// Starts running the steps as async executions in dependency order and returns the pipeline
+// immediately for polling. Dependency cycles are rejected, naming the steps along the cycle.
+func (h *Handler) SubmitPipeline(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+
+	var req models.CreatePipelineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := h.validator.ValidateCreatePipelineRequest(&req); err != nil {
+		h.respondValidationError(w, "validation failed", err)
+		return
+	}
+
+	userID := getUserIDFromContext(ctx)
+	skipCommandPolicy := hasCapability(ctx, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin)
+
+	pipeline, err := h.orchestrator.SubmitPipeline(ctx, envID, &req, userID, skipCommandPolicy)
+	if err != nil {
+		h.respondServiceError(w, "failed to submit pipeline", err)
+		return
+	}
+
+	h.logger.Info("pipeline submitted",
+		zap.String("pipeline_id", pipeline.ID),
+		zap.String("environment_id", envID),
+		zap.String("user_id", userID),
+		zap.Int("steps", len(pipeline.Steps)),
+	)
+	h.respondJSON(w, http.StatusAccepted, pipeline)
+}
+
+// GetPipeline handles GET /pipelines/{id}
+// Returns the pipeline with each step's status and execution ID
+func (h *Handler) GetPipeline(w http.ResponseWriter, r *http.Request) {
+	pipeline, err := h.orchestrator.GetPipeline(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.respondServiceError(w, "failed to get pipeline", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, pipeline)
+}
+
+// CancelPipeline handles DELETE /pipelines/{id}
+// Cancels the executions of running steps and marks pending steps canceled
+func (h *Handler) CancelPipeline(w http.ResponseWriter, r *http.Request) {
+	pipeline, err := h.orchestrator.CancelPipeline(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		h.respondServiceError(w, "failed to cancel pipeline", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, pipeline)
+}
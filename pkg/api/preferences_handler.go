@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/preferences"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// PreferencesHandler handles user preference endpoints
+type PreferencesHandler struct {
+	preferencesService *preferences.Service
+	logger             *logger.Logger
+}
+
+// NewPreferencesHandler creates a new preferences handler
+func NewPreferencesHandler(preferencesService *preferences.Service, log *logger.Logger) *PreferencesHandler {
+	return &PreferencesHandler{
+		preferencesService: preferencesService,
+		logger:             log,
+	}
+}
+
+// GetMyPreferences handles GET /api/v1/users/me/preferences
+// Returns the caller's preferences (null = unset) and the preferences in effect for them.
+func (h *PreferencesHandler) GetMyPreferences(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+
+	resp, err := h.preferencesService.Get(ctx, user.ID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get preferences", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// UpdateMyPreferences handles PUT /api/v1/users/me/preferences
+// Replaces the caller's preferences; omitted or null fields fall back to the organization defaults.
+func (h *PreferencesHandler) UpdateMyPreferences(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+
+	prefs, ok := h.decodePreferences(w, r)
+	if !ok {
+		return
+	}
+
+	resp, err := h.preferencesService.Set(ctx, user.ID, prefs)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to save preferences", err)
+		return
+	}
+
+	h.logger.Info("preferences updated", zap.String("user_id", user.ID))
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// GetDefaults handles GET /api/v1/admin/preferences (users.manage)
+// Returns the organization defaults (null = the configured default) and the defaults in effect.
+func (h *PreferencesHandler) GetDefaults(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !hasCapability(ctx, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "users.manage capability required", nil)
+		return
+	}
+
+	resp, err := h.preferencesService.Defaults(ctx)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get preference defaults", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// UpdateDefaults handles PUT /api/v1/admin/preferences (users.manage)
+// Replaces the organization defaults applied to unset user preferences; omitted or null fields
+// fall back to the preferences section of the server configuration.
+func (h *PreferencesHandler) UpdateDefaults(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, user, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "users.manage capability required", nil)
+		return
+	}
+
+	prefs, ok := h.decodePreferences(w, r)
+	if !ok {
+		return
+	}
+
+	resp, err := h.preferencesService.SetDefaults(ctx, prefs, user.ID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to save preference defaults", err)
+		return
+	}
+
+	h.logger.Info("preference defaults updated", zap.String("updated_by", user.ID))
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// decodePreferences reads and validates a preferences body; on failure the error response has
+// been written
+func (h *PreferencesHandler) decodePreferences(w http.ResponseWriter, r *http.Request) (*models.UserPreferences, bool) {
+	var prefs models.UserPreferences
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&prefs); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return nil, false
+	}
+	defer r.Body.Close()
+	// Stamped when saved
+	prefs.UpdatedAt = nil
+
+	if err := validator.ValidateUserPreferences(&prefs, h.preferencesService.Profiles()); err != nil {
+		h.logger.Debug("invalid preferences", zap.Error(err))
+		h.respondJSON(w, http.StatusBadRequest, newValidationErrorResponse("invalid preferences", err))
+		return nil, false
+	}
+	return &prefs, true
+}
+
+// Helper methods
+func (h *PreferencesHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *PreferencesHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
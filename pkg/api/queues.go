@@ -0,0 +1,58 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// GetQueues handles GET /admin/queues (environments.read_all or platform.admin)
+// Returns the depth of the provisioning and execution queues: in flight, waiting (also per
+// environment) and the average wait over the last 5 minutes
+func (h *Handler) GetQueues(w http.ResponseWriter, r *http.Request) {
+	if !hasCapability(r.Context(), roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, h.orchestrator.QueueStatus())
+}
+
+// PrometheusMetrics handles GET /metrics: the queue depths and config reload counters in the
+// Prometheus text format
+func (h *Handler) PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	status := h.orchestrator.QueueStatus()
+	var b strings.Builder
+	gauge := func(name, help string, value func(*orchestrator.QueueStatus) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, q := range []*orchestrator.QueueStatus{status.Provisioning, status.Executions} {
+			fmt.Fprintf(&b, "%s{queue=%q} %g\n", name, q.Name, value(q))
+		}
+	}
+	gauge("agentbox_queue_capacity", "Slots of the queue (concurrent provisionings or executions).",
+		func(q *orchestrator.QueueStatus) float64 { return float64(q.Capacity) })
+	gauge("agentbox_queue_in_flight", "Provisionings or executions holding a slot.",
+		func(q *orchestrator.QueueStatus) float64 { return float64(q.InFlight) })
+	gauge("agentbox_queue_waiting", "Provisionings or executions waiting for a slot.",
+		func(q *orchestrator.QueueStatus) float64 { return float64(q.Waiting) })
+	gauge("agentbox_queue_wait_seconds_avg", "Average time slots were waited for over the last 5 minutes.",
+		func(q *orchestrator.QueueStatus) float64 { return q.AvgWaitSeconds })
+	gauge("agentbox_queue_hold_seconds_avg", "Average time slots were held over the last 5 minutes.",
+		func(q *orchestrator.QueueStatus) float64 { return q.AvgHoldSeconds })
+	if h.configStore != nil {
+		reloads := h.configStore.Status()
+		fmt.Fprintf(&b, "# HELP agentbox_config_reloads_total Config reloads by result.\n# TYPE agentbox_config_reloads_total counter\n")
+		fmt.Fprintf(&b, "agentbox_config_reloads_total{result=\"success\"} %d\n", reloads.ReloadCount)
+		fmt.Fprintf(&b, "agentbox_config_reloads_total{result=\"failure\"} %d\n", reloads.ReloadFailures)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		h.logger.Warn("failed to write metrics", zap.Error(err))
+	}
+}
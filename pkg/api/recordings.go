@@ -0,0 +1,73 @@
+package api
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/recording"
+)
+
+// ListSessionRecordings handles GET /environments/{id}/sessions
+func (h *Handler) ListSessionRecordings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	envID := mux.Vars(r)["id"]
+
+	if _, err := h.orchestrator.GetEnvironment(ctx, envID); err != nil {
+		h.respondServiceError(w, "failed to get environment", err)
+		return
+	}
+	// Recordings show everything typed into the environment: only editors may read them
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+	if h.recordings == nil {
+		h.respondError(w, http.StatusNotFound, "session recording is not enabled", nil)
+		return
+	}
+
+	recordings, err := h.recordings.List(ctx, envID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list session recordings", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": recordings,
+		"total":    len(recordings),
+	})
+}
+
+// GetSessionRecording handles GET /sessions/{id}/recording, streaming the asciicast file
+func (h *Handler) GetSessionRecording(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if h.recordings == nil {
+		h.respondError(w, http.StatusNotFound, "session recording is not enabled", nil)
+		return
+	}
+
+	rec, err := h.recordings.Get(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		h.respondServiceError(w, "failed to get session recording", err)
+		return
+	}
+	if _, ok := h.requireEnvEdit(w, r, rec.EnvironmentID); !ok {
+		return
+	}
+
+	_, f, err := h.recordings.Open(ctx, rec.ID)
+	if err != nil {
+		h.respondServiceError(w, "failed to open session recording", err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", recording.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+rec.ID+`.cast"`)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		h.logger.Warn("failed to stream session recording", zap.String("recording_id", rec.ID), zap.Error(err))
+	}
+}
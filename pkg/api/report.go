@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// SetCallbackVerifier enables result reports: executions authenticate them with the callback
+// token their pod gets as AGENTBOX_CALLBACK_TOKEN, which authService validates
+func (h *Handler) SetCallbackVerifier(authService *auth.Service) {
+	h.callbacks = authService
+}
+
+// ReportExecution handles POST /api/v1/executions/{id}/report
+// Needs no user credentials: the execution's workload authorizes the request with its callback
+// token (Authorization: Bearer <AGENTBOX_CALLBACK_TOKEN>), which is only valid for that
+// execution. The reported metadata is merged into the execution's metadata.
+func (h *Handler) ReportExecution(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	execID := mux.Vars(r)["id"]
+	if h.callbacks == nil {
+		h.respondError(w, http.StatusNotFound, "result reports are not enabled", nil)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		h.respondError(w, http.StatusUnauthorized, "missing callback token", nil)
+		return
+	}
+	claims, err := h.callbacks.ValidateCallbackToken(token)
+	if err != nil {
+		h.respondError(w, http.StatusUnauthorized, "invalid callback token", err)
+		return
+	}
+	if claims.ExecutionID != execID {
+		h.respondError(w, http.StatusForbidden, "callback token is not valid for this execution", nil)
+		return
+	}
+
+	var req models.ReportExecutionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	exec, err := h.orchestrator.GetExecution(ctx, execID)
+	if err != nil {
+		h.respondServiceError(w, "failed to get execution", err)
+		return
+	}
+	if exec.EnvironmentID != claims.EnvironmentID {
+		h.respondError(w, http.StatusForbidden, "callback token is not valid for this execution",
+			fmt.Errorf("token environment %s, execution environment %s", claims.EnvironmentID, exec.EnvironmentID))
+		return
+	}
+
+	metadata := maps.Clone(exec.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string, len(req.Metadata))
+	}
+	maps.Copy(metadata, req.Metadata)
+	if err := h.validator.ValidateMetadata(metadata); err != nil {
+		h.respondValidationError(w, "validation failed", err)
+		return
+	}
+	exec, err = h.orchestrator.UpdateExecution(ctx, execID, &models.UpdateExecutionRequest{Metadata: &metadata})
+	if err != nil {
+		h.respondServiceError(w, "failed to record execution report", err)
+		return
+	}
+
+	h.logger.Info("execution result reported",
+		zap.String("exec_id", execID),
+		zap.String("environment_id", exec.EnvironmentID),
+		zap.Int("keys", len(req.Metadata)),
+	)
+	h.respondJSON(w, http.StatusOK, models.NewExecutionResponse(exec))
+}
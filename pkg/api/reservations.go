@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// CreateReservation handles POST /reservations
+// Reserves capacity for `environments` environments of `resources` (or of the resource profile
+// named by `profile`) between starts_at and ends_at. Environments created with the reservation's
+// ID as reservation_id during the window take the place of its placeholder pods.
+func (h *Handler) CreateReservation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req models.CreateReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Profile != "" {
+		if req.Resources != (models.ResourceSpec{}) {
+			h.respondError(w, http.StatusBadRequest, "set either resources or profile, not both", nil)
+			return
+		}
+		var spec models.ResourceSpec
+		ok := false
+		if h.preferences != nil {
+			spec, ok = h.preferences.Profile(req.Profile)
+		}
+		if !ok {
+			h.respondError(w, http.StatusBadRequest, fmt.Sprintf("unknown resource profile %q", req.Profile), nil)
+			return
+		}
+		req.Resources = spec
+	}
+	if err := h.validator.ValidateResourceSpec(&req.Resources); err != nil {
+		h.respondValidationError(w, "validation failed", err)
+		return
+	}
+
+	teamLimit := 0
+	if req.TeamID != "" {
+		limit, err := h.teamReservationLimit(ctx, req.TeamID)
+		if err != nil {
+			h.respondServiceError(w, "failed to check team", err)
+			return
+		}
+		teamLimit = limit
+	}
+
+	userID := getUserIDFromContext(ctx)
+	rsv, err := h.orchestrator.CreateReservation(ctx, &req, userID, teamLimit)
+	if err != nil {
+		h.respondServiceError(w, "failed to create reservation", err)
+		return
+	}
+
+	h.logger.Info("reservation created",
+		zap.String("reservation_id", rsv.ID),
+		zap.String("user_id", userID),
+		zap.Int("environments", rsv.Environments),
+	)
+	h.respondJSON(w, http.StatusCreated, rsv)
+}
+
+// ListReservations handles GET /reservations
+// Non-admins see the reservations they created and those of their teams.
+func (h *Handler) ListReservations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	resp, err := h.orchestrator.ListReservations(ctx)
+	if err != nil {
+		h.respondServiceError(w, "failed to list reservations", err)
+		return
+	}
+
+	visible := resp.Reservations[:0]
+	for i := range resp.Reservations {
+		allowed, err := h.canViewReservation(ctx, &resp.Reservations[i])
+		if err != nil {
+			h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
+			return
+		}
+		if allowed {
+			visible = append(visible, resp.Reservations[i])
+		}
+	}
+	resp.Reservations = visible
+	resp.Total = len(visible)
+	h.respondJSON(w, http.StatusOK, resp)
+}
+
+// GetReservation handles GET /reservations/{id}
+// Non-admins only see the reservations they created and those of their teams.
+func (h *Handler) GetReservation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rsv, err := h.orchestrator.GetReservation(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		h.respondServiceError(w, "failed to get reservation", err)
+		return
+	}
+	allowed, err := h.canViewReservation(ctx, rsv)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
+		return
+	}
+	if !allowed {
+		h.respondError(w, http.StatusNotFound, "reservation not found", nil)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, rsv)
+}
+
+// CancelReservation handles DELETE /reservations/{id}
+// Deletes the placeholder pods and ends the reservation; environments created with it keep running
+func (h *Handler) CancelReservation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	rsv, err := h.orchestrator.GetReservation(ctx, id)
+	if err != nil {
+		h.respondServiceError(w, "failed to get reservation", err)
+		return
+	}
+	if !h.canEditReservation(w, r, rsv) {
+		return
+	}
+
+	rsv, err = h.orchestrator.CancelReservation(ctx, id)
+	if err != nil {
+		h.respondServiceError(w, "failed to cancel reservation", err)
+		return
+	}
+
+	h.logger.Info("reservation canceled", zap.String("reservation_id", id))
+	h.respondJSON(w, http.StatusOK, rsv)
+}
+
+// teamReservationLimit checks that the user may reserve capacity for the team (the team exists
+// and the user is an editor of it) and returns the team's environment quota (0 = unlimited)
+func (h *Handler) teamReservationLimit(ctx context.Context, teamID string) (int, error) {
+	if h.teamService == nil {
+		return 0, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "teams are not enabled")
+	}
+	team, err := h.teamService.GetTeam(ctx, teamID)
+	if err != nil {
+		return 0, err
+	}
+	if h.permissionService != nil {
+		user, ok := auth.GetUserFromContext(ctx)
+		if !ok || user == nil {
+			return 0, apierrors.New(apierrors.Unauthorized, "", "not authenticated")
+		}
+		allowed, err := h.permissionService.CheckTeamAccess(ctx, user, teamID, permissions.PermissionEditor)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check permissions: %w", err)
+		}
+		if !allowed {
+			return 0, apierrors.New(apierrors.Forbidden, "", "insufficient permissions to reserve capacity for this team")
+		}
+	}
+	return team.MaxEnvironments, nil
+}
+
+// canViewReservation reports whether the user may see the reservation: its creator, an admin,
+// or for a team's reservation a member of the team
+func (h *Handler) canViewReservation(ctx context.Context, rsv *models.Reservation) (bool, error) {
+	if h.permissionService == nil {
+		return true, nil
+	}
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok || user == nil {
+		return false, nil
+	}
+	if roles.HasAny(ctx, user, roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin) || user.ID == rsv.UserID {
+		return true, nil
+	}
+	if rsv.TeamID == "" {
+		return false, nil
+	}
+	allowed, err := h.permissionService.CheckTeamAccess(ctx, user, rsv.TeamID, permissions.PermissionViewer)
+	if err != nil {
+		return false, fmt.Errorf("failed to check permissions: %w", err)
+	}
+	return allowed, nil
+}
+
+// canEditReservation checks that the user may change the reservation: its creator, an admin, or
+// for a team's reservation an editor of the team. Writes the error response when not.
+func (h *Handler) canEditReservation(w http.ResponseWriter, r *http.Request, rsv *models.Reservation) bool {
+	if h.permissionService == nil {
+		return true
+	}
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok || user == nil {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return false
+	}
+	if roles.HasAny(ctx, user, roles.CapEnvironmentsWriteAll, roles.CapPlatformAdmin) || user.ID == rsv.UserID {
+		return true
+	}
+	if rsv.TeamID != "" {
+		allowed, err := h.permissionService.CheckTeamAccess(ctx, user, rsv.TeamID, permissions.PermissionEditor)
+		if err != nil {
+			h.respondError(w, http.StatusInternalServerError, "failed to check permissions", err)
+			return false
+		}
+		if allowed {
+			return true
+		}
+	}
+	h.respondError(w, http.StatusForbidden, "insufficient permissions to change this reservation", nil)
+	return false
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// RoleHandler handles role administration endpoints
+type RoleHandler struct {
+	roleService *roles.Service
+	logger      *logger.Logger
+}
+
+// NewRoleHandler creates a new role handler
+func NewRoleHandler(roleService *roles.Service, log *logger.Logger) *RoleHandler {
+	return &RoleHandler{
+		roleService: roleService,
+		logger:      log,
+	}
+}
+
+// hasCapability reports whether the current user's role grants one of the capabilities
+func hasCapability(ctx context.Context, capabilities ...string) bool {
+	user, ok := auth.GetUserFromContext(ctx)
+	return ok && roles.HasAny(ctx, user, capabilities...)
+}
+
+// ListRoles handles GET /api/v1/admin/roles (users.manage or audit.read)
+func (h *RoleHandler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !hasCapability(ctx, roles.CapUsersManage) && !hasCapability(ctx, roles.CapAuditRead) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	list, err := h.roleService.ListRoles(ctx)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list roles", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"roles":        list,
+		"total":        len(list),
+		"capabilities": roles.AllCapabilities,
+	})
+}
+
+// GetRole handles GET /api/v1/admin/roles/{name} (users.manage or audit.read)
+func (h *RoleHandler) GetRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !hasCapability(ctx, roles.CapUsersManage) && !hasCapability(ctx, roles.CapAuditRead) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	role, err := h.roleService.GetRole(ctx, mux.Vars(r)["name"])
+	if err != nil {
+		h.respondRoleError(w, "failed to get role", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, role)
+}
+
+// CreateRole handles POST /api/v1/admin/roles (users.manage)
+// Only capabilities the current user has can be put into a role.
+func (h *RoleHandler) CreateRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, user, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	var req roles.CreateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	for _, c := range req.Capabilities {
+		if roles.ValidCapability(c) && !roles.Has(ctx, user, c) {
+			h.respondError(w, http.StatusForbidden, "cannot grant a capability you do not have: "+c, nil)
+			return
+		}
+	}
+
+	role, err := h.roleService.CreateRole(ctx, &req, user.ID)
+	if err != nil {
+		h.respondRoleError(w, "failed to create role", err)
+		return
+	}
+
+	h.logger.Info("role created",
+		zap.String("role", role.Name),
+		zap.String("created_by", user.ID),
+	)
+
+	h.respondJSON(w, http.StatusCreated, role)
+}
+
+// DeleteRole handles DELETE /api/v1/admin/roles/{name} (users.manage)
+// Built-in roles and roles still assigned to users cannot be deleted.
+func (h *RoleHandler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, user, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if err := h.roleService.DeleteRole(ctx, name, user.ID); err != nil {
+		h.respondRoleError(w, "failed to delete role", err)
+		return
+	}
+
+	h.logger.Info("role deleted",
+		zap.String("role", name),
+		zap.String("deleted_by", user.ID),
+	)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondRoleError maps role service errors to HTTP status codes
+func (h *RoleHandler) respondRoleError(w http.ResponseWriter, message string, err error) {
+	if apierrors.KindOf(err) != nil {
+		h.respondError(w, apierrors.HTTPStatus(err), err.Error(), err)
+		return
+	}
+	h.respondError(w, http.StatusInternalServerError, message, err)
+}
+
+// Helper methods
+func (h *RoleHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *RoleHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
@@ -3,8 +3,11 @@ package api
 import (
 	"github.com/gorilla/mux"
 
+	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/clientip"
 	"github.com/sciffer/agentbox/pkg/proxy"
+	"github.com/sciffer/agentbox/pkg/roles"
 )
 
 // RouterConfig holds all handlers needed for routing
@@ -15,8 +18,32 @@ type RouterConfig struct {
 	APIKeyHandler     *APIKeyHandler
 	MetricsHandler    *MetricsHandler
 	PermissionHandler *PermissionHandler
-	ProxyHandler      *proxy.Proxy
-	AuthService       *auth.Service
+	TeamHandler       *TeamHandler
+	EnvTokenHandler   *EnvironmentTokenHandler
+	ConfigHandler     *ConfigHandler
+	RoleHandler       *RoleHandler
+	AuditHandler      *AuditHandler
+	ExportJobHandler  *ExportJobHandler
+	// ImpersonationHandler lets super admins act as other users (optional)
+	ImpersonationHandler *ImpersonationHandler
+	// PreferencesHandler serves user preferences and their organization defaults (optional)
+	PreferencesHandler *PreferencesHandler
+	// NotificationHandler sends test critical event emails (optional)
+	NotificationHandler *NotificationHandler
+	// FaultHandler controls Kubernetes fault injection (only set when it is enabled)
+	FaultHandler *FaultHandler
+	ProxyHandler *proxy.Proxy
+	// PortForwarder serves port forwarding to environments (optional)
+	PortForwarder *proxy.PortForwarder
+	AuthService   *auth.Service
+	// RoleService resolves the capabilities of custom roles (nil: only the built-in roles grant any)
+	RoleService *roles.Service
+	// BodyLimits caps request body sizes per route group (zero values use the defaults)
+	BodyLimits config.BodyLimitsConfig
+	// DisableCompression turns off gzip compression of responses
+	DisableCompression bool
+	// ClientIP resolves the client address of requests behind trusted proxies (nil trusts none)
+	ClientIP *clientip.Resolver
 }
 
 // NewRouter creates and configures the HTTP router
@@ -32,6 +59,8 @@ func NewRouter(configOrHandler interface{}, proxyHandlerOrNil ...*proxy.Proxy) *
 		if len(proxyHandlerOrNil) > 0 {
 			proxyHandler = proxyHandlerOrNil[0]
 		}
+		r.Use((&clientip.Resolver{}).Middleware, tracingMiddleware(handler.logger.Logger), compressionMiddleware,
+			bodyLimitMiddleware(config.BodyLimitsConfig{}))
 
 		// Health check (no auth required)
 		api.HandleFunc("/health", handler.HealthCheck).Methods("GET")
@@ -39,22 +68,75 @@ func NewRouter(configOrHandler interface{}, proxyHandlerOrNil ...*proxy.Proxy) *
 		// Environment routes (no auth for backward compatibility in tests)
 		api.HandleFunc("/environments", handler.CreateEnvironment).Methods("POST")
 		api.HandleFunc("/environments", handler.ListEnvironments).Methods("GET")
+		api.HandleFunc("/environments", handler.DeleteEnvironments).Methods("DELETE")
+		api.HandleFunc("/environments/import", handler.ImportEnvironments).Methods("POST")
 		api.HandleFunc("/environments/{id}", handler.GetEnvironment).Methods("GET")
 		api.HandleFunc("/environments/{id}", handler.UpdateEnvironment).Methods("PATCH")
 		api.HandleFunc("/environments/{id}", handler.DeleteEnvironment).Methods("DELETE")
+		api.HandleFunc("/environments/{id}/wait", handler.WaitForEnvironment).Methods("GET")
+		api.HandleFunc("/environments/{id}/labels", handler.UpdateEnvironmentLabels).Methods("POST")
 		api.HandleFunc("/environments/{id}/retry", handler.RetryReconciliation).Methods("POST")
+		api.HandleFunc("/environments/{id}/transfer-ownership", handler.TransferEnvironmentOwnership).Methods("POST")
+		api.HandleFunc("/environments/{id}/export", handler.ExportEnvironment).Methods("GET")
+		api.HandleFunc("/environments/{id}/archive", handler.GetEnvironmentArchive).Methods("GET")
+		api.HandleFunc("/environments/{id}/archive", handler.ArchiveAndDeleteEnvironment).Methods("POST")
+		api.HandleFunc("/environments/{id}/archives", handler.ListStoredArchives).Methods("GET")
+		api.HandleFunc("/environments/{id}/archives/{name}", handler.GetStoredArchive).Methods("GET")
 		api.HandleFunc("/environments/{id}/exec", handler.ExecuteCommand).Methods("POST")
+		api.HandleFunc("/environments/{id}/exec/queue", handler.GetExecQueue).Methods("GET")
 		// Async execution (queues isolated pod execution, returns execution ID)
 		api.HandleFunc("/environments/{id}/run", handler.SubmitExecution).Methods("POST")
 		api.HandleFunc("/environments/{id}/executions", handler.ListExecutions).Methods("GET")
+		api.HandleFunc("/environments/{id}/executions", handler.PurgeExecutions).Methods("DELETE")
+		api.HandleFunc("/environments/{id}/executions/cancel-all", handler.CancelAllExecutions).Methods("POST")
+		api.HandleFunc("/environments/{id}/stats", handler.GetExecutionStats).Methods("GET")
+		api.HandleFunc("/environments/{id}/activity", handler.GetActivity).Methods("GET")
+		api.HandleFunc("/environments/{id}/events", handler.ListEvents).Methods("GET")
+		api.HandleFunc("/environments/{id}/pipelines", handler.SubmitPipeline).Methods("POST")
+		api.HandleFunc("/environments/{id}/pool/refresh", handler.RefreshStandbyPool).Methods("POST")
+		api.HandleFunc("/environments/{id}/pool/drain", handler.DrainStandbyPool).Methods("POST")
+		api.HandleFunc("/environments/{id}/cordon", handler.CordonEnvironment).Methods("POST")
+		api.HandleFunc("/environments/{id}/uncordon", handler.UncordonEnvironment).Methods("POST")
+		api.HandleFunc("/environments/{id}/snapshots", handler.ListSnapshots).Methods("GET")
+		api.HandleFunc("/environments/{id}/snapshots", handler.CreateSnapshot).Methods("POST")
+		api.HandleFunc("/environments/{id}/snapshots/{snapshotId}/restore", handler.RestoreSnapshot).Methods("POST")
 		if proxyHandler != nil {
 			api.HandleFunc("/environments/{id}/attach", handler.AttachWebSocket(proxyHandler)).Methods("GET")
 		}
 		api.HandleFunc("/environments/{id}/logs", handler.GetLogs).Methods("GET")
 
+		// Environment group routes
+		api.HandleFunc("/environment-groups", handler.CreateEnvironmentGroup).Methods("POST")
+		api.HandleFunc("/environment-groups", handler.ListEnvironmentGroups).Methods("GET")
+		api.HandleFunc("/environment-groups/{id}", handler.GetEnvironmentGroup).Methods("GET")
+		api.HandleFunc("/environment-groups/{id}", handler.UpdateEnvironmentGroup).Methods("PATCH")
+		api.HandleFunc("/environment-groups/{id}", handler.DeleteEnvironmentGroup).Methods("DELETE")
+		api.HandleFunc("/reservations", handler.CreateReservation).Methods("POST")
+		api.HandleFunc("/reservations", handler.ListReservations).Methods("GET")
+		api.HandleFunc("/reservations/{id}", handler.GetReservation).Methods("GET")
+		api.HandleFunc("/reservations/{id}", handler.CancelReservation).Methods("DELETE")
+
 		// Execution status routes
 		api.HandleFunc("/executions/{id}", handler.GetExecution).Methods("GET")
 		api.HandleFunc("/executions/{id}", handler.CancelExecution).Methods("DELETE")
+		api.HandleFunc("/executions/{id}", handler.UpdateExecution).Methods("PATCH")
+		api.HandleFunc("/executions/{id}/requeue", handler.RequeueExecution).Methods("POST")
+
+		// Pipeline routes
+		api.HandleFunc("/pipelines/{id}", handler.GetPipeline).Methods("GET")
+		api.HandleFunc("/pipelines/{id}", handler.CancelPipeline).Methods("DELETE")
+
+		// Operation routes (bulk requests)
+		api.HandleFunc("/operations/{id}", handler.GetOperation).Methods("GET")
+
+		// Image inspection
+		api.HandleFunc("/images/inspect", handler.InspectImage).Methods("GET")
+
+		// Free-text search across environments and executions
+		api.HandleFunc("/search", handler.Search).Methods("GET")
+
+		// Network policy presets
+		api.HandleFunc("/policies/network", handler.ListNetworkPresets).Methods("GET")
 
 		// Pool status (for debugging)
 		api.HandleFunc("/pool/status", handler.GetPoolStatus).Methods("GET")
@@ -67,41 +149,142 @@ func NewRouter(configOrHandler interface{}, proxyHandlerOrNil ...*proxy.Proxy) *
 	if !ok {
 		panic("NewRouter: expected *Handler or *RouterConfig")
 	}
+	r.Use(config.ClientIP.Middleware, tracingMiddleware(config.Handler.logger.Logger))
+	if !config.DisableCompression {
+		r.Use(compressionMiddleware)
+	}
+	r.Use(bodyLimitMiddleware(config.BodyLimits))
 
 	// Public routes (no auth required)
 	api.HandleFunc("/health", config.Handler.HealthCheck).Methods("GET")
+	// Prometheus scrape endpoint (aggregate queue depths only)
+	r.HandleFunc("/metrics", config.Handler.PrometheusMetrics).Methods("GET")
+	// Status badges are authorized by their signed URL
+	api.HandleFunc("/environments/{id}/badge", config.Handler.GetEnvironmentBadge).Methods("GET")
+	// Result reports are authorized by the reporting execution's callback token
+	api.HandleFunc("/executions/{id}/report", config.Handler.ReportExecution).Methods("POST")
+
+	// Middleware of every authenticated route: the user, the environment scope of their token and
+	// the capabilities of their role
+	protectedMiddleware := []mux.MiddlewareFunc{config.AuthService.Middleware, environmentScopeMiddleware(config.Handler.orchestrator)}
+	if config.RoleService != nil {
+		protectedMiddleware = append(protectedMiddleware, config.RoleService.Middleware)
+	}
 
 	// Auth routes (no auth required for login)
 	authRoutes := api.PathPrefix("/auth").Subrouter()
 	authRoutes.HandleFunc("/login", config.AuthHandler.Login).Methods("POST")
 	authRoutes.HandleFunc("/logout", config.AuthHandler.Logout).Methods("POST")
-	authRoutes.HandleFunc("/me", config.AuthHandler.GetMe).Methods("GET")
-	authRoutes.HandleFunc("/change-password", config.AuthHandler.ChangePassword).Methods("POST")
+	// The current user's routes are authenticated like the protected routes
+	authenticated := authRoutes.NewRoute().Subrouter()
+	authenticated.Use(protectedMiddleware...)
+	authenticated.HandleFunc("/me", config.AuthHandler.GetMe).Methods("GET")
+	authenticated.HandleFunc("/change-password", config.AuthHandler.ChangePassword).Methods("POST")
+	// Single sign-on (404 unless OIDC is configured)
+	authRoutes.HandleFunc("/oidc/login", config.AuthHandler.OIDCLogin).Methods("GET")
+	authRoutes.HandleFunc("/oidc/callback", config.AuthHandler.OIDCCallback).Methods("GET")
 
 	// Protected routes (require authentication)
 	protected := api.PathPrefix("").Subrouter()
-	protected.Use(config.AuthService.Middleware)
+	protected.Use(protectedMiddleware...)
 
 	// Environment routes (protected)
 	protected.HandleFunc("/environments", config.Handler.CreateEnvironment).Methods("POST")
 	protected.HandleFunc("/environments", config.Handler.ListEnvironments).Methods("GET")
+	protected.HandleFunc("/environments", config.Handler.DeleteEnvironments).Methods("DELETE")
+	protected.HandleFunc("/environments/import", config.Handler.ImportEnvironments).Methods("POST")
 	protected.HandleFunc("/environments/{id}", config.Handler.GetEnvironment).Methods("GET")
 	protected.HandleFunc("/environments/{id}", config.Handler.UpdateEnvironment).Methods("PATCH")
 	protected.HandleFunc("/environments/{id}", config.Handler.DeleteEnvironment).Methods("DELETE")
+	// Long-poll (or stream) until the environment is running or failed
+	protected.HandleFunc("/environments/{id}/wait", config.Handler.WaitForEnvironment).Methods("GET")
+	protected.HandleFunc("/environments/{id}/labels", config.Handler.UpdateEnvironmentLabels).Methods("POST")
 	protected.HandleFunc("/environments/{id}/retry", config.Handler.RetryReconciliation).Methods("POST")
+	protected.HandleFunc("/environments/{id}/transfer-ownership", config.Handler.TransferEnvironmentOwnership).Methods("POST")
+	protected.HandleFunc("/environments/{id}/export", config.Handler.ExportEnvironment).Methods("GET")
+	protected.HandleFunc("/environments/{id}/archive", config.Handler.GetEnvironmentArchive).Methods("GET")
+	protected.HandleFunc("/environments/{id}/archive", config.Handler.ArchiveAndDeleteEnvironment).Methods("POST")
+	protected.HandleFunc("/environments/{id}/archives", config.Handler.ListStoredArchives).Methods("GET")
+	protected.HandleFunc("/environments/{id}/archives/{name}", config.Handler.GetStoredArchive).Methods("GET")
 	// Execute in existing pod (shares state between commands)
 	protected.HandleFunc("/environments/{id}/exec", config.Handler.ExecuteCommand).Methods("POST")
+	protected.HandleFunc("/environments/{id}/exec/queue", config.Handler.GetExecQueue).Methods("GET")
 	// Async execution (queues isolated pod execution, returns execution ID)
 	protected.HandleFunc("/environments/{id}/run", config.Handler.SubmitExecution).Methods("POST")
 	protected.HandleFunc("/environments/{id}/executions", config.Handler.ListExecutions).Methods("GET")
+	protected.HandleFunc("/environments/{id}/executions", config.Handler.PurgeExecutions).Methods("DELETE")
+	protected.HandleFunc("/environments/{id}/executions/cancel-all", config.Handler.CancelAllExecutions).Methods("POST")
+	protected.HandleFunc("/environments/{id}/stats", config.Handler.GetExecutionStats).Methods("GET")
+	protected.HandleFunc("/environments/{id}/activity", config.Handler.GetActivity).Methods("GET")
+	protected.HandleFunc("/environments/{id}/events", config.Handler.ListEvents).Methods("GET")
+	// Signed status badge URLs (editors)
+	protected.HandleFunc("/environments/{id}/badge/url", config.Handler.GetEnvironmentBadgeURL).Methods("GET")
+	protected.HandleFunc("/environments/{id}/badge/rotate", config.Handler.RotateEnvironmentBadge).Methods("POST")
+	// Pipelines (steps run as async executions in dependency order)
+	protected.HandleFunc("/environments/{id}/pipelines", config.Handler.SubmitPipeline).Methods("POST")
+	// Standby pool administration (editors)
+	protected.HandleFunc("/environments/{id}/pool/refresh", config.Handler.RefreshStandbyPool).Methods("POST")
+	protected.HandleFunc("/environments/{id}/pool/drain", config.Handler.DrainStandbyPool).Methods("POST")
+	protected.HandleFunc("/environments/{id}/cordon", config.Handler.CordonEnvironment).Methods("POST")
+	protected.HandleFunc("/environments/{id}/uncordon", config.Handler.UncordonEnvironment).Methods("POST")
+	// Workspace snapshots (environments with workspace_snapshots set)
+	protected.HandleFunc("/environments/{id}/snapshots", config.Handler.ListSnapshots).Methods("GET")
+	protected.HandleFunc("/environments/{id}/snapshots", config.Handler.CreateSnapshot).Methods("POST")
+	protected.HandleFunc("/environments/{id}/snapshots/{snapshotId}/restore", config.Handler.RestoreSnapshot).Methods("POST")
 	if config.ProxyHandler != nil {
 		protected.HandleFunc("/environments/{id}/attach", config.Handler.AttachWebSocket(config.ProxyHandler)).Methods("GET")
 	}
+	if config.PortForwarder != nil {
+		protected.HandleFunc("/environments/{id}/port-forward", config.Handler.PortForward(config.PortForwarder)).Methods("GET")
+	}
 	protected.HandleFunc("/environments/{id}/logs", config.Handler.GetLogs).Methods("GET")
+	// Recorded attach sessions (environments with record_sessions enabled)
+	protected.HandleFunc("/environments/{id}/sessions", config.Handler.ListSessionRecordings).Methods("GET")
+	protected.HandleFunc("/sessions/{id}/recording", config.Handler.GetSessionRecording).Methods("GET")
+	if config.EnvTokenHandler != nil {
+		protected.HandleFunc("/environments/{id}/tokens", config.EnvTokenHandler.CreateToken).Methods("POST")
+		protected.HandleFunc("/environments/{id}/tokens", config.EnvTokenHandler.ListTokens).Methods("GET")
+		protected.HandleFunc("/environments/{id}/tokens/{tokenId}", config.EnvTokenHandler.RevokeToken).Methods("DELETE")
+	}
+
+	// Environment group routes (protected)
+	protected.HandleFunc("/environment-groups", config.Handler.CreateEnvironmentGroup).Methods("POST")
+	protected.HandleFunc("/environment-groups", config.Handler.ListEnvironmentGroups).Methods("GET")
+	protected.HandleFunc("/environment-groups/{id}", config.Handler.GetEnvironmentGroup).Methods("GET")
+	protected.HandleFunc("/environment-groups/{id}", config.Handler.UpdateEnvironmentGroup).Methods("PATCH")
+	protected.HandleFunc("/environment-groups/{id}", config.Handler.DeleteEnvironmentGroup).Methods("DELETE")
+	protected.HandleFunc("/reservations", config.Handler.CreateReservation).Methods("POST")
+	protected.HandleFunc("/reservations", config.Handler.ListReservations).Methods("GET")
+	protected.HandleFunc("/reservations/{id}", config.Handler.GetReservation).Methods("GET")
+	protected.HandleFunc("/reservations/{id}", config.Handler.CancelReservation).Methods("DELETE")
 
 	// Execution status routes (protected)
 	protected.HandleFunc("/executions/{id}", config.Handler.GetExecution).Methods("GET")
 	protected.HandleFunc("/executions/{id}", config.Handler.CancelExecution).Methods("DELETE")
+	protected.HandleFunc("/executions/{id}", config.Handler.UpdateExecution).Methods("PATCH")
+	protected.HandleFunc("/executions/{id}/requeue", config.Handler.RequeueExecution).Methods("POST")
+
+	// Pipeline routes (protected)
+	protected.HandleFunc("/pipelines/{id}", config.Handler.GetPipeline).Methods("GET")
+	protected.HandleFunc("/pipelines/{id}", config.Handler.CancelPipeline).Methods("DELETE")
+
+	// Operation routes (protected; bulk requests)
+	protected.HandleFunc("/operations/{id}", config.Handler.GetOperation).Methods("GET")
+
+	// Image inspection (protected; limited to the image allowlist)
+	protected.HandleFunc("/images/inspect", config.Handler.InspectImage).Methods("GET")
+
+	// Free-text search (protected; limited to the environments the caller may view)
+	protected.HandleFunc("/search", config.Handler.Search).Methods("GET")
+
+	// Network policy presets (protected; any authenticated user)
+	protected.HandleFunc("/policies/network", config.Handler.ListNetworkPresets).Methods("GET")
+
+	// Preferences of the authenticated user (protected)
+	if config.PreferencesHandler != nil {
+		protected.HandleFunc("/users/me/preferences", config.PreferencesHandler.GetMyPreferences).Methods("GET")
+		protected.HandleFunc("/users/me/preferences", config.PreferencesHandler.UpdateMyPreferences).Methods("PUT")
+	}
 
 	// User management routes (protected, admin only)
 	protected.HandleFunc("/users", config.UserHandler.ListUsers).Methods("GET")
@@ -109,6 +292,8 @@ func NewRouter(configOrHandler interface{}, proxyHandlerOrNil ...*proxy.Proxy) *
 	protected.HandleFunc("/users/{id}", config.UserHandler.GetUser).Methods("GET")
 	protected.HandleFunc("/users/{id}", config.UserHandler.UpdateUser).Methods("PUT")
 	protected.HandleFunc("/users/{id}", config.UserHandler.DeleteUser).Methods("DELETE")
+	protected.HandleFunc("/users/{id}/unlock", config.UserHandler.UnlockUser).Methods("POST")
+	protected.HandleFunc("/users/{id}/role", config.UserHandler.AssignRole).Methods("PUT")
 
 	// User permission routes (protected)
 	if config.PermissionHandler != nil {
@@ -118,10 +303,24 @@ func NewRouter(configOrHandler interface{}, proxyHandlerOrNil ...*proxy.Proxy) *
 		protected.HandleFunc("/users/{id}/permissions/{envId}", config.PermissionHandler.RevokePermission).Methods("DELETE")
 	}
 
+	// Team routes (protected)
+	if config.TeamHandler != nil {
+		protected.HandleFunc("/teams", config.TeamHandler.ListTeams).Methods("GET")
+		protected.HandleFunc("/teams", config.TeamHandler.CreateTeam).Methods("POST")
+		protected.HandleFunc("/teams/{id}", config.TeamHandler.GetTeam).Methods("GET")
+		protected.HandleFunc("/teams/{id}", config.TeamHandler.UpdateTeam).Methods("PUT")
+		protected.HandleFunc("/teams/{id}", config.TeamHandler.DeleteTeam).Methods("DELETE")
+		protected.HandleFunc("/teams/{id}/members", config.TeamHandler.ListMembers).Methods("GET")
+		protected.HandleFunc("/teams/{id}/members", config.TeamHandler.AddMember).Methods("POST")
+		protected.HandleFunc("/teams/{id}/members/{userId}", config.TeamHandler.UpdateMember).Methods("PUT")
+		protected.HandleFunc("/teams/{id}/members/{userId}", config.TeamHandler.RemoveMember).Methods("DELETE")
+	}
+
 	// API key management routes (protected)
 	protected.HandleFunc("/api-keys", config.APIKeyHandler.ListAPIKeys).Methods("GET")
 	protected.HandleFunc("/api-keys", config.APIKeyHandler.CreateAPIKey).Methods("POST")
 	protected.HandleFunc("/api-keys/{id}", config.APIKeyHandler.RevokeAPIKey).Methods("DELETE")
+	protected.HandleFunc("/api-keys/{id}/rotate", config.APIKeyHandler.RotateAPIKey).Methods("POST")
 
 	// API key permission routes (protected)
 	if config.PermissionHandler != nil {
@@ -132,8 +331,70 @@ func NewRouter(configOrHandler interface{}, proxyHandlerOrNil ...*proxy.Proxy) *
 	if config.MetricsHandler != nil {
 		protected.HandleFunc("/metrics/global", config.MetricsHandler.GetGlobalMetrics).Methods("GET")
 		protected.HandleFunc("/metrics/environment/{id}", config.MetricsHandler.GetEnvironmentMetrics).Methods("GET")
+		protected.HandleFunc("/metrics/summary", config.MetricsHandler.GetMetricsSummary).Methods("GET")
+		protected.HandleFunc("/metrics/churn", config.MetricsHandler.GetChurnReport).Methods("GET")
+		protected.HandleFunc("/environments/{id}/metrics/history", config.MetricsHandler.GetEnvironmentMetricsHistory).Methods("GET")
+	}
+
+	// Admin routes (protected, admin only)
+	if config.ConfigHandler != nil {
+		protected.HandleFunc("/admin/config", config.ConfigHandler.GetConfig).Methods("GET")
+	}
+
+	// Role administration (users.manage; listing also audit.read)
+	if config.RoleHandler != nil {
+		protected.HandleFunc("/admin/roles", config.RoleHandler.ListRoles).Methods("GET")
+		protected.HandleFunc("/admin/roles", config.RoleHandler.CreateRole).Methods("POST")
+		protected.HandleFunc("/admin/roles/{name}", config.RoleHandler.GetRole).Methods("GET")
+		protected.HandleFunc("/admin/roles/{name}", config.RoleHandler.DeleteRole).Methods("DELETE")
 	}
 
+	// Audit log (audit.read)
+	if config.AuditHandler != nil {
+		protected.HandleFunc("/admin/audit-log", config.AuditHandler.ListAuditLog).Methods("GET")
+	}
+
+	// Data exports (audit.read; starting and retrying also environments.read_all)
+	if config.ExportJobHandler != nil {
+		protected.HandleFunc("/admin/exports", config.ExportJobHandler.ListExports).Methods("GET")
+		protected.HandleFunc("/admin/exports", config.ExportJobHandler.CreateExport).Methods("POST")
+		protected.HandleFunc("/admin/exports/{id}", config.ExportJobHandler.GetExport).Methods("GET")
+		protected.HandleFunc("/admin/exports/{id}/retry", config.ExportJobHandler.RetryExport).Methods("POST")
+	}
+
+	// Impersonation (super admins; an impersonated request may end its own session)
+	if config.ImpersonationHandler != nil {
+		protected.HandleFunc("/admin/impersonate/{user_id}", config.ImpersonationHandler.StartImpersonation).Methods("POST")
+		protected.HandleFunc("/admin/impersonations", config.ImpersonationHandler.ListImpersonations).Methods("GET")
+		protected.HandleFunc("/admin/impersonations/{id}", config.ImpersonationHandler.RevokeImpersonation).Methods("DELETE")
+	}
+
+	// Organization preference defaults (users.manage)
+	if config.PreferencesHandler != nil {
+		protected.HandleFunc("/admin/preferences", config.PreferencesHandler.GetDefaults).Methods("GET")
+		protected.HandleFunc("/admin/preferences", config.PreferencesHandler.UpdateDefaults).Methods("PUT")
+	}
+
+	// Critical event emails (users.manage)
+	if config.NotificationHandler != nil {
+		protected.HandleFunc("/admin/notifications/email/test", config.NotificationHandler.SendTestEmail).Methods("POST")
+	}
+
+	// Kubernetes fault injection for chaos testing (super admins; insecure, never in production)
+	if config.FaultHandler != nil {
+		protected.HandleFunc("/admin/faults", config.FaultHandler.ListFaults).Methods("GET")
+		protected.HandleFunc("/admin/faults", config.FaultHandler.SetFault).Methods("PUT")
+		protected.HandleFunc("/admin/faults", config.FaultHandler.ClearFaults).Methods("DELETE")
+		protected.HandleFunc("/admin/faults/{method}", config.FaultHandler.DeleteFault).Methods("DELETE")
+	}
+
+	// Orphaned namespace collection (environments.read_all to view, environments.write_all to run)
+	protected.HandleFunc("/admin/namespace-gc", config.Handler.GetNamespaceGC).Methods("GET")
+	protected.HandleFunc("/admin/namespace-gc", config.Handler.RunNamespaceGC).Methods("POST")
+
+	// Provisioning and execution queue depths (environments.read_all)
+	protected.HandleFunc("/admin/queues", config.Handler.GetQueues).Methods("GET")
+
 	// Pool status (for debugging)
 	protected.HandleFunc("/pool/status", config.Handler.GetPoolStatus).Methods("GET")
 
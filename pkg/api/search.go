@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/roles"
+)
+
+// Search handles GET /search
+// Finds environments and executions by free text: ?q= (2 to 100 characters), ?types= (comma
+// separated: environments, executions; default both) and ?limit= (hits per type, default 20,
+// max 100). Only the environments the caller may view, and their executions, are searched.
+func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	opts := orchestrator.SearchOptions{Query: query.Get("q")}
+	if value := query.Get("types"); value != "" {
+		opts.Types = strings.Split(value, ",")
+	}
+	if value := query.Get("limit"); value != "" {
+		if l, err := strconv.Atoi(value); err == nil && l > 0 {
+			opts.Limit = l
+		}
+	}
+
+	// Without a permission service (e.g. unit tests without auth) everything is searched
+	if h.permissionService != nil {
+		user, ok := auth.GetUserFromContext(ctx)
+		if !ok || user == nil {
+			h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+			return
+		}
+		if !roles.Has(ctx, user, roles.CapEnvironmentsReadAll) && !roles.Has(ctx, user, roles.CapEnvironmentsWriteAll) {
+			opts.ViewerID = user.ID
+		}
+	}
+
+	resp, err := h.orchestrator.Search(ctx, opts)
+	if err != nil {
+		h.respondServiceError(w, "failed to search", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sciffer/agentbox/pkg/permissions"
+)
+
+// ListSnapshots handles GET /environments/{id}/snapshots (newest first)
+func (h *Handler) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvPermission(w, r, envID, permissions.PermissionViewer, "insufficient permissions to read this environment"); !ok {
+		return
+	}
+
+	snapshots, err := h.orchestrator.ListSnapshots(r.Context(), envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to list snapshots", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots": snapshots,
+		"total":     len(snapshots),
+	})
+}
+
+// CreateSnapshot handles POST /environments/{id}/snapshots
+// Archives the environment's workspace_snapshots path now, outside the schedule
+func (h *Handler) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	envID := mux.Vars(r)["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	snap, err := h.orchestrator.CreateSnapshot(r.Context(), envID)
+	if err != nil {
+		h.respondServiceError(w, "failed to create snapshot", err)
+		return
+	}
+	h.respondJSON(w, http.StatusCreated, snap)
+}
+
+// RestoreSnapshot handles POST /environments/{id}/snapshots/{snapshotId}/restore
+// Extracts the snapshot into the running main pod over the directory it was taken of
+func (h *Handler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	envID := vars["id"]
+	if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+		return
+	}
+
+	resp, err := h.orchestrator.RestoreSnapshot(r.Context(), envID, vars["snapshotId"])
+	if err != nil {
+		h.respondServiceError(w, "failed to restore snapshot", err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, resp)
+}
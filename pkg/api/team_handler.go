@@ -0,0 +1,397 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/teams"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// TeamHandler handles team and team membership endpoints
+type TeamHandler struct {
+	teamService *teams.Service
+	userService *users.Service
+	logger      *logger.Logger
+
+	// orchestrator learns about the environments of deleted teams (nil: none)
+	orchestrator *orchestrator.Orchestrator
+}
+
+// NewTeamHandler creates a new team handler
+func NewTeamHandler(teamService *teams.Service, userService *users.Service, log *logger.Logger) *TeamHandler {
+	return &TeamHandler{
+		teamService: teamService,
+		userService: userService,
+		logger:      log,
+	}
+}
+
+// SetOrchestrator keeps the orchestrator's environments current when deleting a team detaches
+// its environments
+func (h *TeamHandler) SetOrchestrator(orch *orchestrator.Orchestrator) {
+	h.orchestrator = orch
+}
+
+// ListTeams handles GET /api/v1/teams
+// Users with environments.read_all see all teams, other users see the teams they are members of
+func (h *TeamHandler) ListTeams(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	currentUser, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+
+	var list []*teams.Team
+	var err error
+	if roles.HasAny(ctx, currentUser, roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin) {
+		list, err = h.teamService.ListTeams(ctx)
+	} else {
+		list, err = h.teamService.ListUserTeams(ctx, currentUser.ID)
+	}
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list teams", err)
+		return
+	}
+
+	if list == nil {
+		list = []*teams.Team{}
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"teams": list,
+		"total": len(list),
+	})
+}
+
+// CreateTeam handles POST /api/v1/teams
+// Any authenticated user can create a team and becomes its owner
+func (h *TeamHandler) CreateTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	currentUser, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+
+	var req teams.CreateTeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Name == "" {
+		h.respondError(w, http.StatusBadRequest, "name is required", nil)
+		return
+	}
+	if req.MaxEnvironments < 0 {
+		h.respondError(w, http.StatusBadRequest, "max_environments must be >= 0", nil)
+		return
+	}
+	// Team quotas are managed by admins
+	if req.MaxEnvironments != 0 && !roles.Has(ctx, currentUser, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "only admins can set team quotas", nil)
+		return
+	}
+
+	team, err := h.teamService.CreateTeam(ctx, &req, currentUser.ID)
+	if err != nil {
+		h.respondTeamError(w, "failed to create team", err)
+		return
+	}
+
+	h.logger.Info("team created",
+		zap.String("team_id", team.ID),
+		zap.String("created_by", currentUser.ID),
+	)
+
+	h.respondJSON(w, http.StatusCreated, team)
+}
+
+// GetTeam handles GET /api/v1/teams/{id}
+func (h *TeamHandler) GetTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	teamID := mux.Vars(r)["id"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionViewer) {
+		return
+	}
+
+	team, err := h.teamService.GetTeam(ctx, teamID)
+	if err != nil {
+		h.respondTeamError(w, "failed to get team", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, team)
+}
+
+// UpdateTeam handles PUT /api/v1/teams/{id}
+func (h *TeamHandler) UpdateTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	teamID := mux.Vars(r)["id"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionOwner) {
+		return
+	}
+
+	var req teams.UpdateTeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	currentUser, _ := auth.GetUserFromContext(ctx)
+	if req.MaxEnvironments != nil && !roles.Has(ctx, currentUser, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "only admins can set team quotas", nil)
+		return
+	}
+
+	team, err := h.teamService.UpdateTeam(ctx, teamID, &req)
+	if err != nil {
+		h.respondTeamError(w, "failed to update team", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, team)
+}
+
+// DeleteTeam handles DELETE /api/v1/teams/{id}
+func (h *TeamHandler) DeleteTeam(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	teamID := mux.Vars(r)["id"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionOwner) {
+		return
+	}
+
+	if err := h.teamService.DeleteTeam(ctx, teamID); err != nil {
+		h.respondTeamError(w, "failed to delete team", err)
+		return
+	}
+	if h.orchestrator != nil {
+		h.orchestrator.TeamDeleted(teamID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListMembers handles GET /api/v1/teams/{id}/members
+func (h *TeamHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	teamID := mux.Vars(r)["id"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionViewer) {
+		return
+	}
+
+	if _, err := h.teamService.GetTeam(ctx, teamID); err != nil {
+		h.respondTeamError(w, "failed to get team", err)
+		return
+	}
+
+	members, err := h.teamService.ListMembers(ctx, teamID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to list team members", err)
+		return
+	}
+
+	if members == nil {
+		members = []*teams.Member{}
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"members": members,
+	})
+}
+
+// AddMemberRequest is the request body for adding a team member
+type AddMemberRequest struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// AddMember handles POST /api/v1/teams/{id}/members
+func (h *TeamHandler) AddMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	teamID := mux.Vars(r)["id"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionOwner) {
+		return
+	}
+
+	var req AddMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.UserID == "" {
+		h.respondError(w, http.StatusBadRequest, "user_id is required", nil)
+		return
+	}
+	if !permissions.ValidatePermission(req.Role) {
+		h.respondError(w, http.StatusBadRequest, "invalid role (must be viewer, editor, or owner)", nil)
+		return
+	}
+
+	if _, err := h.userService.GetUserByID(ctx, req.UserID); err != nil {
+		h.respondError(w, http.StatusNotFound, "user not found", err)
+		return
+	}
+
+	member, err := h.teamService.AddMember(ctx, teamID, req.UserID, req.Role)
+	if err != nil {
+		h.respondTeamError(w, "failed to add team member", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusCreated, member)
+}
+
+// UpdateMemberRequest is the request body for changing a team member's role
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// UpdateMember handles PUT /api/v1/teams/{id}/members/{userId}
+func (h *TeamHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	teamID := vars["id"]
+	userID := vars["userId"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionOwner) {
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+
+	if !permissions.ValidatePermission(req.Role) {
+		h.respondError(w, http.StatusBadRequest, "invalid role (must be viewer, editor, or owner)", nil)
+		return
+	}
+
+	existing, err := h.teamService.GetMember(ctx, teamID, userID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to get team member", err)
+		return
+	}
+	if existing == nil {
+		h.respondError(w, http.StatusNotFound, "team member not found", nil)
+		return
+	}
+
+	member, err := h.teamService.AddMember(ctx, teamID, userID, req.Role)
+	if err != nil {
+		h.respondTeamError(w, "failed to update team member", err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, member)
+}
+
+// RemoveMember handles DELETE /api/v1/teams/{id}/members/{userId}
+func (h *TeamHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	teamID := vars["id"]
+	userID := vars["userId"]
+
+	if !h.requireTeamRole(w, r, teamID, permissions.PermissionOwner) {
+		return
+	}
+
+	if err := h.teamService.RemoveMember(ctx, teamID, userID); err != nil {
+		h.respondTeamError(w, "failed to remove team member", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireTeamRole checks that the current user has at least the given role in the team, or
+// manages users (any role) or reads all environments (viewer)
+func (h *TeamHandler) requireTeamRole(w http.ResponseWriter, r *http.Request, teamID, role string) bool {
+	ctx := r.Context()
+
+	currentUser, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return false
+	}
+	if roles.Has(ctx, currentUser, roles.CapUsersManage) ||
+		(role == permissions.PermissionViewer && roles.HasAny(ctx, currentUser, roles.CapEnvironmentsReadAll, roles.CapPlatformAdmin)) {
+		return true
+	}
+
+	member, err := h.teamService.GetMember(ctx, teamID, currentUser.ID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to check team membership", err)
+		return false
+	}
+	if member == nil || permissions.PermissionLevel(member.Role) < permissions.PermissionLevel(role) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return false
+	}
+
+	return true
+}
+
+// respondTeamError maps team service errors to HTTP status codes
+func (h *TeamHandler) respondTeamError(w http.ResponseWriter, message string, err error) {
+	if apierrors.KindOf(err) != nil {
+		h.respondError(w, apierrors.HTTPStatus(err), err.Error(), err)
+		return
+	}
+	h.respondError(w, http.StatusInternalServerError, message, err)
+}
+
+// Helper methods
+func (h *TeamHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Error("failed to encode JSON response", zap.Error(err))
+	}
+}
+
+func (h *TeamHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
+	h.logger.Error(message, zap.Error(err))
+
+	errMsg := message
+	if err != nil {
+		if status >= 400 && status < 500 {
+			errMsg = err.Error()
+		}
+	}
+
+	errResp := newErrorResponse(status, message, errMsg, err)
+
+	h.respondJSON(w, status, errResp)
+}
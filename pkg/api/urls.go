@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// baseURLs returns the http(s) and ws(s) base URLs clients reach the API at: the configured
+// external URL, otherwise the request's scheme and host. Behind a trusted proxy, its
+// X-Forwarded-Proto and X-Forwarded-Host headers describe the original request.
+func (h *Handler) baseURLs(r *http.Request) (apiBase, wsBase string) {
+	var base url.URL
+	if h.externalURL != nil {
+		base = *h.externalURL
+	} else {
+		base.Scheme = "http"
+		if r.TLS != nil {
+			base.Scheme = "https"
+		}
+		base.Host = r.Host
+		if clientip.ViaTrustedProxy(r) {
+			if proto := strings.ToLower(firstForwardedValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+				base.Scheme = proto
+			}
+			if host := firstForwardedValue(r, "X-Forwarded-Host"); validHost(host) {
+				base.Host = host
+			}
+		}
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+
+	ws := base
+	switch {
+	case h.wsScheme != "":
+		ws.Scheme = h.wsScheme
+	case base.Scheme == "https":
+		ws.Scheme = "wss"
+	default:
+		ws.Scheme = "ws"
+	}
+	return base.String(), ws.String()
+}
+
+// setEnvironmentURLs fills in the URLs clients reach the environments at for this request
+func (h *Handler) setEnvironmentURLs(r *http.Request, envs ...*models.Environment) {
+	apiBase, wsBase := h.baseURLs(r)
+	for _, env := range envs {
+		path := "/api/v1/environments/" + url.PathEscape(env.ID)
+		env.APIURL = apiBase + path
+		env.AttachURL = wsBase + path + "/attach"
+		env.Endpoint = env.AttachURL
+	}
+}
+
+// firstForwardedValue returns the first entry of a forwarding header, the one set by the proxy
+// closest to the client
+func firstForwardedValue(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+// validHost reports whether host is a plain host[:port], as a forwarded Host header must be
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/?#@ \\") {
+		return false
+	}
+	u, err := url.Parse("//" + host)
+	return err == nil && u.Host == host
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -9,9 +10,12 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/auth"
-	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/roles"
 	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/pkg/validator"
 )
 
 // UserHandler handles user management endpoints
@@ -19,6 +23,11 @@ type UserHandler struct {
 	userService *users.Service
 	authService *auth.Service
 	logger      *logger.Logger
+
+	// roleService resolves custom roles when users are given a role (nil: built-in roles only)
+	roleService *roles.Service
+	// orchestrator learns about environments transferred when their owner is deleted (nil: none)
+	orchestrator *orchestrator.Orchestrator
 }
 
 // NewUserHandler creates a new user handler
@@ -30,18 +39,29 @@ func NewUserHandler(userService *users.Service, authService *auth.Service, log *
 	}
 }
 
+// SetRoleService enables assigning the custom roles of roleService to users
+func (h *UserHandler) SetRoleService(roleService *roles.Service) {
+	h.roleService = roleService
+}
+
+// SetOrchestrator keeps the orchestrator's environments current when deleting a user transfers
+// their environments
+func (h *UserHandler) SetOrchestrator(orch *orchestrator.Orchestrator) {
+	h.orchestrator = orch
+}
+
 // ListUsers handles GET /api/v1/users
 func (h *UserHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Check permissions (admin only)
+	// Check permissions (users.manage only)
 	user, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if user.Role != users.RoleSuperAdmin && user.Role != users.RoleAdmin {
+	if !roles.Has(ctx, user, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
@@ -78,24 +98,22 @@ func (h *UserHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Check permissions (admin only)
+	// Check permissions (users.manage only)
 	user, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if user.Role != users.RoleSuperAdmin && user.Role != users.RoleAdmin {
+	if !roles.Has(ctx, user, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
 
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 4*1024)
-
 	var req users.CreateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
@@ -106,13 +124,11 @@ func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Password != "" && len(req.Password) < 8 {
-		h.respondError(w, http.StatusBadRequest, "password must be at least 8 characters", nil)
-		return
-	}
-
 	if req.Role == "" {
-		req.Role = "user" // Default role
+		req.Role = users.RoleUser // Default role
+	}
+	if !h.checkRoleAssignment(w, r, user, req.Role) {
+		return
 	}
 
 	if req.Status == "" {
@@ -121,10 +137,20 @@ func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	// Create user
 	createdUser, err := h.userService.CreateUser(ctx, &req)
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		h.respondValidationError(w, "password does not satisfy the password policy", err)
+		return
+	}
+	if errors.Is(err, users.ErrInvalidRole) {
+		h.respondError(w, http.StatusBadRequest, "invalid role", err)
+		return
+	}
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, "failed to create user", err)
 		return
 	}
+	h.recordRoleAssignment(r, createdUser.ID, createdUser.Role, user.ID)
 
 	h.logger.Info("user created",
 		zap.String("username", createdUser.Username),
@@ -147,8 +173,8 @@ func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Users can only view their own profile unless they're admin
-	if user.ID != userID && user.Role != users.RoleSuperAdmin && user.Role != users.RoleAdmin {
+	// Users can only view their own profile unless they manage users
+	if user.ID != userID && !roles.Has(ctx, user, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
@@ -168,58 +194,62 @@ func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["id"]
 
-	// Check permissions (admin only for editing other users)
+	// Check permissions (users.manage only for editing other users)
 	currentUser, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	// Only admins can edit other users
-	if currentUser.ID != userID && currentUser.Role != users.RoleSuperAdmin && currentUser.Role != users.RoleAdmin {
+	// Only user managers can edit other users
+	canManage := roles.Has(ctx, currentUser, roles.CapUsersManage)
+	if currentUser.ID != userID && !canManage {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
 
-	// Non-admins can only update their own email/password, not role/status
-	isAdmin := currentUser.Role == users.RoleSuperAdmin || currentUser.Role == users.RoleAdmin
-
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 4*1024)
-
 	var req users.UpdateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid request body", err)
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
 		return
 	}
 	defer r.Body.Close()
 
-	// If non-admin is updating themselves, they can't change role/status/username
-	if !isAdmin && currentUser.ID == userID {
+	// Users without users.manage can only update their own email/password, not role/status/username
+	if !canManage && currentUser.ID == userID {
 		if req.Role != nil || req.Status != nil || req.Username != nil {
 			h.respondError(w, http.StatusForbidden, "cannot modify role, status, or username", nil)
 			return
 		}
 	}
 
-	// Validate password if provided
-	if req.Password != nil && *req.Password != "" && len(*req.Password) < 8 {
-		h.respondError(w, http.StatusBadRequest, "password must be at least 8 characters", nil)
+	if req.Password != nil && rejectImpersonated(w, r, "change passwords") {
 		return
 	}
 
-	// Prevent non-super-admins from creating super admins
-	if req.Role != nil && *req.Role == users.RoleSuperAdmin && currentUser.Role != users.RoleSuperAdmin {
-		h.respondError(w, http.StatusForbidden, "only super admins can assign super admin role", nil)
+	if req.Role != nil && !h.checkRoleAssignment(w, r, currentUser, *req.Role) {
 		return
 	}
 
 	// Update user
 	updatedUser, err := h.userService.UpdateUser(ctx, userID, &req)
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		h.respondValidationError(w, "password does not satisfy the password policy", err)
+		return
+	}
+	if errors.Is(err, users.ErrInvalidRole) {
+		h.respondError(w, http.StatusBadRequest, "invalid role", err)
+		return
+	}
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, "failed to update user", err)
 		return
 	}
+	if req.Role != nil {
+		h.recordRoleAssignment(r, userID, *req.Role, currentUser.ID)
+	}
 
 	h.logger.Info("user updated",
 		zap.String("user_id", userID),
@@ -230,22 +260,27 @@ func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 }
 
 // DeleteUser handles DELETE /api/v1/users/{id}
+// A user who still owns environments is only deleted with ?transfer_to=<user id>, which makes
+// that user their owner in the same transaction; otherwise 409 lists the environments.
 func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	userID := vars["id"]
 
-	// Check permissions (admin only)
+	// Check permissions (users.manage only)
 	currentUser, ok := auth.GetUserFromContext(ctx)
 	if !ok {
 		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
 		return
 	}
 
-	if currentUser.Role != users.RoleSuperAdmin && currentUser.Role != users.RoleAdmin {
+	if !roles.Has(ctx, currentUser, roles.CapUsersManage) {
 		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
 		return
 	}
+	if rejectImpersonated(w, r, "delete accounts") {
+		return
+	}
 
 	// Prevent users from deleting themselves
 	if currentUser.ID == userID {
@@ -267,19 +302,179 @@ func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete user
-	if err := h.userService.DeleteUser(ctx, userID); err != nil {
+	transferTo := r.URL.Query().Get("transfer_to")
+	transferred, err := h.userService.DeleteUser(ctx, userID, transferTo, currentUser.ID)
+	if err != nil {
+		if apierrors.KindOf(err) != nil {
+			h.respondError(w, apierrors.HTTPStatus(err), apierrors.MessageOf(err), err)
+			return
+		}
 		h.respondError(w, http.StatusInternalServerError, "failed to delete user", err)
 		return
 	}
+	if len(transferred) > 0 && h.orchestrator != nil {
+		h.orchestrator.EnvironmentsTransferred(ctx, transferred, userID, transferTo, currentUser.ID)
+	}
 
 	h.logger.Info("user deleted",
 		zap.String("user_id", userID),
 		zap.String("deleted_by", currentUser.Username),
+		zap.Int("environments_transferred", len(transferred)),
 	)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// AssignRole handles PUT /api/v1/users/{id}/role (users.manage)
+// Gives the user a built-in or custom role: {"role": "operator"}
+func (h *UserHandler) AssignRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := mux.Vars(r)["id"]
+
+	currentUser, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, currentUser, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := requestBodyError(err, "invalid request body")
+		h.respondError(w, status, message, err)
+		return
+	}
+	defer r.Body.Close()
+	if req.Role == "" {
+		h.respondError(w, http.StatusBadRequest, "role is required", nil)
+		return
+	}
+
+	targetUser, err := h.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "user not found", err)
+		return
+	}
+	// Only super admins can change the role of other super admins
+	if targetUser.Role == users.RoleSuperAdmin && currentUser.Role != users.RoleSuperAdmin {
+		h.respondError(w, http.StatusForbidden, "only super admins can change the role of super admin accounts", nil)
+		return
+	}
+	if !h.checkRoleAssignment(w, r, currentUser, req.Role) {
+		return
+	}
+
+	updatedUser, err := h.userService.UpdateUser(ctx, userID, &users.UpdateUserRequest{Role: &req.Role})
+	if errors.Is(err, users.ErrInvalidRole) {
+		h.respondError(w, http.StatusBadRequest, "invalid role", err)
+		return
+	}
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to assign role", err)
+		return
+	}
+	h.recordRoleAssignment(r, userID, req.Role, currentUser.ID)
+
+	h.logger.Info("user role assigned",
+		zap.String("user_id", userID),
+		zap.String("role", req.Role),
+		zap.String("assigned_by", currentUser.Username),
+	)
+
+	h.respondJSON(w, http.StatusOK, updatedUser)
+}
+
+// checkRoleAssignment checks that the current user may give a user the role: it must exist,
+// only super admins hand out super_admin, and nobody hands out capabilities they lack
+func (h *UserHandler) checkRoleAssignment(w http.ResponseWriter, r *http.Request, currentUser *users.User, role string) bool {
+	ctx := r.Context()
+	if role == users.RoleSuperAdmin && currentUser.Role != users.RoleSuperAdmin {
+		h.respondError(w, http.StatusForbidden, "only super admins can assign super admin role", nil)
+		return false
+	}
+
+	var capabilities []string
+	switch {
+	case h.roleService != nil:
+		assigned, err := h.roleService.GetRole(ctx, role)
+		if apierrors.KindOf(err) == apierrors.NotFound {
+			h.respondError(w, http.StatusBadRequest, "invalid role", err)
+			return false
+		}
+		if err != nil {
+			h.respondError(w, http.StatusInternalServerError, "failed to get role", err)
+			return false
+		}
+		capabilities = assigned.Capabilities
+	case roles.IsBuiltin(role):
+		capabilities = roles.BuiltinCapabilities(role)
+	default:
+		h.respondError(w, http.StatusBadRequest, "invalid role: "+role, nil)
+		return false
+	}
+
+	for _, c := range capabilities {
+		if !roles.Has(ctx, currentUser, c) {
+			h.respondError(w, http.StatusForbidden, "cannot assign a role with a capability you do not have: "+c, nil)
+			return false
+		}
+	}
+	return true
+}
+
+// recordRoleAssignment writes a role assignment to the audit log
+func (h *UserHandler) recordRoleAssignment(r *http.Request, userID, role, actorID string) {
+	if h.roleService != nil {
+		h.roleService.RecordAssignment(r.Context(), userID, role, actorID)
+	}
+}
+
+// UnlockUser handles POST /api/v1/users/{id}/unlock
+// Clears the user's failed logins and lockout (admin only)
+func (h *UserHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := mux.Vars(r)["id"]
+
+	currentUser, ok := auth.GetUserFromContext(ctx)
+	if !ok {
+		h.respondError(w, http.StatusUnauthorized, "not authenticated", nil)
+		return
+	}
+	if !roles.Has(ctx, currentUser, roles.CapUsersManage) {
+		h.respondError(w, http.StatusForbidden, "insufficient permissions", nil)
+		return
+	}
+
+	targetUser, err := h.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "user not found", err)
+		return
+	}
+
+	unlocked, err := h.authService.UnlockLogin(ctx, targetUser.Username, currentUser.ID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "failed to unlock user", err)
+		return
+	}
+
+	h.logger.Info("user login unlocked",
+		zap.String("user_id", userID),
+		zap.Bool("was_locked", unlocked),
+		zap.String("unlocked_by", currentUser.Username),
+	)
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id":          userID,
+		"username":         targetUser.Username,
+		"failures_cleared": unlocked,
+	})
+}
+
 // Helper methods
 func (h *UserHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -290,6 +485,12 @@ func (h *UserHandler) respondJSON(w http.ResponseWriter, status int, data interf
 	}
 }
 
+// respondValidationError writes a 400 response, listing each invalid field in details
+func (h *UserHandler) respondValidationError(w http.ResponseWriter, message string, err error) {
+	h.logger.Debug(message, zap.Error(err))
+	h.respondJSON(w, http.StatusBadRequest, newValidationErrorResponse(message, err))
+}
+
 func (h *UserHandler) respondError(w http.ResponseWriter, status int, message string, err error) {
 	h.logger.Error(message, zap.Error(err))
 
@@ -300,11 +501,7 @@ func (h *UserHandler) respondError(w http.ResponseWriter, status int, message st
 		}
 	}
 
-	errResp := models.ErrorResponse{
-		Error:   message,
-		Message: errMsg,
-		Code:    status,
-	}
+	errResp := newErrorResponse(status, message, errMsg, err)
 
 	h.respondJSON(w, status, errResp)
 }
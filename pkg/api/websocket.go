@@ -1,12 +1,16 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/pkg/auth"
 	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/proxy"
 )
@@ -25,14 +29,44 @@ func (h *Handler) AttachWebSocket(proxyHandler *proxy.Proxy) http.HandlerFunc {
 			return
 		}
 
-		// Check if environment is running
+		// Check if environment is running (degraded = its cluster is unreachable)
 		if env.Status != models.StatusRunning {
 			h.respondError(w, http.StatusBadRequest, "environment is not running", fmt.Errorf("environment status is %s", env.Status))
 			return
 		}
 
+		client, err := h.orchestrator.ClientForEnvironment(env)
+		if err != nil {
+			h.respondError(w, http.StatusServiceUnavailable, "environment cluster is not available", err)
+			return
+		}
+
+		// Record the session when the environment opted in; sessions that should be recorded
+		// are refused rather than left unrecorded
+		var rec proxy.Recorder
+		if env.RecordSessions && h.recordings != nil {
+			userID := ""
+			if user, ok := auth.GetUserFromContext(ctx); ok && user != nil {
+				userID = user.ID
+			}
+			recorder, err := h.recordings.Start(ctx, envID, userID)
+			if err != nil {
+				h.respondError(w, http.StatusInternalServerError, "failed to start session recording", err)
+				return
+			}
+			rec = recorder
+			h.logger.Info("recording attach session",
+				zap.String("environment_id", envID),
+				zap.String("recording_id", recorder.ID()),
+			)
+		}
+
+		// The environment counts as in use for as long as the session is open
+		done := h.orchestrator.TrackSession(ctx, envID)
+		defer done()
+
 		// Handle WebSocket upgrade and proxy to pod
-		if err := proxyHandler.HandleWebSocket(w, r, env.Namespace, "main"); err != nil {
+		if err := proxyHandler.HandleWebSocketWithRecorder(w, r, client, env.Namespace, "main", rec); err != nil {
 			h.logger.Error("websocket connection failed",
 				zap.String("environment_id", envID),
 				zap.Error(err),
@@ -45,3 +79,61 @@ func (h *Handler) AttachWebSocket(proxyHandler *proxy.Proxy) http.HandlerFunc {
 		)
 	}
 }
+
+// PortForward handles GET /environments/{id}/port-forward?port=N (editor or higher): the request
+// is upgraded to a WebSocket that carries one TCP connection to port N of the environment's main
+// pod (see proxy.PortForwarder)
+func (h *Handler) PortForward(forwarder *proxy.PortForwarder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		envID := mux.Vars(r)["id"]
+		if _, ok := h.requireEnvEdit(w, r, envID); !ok {
+			return
+		}
+
+		port, err := strconv.Atoi(r.URL.Query().Get("port"))
+		if err != nil || port < 1 || port > 65535 {
+			h.respondError(w, http.StatusBadRequest, "invalid port", fmt.Errorf("port must be between 1 and 65535, got %q", r.URL.Query().Get("port")))
+			return
+		}
+		if !forwarder.PortAllowed(port) {
+			allowed := "none"
+			if ports := forwarder.AllowedPorts(); len(ports) > 0 {
+				allowed = strings.Join(ports, ", ")
+			}
+			h.respondError(w, http.StatusForbidden, "port not allowed", fmt.Errorf("port %d may not be forwarded (allowed ports: %s)", port, allowed))
+			return
+		}
+
+		env, err := h.orchestrator.GetEnvironment(ctx, envID)
+		if err != nil {
+			h.respondError(w, http.StatusNotFound, "environment not found", err)
+			return
+		}
+		if env.Status != models.StatusRunning {
+			h.respondError(w, http.StatusBadRequest, "environment is not running", fmt.Errorf("environment status is %s", env.Status))
+			return
+		}
+		client, err := h.orchestrator.ClientForEnvironment(env)
+		if err != nil {
+			h.respondError(w, http.StatusServiceUnavailable, "environment cluster is not available", err)
+			return
+		}
+
+		// The environment counts as in use for as long as the connection is open
+		done := h.orchestrator.TrackSession(ctx, envID)
+		defer done()
+
+		err = forwarder.HandlePortForward(w, r, client, envID, env.Namespace, "main", port)
+		if errors.Is(err, proxy.ErrPortForwardLimit) {
+			h.respondError(w, http.StatusTooManyRequests, "too many port forwards", err)
+			return
+		}
+		if err != nil {
+			h.logger.Error("port forward connection failed",
+				zap.String("environment_id", envID),
+				zap.Error(err),
+			)
+		}
+	}
+}
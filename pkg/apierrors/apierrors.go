@@ -0,0 +1,243 @@
+// Package apierrors defines the error kinds shared by the orchestrator, the services and the
+// HTTP API. Services return errors of a Kind (optionally with a more specific code); handlers
+// map them to HTTP statuses and machine-readable codes in one place instead of matching on
+// error messages.
+package apierrors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Kind is a category of error. Kinds are sentinel errors: errors.Is(err, apierrors.NotFound)
+// reports whether err, or any error it wraps, is of that kind.
+type Kind struct {
+	code   string
+	status int
+}
+
+// Error implements the error interface
+func (k *Kind) Error() string {
+	return k.code
+}
+
+// Code returns the kind's machine-readable code, used when an error has no more specific one
+func (k *Kind) Code() string {
+	return k.code
+}
+
+// HTTPStatus returns the HTTP status errors of this kind are reported with
+func (k *Kind) HTTPStatus() int {
+	return k.status
+}
+
+// Error kinds
+var (
+	NotFound         = &Kind{code: "NOT_FOUND", status: http.StatusNotFound}
+	Conflict         = &Kind{code: "CONFLICT", status: http.StatusConflict}
+	QuotaExceeded    = &Kind{code: "QUOTA_EXCEEDED", status: http.StatusForbidden}
+	NotRunning       = &Kind{code: "NOT_RUNNING", status: http.StatusBadRequest}
+	ValidationFailed = &Kind{code: "VALIDATION_FAILED", status: http.StatusBadRequest}
+	Unauthorized     = &Kind{code: "UNAUTHORIZED", status: http.StatusUnauthorized}
+	Forbidden        = &Kind{code: "FORBIDDEN", status: http.StatusForbidden}
+	RateLimited      = &Kind{code: "RATE_LIMITED", status: http.StatusTooManyRequests}
+	Unavailable      = &Kind{code: "UNAVAILABLE", status: http.StatusServiceUnavailable}
+	PayloadTooLarge  = &Kind{code: "PAYLOAD_TOO_LARGE", status: http.StatusRequestEntityTooLarge}
+	Unschedulable    = &Kind{code: "UNSCHEDULABLE", status: http.StatusUnprocessableEntity}
+	Timeout          = &Kind{code: "TIMEOUT", status: http.StatusRequestTimeout}
+	BadGateway       = &Kind{code: "BAD_GATEWAY", status: http.StatusBadGateway}
+	Locked           = &Kind{code: "LOCKED", status: http.StatusLocked}
+)
+
+// Specific error codes reported in ErrorResponse.code
+const (
+	CodeEnvironmentNotFound      = "ENV_NOT_FOUND"
+	CodeEnvironmentNotRunning    = "ENV_NOT_RUNNING"
+	CodeEnvironmentDegraded      = "ENV_DEGRADED"
+	CodeUnknownCluster           = "UNKNOWN_CLUSTER"
+	CodeExecutionNotFound        = "EXECUTION_NOT_FOUND"
+	CodeExecutionNotCancelable   = "EXECUTION_NOT_CANCELABLE"
+	CodeExecutionNotRequeueable  = "EXECUTION_NOT_REQUEUEABLE"
+	CodeCommandRejected          = "COMMAND_REJECTED"
+	CodePodQuotaExceeded         = "POD_QUOTA_EXCEEDED"
+	CodePodForbidden             = "POD_FORBIDDEN"
+	CodePodAlreadyExists         = "POD_ALREADY_EXISTS"
+	CodeTeamNotFound             = "TEAM_NOT_FOUND"
+	CodeTeamMemberNotFound       = "TEAM_MEMBER_NOT_FOUND"
+	CodeTeamQuotaExceeded        = "TEAM_QUOTA_EXCEEDED"
+	CodeTeamNameTaken            = "TEAM_NAME_TAKEN"
+	CodeGroupNotFound            = "ENV_GROUP_NOT_FOUND"
+	CodeExceedsNodeCapacity      = "EXCEEDS_NODE_CAPACITY"
+	CodeExceedsEnvironmentQuota  = "EXCEEDS_ENV_QUOTA"
+	CodeInvalidNamespace         = "INVALID_NAMESPACE"
+	CodeEnvironmentTokenNotFound = "ENV_TOKEN_NOT_FOUND"
+	CodeSessionRecordingNotFound = "SESSION_RECORDING_NOT_FOUND"
+	CodeCallbackRejected         = "CALLBACK_REJECTED"
+	CodePoolNotEnabled           = "POOL_NOT_ENABLED"
+	CodeNamespaceGCUnavailable   = "NAMESPACE_GC_UNAVAILABLE"
+	CodeLoginLocked              = "LOGIN_LOCKED"
+	CodeExecQueueTimeout         = "EXEC_QUEUE_TIMEOUT"
+	CodeExecQueueFull            = "EXEC_QUEUE_FULL"
+	CodePipelineNotFound         = "PIPELINE_NOT_FOUND"
+	CodePipelineNotCancelable    = "PIPELINE_NOT_CANCELABLE"
+	CodeImageNotAllowed          = "IMAGE_NOT_ALLOWED"
+	CodeImageNotFound            = "IMAGE_NOT_FOUND"
+	CodeRegistryAuthFailed       = "REGISTRY_AUTH_FAILED"
+	CodeRegistryRateLimited      = "REGISTRY_RATE_LIMITED"
+	CodeRegistryUnavailable      = "REGISTRY_UNAVAILABLE"
+	CodeExecFilesFailed          = "EXEC_FILES_FAILED"
+	CodeOperationNotFound        = "OPERATION_NOT_FOUND"
+	CodeExecTimedOut             = "EXEC_TIMED_OUT"
+	CodeEnvironmentCompleted     = "ENV_COMPLETED"
+	CodeRoleNotFound             = "ROLE_NOT_FOUND"
+	CodeRoleInUse                = "ROLE_IN_USE"
+	CodeExportNotFound           = "EXPORT_NOT_FOUND"
+	CodeExportsNotConfigured     = "EXPORTS_NOT_CONFIGURED"
+	CodeUserNotFound             = "USER_NOT_FOUND"
+	CodeUserOwnsEnvironments     = "USER_OWNS_ENVIRONMENTS"
+	CodeBuildsNotEnabled         = "BUILDS_NOT_ENABLED"
+	CodeLogShippingNotConfigured = "LOG_SHIPPING_NOT_CONFIGURED"
+	CodeImpersonationNotFound    = "IMPERSONATION_NOT_FOUND"
+	CodeImpersonationForbidden   = "IMPERSONATION_FORBIDDEN"
+	CodeReadOnlyAPIKey           = "READ_ONLY_API_KEY"
+	CodeBadgeSignatureInvalid    = "BADGE_SIGNATURE_INVALID"
+	CodeEmailNotConfigured       = "EMAIL_NOT_CONFIGURED"
+	CodeEmailSendFailed          = "EMAIL_SEND_FAILED"
+	CodeEnvironmentCordoned      = "ENV_CORDONED"
+	CodeAPIKeyIPNotAllowed       = "API_KEY_IP_NOT_ALLOWED"
+	CodeAPIKeyNotFound           = "API_KEY_NOT_FOUND"
+	CodeAPIKeyNotRotatable       = "API_KEY_NOT_ROTATABLE"
+	CodeSnapshotNotFound         = "SNAPSHOT_NOT_FOUND"
+	CodeSnapshotTooLarge         = "SNAPSHOT_TOO_LARGE"
+	CodeSnapshotsNotEnabled      = "SNAPSHOTS_NOT_ENABLED"
+	CodeNamespaceLimitReached    = "NAMESPACE_LIMIT_REACHED"
+	CodeCreationRateLimited      = "CREATION_RATE_LIMITED"
+	CodeUnknownNetworkPreset     = "UNKNOWN_NETWORK_PRESET"
+	CodeReservationNotFound      = "RESERVATION_NOT_FOUND"
+	CodeReservationQuotaExceeded = "RESERVATION_QUOTA_EXCEEDED"
+	CodeReservationNotActive     = "RESERVATION_NOT_ACTIVE"
+	CodeReservationExhausted     = "RESERVATION_EXHAUSTED"
+	CodePriorityClassNotAllowed  = "PRIORITY_CLASS_NOT_ALLOWED"
+	CodeServiceAccountNotAllowed = "SERVICE_ACCOUNT_NOT_ALLOWED"
+	CodeActivityUnavailable      = "ACTIVITY_UNAVAILABLE"
+	CodeSearchUnavailable        = "SEARCH_UNAVAILABLE"
+	CodeStorageNotConfigured     = "STORAGE_NOT_CONFIGURED"
+	CodeArchiveNotFound          = "ARCHIVE_NOT_FOUND"
+	// CodeBadRequest and CodeInternal are reported for 4xx and 5xx errors without a kind
+	CodeBadRequest = "BAD_REQUEST"
+	CodeInternal   = "INTERNAL_ERROR"
+)
+
+// Error is an error of a Kind with a specific code and a client-facing message
+type Error struct {
+	Kind *Kind
+	// Code is the machine-readable code; defaults to the kind's code
+	Code string
+	// Message describes the error for clients
+	Message string
+	// Err is the underlying cause, if any
+	Err error
+}
+
+// New returns an error of the given kind and code with a formatted message
+func New(kind *Kind, code, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap returns an error of the given kind and code that wraps err
+func Wrap(kind *Kind, code string, err error, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Code: code, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap exposes both the kind and the cause to errors.Is and errors.As
+func (e *Error) Unwrap() []error {
+	if e.Err != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Kind}
+}
+
+// KindOf returns the kind of err, or nil when err has none
+func KindOf(err error) *Kind {
+	var e *Error
+	if errors.As(err, &e) && e.Kind != nil {
+		return e.Kind
+	}
+	var k *Kind
+	if errors.As(err, &k) {
+		return k
+	}
+	return nil
+}
+
+// HTTPStatus returns the HTTP status for err: its kind's status, or 500 when it has no kind
+func HTTPStatus(err error) int {
+	if k := KindOf(err); k != nil {
+		return k.status
+	}
+	return http.StatusInternalServerError
+}
+
+// CodeOf returns the machine-readable code of err: the code of the outermost *Error, the code
+// of its kind, or "" when err has no kind
+func CodeOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Code != "" {
+			return e.Code
+		}
+		if e.Kind != nil {
+			return e.Kind.code
+		}
+	}
+	if k := KindOf(err); k != nil {
+		return k.code
+	}
+	return ""
+}
+
+// MessageOf returns the client-facing message of the outermost *Error in err's chain, or ""
+func MessageOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return ""
+}
+
+// StatusCode returns the generic code for an HTTP status, used for errors without a kind
+func StatusCode(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return NotFound.code
+	case http.StatusConflict:
+		return Conflict.code
+	case http.StatusUnauthorized:
+		return Unauthorized.code
+	case http.StatusForbidden:
+		return Forbidden.code
+	case http.StatusTooManyRequests:
+		return RateLimited.code
+	case http.StatusServiceUnavailable:
+		return Unavailable.code
+	case http.StatusRequestEntityTooLarge:
+		return PayloadTooLarge.code
+	case http.StatusRequestTimeout:
+		return Timeout.code
+	case http.StatusLocked:
+		return Locked.code
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== API Key IP Allowlists ==========
+
+// Audit actions written for rejected API keys. Unknown keys are not audited: every expired JWT
+// is tried as an API key too.
+const (
+	AuditActionAPIKeyRejected = "api_key.rejected"
+	AuditActionAPIKeyIPDenied = "api_key.ip_denied"
+)
+
+const (
+	// apiKeyDisplayPrefixLength is how many characters of the secret part are kept in key_prefix
+	apiKeyDisplayPrefixLength = 8
+	// maxAPIKeyAllowedCIDRs is the most allowlist entries one key may have
+	maxAPIKeyAllowedCIDRs = 32
+)
+
+// ErrAPIKeyIPNotAllowed is returned when a valid API key is used from an address outside its
+// allowlist
+var ErrAPIKeyIPNotAllowed = errors.New("API key is not allowed from this address")
+
+// ParseAllowedCIDRs validates an API key allowlist: CIDRs such as "10.0.0.0/8" or single IPv4
+// or IPv6 addresses. Entries are returned in canonical form ("10.1.2.3" becomes "10.1.2.3/32").
+func ParseAllowedCIDRs(entries []string) ([]string, error) {
+	if len(entries) > maxAPIKeyAllowedCIDRs {
+		return nil, fmt.Errorf("at most %d allowed CIDRs", maxAPIKeyAllowedCIDRs)
+	}
+	cidrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		prefix, err := parseAllowedCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, prefix.String())
+	}
+	return cidrs, nil
+}
+
+// parseAllowedCIDR parses one allowlist entry
+func parseAllowedCIDR(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid allowed CIDR %q: %w", entry, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid allowed CIDR %q: %w", entry, err)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ipAllowed reports whether clientIP is in the allowlist; an empty allowlist allows every
+// address, a non-empty one no unknown address
+func ipAllowed(cidrs []string, clientIP string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, cidr := range cidrs {
+		prefix, err := parseAllowedCIDR(cidr)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// displayPrefix returns the non-secret start of an API key shown to identify it, e.g.
+// "ak_live_1a2b3c4d"
+func displayPrefix(keyPrefix, fullKey string) string {
+	return fullKey[:min(len(fullKey), len(keyPrefix)+apiKeyDisplayPrefixLength)]
+}
+
+// auditAPIKeyRejection records an API key refused because of its allowlist (api_key.ip_denied)
+// or because it was revoked or expired (api_key.rejected)
+func (s *Service) auditAPIKeyRejection(ctx context.Context, action, keyID, userID, clientIP, reason string) {
+	where := clientIP
+	if where == "" {
+		where = "unknown address"
+	}
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       action,
+		ActorID:      userID,
+		ResourceType: "api_key",
+		ResourceID:   keyID,
+		Message:      fmt.Sprintf("API key %s rejected from %s: %s", keyID, where, reason),
+		ClientIP:     clientIP,
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry for rejected API key", zap.String("key_id", keyID), zap.Error(err))
+	}
+}
+
+// encodeAllowedCIDRs stores an allowlist as a JSON array; NULL when empty
+func encodeAllowedCIDRs(cidrs []string) interface{} {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(cidrs)
+	if err != nil {
+		return nil
+	}
+	return string(data)
+}
+
+// decodeAllowedCIDRs reads an allowlist stored by encodeAllowedCIDRs
+func decodeAllowedCIDRs(stored sql.NullString) ([]string, error) {
+	if !stored.Valid || stored.String == "" {
+		return nil, nil
+	}
+	var cidrs []string
+	if err := json.Unmarshal([]byte(stored.String), &cidrs); err != nil {
+		return nil, fmt.Errorf("invalid stored allowlist: %w", err)
+	}
+	return cidrs, nil
+}
+
+// nullIfEmpty returns nil for an empty string so it is stored as NULL
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
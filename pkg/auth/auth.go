@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -14,7 +15,10 @@ import (
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/clientip"
 	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/impersonation"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
@@ -22,8 +26,24 @@ import (
 type Service struct {
 	db          *database.DB
 	userService *users.Service
-	jwtSecret   []byte
 	logger      *zap.Logger
+
+	// signingKeys is the JWT key set; the first key signs new tokens (see SetSigningKeys)
+	signingKeys []SigningKey
+
+	// API key lifecycle settings (see SetAPIKeyLifecycle)
+	rotationGracePeriod time.Duration
+	expiryWarningWindow time.Duration
+
+	// Single sign-on (see SetOIDC)
+	oidc                  *OIDCProvider
+	passwordLoginDisabled bool
+
+	// environmentTokenMaxTTL caps environment token lifetimes (see SetEnvironmentTokenMaxTTL)
+	environmentTokenMaxTTL time.Duration
+
+	// loginLockout throttles failed password logins (see SetLoginLockout)
+	loginLockout config.LoginLockoutConfig
 }
 
 // GetUserService returns the user service (for access in handlers)
@@ -31,18 +51,19 @@ func (s *Service) GetUserService() *users.Service {
 	return s.userService
 }
 
-// NewService creates a new auth service
+// NewService creates a new auth service. It signs tokens with a random key until the configured
+// key set is installed with SetSigningKeys.
 func NewService(db *database.DB, userService *users.Service, logger *zap.Logger) *Service {
-	secret := os.Getenv("AGENTBOX_JWT_SECRET")
-	if secret == "" {
-		secret = "change-me-in-production" // Default, should be set via env var
-	}
-
 	return &Service{
 		db:          db,
 		userService: userService,
-		jwtSecret:   []byte(secret),
 		logger:      logger,
+		signingKeys: []SigningKey{newEphemeralKey()},
+
+		rotationGracePeriod: DefaultAPIKeyRotationGracePeriod,
+		expiryWarningWindow: DefaultAPIKeyExpiryWarningWindow,
+
+		environmentTokenMaxTTL: DefaultEnvironmentTokenMaxTTL,
 	}
 }
 
@@ -51,6 +72,11 @@ type Claims struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	// Scope is empty for user tokens; scoped tokens (see CallbackTokenScope) are not user tokens
+	Scope string `json:"scope,omitempty"`
+	// ImpersonatorID is set on impersonation tokens: the super admin acting as the user, in the
+	// session named by the token's ID (jti)
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -58,6 +84,8 @@ type Claims struct {
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// ClientIP is the address the request came from, set by the handler for login throttling
+	ClientIP string `json:"-"`
 }
 
 // LoginResponse is the response from login
@@ -68,11 +96,24 @@ type LoginResponse struct {
 	ExpiresAt    time.Time   `json:"expires_at"`
 }
 
-// Login authenticates a user and returns a JWT token
+// Login authenticates a user and returns a JWT token. While the username or the client address
+// is throttled after failed attempts it returns a *LoginLockedError without checking the password.
 func (s *Service) Login(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
-	// Get user with password hash
+	if s.passwordLoginDisabled {
+		return nil, ErrPasswordLoginDisabled
+	}
+
+	subjects := s.lockoutSubjects(req.Username, req.ClientIP)
+	if err := s.checkLoginAllowed(ctx, subjects); err != nil {
+		return nil, err
+	}
+
+	// Get user with password hash; unknown usernames are throttled like wrong passwords
 	user, passwordHash, err := s.userService.GetUserWithPassword(ctx, req.Username)
 	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			s.recordLoginFailure(ctx, subjects, req.ClientIP)
+		}
 		return nil, fmt.Errorf("invalid credentials")
 	}
 
@@ -87,8 +128,13 @@ func (s *Service) Login(ctx context.Context, req *LoginRequest) (*LoginResponse,
 	}
 
 	if !users.VerifyPassword(passwordHash, req.Password) {
+		s.recordLoginFailure(ctx, subjects, req.ClientIP)
 		return nil, fmt.Errorf("invalid credentials")
 	}
+	// Only the username's failures are reset: one valid account must not clear an address
+	if len(subjects) > 0 {
+		s.clearLoginFailures(ctx, subjects[0].key)
+	}
 
 	// Update last login (best effort, don't fail login if this fails)
 	if err := s.userService.UpdateLastLogin(ctx, user.ID); err != nil {
@@ -110,37 +156,61 @@ func (s *Service) Login(ctx context.Context, req *LoginRequest) (*LoginResponse,
 
 // ValidateJWT validates a JWT token and returns the user
 func (s *Service) ValidateJWT(ctx context.Context, tokenString string) (*users.User, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return s.jwtSecret, nil
-	})
+	user, _, err := s.validateJWT(ctx, tokenString)
+	return user, err
+}
+
+// validateJWT validates a JWT token and returns the user and, for impersonation tokens, the
+// admin impersonating them
+func (s *Service) validateJWT(ctx context.Context, tokenString string) (*users.User, *impersonation.Impersonation, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, s.verificationKeys)
 
 	if err != nil {
-		return nil, fmt.Errorf("invalid token: %w", err)
+		return nil, nil, fmt.Errorf("invalid token: %w", err)
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		// Scoped tokens (e.g. callback tokens handed to pods) must not authenticate as the user
+		if claims.Scope != "" {
+			return nil, nil, fmt.Errorf("invalid token")
+		}
+
+		// Impersonation tokens are only good while their session is
+		var imp *impersonation.Impersonation
+		if claims.ImpersonatorID != "" {
+			imp, err = s.checkImpersonation(ctx, claims)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
 		// Get user from database
 		user, err := s.userService.GetUserByID(ctx, claims.UserID)
 		if err != nil {
-			return nil, fmt.Errorf("user not found")
+			return nil, nil, fmt.Errorf("user not found")
 		}
 
 		// Check if user is still active
 		if user.Status != "active" {
-			return nil, fmt.Errorf("user account is not active")
+			return nil, nil, fmt.Errorf("user account is not active")
 		}
 
-		return user, nil
+		return user, imp, nil
 	}
 
-	return nil, fmt.Errorf("invalid token")
+	return nil, nil, fmt.Errorf("invalid token")
 }
 
-// ValidateAPIKey validates an API key and returns the user
+// ValidateAPIKey validates an API key used from the client address in ctx (see clientip) and
+// returns the user
 func (s *Service) ValidateAPIKey(ctx context.Context, apiKey string) (*users.User, error) {
+	user, _, err := s.validateAPIKey(ctx, apiKey, clientip.FromContext(ctx))
+	return user, err
+}
+
+// validateAPIKey validates an API key used from clientIP and returns the user and whether the
+// key is read-only. Keys with an allowlist are refused from other and unknown addresses.
+func (s *Service) validateAPIKey(ctx context.Context, apiKey, clientIP string) (*users.User, bool, error) {
 	// Hash the provided API key
 	hash := sha256.Sum256([]byte(apiKey))
 	keyHash := hex.EncodeToString(hash[:])
@@ -151,52 +221,63 @@ func (s *Service) ValidateAPIKey(ctx context.Context, apiKey string) (*users.Use
 		UserID    string
 		ExpiresAt sql.NullTime
 		RevokedAt sql.NullTime
+		ReadOnly  bool
+		CIDRs     sql.NullString
 	}
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, user_id, expires_at, revoked_at
+		SELECT id, user_id, expires_at, revoked_at, read_only, allowed_cidrs
 		FROM api_keys
 		WHERE key_hash = $1
-	`, keyHash).Scan(&key.ID, &key.UserID, &key.ExpiresAt, &key.RevokedAt)
+	`, keyHash).Scan(&key.ID, &key.UserID, &key.ExpiresAt, &key.RevokedAt, &key.ReadOnly, &key.CIDRs)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("invalid API key")
+		return nil, false, fmt.Errorf("invalid API key")
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to validate API key: %w", err)
+		return nil, false, fmt.Errorf("failed to validate API key: %w", err)
 	}
 
-	// Check if revoked
-	if key.RevokedAt.Valid {
-		return nil, fmt.Errorf("API key has been revoked")
+	// Check if revoked (a future revoked_at is a rotated key still within its grace period)
+	if key.RevokedAt.Valid && !key.RevokedAt.Time.After(time.Now()) {
+		s.auditAPIKeyRejection(ctx, AuditActionAPIKeyRejected, key.ID, key.UserID, clientIP, "revoked")
+		return nil, false, fmt.Errorf("API key has been revoked")
 	}
 
 	// Check if expired
 	if key.ExpiresAt.Valid && key.ExpiresAt.Time.Before(time.Now()) {
-		return nil, fmt.Errorf("API key has expired")
+		s.auditAPIKeyRejection(ctx, AuditActionAPIKeyRejected, key.ID, key.UserID, clientIP, "expired")
+		return nil, false, fmt.Errorf("API key has expired")
 	}
 
-	// Update last_used timestamp (best effort)
+	// Check the allowlist; a key whose allowlist cannot be read is allowed from nowhere
+	cidrs, err := decodeAllowedCIDRs(key.CIDRs)
+	if err != nil || !ipAllowed(cidrs, clientIP) {
+		s.auditAPIKeyRejection(ctx, AuditActionAPIKeyIPDenied, key.ID, key.UserID, clientIP, "address not in allowlist")
+		return nil, false, ErrAPIKeyIPNotAllowed
+	}
+
+	// Update last_used timestamp and address (best effort)
 	if _, err := s.db.ExecContext(ctx, `
 		UPDATE api_keys
-		SET last_used = CURRENT_TIMESTAMP
+		SET last_used = CURRENT_TIMESTAMP, last_used_ip = $2
 		WHERE id = $1
-	`, key.ID); err != nil {
+	`, key.ID, nullIfEmpty(clientIP)); err != nil {
 		s.logger.Warn("failed to update API key last_used", zap.String("key_id", key.ID), zap.Error(err))
 	}
 
 	// Get user
 	user, err := s.userService.GetUserByID(ctx, key.UserID)
 	if err != nil {
-		return nil, fmt.Errorf("user not found")
+		return nil, false, fmt.Errorf("user not found")
 	}
 
 	// Check if user is active
 	if user.Status != users.StatusActive {
-		return nil, fmt.Errorf("user account is not active")
+		return nil, false, fmt.Errorf("user account is not active")
 	}
 
-	return user, nil
+	return user, key.ReadOnly, nil
 }
 
 // generateToken generates a JWT token for a user
@@ -226,8 +307,7 @@ func (s *Service) generateToken(user *users.User) (string, time.Time, error) {
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(s.jwtSecret)
+	tokenString, err := s.signToken(claims)
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -244,9 +324,15 @@ type APIKeyPermissionRequest struct {
 // CreateAPIKeyRequest is the request to create an API key
 type CreateAPIKeyRequest struct {
 	UserID      string
+	Name        string
 	Description string
-	ExpiresAt   *time.Time
-	Permissions []APIKeyPermissionRequest // Environment-specific permissions
+	// AllowedCIDRs restricts the client addresses the key works from (see ParseAllowedCIDRs);
+	// empty allows any address
+	AllowedCIDRs []string
+	ExpiresAt    *time.Time
+	Permissions  []APIKeyPermissionRequest // Environment-specific permissions
+	// ReadOnly keys are refused every request that is not a read (see Middleware)
+	ReadOnly bool
 }
 
 // APIKeyPermissionResponse represents an environment permission in responses
@@ -257,34 +343,28 @@ type APIKeyPermissionResponse struct {
 
 // APIKeyResponse is the response when creating an API key
 type APIKeyResponse struct {
-	ID          string                     `json:"id"`
-	Key         string                     `json:"key"` // Only shown once on creation
-	KeyPrefix   string                     `json:"key_prefix"`
-	Description string                     `json:"description"`
-	CreatedAt   time.Time                  `json:"created_at"`
-	ExpiresAt   *time.Time                 `json:"expires_at,omitempty"`
-	Permissions []APIKeyPermissionResponse `json:"permissions,omitempty"`
+	ID   string `json:"id"`
+	Key  string `json:"key"` // Only shown once on creation
+	Name string `json:"name,omitempty"`
+	// KeyPrefix is the non-secret start of the key (e.g. "ak_live_1a2b3c4d"), shown to identify it
+	KeyPrefix    string                     `json:"key_prefix"`
+	Description  string                     `json:"description"`
+	AllowedCIDRs []string                   `json:"allowed_cidrs,omitempty"`
+	CreatedAt    time.Time                  `json:"created_at"`
+	ExpiresAt    *time.Time                 `json:"expires_at,omitempty"`
+	Permissions  []APIKeyPermissionResponse `json:"permissions,omitempty"`
+	ReadOnly     bool                       `json:"read_only"`
+	// Set when the key was created by rotating another key
+	RotatedFrom          string     `json:"rotated_from,omitempty"`
+	PreviousKeyRevokesAt *time.Time `json:"previous_key_revokes_at,omitempty"`
 }
 
 // CreateAPIKey creates a new API key for a user
 func (s *Service) CreateAPIKey(ctx context.Context, req *CreateAPIKeyRequest) (*APIKeyResponse, error) {
-	// Generate random API key
-	keyLength := 32
-	keyBytes := make([]byte, keyLength)
-	if _, err := rand.Read(keyBytes); err != nil {
-		return nil, fmt.Errorf("failed to generate API key: %w", err)
-	}
-
-	apiKey := hex.EncodeToString(keyBytes)
-	keyPrefix := os.Getenv("AGENTBOX_API_KEY_PREFIX")
-	if keyPrefix == "" {
-		keyPrefix = "ak_live_"
+	fullKey, keyPrefix, keyHash, err := generateAPIKey()
+	if err != nil {
+		return nil, err
 	}
-	fullKey := keyPrefix + apiKey
-
-	// Hash the key
-	hash := sha256.Sum256([]byte(fullKey))
-	keyHash := hex.EncodeToString(hash[:])
 
 	id := uuid.New().String()
 
@@ -293,10 +373,10 @@ func (s *Service) CreateAPIKey(ctx context.Context, req *CreateAPIKeyRequest) (*
 		expiresAt = sql.NullTime{Time: *req.ExpiresAt, Valid: true}
 	}
 
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO api_keys (id, user_id, key_hash, key_prefix, description, expires_at, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
-	`, id, req.UserID, keyHash, keyPrefix, req.Description, expiresAt)
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, user_id, key_hash, key_prefix, name, description, allowed_cidrs, expires_at, created_at, read_only)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP, $9)
+	`, id, req.UserID, keyHash, keyPrefix, nullIfEmpty(req.Name), req.Description, encodeAllowedCIDRs(req.AllowedCIDRs), expiresAt, req.ReadOnly)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create API key: %w", err)
 	}
@@ -307,18 +387,41 @@ func (s *Service) CreateAPIKey(ctx context.Context, req *CreateAPIKeyRequest) (*
 	}
 
 	return &APIKeyResponse{
-		ID:          id,
-		Key:         fullKey, // Only returned once
-		KeyPrefix:   keyPrefix,
-		Description: req.Description,
-		ExpiresAt:   expiresAtPtr,
+		ID:           id,
+		Key:          fullKey, // Only returned once
+		Name:         req.Name,
+		KeyPrefix:    keyPrefix,
+		Description:  req.Description,
+		AllowedCIDRs: req.AllowedCIDRs,
+		ExpiresAt:    expiresAtPtr,
+		ReadOnly:     req.ReadOnly,
 	}, nil
 }
 
+// generateAPIKey creates a new random API key and returns it with its display prefix (the
+// configured prefix and the start of the random part) and storage hash
+func generateAPIKey() (fullKey, keyPrefix, keyHash string, err error) {
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", "", "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	keyPrefix = os.Getenv("AGENTBOX_API_KEY_PREFIX")
+	if keyPrefix == "" {
+		keyPrefix = "ak_live_"
+	}
+	fullKey = keyPrefix + hex.EncodeToString(keyBytes)
+
+	// Hash the key
+	hash := sha256.Sum256([]byte(fullKey))
+	return fullKey, displayPrefix(keyPrefix, fullKey), hex.EncodeToString(hash[:]), nil
+}
+
 // ListAPIKeys lists API keys for a user
 func (s *Service) ListAPIKeys(ctx context.Context, userID string) ([]*APIKeyInfo, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, key_prefix, description, last_used, created_at, expires_at, revoked_at
+		SELECT id, key_prefix, name, description, allowed_cidrs, last_used, last_used_ip, created_at, expires_at,
+			revoked_at, rotated_from, read_only
 		FROM api_keys
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -328,14 +431,16 @@ func (s *Service) ListAPIKeys(ctx context.Context, userID string) ([]*APIKeyInfo
 	}
 	defer rows.Close()
 
+	now := time.Now()
 	var keys []*APIKeyInfo
 	for rows.Next() {
 		var key APIKeyInfo
+		var name, description, cidrs, lastUsedIP, rotatedFrom sql.NullString
 		var lastUsed, expiresAt, revokedAt sql.NullTime
 
 		err := rows.Scan(
-			&key.ID, &key.KeyPrefix, &key.Description,
-			&lastUsed, &key.CreatedAt, &expiresAt, &revokedAt,
+			&key.ID, &key.KeyPrefix, &name, &description, &cidrs,
+			&lastUsed, &lastUsedIP, &key.CreatedAt, &expiresAt, &revokedAt, &rotatedFrom, &key.ReadOnly,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan API key: %w", err)
@@ -350,6 +455,12 @@ func (s *Service) ListAPIKeys(ctx context.Context, userID string) ([]*APIKeyInfo
 		if revokedAt.Valid {
 			key.RevokedAt = &revokedAt.Time
 		}
+		key.Name = name.String
+		key.Description = description.String
+		key.AllowedCIDRs, _ = decodeAllowedCIDRs(cidrs)
+		key.LastUsedIP = lastUsedIP.String
+		key.RotatedFrom = rotatedFrom.String
+		key.Status = s.apiKeyStatus(key.ExpiresAt, key.RevokedAt, now)
 
 		keys = append(keys, &key)
 	}
@@ -359,22 +470,30 @@ func (s *Service) ListAPIKeys(ctx context.Context, userID string) ([]*APIKeyInfo
 
 // APIKeyInfo represents API key information (without the actual key)
 type APIKeyInfo struct {
-	ID          string     `json:"id"`
-	KeyPrefix   string     `json:"key_prefix"`
-	Description string     `json:"description"`
-	LastUsed    *time.Time `json:"last_used,omitempty"`
-	CreatedAt   time.Time  `json:"created_at"`
-	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ID           string     `json:"id"`
+	Name         string     `json:"name,omitempty"`
+	KeyPrefix    string     `json:"key_prefix"`
+	Description  string     `json:"description"`
+	AllowedCIDRs []string   `json:"allowed_cidrs,omitempty"`
+	LastUsed     *time.Time `json:"last_used,omitempty"`
+	LastUsedIP   string     `json:"last_used_ip,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	// RevokedAt may be in the future when the key was rotated and is within its grace period
 	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	RotatedFrom string     `json:"rotated_from,omitempty"`
+	ReadOnly    bool       `json:"read_only"`
+	// Status is computed: active, expiring, expired or revoked
+	Status string `json:"status"`
 }
 
 // RevokeAPIKey revokes an API key
 func (s *Service) RevokeAPIKey(ctx context.Context, keyID, userID string) error {
 	result, err := s.db.ExecContext(ctx, `
 		UPDATE api_keys
-		SET revoked_at = CURRENT_TIMESTAMP
-		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
-	`, keyID, userID)
+		SET revoked_at = $3
+		WHERE id = $1 AND user_id = $2 AND (revoked_at IS NULL OR revoked_at > $3)
+	`, keyID, userID, time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to revoke API key: %w", err)
 	}
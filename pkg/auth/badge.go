@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// ========== Status Badges ==========
+
+// Status badges show an environment's status to anyone holding the badge URL, without
+// credentials. The URL is signed with a per-environment secret: rotating the secret revokes every
+// badge URL handed out before.
+
+// BadgeSignature returns the signature of the environment's badge URL, creating the
+// environment's badge secret on first use
+func (s *Service) BadgeSignature(ctx context.Context, envID string) (string, error) {
+	secret, err := newBadgeSecret()
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO environment_badge_secrets (environment_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (environment_id) DO NOTHING
+	`, envID, secret, time.Now().UTC()); err != nil {
+		return "", fmt.Errorf("failed to create badge secret: %w", err)
+	}
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT secret FROM environment_badge_secrets WHERE environment_id = $1
+	`, envID).Scan(&secret); err != nil {
+		return "", fmt.Errorf("failed to get badge secret: %w", err)
+	}
+	return signBadge(secret, envID), nil
+}
+
+// RotateBadgeSecret replaces the environment's badge secret, so badge URLs signed before stop
+// working, and returns the new signature
+func (s *Service) RotateBadgeSecret(ctx context.Context, envID string) (string, error) {
+	secret, err := newBadgeSecret()
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO environment_badge_secrets (environment_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (environment_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at
+	`, envID, secret, time.Now().UTC()); err != nil {
+		return "", fmt.Errorf("failed to rotate badge secret: %w", err)
+	}
+	return signBadge(secret, envID), nil
+}
+
+// VerifyBadgeSignature reports whether signature is the current signature of the environment's
+// badge URL
+func (s *Service) VerifyBadgeSignature(ctx context.Context, envID, signature string) (bool, error) {
+	var secret string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT secret FROM environment_badge_secrets WHERE environment_id = $1
+	`, envID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get badge secret: %w", err)
+	}
+	return hmac.Equal([]byte(signBadge(secret, envID)), []byte(signature)), nil
+}
+
+// newBadgeSecret generates a random badge secret
+func newBadgeSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate badge secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signBadge returns the HMAC-SHA256 of the environment ID under secret
+func signBadge(secret, envID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(envID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ========== Callback Tokens ==========
+
+// CallbackTokenScope marks a JWT as a callback token. Callback tokens are handed to environment
+// pods (as AGENTBOX_CALLBACK_TOKEN) so workloads can report results back; they only authorize
+// result-reporting for their own environment/execution and are rejected as user tokens.
+const CallbackTokenScope = "callback"
+
+// MaxCallbackTokenTTL caps the lifetime of a callback token
+const MaxCallbackTokenTTL = 24 * time.Hour
+
+// CallbackClaims are the claims of a callback token
+type CallbackClaims struct {
+	Scope         string `json:"scope"`
+	EnvironmentID string `json:"environment_id"`
+	// ExecutionID is empty for tokens issued to an environment's main or standby pods
+	ExecutionID string `json:"execution_id,omitempty"`
+	UserID      string `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// GenerateCallbackToken issues a callback token for an environment (and optionally one of its
+// executions) on behalf of userID, valid for ttl (capped at MaxCallbackTokenTTL)
+func (s *Service) GenerateCallbackToken(envID, execID, userID string, ttl time.Duration) (string, error) {
+	if envID == "" {
+		return "", fmt.Errorf("environment ID is required")
+	}
+	if ttl <= 0 || ttl > MaxCallbackTokenTTL {
+		ttl = MaxCallbackTokenTTL
+	}
+	now := time.Now()
+	subject := envID
+	if execID != "" {
+		subject = execID
+	}
+	claims := &CallbackClaims{
+		Scope:         CallbackTokenScope,
+		EnvironmentID: envID,
+		ExecutionID:   execID,
+		UserID:        userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "agentbox",
+			Subject:   subject,
+		},
+	}
+	return s.signToken(claims)
+}
+
+// ValidateCallbackToken validates a callback token and returns its claims. Result-reporting
+// endpoints must also check that the claims match the environment/execution being reported on.
+func (s *Service) ValidateCallbackToken(tokenString string) (*CallbackClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &CallbackClaims{}, s.verificationKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	claims, ok := token.Claims.(*CallbackClaims)
+	if !ok || !token.Valid || claims.Scope != CallbackTokenScope || claims.EnvironmentID == "" {
+		return nil, fmt.Errorf("invalid callback token")
+	}
+	return claims, nil
+}
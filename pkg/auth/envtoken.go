@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// ========== Environment Tokens ==========
+
+// EnvironmentTokenPrefix starts every environment token, so the middleware can tell them apart
+// from JWTs and API keys
+const EnvironmentTokenPrefix = "aet_"
+
+// DefaultEnvironmentTokenMaxTTL caps the lifetime of environment tokens unless configured otherwise
+const DefaultEnvironmentTokenMaxTTL = 24 * time.Hour
+
+// environmentTokenRetention is how long expired tokens are kept (and listed) before being purged
+const environmentTokenRetention = 7 * 24 * time.Hour
+
+// podTokenLifetime is the expiry of tokens issued to main pods. They are meant to live as long as
+// the environment, so they are revoked when it is deleted (or its main pod replaced) instead.
+const podTokenLifetime = 10 * 365 * 24 * time.Hour
+
+// EnvironmentScopeContextKey is the context key for the scope of an environment token
+const EnvironmentScopeContextKey ContextKey = "environment_scope"
+
+// EnvironmentToken is an API token that acts for its creator on a single environment only, with
+// at most the given permission. Tokens are short-lived and revocable.
+type EnvironmentToken struct {
+	ID            string `json:"id"`
+	EnvironmentID string `json:"environment_id"`
+	UserID        string `json:"user_id"`
+	Permission    string `json:"permission"`
+	Description   string `json:"description,omitempty"`
+	// Token is the secret; only returned when the token is created
+	Token     string     `json:"token,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// EnvironmentScope limits an authenticated request to one environment
+type EnvironmentScope struct {
+	TokenID       string
+	EnvironmentID string
+	Permission    string
+}
+
+// GetEnvironmentScopeFromContext returns the scope of a request authenticated with an
+// environment token; ok is false for unscoped (user token or API key) requests
+func GetEnvironmentScopeFromContext(ctx context.Context) (*EnvironmentScope, bool) {
+	scope, ok := ctx.Value(EnvironmentScopeContextKey).(*EnvironmentScope)
+	return scope, ok && scope != nil
+}
+
+// SetEnvironmentTokenMaxTTL sets the longest lifetime environment tokens can be created with.
+// A non-positive value keeps the current setting.
+func (s *Service) SetEnvironmentTokenMaxTTL(maxTTL time.Duration) {
+	if maxTTL > 0 {
+		s.environmentTokenMaxTTL = maxTTL
+	}
+}
+
+// CreateEnvironmentToken issues a token for userID scoped to an environment. A ttl of zero, or one
+// above the configured maximum, uses the maximum. The secret is only returned here.
+func (s *Service) CreateEnvironmentToken(ctx context.Context, envID, userID, permission, description string, ttl time.Duration) (*EnvironmentToken, error) {
+	if envID == "" {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "environment ID is required")
+	}
+	if !permissions.ValidatePermission(permission) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "invalid permission level: %s", permission)
+	}
+	if ttl < 0 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "ttl must not be negative")
+	}
+	if ttl == 0 || ttl > s.environmentTokenMaxTTL {
+		ttl = s.environmentTokenMaxTTL
+	}
+
+	return s.insertEnvironmentToken(ctx, envID, userID, permission, description, ttl, false)
+}
+
+// insertEnvironmentToken stores a new token valid for ttl and returns it with its secret
+func (s *Service) insertEnvironmentToken(ctx context.Context, envID, userID, permission, description string, ttl time.Duration, issuedToPod bool) (*EnvironmentToken, error) {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	secret := EnvironmentTokenPrefix + hex.EncodeToString(secretBytes)
+
+	now := time.Now().UTC()
+	token := &EnvironmentToken{
+		ID:            uuid.New().String(),
+		EnvironmentID: envID,
+		UserID:        userID,
+		Permission:    permission,
+		Description:   description,
+		Token:         secret,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO environment_tokens (id, environment_id, user_id, token_hash, permission, description, created_at, expires_at, issued_to_pod)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, token.ID, envID, userID, hashEnvironmentToken(secret), permission, description, now, token.ExpiresAt, issuedToPod); err != nil {
+		return nil, fmt.Errorf("failed to create environment token: %w", err)
+	}
+
+	// Long-expired or long-revoked tokens are of no further use
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM environment_tokens WHERE expires_at < $1 OR revoked_at < $1`, now.Add(-environmentTokenRetention)); err != nil {
+		s.logger.Warn("failed to purge expired environment tokens", zap.Error(err))
+	}
+
+	return token, nil
+}
+
+// IssueEnvironmentToken issues an editor token for an environment's main pod and returns its
+// secret. The token is valid until it is revoked, regardless of the maximum TTL; the token of
+// the environment's previous main pod is revoked. Implements orchestrator.EnvironmentTokenIssuer.
+func (s *Service) IssueEnvironmentToken(ctx context.Context, envID, userID string) (string, error) {
+	if err := s.revokePodTokens(ctx, envID); err != nil {
+		return "", err
+	}
+	token, err := s.insertEnvironmentToken(ctx, envID, userID, permissions.PermissionEditor, "issued to environment pod", podTokenLifetime, true)
+	if err != nil {
+		return "", err
+	}
+	return token.Token, nil
+}
+
+// RevokeEnvironmentTokens revokes all the tokens of an environment that is deleted (implements
+// orchestrator.EnvironmentTokenIssuer)
+func (s *Service) RevokeEnvironmentTokens(ctx context.Context, envID string) error {
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE environment_tokens SET revoked_at = $2 WHERE environment_id = $1 AND revoked_at IS NULL
+	`, envID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to revoke environment tokens: %w", err)
+	}
+	return nil
+}
+
+// revokePodTokens revokes the tokens issued to an environment's main pods
+func (s *Service) revokePodTokens(ctx context.Context, envID string) error {
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE environment_tokens SET revoked_at = $2
+		WHERE environment_id = $1 AND issued_to_pod = TRUE AND revoked_at IS NULL
+	`, envID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to revoke pod environment tokens: %w", err)
+	}
+	return nil
+}
+
+// ListEnvironmentTokens returns the tokens of an environment, newest first, without their secrets
+func (s *Service) ListEnvironmentTokens(ctx context.Context, envID string) ([]*EnvironmentToken, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, environment_id, user_id, permission, description, created_at, expires_at, revoked_at, last_used
+		FROM environment_tokens
+		WHERE environment_id = $1
+		ORDER BY created_at DESC
+	`, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*EnvironmentToken{}
+	for rows.Next() {
+		var token EnvironmentToken
+		var description sql.NullString
+		var revokedAt, lastUsed sql.NullTime
+		if err := rows.Scan(&token.ID, &token.EnvironmentID, &token.UserID, &token.Permission, &description,
+			&token.CreatedAt, &token.ExpiresAt, &revokedAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan environment token: %w", err)
+		}
+		token.Description = description.String
+		if revokedAt.Valid {
+			token.RevokedAt = &revokedAt.Time
+		}
+		if lastUsed.Valid {
+			token.LastUsed = &lastUsed.Time
+		}
+		tokens = append(tokens, &token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeEnvironmentToken revokes one of an environment's tokens
+func (s *Service) RevokeEnvironmentToken(ctx context.Context, envID, tokenID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE environment_tokens
+		SET revoked_at = $3
+		WHERE id = $1 AND environment_id = $2 AND revoked_at IS NULL
+	`, tokenID, envID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to revoke environment token: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return apierrors.New(apierrors.NotFound, apierrors.CodeEnvironmentTokenNotFound, "environment token not found or already revoked")
+	}
+	return nil
+}
+
+// ValidateEnvironmentToken validates an environment token and returns the user it acts for and
+// the environment it is limited to
+func (s *Service) ValidateEnvironmentToken(ctx context.Context, secret string) (*users.User, *EnvironmentScope, error) {
+	if !strings.HasPrefix(secret, EnvironmentTokenPrefix) {
+		return nil, nil, fmt.Errorf("invalid environment token")
+	}
+
+	var tokenID, envID, userID, permission string
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, environment_id, user_id, permission, expires_at, revoked_at
+		FROM environment_tokens
+		WHERE token_hash = $1
+	`, hashEnvironmentToken(secret)).Scan(&tokenID, &envID, &userID, &permission, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("invalid environment token")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to validate environment token: %w", err)
+	}
+	if revokedAt.Valid {
+		return nil, nil, fmt.Errorf("environment token has been revoked")
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, nil, fmt.Errorf("environment token has expired")
+	}
+
+	if _, err := s.db.ExecContext(ctx, `UPDATE environment_tokens SET last_used = $2 WHERE id = $1`, tokenID, time.Now().UTC()); err != nil {
+		s.logger.Warn("failed to update environment token last_used", zap.String("token_id", tokenID), zap.Error(err))
+	}
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user not found")
+	}
+	if user.Status != users.StatusActive {
+		return nil, nil, fmt.Errorf("user account is not active")
+	}
+
+	return user, &EnvironmentScope{TokenID: tokenID, EnvironmentID: envID, Permission: permission}, nil
+}
+
+// hashEnvironmentToken returns the stored hash of a token secret
+func hashEnvironmentToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
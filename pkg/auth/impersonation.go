@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/impersonation"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// ========== Impersonation ==========
+
+// Audit actions written for impersonation sessions
+const (
+	AuditActionImpersonationStarted = "auth.impersonation_started"
+	AuditActionImpersonationRevoked = "auth.impersonation_revoked"
+)
+
+// DefaultImpersonationTTL is the lifetime of an impersonation token unless requested otherwise;
+// MaxImpersonationTTL caps it
+const (
+	DefaultImpersonationTTL = 15 * time.Minute
+	MaxImpersonationTTL     = time.Hour
+)
+
+// ImpersonationSession is a period in which a super admin acts as another user, for support
+// debugging. Requests made with the session's token are authorized as the user; what they record
+// in the audit log names the admin as well.
+type ImpersonationSession struct {
+	ID        string     `json:"id"`
+	AdminID   string     `json:"admin_id"`
+	UserID    string     `json:"user_id"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy string     `json:"revoked_by,omitempty"`
+	// Active reports whether the session's token is still accepted
+	Active bool `json:"active"`
+}
+
+// ImpersonationResponse is the response when an impersonation session is started
+type ImpersonationResponse struct {
+	// Token authenticates as User until ExpiresAt (or until the session is revoked)
+	Token     string                `json:"token"`
+	ExpiresAt time.Time             `json:"expires_at"`
+	User      *users.User           `json:"user"`
+	Session   *ImpersonationSession `json:"session"`
+}
+
+// StartImpersonation starts a session in which admin acts as the user userID and returns its
+// token. Only super admins impersonate, never from an impersonated request, and never another
+// super admin or an inactive user. A ttl of zero uses DefaultImpersonationTTL; longer than
+// MaxImpersonationTTL is capped.
+func (s *Service) StartImpersonation(ctx context.Context, admin *users.User, userID, reason string, ttl time.Duration) (*ImpersonationResponse, error) {
+	if _, ok := impersonation.FromContext(ctx); ok {
+		return nil, apierrors.New(apierrors.Forbidden, apierrors.CodeImpersonationForbidden, "cannot impersonate while impersonating")
+	}
+	if admin.Role != users.RoleSuperAdmin {
+		return nil, apierrors.New(apierrors.Forbidden, "", "only super admins can impersonate users")
+	}
+	if userID == admin.ID {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "cannot impersonate yourself")
+	}
+	if ttl < 0 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "ttl must not be negative")
+	}
+	if ttl == 0 {
+		ttl = DefaultImpersonationTTL
+	}
+	if ttl > MaxImpersonationTTL {
+		ttl = MaxImpersonationTTL
+	}
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if errors.Is(err, users.ErrUserNotFound) {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeUserNotFound, "user %s not found", userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Role == users.RoleSuperAdmin {
+		return nil, apierrors.New(apierrors.Forbidden, apierrors.CodeImpersonationForbidden, "super admins cannot be impersonated")
+	}
+	if user.Status != users.StatusActive {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "user account is not active")
+	}
+
+	now := time.Now().UTC()
+	session := &ImpersonationSession{
+		ID:        uuid.New().String(),
+		AdminID:   admin.ID,
+		UserID:    user.ID,
+		Reason:    reason,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Active:    true,
+	}
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO impersonation_sessions (id, admin_id, user_id, reason, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, session.ID, admin.ID, user.ID, reason, now, session.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("failed to create impersonation session: %w", err)
+	}
+
+	token, err := s.signToken(&Claims{
+		UserID:         user.ID,
+		Username:       user.Username,
+		Role:           user.Role,
+		ImpersonatorID: admin.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        session.ID,
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "agentbox",
+			Subject:   user.ID,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	message := fmt.Sprintf("%s started impersonating %s until %s", admin.Username, user.Username, session.ExpiresAt.Format(time.RFC3339))
+	if reason != "" {
+		message += ": " + reason
+	}
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       AuditActionImpersonationStarted,
+		ActorID:      admin.ID,
+		ResourceType: "user",
+		ResourceID:   user.ID,
+		Message:      message,
+		Details:      session.ID,
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry for impersonation", zap.String("session_id", session.ID), zap.Error(err))
+	}
+
+	return &ImpersonationResponse{Token: token, ExpiresAt: session.ExpiresAt, User: user, Session: session}, nil
+}
+
+const impersonationSessionColumns = `id, admin_id, user_id, COALESCE(reason, ''), created_at, expires_at, revoked_at, COALESCE(revoked_by, '')`
+
+// scanImpersonationSession scans a row of impersonationSessionColumns
+func scanImpersonationSession(scan func(dest ...interface{}) error) (*ImpersonationSession, error) {
+	var session ImpersonationSession
+	var revokedAt sql.NullTime
+	if err := scan(&session.ID, &session.AdminID, &session.UserID, &session.Reason,
+		&session.CreatedAt, &session.ExpiresAt, &revokedAt, &session.RevokedBy); err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	session.Active = !revokedAt.Valid && session.ExpiresAt.After(time.Now())
+	return &session, nil
+}
+
+// GetImpersonationSession returns an impersonation session
+func (s *Service) GetImpersonationSession(ctx context.Context, id string) (*ImpersonationSession, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+impersonationSessionColumns+` FROM impersonation_sessions WHERE id = $1`, id)
+	session, err := scanImpersonationSession(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeImpersonationNotFound, "impersonation session not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get impersonation session: %w", err)
+	}
+	return session, nil
+}
+
+// ListImpersonationSessions returns the most recent impersonation sessions (at most limit,
+// default 100, max 1000), newest first; activeOnly leaves out expired and revoked ones
+func (s *Service) ListImpersonationSessions(ctx context.Context, activeOnly bool, limit int) ([]*ImpersonationSession, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	query := `SELECT ` + impersonationSessionColumns + ` FROM impersonation_sessions`
+	args := []interface{}{limit}
+	if activeOnly {
+		query += ` WHERE revoked_at IS NULL AND expires_at > $2`
+		args = append(args, time.Now().UTC())
+	}
+	query += ` ORDER BY created_at DESC, id LIMIT $1`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list impersonation sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []*ImpersonationSession{}
+	for rows.Next() {
+		session, err := scanImpersonationSession(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan impersonation session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeImpersonation ends an impersonation session before it expires; its token is rejected
+// from then on. actorID is the super admin (or the impersonating admin) revoking it.
+func (s *Service) RevokeImpersonation(ctx context.Context, id, actorID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE impersonation_sessions
+		SET revoked_at = $2, revoked_by = $3
+		WHERE id = $1 AND revoked_at IS NULL
+	`, id, time.Now().UTC(), actorID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke impersonation session: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return apierrors.New(apierrors.NotFound, apierrors.CodeImpersonationNotFound, "impersonation session not found or already revoked")
+	}
+
+	session, err := s.GetImpersonationSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       AuditActionImpersonationRevoked,
+		ActorID:      actorID,
+		ResourceType: "user",
+		ResourceID:   session.UserID,
+		Message:      fmt.Sprintf("Impersonation of user %s by %s revoked", session.UserID, session.AdminID),
+		Details:      session.ID,
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry for impersonation revocation", zap.String("session_id", id), zap.Error(err))
+	}
+	return nil
+}
+
+// checkImpersonation checks that the session of an impersonation token is still active and that
+// its admin is still an active super admin
+func (s *Service) checkImpersonation(ctx context.Context, claims *Claims) (*impersonation.Impersonation, error) {
+	var adminID, userID string
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT admin_id, user_id, expires_at, revoked_at
+		FROM impersonation_sessions
+		WHERE id = $1
+	`, claims.ID).Scan(&adminID, &userID, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate impersonation session: %w", err)
+	}
+	if adminID != claims.ImpersonatorID || userID != claims.UserID {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if revokedAt.Valid {
+		return nil, fmt.Errorf("impersonation session has been revoked")
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("impersonation session has expired")
+	}
+
+	admin, err := s.userService.GetUserByID(ctx, adminID)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating user not found")
+	}
+	if admin.Status != users.StatusActive || admin.Role != users.RoleSuperAdmin {
+		return nil, fmt.Errorf("impersonating user is no longer an active super admin")
+	}
+	return &impersonation.Impersonation{SessionID: claims.ID, AdminID: adminID}, nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/sciffer/agentbox/internal/config"
+)
+
+// ========== JWT Signing Keys ==========
+
+// ephemeralKeyID is the kid of the random key a service signs with until SetSigningKeys is called
+const ephemeralKeyID = "ephemeral"
+
+// SigningKey is a JWT signing secret. Its ID is written to the kid header of the tokens it signs.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+	// RetireAt is when the key stops being accepted; zero keeps it until it is removed
+	RetireAt time.Time
+}
+
+// SigningKeysFromConfig returns the JWT key set of the auth config (auth.jwt_keys, or auth.secret
+// as the only key). It is empty when no secret is configured.
+func SigningKeysFromConfig(cfg config.AuthConfig) ([]SigningKey, error) {
+	configured := cfg.EffectiveJWTKeys()
+	keys := make([]SigningKey, 0, len(configured))
+	for _, k := range configured {
+		key := SigningKey{ID: k.ID, Secret: []byte(k.Secret)}
+		if k.RetireAt != "" {
+			retireAt, err := time.Parse(time.RFC3339, k.RetireAt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retire_at of JWT key %q: %w", k.ID, err)
+			}
+			key.RetireAt = retireAt
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// newEphemeralKey returns a random signing key; tokens it signs stop working when the process exits
+func newEphemeralKey() SigningKey {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("failed to generate JWT signing key: %v", err))
+	}
+	return SigningKey{ID: ephemeralKeyID, Secret: secret}
+}
+
+// SetSigningKeys replaces the JWT key set. The first key signs new tokens; the others are only
+// accepted for validating tokens until they retire, so a secret can be rotated by adding the new
+// key first and giving the old one a retirement date past the longest token lifetime.
+func (s *Service) SetSigningKeys(keys []SigningKey) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one JWT signing key is required")
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.ID == "" {
+			return fmt.Errorf("JWT signing keys need an ID")
+		}
+		if seen[key.ID] {
+			return fmt.Errorf("duplicate JWT signing key ID %q", key.ID)
+		}
+		seen[key.ID] = true
+		if string(key.Secret) == config.InsecureDefaultJWTSecret {
+			return fmt.Errorf("JWT signing key %q uses the insecure sample secret", key.ID)
+		}
+		if len(key.Secret) < config.MinJWTSecretLength {
+			return fmt.Errorf("JWT signing key %q must be at least %d bytes", key.ID, config.MinJWTSecretLength)
+		}
+	}
+	if !keys[0].RetireAt.IsZero() {
+		return fmt.Errorf("the signing JWT key %q cannot retire", keys[0].ID)
+	}
+	s.signingKeys = append([]SigningKey(nil), keys...)
+	return nil
+}
+
+// signToken signs claims with the current key and sets the kid header
+func (s *Service) signToken(claims jwt.Claims) (string, error) {
+	key := s.signingKeys[0]
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
+}
+
+// verificationKeys is the jwt.Keyfunc of all token validation: the key named by the token's kid
+// is tried first, then the other keys that have not retired (tokens without a kid predate key
+// IDs). Only HMAC-signed tokens are accepted.
+func (s *Service) verificationKeys(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	now := time.Now()
+
+	set := jwt.VerificationKeySet{}
+	for _, key := range s.signingKeys {
+		if !key.RetireAt.IsZero() && !now.Before(key.RetireAt) {
+			continue
+		}
+		if key.ID == kid {
+			set.Keys = append([]jwt.VerificationKey{key.Secret}, set.Keys...)
+		} else {
+			set.Keys = append(set.Keys, key.Secret)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no active signing key")
+	}
+	return set, nil
+}
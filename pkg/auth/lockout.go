@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Login Throttling & Lockout ==========
+
+// Audit actions written for login lockouts
+const (
+	AuditActionLoginLocked   = "auth.login_locked"
+	AuditActionLoginUnlocked = "auth.login_unlocked"
+)
+
+// Prefixes of the subjects failed logins are counted against
+const (
+	lockoutSubjectUser = "user:"
+	lockoutSubjectIP   = "ip:"
+)
+
+// LoginLockedError is returned by Login while the username or the client address may not try
+// again, either shortly after a failure or because it is locked out
+type LoginLockedError struct {
+	// RetryAfter is how long until the next attempt is accepted
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts; try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Unwrap makes the error a RateLimited error with the LOGIN_LOCKED code
+func (e *LoginLockedError) Unwrap() error {
+	return apierrors.New(apierrors.RateLimited, apierrors.CodeLoginLocked, "%s", e.Error())
+}
+
+// lockoutSubject is a username or client address failed logins are counted against
+type lockoutSubject struct {
+	key string
+	// maxFailures is the number of consecutive failures that lock the subject out
+	maxFailures int
+}
+
+// SetLoginLockout configures login throttling. Failed logins are not throttled until it is
+// called with an enabled configuration.
+func (s *Service) SetLoginLockout(cfg config.LoginLockoutConfig) {
+	s.loginLockout = cfg
+}
+
+// lockoutSubjects returns the subjects a login attempt is throttled by (none when disabled)
+func (s *Service) lockoutSubjects(username, clientIP string) []lockoutSubject {
+	cfg := s.loginLockout
+	if !cfg.Enabled {
+		return nil
+	}
+	subjects := []lockoutSubject{{key: lockoutSubjectUser + username, maxFailures: cfg.MaxFailures}}
+	if clientIP != "" && cfg.MaxFailuresPerIP > 0 {
+		subjects = append(subjects, lockoutSubject{key: lockoutSubjectIP + clientIP, maxFailures: cfg.MaxFailuresPerIP})
+	}
+	return subjects
+}
+
+// checkLoginAllowed returns a *LoginLockedError when any of the subjects is still blocked
+func (s *Service) checkLoginAllowed(ctx context.Context, subjects []lockoutSubject) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, subject := range subjects {
+		var lockedUntil sql.NullTime
+		err := s.db.QueryRowContext(ctx, `SELECT locked_until FROM login_failures WHERE subject = $1`, subject.key).Scan(&lockedUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check login lockout: %w", err)
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(now) {
+			wait = max(wait, lockedUntil.Time.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return &LoginLockedError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login against every subject, blocking each for an
+// exponentially growing delay, or for the lockout duration once it reaches its maximum
+func (s *Service) recordLoginFailure(ctx context.Context, subjects []lockoutSubject, clientIP string) {
+	now := time.Now()
+	for _, subject := range subjects {
+		failures, err := s.countLoginFailure(ctx, subject, now)
+		if err != nil {
+			s.logger.Warn("failed to record failed login", zap.String("subject", subject.key), zap.Error(err))
+			continue
+		}
+		if failures == subject.maxFailures {
+			s.auditLoginLocked(ctx, subject, failures, clientIP)
+		}
+	}
+}
+
+// countLoginFailure adds a failure to subject and returns its consecutive failures. Failures
+// older than the lockout duration are forgotten, so an expired lockout starts over.
+func (s *Service) countLoginFailure(ctx context.Context, subject lockoutSubject, now time.Time) (int, error) {
+	lockoutDuration := time.Duration(s.loginLockout.LockoutSeconds) * time.Second
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var failures int
+	var lastFailure time.Time
+	err = tx.QueryRowContext(ctx, `SELECT failures, last_failure_at FROM login_failures WHERE subject = $1`, subject.key).
+		Scan(&failures, &lastFailure)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		failures = 0
+	case err != nil:
+		return 0, err
+	case now.Sub(lastFailure) > lockoutDuration:
+		failures = 0
+	}
+	failures++
+
+	delay := lockoutDuration
+	if failures < subject.maxFailures {
+		delay = s.loginDelay(failures)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO login_failures (subject, failures, last_failure_at, locked_until)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = EXCLUDED.failures,
+			last_failure_at = EXCLUDED.last_failure_at,
+			locked_until = EXCLUDED.locked_until
+	`, subject.key, failures, now, now.Add(delay)); err != nil {
+		return 0, err
+	}
+	return failures, tx.Commit()
+}
+
+// loginDelay is how long a subject is blocked after its nth consecutive failure: the base
+// delay, doubled for every further failure, capped at the lockout duration
+func (s *Service) loginDelay(failures int) time.Duration {
+	lockoutDuration := time.Duration(s.loginLockout.LockoutSeconds) * time.Second
+	delay := time.Duration(s.loginLockout.BaseDelayMs) * time.Millisecond
+	for i := 1; i < failures && delay < lockoutDuration; i++ {
+		delay *= 2
+	}
+	return min(delay, lockoutDuration)
+}
+
+// clearLoginFailures forgets the failed logins of a subject
+func (s *Service) clearLoginFailures(ctx context.Context, key string) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM login_failures WHERE subject = $1`, key); err != nil {
+		s.logger.Warn("failed to reset failed logins", zap.String("subject", key), zap.Error(err))
+	}
+}
+
+// auditLoginLocked records that a username or client address was locked out
+func (s *Service) auditLoginLocked(ctx context.Context, subject lockoutSubject, failures int, clientIP string) {
+	lockoutDuration := time.Duration(s.loginLockout.LockoutSeconds) * time.Second
+	resourceType, resourceID := "user", strings.TrimPrefix(subject.key, lockoutSubjectUser)
+	if strings.HasPrefix(subject.key, lockoutSubjectIP) {
+		resourceType, resourceID = "client_address", strings.TrimPrefix(subject.key, lockoutSubjectIP)
+	}
+
+	s.logger.Warn("login locked out after repeated failures",
+		zap.String(resourceType, resourceID),
+		zap.Int("failures", failures),
+		zap.Duration("duration", lockoutDuration),
+	)
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       AuditActionLoginLocked,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Message:      fmt.Sprintf("Login for %s %s locked out for %s after %d failed attempts", resourceType, resourceID, lockoutDuration, failures),
+		ClientIP:     clientIP,
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry for login lockout", zap.String("subject", subject.key), zap.Error(err))
+	}
+}
+
+// UnlockLogin clears the failed logins and any lockout of username (actorID is the admin doing
+// it). It reports whether there was anything to clear.
+func (s *Service) UnlockLogin(ctx context.Context, username, actorID string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM login_failures WHERE subject = $1`, lockoutSubjectUser+username)
+	if err != nil {
+		return false, fmt.Errorf("failed to unlock login: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, nil
+	}
+
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       AuditActionLoginUnlocked,
+		ActorID:      actorID,
+		ResourceType: "user",
+		ResourceID:   username,
+		Message:      fmt.Sprintf("Login for user %s unlocked", username),
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry for login unlock", zap.String("username", username), zap.Error(err))
+	}
+	return true, nil
+}
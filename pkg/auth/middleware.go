@@ -2,11 +2,15 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/impersonation"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
@@ -16,13 +20,20 @@ type ContextKey string
 // UserContextKey is the context key for user
 const UserContextKey ContextKey = "user"
 
+// ReadOnlyContextKey is the context key marking requests made with a read-only API key
+const ReadOnlyContextKey ContextKey = "read_only"
+
 // Middleware provides authentication middleware for HTTP handlers
 func (s *Service) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check for X-API-Key header first (common pattern for API key auth)
 		apiKey := r.Header.Get("X-API-Key")
 		if apiKey != "" {
-			user, err := s.ValidateAPIKey(r.Context(), apiKey)
+			user, readOnly, err := s.validateAPIKey(r.Context(), apiKey, clientip.FromRequest(r))
+			if errors.Is(err, ErrAPIKeyIPNotAllowed) {
+				s.respondIPNotAllowed(w)
+				return
+			}
 			if err != nil {
 				s.logger.Debug("API key authentication failed", zap.Error(err))
 				s.respondUnauthorized(w, "invalid API key")
@@ -30,8 +41,7 @@ func (s *Service) Middleware(next http.Handler) http.Handler {
 			}
 
 			// API key valid, set user in context
-			ctx := context.WithValue(r.Context(), UserContextKey, user)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			s.serveAPIKeyRequest(w, r, next, user, readOnly)
 			return
 		}
 
@@ -51,17 +61,39 @@ func (s *Service) Middleware(next http.Handler) http.Handler {
 
 		token := parts[1]
 
+		// Environment tokens act for their creator on a single environment
+		if strings.HasPrefix(token, EnvironmentTokenPrefix) {
+			user, scope, err := s.ValidateEnvironmentToken(r.Context(), token)
+			if err != nil {
+				s.logger.Debug("environment token authentication failed", zap.Error(err))
+				s.respondUnauthorized(w, "invalid environment token")
+				return
+			}
+			ctx := context.WithValue(r.Context(), UserContextKey, user)
+			ctx = context.WithValue(ctx, EnvironmentScopeContextKey, scope)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// Try JWT first
-		user, err := s.ValidateJWT(r.Context(), token)
+		user, imp, err := s.validateJWT(r.Context(), token)
 		if err == nil {
-			// JWT valid, set user in context
+			// JWT valid, set user in context; impersonated requests act as the user but record
+			// the admin behind them
 			ctx := context.WithValue(r.Context(), UserContextKey, user)
+			if imp != nil {
+				ctx = impersonation.NewContext(ctx, imp)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
 		// Try API key via Authorization header (Bearer <api-key>)
-		user, err = s.ValidateAPIKey(r.Context(), token)
+		user, readOnly, err := s.validateAPIKey(r.Context(), token, clientip.FromRequest(r))
+		if errors.Is(err, ErrAPIKeyIPNotAllowed) {
+			s.respondIPNotAllowed(w)
+			return
+		}
 		if err != nil {
 			s.logger.Debug("authentication failed", zap.Error(err))
 			s.respondUnauthorized(w, "invalid token or API key")
@@ -69,11 +101,41 @@ func (s *Service) Middleware(next http.Handler) http.Handler {
 		}
 
 		// API key valid, set user in context
-		ctx := context.WithValue(r.Context(), UserContextKey, user)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		s.serveAPIKeyRequest(w, r, next, user, readOnly)
 	})
 }
 
+// serveAPIKeyRequest serves a request authenticated with an API key as the key's user. A
+// read-only key is refused anything but reads before any handler runs, whatever the user's
+// permissions.
+func (s *Service) serveAPIKeyRequest(w http.ResponseWriter, r *http.Request, next http.Handler, user *users.User, readOnly bool) {
+	if readOnly && !isReadRequest(r) {
+		s.respondReadOnly(w)
+		return
+	}
+	ctx := context.WithValue(r.Context(), UserContextKey, user)
+	if readOnly {
+		ctx = context.WithValue(ctx, ReadOnlyContextKey, true)
+	}
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// isReadRequest reports whether a request only reads: a GET, HEAD or OPTIONS request that is not
+// a WebSocket upgrade (attaching and port forwarding act on the environment)
+func isReadRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return !strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	}
+	return false
+}
+
+// IsReadOnly reports whether the request was authenticated with a read-only API key
+func IsReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(ReadOnlyContextKey).(bool)
+	return readOnly
+}
+
 // GetUserFromContext extracts the user from the request context
 func GetUserFromContext(ctx context.Context) (*users.User, bool) {
 	user, ok := ctx.Value(UserContextKey).(*users.User)
@@ -84,7 +146,25 @@ func GetUserFromContext(ctx context.Context) (*users.User, bool) {
 func (s *Service) respondUnauthorized(w http.ResponseWriter, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusUnauthorized)
-	if _, err := w.Write([]byte(`{"error":"unauthorized","message":"` + message + `"}`)); err != nil {
+	if _, err := w.Write([]byte(`{"error":"unauthorized","message":"` + message + `","code":"UNAUTHORIZED","status":401}`)); err != nil {
 		s.logger.Warn("failed to write unauthorized response", zap.Error(err))
 	}
 }
+
+// respondReadOnly sends the forbidden response for a change attempted with a read-only API key
+func (s *Service) respondReadOnly(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	if _, err := w.Write([]byte(`{"error":"forbidden","message":"this API key is read-only","code":"` + apierrors.CodeReadOnlyAPIKey + `","status":403}`)); err != nil {
+		s.logger.Warn("failed to write forbidden response", zap.Error(err))
+	}
+}
+
+// respondIPNotAllowed sends the forbidden response for an API key used from outside its allowlist
+func (s *Service) respondIPNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	if _, err := w.Write([]byte(`{"error":"forbidden","message":"this API key is not allowed from this address","code":"` + apierrors.CodeAPIKeyIPNotAllowed + `","status":403}`)); err != nil {
+		s.logger.Warn("failed to write forbidden response", zap.Error(err))
+	}
+}
@@ -0,0 +1,589 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// ========== OIDC Single Sign-On ==========
+
+// OIDCStateScope marks the short-lived JWT that carries an SSO login's state, nonce and PKCE
+// verifier between /auth/oidc/login and /auth/oidc/callback (in a cookie)
+const OIDCStateScope = "oidc_state"
+
+// OIDCStateTTL is how long a user has to complete the provider login
+const OIDCStateTTL = 10 * time.Minute
+
+// oidcKeysMinRefresh limits how often the provider's signing keys are re-fetched for an unknown key ID
+const oidcKeysMinRefresh = time.Minute
+
+// ErrPasswordLoginDisabled is returned by Login when only SSO logins are allowed
+var ErrPasswordLoginDisabled = errors.New("password login is disabled; use single sign-on")
+
+// OIDCProvider talks to an OpenID Connect provider: discovery, the authorization code exchange
+// and ID token verification. Discovery and signing keys are fetched lazily and cached.
+type OIDCProvider struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{} // kid -> *rsa.PublicKey or *ecdsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// oidcDiscovery is the subset of the provider's openid-configuration used here
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCIdentity is the verified identity from an ID token
+type OIDCIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Groups            []string
+}
+
+// NewOIDCProvider creates a provider client (nil client uses a client with a 10s timeout)
+func NewOIDCProvider(cfg config.OIDCConfig, client *http.Client) *OIDCProvider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OIDCProvider{cfg: cfg, client: client}
+}
+
+// getDiscovery returns the cached discovery document, fetching it on first use
+func (p *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	var doc oidcDiscovery
+	if err := p.getJSON(ctx, wellKnown, &doc); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(p.cfg.IssuerURL, "/") {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", doc.Issuer, p.cfg.IssuerURL)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing endpoints")
+	}
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// AuthCodeURL returns the provider URL that starts a login with the given state, nonce and PKCE challenge
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	doc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	scopes := append([]string{"openid"}, p.cfg.Scopes...)
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the identity from the verified ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*OIDCIdentity, error) {
+	doc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+	return p.verifyIDToken(ctx, doc, tokens.IDToken, nonce)
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and nonce
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, doc *oidcDiscovery, rawToken, nonce string) (*OIDCIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, doc, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(doc.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, fmt.Errorf("invalid ID token: nonce mismatch")
+	}
+
+	identity := &OIDCIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = v
+	case string: // some providers send "true"
+		identity.EmailVerified = v == "true"
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("invalid ID token: missing subject")
+	}
+	switch groups := claims[p.cfg.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+	return identity, nil
+}
+
+// signingKey returns the provider key with the given ID, re-fetching the key set (at most once
+// per oidcKeysMinRefresh) when it is unknown so key rotation is picked up
+func (p *OIDCProvider) signingKey(ctx context.Context, doc *oidcDiscovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < oidcKeysMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, doc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key; a token without a key ID matches a key set with a single key
+func (p *OIDCProvider) lookupKey(kid string) interface{} {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// getJSON fetches url and decodes its JSON body into out
+func (p *OIDCProvider) getJSON(ctx context.Context, rawURL string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: HTTP %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// jsonWebKey is an RSA or EC public key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the JWK into a crypto public key
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// oidcStateClaims are the claims of the login state token
+type oidcStateClaims struct {
+	Scope        string `json:"scope"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	jwt.RegisteredClaims
+}
+
+// SetOIDC enables single sign-on through provider (nil disables it) and whether
+// username/password logins are still accepted
+func (s *Service) SetOIDC(provider *OIDCProvider, passwordLoginEnabled bool) {
+	s.oidc = provider
+	s.passwordLoginDisabled = !passwordLoginEnabled
+}
+
+// OIDCEnabled reports whether single sign-on is configured
+func (s *Service) OIDCEnabled() bool {
+	return s.oidc != nil
+}
+
+// PostLoginRedirectURL is where the SSO callback sends the browser with the issued token ("" to respond with JSON)
+func (s *Service) PostLoginRedirectURL() string {
+	if s.oidc == nil {
+		return ""
+	}
+	return s.oidc.cfg.PostLoginRedirectURL
+}
+
+// BeginOIDCLogin starts an SSO login. It returns the provider URL to redirect the browser to and
+// a state token that must be presented to CompleteOIDCLogin (the handler keeps it in a cookie).
+func (s *Service) BeginOIDCLogin(ctx context.Context) (authURL, stateToken string, err error) {
+	if s.oidc == nil {
+		return "", "", fmt.Errorf("single sign-on is not configured")
+	}
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	authURL, err = s.oidc.AuthCodeURL(ctx, state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	stateToken, err = s.signToken(&oidcStateClaims{
+		Scope:        OIDCStateScope,
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(OIDCStateTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    "agentbox",
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign login state: %w", err)
+	}
+	return authURL, stateToken, nil
+}
+
+// CompleteOIDCLogin finishes an SSO login: it checks state against stateToken, exchanges the
+// code, provisions or links the user and issues a regular agentbox token
+func (s *Service) CompleteOIDCLogin(ctx context.Context, code, state, stateToken string) (*LoginResponse, error) {
+	if s.oidc == nil {
+		return nil, fmt.Errorf("single sign-on is not configured")
+	}
+	if code == "" || state == "" || stateToken == "" {
+		return nil, fmt.Errorf("missing code, state or login session")
+	}
+
+	claims := &oidcStateClaims{}
+	_, err := jwt.ParseWithClaims(stateToken, claims, s.verificationKeys, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || claims.Scope != OIDCStateScope {
+		return nil, fmt.Errorf("login session is invalid or expired")
+	}
+	if claims.State != state {
+		return nil, fmt.Errorf("login state mismatch")
+	}
+
+	identity, err := s.oidc.Exchange(ctx, code, claims.CodeVerifier, claims.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.provisionOIDCUser(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status != users.StatusActive {
+		return nil, fmt.Errorf("user account is not active")
+	}
+	if err := s.userService.UpdateLastLogin(ctx, user.ID); err != nil {
+		s.logger.Warn("failed to update last login", zap.String("user_id", user.ID), zap.Error(err))
+	}
+
+	token, expiresAt, err := s.generateToken(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return &LoginResponse{Token: token, User: user, ExpiresAt: expiresAt}, nil
+}
+
+// provisionOIDCUser returns the user for identity: the one linked to its subject, else an
+// existing user with the same (verified) email, which gets linked, else a new user. The role
+// from the group mapping is applied on every login when a mapping is configured; it never
+// lowers the role of a local (password) account.
+func (s *Service) provisionOIDCUser(ctx context.Context, identity *OIDCIdentity) (*users.User, error) {
+	role := s.oidc.mapRole(identity.Groups)
+
+	user, err := s.userService.GetUserByExternalID(ctx, identity.Subject)
+	if err != nil && !errors.Is(err, users.ErrUserNotFound) {
+		return nil, err
+	}
+	if user == nil && identity.Email != "" && identity.EmailVerified {
+		user, err = s.userService.GetUserByEmail(ctx, identity.Email)
+		if err != nil && !errors.Is(err, users.ErrUserNotFound) {
+			return nil, err
+		}
+		if user != nil {
+			linked, err := s.userService.GetExternalID(ctx, user.ID)
+			if err != nil {
+				return nil, err
+			}
+			if linked != "" {
+				return nil, fmt.Errorf("email %s is already linked to another identity", identity.Email)
+			}
+			if err := s.userService.SetExternalID(ctx, user.ID, identity.Subject); err != nil {
+				return nil, err
+			}
+			s.logger.Info("linked user to SSO identity", zap.String("user_id", user.ID), zap.String("subject", identity.Subject))
+		}
+	}
+
+	if user == nil {
+		username, err := s.uniqueUsername(ctx, identity)
+		if err != nil {
+			return nil, err
+		}
+		email := ""
+		if identity.EmailVerified {
+			email = identity.Email
+		}
+		user, err = s.userService.CreateUser(ctx, &users.CreateUserRequest{
+			Username:   username,
+			Email:      email,
+			Role:       role,
+			Status:     users.StatusActive,
+			ExternalID: identity.Subject,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.logger.Info("provisioned SSO user",
+			zap.String("user_id", user.ID),
+			zap.String("username", user.Username),
+			zap.String("role", role),
+		)
+		return user, nil
+	}
+
+	// Keep roles in sync with the provider's groups; the super admin is never demoted
+	if len(s.oidc.cfg.RoleMapping) > 0 && user.Role != role && user.Role != users.RoleSuperAdmin {
+		// Local accounts linked to the identity keep the role an admin gave them: the mapping
+		// may promote them but never lowers it
+		local, err := s.userService.HasPassword(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if local && (user.Role != users.RoleUser || role != users.RoleAdmin) {
+			s.logger.Debug("kept role of local account linked to SSO identity",
+				zap.String("user_id", user.ID), zap.String("role", user.Role), zap.String("mapped_role", role))
+			return user, nil
+		}
+		user, err = s.userService.UpdateUser(ctx, user.ID, &users.UpdateUserRequest{Role: &role})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// mapRole returns the most privileged role mapped from groups, or the default role when no
+// group is mapped
+func (p *OIDCProvider) mapRole(groups []string) string {
+	matched := ""
+	for _, g := range groups {
+		switch p.cfg.RoleMapping[g] {
+		case users.RoleAdmin:
+			return users.RoleAdmin
+		case users.RoleUser:
+			matched = users.RoleUser
+		}
+	}
+	if matched != "" {
+		return matched
+	}
+	if p.cfg.DefaultRole != "" {
+		return p.cfg.DefaultRole
+	}
+	return users.RoleUser
+}
+
+// uniqueUsername derives a username from the identity (preferred_username, email or subject),
+// disambiguating it with a hash of the subject when it is taken
+func (s *Service) uniqueUsername(ctx context.Context, identity *OIDCIdentity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" && identity.Email != "" {
+		base = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	if base == "" {
+		base = "sso-user"
+	}
+	sum := sha256.Sum256([]byte(identity.Subject))
+	for _, candidate := range []string{base, base + "-" + hex.EncodeToString(sum[:3]), base + "-" + hex.EncodeToString(sum[:8])} {
+		_, err := s.userService.GetUserByUsername(ctx, candidate)
+		if errors.Is(err, users.ErrUserNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("could not find a free username for %q", base)
+}
+
+// randomToken returns 32 random bytes, base64url-encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
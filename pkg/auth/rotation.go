@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== API Key Rotation & Expiry ==========
+
+const (
+	// DefaultAPIKeyRotationGracePeriod is how long a rotated key keeps working
+	DefaultAPIKeyRotationGracePeriod = 24 * time.Hour
+	// DefaultAPIKeyExpiryWarningWindow is how far ahead of expiry a key is reported as expiring
+	DefaultAPIKeyExpiryWarningWindow = 7 * 24 * time.Hour
+)
+
+// API key statuses reported by ListAPIKeys
+const (
+	APIKeyStatusActive   = "active"
+	APIKeyStatusExpiring = "expiring"
+	APIKeyStatusExpired  = "expired"
+	APIKeyStatusRevoked  = "revoked"
+)
+
+// Audit actions written for API key lifecycle events
+const (
+	AuditActionAPIKeyRotated  = "api_key.rotated"
+	AuditActionAPIKeyExpiring = "api_key.expiring"
+)
+
+// SetAPIKeyLifecycle configures the rotation grace period and the expiry warning window.
+// A negative grace period or non-positive warning window keeps the current setting.
+func (s *Service) SetAPIKeyLifecycle(gracePeriod, warningWindow time.Duration) {
+	if gracePeriod >= 0 {
+		s.rotationGracePeriod = gracePeriod
+	}
+	if warningWindow > 0 {
+		s.expiryWarningWindow = warningWindow
+	}
+}
+
+// apiKeyStatus computes the status of a key at the given time
+func (s *Service) apiKeyStatus(expiresAt, revokedAt *time.Time, now time.Time) string {
+	if revokedAt != nil {
+		if !revokedAt.After(now) {
+			return APIKeyStatusRevoked
+		}
+		// Rotated, still within the grace period
+		return APIKeyStatusExpiring
+	}
+	if expiresAt != nil {
+		if !expiresAt.After(now) {
+			return APIKeyStatusExpired
+		}
+		if expiresAt.Before(now.Add(s.expiryWarningWindow)) {
+			return APIKeyStatusExpiring
+		}
+	}
+	return APIKeyStatusActive
+}
+
+// RotateAPIKey atomically creates a replacement for an API key with the same name, description,
+// allowlist, validity period, environment permissions and read-only flag, and schedules the old key's revocation after
+// the rotation grace period. The new secret is only returned here.
+func (s *Service) RotateAPIKey(ctx context.Context, keyID, userID string) (*APIKeyResponse, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var name, description, cidrs sql.NullString
+	var createdAt time.Time
+	var expiresAt, revokedAt sql.NullTime
+	var readOnly bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT name, description, allowed_cidrs, created_at, expires_at, revoked_at, read_only
+		FROM api_keys
+		WHERE id = $1 AND user_id = $2
+	`, keyID, userID).Scan(&name, &description, &cidrs, &createdAt, &expiresAt, &revokedAt, &readOnly)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeAPIKeyNotFound, "API key not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	now := time.Now()
+	if revokedAt.Valid {
+		if revokedAt.Time.After(now) {
+			return nil, apierrors.New(apierrors.Conflict, apierrors.CodeAPIKeyNotRotatable, "API key has already been rotated")
+		}
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeAPIKeyNotRotatable, "API key has been revoked")
+	}
+	if expiresAt.Valid && expiresAt.Time.Before(now) {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeAPIKeyNotRotatable, "API key has expired")
+	}
+
+	fullKey, keyPrefix, keyHash, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	newID := uuid.New().String()
+
+	// The replacement gets the same validity period as the original key
+	var newExpiresAt sql.NullTime
+	if expiresAt.Valid {
+		newExpiresAt = sql.NullTime{Time: now.Add(expiresAt.Time.Sub(createdAt)), Valid: true}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO api_keys (id, user_id, key_hash, key_prefix, name, description, allowed_cidrs, expires_at, created_at, rotated_from, read_only)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, newID, userID, keyHash, keyPrefix, name, description, cidrs, newExpiresAt, now, keyID, readOnly); err != nil {
+		return nil, fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	permissions, err := copyAPIKeyPermissions(ctx, tx, keyID, newID)
+	if err != nil {
+		return nil, err
+	}
+
+	revokesAt := now.Add(s.rotationGracePeriod)
+	if expiresAt.Valid && expiresAt.Time.Before(revokesAt) {
+		// Never extend the life of the old key
+		revokesAt = expiresAt.Time
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE api_keys SET revoked_at = $1 WHERE id = $2`, revokesAt, keyID); err != nil {
+		return nil, fmt.Errorf("failed to schedule API key revocation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit API key rotation: %w", err)
+	}
+
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       AuditActionAPIKeyRotated,
+		ActorID:      userID,
+		ResourceType: "api_key",
+		ResourceID:   keyID,
+		Message:      fmt.Sprintf("API key %s rotated to %s; old key revoked at %s", keyID, newID, revokesAt.UTC().Format(time.RFC3339)),
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry for API key rotation", zap.String("key_id", keyID), zap.Error(err))
+	}
+
+	resp := &APIKeyResponse{
+		ID:                   newID,
+		Key:                  fullKey, // Only returned once
+		Name:                 name.String,
+		KeyPrefix:            keyPrefix,
+		Description:          description.String,
+		CreatedAt:            now,
+		Permissions:          permissions,
+		ReadOnly:             readOnly,
+		RotatedFrom:          keyID,
+		PreviousKeyRevokesAt: &revokesAt,
+	}
+	if newExpiresAt.Valid {
+		resp.ExpiresAt = &newExpiresAt.Time
+	}
+	resp.AllowedCIDRs, _ = decodeAllowedCIDRs(cidrs)
+	return resp, nil
+}
+
+// copyAPIKeyPermissions copies all environment permissions from one key to another within tx
+func copyAPIKeyPermissions(ctx context.Context, tx *sql.Tx, fromKeyID, toKeyID string) ([]APIKeyPermissionResponse, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT environment_id, permission
+		FROM api_key_permissions
+		WHERE api_key_id = $1
+		ORDER BY environment_id
+	`, fromKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key permissions: %w", err)
+	}
+	var permissions []APIKeyPermissionResponse
+	for rows.Next() {
+		var p APIKeyPermissionResponse
+		if err := rows.Scan(&p.EnvironmentID, &p.Permission); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan API key permission: %w", err)
+		}
+		permissions = append(permissions, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read API key permissions: %w", err)
+	}
+
+	for _, p := range permissions {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO api_key_permissions (id, api_key_id, environment_id, permission, created_at)
+			VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		`, uuid.New().String(), toKeyID, p.EnvironmentID, p.Permission); err != nil {
+			return nil, fmt.Errorf("failed to copy API key permission: %w", err)
+		}
+	}
+	return permissions, nil
+}
+
+// NotifyExpiringAPIKeys writes an "api_key.expiring" audit entry for every active key that
+// expires within the warning window and has not been reported yet. It returns the number of
+// keys reported.
+func (s *Service) NotifyExpiringAPIKeys(ctx context.Context) (int, error) {
+	now := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, key_prefix, expires_at
+		FROM api_keys
+		WHERE revoked_at IS NULL AND expiry_notified_at IS NULL
+			AND expires_at IS NOT NULL AND expires_at > $1 AND expires_at <= $2
+	`, now, now.Add(s.expiryWarningWindow))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expiring API keys: %w", err)
+	}
+
+	type expiringKey struct {
+		id, userID, prefix string
+		expiresAt          time.Time
+	}
+	var keys []expiringKey
+	for rows.Next() {
+		var k expiringKey
+		if err := rows.Scan(&k.id, &k.userID, &k.prefix, &k.expiresAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan expiring API key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list expiring API keys: %w", err)
+	}
+
+	notified := 0
+	for _, k := range keys {
+		if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+			Action:       AuditActionAPIKeyExpiring,
+			ActorID:      k.userID,
+			ResourceType: "api_key",
+			ResourceID:   k.id,
+			Message:      fmt.Sprintf("API key %s (%s...) expires at %s", k.id, k.prefix, k.expiresAt.UTC().Format(time.RFC3339)),
+		}); err != nil {
+			return notified, err
+		}
+		if _, err := s.db.ExecContext(ctx, `UPDATE api_keys SET expiry_notified_at = $1 WHERE id = $2`, now, k.id); err != nil {
+			return notified, fmt.Errorf("failed to mark API key as notified: %w", err)
+		}
+		s.logger.Warn("API key expiring soon",
+			zap.String("key_id", k.id),
+			zap.String("user_id", k.userID),
+			zap.Time("expires_at", k.expiresAt),
+		)
+		notified++
+	}
+	return notified, nil
+}
+
+// RunAPIKeyExpiryNotifier calls NotifyExpiringAPIKeys every interval until ctx is cancelled
+func (s *Service) RunAPIKeyExpiryNotifier(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.NotifyExpiringAPIKeys(ctx); err != nil {
+			s.logger.Error("API key expiry check failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
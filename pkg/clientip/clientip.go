@@ -0,0 +1,176 @@
+// Package clientip works out the address a request really came from. Forwarding headers
+// (X-Forwarded-For, X-Real-IP) are only believed when the connection comes from a trusted proxy,
+// so clients cannot pick the address they are rate limited and audited under.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// contextKey is the type of the context key the client address is stored under
+type contextKey struct{}
+
+// trustedProxyKey is the context key marking requests that came through a trusted proxy
+type trustedProxyKey struct{}
+
+// WithClientIP returns a context carrying the request's client address
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextKey{}, ip)
+}
+
+// FromContext returns the client address stored by WithClientIP, or ""
+func FromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(contextKey{}).(string)
+	return ip
+}
+
+// ViaTrustedProxy reports whether the middleware found r to come from a trusted proxy, whose
+// forwarding headers (X-Forwarded-Proto, X-Forwarded-Host, ...) may then be believed
+func ViaTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedProxyKey{}).(bool)
+	return trusted
+}
+
+// FromRequest returns the client address of r: the one resolved by the middleware when it ran,
+// otherwise the peer address
+func FromRequest(r *http.Request) string {
+	if ip := FromContext(r.Context()); ip != "" {
+		return ip
+	}
+	return peerAddr(r)
+}
+
+// Resolver extracts client addresses, trusting forwarding headers from the configured proxies
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver creates a resolver that trusts the given proxies (CIDRs such as "10.0.0.0/8", or
+// single addresses). Without any, forwarding headers are always ignored.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, proxy := range trustedProxies {
+		prefix, err := ParseTrustedProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, prefix)
+	}
+	return r, nil
+}
+
+// ParseTrustedProxy parses a trusted proxy entry: a CIDR or a single IPv4 or IPv6 address
+func ParseTrustedProxy(proxy string) (netip.Prefix, error) {
+	proxy = strings.TrimSpace(proxy)
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Resolve returns the client address of r. When the peer is a trusted proxy, X-Forwarded-For is
+// read from the right, skipping trusted proxies, and the first other address is the client;
+// X-Real-IP is used when there is no X-Forwarded-For. Otherwise the peer itself is the client.
+func (res *Resolver) Resolve(r *http.Request) string {
+	peer := peerAddr(r)
+	if !res.trustsPeer(r) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if ip, ok := normalize(r.Header.Get("X-Real-IP")); ok {
+			return ip
+		}
+		return peer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := normalize(hops[i])
+		if !ok {
+			// A malformed entry was not written by a proxy we trust: stop at the last good hop
+			break
+		}
+		client = ip
+		if !res.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// trustsPeer reports whether the connection of r comes from a trusted proxy
+func (res *Resolver) trustsPeer(r *http.Request) bool {
+	return res != nil && len(res.trusted) > 0 && res.isTrusted(peerAddr(r))
+}
+
+// isTrusted reports whether ip belongs to a trusted proxy
+func (res *Resolver) isTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware stores the resolved client address in the request context (see FromContext) and
+// whether the request came through a trusted proxy (see ViaTrustedProxy). A nil resolver trusts
+// no proxy.
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithClientIP(r.Context(), res.Resolve(r))
+		if res.trustsPeer(r) {
+			ctx = context.WithValue(ctx, trustedProxyKey{}, true)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// peerAddr returns the address of the connection's peer (without the port)
+func peerAddr(r *http.Request) string {
+	if ip, ok := normalize(r.RemoteAddr); ok {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// normalize parses an address as found in headers or RemoteAddr ("1.2.3.4", "1.2.3.4:80",
+// "2001:db8::1", "[2001:db8::1]:80") and returns it in canonical form; IPv4-mapped IPv6
+// addresses become IPv4 and zones are dropped
+func normalize(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", false
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().WithZone("").String(), true
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ActivityRange selects one page of a source of an environment's activity feed: the items
+// newer than Since and older than the page cursor, newest first (ties ordered by ID, descending)
+type ActivityRange struct {
+	// Since excludes items at or before it (nil = no lower bound)
+	Since *time.Time
+	// Before excludes items after it (nil = no upper bound). Items at Before are included when
+	// their ID is below BeforeID, or all of them with BeforeInclusive.
+	Before          *time.Time
+	BeforeID        string
+	BeforeInclusive bool
+	Limit           int
+}
+
+// where appends the range's conditions on the timestamp column (and id) to args, numbered after
+// the arguments already in it
+func (r ActivityRange) where(column string, args []interface{}) (string, []interface{}) {
+	var where string
+	if r.Since != nil {
+		args = append(args, *r.Since)
+		where += fmt.Sprintf(` AND %s > $%d`, column, len(args))
+	}
+	if r.Before != nil {
+		switch {
+		case r.BeforeInclusive:
+			args = append(args, *r.Before)
+			where += fmt.Sprintf(` AND %s <= $%d`, column, len(args))
+		case r.BeforeID != "":
+			args = append(args, *r.Before, r.BeforeID)
+			where += fmt.Sprintf(` AND (%s, id) < ($%d, $%d)`, column, len(args)-1, len(args))
+		default:
+			args = append(args, *r.Before)
+			where += fmt.Sprintf(` AND %s < $%d`, column, len(args))
+		}
+	}
+	return where, args
+}
+
+// limit returns the page size of the range, capped like the other listings
+func (r ActivityRange) limit() int {
+	if r.Limit <= 0 {
+		return 100
+	}
+	if r.Limit > 1000 {
+		return 1000
+	}
+	return r.Limit
+}
+
+// ListEnvironmentActivityEvents returns the environment's events in the range, leaving out the
+// given event types
+func (db *DB) ListEnvironmentActivityEvents(ctx context.Context, environmentID string, r ActivityRange, excludedTypes ...string) ([]*models.EnvironmentEvent, error) {
+	where := ` WHERE environment_id = $1`
+	args := []interface{}{environmentID}
+	if len(excludedTypes) > 0 {
+		placeholders := make([]string, len(excludedTypes))
+		for i, eventType := range excludedTypes {
+			args = append(args, eventType)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		where += ` AND event_type NOT IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+	rangeWhere, args := r.where("created_at", args)
+	args = append(args, r.limit())
+	query := `SELECT id, environment_id, event_type, message, COALESCE(details, ''), created_at, COALESCE(actor_id, '')
+		FROM environment_events` + where + rangeWhere +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment activity events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*models.EnvironmentEvent
+	for rows.Next() {
+		var e models.EnvironmentEvent
+		if err := rows.Scan(&e.ID, &e.EnvironmentID, &e.EventType, &e.Message, &e.Details, &e.CreatedAt, &e.ActorID); err != nil {
+			return nil, fmt.Errorf("failed to scan environment event: %w", err)
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+// ListEnvironmentAuditEntries returns the audit log entries about the environment in the range
+func (db *DB) ListEnvironmentAuditEntries(ctx context.Context, environmentID string, r ActivityRange) ([]*models.AuditEntry, error) {
+	rangeWhere, args := r.where("created_at", []interface{}{environmentID})
+	args = append(args, r.limit())
+	query := `
+		SELECT id, action, COALESCE(actor_id, ''), COALESCE(resource_type, ''), COALESCE(resource_id, ''),
+			message, COALESCE(details, ''), COALESCE(client_ip, ''), created_at, COALESCE(impersonator_id, '')
+		FROM audit_log
+		WHERE resource_type = 'environment' AND resource_id = $1` + rangeWhere +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*models.AuditEntry
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.Action, &e.ActorID, &e.ResourceType, &e.ResourceID,
+			&e.Message, &e.Details, &e.ClientIP, &e.CreatedAt, &e.ImpersonatorID); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// ListExecutionActivity returns the environment's executions submitted in the range or, with
+// completed, the ones that completed in it (ordered by completed_at)
+func (db *DB) ListExecutionActivity(ctx context.Context, environmentID string, completed bool, r ActivityRange) ([]*models.Execution, error) {
+	column := "created_at"
+	where := ` WHERE environment_id = $1`
+	if completed {
+		column = "completed_at"
+		where += ` AND completed_at IS NOT NULL`
+	}
+	rangeWhere, args := r.where(column, []interface{}{environmentID})
+	args = append(args, r.limit())
+	query := `SELECT ` + executionColumns + ` FROM executions` + where + rangeWhere +
+		fmt.Sprintf(` ORDER BY %s DESC, id DESC LIMIT $%d`, column, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list execution activity: %w", err)
+	}
+	defer rows.Close()
+
+	var executions []*models.Execution
+	for rows.Next() {
+		exec, err := db.scanExecution(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan execution: %w", err)
+		}
+		executions = append(executions, exec)
+	}
+	return executions, rows.Err()
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/impersonation"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// AuditFilter selects audit log entries (empty fields match everything)
+type AuditFilter struct {
+	Action         string
+	ActorID        string
+	ImpersonatorID string
+	ResourceType   string
+	ResourceID     string
+	Limit          int
+}
+
+// SaveAuditEntry persists an audit log entry. ID and CreatedAt are filled in when empty,
+// ClientIP from the request's client address in ctx and ImpersonatorID from the admin
+// impersonating the request's user.
+func (db *DB) SaveAuditEntry(ctx context.Context, entry *models.AuditEntry) error {
+	if entry.ID == "" {
+		entry.ID = uuid.New().String()
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	if entry.ClientIP == "" {
+		entry.ClientIP = clientip.FromContext(ctx)
+	}
+	if entry.ImpersonatorID == "" {
+		entry.ImpersonatorID = impersonation.AdminID(ctx)
+	}
+
+	query := `
+		INSERT INTO audit_log (id, action, actor_id, resource_type, resource_id, message, details, client_ip, created_at, impersonator_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	_, err := db.ExecContext(ctx, query,
+		entry.ID, entry.Action, nullIfEmpty(entry.ActorID), nullIfEmpty(entry.ResourceType),
+		nullIfEmpty(entry.ResourceID), entry.Message, nullIfEmpty(entry.Details), nullIfEmpty(entry.ClientIP),
+		entry.CreatedAt, nullIfEmpty(entry.ImpersonatorID),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEntries returns audit log entries matching the filter, newest first
+func (db *DB) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]*models.AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	where := "WHERE 1=1"
+	var args []interface{}
+	for _, cond := range []struct {
+		column string
+		value  string
+	}{
+		{"action", filter.Action},
+		{"actor_id", filter.ActorID},
+		{"impersonator_id", filter.ImpersonatorID},
+		{"resource_type", filter.ResourceType},
+		{"resource_id", filter.ResourceID},
+	} {
+		if cond.value == "" {
+			continue
+		}
+		args = append(args, cond.value)
+		where += fmt.Sprintf(" AND %s = $%d", cond.column, len(args))
+	}
+	args = append(args, limit)
+
+	query := `
+		SELECT id, action, COALESCE(actor_id, ''), COALESCE(resource_type, ''), COALESCE(resource_id, ''),
+			message, COALESCE(details, ''), COALESCE(client_ip, ''), created_at, COALESCE(impersonator_id, '')
+		FROM audit_log
+		` + where + fmt.Sprintf(`
+		ORDER BY created_at DESC, id
+		LIMIT $%d`, len(args))
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*models.AuditEntry
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.Action, &e.ActorID, &e.ResourceType, &e.ResourceID,
+			&e.Message, &e.Details, &e.ClientIP, &e.CreatedAt, &e.ImpersonatorID); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
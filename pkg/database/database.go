@@ -3,9 +3,11 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
@@ -18,6 +20,45 @@ type DB struct {
 	*sql.DB
 	driver string
 	logger *zap.Logger
+	// errorCount counts the failed queries and statements (see ErrorCount)
+	errorCount atomic.Int64
+}
+
+// ErrorCount returns how many queries and statements failed since the connection was opened.
+// Missing rows and canceled or timed out contexts are not errors of the database; statements
+// run in transactions are not counted.
+func (db *DB) ErrorCount() int64 {
+	return db.errorCount.Load()
+}
+
+// countError counts err if it is an error of the database
+func (db *DB) countError(err error) {
+	if err == nil || errors.Is(err, sql.ErrNoRows) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	db.errorCount.Add(1)
+}
+
+// ExecContext executes a statement, counting failures
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	result, err := db.DB.ExecContext(ctx, query, args...)
+	db.countError(err)
+	return result, err
+}
+
+// QueryContext runs a query, counting failures
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	db.countError(err)
+	return rows, err
+}
+
+// QueryRowContext runs a query returning at most one row, counting failures
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	db.countError(row.Err())
+	return row
 }
 
 // NewDB creates a new database connection
@@ -43,8 +84,11 @@ func NewDB(logger *zap.Logger) (*DB, error) {
 		if dbPath == "" {
 			dbPath = "./agentbox.db"
 		}
-		// modernc.org/sqlite uses "sqlite" as driver name and different pragma syntax
-		db, err = sql.Open("sqlite", dbPath+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)")
+		// modernc.org/sqlite uses "sqlite" as driver name and different pragma syntax; busy_timeout
+		// makes concurrent writers (e.g. finishing session recordings) wait instead of failing.
+		// Timestamps are written without the monotonic clock reading time.Time.String() adds, so
+		// equal timestamps compare equal in keyset pagination.
+		db, err = sql.Open("sqlite", dbPath+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_time_format=sqlite")
 		driver = "sqlite"
 		if err != nil {
 			return nil, fmt.Errorf("failed to open SQLite database: %w", err)
@@ -144,13 +188,697 @@ func (db *DB) Migrate() error {
 // getMigrations returns a map of version -> SQL migration
 func getMigrations() map[int]string {
 	return map[int]string{
-		1: initialSchema,
-		2: apiKeyPermissionsSchema,
-		3: environmentsAndExecutionsSchema,
-		4: reconciliationSchema,
+		1:  initialSchema,
+		2:  apiKeyPermissionsSchema,
+		3:  environmentsAndExecutionsSchema,
+		4:  reconciliationSchema,
+		5:  teamsSchema,
+		6:  executionPoolSchema,
+		7:  auditAndAPIKeyRotationSchema,
+		8:  environmentClusterSchema,
+		9:  executionHistorySchema,
+		10: environmentPhaseSchema,
+		11: commandPolicySchema,
+		12: readinessCheckSchema,
+		13: executionOutputSchema,
+		14: userExternalIDSchema,
+		15: environmentActivitySchema,
+		16: environmentGroupsSchema,
+		17: executionOverridesSchema,
+		18: environmentTokensSchema,
+		19: metricRollupsSchema,
+		20: sessionRecordingsSchema,
+		21: executionCallbackSchema,
+		22: environmentAffinitySchema,
+		23: executionModeSchema,
+		24: executionCommandTextSchema,
+		25: loginFailuresSchema,
+		26: environmentExecModeSchema,
+		27: auditClientIPSchema,
+		28: pipelinesSchema,
+		29: executionInputFilesSchema,
+		30: operationsSchema,
+		31: environmentOneShotSchema,
+		32: rolesSchema,
+		33: executionCacheSchema,
+		34: exportJobsSchema,
+		35: environmentChangeFeedSchema,
+		36: userPreferencesSchema,
+		37: executionEventsSchema,
+		38: environmentBuildSchema,
+		39: environmentLogShippingSchema,
+		40: impersonationSchema,
+		41: readOnlyAccessSchema,
+		42: executionResourceUsageSchema,
+		43: emailAlertsSchema,
+		44: metadataSchema,
+		45: cordonSchema,
+		46: apiKeyIdentitySchema,
+		47: workspaceSnapshotsSchema,
+		48: podChurnSchema,
+		49: reservationsSchema,
+		50: activitySchema,
+		51: executionRequeueSchema,
+		52: environmentLifecycleSchema,
+		53: builtinRoleCapabilitiesSchema,
+		54: badgeSecretCleanupSchema,
+		55: podEnvironmentTokensSchema,
+		56: reservationSlotsSchema,
 	}
 }
 
+// reservationSlotsSchema adds the placeholder slots taken by the environments of open
+// reservations. Environments created before it take the lowest slots, oldest first.
+const reservationSlotsSchema = `
+CREATE TABLE IF NOT EXISTS reservation_slots (
+    reservation_id TEXT NOT NULL,
+    slot INTEGER NOT NULL,
+    environment_id TEXT NOT NULL,
+    PRIMARY KEY (reservation_id, slot)
+);
+
+INSERT INTO reservation_slots (reservation_id, slot, environment_id)
+SELECT e.reservation_id, ROW_NUMBER() OVER (PARTITION BY e.reservation_id ORDER BY e.created_at, e.id) - 1, e.id
+FROM environments e JOIN reservations r ON r.id = e.reservation_id
+WHERE r.status IN ('scheduled', 'holding');
+`
+
+// podEnvironmentTokensSchema marks the environment tokens issued to main pods (AGENTBOX_TOKEN),
+// which live as long as the environment and are replaced when its main pod is recreated
+const podEnvironmentTokensSchema = `
+ALTER TABLE environment_tokens ADD COLUMN issued_to_pod BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE environment_tokens SET issued_to_pod = TRUE WHERE description = 'issued to environment pod';
+`
+
+// badgeSecretCleanupSchema deletes the badge secrets of environments deleted before their secret
+// was deleted with them
+const badgeSecretCleanupSchema = `
+DELETE FROM environment_badge_secrets WHERE environment_id NOT IN (SELECT id FROM environments);
+`
+
+// builtinRoleCapabilitiesSchema gives the built-in admin role the access it had before roles:
+// users, API keys, metrics, the audit log and platform administration, but no access to every
+// environment (environments.read_all and write_all stay with super_admin)
+const builtinRoleCapabilitiesSchema = `
+UPDATE roles SET description = 'Manages users, API keys and the platform',
+    capabilities = '["users.manage","api_keys.manage","metrics.read","audit.read","platform.admin"]'
+    WHERE name = 'admin' AND built_in = TRUE;
+UPDATE roles SET capabilities = '["environments.read_all","environments.write_all","users.manage","api_keys.manage","metrics.read","audit.read","platform.admin"]'
+    WHERE name = 'super_admin' AND built_in = TRUE;
+`
+
+// environmentLifecycleSchema adds the lifecycle settings of environments (JSON)
+const environmentLifecycleSchema = `
+ALTER TABLE environments ADD COLUMN lifecycle TEXT;
+`
+
+// executionRequeueSchema adds what an execution was submitted with (JSON) and the execution it was
+// requeued from
+const executionRequeueSchema = `
+ALTER TABLE executions ADD COLUMN submission TEXT;
+ALTER TABLE executions ADD COLUMN requeued_from TEXT;
+`
+
+// activitySchema adds the user behind an environment event and the index of the activity feed's
+// completed executions
+const activitySchema = `
+ALTER TABLE environment_events ADD COLUMN actor_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_executions_env_completed_at ON executions(environment_id, completed_at);
+`
+
+// reservationsSchema adds capacity reservations (resources and node_selector are JSON) and the
+// reservation an environment was created with
+const reservationsSchema = `
+CREATE TABLE IF NOT EXISTS reservations (
+    id TEXT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    user_id TEXT NOT NULL,
+    team_id TEXT,
+    cluster VARCHAR(255) NOT NULL,
+    namespace VARCHAR(255) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    environments INTEGER NOT NULL,
+    resources TEXT NOT NULL,
+    node_selector TEXT,
+    used INTEGER NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_reservations_ends_at ON reservations(ends_at);
+
+ALTER TABLE environments ADD COLUMN reservation_id TEXT;
+`
+
+// podChurnSchema adds the managed pods scheduled per node, stored by the metrics collector
+// every collection interval for the churn report
+const podChurnSchema = `
+CREATE TABLE IF NOT EXISTS pod_churn (
+    id TEXT PRIMARY KEY,
+    cluster VARCHAR(255) NOT NULL,
+    node_name VARCHAR(255) NOT NULL,
+    pods_created INTEGER NOT NULL,
+    timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_pod_churn_timestamp ON pod_churn(timestamp);
+`
+
+// workspaceSnapshotsSchema adds the per-environment workspace snapshot settings (JSON) and the
+// index of stored snapshots (the archives themselves are files in snapshots.directory)
+const workspaceSnapshotsSchema = `
+ALTER TABLE environments ADD COLUMN workspace_snapshots TEXT;
+
+CREATE TABLE IF NOT EXISTS workspace_snapshots (
+    id TEXT PRIMARY KEY,
+    environment_id VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    trigger_type VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_workspace_snapshots_environment_id ON workspace_snapshots(environment_id, created_at);
+`
+
+// apiKeyIdentitySchema adds API key names, IP allowlists (JSON arrays of CIDRs) and the address
+// keys were last used from
+const apiKeyIdentitySchema = `
+ALTER TABLE api_keys ADD COLUMN name TEXT;
+ALTER TABLE api_keys ADD COLUMN allowed_cidrs TEXT;
+ALTER TABLE api_keys ADD COLUMN last_used_ip TEXT;
+`
+
+// cordonSchema adds the cordon state of environments (no new executions while set)
+const cordonSchema = `
+ALTER TABLE environments ADD COLUMN cordoned BOOLEAN;
+ALTER TABLE environments ADD COLUMN cordon_reason TEXT;
+ALTER TABLE environments ADD COLUMN cordoned_at TIMESTAMP;
+`
+
+// metadataSchema adds the freeform metadata (a JSON object) of environments and executions
+const metadataSchema = `
+ALTER TABLE environments ADD COLUMN metadata TEXT;
+ALTER TABLE executions ADD COLUMN metadata TEXT;
+`
+
+// emailAlertsSchema adds the preference opting users in to critical event emails
+const emailAlertsSchema = `
+ALTER TABLE user_preferences ADD COLUMN email_critical_alerts BOOLEAN;
+ALTER TABLE org_preferences ADD COLUMN email_critical_alerts BOOLEAN;
+`
+
+// executionResourceUsageSchema adds the CPU time and peak memory the exec wrapper reports for
+// an execution's command
+const executionResourceUsageSchema = `
+ALTER TABLE executions ADD COLUMN cpu_seconds REAL;
+ALTER TABLE executions ADD COLUMN max_memory_bytes BIGINT;
+`
+
+// readOnlyAccessSchema adds read-only API keys and the per-environment secrets status badge URLs
+// are signed with
+const readOnlyAccessSchema = `
+ALTER TABLE api_keys ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS environment_badge_secrets (
+    environment_id VARCHAR(255) PRIMARY KEY,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+`
+
+// impersonationSchema records the sessions in which a super admin acts as another user, and the
+// admin behind audit entries written during one
+const impersonationSchema = `
+CREATE TABLE IF NOT EXISTS impersonation_sessions (
+    id TEXT PRIMARY KEY,
+    admin_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    revoked_by TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_impersonation_sessions_created_at ON impersonation_sessions(created_at);
+
+ALTER TABLE audit_log ADD COLUMN impersonator_id TEXT;
+`
+
+// environmentLogShippingSchema stores where an environment's log is shipped (JSON)
+const environmentLogShippingSchema = `
+ALTER TABLE environments ADD COLUMN log_shipping TEXT;
+`
+
+// environmentBuildSchema stores how an environment's image is built (JSON)
+const environmentBuildSchema = `
+ALTER TABLE environments ADD COLUMN build TEXT;
+`
+
+// executionEventsSchema stores the lifecycle events of executions (a JSON array)
+const executionEventsSchema = `
+ALTER TABLE executions ADD COLUMN events TEXT;
+`
+
+// userPreferencesSchema adds user preferences and the organization defaults unset preferences
+// fall back to (a single row); NULL columns are unset
+const userPreferencesSchema = `
+CREATE TABLE IF NOT EXISTS user_preferences (
+    user_id VARCHAR(255) PRIMARY KEY,
+    default_profile VARCHAR(255),
+    notify_on_environment_failed BOOLEAN,
+    notify_on_execution_failed BOOLEAN,
+    timezone VARCHAR(64),
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS org_preferences (
+    id VARCHAR(32) PRIMARY KEY,
+    default_profile VARCHAR(255),
+    notify_on_environment_failed BOOLEAN,
+    notify_on_execution_failed BOOLEAN,
+    timezone VARCHAR(64),
+    updated_at TIMESTAMP NOT NULL
+);
+`
+
+// environmentChangeFeedSchema versions environment rows (version and updated_at are bumped on
+// every write) and records deleted environments as tombstones, so replicas can poll for changes
+// to the environments they cache
+const environmentChangeFeedSchema = `
+ALTER TABLE environments ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE environments ADD COLUMN updated_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_environments_updated_at ON environments(updated_at);
+
+CREATE TABLE IF NOT EXISTS environment_tombstones (
+    id VARCHAR(255) PRIMARY KEY,
+    deleted_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_environment_tombstones_deleted_at ON environment_tombstones(deleted_at);
+`
+
+// exportJobsSchema adds export jobs: exports of executions, environment events and audit log
+// entries to an external sink, with a checkpoint per dataset (progress)
+const exportJobsSchema = `
+CREATE TABLE IF NOT EXISTS export_jobs (
+    id TEXT PRIMARY KEY,
+    trigger_type VARCHAR(50) NOT NULL,
+    datasets TEXT NOT NULL,
+    range_from TIMESTAMP NOT NULL,
+    range_to TIMESTAMP NOT NULL,
+    sink VARCHAR(50) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP,
+    progress TEXT NOT NULL,
+    error TEXT,
+    created_by TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_export_jobs_status ON export_jobs(status);
+CREATE INDEX IF NOT EXISTS idx_export_jobs_created_at ON export_jobs(created_at);
+`
+
+// executionCacheSchema adds the execution result cache: the finished execution whose result is
+// reused for identical executions until expires_at. Executions record whether they asked for
+// the cache and which execution a cache hit copied.
+const executionCacheSchema = `
+ALTER TABLE executions ADD COLUMN cache_enabled BOOLEAN;
+ALTER TABLE executions ADD COLUMN cached_from TEXT;
+
+CREATE TABLE IF NOT EXISTS execution_cache (
+    cache_key VARCHAR(64) PRIMARY KEY,
+    environment_id VARCHAR(255) NOT NULL,
+    execution_id VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (environment_id) REFERENCES environments(id) ON DELETE CASCADE,
+    FOREIGN KEY (execution_id) REFERENCES executions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_execution_cache_env_id ON execution_cache(environment_id);
+CREATE INDEX IF NOT EXISTS idx_execution_cache_expires_at ON execution_cache(expires_at);
+`
+
+// rolesSchema adds roles: named sets of capabilities that users.role refers to. The built-in
+// roles are seeded with the access they always had.
+const rolesSchema = `
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT,
+    capabilities TEXT NOT NULL,
+    built_in BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO roles (name, description, capabilities, built_in) VALUES
+    ('user', 'Access to own and shared environments', '[]', TRUE),
+    ('admin', 'Manages users, API keys and the platform', '["users.manage","api_keys.manage","metrics.read","audit.read","platform.admin"]', TRUE),
+    ('super_admin', 'Full access, including super admin accounts', '["environments.read_all","environments.write_all","users.manage","api_keys.manage","metrics.read","audit.read","platform.admin"]', TRUE);
+`
+
+// environmentOneShotSchema adds the mode of environments and the result of oneshot
+// environments (exit code, output, completion time), which are deleted retention_seconds after
+// they complete
+const environmentOneShotSchema = `
+ALTER TABLE environments ADD COLUMN mode TEXT;
+ALTER TABLE environments ADD COLUMN retention_seconds INTEGER;
+ALTER TABLE environments ADD COLUMN exit_code INTEGER;
+ALTER TABLE environments ADD COLUMN output TEXT;
+ALTER TABLE environments ADD COLUMN output_truncated BOOLEAN;
+ALTER TABLE environments ADD COLUMN completed_at TIMESTAMP;
+`
+
+// operationsSchema adds operations: bulk requests (e.g. bulk delete) carried out in the
+// background with a result per environment
+const operationsSchema = `
+CREATE TABLE IF NOT EXISTS operations (
+    id TEXT PRIMARY KEY,
+    type VARCHAR(50) NOT NULL,
+    user_id TEXT,
+    status VARCHAR(50) NOT NULL,
+    results TEXT NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+`
+
+// executionInputFilesSchema records an execution's input files (paths and sizes) and the code
+// classifying its error
+const executionInputFilesSchema = `
+ALTER TABLE executions ADD COLUMN input_files TEXT;
+ALTER TABLE executions ADD COLUMN error_code TEXT;
+`
+
+// pipelinesSchema adds pipelines: steps run as executions of an environment in dependency order
+const pipelinesSchema = `
+CREATE TABLE IF NOT EXISTS pipelines (
+    id TEXT PRIMARY KEY,
+    environment_id TEXT NOT NULL,
+    user_id TEXT,
+    status VARCHAR(50) NOT NULL,
+    max_parallel INTEGER NOT NULL,
+    steps TEXT NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_pipelines_environment_id ON pipelines(environment_id);
+`
+
+// auditClientIPSchema records the client address of the request behind an audit entry
+const auditClientIPSchema = `
+ALTER TABLE audit_log ADD COLUMN client_ip TEXT;
+`
+
+// environmentExecModeSchema adds the exec mode (serialized or parallel) of environments
+const environmentExecModeSchema = `
+ALTER TABLE environments ADD COLUMN exec_mode TEXT;
+`
+
+// loginFailuresSchema tracks consecutive failed logins per username ("user:<name>") and per
+// client address ("ip:<address>") so lockouts survive restarts
+const loginFailuresSchema = `
+CREATE TABLE IF NOT EXISTS login_failures (
+    subject TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+`
+
+// executionCommandTextSchema adds the command line of executions as searchable text (arguments
+// joined by spaces; existing rows are converted from the JSON command) and an index that keeps
+// per-environment listings ordered. Substring filters scan an environment's executions.
+const executionCommandTextSchema = `
+ALTER TABLE executions ADD COLUMN command_text TEXT;
+UPDATE executions SET command_text = REPLACE(SUBSTR(command, 3, LENGTH(command) - 4), '","', ' ') WHERE command LIKE '["%"]';
+CREATE INDEX IF NOT EXISTS idx_executions_env_created_at ON executions(environment_id, created_at);
+`
+
+// executionModeSchema records where each execution ran (standby, ephemeral or main_fallback pod)
+// and when its own pod was scheduled and started. Pooled executions are backfilled as standby.
+const executionModeSchema = `
+ALTER TABLE executions ADD COLUMN execution_mode TEXT;
+ALTER TABLE executions ADD COLUMN pod_scheduled_at TIMESTAMP;
+ALTER TABLE executions ADD COLUMN pod_started_at TIMESTAMP;
+UPDATE executions SET execution_mode = 'standby' WHERE served_from_pool;
+`
+
+// environmentAffinitySchema stores the node affinity and pod anti-affinity of environments (JSON)
+const environmentAffinitySchema = `
+ALTER TABLE environments ADD COLUMN affinity TEXT;
+`
+
+// executionCallbackSchema records the callback URL of executions and its delivery state (JSON)
+const executionCallbackSchema = `
+ALTER TABLE executions ADD COLUMN callback TEXT;
+`
+
+// sessionRecordingsSchema adds the per-environment session recording opt-in and the index of
+// recorded attach sessions (the recordings themselves are files in recording.directory)
+const sessionRecordingsSchema = `
+ALTER TABLE environments ADD COLUMN record_sessions BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS session_recordings (
+    id TEXT PRIMARY KEY,
+    environment_id VARCHAR(255) NOT NULL,
+    user_id TEXT,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ended_at TIMESTAMP,
+    size_bytes INTEGER NOT NULL DEFAULT 0,
+    truncated BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_session_recordings_environment_id ON session_recordings(environment_id);
+`
+
+// metricRollupsSchema adds 5-minute rollups of the metrics samples, kept after the raw samples
+// expire. Global metrics use an empty environment_id.
+const metricRollupsSchema = `
+CREATE TABLE IF NOT EXISTS metric_rollups (
+    environment_id VARCHAR(255) NOT NULL DEFAULT '',
+    metric_type VARCHAR(50) NOT NULL,
+    bucket_start TIMESTAMP NOT NULL,
+    value_sum REAL NOT NULL,
+    value_count INTEGER NOT NULL,
+    value_max REAL NOT NULL,
+    PRIMARY KEY (environment_id, metric_type, bucket_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_metric_rollups_bucket_start ON metric_rollups(bucket_start);
+`
+
+// environmentTokensSchema adds API tokens scoped to a single environment
+const environmentTokensSchema = `
+CREATE TABLE IF NOT EXISTS environment_tokens (
+    id TEXT PRIMARY KEY,
+    environment_id VARCHAR(255) NOT NULL,
+    user_id TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    permission VARCHAR(50) NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    last_used TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_environment_tokens_environment_id ON environment_tokens(environment_id);
+`
+
+// executionOverridesSchema records the image and resources (JSON) executions ran with
+const executionOverridesSchema = `
+ALTER TABLE executions ADD COLUMN effective_image TEXT;
+ALTER TABLE executions ADD COLUMN effective_resources TEXT;
+`
+
+// environmentGroupsSchema adds environment groups: a template and replica count managed as one unit
+const environmentGroupsSchema = `
+CREATE TABLE IF NOT EXISTS environment_groups (
+    id TEXT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    user_id TEXT NOT NULL,
+    team_id TEXT,
+    template TEXT NOT NULL,
+    replicas INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE environments ADD COLUMN group_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_environments_group_id ON environments(group_id);
+`
+
+// environmentActivitySchema tracks when environments were last used and their own idle timeout
+const environmentActivitySchema = `
+ALTER TABLE environments ADD COLUMN last_activity_at TIMESTAMP;
+ALTER TABLE environments ADD COLUMN idle_timeout INTEGER NOT NULL DEFAULT 0;
+`
+
+// userExternalIDSchema adds the identity provider subject of users who log in through SSO
+const userExternalIDSchema = `
+ALTER TABLE users ADD COLUMN external_id VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_external_id ON users(external_id);
+`
+
+// executionOutputSchema records the full output sizes of executions and whether the stored
+// output was truncated
+const executionOutputSchema = `
+ALTER TABLE executions ADD COLUMN stdout_bytes_total BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE executions ADD COLUMN stderr_bytes_total BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE executions ADD COLUMN output_truncated BOOLEAN NOT NULL DEFAULT FALSE;
+`
+
+// readinessCheckSchema adds the environment readiness check (JSON) and the status message
+// explaining a failed environment
+const readinessCheckSchema = `
+ALTER TABLE environments ADD COLUMN readiness_check TEXT;
+ALTER TABLE environments ADD COLUMN status_message TEXT;
+`
+
+// commandPolicySchema adds the per-environment exec command policy (JSON)
+const commandPolicySchema = `
+ALTER TABLE environments ADD COLUMN command_policy TEXT;
+`
+
+// environmentPhaseSchema adds the provisioning phase to environments
+const environmentPhaseSchema = `
+ALTER TABLE environments ADD COLUMN phase VARCHAR(50);
+`
+
+// executionHistorySchema drops the executions -> environments cascade so execution history
+// survives environment deletion (the table is rebuilt; SQLite cannot drop a constraint)
+const executionHistorySchema = `
+CREATE TABLE executions_history (
+    id TEXT PRIMARY KEY,
+    environment_id TEXT NOT NULL,
+    user_id TEXT,
+    command TEXT NOT NULL,
+    env_vars TEXT,
+    status VARCHAR(50) NOT NULL,
+    pod_name TEXT,
+    namespace TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    queued_at TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    exit_code INTEGER,
+    stdout TEXT,
+    stderr TEXT,
+    error TEXT,
+    duration_ms BIGINT,
+    served_from_pool BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO executions_history (
+    id, environment_id, user_id, command, env_vars, status, pod_name, namespace, created_at,
+    queued_at, started_at, completed_at, exit_code, stdout, stderr, error, duration_ms, served_from_pool
+)
+SELECT
+    id, environment_id, user_id, command, env_vars, status, pod_name, namespace, created_at,
+    queued_at, started_at, completed_at, exit_code, stdout, stderr, error, duration_ms, served_from_pool
+FROM executions;
+
+DROP TABLE executions;
+ALTER TABLE executions_history RENAME TO executions;
+
+CREATE INDEX IF NOT EXISTS idx_executions_env_id ON executions(environment_id);
+CREATE INDEX IF NOT EXISTS idx_executions_user_id ON executions(user_id);
+CREATE INDEX IF NOT EXISTS idx_executions_status ON executions(status);
+CREATE INDEX IF NOT EXISTS idx_executions_created_at ON executions(created_at);
+`
+
+// environmentClusterSchema records which Kubernetes cluster an environment runs on
+// (NULL = the configured default cluster)
+const environmentClusterSchema = `
+ALTER TABLE environments ADD COLUMN cluster TEXT;
+`
+
+// auditAndAPIKeyRotationSchema adds the audit log and API key rotation/expiry tracking
+const auditAndAPIKeyRotationSchema = `
+-- Audit log (security-relevant actions and notifications)
+CREATE TABLE IF NOT EXISTS audit_log (
+    id TEXT PRIMARY KEY,
+    action VARCHAR(100) NOT NULL,
+    actor_id TEXT,
+    resource_type VARCHAR(50),
+    resource_id TEXT,
+    message TEXT NOT NULL,
+    details TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log(resource_type, resource_id);
+
+-- rotated_from links a rotated key to the key it replaced; expiry_notified_at dedupes expiry reminders
+ALTER TABLE api_keys ADD COLUMN rotated_from TEXT;
+ALTER TABLE api_keys ADD COLUMN expiry_notified_at TIMESTAMP;
+`
+
+// executionPoolSchema records whether an execution was served from the standby pool
+const executionPoolSchema = `
+ALTER TABLE executions ADD COLUMN served_from_pool BOOLEAN NOT NULL DEFAULT FALSE;
+`
+
+// teamsSchema adds teams, team membership and the environments.team_id column.
+// Existing environments are moved into a personal team per owner.
+const teamsSchema = `
+-- Teams (environment ownership shared by a group of users)
+CREATE TABLE IF NOT EXISTS teams (
+    id TEXT PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    description TEXT,
+    personal BOOLEAN NOT NULL DEFAULT FALSE,
+    owner_id TEXT,
+    max_environments INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Team members; role is a permission level (viewer, editor, owner) applied to all team environments
+CREATE TABLE IF NOT EXISTS team_members (
+    id TEXT PRIMARY KEY,
+    team_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE(team_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_team_members_team_id ON team_members(team_id);
+CREATE INDEX IF NOT EXISTS idx_team_members_user_id ON team_members(user_id);
+
+ALTER TABLE environments ADD COLUMN team_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_environments_team_id ON environments(team_id);
+
+-- Backfill: personal team per existing environment owner
+INSERT INTO teams (id, name, description, personal, owner_id, created_at)
+SELECT DISTINCT 'personal-' || user_id, 'personal-' || user_id, 'Personal team', TRUE, user_id, CURRENT_TIMESTAMP
+FROM environments
+WHERE user_id IS NOT NULL AND user_id <> '';
+
+INSERT INTO team_members (id, team_id, user_id, role, added_at)
+SELECT 'personal-' || u.id, 'personal-' || u.id, u.id, 'owner', CURRENT_TIMESTAMP
+FROM users u
+WHERE u.id IN (SELECT user_id FROM environments);
+
+UPDATE environments SET team_id = 'personal-' || user_id
+WHERE user_id IS NOT NULL AND user_id <> '';
+`
+
 // reconciliationSchema adds environment_events table and reconciliation fields to environments
 const reconciliationSchema = `
 -- Environment events (reconciliation and lifecycle logs for display in environment logs tab)
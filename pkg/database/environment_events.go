@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,14 +13,20 @@ import (
 
 // SaveEnvironmentEvent persists a reconciliation or lifecycle event for an environment (shown in logs tab)
 func (db *DB) SaveEnvironmentEvent(ctx context.Context, envID, eventType, message, details string) (*models.EnvironmentEvent, error) {
+	return db.SaveEnvironmentEventBy(ctx, envID, "", eventType, message, details)
+}
+
+// SaveEnvironmentEventBy persists an environment event caused by a user (actorID, empty for the
+// server itself)
+func (db *DB) SaveEnvironmentEventBy(ctx context.Context, envID, actorID, eventType, message, details string) (*models.EnvironmentEvent, error) {
 	id := uuid.New().String()
 	now := time.Now()
 
 	query := `
-		INSERT INTO environment_events (id, environment_id, event_type, message, details, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO environment_events (id, environment_id, event_type, message, details, created_at, actor_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`
-	_, err := db.ExecContext(ctx, query, id, envID, eventType, message, nullIfEmpty(details), now)
+	_, err := db.ExecContext(ctx, query, id, envID, eventType, message, nullIfEmpty(details), now, nullIfEmpty(actorID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to save environment event: %w", err)
 	}
@@ -28,14 +35,22 @@ func (db *DB) SaveEnvironmentEvent(ctx context.Context, envID, eventType, messag
 		ID:            id,
 		EnvironmentID: envID,
 		EventType:     eventType,
+		ActorID:       actorID,
 		Message:       message,
 		Details:       details,
 		CreatedAt:     now,
 	}, nil
 }
 
-// ListEnvironmentEvents returns events for an environment, newest first (for merging with pod logs)
+// ListEnvironmentEvents returns the newest events of an environment (500 by default, at most
+// 5000), oldest first (for merging with pod logs)
 func (db *DB) ListEnvironmentEvents(ctx context.Context, environmentID string, limit int) ([]*models.EnvironmentEvent, error) {
+	return db.ListEnvironmentEventsBetween(ctx, environmentID, nil, nil, limit)
+}
+
+// ListEnvironmentEventsBetween returns the newest events of an environment created within
+// [from, to] (nil = unbounded; 500 by default, at most 5000), oldest first
+func (db *DB) ListEnvironmentEventsBetween(ctx context.Context, environmentID string, from, to *time.Time, limit int) ([]*models.EnvironmentEvent, error) {
 	if limit <= 0 {
 		limit = 500
 	}
@@ -43,14 +58,30 @@ func (db *DB) ListEnvironmentEvents(ctx context.Context, environmentID string, l
 		limit = 5000
 	}
 
+	where := `environment_id = $1`
+	args := []interface{}{environmentID}
+	// Local time, like the stored timestamps
+	if from != nil {
+		args = append(args, from.Local())
+		where += fmt.Sprintf(` AND created_at >= $%d`, len(args))
+	}
+	if to != nil {
+		args = append(args, to.Local())
+		where += fmt.Sprintf(` AND created_at <= $%d`, len(args))
+	}
+	args = append(args, limit)
 	query := `
-		SELECT id, environment_id, event_type, message, COALESCE(details, ''), created_at
-		FROM environment_events
-		WHERE environment_id = $1
+		SELECT id, environment_id, event_type, message, details, created_at, actor_id FROM (
+			SELECT id, environment_id, event_type, message, COALESCE(details, '') AS details, created_at,
+				COALESCE(actor_id, '') AS actor_id
+			FROM environment_events
+			WHERE ` + where + fmt.Sprintf(`
+			ORDER BY created_at DESC
+			LIMIT $%d
+		) newest
 		ORDER BY created_at ASC
-		LIMIT $2
-	`
-	rows, err := db.QueryContext(ctx, query, environmentID, limit)
+	`, len(args))
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list environment events: %w", err)
 	}
@@ -59,10 +90,71 @@ func (db *DB) ListEnvironmentEvents(ctx context.Context, environmentID string, l
 	var events []*models.EnvironmentEvent
 	for rows.Next() {
 		var e models.EnvironmentEvent
-		if err := rows.Scan(&e.ID, &e.EnvironmentID, &e.EventType, &e.Message, &e.Details, &e.CreatedAt); err != nil {
+		if err := rows.Scan(&e.ID, &e.EnvironmentID, &e.EventType, &e.Message, &e.Details, &e.CreatedAt, &e.ActorID); err != nil {
 			return nil, fmt.Errorf("failed to scan environment event: %w", err)
 		}
 		events = append(events, &e)
 	}
 	return events, rows.Err()
 }
+
+// keepFailureEvents returns the condition pruning statements add so the newest event of each
+// failed environment whose type is in failureTypes is kept, with its arguments appended to args
+func keepFailureEvents(failureTypes []string, args []interface{}) (string, []interface{}) {
+	if len(failureTypes) == 0 {
+		return "", args
+	}
+	args = append(args, string(models.StatusFailed))
+	status := len(args)
+	placeholders := make([]string, len(failureTypes))
+	for i, eventType := range failureTypes {
+		args = append(args, eventType)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	return fmt.Sprintf(` AND id NOT IN (
+			SELECT id FROM (
+				SELECT e.id, ROW_NUMBER() OVER (PARTITION BY e.environment_id ORDER BY e.created_at DESC, e.id DESC) AS rn
+				FROM environment_events e
+				JOIN environments env ON env.id = e.environment_id
+				WHERE env.status = $%d AND e.event_type IN (%s)
+			) failures
+			WHERE failures.rn = 1
+		)`, status, strings.Join(placeholders, ", ")), args
+}
+
+// DeleteEnvironmentEventsBefore deletes events created before the cutoff, except the newest
+// event of each failed environment whose type is in failureTypes, so the cause of the failure
+// stays visible. Returns the number of events deleted.
+func (db *DB) DeleteEnvironmentEventsBefore(ctx context.Context, before time.Time, failureTypes []string) (int64, error) {
+	keep, args := keepFailureEvents(failureTypes, []interface{}{before.Local()})
+	return db.deleteEnvironmentEvents(ctx, `DELETE FROM environment_events WHERE created_at < $1`+keep, args...)
+}
+
+// DeleteEnvironmentEventsBeyondLimit keeps the newest limit events of each environment and
+// deletes the older ones, except the newest event of each failed environment whose type is in
+// failureTypes. Returns the number of events deleted.
+func (db *DB) DeleteEnvironmentEventsBeyondLimit(ctx context.Context, limit int, failureTypes []string) (int64, error) {
+	keep, args := keepFailureEvents(failureTypes, []interface{}{limit})
+	query := `
+		DELETE FROM environment_events WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY environment_id ORDER BY created_at DESC, id DESC) AS rn
+				FROM environment_events
+			) ranked
+			WHERE ranked.rn > $1
+		)` + keep
+	return db.deleteEnvironmentEvents(ctx, query, args...)
+}
+
+// deleteEnvironmentEvents runs an events DELETE statement and returns the number of rows deleted
+func (db *DB) deleteEnvironmentEvents(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete environment events: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count deleted environment events: %w", err)
+	}
+	return n, nil
+}
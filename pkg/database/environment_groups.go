@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// environmentGroupColumns is the column list of environment group SELECT queries (order matches scanEnvironmentGroup)
+const environmentGroupColumns = `id, name, user_id, team_id, template, replicas, created_at, updated_at`
+
+// SaveEnvironmentGroup inserts an environment group or updates its replica count
+func (db *DB) SaveEnvironmentGroup(ctx context.Context, group *models.EnvironmentGroup) error {
+	templateJSON, err := json.Marshal(group.Template)
+	if err != nil {
+		return fmt.Errorf("failed to encode group template: %w", err)
+	}
+
+	query := `
+		INSERT INTO environment_groups (id, name, user_id, team_id, template, replicas, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			replicas = EXCLUDED.replicas,
+			updated_at = EXCLUDED.updated_at
+	`
+	_, err = db.ExecContext(ctx, query,
+		group.ID, group.Name, group.UserID, nullIfEmpty(group.TeamID), string(templateJSON),
+		group.Replicas, group.CreatedAt, group.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save environment group: %w", err)
+	}
+	return nil
+}
+
+// GetEnvironmentGroup retrieves an environment group by ID
+func (db *DB) GetEnvironmentGroup(ctx context.Context, id string) (*models.EnvironmentGroup, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+environmentGroupColumns+` FROM environment_groups WHERE id = $1`, id)
+	group, err := scanEnvironmentGroup(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeGroupNotFound, "environment group not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment group: %w", err)
+	}
+	return group, nil
+}
+
+// ListEnvironmentGroups returns all environment groups, newest first
+func (db *DB) ListEnvironmentGroups(ctx context.Context) ([]*models.EnvironmentGroup, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+environmentGroupColumns+` FROM environment_groups ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment groups: %w", err)
+	}
+	defer rows.Close()
+
+	var groups []*models.EnvironmentGroup
+	for rows.Next() {
+		group, err := scanEnvironmentGroup(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan environment group: %w", err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// DeleteEnvironmentGroup deletes an environment group (its environments are deleted separately)
+func (db *DB) DeleteEnvironmentGroup(ctx context.Context, id string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM environment_groups WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete environment group: %w", err)
+	}
+	return nil
+}
+
+// scanEnvironmentGroup scans one row selected with environmentGroupColumns
+func scanEnvironmentGroup(row rowScanner) (*models.EnvironmentGroup, error) {
+	var group models.EnvironmentGroup
+	var teamID sql.NullString
+	var templateJSON string
+	if err := row.Scan(&group.ID, &group.Name, &group.UserID, &teamID, &templateJSON, &group.Replicas,
+		&group.CreatedAt, &group.UpdatedAt); err != nil {
+		return nil, err
+	}
+	group.TeamID = teamID.String
+	if err := json.Unmarshal([]byte(templateJSON), &group.Template); err != nil {
+		return nil, fmt.Errorf("invalid template of environment group %s: %w", group.ID, err)
+	}
+	return &group, nil
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+)
+
+// ownerPermission is the environment_permissions level of an environment's owner
+// (permissions.PermissionOwner, which imports this package)
+const ownerPermission = "owner"
+
+// TransferEnvironmentOwnership makes toUserID the owner of an environment and returns the
+// previous owner's ID. The previous owner's owner grant moves to toUserID in the same transaction.
+func (db *DB) TransferEnvironmentOwnership(ctx context.Context, envID, toUserID, grantedBy string) (previous string, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			//nolint:errcheck // Best effort rollback on error path, error is already being returned
+			tx.Rollback()
+		}
+	}()
+
+	var owner sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM environments WHERE id = $1", envID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", apierrors.New(apierrors.NotFound, apierrors.CodeEnvironmentNotFound, "environment %s not found", envID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get environment owner: %w", err)
+	}
+	if err = userExists(ctx, tx, toUserID); err != nil {
+		return "", err
+	}
+	if err = TransferEnvironmentsTx(ctx, tx, []string{envID}, owner.String, toUserID, grantedBy); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return owner.String, nil
+}
+
+// ListEnvironmentIDsByOwnerTx returns the IDs of the environments userID owns, oldest first
+func ListEnvironmentIDsByOwnerTx(ctx context.Context, tx *sql.Tx, userID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM environments WHERE user_id = $1 ORDER BY created_at, id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list owned environments: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan environment id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// TransferEnvironmentsTx moves the environments envIDs from fromUserID to toUserID within tx:
+// their user_id is updated, fromUserID's owner grants on them are removed and toUserID is
+// granted owner (by grantedBy, "" for nobody)
+func TransferEnvironmentsTx(ctx context.Context, tx *sql.Tx, envIDs []string, fromUserID, toUserID, grantedBy string) error {
+	for _, envID := range envIDs {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE environments SET user_id = $1, version = version + 1, updated_at = $2 WHERE id = $3",
+			toUserID, changeTime(), envID); err != nil {
+			return fmt.Errorf("failed to update environment owner: %w", err)
+		}
+		if fromUserID != "" && fromUserID != toUserID {
+			if _, err := tx.ExecContext(ctx, `
+				DELETE FROM environment_permissions
+				WHERE environment_id = $1 AND user_id = $2 AND permission = $3
+			`, envID, fromUserID, ownerPermission); err != nil {
+				return fmt.Errorf("failed to revoke previous owner permission: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO environment_permissions (id, user_id, environment_id, permission, granted_by, granted_at)
+			VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+			ON CONFLICT (user_id, environment_id) DO UPDATE SET
+				permission = EXCLUDED.permission,
+				granted_by = EXCLUDED.granted_by,
+				granted_at = CURRENT_TIMESTAMP
+		`, uuid.New().String(), toUserID, envID, ownerPermission, nullIfEmpty(grantedBy)); err != nil {
+			return fmt.Errorf("failed to grant owner permission: %w", err)
+		}
+	}
+	return nil
+}
+
+// userExists returns a NotFound error when there is no user with the given ID
+func userExists(ctx context.Context, tx *sql.Tx, userID string) error {
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id = $1", userID).Scan(&n); err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	if n == 0 {
+		return apierrors.New(apierrors.NotFound, apierrors.CodeUserNotFound, "user %s not found", userID)
+	}
+	return nil
+}
@@ -5,10 +5,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/models"
 )
 
@@ -50,30 +52,94 @@ func (db *DB) SaveEnvironment(ctx context.Context, env *models.Environment) erro
 	if err != nil {
 		poolJSON = []byte("null")
 	}
+	commandPolicyJSON, err := json.Marshal(env.CommandPolicy)
+	if err != nil {
+		commandPolicyJSON = []byte("null")
+	}
+	readinessCheckJSON, err := json.Marshal(env.ReadinessCheck)
+	if err != nil {
+		readinessCheckJSON = []byte("null")
+	}
+	affinityJSON, err := json.Marshal(env.Affinity)
+	if err != nil {
+		affinityJSON = []byte("null")
+	}
+	buildJSON, err := json.Marshal(env.Build)
+	if err != nil {
+		buildJSON = []byte("null")
+	}
+	logShippingJSON, err := json.Marshal(env.LogShipping)
+	if err != nil {
+		logShippingJSON = []byte("null")
+	}
+	workspaceSnapshotsJSON, err := json.Marshal(env.WorkspaceSnapshots)
+	if err != nil {
+		workspaceSnapshotsJSON = []byte("null")
+	}
+	lifecycleJSON, err := json.Marshal(env.Lifecycle)
+	if err != nil {
+		lifecycleJSON = []byte("null")
+	}
+	metadata := metadataJSON(env.Metadata)
 
 	query := `
 		INSERT INTO environments (
 			id, name, status, image, created_at, started_at, user_id, namespace, endpoint,
 			timeout, resources_cpu, resources_memory, resources_storage,
 			env_vars, command, labels, node_selector, tolerations, isolation_config, pool_config,
-			reconciliation_retry_count, last_reconciliation_error, last_reconciliation_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
+			reconciliation_retry_count, last_reconciliation_error, last_reconciliation_at,
+			team_id, cluster, phase, command_policy, readiness_check, status_message,
+			last_activity_at, idle_timeout, group_id, record_sessions, affinity, exec_mode,
+			mode, retention_seconds, exit_code, output, output_truncated, completed_at,
+			build, log_shipping, metadata, cordoned, cordon_reason, cordoned_at, workspace_snapshots, reservation_id, lifecycle, version, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35,
+			$36, $37, $38, $39, $40, $41, $42, $43, $44, $45, $46, $47, $48, $49, $50, 1, $51)
 		ON CONFLICT (id) DO UPDATE SET
 			status = EXCLUDED.status,
+			phase = EXCLUDED.phase,
 			started_at = EXCLUDED.started_at,
 			endpoint = EXCLUDED.endpoint,
+			labels = EXCLUDED.labels,
 			reconciliation_retry_count = EXCLUDED.reconciliation_retry_count,
 			last_reconciliation_error = EXCLUDED.last_reconciliation_error,
-			last_reconciliation_at = EXCLUDED.last_reconciliation_at
+			last_reconciliation_at = EXCLUDED.last_reconciliation_at,
+			team_id = EXCLUDED.team_id,
+			command_policy = EXCLUDED.command_policy,
+			status_message = EXCLUDED.status_message,
+			last_activity_at = EXCLUDED.last_activity_at,
+			idle_timeout = EXCLUDED.idle_timeout,
+			record_sessions = EXCLUDED.record_sessions,
+			affinity = EXCLUDED.affinity,
+			exec_mode = EXCLUDED.exec_mode,
+			exit_code = EXCLUDED.exit_code,
+			output = EXCLUDED.output,
+			output_truncated = EXCLUDED.output_truncated,
+			completed_at = EXCLUDED.completed_at,
+			metadata = EXCLUDED.metadata,
+			cordoned = EXCLUDED.cordoned,
+			cordon_reason = EXCLUDED.cordon_reason,
+			cordoned_at = EXCLUDED.cordoned_at,
+			workspace_snapshots = EXCLUDED.workspace_snapshots,
+			lifecycle = EXCLUDED.lifecycle,
+			version = environments.version + 1,
+			updated_at = EXCLUDED.updated_at
 	`
 
 	_, err = db.ExecContext(ctx, query,
 		env.ID, env.Name, string(env.Status), env.Image, env.CreatedAt, env.StartedAt, env.UserID,
-		env.Namespace, env.Endpoint, env.Timeout,
+		env.Namespace, nil, env.Timeout, // endpoint: URLs are derived per request (see api.setEnvironmentURLs)
 		env.Resources.CPU, env.Resources.Memory, env.Resources.Storage,
 		string(envVarsJSON), string(commandJSON), string(labelsJSON),
 		string(nodeSelectorJSON), string(tolerationsJSON), string(isolationJSON), string(poolJSON),
 		env.ReconciliationRetryCount, nullIfEmpty(env.LastReconciliationError), env.LastReconciliationAt,
+		nullIfEmpty(env.TeamID), nullIfEmpty(env.Cluster), nullIfEmpty(string(env.Phase)),
+		string(commandPolicyJSON), string(readinessCheckJSON), nullIfEmpty(env.StatusMessage),
+		env.LastActivityAt, env.IdleTimeout, nullIfEmpty(env.GroupID), env.RecordSessions,
+		string(affinityJSON), nullIfEmpty(env.ExecMode),
+		nullIfEmpty(env.Mode), env.RetentionSeconds, env.ExitCode, nullIfEmpty(env.Output), env.OutputTruncated, env.CompletedAt,
+		string(buildJSON), string(logShippingJSON), metadata,
+		env.Cordoned, nullIfEmpty(env.CordonReason), env.CordonedAt, string(workspaceSnapshotsJSON), nullIfEmpty(env.ReservationID),
+		string(lifecycleJSON), changeTime(),
 	)
 
 	if err != nil {
@@ -83,36 +149,51 @@ func (db *DB) SaveEnvironment(ctx context.Context, env *models.Environment) erro
 	return nil
 }
 
-// GetEnvironment retrieves an environment from the database
-func (db *DB) GetEnvironment(ctx context.Context, id string) (*models.Environment, error) {
+// environmentColumns is the column list shared by all environment SELECT queries (order matches scanEnvironment)
+const environmentColumns = `id, name, status, image, created_at, started_at, user_id, namespace, endpoint,
+			timeout, resources_cpu, resources_memory, resources_storage,
+			env_vars, command, labels, node_selector, tolerations, isolation_config, pool_config,
+			COALESCE(reconciliation_retry_count, 0), last_reconciliation_error, last_reconciliation_at,
+			team_id, cluster, phase, command_policy, readiness_check, status_message,
+			last_activity_at, COALESCE(idle_timeout, 0), group_id, COALESCE(record_sessions, FALSE), affinity,
+			COALESCE(exec_mode, ''), COALESCE(mode, ''), COALESCE(retention_seconds, 0), exit_code,
+			COALESCE(output, ''), COALESCE(output_truncated, FALSE), completed_at,
+			build, log_shipping, metadata, COALESCE(cordoned, FALSE), COALESCE(cordon_reason, ''), cordoned_at,
+			workspace_snapshots, reservation_id, lifecycle, COALESCE(version, 0), updated_at`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEnvironment scans one row selected with environmentColumns into an Environment
+func (db *DB) scanEnvironment(row rowScanner) (*models.Environment, error) {
 	var env models.Environment
 	var statusStr string
 	var envVarsJSON, commandJSON, labelsJSON, nodeSelectorJSON, tolerationsJSON, isolationJSON, poolJSON sql.NullString
 	var lastReconciliationError sql.NullString
-	var lastReconciliationAt sql.NullTime
-
-	query := `
-		SELECT id, name, status, image, created_at, started_at, user_id, namespace, endpoint,
-			timeout, resources_cpu, resources_memory, resources_storage,
-			env_vars, command, labels, node_selector, tolerations, isolation_config, pool_config,
-			COALESCE(reconciliation_retry_count, 0), last_reconciliation_error, last_reconciliation_at
-		FROM environments
-		WHERE id = $1
-	`
+	var lastReconciliationAt, lastActivityAt, completedAt, updatedAt, cordonedAt sql.NullTime
+	var teamID, cluster, phase, commandPolicyJSON, readinessCheckJSON, statusMessage, groupID, affinityJSON, buildJSON, logShippingJSON, metadataJSON, workspaceSnapshotsJSON, reservationID, lifecycleJSON sql.NullString
+	// endpoint holds the URL older versions stored (e.g. ws://localhost:8080/...); it is ignored
+	// and derived per request instead
+	var endpoint sql.NullString
+	var exitCode sql.NullInt64
 
-	err := db.QueryRowContext(ctx, query, id).Scan(
+	err := row.Scan(
 		&env.ID, &env.Name, &statusStr, &env.Image, &env.CreatedAt, &env.StartedAt, &env.UserID,
-		&env.Namespace, &env.Endpoint, &env.Timeout,
+		&env.Namespace, &endpoint, &env.Timeout,
 		&env.Resources.CPU, &env.Resources.Memory, &env.Resources.Storage,
 		&envVarsJSON, &commandJSON, &labelsJSON, &nodeSelectorJSON, &tolerationsJSON, &isolationJSON, &poolJSON,
 		&env.ReconciliationRetryCount, &lastReconciliationError, &lastReconciliationAt,
+		&teamID, &cluster, &phase, &commandPolicyJSON, &readinessCheckJSON, &statusMessage,
+		&lastActivityAt, &env.IdleTimeout, &groupID, &env.RecordSessions,
+		&affinityJSON, &env.ExecMode, &env.Mode, &env.RetentionSeconds, &exitCode,
+		&env.Output, &env.OutputTruncated, &completedAt,
+		&buildJSON, &logShippingJSON, &metadataJSON, &env.Cordoned, &env.CordonReason, &cordonedAt,
+		&workspaceSnapshotsJSON, &reservationID, &lifecycleJSON, &env.Version, &updatedAt,
 	)
-
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("environment not found: %s", id)
-	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get environment: %w", err)
+		return nil, err
 	}
 
 	env.Status = models.EnvironmentStatus(statusStr)
@@ -153,27 +234,106 @@ func (db *DB) GetEnvironment(ctx context.Context, id string) (*models.Environmen
 			db.logger.Warn("failed to unmarshal pool_config", zap.Error(err), zap.String("environment_id", env.ID))
 		}
 	}
+	if commandPolicyJSON.Valid {
+		if err := json.Unmarshal([]byte(commandPolicyJSON.String), &env.CommandPolicy); err != nil {
+			db.logger.Warn("failed to unmarshal command_policy", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if readinessCheckJSON.Valid {
+		if err := json.Unmarshal([]byte(readinessCheckJSON.String), &env.ReadinessCheck); err != nil {
+			db.logger.Warn("failed to unmarshal readiness_check", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if lifecycleJSON.Valid {
+		if err := json.Unmarshal([]byte(lifecycleJSON.String), &env.Lifecycle); err != nil {
+			db.logger.Warn("failed to unmarshal lifecycle", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if affinityJSON.Valid {
+		if err := json.Unmarshal([]byte(affinityJSON.String), &env.Affinity); err != nil {
+			db.logger.Warn("failed to unmarshal affinity", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if buildJSON.Valid {
+		if err := json.Unmarshal([]byte(buildJSON.String), &env.Build); err != nil {
+			db.logger.Warn("failed to unmarshal build", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if logShippingJSON.Valid {
+		if err := json.Unmarshal([]byte(logShippingJSON.String), &env.LogShipping); err != nil {
+			db.logger.Warn("failed to unmarshal log shipping", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if metadataJSON.Valid {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &env.Metadata); err != nil {
+			db.logger.Warn("failed to unmarshal metadata", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if workspaceSnapshotsJSON.Valid {
+		if err := json.Unmarshal([]byte(workspaceSnapshotsJSON.String), &env.WorkspaceSnapshots); err != nil {
+			db.logger.Warn("failed to unmarshal workspace snapshots", zap.Error(err), zap.String("environment_id", env.ID))
+		}
+	}
+	if statusMessage.Valid {
+		env.StatusMessage = statusMessage.String
+	}
 	if lastReconciliationError.Valid {
 		env.LastReconciliationError = lastReconciliationError.String
 	}
 	if lastReconciliationAt.Valid {
 		env.LastReconciliationAt = &lastReconciliationAt.Time
 	}
+	if lastActivityAt.Valid {
+		env.LastActivityAt = &lastActivityAt.Time
+	}
+	if completedAt.Valid {
+		env.CompletedAt = &completedAt.Time
+	}
+	if updatedAt.Valid {
+		env.UpdatedAt = &updatedAt.Time
+	}
+	if cordonedAt.Valid {
+		env.CordonedAt = &cordonedAt.Time
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		env.ExitCode = &code
+	}
+	if groupID.Valid {
+		env.GroupID = groupID.String
+	}
+	env.ReservationID = reservationID.String
+	if teamID.Valid {
+		env.TeamID = teamID.String
+	}
+	if cluster.Valid {
+		env.Cluster = cluster.String
+	}
+	if phase.Valid {
+		env.Phase = models.EnvironmentPhase(phase.String)
+	}
 
 	return &env, nil
 }
 
+// GetEnvironment retrieves an environment from the database
+func (db *DB) GetEnvironment(ctx context.Context, id string) (*models.Environment, error) {
+	query := `SELECT ` + environmentColumns + ` FROM environments WHERE id = $1`
+
+	env, err := db.scanEnvironment(db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeEnvironmentNotFound, "environment not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+
+	return env, nil
+}
+
 // ListEnvironments retrieves all environments from the database
 func (db *DB) ListEnvironments(ctx context.Context, limit, offset int) ([]*models.Environment, error) {
-	query := `
-		SELECT id, name, status, image, created_at, started_at, user_id, namespace, endpoint,
-			timeout, resources_cpu, resources_memory, resources_storage,
-			env_vars, command, labels, node_selector, tolerations, isolation_config, pool_config,
-			COALESCE(reconciliation_retry_count, 0), last_reconciliation_error, last_reconciliation_at
-		FROM environments
-		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2
-	`
+	query := `SELECT ` + environmentColumns + ` FROM environments ORDER BY created_at DESC LIMIT $1 OFFSET $2`
 
 	rows, err := db.QueryContext(ctx, query, limit, offset)
 	if err != nil {
@@ -183,103 +343,288 @@ func (db *DB) ListEnvironments(ctx context.Context, limit, offset int) ([]*model
 
 	var environments []*models.Environment
 	for rows.Next() {
-		var env models.Environment
-		var statusStr string
-		var envVarsJSON, commandJSON, labelsJSON, nodeSelectorJSON, tolerationsJSON, isolationJSON, poolJSON sql.NullString
-		var lastReconciliationError sql.NullString
-		var lastReconciliationAt sql.NullTime
-
-		err := rows.Scan(
-			&env.ID, &env.Name, &statusStr, &env.Image, &env.CreatedAt, &env.StartedAt, &env.UserID,
-			&env.Namespace, &env.Endpoint, &env.Timeout,
-			&env.Resources.CPU, &env.Resources.Memory, &env.Resources.Storage,
-			&envVarsJSON, &commandJSON, &labelsJSON, &nodeSelectorJSON, &tolerationsJSON, &isolationJSON, &poolJSON,
-			&env.ReconciliationRetryCount, &lastReconciliationError, &lastReconciliationAt,
-		)
+		env, err := db.scanEnvironment(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan environment: %w", err)
 		}
+		environments = append(environments, env)
+	}
 
-		env.Status = models.EnvironmentStatus(statusStr)
+	return environments, rows.Err()
+}
 
-		// Deserialize JSON fields
-		if envVarsJSON.Valid {
-			if err := json.Unmarshal([]byte(envVarsJSON.String), &env.Env); err != nil {
-				db.logger.Warn("failed to unmarshal env_vars", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if commandJSON.Valid {
-			if err := json.Unmarshal([]byte(commandJSON.String), &env.Command); err != nil {
-				db.logger.Warn("failed to unmarshal command", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if labelsJSON.Valid {
-			if err := json.Unmarshal([]byte(labelsJSON.String), &env.Labels); err != nil {
-				db.logger.Warn("failed to unmarshal labels", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if nodeSelectorJSON.Valid {
-			if err := json.Unmarshal([]byte(nodeSelectorJSON.String), &env.NodeSelector); err != nil {
-				db.logger.Warn("failed to unmarshal node_selector", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if tolerationsJSON.Valid {
-			if err := json.Unmarshal([]byte(tolerationsJSON.String), &env.Tolerations); err != nil {
-				db.logger.Warn("failed to unmarshal tolerations", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if isolationJSON.Valid {
-			if err := json.Unmarshal([]byte(isolationJSON.String), &env.Isolation); err != nil {
-				db.logger.Warn("failed to unmarshal isolation_config", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if poolJSON.Valid {
-			if err := json.Unmarshal([]byte(poolJSON.String), &env.Pool); err != nil {
-				db.logger.Warn("failed to unmarshal pool_config", zap.Error(err), zap.String("environment_id", env.ID))
-			}
-		}
-		if lastReconciliationError.Valid {
-			env.LastReconciliationError = lastReconciliationError.String
+// ListEnvironmentsAfter returns up to limit environments ordered by (created_at, id) descending,
+// starting after the cursor (from the beginning when it is nil). Unlike offsets, a cursor stays
+// valid when environments are created or deleted between pages.
+func (db *DB) ListEnvironmentsAfter(ctx context.Context, after *models.PageCursor, limit int) ([]*models.Environment, error) {
+	return db.ListEnvironmentsFiltered(ctx, EnvironmentListFilter{}, after, limit)
+}
+
+// EnvironmentListFilter selects the environments returned by ListEnvironmentsFiltered
+type EnvironmentListFilter struct {
+	// TeamID, GroupID and UserID match environments with that team, group or owner ("" for any)
+	TeamID  string
+	GroupID string
+	UserID  string
+	// Metadata matches environments whose metadata holds all of these key/value pairs
+	Metadata map[string]string
+}
+
+// where returns the WHERE clause of the filter ("" when it matches everything) and its
+// arguments, numbered from $1 (driver is the database's, for the metadata conditions)
+func (f EnvironmentListFilter) where(driver string) (string, []interface{}) {
+	var conditions string
+	var args []interface{}
+	if f.TeamID != "" {
+		args = append(args, f.TeamID)
+		conditions += fmt.Sprintf(` AND team_id = $%d`, len(args))
+	}
+	if f.GroupID != "" {
+		args = append(args, f.GroupID)
+		conditions += fmt.Sprintf(` AND group_id = $%d`, len(args))
+	}
+	if f.UserID != "" {
+		args = append(args, f.UserID)
+		conditions += fmt.Sprintf(` AND user_id = $%d`, len(args))
+	}
+	metadata, args := metadataWhere(driver, f.Metadata, args)
+	conditions += metadata
+	if conditions == "" {
+		return "", args
+	}
+	return ` WHERE ` + strings.TrimPrefix(conditions, ` AND `), args
+}
+
+// ListEnvironmentsFiltered is ListEnvironmentsAfter returning only the environments matching
+// the filter
+func (db *DB) ListEnvironmentsFiltered(ctx context.Context, filter EnvironmentListFilter, after *models.PageCursor, limit int) ([]*models.Environment, error) {
+	return db.ListEnvironmentsPage(ctx, filter, after, 0, limit)
+}
+
+// ListEnvironmentsPage is ListEnvironmentsFiltered skipping the first offset environments after
+// the cursor
+func (db *DB) ListEnvironmentsPage(ctx context.Context, filter EnvironmentListFilter, after *models.PageCursor, offset, limit int) ([]*models.Environment, error) {
+	where, args := filter.where(db.driver)
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		cursor := fmt.Sprintf(`(created_at, id) < ($%d, $%d)`, len(args)-1, len(args))
+		if where == "" {
+			where = ` WHERE ` + cursor
+		} else {
+			where += ` AND ` + cursor
 		}
-		if lastReconciliationAt.Valid {
-			env.LastReconciliationAt = &lastReconciliationAt.Time
+	}
+	args = append(args, limit, offset)
+	query := `SELECT ` + environmentColumns + ` FROM environments` + where +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+	defer rows.Close()
+
+	var environments []*models.Environment
+	for rows.Next() {
+		env, err := db.scanEnvironment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan environment: %w", err)
 		}
+		environments = append(environments, env)
+	}
+
+	return environments, rows.Err()
+}
+
+// CountEnvironments returns the number of environments matching the filter
+func (db *DB) CountEnvironments(ctx context.Context, filter EnvironmentListFilter) (int, error) {
+	where, args := filter.where(db.driver)
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM environments`+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count environments: %w", err)
+	}
+	return count, nil
+}
+
+// ListEnvironmentsByUserAndName returns a user's environments with the given name, newest first
+func (db *DB) ListEnvironmentsByUserAndName(ctx context.Context, userID, name string) ([]*models.Environment, error) {
+	query := `SELECT ` + environmentColumns + ` FROM environments WHERE user_id = $1 AND name = $2 ORDER BY created_at DESC`
+
+	rows, err := db.QueryContext(ctx, query, userID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments by name: %w", err)
+	}
+	defer rows.Close()
 
-		environments = append(environments, &env)
+	var environments []*models.Environment
+	for rows.Next() {
+		env, err := db.scanEnvironment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan environment: %w", err)
+		}
+		environments = append(environments, env)
 	}
 
 	return environments, rows.Err()
 }
 
-// DeleteEnvironment deletes an environment from the database
-func (db *DB) DeleteEnvironment(ctx context.Context, id string) error {
-	_, err := db.ExecContext(ctx, "DELETE FROM environments WHERE id = $1", id)
+// DeleteEnvironment deletes an environment and its badge secret from the database and leaves a
+// tombstone for it, so other replicas evict it from their caches (see ListEnvironmentTombstonesSince)
+func (db *DB) DeleteEnvironment(ctx context.Context, id string) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			//nolint:errcheck // Best effort rollback on error path, error is already being returned
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM environments WHERE id = $1", id); err != nil {
 		return fmt.Errorf("failed to delete environment: %w", err)
 	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM environment_badge_secrets WHERE environment_id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete environment badge secret: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO environment_tombstones (id, deleted_at) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET deleted_at = EXCLUDED.deleted_at
+	`, id, changeTime()); err != nil {
+		return fmt.Errorf("failed to record environment tombstone: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
+// ListEnvironmentsChangedSince returns the environments written at or after since
+func (db *DB) ListEnvironmentsChangedSince(ctx context.Context, since time.Time) ([]*models.Environment, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+environmentColumns+" FROM environments WHERE updated_at >= $1 ORDER BY updated_at", since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed environments: %w", err)
+	}
+	defer rows.Close()
+
+	var environments []*models.Environment
+	for rows.Next() {
+		env, err := db.scanEnvironment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan environment: %w", err)
+		}
+		environments = append(environments, env)
+	}
+	return environments, rows.Err()
+}
+
+// ListEnvironmentTombstonesSince returns the IDs of the environments deleted at or after since
+func (db *DB) ListEnvironmentTombstonesSince(ctx context.Context, since time.Time) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM environment_tombstones WHERE deleted_at >= $1", since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment tombstones: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan environment tombstone: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// PruneEnvironmentTombstones removes tombstones of environments deleted before the given time
+func (db *DB) PruneEnvironmentTombstones(ctx context.Context, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM environment_tombstones WHERE deleted_at < $1", before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune environment tombstones: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// changeTime is the updated_at (or deleted_at) of an environment write. It is set by the
+// application in UTC rather than by the database, so change polling compares like with like.
+func changeTime() time.Time {
+	return time.Now().UTC()
+}
+
 // UpdateEnvironmentStatus updates an environment's status and optionally started_at
 func (db *DB) UpdateEnvironmentStatus(ctx context.Context, id string, status models.EnvironmentStatus, startedAt *time.Time) error {
-	query := "UPDATE environments SET status = $1, started_at = $2 WHERE id = $3"
-	_, err := db.ExecContext(ctx, query, string(status), startedAt, id)
+	query := "UPDATE environments SET status = $1, started_at = $2, version = version + 1, updated_at = $3 WHERE id = $4"
+	_, err := db.ExecContext(ctx, query, string(status), startedAt, changeTime(), id)
 	if err != nil {
 		return fmt.Errorf("failed to update environment status: %w", err)
 	}
 	return nil
 }
 
+// UpdateEnvironmentPhase updates an environment's provisioning phase
+func (db *DB) UpdateEnvironmentPhase(ctx context.Context, id string, phase models.EnvironmentPhase) error {
+	_, err := db.ExecContext(ctx, "UPDATE environments SET phase = $1, version = version + 1, updated_at = $2 WHERE id = $3", string(phase), changeTime(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update environment phase: %w", err)
+	}
+	return nil
+}
+
+// UpdateEnvironmentImage records the image an environment runs (set once its build succeeds)
+func (db *DB) UpdateEnvironmentImage(ctx context.Context, id, image string) error {
+	_, err := db.ExecContext(ctx, "UPDATE environments SET image = $1, version = version + 1, updated_at = $2 WHERE id = $3", image, changeTime(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update environment image: %w", err)
+	}
+	return nil
+}
+
+// UpdateEnvironmentCordon records whether an environment is cordoned, with the reason and when
+// it was cordoned
+func (db *DB) UpdateEnvironmentCordon(ctx context.Context, id string, cordoned bool, reason string, at *time.Time) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE environments SET cordoned = $1, cordon_reason = $2, cordoned_at = $3, version = version + 1, updated_at = $4 WHERE id = $5",
+		cordoned, nullIfEmpty(reason), at, changeTime(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update environment cordon: %w", err)
+	}
+	return nil
+}
+
+// UpdateEnvironmentActivity records when an environment was last used
+func (db *DB) UpdateEnvironmentActivity(ctx context.Context, id string, at time.Time) error {
+	_, err := db.ExecContext(ctx, "UPDATE environments SET last_activity_at = $1, version = version + 1, updated_at = $2 WHERE id = $3", at, changeTime(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update environment activity: %w", err)
+	}
+	return nil
+}
+
 // UpdateEnvironmentReconciliationState updates retry count and last error for an environment
 func (db *DB) UpdateEnvironmentReconciliationState(ctx context.Context, id string, retryCount int, lastError string, lastAt *time.Time) error {
-	query := "UPDATE environments SET reconciliation_retry_count = $1, last_reconciliation_error = $2, last_reconciliation_at = $3 WHERE id = $4"
-	_, err := db.ExecContext(ctx, query, retryCount, nullIfEmpty(lastError), lastAt, id)
+	query := `UPDATE environments SET reconciliation_retry_count = $1, last_reconciliation_error = $2, last_reconciliation_at = $3,
+		version = version + 1, updated_at = $4 WHERE id = $5`
+	_, err := db.ExecContext(ctx, query, retryCount, nullIfEmpty(lastError), lastAt, changeTime(), id)
 	if err != nil {
 		return fmt.Errorf("failed to update environment reconciliation state: %w", err)
 	}
 	return nil
 }
 
+// CountEnvironmentsByTeam returns how many environments belong to a team (for per-team quotas)
+func (db *DB) CountEnvironmentsByTeam(ctx context.Context, teamID string) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM environments WHERE team_id = $1", teamID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count team environments: %w", err)
+	}
+	return count, nil
+}
+
 // LoadAllEnvironments loads all environments from the database (for startup recovery)
 func (db *DB) LoadAllEnvironments(ctx context.Context) ([]*models.Environment, error) {
 	// Use a large limit to get all environments
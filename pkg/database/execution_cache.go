@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ExecutionCacheEntry maps an execution cache key to the finished execution holding the result
+type ExecutionCacheEntry struct {
+	Key           string
+	EnvironmentID string
+	ExecutionID   string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// SaveExecutionCacheEntry stores a cache entry, replacing any entry with the same key
+func (db *DB) SaveExecutionCacheEntry(ctx context.Context, entry *ExecutionCacheEntry) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO execution_cache (cache_key, environment_id, execution_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (cache_key) DO UPDATE SET
+			execution_id = EXCLUDED.execution_id,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+	`, entry.Key, entry.EnvironmentID, entry.ExecutionID, entry.CreatedAt, entry.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to save execution cache entry: %w", err)
+	}
+	return nil
+}
+
+// LookupExecutionCache returns the ID of the execution cached under key, or "" when there is no
+// entry or it expired before now
+func (db *DB) LookupExecutionCache(ctx context.Context, key string, now time.Time) (string, error) {
+	var execID string
+	err := db.QueryRowContext(ctx, `
+		SELECT execution_id FROM execution_cache WHERE cache_key = $1 AND expires_at > $2
+	`, key, now).Scan(&execID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up execution cache: %w", err)
+	}
+	return execID, nil
+}
+
+// DeleteExecutionCacheForEnvironment removes all cache entries of an environment and returns
+// how many were removed
+func (db *DB) DeleteExecutionCacheForEnvironment(ctx context.Context, envID string) (int64, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM execution_cache WHERE environment_id = $1", envID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to invalidate execution cache: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredExecutionCache removes cache entries that expired before now and returns how many
+// were removed
+func (db *DB) DeleteExpiredExecutionCache(ctx context.Context, now time.Time) (int64, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM execution_cache WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired execution cache entries: %w", err)
+	}
+	return result.RowsAffected()
+}
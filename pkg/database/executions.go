@@ -5,12 +5,25 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/models"
 )
 
+// executionColumns is the column list used by all execution SELECTs (see scanExecution)
+const executionColumns = `id, environment_id, user_id, command, env_vars, status, pod_name, namespace,
+			created_at, queued_at, started_at, completed_at,
+			exit_code, stdout, stderr, error, duration_ms, served_from_pool,
+			stdout_bytes_total, stderr_bytes_total, output_truncated,
+			effective_image, effective_resources, callback,
+			execution_mode, pod_scheduled_at, pod_started_at,
+			input_files, error_code, cache_enabled, cached_from, events,
+			cpu_seconds, max_memory_bytes, metadata, submission, requeued_from`
+
 // SaveExecution saves an execution to the database
 func (db *DB) SaveExecution(ctx context.Context, exec *models.Execution) error {
 	// Serialize optional fields to JSON
@@ -22,13 +35,40 @@ func (db *DB) SaveExecution(ctx context.Context, exec *models.Execution) error {
 	if err != nil {
 		commandJSON = []byte("[]")
 	}
+	var effectiveResources interface{}
+	if exec.EffectiveResources != nil {
+		if resourcesJSON, err := json.Marshal(exec.EffectiveResources); err == nil {
+			effectiveResources = string(resourcesJSON)
+		}
+	}
+	var callback interface{}
+	if exec.Callback != nil {
+		if callbackJSON, err := json.Marshal(exec.Callback); err == nil {
+			callback = string(callbackJSON)
+		}
+	}
+	var inputFiles interface{}
+	if len(exec.Files) > 0 {
+		if filesJSON, err := json.Marshal(exec.Files); err == nil {
+			inputFiles = string(filesJSON)
+		}
+	}
+	var events interface{}
+	if len(exec.Events) > 0 {
+		if eventsJSON, err := json.Marshal(exec.Events); err == nil {
+			events = string(eventsJSON)
+		}
+	}
+	var submission interface{}
+	if exec.Submission != nil {
+		if submissionJSON, err := json.Marshal(exec.Submission); err == nil {
+			submission = string(submissionJSON)
+		}
+	}
 
 	query := `
-		INSERT INTO executions (
-			id, environment_id, user_id, command, env_vars, status, pod_name, namespace,
-			created_at, queued_at, started_at, completed_at,
-			exit_code, stdout, stderr, error, duration_ms
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		INSERT INTO executions (` + executionColumns + `, command_text
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38)
 		ON CONFLICT (id) DO UPDATE SET
 			status = EXCLUDED.status,
 			queued_at = EXCLUDED.queued_at,
@@ -40,14 +80,36 @@ func (db *DB) SaveExecution(ctx context.Context, exec *models.Execution) error {
 			error = EXCLUDED.error,
 			duration_ms = EXCLUDED.duration_ms,
 			pod_name = EXCLUDED.pod_name,
-			namespace = EXCLUDED.namespace
+			namespace = EXCLUDED.namespace,
+			served_from_pool = EXCLUDED.served_from_pool,
+			stdout_bytes_total = EXCLUDED.stdout_bytes_total,
+			stderr_bytes_total = EXCLUDED.stderr_bytes_total,
+			output_truncated = EXCLUDED.output_truncated,
+			effective_image = EXCLUDED.effective_image,
+			effective_resources = EXCLUDED.effective_resources,
+			callback = EXCLUDED.callback,
+			execution_mode = EXCLUDED.execution_mode,
+			pod_scheduled_at = EXCLUDED.pod_scheduled_at,
+			pod_started_at = EXCLUDED.pod_started_at,
+			error_code = EXCLUDED.error_code,
+			events = EXCLUDED.events,
+			cpu_seconds = EXCLUDED.cpu_seconds,
+			max_memory_bytes = EXCLUDED.max_memory_bytes,
+			metadata = EXCLUDED.metadata
 	`
 
 	_, err = db.ExecContext(ctx, query,
 		exec.ID, exec.EnvironmentID, exec.UserID, string(commandJSON), string(envVarsJSON),
 		string(exec.Status), exec.PodName, exec.Namespace,
 		exec.CreatedAt, exec.QueuedAt, exec.StartedAt, exec.CompletedAt,
-		exec.ExitCode, exec.Stdout, exec.Stderr, exec.Error, exec.DurationMs,
+		exec.ExitCode, exec.Stdout, exec.Stderr, exec.Error, exec.DurationMs, exec.ServedFromPool,
+		exec.StdoutBytesTotal, exec.StderrBytesTotal, exec.Truncated,
+		nullIfEmpty(exec.EffectiveImage), effectiveResources, callback,
+		nullIfEmpty(exec.Mode), exec.PodScheduledAt, exec.PodStartedAt,
+		inputFiles, nullIfEmpty(exec.ErrorCode), exec.CacheEnabled, nullIfEmpty(exec.CachedFrom), events,
+		exec.CPUSeconds, exec.MaxMemoryBytes, metadataJSON(exec.Metadata),
+		submission, nullIfEmpty(exec.RequeuedFrom),
+		strings.Join(exec.Command, " "),
 	)
 
 	if err != nil {
@@ -59,62 +121,98 @@ func (db *DB) SaveExecution(ctx context.Context, exec *models.Execution) error {
 
 // GetExecution retrieves an execution from the database
 func (db *DB) GetExecution(ctx context.Context, id string) (*models.Execution, error) {
-	var exec models.Execution
-	var statusStr string
-	var commandJSON, envVarsJSON sql.NullString
-
-	query := `
-		SELECT id, environment_id, user_id, command, env_vars, status, pod_name, namespace,
-			created_at, queued_at, started_at, completed_at,
-			exit_code, stdout, stderr, error, duration_ms
-		FROM executions
-		WHERE id = $1
-	`
-
-	err := db.QueryRowContext(ctx, query, id).Scan(
-		&exec.ID, &exec.EnvironmentID, &exec.UserID, &commandJSON, &envVarsJSON,
-		&statusStr, &exec.PodName, &exec.Namespace,
-		&exec.CreatedAt, &exec.QueuedAt, &exec.StartedAt, &exec.CompletedAt,
-		&exec.ExitCode, &exec.Stdout, &exec.Stderr, &exec.Error, &exec.DurationMs,
-	)
+	query := `SELECT ` + executionColumns + ` FROM executions WHERE id = $1`
 
+	exec, err := db.scanExecution(db.QueryRowContext(ctx, query, id))
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("execution not found: %s", id)
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeExecutionNotFound, "execution not found: %s", id)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get execution: %w", err)
 	}
 
-	exec.Status = models.ExecutionStatus(statusStr)
+	return exec, nil
+}
 
-	// Deserialize JSON fields
-	if commandJSON.Valid {
-		if err := json.Unmarshal([]byte(commandJSON.String), &exec.Command); err != nil {
-			db.logger.Warn("failed to unmarshal command", zap.Error(err), zap.String("execution_id", exec.ID))
-		}
+// ListExecutions retrieves executions for an environment from the database
+func (db *DB) ListExecutions(ctx context.Context, environmentID string, limit int) ([]*models.Execution, error) {
+	return db.ListExecutionsAfter(ctx, environmentID, nil, limit)
+}
+
+// ListExecutionsAfter returns up to limit executions of an environment ordered by (created_at, id)
+// descending, starting after the cursor (from the newest when it is nil)
+func (db *DB) ListExecutionsAfter(ctx context.Context, environmentID string, after *models.PageCursor, limit int) ([]*models.Execution, error) {
+	return db.ListExecutionsFiltered(ctx, ExecutionListFilter{EnvironmentID: environmentID}, after, limit)
+}
+
+// ExecutionListFilter selects the executions returned by ListExecutionsFiltered and
+// CountExecutions; zero fields match everything
+type ExecutionListFilter struct {
+	EnvironmentID string
+	// CommandContains matches a substring of the command line (arguments joined by spaces),
+	// case-insensitively
+	CommandContains string
+	ExitCode        *int
+	Status          models.ExecutionStatus
+	CreatedAfter    *time.Time // inclusive
+	CreatedBefore   *time.Time // exclusive
+	UserID          string
+	// Metadata matches executions whose metadata holds all of these key/value pairs
+	Metadata map[string]string
+}
+
+// where returns the WHERE clause of the filter and its arguments, numbered from $1 (driver is
+// the database's, for the metadata conditions)
+func (f ExecutionListFilter) where(driver string) (string, []interface{}) {
+	where := ` WHERE environment_id = $1`
+	args := []interface{}{f.EnvironmentID}
+	if f.CommandContains != "" {
+		args = append(args, "%"+escapeLike(strings.ToLower(f.CommandContains))+"%")
+		where += fmt.Sprintf(` AND LOWER(command_text) LIKE $%d ESCAPE '\'`, len(args))
 	}
-	if envVarsJSON.Valid {
-		if err := json.Unmarshal([]byte(envVarsJSON.String), &exec.Env); err != nil {
-			db.logger.Warn("failed to unmarshal env_vars", zap.Error(err), zap.String("execution_id", exec.ID))
-		}
+	if f.ExitCode != nil {
+		args = append(args, *f.ExitCode)
+		where += fmt.Sprintf(` AND exit_code = $%d`, len(args))
+	}
+	if f.Status != "" {
+		args = append(args, string(f.Status))
+		where += fmt.Sprintf(` AND status = $%d`, len(args))
+	}
+	if f.CreatedAfter != nil {
+		args = append(args, *f.CreatedAfter)
+		where += fmt.Sprintf(` AND created_at >= $%d`, len(args))
 	}
+	if f.CreatedBefore != nil {
+		args = append(args, *f.CreatedBefore)
+		where += fmt.Sprintf(` AND created_at < $%d`, len(args))
+	}
+	if f.UserID != "" {
+		args = append(args, f.UserID)
+		where += fmt.Sprintf(` AND user_id = $%d`, len(args))
+	}
+	metadata, args := metadataWhere(driver, f.Metadata, args)
+	return where + metadata, args
+}
 
-	return &exec, nil
+// ListExecutionsFiltered returns up to limit executions matching the filter ordered by
+// (created_at, id) descending, starting after the cursor (from the newest when it is nil)
+func (db *DB) ListExecutionsFiltered(ctx context.Context, filter ExecutionListFilter, after *models.PageCursor, limit int) ([]*models.Execution, error) {
+	return db.ListExecutionsPage(ctx, filter, after, 0, limit)
 }
 
-// ListExecutions retrieves executions for an environment from the database
-func (db *DB) ListExecutions(ctx context.Context, environmentID string, limit int) ([]*models.Execution, error) {
-	query := `
-		SELECT id, environment_id, user_id, command, env_vars, status, pod_name, namespace,
-			created_at, queued_at, started_at, completed_at,
-			exit_code, stdout, stderr, error, duration_ms
-		FROM executions
-		WHERE environment_id = $1
-		ORDER BY created_at DESC
-		LIMIT $2
-	`
+// ListExecutionsPage is ListExecutionsFiltered skipping the first offset executions after the
+// cursor
+func (db *DB) ListExecutionsPage(ctx context.Context, filter ExecutionListFilter, after *models.PageCursor, offset, limit int) ([]*models.Execution, error) {
+	where, args := filter.where(db.driver)
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		where += fmt.Sprintf(` AND (created_at, id) < ($%d, $%d)`, len(args)-1, len(args))
+	}
+	args = append(args, limit, offset)
+	query := `SELECT ` + executionColumns + ` FROM executions` + where +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
 
-	rows, err := db.QueryContext(ctx, query, environmentID, limit)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list executions: %w", err)
 	}
@@ -122,38 +220,117 @@ func (db *DB) ListExecutions(ctx context.Context, environmentID string, limit in
 
 	var executions []*models.Execution
 	for rows.Next() {
-		var exec models.Execution
-		var statusStr string
-		var commandJSON, envVarsJSON sql.NullString
-
-		err := rows.Scan(
-			&exec.ID, &exec.EnvironmentID, &exec.UserID, &commandJSON, &envVarsJSON,
-			&statusStr, &exec.PodName, &exec.Namespace,
-			&exec.CreatedAt, &exec.QueuedAt, &exec.StartedAt, &exec.CompletedAt,
-			&exec.ExitCode, &exec.Stdout, &exec.Stderr, &exec.Error, &exec.DurationMs,
-		)
+		exec, err := db.scanExecution(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan execution: %w", err)
 		}
+		executions = append(executions, exec)
+	}
+
+	return executions, rows.Err()
+}
 
-		exec.Status = models.ExecutionStatus(statusStr)
+// CountExecutions returns the number of executions matching the filter
+func (db *DB) CountExecutions(ctx context.Context, filter ExecutionListFilter) (int, error) {
+	where, args := filter.where(db.driver)
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM executions`+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count executions: %w", err)
+	}
+	return count, nil
+}
+
+// escapeLike escapes the LIKE wildcards of s (with backslash as the escape character)
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// scanExecution scans a row selected with executionColumns
+func (db *DB) scanExecution(row rowScanner) (*models.Execution, error) {
+	var exec models.Execution
+	var statusStr string
+	var commandJSON, envVarsJSON, effectiveImage, effectiveResourcesJSON, callbackJSON, mode sql.NullString
+	var inputFilesJSON, errorCode, cachedFrom, eventsJSON, metadataJSON sql.NullString
+	var submissionJSON, requeuedFrom sql.NullString
+	var cacheEnabled sql.NullBool
 
-		// Deserialize JSON fields
-		if commandJSON.Valid {
-			if err := json.Unmarshal([]byte(commandJSON.String), &exec.Command); err != nil {
-				db.logger.Warn("failed to unmarshal command", zap.Error(err), zap.String("execution_id", exec.ID))
-			}
+	err := row.Scan(
+		&exec.ID, &exec.EnvironmentID, &exec.UserID, &commandJSON, &envVarsJSON,
+		&statusStr, &exec.PodName, &exec.Namespace,
+		&exec.CreatedAt, &exec.QueuedAt, &exec.StartedAt, &exec.CompletedAt,
+		&exec.ExitCode, &exec.Stdout, &exec.Stderr, &exec.Error, &exec.DurationMs, &exec.ServedFromPool,
+		&exec.StdoutBytesTotal, &exec.StderrBytesTotal, &exec.Truncated,
+		&effectiveImage, &effectiveResourcesJSON, &callbackJSON,
+		&mode, &exec.PodScheduledAt, &exec.PodStartedAt,
+		&inputFilesJSON, &errorCode, &cacheEnabled, &cachedFrom, &eventsJSON,
+		&exec.CPUSeconds, &exec.MaxMemoryBytes, &metadataJSON,
+		&submissionJSON, &requeuedFrom,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	exec.Status = models.ExecutionStatus(statusStr)
+	exec.EffectiveImage = effectiveImage.String
+	exec.Mode = mode.String
+	exec.ErrorCode = errorCode.String
+	exec.CacheEnabled = cacheEnabled.Bool
+	exec.CachedFrom = cachedFrom.String
+	exec.Cached = cachedFrom.Valid
+	exec.RequeuedFrom = requeuedFrom.String
+
+	// Deserialize JSON fields
+	if commandJSON.Valid {
+		if err := json.Unmarshal([]byte(commandJSON.String), &exec.Command); err != nil {
+			db.logger.Warn("failed to unmarshal command", zap.Error(err), zap.String("execution_id", exec.ID))
 		}
-		if envVarsJSON.Valid {
-			if err := json.Unmarshal([]byte(envVarsJSON.String), &exec.Env); err != nil {
-				db.logger.Warn("failed to unmarshal env_vars", zap.Error(err), zap.String("execution_id", exec.ID))
-			}
+	}
+	if envVarsJSON.Valid {
+		if err := json.Unmarshal([]byte(envVarsJSON.String), &exec.Env); err != nil {
+			db.logger.Warn("failed to unmarshal env_vars", zap.Error(err), zap.String("execution_id", exec.ID))
+		}
+	}
+	if effectiveResourcesJSON.Valid {
+		if err := json.Unmarshal([]byte(effectiveResourcesJSON.String), &exec.EffectiveResources); err != nil {
+			db.logger.Warn("failed to unmarshal effective_resources", zap.Error(err), zap.String("execution_id", exec.ID))
+		}
+	}
+	if callbackJSON.Valid {
+		if err := json.Unmarshal([]byte(callbackJSON.String), &exec.Callback); err != nil {
+			db.logger.Warn("failed to unmarshal callback", zap.Error(err), zap.String("execution_id", exec.ID))
+		}
+	}
+	if inputFilesJSON.Valid {
+		if err := json.Unmarshal([]byte(inputFilesJSON.String), &exec.Files); err != nil {
+			db.logger.Warn("failed to unmarshal input_files", zap.Error(err), zap.String("execution_id", exec.ID))
+		}
+	}
+	if eventsJSON.Valid {
+		if err := json.Unmarshal([]byte(eventsJSON.String), &exec.Events); err != nil {
+			db.logger.Warn("failed to unmarshal events", zap.Error(err), zap.String("execution_id", exec.ID))
+		}
+	}
+	if metadataJSON.Valid {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &exec.Metadata); err != nil {
+			db.logger.Warn("failed to unmarshal metadata", zap.Error(err), zap.String("execution_id", exec.ID))
+		}
+	}
+	if submissionJSON.Valid {
+		if err := json.Unmarshal([]byte(submissionJSON.String), &exec.Submission); err != nil {
+			db.logger.Warn("failed to unmarshal submission", zap.Error(err), zap.String("execution_id", exec.ID))
 		}
-
-		executions = append(executions, &exec)
 	}
 
-	return executions, rows.Err()
+	return &exec, nil
+}
+
+// UpdateExecutionMetadata replaces the metadata of an execution
+func (db *DB) UpdateExecutionMetadata(ctx context.Context, id string, metadata map[string]string) error {
+	_, err := db.ExecContext(ctx, "UPDATE executions SET metadata = $1 WHERE id = $2", metadataJSON(metadata), id)
+	if err != nil {
+		return fmt.Errorf("failed to update execution metadata: %w", err)
+	}
+	return nil
 }
 
 // DeleteExecution deletes an execution from the database
@@ -168,9 +345,7 @@ func (db *DB) DeleteExecution(ctx context.Context, id string) error {
 // LoadAllExecutions loads all executions from the database (for startup recovery)
 func (db *DB) LoadAllExecutions(ctx context.Context) ([]*models.Execution, error) {
 	query := `
-		SELECT id, environment_id, user_id, command, env_vars, status, pod_name, namespace,
-			created_at, queued_at, started_at, completed_at,
-			exit_code, stdout, stderr, error, duration_ms
+		SELECT ` + executionColumns + `
 		FROM executions
 		ORDER BY created_at DESC
 	`
@@ -183,37 +358,257 @@ func (db *DB) LoadAllExecutions(ctx context.Context) ([]*models.Execution, error
 
 	var executions []*models.Execution
 	for rows.Next() {
-		var exec models.Execution
-		var statusStr string
-		var commandJSON, envVarsJSON sql.NullString
-
-		err := rows.Scan(
-			&exec.ID, &exec.EnvironmentID, &exec.UserID, &commandJSON, &envVarsJSON,
-			&statusStr, &exec.PodName, &exec.Namespace,
-			&exec.CreatedAt, &exec.QueuedAt, &exec.StartedAt, &exec.CompletedAt,
-			&exec.ExitCode, &exec.Stdout, &exec.Stderr, &exec.Error, &exec.DurationMs,
-		)
+		exec, err := db.scanExecution(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan execution: %w", err)
 		}
+		executions = append(executions, exec)
+	}
+
+	db.logger.Info("loaded executions from database", zap.Int("count", len(executions)))
+	return executions, rows.Err()
+}
+
+// terminalExecutionStatuses is the SQL list of statuses that retention is allowed to purge
+const terminalExecutionStatuses = `('completed', 'failed', 'canceled')`
+
+// notPipelineStep is the SQL condition exempting executions that run a pipeline step from
+// retention (pipelines keep their steps' execution IDs); it matches the step's JSON encoding,
+// which works alike on PostgreSQL and SQLite
+const notPipelineStep = `NOT EXISTS (
+	SELECT 1 FROM pipelines WHERE pipelines.steps LIKE '%"execution_id":"' || executions.id || '"%'
+)`
+
+// DeleteExecutionsBefore deletes finished executions created before the given time and returns the deleted IDs.
+// When environmentID is empty, executions of all environments are considered. Pipeline steps are kept.
+func (db *DB) DeleteExecutionsBefore(ctx context.Context, environmentID string, before time.Time) ([]string, error) {
+	query := `DELETE FROM executions WHERE status IN ` + terminalExecutionStatuses + ` AND created_at < $1 AND ` + notPipelineStep
+	args := []interface{}{before}
+	if environmentID != "" {
+		query += ` AND environment_id = $2`
+		args = append(args, environmentID)
+	}
+	query += ` RETURNING id`
+
+	return db.deleteExecutionsReturningIDs(ctx, query, args...)
+}
+
+// DeleteExecutionsBeyondLimit keeps the newest keep executions per environment and deletes older finished ones
+// other than pipeline steps. Returns the deleted IDs.
+func (db *DB) DeleteExecutionsBeyondLimit(ctx context.Context, keep int) ([]string, error) {
+	query := `
+		DELETE FROM executions WHERE id IN (
+			SELECT id FROM (
+				SELECT id, status,
+					ROW_NUMBER() OVER (PARTITION BY environment_id ORDER BY created_at DESC, id DESC) AS rn
+				FROM executions
+			) ranked
+			WHERE ranked.rn > $1 AND ranked.status IN ` + terminalExecutionStatuses + `
+		) AND ` + notPipelineStep + `
+		RETURNING id
+	`
+
+	return db.deleteExecutionsReturningIDs(ctx, query, keep)
+}
+
+// deleteExecutionsReturningIDs runs a DELETE ... RETURNING id statement and collects the IDs
+func (db *DB) deleteExecutionsReturningIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete executions: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan deleted execution id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ExecutionStatsFilter selects the executions aggregated by GetExecutionStats
+type ExecutionStatsFilter struct {
+	EnvironmentID string
+	From          *time.Time // inclusive
+	To            *time.Time // exclusive
+	SampleLimit   int        // max recent durations returned for percentile computation
+}
+
+// GetExecutionStats aggregates executions of an environment: counts per status, total duration,
+// pool and cache hits and the last execution time. It also returns the durations (ms) of the
+// most recent finished executions, bounded by SampleLimit, so callers can compute percentiles.
+func (db *DB) GetExecutionStats(ctx context.Context, filter ExecutionStatsFilter) (*models.ExecutionStats, []int64, error) {
+	where := ` WHERE environment_id = $1`
+	args := []interface{}{filter.EnvironmentID}
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		where += fmt.Sprintf(` AND created_at >= $%d`, len(args))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		where += fmt.Sprintf(` AND created_at < $%d`, len(args))
+	}
+
+	stats := &models.ExecutionStats{
+		EnvironmentID: filter.EnvironmentID,
+		ByStatus:      make(map[string]int),
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT status, COUNT(*), COALESCE(SUM(duration_ms), 0),
+			SUM(CASE WHEN started_at IS NOT NULL THEN 1 ELSE 0 END),
+			SUM(CASE WHEN served_from_pool THEN 1 ELSE 0 END),
+			SUM(CASE WHEN cache_enabled THEN 1 ELSE 0 END),
+			SUM(CASE WHEN cached_from IS NOT NULL THEN 1 ELSE 0 END)
+		FROM executions`+where+`
+		GROUP BY status
+	`, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to aggregate executions: %w", err)
+	}
+	defer rows.Close()
+
+	var totalDurationMs int64
+	for rows.Next() {
+		var status string
+		var count, started, poolHits, cacheLookups, cacheHits int
+		var durationMs int64
+		if err := rows.Scan(&status, &count, &durationMs, &started, &poolHits, &cacheLookups, &cacheHits); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan execution stats: %w", err)
+		}
+		stats.ByStatus[status] = count
+		stats.Total += count
+		stats.Started += started
+		stats.PoolHits += poolHits
+		stats.CacheLookups += cacheLookups
+		stats.CacheHits += cacheHits
+		totalDurationMs += durationMs
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to aggregate executions: %w", err)
+	}
+	stats.TotalExecSeconds = float64(totalDurationMs) / 1000
 
-		exec.Status = models.ExecutionStatus(statusStr)
+	modeRows, err := db.QueryContext(ctx, `
+		SELECT execution_mode, COUNT(*) FROM executions`+where+` AND execution_mode IS NOT NULL
+		GROUP BY execution_mode
+	`, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to count execution modes: %w", err)
+	}
+	defer modeRows.Close()
+	stats.ByMode = make(map[string]int)
+	for modeRows.Next() {
+		var mode string
+		var count int
+		if err := modeRows.Scan(&mode, &count); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan execution modes: %w", err)
+		}
+		stats.ByMode[mode] = count
+	}
+	if err := modeRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to count execution modes: %w", err)
+	}
+	stats.MainFallbacks = stats.ByMode[models.ExecutionModeMainFallback]
 
-		// Deserialize JSON fields
-		if commandJSON.Valid {
-			if err := json.Unmarshal([]byte(commandJSON.String), &exec.Command); err != nil {
-				db.logger.Warn("failed to unmarshal command", zap.Error(err), zap.String("execution_id", exec.ID))
-			}
+	if stats.Total > 0 {
+		var last time.Time
+		err := db.QueryRowContext(ctx, `SELECT created_at FROM executions`+where+` ORDER BY created_at DESC LIMIT 1`, args...).Scan(&last)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("failed to get last execution: %w", err)
 		}
-		if envVarsJSON.Valid {
-			if err := json.Unmarshal([]byte(envVarsJSON.String), &exec.Env); err != nil {
-				db.logger.Warn("failed to unmarshal env_vars", zap.Error(err), zap.String("execution_id", exec.ID))
-			}
+		if err == nil {
+			stats.LastExecutionAt = &last
 		}
+	}
 
-		executions = append(executions, &exec)
+	limit := filter.SampleLimit
+	if limit <= 0 {
+		limit = 1000
 	}
+	sampleArgs := append(append([]interface{}{}, args...), limit)
+	sampleRows, err := db.QueryContext(ctx, `
+		SELECT duration_ms FROM executions`+where+` AND duration_ms IS NOT NULL
+		ORDER BY created_at DESC
+		LIMIT `+fmt.Sprintf("$%d", len(sampleArgs)), sampleArgs...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sample execution durations: %w", err)
+	}
+	defer sampleRows.Close()
 
-	db.logger.Info("loaded executions from database", zap.Int("count", len(executions)))
-	return executions, rows.Err()
+	var durations []int64
+	for sampleRows.Next() {
+		var d int64
+		if err := sampleRows.Scan(&d); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan execution duration: %w", err)
+		}
+		durations = append(durations, d)
+	}
+
+	return stats, durations, sampleRows.Err()
+}
+
+// ExecutionTimings are the queue and pod startup times (ms) of a sample of executions
+type ExecutionTimings struct {
+	// QueueMs is created_at → started_at of started executions
+	QueueMs []int64
+	// PodStartupMs is started_at → pod_started_at of executions that ran in their own pod
+	PodStartupMs []int64
+}
+
+// GetExecutionTimings returns the timings of the most recent started executions matching the
+// filter, bounded by SampleLimit (the durations are computed here to stay portable across
+// databases)
+func (db *DB) GetExecutionTimings(ctx context.Context, filter ExecutionStatsFilter) (*ExecutionTimings, error) {
+	args := []interface{}{filter.EnvironmentID}
+	where := ` WHERE environment_id = $1 AND started_at IS NOT NULL`
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		where += fmt.Sprintf(` AND created_at >= $%d`, len(args))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		where += fmt.Sprintf(` AND created_at < $%d`, len(args))
+	}
+	limit := filter.SampleLimit
+	if limit <= 0 {
+		limit = 1000
+	}
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT created_at, started_at, pod_started_at FROM executions`+where+`
+		ORDER BY created_at DESC
+		LIMIT `+fmt.Sprintf("$%d", len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample execution timings: %w", err)
+	}
+	defer rows.Close()
+
+	timings := &ExecutionTimings{}
+	for rows.Next() {
+		var createdAt, startedAt time.Time
+		var podStartedAt sql.NullTime
+		if err := rows.Scan(&createdAt, &startedAt, &podStartedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan execution timings: %w", err)
+		}
+		timings.QueueMs = append(timings.QueueMs, nonNegativeMs(startedAt.Sub(createdAt)))
+		if podStartedAt.Valid {
+			timings.PodStartupMs = append(timings.PodStartupMs, nonNegativeMs(podStartedAt.Time.Sub(startedAt)))
+		}
+	}
+	return timings, rows.Err()
+}
+
+// nonNegativeMs converts d to milliseconds, clamping clock skew between replicas to 0
+func nonNegativeMs(d time.Duration) int64 {
+	if d < 0 {
+		return 0
+	}
+	return d.Milliseconds()
 }
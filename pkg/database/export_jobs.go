@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// exportJobColumns is the column list of export job SELECT queries (order matches scanExportJob)
+const exportJobColumns = `id, trigger_type, datasets, range_from, range_to, sink, status, attempts,
+	next_attempt_at, progress, error, created_by, created_at, started_at, completed_at`
+
+// SaveExportJob inserts an export job or updates its state and progress
+func (db *DB) SaveExportJob(ctx context.Context, job *models.ExportJob) error {
+	datasetsJSON, err := json.Marshal(job.Datasets)
+	if err != nil {
+		return fmt.Errorf("failed to encode export datasets: %w", err)
+	}
+	progressJSON, err := json.Marshal(job.Progress)
+	if err != nil {
+		return fmt.Errorf("failed to encode export progress: %w", err)
+	}
+
+	query := `
+		INSERT INTO export_jobs (` + exportJobColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (id) DO UPDATE SET
+			status = EXCLUDED.status,
+			attempts = EXCLUDED.attempts,
+			next_attempt_at = EXCLUDED.next_attempt_at,
+			progress = EXCLUDED.progress,
+			error = EXCLUDED.error,
+			started_at = EXCLUDED.started_at,
+			completed_at = EXCLUDED.completed_at
+	`
+	_, err = db.ExecContext(ctx, query,
+		job.ID, job.Trigger, string(datasetsJSON), job.From, job.To, job.Sink, string(job.Status), job.Attempts,
+		job.NextAttemptAt, string(progressJSON), nullIfEmpty(job.Error), nullIfEmpty(job.CreatedBy),
+		job.CreatedAt, job.StartedAt, job.CompletedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save export job: %w", err)
+	}
+	return nil
+}
+
+// GetExportJob retrieves an export job by ID
+func (db *DB) GetExportJob(ctx context.Context, id string) (*models.ExportJob, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+exportJobColumns+` FROM export_jobs WHERE id = $1`, id)
+	job, err := scanExportJob(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeExportNotFound, "export job not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get export job: %w", err)
+	}
+	return job, nil
+}
+
+// ListExportJobs returns up to limit export jobs, newest first; a non-empty status selects the
+// jobs in that state
+func (db *DB) ListExportJobs(ctx context.Context, status models.ExportJobStatus, limit int) ([]*models.ExportJob, error) {
+	where := ""
+	args := []interface{}{}
+	if status != "" {
+		args = append(args, string(status))
+		where = ` WHERE status = $1`
+	}
+	args = append(args, limit)
+	query := `SELECT ` + exportJobColumns + ` FROM export_jobs` + where +
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args))
+	return db.queryExportJobs(ctx, query, args...)
+}
+
+// ListUnfinishedExportJobs returns the pending and running export jobs, oldest first
+func (db *DB) ListUnfinishedExportJobs(ctx context.Context) ([]*models.ExportJob, error) {
+	query := `SELECT ` + exportJobColumns + ` FROM export_jobs
+		WHERE status IN ($1, $2) ORDER BY created_at ASC, id ASC`
+	return db.queryExportJobs(ctx, query, string(models.ExportJobPending), string(models.ExportJobRunning))
+}
+
+// HasScheduledExportJob reports whether a scheduled export job of the range starting at from exists
+func (db *DB) HasScheduledExportJob(ctx context.Context, from time.Time) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM export_jobs WHERE trigger_type = $1 AND range_from = $2`,
+		models.ExportTriggerScheduled, from).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up scheduled export job: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (db *DB) queryExportJobs(ctx context.Context, query string, args ...interface{}) ([]*models.ExportJob, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list export jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*models.ExportJob{}
+	for rows.Next() {
+		job, err := scanExportJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan export job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// scanExportJob scans one row selected with exportJobColumns
+func scanExportJob(row rowScanner) (*models.ExportJob, error) {
+	var job models.ExportJob
+	var status, datasetsJSON, progressJSON string
+	var errMsg, createdBy sql.NullString
+	var nextAttemptAt, startedAt, completedAt sql.NullTime
+	if err := row.Scan(&job.ID, &job.Trigger, &datasetsJSON, &job.From, &job.To, &job.Sink, &status, &job.Attempts,
+		&nextAttemptAt, &progressJSON, &errMsg, &createdBy, &job.CreatedAt, &startedAt, &completedAt); err != nil {
+		return nil, err
+	}
+	job.Status = models.ExportJobStatus(status)
+	job.Error = errMsg.String
+	job.CreatedBy = createdBy.String
+	if nextAttemptAt.Valid {
+		job.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	if err := json.Unmarshal([]byte(datasetsJSON), &job.Datasets); err != nil {
+		return nil, fmt.Errorf("invalid datasets of export job %s: %w", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(progressJSON), &job.Progress); err != nil {
+		return nil, fmt.Errorf("invalid progress of export job %s: %w", job.ID, err)
+	}
+	return &job, nil
+}
+
+// ========== Export Readers ==========
+
+// The export readers return up to limit records created in [from, to), oldest first by
+// (created_at, id), starting after the record identified by after (from the oldest when nil).
+// Exports page through a range with them rather than holding one query open.
+
+// ListExecutionsForExport returns a page of the executions created in [from, to)
+func (db *DB) ListExecutionsForExport(ctx context.Context, from, to time.Time, after *models.PageCursor, limit int) ([]*models.Execution, error) {
+	where, args := exportRange(from, to, after)
+	args = append(args, limit)
+	query := `SELECT ` + executionColumns + ` FROM executions` + where +
+		fmt.Sprintf(` ORDER BY created_at ASC, id ASC LIMIT $%d`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list executions for export: %w", err)
+	}
+	defer rows.Close()
+
+	var executions []*models.Execution
+	for rows.Next() {
+		exec, err := db.scanExecution(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan execution: %w", err)
+		}
+		executions = append(executions, exec)
+	}
+	return executions, rows.Err()
+}
+
+// ListEnvironmentEventsForExport returns a page of the environment events created in [from, to)
+func (db *DB) ListEnvironmentEventsForExport(ctx context.Context, from, to time.Time, after *models.PageCursor, limit int) ([]*models.EnvironmentEvent, error) {
+	where, args := exportRange(from, to, after)
+	args = append(args, limit)
+	query := `SELECT id, environment_id, event_type, message, COALESCE(details, ''), created_at
+		FROM environment_events` + where +
+		fmt.Sprintf(` ORDER BY created_at ASC, id ASC LIMIT $%d`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment events for export: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*models.EnvironmentEvent
+	for rows.Next() {
+		var e models.EnvironmentEvent
+		if err := rows.Scan(&e.ID, &e.EnvironmentID, &e.EventType, &e.Message, &e.Details, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan environment event: %w", err)
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+// ListAuditEntriesForExport returns a page of the audit log entries created in [from, to)
+func (db *DB) ListAuditEntriesForExport(ctx context.Context, from, to time.Time, after *models.PageCursor, limit int) ([]*models.AuditEntry, error) {
+	where, args := exportRange(from, to, after)
+	args = append(args, limit)
+	query := `SELECT id, action, COALESCE(actor_id, ''), COALESCE(resource_type, ''), COALESCE(resource_id, ''),
+			message, COALESCE(details, ''), COALESCE(client_ip, ''), created_at, COALESCE(impersonator_id, '')
+		FROM audit_log` + where +
+		fmt.Sprintf(` ORDER BY created_at ASC, id ASC LIMIT $%d`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit entries for export: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*models.AuditEntry
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(&e.ID, &e.Action, &e.ActorID, &e.ResourceType, &e.ResourceID,
+			&e.Message, &e.Details, &e.ClientIP, &e.CreatedAt, &e.ImpersonatorID); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// exportRange returns the WHERE clause selecting records created in [from, to) after the cursor
+func exportRange(from, to time.Time, after *models.PageCursor) (string, []interface{}) {
+	where := ` WHERE created_at >= $1 AND created_at < $2`
+	args := []interface{}{from, to}
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		where += fmt.Sprintf(` AND (created_at, id) > ($%d, $%d)`, len(args)-1, len(args))
+	}
+	return where, args
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// metadataJSON serializes environment or execution metadata for its TEXT column (NULL when
+// there is none)
+func metadataJSON(metadata map[string]string) interface{} {
+	if len(metadata) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil
+	}
+	return string(data)
+}
+
+// metadataWhere returns the conditions selecting rows whose metadata column holds every
+// key/value pair of match (exact matches), with args extended by their arguments. The JSON is
+// read in the database: jsonb on PostgreSQL, json_each on SQLite.
+func metadataWhere(driver string, match map[string]string, args []interface{}) (string, []interface{}) {
+	keys := make([]string, 0, len(match))
+	for k := range match {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var where string
+	for _, k := range keys {
+		args = append(args, k, match[k])
+		key, value := len(args)-1, len(args)
+		if driver == "postgres" {
+			where += fmt.Sprintf(` AND (metadata::jsonb ->> $%d::text) = $%d`, key, value)
+		} else {
+			where += fmt.Sprintf(` AND EXISTS (SELECT 1 FROM json_each(metadata) WHERE json_each.key = $%d AND json_each.type = 'text' AND json_each.value = $%d)`, key, value)
+		}
+	}
+	return where, args
+}
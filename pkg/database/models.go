@@ -21,15 +21,18 @@ type User struct {
 
 // APIKey represents an API key in the database
 type APIKey struct {
-	ID          string
-	UserID      string
-	KeyHash     string
-	KeyPrefix   string
-	Description sql.NullString
-	LastUsed    sql.NullTime
-	CreatedAt   time.Time
-	ExpiresAt   sql.NullTime
-	RevokedAt   sql.NullTime
+	ID           string
+	UserID       string
+	KeyHash      string
+	KeyPrefix    string
+	Name         sql.NullString
+	Description  sql.NullString
+	AllowedCIDRs sql.NullString // JSON array
+	LastUsed     sql.NullTime
+	LastUsedIP   sql.NullString
+	CreatedAt    time.Time
+	ExpiresAt    sql.NullTime
+	RevokedAt    sql.NullTime
 }
 
 // EnvironmentPermission represents environment access permissions
@@ -46,7 +49,7 @@ type EnvironmentPermission struct {
 type Metric struct {
 	ID            string
 	EnvironmentID sql.NullString
-	MetricType    string // running_sandboxes, cpu_usage, memory_usage, start_time
+	MetricType    string // running_sandboxes, cpu_usage, memory_usage, start_time, executions_purged
 	Value         float64
 	Timestamp     time.Time
 }
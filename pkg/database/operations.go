@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// operationColumns is the column list of operation SELECT queries (order matches scanOperation)
+const operationColumns = `id, type, user_id, status, results, error, created_at, completed_at`
+
+// SaveOperation inserts an operation or updates its status and results
+func (db *DB) SaveOperation(ctx context.Context, op *models.Operation) error {
+	resultsJSON, err := json.Marshal(op.Results)
+	if err != nil {
+		return fmt.Errorf("failed to encode operation results: %w", err)
+	}
+
+	query := `
+		INSERT INTO operations (` + operationColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			status = EXCLUDED.status,
+			results = EXCLUDED.results,
+			error = EXCLUDED.error,
+			completed_at = EXCLUDED.completed_at
+	`
+	_, err = db.ExecContext(ctx, query,
+		op.ID, string(op.Type), nullIfEmpty(op.UserID), string(op.Status),
+		string(resultsJSON), nullIfEmpty(op.Error), op.CreatedAt, op.CompletedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save operation: %w", err)
+	}
+	return nil
+}
+
+// GetOperation retrieves an operation by ID
+func (db *DB) GetOperation(ctx context.Context, id string) (*models.Operation, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+operationColumns+` FROM operations WHERE id = $1`, id)
+	op, err := scanOperation(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeOperationNotFound, "operation not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get operation: %w", err)
+	}
+	return op, nil
+}
+
+// scanOperation scans one row selected with operationColumns
+func scanOperation(row rowScanner) (*models.Operation, error) {
+	var op models.Operation
+	var userID, errMsg sql.NullString
+	var opType, status, resultsJSON string
+	var completedAt sql.NullTime
+	if err := row.Scan(&op.ID, &opType, &userID, &status, &resultsJSON, &errMsg, &op.CreatedAt, &completedAt); err != nil {
+		return nil, err
+	}
+	op.Type = models.OperationType(opType)
+	op.UserID = userID.String
+	op.Status = models.OperationStatus(status)
+	op.Error = errMsg.String
+	if completedAt.Valid {
+		op.CompletedAt = &completedAt.Time
+	}
+	if err := json.Unmarshal([]byte(resultsJSON), &op.Results); err != nil {
+		return nil, fmt.Errorf("invalid results of operation %s: %w", op.ID, err)
+	}
+	op.CountResults()
+	return &op, nil
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// pipelineColumns is the column list of pipeline SELECT queries (order matches scanPipeline)
+const pipelineColumns = `id, environment_id, user_id, status, max_parallel, steps, error, created_at, completed_at`
+
+// SavePipeline inserts a pipeline or updates its status and steps
+func (db *DB) SavePipeline(ctx context.Context, pipeline *models.Pipeline) error {
+	stepsJSON, err := json.Marshal(pipeline.Steps)
+	if err != nil {
+		return fmt.Errorf("failed to encode pipeline steps: %w", err)
+	}
+
+	query := `
+		INSERT INTO pipelines (` + pipelineColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			status = EXCLUDED.status,
+			steps = EXCLUDED.steps,
+			error = EXCLUDED.error,
+			completed_at = EXCLUDED.completed_at
+	`
+	_, err = db.ExecContext(ctx, query,
+		pipeline.ID, pipeline.EnvironmentID, nullIfEmpty(pipeline.UserID), string(pipeline.Status),
+		pipeline.MaxParallel, string(stepsJSON), nullIfEmpty(pipeline.Error), pipeline.CreatedAt, pipeline.CompletedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save pipeline: %w", err)
+	}
+	return nil
+}
+
+// GetPipeline retrieves a pipeline by ID
+func (db *DB) GetPipeline(ctx context.Context, id string) (*models.Pipeline, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+pipelineColumns+` FROM pipelines WHERE id = $1`, id)
+	pipeline, err := scanPipeline(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodePipelineNotFound, "pipeline not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pipeline: %w", err)
+	}
+	return pipeline, nil
+}
+
+// scanPipeline scans one row selected with pipelineColumns
+func scanPipeline(row rowScanner) (*models.Pipeline, error) {
+	var pipeline models.Pipeline
+	var userID, errMsg sql.NullString
+	var status, stepsJSON string
+	var completedAt sql.NullTime
+	if err := row.Scan(&pipeline.ID, &pipeline.EnvironmentID, &userID, &status, &pipeline.MaxParallel,
+		&stepsJSON, &errMsg, &pipeline.CreatedAt, &completedAt); err != nil {
+		return nil, err
+	}
+	pipeline.UserID = userID.String
+	pipeline.Status = models.PipelineStatus(status)
+	pipeline.Error = errMsg.String
+	if completedAt.Valid {
+		pipeline.CompletedAt = &completedAt.Time
+	}
+	if err := json.Unmarshal([]byte(stepsJSON), &pipeline.Steps); err != nil {
+		return nil, fmt.Errorf("invalid steps of pipeline %s: %w", pipeline.ID, err)
+	}
+	return &pipeline, nil
+}
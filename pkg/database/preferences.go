@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// orgPreferencesID is the key of the single organization defaults row
+const orgPreferencesID = "default"
+
+const preferenceColumns = "default_profile, notify_on_environment_failed, notify_on_execution_failed, email_critical_alerts, timezone, updated_at"
+
+// GetUserPreferences returns a user's preferences; every field is unset when the user has not
+// saved any
+func (db *DB) GetUserPreferences(ctx context.Context, userID string) (*models.UserPreferences, error) {
+	row := db.QueryRowContext(ctx, "SELECT "+preferenceColumns+" FROM user_preferences WHERE user_id = $1", userID)
+	prefs, err := scanPreferences(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user preferences: %w", err)
+	}
+	return prefs, nil
+}
+
+// SaveUserPreferences replaces a user's preferences
+func (db *DB) SaveUserPreferences(ctx context.Context, userID string, prefs *models.UserPreferences) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO user_preferences (user_id, `+preferenceColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id) DO UPDATE SET
+			default_profile = EXCLUDED.default_profile,
+			notify_on_environment_failed = EXCLUDED.notify_on_environment_failed,
+			notify_on_execution_failed = EXCLUDED.notify_on_execution_failed,
+			email_critical_alerts = EXCLUDED.email_critical_alerts,
+			timezone = EXCLUDED.timezone,
+			updated_at = EXCLUDED.updated_at
+	`, append([]interface{}{userID}, preferenceValues(prefs)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to save user preferences: %w", err)
+	}
+	return nil
+}
+
+// GetOrgPreferences returns the organization defaults; every field is unset when no admin has
+// saved any
+func (db *DB) GetOrgPreferences(ctx context.Context) (*models.UserPreferences, error) {
+	row := db.QueryRowContext(ctx, "SELECT "+preferenceColumns+" FROM org_preferences WHERE id = $1", orgPreferencesID)
+	prefs, err := scanPreferences(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization preferences: %w", err)
+	}
+	return prefs, nil
+}
+
+// SaveOrgPreferences replaces the organization defaults
+func (db *DB) SaveOrgPreferences(ctx context.Context, prefs *models.UserPreferences) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO org_preferences (id, `+preferenceColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			default_profile = EXCLUDED.default_profile,
+			notify_on_environment_failed = EXCLUDED.notify_on_environment_failed,
+			notify_on_execution_failed = EXCLUDED.notify_on_execution_failed,
+			email_critical_alerts = EXCLUDED.email_critical_alerts,
+			timezone = EXCLUDED.timezone,
+			updated_at = EXCLUDED.updated_at
+	`, append([]interface{}{orgPreferencesID}, preferenceValues(prefs)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to save organization preferences: %w", err)
+	}
+	return nil
+}
+
+// preferenceValues returns the column values of prefs in preferenceColumns order, stamping
+// UpdatedAt
+func preferenceValues(prefs *models.UserPreferences) []interface{} {
+	now := time.Now().UTC()
+	prefs.UpdatedAt = &now
+	var profile, timezone sql.NullString
+	var notifyEnv, notifyExec, emailAlerts sql.NullBool
+	if prefs.DefaultProfile != nil {
+		profile = sql.NullString{String: *prefs.DefaultProfile, Valid: true}
+	}
+	if prefs.NotifyOnEnvironmentFailed != nil {
+		notifyEnv = sql.NullBool{Bool: *prefs.NotifyOnEnvironmentFailed, Valid: true}
+	}
+	if prefs.NotifyOnExecutionFailed != nil {
+		notifyExec = sql.NullBool{Bool: *prefs.NotifyOnExecutionFailed, Valid: true}
+	}
+	if prefs.EmailCriticalAlerts != nil {
+		emailAlerts = sql.NullBool{Bool: *prefs.EmailCriticalAlerts, Valid: true}
+	}
+	if prefs.Timezone != nil {
+		timezone = sql.NullString{String: *prefs.Timezone, Valid: true}
+	}
+	return []interface{}{profile, notifyEnv, notifyExec, emailAlerts, timezone, now}
+}
+
+// scanPreferences reads a preferences row; a missing row is returned as unset preferences
+func scanPreferences(row *sql.Row) (*models.UserPreferences, error) {
+	var profile, timezone sql.NullString
+	var notifyEnv, notifyExec, emailAlerts sql.NullBool
+	var updatedAt time.Time
+	err := row.Scan(&profile, &notifyEnv, &notifyExec, &emailAlerts, &timezone, &updatedAt)
+	if err == sql.ErrNoRows {
+		return &models.UserPreferences{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefs := &models.UserPreferences{UpdatedAt: &updatedAt}
+	if profile.Valid {
+		prefs.DefaultProfile = &profile.String
+	}
+	if notifyEnv.Valid {
+		prefs.NotifyOnEnvironmentFailed = &notifyEnv.Bool
+	}
+	if notifyExec.Valid {
+		prefs.NotifyOnExecutionFailed = &notifyExec.Bool
+	}
+	if emailAlerts.Valid {
+		prefs.EmailCriticalAlerts = &emailAlerts.Bool
+	}
+	if timezone.Valid {
+		prefs.Timezone = &timezone.String
+	}
+	return prefs, nil
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// reservationColumns is the column list of reservation SELECT queries (order matches scanReservation)
+const reservationColumns = `id, name, user_id, team_id, cluster, namespace, starts_at, ends_at, environments,
+	resources, node_selector, used, status, created_at`
+
+// SaveReservation inserts a reservation or updates its status; closing it frees its slots
+func (db *DB) SaveReservation(ctx context.Context, rsv *models.Reservation) error {
+	resourcesJSON, err := json.Marshal(rsv.Resources)
+	if err != nil {
+		return fmt.Errorf("failed to encode reservation resources: %w", err)
+	}
+	nodeSelectorJSON, err := json.Marshal(rsv.NodeSelector)
+	if err != nil {
+		return fmt.Errorf("failed to encode reservation node selector: %w", err)
+	}
+
+	query := `
+		INSERT INTO reservations (id, name, user_id, team_id, cluster, namespace, starts_at, ends_at,
+			environments, resources, node_selector, used, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (id) DO UPDATE SET
+			status = EXCLUDED.status
+	`
+	_, err = db.ExecContext(ctx, query,
+		rsv.ID, rsv.Name, rsv.UserID, nullIfEmpty(rsv.TeamID), rsv.Cluster, rsv.Namespace,
+		rsv.StartsAt, rsv.EndsAt, rsv.Environments, string(resourcesJSON), string(nodeSelectorJSON),
+		rsv.Used, string(rsv.Status), rsv.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
+	// A closed reservation holds no more placeholders; Used keeps its count
+	if !rsv.Open() {
+		if _, err := db.ExecContext(ctx, `DELETE FROM reservation_slots WHERE reservation_id = $1`, rsv.ID); err != nil {
+			return fmt.Errorf("failed to delete reservation slots: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetReservation retrieves a reservation by ID
+func (db *DB) GetReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+reservationColumns+` FROM reservations WHERE id = $1`, id)
+	rsv, err := scanReservation(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeReservationNotFound, "reservation not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation: %w", err)
+	}
+	if err := db.loadReservationSlots(ctx, rsv); err != nil {
+		return nil, err
+	}
+	return rsv, nil
+}
+
+// ListReservations returns the reservations, newest first; with openOnly, only the scheduled
+// and holding ones
+func (db *DB) ListReservations(ctx context.Context, openOnly bool) ([]*models.Reservation, error) {
+	query := `SELECT ` + reservationColumns + ` FROM reservations`
+	var args []interface{}
+	if openOnly {
+		query += ` WHERE status IN ($1, $2)`
+		args = append(args, string(models.ReservationScheduled), string(models.ReservationHolding))
+	}
+	query += ` ORDER BY created_at DESC, id DESC`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reservations: %w", err)
+	}
+	defer rows.Close()
+
+	var reservations []*models.Reservation
+	for rows.Next() {
+		rsv, err := scanReservation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan reservation: %w", err)
+		}
+		reservations = append(reservations, rsv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := db.loadReservationSlots(ctx, reservations...); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// ClaimReservation takes the lowest free slot of an open reservation for an environment and
+// returns it; ok is false when every environment is used or the reservation is no longer open
+func (db *DB) ClaimReservation(ctx context.Context, id, envID string) (slot int, ok bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil || !ok {
+			//nolint:errcheck // Best effort rollback, the claim did not happen
+			tx.Rollback()
+		}
+	}()
+
+	// Counting the environment first locks the reservation's row until the slot is taken
+	var environments int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE reservations SET used = used + 1
+		WHERE id = $1 AND used < environments AND status IN ($2, $3)
+		RETURNING environments`,
+		id, string(models.ReservationScheduled), string(models.ReservationHolding)).Scan(&environments)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to claim reservation: %w", err)
+	}
+
+	taken, err := reservationSlotsTx(ctx, tx, id)
+	if err != nil {
+		return 0, false, err
+	}
+	slot = -1
+	for free := 0; free < environments; free++ {
+		if _, used := taken[free]; !used {
+			slot = free
+			break
+		}
+	}
+	if slot < 0 {
+		return 0, false, nil
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO reservation_slots (reservation_id, slot, environment_id) VALUES ($1, $2, $3)`,
+		id, slot, envID); err != nil {
+		return 0, false, fmt.Errorf("failed to take reservation slot: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return slot, true, nil
+}
+
+// ReleaseReservation gives back the slot an environment took with ClaimReservation and returns
+// it; ok is false when the environment holds no slot of the reservation
+func (db *DB) ReleaseReservation(ctx context.Context, id, envID string) (slot int, ok bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil || !ok {
+			//nolint:errcheck // Best effort rollback, nothing was released
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `DELETE FROM reservation_slots WHERE reservation_id = $1 AND environment_id = $2 RETURNING slot`,
+		id, envID).Scan(&slot)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to release reservation slot: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE reservations SET used = used - 1 WHERE id = $1 AND used > 0`, id); err != nil {
+		return 0, false, fmt.Errorf("failed to release reservation: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return slot, true, nil
+}
+
+// reservationSlotsTx returns the environments holding the slots of a reservation by slot
+func reservationSlotsTx(ctx context.Context, tx *sql.Tx, id string) (map[int]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT slot, environment_id FROM reservation_slots WHERE reservation_id = $1`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reservation slots: %w", err)
+	}
+	defer rows.Close()
+	return scanReservationSlots(rows)
+}
+
+// loadReservationSlots sets the slots of the open reservations among rsvs
+func (db *DB) loadReservationSlots(ctx context.Context, rsvs ...*models.Reservation) error {
+	for _, rsv := range rsvs {
+		if !rsv.Open() {
+			continue
+		}
+		rows, err := db.QueryContext(ctx, `SELECT slot, environment_id FROM reservation_slots WHERE reservation_id = $1`, rsv.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list reservation slots: %w", err)
+		}
+		slots, err := scanReservationSlots(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		rsv.Slots = slots
+	}
+	return nil
+}
+
+// scanReservationSlots scans slot, environment_id rows
+func scanReservationSlots(rows *sql.Rows) (map[int]string, error) {
+	slots := make(map[int]string)
+	for rows.Next() {
+		var slot int
+		var envID string
+		if err := rows.Scan(&slot, &envID); err != nil {
+			return nil, fmt.Errorf("failed to scan reservation slot: %w", err)
+		}
+		slots[slot] = envID
+	}
+	return slots, rows.Err()
+}
+
+// scanReservation scans one row selected with reservationColumns
+func scanReservation(row rowScanner) (*models.Reservation, error) {
+	var rsv models.Reservation
+	var teamID, nodeSelectorJSON sql.NullString
+	var resourcesJSON, status string
+	if err := row.Scan(&rsv.ID, &rsv.Name, &rsv.UserID, &teamID, &rsv.Cluster, &rsv.Namespace,
+		&rsv.StartsAt, &rsv.EndsAt, &rsv.Environments, &resourcesJSON, &nodeSelectorJSON,
+		&rsv.Used, &status, &rsv.CreatedAt); err != nil {
+		return nil, err
+	}
+	rsv.TeamID = teamID.String
+	rsv.Status = models.ReservationStatus(status)
+	if err := json.Unmarshal([]byte(resourcesJSON), &rsv.Resources); err != nil {
+		return nil, fmt.Errorf("invalid resources of reservation %s: %w", rsv.ID, err)
+	}
+	if nodeSelectorJSON.Valid {
+		if err := json.Unmarshal([]byte(nodeSelectorJSON.String), &rsv.NodeSelector); err != nil {
+			return nil, fmt.Errorf("invalid node selector of reservation %s: %w", rsv.ID, err)
+		}
+	}
+	return &rsv, nil
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// SearchFilter selects the environments and executions returned by SearchEnvironments and
+// SearchExecutions
+type SearchFilter struct {
+	// Query is matched case-insensitively as a substring (a prefix of IDs)
+	Query string
+	// ViewerID restricts the results to the environments the user has a permission on or whose
+	// team the user is a member of, and their executions; "" returns all of them
+	ViewerID string
+}
+
+// visibleWhere returns the condition restricting environments (their id and team_id columns)
+// to the viewer's, with args extended by its argument
+func (f SearchFilter) visibleWhere(args []interface{}) (string, []interface{}) {
+	if f.ViewerID == "" {
+		return "", args
+	}
+	args = append(args, f.ViewerID)
+	n := len(args)
+	return fmt.Sprintf(` AND (id IN (SELECT environment_id FROM environment_permissions WHERE user_id = $%d)`+
+		` OR team_id IN (SELECT team_id FROM team_members WHERE user_id = $%d))`, n, n), args
+}
+
+// jsonKeysOrValuesLike returns the condition matching rows whose column (a JSON object) has a
+// key or value LIKE the pattern argument $n, case-insensitively. The JSON is read in the
+// database: jsonb on PostgreSQL, json_each on SQLite.
+func jsonKeysOrValuesLike(driver, column string, n int) string {
+	if driver == "postgres" {
+		return fmt.Sprintf(`EXISTS (SELECT 1 FROM jsonb_each_text(CASE WHEN jsonb_typeof(%[1]s::jsonb) = 'object' THEN %[1]s::jsonb ELSE '{}'::jsonb END) AS kv`+
+			` WHERE LOWER(kv.key) LIKE $%[2]d ESCAPE '\' OR LOWER(kv.value) LIKE $%[2]d ESCAPE '\')`, column, n)
+	}
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM json_each(%[1]s)`+
+		` WHERE LOWER(json_each.key) LIKE $%[2]d ESCAPE '\' OR (json_each.type = 'text' AND LOWER(json_each.value) LIKE $%[2]d ESCAPE '\'))`, column, n)
+}
+
+// SearchEnvironments returns up to limit environments, newest first, whose name, image, label
+// or metadata keys or values, or owner's username contain the query, or whose ID starts with
+// it. Each is returned with its owner's username ("" when the user is gone).
+func (db *DB) SearchEnvironments(ctx context.Context, filter SearchFilter, limit int) ([]*models.Environment, []string, error) {
+	query := strings.ToLower(filter.Query)
+	args := []interface{}{"%" + escapeLike(query) + "%", escapeLike(query) + "%", limit}
+	where := ` WHERE (LOWER(name) LIKE $1 ESCAPE '\' OR LOWER(image) LIKE $1 ESCAPE '\'` +
+		` OR ` + jsonKeysOrValuesLike(db.driver, "labels", 1) +
+		` OR ` + jsonKeysOrValuesLike(db.driver, "metadata", 1) +
+		` OR LOWER(id) LIKE $2 ESCAPE '\'` +
+		` OR user_id IN (SELECT id FROM users WHERE LOWER(username) LIKE $1 ESCAPE '\'))`
+	visible, args := filter.visibleWhere(args)
+
+	rows, err := db.QueryContext(ctx, `SELECT `+environmentColumns+
+		`, (SELECT username FROM users WHERE users.id = environments.user_id) FROM environments`+
+		where+visible+` ORDER BY created_at DESC, id DESC LIMIT $3`, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to search environments: %w", err)
+	}
+	defer rows.Close()
+
+	var environments []*models.Environment
+	var owners []string
+	for rows.Next() {
+		var owner sql.NullString
+		env, err := db.scanEnvironment(extraColumns{rows, []interface{}{&owner}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan environment: %w", err)
+		}
+		environments = append(environments, env)
+		owners = append(owners, owner.String)
+	}
+
+	return environments, owners, rows.Err()
+}
+
+// SearchExecutions returns up to limit executions, newest first, whose command line (arguments
+// joined by spaces) contains the query
+func (db *DB) SearchExecutions(ctx context.Context, filter SearchFilter, limit int) ([]*models.Execution, error) {
+	args := []interface{}{"%" + escapeLike(strings.ToLower(filter.Query)) + "%", limit}
+	where := ` WHERE LOWER(command_text) LIKE $1 ESCAPE '\'`
+	if visible, visibleArgs := filter.visibleWhere(args); visible != "" {
+		args = visibleArgs
+		where += ` AND environment_id IN (SELECT id FROM environments WHERE ` + strings.TrimPrefix(visible, ` AND `) + `)`
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT `+executionColumns+` FROM executions`+where+
+		` ORDER BY created_at DESC, id DESC LIMIT $2`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search executions: %w", err)
+	}
+	defer rows.Close()
+
+	var executions []*models.Execution
+	for rows.Next() {
+		exec, err := db.scanExecution(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan execution: %w", err)
+		}
+		executions = append(executions, exec)
+	}
+
+	return executions, rows.Err()
+}
+
+// extraColumns scans a row holding more columns than a scan function reads: the remaining ones
+// go to extra
+type extraColumns struct {
+	row   rowScanner
+	extra []interface{}
+}
+
+func (s extraColumns) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.extra...)...)
+}
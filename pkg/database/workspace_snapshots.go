@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// workspaceSnapshotColumns is the column list of workspace snapshot SELECT queries (order matches
+// scanWorkspaceSnapshot)
+const workspaceSnapshotColumns = `id, environment_id, path, size_bytes, trigger_type, created_at`
+
+// SaveWorkspaceSnapshot records a stored workspace snapshot
+func (db *DB) SaveWorkspaceSnapshot(ctx context.Context, snap *models.WorkspaceSnapshot) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO workspace_snapshots (`+workspaceSnapshotColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, snap.ID, snap.EnvironmentID, snap.Path, snap.SizeBytes, snap.Trigger, snap.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save workspace snapshot: %w", err)
+	}
+	return nil
+}
+
+// GetWorkspaceSnapshot retrieves a snapshot of an environment by ID
+func (db *DB) GetWorkspaceSnapshot(ctx context.Context, envID, id string) (*models.WorkspaceSnapshot, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+workspaceSnapshotColumns+` FROM workspace_snapshots
+		WHERE id = $1 AND environment_id = $2`, id, envID)
+	snap, err := scanWorkspaceSnapshot(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeSnapshotNotFound, "snapshot not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// ListWorkspaceSnapshots returns an environment's snapshots, newest first
+func (db *DB) ListWorkspaceSnapshots(ctx context.Context, envID string) ([]*models.WorkspaceSnapshot, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+workspaceSnapshotColumns+` FROM workspace_snapshots
+		WHERE environment_id = $1 ORDER BY created_at DESC, id DESC`, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workspace snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	snapshots := []*models.WorkspaceSnapshot{}
+	for rows.Next() {
+		snap, err := scanWorkspaceSnapshot(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan workspace snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, rows.Err()
+}
+
+// DeleteWorkspaceSnapshot removes a snapshot from the index
+func (db *DB) DeleteWorkspaceSnapshot(ctx context.Context, id string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM workspace_snapshots WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete workspace snapshot: %w", err)
+	}
+	return nil
+}
+
+// DeleteWorkspaceSnapshots removes all snapshots of an environment from the index
+func (db *DB) DeleteWorkspaceSnapshots(ctx context.Context, envID string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM workspace_snapshots WHERE environment_id = $1", envID); err != nil {
+		return fmt.Errorf("failed to delete workspace snapshots: %w", err)
+	}
+	return nil
+}
+
+// scanWorkspaceSnapshot scans one row selected with workspaceSnapshotColumns
+func scanWorkspaceSnapshot(row rowScanner) (*models.WorkspaceSnapshot, error) {
+	var snap models.WorkspaceSnapshot
+	if err := row.Scan(&snap.ID, &snap.EnvironmentID, &snap.Path, &snap.SizeBytes, &snap.Trigger, &snap.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
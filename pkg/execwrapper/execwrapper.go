@@ -0,0 +1,61 @@
+// Package execwrapper defines the result the exec wrapper (cmd/agentbox-wrapper) reports for the
+// command it runs in an execution pod, and the log footer it is reported in. It has no
+// dependencies, so the wrapper binary stays small.
+package execwrapper
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// FooterMarker starts the last line of a wrapped pod's log; the result follows as JSON
+const FooterMarker = "__AGENTBOX_EXEC_RESULT__"
+
+// Result is what the wrapper reports about the command it ran
+type Result struct {
+	// ExitCode is the command's exit code; 128+N when it was killed by signal N, 127 when it
+	// could not be started
+	ExitCode int `json:"exit_code"`
+	// Signal names the signal that killed the command, if any
+	Signal string `json:"signal,omitempty"`
+	// Error explains why the command could not be started
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// CPUSeconds is the user and system CPU time of the command and the children it waited for
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// MaxMemoryBytes is the peak resident set size of the command's largest process
+	MaxMemoryBytes int64 `json:"max_memory_bytes"`
+}
+
+// Footer formats the footer reporting r. It starts with a newline, so it is a line of its own
+// whatever the command wrote last.
+func Footer(r *Result) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return []byte("\n" + FooterMarker + " " + string(data) + "\n"), nil
+}
+
+// ParseFooter finds the footer at the end of a wrapped pod's log. It returns the log without the
+// footer (and the newline it starts with) and the result; ok is false when the log does not end
+// with a valid footer, e.g. when the pod was killed before the command finished.
+func ParseFooter(logs string) (rest string, result *Result, ok bool) {
+	i := strings.LastIndex(logs, FooterMarker+" ")
+	if i < 0 || (i > 0 && logs[i-1] != '\n') {
+		return logs, nil, false
+	}
+	// A TTY turns the footer's newlines into CRLF
+	line := strings.TrimRight(logs[i+len(FooterMarker)+1:], "\r\n")
+	if strings.ContainsAny(line, "\r\n") {
+		return logs, nil, false
+	}
+	var r Result
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		return logs, nil, false
+	}
+	rest = strings.TrimSuffix(strings.TrimSuffix(logs[:i], "\n"), "\r")
+	return rest, &r, true
+}
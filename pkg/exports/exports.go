@@ -0,0 +1,476 @@
+// Package exports copies executions, environment events and audit log entries to an external
+// sink (an S3-compatible bucket or a webhook) as newline-delimited JSON, for analysis and
+// retention outside the platform. Exports run as jobs over a time range: nightly for the
+// previous UTC day when enabled, or on demand. Records are read page by page and written in
+// batches; every batch is checkpointed, so a failed job is retried with backoff from where it
+// stopped and re-running a batch overwrites (S3) or repeats with the same batch number
+// (webhook) instead of duplicating records.
+package exports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// Limits of the export job listing
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// maxBackoff caps the delay before a failed job is retried
+const maxBackoff = time.Hour
+
+// idleWakeup is the longest the worker sleeps without checking for jobs
+const idleWakeup = time.Hour
+
+// Service runs export jobs in a single background worker
+type Service struct {
+	db      *database.DB
+	cfg     config.ExportConfig
+	sink    Sink
+	dailyAt time.Duration
+	logger  *zap.Logger
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewService creates an export service writing to the sink configured in cfg (exports are
+// unavailable when cfg.Sink is empty); store is the storage backend of the storage sink
+func NewService(db *database.DB, cfg config.ExportConfig, store storage.Backend, logger *zap.Logger) (*Service, error) {
+	sink, err := NewSink(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+	dailyAt, err := time.Parse("15:04", cfg.DailyAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exports daily_at %q: %w", cfg.DailyAt, err)
+	}
+	return &Service{
+		db:      db,
+		cfg:     cfg,
+		sink:    sink,
+		dailyAt: time.Duration(dailyAt.Hour())*time.Hour + time.Duration(dailyAt.Minute())*time.Minute,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// Configured reports whether exports have a sink
+func (s *Service) Configured() bool {
+	return s.sink != nil
+}
+
+// Start starts the worker running pending jobs and, when exports are enabled, scheduling the
+// nightly export. Jobs interrupted by a restart are resumed from their checkpoint.
+func (s *Service) Start(ctx context.Context) {
+	if s.sink == nil {
+		s.logger.Info("data exports disabled (no exports.sink)")
+		return
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.loop(ctx)
+	}()
+}
+
+// Stop stops the worker; a job being run is left pending and resumed on the next start
+func (s *Service) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+// CreateJob creates an on-demand export of the records created in [req.From, req.To)
+func (s *Service) CreateJob(ctx context.Context, req *models.CreateExportRequest, actorID string) (*models.ExportJob, error) {
+	if s.sink == nil {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeExportsNotConfigured, "data exports are not configured (exports.sink is empty)")
+	}
+	if req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "from and to are required and from must be before to")
+	}
+	if req.To.After(time.Now().Add(time.Minute)) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "to must not be in the future")
+	}
+	datasets := req.Datasets
+	if len(datasets) == 0 {
+		datasets = s.cfg.Datasets
+	}
+	seen := make(map[string]bool, len(datasets))
+	unique := make([]string, 0, len(datasets))
+	for _, d := range datasets {
+		if !config.ValidExportDataset(d) {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "unknown dataset: %s", d)
+		}
+		if !seen[d] {
+			seen[d] = true
+			unique = append(unique, d)
+		}
+	}
+
+	job := s.newJob(models.ExportTriggerManual, unique, req.From.UTC(), req.To.UTC(), actorID)
+	if err := s.db.SaveExportJob(ctx, job); err != nil {
+		return nil, err
+	}
+	s.logger.Info("export job created",
+		zap.String("job_id", job.ID),
+		zap.Strings("datasets", job.Datasets),
+		zap.Time("from", job.From),
+		zap.Time("to", job.To),
+	)
+	s.audit(ctx, "export.created", actorID, job, fmt.Sprintf("export of %v from %s to %s created",
+		job.Datasets, job.From.Format(time.RFC3339), job.To.Format(time.RFC3339)))
+	s.notify()
+	return job, nil
+}
+
+// GetJob returns an export job
+func (s *Service) GetJob(ctx context.Context, id string) (*models.ExportJob, error) {
+	return s.db.GetExportJob(ctx, id)
+}
+
+// ListJobs returns export jobs newest first, optionally only those in status
+func (s *Service) ListJobs(ctx context.Context, status models.ExportJobStatus, limit int) ([]*models.ExportJob, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	return s.db.ListExportJobs(ctx, status, min(limit, MaxListLimit))
+}
+
+// RetryJob re-queues a failed job; it continues from its checkpoint with a fresh set of attempts
+func (s *Service) RetryJob(ctx context.Context, id, actorID string) (*models.ExportJob, error) {
+	if s.sink == nil {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeExportsNotConfigured, "data exports are not configured (exports.sink is empty)")
+	}
+	job, err := s.db.GetExportJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != models.ExportJobFailed {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeBadRequest, "only failed export jobs can be retried (job is %s)", job.Status)
+	}
+	job.Status = models.ExportJobPending
+	job.Attempts = 0
+	job.NextAttemptAt = nil
+	job.CompletedAt = nil
+	if err := s.db.SaveExportJob(ctx, job); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, "export.retried", actorID, job, "failed export retried")
+	s.notify()
+	return job, nil
+}
+
+func (s *Service) newJob(trigger string, datasets []string, from, to time.Time, createdBy string) *models.ExportJob {
+	progress := make(map[string]*models.ExportCheckpoint, len(datasets))
+	for _, d := range datasets {
+		progress[d] = &models.ExportCheckpoint{}
+	}
+	return &models.ExportJob{
+		ID:        "export-" + uuid.New().String()[:8],
+		Trigger:   trigger,
+		Datasets:  datasets,
+		From:      from,
+		To:        to,
+		Sink:      s.cfg.Sink,
+		Status:    models.ExportJobPending,
+		Progress:  progress,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// notify wakes the worker up without blocking
+func (s *Service) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// audit writes an audit log entry about an export job; failures are only logged
+func (s *Service) audit(ctx context.Context, action, actorID string, job *models.ExportJob, message string) {
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       action,
+		ActorID:      actorID,
+		ResourceType: "export",
+		ResourceID:   job.ID,
+		Message:      message,
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry", zap.String("action", action), zap.Error(err))
+	}
+}
+
+// ========== Worker ==========
+
+// loop runs due jobs one at a time and sleeps until the next retry or nightly export is due
+func (s *Service) loop(ctx context.Context) {
+	for {
+		next := s.runDue(ctx, time.Now().UTC())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// runDue schedules the nightly export when due and runs every due job; it returns when the
+// worker should look again
+func (s *Service) runDue(ctx context.Context, now time.Time) time.Time {
+	next := now.Add(idleWakeup)
+	if s.cfg.Enabled {
+		next = s.scheduleNightly(ctx, now)
+	}
+
+	jobs, err := s.db.ListUnfinishedExportJobs(ctx)
+	if err != nil {
+		s.logger.Warn("failed to list export jobs", zap.Error(err))
+		return earliest(next, now.Add(time.Minute))
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return next
+		}
+		// Running jobs were interrupted by a restart and are resumed right away
+		if job.Status == models.ExportJobPending && job.NextAttemptAt != nil && job.NextAttemptAt.After(now) {
+			next = earliest(next, *job.NextAttemptAt)
+			continue
+		}
+		s.runJob(ctx, job)
+		if job.Status == models.ExportJobPending && job.NextAttemptAt != nil {
+			next = earliest(next, *job.NextAttemptAt)
+		}
+	}
+	return next
+}
+
+// scheduleNightly creates the export of the previous UTC day once daily_at has passed today
+// (unless it exists) and returns when the next nightly export is due
+func (s *Service) scheduleNightly(ctx context.Context, now time.Time) time.Time {
+	today := now.UTC().Truncate(24 * time.Hour)
+	runAt := today.Add(s.dailyAt)
+	if now.Before(runAt) {
+		return runAt
+	}
+
+	from := today.Add(-24 * time.Hour)
+	exists, err := s.db.HasScheduledExportJob(ctx, from)
+	if err != nil {
+		s.logger.Warn("failed to check nightly export", zap.Error(err))
+		return now.Add(time.Minute)
+	}
+	if !exists {
+		job := s.newJob(models.ExportTriggerScheduled, s.cfg.Datasets, from, today, "")
+		if err := s.db.SaveExportJob(ctx, job); err != nil {
+			s.logger.Warn("failed to create nightly export", zap.Error(err))
+			return now.Add(time.Minute)
+		}
+		s.logger.Info("nightly export scheduled", zap.String("job_id", job.ID), zap.Time("from", from))
+	}
+	return runAt.Add(24 * time.Hour)
+}
+
+// runJob runs one attempt of a job and records its outcome
+func (s *Service) runJob(ctx context.Context, job *models.ExportJob) {
+	now := time.Now().UTC()
+	job.Status = models.ExportJobRunning
+	job.Attempts++
+	job.NextAttemptAt = nil
+	if job.StartedAt == nil {
+		job.StartedAt = &now
+	}
+	if err := s.db.SaveExportJob(ctx, job); err != nil {
+		s.logger.Warn("failed to start export job", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+
+	err := s.export(ctx, job)
+	// The job outlives the worker's context, so its outcome is saved without it
+	saveCtx := context.WithoutCancel(ctx)
+	now = time.Now().UTC()
+	switch {
+	case err == nil:
+		job.Status = models.ExportJobSucceeded
+		job.Error = ""
+		job.CompletedAt = &now
+		s.logger.Info("export job succeeded", zap.String("job_id", job.ID), zap.Int("attempts", job.Attempts))
+	case ctx.Err() != nil:
+		// Stopped by shutdown: not a failed attempt
+		job.Status = models.ExportJobPending
+		job.Attempts--
+	case job.Attempts >= s.cfg.MaxAttempts:
+		job.Status = models.ExportJobFailed
+		job.Error = err.Error()
+		job.CompletedAt = &now
+		s.logger.Warn("export job failed", zap.String("job_id", job.ID), zap.Int("attempts", job.Attempts), zap.Error(err))
+	default:
+		backoff := time.Duration(s.cfg.InitialBackoffMs) * time.Millisecond
+		for i := 1; i < job.Attempts && backoff < maxBackoff; i++ {
+			backoff *= 2
+		}
+		retryAt := now.Add(min(backoff, maxBackoff))
+		job.Status = models.ExportJobPending
+		job.Error = err.Error()
+		job.NextAttemptAt = &retryAt
+		s.logger.Warn("export job attempt failed, retrying",
+			zap.String("job_id", job.ID),
+			zap.Int("attempt", job.Attempts),
+			zap.Time("retry_at", retryAt),
+			zap.Error(err),
+		)
+	}
+	if err := s.db.SaveExportJob(saveCtx, job); err != nil {
+		s.logger.Warn("failed to save export job", zap.String("job_id", job.ID), zap.Error(err))
+	}
+}
+
+// export writes the remaining batches of every dataset of the job, checkpointing after each
+func (s *Service) export(ctx context.Context, job *models.ExportJob) error {
+	if job.Progress == nil {
+		job.Progress = make(map[string]*models.ExportCheckpoint, len(job.Datasets))
+	}
+	for _, dataset := range job.Datasets {
+		cp := job.Progress[dataset]
+		if cp == nil {
+			cp = &models.ExportCheckpoint{}
+			job.Progress[dataset] = cp
+		}
+		for !cp.Done {
+			if err := s.exportBatch(ctx, job, dataset, cp); err != nil {
+				return fmt.Errorf("%s: %w", dataset, err)
+			}
+			if err := s.db.SaveExportJob(ctx, job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportBatch writes the next batch of a dataset and advances its checkpoint
+func (s *Service) exportBatch(ctx context.Context, job *models.ExportJob, dataset string, cp *models.ExportCheckpoint) error {
+	var after *models.PageCursor
+	if cp.LastCreatedAt != nil {
+		after = &models.PageCursor{CreatedAt: *cp.LastCreatedAt, ID: cp.LastID}
+	}
+	records, err := s.readPage(ctx, dataset, job.From, job.To, after, s.cfg.BatchSize)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		cp.Done = true
+		return nil
+	}
+
+	// Encode up to max_batch_bytes (always at least one record)
+	var body bytes.Buffer
+	count := 0
+	for _, rec := range records {
+		line, err := json.Marshal(rec.data)
+		if err != nil {
+			return fmt.Errorf("failed to encode record %s: %w", rec.id, err)
+		}
+		if count > 0 && int64(body.Len()+len(line)+1) > s.cfg.MaxBatchBytes {
+			break
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+		count++
+	}
+
+	batch := &Batch{
+		JobID:   job.ID,
+		Dataset: dataset,
+		Seq:     cp.Batches + 1,
+		From:    job.From,
+		Records: count,
+		Body:    body.Bytes(),
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := s.sink.Write(writeCtx, batch); err != nil {
+		return fmt.Errorf("batch %d: %w", batch.Seq, err)
+	}
+
+	last := records[count-1]
+	cp.Records += int64(count)
+	cp.Batches++
+	cp.LastCreatedAt = &last.createdAt
+	cp.LastID = last.id
+	// A short page that was written in full was the last one
+	cp.Done = len(records) < s.cfg.BatchSize && count == len(records)
+	return nil
+}
+
+// record is one exported row with its position in the (created_at, id) order
+type record struct {
+	id        string
+	createdAt time.Time
+	data      interface{}
+}
+
+// readPage reads up to limit records of a dataset created in [from, to) after the cursor
+func (s *Service) readPage(ctx context.Context, dataset string, from, to time.Time, after *models.PageCursor, limit int) ([]record, error) {
+	var records []record
+	switch dataset {
+	case config.ExportDatasetExecutions:
+		execs, err := s.db.ListExecutionsForExport(ctx, from, to, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range execs {
+			records = append(records, record{id: e.ID, createdAt: e.CreatedAt, data: e})
+		}
+	case config.ExportDatasetEnvironmentEvents:
+		events, err := s.db.ListEnvironmentEventsForExport(ctx, from, to, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			records = append(records, record{id: e.ID, createdAt: e.CreatedAt, data: e})
+		}
+	case config.ExportDatasetAuditLog:
+		entries, err := s.db.ListAuditEntriesForExport(ctx, from, to, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			records = append(records, record{id: e.ID, createdAt: e.CreatedAt, data: e})
+		}
+	default:
+		return nil, fmt.Errorf("unknown dataset: %s", dataset)
+	}
+	return records, nil
+}
+
+// earliest returns the earlier of two times
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
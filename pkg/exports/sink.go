@@ -0,0 +1,130 @@
+package exports
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// StoragePrefix is the key prefix of the storage sink's objects in the storage backend
+const StoragePrefix = "exports/"
+
+// ContentType is the media type of export batches (newline-delimited JSON)
+const ContentType = "application/x-ndjson"
+
+// Headers of a webhook batch delivery (signed like execution callbacks when a secret is set)
+const (
+	JobIDHeader   = "X-AgentBox-Export-Job"
+	DatasetHeader = "X-AgentBox-Export-Dataset"
+	BatchHeader   = "X-AgentBox-Export-Batch"
+)
+
+// Batch is one batch of exported records, encoded as newline-delimited JSON
+type Batch struct {
+	JobID   string
+	Dataset string
+	// Seq numbers the batches of a dataset from 1; a re-run batch keeps its number
+	Seq int
+	// From is the start of the job's range, used to partition object keys by day
+	From    time.Time
+	Records int
+	Body    []byte
+}
+
+// Sink receives export batches. Writing the same batch twice must not duplicate its records
+// downstream (objects are overwritten; webhook receivers can deduplicate on job, dataset and
+// batch number).
+type Sink interface {
+	Write(ctx context.Context, batch *Batch) error
+}
+
+// NewSink creates the sink configured in cfg; it returns nil when no sink is configured. store
+// is the storage backend of the storage sink.
+func NewSink(cfg config.ExportConfig, store storage.Backend) (Sink, error) {
+	client := &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second}
+	switch cfg.Sink {
+	case "":
+		return nil, nil
+	case config.ExportSinkWebhook:
+		return &webhookSink{cfg: cfg.Webhook, client: client}, nil
+	case config.ExportSinkS3:
+		s3, err := storage.NewS3(cfg.S3, client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exports s3 settings: %w", err)
+		}
+		return &objectSink{backend: s3}, nil
+	case config.ExportSinkStorage:
+		if store == nil {
+			return nil, fmt.Errorf("the exports storage sink requires a storage backend")
+		}
+		return &objectSink{backend: storage.WithPrefix(store, StoragePrefix)}, nil
+	default:
+		return nil, fmt.Errorf("unknown exports sink: %s", cfg.Sink)
+	}
+}
+
+// ========== Webhook ==========
+
+// webhookSink POSTs every batch to a URL
+type webhookSink struct {
+	cfg    config.ExportWebhookConfig
+	client *http.Client
+}
+
+func (w *webhookSink) Write(ctx context.Context, batch *Batch) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(batch.Body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	for name, value := range w.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set(JobIDHeader, batch.JobID)
+	req.Header.Set(DatasetHeader, batch.Dataset)
+	req.Header.Set(BatchHeader, strconv.Itoa(batch.Seq))
+	if w.cfg.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(orchestrator.CallbackTimestampHeader, timestamp)
+		req.Header.Set(orchestrator.CallbackSignatureHeader, orchestrator.SignCallback(w.cfg.Secret, timestamp, batch.Body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ========== Object storage ==========
+
+// objectSink uploads every batch as one object (the S3 sink, or the storage sink writing to the
+// shared storage backend)
+type objectSink struct {
+	backend storage.Backend
+}
+
+// ObjectKey returns the object key of a batch:
+// <prefix><dataset>/dt=<YYYY-MM-DD of the range start>/<job id>-<batch number>.ndjson
+func ObjectKey(prefix string, batch *Batch) string {
+	return fmt.Sprintf("%s%s/dt=%s/%s-%06d.ndjson",
+		prefix, batch.Dataset, batch.From.UTC().Format("2006-01-02"), batch.JobID, batch.Seq)
+}
+
+func (s *objectSink) Write(ctx context.Context, batch *Batch) error {
+	// The backend adds the bucket prefix
+	return s.backend.Put(ctx, ObjectKey("", batch), bytes.NewReader(batch.Body), ContentType)
+}
@@ -0,0 +1,35 @@
+// Package impersonation carries the super admin behind a request made on another user's behalf
+// (with an impersonation token) through the request's context, so that what the request records,
+// audit log entries in particular, names both the user acted as and the admin acting.
+package impersonation
+
+import "context"
+
+// contextKey is the type of the context key the impersonation is stored under
+type contextKey struct{}
+
+// Impersonation identifies the session and the admin behind an impersonated request
+type Impersonation struct {
+	SessionID string
+	AdminID   string
+}
+
+// NewContext returns a context of a request made in the given impersonation session
+func NewContext(ctx context.Context, imp *Impersonation) context.Context {
+	return context.WithValue(ctx, contextKey{}, imp)
+}
+
+// FromContext returns the impersonation stored by NewContext; ok is false for requests the user
+// made themselves
+func FromContext(ctx context.Context) (*Impersonation, bool) {
+	imp, ok := ctx.Value(contextKey{}).(*Impersonation)
+	return imp, ok && imp != nil
+}
+
+// AdminID returns the admin impersonating the user of the request in ctx, or ""
+func AdminID(ctx context.Context) string {
+	if imp, ok := FromContext(ctx); ok {
+		return imp.AdminID
+	}
+	return ""
+}
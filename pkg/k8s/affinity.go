@@ -0,0 +1,143 @@
+package k8s
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultTopologyKey spreads anti-affine pods one per node
+const defaultTopologyKey = "kubernetes.io/hostname"
+
+// Affinity is the subset of Kubernetes pod affinity AgentBox supports
+type Affinity struct {
+	RequiredNodeTerms  []NodeSelectorTerm
+	PreferredNodeTerms []PreferredNodeTerm
+	PodAntiAffinity    *PodAntiAffinity
+}
+
+// NodeSelectorTerm matches nodes satisfying all of its expressions
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement
+}
+
+// NodeSelectorRequirement matches a node label
+type NodeSelectorRequirement struct {
+	Key      string
+	Operator string // "In", "NotIn" or "Exists"
+	Values   []string
+}
+
+// PreferredNodeTerm is a weighted node term
+type PreferredNodeTerm struct {
+	Weight           int32
+	MatchExpressions []NodeSelectorRequirement
+}
+
+// PodAntiAffinity keeps pods with MatchLabels out of the same topology domain
+type PodAntiAffinity struct {
+	MatchLabels map[string]string
+	TopologyKey string
+	Required    bool
+	Weight      int32
+}
+
+// ToCoreAffinity converts an affinity to the Kubernetes format. The node selector is added to
+// every required node term: the terms are ORed, so a term without it would let the pod escape
+// the selector. Returns nil when there is nothing to constrain.
+func ToCoreAffinity(a *Affinity, nodeSelector map[string]string) *corev1.Affinity {
+	if a == nil {
+		return nil
+	}
+	var affinity corev1.Affinity
+
+	if len(a.RequiredNodeTerms) > 0 || len(a.PreferredNodeTerms) > 0 {
+		nodeAffinity := &corev1.NodeAffinity{}
+		if len(a.RequiredNodeTerms) > 0 {
+			selectorReqs := nodeSelectorRequirements(nodeSelector)
+			required := &corev1.NodeSelector{}
+			for _, term := range a.RequiredNodeTerms {
+				exprs := append(toCoreNodeSelectorRequirements(term.MatchExpressions), selectorReqs...)
+				required.NodeSelectorTerms = append(required.NodeSelectorTerms, corev1.NodeSelectorTerm{MatchExpressions: exprs})
+			}
+			nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+		}
+		for _, term := range a.PreferredNodeTerms {
+			nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+				nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+				corev1.PreferredSchedulingTerm{
+					Weight:     term.Weight,
+					Preference: corev1.NodeSelectorTerm{MatchExpressions: toCoreNodeSelectorRequirements(term.MatchExpressions)},
+				},
+			)
+		}
+		affinity.NodeAffinity = nodeAffinity
+	}
+
+	if anti := a.PodAntiAffinity; anti != nil {
+		topologyKey := anti.TopologyKey
+		if topologyKey == "" {
+			topologyKey = defaultTopologyKey
+		}
+		term := corev1.PodAffinityTerm{
+			LabelSelector: &metav1.LabelSelector{MatchLabels: anti.MatchLabels},
+			TopologyKey:   topologyKey,
+		}
+		podAntiAffinity := &corev1.PodAntiAffinity{}
+		if anti.Required {
+			podAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{term}
+		} else {
+			weight := anti.Weight
+			if weight == 0 {
+				weight = 100
+			}
+			podAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = []corev1.WeightedPodAffinityTerm{
+				{Weight: weight, PodAffinityTerm: term},
+			}
+		}
+		affinity.PodAntiAffinity = podAntiAffinity
+	}
+
+	if affinity.NodeAffinity == nil && affinity.PodAntiAffinity == nil {
+		return nil
+	}
+	return &affinity
+}
+
+// toCoreNodeSelectorRequirements converts node selector requirements ("In" is the default operator)
+func toCoreNodeSelectorRequirements(reqs []NodeSelectorRequirement) []corev1.NodeSelectorRequirement {
+	out := make([]corev1.NodeSelectorRequirement, 0, len(reqs))
+	for _, r := range reqs {
+		req := corev1.NodeSelectorRequirement{Key: r.Key, Values: r.Values}
+		switch r.Operator {
+		case "NotIn":
+			req.Operator = corev1.NodeSelectorOpNotIn
+		case "Exists":
+			req.Operator = corev1.NodeSelectorOpExists
+			req.Values = nil
+		default:
+			req.Operator = corev1.NodeSelectorOpIn
+		}
+		out = append(out, req)
+	}
+	return out
+}
+
+// nodeSelectorRequirements expresses a node selector as "In" requirements, sorted by key
+func nodeSelectorRequirements(nodeSelector map[string]string) []corev1.NodeSelectorRequirement {
+	keys := make([]string, 0, len(nodeSelector))
+	for k := range nodeSelector {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	reqs := make([]corev1.NodeSelectorRequirement, 0, len(keys))
+	for _, k := range keys {
+		reqs = append(reqs, corev1.NodeSelectorRequirement{
+			Key:      k,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{nodeSelector[k]},
+		})
+	}
+	return reqs
+}
@@ -17,8 +17,33 @@ type Client struct {
 	config    *rest.Config
 }
 
+// ClientOptions tunes the client-side rate limiter of a Client
+type ClientOptions struct {
+	// QPS is the sustained rate of API requests per second
+	QPS float32
+	// Burst is the number of requests allowed above QPS for short periods
+	Burst int
+}
+
+// DefaultClientOptions raise client-go's defaults (QPS=5, Burst=10), which are too low for
+// parallel provisioning: each environment creation needs ~5 API calls (namespace, quota,
+// network policy, pod, watch)
+var DefaultClientOptions = ClientOptions{QPS: 50, Burst: 100}
+
 // NewClient creates a new Kubernetes client
 func NewClient(kubeconfig string) (*Client, error) {
+	return NewClientForContext(kubeconfig, "")
+}
+
+// NewClientForContext creates a Kubernetes client from a kubeconfig file using the given
+// context (empty = the kubeconfig's current context). An empty kubeconfig uses in-cluster config.
+func NewClientForContext(kubeconfig, kubeContext string) (*Client, error) {
+	return NewClientWithOptions(kubeconfig, kubeContext, DefaultClientOptions)
+}
+
+// NewClientWithOptions is NewClientForContext with explicit rate limits; zero values use
+// DefaultClientOptions
+func NewClientWithOptions(kubeconfig, kubeContext string, opts ClientOptions) (*Client, error) {
 	var config *rest.Config
 	var err error
 
@@ -29,18 +54,24 @@ func NewClient(kubeconfig string) (*Client, error) {
 			return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
 		}
 	} else {
-		// Use kubeconfig file
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		// Use kubeconfig file (optionally a specific context)
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+		).ClientConfig()
 		if err != nil {
 			return nil, fmt.Errorf("failed to build config from kubeconfig: %w", err)
 		}
 	}
 
-	// Increase rate limits for parallel environment provisioning
-	// Default is QPS=5, Burst=10 which is too low for parallel requests
-	// Each environment creation needs ~5 API calls (namespace, quota, network policy, pod, watch)
-	config.QPS = 50
-	config.Burst = 100
+	config.QPS = opts.QPS
+	if config.QPS <= 0 {
+		config.QPS = DefaultClientOptions.QPS
+	}
+	config.Burst = opts.Burst
+	if config.Burst <= 0 {
+		config.Burst = DefaultClientOptions.Burst
+	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -0,0 +1,142 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultClusterName is the cluster name used when only a single cluster is configured
+const DefaultClusterName = "default"
+
+// PodMetricsClient is implemented by clients that can read pod usage from metrics-server
+type PodMetricsClient interface {
+	GetPodMetrics(ctx context.Context, namespace, podName string) (*PodMetrics, error)
+}
+
+// ClusterHealth is the last observed connectivity of a cluster
+type ClusterHealth struct {
+	Reachable bool
+	Error     string
+	CheckedAt time.Time
+}
+
+// Clusters is a named set of Kubernetes clients, one per configured cluster.
+// Cluster reachability is tracked so callers can avoid calls to clusters known to be down.
+type Clusters struct {
+	clients     map[string]ClientInterface
+	defaultName string
+
+	healthMutex sync.RWMutex
+	health      map[string]ClusterHealth
+}
+
+// NewClusters creates a cluster set; defaultName must be one of the clients
+func NewClusters(defaultName string, clients map[string]ClientInterface) (*Clusters, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("at least one cluster is required")
+	}
+	if _, ok := clients[defaultName]; !ok {
+		return nil, fmt.Errorf("default cluster %q is not configured", defaultName)
+	}
+	return &Clusters{
+		clients:     clients,
+		defaultName: defaultName,
+		health:      make(map[string]ClusterHealth),
+	}, nil
+}
+
+// SingleCluster wraps one client as a cluster set with the given name
+func SingleCluster(name string, client ClientInterface) *Clusters {
+	if name == "" {
+		name = DefaultClusterName
+	}
+	return &Clusters{
+		clients:     map[string]ClientInterface{name: client},
+		defaultName: name,
+		health:      make(map[string]ClusterHealth),
+	}
+}
+
+// DefaultName returns the name of the default cluster
+func (c *Clusters) DefaultName() string {
+	return c.defaultName
+}
+
+// Default returns the default cluster's client
+func (c *Clusters) Default() ClientInterface {
+	return c.clients[c.defaultName]
+}
+
+// Get returns the client for a cluster; an empty name means the default cluster
+func (c *Clusters) Get(name string) (ClientInterface, error) {
+	if name == "" {
+		name = c.defaultName
+	}
+	client, ok := c.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", name)
+	}
+	return client, nil
+}
+
+// Has reports whether a cluster with the given name is configured
+func (c *Clusters) Has(name string) bool {
+	_, ok := c.clients[name]
+	return ok
+}
+
+// Names returns all cluster names, sorted
+func (c *Clusters) Names() []string {
+	names := make([]string, 0, len(c.clients))
+	for name := range c.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckHealth runs a health check against a cluster and records the result
+func (c *Clusters) CheckHealth(ctx context.Context, name string) error {
+	client, err := c.Get(name)
+	if err != nil {
+		return err
+	}
+	err = client.HealthCheck(ctx)
+	c.SetHealth(name, err)
+	return err
+}
+
+// SetHealth records the outcome of a connectivity check for a cluster
+func (c *Clusters) SetHealth(name string, err error) {
+	if name == "" {
+		name = c.defaultName
+	}
+	h := ClusterHealth{Reachable: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	c.healthMutex.Lock()
+	c.health[name] = h
+	c.healthMutex.Unlock()
+}
+
+// Health returns the last recorded health of a cluster (reachable until a check fails)
+func (c *Clusters) Health(name string) ClusterHealth {
+	if name == "" {
+		name = c.defaultName
+	}
+	c.healthMutex.RLock()
+	defer c.healthMutex.RUnlock()
+	if h, ok := c.health[name]; ok {
+		return h
+	}
+	return ClusterHealth{Reachable: true}
+}
+
+// Reachable reports whether the cluster was reachable at the last check
+func (c *Clusters) Reachable(name string) bool {
+	return c.Health(name).Reachable
+}
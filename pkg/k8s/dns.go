@@ -0,0 +1,59 @@
+package k8s
+
+import (
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DNSConfig is a pod's DNS policy and resolver configuration
+type DNSConfig struct {
+	Policy      string // "ClusterFirst" (default) or "None"
+	Nameservers []string
+	Searches    []string
+	Options     []DNSOption
+}
+
+// DNSOption is a resolver option; an empty Value is omitted
+type DNSOption struct {
+	Name  string
+	Value string
+}
+
+// ToCoreDNS converts a DNS config to the pod's DNS policy and PodDNSConfig. A nil config keeps
+// the Kubernetes defaults (empty policy, nil config).
+func ToCoreDNS(d *DNSConfig) (corev1.DNSPolicy, *corev1.PodDNSConfig) {
+	if d == nil {
+		return "", nil
+	}
+	policy := corev1.DNSClusterFirst
+	if d.Policy == "None" {
+		policy = corev1.DNSNone
+	}
+	if len(d.Nameservers) == 0 && len(d.Searches) == 0 && len(d.Options) == 0 {
+		return policy, nil
+	}
+	config := &corev1.PodDNSConfig{Nameservers: d.Nameservers, Searches: d.Searches}
+	for _, o := range d.Options {
+		option := corev1.PodDNSConfigOption{Name: o.Name}
+		if o.Value != "" {
+			value := o.Value
+			option.Value = &value
+		}
+		config.Options = append(config.Options, option)
+	}
+	return policy, config
+}
+
+// dnsServerCIDR returns the single-address CIDR of a resolver IP ("" when it is not an IP)
+func dnsServerCIDR(server string) string {
+	ip := net.ParseIP(server)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return ip.String() + "/32"
+	default:
+		return ip.String() + "/128"
+	}
+}
@@ -0,0 +1,474 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ========== Fault injection (chaos testing) ==========
+//
+// FaultInjectingClient makes API calls slow or fail on purpose, so the orchestrator's fallback
+// and retry paths can be exercised against a real cluster. It is only installed when
+// kubernetes.insecure_fault_injection is set and must never be enabled in production.
+
+// Error kinds of Fault.Error. Any other text is returned as a plain error with that message.
+const (
+	// FaultQuotaExceeded is a ResourceQuota rejection (403 "exceeded quota")
+	FaultQuotaExceeded = "quota_exceeded"
+	// FaultForbidden is an admission or RBAC rejection (403)
+	FaultForbidden = "forbidden"
+	// FaultConflict is a write conflict (409)
+	FaultConflict = "conflict"
+	// FaultAlreadyExists is a create of an existing object (409)
+	FaultAlreadyExists = "already_exists"
+	// FaultNotFound is a missing object (404)
+	FaultNotFound = "not_found"
+	// FaultTimeout is a server-side timeout (504); retried as transient
+	FaultTimeout = "timeout"
+	// FaultUnavailable is an unavailable API server (503); retried as transient
+	FaultUnavailable = "unavailable"
+	// FaultDeadlineExceeded fails the call as if its context expired, e.g. WaitForPodRunning
+	// timing out
+	FaultDeadlineExceeded = "deadline_exceeded"
+)
+
+// FaultAllMethods is the Fault.Method that applies to every method without a fault of its own
+const FaultAllMethods = "*"
+
+// Fault is the latency and errors injected into the calls of one ClientInterface method
+type Fault struct {
+	// Method is a ClientInterface method name such as "CreatePod", or "*"
+	Method string `json:"method"`
+	// LatencyMs delays every call (before it is made) by this many milliseconds
+	LatencyMs int `json:"latency_ms,omitempty"`
+	// ErrorRate is the fraction of calls, 0 to 1, that fail with Error instead of being made
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	// Error is one of the Fault* kinds or a message (default: unavailable)
+	Error string `json:"error,omitempty"`
+	// Times limits how many errors are injected (0 = no limit); the fault is removed once its
+	// errors are used up and it has no latency
+	Times int `json:"times,omitempty"`
+	// Injected is how many errors were injected so far (read-only)
+	Injected int `json:"injected"`
+}
+
+// clientMethods are the names of the ClientInterface methods faults can target
+var clientMethods = func() map[string]bool {
+	t := reflect.TypeOf((*ClientInterface)(nil)).Elem()
+	methods := make(map[string]bool, t.NumMethod())
+	for i := 0; i < t.NumMethod(); i++ {
+		methods[t.Method(i).Name] = true
+	}
+	return methods
+}()
+
+// FaultInjector holds the faults of a FaultInjectingClient (or a test double). It is safe for
+// concurrent use; faults may be changed while calls are in flight.
+type FaultInjector struct {
+	mu     sync.Mutex
+	faults map[string]*Fault
+	rand   *rand.Rand
+}
+
+// NewFaultInjector creates an injector without faults; seed drives ErrorRate, so a fixed seed
+// makes the injected failures reproducible
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{faults: make(map[string]*Fault), rand: rand.New(rand.NewSource(seed))}
+}
+
+// Set adds the fault, replacing the one of the same method
+func (f *FaultInjector) Set(fault Fault) error {
+	if fault.Method != FaultAllMethods && !clientMethods[fault.Method] {
+		return fmt.Errorf("unknown method %q", fault.Method)
+	}
+	if fault.LatencyMs < 0 {
+		return fmt.Errorf("latency_ms must be >= 0")
+	}
+	if fault.ErrorRate < 0 || fault.ErrorRate > 1 {
+		return fmt.Errorf("error_rate must be between 0 and 1")
+	}
+	if fault.Times < 0 {
+		return fmt.Errorf("times must be >= 0")
+	}
+	if fault.LatencyMs == 0 && fault.ErrorRate == 0 {
+		return fmt.Errorf("a fault needs latency_ms or error_rate")
+	}
+	if fault.Error == "" {
+		fault.Error = FaultUnavailable
+	}
+	fault.Injected = 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[fault.Method] = &fault
+	return nil
+}
+
+// Remove removes the fault of method and reports whether there was one
+func (f *FaultInjector) Remove(method string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.faults[method]
+	delete(f.faults, method)
+	return ok
+}
+
+// Clear removes every fault
+func (f *FaultInjector) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[string]*Fault)
+}
+
+// List returns the faults sorted by method
+func (f *FaultInjector) List() []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	faults := make([]Fault, 0, len(f.faults))
+	for _, fault := range f.faults {
+		faults = append(faults, *fault)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Method < faults[j].Method })
+	return faults
+}
+
+// Inject applies the fault of method (or the "*" fault) to a call: it waits the fault's latency,
+// or until ctx is done, and returns the error the call must fail with, if any
+func (f *FaultInjector) Inject(ctx context.Context, method string) error {
+	latency, errKind := f.draw(method)
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if errKind == "" {
+		return nil
+	}
+	return faultError(method, errKind)
+}
+
+// draw picks the latency and, according to the error rate, the error kind of one call
+func (f *FaultInjector) draw(method string) (time.Duration, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fault, ok := f.faults[method]
+	if !ok {
+		if fault, ok = f.faults[FaultAllMethods]; !ok {
+			return 0, ""
+		}
+	}
+	latency := time.Duration(fault.LatencyMs) * time.Millisecond
+	if fault.ErrorRate == 0 || (fault.Times > 0 && fault.Injected >= fault.Times) ||
+		(fault.ErrorRate < 1 && f.rand.Float64() >= fault.ErrorRate) {
+		return latency, ""
+	}
+	fault.Injected++
+	if fault.Times > 0 && fault.Injected >= fault.Times && fault.LatencyMs == 0 {
+		delete(f.faults, fault.Method)
+	}
+	return latency, fault.Error
+}
+
+// faultError builds the error of kind the way the API server (and Client) would report it
+func faultError(method, kind string) error {
+	resource := schema.GroupResource{Resource: "pods"}
+	name := "fault-injected"
+	var err error
+	switch kind {
+	case FaultQuotaExceeded:
+		err = k8serrors.NewForbidden(resource, name,
+			errors.New("exceeded quota: agentbox-quota, requested: limits.cpu=1, used: limits.cpu=2, limited: limits.cpu=2"))
+	case FaultForbidden:
+		err = k8serrors.NewForbidden(resource, name, errors.New("denied by fault injection"))
+	case FaultConflict:
+		err = k8serrors.NewConflict(resource, name, errors.New("the object has been modified"))
+	case FaultAlreadyExists:
+		err = k8serrors.NewAlreadyExists(resource, name)
+	case FaultNotFound:
+		err = k8serrors.NewNotFound(resource, name)
+	case FaultTimeout:
+		err = k8serrors.NewServerTimeout(resource, method, 1)
+	case FaultUnavailable:
+		err = k8serrors.NewServiceUnavailable("the server is currently unable to handle the request")
+	case FaultDeadlineExceeded:
+		return fmt.Errorf("fault injected into %s: %w", method, context.DeadlineExceeded)
+	default:
+		return fmt.Errorf("fault injected into %s: %s", method, kind)
+	}
+	if method == "CreatePod" {
+		// Client.CreatePod classifies its failures; the orchestrator's fallbacks depend on it
+		return classifyCreatePodError(err, func() bool { return kind == FaultQuotaExceeded })
+	}
+	return fmt.Errorf("fault injected into %s: %w", method, err)
+}
+
+// FaultInjectingClient wraps a ClientInterface and injects the faults of its FaultInjector
+// into the calls. Wrap it in the retrying client so injected transient errors are retried like
+// real ones.
+type FaultInjectingClient struct {
+	ClientInterface
+	faults *FaultInjector
+}
+
+// Ensure FaultInjectingClient implements ClientInterface and forwards pod metrics
+var (
+	_ ClientInterface  = (*FaultInjectingClient)(nil)
+	_ PodMetricsClient = (*FaultInjectingClient)(nil)
+)
+
+// WithFaults wraps client so faults are injected into its calls
+func WithFaults(client ClientInterface, faults *FaultInjector) *FaultInjectingClient {
+	return &FaultInjectingClient{ClientInterface: client, faults: faults}
+}
+
+// Unwrap returns the wrapped client
+func (c *FaultInjectingClient) Unwrap() ClientInterface {
+	return c.ClientInterface
+}
+
+// HealthCheck injects faults into Client.HealthCheck
+func (c *FaultInjectingClient) HealthCheck(ctx context.Context) error {
+	if err := c.faults.Inject(ctx, "HealthCheck"); err != nil {
+		return err
+	}
+	return c.ClientInterface.HealthCheck(ctx)
+}
+
+// GetServerVersion injects faults into Client.GetServerVersion
+func (c *FaultInjectingClient) GetServerVersion(ctx context.Context) (string, error) {
+	if err := c.faults.Inject(ctx, "GetServerVersion"); err != nil {
+		return "", err
+	}
+	return c.ClientInterface.GetServerVersion(ctx)
+}
+
+// GetClusterCapacity injects faults into Client.GetClusterCapacity
+func (c *FaultInjectingClient) GetClusterCapacity(ctx context.Context) (int, string, string, error) {
+	if err := c.faults.Inject(ctx, "GetClusterCapacity"); err != nil {
+		return 0, "", "", err
+	}
+	return c.ClientInterface.GetClusterCapacity(ctx)
+}
+
+// GetNodeAllocatable injects faults into Client.GetNodeAllocatable
+func (c *FaultInjectingClient) GetNodeAllocatable(ctx context.Context, nodeSelector map[string]string, tolerations []Toleration) ([]NodeAllocatable, error) {
+	if err := c.faults.Inject(ctx, "GetNodeAllocatable"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.GetNodeAllocatable(ctx, nodeSelector, tolerations)
+}
+
+// CreateNamespace injects faults into Client.CreateNamespace
+func (c *FaultInjectingClient) CreateNamespace(ctx context.Context, name string, labels map[string]string) error {
+	if err := c.faults.Inject(ctx, "CreateNamespace"); err != nil {
+		return err
+	}
+	return c.ClientInterface.CreateNamespace(ctx, name, labels)
+}
+
+// DeleteNamespace injects faults into Client.DeleteNamespace
+func (c *FaultInjectingClient) DeleteNamespace(ctx context.Context, name string) error {
+	if err := c.faults.Inject(ctx, "DeleteNamespace"); err != nil {
+		return err
+	}
+	return c.ClientInterface.DeleteNamespace(ctx, name)
+}
+
+// NamespaceExists injects faults into Client.NamespaceExists
+func (c *FaultInjectingClient) NamespaceExists(ctx context.Context, name string) (bool, error) {
+	if err := c.faults.Inject(ctx, "NamespaceExists"); err != nil {
+		return false, err
+	}
+	return c.ClientInterface.NamespaceExists(ctx, name)
+}
+
+// GetNamespace injects faults into Client.GetNamespace
+func (c *FaultInjectingClient) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	if err := c.faults.Inject(ctx, "GetNamespace"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.GetNamespace(ctx, name)
+}
+
+// ListNamespaces injects faults into Client.ListNamespaces
+func (c *FaultInjectingClient) ListNamespaces(ctx context.Context, labelSelector string) (*corev1.NamespaceList, error) {
+	if err := c.faults.Inject(ctx, "ListNamespaces"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.ListNamespaces(ctx, labelSelector)
+}
+
+// UpdateNamespaceLabels injects faults into Client.UpdateNamespaceLabels
+func (c *FaultInjectingClient) UpdateNamespaceLabels(ctx context.Context, name string, add map[string]string, remove []string) error {
+	if err := c.faults.Inject(ctx, "UpdateNamespaceLabels"); err != nil {
+		return err
+	}
+	return c.ClientInterface.UpdateNamespaceLabels(ctx, name, add, remove)
+}
+
+// CreateResourceQuota injects faults into Client.CreateResourceQuota
+func (c *FaultInjectingClient) CreateResourceQuota(ctx context.Context, namespace, cpu, memory, storage string) error {
+	if err := c.faults.Inject(ctx, "CreateResourceQuota"); err != nil {
+		return err
+	}
+	return c.ClientInterface.CreateResourceQuota(ctx, namespace, cpu, memory, storage)
+}
+
+// ApplyServiceAccount injects faults into Client.ApplyServiceAccount
+func (c *FaultInjectingClient) ApplyServiceAccount(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	if err := c.faults.Inject(ctx, "ApplyServiceAccount"); err != nil {
+		return err
+	}
+	return c.ClientInterface.ApplyServiceAccount(ctx, namespace, name, annotations)
+}
+
+// CreateNetworkPolicy injects faults into Client.CreateNetworkPolicy
+func (c *FaultInjectingClient) CreateNetworkPolicy(ctx context.Context, namespace string) error {
+	if err := c.faults.Inject(ctx, "CreateNetworkPolicy"); err != nil {
+		return err
+	}
+	return c.ClientInterface.CreateNetworkPolicy(ctx, namespace)
+}
+
+// CreateNetworkPolicyWithConfig injects faults into Client.CreateNetworkPolicyWithConfig
+func (c *FaultInjectingClient) CreateNetworkPolicyWithConfig(ctx context.Context, namespace string, config *NetworkPolicyConfig) error {
+	if err := c.faults.Inject(ctx, "CreateNetworkPolicyWithConfig"); err != nil {
+		return err
+	}
+	return c.ClientInterface.CreateNetworkPolicyWithConfig(ctx, namespace, config)
+}
+
+// CreatePod injects faults into Client.CreatePod
+func (c *FaultInjectingClient) CreatePod(ctx context.Context, spec *PodSpec) error {
+	if err := c.faults.Inject(ctx, "CreatePod"); err != nil {
+		return err
+	}
+	return c.ClientInterface.CreatePod(ctx, spec)
+}
+
+// GetPod injects faults into Client.GetPod
+func (c *FaultInjectingClient) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	if err := c.faults.Inject(ctx, "GetPod"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.GetPod(ctx, namespace, name)
+}
+
+// DeletePod injects faults into Client.DeletePod
+func (c *FaultInjectingClient) DeletePod(ctx context.Context, namespace, name string, force bool) error {
+	if err := c.faults.Inject(ctx, "DeletePod"); err != nil {
+		return err
+	}
+	return c.ClientInterface.DeletePod(ctx, namespace, name, force)
+}
+
+// DeletePodWithGracePeriod injects faults into Client.DeletePodWithGracePeriod
+func (c *FaultInjectingClient) DeletePodWithGracePeriod(ctx context.Context, namespace, name string, gracePeriodSeconds int64) error {
+	if err := c.faults.Inject(ctx, "DeletePodWithGracePeriod"); err != nil {
+		return err
+	}
+	return c.ClientInterface.DeletePodWithGracePeriod(ctx, namespace, name, gracePeriodSeconds)
+}
+
+// PatchPodLabels injects faults into Client.PatchPodLabels
+func (c *FaultInjectingClient) PatchPodLabels(ctx context.Context, namespace, name string, add map[string]string, remove []string) error {
+	if err := c.faults.Inject(ctx, "PatchPodLabels"); err != nil {
+		return err
+	}
+	return c.ClientInterface.PatchPodLabels(ctx, namespace, name, add, remove)
+}
+
+// WaitForPodRunning injects faults into Client.WaitForPodRunning
+func (c *FaultInjectingClient) WaitForPodRunning(ctx context.Context, namespace, name string) error {
+	if err := c.faults.Inject(ctx, "WaitForPodRunning"); err != nil {
+		return err
+	}
+	return c.ClientInterface.WaitForPodRunning(ctx, namespace, name)
+}
+
+// WaitForPodCompletion injects faults into Client.WaitForPodCompletion
+func (c *FaultInjectingClient) WaitForPodCompletion(ctx context.Context, namespace, name string, maxLogBytes int64) (*PodCompletionResult, error) {
+	if err := c.faults.Inject(ctx, "WaitForPodCompletion"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.WaitForPodCompletion(ctx, namespace, name, maxLogBytes)
+}
+
+// ExecInPod injects faults into Client.ExecInPod
+func (c *FaultInjectingClient) ExecInPod(ctx context.Context, namespace, podName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if err := c.faults.Inject(ctx, "ExecInPod"); err != nil {
+		return err
+	}
+	return c.ClientInterface.ExecInPod(ctx, namespace, podName, command, stdin, stdout, stderr)
+}
+
+// ProbeHTTPGet injects faults into Client.ProbeHTTPGet
+func (c *FaultInjectingClient) ProbeHTTPGet(ctx context.Context, namespace, podName string, port int, path string) (int, string, error) {
+	if err := c.faults.Inject(ctx, "ProbeHTTPGet"); err != nil {
+		return 0, "", err
+	}
+	return c.ClientInterface.ProbeHTTPGet(ctx, namespace, podName, port, path)
+}
+
+// PortForward injects faults into Client.PortForward
+func (c *FaultInjectingClient) PortForward(ctx context.Context, namespace, podName string, port int, conn io.ReadWriter) error {
+	if err := c.faults.Inject(ctx, "PortForward"); err != nil {
+		return err
+	}
+	return c.ClientInterface.PortForward(ctx, namespace, podName, port, conn)
+}
+
+// GetPodLogs injects faults into Client.GetPodLogs
+func (c *FaultInjectingClient) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, timestamps bool) (string, error) {
+	if err := c.faults.Inject(ctx, "GetPodLogs"); err != nil {
+		return "", err
+	}
+	return c.ClientInterface.GetPodLogs(ctx, namespace, podName, tailLines, timestamps)
+}
+
+// StreamPodLogs injects faults into opening the stream of Client.StreamPodLogs
+func (c *FaultInjectingClient) StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow, timestamps bool) (io.ReadCloser, error) {
+	if err := c.faults.Inject(ctx, "StreamPodLogs"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.StreamPodLogs(ctx, namespace, podName, tailLines, follow, timestamps)
+}
+
+// ListPods injects faults into Client.ListPods
+func (c *FaultInjectingClient) ListPods(ctx context.Context, namespace string, labelSelector string) (*corev1.PodList, error) {
+	if err := c.faults.Inject(ctx, "ListPods"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.ListPods(ctx, namespace, labelSelector)
+}
+
+// WatchPods injects faults into starting Client.WatchPods
+func (c *FaultInjectingClient) WatchPods(ctx context.Context, labelSelector string, onList func([]PodEvent), onEvent func(PodEvent)) error {
+	if err := c.faults.Inject(ctx, "WatchPods"); err != nil {
+		return err
+	}
+	return c.ClientInterface.WatchPods(ctx, labelSelector, onList, onEvent)
+}
+
+// GetPodMetrics forwards to the wrapped client when it can read pod metrics
+func (c *FaultInjectingClient) GetPodMetrics(ctx context.Context, namespace, podName string) (*PodMetrics, error) {
+	metricsClient, ok := c.ClientInterface.(PodMetricsClient)
+	if !ok {
+		return nil, errors.New("pod metrics are not supported by this client")
+	}
+	return metricsClient.GetPodMetrics(ctx, namespace, podName)
+}
@@ -3,8 +3,11 @@ package k8s
 import (
 	"context"
 	"io"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/execwrapper"
 )
 
 // PodCompletionResult contains the result of a pod that ran to completion
@@ -12,6 +15,17 @@ type PodCompletionResult struct {
 	Phase    corev1.PodPhase
 	ExitCode int
 	Logs     string
+	// LogBytesTotal is the size of the pod's full log; when it exceeds the limit passed to
+	// WaitForPodCompletion, Logs keeps only its head and tail and LogsTruncated is set
+	LogBytesTotal int64
+	LogsTruncated bool
+	// ScheduledAt is when the pod was bound to a node, StartedAt when its container started
+	// (nil when the pod status does not report it)
+	ScheduledAt *time.Time
+	StartedAt   *time.Time
+	// Wrapper is what the exec wrapper reported about the command of a wrapped pod (nil when the
+	// pod was not wrapped or the wrapper printed no result); ExitCode is then taken from it
+	Wrapper *execwrapper.Result
 }
 
 // ClientInterface defines the interface for Kubernetes client operations
@@ -20,19 +34,29 @@ type ClientInterface interface {
 	HealthCheck(ctx context.Context) error
 	GetServerVersion(ctx context.Context) (string, error)
 	GetClusterCapacity(ctx context.Context) (int, string, string, error)
+	GetNodeAllocatable(ctx context.Context, nodeSelector map[string]string, tolerations []Toleration) ([]NodeAllocatable, error)
 	CreateNamespace(ctx context.Context, name string, labels map[string]string) error
 	DeleteNamespace(ctx context.Context, name string) error
 	NamespaceExists(ctx context.Context, name string) (bool, error)
+	GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+	ListNamespaces(ctx context.Context, labelSelector string) (*corev1.NamespaceList, error)
+	UpdateNamespaceLabels(ctx context.Context, name string, add map[string]string, remove []string) error
 	CreateResourceQuota(ctx context.Context, namespace, cpu, memory, storage string) error
+	ApplyServiceAccount(ctx context.Context, namespace, name string, annotations map[string]string) error
 	CreateNetworkPolicy(ctx context.Context, namespace string) error
 	CreateNetworkPolicyWithConfig(ctx context.Context, namespace string, config *NetworkPolicyConfig) error
 	CreatePod(ctx context.Context, spec *PodSpec) error
 	GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
 	DeletePod(ctx context.Context, namespace, name string, force bool) error
+	DeletePodWithGracePeriod(ctx context.Context, namespace, name string, gracePeriodSeconds int64) error
+	PatchPodLabels(ctx context.Context, namespace, name string, add map[string]string, remove []string) error
 	WaitForPodRunning(ctx context.Context, namespace, name string) error
-	WaitForPodCompletion(ctx context.Context, namespace, name string) (*PodCompletionResult, error)
+	WaitForPodCompletion(ctx context.Context, namespace, name string, maxLogBytes int64) (*PodCompletionResult, error)
 	ExecInPod(ctx context.Context, namespace, podName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
-	GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64) (string, error)
-	StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow bool) (io.ReadCloser, error)
+	ProbeHTTPGet(ctx context.Context, namespace, podName string, port int, path string) (int, string, error)
+	PortForward(ctx context.Context, namespace, podName string, port int, conn io.ReadWriter) error
+	GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, timestamps bool) (string, error)
+	StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow, timestamps bool) (io.ReadCloser, error)
 	ListPods(ctx context.Context, namespace string, labelSelector string) (*corev1.PodList, error)
+	WatchPods(ctx context.Context, labelSelector string, onList func([]PodEvent), onEvent func(PodEvent)) error
 }
@@ -0,0 +1,21 @@
+package k8s
+
+import (
+	"strings"
+	"time"
+)
+
+// ParseLogLine splits a pod log line requested with timestamps into its timestamp and message.
+// Kubernetes prefixes each line with an RFC3339 timestamp followed by a single space.
+// ok is false when the line has no parseable timestamp; message is then the whole line.
+func ParseLogLine(line string) (timestamp time.Time, message string, ok bool) {
+	prefix, rest, found := strings.Cut(line, " ")
+	ts, err := time.Parse(time.RFC3339Nano, prefix)
+	if err != nil {
+		return time.Time{}, line, false
+	}
+	if !found {
+		rest = ""
+	}
+	return ts, rest, true
+}
@@ -2,14 +2,47 @@ package k8s
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// namespaceHashLength is the number of hex characters of the name hash kept when a namespace
+// name has to be shortened
+const namespaceHashLength = 8
+
+// NamespaceName returns the namespace for an environment: prefix followed by the environment ID.
+// Names longer than the 63 characters Kubernetes allows are cut and end in a hash of the full
+// name, so they stay deterministic and unique.
+func NamespaceName(prefix, envID string) string {
+	name := prefix + envID
+	if len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:namespaceHashLength]
+	head := strings.TrimRight(name[:validation.DNS1123LabelMaxLength-namespaceHashLength-1], "-")
+	return head + "-" + hash
+}
+
+// ValidateNamespaceName returns an error describing why name is not a valid namespace name
+// (a DNS-1123 label), or nil
+func ValidateNamespaceName(name string) error {
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace name %q: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 // CreateNamespace creates a new namespace for an environment
 func (c *Client) CreateNamespace(ctx context.Context, name string, labels map[string]string) error {
 	ns := &corev1.Namespace{
@@ -27,6 +60,44 @@ func (c *Client) CreateNamespace(ctx context.Context, name string, labels map[st
 	return nil
 }
 
+// ListNamespaces lists the namespaces matching labelSelector (all namespaces when it is empty)
+func (c *Client) ListNamespaces(ctx context.Context, labelSelector string) (*corev1.NamespaceList, error) {
+	namespaces, err := c.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	return namespaces, nil
+}
+
+// UpdateNamespaceLabels sets the labels in add and deletes the labels in remove on a namespace,
+// leaving its other labels untouched
+func (c *Client) UpdateNamespaceLabels(ctx context.Context, name string, add map[string]string, remove []string) error {
+	patch, err := labelsPatch(add, remove)
+	if err != nil {
+		return err
+	}
+	if _, err := c.clientset.CoreV1().Namespaces().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to update namespace labels: %w", err)
+	}
+	return nil
+}
+
+// labelsPatch builds a JSON merge patch that sets the labels in add and deletes those in remove
+func labelsPatch(add map[string]string, remove []string) ([]byte, error) {
+	labels := make(map[string]interface{}, len(add)+len(remove))
+	for _, k := range remove {
+		labels[k] = nil
+	}
+	for k, v := range add {
+		labels[k] = v
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"labels": labels}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build labels patch: %w", err)
+	}
+	return patch, nil
+}
+
 // DeleteNamespace deletes a namespace and waits for it to be fully removed
 func (c *Client) DeleteNamespace(ctx context.Context, name string) error {
 	// Use Foreground propagation policy to ensure all resources are deleted
@@ -90,6 +161,19 @@ func (c *Client) NamespaceExists(ctx context.Context, name string) (bool, error)
 	return true, nil
 }
 
+// GetNamespace returns a namespace, or nil when it does not exist. A namespace being deleted is
+// returned with phase Terminating until it is gone.
+func (c *Client) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	ns, err := c.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get namespace: %w", err)
+	}
+	return ns, nil
+}
+
 // CreateResourceQuota creates resource quotas for a namespace
 func (c *Client) CreateResourceQuota(ctx context.Context, namespace, cpu, memory, storage string) error {
 	quota := &corev1.ResourceQuota{
@@ -113,3 +197,34 @@ func (c *Client) CreateResourceQuota(ctx context.Context, namespace, cpu, memory
 
 	return nil
 }
+
+// ApplyServiceAccount creates a ServiceAccount in a namespace, or replaces the annotations of an
+// existing one, so a changed annotation (e.g. another IAM role) takes effect for new pods
+func (c *Client) ApplyServiceAccount(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	accounts := c.clientset.CoreV1().ServiceAccounts(namespace)
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{"managed-by": "agentbox"},
+			Annotations: annotations,
+		},
+	}
+	_, err := accounts.Create(ctx, sa, metav1.CreateOptions{})
+	if err == nil {
+		return nil
+	}
+	if !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create service account: %w", err)
+	}
+
+	existing, err := accounts.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get service account: %w", err)
+	}
+	existing.Annotations = annotations
+	if _, err := accounts.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update service account: %w", err)
+	}
+	return nil
+}
@@ -17,6 +17,10 @@ type NetworkPolicyConfig struct {
 	AllowedEgressCIDRs   []string
 	AllowedIngressPorts  []int32
 	AllowClusterInternal bool
+	// DNSServers are resolver IPs the pods may reach on port 53
+	DNSServers []string
+	// DenyClusterDNS drops the egress rule to the cluster DNS (pods with DNS policy "None")
+	DenyClusterDNS bool
 }
 
 // CreateNetworkPolicy creates a network policy for isolation (uses default restrictive config)
@@ -37,20 +41,23 @@ func (c *Client) CreateNetworkPolicyWithConfig(ctx context.Context, namespace st
 	udpProtocol := corev1.ProtocolUDP
 	tcpProtocol := corev1.ProtocolTCP
 
-	// Start with DNS egress rule (always required)
-	egressRules := []networkingv1.NetworkPolicyEgressRule{
+	dnsPorts := []networkingv1.NetworkPolicyPort{
 		{
+			Protocol: &udpProtocol,
+			Port:     &intstr.IntOrString{Type: intstr.Int, IntVal: dnsPort},
+		},
+		{
+			Protocol: &tcpProtocol,
+			Port:     &intstr.IntOrString{Type: intstr.Int, IntVal: dnsPort},
+		},
+	}
+
+	// Start with DNS egress rule (required unless the pods resolve through their own servers)
+	var egressRules []networkingv1.NetworkPolicyEgressRule
+	if config == nil || !config.DenyClusterDNS {
+		egressRules = append(egressRules, networkingv1.NetworkPolicyEgressRule{
 			// Allow DNS to kube-dns
-			Ports: []networkingv1.NetworkPolicyPort{
-				{
-					Protocol: &udpProtocol,
-					Port:     &intstr.IntOrString{Type: intstr.Int, IntVal: dnsPort},
-				},
-				{
-					Protocol: &tcpProtocol,
-					Port:     &intstr.IntOrString{Type: intstr.Int, IntVal: dnsPort},
-				},
-			},
+			Ports: dnsPorts,
 			To: []networkingv1.NetworkPolicyPeer{
 				{
 					NamespaceSelector: &metav1.LabelSelector{
@@ -60,13 +67,31 @@ func (c *Client) CreateNetworkPolicyWithConfig(ctx context.Context, namespace st
 					},
 				},
 			},
-		},
+		})
 	}
 
 	// Build ingress rules
 	var ingressRules []networkingv1.NetworkPolicyIngressRule
 
 	if config != nil {
+		// Allow DNS to the configured resolvers
+		for _, server := range config.DNSServers {
+			cidr := dnsServerCIDR(server)
+			if cidr == "" {
+				continue
+			}
+			egressRules = append(egressRules, networkingv1.NetworkPolicyEgressRule{
+				Ports: dnsPorts,
+				To: []networkingv1.NetworkPolicyPeer{
+					{
+						IPBlock: &networkingv1.IPBlock{
+							CIDR: cidr,
+						},
+					},
+				},
+			})
+		}
+
 		// Allow internet access if enabled
 		if config.AllowInternet {
 			egressRules = append(egressRules, networkingv1.NetworkPolicyEgressRule{
@@ -0,0 +1,132 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeAllocatable describes the resources of a node pods can be scheduled on
+type NodeAllocatable struct {
+	Name string
+	// CPUMillicores and MemoryBytes are the node's allocatable resources
+	CPUMillicores int64
+	MemoryBytes   int64
+	// FreeCPUMillicores and FreeMemoryBytes are what remains after the requests of the pods on the node
+	FreeCPUMillicores int64
+	FreeMemoryBytes   int64
+}
+
+// GetNodeAllocatable returns the nodes a pod with the given node selector and tolerations can be
+// scheduled on, largest first
+func (c *Client) GetNodeAllocatable(ctx context.Context, nodeSelector map[string]string, tolerations []Toleration) ([]NodeAllocatable, error) {
+	nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	pods, err := c.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase!=Succeeded,status.phase!=Failed",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	return SchedulableNodes(nodes.Items, pods.Items, nodeSelector, tolerations), nil
+}
+
+// SchedulableNodes returns the ready, schedulable nodes whose labels match nodeSelector and whose
+// NoSchedule/NoExecute taints are all tolerated, largest first. Free resources subtract the
+// requests of the pods assigned to each node.
+func SchedulableNodes(nodes []corev1.Node, pods []corev1.Pod, nodeSelector map[string]string, tolerations []Toleration) []NodeAllocatable {
+	coreTolerations := toCoreTolerations(tolerations)
+
+	requested := make(map[string]corev1.ResourceList)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		total := requested[pod.Spec.NodeName]
+		if total == nil {
+			total = corev1.ResourceList{}
+			requested[pod.Spec.NodeName] = total
+		}
+		for _, container := range pod.Spec.Containers {
+			for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+				if q, ok := container.Resources.Requests[name]; ok {
+					sum := total[name]
+					sum.Add(q)
+					total[name] = sum
+				}
+			}
+		}
+	}
+
+	var result []NodeAllocatable
+	for i := range nodes {
+		node := &nodes[i]
+		if !nodeSchedulable(node, nodeSelector, coreTolerations) {
+			continue
+		}
+		cpu := node.Status.Allocatable[corev1.ResourceCPU]
+		memory := node.Status.Allocatable[corev1.ResourceMemory]
+		usedCPU := requested[node.Name][corev1.ResourceCPU]
+		usedMemory := requested[node.Name][corev1.ResourceMemory]
+		result = append(result, NodeAllocatable{
+			Name:              node.Name,
+			CPUMillicores:     cpu.MilliValue(),
+			MemoryBytes:       memory.Value(),
+			FreeCPUMillicores: max(cpu.MilliValue()-usedCPU.MilliValue(), 0),
+			FreeMemoryBytes:   max(memory.Value()-usedMemory.Value(), 0),
+		})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].CPUMillicores != result[j].CPUMillicores {
+			return result[i].CPUMillicores > result[j].CPUMillicores
+		}
+		return result[i].MemoryBytes > result[j].MemoryBytes
+	})
+	return result
+}
+
+// nodeSchedulable reports whether a pod with the given node selector and tolerations can be
+// placed on node
+func nodeSchedulable(node *corev1.Node, nodeSelector map[string]string, tolerations []corev1.Toleration) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	ready := false
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			ready = cond.Status == corev1.ConditionTrue
+		}
+	}
+	if !ready {
+		return false
+	}
+	for k, v := range nodeSelector {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range tolerations {
+			if tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// LimitedBuffer is an io.Writer that keeps at most limit bytes of what is written to it: the
+// first half and the most recent half. Everything in between is counted but dropped, so memory
+// stays bounded however much a command prints. It is safe for concurrent use.
+type LimitedBuffer struct {
+	mu    sync.Mutex
+	limit int64
+	head  []byte
+	tail  []byte // ring buffer holding the last bytes written once head is full
+	start int    // index of the oldest byte in tail
+	total int64
+}
+
+// NewLimitedBuffer returns a LimitedBuffer that keeps at most limit bytes (<= 0 keeps everything)
+func NewLimitedBuffer(limit int64) *LimitedBuffer {
+	return &LimitedBuffer{limit: limit}
+}
+
+// Write records p. It never fails.
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	b.total += int64(n)
+	if b.limit <= 0 {
+		b.head = append(b.head, p...)
+		return n, nil
+	}
+
+	headCap := int(b.limit / 2)
+	if room := headCap - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+	tailCap := int(b.limit) - headCap
+	if len(p) == 0 || tailCap == 0 {
+		return n, nil
+	}
+	if len(p) >= tailCap {
+		// Only the last tailCap bytes of p survive
+		b.tail = append(b.tail[:0], p[len(p)-tailCap:]...)
+		b.start = 0
+		return n, nil
+	}
+	for len(p) > 0 {
+		if len(b.tail) < tailCap {
+			room := tailCap - len(b.tail)
+			if room > len(p) {
+				room = len(p)
+			}
+			b.tail = append(b.tail, p[:room]...)
+			p = p[room:]
+			continue
+		}
+		// Full ring: overwrite the oldest bytes
+		copied := copy(b.tail[b.start:], p)
+		p = p[copied:]
+		b.start = (b.start + copied) % tailCap
+	}
+	return n, nil
+}
+
+// Total returns the number of bytes written, including dropped ones
+func (b *LimitedBuffer) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// Truncated reports whether any written bytes were dropped
+func (b *LimitedBuffer) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.truncated()
+}
+
+func (b *LimitedBuffer) truncated() bool {
+	return b.total > int64(len(b.head)+len(b.tail))
+}
+
+// String returns the kept output. When bytes were dropped, a marker giving their count separates
+// the head from the tail; a character split by the cut is dropped along with them.
+func (b *LimitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tail := make([]byte, 0, len(b.tail))
+	tail = append(tail, b.tail[b.start:]...)
+	tail = append(tail, b.tail[:b.start]...)
+	if !b.truncated() {
+		return string(b.head) + string(tail)
+	}
+
+	head := trimPartialRuneEnd(b.head)
+	tail = trimPartialRuneStart(tail)
+	dropped := b.total - int64(len(head)+len(tail))
+	out := make([]byte, 0, len(head)+len(tail)+64)
+	out = append(out, head...)
+	out = append(out, TruncationMarker(dropped)...)
+	out = append(out, tail...)
+	return string(out)
+}
+
+// trimPartialRuneEnd drops an incomplete UTF-8 sequence from the end of p
+func trimPartialRuneEnd(p []byte) []byte {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i]
+			}
+			break
+		}
+	}
+	return p
+}
+
+// trimPartialRuneStart drops the continuation bytes of a UTF-8 sequence cut off at the start of p
+func trimPartialRuneStart(p []byte) []byte {
+	for i := 0; i < len(p) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(p[i]) {
+			return p[i:]
+		}
+	}
+	return p
+}
+
+// TruncationMarker is the line inserted where dropped bytes were removed from captured output
+func TruncationMarker(dropped int64) string {
+	return fmt.Sprintf("\n... [%d bytes truncated] ...\n", dropped)
+}
@@ -5,13 +5,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/remotecommand"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
 )
 
 // Toleration represents a Kubernetes toleration
@@ -30,23 +38,60 @@ type SecurityContext struct {
 	RunAsNonRoot             *bool
 	ReadOnlyRootFilesystem   *bool
 	AllowPrivilegeEscalation *bool
+	Capabilities             *Capabilities
+	// SeccompProfile is a seccomp profile type, e.g. "RuntimeDefault" ("" = not set)
+	SeccompProfile string
+}
+
+// Capabilities lists Linux capabilities to add to and drop from a container
+type Capabilities struct {
+	Add  []string
+	Drop []string
 }
 
 // PodSpec holds pod creation parameters
 type PodSpec struct {
-	Name            string
-	Namespace       string
-	Image           string
-	Command         []string
-	Env             map[string]string
-	CPU             string
-	Memory          string
-	Storage         string
-	RuntimeClass    string
-	Labels          map[string]string
-	NodeSelector    map[string]string
-	Tolerations     []Toleration
-	SecurityContext *SecurityContext
+	Name         string
+	Namespace    string
+	Image        string
+	Command      []string
+	Env          map[string]string
+	CPU          string
+	Memory       string
+	Storage      string
+	RuntimeClass string
+	// PriorityClassName sets the pod's PriorityClass (empty = the cluster default)
+	PriorityClassName string
+	// ServiceAccountName runs the pod with a ServiceAccount of its namespace (empty = default).
+	// AutomountServiceAccountToken controls whether its API token is mounted (nil = the
+	// ServiceAccount's setting).
+	ServiceAccountName           string
+	AutomountServiceAccountToken *bool
+	Labels                       map[string]string
+	NodeSelector                 map[string]string
+	Tolerations                  []Toleration
+	Affinity                     *Affinity
+	SecurityContext              *SecurityContext
+	DNS                          *DNSConfig
+	// ScratchDirs are mounted as writable emptyDir volumes (e.g. with a read-only root filesystem)
+	ScratchDirs []string
+	// SecretMounts mount secrets read-only (e.g. registry credentials of build pods)
+	SecretMounts []SecretMount
+	// Wrapper runs Command under the exec wrapper (nil = as is)
+	Wrapper *ExecWrapper
+	// PreStop runs in the container before it is sent SIGTERM (nil = none).
+	// TerminationGracePeriodSeconds is how long the container gets to stop (nil = the cluster
+	// default).
+	PreStop                       []string
+	TerminationGracePeriodSeconds *int64
+}
+
+// SecretMount mounts the keys of a secret as files under MountPath
+type SecretMount struct {
+	SecretName string
+	MountPath  string
+	// Items maps secret keys to file names (nil = every key, under its own name)
+	Items map[string]string
 }
 
 // CreatePod creates a new pod
@@ -78,34 +123,7 @@ func (c *Client) CreatePod(ctx context.Context, spec *PodSpec) error {
 		})
 	}
 
-	// Convert tolerations to Kubernetes format
-	var tolerations []corev1.Toleration
-	for _, t := range spec.Tolerations {
-		toleration := corev1.Toleration{
-			Key:   t.Key,
-			Value: t.Value,
-		}
-		// Set operator (default to "Equal" if not specified)
-		switch t.Operator {
-		case "Exists":
-			toleration.Operator = corev1.TolerationOpExists
-		default:
-			toleration.Operator = corev1.TolerationOpEqual
-		}
-		// Set effect
-		switch t.Effect {
-		case "NoSchedule":
-			toleration.Effect = corev1.TaintEffectNoSchedule
-		case "PreferNoSchedule":
-			toleration.Effect = corev1.TaintEffectPreferNoSchedule
-		case "NoExecute":
-			toleration.Effect = corev1.TaintEffectNoExecute
-		}
-		if t.TolerationSeconds != nil {
-			toleration.TolerationSeconds = t.TolerationSeconds
-		}
-		tolerations = append(tolerations, toleration)
-	}
+	tolerations := toCoreTolerations(spec.Tolerations)
 
 	// Build container security context
 	var containerSecurityContext *corev1.SecurityContext
@@ -117,6 +135,57 @@ func (c *Client) CreatePod(ctx context.Context, spec *PodSpec) error {
 			ReadOnlyRootFilesystem:   spec.SecurityContext.ReadOnlyRootFilesystem,
 			AllowPrivilegeEscalation: spec.SecurityContext.AllowPrivilegeEscalation,
 		}
+		if caps := spec.SecurityContext.Capabilities; caps != nil {
+			containerSecurityContext.Capabilities = &corev1.Capabilities{
+				Add:  toCoreCapabilities(caps.Add),
+				Drop: toCoreCapabilities(caps.Drop),
+			}
+		}
+		if spec.SecurityContext.SeccompProfile != "" {
+			containerSecurityContext.SeccompProfile = &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileType(spec.SecurityContext.SeccompProfile),
+			}
+		}
+	}
+
+	// Scratch directories are emptyDir volumes, named by position
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	for i, dir := range spec.ScratchDirs {
+		name := fmt.Sprintf("scratch-%d", i)
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: dir})
+	}
+	for i, sm := range spec.SecretMounts {
+		name := fmt.Sprintf("secret-%d", i)
+		source := &corev1.SecretVolumeSource{SecretName: sm.SecretName}
+		for _, key := range slices.Sorted(maps.Keys(sm.Items)) {
+			source.Items = append(source.Items, corev1.KeyToPath{Key: key, Path: sm.Items[key]})
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{Secret: source},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: sm.MountPath, ReadOnly: true})
+	}
+
+	// Every pod gets a writable directory for the PID files of killable commands
+	volumes = append(volumes, corev1.Volume{
+		Name:         execStateVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	mounts = append(mounts, corev1.VolumeMount{Name: execStateVolume, MountPath: ExecStateDir})
+
+	dnsPolicy, dnsConfig := ToCoreDNS(spec.DNS)
+
+	var lifecycle *corev1.Lifecycle
+	if len(spec.PreStop) > 0 {
+		lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.LifecycleHandler{Exec: &corev1.ExecAction{Command: spec.PreStop}},
+		}
 	}
 
 	pod := &corev1.Pod{
@@ -133,8 +202,15 @@ func (c *Client) CreatePod(ctx context.Context, spec *PodSpec) error {
 				}
 				return nil
 			}(),
-			NodeSelector: spec.NodeSelector,
-			Tolerations:  tolerations,
+			PriorityClassName:             spec.PriorityClassName,
+			ServiceAccountName:            spec.ServiceAccountName,
+			AutomountServiceAccountToken:  spec.AutomountServiceAccountToken,
+			NodeSelector:                  spec.NodeSelector,
+			Tolerations:                   tolerations,
+			Affinity:                      ToCoreAffinity(spec.Affinity, spec.NodeSelector),
+			DNSPolicy:                     dnsPolicy,
+			DNSConfig:                     dnsConfig,
+			TerminationGracePeriodSeconds: spec.TerminationGracePeriodSeconds,
 			Containers: []corev1.Container{
 				{
 					Name:            "main",
@@ -142,6 +218,8 @@ func (c *Client) CreatePod(ctx context.Context, spec *PodSpec) error {
 					Command:         spec.Command,
 					Env:             envVars,
 					SecurityContext: containerSecurityContext,
+					VolumeMounts:    mounts,
+					Lifecycle:       lifecycle,
 					Resources: corev1.ResourceRequirements{
 						Requests: corev1.ResourceList{
 							corev1.ResourceCPU:              resource.MustParse(spec.CPU),
@@ -158,18 +236,155 @@ func (c *Client) CreatePod(ctx context.Context, spec *PodSpec) error {
 					TTY:   true,
 				},
 			},
+			Volumes:       volumes,
 			RestartPolicy: corev1.RestartPolicyNever,
 		},
 	}
+	if spec.Wrapper != nil {
+		wrapPod(pod, spec.Wrapper)
+	}
 
 	_, err := c.clientset.CoreV1().Pods(spec.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to create pod: %w", err)
+		return classifyCreatePodError(err, func() bool { return c.quotaExhausted(ctx, pod) })
 	}
 
 	return nil
 }
 
+// toCoreCapabilities converts capability names to the Kubernetes type
+func toCoreCapabilities(names []string) []corev1.Capability {
+	var caps []corev1.Capability
+	for _, name := range names {
+		caps = append(caps, corev1.Capability(name))
+	}
+	return caps
+}
+
+// toCoreTolerations converts tolerations to the Kubernetes format ("Equal" is the default operator)
+func toCoreTolerations(ts []Toleration) []corev1.Toleration {
+	var tolerations []corev1.Toleration
+	for _, t := range ts {
+		toleration := corev1.Toleration{
+			Key:   t.Key,
+			Value: t.Value,
+		}
+		// Set operator (default to "Equal" if not specified)
+		switch t.Operator {
+		case "Exists":
+			toleration.Operator = corev1.TolerationOpExists
+		default:
+			toleration.Operator = corev1.TolerationOpEqual
+		}
+		// Set effect
+		switch t.Effect {
+		case "NoSchedule":
+			toleration.Effect = corev1.TaintEffectNoSchedule
+		case "PreferNoSchedule":
+			toleration.Effect = corev1.TaintEffectPreferNoSchedule
+		case "NoExecute":
+			toleration.Effect = corev1.TaintEffectNoExecute
+		}
+		if t.TolerationSeconds != nil {
+			toleration.TolerationSeconds = t.TolerationSeconds
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations
+}
+
+// podStartTimes returns when a pod was scheduled (its PodScheduled condition) and when its first
+// container started (from its running or terminated state)
+func podStartTimes(pod *corev1.Pod) (scheduledAt, startedAt *time.Time) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionTrue && !cond.LastTransitionTime.IsZero() {
+			t := cond.LastTransitionTime.Time
+			scheduledAt = &t
+		}
+	}
+	if len(pod.Status.ContainerStatuses) > 0 {
+		state := pod.Status.ContainerStatuses[0].State
+		var started metav1.Time
+		switch {
+		case state.Terminated != nil:
+			started = state.Terminated.StartedAt
+		case state.Running != nil:
+			started = state.Running.StartedAt
+		}
+		if !started.IsZero() {
+			t := started.Time
+			startedAt = &t
+		}
+	}
+	return scheduledAt, startedAt
+}
+
+// classifyCreatePodError tags a pod creation failure with an apierrors kind: a name already taken
+// is Conflict, a ResourceQuota rejection is QuotaExceeded, any other admission/RBAC rejection is
+// Forbidden. The API server reports quota rejections as Forbidden too; quotaExhausted tells them
+// apart (see Client.quotaExhausted).
+func classifyCreatePodError(err error, quotaExhausted func() bool) error {
+	if errors.IsAlreadyExists(err) {
+		return apierrors.Wrap(apierrors.Conflict, apierrors.CodePodAlreadyExists, err, "failed to create pod")
+	}
+	if !errors.IsForbidden(err) {
+		return fmt.Errorf("failed to create pod: %w", err)
+	}
+	if quotaExhausted() {
+		return apierrors.Wrap(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, err, "failed to create pod")
+	}
+	return apierrors.Wrap(apierrors.Forbidden, apierrors.CodePodForbidden, err, "failed to create pod")
+}
+
+// quotaExhausted reports whether a ResourceQuota of the pod's namespace has no room left for the
+// pod, going by the quotas' recorded usage
+func (c *Client) quotaExhausted(ctx context.Context, pod *corev1.Pod) bool {
+	quotas, err := c.clientset.CoreV1().ResourceQuotas(pod.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false
+	}
+	usage := podQuotaUsage(pod)
+	for i := range quotas.Items {
+		status := quotas.Items[i].Status
+		for name, hard := range status.Hard {
+			need, ok := usage[name]
+			if !ok {
+				continue
+			}
+			used := status.Used[name].DeepCopy()
+			used.Add(need)
+			if used.Cmp(hard) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// podQuotaUsage is what creating pod adds to the quota resources it counts against
+func podQuotaUsage(pod *corev1.Pod) corev1.ResourceList {
+	usage := corev1.ResourceList{
+		corev1.ResourcePods:               *resource.NewQuantity(1, resource.DecimalSI),
+		corev1.ResourceName("count/pods"): *resource.NewQuantity(1, resource.DecimalSI),
+	}
+	add := func(name corev1.ResourceName, q resource.Quantity) {
+		total := usage[name].DeepCopy()
+		total.Add(q)
+		usage[name] = total
+	}
+	for i := range pod.Spec.Containers {
+		resources := pod.Spec.Containers[i].Resources
+		for name, q := range resources.Requests {
+			add(name, q)
+			add(corev1.ResourceName("requests."+string(name)), q)
+		}
+		for name, q := range resources.Limits {
+			add(corev1.ResourceName("limits."+string(name)), q)
+		}
+	}
+	return usage
+}
+
 // GetPod retrieves a pod
 func (c *Client) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
 	pod, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
@@ -195,6 +410,16 @@ func (c *Client) DeletePod(ctx context.Context, namespace, name string, force bo
 	return nil
 }
 
+// DeletePodWithGracePeriod deletes a pod, giving its containers gracePeriodSeconds to stop
+// (their pre-stop hooks included) instead of the pod's own grace period
+func (c *Client) DeletePodWithGracePeriod(ctx context.Context, namespace, name string, gracePeriodSeconds int64) error {
+	err := c.clientset.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriodSeconds})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod: %w", err)
+	}
+	return nil
+}
+
 // WaitForPodRunning waits for a pod to reach running state
 func (c *Client) WaitForPodRunning(ctx context.Context, namespace, name string) error {
 	watch, err := c.clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
@@ -266,6 +491,32 @@ func (c *Client) WaitForPodRunning(ctx context.Context, namespace, name string)
 // DefaultContainerName is the container name used in agentbox-created pods (main pod and ephemeral)
 const DefaultContainerName = "main"
 
+// ProbeHTTPGet sends an HTTP GET to a port of a pod through the API server's pod proxy and
+// returns the response status and body. Non-2xx responses are not an error; err is only set
+// when no response was received.
+func (c *Client) ProbeHTTPGet(ctx context.Context, namespace, podName string, port int, path string) (int, string, error) {
+	body, err := c.clientset.CoreV1().Pods(namespace).ProxyGet("http", podName, strconv.Itoa(port), path, nil).DoRaw(ctx)
+	if err == nil {
+		return http.StatusOK, string(body), nil
+	}
+	if status, ok := err.(errors.APIStatus); ok && status.Status().Code != 0 {
+		if len(body) == 0 {
+			body = []byte(status.Status().Message)
+		}
+		return int(status.Status().Code), string(body), nil
+	}
+	return 0, "", fmt.Errorf("failed to probe pod: %w", err)
+}
+
+// ExecStateDir is a writable emptyDir mounted in every pod, also with a read-only root filesystem,
+// where the orchestrator keeps the PID files of commands it may have to kill
+const ExecStateDir = "/.agentbox-exec"
+
+const execStateVolume = "agentbox-exec"
+
+// ShellProbeCommand succeeds in containers whose image has /bin/sh
+var ShellProbeCommand = []string{"/bin/sh", "-c", "exit 0"}
+
 // ExecInPod executes a command in a running pod
 func (c *Client) ExecInPod(ctx context.Context, namespace, podName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	req := c.clientset.CoreV1().RESTClient().Post().
@@ -301,9 +552,12 @@ func (c *Client) ExecInPod(ctx context.Context, namespace, podName string, comma
 	return nil
 }
 
-// GetPodLogs retrieves logs from a pod
-func (c *Client) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64) (string, error) {
-	opts := &corev1.PodLogOptions{}
+// GetPodLogs retrieves logs from a pod. With timestamps, each line is prefixed with its
+// RFC3339 timestamp (see ParseLogLine).
+func (c *Client) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, timestamps bool) (string, error) {
+	opts := &corev1.PodLogOptions{
+		Timestamps: timestamps,
+	}
 	if tailLines != nil {
 		opts.TailLines = tailLines
 	}
@@ -324,10 +578,26 @@ func (c *Client) GetPodLogs(ctx context.Context, namespace, podName string, tail
 	return buf.String(), nil
 }
 
-// StreamPodLogs streams logs from a pod, optionally following new logs
-func (c *Client) StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow bool) (io.ReadCloser, error) {
+// readPodLogs streams a pod's full log into w without buffering it in memory first
+func (c *Client) readPodLogs(ctx context.Context, namespace, podName string, w io.Writer) error {
+	logs, err := c.clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{}).Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get pod logs: %w", err)
+	}
+	defer logs.Close()
+
+	if _, err := io.Copy(w, logs); err != nil {
+		return fmt.Errorf("failed to read logs: %w", err)
+	}
+	return nil
+}
+
+// StreamPodLogs streams logs from a pod, optionally following new logs and prefixing each
+// line with its RFC3339 timestamp (see ParseLogLine)
+func (c *Client) StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow, timestamps bool) (io.ReadCloser, error) {
 	opts := &corev1.PodLogOptions{
-		Follow: follow,
+		Follow:     follow,
+		Timestamps: timestamps,
 	}
 	if tailLines != nil {
 		opts.TailLines = tailLines
@@ -342,6 +612,19 @@ func (c *Client) StreamPodLogs(ctx context.Context, namespace, podName string, t
 	return logs, nil
 }
 
+// PatchPodLabels sets the labels in add and deletes the labels in remove on a running pod,
+// leaving its other labels untouched
+func (c *Client) PatchPodLabels(ctx context.Context, namespace, name string, add map[string]string, remove []string) error {
+	patch, err := labelsPatch(add, remove)
+	if err != nil {
+		return err
+	}
+	if _, err := c.clientset.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch pod labels: %w", err)
+	}
+	return nil
+}
+
 // ListPods lists all pods in a namespace
 func (c *Client) ListPods(ctx context.Context, namespace string, labelSelector string) (*corev1.PodList, error) {
 	opts := metav1.ListOptions{}
@@ -357,8 +640,11 @@ func (c *Client) ListPods(ctx context.Context, namespace string, labelSelector s
 	return pods, nil
 }
 
-// WaitForPodCompletion waits for a pod to complete (succeed or fail) and returns the result
-func (c *Client) WaitForPodCompletion(ctx context.Context, namespace, name string) (*PodCompletionResult, error) {
+// WaitForPodCompletion waits for a pod to complete (succeed or fail) and returns the result.
+// At most maxLogBytes of the pod's log are kept (the head and the tail; <= 0 keeps everything).
+// When ctx is done first, the error is returned together with a result holding the log the pod
+// wrote until then.
+func (c *Client) WaitForPodCompletion(ctx context.Context, namespace, name string, maxLogBytes int64) (*PodCompletionResult, error) {
 	watch, err := c.clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
 		FieldSelector: fmt.Sprintf("metadata.name=%s", name),
 	})
@@ -382,9 +668,10 @@ func (c *Client) WaitForPodCompletion(ctx context.Context, namespace, name strin
 			switch pod.Status.Phase {
 			case corev1.PodSucceeded, corev1.PodFailed:
 				// Pod completed, get logs
-				logs, err := c.GetPodLogs(ctx, namespace, name, nil)
-				if err != nil {
-					logs = fmt.Sprintf("(failed to get logs: %v)", err)
+				logs := NewLimitedBuffer(maxLogBytes)
+				if err := c.readPodLogs(ctx, namespace, name, logs); err != nil {
+					logs = NewLimitedBuffer(maxLogBytes)
+					fmt.Fprintf(logs, "(failed to get logs: %v)", err)
 				}
 
 				exitCode := 0
@@ -399,11 +686,20 @@ func (c *Client) WaitForPodCompletion(ctx context.Context, namespace, name strin
 					}
 				}
 
-				return &PodCompletionResult{
-					Phase:    pod.Status.Phase,
-					ExitCode: exitCode,
-					Logs:     logs,
-				}, nil
+				scheduledAt, startedAt := podStartTimes(pod)
+				result := &PodCompletionResult{
+					Phase:         pod.Status.Phase,
+					ExitCode:      exitCode,
+					Logs:          logs.String(),
+					LogBytesTotal: logs.Total(),
+					LogsTruncated: logs.Truncated(),
+					ScheduledAt:   scheduledAt,
+					StartedAt:     startedAt,
+				}
+				if pod.Annotations[WrapperAnnotation] == "true" {
+					result.TakeWrapperFooter()
+				}
+				return result, nil
 
 			case corev1.PodPending, corev1.PodRunning:
 				// Still running, continue waiting
@@ -411,7 +707,28 @@ func (c *Client) WaitForPodCompletion(ctx context.Context, namespace, name strin
 			}
 
 		case <-ctx.Done():
-			return nil, fmt.Errorf("timeout waiting for pod completion: %w", ctx.Err())
+			return c.partialCompletion(ctx, namespace, name, maxLogBytes), fmt.Errorf("timeout waiting for pod completion: %w", ctx.Err())
 		}
 	}
 }
+
+// partialLogTimeout bounds reading the log of a pod that did not complete in time
+const partialLogTimeout = 10 * time.Second
+
+// partialCompletion returns the log a still running pod has written so far. It reads the log
+// past the end of ctx, which is already done.
+func (c *Client) partialCompletion(ctx context.Context, namespace, name string, maxLogBytes int64) *PodCompletionResult {
+	logCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), partialLogTimeout)
+	defer cancel()
+	logs := NewLimitedBuffer(maxLogBytes)
+	if err := c.readPodLogs(logCtx, namespace, name, logs); err != nil {
+		logs = NewLimitedBuffer(maxLogBytes)
+		fmt.Fprintf(logs, "(failed to get logs: %v)", err)
+	}
+	return &PodCompletionResult{
+		Phase:         corev1.PodRunning,
+		Logs:          logs.String(),
+		LogBytesTotal: logs.Total(),
+		LogsTruncated: logs.Truncated(),
+	}
+}
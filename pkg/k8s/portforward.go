@@ -0,0 +1,90 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// PortForward forwards one TCP connection to a port of a pod through the API server (like
+// kubectl port-forward): bytes read from conn are sent to the port and its replies written to
+// conn. It returns when the pod closes the connection, ctx is canceled or conn fails; the error
+// carries the API server's message when the port could not be reached.
+func (c *Client) PortForward(ctx context.Context, namespace, podName string, port int, conn io.ReadWriter) error {
+	transport, upgrader, err := spdy.RoundTripperFor(c.config)
+	if err != nil {
+		return fmt.Errorf("failed to create port forward transport: %w", err)
+	}
+	req := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return fmt.Errorf("failed to start port forward: %w", err)
+	}
+	defer streamConn.Close()
+
+	// One error and one data stream per forwarded connection, tied together by the request ID
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(port))
+	headers.Set(corev1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("failed to create port forward error stream: %w", err)
+	}
+	// The error stream is only read
+	errorStream.Close()
+	remoteErr := make(chan error, 1)
+	go func() {
+		msg, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			remoteErr <- fmt.Errorf("failed to read port forward error stream: %w", err)
+		case len(msg) > 0:
+			remoteErr <- fmt.Errorf("port forward to port %d failed: %s", port, msg)
+		}
+		close(remoteErr)
+	}()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("failed to create port forward data stream: %w", err)
+	}
+
+	remoteDone := make(chan struct{})
+	localErr := make(chan error, 1)
+	go func() {
+		// The pod closing the connection ends the forward
+		io.Copy(conn, dataStream) //nolint:errcheck // the outcome is reported by the error stream
+		close(remoteDone)
+	}()
+	go func() {
+		// Tell the pod no more data is coming once conn is drained
+		defer dataStream.Close()
+		if _, err := io.Copy(dataStream, conn); err != nil {
+			localErr <- err
+		}
+	}()
+
+	select {
+	case <-remoteDone:
+	case err := <-localErr:
+		return fmt.Errorf("port forward connection failed: %w", err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// Closing the connection ends the error stream once the pod's side is done
+	streamConn.Close()
+	return <-remoteErr
+}
@@ -0,0 +1,310 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// RetryPolicy controls how API calls are retried after transient failures
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts per call, including the first (<= 1 disables retries)
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry; it doubles after every attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries transient failures twice, starting at 200ms
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// backoff returns the delay before retry number attempt (1-based), with up to 20% jitter so
+// clients that failed together do not retry in lockstep
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// IsTransientError reports whether err is worth retrying: throttling (429), server-side errors
+// (5xx, timeouts) and connection failures. Errors with request semantics such as 404 Not Found,
+// 409 Conflict / AlreadyExists or 403 Forbidden are never transient.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if k8serrors.IsTooManyRequests(err) || k8serrors.IsServerTimeout(err) || k8serrors.IsTimeout(err) ||
+		k8serrors.IsInternalError(err) || k8serrors.IsServiceUnavailable(err) || k8serrors.IsUnexpectedServerError(err) {
+		return true
+	}
+	var status k8serrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code >= 500
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// RetryingClient wraps a ClientInterface and retries its idempotent operations after transient
+// errors. Long-running calls (waits, exec, log streams) are passed through unchanged.
+type RetryingClient struct {
+	ClientInterface
+	policy RetryPolicy
+	logger *zap.Logger
+}
+
+// Ensure RetryingClient implements ClientInterface and forwards pod metrics
+var (
+	_ ClientInterface  = (*RetryingClient)(nil)
+	_ PodMetricsClient = (*RetryingClient)(nil)
+)
+
+// WithRetry wraps client so its API calls are retried according to policy
+func WithRetry(client ClientInterface, policy RetryPolicy, logger *zap.Logger) *RetryingClient {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &RetryingClient{ClientInterface: client, policy: policy, logger: logger}
+}
+
+// Unwrap returns the wrapped client
+func (c *RetryingClient) Unwrap() ClientInterface {
+	return c.ClientInterface
+}
+
+// do runs fn until it succeeds, fails with a non-transient error, runs out of attempts, or ctx
+// is done; the wait between attempts never extends past ctx's deadline
+func (c *RetryingClient) do(ctx context.Context, op string, fn func() error) error {
+	attempts := c.policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= attempts || !IsTransientError(err) {
+			return err
+		}
+		delay := c.policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			c.logger.Warn("kubernetes call failed, not retrying past context deadline",
+				zap.String("operation", op), zap.Int("attempt", attempt), zap.Error(err))
+			return err
+		}
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.String("operation", op),
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+		c.logger.Warn("kubernetes call failed, retrying",
+			zap.String("operation", op),
+			zap.Int("attempt", attempt),
+			zap.Int("max_attempts", attempts),
+			zap.Duration("backoff", delay),
+			zap.Error(err),
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// CreateNamespace retries Client.CreateNamespace
+func (c *RetryingClient) CreateNamespace(ctx context.Context, name string, labels map[string]string) error {
+	return c.do(ctx, "CreateNamespace", func() error {
+		return c.ClientInterface.CreateNamespace(ctx, name, labels)
+	})
+}
+
+// DeleteNamespace retries Client.DeleteNamespace
+func (c *RetryingClient) DeleteNamespace(ctx context.Context, name string) error {
+	return c.do(ctx, "DeleteNamespace", func() error {
+		return c.ClientInterface.DeleteNamespace(ctx, name)
+	})
+}
+
+// NamespaceExists retries Client.NamespaceExists
+func (c *RetryingClient) NamespaceExists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	err := c.do(ctx, "NamespaceExists", func() error {
+		var err error
+		exists, err = c.ClientInterface.NamespaceExists(ctx, name)
+		return err
+	})
+	return exists, err
+}
+
+// GetNamespace retries Client.GetNamespace
+func (c *RetryingClient) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	var ns *corev1.Namespace
+	err := c.do(ctx, "GetNamespace", func() error {
+		var err error
+		ns, err = c.ClientInterface.GetNamespace(ctx, name)
+		return err
+	})
+	return ns, err
+}
+
+// ListNamespaces retries Client.ListNamespaces
+func (c *RetryingClient) ListNamespaces(ctx context.Context, labelSelector string) (*corev1.NamespaceList, error) {
+	var namespaces *corev1.NamespaceList
+	err := c.do(ctx, "ListNamespaces", func() error {
+		var err error
+		namespaces, err = c.ClientInterface.ListNamespaces(ctx, labelSelector)
+		return err
+	})
+	return namespaces, err
+}
+
+// UpdateNamespaceLabels retries Client.UpdateNamespaceLabels
+func (c *RetryingClient) UpdateNamespaceLabels(ctx context.Context, name string, add map[string]string, remove []string) error {
+	return c.do(ctx, "UpdateNamespaceLabels", func() error {
+		return c.ClientInterface.UpdateNamespaceLabels(ctx, name, add, remove)
+	})
+}
+
+// CreateResourceQuota retries Client.CreateResourceQuota
+func (c *RetryingClient) CreateResourceQuota(ctx context.Context, namespace, cpu, memory, storage string) error {
+	return c.do(ctx, "CreateResourceQuota", func() error {
+		return c.ClientInterface.CreateResourceQuota(ctx, namespace, cpu, memory, storage)
+	})
+}
+
+// ApplyServiceAccount retries Client.ApplyServiceAccount
+func (c *RetryingClient) ApplyServiceAccount(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	return c.do(ctx, "ApplyServiceAccount", func() error {
+		return c.ClientInterface.ApplyServiceAccount(ctx, namespace, name, annotations)
+	})
+}
+
+// CreateNetworkPolicy retries Client.CreateNetworkPolicy
+func (c *RetryingClient) CreateNetworkPolicy(ctx context.Context, namespace string) error {
+	return c.do(ctx, "CreateNetworkPolicy", func() error {
+		return c.ClientInterface.CreateNetworkPolicy(ctx, namespace)
+	})
+}
+
+// CreateNetworkPolicyWithConfig retries Client.CreateNetworkPolicyWithConfig
+func (c *RetryingClient) CreateNetworkPolicyWithConfig(ctx context.Context, namespace string, config *NetworkPolicyConfig) error {
+	return c.do(ctx, "CreateNetworkPolicyWithConfig", func() error {
+		return c.ClientInterface.CreateNetworkPolicyWithConfig(ctx, namespace, config)
+	})
+}
+
+// CreatePod retries Client.CreatePod. A retry after a create that reached the API server
+// fails with AlreadyExists, which is not retried.
+func (c *RetryingClient) CreatePod(ctx context.Context, spec *PodSpec) error {
+	return c.do(ctx, "CreatePod", func() error {
+		return c.ClientInterface.CreatePod(ctx, spec)
+	})
+}
+
+// GetPod retries Client.GetPod
+func (c *RetryingClient) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	var pod *corev1.Pod
+	err := c.do(ctx, "GetPod", func() error {
+		var err error
+		pod, err = c.ClientInterface.GetPod(ctx, namespace, name)
+		return err
+	})
+	return pod, err
+}
+
+// DeletePod retries Client.DeletePod
+func (c *RetryingClient) DeletePod(ctx context.Context, namespace, name string, force bool) error {
+	return c.do(ctx, "DeletePod", func() error {
+		return c.ClientInterface.DeletePod(ctx, namespace, name, force)
+	})
+}
+
+// DeletePodWithGracePeriod retries Client.DeletePodWithGracePeriod
+func (c *RetryingClient) DeletePodWithGracePeriod(ctx context.Context, namespace, name string, gracePeriodSeconds int64) error {
+	return c.do(ctx, "DeletePodWithGracePeriod", func() error {
+		return c.ClientInterface.DeletePodWithGracePeriod(ctx, namespace, name, gracePeriodSeconds)
+	})
+}
+
+// PatchPodLabels retries Client.PatchPodLabels
+func (c *RetryingClient) PatchPodLabels(ctx context.Context, namespace, name string, add map[string]string, remove []string) error {
+	return c.do(ctx, "PatchPodLabels", func() error {
+		return c.ClientInterface.PatchPodLabels(ctx, namespace, name, add, remove)
+	})
+}
+
+// ListPods retries Client.ListPods
+func (c *RetryingClient) ListPods(ctx context.Context, namespace string, labelSelector string) (*corev1.PodList, error) {
+	var pods *corev1.PodList
+	err := c.do(ctx, "ListPods", func() error {
+		var err error
+		pods, err = c.ClientInterface.ListPods(ctx, namespace, labelSelector)
+		return err
+	})
+	return pods, err
+}
+
+// GetNodeAllocatable retries Client.GetNodeAllocatable
+func (c *RetryingClient) GetNodeAllocatable(ctx context.Context, nodeSelector map[string]string, tolerations []Toleration) ([]NodeAllocatable, error) {
+	var nodes []NodeAllocatable
+	err := c.do(ctx, "GetNodeAllocatable", func() error {
+		var err error
+		nodes, err = c.ClientInterface.GetNodeAllocatable(ctx, nodeSelector, tolerations)
+		return err
+	})
+	return nodes, err
+}
+
+// GetPodLogs retries Client.GetPodLogs
+func (c *RetryingClient) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, timestamps bool) (string, error) {
+	var logs string
+	err := c.do(ctx, "GetPodLogs", func() error {
+		var err error
+		logs, err = c.ClientInterface.GetPodLogs(ctx, namespace, podName, tailLines, timestamps)
+		return err
+	})
+	return logs, err
+}
+
+// GetPodMetrics forwards to the wrapped client when it can read pod metrics
+func (c *RetryingClient) GetPodMetrics(ctx context.Context, namespace, podName string) (*PodMetrics, error) {
+	metricsClient, ok := c.ClientInterface.(PodMetricsClient)
+	if !ok {
+		return nil, errors.New("pod metrics are not supported by this client")
+	}
+	var metrics *PodMetrics
+	err := c.do(ctx, "GetPodMetrics", func() error {
+		var err error
+		metrics, err = metricsClient.GetPodMetrics(ctx, namespace, podName)
+		return err
+	})
+	return metrics, err
+}
@@ -0,0 +1,279 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/tracing"
+)
+
+// TracingClient wraps a ClientInterface and records a span for each of its calls, tagged with
+// the cluster, namespace and pod. Wrap the retrying client so one span covers all attempts.
+type TracingClient struct {
+	ClientInterface
+	cluster string
+}
+
+// Ensure TracingClient implements ClientInterface and forwards pod metrics
+var (
+	_ ClientInterface  = (*TracingClient)(nil)
+	_ PodMetricsClient = (*TracingClient)(nil)
+)
+
+// WithTracing wraps client so its calls are traced; cluster names the cluster in the spans
+func WithTracing(client ClientInterface, cluster string) *TracingClient {
+	return &TracingClient{ClientInterface: client, cluster: cluster}
+}
+
+// Unwrap returns the wrapped client
+func (c *TracingClient) Unwrap() ClientInterface {
+	return c.ClientInterface
+}
+
+// trace runs fn in a span named after the operation
+func (c *TracingClient) trace(ctx context.Context, op, namespace, pod string, fn func(ctx context.Context) error) error {
+	attrs := []attribute.KeyValue{attribute.String("k8s.cluster.name", c.cluster)}
+	if namespace != "" {
+		attrs = append(attrs, attribute.String("k8s.namespace.name", namespace))
+	}
+	if pod != "" {
+		attrs = append(attrs, attribute.String("k8s.pod.name", pod))
+	}
+	ctx, span := tracing.Start(ctx, "k8s."+op, attrs...)
+	err := fn(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+// HealthCheck traces Client.HealthCheck
+func (c *TracingClient) HealthCheck(ctx context.Context) error {
+	return c.trace(ctx, "HealthCheck", "", "", c.ClientInterface.HealthCheck)
+}
+
+// GetNodeAllocatable traces Client.GetNodeAllocatable
+func (c *TracingClient) GetNodeAllocatable(ctx context.Context, nodeSelector map[string]string, tolerations []Toleration) ([]NodeAllocatable, error) {
+	var nodes []NodeAllocatable
+	err := c.trace(ctx, "GetNodeAllocatable", "", "", func(ctx context.Context) error {
+		var err error
+		nodes, err = c.ClientInterface.GetNodeAllocatable(ctx, nodeSelector, tolerations)
+		return err
+	})
+	return nodes, err
+}
+
+// CreateNamespace traces Client.CreateNamespace
+func (c *TracingClient) CreateNamespace(ctx context.Context, name string, labels map[string]string) error {
+	return c.trace(ctx, "CreateNamespace", name, "", func(ctx context.Context) error {
+		return c.ClientInterface.CreateNamespace(ctx, name, labels)
+	})
+}
+
+// DeleteNamespace traces Client.DeleteNamespace
+func (c *TracingClient) DeleteNamespace(ctx context.Context, name string) error {
+	return c.trace(ctx, "DeleteNamespace", name, "", func(ctx context.Context) error {
+		return c.ClientInterface.DeleteNamespace(ctx, name)
+	})
+}
+
+// NamespaceExists traces Client.NamespaceExists
+func (c *TracingClient) NamespaceExists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	err := c.trace(ctx, "NamespaceExists", name, "", func(ctx context.Context) error {
+		var err error
+		exists, err = c.ClientInterface.NamespaceExists(ctx, name)
+		return err
+	})
+	return exists, err
+}
+
+// GetNamespace traces Client.GetNamespace
+func (c *TracingClient) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	var ns *corev1.Namespace
+	err := c.trace(ctx, "GetNamespace", name, "", func(ctx context.Context) error {
+		var err error
+		ns, err = c.ClientInterface.GetNamespace(ctx, name)
+		return err
+	})
+	return ns, err
+}
+
+// ListNamespaces traces Client.ListNamespaces
+func (c *TracingClient) ListNamespaces(ctx context.Context, labelSelector string) (*corev1.NamespaceList, error) {
+	var namespaces *corev1.NamespaceList
+	err := c.trace(ctx, "ListNamespaces", "", "", func(ctx context.Context) error {
+		var err error
+		namespaces, err = c.ClientInterface.ListNamespaces(ctx, labelSelector)
+		return err
+	})
+	return namespaces, err
+}
+
+// UpdateNamespaceLabels traces Client.UpdateNamespaceLabels
+func (c *TracingClient) UpdateNamespaceLabels(ctx context.Context, name string, add map[string]string, remove []string) error {
+	return c.trace(ctx, "UpdateNamespaceLabels", name, "", func(ctx context.Context) error {
+		return c.ClientInterface.UpdateNamespaceLabels(ctx, name, add, remove)
+	})
+}
+
+// CreateResourceQuota traces Client.CreateResourceQuota
+func (c *TracingClient) CreateResourceQuota(ctx context.Context, namespace, cpu, memory, storage string) error {
+	return c.trace(ctx, "CreateResourceQuota", namespace, "", func(ctx context.Context) error {
+		return c.ClientInterface.CreateResourceQuota(ctx, namespace, cpu, memory, storage)
+	})
+}
+
+// ApplyServiceAccount traces Client.ApplyServiceAccount
+func (c *TracingClient) ApplyServiceAccount(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	return c.trace(ctx, "ApplyServiceAccount", namespace, "", func(ctx context.Context) error {
+		return c.ClientInterface.ApplyServiceAccount(ctx, namespace, name, annotations)
+	})
+}
+
+// CreateNetworkPolicy traces Client.CreateNetworkPolicy
+func (c *TracingClient) CreateNetworkPolicy(ctx context.Context, namespace string) error {
+	return c.trace(ctx, "CreateNetworkPolicy", namespace, "", func(ctx context.Context) error {
+		return c.ClientInterface.CreateNetworkPolicy(ctx, namespace)
+	})
+}
+
+// CreateNetworkPolicyWithConfig traces Client.CreateNetworkPolicyWithConfig
+func (c *TracingClient) CreateNetworkPolicyWithConfig(ctx context.Context, namespace string, config *NetworkPolicyConfig) error {
+	return c.trace(ctx, "CreateNetworkPolicy", namespace, "", func(ctx context.Context) error {
+		return c.ClientInterface.CreateNetworkPolicyWithConfig(ctx, namespace, config)
+	})
+}
+
+// CreatePod traces Client.CreatePod
+func (c *TracingClient) CreatePod(ctx context.Context, spec *PodSpec) error {
+	return c.trace(ctx, "CreatePod", spec.Namespace, spec.Name, func(ctx context.Context) error {
+		return c.ClientInterface.CreatePod(ctx, spec)
+	})
+}
+
+// GetPod traces Client.GetPod
+func (c *TracingClient) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	var pod *corev1.Pod
+	err := c.trace(ctx, "GetPod", namespace, name, func(ctx context.Context) error {
+		var err error
+		pod, err = c.ClientInterface.GetPod(ctx, namespace, name)
+		return err
+	})
+	return pod, err
+}
+
+// DeletePod traces Client.DeletePod
+func (c *TracingClient) DeletePod(ctx context.Context, namespace, name string, force bool) error {
+	return c.trace(ctx, "DeletePod", namespace, name, func(ctx context.Context) error {
+		return c.ClientInterface.DeletePod(ctx, namespace, name, force)
+	})
+}
+
+// DeletePodWithGracePeriod traces Client.DeletePodWithGracePeriod
+func (c *TracingClient) DeletePodWithGracePeriod(ctx context.Context, namespace, name string, gracePeriodSeconds int64) error {
+	return c.trace(ctx, "DeletePodWithGracePeriod", namespace, name, func(ctx context.Context) error {
+		return c.ClientInterface.DeletePodWithGracePeriod(ctx, namespace, name, gracePeriodSeconds)
+	})
+}
+
+// PatchPodLabels traces Client.PatchPodLabels
+func (c *TracingClient) PatchPodLabels(ctx context.Context, namespace, name string, add map[string]string, remove []string) error {
+	return c.trace(ctx, "PatchPodLabels", namespace, name, func(ctx context.Context) error {
+		return c.ClientInterface.PatchPodLabels(ctx, namespace, name, add, remove)
+	})
+}
+
+// WaitForPodRunning traces Client.WaitForPodRunning; its span covers scheduling and image pull
+func (c *TracingClient) WaitForPodRunning(ctx context.Context, namespace, name string) error {
+	return c.trace(ctx, "WaitForPodRunning", namespace, name, func(ctx context.Context) error {
+		return c.ClientInterface.WaitForPodRunning(ctx, namespace, name)
+	})
+}
+
+// WaitForPodCompletion traces Client.WaitForPodCompletion
+func (c *TracingClient) WaitForPodCompletion(ctx context.Context, namespace, name string, maxLogBytes int64) (*PodCompletionResult, error) {
+	var result *PodCompletionResult
+	err := c.trace(ctx, "WaitForPodCompletion", namespace, name, func(ctx context.Context) error {
+		var err error
+		result, err = c.ClientInterface.WaitForPodCompletion(ctx, namespace, name, maxLogBytes)
+		return err
+	})
+	return result, err
+}
+
+// ExecInPod traces Client.ExecInPod
+func (c *TracingClient) ExecInPod(ctx context.Context, namespace, podName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return c.trace(ctx, "ExecInPod", namespace, podName, func(ctx context.Context) error {
+		return c.ClientInterface.ExecInPod(ctx, namespace, podName, command, stdin, stdout, stderr)
+	})
+}
+
+// PortForward traces Client.PortForward
+func (c *TracingClient) PortForward(ctx context.Context, namespace, podName string, port int, conn io.ReadWriter) error {
+	return c.trace(ctx, "PortForward", namespace, podName, func(ctx context.Context) error {
+		return c.ClientInterface.PortForward(ctx, namespace, podName, port, conn)
+	})
+}
+
+// ProbeHTTPGet traces Client.ProbeHTTPGet
+func (c *TracingClient) ProbeHTTPGet(ctx context.Context, namespace, podName string, port int, path string) (int, string, error) {
+	var status int
+	var body string
+	err := c.trace(ctx, "ProbeHTTPGet", namespace, podName, func(ctx context.Context) error {
+		var err error
+		status, body, err = c.ClientInterface.ProbeHTTPGet(ctx, namespace, podName, port, path)
+		return err
+	})
+	return status, body, err
+}
+
+// GetPodLogs traces Client.GetPodLogs
+func (c *TracingClient) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, timestamps bool) (string, error) {
+	var logs string
+	err := c.trace(ctx, "GetPodLogs", namespace, podName, func(ctx context.Context) error {
+		var err error
+		logs, err = c.ClientInterface.GetPodLogs(ctx, namespace, podName, tailLines, timestamps)
+		return err
+	})
+	return logs, err
+}
+
+// StreamPodLogs traces opening the log stream of Client.StreamPodLogs (not reading it)
+func (c *TracingClient) StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow, timestamps bool) (io.ReadCloser, error) {
+	var stream io.ReadCloser
+	err := c.trace(ctx, "StreamPodLogs", namespace, podName, func(ctx context.Context) error {
+		var err error
+		stream, err = c.ClientInterface.StreamPodLogs(ctx, namespace, podName, tailLines, follow, timestamps)
+		return err
+	})
+	return stream, err
+}
+
+// ListPods traces Client.ListPods
+func (c *TracingClient) ListPods(ctx context.Context, namespace string, labelSelector string) (*corev1.PodList, error) {
+	var pods *corev1.PodList
+	err := c.trace(ctx, "ListPods", namespace, "", func(ctx context.Context) error {
+		var err error
+		pods, err = c.ClientInterface.ListPods(ctx, namespace, labelSelector)
+		return err
+	})
+	return pods, err
+}
+
+// GetPodMetrics forwards to the wrapped client when it can read pod metrics
+func (c *TracingClient) GetPodMetrics(ctx context.Context, namespace, podName string) (*PodMetrics, error) {
+	metricsClient, ok := c.ClientInterface.(PodMetricsClient)
+	if !ok {
+		return nil, errors.New("pod metrics are not supported by this client")
+	}
+	var metrics *PodMetrics
+	err := c.trace(ctx, "GetPodMetrics", namespace, podName, func(ctx context.Context) error {
+		var err error
+		metrics, err = metricsClient.GetPodMetrics(ctx, namespace, podName)
+		return err
+	})
+	return metrics, err
+}
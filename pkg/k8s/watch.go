@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// ErrWatchClosed is returned by WatchPods when the API server ends the watch (e.g. its timeout);
+// watch again to resume
+var ErrWatchClosed = errors.New("watch closed")
+
+// PodEvent is the state of a pod seen by WatchPods
+type PodEvent struct {
+	Namespace string
+	Name      string
+	Labels    map[string]string
+	Phase     corev1.PodPhase
+	// NodeName is the node the pod is scheduled on; empty until it is scheduled
+	NodeName string
+	// Deleted is set when the pod is gone
+	Deleted bool
+}
+
+func podEventFor(pod *corev1.Pod, deleted bool) PodEvent {
+	return PodEvent{
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		Labels:    pod.Labels,
+		Phase:     pod.Status.Phase,
+		NodeName:  pod.Spec.NodeName,
+		Deleted:   deleted,
+	}
+}
+
+// WatchPods lists the pods matching labelSelector in all namespaces and passes them to onList,
+// then passes every change to them to onEvent until ctx is canceled (returning nil) or the watch
+// fails. onList receives the complete current state: callers replace what they knew with it.
+// Errors are returned as they come, so callers can tell missing permissions (IsForbidden) from
+// a dropped connection or ErrWatchClosed, and watch again.
+func (c *Client) WatchPods(ctx context.Context, labelSelector string, onList func([]PodEvent), onEvent func(PodEvent)) error {
+	pods, err := c.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	listed := make([]PodEvent, 0, len(pods.Items))
+	for i := range pods.Items {
+		listed = append(listed, podEventFor(&pods.Items[i], false))
+	}
+	onList(listed)
+
+	w, err := c.clientset.CoreV1().Pods("").Watch(ctx, metav1.ListOptions{
+		LabelSelector:   labelSelector,
+		ResourceVersion: pods.ResourceVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch pods: %w", err)
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return ErrWatchClosed
+			}
+			switch event.Type {
+			case watch.Error:
+				// E.g. 410 Gone once the resource version is too old: list again
+				return fmt.Errorf("pod watch failed: %w", k8serrors.FromObject(event.Object))
+			case watch.Added, watch.Modified, watch.Deleted:
+				if pod, ok := event.Object.(*corev1.Pod); ok {
+					onEvent(podEventFor(pod, event.Type == watch.Deleted))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package k8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/execwrapper"
+)
+
+// ExecWrapper makes a pod's command run under the exec wrapper (cmd/agentbox-wrapper), which
+// reports the command's exit code and resource usage. The binary comes from Image (copied by an
+// init container from Path) or from the ConfigMapKey of ConfigMap.
+type ExecWrapper struct {
+	Image        string
+	Path         string
+	ConfigMap    string
+	ConfigMapKey string
+}
+
+// WrapperAnnotation marks pods whose command runs under the exec wrapper; WaitForPodCompletion
+// reads the wrapper's result from their log
+const WrapperAnnotation = "agentbox.io/exec-wrapper"
+
+// Where the wrapper binary and its result file are in a wrapped pod. The binary is copied to
+// wrapperDir, or mounted from its ConfigMap at wrapperConfigMapDir; the result file is always
+// written to wrapperDir, which is writable.
+const (
+	wrapperVolume          = "agentbox-wrapper"
+	wrapperConfigMapVolume = "agentbox-wrapper-bin"
+	wrapperDir             = "/.agentbox"
+	wrapperConfigMapDir    = "/.agentbox-bin"
+	wrapperBinaryName      = "agentbox-wrapper"
+	wrapperResultFile      = wrapperDir + "/result.json"
+)
+
+// wrapPod runs the pod's main container under the wrapper: it mounts the wrapper's volumes,
+// prefixes the command and, with an image, adds the init container copying the binary. The init
+// container runs with the main container's security context and resources, which leaves the
+// pod's effective requests unchanged.
+func wrapPod(pod *corev1.Pod, w *ExecWrapper) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[WrapperAnnotation] = "true"
+
+	main := &pod.Spec.Containers[0]
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         wrapperVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	main.VolumeMounts = append(main.VolumeMounts, corev1.VolumeMount{Name: wrapperVolume, MountPath: wrapperDir})
+
+	binary := wrapperDir + "/" + wrapperBinaryName
+	if w.ConfigMap != "" {
+		binary = wrapperConfigMapDir + "/" + wrapperBinaryName
+		mode := int32(0o555)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: wrapperConfigMapVolume,
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: w.ConfigMap},
+				Items:                []corev1.KeyToPath{{Key: w.ConfigMapKey, Path: wrapperBinaryName, Mode: &mode}},
+			}},
+		})
+		main.VolumeMounts = append(main.VolumeMounts, corev1.VolumeMount{
+			Name: wrapperConfigMapVolume, MountPath: wrapperConfigMapDir, ReadOnly: true,
+		})
+	} else {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{
+			Name:            "agentbox-wrapper",
+			Image:           w.Image,
+			Command:         []string{"cp", w.Path, binary},
+			SecurityContext: main.SecurityContext,
+			Resources:       main.Resources,
+			VolumeMounts:    []corev1.VolumeMount{{Name: wrapperVolume, MountPath: wrapperDir}},
+		})
+	}
+	main.Command = append([]string{binary, "--result-file", wrapperResultFile, "--"}, main.Command...)
+}
+
+// TakeWrapperFooter moves the result the exec wrapper printed at the end of Logs to Wrapper, and
+// takes the command's exit code from it. Logs is left alone when it ends without a footer (the
+// pod was killed, or its image could not run the wrapper).
+func (r *PodCompletionResult) TakeWrapperFooter() {
+	rest, result, ok := execwrapper.ParseFooter(r.Logs)
+	if !ok {
+		return
+	}
+	r.LogBytesTotal -= int64(len(r.Logs) - len(rest))
+	r.Logs = rest
+	r.Wrapper = result
+	r.ExitCode = result.ExitCode
+}
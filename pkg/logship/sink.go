@@ -0,0 +1,172 @@
+// Package logship pushes batches of environment logs to the sinks environments ship their main
+// pod log to: Loki's push API, an S3-compatible bucket (one newline-delimited JSON object per
+// batch) or a webhook. The orchestrator follows the logs and batches them; this package only
+// delivers batches.
+package logship
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/exports"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// Headers of a webhook batch delivery (signed like execution callbacks when a secret is set)
+const (
+	EnvironmentIDHeader = "X-AgentBox-Environment-ID"
+	StreamHeader        = "X-AgentBox-Log-Stream"
+	BatchHeader         = "X-AgentBox-Log-Batch"
+)
+
+// NewSink creates a sink of the given type (an orchestrator.LogSinkFactory); timeout bounds
+// one push
+func NewSink(sink string, creds config.LogShippingCredentials, timeout time.Duration) (orchestrator.LogSink, error) {
+	if err := creds.CheckSink(sink); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	switch sink {
+	case config.LogSinkLoki:
+		return &lokiSink{creds: creds, client: client}, nil
+	case config.LogSinkWebhook:
+		return &webhookSink{creds: creds, client: client}, nil
+	default:
+		s3, err := exports.NewSink(config.ExportConfig{
+			Sink:           config.ExportSinkS3,
+			S3:             creds.S3,
+			TimeoutSeconds: int(timeout / time.Second),
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Sink{sink: s3}, nil
+	}
+}
+
+// ndjson encodes the lines of a batch as newline-delimited JSON objects
+func ndjson(batch *orchestrator.LogBatch) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, line := range batch.Lines {
+		_ = enc.Encode(struct {
+			Time time.Time `json:"time"`
+			Line string    `json:"line"`
+		}{line.Time, line.Line})
+	}
+	return buf.Bytes()
+}
+
+// send sends a push request and fails on a non-2xx response
+func send(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("push failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("push returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ========== Loki ==========
+
+// lokiSink pushes every batch as one stream labeled with the environment, namespace and pod
+type lokiSink struct {
+	creds  config.LogShippingCredentials
+	client *http.Client
+}
+
+func (l *lokiSink) Push(ctx context.Context, batch *orchestrator.LogBatch) error {
+	values := make([][2]string, len(batch.Lines))
+	for i, line := range batch.Lines {
+		values[i] = [2]string{strconv.FormatInt(line.Time.UnixNano(), 10), line.Line}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"streams": []interface{}{map[string]interface{}{
+			"stream": map[string]string{
+				"job":            "agentbox",
+				"environment_id": batch.EnvironmentID,
+				"namespace":      batch.Namespace,
+				"pod":            batch.Pod,
+			},
+			"values": values,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode loki push: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.creds.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build loki request: %w", err)
+	}
+	for name, value := range l.creds.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.creds.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.creds.TenantID)
+	}
+	if l.creds.Username != "" {
+		req.SetBasicAuth(l.creds.Username, l.creds.Password)
+	}
+	return send(l.client, req)
+}
+
+// ========== Webhook ==========
+
+// webhookSink POSTs every batch as newline-delimited JSON
+type webhookSink struct {
+	creds  config.LogShippingCredentials
+	client *http.Client
+}
+
+func (w *webhookSink) Push(ctx context.Context, batch *orchestrator.LogBatch) error {
+	body := ndjson(batch)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.creds.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	for name, value := range w.creds.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", exports.ContentType)
+	req.Header.Set(EnvironmentIDHeader, batch.EnvironmentID)
+	req.Header.Set(StreamHeader, batch.Stream)
+	req.Header.Set(BatchHeader, strconv.Itoa(batch.Seq))
+	if w.creds.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(orchestrator.CallbackTimestampHeader, timestamp)
+		req.Header.Set(orchestrator.CallbackSignatureHeader, orchestrator.SignCallback(w.creds.Secret, timestamp, body))
+	}
+	return send(w.client, req)
+}
+
+// ========== S3 ==========
+
+// s3Sink uploads every batch as one object through the exports S3 sink; keys are
+// <prefix>logs/<environment id>/dt=<YYYY-MM-DD of the first line>/<stream>-<batch number>.ndjson
+type s3Sink struct {
+	sink exports.Sink
+}
+
+func (s *s3Sink) Push(ctx context.Context, batch *orchestrator.LogBatch) error {
+	return s.sink.Write(ctx, &exports.Batch{
+		JobID:   batch.Stream,
+		Dataset: "logs/" + batch.EnvironmentID,
+		Seq:     batch.Seq,
+		From:    batch.Lines[0].Time,
+		Records: len(batch.Lines),
+		Body:    ndjson(batch),
+	})
+}
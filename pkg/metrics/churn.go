@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/database"
+)
+
+// Namespace churn is stored as global metrics holding the namespaces created and deleted during
+// one collection interval, so their sum over a range is the churn of that range
+const (
+	MetricNamespacesCreated = "namespaces_created"
+	MetricNamespacesDeleted = "namespaces_deleted"
+)
+
+// ChurnReport is the namespace and pod churn over a time range, per hour and per node. It is
+// built from raw samples, so it covers at most the raw retention (24 hours by default).
+type ChurnReport struct {
+	From              time.Time   `json:"from"`
+	To                time.Time   `json:"to"`
+	NamespacesCreated int64       `json:"namespaces_created"`
+	NamespacesDeleted int64       `json:"namespaces_deleted"`
+	PodsCreated       int64       `json:"pods_created"`
+	Hours             []ChurnHour `json:"hours"`
+	// Nodes lists the nodes pods were scheduled on, busiest first
+	Nodes []NodeChurn `json:"nodes"`
+}
+
+// ChurnHour is the churn of one hour, starting at Hour
+type ChurnHour struct {
+	Hour              time.Time `json:"hour"`
+	NamespacesCreated int64     `json:"namespaces_created"`
+	NamespacesDeleted int64     `json:"namespaces_deleted"`
+	PodsCreated       int64     `json:"pods_created"`
+}
+
+// NodeChurn is how many managed pods were scheduled on a node over the range
+type NodeChurn struct {
+	Cluster     string `json:"cluster"`
+	Node        string `json:"node"`
+	PodsCreated int64  `json:"pods_created"`
+}
+
+// CollectChurn stores the namespaces created and deleted since the previous collection and the
+// pods the orchestrator's pod watches saw scheduled per node; it runs every collection interval
+func (c *Collector) CollectChurn(ctx context.Context) {
+	created, deleted := c.orchestrator.NamespacesCreatedTotal(), c.orchestrator.NamespacesDeletedTotal()
+	if err := c.storeMetric(ctx, "", MetricNamespacesCreated, float64(created-c.lastNamespacesCreated)); err != nil {
+		c.logger.Warn("failed to store namespaces_created metric", zap.Error(err))
+	} else {
+		c.lastNamespacesCreated = created
+	}
+	if err := c.storeMetric(ctx, "", MetricNamespacesDeleted, float64(deleted-c.lastNamespacesDeleted)); err != nil {
+		c.logger.Warn("failed to store namespaces_deleted metric", zap.Error(err))
+	} else {
+		c.lastNamespacesDeleted = deleted
+	}
+
+	for _, count := range c.orchestrator.TakeScheduledPods() {
+		if _, err := c.db.ExecContext(ctx, `
+			INSERT INTO pod_churn (id, cluster, node_name, pods_created, timestamp)
+			VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		`, uuid.New().String(), count.Cluster, count.Node, count.Pods); err != nil {
+			c.logger.Warn("failed to store pod churn", zap.String("node", count.Node), zap.Error(err))
+		}
+	}
+}
+
+// GetChurnReport returns the churn between from and to in hourly buckets
+func GetChurnReport(ctx context.Context, db *database.DB, from, to time.Time) (*ChurnReport, error) {
+	report := &ChurnReport{From: from, To: to, Hours: []ChurnHour{}, Nodes: []NodeChurn{}}
+	hours := make(map[int64]*ChurnHour)
+	for h := from.UTC().Truncate(time.Hour); h.Before(to); h = h.Add(time.Hour) {
+		report.Hours = append(report.Hours, ChurnHour{Hour: h})
+	}
+	for i := range report.Hours {
+		hours[report.Hours[i].Hour.Unix()] = &report.Hours[i]
+	}
+	hourOf := func(ts time.Time) *ChurnHour {
+		return hours[ts.UTC().Truncate(time.Hour).Unix()]
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT metric_type, value, timestamp
+		FROM metrics
+		WHERE environment_id IS NULL AND metric_type IN ($1, $2) AND timestamp >= $3 AND timestamp < $4
+	`, MetricNamespacesCreated, MetricNamespacesDeleted, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query namespace churn: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metricType string
+		var value float64
+		var ts time.Time
+		if err := rows.Scan(&metricType, &value, &ts); err != nil {
+			return nil, fmt.Errorf("failed to scan namespace churn: %w", err)
+		}
+		hour := hourOf(ts)
+		if hour == nil {
+			continue
+		}
+		if metricType == MetricNamespacesCreated {
+			hour.NamespacesCreated += int64(value)
+			report.NamespacesCreated += int64(value)
+		} else {
+			hour.NamespacesDeleted += int64(value)
+			report.NamespacesDeleted += int64(value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read namespace churn: %w", err)
+	}
+
+	podRows, err := db.QueryContext(ctx, `
+		SELECT cluster, node_name, pods_created, timestamp
+		FROM pod_churn
+		WHERE timestamp >= $1 AND timestamp < $2
+	`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pod churn: %w", err)
+	}
+	defer podRows.Close()
+	nodes := make(map[NodeChurn]int64)
+	for podRows.Next() {
+		var node NodeChurn
+		var pods int64
+		var ts time.Time
+		if err := podRows.Scan(&node.Cluster, &node.Node, &pods, &ts); err != nil {
+			return nil, fmt.Errorf("failed to scan pod churn: %w", err)
+		}
+		if hour := hourOf(ts); hour != nil {
+			hour.PodsCreated += pods
+		}
+		nodes[node] += pods
+		report.PodsCreated += pods
+	}
+	if err := podRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pod churn: %w", err)
+	}
+
+	for node, pods := range nodes {
+		node.PodsCreated = pods
+		report.Nodes = append(report.Nodes, node)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		a, b := report.Nodes[i], report.Nodes[j]
+		if a.PodsCreated != b.PodsCreated {
+			return a.PodsCreated > b.PodsCreated
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		return a.Node < b.Node
+	})
+	return report, nil
+}
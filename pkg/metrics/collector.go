@@ -12,6 +12,7 @@ import (
 
 	"github.com/sciffer/agentbox/pkg/database"
 	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/orchestrator"
 )
 
@@ -19,16 +20,24 @@ import (
 type Collector struct {
 	db           *database.DB
 	orchestrator *orchestrator.Orchestrator
-	k8sClient    *k8s.Client
+	clusters     *k8s.Clusters
 	interval     time.Duration
 	enabled      bool
-	stopChan     chan struct{}
-	wg           sync.WaitGroup
-	logger       *zap.Logger
+	// rawRetention and rollupRetention bound how long samples and rollups are kept
+	rawRetention    time.Duration
+	rollupRetention time.Duration
+	// lastNamespacesCreated and lastNamespacesDeleted are the orchestrator's namespace counts at
+	// the previous collection, so each one stores the churn of its interval
+	lastNamespacesCreated int64
+	lastNamespacesDeleted int64
+	stopChan              chan struct{}
+	wg                    sync.WaitGroup
+	logger                *zap.Logger
 }
 
 // NewCollector creates a new metrics collector
-func NewCollector(db *database.DB, orch *orchestrator.Orchestrator, k8sClient *k8s.Client, logger *zap.Logger) *Collector {
+// clusters may be nil, in which case pod CPU/memory usage is not collected.
+func NewCollector(db *database.DB, orch *orchestrator.Orchestrator, clusters *k8s.Clusters, logger *zap.Logger) *Collector {
 	enabled := os.Getenv("AGENTBOX_METRICS_ENABLED") != "false"
 	intervalStr := os.Getenv("AGENTBOX_METRICS_COLLECTION_INTERVAL")
 	interval := 30 * time.Second
@@ -37,15 +46,25 @@ func NewCollector(db *database.DB, orch *orchestrator.Orchestrator, k8sClient *k
 			interval = d
 		}
 	}
+	rawRetention := DefaultRawRetention
+	if d, err := time.ParseDuration(os.Getenv("AGENTBOX_METRICS_RAW_RETENTION")); err == nil && d > 0 {
+		rawRetention = d
+	}
+	rollupRetention := DefaultRollupRetention
+	if d, err := time.ParseDuration(os.Getenv("AGENTBOX_METRICS_ROLLUP_RETENTION")); err == nil && d > 0 {
+		rollupRetention = d
+	}
 
 	return &Collector{
-		db:           db,
-		orchestrator: orch,
-		k8sClient:    k8sClient,
-		interval:     interval,
-		enabled:      enabled,
-		stopChan:     make(chan struct{}),
-		logger:       logger,
+		db:              db,
+		orchestrator:    orch,
+		clusters:        clusters,
+		interval:        interval,
+		enabled:         enabled,
+		rawRetention:    rawRetention,
+		rollupRetention: rollupRetention,
+		stopChan:        make(chan struct{}),
+		logger:          logger,
 	}
 }
 
@@ -72,10 +91,12 @@ func (c *Collector) Stop() {
 	c.wg.Wait()
 }
 
-// collectLoop runs the collection loop
+// collectLoop runs the collection loop and the rollup job
 func (c *Collector) collectLoop(ctx context.Context) {
 	ticker := time.NewTicker(c.interval)
 	defer ticker.Stop()
+	rollupTicker := time.NewTicker(RollupInterval)
+	defer rollupTicker.Stop()
 
 	// Collect immediately on start
 	c.collectMetrics(ctx)
@@ -84,6 +105,12 @@ func (c *Collector) collectLoop(ctx context.Context) {
 		select {
 		case <-ticker.C:
 			c.collectMetrics(ctx)
+		case <-rollupTicker.C:
+			if n, err := c.Rollup(ctx, time.Now()); err != nil {
+				c.logger.Warn("failed to roll up metrics", zap.Error(err))
+			} else if n > 0 {
+				c.logger.Debug("rolled up metrics", zap.Int("rollups", n))
+			}
 		case <-c.stopChan:
 			return
 		case <-ctx.Done():
@@ -96,6 +123,7 @@ func (c *Collector) collectLoop(ctx context.Context) {
 func (c *Collector) collectMetrics(ctx context.Context) {
 	// Collect global metrics
 	c.collectGlobalMetrics(ctx)
+	c.CollectChurn(ctx)
 
 	// Collect per-environment metrics
 	c.collectEnvironmentMetrics(ctx)
@@ -122,8 +150,8 @@ func (c *Collector) collectGlobalMetrics(ctx context.Context) {
 			runningCount++
 
 			// Get actual metrics from Kubernetes
-			if c.k8sClient != nil {
-				metrics, err := c.k8sClient.GetPodMetrics(ctx, env.Namespace, "main")
+			if c.clusters != nil {
+				metrics, err := c.podMetrics(ctx, env)
 				if err != nil {
 					c.logger.Debug("failed to get pod metrics",
 						zap.String("environment_id", env.ID),
@@ -159,6 +187,24 @@ func (c *Collector) collectGlobalMetrics(ctx context.Context) {
 		}
 	}
 
+	// Store cumulative count of executions removed by the retention policy
+	if err := c.storeMetric(ctx, "", "executions_purged", float64(c.orchestrator.PurgedExecutionsTotal())); err != nil {
+		c.logger.Warn("failed to store executions_purged metric", zap.Error(err))
+	}
+
+	// Store cumulative counts of execution result cache hits and misses
+	if err := c.storeMetric(ctx, "", "execution_cache_hits", float64(c.orchestrator.ExecutionCacheHitsTotal())); err != nil {
+		c.logger.Warn("failed to store execution_cache_hits metric", zap.Error(err))
+	}
+	if err := c.storeMetric(ctx, "", "execution_cache_misses", float64(c.orchestrator.ExecutionCacheMissesTotal())); err != nil {
+		c.logger.Warn("failed to store execution_cache_misses metric", zap.Error(err))
+	}
+
+	// Store cumulative count of orphaned namespaces deleted by the collector
+	if err := c.storeMetric(ctx, "", "namespaces_collected", float64(c.orchestrator.CollectedNamespacesTotal())); err != nil {
+		c.logger.Warn("failed to store namespaces_collected metric", zap.Error(err))
+	}
+
 	// Store aggregated CPU and memory usage
 	if err := c.storeMetric(ctx, "", "cpu_usage", totalCPU); err != nil {
 		c.logger.Warn("failed to store cpu_usage metric", zap.Error(err))
@@ -170,6 +216,19 @@ func (c *Collector) collectGlobalMetrics(ctx context.Context) {
 	}
 }
 
+// podMetrics reads the main pod's usage from the environment's cluster
+func (c *Collector) podMetrics(ctx context.Context, env *models.Environment) (*k8s.PodMetrics, error) {
+	client, err := c.clusters.Get(env.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	metricsClient, ok := client.(k8s.PodMetricsClient)
+	if !ok {
+		return nil, fmt.Errorf("cluster %q does not support pod metrics", env.Cluster)
+	}
+	return metricsClient.GetPodMetrics(ctx, env.Namespace, "main")
+}
+
 // collectEnvironmentMetrics collects metrics per environment
 func (c *Collector) collectEnvironmentMetrics(ctx context.Context) {
 	// Get all environments
@@ -189,8 +248,8 @@ func (c *Collector) collectEnvironmentMetrics(ctx context.Context) {
 
 			// Get actual CPU/memory usage from Kubernetes
 			var cpuUsage, memoryUsage float64
-			if c.k8sClient != nil {
-				metrics, err := c.k8sClient.GetPodMetrics(ctx, env.Namespace, "main")
+			if c.clusters != nil {
+				metrics, err := c.podMetrics(ctx, env)
 				if err != nil {
 					c.logger.Debug("failed to get pod metrics for environment",
 						zap.String("environment_id", env.ID),
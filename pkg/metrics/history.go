@@ -0,0 +1,473 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/database"
+)
+
+const (
+	// RollupInterval is the width of the rollup buckets
+	RollupInterval = 5 * time.Minute
+	// DefaultRawRetention is how long raw samples are kept once rolled up
+	DefaultRawRetention = 24 * time.Hour
+	// DefaultRollupRetention is how long rollups are kept
+	DefaultRollupRetention = 30 * 24 * time.Hour
+	// MaxHistoryPoints caps the number of buckets in a history response
+	MaxHistoryPoints = 1000
+	// rollupBatch is the span of raw samples aggregated per rollup transaction
+	rollupBatch = time.Hour
+)
+
+// HistoryMetricTypes are the series returned by the history endpoints
+var HistoryMetricTypes = []string{"cpu_usage", "memory_usage", "running_sandboxes"}
+
+// Series is one metric over a history's buckets; entries are nil for buckets without samples
+type Series struct {
+	Avg []*float64 `json:"avg"`
+	Max []*float64 `json:"max"`
+}
+
+// History is a downsampled set of metric series, shaped for charting: Timestamps holds the
+// bucket start times and every series has one value per timestamp
+type History struct {
+	EnvironmentID string             `json:"environment_id,omitempty"`
+	From          time.Time          `json:"from"`
+	To            time.Time          `json:"to"`
+	StepSeconds   int64              `json:"step_seconds"`
+	Timestamps    []time.Time        `json:"timestamps"`
+	Series        map[string]*Series `json:"series"`
+}
+
+// EnvironmentUsage is an environment's usage aggregated over a time range
+type EnvironmentUsage struct {
+	EnvironmentID string  `json:"environment_id"`
+	CPUAvg        float64 `json:"cpu_avg"`
+	CPUMax        float64 `json:"cpu_max"`
+	MemoryAvg     float64 `json:"memory_avg"`
+	MemoryMax     float64 `json:"memory_max"`
+	Samples       int64   `json:"samples"`
+}
+
+// aggregate accumulates samples (or rollups) of one bucket
+type aggregate struct {
+	sum   float64
+	count int64
+	max   float64
+}
+
+func (a *aggregate) add(sum float64, count int64, maxValue float64) {
+	if a.count == 0 || maxValue > a.max {
+		a.max = maxValue
+	}
+	a.sum += sum
+	a.count += count
+}
+
+// HistoryStep returns the bucket width for a time range: the requested step rounded up to whole
+// seconds, raised so the range fits in MaxHistoryPoints buckets
+func HistoryStep(from, to time.Time, requested time.Duration) time.Duration {
+	minStep := to.Sub(from) / (MaxHistoryPoints - 1)
+	step := requested
+	if step < minStep {
+		step = minStep
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	if rem := step % time.Second; rem != 0 {
+		step += time.Second - rem
+	}
+	return step
+}
+
+// GetHistory returns the environment's metrics (global metrics when envID is empty) between from
+// and to, averaged and maxed per step. Rollups are used where raw samples have expired, or where
+// the step is at least RollupInterval.
+func GetHistory(ctx context.Context, db *database.DB, envID string, from, to time.Time, step time.Duration) (*History, error) {
+	step = HistoryStep(from, to, step)
+	boundary, err := rawBoundary(ctx, db, envID, step)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]map[int64]*aggregate, len(HistoryMetricTypes))
+	for _, t := range HistoryMetricTypes {
+		buckets[t] = make(map[int64]*aggregate)
+	}
+	bucketOf := func(ts time.Time) int64 {
+		return ts.Truncate(step).Unix()
+	}
+
+	// Rollups before the boundary
+	if boundary.After(from) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT metric_type, bucket_start, value_sum, value_count, value_max
+			FROM metric_rollups
+			WHERE environment_id = $1 AND bucket_start >= $2 AND bucket_start < $3 AND bucket_start <= $4
+		`, envID, from.Truncate(RollupInterval).UTC(), boundary.UTC(), to.UTC())
+		if err != nil {
+			return nil, fmt.Errorf("failed to query metric rollups: %w", err)
+		}
+		err = scanAggregates(rows, func(metricType string, ts time.Time, sum float64, count int64, maxValue float64) {
+			if series, ok := buckets[metricType]; ok {
+				key := bucketOf(ts)
+				if series[key] == nil {
+					series[key] = &aggregate{}
+				}
+				series[key].add(sum, count, maxValue)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Raw samples from the boundary on
+	rawFrom := from
+	if boundary.After(rawFrom) {
+		rawFrom = boundary
+	}
+	query := `
+		SELECT metric_type, timestamp, value, 1, value
+		FROM metrics
+		WHERE timestamp >= $1 AND timestamp <= $2 AND ` + envCondition(envID, 3)
+	args := []interface{}{rawFrom.UTC(), to.UTC()}
+	if envID != "" {
+		args = append(args, envID)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	err = scanAggregates(rows, func(metricType string, ts time.Time, sum float64, count int64, maxValue float64) {
+		if series, ok := buckets[metricType]; ok {
+			key := bucketOf(ts)
+			if series[key] == nil {
+				series[key] = &aggregate{}
+			}
+			series[key].add(sum, count, maxValue)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Lay the buckets out on a shared, sorted timeline
+	seen := make(map[int64]bool)
+	for _, series := range buckets {
+		for key := range series {
+			seen[key] = true
+		}
+	}
+	keys := make([]int64, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	history := &History{
+		EnvironmentID: envID,
+		From:          from,
+		To:            to,
+		StepSeconds:   int64(step / time.Second),
+		Timestamps:    make([]time.Time, len(keys)),
+		Series:        make(map[string]*Series, len(buckets)),
+	}
+	for i, key := range keys {
+		history.Timestamps[i] = time.Unix(key, 0).UTC()
+	}
+	for metricType, series := range buckets {
+		s := &Series{Avg: make([]*float64, len(keys)), Max: make([]*float64, len(keys))}
+		for i, key := range keys {
+			if a := series[key]; a != nil && a.count > 0 {
+				avg, maxValue := a.sum/float64(a.count), a.max
+				s.Avg[i], s.Max[i] = &avg, &maxValue
+			}
+		}
+		history.Series[metricType] = s
+	}
+	return history, nil
+}
+
+// TopEnvironments returns the environments with the highest average CPU usage between from and
+// to, with their memory usage
+func TopEnvironments(ctx context.Context, db *database.DB, from, to time.Time, limit int) ([]EnvironmentUsage, error) {
+	boundary, err := rawBoundary(ctx, db, "", RollupInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct{ env, metric string }
+	totals := make(map[key]*aggregate)
+	collect := func(rows *sql.Rows) error {
+		defer rows.Close()
+		for rows.Next() {
+			var k key
+			var sum, maxValue float64
+			var count int64
+			if err := rows.Scan(&k.env, &k.metric, &sum, &count, &maxValue); err != nil {
+				return fmt.Errorf("failed to scan metric totals: %w", err)
+			}
+			if totals[k] == nil {
+				totals[k] = &aggregate{}
+			}
+			totals[k].add(sum, count, maxValue)
+		}
+		return rows.Err()
+	}
+
+	if boundary.After(from) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT environment_id, metric_type, SUM(value_sum), SUM(value_count), MAX(value_max)
+			FROM metric_rollups
+			WHERE environment_id <> '' AND metric_type IN ('cpu_usage', 'memory_usage')
+			AND bucket_start >= $1 AND bucket_start < $2 AND bucket_start <= $3
+			GROUP BY environment_id, metric_type
+		`, from.Truncate(RollupInterval).UTC(), boundary.UTC(), to.UTC())
+		if err != nil {
+			return nil, fmt.Errorf("failed to query metric rollups: %w", err)
+		}
+		if err := collect(rows); err != nil {
+			return nil, err
+		}
+	}
+	rawFrom := from
+	if boundary.After(rawFrom) {
+		rawFrom = boundary
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT environment_id, metric_type, SUM(value), COUNT(*), MAX(value)
+		FROM metrics
+		WHERE environment_id IS NOT NULL AND metric_type IN ('cpu_usage', 'memory_usage')
+		AND timestamp >= $1 AND timestamp <= $2
+		GROUP BY environment_id, metric_type
+	`, rawFrom.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	if err := collect(rows); err != nil {
+		return nil, err
+	}
+
+	byEnv := make(map[string]*EnvironmentUsage)
+	for k, a := range totals {
+		if a.count == 0 {
+			continue
+		}
+		u := byEnv[k.env]
+		if u == nil {
+			u = &EnvironmentUsage{EnvironmentID: k.env}
+			byEnv[k.env] = u
+		}
+		switch k.metric {
+		case "cpu_usage":
+			u.CPUAvg, u.CPUMax, u.Samples = a.sum/float64(a.count), a.max, a.count
+		case "memory_usage":
+			u.MemoryAvg, u.MemoryMax = a.sum/float64(a.count), a.max
+		}
+	}
+	usage := make([]EnvironmentUsage, 0, len(byEnv))
+	for _, u := range byEnv {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].CPUAvg != usage[j].CPUAvg {
+			return usage[i].CPUAvg > usage[j].CPUAvg
+		}
+		return usage[i].EnvironmentID < usage[j].EnvironmentID
+	})
+	if limit > 0 && len(usage) > limit {
+		usage = usage[:limit]
+	}
+	return usage, nil
+}
+
+// rawBoundary returns the time from which history is read from raw samples rather than rollups.
+// Coarse steps use rollups wherever they exist; fine steps use raw samples wherever they exist.
+func rawBoundary(ctx context.Context, db *database.DB, envID string, step time.Duration) (time.Time, error) {
+	if step < RollupInterval {
+		args := []interface{}{}
+		if envID != "" {
+			args = append(args, envID)
+		}
+		earliest, ok, err := firstTime(ctx, db, `SELECT timestamp FROM metrics WHERE `+envCondition(envID, 1)+
+			` ORDER BY timestamp ASC LIMIT 1`, args...)
+		if err != nil || ok {
+			return earliest, err
+		}
+	}
+	return rollupWatermark(ctx, db)
+}
+
+// rollupWatermark returns the end of the latest rollup bucket (zero if nothing was rolled up);
+// every raw sample before it has been rolled up
+func rollupWatermark(ctx context.Context, db *database.DB) (time.Time, error) {
+	latest, ok, err := firstTime(ctx, db, `SELECT bucket_start FROM metric_rollups ORDER BY bucket_start DESC LIMIT 1`)
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+	return latest.Add(RollupInterval), nil
+}
+
+// firstTime runs a query selecting a single timestamp column. Plain column queries are used
+// instead of MIN/MAX so SQLite keeps the column type and returns a time.
+func firstTime(ctx context.Context, db *database.DB, query string, args ...interface{}) (time.Time, bool, error) {
+	var t time.Time
+	err := db.QueryRowContext(ctx, query, args...).Scan(&t)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	return t.UTC(), true, nil
+}
+
+// envCondition selects the samples of an environment (bound as parameter n), or the global
+// samples when envID is empty
+func envCondition(envID string, n int) string {
+	if envID == "" {
+		return "environment_id IS NULL"
+	}
+	return fmt.Sprintf("environment_id = $%d", n)
+}
+
+// scanAggregates reads (metric_type, time, sum, count, max) rows
+func scanAggregates(rows *sql.Rows, fn func(metricType string, ts time.Time, sum float64, count int64, maxValue float64)) error {
+	defer rows.Close()
+	for rows.Next() {
+		var metricType string
+		var ts time.Time
+		var sum, maxValue float64
+		var count int64
+		if err := rows.Scan(&metricType, &ts, &sum, &count, &maxValue); err != nil {
+			return fmt.Errorf("failed to scan metric: %w", err)
+		}
+		fn(metricType, ts, sum, count, maxValue)
+	}
+	return rows.Err()
+}
+
+// Rollup aggregates the raw samples of every completed RollupInterval bucket not yet rolled up,
+// then deletes raw samples older than the raw retention and rollups older than the rollup
+// retention. It returns the number of rollups written.
+func (c *Collector) Rollup(ctx context.Context, now time.Time) (int, error) {
+	end := now.UTC().Truncate(RollupInterval)
+	watermark, err := rollupWatermark(ctx, c.db)
+	if err != nil {
+		return 0, err
+	}
+	// Start at the first sample not rolled up yet, skipping periods without samples
+	start, ok, err := firstTime(ctx, c.db, `SELECT timestamp FROM metrics WHERE timestamp >= $1 ORDER BY timestamp ASC LIMIT 1`, watermark)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, c.expire(ctx, now)
+	}
+	start = start.Truncate(RollupInterval)
+	if start.Before(watermark) {
+		start = watermark
+	}
+	// Samples older than the rollup retention would be expired right away
+	if oldest := end.Add(-c.rollupRetention).Truncate(RollupInterval); start.Before(oldest) {
+		start = oldest
+	}
+
+	written := 0
+	for batchStart := start; batchStart.Before(end); batchStart = batchStart.Add(rollupBatch) {
+		batchEnd := batchStart.Add(rollupBatch)
+		if batchEnd.After(end) {
+			batchEnd = end
+		}
+		n, err := c.rollupBatch(ctx, batchStart, batchEnd)
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, c.expire(ctx, now)
+}
+
+// rollupBatch writes the rollups of the buckets in [start, end) in one transaction
+func (c *Collector) rollupBatch(ctx context.Context, start, end time.Time) (int, error) {
+	type key struct {
+		env, metric string
+		bucket      int64
+	}
+	aggregates := make(map[key]*aggregate)
+
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT environment_id, metric_type, timestamp, value
+		FROM metrics
+		WHERE timestamp >= $1 AND timestamp < $2
+	`, start.UTC(), end.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	for rows.Next() {
+		var envID sql.NullString
+		var k key
+		var ts time.Time
+		var value float64
+		if err := rows.Scan(&envID, &k.metric, &ts, &value); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan metric: %w", err)
+		}
+		k.env = envID.String
+		// Clamp to the batch: stored and bound timestamps may compare with second precision
+		bucket := ts.UTC().Truncate(RollupInterval)
+		if bucket.Before(start) {
+			bucket = start
+		}
+		if !bucket.Before(end) {
+			bucket = end.Add(-RollupInterval)
+		}
+		k.bucket = bucket.Unix()
+		if aggregates[k] == nil {
+			aggregates[k] = &aggregate{}
+		}
+		aggregates[k].add(value, 1, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read metrics: %w", err)
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	for k, a := range aggregates {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO metric_rollups (environment_id, metric_type, bucket_start, value_sum, value_count, value_max)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, k.env, k.metric, time.Unix(k.bucket, 0).UTC(), a.sum, a.count, a.max); err != nil {
+			return 0, fmt.Errorf("failed to store metric rollup: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit metric rollups: %w", err)
+	}
+	return len(aggregates), nil
+}
+
+// expire deletes raw samples and rollups past their retention
+func (c *Collector) expire(ctx context.Context, now time.Time) error {
+	if _, err := c.db.ExecContext(ctx, `DELETE FROM metrics WHERE timestamp < $1`, now.Add(-c.rawRetention).UTC()); err != nil {
+		return fmt.Errorf("failed to expire metrics: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, `DELETE FROM pod_churn WHERE timestamp < $1`, now.Add(-c.rawRetention).UTC()); err != nil {
+		return fmt.Errorf("failed to expire pod churn: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, `DELETE FROM metric_rollups WHERE bucket_start < $1`, now.Add(-c.rollupRetention).UTC()); err != nil {
+		return fmt.Errorf("failed to expire metric rollups: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// DeepCopy returns a copy of the environment that shares no maps, slices or pointers with it,
+// so it can be handed to another goroutine while the original keeps being updated
+func (e *Environment) DeepCopy() *Environment {
+	if e == nil {
+		return nil
+	}
+	c := *e
+	c.StartedAt = copyTime(e.StartedAt)
+	c.LastActivityAt = copyTime(e.LastActivityAt)
+	c.LastReconciliationAt = copyTime(e.LastReconciliationAt)
+	c.CompletedAt = copyTime(e.CompletedAt)
+	c.UpdatedAt = copyTime(e.UpdatedAt)
+	c.EstimatedStart = copyTime(e.EstimatedStart)
+	c.CordonedAt = copyTime(e.CordonedAt)
+	if e.ExitCode != nil {
+		exitCode := *e.ExitCode
+		c.ExitCode = &exitCode
+	}
+	if e.Metrics != nil {
+		metrics := *e.Metrics
+		c.Metrics = &metrics
+	}
+	c.Env = maps.Clone(e.Env)
+	c.Command = slices.Clone(e.Command)
+	c.Labels = maps.Clone(e.Labels)
+	c.Metadata = maps.Clone(e.Metadata)
+	c.NodeSelector = maps.Clone(e.NodeSelector)
+	if e.Tolerations != nil {
+		c.Tolerations = make([]Toleration, len(e.Tolerations))
+		for i, t := range e.Tolerations {
+			t.TolerationSeconds = copyInt64(t.TolerationSeconds)
+			c.Tolerations[i] = t
+		}
+	}
+	c.Affinity = e.Affinity.DeepCopy()
+	c.Isolation = e.Isolation.DeepCopy()
+	if e.Pool != nil {
+		pool := *e.Pool
+		c.Pool = &pool
+	}
+	c.PoolReady = copyBool(e.PoolReady)
+	if e.CommandPolicy != nil {
+		policy := *e.CommandPolicy
+		policy.DenyPatterns = slices.Clone(e.CommandPolicy.DenyPatterns)
+		policy.AllowedBinaries = slices.Clone(e.CommandPolicy.AllowedBinaries)
+		c.CommandPolicy = &policy
+	}
+	if e.ReadinessCheck != nil {
+		check := *e.ReadinessCheck
+		check.Exec = slices.Clone(e.ReadinessCheck.Exec)
+		if e.ReadinessCheck.HTTPGet != nil {
+			httpGet := *e.ReadinessCheck.HTTPGet
+			check.HTTPGet = &httpGet
+		}
+		c.ReadinessCheck = &check
+	}
+	c.Lifecycle = e.Lifecycle.DeepCopy()
+	if e.Build != nil {
+		build := *e.Build
+		c.Build = &build
+	}
+	if e.WorkspaceSnapshots != nil {
+		snapshots := *e.WorkspaceSnapshots
+		c.WorkspaceSnapshots = &snapshots
+	}
+	if e.LogShipping != nil {
+		shipping := *e.LogShipping
+		c.LogShipping = &shipping
+	}
+	return &c
+}
+
+// DeepCopy returns a copy of the affinity that shares no maps or slices with it
+func (a *Affinity) DeepCopy() *Affinity {
+	if a == nil {
+		return nil
+	}
+	c := &Affinity{}
+	if a.RequiredNodeTerms != nil {
+		c.RequiredNodeTerms = make([]NodeSelectorTerm, len(a.RequiredNodeTerms))
+		for i, term := range a.RequiredNodeTerms {
+			c.RequiredNodeTerms[i] = NodeSelectorTerm{MatchExpressions: copyNodeSelectorRequirements(term.MatchExpressions)}
+		}
+	}
+	if a.PreferredNodeTerms != nil {
+		c.PreferredNodeTerms = make([]PreferredNodeTerm, len(a.PreferredNodeTerms))
+		for i, term := range a.PreferredNodeTerms {
+			c.PreferredNodeTerms[i] = PreferredNodeTerm{Weight: term.Weight, MatchExpressions: copyNodeSelectorRequirements(term.MatchExpressions)}
+		}
+	}
+	if a.PodAntiAffinity != nil {
+		anti := *a.PodAntiAffinity
+		anti.MatchLabels = maps.Clone(a.PodAntiAffinity.MatchLabels)
+		c.PodAntiAffinity = &anti
+	}
+	return c
+}
+
+// DeepCopy returns a copy of the isolation config that shares no slices or pointers with it
+func (i *IsolationConfig) DeepCopy() *IsolationConfig {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	if i.NetworkPolicy != nil {
+		policy := *i.NetworkPolicy
+		policy.AllowedEgressCIDRs = slices.Clone(i.NetworkPolicy.AllowedEgressCIDRs)
+		policy.AllowedIngressPorts = slices.Clone(i.NetworkPolicy.AllowedIngressPorts)
+		c.NetworkPolicy = &policy
+	}
+	if sc := i.SecurityContext; sc != nil {
+		c.SecurityContext = &SecurityContextConfig{
+			RunAsUser:                copyInt64(sc.RunAsUser),
+			RunAsGroup:               copyInt64(sc.RunAsGroup),
+			RunAsNonRoot:             copyBool(sc.RunAsNonRoot),
+			ReadOnlyRootFilesystem:   copyBool(sc.ReadOnlyRootFilesystem),
+			AllowPrivilegeEscalation: copyBool(sc.AllowPrivilegeEscalation),
+			Capabilities:             sc.Capabilities.DeepCopy(),
+			SeccompProfile:           sc.SeccompProfile,
+		}
+	}
+	if i.DNS != nil {
+		dns := *i.DNS
+		dns.Nameservers = slices.Clone(i.DNS.Nameservers)
+		dns.Searches = slices.Clone(i.DNS.Searches)
+		dns.Options = slices.Clone(i.DNS.Options)
+		c.DNS = &dns
+	}
+	if i.ServiceAccount != nil {
+		sa := *i.ServiceAccount
+		sa.Annotations = maps.Clone(i.ServiceAccount.Annotations)
+		c.ServiceAccount = &sa
+	}
+	return &c
+}
+
+// DeepCopy returns a copy of the capabilities that shares no slices with them
+func (c *CapabilitiesConfig) DeepCopy() *CapabilitiesConfig {
+	if c == nil {
+		return nil
+	}
+	return &CapabilitiesConfig{Add: slices.Clone(c.Add), Drop: slices.Clone(c.Drop)}
+}
+
+// DeepCopy returns a copy of the lifecycle config that shares no slices or pointers with it
+func (l *LifecycleConfig) DeepCopy() *LifecycleConfig {
+	if l == nil {
+		return nil
+	}
+	c := *l
+	c.PreStop = slices.Clone(l.PreStop)
+	if l.TerminationGracePeriodSeconds != nil {
+		grace := *l.TerminationGracePeriodSeconds
+		c.TerminationGracePeriodSeconds = &grace
+	}
+	return &c
+}
+
+// DeepCopy returns a copy of the execution that shares no maps, slices or pointers with it
+func (e *Execution) DeepCopy() *Execution {
+	if e == nil {
+		return nil
+	}
+	c := *e
+	c.Command = slices.Clone(e.Command)
+	c.Env = maps.Clone(e.Env)
+	c.Metadata = maps.Clone(e.Metadata)
+	c.Files = slices.Clone(e.Files)
+	c.Events = slices.Clone(e.Events)
+	c.QueuedAt = copyTime(e.QueuedAt)
+	c.StartedAt = copyTime(e.StartedAt)
+	c.CompletedAt = copyTime(e.CompletedAt)
+	c.PodScheduledAt = copyTime(e.PodScheduledAt)
+	c.PodStartedAt = copyTime(e.PodStartedAt)
+	c.EstimatedStart = copyTime(e.EstimatedStart)
+	if e.ExitCode != nil {
+		exitCode := *e.ExitCode
+		c.ExitCode = &exitCode
+	}
+	c.DurationMs = copyInt64(e.DurationMs)
+	c.MaxMemoryBytes = copyInt64(e.MaxMemoryBytes)
+	if e.CPUSeconds != nil {
+		cpuSeconds := *e.CPUSeconds
+		c.CPUSeconds = &cpuSeconds
+	}
+	if e.EffectiveResources != nil {
+		resources := *e.EffectiveResources
+		c.EffectiveResources = &resources
+	}
+	if e.Callback != nil {
+		callback := *e.Callback
+		callback.LastAttemptAt = copyTime(e.Callback.LastAttemptAt)
+		callback.DeliveredAt = copyTime(e.Callback.DeliveredAt)
+		c.Callback = &callback
+	}
+	if e.Submission != nil {
+		submission := *e.Submission
+		if e.Submission.Resources != nil {
+			resources := *e.Submission.Resources
+			submission.Resources = &resources
+		}
+		submission.Isolation = e.Submission.Isolation.DeepCopy()
+		c.Submission = &submission
+	}
+	return &c
+}
+
+// DeepCopy returns a copy of the pipeline that shares no maps, slices or pointers with it
+func (p *Pipeline) DeepCopy() *Pipeline {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.CompletedAt = copyTime(p.CompletedAt)
+	c.Steps = make([]PipelineStep, len(p.Steps))
+	for i, step := range p.Steps {
+		step.Command = slices.Clone(step.Command)
+		step.Env = maps.Clone(step.Env)
+		step.DependsOn = slices.Clone(step.DependsOn)
+		if step.ExitCode != nil {
+			exitCode := *step.ExitCode
+			step.ExitCode = &exitCode
+		}
+		step.StartedAt = copyTime(step.StartedAt)
+		step.CompletedAt = copyTime(step.CompletedAt)
+		c.Steps[i] = step
+	}
+	return &c
+}
+
+// DeepCopy returns a copy of the operation that shares no slices or pointers with it
+func (op *Operation) DeepCopy() *Operation {
+	if op == nil {
+		return nil
+	}
+	c := *op
+	c.CompletedAt = copyTime(op.CompletedAt)
+	c.Results = slices.Clone(op.Results)
+	return &c
+}
+
+func copyNodeSelectorRequirements(reqs []NodeSelectorRequirement) []NodeSelectorRequirement {
+	if reqs == nil {
+		return nil
+	}
+	out := make([]NodeSelectorRequirement, len(reqs))
+	for i, r := range reqs {
+		r.Values = slices.Clone(r.Values)
+		out[i] = r
+	}
+	return out
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func copyInt64(v *int64) *int64 {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
+func copyBool(v *bool) *bool {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
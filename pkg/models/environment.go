@@ -1,6 +1,13 @@
 package models
 
-import "time"
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // EnvironmentStatus represents the current state of an environment
 type EnvironmentStatus string
@@ -11,6 +18,32 @@ const (
 	StatusTerminating EnvironmentStatus = "terminating"
 	StatusTerminated  EnvironmentStatus = "terminated"
 	StatusFailed      EnvironmentStatus = "failed"
+	// StatusDegraded is reported (never stored) while the environment's cluster is unreachable
+	StatusDegraded EnvironmentStatus = "degraded"
+)
+
+// IsSettled reports whether the environment is done starting up: it is running, failed, or
+// being deleted
+func (s EnvironmentStatus) IsSettled() bool {
+	return s == StatusRunning || s == StatusFailed || s == StatusTerminating || s == StatusTerminated
+}
+
+// EnvironmentPhase is the provisioning step an environment is in (finer-grained than its status)
+type EnvironmentPhase string
+
+// Provisioning phases, in order
+const (
+	PhaseQueued                      EnvironmentPhase = "queued"
+	PhaseBuilding                    EnvironmentPhase = "building"                       // only environments with a build section
+	PhaseWaitingForPreviousNamespace EnvironmentPhase = "waiting_for_previous_namespace" // a namespace of the same name is still being deleted
+	PhaseCreatingNamespace           EnvironmentPhase = "creating_namespace"
+	PhaseApplyingQuota               EnvironmentPhase = "applying_quota"
+	PhaseApplyingNetworkPolicy       EnvironmentPhase = "applying_network_policy"
+	PhaseCreatingPod                 EnvironmentPhase = "creating_pod"
+	PhasePullingImage                EnvironmentPhase = "pulling_image"
+	PhaseStarting                    EnvironmentPhase = "starting"
+	PhaseWaitingReady                EnvironmentPhase = "waiting_ready"
+	PhaseReady                       EnvironmentPhase = "ready"
 )
 
 // Toleration represents a Kubernetes toleration for pod scheduling
@@ -22,6 +55,63 @@ type Toleration struct {
 	TolerationSeconds *int64 `json:"tolerationSeconds,omitempty"`
 }
 
+// Node selector operators supported in affinity terms
+const (
+	NodeSelectorOpIn     = "In"
+	NodeSelectorOpNotIn  = "NotIn"
+	NodeSelectorOpExists = "Exists"
+)
+
+// Affinity constrains where an environment's pods (main, execution and standby pods) are
+// scheduled. It is a subset of the Kubernetes affinity API; the environment's node_selector
+// still applies and is added to every required node term.
+type Affinity struct {
+	// RequiredNodeTerms: a pod is only scheduled on a node matching at least one term
+	RequiredNodeTerms []NodeSelectorTerm `json:"required_node_terms,omitempty"`
+	// PreferredNodeTerms rank the nodes a pod can be scheduled on (e.g. prefer spot nodes)
+	PreferredNodeTerms []PreferredNodeTerm `json:"preferred_node_terms,omitempty"`
+	// PodAntiAffinity spreads the environment's pods across a topology (e.g. zones)
+	PodAntiAffinity *PodAntiAffinity `json:"pod_anti_affinity,omitempty"`
+}
+
+// IsEmpty reports whether the affinity has no constraint; an empty affinity in a PATCH removes it
+func (a *Affinity) IsEmpty() bool {
+	return a == nil || (len(a.RequiredNodeTerms) == 0 && len(a.PreferredNodeTerms) == 0 && a.PodAntiAffinity == nil)
+}
+
+// NodeSelectorTerm matches nodes satisfying all of its expressions
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `json:"match_expressions"`
+}
+
+// NodeSelectorRequirement matches a node label: "In" and "NotIn" compare it to Values,
+// "Exists" only requires the label (Values must be empty)
+type NodeSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
+// PreferredNodeTerm is a node term with a weight (1-100) added to the score of matching nodes
+type PreferredNodeTerm struct {
+	Weight           int32                     `json:"weight"`
+	MatchExpressions []NodeSelectorRequirement `json:"match_expressions"`
+}
+
+// PodAntiAffinity keeps a pod away from nodes (or zones, per TopologyKey) already running pods
+// with the given labels in the environment's namespace
+type PodAntiAffinity struct {
+	// MatchLabels selects the pods to spread from (default: all of the environment's pods)
+	MatchLabels map[string]string `json:"match_labels,omitempty"`
+	// TopologyKey is the node label defining a domain, e.g. "topology.kubernetes.io/zone"
+	// (default: "kubernetes.io/hostname", one pod per node)
+	TopologyKey string `json:"topology_key,omitempty"`
+	// Required makes spreading a hard constraint; by default it is a preference with Weight
+	Required bool `json:"required,omitempty"`
+	// Weight of the preference, 1-100 (default: 100)
+	Weight int32 `json:"weight,omitempty"`
+}
+
 // NetworkPolicyConfig defines network isolation settings
 type NetworkPolicyConfig struct {
 	// AllowInternet enables full internet access (default: false)
@@ -34,6 +124,16 @@ type NetworkPolicyConfig struct {
 	AllowClusterInternal bool `json:"allow_cluster_internal,omitempty"`
 }
 
+// NetworkPreset is a named network policy of the server configuration, with the network
+// policy rules it results in
+type NetworkPreset struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Policy      NetworkPolicyConfig `json:"policy"`
+	// Rules describes the traffic the policy allows, one rule per entry
+	Rules []string `json:"rules"`
+}
+
 // SecurityContextConfig defines pod security settings
 type SecurityContextConfig struct {
 	// RunAsUser specifies the UID to run the container as
@@ -46,6 +146,94 @@ type SecurityContextConfig struct {
 	ReadOnlyRootFilesystem *bool `json:"read_only_root_filesystem,omitempty"`
 	// AllowPrivilegeEscalation controls whether a process can gain more privileges
 	AllowPrivilegeEscalation *bool `json:"allow_privilege_escalation,omitempty"`
+	// Capabilities adds or drops Linux capabilities (e.g. drop ["ALL"], add ["NET_BIND_SERVICE"])
+	Capabilities *CapabilitiesConfig `json:"capabilities,omitempty"`
+	// SeccompProfile is the seccomp profile type: RuntimeDefault or Unconfined (empty = the
+	// runtime's default behavior)
+	SeccompProfile string `json:"seccomp_profile,omitempty"`
+}
+
+// CapabilitiesConfig lists Linux capabilities (without the CAP_ prefix) to add and drop
+type CapabilitiesConfig struct {
+	Add  []string `json:"add,omitempty"`
+	Drop []string `json:"drop,omitempty"`
+}
+
+// Seccomp profile types of SecurityContextConfig.SeccompProfile
+const (
+	SeccompRuntimeDefault = "RuntimeDefault"
+	SeccompUnconfined     = "Unconfined"
+)
+
+// DefaultCapabilities are the capabilities container runtimes grant by default; adding them does
+// not widen what a container may do
+var DefaultCapabilities = []string{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD", "NET_BIND_SERVICE",
+	"NET_RAW", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// PrivilegedSetting returns the first setting of sc that grants more than the container runtime
+// allows by default (a capability outside DefaultCapabilities or the Unconfined seccomp
+// profile), or "" when there is none
+func (sc *SecurityContextConfig) PrivilegedSetting() string {
+	if sc == nil {
+		return ""
+	}
+	if sc.Capabilities != nil {
+		for _, name := range sc.Capabilities.Add {
+			if !slices.Contains(DefaultCapabilities, name) {
+				return "capabilities.add " + name
+			}
+		}
+	}
+	if sc.SeccompProfile == SeccompUnconfined {
+		return "seccomp_profile " + SeccompUnconfined
+	}
+	return ""
+}
+
+// Exec modes of Environment.ExecMode
+const (
+	// ExecModeSerialized queues synchronous execs so only one runs in the main pod at a time
+	ExecModeSerialized = "serialized"
+	// ExecModeParallel runs synchronous execs concurrently
+	ExecModeParallel = "parallel"
+)
+
+// Environment modes of Environment.Mode
+const (
+	// EnvironmentModeInteractive keeps the main pod running (by default with sleep infinity) for
+	// execs and attach sessions
+	EnvironmentModeInteractive = "interactive"
+	// EnvironmentModeOneShot runs the main pod's command to completion, records its exit code and
+	// output on the environment and ends it: terminated on exit code 0, failed otherwise
+	EnvironmentModeOneShot = "oneshot"
+)
+
+// DNS policies of DNSConfig.Policy
+const (
+	// DNSPolicyClusterFirst resolves through the cluster DNS; Nameservers are added to it
+	DNSPolicyClusterFirst = "ClusterFirst"
+	// DNSPolicyNone resolves only through Nameservers (e.g. a filtering resolver)
+	DNSPolicyNone = "None"
+)
+
+// DNSConfig defines how an environment's pods resolve names
+type DNSConfig struct {
+	// Policy is "ClusterFirst" (default) or "None"; "None" requires Nameservers
+	Policy string `json:"policy,omitempty"`
+	// Nameservers are resolver IPs (at most 3); egress to them on port 53 is allowed automatically
+	Nameservers []string `json:"nameservers,omitempty"`
+	// Searches are DNS search domains
+	Searches []string `json:"searches,omitempty"`
+	// Options are resolver options, e.g. {"name": "ndots", "value": "2"}
+	Options []DNSOption `json:"options,omitempty"`
+}
+
+// DNSOption is a resolver option; Value is omitted for flags such as "edns0"
+type DNSOption struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
 }
 
 // IsolationConfig defines the isolation level and security settings
@@ -53,10 +241,42 @@ type IsolationConfig struct {
 	// RuntimeClass specifies the container runtime (e.g., "gvisor", "kata", "runc")
 	// Empty string uses the cluster default
 	RuntimeClass string `json:"runtime_class,omitempty"`
+	// PriorityClassName sets the Kubernetes PriorityClass of the pods (empty = the server's default
+	// for the pod type); it must be one of kubernetes.priority_classes.allowed
+	PriorityClassName string `json:"priority_class_name,omitempty"`
+	// NetworkPreset names a network policy preset of the server configuration (e.g.
+	// "internet-only"). It is resolved into NetworkPolicy when the environment is created or
+	// updated: NetworkPolicy's lists replace the preset's and its allow_* flags set to true are
+	// added to the preset's.
+	NetworkPreset string `json:"network_preset,omitempty"`
 	// NetworkPolicy defines network isolation settings
 	NetworkPolicy *NetworkPolicyConfig `json:"network_policy,omitempty"`
 	// SecurityContext defines pod security settings
 	SecurityContext *SecurityContextConfig `json:"security_context,omitempty"`
+	// DNS overrides the pods' DNS resolution (nil = cluster DNS)
+	DNS *DNSConfig `json:"dns,omitempty"`
+	// ExecInheritSecurityContext runs ephemeral execution pods with exactly the environment's
+	// security context instead of the stricter execution_security defaults (only admins may set it)
+	ExecInheritSecurityContext bool `json:"exec_inherit_security_context,omitempty"`
+	// DisableExecWrapper runs execution pods' commands as is, for images that cannot run the exec
+	// wrapper (executions.wrapper); their executions report no cpu_seconds or max_memory_bytes
+	DisableExecWrapper bool `json:"disable_exec_wrapper,omitempty"`
+	// ServiceAccount runs the environment's pods with a ServiceAccount created in its namespace
+	// (nil = the namespace's default ServiceAccount); it cannot be set per execution
+	ServiceAccount *ServiceAccountConfig `json:"service_account,omitempty"`
+}
+
+// ServiceAccountConfig describes the ServiceAccount created in an environment's namespace for its
+// main, standby and execution pods, e.g. to grant cloud IAM roles through IRSA or Workload Identity
+type ServiceAccountConfig struct {
+	// Name of the ServiceAccount (lowercase alphanumeric with hyphens; not "default")
+	Name string `json:"name"`
+	// Annotations are set on the ServiceAccount (e.g. eks.amazonaws.com/role-arn); each must be
+	// allowed by kubernetes.service_accounts.allowed_annotations
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// AutomountToken mounts a Kubernetes API token of the ServiceAccount into the pods (default:
+	// false; IRSA and Workload Identity do not need it)
+	AutomountToken bool `json:"automount_token,omitempty"`
 }
 
 // PoolConfig defines standby pod pool settings for an environment
@@ -67,6 +287,166 @@ type PoolConfig struct {
 	Size int `json:"size,omitempty"`
 	// MinReady is the minimum number of pods that should be ready before accepting executions
 	MinReady int `json:"min_ready,omitempty"`
+	// PrewarmOnCreate starts creating the standby pods together with the main pod instead of
+	// once the environment is running
+	PrewarmOnCreate bool `json:"prewarm_on_create,omitempty"`
+}
+
+// CommandPolicy restricts the commands non-admin users may run in an environment. It is
+// combined with the server-wide policy: deny patterns add up, allowed binaries replace the
+// global allowlist, and the smaller max argument length wins.
+type CommandPolicy struct {
+	// Unrestricted disables command checks for the environment (only admins may set it)
+	Unrestricted bool `json:"unrestricted,omitempty"`
+	// DenyPatterns are regular expressions matched against the command line
+	DenyPatterns []string `json:"deny_patterns,omitempty"`
+	// AllowedBinaries enables allowlist mode: only these programs may be run (matched by base name)
+	AllowedBinaries []string `json:"allowed_binaries,omitempty"`
+	// MaxArgLength is the maximum length of a single argument in bytes (0 = unlimited)
+	MaxArgLength int `json:"max_arg_length,omitempty"`
+}
+
+// ReadinessCheck is run against an environment's pod after it starts; the environment becomes
+// running (and a standby pod joins the pool) only once the check succeeds. Exactly one of
+// Exec, HTTPGet and FileExists must be set.
+type ReadinessCheck struct {
+	// Exec runs a command in the pod; exit code 0 means ready
+	Exec []string `json:"exec,omitempty"`
+	// HTTPGet requests a port/path of the pod; a 2xx or 3xx response means ready
+	HTTPGet *HTTPGetCheck `json:"http_get,omitempty"`
+	// FileExists is a path in the pod whose existence means ready
+	FileExists string `json:"file_exists,omitempty"`
+	// IntervalSeconds is the time between attempts (default: 2)
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+	// TimeoutSeconds limits a single attempt (default: 5)
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// FailureThreshold fails the environment after this many consecutive failed attempts
+	// (0 = keep trying until the startup timeout)
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+}
+
+// HTTPGetCheck is an HTTP readiness check against a port of the pod
+type HTTPGetCheck struct {
+	Port int `json:"port"`
+	// Path defaults to "/"
+	Path string `json:"path,omitempty"`
+}
+
+// IsEmpty reports whether the check has no probe; an empty check in a PATCH removes the check
+func (c *ReadinessCheck) IsEmpty() bool {
+	return c == nil || (len(c.Exec) == 0 && c.HTTPGet == nil && c.FileExists == "")
+}
+
+// LifecycleConfig controls how the main container of an environment is stopped when its pod is
+// deleted (environment deletion, or the main pod being recreated by reconciliation)
+type LifecycleConfig struct {
+	// PreStop runs in the main container before it is sent SIGTERM, e.g. to flush state to disk
+	PreStop []string `json:"pre_stop,omitempty"`
+	// TerminationGracePeriodSeconds is how long the container gets to stop, pre_stop included,
+	// before it is killed (nil = Kubernetes' default of 30 seconds)
+	TerminationGracePeriodSeconds *int `json:"termination_grace_period_seconds,omitempty"`
+}
+
+// IsEmpty reports whether the config sets nothing; an empty config in a PATCH removes it
+func (c *LifecycleConfig) IsEmpty() bool {
+	return c == nil || (len(c.PreStop) == 0 && c.TerminationGracePeriodSeconds == nil)
+}
+
+// WorkspaceSnapshotConfig opts an environment into workspace snapshots: Path is archived out of
+// the main pod every interval, the newest Keep snapshots are kept, and the newest one is restored
+// when the main pod has to be recreated (e.g. after a node failure)
+type WorkspaceSnapshotConfig struct {
+	// Path is the absolute directory of the main pod to snapshot, e.g. "/workspace"
+	Path string `json:"path"`
+	// IntervalSeconds is the time between scheduled snapshots (0 = snapshots.default_interval_seconds)
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+	// Keep is how many snapshots are kept; older ones are deleted (0 = snapshots.default_keep)
+	Keep int `json:"keep,omitempty"`
+}
+
+// IsEmpty reports whether no path is set; an empty config in a PATCH turns snapshots off
+func (c *WorkspaceSnapshotConfig) IsEmpty() bool {
+	return c == nil || c.Path == ""
+}
+
+// Workspace snapshot limits
+const (
+	// MinSnapshotIntervalSeconds is the shortest snapshot interval an environment may set
+	MinSnapshotIntervalSeconds = 60
+	// MaxSnapshotKeep is the most snapshots an environment may keep
+	MaxSnapshotKeep = 100
+)
+
+// Workspace snapshot triggers
+const (
+	SnapshotTriggerScheduled = "scheduled"
+	SnapshotTriggerManual    = "manual"
+)
+
+// WorkspaceSnapshot is one stored archive of an environment's workspace
+type WorkspaceSnapshot struct {
+	ID            string `json:"id"`
+	EnvironmentID string `json:"environment_id"`
+	// Path is the directory of the main pod the snapshot was taken of
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Trigger is SnapshotTriggerScheduled or SnapshotTriggerManual
+	Trigger   string    `json:"trigger"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RestoreSnapshotResponse reports a restored workspace snapshot
+type RestoreSnapshotResponse struct {
+	EnvironmentID string `json:"environment_id"`
+	SnapshotID    string `json:"snapshot_id"`
+	Path          string `json:"path"`
+	SizeBytes     int64  `json:"size_bytes"`
+}
+
+// BuildSpec builds an environment's image in the cluster instead of pulling an existing one;
+// the environment then runs the pushed image by digest. Exactly one of Dockerfile and GitURL
+// must be set.
+type BuildSpec struct {
+	// Dockerfile is the contents of a Dockerfile, built with an empty context (so it cannot COPY
+	// local files)
+	Dockerfile string `json:"dockerfile,omitempty"`
+	// GitURL is the https URL of a git repository holding the build context
+	GitURL string `json:"git_url,omitempty"`
+	// GitRef is the ref (e.g. refs/heads/main, refs/tags/v1) or commit to build (default: the
+	// repository's default branch)
+	GitRef string `json:"git_ref,omitempty"`
+	// ContextPath is the repository directory used as build context (default: its root)
+	ContextPath string `json:"context_path,omitempty"`
+	// DockerfilePath is the Dockerfile's path relative to the context (default: Dockerfile)
+	DockerfilePath string `json:"dockerfile_path,omitempty"`
+}
+
+// LogShippingSpec ships the main pod's log of an environment to an external sink while it runs,
+// so the log outlives pods recreated by reconciliation
+type LogShippingSpec struct {
+	// Sink is "loki", "s3" or "webhook"
+	Sink string `json:"sink,omitempty"`
+	// Credentials names an entry of the server's log_shipping.credentials holding the sink's
+	// endpoint and secrets
+	Credentials string `json:"credentials,omitempty"`
+	// Disabled ships nothing, even when the server ships the log of every environment
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// LogShippingStats reports the log shipping of an environment on the server answering
+type LogShippingStats struct {
+	Sink        string `json:"sink"`
+	Credentials string `json:"credentials"`
+	// Active reports whether the main pod's log is being followed
+	Active         bool  `json:"active"`
+	ShippedBytes   int64 `json:"shipped_bytes"`
+	ShippedLines   int64 `json:"shipped_lines"`
+	ShippedBatches int64 `json:"shipped_batches"`
+	// DroppedLines counts lines of batches the sink still rejected after all attempts
+	DroppedLines  int64      `json:"dropped_lines"`
+	LastShippedAt *time.Time `json:"last_shipped_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
 }
 
 // Environment represents an isolated execution environment
@@ -74,11 +454,14 @@ type Environment struct {
 	ID           string            `json:"id"`
 	Name         string            `json:"name"`
 	Status       EnvironmentStatus `json:"status"`
+	Phase        EnvironmentPhase  `json:"phase,omitempty"`
 	Image        string            `json:"image"`
 	CreatedAt    time.Time         `json:"created_at"`
 	StartedAt    *time.Time        `json:"started_at,omitempty"`
 	Resources    ResourceSpec      `json:"resources"`
-	Endpoint     string            `json:"endpoint"`
+	Endpoint     string            `json:"endpoint"`             // Attach URL (same as AttachURL, kept for older clients)
+	APIURL       string            `json:"api_url,omitempty"`    // The environment's http(s) API resource
+	AttachURL    string            `json:"attach_url,omitempty"` // The environment's ws(s) attach URL
 	Namespace    string            `json:"namespace"`
 	Metrics      *ResourceMetrics  `json:"metrics,omitempty"`
 	Env          map[string]string `json:"env,omitempty"`
@@ -86,28 +469,190 @@ type Environment struct {
 	Labels       map[string]string `json:"labels,omitempty"`
 	Timeout      int               `json:"timeout,omitempty"`
 	UserID       string            `json:"user_id,omitempty"`
+	TeamID       string            `json:"team_id,omitempty"`
+	Cluster      string            `json:"cluster,omitempty"`
 	NodeSelector map[string]string `json:"node_selector,omitempty"`
 	Tolerations  []Toleration      `json:"tolerations,omitempty"`
+	Affinity     *Affinity         `json:"affinity,omitempty"`
 	Isolation    *IsolationConfig  `json:"isolation,omitempty"`
 	Pool         *PoolConfig       `json:"pool,omitempty"`
+	// PoolReady reports whether the standby pool holds at least pool.min_ready pods (the full
+	// pool size when min_ready is unset); nil without a pool
+	PoolReady *bool `json:"pool_ready,omitempty"`
+	// CommandPolicy restricts exec commands (nil = server-wide policy only)
+	CommandPolicy *CommandPolicy `json:"command_policy,omitempty"`
+	// ReadinessCheck must pass before the environment is running (nil = running once the pod is)
+	ReadinessCheck *ReadinessCheck `json:"readiness_check,omitempty"`
+	// Lifecycle is how the main container is stopped (nil = Kubernetes' defaults)
+	Lifecycle *LifecycleConfig `json:"lifecycle,omitempty"`
+	// Build is how the environment's image is built; Image is empty until the build succeeds
+	Build *BuildSpec `json:"build,omitempty"`
+	// LogShipping ships the main pod's log to an external sink (nil = the server's default)
+	LogShipping *LogShippingSpec `json:"log_shipping,omitempty"`
+	// WorkspaceSnapshots periodically archives a directory of the main pod and restores it into
+	// a recreated main pod (nil = no snapshots)
+	WorkspaceSnapshots *WorkspaceSnapshotConfig `json:"workspace_snapshots,omitempty"`
+	// Metadata is freeform key/value data kept by AgentBox only: unlike Labels it is not
+	// restricted to Kubernetes label syntax and never reaches the cluster
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Cordoned environments accept no new execs or executions (423 Locked); running ones finish
+	// and the standby pool is not replenished. CordonReason is reported to rejected callers.
+	Cordoned     bool       `json:"cordoned,omitempty"`
+	CordonReason string     `json:"cordon_reason,omitempty"`
+	CordonedAt   *time.Time `json:"cordoned_at,omitempty"`
+	// StatusMessage explains the current status, e.g. the output of a failed readiness check
+	StatusMessage string `json:"status_message,omitempty"`
+	// LastActivityAt is when the environment was last used (exec, run, logs, attach)
+	LastActivityAt *time.Time `json:"last_activity_at,omitempty"`
+	// IdleTimeout terminates the environment after this many seconds without activity
+	// (0 = the server's default idle timeout)
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	// GroupID is the environment group this environment is a replica of, if any
+	GroupID string `json:"group_id,omitempty"`
+	// ReservationID is the capacity reservation the environment was created with, if any
+	ReservationID string `json:"reservation_id,omitempty"`
+	// RecordSessions records interactive attach sessions (see GET /environments/{id}/sessions)
+	RecordSessions bool `json:"record_sessions,omitempty"`
+	// ExecMode is how synchronous execs share the main pod (ExecMode*; empty = serialized)
+	ExecMode string `json:"exec_mode,omitempty"`
+	// Mode is "interactive" or "oneshot" (EnvironmentMode*; empty = interactive)
+	Mode string `json:"mode,omitempty"`
+	// RetentionSeconds deletes a oneshot environment this long after its command completed
+	// (0 = kept until deleted)
+	RetentionSeconds int `json:"retention_seconds,omitempty"`
+	// ExitCode, Output and CompletedAt are the result of a oneshot environment's command, set when
+	// it completes. ExitCode stays nil when the command did not finish (it timed out). Output is
+	// the pod log, keeping its head and tail when it exceeds executions.max_output_bytes.
+	ExitCode        *int       `json:"exit_code,omitempty"`
+	Output          string     `json:"output,omitempty"`
+	OutputTruncated bool       `json:"output_truncated,omitempty"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	// SchedulingWarning is set in the create response when the cluster currently lacks the free
+	// capacity to schedule the environment (it stays pending until capacity frees up)
+	SchedulingWarning string `json:"scheduling_warning,omitempty"`
+	// EstimatedStart is set in the create response when the provisioning queue is full: when
+	// provisioning is expected to start, from how long provisioning took recently
+	EstimatedStart *time.Time `json:"estimated_start,omitempty"`
+	// UpdatedAt is when the environment was last written to the database, and Version counts
+	// those writes; replicas compare Version to tell whether their cached copy is current
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Version   int64      `json:"-"`
 
 	// Reconciliation retry tracking (for pending/failed environments)
 	ReconciliationRetryCount  int        `json:"reconciliation_retry_count,omitempty"`
 	LastReconciliationError   string     `json:"last_reconciliation_error,omitempty"`
 	LastReconciliationAt      *time.Time `json:"last_reconciliation_at,omitempty"`
-	ReconciliationRetriesLeft int        `json:"reconciliation_retries_left,omitempty"` // Computed: max_retries - retry_count (for UI)
+	ReconciliationRetriesLeft int        `json:"reconciliation_retries_left,omitempty"` // Computed: max_retries - retry_count, -1 when unlimited (for UI)
+}
+
+// Metadata limits (environments and executions)
+const (
+	MaxMetadataKeys       = 32
+	MaxMetadataKeyLength  = 128
+	MaxMetadataValueBytes = 4096
+)
+
+// SerializesExecs reports whether synchronous execs in the environment run one at a time
+func (e *Environment) SerializesExecs() bool {
+	return e.ExecMode != ExecModeParallel
+}
+
+// IsOneShot reports whether the environment runs its command to completion (EnvironmentModeOneShot)
+func (e *Environment) IsOneShot() bool {
+	return e.Mode == EnvironmentModeOneShot
 }
 
 // EnvironmentEvent is a reconciliation or lifecycle event shown in environment logs
 type EnvironmentEvent struct {
 	ID            string    `json:"id"`
 	EnvironmentID string    `json:"environment_id"`
-	EventType     string    `json:"event_type"` // e.g. "reconciliation_start", "reconciliation_success", "reconciliation_failure", "provisioning"
+	EventType     string    `json:"event_type"`         // e.g. "reconciliation_start", "reconciliation_success", "reconciliation_failure", "provisioning_phase"
+	ActorID       string    `json:"actor_id,omitempty"` // user whose request caused the event (empty for the server)
 	Message       string    `json:"message"`
 	Details       string    `json:"details,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// EnvironmentEventsResponse is a page of an environment's events, newest first (events with the
+// same timestamp ordered by ID, descending)
+type EnvironmentEventsResponse struct {
+	Events []*EnvironmentEvent `json:"events"`
+	// NextPageToken fetches the next (older) page (as page_token); empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// ActivityItem is one entry of an environment's activity feed, merged from the environment's
+// events, the audit log entries about it and its executions
+type ActivityItem struct {
+	// ID is unique within the feed and stable across requests ("<source>:<id of the object>")
+	ID string `json:"id"`
+	// Source is where the item comes from: "event", "audit" or "execution"
+	Source string `json:"source"`
+	// Action is the event type, the audit action, or execution.submitted / execution.completed
+	Action    string    `json:"action"`
+	ActorID   string    `json:"actor_id,omitempty"`
+	Summary   string    `json:"summary"`
+	Details   string    `json:"details,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Link is the API path of the underlying object, when it has one
+	Link string `json:"link,omitempty"`
+}
+
+// ActivityFeedResponse is a page of an environment's activity feed, newest first (items with
+// the same timestamp ordered by ID, descending)
+type ActivityFeedResponse struct {
+	Items []ActivityItem `json:"items"`
+	// NextPageToken fetches the next (older) page (as page_token); empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// Search hit types (and values of GET /search's types)
+const (
+	SearchTypeEnvironment = "environment"
+	SearchTypeExecution   = "execution"
+)
+
+// SearchHit is an environment or execution matching a search
+type SearchHit struct {
+	Type string `json:"type"` // "environment" or "execution"
+	ID   string `json:"id"`
+	// EnvironmentID is the environment's own ID for environment hits
+	EnvironmentID string `json:"environment_id"`
+	// MatchedFields are the fields holding the query: id (as a prefix), name, image, labels,
+	// metadata and owner for environments, command for executions
+	MatchedFields []string `json:"matched_fields"`
+	Name          string   `json:"name,omitempty"`
+	Image         string   `json:"image,omitempty"`
+	Owner         string   `json:"owner,omitempty"` // the owner's username
+	// Command is the execution's command line (arguments joined by spaces)
+	Command   string    `json:"command,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SearchResponse is the result of GET /search: environment hits, then execution hits, each
+// newest first
+type SearchResponse struct {
+	Hits []SearchHit `json:"hits"`
+	// Truncated is set when a type has more hits than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// AuditEntry is a security-relevant action or notification recorded in the audit log
+type AuditEntry struct {
+	ID      string `json:"id"`
+	Action  string `json:"action"` // e.g. "api_key.rotated", "api_key.expiring"
+	ActorID string `json:"actor_id,omitempty"`
+	// ImpersonatorID is the super admin who acted as ActorID (entries written while impersonating)
+	ImpersonatorID string    `json:"impersonator_id,omitempty"`
+	ResourceType   string    `json:"resource_type,omitempty"`
+	ResourceID     string    `json:"resource_id,omitempty"`
+	Message        string    `json:"message"`
+	Details        string    `json:"details,omitempty"`
+	ClientIP       string    `json:"client_ip,omitempty"` // client address of the request behind the entry
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 // ResourceSpec defines resource limits and requests
 type ResourceSpec struct {
 	CPU     string `json:"cpu"`
@@ -124,7 +669,7 @@ type ResourceMetrics struct {
 // CreateEnvironmentRequest is the request body for creating an environment
 type CreateEnvironmentRequest struct {
 	Name         string            `json:"name" validate:"required"`
-	Image        string            `json:"image" validate:"required"`
+	Image        string            `json:"image"` // required unless build is set
 	Resources    ResourceSpec      `json:"resources" validate:"required"`
 	Timeout      int               `json:"timeout,omitempty"`
 	Env          map[string]string `json:"env,omitempty"`
@@ -132,8 +677,49 @@ type CreateEnvironmentRequest struct {
 	Labels       map[string]string `json:"labels,omitempty"`
 	NodeSelector map[string]string `json:"node_selector,omitempty"`
 	Tolerations  []Toleration      `json:"tolerations,omitempty"`
-	Isolation    *IsolationConfig  `json:"isolation,omitempty"`
-	Pool         *PoolConfig       `json:"pool,omitempty"`
+	// Affinity adds node affinity and pod anti-affinity to the environment's pods (optional)
+	Affinity  *Affinity        `json:"affinity,omitempty"`
+	Isolation *IsolationConfig `json:"isolation,omitempty"`
+	Pool      *PoolConfig      `json:"pool,omitempty"`
+	// TeamID assigns the environment to a team (optional; caller must be an editor of the team)
+	TeamID string `json:"team_id,omitempty"`
+	// Cluster selects a configured Kubernetes cluster (optional; defaults to the configured default cluster)
+	Cluster string `json:"cluster,omitempty"`
+	// CommandPolicy restricts exec commands in the environment (optional)
+	CommandPolicy *CommandPolicy `json:"command_policy,omitempty"`
+	// ReadinessCheck delays the running status until the workload is ready (optional)
+	ReadinessCheck *ReadinessCheck `json:"readiness_check,omitempty"`
+	// Lifecycle runs a pre-stop command and sets the grace period of the main container
+	// (optional)
+	Lifecycle *LifecycleConfig `json:"lifecycle,omitempty"`
+	// IdleTimeout terminates the environment after this many seconds without activity (optional;
+	// 0 = the server's default idle timeout)
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	// RecordSessions records interactive attach sessions (optional; off by default)
+	RecordSessions bool `json:"record_sessions,omitempty"`
+	// ExecMode is "serialized" (default: synchronous execs run one at a time, in arrival order)
+	// or "parallel" (they run concurrently)
+	ExecMode string `json:"exec_mode,omitempty"`
+	// Mode is "interactive" (default: the main pod stays up for execs and attach) or "oneshot"
+	// (command is required and runs to completion; its exit code and output are recorded)
+	Mode string `json:"mode,omitempty"`
+	// RetentionSeconds deletes a oneshot environment this long after it completes (optional;
+	// 0 = kept until deleted)
+	RetentionSeconds int `json:"retention_seconds,omitempty"`
+	// Build builds the image in the cluster instead of pulling image (optional; cannot be
+	// combined with image)
+	Build *BuildSpec `json:"build,omitempty"`
+	// LogShipping ships the main pod's log to an external sink (optional; defaults to the
+	// server's log_shipping settings)
+	LogShipping *LogShippingSpec `json:"log_shipping,omitempty"`
+	// WorkspaceSnapshots opts into periodic snapshots of a directory of the main pod (optional)
+	WorkspaceSnapshots *WorkspaceSnapshotConfig `json:"workspace_snapshots,omitempty"`
+	// Metadata is freeform key/value data stored with the environment and not passed to the
+	// cluster (optional; at most MaxMetadataKeys keys)
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ReservationID uses one environment of a capacity reservation during its window (optional):
+	// the environment takes the place of a placeholder pod and skips the creation rate limit
+	ReservationID string `json:"reservation_id,omitempty"`
 }
 
 // UpdateEnvironmentRequest is the request body for PATCH /environments/{id} (optional fields only)
@@ -147,8 +733,121 @@ type UpdateEnvironmentRequest struct {
 	Labels       *map[string]string `json:"labels,omitempty"`
 	NodeSelector *map[string]string `json:"node_selector,omitempty"`
 	Tolerations  *[]Toleration      `json:"tolerations,omitempty"`
-	Isolation    *IsolationConfig   `json:"isolation,omitempty"`
-	Pool         *PoolConfig        `json:"pool,omitempty"`
+	// Affinity replaces the environment's affinity (used for pods created from now on); an
+	// empty object removes it
+	Affinity  *Affinity        `json:"affinity,omitempty"`
+	Isolation *IsolationConfig `json:"isolation,omitempty"`
+	Pool      *PoolConfig      `json:"pool,omitempty"`
+	// CommandPolicy replaces the environment's command policy
+	CommandPolicy *CommandPolicy `json:"command_policy,omitempty"`
+	// ReadinessCheck replaces the environment's readiness check (used for pods created from now
+	// on); an empty object removes it
+	ReadinessCheck *ReadinessCheck `json:"readiness_check,omitempty"`
+	// Lifecycle replaces the environment's lifecycle settings (used for main pods created from
+	// now on); an empty object removes them
+	Lifecycle *LifecycleConfig `json:"lifecycle,omitempty"`
+	// IdleTimeout replaces the environment's idle timeout in seconds (0 = the server's default)
+	IdleTimeout *int `json:"idle_timeout,omitempty"`
+	// RecordSessions turns session recording on or off for sessions started from now on
+	RecordSessions *bool `json:"record_sessions,omitempty"`
+	// ExecMode replaces the environment's exec mode; execs already queued keep waiting
+	ExecMode *string `json:"exec_mode,omitempty"`
+	// Metadata replaces the environment's metadata; an empty object removes it
+	Metadata *map[string]string `json:"metadata,omitempty"`
+	// WorkspaceSnapshots replaces the environment's snapshot settings; an empty object turns
+	// snapshots off (existing snapshots are kept)
+	WorkspaceSnapshots *WorkspaceSnapshotConfig `json:"workspace_snapshots,omitempty"`
+}
+
+// CordonRequest is the (optional) request body for POST /environments/{id}/cordon
+type CordonRequest struct {
+	// Reason is reported to callers whose execs are rejected, e.g. "maintenance until 14:00 UTC"
+	Reason string `json:"reason,omitempty"`
+}
+
+// UpdateLabelsRequest is the request body for POST /environments/{id}/labels: the keys in Add
+// are set and the keys in Remove deleted, leaving the environment's other labels untouched
+type UpdateLabelsRequest struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// TransferOwnershipRequest is the request body for POST /environments/{id}/transfer-ownership
+type TransferOwnershipRequest struct {
+	// UserID is the user who becomes the environment's owner
+	UserID string `json:"user_id"`
+}
+
+// ReservedLabels are the label keys agentbox sets on the namespaces and pods it manages; they
+// cannot be changed through the labels endpoint
+var ReservedLabels = map[string]bool{
+	"app":            true,
+	"env-id":         true,
+	"environment-id": true,
+	"exec-id":        true,
+	"managed-by":     true,
+	"type":           true,
+	"user-id":        true,
+}
+
+// ApplyAction is the outcome of applying one environment document with POST /environments/import
+type ApplyAction string
+
+const (
+	ApplyCreated   ApplyAction = "created"
+	ApplyUpdated   ApplyAction = "updated"
+	ApplyUnchanged ApplyAction = "unchanged"
+	ApplyError     ApplyAction = "error"
+)
+
+// ApplyResult reports what importing one environment document did (or would do, on a dry run)
+type ApplyResult struct {
+	// Index is the position of the document in the request, starting at 0
+	Index         int         `json:"index"`
+	Name          string      `json:"name,omitempty"`
+	Action        ApplyAction `json:"action"`
+	EnvironmentID string      `json:"environment_id,omitempty"`
+	// Changes lists the fields that differ from the existing environment
+	Changes []string `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// ImportEnvironmentsResponse is the response of POST /environments/import
+type ImportEnvironmentsResponse struct {
+	DryRun  bool          `json:"dry_run"`
+	Results []ApplyResult `json:"results"`
+}
+
+// ArchiveManifest is the manifest.json of an environment archive: what the archive holds and
+// which parts could not be included
+type ArchiveManifest struct {
+	EnvironmentID string            `json:"environment_id"`
+	Name          string            `json:"name"`
+	Status        EnvironmentStatus `json:"status"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Events        int               `json:"events"`
+	Executions    int               `json:"executions"`
+	// Logs is set when logs/main.log holds the main pod's log
+	Logs bool `json:"logs"`
+	// Sessions is the number of session recordings under artifacts/sessions/
+	Sessions int      `json:"sessions,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Deleted is set when the environment is deleted once the archive is complete
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// StoredArchive is an environment archive kept in the storage backend (?store=true)
+type StoredArchive struct {
+	// Name identifies the archive among the environment's archives (<timestamp>.zip)
+	Name          string    `json:"name"`
+	EnvironmentID string    `json:"environment_id"`
+	SizeBytes     int64     `json:"size_bytes"`
+	CreatedAt     time.Time `json:"created_at"`
+	// DownloadURL downloads the archive straight from the storage backend, when it hands out
+	// presigned URLs (it expires after storage.presign_expiry_seconds)
+	DownloadURL string `json:"download_url,omitempty"`
+	// Deleted is set when the environment was deleted once the archive was stored
+	Deleted bool `json:"deleted,omitempty"`
 }
 
 // ExecRequest is the request body for executing a command in an existing environment
@@ -165,14 +864,109 @@ type EphemeralExecRequest struct {
 	Command       []string          `json:"command" validate:"required,min=1"`
 	Timeout       int               `json:"timeout,omitempty"`
 	Env           map[string]string `json:"env,omitempty"` // Additional env vars (merged with environment's)
+	// WaitSeconds blocks the request up to this many seconds for the execution to finish (0 = return immediately)
+	WaitSeconds int `json:"wait_seconds,omitempty"`
+
+	// Image, Resources and Isolation override the environment's values for this execution only.
+	// Resource fields left empty keep the environment's values; an overridden execution always
+	// runs in a new pod.
+	Image     string           `json:"image,omitempty"`
+	Resources *ResourceSpec    `json:"resources,omitempty"`
+	Isolation *IsolationConfig `json:"isolation,omitempty"`
+
+	// CallbackURL receives a POST of the execution result (an ExecutionResponse) once the
+	// execution finishes. CallbackHeaders are added to that request and, when CallbackSecret is
+	// set, the body is signed with it (X-AgentBox-Signature).
+	CallbackURL     string            `json:"callback_url,omitempty"`
+	CallbackHeaders map[string]string `json:"callback_headers,omitempty"`
+	CallbackSecret  string            `json:"callback_secret,omitempty"`
+
+	// Files are written into the pod before the command runs: relative path → content (base64
+	// in JSON). They land under the server's execution working directory, which becomes the
+	// command's working directory.
+	Files map[string][]byte `json:"files,omitempty"`
+
+	// Cache returns the result of an earlier identical execution (same environment, image,
+	// environment variables, command and files) finished within the last CacheTTL seconds
+	// (default DefaultExecutionCacheTTL) instead of running the command again
+	Cache    bool `json:"cache,omitempty"`
+	CacheTTL int  `json:"cache_ttl,omitempty"`
+
+	// SkipSoftTimeout runs the command without the soft timeout warning: it is only killed at
+	// its timeout
+	SkipSoftTimeout bool `json:"skip_soft_timeout,omitempty"`
+
+	// Metadata is freeform key/value data stored with the execution and not passed to its pod
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+// UpdateExecutionRequest is the request body for PATCH /executions/{id}
+type UpdateExecutionRequest struct {
+	// Metadata replaces the execution's metadata; an empty object removes it
+	Metadata *map[string]string `json:"metadata,omitempty"`
+}
+
+// ReportExecutionRequest is the body of a result report an execution's workload sends with its
+// callback token
+type ReportExecutionRequest struct {
+	// Metadata is merged into the execution's metadata (reported keys replace existing ones)
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Execution result cache TTL bounds (seconds)
+const (
+	DefaultExecutionCacheTTL = 3600
+	MaxExecutionCacheTTL     = 7 * 24 * 3600
+)
+
 // ExecResponse is the response from executing a command synchronously
 type ExecResponse struct {
-	Stdout     string `json:"stdout"`
-	Stderr     string `json:"stderr"`
-	ExitCode   int    `json:"exit_code"`
-	DurationMs int64  `json:"duration_ms"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// ExitCode is null when the command timed out
+	ExitCode   *int  `json:"exit_code"`
+	DurationMs int64 `json:"duration_ms"`
+	// TimedOut is set when the command was stopped at its timeout; Stdout and Stderr hold the
+	// output produced until then
+	TimedOut bool `json:"timed_out"`
+	// StillRunning is set when the timed-out command could not be killed (e.g. the image has no
+	// shell); it may still be running in the main pod
+	StillRunning bool `json:"still_running,omitempty"`
+
+	// Output size accounting (see Execution)
+	StdoutBytesTotal int64  `json:"stdout_bytes_total"`
+	StderrBytesTotal int64  `json:"stderr_bytes_total"`
+	Truncated        bool   `json:"truncated"`
+	OutputNote       string `json:"output_note,omitempty"`
+
+	// QueuePosition is how many execs were ahead of this one in a serialized environment when it
+	// arrived (0 = it started right away); QueueWaitMs is how long it waited
+	QueuePosition int   `json:"queue_position,omitempty"`
+	QueueWaitMs   int64 `json:"queue_wait_ms,omitempty"`
+}
+
+// ExecQueueStats describes the synchronous exec queue of an environment
+type ExecQueueStats struct {
+	EnvironmentID string `json:"environment_id"`
+	ExecMode      string `json:"exec_mode"`
+	// Running is the number of execs currently running in the main pod
+	Running int `json:"running"`
+	// Queued is the number of execs waiting for their turn
+	Queued int `json:"queued"`
+	// MaxQueued is the most execs that may wait at once
+	MaxQueued int `json:"max_queued,omitempty"`
+}
+
+// TruncatedOutputNote explains truncated stdout/stderr in execution responses
+const TruncatedOutputNote = "output exceeded the server's size limit: only its beginning and end were kept " +
+	"(see the truncation marker); the dropped content was not stored"
+
+// OutputNote returns the note attached to an execution's output, if any
+func OutputNote(truncated bool) string {
+	if truncated {
+		return TruncatedOutputNote
+	}
+	return ""
 }
 
 // ExecutionStatus represents the current state of an async execution
@@ -187,6 +981,45 @@ const (
 	ExecutionStatusCanceled  ExecutionStatus = "canceled"
 )
 
+// IsTerminal reports whether the execution has finished (completed, failed or canceled)
+func (s ExecutionStatus) IsTerminal() bool {
+	return s == ExecutionStatusCompleted || s == ExecutionStatusFailed || s == ExecutionStatusCanceled
+}
+
+// Execution modes: where an execution ran
+const (
+	// ExecutionModeStandby: a pre-warmed standby pod of the environment's pool
+	ExecutionModeStandby = "standby"
+	// ExecutionModeEphemeral: a new pod created for the execution
+	ExecutionModeEphemeral = "ephemeral"
+	// ExecutionModeMainFallback: the environment's main pod, because the execution pod could not
+	// be created (e.g. the namespace quota is exhausted). The execution shares the main pod's
+	// filesystem and processes, so it is not isolated.
+	ExecutionModeMainFallback = "main_fallback"
+)
+
+// MainFallbackWarning is reported on executions that ran in the main pod
+const MainFallbackWarning = "execution ran in the environment's main pod (the execution pod could not be created); it was not isolated from the environment"
+
+// Execution callback delivery states
+const (
+	CallbackStatusPending    = "pending"
+	CallbackStatusDelivering = "delivering"
+	CallbackStatusDelivered  = "delivered"
+	CallbackStatusFailed     = "failed"
+)
+
+// ExecutionCallback is the callback an execution's result is pushed to, with its delivery state.
+// The callback's headers and secret are not part of it: they are never stored or returned.
+type ExecutionCallback struct {
+	URL           string     `json:"url"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
 // Execution represents an async command execution
 type Execution struct {
 	ID            string            `json:"id"`
@@ -210,6 +1043,114 @@ type Execution struct {
 	Stderr     string `json:"stderr,omitempty"`
 	Error      string `json:"error,omitempty"`
 	DurationMs *int64 `json:"duration_ms,omitempty"`
+	// CPUSeconds and MaxMemoryBytes are the command's CPU time (user and system) and peak resident
+	// memory, reported by the exec wrapper (ephemeral mode with executions.wrapper only)
+	CPUSeconds     *float64 `json:"cpu_seconds,omitempty"`
+	MaxMemoryBytes *int64   `json:"max_memory_bytes,omitempty"`
+	// ErrorCode classifies Error when the failure has a distinct cause (e.g. EXEC_FILES_FAILED,
+	// or EXEC_TIMED_OUT for an execution stopped at its timeout)
+	ErrorCode string `json:"error_code,omitempty"`
+
+	// Files lists the input files written into the pod before the command ran (contents are
+	// not kept)
+	Files []ExecutionFile `json:"files,omitempty"`
+
+	// ServedFromPool is true when the execution ran in a pre-warmed standby pod
+	ServedFromPool bool `json:"served_from_pool"`
+	// Mode is where the execution ran (ExecutionMode*); empty until it got a pod
+	Mode string `json:"mode,omitempty"`
+	// PodScheduledAt and PodStartedAt are when the execution's own pod was scheduled on a node and
+	// its container started (ephemeral mode only): started_at → pod_scheduled_at is scheduling,
+	// pod_scheduled_at → pod_started_at image pull and container start
+	PodScheduledAt *time.Time `json:"pod_scheduled_at,omitempty"`
+	PodStartedAt   *time.Time `json:"pod_started_at,omitempty"`
+
+	// EffectiveImage and EffectiveResources are what the execution ran with: the environment's
+	// values with the request's overrides applied
+	EffectiveImage     string        `json:"effective_image,omitempty"`
+	EffectiveResources *ResourceSpec `json:"effective_resources,omitempty"`
+
+	// StdoutBytesTotal and StderrBytesTotal are the sizes of the full output. When either exceeds
+	// the server's output cap, the middle of that stream is dropped and Truncated is set.
+	StdoutBytesTotal int64 `json:"stdout_bytes_total"`
+	StderrBytesTotal int64 `json:"stderr_bytes_total"`
+	Truncated        bool  `json:"truncated"`
+
+	// Callback is set when the execution was submitted with a callback_url
+	Callback *ExecutionCallback `json:"callback,omitempty"`
+
+	// CacheEnabled is set when the execution was submitted with cache: true. Cached is set when
+	// its result was taken from the cache instead of running the command; CachedFrom is then
+	// the execution that produced it.
+	CacheEnabled bool   `json:"cache_enabled,omitempty"`
+	Cached       bool   `json:"cached,omitempty"`
+	CachedFrom   string `json:"cached_from,omitempty"`
+
+	// Events are the steps of the execution's life, oldest first (ExecutionEvent*)
+	Events []ExecutionEvent `json:"events,omitempty"`
+
+	// EstimatedStart is set in the submit response when the execution queue is full: when the
+	// execution is expected to start, from how long executions held their slots recently
+	EstimatedStart *time.Time `json:"estimated_start,omitempty"`
+
+	// Metadata is freeform key/value data set at submit or with PATCH /executions/{id}
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Submission holds the submit parameters not kept elsewhere, so the execution can be
+	// requeued; nil for executions submitted before it was recorded
+	Submission *ExecutionSubmission `json:"-"`
+	// RequeuedFrom is the execution this one was requeued from (POST /executions/{id}/requeue)
+	RequeuedFrom string `json:"requeued_from,omitempty"`
+}
+
+// ExecutionSubmission is how an execution was submitted, beyond its command, env, metadata and
+// cache flag. Input file contents and callback credentials are not kept.
+type ExecutionSubmission struct {
+	Timeout         int              `json:"timeout,omitempty"`
+	Image           string           `json:"image,omitempty"`
+	Resources       *ResourceSpec    `json:"resources,omitempty"`
+	Isolation       *IsolationConfig `json:"isolation,omitempty"`
+	CacheTTL        int              `json:"cache_ttl,omitempty"`
+	SkipSoftTimeout bool             `json:"skip_soft_timeout,omitempty"`
+}
+
+// CancelExecutionsResponse is the result of POST /environments/{id}/executions/cancel-all
+type CancelExecutionsResponse struct {
+	// Canceled is the number of executions canceled; ByStatus splits it by the status they had
+	Canceled int                     `json:"canceled"`
+	ByStatus map[ExecutionStatus]int `json:"by_status"`
+}
+
+// ExecutionEvent is a step in the life of an execution
+type ExecutionEvent struct {
+	Type string    `json:"type"`
+	At   time.Time `json:"at"`
+	// Message adds detail, e.g. the signal sent at the soft timeout or why the command was killed
+	Message string `json:"message,omitempty"`
+}
+
+// Execution event types
+const (
+	ExecutionEventQueued  = "queued"
+	ExecutionEventStarted = "started"
+	// ExecutionEventSoftTimeoutWarned is recorded when the command was signaled that its timeout
+	// is near (see executions.soft_timeout_percent)
+	ExecutionEventSoftTimeoutWarned = "soft_timeout_warned"
+	// ExecutionEventKilled is recorded when the command was stopped at its timeout or canceled
+	ExecutionEventKilled = "killed"
+	// ExecutionEventKillFailed is recorded when stopping the command failed (e.g. its image has
+	// no shell); it may still be running in the pod
+	ExecutionEventKillFailed = "kill_failed"
+)
+
+// ExecFilesReadyMarker is the file created in the working directory once an execution's input
+// files are written; the command waits for it and removes it before starting
+const ExecFilesReadyMarker = ".agentbox-files-ready"
+
+// ExecutionFile is an input file of an execution as recorded for auditing
+type ExecutionFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
 }
 
 // ExecutionResponse is the API response for execution status
@@ -224,13 +1165,130 @@ type ExecutionResponse struct {
 	Stdout        string          `json:"stdout,omitempty"`
 	Stderr        string          `json:"stderr,omitempty"`
 	Error         string          `json:"error,omitempty"`
+	ErrorCode     string          `json:"error_code,omitempty"`
 	DurationMs    *int64          `json:"duration_ms,omitempty"`
+
+	CPUSeconds     *float64 `json:"cpu_seconds,omitempty"`
+	MaxMemoryBytes *int64   `json:"max_memory_bytes,omitempty"`
+
+	Files []ExecutionFile `json:"files,omitempty"`
+
+	StdoutBytesTotal int64  `json:"stdout_bytes_total,omitempty"`
+	StderrBytesTotal int64  `json:"stderr_bytes_total,omitempty"`
+	Truncated        bool   `json:"truncated,omitempty"`
+	OutputNote       string `json:"output_note,omitempty"`
+
+	EffectiveImage     string        `json:"effective_image,omitempty"`
+	EffectiveResources *ResourceSpec `json:"effective_resources,omitempty"`
+
+	Mode           string     `json:"mode,omitempty"`
+	PodName        string     `json:"pod_name,omitempty"`
+	PodScheduledAt *time.Time `json:"pod_scheduled_at,omitempty"`
+	PodStartedAt   *time.Time `json:"pod_started_at,omitempty"`
+	// Warning flags executions that did not run with the expected isolation (main_fallback mode)
+	Warning string `json:"warning,omitempty"`
+
+	Callback *ExecutionCallback `json:"callback,omitempty"`
+
+	Cached     bool   `json:"cached,omitempty"`
+	CachedFrom string `json:"cached_from,omitempty"`
+
+	RequeuedFrom string `json:"requeued_from,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// NewExecutionResponse converts an execution to its full API representation
+func NewExecutionResponse(exec *Execution) ExecutionResponse {
+	return ExecutionResponse{
+		ID:                 exec.ID,
+		EnvironmentID:      exec.EnvironmentID,
+		Status:             exec.Status,
+		CreatedAt:          exec.CreatedAt,
+		StartedAt:          exec.StartedAt,
+		CompletedAt:        exec.CompletedAt,
+		ExitCode:           exec.ExitCode,
+		Stdout:             exec.Stdout,
+		Stderr:             exec.Stderr,
+		Error:              exec.Error,
+		ErrorCode:          exec.ErrorCode,
+		DurationMs:         exec.DurationMs,
+		CPUSeconds:         exec.CPUSeconds,
+		MaxMemoryBytes:     exec.MaxMemoryBytes,
+		Files:              exec.Files,
+		StdoutBytesTotal:   exec.StdoutBytesTotal,
+		StderrBytesTotal:   exec.StderrBytesTotal,
+		Truncated:          exec.Truncated,
+		OutputNote:         OutputNote(exec.Truncated),
+		EffectiveImage:     exec.EffectiveImage,
+		EffectiveResources: exec.EffectiveResources,
+		Mode:               exec.Mode,
+		PodName:            exec.PodName,
+		PodScheduledAt:     exec.PodScheduledAt,
+		PodStartedAt:       exec.PodStartedAt,
+		Warning:            executionWarning(exec),
+		Callback:           exec.Callback,
+		Cached:             exec.Cached,
+		CachedFrom:         exec.CachedFrom,
+		RequeuedFrom:       exec.RequeuedFrom,
+		Metadata:           exec.Metadata,
+	}
+}
+
+// executionWarning returns the warning reported with an execution ("" when there is none)
+func executionWarning(exec *Execution) string {
+	if exec.Mode == ExecutionModeMainFallback {
+		return MainFallbackWarning
+	}
+	return ""
 }
 
 // ExecutionListResponse is the response for listing executions
 type ExecutionListResponse struct {
 	Executions []ExecutionResponse `json:"executions"`
-	Total      int                 `json:"total"`
+	// Total counts the matching executions across all pages
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	// NextPageToken fetches the next page (as page_token); empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// ExecutionStats summarizes executions of an environment over an optional time range
+type ExecutionStats struct {
+	EnvironmentID      string         `json:"environment_id"`
+	From               *time.Time     `json:"from,omitempty"`
+	To                 *time.Time     `json:"to,omitempty"`
+	Total              int            `json:"total"`
+	ByStatus           map[string]int `json:"by_status"`
+	FailureRate        float64        `json:"failure_rate"`    // failed / (completed + failed)
+	DurationP50Ms      int64          `json:"duration_p50_ms"` // over the most recent DurationSampleSize executions
+	DurationP95Ms      int64          `json:"duration_p95_ms"` // over the most recent DurationSampleSize executions
+	DurationSampleSize int            `json:"duration_sample_size"`
+	TotalExecSeconds   float64        `json:"total_exec_seconds"`
+	LastExecutionAt    *time.Time     `json:"last_execution_at,omitempty"`
+	Started            int            `json:"started"`       // executions that got a pod
+	PoolHits           int            `json:"pool_hits"`     // executions served from the standby pool
+	PoolHitRate        float64        `json:"pool_hit_rate"` // pool_hits / started
+	// ByMode counts started executions per mode (standby, ephemeral, main_fallback)
+	ByMode map[string]int `json:"by_mode"`
+	// MainFallbacks counts executions that ran unisolated in the main pod
+	MainFallbacks int `json:"main_fallbacks"`
+	// CacheLookups counts executions submitted with cache: true and CacheHits those answered
+	// from the result cache
+	CacheLookups int     `json:"cache_lookups"`
+	CacheHits    int     `json:"cache_hits"`
+	CacheHitRate float64 `json:"cache_hit_rate"` // cache_hits / cache_lookups
+	// Queue time (created_at → started_at) and pod startup time (started_at → pod_started_at, for
+	// ephemeral pods) over the most recent TimingSampleSize started executions
+	QueueP50Ms       int64     `json:"queue_p50_ms"`
+	QueueP95Ms       int64     `json:"queue_p95_ms"`
+	PodStartupP50Ms  int64     `json:"pod_startup_p50_ms"`
+	PodStartupP95Ms  int64     `json:"pod_startup_p95_ms"`
+	TimingSampleSize int       `json:"timing_sample_size"`
+	GeneratedAt      time.Time `json:"generated_at"`
+	// LogShipping reports the shipping of the environment's log (omitted when it is not shipped)
+	LogShipping *LogShippingStats `json:"log_shipping,omitempty"`
 }
 
 // ListEnvironmentsResponse is the response for listing environments
@@ -239,6 +1297,57 @@ type ListEnvironmentsResponse struct {
 	Total        int           `json:"total"`
 	Limit        int           `json:"limit"`
 	Offset       int           `json:"offset"`
+	// NextPageToken fetches the next page (as page_token); empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// PageCursor is the position of a keyset-paginated listing ordered by (created_at, id)
+// descending: the next page starts with the first item after it
+type PageCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// ErrInvalidPageToken is returned when a page_token cannot be decoded
+var ErrInvalidPageToken = errors.New("invalid page_token")
+
+// Precedes reports whether the item comes after the cursor in listing order (a nil cursor
+// precedes everything)
+func (c *PageCursor) Precedes(createdAt time.Time, id string) bool {
+	if c == nil {
+		return true
+	}
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.Before(c.CreatedAt)
+	}
+	return id < c.ID
+}
+
+// Token encodes the cursor as an opaque page_token
+func (c *PageCursor) Token() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParsePageToken decodes a page_token; an empty token returns a nil cursor (first page)
+func ParsePageToken(token string) (*PageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return nil, ErrInvalidPageToken
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	// Local time, like the timestamps the server stores, so keyset comparisons line up
+	return &PageCursor{CreatedAt: time.Unix(0, n), ID: id}, nil
 }
 
 // HealthResponse is the response for health checks
@@ -247,6 +1356,48 @@ type HealthResponse struct {
 	Version    string                 `json:"version"`
 	Kubernetes KubernetesHealthStatus `json:"kubernetes"`
 	Capacity   ClusterCapacity        `json:"capacity"`
+	// Clusters reports connectivity and capacity per configured cluster
+	Clusters []ClusterHealth `json:"clusters,omitempty"`
+	// Cache reports how current this replica's environment cache is (only with a database)
+	Cache *CacheHealth `json:"cache,omitempty"`
+	// Guardrails reports usage against the namespace and creation rate limits
+	Guardrails GuardrailStatus `json:"guardrails"`
+}
+
+// GuardrailStatus is the usage of the guardrails that bound namespace churn. A limit of 0 means
+// unlimited; creating environments fails with 429 while a limit is reached.
+type GuardrailStatus struct {
+	// ManagedNamespaces counts the environment namespaces AgentBox manages
+	ManagedNamespaces int `json:"managed_namespaces"`
+	MaxNamespaces     int `json:"max_namespaces"`
+	// EnvironmentsCreatedLastHour counts this replica's creations over the sliding hour
+	EnvironmentsCreatedLastHour int  `json:"environments_created_last_hour"`
+	MaxEnvironmentsPerHour      int  `json:"max_environments_per_hour"`
+	LimitReached                bool `json:"limit_reached"`
+}
+
+// CacheHealth describes the in-memory environment cache, which is kept in sync with changes
+// other replicas make by polling the database
+type CacheHealth struct {
+	// LastSyncAt is when the cache last caught up with the database (nil before the first sync)
+	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
+	// StalenessSeconds is how long ago that was; changes made since may not be reflected yet
+	StalenessSeconds float64 `json:"staleness_seconds"`
+	Environments     int     `json:"environments"`
+	// Refreshed and Evicted count the cached environments replaced by a newer version and
+	// removed because they were deleted, since the server started
+	Refreshed int64 `json:"refreshed"`
+	Evicted   int64 `json:"evicted"`
+}
+
+// ClusterHealth is the health of a single configured cluster
+type ClusterHealth struct {
+	Name      string          `json:"name"`
+	Default   bool            `json:"default"`
+	Connected bool            `json:"connected"`
+	Version   string          `json:"version,omitempty"`
+	Capacity  ClusterCapacity `json:"capacity"`
+	Error     string          `json:"error,omitempty"`
 }
 
 // KubernetesHealthStatus represents the k8s cluster health
@@ -266,7 +1417,18 @@ type ClusterCapacity struct {
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Message string `json:"message"`
-	Code    int    `json:"code"`
+	// Code is a machine-readable error code such as "ENV_NOT_RUNNING" (see pkg/apierrors)
+	Code string `json:"code"`
+	// Status is the HTTP status code
+	Status  int           `json:"status"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+// ErrorDetail describes a single invalid field in a rejected request
+type ErrorDetail struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 // WebSocketMessage represents messages sent over WebSocket connections
@@ -282,9 +1444,415 @@ type LogEntry struct {
 	Timestamp time.Time `json:"timestamp"`
 	Stream    string    `json:"stream"` // stdout or stderr
 	Message   string    `json:"message"`
+	// Context marks lines returned around a search match that do not match themselves
+	Context bool `json:"context,omitempty"`
 }
 
 // LogsResponse is the response for getting logs
 type LogsResponse struct {
 	Logs []LogEntry `json:"logs"`
+	// Truncated is set when a log search stopped at its result or time limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// EnvironmentGroupStatus summarizes the readiness of a group's replicas
+type EnvironmentGroupStatus string
+
+const (
+	// GroupReady: every replica is running
+	GroupReady EnvironmentGroupStatus = "ready"
+	// GroupProvisioning: replicas are still pending
+	GroupProvisioning EnvironmentGroupStatus = "provisioning"
+	// GroupPartial: some replicas are running, the others failed or could not be created
+	GroupPartial EnvironmentGroupStatus = "partial"
+	// GroupFailed: no replica is running or pending
+	GroupFailed EnvironmentGroupStatus = "failed"
+)
+
+// EnvironmentGroup is a set of identical environments created from one template and managed as a unit
+type EnvironmentGroup struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	UserID string `json:"user_id,omitempty"`
+	TeamID string `json:"team_id,omitempty"`
+	// Template is the spec every replica is created from (replicas are named <group name>-<n>)
+	Template CreateEnvironmentRequest `json:"template"`
+	// Replicas is the desired number of environments
+	Replicas  int       `json:"replicas"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Aggregate state of the group's environments (filled in on read)
+	Status         EnvironmentGroupStatus    `json:"status,omitempty"`
+	ReadyReplicas  int                       `json:"ready_replicas"`
+	StatusCounts   map[EnvironmentStatus]int `json:"status_counts,omitempty"`
+	EnvironmentIDs []string                  `json:"environment_ids"`
+	// Errors lists replicas that could not be created by the last create or scale request
+	Errors []string `json:"errors,omitempty"`
+}
+
+// CreateEnvironmentGroupRequest is the request body for creating an environment group
+type CreateEnvironmentGroupRequest struct {
+	Name     string                   `json:"name"`
+	Replicas int                      `json:"replicas"`
+	Template CreateEnvironmentRequest `json:"template"`
+}
+
+// UpdateEnvironmentGroupRequest scales an environment group (PATCH)
+type UpdateEnvironmentGroupRequest struct {
+	Replicas *int `json:"replicas,omitempty"`
+}
+
+// ListEnvironmentGroupsResponse is the response for listing environment groups
+type ListEnvironmentGroupsResponse struct {
+	Groups []EnvironmentGroup `json:"groups"`
+	Total  int                `json:"total"`
+}
+
+// ReservationStatus is the state of a capacity reservation
+type ReservationStatus string
+
+const (
+	// ReservationScheduled: the window has not started; no capacity is held yet
+	ReservationScheduled ReservationStatus = "scheduled"
+	// ReservationHolding: placeholder pods hold the capacity of the unused environments
+	ReservationHolding ReservationStatus = "holding"
+	// ReservationExpired: the window ended and the placeholder pods were deleted
+	ReservationExpired ReservationStatus = "expired"
+	// ReservationCanceled: the reservation was deleted before its window ended
+	ReservationCanceled ReservationStatus = "canceled"
+)
+
+// Reservation holds cluster capacity for a number of environments during a time window.
+// Shortly before the window, one placeholder pod per environment is created in the
+// reservation's namespace; environments created with the reservation replace them one by one.
+type Reservation struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	UserID  string `json:"user_id,omitempty"`
+	TeamID  string `json:"team_id,omitempty"`
+	Cluster string `json:"cluster"`
+	// Namespace holds the placeholder pods
+	Namespace string    `json:"namespace"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	// Environments is how many environments are reserved, each with Resources
+	Environments int               `json:"environments"`
+	Resources    ResourceSpec      `json:"resources"`
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	// Used counts the environments created with the reservation
+	Used      int               `json:"used"`
+	Status    ReservationStatus `json:"status"`
+	CreatedAt time.Time         `json:"created_at"`
+	// Slots maps the placeholder slots taken to the environments that took them, while the
+	// reservation is open
+	Slots map[int]string `json:"-"`
+}
+
+// Open reports whether the reservation still counts against its owner's reservation quota
+func (r *Reservation) Open() bool {
+	return r.Status == ReservationScheduled || r.Status == ReservationHolding
+}
+
+// CreateReservationRequest is the request body for creating a capacity reservation. The size of
+// each environment is resources, or the resource profile named by profile.
+type CreateReservationRequest struct {
+	Name string `json:"name"`
+	// TeamID reserves for a team (optional; caller must be an editor of the team)
+	TeamID       string            `json:"team_id,omitempty"`
+	Cluster      string            `json:"cluster,omitempty"`
+	StartsAt     time.Time         `json:"starts_at"`
+	EndsAt       time.Time         `json:"ends_at"`
+	Environments int               `json:"environments"`
+	Resources    ResourceSpec      `json:"resources"`
+	Profile      string            `json:"profile,omitempty"`
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+}
+
+// ListReservationsResponse is the response for listing reservations
+type ListReservationsResponse struct {
+	Reservations []Reservation `json:"reservations"`
+	Total        int           `json:"total"`
+}
+
+// PipelineStatus is the state of a pipeline
+type PipelineStatus string
+
+const (
+	// PipelineRunning: steps are running or waiting for their dependencies
+	PipelineRunning PipelineStatus = "running"
+	// PipelineCompleted: every step completed with exit code 0
+	PipelineCompleted PipelineStatus = "completed"
+	// PipelineFailed: at least one step failed, was canceled on its own or was skipped
+	PipelineFailed PipelineStatus = "failed"
+	// PipelineCanceled: the pipeline was canceled
+	PipelineCanceled PipelineStatus = "canceled"
+)
+
+// IsTerminal reports whether the pipeline has finished
+func (s PipelineStatus) IsTerminal() bool {
+	return s != PipelineRunning
+}
+
+// PipelineStepStatus is the state of a pipeline step
+type PipelineStepStatus string
+
+const (
+	// StepPending: waiting for its dependencies or for a free slot
+	StepPending PipelineStepStatus = "pending"
+	// StepRunning: its execution was submitted (see the execution for queued/running)
+	StepRunning PipelineStepStatus = "running"
+	// StepCompleted: its execution completed with exit code 0
+	StepCompleted PipelineStepStatus = "completed"
+	// StepFailed: its execution failed, exited non-zero or could not be submitted
+	StepFailed PipelineStepStatus = "failed"
+	// StepCanceled: its execution was canceled, or the pipeline was canceled before it ran
+	StepCanceled PipelineStepStatus = "canceled"
+	// StepSkipped: a step it depends on did not complete, so it never ran
+	StepSkipped PipelineStepStatus = "skipped"
+)
+
+// IsTerminal reports whether the step has finished (or will never run)
+func (s PipelineStepStatus) IsTerminal() bool {
+	return s != StepPending && s != StepRunning
+}
+
+// PipelineStepRequest is one step of a pipeline submission
+type PipelineStepRequest struct {
+	// Name identifies the step within the pipeline (referenced by depends_on)
+	Name    string            `json:"name"`
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env,omitempty"`
+	// DependsOn lists the steps that must complete before this one starts
+	DependsOn []string `json:"depends_on,omitempty"`
+	Timeout   int      `json:"timeout,omitempty"`
+}
+
+// CreatePipelineRequest is the request body for submitting a pipeline
+type CreatePipelineRequest struct {
+	Steps []PipelineStepRequest `json:"steps"`
+	// MaxParallel caps how many independent steps run at once (0 = server default)
+	MaxParallel int `json:"max_parallel,omitempty"`
+}
+
+// PipelineStep is a step of a pipeline with the state of its execution
+type PipelineStep struct {
+	Name      string            `json:"name"`
+	Command   []string          `json:"command"`
+	Env       map[string]string `json:"env,omitempty"`
+	DependsOn []string          `json:"depends_on,omitempty"`
+	Timeout   int               `json:"timeout,omitempty"`
+
+	Status PipelineStepStatus `json:"status"`
+	// ExecutionID is the async execution running the step; empty until it is submitted
+	ExecutionID string     `json:"execution_id,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Pipeline is a set of steps run as executions of one environment in dependency order
+type Pipeline struct {
+	ID            string         `json:"id"`
+	EnvironmentID string         `json:"environment_id"`
+	UserID        string         `json:"user_id,omitempty"`
+	Status        PipelineStatus `json:"status"`
+	MaxParallel   int            `json:"max_parallel"`
+	Steps         []PipelineStep `json:"steps"`
+	// Error explains why the pipeline stopped early (canceled or interrupted)
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// OperationType is the kind of work an operation carries out
+type OperationType string
+
+const (
+	// OperationDeleteEnvironments deletes a set of environments (bulk delete)
+	OperationDeleteEnvironments OperationType = "delete_environments"
+)
+
+// OperationStatus is the state of an operation
+type OperationStatus string
+
+const (
+	// OperationRunning: items are being processed
+	OperationRunning OperationStatus = "running"
+	// OperationCompleted: every item succeeded
+	OperationCompleted OperationStatus = "completed"
+	// OperationFailed: at least one item failed, or the operation was interrupted
+	OperationFailed OperationStatus = "failed"
+)
+
+// OperationResultStatus is the state of one item of an operation
+type OperationResultStatus string
+
+const (
+	OperationResultPending   OperationResultStatus = "pending"
+	OperationResultSucceeded OperationResultStatus = "succeeded"
+	OperationResultFailed    OperationResultStatus = "failed"
+)
+
+// Operation tracks a bulk request carried out in the background, item by item
+type Operation struct {
+	ID     string          `json:"id"`
+	Type   OperationType   `json:"type"`
+	UserID string          `json:"user_id,omitempty"`
+	Status OperationStatus `json:"status"`
+	// Total, Succeeded and Failed count the results; Total - Succeeded - Failed are pending
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []OperationResult `json:"results"`
+	// Error explains why the operation stopped early (interrupted)
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// OperationResult is the outcome for one environment of an operation
+type OperationResult struct {
+	EnvironmentID string                `json:"environment_id"`
+	Status        OperationResultStatus `json:"status"`
+	Error         string                `json:"error,omitempty"`
+}
+
+// CountResults sets Total, Succeeded and Failed from the results
+func (op *Operation) CountResults() {
+	op.Total, op.Succeeded, op.Failed = len(op.Results), 0, 0
+	for _, r := range op.Results {
+		switch r.Status {
+		case OperationResultSucceeded:
+			op.Succeeded++
+		case OperationResultFailed:
+			op.Failed++
+		}
+	}
+}
+
+// BulkDeleteDryRunResponse lists the environments a bulk delete would delete
+type BulkDeleteDryRunResponse struct {
+	DryRun         bool     `json:"dry_run"`
+	EnvironmentIDs []string `json:"environment_ids"`
+	Total          int      `json:"total"`
+}
+
+// ExportJobStatus is the state of an export job
+type ExportJobStatus string
+
+const (
+	// ExportJobPending: waiting for its first run, or for a retry after a failed attempt
+	ExportJobPending ExportJobStatus = "pending"
+	// ExportJobRunning: batches are being written
+	ExportJobRunning ExportJobStatus = "running"
+	// ExportJobSucceeded: every dataset was exported
+	ExportJobSucceeded ExportJobStatus = "succeeded"
+	// ExportJobFailed: the last attempt failed and no retries are left
+	ExportJobFailed ExportJobStatus = "failed"
+)
+
+// Export job triggers
+const (
+	ExportTriggerScheduled = "scheduled"
+	ExportTriggerManual    = "manual"
+)
+
+// ExportJob exports the records of some datasets created in [From, To) to the configured sink.
+// Progress is checkpointed after every batch, so a retried job continues where it stopped.
+type ExportJob struct {
+	ID       string          `json:"id"`
+	Trigger  string          `json:"trigger"` // ExportTrigger*
+	Datasets []string        `json:"datasets"`
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Sink     string          `json:"sink"`
+	Status   ExportJobStatus `json:"status"`
+	// Attempts counts the runs of the job; NextAttemptAt is when a pending job is retried
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	// Progress holds the checkpoint of every dataset (key = dataset)
+	Progress map[string]*ExportCheckpoint `json:"progress"`
+	// Error is the error of the last failed attempt
+	Error       string     `json:"error,omitempty"`
+	CreatedBy   string     `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// ExportCheckpoint is how far an export job got with one dataset
+type ExportCheckpoint struct {
+	// Records and Batches count what was written so far
+	Records int64 `json:"records"`
+	Batches int   `json:"batches"`
+	// LastCreatedAt and LastID identify the last record written; the next batch starts after it
+	LastCreatedAt *time.Time `json:"last_created_at,omitempty"`
+	LastID        string     `json:"last_id,omitempty"`
+	Done          bool       `json:"done"`
+}
+
+// CreateExportRequest is the request to start an on-demand export
+type CreateExportRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Datasets to export (default: exports.datasets)
+	Datasets []string `json:"datasets,omitempty"`
+}
+
+// UserPreferences are a user's settings, or the organization defaults. Nil fields are unset and
+// fall back to the organization defaults (for users) or the server configuration (for the
+// organization defaults).
+type UserPreferences struct {
+	// DefaultProfile is the resource profile of environments created without resources
+	DefaultProfile *string `json:"default_profile"`
+	// NotifyOnEnvironmentFailed and NotifyOnExecutionFailed select the failure notifications sent
+	// for the user's environments and executions
+	NotifyOnEnvironmentFailed *bool `json:"notify_on_environment_failed"`
+	NotifyOnExecutionFailed   *bool `json:"notify_on_execution_failed"`
+	// EmailCriticalAlerts emails the user critical events: their environments failing for good
+	// and, for users who can read platform-wide metrics, failing clusters and database errors
+	EmailCriticalAlerts *bool `json:"email_critical_alerts"`
+	// Timezone is the IANA time zone notification times are given in, e.g. "Europe/Berlin"
+	Timezone  *string    `json:"timezone"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// EffectivePreferences are the preferences in effect after defaults were applied
+type EffectivePreferences struct {
+	DefaultProfile            string `json:"default_profile"` // "" = none
+	NotifyOnEnvironmentFailed bool   `json:"notify_on_environment_failed"`
+	NotifyOnExecutionFailed   bool   `json:"notify_on_execution_failed"`
+	EmailCriticalAlerts       bool   `json:"email_critical_alerts"`
+	Timezone                  string `json:"timezone"`
+}
+
+// Apply returns base with the preferences that are set replacing its values
+func (p *UserPreferences) Apply(base EffectivePreferences) EffectivePreferences {
+	if p == nil {
+		return base
+	}
+	if p.DefaultProfile != nil {
+		base.DefaultProfile = *p.DefaultProfile
+	}
+	if p.NotifyOnEnvironmentFailed != nil {
+		base.NotifyOnEnvironmentFailed = *p.NotifyOnEnvironmentFailed
+	}
+	if p.NotifyOnExecutionFailed != nil {
+		base.NotifyOnExecutionFailed = *p.NotifyOnExecutionFailed
+	}
+	if p.EmailCriticalAlerts != nil {
+		base.EmailCriticalAlerts = *p.EmailCriticalAlerts
+	}
+	if p.Timezone != nil {
+		base.Timezone = *p.Timezone
+	}
+	return base
+}
+
+// PreferencesResponse holds the stored preferences and the preferences in effect
+type PreferencesResponse struct {
+	Preferences UserPreferences      `json:"preferences"`
+	Effective   EffectivePreferences `json:"effective"`
 }
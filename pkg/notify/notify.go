@@ -0,0 +1,512 @@
+// Package notify emails critical events to the users who opted in to them (the
+// email_critical_alerts preference): environments failing after their last provisioning retry go
+// to the environment's owner; Kubernetes clusters failing their health check and database error
+// spikes go to the users who can read platform-wide metrics. Emails are sent in the background
+// through the SMTP server of notifications.email and rate limited: the same event is emailed to
+// the same user at most once per cooldown, and at most max_per_hour emails are sent per hour.
+// Send failures are logged and never block the caller.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// Critical events
+const (
+	// EventEnvironmentFailed: an environment failed after its last provisioning retry
+	EventEnvironmentFailed = "environment_failed"
+	// EventClusterUnhealthy: a cluster has been failing its health check for a while
+	EventClusterUnhealthy = "cluster_unhealthy"
+	// EventDatabaseErrors: database errors spiked
+	EventDatabaseErrors = "database_errors"
+	// EventTest: a test email sent by an admin
+	EventTest = "test"
+)
+
+const (
+	// queueSize bounds the events waiting to be emailed; further events are dropped
+	queueSize = 256
+	// sendTimeout bounds the delivery of one email
+	sendTimeout = 30 * time.Second
+	// checkInterval is how often clusters and database errors are checked
+	checkInterval = time.Minute
+	// usersPageSize is the page size recipients are listed with
+	usersPageSize = 500
+)
+
+// Event is a critical event to email
+type Event struct {
+	Kind string
+	// Key identifies what the event is about (environment ID, cluster name, ...); the same
+	// event is emailed to a user once per cooldown
+	Key string
+	// UserID is the recipient of environment events, the environment's owner
+	UserID          string
+	EnvironmentID   string
+	EnvironmentName string
+	Cluster         string
+	Error           string
+	// Attempts is how often an environment's provisioning was tried
+	Attempts int
+	// ErrorCount database errors happened within Window; a cluster has been failing its
+	// health check for Window
+	ErrorCount int64
+	Window     time.Duration
+	OccurredAt time.Time
+}
+
+// PreferencesProvider resolves the preferences in effect for a user (implemented by
+// preferences.Service)
+type PreferencesProvider interface {
+	Effective(ctx context.Context, userID string) (models.EffectivePreferences, error)
+}
+
+// ClusterChecker runs the health checks of the Kubernetes clusters (implemented by k8s.Clusters)
+type ClusterChecker interface {
+	Names() []string
+	CheckHealth(ctx context.Context, name string) error
+}
+
+// ErrorCounter counts the database errors since startup (implemented by database.DB)
+type ErrorCounter interface {
+	ErrorCount() int64
+}
+
+// Service emails critical events
+type Service struct {
+	cfg         config.EmailConfig
+	sender      Sender
+	users       *users.Service
+	roles       *roles.Service
+	preferences PreferencesProvider
+	logger      *zap.Logger
+
+	queue chan Event
+
+	// limitMutex guards the rate limits: when each event was last emailed to each user and
+	// when the emails of the last hour were sent
+	limitMutex sync.Mutex
+	lastSent   map[string]time.Time
+	sentTimes  []time.Time
+
+	// checkMutex guards the state of the platform checks
+	checkMutex     sync.Mutex
+	unhealthySince map[string]time.Time
+	reported       map[string]bool
+	errorSamples   []errorSample
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// errorSample is the database error count at a point in time
+type errorSample struct {
+	at    time.Time
+	count int64
+}
+
+// NewService creates a service emailing critical events through the SMTP server of cfg; nothing
+// is sent unless cfg.Enabled
+func NewService(cfg config.EmailConfig, userService *users.Service, preferences PreferencesProvider, logger *zap.Logger) *Service {
+	s := &Service{
+		cfg:            cfg,
+		users:          userService,
+		preferences:    preferences,
+		logger:         logger,
+		queue:          make(chan Event, queueSize),
+		lastSent:       make(map[string]time.Time),
+		unhealthySince: make(map[string]time.Time),
+		reported:       make(map[string]bool),
+	}
+	if cfg.Enabled {
+		s.sender = NewSMTPSender(cfg)
+	}
+	return s
+}
+
+// SetRoleService resolves custom roles when looking for the users platform events go to;
+// without it only the built-in roles are known
+func (s *Service) SetRoleService(roleService *roles.Service) {
+	s.roles = roleService
+}
+
+// SetSender replaces the SMTP sender (e.g. in tests); a nil sender disables emails
+func (s *Service) SetSender(sender Sender) {
+	s.sender = sender
+}
+
+// Configured reports whether emails are sent
+func (s *Service) Configured() bool {
+	return s.sender != nil
+}
+
+// Start starts emailing queued events and, with clusters or errors, checking every minute for
+// failing clusters and database error spikes. Either may be nil.
+func (s *Service) Start(ctx context.Context, clusters ClusterChecker, errors ErrorCounter) {
+	if s.sender == nil {
+		s.logger.Info("critical event emails disabled (notifications.email.enabled is false)")
+		return
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-s.queue:
+				s.deliver(ctx, ev)
+			}
+		}
+	}()
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.CheckPlatform(ctx, clusters, errors, now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background work; queued events are dropped
+func (s *Service) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Notify queues an event to be emailed to its recipients. It never blocks: the event is dropped
+// when emails are disabled or too many events are waiting.
+func (s *Service) Notify(ev Event) {
+	if s.sender == nil {
+		return
+	}
+	if ev.OccurredAt.IsZero() {
+		ev.OccurredAt = time.Now()
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.logger.Warn("critical event email dropped: too many emails queued",
+			zap.String("event", ev.Kind), zap.String("key", ev.Key))
+	}
+}
+
+// SendTest sends a test email to the address to, bypassing preferences and rate limits. It
+// fails with Unavailable when emails are disabled and BadGateway when the SMTP server fails.
+func (s *Service) SendTest(ctx context.Context, to string) error {
+	if s.sender == nil {
+		return apierrors.New(apierrors.Unavailable, apierrors.CodeEmailNotConfigured,
+			"email notifications are not configured")
+	}
+	msg, err := render(Event{Kind: EventTest, OccurredAt: time.Now()}, time.UTC)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	if err := s.sender.Send(ctx, to, msg); err != nil {
+		s.logger.Warn("test email failed", zap.String("to", to), zap.Error(err))
+		return apierrors.Wrap(apierrors.BadGateway, apierrors.CodeEmailSendFailed, err,
+			"failed to send test email: %v", err)
+	}
+	return nil
+}
+
+// CheckPlatform runs one round of the platform checks Start runs every minute: clusters failing
+// their health check for cluster_unhealthy_minutes are reported once per outage, and database
+// errors reaching db_error_threshold within db_error_window_minutes once per spike.
+func (s *Service) CheckPlatform(ctx context.Context, clusters ClusterChecker, errors ErrorCounter, now time.Time) {
+	if clusters != nil {
+		for _, name := range clusters.Names() {
+			checkCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+			err := clusters.CheckHealth(checkCtx, name)
+			cancel()
+			s.checkCluster(name, err, now)
+		}
+	}
+	if errors != nil {
+		s.checkDatabaseErrors(errors.ErrorCount(), now)
+	}
+}
+
+// checkCluster records the outcome of a cluster's health check and reports a lasting failure
+func (s *Service) checkCluster(name string, err error, now time.Time) {
+	key := "cluster:" + name
+	s.checkMutex.Lock()
+	if err == nil {
+		delete(s.unhealthySince, name)
+		delete(s.reported, key)
+		s.checkMutex.Unlock()
+		return
+	}
+	since, ok := s.unhealthySince[name]
+	if !ok {
+		since = now
+		s.unhealthySince[name] = now
+	}
+	window := time.Duration(s.cfg.ClusterUnhealthyMinutes) * time.Minute
+	report := !s.reported[key] && now.Sub(since) >= window
+	if report {
+		s.reported[key] = true
+	}
+	s.checkMutex.Unlock()
+
+	if report {
+		s.Notify(Event{
+			Kind:       EventClusterUnhealthy,
+			Key:        name,
+			Cluster:    name,
+			Error:      err.Error(),
+			Window:     now.Sub(since).Round(time.Minute),
+			OccurredAt: now,
+		})
+	}
+}
+
+// checkDatabaseErrors records the database error count and reports a spike
+func (s *Service) checkDatabaseErrors(count int64, now time.Time) {
+	const key = "database"
+	window := time.Duration(s.cfg.DBErrorWindowMinutes) * time.Minute
+	s.checkMutex.Lock()
+	s.errorSamples = append(s.errorSamples, errorSample{at: now, count: count})
+	// Keep the newest sample at least a window old as the baseline
+	for len(s.errorSamples) > 1 && now.Sub(s.errorSamples[1].at) >= window {
+		s.errorSamples = s.errorSamples[1:]
+	}
+	recent := count - s.errorSamples[0].count
+	report := false
+	if recent >= int64(s.cfg.DBErrorThreshold) {
+		report = !s.reported[key]
+		s.reported[key] = true
+	} else {
+		delete(s.reported, key)
+	}
+	s.checkMutex.Unlock()
+
+	if report {
+		s.Notify(Event{
+			Kind:       EventDatabaseErrors,
+			Key:        key,
+			ErrorCount: recent,
+			Window:     window,
+			OccurredAt: now,
+		})
+	}
+}
+
+// recipient is a user an event is emailed to
+type recipient struct {
+	userID   string
+	email    string
+	location *time.Location
+}
+
+// deliver emails an event to each of its recipients the rate limits allow
+func (s *Service) deliver(ctx context.Context, ev Event) {
+	recipients, err := s.recipients(ctx, ev)
+	if err != nil {
+		s.logger.Warn("failed to resolve critical event email recipients",
+			zap.String("event", ev.Kind), zap.String("key", ev.Key), zap.Error(err))
+		return
+	}
+	for _, r := range recipients {
+		if !s.allow(ev.Kind+"|"+ev.Key+"|"+r.userID, time.Now()) {
+			s.logger.Debug("critical event email rate limited",
+				zap.String("event", ev.Kind), zap.String("key", ev.Key), zap.String("user_id", r.userID))
+			continue
+		}
+		msg, err := render(ev, r.location)
+		if err != nil {
+			s.logger.Warn("failed to render critical event email", zap.String("event", ev.Kind), zap.Error(err))
+			return
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err = s.sender.Send(sendCtx, r.email, msg)
+		cancel()
+		if err != nil {
+			s.logger.Warn("failed to send critical event email",
+				zap.String("event", ev.Kind), zap.String("key", ev.Key), zap.String("user_id", r.userID), zap.Error(err))
+		}
+	}
+}
+
+// allow applies the rate limits to an email about to be sent: the cooldown of the event for the
+// user (key) and the hourly cap. An allowed email is counted whether or not it is delivered, so
+// a failing SMTP server is not retried in a loop.
+func (s *Service) allow(key string, now time.Time) bool {
+	cooldown := time.Duration(s.cfg.CooldownMinutes) * time.Minute
+	s.limitMutex.Lock()
+	defer s.limitMutex.Unlock()
+	if last, ok := s.lastSent[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	for len(s.sentTimes) > 0 && now.Sub(s.sentTimes[0]) >= time.Hour {
+		s.sentTimes = s.sentTimes[1:]
+	}
+	if len(s.sentTimes) >= s.cfg.MaxPerHour {
+		s.logger.Warn("critical event email dropped: hourly limit reached", zap.Int("max_per_hour", s.cfg.MaxPerHour))
+		return false
+	}
+	for k, last := range s.lastSent {
+		if now.Sub(last) >= cooldown {
+			delete(s.lastSent, k)
+		}
+	}
+	s.lastSent[key] = now
+	s.sentTimes = append(s.sentTimes, now)
+	return true
+}
+
+// recipients returns the opted-in, active users with an email address an event goes to: the
+// owner for environment events, the users who can read platform-wide metrics otherwise
+func (s *Service) recipients(ctx context.Context, ev Event) ([]recipient, error) {
+	if ev.Kind == EventEnvironmentFailed {
+		if ev.UserID == "" {
+			return nil, nil
+		}
+		user, err := s.users.GetUserByID(ctx, ev.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := s.recipient(ctx, user); ok {
+			return []recipient{r}, nil
+		}
+		return nil, nil
+	}
+
+	var result []recipient
+	capabilities := make(map[string]bool)
+	for offset := 0; ; offset += usersPageSize {
+		page, err := s.users.ListUsers(ctx, usersPageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range page {
+			allowed, ok := capabilities[user.Role]
+			if !ok {
+				allowed = s.canReadMetrics(ctx, user.Role)
+				capabilities[user.Role] = allowed
+			}
+			if !allowed {
+				continue
+			}
+			if r, ok := s.recipient(ctx, user); ok {
+				result = append(result, r)
+			}
+		}
+		if len(page) < usersPageSize {
+			return result, nil
+		}
+	}
+}
+
+// canReadMetrics reports whether a role has the metrics.read capability
+func (s *Service) canReadMetrics(ctx context.Context, role string) bool {
+	capabilities := roles.BuiltinCapabilities(role)
+	if s.roles != nil {
+		var err error
+		if capabilities, err = s.roles.RoleCapabilities(ctx, role); err != nil {
+			s.logger.Warn("failed to read role capabilities", zap.String("role", role), zap.Error(err))
+			return false
+		}
+	}
+	for _, c := range capabilities {
+		if c == roles.CapMetricsRead {
+			return true
+		}
+	}
+	return false
+}
+
+// recipient returns the recipient for a user who is active, has an email address and opted in
+func (s *Service) recipient(ctx context.Context, user *users.User) (recipient, bool) {
+	if user.Status != users.StatusActive || user.Email == nil || *user.Email == "" {
+		return recipient{}, false
+	}
+	prefs, err := s.preferences.Effective(ctx, user.ID)
+	if err != nil {
+		s.logger.Warn("failed to read user preferences", zap.String("user_id", user.ID), zap.Error(err))
+		return recipient{}, false
+	}
+	if !prefs.EmailCriticalAlerts {
+		return recipient{}, false
+	}
+	loc, err := config.LoadTimezone(prefs.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return recipient{userID: user.ID, email: *user.Email, location: loc}, true
+}
+
+// templates are the subject and body of each event's email
+var templates = map[string]*template.Template{
+	EventEnvironmentFailed: template.Must(template.New(EventEnvironmentFailed).Parse(`{{define "subject"}}[agentbox] Environment {{.EnvironmentName}} failed after {{.Attempts}} attempts{{end}}
+{{- define "body"}}Your environment {{.EnvironmentName}} ({{.EnvironmentID}}) could not be provisioned after {{.Attempts}} attempts and was marked failed. It is not retried automatically: once the cause is fixed, retry it from the UI or with POST /api/v1/environments/{{.EnvironmentID}}/retry.
+
+Last error: {{.Error}}
+Time: {{.Time}}
+{{end}}`)),
+	EventClusterUnhealthy: template.Must(template.New(EventClusterUnhealthy).Parse(`{{define "subject"}}[agentbox] Kubernetes cluster {{.Cluster}} is failing its health check{{end}}
+{{- define "body"}}The Kubernetes cluster {{.Cluster}} has been failing its health check for {{.Window}}. Environments on it are reported as degraded and are not reconciled until it is reachable again.
+
+Last error: {{.Error}}
+Time: {{.Time}}
+{{end}}`)),
+	EventDatabaseErrors: template.Must(template.New(EventDatabaseErrors).Parse(`{{define "subject"}}[agentbox] Database errors are spiking{{end}}
+{{- define "body"}}The agentbox server hit {{.ErrorCount}} database errors within the last {{.Window}}. Check the server logs and the database's health.
+
+Time: {{.Time}}
+{{end}}`)),
+	EventTest: template.Must(template.New(EventTest).Parse(`{{define "subject"}}[agentbox] Test email{{end}}
+{{- define "body"}}This is a test email from agentbox. Critical event emails are delivered to this address.
+
+Time: {{.Time}}
+{{end}}`)),
+}
+
+// templateData is what the templates are executed with: the event and its time in the
+// recipient's time zone
+type templateData struct {
+	Event
+	Time string
+}
+
+// render formats the email of an event, with times in loc
+func render(ev Event, loc *time.Location) (*Message, error) {
+	tmpl, ok := templates[ev.Kind]
+	if !ok {
+		return nil, fmt.Errorf("no email template for event %q", ev.Kind)
+	}
+	data := templateData{Event: ev, Time: ev.OccurredAt.In(loc).Format("2006-01-02 15:04:05 MST")}
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return nil, err
+	}
+	return &Message{Subject: subject.String(), Body: body.String()}, nil
+}
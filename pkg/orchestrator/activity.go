@@ -0,0 +1,263 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Activity feed ==========
+
+// AuditActionEnvironmentDeleted is the audit log action of an environment being deleted (its
+// events and executions are deleted with it; the audit log keeps the deletion in its feed)
+const AuditActionEnvironmentDeleted = "environment.deleted"
+
+// Environment event types written for the activity feed
+const (
+	eventTypeCreated           = "created"
+	eventTypeProvisioned       = "provisioned"
+	eventTypeUpdated           = "updated"
+	eventTypeExecutionsPurged  = "executions_purged"
+	eventTypeProvisioningPhase = "provisioning_phase"
+)
+
+// errActivityNeedsDatabase is returned for the activity feed of a server without a database
+var errActivityNeedsDatabase = apierrors.New(apierrors.Unavailable, apierrors.CodeActivityUnavailable,
+	"the activity feed requires a database")
+
+// ActivityFeedOptions holds the pagination of ActivityFeed
+type ActivityFeedOptions struct {
+	Limit int
+	// PageToken resumes the feed after the last item of the previous page
+	// (ActivityFeedResponse.NextPageToken)
+	PageToken string
+	// Since returns only the items newer than it, for polling with the timestamp of the newest
+	// item seen
+	Since *time.Time
+}
+
+// activitySource is one of the sources merged into the feed. Its prefix starts the IDs of its
+// items, so items with the same timestamp are ordered by source, then by the ID of the object.
+type activitySource struct {
+	prefix string
+	list   func(ctx context.Context, envID string, r database.ActivityRange) ([]models.ActivityItem, error)
+}
+
+// ActivityFeed returns a page of an environment's activity, newest first: its events (except
+// provisioning phases), the audit log entries about it and its executions being submitted and
+// completing. A deleted environment keeps the audit log part of its feed.
+func (o *Orchestrator) ActivityFeed(ctx context.Context, envID string, opts ActivityFeedOptions) (*models.ActivityFeedResponse, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	cursor, err := models.ParsePageToken(opts.PageToken)
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.ValidationFailed, apierrors.CodeBadRequest, err, "invalid page_token")
+	}
+	if o.db == nil {
+		return nil, errActivityNeedsDatabase
+	}
+	if _, err := o.GetEnvironment(ctx, envID); err != nil {
+		if !errors.Is(err, apierrors.NotFound) {
+			return nil, err
+		}
+		deleted, auditErr := o.db.ListEnvironmentAuditEntries(ctx, envID, database.ActivityRange{Limit: 1})
+		if auditErr != nil || len(deleted) == 0 {
+			return nil, err
+		}
+	}
+
+	var since *time.Time
+	if opts.Since != nil {
+		// Local time, like the stored timestamps
+		local := opts.Since.Local()
+		since = &local
+	}
+	// One extra item per source tells whether there is a next page
+	var items []models.ActivityItem
+	for _, source := range o.activitySources() {
+		r := database.ActivityRange{Since: since, Limit: limit + 1}
+		if cursor != nil {
+			before := cursor.CreatedAt
+			r.Before = &before
+			// Items at the cursor's timestamp follow it when their ID is lower
+			cursorPrefix, cursorID, _ := strings.Cut(cursor.ID, ":")
+			switch {
+			case source.prefix == cursorPrefix:
+				r.BeforeID = cursorID
+			case source.prefix < cursorPrefix:
+				r.BeforeInclusive = true
+			}
+		}
+		sourceItems, err := source.list(ctx, envID, r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, sourceItems...)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Timestamp.Equal(items[j].Timestamp) {
+			return items[i].Timestamp.After(items[j].Timestamp)
+		}
+		return items[i].ID > items[j].ID
+	})
+	resp := &models.ActivityFeedResponse{Items: []models.ActivityItem{}}
+	if len(items) > limit {
+		items = items[:limit]
+		last := items[limit-1]
+		resp.NextPageToken = (&models.PageCursor{CreatedAt: last.Timestamp, ID: last.ID}).Token()
+	}
+	resp.Items = append(resp.Items, items...)
+	return resp, nil
+}
+
+// activitySources returns the sources of the activity feed
+func (o *Orchestrator) activitySources() []activitySource {
+	return []activitySource{
+		{prefix: "audit", list: func(ctx context.Context, envID string, r database.ActivityRange) ([]models.ActivityItem, error) {
+			entries, err := o.db.ListEnvironmentAuditEntries(ctx, envID, r)
+			items := make([]models.ActivityItem, len(entries))
+			for i, e := range entries {
+				items[i] = models.ActivityItem{
+					ID:        "audit:" + e.ID,
+					Source:    "audit",
+					Action:    e.Action,
+					ActorID:   e.ActorID,
+					Summary:   e.Message,
+					Details:   e.Details,
+					Timestamp: e.CreatedAt,
+				}
+			}
+			return items, err
+		}},
+		{prefix: "event", list: func(ctx context.Context, envID string, r database.ActivityRange) ([]models.ActivityItem, error) {
+			events, err := o.db.ListEnvironmentActivityEvents(ctx, envID, r, eventTypeProvisioningPhase)
+			items := make([]models.ActivityItem, len(events))
+			for i, e := range events {
+				items[i] = models.ActivityItem{
+					ID:        "event:" + e.ID,
+					Source:    "event",
+					Action:    e.EventType,
+					ActorID:   e.ActorID,
+					Summary:   e.Message,
+					Details:   e.Details,
+					Timestamp: e.CreatedAt,
+					Link:      "/api/v1/environments/" + envID + "/logs",
+				}
+			}
+			return items, err
+		}},
+		{prefix: "execution.completed", list: func(ctx context.Context, envID string, r database.ActivityRange) ([]models.ActivityItem, error) {
+			execs, err := o.db.ListExecutionActivity(ctx, envID, true, r)
+			items := make([]models.ActivityItem, len(execs))
+			for i, exec := range execs {
+				summary := fmt.Sprintf("Execution %s", exec.Status)
+				if exec.ExitCode != nil {
+					summary += fmt.Sprintf(" with exit code %d", *exec.ExitCode)
+				}
+				items[i] = executionActivityItem(exec, "execution.completed", summary, *exec.CompletedAt)
+				items[i].Details = exec.Error
+			}
+			return items, err
+		}},
+		{prefix: "execution.submitted", list: func(ctx context.Context, envID string, r database.ActivityRange) ([]models.ActivityItem, error) {
+			execs, err := o.db.ListExecutionActivity(ctx, envID, false, r)
+			items := make([]models.ActivityItem, len(execs))
+			for i, exec := range execs {
+				items[i] = executionActivityItem(exec, "execution.submitted",
+					"Execution submitted: "+truncateCommand(exec.Command), exec.CreatedAt)
+			}
+			return items, err
+		}},
+	}
+}
+
+// executionActivityItem returns the feed item of an execution being submitted or completing
+func executionActivityItem(exec *models.Execution, action, summary string, at time.Time) models.ActivityItem {
+	return models.ActivityItem{
+		ID:        action + ":" + exec.ID,
+		Source:    "execution",
+		Action:    action,
+		ActorID:   exec.UserID,
+		Summary:   summary,
+		Timestamp: at,
+		Link:      "/api/v1/executions/" + exec.ID,
+	}
+}
+
+// truncateCommand returns the command line for a summary, cut to 100 characters
+func truncateCommand(command []string) string {
+	line := strings.Join(command, " ")
+	if len(line) > 100 {
+		return line[:97] + "..."
+	}
+	return line
+}
+
+// logActivityEvent writes an environment event caused by a user (actorID)
+func (o *Orchestrator) logActivityEvent(ctx context.Context, envID, actorID, eventType, message, details string) {
+	if o.db == nil {
+		return
+	}
+	if _, err := o.db.SaveEnvironmentEventBy(context.WithoutCancel(ctx), envID, actorID, eventType, message, details); err != nil {
+		o.logger.Warn("failed to save environment event", zap.String("environment_id", envID),
+			zap.String("event_type", eventType), zap.Error(err))
+	}
+}
+
+// EnvironmentUpdated records in the environment's activity that actorID patched its
+// configuration (the fields set in patch)
+func (o *Orchestrator) EnvironmentUpdated(ctx context.Context, envID, actorID string, patch *models.UpdateEnvironmentRequest) {
+	var fields map[string]json.RawMessage
+	raw, _ := json.Marshal(patch)
+	_ = json.Unmarshal(raw, &fields)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	o.logActivityEvent(ctx, envID, actorID, eventTypeUpdated,
+		"Configuration updated: "+strings.Join(names, ", "), string(raw))
+}
+
+// ExecutionsPurged records in the environment's activity that actorID deleted its finished
+// executions created before the given time
+func (o *Orchestrator) ExecutionsPurged(ctx context.Context, envID, actorID string, before time.Time, deleted int) {
+	o.logActivityEvent(ctx, envID, actorID, eventTypeExecutionsPurged,
+		fmt.Sprintf("%d executions created before %s purged", deleted, before.Format(time.RFC3339)), "")
+}
+
+// EnvironmentDeleted writes the deletion of an environment by actorID to the audit log
+func (o *Orchestrator) EnvironmentDeleted(ctx context.Context, envID, actorID string, force bool) {
+	if o.db == nil {
+		return
+	}
+	message := fmt.Sprintf("Environment %s deleted", envID)
+	if force {
+		message += " (forced)"
+	}
+	if err := o.db.SaveAuditEntry(context.WithoutCancel(ctx), &models.AuditEntry{
+		Action:       AuditActionEnvironmentDeleted,
+		ActorID:      actorID,
+		ResourceType: "environment",
+		ResourceID:   envID,
+		Message:      message,
+	}); err != nil {
+		o.logger.Warn("failed to write audit entry for environment deletion", zap.String("environment_id", envID), zap.Error(err))
+	}
+}
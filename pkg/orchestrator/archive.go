@@ -0,0 +1,183 @@
+package orchestrator
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// archiveExecutionBatch is how many executions one database query reads while archiving
+const archiveExecutionBatch = 100
+
+// maxArchiveEvents is the most environment events an archive holds (the database listing limit)
+const maxArchiveEvents = 5000
+
+// WriteEnvironmentArchive writes the state of an environment into zw: environment.json (the
+// environment as GetEnvironment returns it), spec.json (its export document), events.jsonl,
+// executions/<id>.json (every execution record with its output) and logs/main.log (the main
+// pod's log with Kubernetes timestamps). Everything is streamed, so large logs and execution
+// histories are never held in memory. Parts that cannot be read (e.g. the log of a pod that is
+// gone) are left out and reported in the manifest; errors writing to zw end the archive.
+func (o *Orchestrator) WriteEnvironmentArchive(ctx context.Context, envID string, zw *zip.Writer) (*models.ArchiveManifest, error) {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &models.ArchiveManifest{
+		EnvironmentID: env.ID,
+		Name:          env.Name,
+		Status:        env.Status,
+		CreatedAt:     o.clock.Now().UTC(),
+	}
+
+	if err := WriteArchiveJSON(zw, "environment.json", env); err != nil {
+		return nil, err
+	}
+	if err := WriteArchiveJSON(zw, "spec.json", EnvironmentSpec(env)); err != nil {
+		return nil, err
+	}
+
+	events, err := o.environmentEvents(ctx, envID)
+	if err != nil {
+		manifest.Warnings = append(manifest.Warnings, "events: "+err.Error())
+	}
+	w, err := CreateArchiveFile(zw, "events.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return nil, fmt.Errorf("failed to write events.jsonl: %w", err)
+		}
+	}
+	manifest.Events = len(events)
+
+	err = o.forEachExecution(ctx, envID, func(exec *models.Execution) error {
+		manifest.Executions++
+		return WriteArchiveJSON(zw, "executions/"+exec.ID+".json", exec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.writeArchiveLog(ctx, env, zw); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		manifest.Warnings = append(manifest.Warnings, "logs: "+err.Error())
+	} else {
+		manifest.Logs = true
+	}
+	return manifest, nil
+}
+
+// environmentEvents returns all events of an environment, oldest first (none without a database)
+func (o *Orchestrator) environmentEvents(ctx context.Context, envID string) ([]*models.EnvironmentEvent, error) {
+	if o.db == nil {
+		return nil, nil
+	}
+	return o.db.ListEnvironmentEvents(ctx, envID, maxArchiveEvents)
+}
+
+// forEachExecution calls fn with every execution of an environment, newest first, reading the
+// database a batch at a time
+func (o *Orchestrator) forEachExecution(ctx context.Context, envID string, fn func(exec *models.Execution) error) error {
+	filter := database.ExecutionListFilter{EnvironmentID: envID}
+	if o.db != nil {
+		var cursor *models.PageCursor
+		for {
+			execs, err := o.db.ListExecutionsFiltered(ctx, filter, cursor, archiveExecutionBatch)
+			if err != nil {
+				return fmt.Errorf("failed to list executions: %w", err)
+			}
+			for _, exec := range execs {
+				if err := fn(exec); err != nil {
+					return err
+				}
+			}
+			if len(execs) < archiveExecutionBatch {
+				return nil
+			}
+			last := execs[len(execs)-1]
+			cursor = &models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		}
+	}
+
+	o.execMutex.RLock()
+	var execs []*models.Execution
+	for _, exec := range o.executions {
+		if matchesExecutionFilter(exec, filter) {
+			execs = append(execs, exec.DeepCopy())
+		}
+	}
+	o.execMutex.RUnlock()
+	sort.Slice(execs, func(i, j int) bool {
+		if !execs[i].CreatedAt.Equal(execs[j].CreatedAt) {
+			return execs[i].CreatedAt.After(execs[j].CreatedAt)
+		}
+		return execs[i].ID > execs[j].ID
+	})
+	for _, exec := range execs {
+		if err := fn(exec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchiveLog copies the main pod's log into logs/main.log; the file is only created once
+// the log stream is open, so an unavailable log leaves no empty file behind
+func (o *Orchestrator) writeArchiveLog(ctx context.Context, env *models.Environment, zw *zip.Writer) error {
+	if env.Status == models.StatusDegraded {
+		return fmt.Errorf("cluster %q is unreachable", o.clusterName(env))
+	}
+	client, err := o.clientFor(env)
+	if err != nil {
+		return err
+	}
+	stream, err := client.StreamPodLogs(ctx, env.Namespace, mainPodName, nil, false, true)
+	if err != nil {
+		return fmt.Errorf("failed to read pod logs: %w", err)
+	}
+	defer stream.Close()
+
+	w, err := CreateArchiveFile(zw, "logs/main.log")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, stream); err != nil {
+		return fmt.Errorf("failed to copy pod logs: %w", err)
+	}
+	return nil
+}
+
+// CreateArchiveFile starts a file in an environment archive
+func CreateArchiveFile(zw *zip.Writer, name string) (io.Writer, error) {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add %s to archive: %w", name, err)
+	}
+	return w, nil
+}
+
+// WriteArchiveJSON adds v to an environment archive as an indented JSON file
+func WriteArchiveJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := CreateArchiveFile(zw, name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/tracing"
+)
+
+// ========== Image Builds ==========
+
+const (
+	// buildMaxLogBytes caps the build log read back from a build pod (its head and tail are kept)
+	buildMaxLogBytes = 1024 * 1024
+	// buildLogTailLines is how much of the build log the build event and a failed environment's
+	// status message keep
+	buildLogTailLines = 30
+	// buildDigestMarker prefixes the line of the build log holding the pushed image's digest
+	buildDigestMarker = "agentbox-image-digest: "
+	// buildContextDir is where a build section's Dockerfile is written in the build pod
+	buildContextDir = "/workspace"
+)
+
+// buildScript runs Kaniko in the build pod with its arguments, writing the Dockerfile of the
+// build section first (if any) and printing the digest of the pushed image last
+var buildScript = `set -e
+if [ -n "$AGENTBOX_DOCKERFILE" ]; then
+  mkdir -p ` + buildContextDir + `
+  printf '%s' "$AGENTBOX_DOCKERFILE" > ` + buildContextDir + `/Dockerfile
+fi
+/kaniko/executor "$@" --digest-file=/tmp/agentbox-image-digest
+echo "` + buildDigestMarker + `$(cat /tmp/agentbox-image-digest)"
+`
+
+// Labels of built images, for registry garbage collection
+const (
+	buildLabelEnvironmentID = "agentbox.io/environment-id"
+	buildLabelBuiltAt       = "agentbox.io/built-at"
+)
+
+// provisionTimeout is how long provisioning env may take: the startup timeout, plus the build
+// timeout while its image still has to be built. A wait for a previous namespace of the same name
+// extends it (see waitForPreviousNamespace).
+func (o *Orchestrator) provisionTimeout(env *models.Environment) time.Duration {
+	cfg := o.cfg()
+	timeout := time.Duration(cfg.Timeouts.StartupTimeout) * time.Second
+	if env.Build != nil && env.Image == "" {
+		timeout += time.Duration(cfg.Builds.TimeoutSeconds) * time.Second
+	}
+	return timeout
+}
+
+// buildEnvironmentImage builds the image of a build section with a Kaniko pod in the build
+// namespace, and records the pushed image (referenced by digest) as the environment's image.
+// The tail of the build log is logged as a "build_succeeded" or "build_failed" event; a failed
+// build also becomes the environment's status message.
+func (o *Orchestrator) buildEnvironmentImage(ctx context.Context, client k8s.ClientInterface, envID string, build *models.BuildSpec) (string, error) {
+	cfg := o.cfg().Builds
+	if !cfg.Enabled {
+		return "", errors.New("image builds are not enabled")
+	}
+	o.setEnvironmentPhase(envID, models.PhaseBuilding)
+
+	if err := o.ensureBuildNamespace(ctx, client, cfg.Namespace); err != nil {
+		return "", err
+	}
+
+	// Every attempt gets its own pod, so a pod of an earlier attempt still being deleted is no conflict
+	podName := fmt.Sprintf("build-%s-%d", envID, o.clock.Now().Unix())
+	spec := &k8s.PodSpec{
+		Name:      podName,
+		Namespace: cfg.Namespace,
+		Image:     cfg.BuilderImage,
+		Command:   append([]string{"/busybox/sh", "-c", buildScript, "kaniko"}, kanikoArgs(cfg.Registry, cfg.InsecureRegistry, envID, build, o.clock.Now())...),
+		CPU:       cfg.CPU,
+		Memory:    cfg.Memory,
+		Storage:   cfg.Storage,
+		Labels: map[string]string{
+			"app":    "agentbox-build",
+			"env-id": envID,
+		},
+	}
+	if build.Dockerfile != "" {
+		spec.Env = map[string]string{"AGENTBOX_DOCKERFILE": build.Dockerfile}
+	}
+	if cfg.PushSecret != "" {
+		spec.SecretMounts = []k8s.SecretMount{{
+			SecretName: cfg.PushSecret,
+			MountPath:  "/kaniko/.docker",
+			Items:      map[string]string{corev1.DockerConfigJsonKey: "config.json"},
+		}}
+	}
+
+	var result *k8s.PodCompletionResult
+	err := tracing.WithSpan(ctx, "provision.build_image", func(ctx context.Context) error {
+		if err := client.CreatePod(ctx, spec); err != nil {
+			return fmt.Errorf("failed to create build pod: %w", err)
+		}
+		defer func() {
+			if err := client.DeletePod(context.Background(), cfg.Namespace, podName, true); err != nil {
+				o.logger.Warn("failed to delete build pod", zap.String("environment_id", envID), zap.String("pod", podName), zap.Error(err))
+			}
+		}()
+		buildCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+		defer cancel()
+		var err error
+		result, err = client.WaitForPodCompletion(buildCtx, cfg.Namespace, podName, buildMaxLogBytes)
+		if err != nil && buildCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("image build timed out after %ds", cfg.TimeoutSeconds)
+		}
+		return err
+	})
+	if err != nil {
+		o.failBuild(envID, err.Error(), "")
+		return "", err
+	}
+
+	tail := logTail(result.Logs, buildLogTailLines)
+	digest := buildDigest(result.Logs)
+	if result.ExitCode != 0 || result.Phase == corev1.PodFailed || digest == "" {
+		msg := fmt.Sprintf("image build failed (exit code %d)", result.ExitCode)
+		o.failBuild(envID, msg, tail)
+		return "", errors.New(msg)
+	}
+
+	image := cfg.Registry + "@" + digest
+	o.envMutex.Lock()
+	if e, exists := o.environments[envID]; exists {
+		e.Image = image
+	}
+	o.envMutex.Unlock()
+	if o.db != nil {
+		if err := o.db.UpdateEnvironmentImage(context.Background(), envID, image); err != nil {
+			o.logger.Warn("failed to update environment image", zap.String("environment_id", envID), zap.Error(err))
+		}
+	}
+	o.logReconciliationEvent(envID, "build_succeeded", "Image built: "+image, tail)
+	o.logger.Info("environment image built", zap.String("environment_id", envID), zap.String("image", image))
+	return image, nil
+}
+
+// failBuild records a failed build: an event with the tail of the build log, which also becomes
+// the environment's status message
+func (o *Orchestrator) failBuild(envID, msg, tail string) {
+	statusMessage := msg
+	if tail != "" {
+		statusMessage += ":\n" + tail
+	}
+	o.envMutex.Lock()
+	if e, exists := o.environments[envID]; exists {
+		e.StatusMessage = statusMessage
+	}
+	o.envMutex.Unlock()
+	o.logReconciliationEvent(envID, "build_failed", "Image build failed", statusMessage)
+}
+
+// ensureBuildNamespace creates the build namespace unless it exists. It is not labeled
+// managed-by=agentbox, so the orphaned namespace collector leaves it alone.
+func (o *Orchestrator) ensureBuildNamespace(ctx context.Context, client k8s.ClientInterface, namespace string) error {
+	exists, err := client.NamespaceExists(ctx, namespace)
+	if err != nil {
+		return fmt.Errorf("failed to check build namespace: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	if err := client.CreateNamespace(ctx, namespace, map[string]string{"app": "agentbox-build"}); err != nil {
+		// Another build may have created it meanwhile
+		if exists, _ := client.NamespaceExists(ctx, namespace); exists {
+			return nil
+		}
+		return fmt.Errorf("failed to create build namespace: %w", err)
+	}
+	return nil
+}
+
+// kanikoArgs returns the Kaniko executor arguments building a build section into
+// <registry>:<envID>, labeled as built at builtAt
+func kanikoArgs(registry string, insecure bool, envID string, build *models.BuildSpec, builtAt time.Time) []string {
+	var args []string
+	if build.GitURL != "" {
+		buildContext := "git://" + strings.TrimPrefix(build.GitURL, "https://")
+		if build.GitRef != "" {
+			buildContext += "#" + build.GitRef
+		}
+		args = append(args, "--context="+buildContext)
+		if build.ContextPath != "" {
+			args = append(args, "--context-sub-path="+build.ContextPath)
+		}
+		if build.DockerfilePath != "" {
+			args = append(args, "--dockerfile="+build.DockerfilePath)
+		}
+	} else {
+		args = append(args, "--context=dir://"+buildContextDir, "--dockerfile="+buildContextDir+"/Dockerfile")
+	}
+	args = append(args,
+		"--destination="+registry+":"+envID,
+		"--label="+buildLabelEnvironmentID+"="+envID,
+		"--label="+buildLabelBuiltAt+"="+builtAt.UTC().Format(time.RFC3339),
+	)
+	if insecure {
+		args = append(args, "--insecure")
+	}
+	return args
+}
+
+// buildDigest returns the digest a build pod printed after pushing its image ("" when missing)
+func buildDigest(logs string) string {
+	for _, line := range strings.Split(logs, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if digest, ok := strings.CutPrefix(line, buildDigestMarker); ok && strings.HasPrefix(digest, "sha256:") {
+			return digest
+		}
+	}
+	return ""
+}
+
+// logTail returns the last n lines of a log
+func logTail(logs string, n int) string {
+	lines := strings.Split(strings.TrimRight(logs, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,181 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+const (
+	// cacheSyncOverlap is how far before the previous pass each pass starts reading changes, to
+	// cover clock skew between replicas and writes that committed late; rows read twice are
+	// recognized by their version
+	cacheSyncOverlap = 30 * time.Second
+	// cacheSyncDisabledRecheck is how often a disabled cache sync checks whether a configuration
+	// reload enabled it
+	cacheSyncDisabledRecheck = 30 * time.Second
+	// environmentTombstoneRetention is how long deleted environments are remembered for replicas
+	// that have not synced yet
+	environmentTombstoneRetention = time.Hour
+)
+
+// startCacheSync marks the cache as current as of now; called before loading environments from
+// the database, so the first sync pass picks up whatever changed while they were loading
+func (o *Orchestrator) startCacheSync() {
+	now := o.clock.Now()
+	o.cacheSyncMutex.Lock()
+	o.cacheSyncCursor = now
+	o.cacheSyncMutex.Unlock()
+	o.lastCacheSync.Store(&now)
+}
+
+// runCacheSyncLoop periodically applies environment changes made by other replicas to the cache
+func (o *Orchestrator) runCacheSyncLoop() {
+	if o.db == nil {
+		return
+	}
+	interval := o.cacheSyncInterval()
+	ticker := o.clock.NewTicker(cacheSyncTicker(interval))
+	defer ticker.Stop()
+
+	if interval > 0 {
+		o.logger.Info("environment cache sync started", zap.Duration("interval", interval))
+	}
+
+	for {
+		select {
+		case <-o.cacheSyncStopChan:
+			return
+		case <-ticker.C():
+			if interval > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				if err := o.SyncEnvironmentCache(ctx); err != nil {
+					o.logger.Warn("environment cache sync failed", zap.Error(err))
+				}
+				cancel()
+			}
+
+			// Pick up interval changes from a configuration reload
+			if next := o.cacheSyncInterval(); next != interval {
+				interval = next
+				ticker.Reset(cacheSyncTicker(interval))
+				o.logger.Info("environment cache sync interval changed", zap.Duration("interval", interval))
+			}
+		}
+	}
+}
+
+// cacheSyncInterval returns the configured cache sync interval; 0 means disabled
+func (o *Orchestrator) cacheSyncInterval() time.Duration {
+	seconds := o.cfg().Reconciliation.CacheSyncIntervalSeconds
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheSyncTicker returns the ticker period for a cache sync interval (disabled syncs still tick
+// to notice a reload enabling them)
+func cacheSyncTicker(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return cacheSyncDisabledRecheck
+	}
+	return interval
+}
+
+// SyncEnvironmentCache runs one cache sync pass: cached environments whose database row has a
+// newer version are replaced by it and environments deleted by another replica are evicted
+// (their standby pool is dropped and waiters are woken). Environments this replica does not cache
+// are left alone, as are the ones it is deleting itself. No-op without a database.
+func (o *Orchestrator) SyncEnvironmentCache(ctx context.Context) error {
+	if o.db == nil {
+		return nil
+	}
+	o.cacheSyncMutex.Lock()
+	defer o.cacheSyncMutex.Unlock()
+
+	started := o.clock.Now()
+	since := o.cacheSyncCursor.Add(-cacheSyncOverlap)
+
+	changed, err := o.db.ListEnvironmentsChangedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	deleted, err := o.db.ListEnvironmentTombstonesSince(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	var refreshed []string
+	var evicted []string
+	o.envMutex.Lock()
+	for _, env := range changed {
+		cached, ok := o.environments[env.ID]
+		if !ok || cached.Status == models.StatusTerminating || env.Version <= cached.Version {
+			continue
+		}
+		o.environments[env.ID] = env
+		refreshed = append(refreshed, env.ID)
+	}
+	for _, id := range deleted {
+		if _, ok := o.environments[id]; !ok {
+			continue
+		}
+		delete(o.environments, id)
+		evicted = append(evicted, id)
+	}
+	o.envMutex.Unlock()
+
+	for _, id := range refreshed {
+		o.notifyEnvironmentStatus(id)
+	}
+	for _, id := range evicted {
+		o.drainStandbyPool(id)
+		o.stopLogShipping(id)
+		o.notifyEnvironmentStatus(id)
+		o.logger.Info("environment deleted by another replica, evicted from cache", zap.String("environment_id", id))
+	}
+	o.cacheRefreshed.Add(int64(len(refreshed)))
+	o.cacheEvicted.Add(int64(len(evicted)))
+
+	if _, err := o.db.PruneEnvironmentTombstones(ctx, started.Add(-environmentTombstoneRetention)); err != nil {
+		o.logger.Warn("failed to prune environment tombstones", zap.Error(err))
+	}
+
+	o.cacheSyncCursor = started
+	o.lastCacheSync.Store(&started)
+	return nil
+}
+
+// isCached reports whether an environment is in the in-memory cache
+func (o *Orchestrator) isCached(envID string) bool {
+	o.envMutex.RLock()
+	defer o.envMutex.RUnlock()
+	_, ok := o.environments[envID]
+	return ok
+}
+
+// cacheHealth reports the state of the environment cache (nil without a database)
+func (o *Orchestrator) cacheHealth() *models.CacheHealth {
+	if o.db == nil {
+		return nil
+	}
+	o.envMutex.RLock()
+	count := len(o.environments)
+	o.envMutex.RUnlock()
+
+	health := &models.CacheHealth{
+		Environments: count,
+		Refreshed:    o.cacheRefreshed.Load(),
+		Evicted:      o.cacheEvicted.Load(),
+	}
+	if last := o.lastCacheSync.Load(); last != nil {
+		at := last.UTC()
+		health.LastSyncAt = &at
+		health.StalenessSeconds = o.clock.Now().Sub(*last).Seconds()
+	}
+	return health
+}
@@ -0,0 +1,372 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Callbacks ==========
+
+// Headers of a callback delivery
+const (
+	CallbackSignatureHeader   = "X-AgentBox-Signature"
+	CallbackTimestampHeader   = "X-AgentBox-Timestamp"
+	CallbackExecutionIDHeader = "X-AgentBox-Execution-ID"
+)
+
+// Callback limits
+const (
+	maxCallbackHeaders   = 20
+	maxCallbackURLLength = 2048
+	// maxCallbackBackoff caps the delay between two delivery attempts
+	maxCallbackBackoff = time.Minute
+)
+
+// errInternalCallbackAddress is returned when a callback host resolves to an internal address
+var errInternalCallbackAddress = errors.New("internal addresses are not allowed")
+
+// callbackHeaderName matches valid HTTP header names (RFC 9110 tokens)
+var callbackHeaderName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// reservedCallbackHeaders are set by the server and cannot be overridden by callback_headers
+var reservedCallbackHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+// blockedCallbackPrefixes are internal ranges not covered by the netip.Addr classifiers
+var blockedCallbackPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64 (embeds IPv4 addresses)
+}
+
+// callbackTarget is the part of a callback that is only kept in memory until it is delivered
+type callbackTarget struct {
+	url     string
+	headers map[string]string
+	secret  string
+}
+
+// newCallbackTarget validates the callback of an execution request against
+// executions.callbacks; it returns nil when the request has no callback
+func newCallbackTarget(cfg config.ExecutionCallbackConfig, req *EphemeralExecRequest) (*callbackTarget, error) {
+	if req.CallbackURL == "" {
+		if len(req.CallbackHeaders) > 0 || req.CallbackSecret != "" {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeCallbackRejected,
+				"callback_headers and callback_secret require a callback_url")
+		}
+		return nil, nil
+	}
+	if err := checkCallbackURL(cfg, req.CallbackURL); err != nil {
+		return nil, err
+	}
+	if len(req.CallbackHeaders) > maxCallbackHeaders {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeCallbackRejected,
+			"at most %d callback_headers are allowed", maxCallbackHeaders)
+	}
+	headers := make(map[string]string, len(req.CallbackHeaders))
+	for name, value := range req.CallbackHeaders {
+		canonical := http.CanonicalHeaderKey(name)
+		if !callbackHeaderName.MatchString(name) || strings.ContainsAny(value, "\r\n\x00") {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeCallbackRejected,
+				"invalid callback header %q", name)
+		}
+		if reservedCallbackHeaders[canonical] || strings.HasPrefix(canonical, "X-Agentbox-") {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeCallbackRejected,
+				"callback header %q is set by the server", name)
+		}
+		headers[canonical] = value
+	}
+	return &callbackTarget{url: req.CallbackURL, headers: headers, secret: req.CallbackSecret}, nil
+}
+
+// checkCallbackURL rejects callback URLs whose scheme or host is not allowed. Host names are
+// resolved when the callback is delivered, where internal addresses are refused again.
+func checkCallbackURL(cfg config.ExecutionCallbackConfig, raw string) error {
+	reject := func(format string, args ...interface{}) error {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeCallbackRejected, "callback_url rejected: "+format, args...)
+	}
+	if len(raw) > maxCallbackURLLength {
+		return reject("longer than %d characters", maxCallbackURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Hostname() == "" {
+		return reject("must be an absolute URL")
+	}
+	if u.User != nil {
+		return reject("must not contain credentials (use callback_headers)")
+	}
+	if !containsString(callbackSchemes(cfg), u.Scheme) {
+		return reject("scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if len(cfg.AllowedHosts) > 0 && !callbackHostAllowed(cfg.AllowedHosts, host) {
+		return reject("host %q is not allowed", host)
+	}
+	if cfg.AllowPrivateNetworks {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return reject("internal address %q", host)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && isInternalAddr(addr) {
+		return reject("internal address %q", host)
+	}
+	return nil
+}
+
+// callbackSchemes returns the allowed callback URL schemes (https when none are configured)
+func callbackSchemes(cfg config.ExecutionCallbackConfig) []string {
+	if len(cfg.AllowedSchemes) == 0 {
+		return []string{"https"}
+	}
+	return cfg.AllowedSchemes
+}
+
+// callbackHostAllowed reports whether host matches an allowed host; "*.example.com" matches the
+// subdomains of example.com
+func callbackHostAllowed(allowed []string, host string) bool {
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// isInternalAddr reports whether addr is a loopback, private, link-local (including cloud
+// metadata endpoints) or otherwise non-public address
+func isInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedCallbackPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// callbackClient returns the HTTP client deliveries are made with. Unless private networks are
+// allowed, every address it connects to is checked after DNS resolution, so a host name that
+// resolves (or is rebound) to an internal address is refused. Redirects are not followed and
+// proxies are not used, as both would bypass the check.
+func callbackClient(cfg config.ExecutionCallbackConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !cfg.AllowPrivateNetworks {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("callback address %q: %w", address, err)
+			}
+			if isInternalAddr(addrPort.Addr()) {
+				return fmt.Errorf("callback address %s: %w", addrPort.Addr(), errInternalCallbackAddress)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// SignCallback returns the X-AgentBox-Signature value of a callback body sent at timestamp
+// (X-AgentBox-Timestamp): the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret
+func SignCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverExecutionCallback pushes a finished execution's result to its callback URL in the
+// background; each execution is delivered at most once
+func (o *Orchestrator) deliverExecutionCallback(execID string) {
+	o.execMutex.Lock()
+	target := o.execCallbacks[execID]
+	delete(o.execCallbacks, execID)
+	exec, exists := o.executions[execID]
+	var result models.ExecutionResponse
+	if exists {
+		result = models.NewExecutionResponse(exec)
+	}
+	o.execMutex.Unlock()
+	if target == nil || !exists {
+		return
+	}
+
+	// The delivery state describes the callback, not the result it carries
+	result.Callback = nil
+	body, err := json.Marshal(result)
+	if err != nil {
+		o.logger.Error("execution callback: failed to encode result", zap.String("exec_id", execID), zap.Error(err))
+		return
+	}
+	go o.runCallbackDelivery(execID, target, body)
+}
+
+// runCallbackDelivery POSTs body to the callback until it is accepted (2xx), a non-retryable
+// response is received or executions.callbacks.max_attempts is reached, recording the delivery
+// state on the execution after every attempt. Delivery stops when the orchestrator stops.
+func (o *Orchestrator) runCallbackDelivery(execID string, target *callbackTarget, body []byte) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-o.callbackStopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cfg := o.cfg().Executions.Callbacks
+	maxAttempts := max(cfg.MaxAttempts, 1)
+	timeout := time.Duration(max(cfg.TimeoutSeconds, 1)) * time.Second
+	backoff := time.Duration(cfg.InitialBackoffMs) * time.Millisecond
+	client := callbackClient(cfg)
+
+	state := models.ExecutionCallback{URL: target.url, Status: models.CallbackStatusDelivering}
+	for attempt := 1; ; attempt++ {
+		now := o.clock.Now()
+		retryable, err := o.postCallback(ctx, client, timeout, execID, target, body)
+		if ctx.Err() != nil {
+			return
+		}
+		state.Attempts = attempt
+		state.LastAttemptAt = &now
+		state.LastError = ""
+		switch {
+		case err == nil:
+			state.Status = models.CallbackStatusDelivered
+			state.DeliveredAt = &now
+		case !retryable || attempt >= maxAttempts:
+			state.Status = models.CallbackStatusFailed
+			state.LastError = err.Error()
+		default:
+			state.LastError = err.Error()
+		}
+		o.setExecutionCallback(execID, state)
+
+		if state.Status != models.CallbackStatusDelivering {
+			if state.Status == models.CallbackStatusFailed {
+				o.logger.Warn("execution callback: delivery failed",
+					zap.String("exec_id", execID), zap.Int("attempts", attempt), zap.Error(err))
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxCallbackBackoff)
+	}
+}
+
+// postCallback makes one delivery attempt; it reports whether a failure is worth retrying
+func (o *Orchestrator) postCallback(
+	ctx context.Context, client *http.Client, timeout time.Duration, execID string, target *callbackTarget, body []byte,
+) (retryable bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range target.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackExecutionIDHeader, execID)
+	if target.secret != "" {
+		timestamp := strconv.FormatInt(o.clock.Now().Unix(), 10)
+		req.Header.Set(CallbackTimestampHeader, timestamp)
+		req.Header.Set(CallbackSignatureHeader, SignCallback(target.secret, timestamp, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errInternalCallbackAddress), err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("callback returned HTTP %d", resp.StatusCode)
+	// Other client errors (including redirects, which are not followed) will not go away on retry
+	retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, err
+}
+
+// setExecutionCallback records the callback delivery state of an execution
+func (o *Orchestrator) setExecutionCallback(execID string, state models.ExecutionCallback) {
+	o.execMutex.Lock()
+	exec, exists := o.executions[execID]
+	if exists {
+		// Replace rather than update: copies of the execution handed out earlier share the pointer
+		callback := state
+		exec.Callback = &callback
+		exec = exec.DeepCopy()
+	}
+	o.execMutex.Unlock()
+
+	if exists && o.db != nil {
+		if err := o.db.SaveExecution(context.Background(), exec); err != nil {
+			o.logger.Error("failed to save execution callback state", zap.Error(err), zap.String("execution_id", execID))
+		}
+	}
+}
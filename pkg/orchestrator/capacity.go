@@ -0,0 +1,243 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Capacity Admission ==========
+
+// capacityCacheTTL is how long fetched node capacity is reused before asking the cluster again
+const capacityCacheTTL = 30 * time.Second
+
+// capacityCacheEntry holds the schedulable nodes for one cluster, node selector and tolerations
+type capacityCacheEntry struct {
+	nodes     []k8s.NodeAllocatable
+	fetchedAt time.Time
+}
+
+// checkCapacity compares a request with the nodes of the cluster it targets. It returns an
+// Unschedulable error when no node could ever fit the environment's pod, and a warning when the
+// nodes currently lack the free capacity for it and its standby pool. When capacity cannot be
+// read the request is accepted.
+func (o *Orchestrator) checkCapacity(ctx context.Context, cluster string, req *models.CreateEnvironmentRequest) (string, error) {
+	cpu, err := resource.ParseQuantity(req.Resources.CPU)
+	if err != nil {
+		return "", nil
+	}
+	memory, err := resource.ParseQuantity(req.Resources.Memory)
+	if err != nil {
+		return "", nil
+	}
+	wantCPU, wantMemory := cpu.MilliValue(), memory.Value()
+
+	nodes, err := o.schedulableNodes(ctx, cluster, req.NodeSelector, req.Tolerations)
+	if err != nil {
+		o.logger.Warn("failed to read node capacity, skipping capacity check", zap.String("cluster", cluster), zap.Error(err))
+		return "", nil
+	}
+	if len(nodes) == 0 {
+		return "", apierrors.New(apierrors.Unschedulable, apierrors.CodeExceedsNodeCapacity,
+			"no schedulable node in cluster %q matches the node selector and tolerations", cluster)
+	}
+
+	// Nodes are sorted by CPU, so the node with the most memory may not be the first
+	fits := false
+	for _, node := range nodes {
+		if node.CPUMillicores >= wantCPU && node.MemoryBytes >= wantMemory {
+			fits = true
+			break
+		}
+	}
+	if !fits {
+		largest := nodes[0]
+		return "", apierrors.New(apierrors.Unschedulable, apierrors.CodeExceedsNodeCapacity,
+			"requested %s CPU and %s memory does not fit on any node; the largest available node (%s) has %s CPU and %s memory allocatable",
+			req.Resources.CPU, req.Resources.Memory, largest.Name, formatMillicores(largest.CPUMillicores), formatBytes(largest.MemoryBytes))
+	}
+
+	// The main pod and the standby pool are scheduled right away
+	pods := 1
+	if req.Pool != nil && req.Pool.Enabled && req.Pool.Size > 0 {
+		pods += req.Pool.Size
+	}
+	free := 0
+	for _, node := range nodes {
+		if wantCPU <= 0 || wantMemory <= 0 {
+			free = pods
+			break
+		}
+		free += int(min(node.FreeCPUMillicores/wantCPU, node.FreeMemoryBytes/wantMemory))
+	}
+	if free >= pods {
+		return "", nil
+	}
+	return fmt.Sprintf("the cluster currently has free capacity for %d of the %d pods this environment needs (%s CPU and %s memory each); it stays pending until capacity frees up",
+		free, pods, req.Resources.CPU, req.Resources.Memory), nil
+}
+
+// schedulableNodes returns the nodes a pod with the given placement can run on, from the cache
+// when it was fetched less than capacityCacheTTL ago
+func (o *Orchestrator) schedulableNodes(ctx context.Context, cluster string, nodeSelector map[string]string, tolerations []models.Toleration) ([]k8s.NodeAllocatable, error) {
+	key := capacityCacheKey(cluster, nodeSelector, tolerations)
+
+	o.capacityCacheMutex.Lock()
+	entry, ok := o.capacityCache[key]
+	o.capacityCacheMutex.Unlock()
+	if ok && o.clock.Now().Sub(entry.fetchedAt) < capacityCacheTTL {
+		return entry.nodes, nil
+	}
+
+	client, err := o.clusters.Get(cluster)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := client.GetNodeAllocatable(ctx, nodeSelector, toK8sTolerations(tolerations))
+	if err != nil {
+		return nil, err
+	}
+
+	o.capacityCacheMutex.Lock()
+	o.capacityCache[key] = &capacityCacheEntry{nodes: nodes, fetchedAt: o.clock.Now()}
+	o.capacityCacheMutex.Unlock()
+	return nodes, nil
+}
+
+// capacityCacheKey identifies a cluster and pod placement
+func capacityCacheKey(cluster string, nodeSelector map[string]string, tolerations []models.Toleration) string {
+	parts := []string{cluster}
+	keys := make([]string, 0, len(nodeSelector))
+	for k := range nodeSelector {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, k+"="+nodeSelector[k])
+	}
+	for _, t := range tolerations {
+		parts = append(parts, fmt.Sprintf("%s:%s:%s:%s", t.Key, t.Operator, t.Value, t.Effect))
+	}
+	return strings.Join(parts, "|")
+}
+
+// toK8sTolerations converts model tolerations to k8s tolerations
+func toK8sTolerations(tolerations []models.Toleration) []k8s.Toleration {
+	var k8sTolerations []k8s.Toleration
+	for _, t := range tolerations {
+		k8sTolerations = append(k8sTolerations, k8s.Toleration{
+			Key:               t.Key,
+			Operator:          t.Operator,
+			Value:             t.Value,
+			Effect:            t.Effect,
+			TolerationSeconds: t.TolerationSeconds,
+		})
+	}
+	return k8sTolerations
+}
+
+// toK8sAffinity converts a model affinity to a k8s affinity. The anti-affinity selects all of
+// the environment's pods unless it names labels.
+func toK8sAffinity(affinity *models.Affinity) *k8s.Affinity {
+	if affinity.IsEmpty() {
+		return nil
+	}
+	out := &k8s.Affinity{}
+	for _, term := range affinity.RequiredNodeTerms {
+		out.RequiredNodeTerms = append(out.RequiredNodeTerms, k8s.NodeSelectorTerm{
+			MatchExpressions: toK8sNodeSelectorRequirements(term.MatchExpressions),
+		})
+	}
+	for _, term := range affinity.PreferredNodeTerms {
+		out.PreferredNodeTerms = append(out.PreferredNodeTerms, k8s.PreferredNodeTerm{
+			Weight:           term.Weight,
+			MatchExpressions: toK8sNodeSelectorRequirements(term.MatchExpressions),
+		})
+	}
+	if anti := affinity.PodAntiAffinity; anti != nil {
+		matchLabels := anti.MatchLabels
+		if len(matchLabels) == 0 {
+			matchLabels = map[string]string{"app": "agentbox"}
+		}
+		out.PodAntiAffinity = &k8s.PodAntiAffinity{
+			MatchLabels: matchLabels,
+			TopologyKey: anti.TopologyKey,
+			Required:    anti.Required,
+			Weight:      anti.Weight,
+		}
+	}
+	return out
+}
+
+func toK8sNodeSelectorRequirements(reqs []models.NodeSelectorRequirement) []k8s.NodeSelectorRequirement {
+	out := make([]k8s.NodeSelectorRequirement, 0, len(reqs))
+	for _, r := range reqs {
+		out = append(out, k8s.NodeSelectorRequirement{Key: r.Key, Operator: r.Operator, Values: r.Values})
+	}
+	return out
+}
+
+// setDNSPolicyDefault records the effective DNS policy ("ClusterFirst" when none was given)
+func setDNSPolicyDefault(isolation *models.IsolationConfig) {
+	if isolation != nil && isolation.DNS != nil && isolation.DNS.Policy == "" {
+		isolation.DNS.Policy = models.DNSPolicyClusterFirst
+	}
+}
+
+// toK8sDNS converts an isolation's DNS config to a k8s DNS config (nil = cluster DNS)
+func toK8sDNS(isolation *models.IsolationConfig) *k8s.DNSConfig {
+	if isolation == nil || isolation.DNS == nil {
+		return nil
+	}
+	dns := isolation.DNS
+	out := &k8s.DNSConfig{
+		Policy:      dns.Policy,
+		Nameservers: dns.Nameservers,
+		Searches:    dns.Searches,
+	}
+	for _, o := range dns.Options {
+		out.Options = append(out.Options, k8s.DNSOption{Name: o.Name, Value: o.Value})
+	}
+	return out
+}
+
+// toK8sSecurityContext converts a security context config to a k8s security context (nil = none)
+func toK8sSecurityContext(sc *models.SecurityContextConfig) *k8s.SecurityContext {
+	if sc == nil {
+		return nil
+	}
+	out := &k8s.SecurityContext{
+		RunAsUser:                sc.RunAsUser,
+		RunAsGroup:               sc.RunAsGroup,
+		RunAsNonRoot:             sc.RunAsNonRoot,
+		ReadOnlyRootFilesystem:   sc.ReadOnlyRootFilesystem,
+		AllowPrivilegeEscalation: sc.AllowPrivilegeEscalation,
+		SeccompProfile:           sc.SeccompProfile,
+	}
+	if sc.Capabilities != nil {
+		out.Capabilities = &k8s.Capabilities{Add: sc.Capabilities.Add, Drop: sc.Capabilities.Drop}
+	}
+	return out
+}
+
+// formatMillicores formats CPU as cores when whole, otherwise as millicores
+func formatMillicores(m int64) string {
+	if m%1000 == 0 {
+		return fmt.Sprintf("%d", m/1000)
+	}
+	return fmt.Sprintf("%dm", m)
+}
+
+// formatBytes formats memory in binary units (e.g. "15Gi")
+func formatBytes(b int64) string {
+	return resource.NewQuantity(b, resource.BinarySI).String()
+}
@@ -0,0 +1,82 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// ========== Command Policy ==========
+
+// AuditActionCommandDenied is written to the audit log when a command is rejected by policy
+const AuditActionCommandDenied = "exec.command_denied"
+
+// globalCommandPolicy returns the server-wide command policy from the current configuration
+func (o *Orchestrator) globalCommandPolicy() *models.CommandPolicy {
+	p := o.cfg().CommandPolicy
+	return &models.CommandPolicy{
+		DenyPatterns:    p.DenyPatterns,
+		AllowedBinaries: p.AllowedBinaries,
+		MaxArgLength:    p.MaxArgLength,
+	}
+}
+
+// CheckCommandPolicy evaluates command against the server-wide and the environment's command
+// policy on behalf of userID. Rejections are recorded in the audit log with the full command.
+// Callers skip the check for admins.
+func (o *Orchestrator) CheckCommandPolicy(ctx context.Context, envID string, command []string, userID string) error {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return err
+	}
+	return o.checkCommandPolicy(ctx, env, command, userID)
+}
+
+// CheckReadinessCommand evaluates the exec command of a readiness check like CheckCommandPolicy,
+// against policy: the command policy of the environment the check will run in. envID is "" for
+// environments not created yet. Checks without a command always pass.
+func (o *Orchestrator) CheckReadinessCommand(ctx context.Context, envID string, policy *models.CommandPolicy, check *models.ReadinessCheck, userID string) error {
+	if check == nil || len(check.Exec) == 0 {
+		return nil
+	}
+	return o.checkCommandPolicy(ctx, &models.Environment{ID: envID, CommandPolicy: policy}, check.Exec, userID)
+}
+
+// checkCommandPolicy is CheckCommandPolicy for an environment that was already looked up
+func (o *Orchestrator) checkCommandPolicy(ctx context.Context, env *models.Environment, command []string, userID string) error {
+	err := validator.EvaluateCommandPolicy(command, o.globalCommandPolicy(), env.CommandPolicy)
+	var violation *validator.CommandPolicyViolation
+	if !errors.As(err, &violation) {
+		return err
+	}
+
+	o.logger.Warn("command rejected by policy",
+		zap.String("environment_id", env.ID),
+		zap.String("user_id", userID),
+		zap.String("rule", violation.Rule),
+		zap.Strings("command", command),
+	)
+	if o.db != nil {
+		// Keep the exact argv (not a space-joined string) so the attempt can be reproduced
+		fullCommand, _ := json.Marshal(command)
+		if auditErr := o.db.SaveAuditEntry(ctx, &models.AuditEntry{
+			Action:       AuditActionCommandDenied,
+			ActorID:      userID,
+			ResourceType: "environment",
+			ResourceID:   env.ID,
+			Message:      fmt.Sprintf("Command rejected in environment %s (%s): %s", env.ID, violation.Rule, violation.Message),
+			Details:      string(fullCommand),
+		}); auditErr != nil {
+			o.logger.Warn("failed to write audit entry for rejected command", zap.String("environment_id", env.ID), zap.Error(auditErr))
+		}
+	}
+
+	return apierrors.Wrap(apierrors.Forbidden, apierrors.CodeCommandRejected, err, "command rejected by policy")
+}
@@ -0,0 +1,101 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Completion Notification ==========
+
+// MaxExecutionWaitSeconds caps how long a client may block waiting for an execution to finish
+const MaxExecutionWaitSeconds = 300
+
+// executionWaiter is closed when its execution reaches a terminal state; refs counts the
+// callers blocked on it so the entry can be dropped when they all give up
+type executionWaiter struct {
+	done chan struct{}
+	refs int
+}
+
+// subscribeExecutionDone returns a channel that is closed when the execution finishes and a
+// release func that must be called once the caller stops waiting
+func (o *Orchestrator) subscribeExecutionDone(execID string) (<-chan struct{}, func()) {
+	o.waitersMutex.Lock()
+	w, ok := o.execWaiters[execID]
+	if !ok {
+		w = &executionWaiter{done: make(chan struct{})}
+		o.execWaiters[execID] = w
+	}
+	w.refs++
+	o.waitersMutex.Unlock()
+
+	release := func() {
+		o.waitersMutex.Lock()
+		defer o.waitersMutex.Unlock()
+		// The entry is gone (or replaced) once the execution was notified
+		if cur, ok := o.execWaiters[execID]; ok && cur == w {
+			w.refs--
+			if w.refs == 0 {
+				delete(o.execWaiters, execID)
+			}
+		}
+	}
+	return w.done, release
+}
+
+// notifyExecutionDone caches the execution's result if it asked for that, wakes everyone
+// waiting for it, pushes its result to its callback, if any, and sends the failure notification
+// of a failed execution; call after the terminal state is persisted
+func (o *Orchestrator) notifyExecutionDone(execID string) {
+	o.cacheExecutionResult(execID)
+	o.deliverExecutionCallback(execID)
+	o.notifyExecutionFailed(execID)
+
+	o.waitersMutex.Lock()
+	defer o.waitersMutex.Unlock()
+	if w, ok := o.execWaiters[execID]; ok {
+		close(w.done)
+		delete(o.execWaiters, execID)
+	}
+}
+
+// WaitForExecution blocks until the execution reaches a terminal state, wait elapses, or ctx is
+// done (e.g. the client disconnected). It returns the execution's current state and whether it
+// has finished; a ctx error is returned as is.
+func (o *Orchestrator) WaitForExecution(ctx context.Context, execID string, wait time.Duration) (*models.Execution, bool, error) {
+	// Subscribe before reading the state so a completion in between is not missed
+	done, release := o.subscribeExecutionDone(execID)
+	defer release()
+
+	exec, err := o.GetExecution(ctx, execID)
+	if err != nil {
+		return nil, false, err
+	}
+	if exec.Status.IsTerminal() {
+		return exec, true, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case <-timer.C:
+	case <-done:
+	}
+
+	exec, err = o.GetExecution(ctx, execID)
+	if err != nil {
+		return nil, false, err
+	}
+	return exec, exec.Status.IsTerminal(), nil
+}
+
+// ExecutionWaiterCount returns the number of executions that currently have blocked waiters
+func (o *Orchestrator) ExecutionWaiterCount() int {
+	o.waitersMutex.Lock()
+	defer o.waitersMutex.Unlock()
+	return len(o.execWaiters)
+}
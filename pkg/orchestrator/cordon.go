@@ -0,0 +1,87 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Cordon ==========
+
+// CordonEnvironment stops an environment from accepting new execs and executions, e.g. before
+// maintenance: they are rejected with 423 Locked and the reason, while running executions finish
+// and everything else (status, logs, files) keeps working. The standby pool is not replenished
+// while cordoned. Cordoning a cordoned environment updates its reason.
+func (o *Orchestrator) CordonEnvironment(ctx context.Context, envID, reason string) (*models.Environment, error) {
+	return o.setCordon(ctx, envID, true, reason)
+}
+
+// UncordonEnvironment lets a cordoned environment accept executions again and resumes standby
+// pool replenishment. No-op for an environment that is not cordoned.
+func (o *Orchestrator) UncordonEnvironment(ctx context.Context, envID string) (*models.Environment, error) {
+	env, err := o.setCordon(ctx, envID, false, "")
+	if err != nil {
+		return nil, err
+	}
+	o.triggerReplenish()
+	return env, nil
+}
+
+// setCordon updates and persists an environment's cordon state, logging an event when it changes
+func (o *Orchestrator) setCordon(ctx context.Context, envID string, cordoned bool, reason string) (*models.Environment, error) {
+	o.envMutex.Lock()
+	env, exists := o.environments[envID]
+	if !exists {
+		o.envMutex.Unlock()
+		return nil, errEnvironmentNotFound
+	}
+	changed := env.Cordoned != cordoned
+	env.Cordoned = cordoned
+	env.CordonReason = reason
+	if !cordoned {
+		env.CordonedAt = nil
+	} else if changed {
+		now := o.clock.Now()
+		env.CordonedAt = &now
+	}
+	envCopy := env.DeepCopy()
+	o.envMutex.Unlock()
+
+	if o.db != nil {
+		if err := o.db.UpdateEnvironmentCordon(ctx, envID, cordoned, reason, envCopy.CordonedAt); err != nil {
+			o.logger.Error("failed to save environment cordon to database", zap.Error(err), zap.String("environment_id", envID))
+			return nil, fmt.Errorf("failed to persist update: %w", err)
+		}
+	}
+
+	if changed {
+		if cordoned {
+			o.logReconciliationEvent(envID, "cordon", "Environment cordoned; new executions are rejected", reason)
+		} else {
+			o.logReconciliationEvent(envID, "uncordon", "Environment uncordoned; executions accepted again", "")
+		}
+		o.logger.Info("environment cordon changed",
+			zap.String("environment_id", envID),
+			zap.Bool("cordoned", cordoned),
+			zap.String("reason", reason),
+		)
+	}
+	o.setPoolReady(envCopy)
+	return envCopy, nil
+}
+
+// checkCordoned rejects new execs and executions on a cordoned environment
+func checkCordoned(env *models.Environment) error {
+	if !env.Cordoned {
+		return nil
+	}
+	if env.CordonReason != "" {
+		return apierrors.New(apierrors.Locked, apierrors.CodeEnvironmentCordoned,
+			"environment is cordoned: %s", env.CordonReason)
+	}
+	return apierrors.New(apierrors.Locked, apierrors.CodeEnvironmentCordoned, "environment is cordoned")
+}
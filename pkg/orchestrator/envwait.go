@@ -0,0 +1,143 @@
+package orchestrator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Environment Readiness Notification ==========
+
+const (
+	// DefaultEnvironmentWaitSeconds is how long GET /environments/{id}/wait blocks by default
+	DefaultEnvironmentWaitSeconds = 60
+	// MaxEnvironmentWaitSeconds caps how long a client may block waiting for an environment
+	MaxEnvironmentWaitSeconds = 300
+)
+
+// environmentWatcher is signaled when its environment's status changes; the channel holds one
+// signal so changes made while the watcher is busy coalesce into one wake-up
+type environmentWatcher struct {
+	changed chan struct{}
+}
+
+// WatchEnvironmentStatus returns a channel that is signaled whenever the environment's status
+// changes and a release func that must be called once the caller stops watching. Signals carry no
+// state: read the environment after each one. Watch before reading the current state so a change
+// in between is not missed.
+func (o *Orchestrator) WatchEnvironmentStatus(envID string) (<-chan struct{}, func()) {
+	w := &environmentWatcher{changed: make(chan struct{}, 1)}
+
+	o.envWatchersMutex.Lock()
+	watchers, ok := o.envWatchers[envID]
+	if !ok {
+		watchers = make(map[*environmentWatcher]struct{})
+		o.envWatchers[envID] = watchers
+	}
+	watchers[w] = struct{}{}
+	o.envWatchersMutex.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			o.envWatchersMutex.Lock()
+			defer o.envWatchersMutex.Unlock()
+			delete(watchers, w)
+			if len(o.envWatchers[envID]) == 0 {
+				delete(o.envWatchers, envID)
+			}
+		})
+	}
+	return w.changed, release
+}
+
+// notifyEnvironmentStatus wakes everyone watching the environment; call after its new status is
+// stored (and persisted) so the woken callers read it
+func (o *Orchestrator) notifyEnvironmentStatus(envID string) {
+	o.envWatchersMutex.Lock()
+	defer o.envWatchersMutex.Unlock()
+	for w := range o.envWatchers[envID] {
+		select {
+		case w.changed <- struct{}{}:
+		default:
+			// A wake-up is already pending
+		}
+	}
+}
+
+// WaitForEnvironment blocks until the environment has settled (running, failed or being deleted),
+// wait elapses, or ctx is done (e.g. the client disconnected). It returns the environment's current
+// state and whether it has settled; a ctx error is returned as is.
+func (o *Orchestrator) WaitForEnvironment(ctx context.Context, envID string, wait time.Duration) (*models.Environment, bool, error) {
+	changed, release := o.WatchEnvironmentStatus(envID)
+	defer release()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		env, err := o.GetEnvironment(ctx, envID)
+		if err != nil {
+			return nil, false, err
+		}
+		if env.Status.IsSettled() {
+			return env, true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-timer.C:
+			env, err = o.GetEnvironment(ctx, envID)
+			if err != nil {
+				return nil, false, err
+			}
+			return env, env.Status.IsSettled(), nil
+		case <-changed:
+		}
+	}
+}
+
+// EnvironmentWatcherCount returns the number of callers currently watching environments
+func (o *Orchestrator) EnvironmentWatcherCount() int {
+	o.envWatchersMutex.Lock()
+	defer o.envWatchersMutex.Unlock()
+	count := 0
+	for _, watchers := range o.envWatchers {
+		count += len(watchers)
+	}
+	return count
+}
+
+// trackProvisioning records that envID's provisioning goroutine is running; the returned func
+// must be called when it exits
+func (o *Orchestrator) trackProvisioning(envID string) func() {
+	done := make(chan struct{})
+	o.provisioningMutex.Lock()
+	o.provisioning[envID] = done
+	o.provisioningMutex.Unlock()
+
+	return func() {
+		o.provisioningMutex.Lock()
+		if o.provisioning[envID] == done {
+			delete(o.provisioning, envID)
+		}
+		o.provisioningMutex.Unlock()
+		close(done)
+	}
+}
+
+// ProvisioningDone returns a channel that is closed once the environment's provisioning goroutine
+// has exited, whether it succeeded or failed. The channel is already closed when no provisioning
+// of the environment is in flight.
+func (o *Orchestrator) ProvisioningDone(envID string) <-chan struct{} {
+	o.provisioningMutex.Lock()
+	defer o.provisioningMutex.Unlock()
+	if done, ok := o.provisioning[envID]; ok {
+		return done
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -0,0 +1,74 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Environment events ==========
+
+// EventListOptions holds the time filter and pagination of ListEvents
+type EventListOptions struct {
+	Limit int
+	// PageToken resumes the listing after the last event of the previous page
+	// (EnvironmentEventsResponse.NextPageToken)
+	PageToken string
+	// Since returns only the events newer than it, for polling with the timestamp of the newest
+	// event seen
+	Since *time.Time
+	// Until returns only the events at or before it
+	Until *time.Time
+}
+
+// ListEvents returns a page of an environment's reconciliation and lifecycle events, newest
+// first. Events are only recorded with a database; without one the page is empty.
+func (o *Orchestrator) ListEvents(ctx context.Context, envID string, opts EventListOptions) (*models.EnvironmentEventsResponse, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	cursor, err := models.ParsePageToken(opts.PageToken)
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.ValidationFailed, apierrors.CodeBadRequest, err, "invalid page_token")
+	}
+	if _, err := o.GetEnvironment(ctx, envID); err != nil {
+		return nil, err
+	}
+	resp := &models.EnvironmentEventsResponse{Events: []*models.EnvironmentEvent{}}
+	if o.db == nil {
+		return resp, nil
+	}
+
+	// One extra event tells whether there is a next page; times are local, like the stored timestamps
+	r := database.ActivityRange{Limit: limit + 1}
+	if opts.Since != nil {
+		since := opts.Since.Local()
+		r.Since = &since
+	}
+	switch {
+	case cursor != nil:
+		before := cursor.CreatedAt.Local()
+		r.Before, r.BeforeID = &before, cursor.ID
+	case opts.Until != nil:
+		until := opts.Until.Local()
+		r.Before, r.BeforeInclusive = &until, true
+	}
+	events, err := o.db.ListEnvironmentActivityEvents(ctx, envID, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > limit {
+		events = events[:limit]
+		last := events[limit-1]
+		resp.NextPageToken = (&models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}).Token()
+	}
+	resp.Events = append(resp.Events, events...)
+	return resp, nil
+}
@@ -0,0 +1,163 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Per-Environment Exec Queue ==========
+
+// execQueue tracks the synchronous execs of one environment (guarded by execQueueMutex). In
+// serialized mode an exec only starts when nothing runs and nobody is waiting ahead of it;
+// waiting execs are started one at a time in arrival order.
+type execQueue struct {
+	running int
+	// waiting holds one channel per queued exec, closed when it is its turn
+	waiting []chan struct{}
+}
+
+// ExecQueueError is returned by ExecuteCommand and ExecuteCommandStream when an exec in a
+// serialized environment cannot start: the queue is full, or its timeout expired while queued
+type ExecQueueError struct {
+	// Full is set when the exec was rejected because the queue was full
+	Full bool
+	// Ahead is the number of execs still ahead of it (running or queued)
+	Ahead int
+	// Queued is the number of execs waiting in the environment's queue
+	Queued int
+	// Waited is how long the exec waited before giving up
+	Waited time.Duration
+}
+
+// Error implements the error interface
+func (e *ExecQueueError) Error() string {
+	if e.Full {
+		return fmt.Sprintf("exec queue is full: %d execs are already waiting", e.Queued)
+	}
+	return fmt.Sprintf("exec did not start before its timeout: waited %s with %d execs still ahead (%d queued)",
+		e.Waited.Round(time.Millisecond), e.Ahead, e.Queued)
+}
+
+// Unwrap makes a full queue a RateLimited error and an expired wait a Timeout error
+func (e *ExecQueueError) Unwrap() error {
+	if e.Full {
+		return apierrors.New(apierrors.RateLimited, apierrors.CodeExecQueueFull, "%s", e.Error())
+	}
+	return apierrors.New(apierrors.Timeout, apierrors.CodeExecQueueTimeout, "%s", e.Error())
+}
+
+// execTurn is an exec's slot in the main pod of an environment
+type execTurn struct {
+	// position is the number of execs that were ahead of it when it arrived
+	position int
+	// waited is how long it was queued
+	waited  time.Duration
+	release func()
+}
+
+// waitExecTurn blocks until the exec may run in env's main pod. Execs in a serialized
+// environment queue behind each other for as long as ctx allows; parallel ones start right away.
+// The returned turn must be released when the exec is done.
+func (o *Orchestrator) waitExecTurn(ctx context.Context, env *models.Environment) (*execTurn, error) {
+	envID := env.ID
+	release := func() { o.releaseExecTurn(envID) }
+
+	o.execQueueMutex.Lock()
+	q := o.execQueues[envID]
+	if q == nil {
+		q = &execQueue{}
+		o.execQueues[envID] = q
+	}
+	if !env.SerializesExecs() || (q.running == 0 && len(q.waiting) == 0) {
+		q.running++
+		o.execQueueMutex.Unlock()
+		return &execTurn{release: release}, nil
+	}
+	if maxQueued := o.cfg().Executions.MaxQueueDepth; maxQueued > 0 && len(q.waiting) >= maxQueued {
+		queued := len(q.waiting)
+		o.execQueueMutex.Unlock()
+		return nil, &ExecQueueError{Full: true, Ahead: q.running + queued, Queued: queued}
+	}
+	ready := make(chan struct{})
+	q.waiting = append(q.waiting, ready)
+	position := q.running + len(q.waiting) - 1
+	o.execQueueMutex.Unlock()
+
+	start := o.clock.Now()
+	select {
+	case <-ready:
+		return &execTurn{position: position, waited: o.clock.Now().Sub(start), release: release}, nil
+	case <-ctx.Done():
+	}
+
+	o.execQueueMutex.Lock()
+	for i, ch := range q.waiting {
+		if ch == ready {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			err := &ExecQueueError{Ahead: q.running + i, Queued: len(q.waiting), Waited: o.clock.Now().Sub(start)}
+			o.execQueueMutex.Unlock()
+			return nil, err
+		}
+	}
+	// Its turn came just as it gave up: pass the turn on
+	queued := len(q.waiting)
+	o.execQueueMutex.Unlock()
+	release()
+	return nil, &ExecQueueError{Queued: queued, Waited: o.clock.Now().Sub(start)}
+}
+
+// releaseExecTurn ends an exec in envID's main pod and starts the next queued one
+func (o *Orchestrator) releaseExecTurn(envID string) {
+	o.execQueueMutex.Lock()
+	defer o.execQueueMutex.Unlock()
+
+	q := o.execQueues[envID]
+	if q == nil {
+		return
+	}
+	q.running--
+	if q.running == 0 && len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		close(next)
+	}
+	if q.running == 0 && len(q.waiting) == 0 {
+		delete(o.execQueues, envID)
+	}
+}
+
+// ExecQueueStats returns the number of running and queued synchronous execs of an environment
+func (o *Orchestrator) ExecQueueStats(ctx context.Context, envID string) (*models.ExecQueueStats, error) {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &models.ExecQueueStats{
+		EnvironmentID: envID,
+		ExecMode:      effectiveExecMode(env.ExecMode),
+	}
+	if env.SerializesExecs() {
+		stats.MaxQueued = o.cfg().Executions.MaxQueueDepth
+	}
+	o.execQueueMutex.Lock()
+	if q := o.execQueues[envID]; q != nil {
+		stats.Running = q.running
+		stats.Queued = len(q.waiting)
+	}
+	o.execQueueMutex.Unlock()
+	return stats, nil
+}
+
+// effectiveExecMode returns the exec mode an environment with the given setting uses
+func effectiveExecMode(mode string) string {
+	if mode == "" {
+		return models.ExecModeSerialized
+	}
+	return mode
+}
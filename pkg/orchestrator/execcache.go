@@ -0,0 +1,191 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Result Cache ==========
+
+// execCacheTarget is where a running execution's result is cached once it finishes
+type execCacheTarget struct {
+	key string
+	ttl time.Duration
+}
+
+// executionCacheTTL returns the cache lifetime for a requested TTL in seconds (0 = default)
+func executionCacheTTL(seconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = models.DefaultExecutionCacheTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// executionCacheKey identifies an execution's inputs: the environment, the image the execution
+// runs, its environment variables (the environment's merged with the request's), command and
+// input files. Changing the environment's image or env therefore yields a different key.
+func executionCacheKey(env *models.Environment, req *EphemeralExecRequest, image string) string {
+	vars := maps.Clone(env.Env)
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	maps.Copy(vars, req.Env)
+	files := req.Files
+	if len(files) == 0 {
+		files = nil
+	}
+
+	// Maps are encoded with sorted keys, so equal inputs always encode the same
+	data, _ := json.Marshal(struct {
+		EnvironmentID string            `json:"environment_id"`
+		Image         string            `json:"image"`
+		Env           map[string]string `json:"env"`
+		Command       []string          `json:"command"`
+		Files         map[string][]byte `json:"files"`
+	}{env.ID, image, vars, req.Command, files})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheableResult reports whether an execution's result may be reused: the command ran to
+// completion (with any exit code) and was not itself served from the cache
+func cacheableResult(exec *models.Execution) bool {
+	if exec.Status != models.ExecutionStatusCompleted && exec.Status != models.ExecutionStatusFailed {
+		return false
+	}
+	return exec.ExitCode != nil && exec.ErrorCode == "" && !exec.Cached
+}
+
+// lookupExecutionCache returns the finished execution cached under key, or nil on a miss
+func (o *Orchestrator) lookupExecutionCache(ctx context.Context, key string) *models.Execution {
+	execID, err := o.db.LookupExecutionCache(ctx, key, o.clock.Now())
+	if err != nil {
+		o.logger.Warn("failed to look up execution cache", zap.Error(err))
+	}
+	if execID != "" {
+		if original, err := o.GetExecution(ctx, execID); err == nil && cacheableResult(original) {
+			o.cacheHits.Add(1)
+			return original
+		}
+	}
+	o.cacheMisses.Add(1)
+	return nil
+}
+
+// completeFromCache finishes exec with the result of the cached execution original without
+// running anything, and returns a copy of it
+func (o *Orchestrator) completeFromCache(ctx context.Context, exec, original *models.Execution, callback *callbackTarget) *models.Execution {
+	now := o.clock.Now()
+	var durationMs int64
+	exec.Status = original.Status
+	exec.PodName = ""
+	exec.CompletedAt = &now
+	exitCode := *original.ExitCode
+	exec.ExitCode = &exitCode
+	exec.Stdout = original.Stdout
+	exec.Stderr = original.Stderr
+	exec.Error = original.Error
+	exec.DurationMs = &durationMs
+	exec.StdoutBytesTotal = original.StdoutBytesTotal
+	exec.StderrBytesTotal = original.StderrBytesTotal
+	exec.Truncated = original.Truncated
+	exec.Cached = true
+	exec.CachedFrom = original.ID
+
+	o.execMutex.Lock()
+	o.executions[exec.ID] = exec
+	if callback != nil {
+		o.execCallbacks[exec.ID] = callback
+	}
+	execCopy := exec.DeepCopy()
+	o.execMutex.Unlock()
+
+	if err := o.db.SaveExecution(ctx, execCopy); err != nil {
+		o.logger.Error("failed to save execution to database", zap.Error(err), zap.String("execution_id", exec.ID))
+	}
+
+	o.logger.Info("execution served from cache",
+		zap.String("exec_id", exec.ID),
+		zap.String("cached_from", original.ID),
+		zap.String("environment_id", exec.EnvironmentID),
+		zap.String("user_id", exec.UserID),
+	)
+
+	o.notifyExecutionDone(exec.ID)
+	return execCopy
+}
+
+// cacheExecutionResult stores a finished execution's result under its cache key if it was
+// submitted with cache: true and ran to completion
+func (o *Orchestrator) cacheExecutionResult(execID string) {
+	o.execMutex.Lock()
+	target := o.execCacheKeys[execID]
+	delete(o.execCacheKeys, execID)
+	exec, exists := o.executions[execID]
+	cacheable := exists && cacheableResult(exec)
+	var envID string
+	if exists {
+		envID = exec.EnvironmentID
+	}
+	o.execMutex.Unlock()
+	if target == nil || !cacheable || o.db == nil {
+		return
+	}
+
+	now := o.clock.Now()
+	if err := o.db.SaveExecutionCacheEntry(context.Background(), &database.ExecutionCacheEntry{
+		Key:           target.key,
+		EnvironmentID: envID,
+		ExecutionID:   execID,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(target.ttl),
+	}); err != nil {
+		o.logger.Warn("failed to cache execution result", zap.String("exec_id", execID), zap.Error(err))
+	}
+}
+
+// invalidateExecutionCache drops the cached results of an environment (after its image or env
+// changed)
+func (o *Orchestrator) invalidateExecutionCache(ctx context.Context, envID string) {
+	if o.db == nil {
+		return
+	}
+	removed, err := o.db.DeleteExecutionCacheForEnvironment(ctx, envID)
+	if err != nil {
+		o.logger.Warn("failed to invalidate execution cache", zap.String("environment_id", envID), zap.Error(err))
+		return
+	}
+	if removed > 0 {
+		o.logger.Info("execution cache invalidated", zap.String("environment_id", envID), zap.Int64("entries", removed))
+	}
+}
+
+// deleteExpiredExecutionCache drops result cache entries past their TTL
+func (o *Orchestrator) deleteExpiredExecutionCache(ctx context.Context) {
+	if o.db == nil {
+		return
+	}
+	if _, err := o.db.DeleteExpiredExecutionCache(ctx, o.clock.Now()); err != nil {
+		o.logger.Warn("failed to delete expired execution cache entries", zap.Error(err))
+	}
+}
+
+// ExecutionCacheHitsTotal returns the number of executions served from the result cache since
+// startup
+func (o *Orchestrator) ExecutionCacheHitsTotal() int64 {
+	return o.cacheHits.Load()
+}
+
+// ExecutionCacheMissesTotal returns the number of result cache lookups that missed since startup
+func (o *Orchestrator) ExecutionCacheMissesTotal() int64 {
+	return o.cacheMisses.Load()
+}
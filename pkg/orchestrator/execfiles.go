@@ -0,0 +1,150 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Input Files ==========
+
+// execWorkingDir returns the directory input files are written to in the pod
+func (o *Orchestrator) execWorkingDir() string {
+	if dir := o.cfg().Executions.WorkingDir; dir != "" {
+		return dir
+	}
+	return config.DefaultExecWorkingDir
+}
+
+// executionFiles returns the audit record of input files: paths and sizes, sorted by path
+func executionFiles(files map[string][]byte) []models.ExecutionFile {
+	if len(files) == 0 {
+		return nil
+	}
+	list := make([]models.ExecutionFile, 0, len(files))
+	for p, content := range files {
+		list = append(list, models.ExecutionFile{Path: p, Size: int64(len(content))})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// filesTarball packs the input files (validated relative paths) into a tar archive, with an entry
+// for each parent directory
+func filesTarball(files map[string][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	now := time.Now()
+	dirs := make(map[string]bool)
+	for _, f := range executionFiles(files) {
+		var parents []string
+		for dir := path.Dir(f.Path); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			parents = append(parents, dir)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			hdr := &tar.Header{Typeflag: tar.TypeDir, Name: parents[i] + "/", Mode: 0o755, ModTime: now}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return nil, err
+			}
+		}
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: f.Path, Mode: 0o644, Size: f.Size, ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(files[f.Path]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inWorkingDir wraps command so it runs with dir as its working directory
+func inWorkingDir(dir string, command []string) []string {
+	return append([]string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, dir}, command...)
+}
+
+// afterFilesReady wraps the command of an execution pod so it waits until the input files are
+// written (the ready marker appears in dir), then runs in dir
+func afterFilesReady(dir string, command []string) []string {
+	script := fmt.Sprintf(`while [ ! -e "$0/%[1]s" ]; do sleep 0.2 2>/dev/null || sleep 1; done; rm -f "$0/%[1]s"; cd "$0" && exec "$@"`,
+		models.ExecFilesReadyMarker)
+	return append([]string{"/bin/sh", "-c", script, dir}, command...)
+}
+
+// writeExecutionFiles extracts the input files into dir in the pod, creating dir first; with
+// signalReady it then creates the ready marker an afterFilesReady command waits for
+func writeExecutionFiles(
+	ctx context.Context, client k8s.ClientInterface, namespace, podName, dir string, files map[string][]byte, signalReady bool,
+) error {
+	archive, err := filesTarball(files)
+	if err != nil {
+		return fmt.Errorf("failed to pack input files: %w", err)
+	}
+	script := `mkdir -p "$0" && tar -xf - -C "$0"`
+	if signalReady {
+		script += fmt.Sprintf(` && touch "$0/%s"`, models.ExecFilesReadyMarker)
+	}
+	var stderr bytes.Buffer
+	err = client.ExecInPod(ctx, namespace, podName, []string{"/bin/sh", "-c", script, dir}, bytes.NewReader(archive), nil, &stderr)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadExecutionFiles writes the execution's input files into the pod and reports whether it
+// succeeded; on failure the execution fails with CodeExecFilesFailed
+func (o *Orchestrator) uploadExecutionFiles(
+	ctx context.Context, client k8s.ClientInterface, execID, namespace, podName, dir string, files map[string][]byte, signalReady bool,
+) bool {
+	err := writeExecutionFiles(ctx, client, namespace, podName, dir, files, signalReady)
+	if err == nil {
+		return true
+	}
+	o.logger.Warn("failed to write execution input files",
+		zap.String("exec_id", execID),
+		zap.String("pod", podName),
+		zap.Error(err),
+	)
+	if execTimedOut(ctx, err) {
+		o.failExecutionTimedOut(execID, 0, func(*models.Execution) {})
+		return false
+	}
+	o.updateExecutionErrorCode(execID, apierrors.CodeExecFilesFailed, fmt.Sprintf("failed to write input files: %v", err))
+	return false
+}
+
+// removeExecutionDir deletes an execution's directory from a shared pod (best-effort). It runs
+// even when ctx is done; ctx only carries the execution's span.
+func (o *Orchestrator) removeExecutionDir(ctx context.Context, client k8s.ClientInterface, execID, namespace, podName, dir string) {
+	cleanupCtx, cleanupCancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cleanupCancel()
+	if err := client.ExecInPod(cleanupCtx, namespace, podName, []string{"rm", "-rf", dir}, nil, io.Discard, io.Discard); err != nil {
+		o.logger.Warn("failed to remove execution directory",
+			zap.String("exec_id", execID),
+			zap.String("pod", podName),
+			zap.String("dir", dir),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,184 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+	utilexec "k8s.io/client-go/util/exec"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Stopping Timed-Out and Abandoned Commands ==========
+
+// AuditActionExecCanceled is the audit log action recorded when the client of a synchronous exec
+// went away before the command finished
+const AuditActionExecCanceled = "exec.client_disconnected"
+
+// Reasons for killing a command, as logged by killExecTree
+const (
+	execTimeoutReason    = "timed out"
+	execCancelReason     = "client disconnected"
+	execUserCancelReason = "execution canceled"
+)
+
+// execKillGracePeriod is how long a timed-out command's processes get to exit after SIGTERM
+// before they are sent SIGKILL
+const execKillGracePeriod = 5 * time.Second
+
+// execPIDFile is where a killable command of the execution records its shell's PID in the pod:
+// the writable directory every pod mounts, as the root filesystem may be read-only
+func execPIDFile(execID string) string {
+	return k8s.ExecStateDir + "/" + execID + ".pid"
+}
+
+// killable wraps command in a shell that records its PID in pidFile while the command runs as
+// its child, so killExecTree can find the command's process tree. Ending the exec session does
+// not stop the command; only a signal does.
+func killable(pidFile string, command []string) []string {
+	return append([]string{"/bin/sh", "-c", `{ echo $$ > "$0"; } 2>/dev/null; "$@"; status=$?; rm -f "$0"; exit $status`, pidFile}, command...)
+}
+
+// shellProbeTimeout bounds checking whether a pod has a shell
+const shellProbeTimeout = 10 * time.Second
+
+// killableCommand returns command wrapped by killable when the pod (running image) has
+// /bin/sh, and command itself otherwise (e.g. distroless images), which then cannot be killed
+// before it exits. Images found to have a shell are remembered; others are checked again.
+func (o *Orchestrator) killableCommand(
+	ctx context.Context, client k8s.ClientInterface, namespace, podName, image, execID string, command []string,
+) []string {
+	if _, ok := o.shellImages.Load(image); ok {
+		return killable(execPIDFile(execID), command)
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, shellProbeTimeout)
+	defer cancel()
+	if err := client.ExecInPod(probeCtx, namespace, podName, k8s.ShellProbeCommand, nil, io.Discard, io.Discard); err != nil {
+		o.logger.Warn("pod has no usable shell, running command directly; it cannot be killed before it exits",
+			zap.String("exec_id", execID),
+			zap.String("pod", podName),
+			zap.String("image", image),
+			zap.Error(err),
+		)
+		return command
+	}
+	o.shellImages.Store(image, true)
+	return killable(execPIDFile(execID), command)
+}
+
+// killNoPIDExit is the exit code of killTreeScript when no PID was recorded: the command was not
+// started through killable, or could not write its PID file
+const killNoPIDExit = 3
+
+// errKillNotDelivered is returned by killExecTree when no signal reached the command
+var errKillNotDelivered = errors.New("no PID recorded for the command, kill not delivered")
+
+// killTreeScript sends SIGTERM to the process tree of the PID in the file $0 (walking /proc for
+// descendants), waits up to the grace period for it to exit and sends SIGKILL to what is left
+const killTreeScript = `pid=$(cat "$0" 2>/dev/null) || exit %d
+rm -f "$0"
+tree() {
+  echo "$1"
+  for s in /proc/[0-9]*/stat; do
+    read -r p c st pp rest < "$s" 2>/dev/null && [ "$pp" = "$1" ] && tree "$p"
+  done
+}
+pids=$(tree "$pid")
+kill -TERM $pids 2>/dev/null
+i=0
+while [ "$i" -lt %d ]; do
+  alive=
+  for p in $pids; do kill -0 "$p" 2>/dev/null && alive=1; done
+  [ -z "$alive" ] && exit 0
+  sleep 1
+  i=$((i+1))
+done
+kill -KILL $pids 2>/dev/null
+exit 0`
+
+// killExecTree stops the processes of a command started with killable whose exec ended early
+// (reason: at its timeout, because the caller went away, or because its execution was canceled):
+// SIGTERM, then SIGKILL after execKillGracePeriod. It returns once they are gone, so the pod can
+// be reused or deleted, or an error when the kill was not delivered (no shell to run the kill, no
+// PID recorded). Runs even when ctx is done; ctx only carries the execution's span.
+func (o *Orchestrator) killExecTree(ctx context.Context, client k8s.ClientInterface, execID, namespace, podName, reason string) error {
+	killCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), execKillGracePeriod+30*time.Second)
+	defer cancel()
+	script := fmt.Sprintf(killTreeScript, killNoPIDExit, int(execKillGracePeriod/time.Second))
+	err := client.ExecInPod(killCtx, namespace, podName, []string{"/bin/sh", "-c", script, execPIDFile(execID)}, nil, io.Discard, io.Discard)
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == killNoPIDExit {
+		err = errKillNotDelivered
+	}
+	if err != nil {
+		o.logger.Warn("failed to kill command",
+			zap.String("exec_id", execID),
+			zap.String("pod", podName),
+			zap.String("reason", reason),
+			zap.Error(err),
+		)
+		return err
+	}
+	o.logger.Info("killed command",
+		zap.String("exec_id", execID),
+		zap.String("pod", podName),
+		zap.String("reason", reason),
+	)
+	return nil
+}
+
+// recordKillFailed adds a kill_failed event to an execution whose command killExecTree could not
+// stop, so its record does not claim the command is gone
+func (o *Orchestrator) recordKillFailed(execID string, killErr error) {
+	o.execMutex.Lock()
+	exec, exists := o.executions[execID]
+	if exists {
+		addExecutionEvent(exec, o.clock.Now(), models.ExecutionEventKillFailed, killErr.Error())
+		exec = exec.DeepCopy()
+	}
+	o.execMutex.Unlock()
+	if exists && o.db != nil {
+		if err := o.db.SaveExecution(context.Background(), exec); err != nil {
+			o.logger.Error("failed to save execution", zap.Error(err), zap.String("execution_id", execID))
+		}
+	}
+}
+
+// stopCanceledExec kills a synchronous exec whose caller canceled it (e.g. the client
+// disconnected) and records the disconnect in the audit log
+func (o *Orchestrator) stopCanceledExec(
+	ctx context.Context, client k8s.ClientInterface, env *models.Environment, execID string, command []string, ran time.Duration,
+) {
+	o.logger.Warn("exec canceled by caller, stopping command",
+		zap.String("environment_id", env.ID),
+		zap.String("exec_id", execID),
+		zap.Strings("command", command),
+		zap.Duration("ran", ran),
+	)
+	killErr := o.killExecTree(ctx, client, execID, env.Namespace, "main", execCancelReason)
+
+	if o.db == nil {
+		return
+	}
+	outcome := "command stopped"
+	if killErr != nil {
+		outcome = fmt.Sprintf("command could not be stopped (%v)", killErr)
+	}
+	// The request's context is canceled; keep its values (client address) for the entry
+	fullCommand, _ := json.Marshal(command)
+	if err := o.db.SaveAuditEntry(context.WithoutCancel(ctx), &models.AuditEntry{
+		Action:       AuditActionExecCanceled,
+		ResourceType: "environment",
+		ResourceID:   env.ID,
+		Message:      fmt.Sprintf("Client disconnected after %s; %s in environment %s", ran.Round(time.Millisecond), outcome, env.ID),
+		Details:      string(fullCommand),
+	}); err != nil {
+		o.logger.Warn("failed to write audit entry for canceled exec", zap.String("environment_id", env.ID), zap.Error(err))
+	}
+}
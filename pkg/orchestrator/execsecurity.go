@@ -0,0 +1,159 @@
+package orchestrator
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Pod Security ==========
+
+// execSecurityContext returns the security context and scratch directories of an ephemeral
+// execution pod: sc (the environment's security context with the execution's overrides)
+// hardened with execution_security, unless the environment inherits its own security context
+func (o *Orchestrator) execSecurityContext(env *models.Environment, sc *models.SecurityContextConfig) (*k8s.SecurityContext, []string) {
+	cfg := o.cfg().ExecSecurity
+	if !cfg.Enabled || (env.Isolation != nil && env.Isolation.ExecInheritSecurityContext) {
+		return toK8sSecurityContext(sc), nil
+	}
+
+	out := toK8sSecurityContext(sc)
+	if out == nil {
+		out = &k8s.SecurityContext{}
+	}
+	if len(cfg.DropCapabilities) > 0 {
+		// Capabilities the environment adds are not granted to execution pods
+		var drop []string
+		if out.Capabilities != nil {
+			drop = append(drop, out.Capabilities.Drop...)
+		}
+		for _, c := range cfg.DropCapabilities {
+			if !slices.Contains(drop, c) {
+				drop = append(drop, c)
+			}
+		}
+		out.Capabilities = &k8s.Capabilities{Drop: drop}
+	}
+	enabled := true
+	if cfg.RunAsNonRoot {
+		out.RunAsNonRoot = &enabled
+		if out.RunAsUser == nil || *out.RunAsUser == 0 {
+			uid := cfg.RunAsUser
+			out.RunAsUser = &uid
+		}
+	}
+	if cfg.ReadOnlyRootFilesystem {
+		out.ReadOnlyRootFilesystem = &enabled
+	}
+	if cfg.SeccompProfile == models.SeccompRuntimeDefault || (cfg.SeccompProfile != "" && out.SeccompProfile == "") {
+		out.SeccompProfile = cfg.SeccompProfile
+	}
+
+	// A read-only root filesystem leaves the scratch path and the working directory writable
+	var scratchDirs []string
+	if isTrue(out.ReadOnlyRootFilesystem) {
+		scratchDirs = []string{cfg.ScratchPath}
+		if wd := o.execWorkingDir(); wd != cfg.ScratchPath {
+			scratchDirs = append(scratchDirs, wd)
+		}
+	}
+	return out, scratchDirs
+}
+
+// mergeSecurityContext applies an execution's security context overrides to the environment's:
+// fields the override sets replace the environment's, and dropped capabilities add up
+func mergeSecurityContext(base, override *models.SecurityContextConfig) *models.SecurityContextConfig {
+	if override == nil {
+		return base
+	}
+	merged := models.SecurityContextConfig{}
+	if base != nil {
+		merged = *base
+	}
+	if override.RunAsUser != nil {
+		merged.RunAsUser = override.RunAsUser
+	}
+	if override.RunAsGroup != nil {
+		merged.RunAsGroup = override.RunAsGroup
+	}
+	if override.RunAsNonRoot != nil {
+		merged.RunAsNonRoot = override.RunAsNonRoot
+	}
+	if override.ReadOnlyRootFilesystem != nil {
+		merged.ReadOnlyRootFilesystem = override.ReadOnlyRootFilesystem
+	}
+	if override.AllowPrivilegeEscalation != nil {
+		merged.AllowPrivilegeEscalation = override.AllowPrivilegeEscalation
+	}
+	if override.SeccompProfile != "" {
+		merged.SeccompProfile = override.SeccompProfile
+	}
+	if override.Capabilities != nil {
+		caps := &models.CapabilitiesConfig{Add: override.Capabilities.Add}
+		if base != nil && base.Capabilities != nil {
+			caps.Drop = append(caps.Drop, base.Capabilities.Drop...)
+		}
+		for _, c := range override.Capabilities.Drop {
+			if !slices.Contains(caps.Drop, c) {
+				caps.Drop = append(caps.Drop, c)
+			}
+		}
+		merged.Capabilities = caps
+	}
+	return &merged
+}
+
+// checkExecSecurityEscalation rejects execution security context overrides that grant more than
+// the environment's own security context: running as root, turning off run_as_non_root or a
+// read-only root filesystem, allowing privilege escalation, adding capabilities the environment
+// does not add, or an unconfined seccomp profile
+func checkExecSecurityEscalation(isolation *models.IsolationConfig, req *models.SecurityContextConfig) error {
+	if req == nil {
+		return nil
+	}
+	env := &models.SecurityContextConfig{}
+	if isolation != nil && isolation.SecurityContext != nil {
+		env = isolation.SecurityContext
+	}
+
+	var problems []string
+	if isTrue(env.RunAsNonRoot) && req.RunAsNonRoot != nil && !*req.RunAsNonRoot {
+		problems = append(problems, "run_as_non_root cannot be turned off")
+	}
+	if req.RunAsUser != nil && *req.RunAsUser == 0 && (env.RunAsUser == nil || *env.RunAsUser != 0) {
+		problems = append(problems, "run_as_user cannot be root (0)")
+	}
+	if req.RunAsGroup != nil && *req.RunAsGroup == 0 && (env.RunAsGroup == nil || *env.RunAsGroup != 0) {
+		problems = append(problems, "run_as_group cannot be root (0)")
+	}
+	if isTrue(env.ReadOnlyRootFilesystem) && req.ReadOnlyRootFilesystem != nil && !*req.ReadOnlyRootFilesystem {
+		problems = append(problems, "read_only_root_filesystem cannot be turned off")
+	}
+	if isTrue(req.AllowPrivilegeEscalation) && !isTrue(env.AllowPrivilegeEscalation) {
+		problems = append(problems, "allow_privilege_escalation cannot be turned on")
+	}
+	if req.Capabilities != nil {
+		for _, c := range req.Capabilities.Add {
+			if env.Capabilities == nil || !slices.Contains(env.Capabilities.Add, c) {
+				problems = append(problems, "capability "+c+" is not added by the environment")
+			}
+		}
+	}
+	if req.SeccompProfile == models.SeccompUnconfined && env.SeccompProfile != models.SeccompUnconfined {
+		problems = append(problems, "seccomp_profile cannot be Unconfined")
+	}
+
+	if len(problems) > 0 {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"execution security context exceeds the environment's: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isTrue reports whether an optional flag is set to true
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
@@ -0,0 +1,209 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Queue ==========
+
+// AuditActionExecutionsCanceled is the audit log action of the executions of an environment being
+// canceled at once
+const AuditActionExecutionsCanceled = "executions.bulk_canceled"
+
+// bulkCancelReason is the error of executions canceled by CancelAllExecutions
+const bulkCancelReason = "canceled by user (bulk)"
+
+// bulkCancelPageSize is how many unfinished executions are read from the database at a time
+const bulkCancelPageSize = 500
+
+// cancelableStatuses are the statuses CancelAllExecutions cancels when none are given
+var cancelableStatuses = []models.ExecutionStatus{
+	models.ExecutionStatusPending,
+	models.ExecutionStatusQueued,
+	models.ExecutionStatusRunning,
+}
+
+// CancelAllExecutions cancels the executions of an environment that have one of the given
+// statuses (pending, queued and running when none are given), including those only in the
+// database. They are all marked canceled at once, so none of them starts meanwhile; their
+// commands are stopped and pods deleted afterwards. The cancellation is written to the audit log
+// as actorID's.
+func (o *Orchestrator) CancelAllExecutions(ctx context.Context, envID, actorID string, statuses []models.ExecutionStatus) (*models.CancelExecutionsResponse, error) {
+	if len(statuses) == 0 {
+		statuses = cancelableStatuses
+	}
+	for _, status := range statuses {
+		if status != models.ExecutionStatusPending && status != models.ExecutionStatusQueued && status != models.ExecutionStatusRunning {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+				"status must be one of pending, queued, running (got %q)", status)
+		}
+	}
+	if _, err := o.GetEnvironment(ctx, envID); err != nil {
+		return nil, err
+	}
+
+	ids, err := o.unfinishedExecutionIDs(ctx, envID, statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	now := o.clock.Now()
+	o.execMutex.Lock()
+	canceled := make([]canceledExecution, 0, len(ids))
+	for _, id := range ids {
+		exec, exists := o.executions[id]
+		if !exists || exec.EnvironmentID != envID || !containsStatus(statuses, exec.Status) {
+			continue
+		}
+		c, err := markExecutionCanceledLocked(exec, bulkCancelReason, now)
+		if err != nil {
+			continue
+		}
+		canceled = append(canceled, c)
+	}
+	o.execMutex.Unlock()
+
+	result := &models.CancelExecutionsResponse{ByStatus: map[models.ExecutionStatus]int{}}
+	canceledIDs := make([]string, 0, len(canceled))
+	for _, c := range canceled {
+		o.finishCanceledExecution(ctx, c, bulkCancelReason)
+		result.Canceled++
+		result.ByStatus[c.previous]++
+		canceledIDs = append(canceledIDs, c.exec.ID)
+	}
+	o.executionsCanceled(ctx, envID, actorID, statuses, result, canceledIDs)
+	return result, nil
+}
+
+// unfinishedExecutionIDs returns the executions of an environment with one of the statuses, in
+// memory or in the database. Those only in the database are loaded into memory.
+func (o *Orchestrator) unfinishedExecutionIDs(ctx context.Context, envID string, statuses []models.ExecutionStatus) ([]string, error) {
+	seen := map[string]bool{}
+	var ids []string
+	o.execMutex.RLock()
+	for id, exec := range o.executions {
+		if exec.EnvironmentID == envID && containsStatus(statuses, exec.Status) {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	o.execMutex.RUnlock()
+
+	if o.db == nil {
+		return ids, nil
+	}
+	for _, status := range statuses {
+		var after *models.PageCursor
+		for {
+			page, err := o.db.ListExecutionsFiltered(ctx, database.ExecutionListFilter{EnvironmentID: envID, Status: status}, after, bulkCancelPageSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list executions: %w", err)
+			}
+			for _, exec := range page {
+				if seen[exec.ID] {
+					continue
+				}
+				seen[exec.ID] = true
+				if _, err := o.GetExecution(ctx, exec.ID); err != nil {
+					continue
+				}
+				ids = append(ids, exec.ID)
+			}
+			if len(page) < bulkCancelPageSize {
+				break
+			}
+			last := page[len(page)-1]
+			after = &models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		}
+	}
+	return ids, nil
+}
+
+func containsStatus(statuses []models.ExecutionStatus, status models.ExecutionStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// executionsCanceled writes a bulk cancellation by actorID to the audit log
+func (o *Orchestrator) executionsCanceled(ctx context.Context, envID, actorID string, statuses []models.ExecutionStatus,
+	result *models.CancelExecutionsResponse, ids []string) {
+	if o.db == nil {
+		return
+	}
+	counts := make([]string, 0, len(result.ByStatus))
+	for _, status := range cancelableStatuses {
+		if n := result.ByStatus[status]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%s: %d", status, n))
+		}
+	}
+	message := fmt.Sprintf("%d executions of environment %s canceled", result.Canceled, envID)
+	if len(counts) > 0 {
+		message += " (" + strings.Join(counts, ", ") + ")"
+	}
+	sort.Strings(ids)
+	details, _ := json.Marshal(map[string]interface{}{"statuses": statuses, "execution_ids": ids})
+	if err := o.db.SaveAuditEntry(context.WithoutCancel(ctx), &models.AuditEntry{
+		Action:       AuditActionExecutionsCanceled,
+		ActorID:      actorID,
+		ResourceType: "environment",
+		ResourceID:   envID,
+		Message:      message,
+		Details:      string(details),
+	}); err != nil {
+		o.logger.Warn("failed to write audit entry for canceled executions", zap.String("environment_id", envID), zap.Error(err))
+	}
+}
+
+// RequeueExecution submits a failed or canceled execution again as userID, with the command, env,
+// metadata and overrides it was submitted with. The new execution's RequeuedFrom links it to the
+// original. Its callback is not carried over (the callback's credentials are not kept), and
+// executions with input files cannot be requeued since their contents are not kept either.
+func (o *Orchestrator) RequeueExecution(ctx context.Context, execID, userID string, skipCommandPolicy bool) (*models.Execution, error) {
+	exec, err := o.GetExecution(ctx, execID)
+	if err != nil {
+		return nil, err
+	}
+	if exec.Status != models.ExecutionStatusFailed && exec.Status != models.ExecutionStatusCanceled {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeExecutionNotRequeueable,
+			"only failed or canceled executions can be requeued (status: %s)", exec.Status)
+	}
+	if len(exec.Files) > 0 {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeExecutionNotRequeueable,
+			"execution had input files, whose contents are not kept; submit it again with its files")
+	}
+	if exec.Submission == nil {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeExecutionNotRequeueable,
+			"execution was submitted before its parameters were recorded; submit it again")
+	}
+
+	sub := exec.Submission
+	return o.SubmitExecution(ctx, &EphemeralExecRequest{
+		EnvironmentID:     exec.EnvironmentID,
+		Command:           exec.Command,
+		Timeout:           sub.Timeout,
+		Env:               exec.Env,
+		Image:             sub.Image,
+		Resources:         sub.Resources,
+		Isolation:         sub.Isolation,
+		Cache:             exec.CacheEnabled,
+		CacheTTL:          sub.CacheTTL,
+		SkipSoftTimeout:   sub.SkipSoftTimeout,
+		Metadata:          exec.Metadata,
+		SkipCommandPolicy: skipCommandPolicy,
+		RequeuedFrom:      exec.ID,
+	}, userID)
+}
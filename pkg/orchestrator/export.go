@@ -0,0 +1,188 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Export / Import ==========
+
+// EnvironmentSpec returns the declarative definition of env: the CreateEnvironmentRequest that
+// recreates it, without runtime fields such as ID, status, namespace or timestamps. A built
+// environment is recreated from the image it built; its build section is only kept while the
+// image has not been built.
+func EnvironmentSpec(env *models.Environment) *models.CreateEnvironmentRequest {
+	var build *models.BuildSpec
+	if env.Image == "" {
+		build = env.Build
+	}
+	return &models.CreateEnvironmentRequest{
+		Name:               env.Name,
+		Image:              env.Image,
+		Resources:          env.Resources,
+		Timeout:            env.Timeout,
+		Env:                env.Env,
+		Command:            env.Command,
+		Labels:             env.Labels,
+		NodeSelector:       env.NodeSelector,
+		Tolerations:        env.Tolerations,
+		Affinity:           env.Affinity,
+		Isolation:          env.Isolation,
+		Pool:               env.Pool,
+		TeamID:             env.TeamID,
+		Cluster:            env.Cluster,
+		CommandPolicy:      env.CommandPolicy,
+		ReadinessCheck:     env.ReadinessCheck,
+		Lifecycle:          env.Lifecycle,
+		IdleTimeout:        env.IdleTimeout,
+		RecordSessions:     env.RecordSessions,
+		ExecMode:           env.ExecMode,
+		Mode:               env.Mode,
+		RetentionSeconds:   env.RetentionSeconds,
+		Build:              build,
+		LogShipping:        env.LogShipping,
+		WorkspaceSnapshots: env.WorkspaceSnapshots,
+		Metadata:           env.Metadata,
+	}
+}
+
+// FindEnvironmentByName returns the user's newest environment with the given name (a NotFound
+// error when there is none). Live in-memory state takes precedence over the database copy.
+func (o *Orchestrator) FindEnvironmentByName(ctx context.Context, userID, name string) (*models.Environment, error) {
+	var found *models.Environment
+	if o.db != nil {
+		envs, err := o.db.ListEnvironmentsByUserAndName(ctx, userID, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(envs) > 0 {
+			found = envs[0]
+		}
+	}
+
+	o.envMutex.RLock()
+	defer o.envMutex.RUnlock()
+	if found != nil {
+		if env, ok := o.environments[found.ID]; ok {
+			return env.DeepCopy(), nil
+		}
+		return found, nil
+	}
+	if o.db == nil {
+		for _, env := range o.environments {
+			if env.UserID == userID && env.Name == name && (found == nil || env.CreatedAt.After(found.CreatedAt)) {
+				found = env
+			}
+		}
+		if found != nil {
+			return found.DeepCopy(), nil
+		}
+	}
+	return nil, apierrors.New(apierrors.NotFound, apierrors.CodeEnvironmentNotFound, "environment not found: %s", name)
+}
+
+// PlanEnvironmentUpdate compares env with spec and returns the patch that makes env match it
+// and the names of the changed fields (none when env is up to date). Fields that cannot be
+// changed on an existing environment (cluster, team, mode) are reported as a validation error.
+func PlanEnvironmentUpdate(env *models.Environment, spec *models.CreateEnvironmentRequest) (*models.UpdateEnvironmentRequest, []string, error) {
+	if spec.Cluster != "" && spec.Cluster != env.Cluster {
+		return nil, nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"cluster cannot be changed (environment %s is on %q)", env.ID, env.Cluster)
+	}
+	if spec.TeamID != env.TeamID {
+		return nil, nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"team_id cannot be changed (environment %s belongs to %q)", env.ID, env.TeamID)
+	}
+
+	if effectiveEnvironmentMode(spec.Mode) != effectiveEnvironmentMode(env.Mode) {
+		return nil, nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"mode cannot be changed (environment %s is %s)", env.ID, effectiveEnvironmentMode(env.Mode))
+	}
+
+	patch := &models.UpdateEnvironmentRequest{}
+	var changes []string
+	diff := func(field string, current, desired interface{}, apply func()) {
+		if !sameSpecValue(current, desired) {
+			changes = append(changes, field)
+			apply()
+		}
+	}
+	diff("image", env.Image, spec.Image, func() { patch.Image = &spec.Image })
+	diff("resources", env.Resources, spec.Resources, func() { patch.Resources = &spec.Resources })
+	diff("timeout", env.Timeout, spec.Timeout, func() { patch.Timeout = &spec.Timeout })
+	diff("env", env.Env, spec.Env, func() { patch.Env = nonNilMap(spec.Env) })
+	diff("command", env.Command, spec.Command, func() {
+		command := append([]string{}, spec.Command...)
+		patch.Command = &command
+	})
+	diff("labels", env.Labels, spec.Labels, func() { patch.Labels = nonNilMap(spec.Labels) })
+	diff("node_selector", env.NodeSelector, spec.NodeSelector, func() { patch.NodeSelector = nonNilMap(spec.NodeSelector) })
+	diff("tolerations", env.Tolerations, spec.Tolerations, func() {
+		tolerations := append([]models.Toleration{}, spec.Tolerations...)
+		patch.Tolerations = &tolerations
+	})
+	diff("affinity", env.Affinity, spec.Affinity, func() { patch.Affinity = orEmpty(spec.Affinity) })
+	diff("isolation", env.Isolation, spec.Isolation, func() { patch.Isolation = orEmpty(spec.Isolation) })
+	diff("pool", env.Pool, spec.Pool, func() { patch.Pool = orEmpty(spec.Pool) })
+	diff("command_policy", env.CommandPolicy, spec.CommandPolicy, func() { patch.CommandPolicy = orEmpty(spec.CommandPolicy) })
+	diff("readiness_check", env.ReadinessCheck, spec.ReadinessCheck, func() { patch.ReadinessCheck = orEmpty(spec.ReadinessCheck) })
+	diff("lifecycle", env.Lifecycle, spec.Lifecycle, func() { patch.Lifecycle = orEmpty(spec.Lifecycle) })
+	diff("idle_timeout", env.IdleTimeout, spec.IdleTimeout, func() { patch.IdleTimeout = &spec.IdleTimeout })
+	diff("record_sessions", env.RecordSessions, spec.RecordSessions, func() { patch.RecordSessions = &spec.RecordSessions })
+	execMode := effectiveExecMode(spec.ExecMode)
+	diff("exec_mode", effectiveExecMode(env.ExecMode), execMode, func() { patch.ExecMode = &execMode })
+	diff("metadata", env.Metadata, spec.Metadata, func() { patch.Metadata = nonNilMap(spec.Metadata) })
+	diff("workspace_snapshots", env.WorkspaceSnapshots, spec.WorkspaceSnapshots, func() {
+		patch.WorkspaceSnapshots = orEmpty(spec.WorkspaceSnapshots)
+	})
+	return patch, changes, nil
+}
+
+// sameSpecValue compares two spec field values by their JSON form, treating nil and empty
+// maps/slices as equal so a round trip through the database does not show up as a change
+func sameSpecValue(a, b interface{}) bool {
+	if isEmptySpecValue(a) && isEmptySpecValue(b) {
+		return true
+	}
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return bytes.Equal(aj, bj)
+}
+
+// isEmptySpecValue reports whether v is an empty map or slice, or a nil or zero-valued pointer
+func isEmptySpecValue(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice:
+		return rv.Len() == 0
+	case reflect.Ptr:
+		return rv.IsNil() || rv.Elem().IsZero()
+	case reflect.Invalid:
+		return true
+	}
+	return false
+}
+
+// nonNilMap returns a pointer to m, or to an empty map when m is nil, so a patch clears the field
+func nonNilMap(m map[string]string) *map[string]string {
+	if m == nil {
+		m = map[string]string{}
+	}
+	return &m
+}
+
+// orEmpty returns v, or a zero value when v is nil, so a patch clears the field
+func orEmpty[T any](v *T) *T {
+	if v == nil {
+		return new(T)
+	}
+	return v
+}
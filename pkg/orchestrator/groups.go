@@ -0,0 +1,334 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Environment Groups ==========
+
+// MaxGroupReplicas is the largest replica count of an environment group
+const MaxGroupReplicas = 100
+
+// ReplicaAdmission is called before each group replica is created (e.g. to check a team quota);
+// an error stops creating replicas without failing the request
+type ReplicaAdmission func(ctx context.Context) error
+
+// CreateEnvironmentGroup creates a group and its replicas from the template. Replicas are
+// provisioned asynchronously like any environment (bounded by the provisioning semaphore); a
+// replica that cannot be created is reported in the group's Errors rather than failing the group.
+func (o *Orchestrator) CreateEnvironmentGroup(ctx context.Context, req *models.CreateEnvironmentGroupRequest, userID string, admit ReplicaAdmission) (*models.EnvironmentGroup, error) {
+	if req.Name == "" {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "name is required")
+	}
+	if req.Replicas < 1 || req.Replicas > MaxGroupReplicas {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "replicas must be between 1 and %d", MaxGroupReplicas)
+	}
+	cluster := req.Template.Cluster
+	if cluster != "" && !o.clusters.Has(cluster) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeUnknownCluster, "unknown cluster %q (configured: %s)", cluster, strings.Join(o.clusters.Names(), ", "))
+	}
+
+	now := o.clock.Now()
+	template := req.Template
+	template.Name = req.Name
+	group := &models.EnvironmentGroup{
+		ID:        "grp-" + uuid.New().String()[:8],
+		Name:      req.Name,
+		UserID:    userID,
+		TeamID:    template.TeamID,
+		Template:  template,
+		Replicas:  req.Replicas,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	o.groupMutex.Lock()
+	defer o.groupMutex.Unlock()
+
+	if o.db != nil {
+		if err := o.db.SaveEnvironmentGroup(ctx, group); err != nil {
+			return nil, err
+		}
+	}
+	o.groups[group.ID] = group
+
+	errs := o.scaleGroup(ctx, group, nil, admit)
+	o.logger.Info("environment group created",
+		zap.String("group_id", group.ID),
+		zap.Int("replicas", group.Replicas),
+		zap.Int("errors", len(errs)),
+	)
+	result, err := o.describeGroup(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	result.Errors = errs
+	return result, nil
+}
+
+// GetEnvironmentGroup returns a group with the aggregate status of its environments
+func (o *Orchestrator) GetEnvironmentGroup(ctx context.Context, id string) (*models.EnvironmentGroup, error) {
+	o.groupMutex.Lock()
+	group, err := o.loadGroup(ctx, id)
+	o.groupMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return o.describeGroup(ctx, group)
+}
+
+// ListEnvironmentGroups returns all groups, newest first, with the aggregate status of each
+func (o *Orchestrator) ListEnvironmentGroups(ctx context.Context) (*models.ListEnvironmentGroupsResponse, error) {
+	var groups []*models.EnvironmentGroup
+	if o.db != nil {
+		fromDB, err := o.db.ListEnvironmentGroups(ctx)
+		if err != nil {
+			return nil, err
+		}
+		groups = fromDB
+	} else {
+		o.groupMutex.Lock()
+		for _, group := range o.groups {
+			groupCopy := *group
+			groups = append(groups, &groupCopy)
+		}
+		o.groupMutex.Unlock()
+		sort.Slice(groups, func(i, j int) bool { return groups[i].CreatedAt.After(groups[j].CreatedAt) })
+	}
+
+	resp := &models.ListEnvironmentGroupsResponse{Groups: make([]models.EnvironmentGroup, 0, len(groups))}
+	for _, group := range groups {
+		described, err := o.describeGroup(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+		resp.Groups = append(resp.Groups, *described)
+	}
+	resp.Total = len(resp.Groups)
+	return resp, nil
+}
+
+// ScaleEnvironmentGroup changes the desired replica count: missing replicas are created from the
+// template and surplus ones deleted (failed first, then pending, then the newest running ones)
+func (o *Orchestrator) ScaleEnvironmentGroup(ctx context.Context, id string, replicas int, admit ReplicaAdmission) (*models.EnvironmentGroup, error) {
+	if replicas < 0 || replicas > MaxGroupReplicas {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "replicas must be between 0 and %d", MaxGroupReplicas)
+	}
+
+	o.groupMutex.Lock()
+	defer o.groupMutex.Unlock()
+
+	group, err := o.loadGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	group.Replicas = replicas
+	group.UpdatedAt = o.clock.Now()
+	if o.db != nil {
+		if err := o.db.SaveEnvironmentGroup(ctx, group); err != nil {
+			return nil, err
+		}
+	}
+	o.groups[group.ID] = group
+
+	members, err := o.groupMembers(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	errs := o.scaleGroup(ctx, group, members, admit)
+	o.logger.Info("environment group scaled",
+		zap.String("group_id", group.ID),
+		zap.Int("replicas", replicas),
+		zap.Int("errors", len(errs)),
+	)
+	result, err := o.describeGroup(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	result.Errors = errs
+	return result, nil
+}
+
+// DeleteEnvironmentGroup deletes every environment of the group and then the group. If some
+// environments cannot be deleted the group is kept (scaled to 0) so the deletion can be retried.
+func (o *Orchestrator) DeleteEnvironmentGroup(ctx context.Context, id string, force bool) error {
+	o.groupMutex.Lock()
+	defer o.groupMutex.Unlock()
+
+	group, err := o.loadGroup(ctx, id)
+	if err != nil {
+		return err
+	}
+	members, err := o.groupMembers(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var errsMutex sync.Mutex
+	o.deleteInBatches(ctx, len(members), func(i int) {
+		if err := o.DeleteEnvironment(ctx, members[i].ID, force); err != nil && !errors.Is(err, apierrors.NotFound) {
+			errsMutex.Lock()
+			errs = append(errs, fmt.Errorf("%s: %w", members[i].ID, err))
+			errsMutex.Unlock()
+		}
+	})
+	if len(errs) > 0 {
+		group.Replicas = 0
+		group.UpdatedAt = o.clock.Now()
+		if o.db != nil {
+			if err := o.db.SaveEnvironmentGroup(ctx, group); err != nil {
+				o.logger.Warn("failed to scale down environment group", zap.String("group_id", group.ID), zap.Error(err))
+			}
+		}
+		o.groups[group.ID] = group
+		return fmt.Errorf("failed to delete %d environments of group %s: %w", len(errs), group.ID, errors.Join(errs...))
+	}
+
+	if o.db != nil {
+		if err := o.db.DeleteEnvironmentGroup(ctx, group.ID); err != nil {
+			return err
+		}
+	}
+	delete(o.groups, group.ID)
+	o.logger.Info("environment group deleted", zap.String("group_id", group.ID), zap.Int("environments", len(members)))
+	return nil
+}
+
+// loadGroup returns a copy of the group from the database (or memory without one). Callers
+// hold groupMutex.
+func (o *Orchestrator) loadGroup(ctx context.Context, id string) (*models.EnvironmentGroup, error) {
+	if o.db != nil {
+		return o.db.GetEnvironmentGroup(ctx, id)
+	}
+	group, ok := o.groups[id]
+	if !ok {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeGroupNotFound, "environment group not found: %s", id)
+	}
+	groupCopy := *group
+	return &groupCopy, nil
+}
+
+// groupMembers returns the group's environments that have not been terminated, oldest first
+func (o *Orchestrator) groupMembers(ctx context.Context, groupID string) ([]models.Environment, error) {
+	list, err := o.ListEnvironmentsWithOptions(ctx, ListEnvironmentsOptions{GroupID: groupID, Limit: 1000})
+	if err != nil {
+		return nil, err
+	}
+	members := make([]models.Environment, 0, len(list.Environments))
+	for _, env := range list.Environments {
+		if env.Status != models.StatusTerminating && env.Status != models.StatusTerminated {
+			members = append(members, env)
+		}
+	}
+	// The listing is newest first
+	for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+		members[i], members[j] = members[j], members[i]
+	}
+	return members, nil
+}
+
+// scaleGroup creates or deletes environments until the group has group.Replicas of them and
+// returns the problems encountered. Callers hold groupMutex.
+func (o *Orchestrator) scaleGroup(ctx context.Context, group *models.EnvironmentGroup, members []models.Environment, admit ReplicaAdmission) []string {
+	var errs []string
+
+	if surplus := len(members) - group.Replicas; surplus > 0 {
+		// Delete the least useful replicas first: failed, then pending, then the newest
+		rank := func(status models.EnvironmentStatus) int {
+			switch status {
+			case models.StatusRunning:
+				return 2
+			case models.StatusPending:
+				return 1
+			}
+			return 0
+		}
+		victims := append([]models.Environment(nil), members...)
+		sort.SliceStable(victims, func(i, j int) bool {
+			if ri, rj := rank(victims[i].Status), rank(victims[j].Status); ri != rj {
+				return ri < rj
+			}
+			return victims[i].CreatedAt.After(victims[j].CreatedAt)
+		})
+		var errsMutex sync.Mutex
+		o.deleteInBatches(ctx, surplus, func(i int) {
+			if err := o.DeleteEnvironment(ctx, victims[i].ID, false); err != nil {
+				errsMutex.Lock()
+				errs = append(errs, fmt.Sprintf("failed to delete %s: %v", victims[i].ID, err))
+				errsMutex.Unlock()
+			}
+		})
+		return errs
+	}
+
+	used := make(map[string]bool, len(members))
+	for _, env := range members {
+		used[env.Name] = true
+	}
+	ordinal := 0
+	for missing := group.Replicas - len(members); missing > 0; missing-- {
+		var name string
+		for {
+			ordinal++
+			if name = group.Name + "-" + strconv.Itoa(ordinal); !used[name] {
+				break
+			}
+		}
+		if admit != nil {
+			if err := admit(ctx); err != nil {
+				// Replicas are identical: the others would be refused too
+				errs = append(errs, fmt.Sprintf("%s: %v (%d replicas not created)", name, err, missing))
+				break
+			}
+		}
+		req := group.Template
+		req.Name = name
+		if _, err := o.createEnvironment(ctx, &req, group.UserID, group.ID); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v (%d replicas not created)", name, err, missing))
+			break
+		}
+		used[name] = true
+	}
+	return errs
+}
+
+// describeGroup fills in the aggregate status of the group's environments
+func (o *Orchestrator) describeGroup(ctx context.Context, group *models.EnvironmentGroup) (*models.EnvironmentGroup, error) {
+	members, err := o.groupMembers(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	result := *group
+	result.StatusCounts = make(map[models.EnvironmentStatus]int)
+	result.EnvironmentIDs = make([]string, 0, len(members))
+	for _, env := range members {
+		result.StatusCounts[env.Status]++
+		result.EnvironmentIDs = append(result.EnvironmentIDs, env.ID)
+	}
+	result.ReadyReplicas = result.StatusCounts[models.StatusRunning]
+
+	switch {
+	case result.ReadyReplicas >= result.Replicas:
+		result.Status = models.GroupReady
+	case result.StatusCounts[models.StatusPending] > 0:
+		result.Status = models.GroupProvisioning
+	case result.ReadyReplicas > 0:
+		result.Status = models.GroupPartial
+	default:
+		result.Status = models.GroupFailed
+	}
+	return &result, nil
+}
@@ -0,0 +1,184 @@
+package orchestrator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Guardrails (namespace churn limits) ==========
+
+const (
+	// creationWindow is the sliding window of guardrails.max_environments_per_hour
+	creationWindow = time.Hour
+	// defaultNamespaceDeleteBatchSize applies when guardrails.namespace_delete_batch_size is unset
+	defaultNamespaceDeleteBatchSize = 10
+)
+
+// NodeKey identifies a node of a configured cluster
+type NodeKey struct {
+	Cluster string
+	Node    string
+}
+
+// NodePodCount is how many managed pods were scheduled on a node
+type NodePodCount struct {
+	NodeKey
+	Pods int64
+}
+
+// admitEnvironment stores a new environment in memory unless a guardrail refuses it: the
+// managed namespace limit (one namespace per environment) or the creation rate limit. Both
+// fail with RateLimited (429). Environments of a reservation skip the rate limit and are not
+// counted in it.
+func (o *Orchestrator) admitEnvironment(env *models.Environment) error {
+	limits := o.cfg().Guardrails
+	now := o.clock.Now()
+	reserved := env.ReservationID != ""
+
+	o.guardrailMutex.Lock()
+	defer o.guardrailMutex.Unlock()
+	o.creationTimes = pruneCreationTimes(o.creationTimes, now)
+	if !reserved && limits.MaxEnvironmentsPerHour > 0 && len(o.creationTimes) >= limits.MaxEnvironmentsPerHour {
+		retryIn := o.creationTimes[0].Add(creationWindow).Sub(now).Round(time.Second)
+		return apierrors.New(apierrors.RateLimited, apierrors.CodeCreationRateLimited,
+			"environment creation limit of %d per hour reached; retry in %s", limits.MaxEnvironmentsPerHour, retryIn)
+	}
+
+	o.envMutex.Lock()
+	defer o.envMutex.Unlock()
+	if limits.MaxNamespaces > 0 && len(o.environments) >= limits.MaxNamespaces {
+		return apierrors.New(apierrors.RateLimited, apierrors.CodeNamespaceLimitReached,
+			"managed namespace limit of %d reached; delete environments to create new ones", limits.MaxNamespaces)
+	}
+	o.environments[env.ID] = env
+	if !reserved {
+		o.creationTimes = append(o.creationTimes, now)
+	}
+	return nil
+}
+
+// pruneCreationTimes drops the creations that left the sliding window
+func pruneCreationTimes(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-creationWindow)
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// GuardrailStatus reports the guardrail limits and how close this replica is to them
+func (o *Orchestrator) GuardrailStatus() models.GuardrailStatus {
+	limits := o.cfg().Guardrails
+	now := o.clock.Now()
+
+	o.guardrailMutex.Lock()
+	o.creationTimes = pruneCreationTimes(o.creationTimes, now)
+	created := len(o.creationTimes)
+	o.guardrailMutex.Unlock()
+	o.envMutex.RLock()
+	namespaces := len(o.environments)
+	o.envMutex.RUnlock()
+
+	return models.GuardrailStatus{
+		ManagedNamespaces:           namespaces,
+		MaxNamespaces:               limits.MaxNamespaces,
+		EnvironmentsCreatedLastHour: created,
+		MaxEnvironmentsPerHour:      limits.MaxEnvironmentsPerHour,
+		LimitReached: (limits.MaxNamespaces > 0 && namespaces >= limits.MaxNamespaces) ||
+			(limits.MaxEnvironmentsPerHour > 0 && created >= limits.MaxEnvironmentsPerHour),
+	}
+}
+
+// NamespacesCreatedTotal returns the number of environment namespaces created since startup
+func (o *Orchestrator) NamespacesCreatedTotal() int64 {
+	return o.namespacesCreated.Load()
+}
+
+// NamespacesDeletedTotal returns the number of environment and orphaned namespaces deleted
+// since startup
+func (o *Orchestrator) NamespacesDeletedTotal() int64 {
+	return o.namespacesDeleted.Load()
+}
+
+// countScheduledPod records a managed pod scheduled on a node, as seen by the pod watch
+func (o *Orchestrator) countScheduledPod(cluster, node string) {
+	o.scheduledPodsMutex.Lock()
+	defer o.scheduledPodsMutex.Unlock()
+	if o.scheduledPods == nil {
+		o.scheduledPods = make(map[NodeKey]int64)
+	}
+	o.scheduledPods[NodeKey{Cluster: cluster, Node: node}]++
+}
+
+// TakeScheduledPods returns the managed pods scheduled per node since the previous call, sorted
+// by cluster and node, and resets the counts. Only pods seen by a pod watch
+// (reconciliation.pod_watch) are counted.
+func (o *Orchestrator) TakeScheduledPods() []NodePodCount {
+	o.scheduledPodsMutex.Lock()
+	counts := o.scheduledPods
+	o.scheduledPods = nil
+	o.scheduledPodsMutex.Unlock()
+
+	result := make([]NodePodCount, 0, len(counts))
+	for key, pods := range counts {
+		result = append(result, NodePodCount{NodeKey: key, Pods: pods})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Cluster != result[j].Cluster {
+			return result[i].Cluster < result[j].Cluster
+		}
+		return result[i].Node < result[j].Node
+	})
+	return result
+}
+
+// namespaceDeleteBatchSize returns how many namespaces bulk operations delete at once
+func (o *Orchestrator) namespaceDeleteBatchSize() int {
+	if n := o.cfg().Guardrails.NamespaceDeleteBatchSize; n > 0 {
+		return n
+	}
+	return defaultNamespaceDeleteBatchSize
+}
+
+// pauseBetweenDeleteBatches waits guardrails.namespace_delete_batch_interval_ms, or until ctx
+// is done
+func (o *Orchestrator) pauseBetweenDeleteBatches(ctx context.Context) {
+	interval := time.Duration(o.cfg().Guardrails.NamespaceDeleteBatchIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		return
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// deleteInBatches calls del for items 0..n-1 in batches of guardrails.namespace_delete_batch_size:
+// the items of a batch run concurrently and the next batch starts a pause after the previous
+// one finished, so deleting many environments does not flood the API server
+func (o *Orchestrator) deleteInBatches(ctx context.Context, n int, del func(i int)) {
+	batchSize := o.namespaceDeleteBatchSize()
+	for start := 0; start < n; start += batchSize {
+		if start > 0 {
+			o.pauseBetweenDeleteBatches(ctx)
+		}
+		end := min(start+batchSize, n)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				del(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+}
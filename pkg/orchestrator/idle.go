@@ -0,0 +1,249 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Idle Reaper ==========
+
+// KeepLabel exempts an environment from the idle reaper when set to "true"
+const KeepLabel = "keep"
+
+// Idle notifications sent to the configured webhook
+const (
+	IdleWarningEvent    = "environment.idle_warning"
+	IdleTerminatedEvent = "environment.idle_terminated"
+)
+
+// IdleNotice is the JSON body POSTed to the idle webhook
+type IdleNotice struct {
+	Event          string    `json:"event"`
+	EnvironmentID  string    `json:"environment_id"`
+	Name           string    `json:"name"`
+	UserID         string    `json:"user_id,omitempty"`
+	TeamID         string    `json:"team_id,omitempty"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	IdleSeconds    int64     `json:"idle_seconds"`
+	// TerminateAt is when the environment will be (or was) terminated
+	TerminateAt time.Time `json:"terminate_at"`
+}
+
+// RecordActivity marks the environment as used now, postponing its idle termination
+func (o *Orchestrator) RecordActivity(ctx context.Context, envID string) {
+	now := o.clock.Now()
+	o.envMutex.Lock()
+	if env, ok := o.environments[envID]; ok {
+		env.LastActivityAt = &now
+	}
+	o.envMutex.Unlock()
+
+	if o.db != nil {
+		if err := o.db.UpdateEnvironmentActivity(ctx, envID, now); err != nil {
+			o.logger.Warn("failed to record environment activity", zap.String("environment_id", envID), zap.Error(err))
+		}
+	}
+}
+
+// TrackSession records activity for a long-lived session (e.g. a WebSocket attachment) and keeps
+// the environment from being reaped until the returned function is called
+func (o *Orchestrator) TrackSession(ctx context.Context, envID string) (done func()) {
+	o.RecordActivity(ctx, envID)
+	o.idleMutex.Lock()
+	o.activeSessions[envID]++
+	o.idleMutex.Unlock()
+
+	return func() {
+		o.idleMutex.Lock()
+		if o.activeSessions[envID]--; o.activeSessions[envID] <= 0 {
+			delete(o.activeSessions, envID)
+		}
+		o.idleMutex.Unlock()
+		o.RecordActivity(context.Background(), envID)
+	}
+}
+
+// lastActivity returns when env was last used, falling back to its start or creation time for
+// environments created before activity was tracked
+func lastActivity(env *models.Environment) time.Time {
+	switch {
+	case env.LastActivityAt != nil:
+		return *env.LastActivityAt
+	case env.StartedAt != nil:
+		return *env.StartedAt
+	}
+	return env.CreatedAt
+}
+
+// idleTimeout returns env's idle timeout: its own, else the server default (0 = never reaped)
+func (o *Orchestrator) idleTimeout(env *models.Environment) time.Duration {
+	if env.Labels[KeepLabel] == "true" {
+		return 0
+	}
+	seconds := env.IdleTimeout
+	if seconds <= 0 {
+		seconds = o.cfg().Idle.TimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// runIdleReaperLoop periodically terminates idle environments. The loop always runs so a
+// timeout enabled by a configuration reload takes effect; a pass is a no-op while no
+// environment has an idle timeout.
+func (o *Orchestrator) runIdleReaperLoop() {
+	interval := o.idleInterval()
+	ticker := o.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	if timeout := o.cfg().Idle.TimeoutSeconds; timeout > 0 {
+		o.logger.Info("idle reaper started",
+			zap.Duration("interval", interval),
+			zap.Int("timeout_seconds", timeout),
+		)
+	}
+
+	for {
+		select {
+		case <-o.idleStopChan:
+			o.logger.Info("idle reaper stopped")
+			return
+		case <-ticker.C():
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			o.ReapIdleEnvironments(ctx, o.clock.Now())
+			cancel()
+
+			// Pick up interval changes from a configuration reload
+			if next := o.idleInterval(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		}
+	}
+}
+
+// idleInterval returns the configured idle reaper interval (at least 10 seconds)
+func (o *Orchestrator) idleInterval() time.Duration {
+	interval := time.Duration(o.cfg().Idle.IntervalSeconds) * time.Second
+	if interval < 10*time.Second {
+		interval = 10 * time.Second
+	}
+	return interval
+}
+
+// ReapIdleEnvironments runs one idle reaper pass as of now: running environments idle past their
+// timeout are terminated, and those within the warning period get an idle_warning event and
+// webhook (once per idle period). Returns the IDs of the terminated environments.
+func (o *Orchestrator) ReapIdleEnvironments(ctx context.Context, now time.Time) []string {
+	warning := time.Duration(o.cfg().Idle.WarningSeconds) * time.Second
+
+	o.envMutex.RLock()
+	var candidates []models.Environment
+	for _, env := range o.environments {
+		if env.Status == models.StatusRunning && o.idleTimeout(env) > 0 {
+			candidates = append(candidates, *env)
+		}
+	}
+	o.envMutex.RUnlock()
+
+	o.idleMutex.Lock()
+	active := make(map[string]bool, len(o.activeSessions))
+	for id := range o.activeSessions {
+		active[id] = true
+	}
+	// Forget warnings for environments that are gone or no longer idle
+	warned := make(map[string]time.Time, len(o.idleWarnings))
+	for _, env := range candidates {
+		if at, ok := o.idleWarnings[env.ID]; ok {
+			warned[env.ID] = at
+		}
+	}
+	o.idleWarnings = warned
+	o.idleMutex.Unlock()
+
+	var terminated []string
+	for i := range candidates {
+		env := &candidates[i]
+		if active[env.ID] {
+			continue
+		}
+		last := lastActivity(env)
+		deadline := last.Add(o.idleTimeout(env))
+
+		if !now.Before(deadline) {
+			// Another replica may have seen activity this one has not: confirm from the database
+			if o.db != nil {
+				current, err := o.db.GetEnvironment(ctx, env.ID)
+				if err != nil {
+					continue
+				}
+				if last = lastActivity(current); now.Before(last.Add(o.idleTimeout(current))) {
+					continue
+				}
+			}
+			if err := o.DeleteEnvironment(ctx, env.ID, false); err != nil {
+				o.logger.Warn("idle reaper: failed to terminate environment", zap.String("environment_id", env.ID), zap.Error(err))
+				continue
+			}
+			o.logger.Info("idle reaper: terminated idle environment",
+				zap.String("environment_id", env.ID),
+				zap.Time("last_activity_at", last),
+			)
+			o.notifyIdle(IdleTerminatedEvent, env, last, now, now)
+			terminated = append(terminated, env.ID)
+			continue
+		}
+
+		if warning <= 0 || now.Before(deadline.Add(-warning)) {
+			continue
+		}
+		o.idleMutex.Lock()
+		alreadyWarned := o.idleWarnings[env.ID].Equal(last)
+		if !alreadyWarned {
+			o.idleWarnings[env.ID] = last
+		}
+		o.idleMutex.Unlock()
+		if alreadyWarned {
+			continue
+		}
+		o.logReconciliationEvent(env.ID, "idle_warning",
+			fmt.Sprintf("Environment has been idle since %s and will be terminated at %s unless it is used",
+				last.UTC().Format(time.RFC3339), deadline.UTC().Format(time.RFC3339)),
+			fmt.Sprintf("idle for %s; label %s=true to exempt it", now.Sub(last).Round(time.Second), KeepLabel))
+		o.notifyIdle(IdleWarningEvent, env, last, deadline, now)
+	}
+
+	return terminated
+}
+
+// notifyIdle POSTs an idle notice to the configured webhook in the background
+func (o *Orchestrator) notifyIdle(event string, env *models.Environment, last, terminateAt, now time.Time) {
+	url := o.cfg().Idle.WebhookURL
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(IdleNotice{
+		Event:          event,
+		EnvironmentID:  env.ID,
+		Name:           env.Name,
+		UserID:         env.UserID,
+		TeamID:         env.TeamID,
+		LastActivityAt: last,
+		IdleSeconds:    int64(now.Sub(last).Seconds()),
+		TerminateAt:    terminateAt,
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		o.postWebhook(ctx, "idle webhook", url, body, zap.String("event", event), zap.String("environment_id", env.ID))
+	}()
+}
@@ -0,0 +1,96 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Container Lifecycle ==========
+
+// defaultTerminationGracePeriod is Kubernetes' grace period for pods that do not set one
+const defaultTerminationGracePeriod = 30 * time.Second
+
+// podDeletionPollInterval is how often a main pod that is stopping is checked for being gone
+const podDeletionPollInterval = time.Second
+
+// checkLifecycle fails with ValidationFailed when lifecycle asks for a longer grace period than
+// timeouts.max_termination_grace_period allows
+func (o *Orchestrator) checkLifecycle(lifecycle *models.LifecycleConfig) error {
+	if lifecycle == nil || lifecycle.TerminationGracePeriodSeconds == nil {
+		return nil
+	}
+	if limit := o.cfg().Timeouts.MaxTerminationGracePeriod; *lifecycle.TerminationGracePeriodSeconds > limit {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"lifecycle.termination_grace_period_seconds must be at most %d", limit)
+	}
+	return nil
+}
+
+// applyLifecycle sets the pre-stop command and grace period of a main pod
+func applyLifecycle(spec *k8s.PodSpec, lifecycle *models.LifecycleConfig) {
+	if lifecycle == nil {
+		return
+	}
+	spec.PreStop = lifecycle.PreStop
+	if lifecycle.TerminationGracePeriodSeconds != nil {
+		grace := int64(*lifecycle.TerminationGracePeriodSeconds)
+		spec.TerminationGracePeriodSeconds = &grace
+	}
+}
+
+// deleteMainPod deletes an environment's main pod, giving its container the lifecycle's grace
+// period to run its pre-stop command and stop. force kills it at once (grace period 0).
+func deleteMainPod(ctx context.Context, client k8s.ClientInterface, namespace string, lifecycle *models.LifecycleConfig, force bool) error {
+	if force || lifecycle == nil || lifecycle.TerminationGracePeriodSeconds == nil {
+		return client.DeletePod(ctx, namespace, mainPodName, force)
+	}
+	return client.DeletePodWithGracePeriod(ctx, namespace, mainPodName, int64(*lifecycle.TerminationGracePeriodSeconds))
+}
+
+// replaceMainPod deletes an environment's main pod so reconciliation can create it again. Without
+// lifecycle settings it is killed at once; with them it gets its grace period, and replaceMainPod
+// waits for it to be gone (up to the grace period and half a minute) since the new pod takes its
+// name.
+func (o *Orchestrator) replaceMainPod(ctx context.Context, client k8s.ClientInterface, namespace string, lifecycle *models.LifecycleConfig) error {
+	if lifecycle.IsEmpty() {
+		return client.DeletePod(ctx, namespace, mainPodName, true)
+	}
+	if err := deleteMainPod(ctx, client, namespace, lifecycle, false); err != nil {
+		return err
+	}
+
+	grace := defaultTerminationGracePeriod
+	if lifecycle.TerminationGracePeriodSeconds != nil {
+		grace = time.Duration(*lifecycle.TerminationGracePeriodSeconds) * time.Second
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, grace+30*time.Second)
+	defer cancel()
+	for {
+		pods, err := client.ListPods(waitCtx, namespace, "")
+		if err == nil && !hasPod(pods.Items, mainPodName) {
+			return nil
+		}
+		select {
+		case <-waitCtx.Done():
+			return fmt.Errorf("main pod still stopping after %s", grace+30*time.Second)
+		case <-time.After(podDeletionPollInterval):
+		}
+	}
+}
+
+// hasPod reports whether pods holds a pod with the given name
+func hasPod(pods []corev1.Pod, name string) bool {
+	for _, pod := range pods {
+		if pod.Name == name {
+			return true
+		}
+	}
+	return false
+}
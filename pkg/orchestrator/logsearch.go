@@ -0,0 +1,298 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Log Search ==========
+
+// Log streams that can be filtered on. Kubernetes merges a container's stdout and stderr into
+// one log, which is reported as stdout.
+const (
+	LogStreamStdout         = "stdout"
+	LogStreamStderr         = "stderr"
+	LogStreamReconciliation = "reconciliation"
+)
+
+const (
+	// MaxLogSearchPatternLength caps the length of a grep pattern
+	MaxLogSearchPatternLength = 1024
+	// MaxLogSearchContextLines caps the before/after context line counts
+	MaxLogSearchContextLines = 100
+	// DefaultLogSearchTimeout bounds how long a search scans the pod log
+	DefaultLogSearchTimeout = 30 * time.Second
+	// maxLogSearchEntries caps the entries (matches and context) a search returns
+	maxLogSearchEntries = 10000
+	// maxLogLineBytes is the longest pod log line scanned; longer lines end the search
+	maxLogLineBytes = 1 << 20
+)
+
+// LogFilter selects log lines. Zero fields do not filter. Call Compile before use.
+type LogFilter struct {
+	// Grep keeps lines containing the substring, or matching the regular expression when Regex is set
+	Grep  string
+	Regex bool
+	// Since and Until keep lines logged within [Since, Until]
+	Since time.Time
+	Until time.Time
+	// Streams keeps lines of the listed streams (stdout, stderr, reconciliation)
+	Streams []string
+	// Before and After add this many lines of context around every match
+	Before int
+	After  int
+	// Timeout bounds the search (default: DefaultLogSearchTimeout); a search that runs out of
+	// time returns what it found so far, marked as truncated
+	Timeout time.Duration
+
+	re *regexp.Regexp
+}
+
+// Compile validates the filter and prepares its pattern. Regular expressions use Go's RE2
+// engine, which runs in time linear in the input, so a pattern cannot stall the search.
+func (f *LogFilter) Compile() error {
+	if len(f.Grep) > MaxLogSearchPatternLength {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "grep pattern must be at most %d characters", MaxLogSearchPatternLength)
+	}
+	if f.Regex && f.Grep != "" {
+		re, err := regexp.Compile(f.Grep)
+		if err != nil {
+			return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "invalid grep regular expression: %v", err)
+		}
+		f.re = re
+	}
+	for _, s := range f.Streams {
+		if s != LogStreamStdout && s != LogStreamStderr && s != LogStreamReconciliation {
+			return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "unknown log stream %q (expected stdout, stderr or reconciliation)", s)
+		}
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && f.Until.Before(f.Since) {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "until must not be before since")
+	}
+	if f.Before < 0 || f.Before > MaxLogSearchContextLines || f.After < 0 || f.After > MaxLogSearchContextLines {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "before and after must be between 0 and %d", MaxLogSearchContextLines)
+	}
+	return nil
+}
+
+// IsZero reports whether the filter keeps every line
+func (f *LogFilter) IsZero() bool {
+	return f.Grep == "" && f.Since.IsZero() && f.Until.IsZero() && len(f.Streams) == 0
+}
+
+// inScope reports whether an entry passes the stream and time filters; only such entries can
+// match or be shown as context
+func (f *LogFilter) inScope(e *models.LogEntry) bool {
+	if len(f.Streams) > 0 {
+		found := false
+		for _, s := range f.Streams {
+			if s == e.Stream {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && e.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Timestamp.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// matches reports whether a message passes the grep filter
+func (f *LogFilter) matches(message string) bool {
+	switch {
+	case f.Grep == "":
+		return true
+	case f.re != nil:
+		return f.re.MatchString(message)
+	default:
+		return strings.Contains(message, f.Grep)
+	}
+}
+
+// LogMatcher applies a filter to a sequence of log entries, emitting matches together with
+// their context lines. Each entry is emitted at most once.
+type LogMatcher struct {
+	filter     *LogFilter
+	before     []models.LogEntry
+	afterCount int
+}
+
+// NewLogMatcher returns a matcher for a compiled filter
+func NewLogMatcher(filter *LogFilter) *LogMatcher {
+	return &LogMatcher{filter: filter}
+}
+
+// Push offers the next entry, calling emit for the entries to output (preceding context lines,
+// the entry itself when it matches, or the entry as trailing context)
+func (m *LogMatcher) Push(e models.LogEntry, emit func(models.LogEntry)) {
+	if !m.filter.inScope(&e) {
+		return
+	}
+	if m.filter.matches(e.Message) {
+		for _, c := range m.before {
+			emit(c)
+		}
+		m.before = m.before[:0]
+		emit(e)
+		m.afterCount = m.filter.After
+		return
+	}
+
+	e.Context = true
+	if m.afterCount > 0 {
+		m.afterCount--
+		emit(e)
+		return
+	}
+	if m.filter.Before > 0 {
+		if len(m.before) == m.filter.Before {
+			m.before = append(m.before[:0], m.before[1:]...)
+		}
+		m.before = append(m.before, e)
+	}
+}
+
+// SearchLogs returns the environment's log entries (pod log and reconciliation events) that pass
+// the filter, with context lines. The pod log is scanned as a stream, so memory use is bounded by
+// the number of entries returned; searches stop early, marked truncated, when they reach
+// maxLogSearchEntries entries or the filter's timeout.
+func (o *Orchestrator) SearchLogs(ctx context.Context, envID string, tailLines *int64, filter *LogFilter) (*models.LogsResponse, error) {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+	o.RecordActivity(ctx, envID)
+
+	timeout := filter.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLogSearchTimeout
+	}
+	searchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp := &models.LogsResponse{Logs: []models.LogEntry{}}
+	emit := func(e models.LogEntry) {
+		if len(resp.Logs) >= maxLogSearchEntries {
+			resp.Truncated = true
+			return
+		}
+		resp.Logs = append(resp.Logs, e)
+	}
+
+	if o.db != nil {
+		var from, to *time.Time
+		if !filter.Since.IsZero() {
+			from = &filter.Since
+		}
+		if !filter.Until.IsZero() {
+			to = &filter.Until
+		}
+		events, err := o.db.ListEnvironmentEventsBetween(ctx, envID, from, to, maxLogEvents)
+		if err == nil {
+			matcher := NewLogMatcher(filter)
+			// Events are listed oldest first
+			for _, e := range events {
+				matcher.Push(eventLogEntry(e), emit)
+			}
+		}
+	}
+
+	if wantsPodLog(filter) && env.Status != models.StatusDegraded {
+		if client, err := o.clientFor(env); err == nil {
+			if err := o.scanPodLog(searchCtx, client, env, tailLines, filter, emit); err != nil {
+				if searchCtx.Err() == nil {
+					return nil, err
+				}
+				resp.Truncated = true
+			}
+		}
+	}
+	if searchCtx.Err() != nil {
+		resp.Truncated = true
+	}
+
+	sort.SliceStable(resp.Logs, func(i, j int) bool {
+		return resp.Logs[i].Timestamp.Before(resp.Logs[j].Timestamp)
+	})
+	return resp, nil
+}
+
+// scanPodLog streams the main pod's log through the filter. It stops at the first line logged
+// after filter.Until, when the search is truncated or when ctx is done.
+func (o *Orchestrator) scanPodLog(ctx context.Context, client k8s.ClientInterface, env *models.Environment, tailLines *int64,
+	filter *LogFilter, emit func(models.LogEntry)) error {
+	stream, err := client.StreamPodLogs(ctx, env.Namespace, "main", tailLines, false, true)
+	if err != nil {
+		// A pod that does not exist (yet) has no log to search
+		return nil
+	}
+	defer stream.Close()
+
+	matcher := NewLogMatcher(filter)
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineBytes)
+	last := o.clock.Now()
+	for lines := 0; scanner.Scan(); lines++ {
+		if lines%256 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		ts, message, ok := k8s.ParseLogLine(line)
+		if ok {
+			last = ts
+			if !filter.Until.IsZero() && ts.After(filter.Until) {
+				return nil
+			}
+		}
+		matcher.Push(models.LogEntry{Timestamp: last, Stream: LogStreamStdout, Message: message}, emit)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read pod log: %w", err)
+	}
+	return nil
+}
+
+// wantsPodLog reports whether the filter can match pod log lines
+func wantsPodLog(filter *LogFilter) bool {
+	if len(filter.Streams) == 0 {
+		return true
+	}
+	for _, s := range filter.Streams {
+		if s == LogStreamStdout {
+			return true
+		}
+	}
+	return false
+}
+
+// eventLogEntry presents an environment event as a reconciliation log entry
+func eventLogEntry(e *models.EnvironmentEvent) models.LogEntry {
+	msg := e.Message
+	if e.Details != "" {
+		msg = msg + " — " + e.Details
+	}
+	return models.LogEntry{
+		Timestamp: e.CreatedAt,
+		Stream:    LogStreamReconciliation,
+		Message:   "[" + e.EventType + "] " + msg,
+	}
+}
@@ -0,0 +1,449 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Log Shipping ==========
+
+const (
+	// logShipReconnectDelay is how long a follower waits before following the main pod's log
+	// again after its stream ended; it doubles while the log cannot be read, up to
+	// logShipMaxReconnectDelay
+	logShipReconnectDelay    = time.Second
+	logShipMaxReconnectDelay = 30 * time.Second
+	// maxShippedLineBytes truncates longer log lines
+	maxShippedLineBytes = 64 * 1024
+)
+
+// LogLine is one line of a shipped log, without its line break
+type LogLine struct {
+	Time time.Time
+	Line string
+}
+
+// LogBatch is a batch of lines of an environment's main pod log
+type LogBatch struct {
+	EnvironmentID string
+	Namespace     string
+	Pod           string
+	// Stream identifies the follower that read the lines (a new one after every server start);
+	// Seq numbers its batches from 1
+	Stream string
+	Seq    int
+	Lines  []LogLine
+	// Bytes is the size of the lines
+	Bytes int
+}
+
+// LogSink receives the log batches of an environment
+type LogSink interface {
+	Push(ctx context.Context, batch *LogBatch) error
+}
+
+// LogSinkFactory creates the sink of an environment from its sink type and credentials; timeout
+// bounds one push
+type LogSinkFactory func(sink string, creds config.LogShippingCredentials, timeout time.Duration) (LogSink, error)
+
+// SetLogSinkFactory enables log shipping (implemented by logship.NewSink) and starts following
+// the log of running environments that ship it; without a factory environments cannot ship
+// their log
+func (o *Orchestrator) SetLogSinkFactory(factory LogSinkFactory) {
+	if factory == nil {
+		o.logSinkFactory.Store(nil)
+		return
+	}
+	o.logSinkFactory.Store(&factory)
+
+	o.envMutex.RLock()
+	var running []string
+	for id, env := range o.environments {
+		if env.Status == models.StatusRunning {
+			running = append(running, id)
+		}
+	}
+	o.envMutex.RUnlock()
+	for _, id := range running {
+		o.startLogShipping(id)
+	}
+}
+
+// logShipper follows the main pod log of one environment
+type logShipper struct {
+	envID       string
+	sink        string
+	credentials string
+	cancel      context.CancelFunc
+	done        chan struct{}
+
+	active         atomic.Bool
+	shippedBytes   atomic.Int64
+	shippedLines   atomic.Int64
+	shippedBatches atomic.Int64
+	droppedLines   atomic.Int64
+
+	mu            sync.Mutex
+	lastShippedAt *time.Time
+	lastError     string
+	lastErrorAt   *time.Time
+}
+
+// recordError remembers the latest shipping error, which happened at now
+func (s *logShipper) recordError(err error, now time.Time) {
+	s.mu.Lock()
+	s.lastError = err.Error()
+	s.lastErrorAt = &now
+	s.mu.Unlock()
+}
+
+// logShippingTarget returns the sink and credentials an environment's log is shipped with; ok is
+// false when it is not shipped
+func (o *Orchestrator) logShippingTarget(spec *models.LogShippingSpec) (sink, credentials string, ok bool) {
+	if spec == nil {
+		cfg := o.cfg().LogShipping
+		return cfg.DefaultSink, cfg.DefaultCredentials, cfg.Enabled
+	}
+	if spec.Disabled {
+		return "", "", false
+	}
+	return spec.Sink, spec.Credentials, true
+}
+
+// checkLogShipping rejects a log shipping section this server cannot ship with
+func (o *Orchestrator) checkLogShipping(spec *models.LogShippingSpec) error {
+	if spec == nil || spec.Disabled {
+		return nil
+	}
+	if o.logSinkFactory.Load() == nil {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeLogShippingNotConfigured, "log shipping is not available on this server")
+	}
+	creds, ok := o.cfg().LogShipping.Credentials[spec.Credentials]
+	if !ok {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeLogShippingNotConfigured, "log shipping credentials %q are not configured", spec.Credentials)
+	}
+	if err := creds.CheckSink(spec.Sink); err != nil {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeLogShippingNotConfigured, "log shipping credentials %q: %v", spec.Credentials, err)
+	}
+	return nil
+}
+
+// startLogShipping starts following the main pod log of an environment that ships it, unless
+// it is already followed
+func (o *Orchestrator) startLogShipping(envID string) {
+	factory := o.logSinkFactory.Load()
+	if factory == nil {
+		return
+	}
+	o.envMutex.RLock()
+	env, exists := o.environments[envID]
+	var spec *models.LogShippingSpec
+	if exists && env.LogShipping != nil {
+		shipping := *env.LogShipping
+		spec = &shipping
+	}
+	o.envMutex.RUnlock()
+	if !exists {
+		return
+	}
+	sinkName, credsName, ok := o.logShippingTarget(spec)
+	if !ok {
+		return
+	}
+
+	o.logShipperMutex.Lock()
+	defer o.logShipperMutex.Unlock()
+	if _, running := o.logShippers[envID]; running {
+		return
+	}
+	log := o.logger.With(zap.String("environment_id", envID), zap.String("sink", sinkName))
+	cfg := o.cfg().LogShipping
+	creds, ok := cfg.Credentials[credsName]
+	if !ok {
+		log.Warn("log shipping credentials not configured; log not shipped", zap.String("credentials", credsName))
+		return
+	}
+	sink, err := (*factory)(sinkName, creds, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	if err != nil {
+		log.Warn("failed to create log sink; log not shipped", zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &logShipper{
+		envID:       envID,
+		sink:        sinkName,
+		credentials: credsName,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	o.logShippers[envID] = s
+	go o.runLogShipper(ctx, s, sink)
+	log.Info("log shipping started")
+}
+
+// stopLogShipping stops following an environment's log and waits for its follower to end
+func (o *Orchestrator) stopLogShipping(envID string) {
+	o.logShipperMutex.Lock()
+	s := o.logShippers[envID]
+	delete(o.logShippers, envID)
+	o.logShipperMutex.Unlock()
+	if s != nil {
+		s.cancel()
+		<-s.done
+	}
+}
+
+// stopAllLogShipping stops every follower (on shutdown)
+func (o *Orchestrator) stopAllLogShipping() {
+	o.logShipperMutex.Lock()
+	shippers := o.logShippers
+	o.logShippers = make(map[string]*logShipper)
+	o.logShipperMutex.Unlock()
+	for _, s := range shippers {
+		s.cancel()
+		<-s.done
+	}
+}
+
+// logShippingStats reports an environment's log shipping (nil when its log is not shipped here)
+func (o *Orchestrator) logShippingStats(envID string) *models.LogShippingStats {
+	o.logShipperMutex.Lock()
+	s := o.logShippers[envID]
+	o.logShipperMutex.Unlock()
+	if s == nil {
+		return nil
+	}
+	stats := &models.LogShippingStats{
+		Sink:           s.sink,
+		Credentials:    s.credentials,
+		Active:         s.active.Load(),
+		ShippedBytes:   s.shippedBytes.Load(),
+		ShippedLines:   s.shippedLines.Load(),
+		ShippedBatches: s.shippedBatches.Load(),
+		DroppedLines:   s.droppedLines.Load(),
+	}
+	s.mu.Lock()
+	stats.LastShippedAt = s.lastShippedAt
+	stats.LastError = s.lastError
+	stats.LastErrorAt = s.lastErrorAt
+	s.mu.Unlock()
+	return stats
+}
+
+// logShippingSource returns where a follower reads an environment's log from; done is set once
+// the log will not grow anymore (the environment is gone, being deleted or a completed oneshot)
+func (o *Orchestrator) logShippingSource(envID string) (client k8s.ClientInterface, namespace string, running, done bool) {
+	o.envMutex.RLock()
+	env, exists := o.environments[envID]
+	if !exists || env.Status == models.StatusTerminating || env.Status == models.StatusTerminated ||
+		(env.IsOneShot() && env.CompletedAt != nil) {
+		o.envMutex.RUnlock()
+		return nil, "", false, true
+	}
+	envCopy := env.DeepCopy()
+	o.envMutex.RUnlock()
+	client, err := o.clientFor(envCopy)
+	if err != nil {
+		return nil, "", false, false
+	}
+	return client, envCopy.Namespace, envCopy.Status == models.StatusRunning, false
+}
+
+// runLogShipper follows an environment's main pod log until the environment is gone or the
+// follower is stopped, following it again whenever its stream ends (e.g. the pod was recreated).
+// Lines are identified by their timestamps, so lines read again are not shipped twice.
+func (o *Orchestrator) runLogShipper(ctx context.Context, s *logShipper, sink LogSink) {
+	defer close(s.done)
+	defer func() {
+		o.logShipperMutex.Lock()
+		if o.logShippers[s.envID] == s {
+			delete(o.logShippers, s.envID)
+		}
+		o.logShipperMutex.Unlock()
+	}()
+
+	batch := &LogBatch{
+		EnvironmentID: s.envID,
+		Pod:           mainPodName,
+		Stream:        o.clock.Now().UTC().Format("20060102T150405Z"),
+	}
+	var shippedUntil time.Time
+	delay := logShipReconnectDelay
+	for {
+		client, namespace, running, done := o.logShippingSource(s.envID)
+		if done {
+			o.logger.Info("log shipping stopped", zap.String("environment_id", s.envID))
+			return
+		}
+		if running {
+			batch.Namespace = namespace
+			read, err := o.followLog(ctx, s, sink, client, batch, &shippedUntil)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				s.recordError(err, o.clock.Now())
+			}
+			if read {
+				delay = logShipReconnectDelay
+			}
+		}
+		s.active.Store(false)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, logShipMaxReconnectDelay)
+	}
+}
+
+// followLog ships the main pod log from after shippedUntil until its stream ends. Lines are read
+// only as fast as batches are pushed, so a slow sink holds the stream back. read reports whether
+// any new line was read.
+func (o *Orchestrator) followLog(ctx context.Context, s *logShipper, sink LogSink, client k8s.ClientInterface, batch *LogBatch, shippedUntil *time.Time) (read bool, err error) {
+	cfg := o.cfg().LogShipping
+	stream, err := client.StreamPodLogs(ctx, batch.Namespace, mainPodName, nil, true, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to follow pod log: %w", err)
+	}
+	defer stream.Close()
+	s.active.Store(true)
+
+	lines := make(chan LogLine, cfg.BatchLines)
+	readErr := make(chan error, 1)
+	after := *shippedUntil
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(stream)
+		for {
+			text, err := reader.ReadString('\n')
+			if text != "" {
+				line := parseLogLine(text, o.clock.Now())
+				if line.Time.After(after) {
+					select {
+					case lines <- line:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					readErr <- fmt.Errorf("failed to read pod log: %w", err)
+				}
+				return
+			}
+		}
+	}()
+
+	flush := time.NewTicker(time.Duration(cfg.FlushIntervalMs) * time.Millisecond)
+	defer flush.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return read, nil
+		case line, ok := <-lines:
+			if !ok {
+				o.shipLogBatch(ctx, s, sink, batch, shippedUntil)
+				select {
+				case err := <-readErr:
+					return read, err
+				default:
+					return read, nil
+				}
+			}
+			read = true
+			batch.Lines = append(batch.Lines, line)
+			batch.Bytes += len(line.Line)
+			if len(batch.Lines) >= cfg.BatchLines || batch.Bytes >= cfg.BatchBytes {
+				o.shipLogBatch(ctx, s, sink, batch, shippedUntil)
+			}
+		case <-flush.C:
+			o.shipLogBatch(ctx, s, sink, batch, shippedUntil)
+		}
+	}
+}
+
+// shipLogBatch pushes the lines of batch, retrying with exponential backoff; a batch the sink
+// still rejects after log_shipping.max_attempts is dropped. The batch is emptied either way.
+func (o *Orchestrator) shipLogBatch(ctx context.Context, s *logShipper, sink LogSink, batch *LogBatch, shippedUntil *time.Time) {
+	if len(batch.Lines) == 0 {
+		return
+	}
+	cfg := o.cfg().LogShipping
+	batch.Seq++
+	last := batch.Lines[len(batch.Lines)-1].Time
+	defer func() {
+		batch.Lines = nil
+		batch.Bytes = 0
+	}()
+
+	backoff := time.Duration(cfg.InitialBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := sink.Push(ctx, batch)
+		if err == nil {
+			now := o.clock.Now()
+			s.shippedBytes.Add(int64(batch.Bytes))
+			s.shippedLines.Add(int64(len(batch.Lines)))
+			s.shippedBatches.Add(1)
+			s.mu.Lock()
+			s.lastShippedAt = &now
+			s.mu.Unlock()
+			*shippedUntil = last
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.recordError(err, o.clock.Now())
+		if attempt >= cfg.MaxAttempts {
+			s.droppedLines.Add(int64(len(batch.Lines)))
+			*shippedUntil = last
+			o.logger.Warn("log batch dropped after failed pushes",
+				zap.String("environment_id", s.envID),
+				zap.Int("lines", len(batch.Lines)),
+				zap.Int("attempts", attempt),
+				zap.Error(err),
+			)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// parseLogLine splits a log line read with Kubernetes timestamps into its time and text; lines
+// without a timestamp get now
+func parseLogLine(text string, now time.Time) LogLine {
+	text = strings.TrimRight(text, "\r\n")
+	if len(text) > maxShippedLineBytes {
+		text = text[:maxShippedLineBytes]
+	}
+	if ts, rest, ok := strings.Cut(text, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return LogLine{Time: t, Line: rest}
+		}
+	}
+	return LogLine{Time: now, Line: text}
+}
@@ -0,0 +1,271 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Orphaned Namespace Collection ==========
+
+// Audit log actions of the orphaned namespace collector
+const (
+	AuditActionNamespaceCollected = "namespace_gc.deleted"
+	AuditActionNamespaceOrphaned  = "namespace_gc.orphan_found" // dry run: reported, not deleted
+)
+
+// managedNamespaceSelector selects the namespaces agentbox created for environments
+const managedNamespaceSelector = "managed-by=agentbox,env-id"
+
+// namespaceDeleteTimeout bounds the wait for one orphaned namespace to go away; a namespace
+// stuck on a finalizer is reported as failed and retried on the next pass
+const namespaceDeleteTimeout = 30 * time.Second
+
+// Outcomes of an orphaned namespace in a NamespaceGCReport
+const (
+	OrphanDeleted     = "deleted"
+	OrphanWouldDelete = "would_delete" // dry run
+	OrphanTooNew      = "too_new"      // younger than min_age_seconds
+	OrphanTerminating = "terminating"  // already being deleted
+	OrphanFailed      = "failed"
+)
+
+// OrphanNamespace is a managed namespace whose environment no longer exists
+type OrphanNamespace struct {
+	Cluster       string    `json:"cluster"`
+	Namespace     string    `json:"namespace"`
+	EnvironmentID string    `json:"environment_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Action        string    `json:"action"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// NamespaceGCReport summarizes one pass of the orphaned namespace collector
+type NamespaceGCReport struct {
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	DryRun      bool      `json:"dry_run"`
+	// Scanned is the number of managed namespaces inspected
+	Scanned int               `json:"scanned"`
+	Orphans []OrphanNamespace `json:"orphans"`
+	Deleted int               `json:"deleted"`
+	// Errors lists clusters that could not be listed and environments that could not be looked up;
+	// their namespaces are left alone
+	Errors []string `json:"errors,omitempty"`
+}
+
+// errNamespaceGCNeedsDatabase is returned when the collector runs without a database
+var errNamespaceGCNeedsDatabase = apierrors.New(apierrors.Unavailable, apierrors.CodeNamespaceGCUnavailable,
+	"orphaned namespace collection requires a database")
+
+// collectOrphanNamespacesIfEnabled runs the collector from the reconciliation loop when it is
+// enabled and a database is configured
+func (o *Orchestrator) collectOrphanNamespacesIfEnabled(ctx context.Context) {
+	gc := o.cfg().Reconciliation.OrphanGC
+	if !gc.Enabled || o.db == nil {
+		return
+	}
+	if _, err := o.CollectOrphanNamespaces(ctx, gc.DryRun); err != nil {
+		o.logger.Warn("orphaned namespace collection failed", zap.Error(err))
+	}
+}
+
+// CollectOrphanNamespaces finds the managed namespaces of environments that no longer exist on
+// every reachable cluster and deletes those older than the configured minimum age (dryRun only
+// reports them). Each orphan is written to the audit log; the report is kept for NamespaceGCStatus.
+// Namespaces are only matched to environments through the database, so it must be configured.
+func (o *Orchestrator) CollectOrphanNamespaces(ctx context.Context, dryRun bool) (*NamespaceGCReport, error) {
+	if o.db == nil {
+		return nil, errNamespaceGCNeedsDatabase
+	}
+	// One pass at a time: an admin-triggered run waits for the loop's run to finish
+	o.namespaceGCMutex.Lock()
+	defer o.namespaceGCMutex.Unlock()
+
+	cfg := o.cfg()
+	minAge := time.Duration(cfg.Reconciliation.OrphanGC.MinAgeSeconds) * time.Second
+	report := &NamespaceGCReport{StartedAt: o.clock.Now(), DryRun: dryRun, Orphans: []OrphanNamespace{}}
+	// Deletions are paced in batches like bulk operations' so a backlog of orphans does not
+	// flood the API server
+	batchSize := o.namespaceDeleteBatchSize()
+	attempted := 0
+
+	for _, cluster := range o.clusters.Names() {
+		if !o.clusters.Reachable(cluster) {
+			report.Errors = append(report.Errors, fmt.Sprintf("cluster %s: unreachable", cluster))
+			continue
+		}
+		client, err := o.clusters.Get(cluster)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cluster %s: %v", cluster, err))
+			continue
+		}
+		namespaces, err := client.ListNamespaces(ctx, managedNamespaceSelector)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cluster %s: %v", cluster, err))
+			continue
+		}
+
+		for i := range namespaces.Items {
+			ns := &namespaces.Items[i]
+			// Namespaces of another installation sharing the cluster have another prefix
+			if !strings.HasPrefix(ns.Name, cfg.Kubernetes.NamespacePrefix) {
+				continue
+			}
+			report.Scanned++
+			envID := ns.Labels["env-id"]
+			orphaned, err := o.environmentGone(ctx, envID)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("environment %s: %v", envID, err))
+				continue
+			}
+			if !orphaned {
+				continue
+			}
+
+			orphan := OrphanNamespace{
+				Cluster:       cluster,
+				Namespace:     ns.Name,
+				EnvironmentID: envID,
+				CreatedAt:     ns.CreationTimestamp.Time,
+			}
+			switch {
+			case ns.Status.Phase == corev1.NamespaceTerminating:
+				orphan.Action = OrphanTerminating
+			case o.clock.Now().Sub(orphan.CreatedAt) < minAge:
+				orphan.Action = OrphanTooNew
+			case dryRun:
+				orphan.Action = OrphanWouldDelete
+				o.auditOrphanNamespace(ctx, AuditActionNamespaceOrphaned, &orphan)
+			default:
+				if attempted > 0 && attempted%batchSize == 0 {
+					o.pauseBetweenDeleteBatches(ctx)
+				}
+				attempted++
+				deleteCtx, cancel := context.WithTimeout(ctx, namespaceDeleteTimeout)
+				err := client.DeleteNamespace(deleteCtx, ns.Name)
+				cancel()
+				if err != nil {
+					orphan.Action = OrphanFailed
+					orphan.Error = err.Error()
+				} else {
+					orphan.Action = OrphanDeleted
+					report.Deleted++
+					o.collectedNamespaces.Add(1)
+					o.namespacesDeleted.Add(1)
+				}
+				o.auditOrphanNamespace(ctx, AuditActionNamespaceCollected, &orphan)
+			}
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+
+	report.CompletedAt = o.clock.Now()
+	o.lastNamespaceGC.Store(report)
+	if len(report.Orphans) > 0 || len(report.Errors) > 0 {
+		o.logger.Info("orphaned namespace collection completed",
+			zap.Bool("dry_run", dryRun),
+			zap.Int("scanned", report.Scanned),
+			zap.Int("orphans", len(report.Orphans)),
+			zap.Int("deleted", report.Deleted),
+			zap.Strings("errors", report.Errors),
+		)
+	}
+	return copyNamespaceGCReport(report), nil
+}
+
+// environmentGone reports whether the environment no longer exists on any replica: it is neither
+// held by this replica nor stored in the database
+func (o *Orchestrator) environmentGone(ctx context.Context, envID string) (bool, error) {
+	o.envMutex.RLock()
+	_, inMemory := o.environments[envID]
+	o.envMutex.RUnlock()
+	if inMemory {
+		return false, nil
+	}
+	if _, err := o.db.GetEnvironment(ctx, envID); err != nil {
+		if errors.Is(err, apierrors.NotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// auditOrphanNamespace records what the collector did with an orphaned namespace
+func (o *Orchestrator) auditOrphanNamespace(ctx context.Context, action string, orphan *OrphanNamespace) {
+	fields := []zap.Field{
+		zap.String("cluster", orphan.Cluster),
+		zap.String("namespace", orphan.Namespace),
+		zap.String("environment_id", orphan.EnvironmentID),
+	}
+	var message string
+	switch orphan.Action {
+	case OrphanWouldDelete:
+		message = fmt.Sprintf("Orphaned namespace %s on cluster %s would be deleted (dry run)", orphan.Namespace, orphan.Cluster)
+		o.logger.Info("found orphaned namespace (dry run)", fields...)
+	case OrphanFailed:
+		message = fmt.Sprintf("Failed to delete orphaned namespace %s on cluster %s: %s", orphan.Namespace, orphan.Cluster, orphan.Error)
+		o.logger.Warn("failed to delete orphaned namespace", append(fields, zap.String("error", orphan.Error))...)
+	default:
+		message = fmt.Sprintf("Deleted orphaned namespace %s on cluster %s", orphan.Namespace, orphan.Cluster)
+		o.logger.Info("deleted orphaned namespace", fields...)
+	}
+
+	if err := o.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       action,
+		ResourceType: "namespace",
+		ResourceID:   orphan.Namespace,
+		Message:      message,
+		Details:      fmt.Sprintf("cluster=%s environment_id=%s", orphan.Cluster, orphan.EnvironmentID),
+	}); err != nil {
+		o.logger.Warn("failed to write audit entry for orphaned namespace", append(fields, zap.Error(err))...)
+	}
+}
+
+// NamespaceGCStatus is the collector's configuration and the report of its latest pass
+type NamespaceGCStatus struct {
+	// Enabled is false when the collector is turned off or no database is configured
+	Enabled       bool  `json:"enabled"`
+	DryRun        bool  `json:"dry_run"`
+	MinAgeSeconds int   `json:"min_age_seconds"`
+	TotalDeleted  int64 `json:"total_deleted"`
+	// LastRun is nil until the first pass (scheduled or triggered) completes
+	LastRun *NamespaceGCReport `json:"last_run"`
+}
+
+// NamespaceGCStatus returns the collector's configuration and its latest report
+func (o *Orchestrator) NamespaceGCStatus() *NamespaceGCStatus {
+	gc := o.cfg().Reconciliation.OrphanGC
+	status := &NamespaceGCStatus{
+		Enabled:       gc.Enabled && o.db != nil,
+		DryRun:        gc.DryRun,
+		MinAgeSeconds: gc.MinAgeSeconds,
+		TotalDeleted:  o.collectedNamespaces.Load(),
+	}
+	if report := o.lastNamespaceGC.Load(); report != nil {
+		status.LastRun = copyNamespaceGCReport(report)
+	}
+	return status
+}
+
+// CollectedNamespacesTotal returns the number of orphaned namespaces deleted since startup
+func (o *Orchestrator) CollectedNamespacesTotal() int64 {
+	return o.collectedNamespaces.Load()
+}
+
+// copyNamespaceGCReport returns a copy of report that shares no slices with it
+func copyNamespaceGCReport(report *NamespaceGCReport) *NamespaceGCReport {
+	reportCopy := *report
+	reportCopy.Orphans = append([]OrphanNamespace{}, report.Orphans...)
+	reportCopy.Errors = append([]string(nil), report.Errors...)
+	return &reportCopy
+}
@@ -0,0 +1,71 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Previous namespaces ==========
+
+// namespaceTerminationPollInterval is how often a namespace that is being deleted is checked
+const namespaceTerminationPollInterval = time.Second
+
+// waitForPreviousNamespace waits, up to timeouts.namespace_termination_timeout, while a namespace
+// of the environment's name is still being deleted (e.g. by a delete that gave up waiting for it),
+// since nothing can be created in it until it is gone. The environment is in the
+// waiting_for_previous_namespace phase meanwhile. The wait is not bounded by ctx's provisioning
+// deadline; it returns how long it waited, so the caller can extend the deadline by that much.
+func (o *Orchestrator) waitForPreviousNamespace(ctx context.Context, client k8s.ClientInterface, envID, namespace string) (time.Duration, error) {
+	ns, err := client.GetNamespace(ctx, namespace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get namespace: %w", err)
+	}
+	if ns == nil || ns.Status.Phase != corev1.NamespaceTerminating {
+		return 0, nil
+	}
+
+	timeout := time.Duration(o.cfg().Timeouts.NamespaceTerminationTimeout) * time.Second
+	o.logger.Info("waiting for the previous namespace to be deleted",
+		zap.String("environment_id", envID),
+		zap.String("namespace", namespace),
+		zap.Duration("timeout", timeout),
+	)
+	o.setEnvironmentPhase(envID, models.PhaseWaitingForPreviousNamespace)
+
+	waitCtx := context.WithoutCancel(ctx)
+	started := o.clock.Now()
+	ticker := o.clock.NewTicker(namespaceTerminationPollInterval)
+	defer ticker.Stop()
+	for {
+		waited := o.clock.Now().Sub(started)
+		if waited >= timeout {
+			return waited, fmt.Errorf("namespace %s of a previous environment is still being deleted after %s; try again once it is gone", namespace, timeout)
+		}
+		<-ticker.C()
+		ns, err := client.GetNamespace(waitCtx, namespace)
+		if err != nil {
+			// Transient errors are retried until the deadline
+			o.logger.Debug("get namespace while waiting for its deletion", zap.String("namespace", namespace), zap.Error(err))
+			continue
+		}
+		if ns == nil || ns.Status.Phase != corev1.NamespaceTerminating {
+			return o.clock.Now().Sub(started), nil
+		}
+	}
+}
+
+// extendDeadline returns ctx with its deadline (if any) moved back by d
+func extendDeadline(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(context.WithoutCancel(ctx), deadline.Add(d))
+}
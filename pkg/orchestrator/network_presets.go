@@ -0,0 +1,119 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Network presets ==========
+
+// NetworkPresets returns the configured network presets sorted by name, with the rules each
+// one results in
+func (o *Orchestrator) NetworkPresets() []models.NetworkPreset {
+	presets := o.cfg().Network.Presets
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]models.NetworkPreset, 0, len(names))
+	for _, name := range names {
+		policy := presetPolicy(presets[name])
+		result = append(result, models.NetworkPreset{
+			Name:        name,
+			Description: presets[name].Description,
+			Policy:      policy,
+			Rules:       networkPolicyRules(&policy),
+		})
+	}
+	return result
+}
+
+// ExpandNetworkPreset resolves isolation.network_preset into isolation.network_policy, so the
+// environment keeps the policy that was applied even if the preset is redefined later. A
+// network_policy given with the preset is applied on top of it: its lists replace the preset's
+// and its allow_* flags set to true are added. Expanding an already expanded isolation does
+// not change it. Unknown presets fail with ValidationFailed.
+func (o *Orchestrator) ExpandNetworkPreset(isolation *models.IsolationConfig) error {
+	if isolation == nil || isolation.NetworkPreset == "" {
+		return nil
+	}
+	presets := o.cfg().Network.Presets
+	preset, ok := presets[isolation.NetworkPreset]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeUnknownNetworkPreset,
+			"unknown network preset %q (available: %s)", isolation.NetworkPreset, strings.Join(names, ", "))
+	}
+
+	policy := presetPolicy(preset)
+	if explicit := isolation.NetworkPolicy; explicit != nil {
+		policy.AllowInternet = policy.AllowInternet || explicit.AllowInternet
+		policy.AllowClusterInternal = policy.AllowClusterInternal || explicit.AllowClusterInternal
+		if len(explicit.AllowedEgressCIDRs) > 0 {
+			policy.AllowedEgressCIDRs = slices.Clone(explicit.AllowedEgressCIDRs)
+		}
+		if len(explicit.AllowedIngressPorts) > 0 {
+			policy.AllowedIngressPorts = slices.Clone(explicit.AllowedIngressPorts)
+		}
+	}
+	isolation.NetworkPolicy = &policy
+	return nil
+}
+
+// presetPolicy converts a configured preset to a network policy
+func presetPolicy(preset config.NetworkPresetConfig) models.NetworkPolicyConfig {
+	return models.NetworkPolicyConfig{
+		AllowInternet:        preset.AllowInternet,
+		AllowedEgressCIDRs:   slices.Clone(preset.AllowedEgressCIDRs),
+		AllowedIngressPorts:  slices.Clone(preset.AllowedIngressPorts),
+		AllowClusterInternal: preset.AllowClusterInternal,
+	}
+}
+
+// networkPolicyRules describes the traffic a network policy allows, as applied by
+// applyNetworkPolicyWithConfig (without per-environment DNS servers)
+func networkPolicyRules(policy *models.NetworkPolicyConfig) []string {
+	rules := []string{"egress to the cluster DNS on port 53"}
+	if policy.AllowInternet {
+		rules = append(rules, "egress to any address")
+	}
+	for _, cidr := range policy.AllowedEgressCIDRs {
+		rules = append(rules, "egress to "+cidr)
+	}
+	if policy.AllowClusterInternal {
+		rules = append(rules, "egress to and ingress from all pods in the cluster")
+	}
+	for _, port := range policy.AllowedIngressPorts {
+		rules = append(rules, fmt.Sprintf("ingress on port %d", port))
+	}
+	return rules
+}
+
+// recordNetworkPreset adds a network_preset_resolved event holding the policy the environment's
+// preset resolved to, for audits
+func (o *Orchestrator) recordNetworkPreset(envID string, isolation *models.IsolationConfig) {
+	if isolation == nil || isolation.NetworkPreset == "" || isolation.NetworkPolicy == nil {
+		return
+	}
+	details, err := json.Marshal(isolation.NetworkPolicy)
+	if err != nil {
+		return
+	}
+	o.logReconciliationEvent(envID, "network_preset_resolved",
+		fmt.Sprintf("Network preset %q resolved to: %s", isolation.NetworkPreset,
+			strings.Join(networkPolicyRules(isolation.NetworkPolicy), "; ")),
+		string(details))
+}
@@ -0,0 +1,229 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/notify"
+	"github.com/sciffer/agentbox/pkg/preferences"
+)
+
+// ========== Failure Notifications ==========
+
+// Failure notifications sent to the notifications webhook
+const (
+	EnvironmentFailedEvent = "environment.failed"
+	ExecutionFailedEvent   = "execution.failed"
+)
+
+// webhookTimeout bounds one notification webhook delivery
+const webhookTimeout = 10 * time.Second
+
+// FailureNotice is the JSON body POSTed to the notifications webhook when an environment fails or
+// an execution fails or exits non-zero, for users whose preferences ask for it
+type FailureNotice struct {
+	Event string `json:"event"`
+	// UserID is the user notified: the environment's owner, or whoever ran the execution
+	UserID        string `json:"user_id"`
+	EnvironmentID string `json:"environment_id"`
+	Name          string `json:"name"`
+	TeamID        string `json:"team_id,omitempty"`
+	ExecutionID   string `json:"execution_id,omitempty"`
+	ExitCode      *int   `json:"exit_code,omitempty"`
+	Error         string `json:"error,omitempty"`
+	// OccurredAt is when the failure was noticed, in the user's time zone
+	OccurredAt time.Time `json:"occurred_at"`
+	Timezone   string    `json:"timezone"`
+}
+
+// PreferencesProvider resolves the preferences in effect for a user (implemented by
+// preferences.Service)
+type PreferencesProvider interface {
+	Effective(ctx context.Context, userID string) (models.EffectivePreferences, error)
+}
+
+// SetPreferences makes failure notifications follow each user's preferences; without a provider
+// the configured defaults apply to everyone
+func (o *Orchestrator) SetPreferences(provider PreferencesProvider) {
+	if provider == nil {
+		o.preferences.Store(nil)
+		return
+	}
+	o.preferences.Store(&provider)
+}
+
+// CriticalNotifier emails critical events (implemented by notify.Service); Notify must not block
+type CriticalNotifier interface {
+	Notify(ev notify.Event)
+}
+
+// SetCriticalNotifier emails critical events, such as environments failing after their last
+// reconciliation retry, to the users who opted in
+func (o *Orchestrator) SetCriticalNotifier(notifier CriticalNotifier) {
+	if notifier == nil {
+		o.criticalNotifier.Store(nil)
+		return
+	}
+	o.criticalNotifier.Store(&notifier)
+}
+
+// notifyCritical hands a critical event to the critical notifier, if any
+func (o *Orchestrator) notifyCritical(ev notify.Event) {
+	if notifier := o.criticalNotifier.Load(); notifier != nil {
+		(*notifier).Notify(ev)
+	}
+}
+
+// effectivePreferences returns the preferences in effect for a user, falling back to the
+// configured defaults when they cannot be read
+func (o *Orchestrator) effectivePreferences(ctx context.Context, userID string) models.EffectivePreferences {
+	defaults := preferences.ConfigDefaults(o.cfg().Preferences)
+	provider := o.preferences.Load()
+	if provider == nil || userID == "" {
+		return defaults
+	}
+	prefs, err := (*provider).Effective(ctx, userID)
+	if err != nil {
+		o.logger.Warn("failed to read user preferences; using defaults", zap.String("user_id", userID), zap.Error(err))
+		return defaults
+	}
+	return prefs
+}
+
+// notifyEnvironmentFailed notifies the owner of a failed environment, if their preferences ask
+// for it, in the background
+func (o *Orchestrator) notifyEnvironmentFailed(envID string) {
+	url := o.cfg().Notifications.WebhookURL
+	if url == "" {
+		return
+	}
+	o.envMutex.RLock()
+	stored, ok := o.environments[envID]
+	var notice FailureNotice
+	if ok {
+		notice = FailureNotice{
+			Event:         EnvironmentFailedEvent,
+			UserID:        stored.UserID,
+			EnvironmentID: stored.ID,
+			Name:          stored.Name,
+			TeamID:        stored.TeamID,
+			Error:         stored.LastReconciliationError,
+		}
+	}
+	o.envMutex.RUnlock()
+	if !ok {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		prefs := o.effectivePreferences(ctx, notice.UserID)
+		if !prefs.NotifyOnEnvironmentFailed {
+			return
+		}
+		o.sendFailureNotice(ctx, url, &notice, prefs.Timezone)
+	}()
+}
+
+// executionFailed reports whether an execution failed to run or its command exited non-zero
+func executionFailed(exec *models.Execution) bool {
+	switch exec.Status {
+	case models.ExecutionStatusFailed:
+		return true
+	case models.ExecutionStatusCompleted:
+		return exec.ExitCode != nil && *exec.ExitCode != 0
+	}
+	return false
+}
+
+// notifyExecutionFailed notifies whoever ran a failed execution (the environment's owner when
+// unknown), if their preferences ask for it, in the background
+func (o *Orchestrator) notifyExecutionFailed(execID string) {
+	url := o.cfg().Notifications.WebhookURL
+	if url == "" {
+		return
+	}
+	o.execMutex.RLock()
+	exec, ok := o.executions[execID]
+	var notice FailureNotice
+	if ok && executionFailed(exec) {
+		notice = FailureNotice{
+			Event:         ExecutionFailedEvent,
+			UserID:        exec.UserID,
+			EnvironmentID: exec.EnvironmentID,
+			ExecutionID:   exec.ID,
+			ExitCode:      exec.ExitCode,
+			Error:         exec.Error,
+		}
+	}
+	o.execMutex.RUnlock()
+	if notice.Event == "" {
+		return
+	}
+	o.envMutex.RLock()
+	if env, ok := o.environments[notice.EnvironmentID]; ok {
+		notice.Name = env.Name
+		notice.TeamID = env.TeamID
+		if notice.UserID == "" {
+			notice.UserID = env.UserID
+		}
+	}
+	o.envMutex.RUnlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		prefs := o.effectivePreferences(ctx, notice.UserID)
+		if !prefs.NotifyOnExecutionFailed {
+			return
+		}
+		o.sendFailureNotice(ctx, url, &notice, prefs.Timezone)
+	}()
+}
+
+// sendFailureNotice POSTs a failure notice, timestamped now in the time zone tz
+func (o *Orchestrator) sendFailureNotice(ctx context.Context, url string, notice *FailureNotice, tz string) {
+	now := o.clock.Now()
+	if loc, err := config.LoadTimezone(tz); err == nil {
+		now = now.In(loc)
+	} else {
+		tz = "UTC"
+		now = now.UTC()
+	}
+	notice.OccurredAt = now
+	notice.Timezone = tz
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return
+	}
+	o.postWebhook(ctx, "notification webhook", url, body,
+		zap.String("event", notice.Event), zap.String("environment_id", notice.EnvironmentID))
+}
+
+// postWebhook POSTs a JSON body to a notification webhook, logging failures under name; fields
+// identify the notification in the logs
+func (o *Orchestrator) postWebhook(ctx context.Context, name, url string, body []byte, fields ...zap.Field) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		o.logger.Warn(name+": invalid request", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		o.logger.Warn(name+": delivery failed", append(fields, zap.Error(err))...)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		o.logger.Warn(name+": unexpected response", append(fields, zap.Int("status", resp.StatusCode))...)
+	}
+}
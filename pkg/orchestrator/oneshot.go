@@ -0,0 +1,201 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Oneshot Environments ==========
+
+// oneShotRetryDelay is how long awaitOneShot waits before watching the main pod again after the
+// watch ended without a result (e.g. the API server closed it)
+const oneShotRetryDelay = time.Second
+
+// effectiveEnvironmentMode returns the mode an environment with the given setting uses
+func effectiveEnvironmentMode(mode string) string {
+	if mode == "" {
+		return models.EnvironmentModeInteractive
+	}
+	return mode
+}
+
+// EnvironmentNotRunningError is returned for commands sent to an environment that is not running.
+// Completed oneshot environments get their own code: they will never run again.
+func EnvironmentNotRunningError(env *models.Environment) error {
+	if env.IsOneShot() && env.CompletedAt != nil {
+		if env.ExitCode != nil {
+			return apierrors.New(apierrors.Conflict, apierrors.CodeEnvironmentCompleted,
+				"oneshot environment has completed (exit code %d); its result is on the environment", *env.ExitCode)
+		}
+		return apierrors.New(apierrors.Conflict, apierrors.CodeEnvironmentCompleted,
+			"oneshot environment has completed (%s)", env.StatusMessage)
+	}
+	return apierrors.New(apierrors.NotRunning, apierrors.CodeEnvironmentNotRunning, "environment is not running (status: %s)", env.Status)
+}
+
+// oneShotTimeout is how long a oneshot environment's command may run: its timeout, else the
+// default timeout
+func (o *Orchestrator) oneShotTimeout(env *models.Environment) time.Duration {
+	timeout := env.Timeout
+	if timeout <= 0 {
+		timeout = o.cfg().Timeouts.DefaultTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// awaitOneShot waits for the main pod of a running oneshot environment to complete and records
+// its result. It is started by provisioning and, after a restart, for every oneshot environment
+// still running.
+func (o *Orchestrator) awaitOneShot(envID string) {
+	o.envMutex.RLock()
+	stored, exists := o.environments[envID]
+	var env *models.Environment
+	if exists {
+		env = stored.DeepCopy()
+	}
+	o.envMutex.RUnlock()
+	if env == nil {
+		return
+	}
+	client, err := o.clientFor(env)
+	if err != nil {
+		o.logger.Error("oneshot environment: no client", zap.String("environment_id", envID), zap.Error(err))
+		return
+	}
+
+	// The deadline counts from the start, also when the watch is resumed after a restart
+	started := o.clock.Now()
+	if env.StartedAt != nil {
+		started = *env.StartedAt
+	}
+	timeout := o.oneShotTimeout(env)
+	ctx, cancel := context.WithDeadline(context.Background(), started.Add(timeout))
+	defer cancel()
+	maxOutput := o.cfg().Executions.MaxOutputBytes
+	var result *k8s.PodCompletionResult
+	for {
+		result, err = client.WaitForPodCompletion(ctx, env.Namespace, "main", maxOutput)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if _, getErr := client.GetPod(ctx, env.Namespace, "main"); getErr != nil {
+			break // The pod is gone (e.g. the environment is being deleted)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(oneShotRetryDelay):
+		}
+	}
+
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if timedOut {
+		// Stop the command; the pod is never restarted
+		deleteCtx, deleteCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if delErr := client.DeletePod(deleteCtx, env.Namespace, "main", true); delErr != nil {
+			o.logger.Warn("oneshot environment: failed to delete timed out pod", zap.String("environment_id", envID), zap.Error(delErr))
+		}
+		deleteCancel()
+	}
+	if !timedOut {
+		timeout = 0
+	}
+	o.completeOneShot(envID, result, err, timeout)
+}
+
+// completeOneShot records the result of a oneshot environment's command: terminated when it
+// exited with code 0, failed otherwise. timedOut is the timeout the command hit, if it did.
+func (o *Orchestrator) completeOneShot(envID string, result *k8s.PodCompletionResult, waitErr error, timedOut time.Duration) {
+	now := o.clock.Now()
+	o.envMutex.Lock()
+	e, exists := o.environments[envID]
+	if !exists || e.Status != models.StatusRunning || e.CompletedAt != nil {
+		// Deleted (or already completed) meanwhile
+		o.envMutex.Unlock()
+		return
+	}
+	e.CompletedAt = &now
+	if result != nil {
+		e.Output = result.Logs
+		e.OutputTruncated = result.LogsTruncated
+	}
+	switch {
+	case timedOut > 0:
+		e.Status = models.StatusFailed
+		e.StatusMessage = fmt.Sprintf("command timed out after %s", timedOut)
+	case waitErr != nil:
+		e.Status = models.StatusFailed
+		e.StatusMessage = "command did not complete: " + waitErr.Error()
+	default:
+		exitCode := result.ExitCode
+		e.ExitCode = &exitCode
+		e.Status = models.StatusTerminated
+		e.StatusMessage = ""
+		if exitCode != 0 {
+			e.Status = models.StatusFailed
+			e.StatusMessage = fmt.Sprintf("command exited with code %d", exitCode)
+		}
+	}
+	env := e.DeepCopy()
+	o.envMutex.Unlock()
+
+	if o.db != nil {
+		if err := o.db.SaveEnvironment(context.Background(), env); err != nil {
+			o.logger.Error("failed to save oneshot environment result", zap.Error(err), zap.String("environment_id", envID))
+		}
+	}
+	o.notifyEnvironmentStatus(envID)
+	o.logReconciliationEvent(envID, "oneshot_completed", "Command completed: "+string(env.Status), env.StatusMessage)
+	o.logger.Info("oneshot environment completed",
+		zap.String("environment_id", envID),
+		zap.String("status", string(env.Status)),
+		zap.String("message", env.StatusMessage),
+	)
+}
+
+// resumeOneShots restarts the completion watch of oneshot environments that were running when
+// the server stopped
+func (o *Orchestrator) resumeOneShots() {
+	o.envMutex.RLock()
+	var envIDs []string
+	for id, env := range o.environments {
+		if env.IsOneShot() && env.Status == models.StatusRunning && env.CompletedAt == nil {
+			envIDs = append(envIDs, id)
+		}
+	}
+	o.envMutex.RUnlock()
+	for _, id := range envIDs {
+		go o.awaitOneShot(id)
+	}
+}
+
+// deleteExpiredOneShots deletes oneshot environments whose retention period after completion
+// has passed. Run by the reconciliation loop.
+func (o *Orchestrator) deleteExpiredOneShots(ctx context.Context) {
+	now := o.clock.Now()
+	o.envMutex.RLock()
+	var expired []string
+	for id, env := range o.environments {
+		if env.IsOneShot() && env.CompletedAt != nil && env.RetentionSeconds > 0 &&
+			env.Status != models.StatusTerminating &&
+			now.Sub(*env.CompletedAt) >= time.Duration(env.RetentionSeconds)*time.Second {
+			expired = append(expired, id)
+		}
+	}
+	o.envMutex.RUnlock()
+
+	for _, id := range expired {
+		if err := o.DeleteEnvironment(ctx, id, true); err != nil {
+			o.logger.Warn("failed to delete expired oneshot environment", zap.String("environment_id", id), zap.Error(err))
+			continue
+		}
+		o.logger.Info("deleted oneshot environment after its retention period", zap.String("environment_id", id))
+	}
+}
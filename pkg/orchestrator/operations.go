@@ -0,0 +1,189 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Operations (bulk requests) ==========
+
+// MatchEnvironments returns every environment matching the filters of opts (status, labels,
+// team, group), newest first; its pagination and sort fields are ignored
+func (o *Orchestrator) MatchEnvironments(ctx context.Context, opts ListEnvironmentsOptions) ([]models.Environment, error) {
+	opts.Limit, opts.Offset, opts.PageToken, opts.Sort = 1000, 0, "", ""
+	var envs []models.Environment
+	for {
+		resp, err := o.ListEnvironmentsWithOptions(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, resp.Environments...)
+		if resp.NextPageToken == "" {
+			return envs, nil
+		}
+		opts.PageToken = resp.NextPageToken
+	}
+}
+
+// DeleteEnvironments starts deleting the environments in the background, in batches of
+// guardrails.namespace_delete_batch_size, and returns the operation tracking their results
+func (o *Orchestrator) DeleteEnvironments(ctx context.Context, envIDs []string, force bool, userID string) (*models.Operation, error) {
+	op := &models.Operation{
+		ID:        "op-" + uuid.New().String()[:8],
+		Type:      models.OperationDeleteEnvironments,
+		UserID:    userID,
+		Status:    models.OperationRunning,
+		Results:   make([]models.OperationResult, len(envIDs)),
+		CreatedAt: o.clock.Now(),
+	}
+	for i, id := range envIDs {
+		op.Results[i] = models.OperationResult{EnvironmentID: id, Status: models.OperationResultPending}
+	}
+	op.CountResults()
+
+	// Register before persisting: a stored running operation this server does not know is
+	// taken for one interrupted by a restart
+	o.operationMutex.Lock()
+	o.operations[op.ID] = op
+	result := op.DeepCopy()
+	o.operationMutex.Unlock()
+	if o.db != nil {
+		if err := o.db.SaveOperation(ctx, op); err != nil {
+			o.operationMutex.Lock()
+			delete(o.operations, op.ID)
+			o.operationMutex.Unlock()
+			return nil, err
+		}
+	}
+
+	o.logger.Info("bulk delete started",
+		zap.String("operation_id", op.ID),
+		zap.Int("environments", len(envIDs)),
+		zap.Bool("force", force),
+		zap.String("user_id", userID),
+	)
+	go o.runBulkDelete(context.WithoutCancel(ctx), op, force)
+	return result, nil
+}
+
+// GetOperation returns an operation with its results. An operation the database reports as
+// running that this server is not running was interrupted by a restart; it is marked failed.
+func (o *Orchestrator) GetOperation(ctx context.Context, id string) (*models.Operation, error) {
+	o.operationMutex.Lock()
+	if op, ok := o.operations[id]; ok {
+		result := op.DeepCopy()
+		o.operationMutex.Unlock()
+		return result, nil
+	}
+	o.operationMutex.Unlock()
+
+	if o.db == nil {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeOperationNotFound, "operation not found: %s", id)
+	}
+	op, err := o.db.GetOperation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if op.Status == models.OperationRunning {
+		// Operations are only dropped from memory after their final state is stored
+		finishInterruptedOperation(op, o.clock.Now())
+		if err := o.db.SaveOperation(ctx, op); err != nil {
+			o.logger.Error("failed to save interrupted operation", zap.Error(err), zap.String("operation_id", id))
+		}
+	}
+	return op, nil
+}
+
+// finishInterruptedOperation marks an operation whose run was lost (server restart) as failed;
+// at now; items that were still pending fail
+func finishInterruptedOperation(op *models.Operation, now time.Time) {
+	for i := range op.Results {
+		if op.Results[i].Status == models.OperationResultPending {
+			op.Results[i].Status = models.OperationResultFailed
+			op.Results[i].Error = "interrupted"
+		}
+	}
+	op.CountResults()
+	op.Status = models.OperationFailed
+	op.Error = "operation was interrupted by a server restart"
+	op.CompletedAt = &now
+}
+
+// runBulkDelete deletes the operation's environments, recording each result as it finishes
+func (o *Orchestrator) runBulkDelete(ctx context.Context, op *models.Operation, force bool) {
+	o.operationMutex.Lock()
+	envIDs := make([]string, len(op.Results))
+	for i, r := range op.Results {
+		envIDs[i] = r.EnvironmentID
+	}
+	o.operationMutex.Unlock()
+
+	o.deleteInBatches(ctx, len(envIDs), func(i int) {
+		envID := envIDs[i]
+		err := o.DeleteEnvironment(ctx, envID, force)
+
+		o.operationMutex.Lock()
+		r := &op.Results[i]
+		if err != nil {
+			r.Status = models.OperationResultFailed
+			r.Error = err.Error()
+		} else {
+			r.Status = models.OperationResultSucceeded
+		}
+		op.CountResults()
+		o.operationMutex.Unlock()
+		if err != nil {
+			o.logger.Warn("bulk delete: failed to delete environment",
+				zap.String("operation_id", op.ID),
+				zap.String("environment_id", envID),
+				zap.Error(err),
+			)
+		} else {
+			o.EnvironmentDeleted(ctx, envID, op.UserID, force)
+		}
+		o.saveOperation(op)
+	})
+
+	now := o.clock.Now()
+	o.operationMutex.Lock()
+	op.Status = models.OperationCompleted
+	if op.Failed > 0 {
+		op.Status = models.OperationFailed
+	}
+	op.CompletedAt = &now
+	o.operationMutex.Unlock()
+	o.saveOperation(op)
+
+	o.operationMutex.Lock()
+	if o.db != nil {
+		delete(o.operations, op.ID)
+	}
+	status, succeeded, failed := op.Status, op.Succeeded, op.Failed
+	o.operationMutex.Unlock()
+
+	o.logger.Info("bulk delete finished",
+		zap.String("operation_id", op.ID),
+		zap.String("status", string(status)),
+		zap.Int("succeeded", succeeded),
+		zap.Int("failed", failed),
+	)
+}
+
+// saveOperation persists the operation's current state
+func (o *Orchestrator) saveOperation(op *models.Operation) {
+	if o.db == nil {
+		return
+	}
+	o.operationMutex.Lock()
+	snapshot := op.DeepCopy()
+	o.operationMutex.Unlock()
+	if err := o.db.SaveOperation(context.Background(), snapshot); err != nil {
+		o.logger.Error("failed to save operation", zap.Error(err), zap.String("operation_id", snapshot.ID))
+	}
+}
@@ -0,0 +1,112 @@
+package orchestrator
+
+import (
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// ========== Construction Options ==========
+
+// defaultPoolInterval is how often the standby pool replenishment worker checks pool sizes
+const defaultPoolInterval = 10 * time.Second
+
+// Clock is the orchestrator's time source: it stamps the records the orchestrator keeps
+// (environments, executions, events) and ticks the background loops and the wait for a previous
+// namespace. Short polling waits within an operation (pod startup, readiness, exec retries, log
+// shipping backoff) and archive file times stay on the wall clock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker the background loops use
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{ticker: time.NewTicker(d)} }
+
+// realTicker adapts a time.Ticker to Ticker
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time   { return t.ticker.C }
+func (t realTicker) Reset(d time.Duration) { t.ticker.Reset(d) }
+func (t realTicker) Stop()                 { t.ticker.Stop() }
+
+// options holds the settings an Option changes; defaultOptions are the production settings
+type options struct {
+	clock                Clock
+	poolInterval         time.Duration
+	backgroundLoops      bool
+	provisionConcurrency int
+	storage              storage.Backend
+}
+
+func defaultOptions() options {
+	return options{
+		clock:                realClock{},
+		poolInterval:         defaultPoolInterval,
+		backgroundLoops:      true,
+		provisionConcurrency: MaxConcurrentProvisions,
+	}
+}
+
+// Option changes how New and NewWithClusters build an orchestrator
+type Option func(*options)
+
+// WithClock makes the orchestrator read time from clock instead of the wall clock; see Clock for
+// what it does and does not control
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+// WithPoolTicker sets how often the standby pool replenishment worker checks pool sizes
+// (10 seconds by default)
+func WithPoolTicker(interval time.Duration) Option {
+	return func(o *options) {
+		if interval > 0 {
+			o.poolInterval = interval
+		}
+	}
+}
+
+// WithoutBackgroundLoops builds an orchestrator that starts none of its background goroutines
+// (pool replenishment, reconciliation, retention, idle reaper, snapshot scheduler, cache sync
+// and pod watches). Their passes only run when called explicitly.
+func WithoutBackgroundLoops() Option {
+	return func(o *options) {
+		o.backgroundLoops = false
+	}
+}
+
+// WithProvisionConcurrency sets how many environments can be provisioned in parallel
+// (MaxConcurrentProvisions by default)
+func WithProvisionConcurrency(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.provisionConcurrency = n
+		}
+	}
+}
+
+// WithStorage stores workspace snapshots in the shared storage backend (under snapshots/)
+// instead of snapshots.directory
+func WithStorage(store storage.Backend) Option {
+	return func(o *options) {
+		o.storage = store
+	}
+}
@@ -1,64 +1,214 @@
 package orchestrator
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"path"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/labels"
+	utilexec "k8s.io/client-go/util/exec"
 
 	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/database"
 	"github.com/sciffer/agentbox/pkg/k8s"
 	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/notify"
+	"github.com/sciffer/agentbox/pkg/storage"
+	"github.com/sciffer/agentbox/pkg/tracing"
+	"github.com/sciffer/agentbox/pkg/validator"
 )
 
 // StandbyPod represents a pre-warmed pod ready to accept commands
 type StandbyPod struct {
 	Name      string
 	Namespace string
+	Cluster   string
 	Image     string
 	CreatedAt time.Time
 }
 
 // Orchestrator manages environment lifecycle
 type Orchestrator struct {
-	k8sClient       k8s.ClientInterface
-	config          *config.Config
+	clusters *k8s.Clusters
+	// config is swapped atomically on configuration reload; read it through cfg()
+	config          atomic.Pointer[config.Config]
 	logger          *logger.Logger
 	db              *database.DB
 	environments    map[string]*models.Environment
 	envMutex        sync.RWMutex
 	namespacePrefix string
-	// provisionSem limits concurrent environment provisioning to prevent
+	// provisionSlots limits concurrent environment provisioning to prevent
 	// overwhelming the Kubernetes API with too many parallel requests
-	provisionSem chan struct{}
-	// execSem limits concurrent executions separately from provisioning
-	execSem chan struct{}
+	provisionSlots *slotQueue
+	// execSlots limits concurrent executions separately from provisioning
+	execSlots *slotQueue
 	// executions tracks async command executions
 	executions map[string]*models.Execution
 	execMutex  sync.RWMutex
+	// execCallbacks holds the callback headers and secret of executions whose result has not
+	// been pushed yet (guarded by execMutex); they are never persisted
+	execCallbacks map[string]*callbackTarget
+	// execCacheKeys holds the result cache key and TTL of executions submitted with cache: true
+	// whose result has not been cached yet (guarded by execMutex)
+	execCacheKeys map[string]*execCacheTarget
+	// cacheHits and cacheMisses count result cache lookups since startup
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	// execWaiters wakes WaitForExecution callers when an execution finishes; key is execution ID
+	execWaiters  map[string]*executionWaiter
+	waitersMutex sync.Mutex
+	// envWatchers wakes WaitForEnvironment and WatchEnvironmentStatus callers when an
+	// environment's status changes; key is environment ID
+	envWatchers      map[string]map[*environmentWatcher]struct{}
+	envWatchersMutex sync.Mutex
+	// shellImages holds the images whose pods were seen to have /bin/sh (see killableCommand)
+	shellImages sync.Map
+	// execQueues orders the synchronous execs of each environment's main pod; key is environment ID
+	execQueues     map[string]*execQueue
+	execQueueMutex sync.Mutex
 	// standbyPool holds pre-warmed pods per environment; key is environment ID
 	standbyPool      map[string][]*StandbyPod
 	standbyPoolMutex sync.Mutex
-	// replenishEnvMutex guards replenishEnvLocks
-	replenishEnvMutex sync.Mutex
-	replenishEnvLocks map[string]*sync.Mutex // per-env lock to prevent over-replenishment from concurrent replenishPool calls
+	// poolInflight counts standby pods being created per environment (guarded by standbyPoolMutex)
+	poolInflight map[string]int
+	// poolGeneration is bumped when an environment's pool is refreshed or drained so pods that
+	// were being created before are discarded (guarded by standbyPoolMutex)
+	poolGeneration map[string]int
+	// poolDrained holds the environments whose pool is drained and not replenished (guarded by
+	// standbyPoolMutex)
+	poolDrained map[string]bool
+	// poolReadyReached holds the environments whose pool has reached pool.min_ready once, so the
+	// time from creation to pool-ready is logged only once (guarded by standbyPoolMutex)
+	poolReadyReached map[string]bool
+	// poolTrigger requests a replenishment pass; buffered so bursts of requests collapse into one
+	poolTrigger chan struct{}
 	// poolStopChan signals the pool replenishment goroutine to stop
 	poolStopChan chan struct{}
 	// reconciliationStopChan signals the reconciliation loop to stop
 	reconciliationStopChan chan struct{}
+	// retentionStopChan signals the retention janitor to stop
+	retentionStopChan chan struct{}
+	// purgedExecutions counts executions removed by retention or explicit purges
+	purgedExecutions atomic.Int64
+	// namespaceGCMutex serializes orphaned namespace collection passes; lastNamespaceGC holds the
+	// report of the latest one and collectedNamespaces counts the namespaces they deleted
+	namespaceGCMutex    sync.Mutex
+	lastNamespaceGC     atomic.Pointer[NamespaceGCReport]
+	collectedNamespaces atomic.Int64
+	// guardrailMutex serializes admitting new environments against the guardrails; creationTimes
+	// holds the creations of the last hour, oldest first (guarded by guardrailMutex)
+	guardrailMutex sync.Mutex
+	creationTimes  []time.Time
+	// namespacesCreated and namespacesDeleted count environment namespaces since the server
+	// started; scheduledPods counts the managed pods scheduled per node since the metrics
+	// collector last took them (guarded by scheduledPodsMutex)
+	namespacesCreated  atomic.Int64
+	namespacesDeleted  atomic.Int64
+	scheduledPodsMutex sync.Mutex
+	scheduledPods      map[NodeKey]int64
+	// statsCache holds recently computed execution statistics; key is env ID plus time range
+	statsCache      map[string]*executionStatsCacheEntry
+	statsCacheMutex sync.Mutex
+	// callbackIssuer mints AGENTBOX_CALLBACK_TOKEN for pods; nil disables the variable
+	callbackIssuer atomic.Pointer[CallbackTokenIssuer]
+	// envTokenIssuer mints AGENTBOX_TOKEN for main pods; nil disables the variable
+	envTokenIssuer atomic.Pointer[EnvironmentTokenIssuer]
+	// preferences resolves whose failures are notified; nil uses the configured defaults
+	preferences atomic.Pointer[PreferencesProvider]
+	// criticalNotifier emails critical events to the users who opted in; nil sends none
+	criticalNotifier atomic.Pointer[CriticalNotifier]
+	// groups caches environment groups (the only copy without a database); groupMutex guards
+	// it and serializes scaling so concurrent requests do not over- or under-provision a group
+	groups     map[string]*models.EnvironmentGroup
+	groupMutex sync.Mutex
+	// pipelines holds the pipelines this server is running (and, without a database, finished
+	// ones); pipelineMutex guards them and their state
+	pipelines     map[string]*pipelineRun
+	pipelineMutex sync.Mutex
+	// operations holds the operations this server is running (and, without a database, finished
+	// ones); operationMutex guards them and their results
+	operations     map[string]*models.Operation
+	operationMutex sync.Mutex
+	// idleStopChan signals the idle reaper to stop
+	idleStopChan chan struct{}
+	// snapshotStopChan signals the workspace snapshot scheduler to stop
+	snapshotStopChan chan struct{}
+	// reservations caches capacity reservations (the only copy without a database);
+	// reservationMutex guards it and serializes quota checks and claims
+	reservations        map[string]*models.Reservation
+	reservationMutex    sync.Mutex
+	reservationStopChan chan struct{}
+	// placeholderSlots maps environments created with a reservation to the placeholder slot they
+	// take the place of (until their main pod is created)
+	placeholderSlots map[string]int
+	// activeSessions counts open long-lived sessions (attachments) per environment; idleWarnings
+	// holds the last activity time each idle warning was sent for. Both guarded by idleMutex.
+	activeSessions map[string]int
+	idleWarnings   map[string]time.Time
+	idleMutex      sync.Mutex
+	// capacityCache holds recently fetched node capacity per cluster, node selector and tolerations
+	capacityCache      map[string]*capacityCacheEntry
+	capacityCacheMutex sync.Mutex
+	// cacheSyncStopChan signals the environment cache sync loop to stop; cacheSyncMutex
+	// serializes sync passes and guards cacheSyncCursor, the time the next pass reads changes from
+	cacheSyncStopChan chan struct{}
+	cacheSyncMutex    sync.Mutex
+	cacheSyncCursor   time.Time
+	lastCacheSync     atomic.Pointer[time.Time]
+	cacheRefreshed    atomic.Int64
+	cacheEvicted      atomic.Int64
+	// podWatches holds the main pod phases seen by each cluster's pod watch; key is cluster name
+	// (the map is fixed at construction, its states are guarded by their own lock)
+	podWatches map[string]*podWatchState
+	// podWatchStopChan signals the pod watches to stop
+	podWatchStopChan chan struct{}
+	// callbackStopChan signals execution callback deliveries to stop
+	callbackStopChan chan struct{}
+	// podStatusCache holds main pod phases read from the Kubernetes API while the pod watch is
+	// unavailable; key is cluster and namespace
+	podStatusCache      map[string]*podStatusCacheEntry
+	podStatusCacheMutex sync.Mutex
+	// logShippers follow the main pod log of environments that ship it; key is environment ID
+	logShippers     map[string]*logShipper
+	logShipperMutex sync.Mutex
+	// logSinkFactory creates the sinks logs are shipped to; nil disables log shipping
+	logSinkFactory atomic.Pointer[LogSinkFactory]
+	// clock drives the background loops; poolInterval is how often the replenishment worker
+	// checks pool sizes
+	clock        Clock
+	poolInterval time.Duration
+	// backgroundLoops is false for orchestrators built WithoutBackgroundLoops
+	backgroundLoops bool
+	// storage is the shared storage backend (set WithStorage); nil keeps snapshots in
+	// snapshots.directory
+	storage storage.Backend
+	// provisioning holds a channel per environment whose provisioning goroutine is running,
+	// closed when it exits; key is environment ID
+	provisioning      map[string]chan struct{}
+	provisioningMutex sync.Mutex
 }
 
+// Errors returned for unknown environment and execution IDs
+var (
+	errEnvironmentNotFound = apierrors.New(apierrors.NotFound, apierrors.CodeEnvironmentNotFound, "environment not found")
+	errExecutionNotFound   = apierrors.New(apierrors.NotFound, apierrors.CodeExecutionNotFound, "execution not found")
+)
+
 // MaxConcurrentProvisions is the maximum number of environments that can be
 // provisioned in parallel. This prevents overwhelming the Kubernetes API.
 const MaxConcurrentProvisions = 10
@@ -73,46 +223,144 @@ const (
 	podPhaseRunning = "Running"
 )
 
-// New creates a new orchestrator instance
-func New(k8sClient k8s.ClientInterface, cfg *config.Config, log *logger.Logger, db *database.DB) *Orchestrator {
+// New creates a new orchestrator instance that runs all environments on a single cluster
+func New(k8sClient k8s.ClientInterface, cfg *config.Config, log *logger.Logger, db *database.DB, opts ...Option) *Orchestrator {
+	return NewWithClusters(k8s.SingleCluster(cfg.Kubernetes.EffectiveDefaultCluster(), k8sClient), cfg, log, db, opts...)
+}
+
+// NewWithClusters creates a new orchestrator instance that places environments on the given clusters
+func NewWithClusters(clusters *k8s.Clusters, cfg *config.Config, log *logger.Logger, db *database.DB, opts ...Option) *Orchestrator {
+	settings := defaultOptions()
+	for _, opt := range opts {
+		opt(&settings)
+	}
+
 	o := &Orchestrator{
-		k8sClient:              k8sClient,
-		config:                 cfg,
+		clusters:               clusters,
 		logger:                 log,
 		db:                     db,
 		environments:           make(map[string]*models.Environment),
 		namespacePrefix:        cfg.Kubernetes.NamespacePrefix,
-		provisionSem:           make(chan struct{}, MaxConcurrentProvisions),
-		execSem:                make(chan struct{}, MaxConcurrentExecutions),
+		provisionSlots:         newSlotQueue(QueueProvisioning, settings.provisionConcurrency, settings.clock),
+		execSlots:              newSlotQueue(QueueExecutions, MaxConcurrentExecutions, settings.clock),
 		executions:             make(map[string]*models.Execution),
+		execCallbacks:          make(map[string]*callbackTarget),
+		execCacheKeys:          make(map[string]*execCacheTarget),
+		execWaiters:            make(map[string]*executionWaiter),
+		envWatchers:            make(map[string]map[*environmentWatcher]struct{}),
+		execQueues:             make(map[string]*execQueue),
 		standbyPool:            make(map[string][]*StandbyPod),
-		replenishEnvLocks:      make(map[string]*sync.Mutex),
+		poolInflight:           make(map[string]int),
+		poolGeneration:         make(map[string]int),
+		poolDrained:            make(map[string]bool),
+		poolReadyReached:       make(map[string]bool),
+		poolTrigger:            make(chan struct{}, 1),
 		poolStopChan:           make(chan struct{}),
 		reconciliationStopChan: make(chan struct{}),
+		retentionStopChan:      make(chan struct{}),
+		statsCache:             make(map[string]*executionStatsCacheEntry),
+		groups:                 make(map[string]*models.EnvironmentGroup),
+		pipelines:              make(map[string]*pipelineRun),
+		operations:             make(map[string]*models.Operation),
+		idleStopChan:           make(chan struct{}),
+		snapshotStopChan:       make(chan struct{}),
+		reservations:           make(map[string]*models.Reservation),
+		reservationStopChan:    make(chan struct{}),
+		placeholderSlots:       make(map[string]int),
+		activeSessions:         make(map[string]int),
+		idleWarnings:           make(map[string]time.Time),
+		capacityCache:          make(map[string]*capacityCacheEntry),
+		cacheSyncStopChan:      make(chan struct{}),
+		podWatches:             make(map[string]*podWatchState),
+		podWatchStopChan:       make(chan struct{}),
+		callbackStopChan:       make(chan struct{}),
+		podStatusCache:         make(map[string]*podStatusCacheEntry),
+		logShippers:            make(map[string]*logShipper),
+		clock:                  settings.clock,
+		poolInterval:           settings.poolInterval,
+		backgroundLoops:        settings.backgroundLoops,
+		storage:                settings.storage,
+		provisioning:           make(map[string]chan struct{}),
+	}
+	o.config.Store(cfg)
+	for _, name := range clusters.Names() {
+		o.podWatches[name] = &podWatchState{cluster: name, phases: make(map[string]corev1.PodPhase)}
 	}
 
 	// Load environments and executions from database on startup
 	if db != nil {
 		ctx := context.Background()
+		o.startCacheSync()
 		if err := o.loadFromDatabase(ctx); err != nil {
 			log.Error("failed to load from database on startup", zap.Error(err))
 		}
+		// Oneshot environments whose command was running keep being watched for its completion
+		o.resumeOneShots()
 	}
 
-	// Start pool replenishment loop so per-environment standby pools work (env.Pool.Enabled);
+	if !settings.backgroundLoops {
+		return o
+	}
+
+	// Start the pool replenishment worker so per-environment standby pools work (env.Pool.Enabled);
 	// when no env has pool enabled, replenishPool() is a no-op.
 	go o.runPoolReplenishment()
 
 	// Start reconciliation loop (handles pending/failed envs and missing pods)
 	go o.runReconciliationLoop()
 
+	// Start the retention janitor of executions and events (no-op when no retention limits are configured)
+	go o.runRetentionLoop()
+
+	// Start the idle reaper (no-op while no environment has an idle timeout)
+	go o.runIdleReaperLoop()
+
+	// Start the workspace snapshot scheduler (no-op while no environment opts in)
+	go o.runSnapshotLoop()
+
+	// Start the reservation loop (no-op while no reservation is open)
+	go o.runReservationLoop()
+
+	// Start the environment cache sync (no-op without a database)
+	go o.runCacheSyncLoop()
+
+	// Watch the managed pods of every cluster so reading an environment's status stays local
+	for _, name := range clusters.Names() {
+		client, _ := clusters.Get(name)
+		go o.runPodWatch(name, client)
+	}
+
 	return o
 }
 
+// cfg returns the current configuration
+func (o *Orchestrator) cfg() *config.Config {
+	return o.config.Load()
+}
+
+// UpdateConfig applies a reloaded configuration. Timeouts, pool, reconciliation and retention
+// settings are read on each use and take effect immediately; settings captured at construction
+// (namespace prefix, clusters) are not affected.
+func (o *Orchestrator) UpdateConfig(cfg *config.Config) {
+	o.config.Store(cfg)
+}
+
 // Stop gracefully shuts down the orchestrator
 func (o *Orchestrator) Stop() {
 	close(o.poolStopChan)
 	close(o.reconciliationStopChan)
+	close(o.retentionStopChan)
+	close(o.idleStopChan)
+	close(o.snapshotStopChan)
+	close(o.reservationStopChan)
+	close(o.cacheSyncStopChan)
+	close(o.podWatchStopChan)
+	close(o.callbackStopChan)
+	if !o.backgroundLoops {
+		// The replenishment worker cleans the pool up on stop when it runs
+		o.cleanupPool()
+	}
+	o.stopAllLogShipping()
 }
 
 // loadFromDatabase loads all environments and executions from the database
@@ -154,33 +402,137 @@ func (o *Orchestrator) loadFromDatabase(ctx context.Context) error {
 
 // CreateEnvironment creates a new isolated environment
 func (o *Orchestrator) CreateEnvironment(ctx context.Context, req *models.CreateEnvironmentRequest, userID string) (*models.Environment, error) {
+	return o.createEnvironment(ctx, req, userID, "")
+}
+
+// createEnvironment creates an environment, as a replica of the group groupID when it is set
+func (o *Orchestrator) createEnvironment(ctx context.Context, req *models.CreateEnvironmentRequest, userID, groupID string) (_ *models.Environment, err error) {
+	ctx, span := tracing.Start(ctx, "orchestrator.CreateEnvironment")
+	defer func() { tracing.End(span, err) }()
+
+	// An environment of a reservation takes the place of one of its placeholder pods: it runs on
+	// the reservation's cluster and nodes, and gives the environment back if it is not created
 	envID := generateEnvironmentID()
+	var reservation *models.Reservation
+	placeholderSlot := 0
+	nodeSelector := req.NodeSelector
+	if req.ReservationID != "" {
+		if reservation, placeholderSlot, err = o.claimReservation(ctx, req, userID, envID); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				o.releaseReservation(context.WithoutCancel(ctx), reservation.ID, envID)
+			}
+		}()
+		if len(nodeSelector) == 0 {
+			nodeSelector = reservation.NodeSelector
+		}
+	}
+
+	cluster := req.Cluster
+	if reservation != nil {
+		cluster = reservation.Cluster
+	}
+	if cluster == "" {
+		cluster = o.clusters.DefaultName()
+	}
+	if !o.clusters.Has(cluster) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeUnknownCluster, "unknown cluster %q (configured: %s)", cluster, strings.Join(o.clusters.Names(), ", "))
+	}
+
+	if req.Build != nil && !o.cfg().Builds.Enabled {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBuildsNotEnabled, "image builds are not enabled on this server")
+	}
+	if err := o.checkLogShipping(req.LogShipping); err != nil {
+		return nil, err
+	}
+	if err := o.checkWorkspaceSnapshots(req.WorkspaceSnapshots); err != nil {
+		return nil, err
+	}
+	// The request may be shared (group replicas); the environment keeps its own resolved copy
+	isolation := req.Isolation.DeepCopy()
+	if err := o.ExpandNetworkPreset(isolation); err != nil {
+		return nil, err
+	}
+	if err := o.checkPriorityClass(isolation); err != nil {
+		return nil, err
+	}
+	if err := o.checkServiceAccount(isolation); err != nil {
+		return nil, err
+	}
+	if err := o.checkLifecycle(req.Lifecycle); err != nil {
+		return nil, err
+	}
+
+	var schedulingWarning string
+	if o.cfg().Resources.CapacityCheck {
+		warning, err := o.checkCapacity(ctx, cluster, req)
+		if err != nil {
+			return nil, err
+		}
+		schedulingWarning = warning
+	}
+
 	namespace := o.generateNamespace(envID)
+	span.SetAttributes(attribute.String("environment.id", envID), attribute.String("k8s.cluster.name", cluster))
+	// Catch an unusable namespace prefix before the environment is persisted
+	if err := k8s.ValidateNamespaceName(namespace); err != nil {
+		return nil, apierrors.Wrap(apierrors.ValidationFailed, apierrors.CodeInvalidNamespace, err,
+			"cannot create a namespace for the environment; check kubernetes.namespace_prefix")
+	}
+	now := o.clock.Now()
 
 	env := &models.Environment{
-		ID:           envID,
-		Name:         req.Name,
-		Status:       models.StatusPending,
-		Image:        req.Image,
-		CreatedAt:    time.Now(),
-		Resources:    req.Resources,
-		Namespace:    namespace,
-		Env:          req.Env,
-		Command:      req.Command,
-		Labels:       req.Labels,
-		Timeout:      req.Timeout,
-		UserID:       userID,
-		NodeSelector: req.NodeSelector,
-		Tolerations:  req.Tolerations,
-		Isolation:    req.Isolation,
-		Pool:         req.Pool,
-		Endpoint:     fmt.Sprintf("ws://localhost:8080/api/v1/environments/%s/attach", envID),
-	}
-
-	// Store environment in memory and database
-	o.envMutex.Lock()
-	o.environments[envID] = env
-	o.envMutex.Unlock()
+		ID:               envID,
+		Name:             req.Name,
+		Status:           models.StatusPending,
+		Phase:            models.PhaseQueued,
+		Image:            req.Image,
+		CreatedAt:        now,
+		LastActivityAt:   &now,
+		Resources:        req.Resources,
+		Namespace:        namespace,
+		Env:              req.Env,
+		Command:          req.Command,
+		Labels:           req.Labels,
+		Timeout:          req.Timeout,
+		UserID:           userID,
+		TeamID:           req.TeamID,
+		Cluster:          cluster,
+		NodeSelector:     nodeSelector,
+		Tolerations:      req.Tolerations,
+		Affinity:         req.Affinity,
+		Isolation:        isolation,
+		Pool:             req.Pool,
+		CommandPolicy:    req.CommandPolicy,
+		ReadinessCheck:   req.ReadinessCheck,
+		Lifecycle:        req.Lifecycle.DeepCopy(),
+		IdleTimeout:      req.IdleTimeout,
+		RecordSessions:   req.RecordSessions,
+		ExecMode:         effectiveExecMode(req.ExecMode),
+		GroupID:          groupID,
+		Mode:             effectiveEnvironmentMode(req.Mode),
+		RetentionSeconds: req.RetentionSeconds,
+		Build:            req.Build,
+		LogShipping:      req.LogShipping,
+		Metadata:         req.Metadata,
+		ReservationID:    req.ReservationID,
+	}
+	if !req.WorkspaceSnapshots.IsEmpty() {
+		env.WorkspaceSnapshots = req.WorkspaceSnapshots
+	}
+	setDNSPolicyDefault(env.Isolation)
+
+	// Store environment in memory (unless a guardrail refuses it) and database
+	if err := o.admitEnvironment(env); err != nil {
+		return nil, err
+	}
+	if reservation != nil {
+		o.reservationMutex.Lock()
+		o.placeholderSlots[envID] = placeholderSlot
+		o.reservationMutex.Unlock()
+	}
 
 	// Save to database
 	if o.db != nil {
@@ -188,27 +540,47 @@ func (o *Orchestrator) CreateEnvironment(ctx context.Context, req *models.Create
 			o.logger.Error("failed to save environment to database", zap.Error(err), zap.String("environment_id", envID))
 			// Continue even if database save fails
 		}
+		o.logActivityEvent(ctx, envID, userID, eventTypeCreated, "Environment created", "")
+		o.logReconciliationEvent(envID, "provisioning_phase", "Provisioning phase: "+string(models.PhaseQueued), "0s since creation")
+		o.recordNetworkPreset(envID, env.Isolation)
 	}
 
+	// Return a deep copy of the environment to avoid race conditions
+	// The caller should not hold a reference to the same struct that the goroutine modifies
+	envCopy := env.DeepCopy()
+	envCopy.SchedulingWarning = schedulingWarning
+	envCopy.EstimatedStart = o.provisionSlots.estimatedStart()
+
 	// Create Kubernetes resources asynchronously with timeout
 	// Capture envID in local variable to avoid race condition
 	provisionEnvID := envID
-	provisionCtx, cancel := context.WithTimeout(context.Background(), time.Duration(o.config.Timeouts.StartupTimeout)*time.Second)
+	provisionCtx, cancel := context.WithTimeout(context.Background(), o.provisionTimeout(env))
+	requestSpan := trace.SpanContextFromContext(ctx)
+	provisioned := o.trackProvisioning(provisionEnvID)
 	go func() {
+		defer provisioned()
 		defer cancel()
+		provisionCtx, span := tracing.StartLinked(provisionCtx, requestSpan, "orchestrator.provision",
+			attribute.String("environment.id", provisionEnvID))
+		var provisionErr error
+		defer func() { tracing.End(span, provisionErr) }()
+		log := o.logger.With(tracing.LogFields(provisionCtx)...)
 
 		// Acquire semaphore to limit concurrent provisioning
-		select {
-		case o.provisionSem <- struct{}{}:
-			// Acquired semaphore, release it when done
-			defer func() { <-o.provisionSem }()
-		case <-provisionCtx.Done():
-			o.logger.Error("timeout waiting to start provisioning",
+		_, waitSpan := tracing.Start(provisionCtx, "provision.wait_for_slot")
+		release, err := o.provisionSlots.acquire(provisionCtx, provisionEnvID)
+		if err != nil {
+			provisionErr = err
+			tracing.End(waitSpan, provisionErr)
+			log.Error("timeout waiting to start provisioning",
 				zap.String("environment_id", provisionEnvID),
 			)
 			o.updateEnvironmentStatus(provisionEnvID, models.StatusFailed)
 			return
 		}
+		waitSpan.End()
+		// Acquired a slot, release it when done
+		defer release()
 
 		// Re-acquire the environment from map to ensure we have the latest reference
 		o.envMutex.RLock()
@@ -216,77 +588,108 @@ func (o *Orchestrator) CreateEnvironment(ctx context.Context, req *models.Create
 		o.envMutex.RUnlock()
 
 		if !exists {
-			o.logger.Warn("environment not found during provisioning",
+			log.Warn("environment not found during provisioning",
 				zap.String("environment_id", provisionEnvID),
 			)
 			return
 		}
 
-		if err := o.provisionEnvironment(provisionCtx, provisionEnv); err != nil {
-			o.logger.Error("failed to provision environment",
+		if provisionErr = o.provisionEnvironment(provisionCtx, provisionEnv); provisionErr != nil {
+			log.Error("failed to provision environment",
 				zap.String("environment_id", provisionEnvID),
-				zap.Error(err),
+				zap.Error(provisionErr),
 			)
 			o.updateEnvironmentStatus(provisionEnvID, models.StatusFailed)
 		}
 	}()
 
-	// Return a copy of the environment to avoid race conditions
-	// The caller should not hold a reference to the same struct that the goroutine modifies
-	envCopy := *env
-	return &envCopy, nil
+	return envCopy, nil
 }
 
 // provisionEnvironment creates the Kubernetes resources
-func (o *Orchestrator) provisionEnvironment(ctx context.Context, env *models.Environment) error {
+func (o *Orchestrator) provisionEnvironment(ctx context.Context, env *models.Environment) (err error) {
 	// Capture values from env to avoid race conditions
 	envID := env.ID
 	envNamespace := env.Namespace
 	envImage := env.Image
 	envCommand := env.Command
 	envResources := env.Resources
-	envEnvVars := env.Env
+	envEnvVars := o.mainPodEnv(ctx, env)
 	envLabels := env.Labels
 	envNodeSelector := env.NodeSelector
 	envTolerations := env.Tolerations
+	envAffinity := env.Affinity
 	envIsolation := env.Isolation
+	envReadinessCheck := env.ReadinessCheck
+	envLifecycle := env.Lifecycle.DeepCopy()
+	envOneShot := env.IsOneShot()
+	envPrewarm := env.Pool != nil && env.Pool.Enabled && env.Pool.PrewarmOnCreate
+	envBuild := env.Build
+	envReservationID := env.ReservationID
+
+	client, err := o.clientFor(env)
+	if err != nil {
+		return err
+	}
+
+	// Build the image first; a retry after a successful build reuses the image
+	if envImage == "" && envBuild != nil {
+		if envImage, err = o.buildEnvironmentImage(ctx, client, envID, envBuild); err != nil {
+			return err
+		}
+	}
 
 	// Create namespace
-	labels := map[string]string{
+	labels := podLabels(map[string]string{
 		"app":        "agentbox",
 		"env-id":     envID,
 		"managed-by": "agentbox",
-	}
-	for k, v := range envLabels {
-		labels[k] = v
-	}
-
-	if err := o.k8sClient.CreateNamespace(ctx, envNamespace, labels); err != nil {
+	}, envLabels)
+
+	// Waiting for a previous namespace moves the provisioning deadline back by the time waited
+	var waited time.Duration
+	if err := tracing.WithSpan(ctx, "provision.wait_for_previous_namespace", func(ctx context.Context) (err error) {
+		waited, err = o.waitForPreviousNamespace(ctx, client, envID, envNamespace)
+		return err
+	}); err != nil {
+		return err
+	}
+	ctx, cancelWait := extendDeadline(ctx, waited)
+	defer cancelWait()
+
+	o.setEnvironmentPhase(envID, models.PhaseCreatingNamespace)
+	if err := tracing.WithSpan(ctx, "provision.create_namespace", func(ctx context.Context) error {
+		return client.CreateNamespace(ctx, envNamespace, labels)
+	}); err != nil {
 		return fmt.Errorf("failed to create namespace: %w", err)
 	}
+	o.namespacesCreated.Add(1)
 
 	// Create resource quota: main pod + at least one exec pod (+ standby pool if enabled)
-	quotaMultiplier := 2 // main + 1 ephemeral exec
-	if env.Pool != nil && env.Pool.Enabled && env.Pool.Size > 0 {
-		quotaMultiplier += env.Pool.Size
-	}
-	quotaCPU := multiplyResourceQuantity(envResources.CPU, quotaMultiplier)
-	quotaMemory := multiplyResourceQuantity(envResources.Memory, quotaMultiplier)
-	if err := o.k8sClient.CreateResourceQuota(
-		ctx,
-		envNamespace,
-		quotaCPU,
-		quotaMemory,
-		envResources.Storage,
-	); err != nil {
+	multiplier := quotaMultiplier(env.Pool)
+	quotaCPU := multiplyResourceQuantity(envResources.CPU, multiplier)
+	quotaMemory := multiplyResourceQuantity(envResources.Memory, multiplier)
+	o.setEnvironmentPhase(envID, models.PhaseApplyingQuota)
+	if err := tracing.WithSpan(ctx, "provision.apply_quota", func(ctx context.Context) error {
+		return client.CreateResourceQuota(ctx, envNamespace, quotaCPU, quotaMemory, envResources.Storage)
+	}); err != nil {
 		return fmt.Errorf("failed to create resource quota: %w", err)
 	}
 
 	// Apply network policy with isolation config
-	if err := o.applyNetworkPolicyWithConfig(ctx, envNamespace, envIsolation); err != nil {
+	o.setEnvironmentPhase(envID, models.PhaseApplyingNetworkPolicy)
+	if err := tracing.WithSpan(ctx, "provision.apply_network_policy", func(ctx context.Context) error {
+		return o.applyNetworkPolicyWithConfig(ctx, client, envNamespace, envIsolation)
+	}); err != nil {
 		return fmt.Errorf("failed to apply network policy: %w", err)
 	}
 
+	if err := tracing.WithSpan(ctx, "provision.apply_service_account", func(ctx context.Context) error {
+		return o.applyServiceAccount(ctx, client, envNamespace, envIsolation)
+	}); err != nil {
+		return fmt.Errorf("failed to apply service account: %w", err)
+	}
+
 	// Create pod
 	podName := "main"
 	command := envCommand
@@ -294,78 +697,132 @@ func (o *Orchestrator) provisionEnvironment(ctx context.Context, env *models.Env
 		command = []string{"/bin/sh", "-c", "sleep infinity"}
 	}
 
-	// Convert model tolerations to k8s tolerations
-	var k8sTolerations []k8s.Toleration
-	for _, t := range envTolerations {
-		k8sTolerations = append(k8sTolerations, k8s.Toleration{
-			Key:               t.Key,
-			Operator:          t.Operator,
-			Value:             t.Value,
-			Effect:            t.Effect,
-			TolerationSeconds: t.TolerationSeconds,
-		})
-	}
+	k8sTolerations := toK8sTolerations(envTolerations)
 
 	// Determine runtime class (per-environment overrides global)
-	runtimeClass := o.config.Kubernetes.RuntimeClass
+	runtimeClass := o.cfg().Kubernetes.RuntimeClass
 	if envIsolation != nil && envIsolation.RuntimeClass != "" {
 		runtimeClass = envIsolation.RuntimeClass
 	}
 
 	// Convert security context if provided
 	var securityContext *k8s.SecurityContext
-	if envIsolation != nil && envIsolation.SecurityContext != nil {
-		securityContext = &k8s.SecurityContext{
-			RunAsUser:                envIsolation.SecurityContext.RunAsUser,
-			RunAsGroup:               envIsolation.SecurityContext.RunAsGroup,
-			RunAsNonRoot:             envIsolation.SecurityContext.RunAsNonRoot,
-			ReadOnlyRootFilesystem:   envIsolation.SecurityContext.ReadOnlyRootFilesystem,
-			AllowPrivilegeEscalation: envIsolation.SecurityContext.AllowPrivilegeEscalation,
-		}
+	if envIsolation != nil {
+		securityContext = toK8sSecurityContext(envIsolation.SecurityContext)
 	}
 
 	podSpec := &k8s.PodSpec{
-		Name:            podName,
-		Namespace:       envNamespace,
-		Image:           envImage,
-		Command:         command,
-		Env:             envEnvVars,
-		CPU:             envResources.CPU,
-		Memory:          envResources.Memory,
-		Storage:         envResources.Storage,
-		RuntimeClass:    runtimeClass,
-		Labels:          labels,
-		NodeSelector:    envNodeSelector,
-		Tolerations:     k8sTolerations,
-		SecurityContext: securityContext,
-	}
-
-	if err := o.k8sClient.CreatePod(ctx, podSpec); err != nil {
+		Name:                         podName,
+		Namespace:                    envNamespace,
+		Image:                        envImage,
+		Command:                      command,
+		Env:                          envEnvVars,
+		CPU:                          envResources.CPU,
+		Memory:                       envResources.Memory,
+		Storage:                      envResources.Storage,
+		RuntimeClass:                 runtimeClass,
+		PriorityClassName:            o.priorityClassFor(envIsolation, podTypeMain),
+		ServiceAccountName:           serviceAccountName(envIsolation),
+		AutomountServiceAccountToken: automountServiceAccountToken(envIsolation),
+		Labels:                       labels,
+		NodeSelector:                 envNodeSelector,
+		Tolerations:                  k8sTolerations,
+		Affinity:                     toK8sAffinity(envAffinity),
+		SecurityContext:              securityContext,
+		DNS:                          toK8sDNS(envIsolation),
+	}
+	applyLifecycle(podSpec, envLifecycle)
+
+	o.setEnvironmentPhase(envID, models.PhaseCreatingPod)
+	o.takePlaceholder(ctx, envID, envReservationID)
+	if err := tracing.WithSpan(ctx, "provision.create_pod", func(ctx context.Context) error {
+		return client.CreatePod(ctx, podSpec)
+	}); err != nil {
 		return fmt.Errorf("failed to create pod: %w", err)
 	}
 
-	// Wait for pod to be running
-	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(o.config.Timeouts.StartupTimeout)*time.Second)
+	if envOneShot {
+		// The command may complete before the pod is ever seen running; awaitOneShot waits for
+		// its completion instead
+		o.updateEnvironmentStatus(envID, models.StatusRunning)
+		o.setEnvironmentPhase(envID, models.PhaseReady)
+		o.startLogShipping(envID)
+		o.logger.Info("oneshot environment started",
+			zap.String("environment_id", envID),
+			zap.String("namespace", envNamespace),
+		)
+		go o.awaitOneShot(envID)
+		return nil
+	}
+
+	// Start the standby pods while the main pod starts rather than once the environment runs
+	if envPrewarm {
+		o.prewarmStandbyPool(envID)
+		defer func() {
+			if err != nil {
+				o.discardStandbyPool(envID)
+			}
+		}()
+	}
+
+	// Wait for pod to be running, tracking image pull / container start progress meanwhile
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(o.cfg().Timeouts.StartupTimeout)*time.Second)
 	defer cancel()
 
-	if err := o.k8sClient.WaitForPodRunning(waitCtx, envNamespace, podName); err != nil {
+	err = tracing.WithSpan(waitCtx, "provision.wait_pod_running", func(waitCtx context.Context) error {
+		watchCtx, stopWatch := context.WithCancel(waitCtx)
+		watchDone := make(chan struct{})
+		go func() {
+			defer close(watchDone)
+			o.watchPodStartup(watchCtx, client, envID, envNamespace, podName)
+		}()
+		err := client.WaitForPodRunning(waitCtx, envNamespace, podName)
+		stopWatch()
+		<-watchDone
+		return err
+	})
+	if err != nil {
 		return fmt.Errorf("pod failed to start: %w", err)
 	}
 
+	// Gate Running on the environment's readiness check, if any
+	if check := envReadinessCheck; check != nil {
+		o.setEnvironmentPhase(envID, models.PhaseWaitingReady)
+		var output string
+		err := tracing.WithSpan(waitCtx, "provision.wait_ready", func(waitCtx context.Context) error {
+			var err error
+			output, err = o.waitForReady(waitCtx, client, envNamespace, podName, check)
+			return err
+		})
+		if err != nil {
+			o.envMutex.Lock()
+			if e, exists := o.environments[envID]; exists {
+				e.StatusMessage = "readiness check failed: " + output
+			}
+			o.envMutex.Unlock()
+			o.logReconciliationEvent(envID, "readiness_failed", "Readiness check failed", output)
+			return fmt.Errorf("environment failed readiness check: %w", err)
+		}
+	}
+
 	// Update environment status
 	// Use captured envID to avoid accessing env fields
-	now := time.Now()
+	now := o.clock.Now()
 	o.envMutex.Lock()
 	var poolEnabled bool
 	if e, exists := o.environments[envID]; exists {
 		// Create a new time value to avoid sharing the pointer
 		startedAt := now
 		e.Status = models.StatusRunning
+		e.StatusMessage = ""
 		e.StartedAt = &startedAt
 		// Check if pool is enabled for this environment
 		poolEnabled = e.Pool != nil && e.Pool.Enabled
 	}
 	o.envMutex.Unlock()
+	o.setEnvironmentPhase(envID, models.PhaseReady)
+	o.notifyEnvironmentStatus(envID)
+	o.startLogShipping(envID)
 
 	// Use captured values to avoid accessing env fields after unlock
 	o.logger.Info("environment provisioned successfully",
@@ -375,7 +832,7 @@ func (o *Orchestrator) provisionEnvironment(ctx context.Context, env *models.Env
 
 	// If environment has pool enabled, trigger immediate pool replenishment
 	if poolEnabled {
-		go o.replenishPool()
+		o.triggerReplenish()
 	}
 
 	return nil
@@ -383,43 +840,80 @@ func (o *Orchestrator) provisionEnvironment(ctx context.Context, env *models.Env
 
 // refreshEnvironmentStatusFromK8s updates env status from the main pod when appropriate;
 // returns a copy of env with possibly updated status and updates in-memory (and DB if updateDB).
+// While the environment's cluster is unreachable the copy reports StatusDegraded (not persisted).
 func (o *Orchestrator) refreshEnvironmentStatusFromK8s(ctx context.Context, envID string, env *models.Environment, updateDB bool) models.Environment {
-	envCopy := *env
-	if env.Status == models.StatusRunning {
-		pod, err := o.k8sClient.GetPod(ctx, env.Namespace, "main")
+	// Copy under the lock: provisioning updates the phase of the stored environment concurrently
+	o.envMutex.RLock()
+	envCopy := *env.DeepCopy()
+	o.envMutex.RUnlock()
+	client, err := o.clientFor(&envCopy)
+	if err != nil || !o.clusters.Reachable(envCopy.Cluster) {
+		if envCopy.Status == models.StatusRunning || envCopy.Status == models.StatusPending {
+			envCopy.Status = models.StatusDegraded
+		}
+		return envCopy
+	}
+	if envCopy.IsOneShot() {
+		// awaitOneShot records the end of the command together with its result
+		return envCopy
+	}
+	if envCopy.Status == models.StatusRunning {
+		phase, err := o.mainPodPhase(ctx, client, &envCopy)
 		if err == nil {
-			newStatus := convertPodPhaseToStatus(string(pod.Status.Phase))
-			if newStatus != models.StatusPending || pod.Status.Phase == podPhasePending {
+			newStatus := convertPodPhaseToStatus(string(phase))
+			if newStatus != models.StatusPending || phase == podPhasePending {
 				envCopy.Status = newStatus
 				o.envMutex.Lock()
-				if e, ok := o.environments[envID]; ok {
+				e, ok := o.environments[envID]
+				changed := ok && e.Status != newStatus
+				if ok {
 					e.Status = newStatus
 				}
 				o.envMutex.Unlock()
+				if changed {
+					o.notifyEnvironmentStatus(envID)
+					if newStatus == models.StatusFailed {
+						o.notifyEnvironmentFailed(envID)
+					}
+				}
 			}
 		}
-	} else if env.Status == models.StatusPending || env.Status == models.StatusFailed {
-		pod, err := o.k8sClient.GetPod(ctx, env.Namespace, "main")
-		if err == nil && pod.Status.Phase == podPhaseRunning {
+	} else if (envCopy.Status == models.StatusPending || envCopy.Status == models.StatusFailed) &&
+		(envCopy.ReadinessCheck == nil || envCopy.Phase == models.PhaseReady) {
+		// A running pod is not enough for environments with a readiness check: only provisioning
+		// marks them Running once the check has passed
+		phase, err := o.mainPodPhase(ctx, client, &envCopy)
+		if err == nil && phase == podPhaseRunning {
 			envCopy.Status = models.StatusRunning
 			if updateDB {
 				o.updateEnvironmentStatus(envID, models.StatusRunning)
 			} else {
 				o.envMutex.Lock()
-				if e, ok := o.environments[envID]; ok {
+				e, ok := o.environments[envID]
+				changed := ok && e.Status != models.StatusRunning
+				if ok {
 					e.Status = models.StatusRunning
 				}
 				o.envMutex.Unlock()
+				if changed {
+					o.notifyEnvironmentStatus(envID)
+				}
+			}
+			// The replenishment provisioning triggered may have run while the cached environment
+			// still read pending (a concurrent reload from the database), so ask again
+			if envCopy.Pool != nil && envCopy.Pool.Enabled {
+				o.triggerReplenish()
 			}
 		}
 	}
 	return envCopy
 }
 
-// getEnvironmentReconciliationRetriesLeft returns maxRetries - count, clamped to >= 0.
+// getEnvironmentReconciliationRetriesLeft returns maxRetries - count, clamped to >= 0, or -1
+// when retries are unlimited (maxRetries < 0).
 func getEnvironmentReconciliationRetriesLeft(maxRetries int, count int) int {
 	if maxRetries < 0 {
-		maxRetries = 0
+		return -1
 	}
 	left := maxRetries - count
 	if left < 0 {
@@ -437,14 +931,15 @@ func (o *Orchestrator) GetEnvironment(ctx context.Context, envID string) (*model
 			o.envMutex.Lock()
 			delete(o.environments, envID)
 			o.envMutex.Unlock()
-			return nil, fmt.Errorf("environment not found")
+			return nil, errEnvironmentNotFound
 		}
 		o.envMutex.Lock()
 		o.environments[envID] = env
 		o.envMutex.Unlock()
 
 		envCopy := o.refreshEnvironmentStatusFromK8s(ctx, envID, env, true)
-		envCopy.ReconciliationRetriesLeft = getEnvironmentReconciliationRetriesLeft(o.config.Reconciliation.MaxRetries, envCopy.ReconciliationRetryCount)
+		envCopy.ReconciliationRetriesLeft = getEnvironmentReconciliationRetriesLeft(o.cfg().Reconciliation.EffectiveMaxRetries(), envCopy.ReconciliationRetryCount)
+		o.setPoolReady(&envCopy)
 		return &envCopy, nil
 	}
 
@@ -452,19 +947,90 @@ func (o *Orchestrator) GetEnvironment(ctx context.Context, envID string) (*model
 	env, exists := o.environments[envID]
 	o.envMutex.RUnlock()
 	if !exists {
-		return nil, fmt.Errorf("environment not found")
+		return nil, errEnvironmentNotFound
 	}
 
 	envCopy := o.refreshEnvironmentStatusFromK8s(ctx, envID, env, false)
-	envCopy.ReconciliationRetriesLeft = getEnvironmentReconciliationRetriesLeft(o.config.Reconciliation.MaxRetries, envCopy.ReconciliationRetryCount)
+	envCopy.ReconciliationRetriesLeft = getEnvironmentReconciliationRetriesLeft(o.cfg().Reconciliation.EffectiveMaxRetries(), envCopy.ReconciliationRetryCount)
+	o.setPoolReady(&envCopy)
 	return &envCopy, nil
 }
 
+// ListEnvironmentsOptions holds the filters and pagination for ListEnvironmentsWithOptions
+type ListEnvironmentsOptions struct {
+	Status        *models.EnvironmentStatus
+	LabelSelector string
+	TeamID        string
+	GroupID       string
+	// UserID lists only the environments this user owns
+	UserID string
+	Limit  int
+	// Offset is deprecated in favor of PageToken, which does not skip or repeat environments
+	// when others are created or deleted between pages
+	Offset int
+	// PageToken resumes the listing after the last environment of the previous page
+	// (ListEnvironmentsResponse.NextPageToken). Requires the default sort and no offset.
+	PageToken string
+	// Sort orders results by "created_at" or "last_activity_at"; prefix "-" for descending.
+	// Empty is the default, newest first.
+	Sort string
+	// Metadata lists only the environments whose metadata holds all of these key/value pairs
+	Metadata map[string]string
+}
+
+// listEnvironmentsBatchSize is how many environments one database query reads while listing
+const listEnvironmentsBatchSize = 500
+
+// sortEnvironmentsByKey orders envs newest first by (created_at, id), the keyset order page
+// tokens resume from
+func sortEnvironmentsByKey(envs []*models.Environment) {
+	sort.Slice(envs, func(i, j int) bool {
+		if !envs[i].CreatedAt.Equal(envs[j].CreatedAt) {
+			return envs[i].CreatedAt.After(envs[j].CreatedAt)
+		}
+		return envs[i].ID > envs[j].ID
+	})
+}
+
+// sortEnvironments orders envs by the ListEnvironmentsOptions.Sort key
+func sortEnvironments(envs []*models.Environment, key string) error {
+	field, descending := strings.CutPrefix(key, "-")
+	var at func(env *models.Environment) time.Time
+	switch field {
+	case "created_at":
+		at = func(env *models.Environment) time.Time { return env.CreatedAt }
+	case "last_activity_at":
+		at = lastActivity
+	default:
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"invalid sort %q: must be created_at or last_activity_at, optionally prefixed with -", key)
+	}
+	sort.SliceStable(envs, func(i, j int) bool {
+		if descending {
+			return at(envs[i]).After(at(envs[j]))
+		}
+		return at(envs[i]).Before(at(envs[j]))
+	})
+	return nil
+}
+
 // ListEnvironments lists all environments from the database (source of truth) with optional filtering.
 // In-memory status is overlaid so live status (running/pending/failed) is shown.
 func (o *Orchestrator) ListEnvironments(
 	ctx context.Context, status *models.EnvironmentStatus, labelSelector string, limit, offset int,
 ) (*models.ListEnvironmentsResponse, error) {
+	return o.ListEnvironmentsWithOptions(ctx, ListEnvironmentsOptions{
+		Status:        status,
+		LabelSelector: labelSelector,
+		Limit:         limit,
+		Offset:        offset,
+	})
+}
+
+// ListEnvironmentsWithOptions is ListEnvironments with additional filters (e.g. team)
+func (o *Orchestrator) ListEnvironmentsWithOptions(ctx context.Context, opts ListEnvironmentsOptions) (*models.ListEnvironmentsResponse, error) {
+	status, labelSelector, limit, offset := opts.Status, opts.LabelSelector, opts.Limit, opts.Offset
+
 	// Validate pagination parameters
 	if limit <= 0 {
 		limit = 100 // Default limit
@@ -475,21 +1041,44 @@ func (o *Orchestrator) ListEnvironments(
 	if offset < 0 {
 		offset = 0
 	}
+	cursor, err := models.ParsePageToken(opts.PageToken)
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.ValidationFailed, apierrors.CodeBadRequest, err, "invalid page_token")
+	}
+	keyset := opts.Sort == "" || opts.Sort == "-created_at"
+	if cursor != nil && (!keyset || offset > 0) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"page_token cannot be combined with offset or a sort other than -created_at")
+	}
 
 	// List from database so deleted envs never appear (consistent across replicas)
+	filter := database.EnvironmentListFilter{TeamID: opts.TeamID, GroupID: opts.GroupID, UserID: opts.UserID, Metadata: opts.Metadata}
+	if o.db != nil && keyset && status == nil && labelSelector == "" {
+		// Every filter is in the query: read just this page, one extra row tells whether there is a next one
+		return o.listEnvironmentsPage(ctx, filter, cursor, offset, limit)
+	}
+
+	// The status (live, from memory) and label filters and the other sorts need every environment
 	var base []*models.Environment
 	if o.db != nil {
-		fromDB, err := o.db.ListEnvironments(ctx, 1000, 0)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list environments from database: %w", err)
+		var after *models.PageCursor
+		for {
+			batch, err := o.db.ListEnvironmentsFiltered(ctx, filter, after, listEnvironmentsBatchSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list environments from database: %w", err)
+			}
+			base = append(base, batch...)
+			if len(batch) < listEnvironmentsBatchSize {
+				break
+			}
+			last := batch[len(batch)-1]
+			after = &models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
 		}
-		base = fromDB
 	} else {
 		// No DB: fallback to in-memory only (e.g. tests)
 		o.envMutex.RLock()
 		for _, env := range o.environments {
-			envCopy := *env
-			base = append(base, &envCopy)
+			base = append(base, env.DeepCopy())
 		}
 		o.envMutex.RUnlock()
 	}
@@ -498,70 +1087,164 @@ func (o *Orchestrator) ListEnvironments(
 	o.envMutex.RLock()
 	filtered := make([]*models.Environment, 0, len(base))
 	for _, env := range base {
-		if inMem, ok := o.environments[env.ID]; ok {
-			env = inMem
-		}
+		env = o.liveEnvironmentLocked(env)
 		if status != nil && env.Status != *status {
 			continue
 		}
 		if labelSelector != "" && !matchesLabelSelector(env.Labels, labelSelector) {
 			continue
 		}
-		envCopy := *env
-		filtered = append(filtered, &envCopy)
+		if opts.TeamID != "" && env.TeamID != opts.TeamID {
+			continue
+		}
+		if opts.GroupID != "" && env.GroupID != opts.GroupID {
+			continue
+		}
+		if opts.UserID != "" && env.UserID != opts.UserID {
+			continue
+		}
+		if !matchesMetadata(env.Metadata, opts.Metadata) {
+			continue
+		}
+		filtered = append(filtered, env.DeepCopy())
 	}
 	o.envMutex.RUnlock()
 
+	if keyset {
+		sortEnvironmentsByKey(filtered)
+	} else if err := sortEnvironments(filtered, opts.Sort); err != nil {
+		return nil, err
+	}
 	total := len(filtered)
+
+	if cursor != nil {
+		next := len(filtered)
+		for i, env := range filtered {
+			if cursor.Precedes(env.CreatedAt, env.ID) {
+				next = i
+				break
+			}
+		}
+		filtered = filtered[next:]
+	}
+
 	start := offset
 	end := offset + limit
-	if start > total {
-		start = total
+	if start > len(filtered) {
+		start = len(filtered)
 	}
-	if end > total {
-		end = total
+	if end > len(filtered) {
+		end = len(filtered)
 	}
 
-	if start >= end {
-		return &models.ListEnvironmentsResponse{
-			Environments: []models.Environment{},
-			Total:        total,
-			Limit:        limit,
-			Offset:       offset,
-		}, nil
+	var nextPageToken string
+	if keyset && end < len(filtered) {
+		last := filtered[end-1]
+		nextPageToken = (&models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}).Token()
 	}
+	return o.environmentListPage(filtered[start:end], total, limit, offset, nextPageToken), nil
+}
 
-	page := filtered[start:end]
-	result := make([]models.Environment, 0, len(page))
-	maxRetries := o.config.Reconciliation.MaxRetries
-	if maxRetries < 0 {
-		maxRetries = 0
+// listEnvironmentsPage lists one page of the environments matching filter in the keyset order,
+// reading only that page (and one more row) from the database
+func (o *Orchestrator) listEnvironmentsPage(
+	ctx context.Context, filter database.EnvironmentListFilter, cursor *models.PageCursor, offset, limit int,
+) (*models.ListEnvironmentsResponse, error) {
+	envs, err := o.db.ListEnvironmentsPage(ctx, filter, cursor, offset, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments from database: %w", err)
+	}
+	total, err := o.db.CountEnvironments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count environments in database: %w", err)
+	}
+
+	var nextPageToken string
+	if len(envs) > limit {
+		envs = envs[:limit]
+		last := envs[limit-1]
+		nextPageToken = (&models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}).Token()
+	}
+	o.envMutex.RLock()
+	for i, env := range envs {
+		envs[i] = o.liveEnvironmentLocked(env).DeepCopy()
+	}
+	o.envMutex.RUnlock()
+	return o.environmentListPage(envs, total, limit, offset, nextPageToken), nil
+}
+
+// liveEnvironmentLocked returns the in-memory environment in place of env read from the
+// database, reported degraded while its cluster is unreachable. The result may be the cached
+// environment itself: callers copy it. o.envMutex must be held.
+func (o *Orchestrator) liveEnvironmentLocked(env *models.Environment) *models.Environment {
+	if inMem, ok := o.environments[env.ID]; ok {
+		env = inMem
+	}
+	if (env.Status == models.StatusRunning || env.Status == models.StatusPending) && !o.clusters.Reachable(env.Cluster) {
+		degraded := *env
+		degraded.Status = models.StatusDegraded
+		env = &degraded
 	}
+	return env
+}
+
+// environmentListPage builds the ListEnvironments response holding page
+func (o *Orchestrator) environmentListPage(page []*models.Environment, total, limit, offset int, nextPageToken string) *models.ListEnvironmentsResponse {
+	result := make([]models.Environment, 0, len(page))
+	maxRetries := o.cfg().Reconciliation.EffectiveMaxRetries()
 	for _, env := range page {
 		envCopy := *env
-		left := maxRetries - envCopy.ReconciliationRetryCount
-		if left < 0 {
-			left = 0
-		}
-		envCopy.ReconciliationRetriesLeft = left
+		envCopy.ReconciliationRetriesLeft = getEnvironmentReconciliationRetriesLeft(maxRetries, envCopy.ReconciliationRetryCount)
 		result = append(result, envCopy)
 	}
 
 	return &models.ListEnvironmentsResponse{
-		Environments: result,
-		Total:        total,
-		Limit:        limit,
-		Offset:       offset,
-	}, nil
+		Environments:  result,
+		Total:         total,
+		Limit:         limit,
+		Offset:        offset,
+		NextPageToken: nextPageToken,
+	}
 }
 
 // UpdateEnvironment applies a partial update to an environment (PATCH); only non-nil fields are updated
 func (o *Orchestrator) UpdateEnvironment(ctx context.Context, envID string, patch *models.UpdateEnvironmentRequest) (*models.Environment, error) {
+	if patch.IdleTimeout != nil && *patch.IdleTimeout < 0 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "idle_timeout cannot be negative")
+	}
+	if patch.ExecMode != nil && !validator.ValidExecMode(*patch.ExecMode) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"exec_mode must be %q or %q", models.ExecModeSerialized, models.ExecModeParallel)
+	}
+	if !patch.WorkspaceSnapshots.IsEmpty() {
+		if err := o.checkWorkspaceSnapshots(patch.WorkspaceSnapshots); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.ExpandNetworkPreset(patch.Isolation); err != nil {
+		return nil, err
+	}
+	if err := o.checkPriorityClass(patch.Isolation); err != nil {
+		return nil, err
+	}
+	if err := o.checkServiceAccount(patch.Isolation); err != nil {
+		return nil, err
+	}
+	if err := o.checkLifecycle(patch.Lifecycle); err != nil {
+		return nil, err
+	}
+
 	o.envMutex.Lock()
 	env, exists := o.environments[envID]
 	if !exists {
 		o.envMutex.Unlock()
-		return nil, fmt.Errorf("environment not found")
+		return nil, errEnvironmentNotFound
+	}
+	if env.IsOneShot() && ((patch.Pool != nil && patch.Pool.Enabled) || (patch.ReadinessCheck != nil && !patch.ReadinessCheck.IsEmpty()) ||
+		!patch.WorkspaceSnapshots.IsEmpty()) {
+		o.envMutex.Unlock()
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"oneshot environments cannot have a standby pool, a readiness check or workspace snapshots")
 	}
 	// Apply patch
 	if patch.Name != nil {
@@ -591,70 +1274,220 @@ func (o *Orchestrator) UpdateEnvironment(ctx context.Context, envID string, patc
 	if patch.Tolerations != nil {
 		env.Tolerations = *patch.Tolerations
 	}
+	if patch.Affinity != nil {
+		env.Affinity = patch.Affinity
+		if patch.Affinity.IsEmpty() {
+			env.Affinity = nil
+		}
+	}
 	if patch.Isolation != nil {
 		env.Isolation = patch.Isolation
+		setDNSPolicyDefault(env.Isolation)
 	}
 	if patch.Pool != nil {
 		env.Pool = patch.Pool
 	}
+	if patch.CommandPolicy != nil {
+		env.CommandPolicy = patch.CommandPolicy
+	}
+	if patch.ReadinessCheck != nil {
+		env.ReadinessCheck = patch.ReadinessCheck
+		if patch.ReadinessCheck.IsEmpty() {
+			env.ReadinessCheck = nil
+		}
+	}
+	if patch.Lifecycle != nil {
+		env.Lifecycle = patch.Lifecycle.DeepCopy()
+		if patch.Lifecycle.IsEmpty() {
+			env.Lifecycle = nil
+		}
+	}
+	if patch.IdleTimeout != nil {
+		env.IdleTimeout = *patch.IdleTimeout
+	}
+	if patch.RecordSessions != nil {
+		env.RecordSessions = *patch.RecordSessions
+	}
+	if patch.ExecMode != nil {
+		env.ExecMode = effectiveExecMode(*patch.ExecMode)
+	}
+	if patch.Metadata != nil {
+		env.Metadata = nil
+		if len(*patch.Metadata) > 0 {
+			env.Metadata = *patch.Metadata
+		}
+	}
+	if patch.WorkspaceSnapshots != nil {
+		env.WorkspaceSnapshots = patch.WorkspaceSnapshots
+		if patch.WorkspaceSnapshots.IsEmpty() {
+			env.WorkspaceSnapshots = nil
+		}
+	}
+	// Save and return a copy: provisioning and reconciliation keep updating env
+	envCopy := env.DeepCopy()
 	o.envMutex.Unlock()
 
 	if o.db != nil {
-		if err := o.db.SaveEnvironment(ctx, env); err != nil {
+		if err := o.db.SaveEnvironment(ctx, envCopy); err != nil {
 			o.logger.Error("failed to save updated environment to database", zap.Error(err), zap.String("environment_id", envID))
 			return nil, fmt.Errorf("failed to persist update: %w", err)
 		}
+		if patch.Isolation != nil {
+			o.recordNetworkPreset(envID, envCopy.Isolation)
+		}
+	}
+	if patch.Image != nil || patch.Env != nil {
+		o.invalidateExecutionCache(ctx, envID)
+	}
+	// Pods created from now on run with the new ServiceAccount, so it must exist in the namespace;
+	// the running main pod keeps its own until it is recreated
+	if patch.Isolation != nil && (envCopy.Status == models.StatusRunning || envCopy.Status == models.StatusDegraded) {
+		client, err := o.clientFor(envCopy)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.applyServiceAccount(ctx, client, envCopy.Namespace, envCopy.Isolation); err != nil {
+			return nil, fmt.Errorf("failed to apply service account: %w", err)
+		}
 	}
 
-	envCopy := *env
-	return &envCopy, nil
+	return envCopy, nil
+}
+
+// UpdateEnvironmentLabels adds and removes environment labels in one step, leaving the other
+// labels alone so clients managing different keys do not overwrite each other. The change is
+// persisted and applied to the live namespace and main pod; standby and execution pods created
+// afterwards carry the new labels. Reserved labels are rejected by the validator.
+func (o *Orchestrator) UpdateEnvironmentLabels(ctx context.Context, envID string, req *models.UpdateLabelsRequest) (*models.Environment, error) {
+	o.envMutex.Lock()
+	env, exists := o.environments[envID]
+	if !exists {
+		o.envMutex.Unlock()
+		return nil, errEnvironmentNotFound
+	}
+	labels := make(map[string]string, len(env.Labels)+len(req.Add))
+	for k, v := range env.Labels {
+		labels[k] = v
+	}
+	for _, k := range req.Remove {
+		delete(labels, k)
+	}
+	for k, v := range req.Add {
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	env.Labels = labels
+	envCopy := env.DeepCopy()
+	o.envMutex.Unlock()
+
+	if o.db != nil {
+		if err := o.db.SaveEnvironment(ctx, envCopy); err != nil {
+			o.logger.Error("failed to save environment labels to database", zap.Error(err), zap.String("environment_id", envID))
+			return nil, fmt.Errorf("failed to persist labels: %w", err)
+		}
+	}
+
+	// Only the requested keys are patched, so labels set on the namespace by others survive. A
+	// degraded environment's main pod is recreated with the new labels by reconciliation.
+	if envCopy.Status != models.StatusRunning && envCopy.Status != models.StatusDegraded {
+		return envCopy, nil
+	}
+	client, err := o.clientFor(envCopy)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.UpdateNamespaceLabels(ctx, envCopy.Namespace, req.Add, req.Remove); err != nil {
+		return nil, fmt.Errorf("failed to apply labels to namespace: %w", err)
+	}
+	if envCopy.Status == models.StatusRunning {
+		if err := client.PatchPodLabels(ctx, envCopy.Namespace, "main", req.Add, req.Remove); err != nil {
+			return nil, fmt.Errorf("failed to apply labels to main pod: %w", err)
+		}
+	}
+	return envCopy, nil
 }
 
 // DeleteEnvironment terminates and removes an environment.
-// Deletes from DB first so all replicas stop listing it; then K8s; then memory.
+// Cancels the environment's unfinished executions and drains its standby pool first, then deletes
+// from DB so all replicas stop listing it; then K8s; then memory. Execution history is kept.
 // If env is not in memory (e.g. request hit another replica), loads from DB so delete can still succeed.
 func (o *Orchestrator) DeleteEnvironment(ctx context.Context, envID string, force bool) error {
-	var namespace string
+	var namespace, cluster string
+	var lifecycle *models.LifecycleConfig
+	var previousStatus models.EnvironmentStatus
 	o.envMutex.Lock()
 	env, exists := o.environments[envID]
 	if exists {
 		namespace = env.Namespace
+		cluster = env.Cluster
+		lifecycle = env.Lifecycle.DeepCopy()
+		previousStatus = env.Status
+		// Stops pool replenishment and reconciliation for this env while it is being deleted
+		env.Status = models.StatusTerminating
 		o.envMutex.Unlock()
+		o.notifyEnvironmentStatus(envID)
 	} else {
 		o.envMutex.Unlock()
 		// Not in memory: try DB so delete works when request hits a replica that never had this env (e.g. failed env only in DB)
 		if o.db != nil {
 			dbEnv, err := o.db.GetEnvironment(ctx, envID)
 			if err != nil || dbEnv == nil {
-				return fmt.Errorf("environment not found")
+				return errEnvironmentNotFound
 			}
 			namespace = dbEnv.Namespace
+			cluster = dbEnv.Cluster
+			lifecycle = dbEnv.Lifecycle
 		} else {
-			return fmt.Errorf("environment not found")
+			return errEnvironmentNotFound
 		}
 	}
 
+	o.cancelEnvironmentExecutions(ctx, envID)
+
 	// Delete from database first so ListEnvironments (DB-backed) stops returning this env on all replicas
 	if o.db != nil {
 		if err := o.db.DeleteEnvironment(ctx, envID); err != nil {
+			if exists {
+				o.restoreStatusAfterFailedDelete(envID, previousStatus)
+			}
 			return fmt.Errorf("failed to delete environment from database: %w", err)
 		}
 	}
+	o.drainStandbyPool(envID)
+	o.stopLogShipping(envID)
+	o.revokeEnvironmentTokens(ctx, envID)
+	o.deleteSnapshots(ctx, envID)
 
-	// Delete pod (best effort - namespace may not exist if env never provisioned)
-	if err := o.k8sClient.DeletePod(ctx, namespace, "main", force); err != nil {
-		o.logger.Debug("delete pod (best effort)", zap.String("environment_id", envID), zap.String("namespace", namespace), zap.Error(err))
-	}
+	client, err := o.clusters.Get(cluster)
+	if err != nil {
+		// Cluster was removed from config; nothing we can clean up there
+		o.logger.Warn("environment cluster not configured, skipping kubernetes cleanup",
+			zap.String("environment_id", envID), zap.String("cluster", cluster))
+	} else {
+		// Delete pod (best effort - namespace may not exist if env never provisioned), giving it
+		// its grace period unless forced
+		if err := deleteMainPod(ctx, client, namespace, lifecycle, force); err != nil {
+			o.logger.Debug("delete pod (best effort)", zap.String("environment_id", envID), zap.String("namespace", namespace), zap.Error(err))
+		}
 
-	// Delete namespace (best effort - may not exist if provisioning failed)
-	if err := o.k8sClient.DeleteNamespace(ctx, namespace); err != nil {
-		o.logger.Debug("delete namespace (best effort)", zap.String("environment_id", envID), zap.String("namespace", namespace), zap.Error(err))
+		// Delete namespace (best effort - may not exist if provisioning failed)
+		if err := client.DeleteNamespace(ctx, namespace); err != nil {
+			o.logger.Debug("delete namespace (best effort)", zap.String("environment_id", envID), zap.String("namespace", namespace), zap.Error(err))
+		} else {
+			o.namespacesDeleted.Add(1)
+		}
 	}
 
 	// Remove from memory so this replica stops serving it
 	o.envMutex.Lock()
 	delete(o.environments, envID)
 	o.envMutex.Unlock()
+	// A placeholder the environment never took is deleted by the reservation loop
+	o.reservationMutex.Lock()
+	delete(o.placeholderSlots, envID)
+	o.reservationMutex.Unlock()
 
 	o.logger.Info("environment deleted",
 		zap.String("environment_id", envID),
@@ -664,96 +1497,246 @@ func (o *Orchestrator) DeleteEnvironment(ctx context.Context, envID string, forc
 	return nil
 }
 
-// ExecuteCommand executes a command in an environment
+// restoreStatusAfterFailedDelete puts back the status an environment had before a delete that
+// could not remove it from the database, so it is not left terminating
+func (o *Orchestrator) restoreStatusAfterFailedDelete(envID string, status models.EnvironmentStatus) {
+	o.envMutex.Lock()
+	env, exists := o.environments[envID]
+	restored := exists && env.Status == models.StatusTerminating
+	if restored {
+		env.Status = status
+	}
+	o.envMutex.Unlock()
+	if restored {
+		o.notifyEnvironmentStatus(envID)
+	}
+}
+
+// cancelEnvironmentExecutions cancels all unfinished executions of an environment that is being
+// deleted: those this replica runs, then those only the database knows (queued or running on
+// another replica, or left behind by a replica that went away)
+func (o *Orchestrator) cancelEnvironmentExecutions(ctx context.Context, envID string) {
+	execIDs, err := o.unfinishedExecutionIDs(ctx, envID, cancelableStatuses)
+	if err != nil {
+		// The database delete that follows fails as well and the environment is kept
+		o.logger.Warn("failed to list executions of deleted environment", zap.String("environment_id", envID), zap.Error(err))
+		return
+	}
+
+	for _, id := range execIDs {
+		if err := o.cancelExecution(ctx, id, "environment deleted"); err != nil {
+			// Finished in the meantime
+			o.logger.Debug("execution not canceled on environment delete", zap.String("exec_id", id), zap.Error(err))
+		}
+	}
+}
+
+// ExecuteCommand executes a command in an environment. In a serialized environment it first
+// waits for the execs ahead of it; the wait counts against its timeout. A command stopped at its
+// timeout is not an error: the response has TimedOut set, no exit code, and the output produced
+// until then. When ctx is canceled (the client disconnected) the command is killed, the
+// disconnect is audited and a context.Canceled error is returned.
 func (o *Orchestrator) ExecuteCommand(ctx context.Context, envID string, command []string, timeout int) (*models.ExecResponse, error) {
-	env, err := o.GetEnvironment(ctx, envID)
+	env, ctx, cancel, err := o.prepareExec(ctx, envID, timeout)
 	if err != nil {
 		return nil, err
 	}
+	defer cancel()
 
-	if env.Status != models.StatusRunning {
-		return nil, fmt.Errorf("environment is not running")
+	client, err := o.clientFor(env)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set timeout if specified (with maximum limit)
-	maxTimeout := o.config.Timeouts.MaxTimeout
-	if timeout > 0 {
-		if timeout > maxTimeout {
-			timeout = maxTimeout
-		}
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
-		defer cancel()
-	} else {
-		// Use default timeout if not specified
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(o.config.Timeouts.DefaultTimeout)*time.Second)
-		defer cancel()
+	turn, err := o.waitExecTurn(ctx, env)
+	if err != nil {
+		return nil, err
 	}
+	defer turn.release()
 
-	// Execute command via Kubernetes
-	startTime := time.Now()
-	stdout, stderr, exitCode, err := o.executeInPod(ctx, env.Namespace, "main", command)
-	duration := time.Since(startTime)
+	// Execute command via Kubernetes; killable so it can be stopped if the caller goes away
+	execID := "sync-" + uuid.New().String()[:8]
+	startTime := o.clock.Now()
+	stdout, stderr, err := o.executeInPod(ctx, client, env.Namespace, "main",
+		o.killableCommand(ctx, client, env.Namespace, "main", env.Image, execID, command))
+	duration := o.clock.Now().Sub(startTime)
 
-	if err != nil {
+	if execCanceled(ctx, err) {
+		// Ending the exec stream does not stop the command; kill it before the next exec's turn
+		o.stopCanceledExec(ctx, client, env, execID, command, duration)
+		return nil, fmt.Errorf("exec canceled: %w", ctx.Err())
+	}
+	timedOut := execTimedOut(ctx, err)
+	if err != nil && !timedOut {
 		return nil, fmt.Errorf("failed to execute command: %w", err)
 	}
+	stillRunning := false
+	if timedOut {
+		// The main pod is shared: stop the command before the next exec's turn
+		stillRunning = o.killExecTree(ctx, client, execID, env.Namespace, "main", execTimeoutReason) != nil
+	}
+
+	truncated := stdout.Truncated() || stderr.Truncated()
+	resp := &models.ExecResponse{
+		Stdout:           stdout.String(),
+		Stderr:           stderr.String(),
+		DurationMs:       duration.Milliseconds(),
+		TimedOut:         timedOut,
+		StillRunning:     stillRunning,
+		StdoutBytesTotal: stdout.Total(),
+		StderrBytesTotal: stderr.Total(),
+		Truncated:        truncated,
+		OutputNote:       models.OutputNote(truncated),
+		QueuePosition:    turn.position,
+		QueueWaitMs:      turn.waited.Milliseconds(),
+	}
+	if !timedOut {
+		exitCode := 0
+		resp.ExitCode = &exitCode
+	}
+	return resp, nil
+}
+
+// ExecuteCommandStream executes a command in the environment's main pod, writing stdout and stderr
+// to the given writers as they are produced. The returned response carries only the exit code and
+// duration. A non-zero exit code is reported in the response rather than as an error, and so is
+// a timeout (TimedOut, without an exit code).
+// Canceling ctx (e.g. client disconnect) kills the command, audits the disconnect and returns a
+// context.Canceled error. Execs queue like ExecuteCommand.
+func (o *Orchestrator) ExecuteCommandStream(
+	ctx context.Context, envID string, command []string, timeout int, stdout, stderr io.Writer,
+) (*models.ExecResponse, error) {
+	env, ctx, cancel, err := o.prepareExec(ctx, envID, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	client, err := o.clientFor(env)
+	if err != nil {
+		return nil, err
+	}
+
+	turn, err := o.waitExecTurn(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	defer turn.release()
+
+	// Killable so it can be stopped if the caller goes away
+	execID := "sync-" + uuid.New().String()[:8]
+	startTime := o.clock.Now()
+	err = client.ExecInPod(ctx, env.Namespace, "main",
+		o.killableCommand(ctx, client, env.Namespace, "main", env.Image, execID, command), nil, stdout, stderr)
+	duration := o.clock.Now().Sub(startTime)
+
+	if execCanceled(ctx, err) {
+		// Ending the exec stream does not stop the command; kill it before the next exec's turn
+		o.stopCanceledExec(ctx, client, env, execID, command, duration)
+		return nil, fmt.Errorf("exec canceled: %w", ctx.Err())
+	}
+	if execTimedOut(ctx, err) {
+		// The main pod is shared: stop the command before the next exec's turn
+		killErr := o.killExecTree(ctx, client, execID, env.Namespace, "main", execTimeoutReason)
+		return &models.ExecResponse{DurationMs: duration.Milliseconds(), TimedOut: true, StillRunning: killErr != nil}, nil
+	}
+	exitCode := 0
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to execute command: %w", err)
+		}
+		exitCode = exitErr.ExitStatus()
+	}
 
 	return &models.ExecResponse{
-		Stdout:     stdout,
-		Stderr:     stderr,
-		ExitCode:   exitCode,
+		ExitCode:   &exitCode,
 		DurationMs: duration.Milliseconds(),
 	}, nil
 }
 
-// GetLogs retrieves logs from an environment (pod logs merged with reconciliation events for the logs tab)
+// prepareExec checks that the environment can run commands and derives the exec context,
+// applying the requested timeout (capped at MaxTimeout) or the default timeout
+func (o *Orchestrator) prepareExec(ctx context.Context, envID string, timeout int) (*models.Environment, context.Context, context.CancelFunc, error) {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if env.Status == models.StatusDegraded {
+		return nil, nil, nil, apierrors.New(apierrors.Unavailable, apierrors.CodeEnvironmentDegraded, "environment is degraded: cluster %q is unreachable", o.clusterName(env))
+	}
+	if env.Status != models.StatusRunning {
+		return nil, nil, nil, EnvironmentNotRunningError(env)
+	}
+	if err := checkCordoned(env); err != nil {
+		return nil, nil, nil, err
+	}
+	o.RecordActivity(ctx, envID)
+
+	// Set timeout if specified (with maximum limit)
+	timeouts := o.cfg().Timeouts
+	if timeout > 0 {
+		if timeout > timeouts.MaxTimeout {
+			timeout = timeouts.MaxTimeout
+		}
+	} else {
+		// Use default timeout if not specified
+		timeout = timeouts.DefaultTimeout
+	}
+	execCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+
+	return env, execCtx, cancel, nil
+}
+
+// maxLogEvents is the most environment events merged into a logs response (the newest ones)
+const maxLogEvents = 500
+
+// GetLogs retrieves logs from an environment (pod logs merged with reconciliation events for the
+// logs tab). Events are merged from the same time window as the pod log: when it is cut to its
+// last tailLines lines, only events from the first returned line on are included.
 func (o *Orchestrator) GetLogs(ctx context.Context, envID string, tailLines *int64) (*models.LogsResponse, error) {
 	env, err := o.GetEnvironment(ctx, envID)
 	if err != nil {
 		return nil, err
 	}
+	o.RecordActivity(ctx, envID)
 
 	var logs []models.LogEntry
 
+	// Get logs from the pod (if it exists and its cluster is reachable)
+	if client, err := o.clientFor(env); err == nil && env.Status != models.StatusDegraded {
+		podLogsStr, err := client.GetPodLogs(ctx, env.Namespace, "main", tailLines, true)
+		if err == nil {
+			logs = parsePodLogs(podLogsStr, o.clock.Now())
+		}
+	}
+
 	// Fetch reconciliation/lifecycle events for this environment
+	// If pod doesn't exist (e.g. pending/failed), we still return reconciliation events
 	if o.db != nil {
-		events, errEvents := o.db.ListEnvironmentEvents(ctx, envID, 500)
-		if errEvents == nil {
-			for _, e := range events {
-				msg := e.Message
-				if e.Details != "" {
-					msg = msg + " — " + e.Details
+		var from *time.Time
+		if tailLines != nil && len(logs) > 0 {
+			// Leading lines without a timestamp get the current time, so take the earliest
+			first := logs[0].Timestamp
+			for _, entry := range logs[1:] {
+				if entry.Timestamp.Before(first) {
+					first = entry.Timestamp
 				}
-				logs = append(logs, models.LogEntry{
-					Timestamp: e.CreatedAt,
-					Stream:    "reconciliation",
-					Message:   "[" + e.EventType + "] " + msg,
-				})
 			}
+			from = &first
 		}
-	}
-
-	// Get logs from the pod (if it exists)
-	podLogsStr, err := o.k8sClient.GetPodLogs(ctx, env.Namespace, "main", tailLines)
-	if err == nil {
-		lines := strings.Split(podLogsStr, "\n")
-		now := time.Now()
-		for _, line := range lines {
-			if line != "" {
-				logs = append(logs, models.LogEntry{
-					Timestamp: now,
-					Stream:    "stdout",
-					Message:   line,
-				})
+		events, errEvents := o.db.ListEnvironmentEventsBetween(ctx, envID, from, nil, maxLogEvents)
+		if errEvents == nil {
+			for _, e := range events {
+				logs = append(logs, eventLogEntry(e))
 			}
 		}
 	}
-	// If pod doesn't exist (e.g. pending/failed), we still return reconciliation events
 
 	// Sort by timestamp so reconciliation events appear in order with pod logs
-	sort.Slice(logs, func(i, j int) bool {
+	// (stable, so pod lines sharing a timestamp keep their original order)
+	sort.SliceStable(logs, func(i, j int) bool {
 		return logs[i].Timestamp.Before(logs[j].Timestamp)
 	})
 
@@ -762,70 +1745,161 @@ func (o *Orchestrator) GetLogs(ctx context.Context, envID string, tailLines *int
 	}, nil
 }
 
-// StreamLogs streams logs from an environment
-func (o *Orchestrator) StreamLogs(ctx context.Context, envID string, tailLines *int64, follow bool) (io.ReadCloser, error) {
-	env, err := o.GetEnvironment(ctx, envID)
-	if err != nil {
-		return nil, err
+// parsePodLogs converts timestamped pod logs into log entries. Lines without a parseable
+// timestamp (e.g. continuation lines) get the previous line's time, or fallback for the first line.
+func parsePodLogs(raw string, fallback time.Time) []models.LogEntry {
+	var entries []models.LogEntry
+	last := fallback
+	for _, line := range strings.Split(raw, "\n") {
+		if line == "" {
+			continue
+		}
+		ts, message, ok := k8s.ParseLogLine(line)
+		if ok {
+			last = ts
+		}
+		entries = append(entries, models.LogEntry{
+			Timestamp: last,
+			Stream:    "stdout",
+			Message:   message,
+		})
+	}
+	return entries
+}
+
+// StreamLogs streams logs from an environment. Lines are prefixed with their Kubernetes
+// timestamp (see k8s.ParseLogLine).
+func (o *Orchestrator) StreamLogs(ctx context.Context, envID string, tailLines *int64, follow bool) (io.ReadCloser, error) {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+	o.RecordActivity(ctx, envID)
+
+	if env.Status == models.StatusDegraded {
+		return nil, apierrors.New(apierrors.Unavailable, apierrors.CodeEnvironmentDegraded, "environment is degraded: cluster %q is unreachable", o.clusterName(env))
+	}
+
+	client, err := o.clientFor(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stream logs from the pod
+	logsStream, err := client.StreamPodLogs(ctx, env.Namespace, "main", tailLines, follow, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream pod logs: %w", err)
+	}
+
+	return logsStream, nil
+}
+
+// GetHealthInfo retrieves health information including cluster capacity.
+// The top-level kubernetes/capacity fields describe the default cluster; Clusters lists every
+// configured cluster. Status is "unhealthy" when the default cluster is unreachable and
+// "degraded" when only other clusters are.
+func (o *Orchestrator) GetHealthInfo(ctx context.Context) (*models.HealthResponse, error) {
+	resp := &models.HealthResponse{
+		Status:  "healthy",
+		Version: "1.0.0",
+	}
+
+	for _, name := range o.clusters.Names() {
+		ch := o.checkClusterHealth(ctx, name)
+		resp.Clusters = append(resp.Clusters, ch)
+
+		if ch.Default {
+			resp.Kubernetes = models.KubernetesHealthStatus{
+				Connected: ch.Connected,
+				Version:   ch.Version,
+			}
+			resp.Capacity = ch.Capacity
+			if !ch.Connected {
+				resp.Status = "unhealthy"
+			}
+		} else if !ch.Connected && resp.Status == "healthy" {
+			resp.Status = "degraded"
+		}
+	}
+	resp.Cache = o.cacheHealth()
+	resp.Guardrails = o.GuardrailStatus()
+
+	return resp, nil
+}
+
+// checkClusterHealth checks connectivity to one cluster, records the result and gathers its capacity
+func (o *Orchestrator) checkClusterHealth(ctx context.Context, name string) models.ClusterHealth {
+	ch := models.ClusterHealth{
+		Name:    name,
+		Default: name == o.clusters.DefaultName(),
 	}
+	if err := o.clusters.CheckHealth(ctx, name); err != nil {
+		ch.Error = err.Error()
+		return ch
+	}
+	ch.Connected = true
 
-	// Stream logs from the pod
-	logsStream, err := o.k8sClient.StreamPodLogs(ctx, env.Namespace, "main", tailLines, follow)
+	client, _ := o.clusters.Get(name)
+	version, err := client.GetServerVersion(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to stream pod logs: %w", err)
+		o.logger.Warn("failed to get kubernetes version", zap.String("cluster", name), zap.Error(err))
 	}
+	ch.Version = version
 
-	return logsStream, nil
+	totalNodes, cpu, memory, err := client.GetClusterCapacity(ctx)
+	if err != nil {
+		o.logger.Warn("failed to get cluster capacity", zap.String("cluster", name), zap.Error(err))
+	} else {
+		ch.Capacity = models.ClusterCapacity{
+			TotalNodes:      totalNodes,
+			AvailableCPU:    cpu,
+			AvailableMemory: memory,
+		}
+	}
+	return ch
 }
 
-// GetHealthInfo retrieves health information including cluster capacity
-func (o *Orchestrator) GetHealthInfo(ctx context.Context) (*models.HealthResponse, error) {
-	// Check Kubernetes connectivity
-	connected := true
-	version := ""
-	capacity := models.ClusterCapacity{}
+// Helper functions
 
-	if err := o.k8sClient.HealthCheck(ctx); err != nil {
-		connected = false
-	} else {
-		// Get version
-		var err error
-		version, err = o.k8sClient.GetServerVersion(ctx)
-		if err != nil {
-			o.logger.Warn("failed to get kubernetes version", zap.Error(err))
-		}
+// ClientForEnvironment returns the Kubernetes client for the cluster an environment runs on
+func (o *Orchestrator) ClientForEnvironment(env *models.Environment) (k8s.ClientInterface, error) {
+	return o.clientFor(env)
+}
+
+// clientFor returns the Kubernetes client for the cluster an environment runs on
+// (environments created before multi-cluster support run on the default cluster)
+func (o *Orchestrator) clientFor(env *models.Environment) (k8s.ClientInterface, error) {
+	return o.clusters.Get(env.Cluster)
+}
 
-		// Get cluster capacity
-		totalNodes, cpu, memory, err := o.k8sClient.GetClusterCapacity(ctx)
+// clientForEnvironmentID returns the Kubernetes client for an environment looked up by ID
+// (in memory first, then the database)
+func (o *Orchestrator) clientForEnvironmentID(ctx context.Context, envID string) (k8s.ClientInterface, error) {
+	o.envMutex.RLock()
+	env, exists := o.environments[envID]
+	var cluster string
+	if exists {
+		cluster = env.Cluster
+	}
+	o.envMutex.RUnlock()
+	if !exists && o.db != nil {
+		dbEnv, err := o.db.GetEnvironment(ctx, envID)
 		if err != nil {
-			o.logger.Warn("failed to get cluster capacity", zap.Error(err))
-		} else {
-			capacity = models.ClusterCapacity{
-				TotalNodes:      totalNodes,
-				AvailableCPU:    cpu,
-				AvailableMemory: memory,
-			}
+			return nil, err
 		}
+		cluster = dbEnv.Cluster
 	}
+	return o.clusters.Get(cluster)
+}
 
-	status := "healthy"
-	if !connected {
-		status = "unhealthy"
+// clusterName returns the name of the cluster an environment runs on
+func (o *Orchestrator) clusterName(env *models.Environment) string {
+	if env.Cluster == "" {
+		return o.clusters.DefaultName()
 	}
-
-	return &models.HealthResponse{
-		Status:  status,
-		Version: "1.0.0",
-		Kubernetes: models.KubernetesHealthStatus{
-			Connected: connected,
-			Version:   version,
-		},
-		Capacity: capacity,
-	}, nil
+	return env.Cluster
 }
 
-// Helper functions
-
 // generateEnvironmentID generates a unique environment ID
 // Format: env-<8-char-hex> (e.g., env-a1b2c3d4)
 func generateEnvironmentID() string {
@@ -836,30 +1910,30 @@ func generateEnvironmentID() string {
 }
 
 func (o *Orchestrator) generateNamespace(envID string) string {
-	return o.namespacePrefix + envID
+	return k8s.NamespaceName(o.namespacePrefix, envID)
 }
 
 func (o *Orchestrator) updateEnvironmentStatus(envID string, status models.EnvironmentStatus) {
 	o.envMutex.Lock()
 	var env *models.Environment
-	var exists bool
-	if env, exists = o.environments[envID]; exists {
-		// Atomically update status to avoid race conditions
-		env.Status = status
+	var changed bool
+	stored, exists := o.environments[envID]
+	if exists {
+		changed = stored.Status != status
+		stored.Status = status
+		if status == models.StatusRunning && stored.StartedAt == nil {
+			now := o.clock.Now()
+			stored.StartedAt = &now
+		}
+		// Save a copy: provisioning and reconciliation keep updating the stored environment
+		env = stored.DeepCopy()
 	}
 	o.envMutex.Unlock()
 
 	// Save to database
 	if exists && o.db != nil {
 		ctx := context.Background()
-		var startedAt *time.Time
-		if status == models.StatusRunning && env.StartedAt == nil {
-			now := time.Now()
-			startedAt = &now
-			env.StartedAt = startedAt
-		} else if env.StartedAt != nil {
-			startedAt = env.StartedAt
-		}
+		startedAt := env.StartedAt
 		if err := o.db.UpdateEnvironmentStatus(ctx, envID, status, startedAt); err != nil {
 			o.logger.Error("failed to update environment status in database", zap.Error(err), zap.String("environment_id", envID))
 		}
@@ -868,9 +1942,25 @@ func (o *Orchestrator) updateEnvironmentStatus(envID string, status models.Envir
 			o.logger.Error("failed to save environment to database", zap.Error(err), zap.String("environment_id", envID))
 		}
 	}
+	if changed {
+		o.notifyEnvironmentStatus(envID)
+		if status == models.StatusFailed {
+			o.notifyEnvironmentFailed(envID)
+		}
+	}
 }
 
 // multiplyResourceQuantity returns a resource string equivalent to (base * multiplier), e.g. "500m" * 2 = "1000m".
+// quotaMultiplier is the number of environment-sized pods the namespace quota holds: the main
+// pod, one ephemeral exec pod and the standby pool
+func quotaMultiplier(pool *models.PoolConfig) int {
+	multiplier := 2
+	if pool != nil && pool.Enabled && pool.Size > 0 {
+		multiplier += pool.Size
+	}
+	return multiplier
+}
+
 func multiplyResourceQuantity(base string, multiplier int) string {
 	if multiplier <= 0 {
 		return "0"
@@ -914,58 +2004,122 @@ func matchesLabelSelector(envLabels map[string]string, selectorStr string) bool
 	return selector.Matches(labelSet)
 }
 
-func (o *Orchestrator) applyNetworkPolicyWithConfig(ctx context.Context, namespace string, isolation *models.IsolationConfig) error {
+func (o *Orchestrator) applyNetworkPolicyWithConfig(
+	ctx context.Context, client k8s.ClientInterface, namespace string, isolation *models.IsolationConfig,
+) error {
 	// If no isolation config, use default restrictive policy
-	if isolation == nil || isolation.NetworkPolicy == nil {
-		return o.k8sClient.CreateNetworkPolicy(ctx, namespace)
+	if isolation == nil || (isolation.NetworkPolicy == nil && isolation.DNS == nil) {
+		return client.CreateNetworkPolicy(ctx, namespace)
 	}
 
 	// Convert model config to k8s config
-	npConfig := &k8s.NetworkPolicyConfig{
-		AllowInternet:        isolation.NetworkPolicy.AllowInternet,
-		AllowedEgressCIDRs:   isolation.NetworkPolicy.AllowedEgressCIDRs,
-		AllowedIngressPorts:  isolation.NetworkPolicy.AllowedIngressPorts,
-		AllowClusterInternal: isolation.NetworkPolicy.AllowClusterInternal,
+	npConfig := &k8s.NetworkPolicyConfig{}
+	if np := isolation.NetworkPolicy; np != nil {
+		npConfig.AllowInternet = np.AllowInternet
+		npConfig.AllowedEgressCIDRs = np.AllowedEgressCIDRs
+		npConfig.AllowedIngressPorts = np.AllowedIngressPorts
+		npConfig.AllowClusterInternal = np.AllowClusterInternal
+	}
+	// Pods must reach their own resolvers; with policy None the cluster DNS is not needed
+	if dns := isolation.DNS; dns != nil {
+		npConfig.DNSServers = dns.Nameservers
+		npConfig.DenyClusterDNS = dns.Policy == models.DNSPolicyNone
 	}
 
-	return o.k8sClient.CreateNetworkPolicyWithConfig(ctx, namespace, npConfig)
+	return client.CreateNetworkPolicyWithConfig(ctx, namespace, npConfig)
 }
 
-func (o *Orchestrator) executeInPod(ctx context.Context, namespace, podName string, command []string) (stdout, stderr string, exitCode int, err error) {
-	var stdoutBuf, stderrBuf bytes.Buffer
+// executeInPod runs command in the pod, capturing stdout and stderr up to the output cap. The
+// buffers are returned even when the exec fails, holding the output produced until then (e.g.
+// when ctx reaches its deadline).
+func (o *Orchestrator) executeInPod(
+	ctx context.Context, client k8s.ClientInterface, namespace, podName string, command []string,
+) (stdout, stderr *k8s.LimitedBuffer, err error) {
+	stdout, stderr = o.newOutputBuffers()
+	err = client.ExecInPod(ctx, namespace, podName, command, nil, stdout, stderr)
+	return stdout, stderr, err
+}
 
-	err = o.k8sClient.ExecInPod(ctx, namespace, podName, command, nil, &stdoutBuf, &stderrBuf)
-	if err != nil {
-		return "", "", 1, err
-	}
+// execTimedOut reports whether err ended an exec because ctx reached its deadline
+func execTimedOut(ctx context.Context, err error) bool {
+	return err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
 
-	return stdoutBuf.String(), stderrBuf.String(), 0, nil
+// execCanceled reports whether err ended an exec because ctx was canceled by the caller (as
+// opposed to reaching its deadline)
+func execCanceled(ctx context.Context, err error) bool {
+	return err != nil && errors.Is(ctx.Err(), context.Canceled)
 }
 
 // runExecutionInMainPod runs the command in the environment's main pod and updates the execution record (used when ephemeral pod creation fails e.g. quota).
-func (o *Orchestrator) runExecutionInMainPod(ctx context.Context, execID, namespace string, command []string, env *models.Environment) {
-	startTime := time.Now()
-	stdout, stderr, exitCode, err := o.executeInPod(ctx, namespace, "main", command)
-	duration := time.Since(startTime)
+func (o *Orchestrator) runExecutionInMainPod(
+	ctx context.Context, client k8s.ClientInterface, execID, namespace string, req *EphemeralExecRequest, env *models.Environment,
+) {
+	command := req.Command
+	if len(req.Files) > 0 {
+		// The main pod is shared: give the execution its own directory and remove it afterwards
+		dir := path.Join(o.execWorkingDir(), execID)
+		defer o.removeExecutionDir(ctx, client, execID, namespace, "main", dir)
+		if !o.uploadExecutionFiles(ctx, client, execID, namespace, "main", dir, req.Files, false) {
+			return
+		}
+		command = inWorkingDir(dir, command)
+	}
+
+	// A cancel that came in before the command started finds no process to kill
+	o.execMutex.RLock()
+	current := o.executions[execID]
+	canceled := current != nil && current.Status == models.ExecutionStatusCanceled
+	o.execMutex.RUnlock()
+	if canceled {
+		return
+	}
+
+	startTime := o.clock.Now()
+	stdout, stderr, err := o.executeInPod(ctx, client, namespace, "main",
+		o.killableCommand(ctx, client, namespace, "main", env.Image, execID, command))
+	duration := o.clock.Now().Sub(startTime)
 	durationMs := duration.Milliseconds()
 
-	if err != nil {
-		o.updateExecutionError(execID, fmt.Sprintf("execution failed: %v", err))
+	if execTimedOut(ctx, err) {
+		// The main pod is shared: stop the command before the next one runs
+		killErr := o.killExecTree(ctx, client, execID, namespace, "main", execTimeoutReason)
+		o.failExecutionTimedOut(execID, duration, func(exec *models.Execution) {
+			setExecutionOutput(exec, stdout, stderr)
+		})
+		if killErr != nil {
+			o.recordKillFailed(execID, killErr)
+		}
 		return
 	}
 
-	completedAt := time.Now()
+	// A command that exits non-zero completed; only a failed exec fails the execution
+	exitCode := 0
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitStatus()
+		err = nil
+	}
+
+	completedAt := o.clock.Now()
 	o.execMutex.Lock()
 	var exec *models.Execution
 	var exists bool
-	if exec, exists = o.executions[execID]; exists {
-		exec.Status = models.ExecutionStatusCompleted
+	if exec, exists = o.executions[execID]; exists && exec.Status != models.ExecutionStatusCanceled {
+		if err != nil {
+			exec.Status = models.ExecutionStatusFailed
+			exec.Error = fmt.Sprintf("execution failed: %v", err)
+		} else {
+			exec.Status = models.ExecutionStatusCompleted
+			exec.ExitCode = &exitCode
+		}
 		exec.CompletedAt = &completedAt
-		exec.ExitCode = &exitCode
-		exec.Stdout = stdout
-		exec.Stderr = stderr
+		setExecutionOutput(exec, stdout, stderr)
 		exec.DurationMs = &durationMs
 	}
+	if exists {
+		exec = exec.DeepCopy()
+	}
 	o.execMutex.Unlock()
 
 	if exists && o.db != nil {
@@ -974,6 +2128,7 @@ func (o *Orchestrator) runExecutionInMainPod(ctx context.Context, execID, namesp
 			o.logger.Error("failed to save execution results to database", zap.Error(err), zap.String("execution_id", execID))
 		}
 	}
+	o.notifyExecutionDone(execID)
 }
 
 // EphemeralExecRequest contains parameters for ephemeral execution
@@ -982,27 +2137,178 @@ type EphemeralExecRequest struct {
 	Command       []string          `json:"command"`
 	Timeout       int               `json:"timeout,omitempty"`
 	Env           map[string]string `json:"env,omitempty"` // Additional env vars (merged with environment's)
+	// Image, Resources and Isolation override the environment's values for this execution
+	// (empty resource fields keep the environment's values)
+	Image     string                  `json:"image,omitempty"`
+	Resources *models.ResourceSpec    `json:"resources,omitempty"`
+	Isolation *models.IsolationConfig `json:"isolation,omitempty"`
+	// CallbackURL receives the execution result when it finishes (see deliverExecutionCallback)
+	CallbackURL     string            `json:"callback_url,omitempty"`
+	CallbackHeaders map[string]string `json:"callback_headers,omitempty"`
+	CallbackSecret  string            `json:"callback_secret,omitempty"`
+	// Files are written into the pod's working directory before the command runs
+	Files map[string][]byte `json:"files,omitempty"`
+	// Cache serves the result of an identical execution from the result cache and caches this
+	// execution's result for CacheTTL seconds (see execcache.go)
+	Cache    bool `json:"cache,omitempty"`
+	CacheTTL int  `json:"cache_ttl,omitempty"`
+	// SkipSoftTimeout runs the command without the soft timeout warning (see softtimeout.go)
+	SkipSoftTimeout bool `json:"skip_soft_timeout,omitempty"`
+	// Metadata is stored with the execution; it is not passed to the pod
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// SkipCommandPolicy bypasses the command policy (set for admins)
+	SkipCommandPolicy bool `json:"-"`
+	// RequeuedFrom is the execution this one requeues (set by RequeueExecution)
+	RequeuedFrom string `json:"-"`
+}
+
+// hasOverrides reports whether the execution overrides the environment's pod settings; such
+// executions cannot use standby pods or the main pod
+func (r *EphemeralExecRequest) hasOverrides() bool {
+	return r.Image != "" || r.Resources != nil || r.Isolation != nil
+}
+
+// execPodSettings returns the image, resources and isolation an execution's pod runs with: the
+// environment's values with the request's overrides applied
+func execPodSettings(env *models.Environment, req *EphemeralExecRequest) (string, models.ResourceSpec, *models.IsolationConfig) {
+	image := env.Image
+	if req.Image != "" {
+		image = req.Image
+	}
+	resources := env.Resources
+	if req.Resources != nil {
+		if req.Resources.CPU != "" {
+			resources.CPU = req.Resources.CPU
+		}
+		if req.Resources.Memory != "" {
+			resources.Memory = req.Resources.Memory
+		}
+		if req.Resources.Storage != "" {
+			resources.Storage = req.Resources.Storage
+		}
+	}
+	isolation := env.Isolation
+	if req.Isolation != nil {
+		merged := models.IsolationConfig{}
+		if env.Isolation != nil {
+			merged = *env.Isolation
+		}
+		if req.Isolation.RuntimeClass != "" {
+			merged.RuntimeClass = req.Isolation.RuntimeClass
+		}
+		if req.Isolation.PriorityClassName != "" {
+			merged.PriorityClassName = req.Isolation.PriorityClassName
+		}
+		merged.SecurityContext = mergeSecurityContext(merged.SecurityContext, req.Isolation.SecurityContext)
+		if req.Isolation.DisableExecWrapper {
+			merged.DisableExecWrapper = true
+		}
+		isolation = &merged
+	}
+	return image, resources, isolation
+}
+
+// checkExecQuota fails when an execution pod with the given resources cannot fit in the
+// environment's namespace quota next to the main pod
+func checkExecQuota(env *models.Environment, resources models.ResourceSpec) error {
+	multiplier := quotaMultiplier(env.Pool)
+	for _, r := range []struct {
+		name, env, exec string
+	}{
+		{"cpu", env.Resources.CPU, resources.CPU},
+		{"memory", env.Resources.Memory, resources.Memory},
+	} {
+		envQuantity, err := resource.ParseQuantity(r.env)
+		if err != nil {
+			continue
+		}
+		execQuantity, err := resource.ParseQuantity(r.exec)
+		if err != nil {
+			return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "invalid %s %q", r.name, r.exec)
+		}
+		// The quota holds the main pod plus (multiplier - 1) pods of the environment's size
+		headroom := resource.MustParse(multiplyResourceQuantity(r.env, multiplier-1))
+		if execQuantity.Cmp(headroom) > 0 {
+			return apierrors.New(apierrors.Unschedulable, apierrors.CodeExceedsEnvironmentQuota,
+				"%s %s exceeds the environment's quota: at most %s is available to an execution pod next to the main pod (environment %s is %s)",
+				r.name, r.exec, headroom.String(), r.name, envQuantity.String())
+		}
+	}
+	return nil
 }
 
 // SubmitExecution queues an async execution and returns immediately with the execution ID
 // The execution runs in a goroutine and can be polled for status via GetExecution
-func (o *Orchestrator) SubmitExecution(ctx context.Context, req *EphemeralExecRequest, userID string) (*models.Execution, error) {
+func (o *Orchestrator) SubmitExecution(ctx context.Context, req *EphemeralExecRequest, userID string) (_ *models.Execution, err error) {
+	ctx, span := tracing.Start(ctx, "orchestrator.SubmitExecution", attribute.String("environment.id", req.EnvironmentID))
+	defer func() { tracing.End(span, err) }()
+
 	// Look up the environment to inherit its configuration
 	env, err := o.GetEnvironment(ctx, req.EnvironmentID)
 	if err != nil {
 		return nil, fmt.Errorf("environment not found: %w", err)
 	}
 
-	// Verify environment is running
+	// Verify environment is running and accepts new executions
 	if env.Status != models.StatusRunning {
-		return nil, fmt.Errorf("environment is not running (status: %s)", env.Status)
+		return nil, EnvironmentNotRunningError(env)
+	}
+	if err := checkCordoned(env); err != nil {
+		return nil, err
+	}
+
+	// Reject disallowed commands before any pod is created
+	if !req.SkipCommandPolicy {
+		if err := o.checkCommandPolicy(ctx, env, req.Command, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	callback, err := newCallbackTarget(o.cfg().Executions.Callbacks, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Isolation != nil {
+		if err := checkExecSecurityEscalation(env.Isolation, req.Isolation.SecurityContext); err != nil {
+			return nil, err
+		}
+		if err := o.checkPriorityClass(req.Isolation); err != nil {
+			return nil, err
+		}
+	}
+
+	// The execution's variables are validated on their own; merged with the environment's they
+	// must still fit the cap
+	if n := mergedEnvCount(env.Env, req.Env); n > validator.MaxEnvVars {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"the execution would run with %d environment variables (the environment's and its own), exceeding the maximum of %d", n, validator.MaxEnvVars)
+	}
+
+	image, resources, _ := execPodSettings(env, req)
+	if req.hasOverrides() {
+		// An overridden execution cannot fall back to the main pod, so fail now rather than
+		// when its pod is refused
+		if err := checkExecQuota(env, resources); err != nil {
+			return nil, err
+		}
+	}
+
+	o.RecordActivity(ctx, env.ID)
+
+	var cacheKey string
+	var cached *models.Execution
+	if req.Cache && o.db != nil {
+		cacheKey = executionCacheKey(env, req, image)
+		cached = o.lookupExecutionCache(ctx, cacheKey)
 	}
 
 	// Generate unique execution ID
-	execID := "exec-" + uuid.New().String()[:8]
-	podName := execID // Use same name for pod
+	execID := "exec-" + uuid.New().String()
+	podName := execID // Use same name for pod (unless taken, see createPodWithUniqueName)
+	span.SetAttributes(attribute.String("execution.id", execID))
 
-	now := time.Now()
+	now := o.clock.Now()
 	exec := &models.Execution{
 		ID:            execID,
 		EnvironmentID: req.EnvironmentID,
@@ -1013,22 +2319,50 @@ func (o *Orchestrator) SubmitExecution(ctx context.Context, req *EphemeralExecRe
 		PodName:       podName,
 		Namespace:     env.Namespace, // Use environment's namespace
 		CreatedAt:     now,
+
+		EffectiveImage:     image,
+		EffectiveResources: &resources,
+		Files:              executionFiles(req.Files),
+		CacheEnabled:       req.Cache,
+		Metadata:           req.Metadata,
+		Submission: &models.ExecutionSubmission{
+			Timeout:         req.Timeout,
+			Image:           req.Image,
+			Resources:       req.Resources,
+			Isolation:       req.Isolation,
+			CacheTTL:        req.CacheTTL,
+			SkipSoftTimeout: req.SkipSoftTimeout,
+		},
+		RequeuedFrom: req.RequeuedFrom,
+	}
+	if callback != nil {
+		exec.Callback = &models.ExecutionCallback{URL: callback.url, Status: models.CallbackStatusPending}
+	}
+	if cached != nil {
+		return o.completeFromCache(ctx, exec, cached, callback), nil
 	}
 
 	// Store execution in memory and database
 	o.execMutex.Lock()
 	o.executions[execID] = exec
+	if callback != nil {
+		o.execCallbacks[execID] = callback
+	}
+	if cacheKey != "" {
+		o.execCacheKeys[execID] = &execCacheTarget{key: cacheKey, ttl: executionCacheTTL(req.CacheTTL)}
+	}
+	execForDB := exec.DeepCopy()
 	o.execMutex.Unlock()
 
 	// Save to database
 	if o.db != nil {
-		if err := o.db.SaveExecution(ctx, exec); err != nil {
+		if err := o.db.SaveExecution(ctx, execForDB); err != nil {
 			o.logger.Error("failed to save execution to database", zap.Error(err), zap.String("execution_id", execID))
 			// Continue even if database save fails
 		}
 	}
 
-	o.logger.Info("execution submitted",
+	o.logger.With(tracing.LogFields(ctx)...).Info("execution submitted",
 		zap.String("exec_id", execID),
 		zap.String("environment_id", req.EnvironmentID),
 		zap.Strings("command", req.Command),
@@ -1036,37 +2370,43 @@ func (o *Orchestrator) SubmitExecution(ctx context.Context, req *EphemeralExecRe
 	)
 
 	// Run execution in background
-	timeout := req.Timeout
-	if timeout <= 0 {
-		timeout = 300 // Default 5 minutes
-	}
-	if timeout > 3600 {
-		timeout = 3600 // Max 1 hour
-	}
-
-	go o.runExecution(execID, env, req, timeout)
+	timeout := o.executionTimeout(req.Timeout)
 
 	// Return a copy to avoid race conditions
-	execCopy := *exec
-	return &execCopy, nil
+	execCopy := execForDB.DeepCopy()
+	execCopy.EstimatedStart = o.execSlots.estimatedStart()
+	go o.runExecution(execID, env, req, timeout, trace.SpanContextFromContext(ctx))
+	return execCopy, nil
 }
 
-// runExecution runs the actual pod execution in the background
-func (o *Orchestrator) runExecution(execID string, env *models.Environment, req *EphemeralExecRequest, timeout int) {
+// runExecution runs the actual pod execution in the background, traced in a span linked to the
+// submitting request's span
+func (o *Orchestrator) runExecution(execID string, env *models.Environment, req *EphemeralExecRequest, timeout int, requestSpan trace.SpanContext) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
+	ctx, span := tracing.StartLinked(ctx, requestSpan, "orchestrator.runExecution",
+		attribute.String("execution.id", execID),
+		attribute.String("environment.id", env.ID),
+	)
+	defer o.endExecutionSpan(span, execID)
 
 	o.updateExecutionStatus(execID, models.ExecutionStatusQueued, nil)
 
-	select {
-	case o.execSem <- struct{}{}:
-		defer func() { <-o.execSem }()
-	case <-ctx.Done():
-		o.updateExecutionError(execID, "timeout waiting in queue")
+	_, queueSpan := tracing.Start(ctx, "execution.queue")
+	release, err := o.execSlots.acquire(ctx, env.ID)
+	if err != nil {
+		tracing.End(queueSpan, err)
+		o.updateExecutionErrorCode(execID, apierrors.CodeExecTimedOut, "timeout waiting in queue")
 		return
 	}
+	queueSpan.End()
+	defer release()
 
-	standbyPod := o.claimStandbyPod(env.ID)
+	// Standby pods run the environment's image and resources
+	var standbyPod *StandbyPod
+	if !req.hasOverrides() {
+		standbyPod = o.claimStandbyPod(env.ID)
+	}
 
 	// If canceled while queued, don't overwrite with Running
 	o.execMutex.Lock()
@@ -1079,19 +2419,25 @@ func (o *Orchestrator) runExecution(execID string, env *models.Environment, req
 		o.execMutex.Unlock()
 		return
 	}
-	now := time.Now()
+	now := o.clock.Now()
 	exec.Status = models.ExecutionStatusRunning
 	exec.StartedAt = &now
 	exec.QueuedAt = &now
+	addExecutionEvent(exec, now, models.ExecutionEventStarted, "")
 	if standbyPod != nil {
 		exec.PodName = standbyPod.Name
 		exec.Namespace = standbyPod.Namespace
+		exec.ServedFromPool = true
+		exec.Mode = models.ExecutionModeStandby
 	}
 	o.execMutex.Unlock()
 
 	if o.db != nil {
 		o.execMutex.RLock()
 		execForDB := o.executions[execID]
+		if execForDB != nil {
+			execForDB = execForDB.DeepCopy()
+		}
 		o.execMutex.RUnlock()
 		if execForDB != nil {
 			dbCtx := context.Background()
@@ -1107,17 +2453,48 @@ func (o *Orchestrator) runExecution(execID string, env *models.Environment, req
 	podName := execRecord.PodName
 	o.execMutex.RUnlock()
 
+	if deadline, ok := ctx.Deadline(); ok {
+		if stop := o.scheduleSoftTimeout(execID, env, req, timeout, deadline); stop != nil {
+			defer stop()
+		}
+	}
+
 	if standbyPod != nil {
-		o.runWithStandbyPod(ctx, execID, standbyPod, req.Command, env)
+		o.runWithStandbyPod(ctx, execID, standbyPod, req, env, execRecord.UserID)
+		return
+	}
+
+	client, err := o.clientFor(env)
+	if err != nil {
+		o.updateExecutionError(execID, err.Error())
 		return
 	}
+	o.runExecutionWithNewPod(ctx, client, execID, env, req, namespace, podName, execRecord)
+}
 
-	o.runExecutionWithNewPod(ctx, execID, env, req, namespace, podName, execRecord)
+// endExecutionSpan ends an execution's span, recording how the execution ended
+func (o *Orchestrator) endExecutionSpan(span trace.Span, execID string) {
+	var err error
+	o.execMutex.RLock()
+	if exec, exists := o.executions[execID]; exists {
+		span.SetAttributes(
+			attribute.String("execution.status", string(exec.Status)),
+			attribute.String("execution.mode", exec.Mode),
+		)
+		if exec.ExitCode != nil {
+			span.SetAttributes(attribute.Int("execution.exit_code", *exec.ExitCode))
+		}
+		if exec.Status == models.ExecutionStatusFailed {
+			err = errors.New(exec.Error)
+		}
+	}
+	o.execMutex.RUnlock()
+	tracing.End(span, err)
 }
 
 // runExecutionWithNewPod creates an ephemeral pod for the execution, waits for completion, and updates the execution record.
 func (o *Orchestrator) runExecutionWithNewPod(
-	ctx context.Context, execID string, env *models.Environment, req *EphemeralExecRequest,
+	ctx context.Context, client k8s.ClientInterface, execID string, env *models.Environment, req *EphemeralExecRequest,
 	namespace, podName string, execRecord *models.Execution,
 ) {
 	if execRecord == nil {
@@ -1138,15 +2515,15 @@ func (o *Orchestrator) runExecutionWithNewPod(
 		return
 	}
 
-	o.logger.Info("starting execution (new pod)",
+	o.logger.With(tracing.LogFields(ctx)...).Info("starting execution (new pod)",
 		zap.String("exec_id", execID),
 		zap.String("pod", podName),
 		zap.String("namespace", namespace),
-		zap.String("image", env.Image),
+		zap.String("image", execRecord.EffectiveImage),
 	)
 
 	podSpec := o.buildEphemeralPodSpec(env, req, execID, namespace, podName, execRecord)
-	fallbackToMain, createErr := o.tryCreateEphemeralPodOrFallback(ctx, execID, namespace, podSpec, req, env)
+	fallbackToMain, createErr := o.tryCreateEphemeralPodOrFallback(ctx, client, execID, namespace, podSpec, req, env)
 	if fallbackToMain {
 		return
 	}
@@ -1154,12 +2531,50 @@ func (o *Orchestrator) runExecutionWithNewPod(
 		o.updateExecutionError(execID, fmt.Sprintf("failed to create pod: %v", createErr))
 		return
 	}
+	podName = podSpec.Name
+	o.setExecutionMode(execID, models.ExecutionModeEphemeral, podName)
+
+	// A timed-out pod is deleted (grace period 0) before the timeout is recorded, so the command
+	// is stopped by the time the execution is reported as finished
+	podDeleted := false
+	deletePod := func() {
+		if !podDeleted {
+			podDeleted = true
+			o.cleanupEphemeralPod(ctx, client, execID, namespace, podName)
+		}
+	}
+	defer deletePod()
 
-	defer o.cleanupEphemeralPod(execID, namespace, podName)
+	if len(req.Files) > 0 {
+		// The pod's command waits for the files, which can be written once it is running
+		if err := client.WaitForPodRunning(ctx, namespace, podName); err != nil {
+			if execTimedOut(ctx, err) {
+				deletePod()
+				o.failExecutionTimedOut(execID, 0, func(*models.Execution) {})
+			} else {
+				o.updateExecutionError(execID, fmt.Sprintf("execution failed: %v", err))
+			}
+			return
+		}
+		if !o.uploadExecutionFiles(ctx, client, execID, namespace, podName, o.execWorkingDir(), req.Files, true) {
+			return
+		}
+	}
 
-	startTime := time.Now()
-	result, err := o.k8sClient.WaitForPodCompletion(ctx, namespace, podName)
-	duration := time.Since(startTime)
+	startTime := o.clock.Now()
+	result, err := client.WaitForPodCompletion(ctx, namespace, podName, o.maxOutputBytes())
+	duration := o.clock.Now().Sub(startTime)
+	if execTimedOut(ctx, err) {
+		deletePod()
+		o.failExecutionTimedOut(execID, duration, func(exec *models.Execution) {
+			if result != nil {
+				exec.Stdout = result.Logs
+				exec.StdoutBytesTotal = result.LogBytesTotal
+				exec.Truncated = result.LogsTruncated
+			}
+		})
+		return
+	}
 	if err != nil {
 		o.updateExecutionError(execID, fmt.Sprintf("execution failed: %v", err))
 		return
@@ -1173,91 +2588,119 @@ func (o *Orchestrator) buildEphemeralPodSpec(
 	env *models.Environment, req *EphemeralExecRequest, execID, namespace, podName string,
 	execRecord *models.Execution,
 ) *k8s.PodSpec {
-	labels := map[string]string{
+	labels := podLabels(map[string]string{
 		"app":            "agentbox",
 		"exec-id":        execID,
 		"managed-by":     "agentbox",
 		"type":           "ephemeral",
 		"user-id":        execRecord.UserID,
 		"environment-id": req.EnvironmentID,
+	}, env.Labels)
+	mergedEnv := o.buildPodEnv(env, execID, execRecord.UserID, o.executionTokenTTL(req.Timeout), "", env.Env, req.Env)
+	image, resources, isolation := execPodSettings(env, req)
+	runtimeClass := o.cfg().Kubernetes.RuntimeClass
+	if isolation != nil && isolation.RuntimeClass != "" {
+		runtimeClass = isolation.RuntimeClass
+	}
+	var envSecurity *models.SecurityContextConfig
+	if isolation != nil {
+		envSecurity = isolation.SecurityContext
+	}
+	securityContext, scratchDirs := o.execSecurityContext(env, envSecurity)
+	k8sTolerations := toK8sTolerations(env.Tolerations)
+	command := req.Command
+	if len(req.Files) > 0 {
+		command = afterFilesReady(o.execWorkingDir(), command)
 	}
-	for k, v := range env.Labels {
-		labels[k] = v
-	}
-	mergedEnv := make(map[string]string)
-	for k, v := range env.Env {
-		mergedEnv[k] = v
-	}
-	for k, v := range req.Env {
-		mergedEnv[k] = v
+	return &k8s.PodSpec{
+		Name:                         sanitizePodName(podName),
+		Namespace:                    namespace,
+		Image:                        image,
+		Command:                      command,
+		Env:                          mergedEnv,
+		CPU:                          resources.CPU,
+		Memory:                       resources.Memory,
+		Storage:                      resources.Storage,
+		RuntimeClass:                 runtimeClass,
+		PriorityClassName:            o.priorityClassFor(isolation, podTypeEphemeral),
+		ServiceAccountName:           serviceAccountName(isolation),
+		AutomountServiceAccountToken: automountServiceAccountToken(isolation),
+		Labels:                       labels,
+		NodeSelector:                 env.NodeSelector,
+		Tolerations:                  k8sTolerations,
+		Affinity:                     toK8sAffinity(env.Affinity),
+		SecurityContext:              securityContext,
+		DNS:                          toK8sDNS(isolation),
+		ScratchDirs:                  scratchDirs,
+		Wrapper:                      o.execWrapper(isolation),
 	}
-	runtimeClass := o.config.Kubernetes.RuntimeClass
-	if env.Isolation != nil && env.Isolation.RuntimeClass != "" {
-		runtimeClass = env.Isolation.RuntimeClass
+}
+
+// execWrapper returns the exec wrapper execution pods run their command under: nil when
+// executions.wrapper is disabled or the environment (or execution) opts out
+func (o *Orchestrator) execWrapper(isolation *models.IsolationConfig) *k8s.ExecWrapper {
+	cfg := o.cfg().Executions.Wrapper
+	if !cfg.Enabled || (isolation != nil && isolation.DisableExecWrapper) {
+		return nil
 	}
-	var securityContext *k8s.SecurityContext
-	if env.Isolation != nil && env.Isolation.SecurityContext != nil {
-		securityContext = &k8s.SecurityContext{
-			RunAsUser:                env.Isolation.SecurityContext.RunAsUser,
-			RunAsGroup:               env.Isolation.SecurityContext.RunAsGroup,
-			RunAsNonRoot:             env.Isolation.SecurityContext.RunAsNonRoot,
-			ReadOnlyRootFilesystem:   env.Isolation.SecurityContext.ReadOnlyRootFilesystem,
-			AllowPrivilegeEscalation: env.Isolation.SecurityContext.AllowPrivilegeEscalation,
-		}
-	}
-	var k8sTolerations []k8s.Toleration
-	for _, t := range env.Tolerations {
-		k8sTolerations = append(k8sTolerations, k8s.Toleration{
-			Key:               t.Key,
-			Operator:          t.Operator,
-			Value:             t.Value,
-			Effect:            t.Effect,
-			TolerationSeconds: t.TolerationSeconds,
-		})
+	return &k8s.ExecWrapper{
+		Image:        cfg.Image,
+		Path:         cfg.Path,
+		ConfigMap:    cfg.ConfigMap,
+		ConfigMapKey: cfg.ConfigMapKey,
 	}
-	return &k8s.PodSpec{
-		Name:            podName,
-		Namespace:       namespace,
-		Image:           env.Image,
-		Command:         req.Command,
-		Env:             mergedEnv,
-		CPU:             env.Resources.CPU,
-		Memory:          env.Resources.Memory,
-		Storage:         env.Resources.Storage,
-		RuntimeClass:    runtimeClass,
-		Labels:          labels,
-		NodeSelector:    env.NodeSelector,
-		Tolerations:     k8sTolerations,
-		SecurityContext: securityContext,
-	}
-}
-
-// tryCreateEphemeralPodOrFallback creates the pod; on quota/forbidden error runs in main pod.
+}
+
+// tryCreateEphemeralPodOrFallback creates the pod; on quota/forbidden error runs in main pod,
+// unless the execution overrides the image, resources or isolation the main pod runs with.
 // Returns (true, nil) when fallback to main pod was used, (false, err) on create error, (false, nil) on success.
 func (o *Orchestrator) tryCreateEphemeralPodOrFallback(
-	ctx context.Context, execID, namespace string, podSpec *k8s.PodSpec, req *EphemeralExecRequest, env *models.Environment,
+	ctx context.Context, client k8s.ClientInterface, execID, namespace string, podSpec *k8s.PodSpec,
+	req *EphemeralExecRequest, env *models.Environment,
 ) (fallbackToMain bool, err error) {
-	err = o.k8sClient.CreatePod(ctx, podSpec)
+	err = o.createPodWithUniqueName(ctx, client, podSpec, "exec")
 	if err == nil {
 		return false, nil
 	}
-	errStr := err.Error()
-	if strings.Contains(errStr, "exceeded quota") || strings.Contains(errStr, "forbidden") {
+	if (errors.Is(err, apierrors.QuotaExceeded) || errors.Is(err, apierrors.Forbidden)) && !req.hasOverrides() {
 		o.logger.Warn("ephemeral pod creation failed (quota); running in main pod — execution is not in a clean sandbox",
 			zap.String("exec_id", execID),
 			zap.String("namespace", namespace),
+			zap.Error(err),
 		)
-		o.runExecutionInMainPod(ctx, execID, namespace, req.Command, env)
+		o.setExecutionMode(execID, models.ExecutionModeMainFallback, "main")
+		o.runExecutionInMainPod(ctx, client, execID, namespace, req, env)
 		return true, nil
 	}
 	return false, err
 }
 
-// cleanupEphemeralPod deletes the ephemeral pod after execution (best-effort).
-func (o *Orchestrator) cleanupEphemeralPod(execID, namespace, podName string) {
-	cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 30*time.Second)
+// setExecutionMode records where an execution runs and persists it
+func (o *Orchestrator) setExecutionMode(execID, mode, podName string) {
+	o.execMutex.Lock()
+	exec, exists := o.executions[execID]
+	if !exists || exec.Status == models.ExecutionStatusCanceled {
+		o.execMutex.Unlock()
+		return
+	}
+	exec.Mode = mode
+	exec.PodName = podName
+	execCopy := exec.DeepCopy()
+	o.execMutex.Unlock()
+
+	if o.db != nil {
+		if err := o.db.SaveExecution(context.Background(), execCopy); err != nil {
+			o.logger.Error("failed to save execution mode", zap.Error(err), zap.String("execution_id", execID))
+		}
+	}
+}
+
+// cleanupEphemeralPod deletes the ephemeral pod after execution (best-effort). It runs even when
+// ctx is done; ctx only carries the execution's span.
+func (o *Orchestrator) cleanupEphemeralPod(ctx context.Context, client k8s.ClientInterface, execID, namespace, podName string) {
+	cleanupCtx, cleanupCancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
 	defer cleanupCancel()
-	if err := o.k8sClient.DeletePod(cleanupCtx, namespace, podName, true); err != nil {
+	if err := client.DeletePod(cleanupCtx, namespace, podName, true); err != nil {
 		o.logger.Warn("failed to cleanup ephemeral pod",
 			zap.String("exec_id", execID),
 			zap.String("pod", podName),
@@ -1275,7 +2718,7 @@ func (o *Orchestrator) cleanupEphemeralPod(execID, namespace, podName string) {
 func (o *Orchestrator) recordEphemeralExecutionCompletion(
 	ctx context.Context, execID, podName string, result *k8s.PodCompletionResult, duration time.Duration,
 ) {
-	completedAt := time.Now()
+	completedAt := o.clock.Now()
 	durationMs := duration.Milliseconds()
 	o.execMutex.Lock()
 	var exec *models.Execution
@@ -1285,7 +2728,19 @@ func (o *Orchestrator) recordEphemeralExecutionCompletion(
 		exec.CompletedAt = &completedAt
 		exec.ExitCode = &result.ExitCode
 		exec.Stdout = result.Logs
+		exec.StdoutBytesTotal = result.LogBytesTotal
+		exec.Truncated = result.LogsTruncated
 		exec.DurationMs = &durationMs
+		exec.PodScheduledAt = result.ScheduledAt
+		exec.PodStartedAt = result.StartedAt
+		if result.Wrapper != nil {
+			cpuSeconds, maxMemory := result.Wrapper.CPUSeconds, result.Wrapper.MaxMemoryBytes
+			exec.CPUSeconds = &cpuSeconds
+			exec.MaxMemoryBytes = &maxMemory
+		}
+	}
+	if exists {
+		exec = exec.DeepCopy()
 	}
 	o.execMutex.Unlock()
 
@@ -1297,7 +2752,8 @@ func (o *Orchestrator) recordEphemeralExecutionCompletion(
 			o.logger.Error("failed to save execution results to database", zap.Error(err), zap.String("execution_id", execID))
 		}
 	}
-	o.logger.Info("execution completed",
+	o.notifyExecutionDone(execID)
+	o.logger.With(tracing.LogFields(ctx)...).Info("execution completed",
 		zap.String("exec_id", execID),
 		zap.String("pod", podName),
 		zap.Int("exit_code", result.ExitCode),
@@ -1306,18 +2762,24 @@ func (o *Orchestrator) recordEphemeralExecutionCompletion(
 }
 
 // runWithStandbyPod executes a command in a pre-warmed standby pod (single-use; pod is deleted after)
-func (o *Orchestrator) runWithStandbyPod(ctx context.Context, execID string, standbyPod *StandbyPod, command []string, env *models.Environment) {
-	o.logger.Info("starting execution (standby pod)",
+func (o *Orchestrator) runWithStandbyPod(ctx context.Context, execID string, standbyPod *StandbyPod, req *EphemeralExecRequest, env *models.Environment, userID string) {
+	o.logger.With(tracing.LogFields(ctx)...).Info("starting execution (standby pod)",
 		zap.String("exec_id", execID),
 		zap.String("pod", standbyPod.Name),
 		zap.String("namespace", standbyPod.Namespace),
 		zap.String("image", standbyPod.Image),
 	)
 
+	client, err := o.clusters.Get(standbyPod.Cluster)
+	if err != nil {
+		o.updateExecutionError(execID, err.Error())
+		return
+	}
+
 	defer func() {
-		cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cleanupCtx, cleanupCancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
 		defer cleanupCancel()
-		if err := o.k8sClient.DeletePod(cleanupCtx, standbyPod.Namespace, standbyPod.Name, true); err != nil {
+		if err := client.DeletePod(cleanupCtx, standbyPod.Namespace, standbyPod.Name, true); err != nil {
 			o.logger.Warn("failed to cleanup standby pod",
 				zap.String("exec_id", execID),
 				zap.String("pod", standbyPod.Name),
@@ -1331,22 +2793,51 @@ func (o *Orchestrator) runWithStandbyPod(ctx context.Context, execID string, sta
 		}
 	}()
 
-	startTime := time.Now()
-	var stdoutBuf, stderrBuf bytes.Buffer
-	err := o.k8sClient.ExecInPod(ctx, standbyPod.Namespace, standbyPod.Name, command, nil, &stdoutBuf, &stderrBuf)
-	duration := time.Since(startTime)
+	command := req.Command
+	if len(req.Files) > 0 {
+		dir := o.execWorkingDir()
+		if !o.uploadExecutionFiles(ctx, client, execID, standbyPod.Namespace, standbyPod.Name, dir, req.Files, false) {
+			o.triggerReplenish()
+			return
+		}
+		command = inWorkingDir(dir, command)
+	}
+
+	// The standby pod was started with the environment's variables only: apply the same merged
+	// variables (environment, execution and metadata) an execution pod gets in its spec
+	podEnv := o.buildPodEnv(env, execID, userID, o.executionTokenTTL(req.Timeout), "", env.Env, req.Env)
+	command, stdin := withExecEnv(podEnv,
+		o.killableCommand(ctx, client, standbyPod.Namespace, standbyPod.Name, env.Image, execID, command))
+
+	startTime := o.clock.Now()
+	stdout, stderr := o.newOutputBuffers()
+	err = client.ExecInPod(ctx, standbyPod.Namespace, standbyPod.Name, command, stdin, stdout, stderr)
+	duration := o.clock.Now().Sub(startTime)
+
+	if execTimedOut(ctx, err) {
+		// Stop the command (SIGTERM, then SIGKILL) before the pod is deleted under it
+		killErr := o.killExecTree(ctx, client, execID, standbyPod.Namespace, standbyPod.Name, execTimeoutReason)
+		o.failExecutionTimedOut(execID, duration, func(exec *models.Execution) {
+			setExecutionOutput(exec, stdout, stderr)
+		})
+		if killErr != nil {
+			o.recordKillFailed(execID, killErr)
+		}
+		o.triggerReplenish()
+		return
+	}
 
 	exitCode := 0
 	if err != nil {
 		exitCode = 1
 	}
 
-	completedAt := time.Now()
+	completedAt := o.clock.Now()
 	durationMs := duration.Milliseconds()
 	o.execMutex.Lock()
 	var exec *models.Execution
 	var exists bool
-	if exec, exists = o.executions[execID]; exists {
+	if exec, exists = o.executions[execID]; exists && exec.Status != models.ExecutionStatusCanceled {
 		if err != nil {
 			exec.Status = models.ExecutionStatusFailed
 			exec.Error = err.Error()
@@ -1355,10 +2846,12 @@ func (o *Orchestrator) runWithStandbyPod(ctx context.Context, execID string, sta
 		}
 		exec.CompletedAt = &completedAt
 		exec.ExitCode = &exitCode
-		exec.Stdout = stdoutBuf.String()
-		exec.Stderr = stderrBuf.String()
+		setExecutionOutput(exec, stdout, stderr)
 		exec.DurationMs = &durationMs
 	}
+	if exists {
+		exec = exec.DeepCopy()
+	}
 	o.execMutex.Unlock()
 
 	if exists && o.db != nil {
@@ -1366,6 +2859,7 @@ func (o *Orchestrator) runWithStandbyPod(ctx context.Context, execID string, sta
 			o.logger.Error("failed to save execution results to database", zap.Error(err), zap.String("execution_id", execID))
 		}
 	}
+	o.notifyExecutionDone(execID)
 
 	o.logger.Info("execution completed (standby pod)",
 		zap.String("exec_id", execID),
@@ -1375,88 +2869,162 @@ func (o *Orchestrator) runWithStandbyPod(ctx context.Context, execID string, sta
 	)
 
 	// Trigger replenishment for this environment
-	go o.replenishPool()
+	o.triggerReplenish()
 }
 
 // GetExecution retrieves an execution by ID
 func (o *Orchestrator) GetExecution(ctx context.Context, execID string) (*models.Execution, error) {
-	// Try database first (for persistence across restarts)
+	// The in-memory record is authoritative while it is cached: every update lands there before
+	// it is persisted, so the stored row can lag behind a running execution
+	o.execMutex.RLock()
+	if exec, exists := o.executions[execID]; exists {
+		// Return a copy (taken under the lock: the callback state changes after completion)
+		execCopy := exec.DeepCopy()
+		o.execMutex.RUnlock()
+		return execCopy, nil
+	}
+	o.execMutex.RUnlock()
+
+	// Fall back to the database (for persistence across restarts)
 	if o.db != nil {
 		if exec, err := o.db.GetExecution(ctx, execID); err == nil {
-			// Also update in-memory cache
+			// Return a copy, taken before the cached one can be updated
+			execCopy := exec.DeepCopy()
 			o.execMutex.Lock()
-			o.executions[execID] = exec
+			if _, exists := o.executions[execID]; !exists {
+				o.executions[execID] = exec
+			}
 			o.execMutex.Unlock()
-			// Return a copy
-			execCopy := *exec
-			return &execCopy, nil
+			return execCopy, nil
 		}
 	}
+	return nil, errExecutionNotFound
+}
 
-	// Fallback to in-memory
-	o.execMutex.RLock()
-	exec, exists := o.executions[execID]
-	o.execMutex.RUnlock()
+// ListExecutionsOptions holds the filters and pagination for ListExecutionsWithOptions
+type ListExecutionsOptions struct {
+	Limit int
+	// Offset skips the first executions; prefer PageToken, which does not skip or repeat
+	// executions when new ones are submitted between pages
+	Offset int
+	// PageToken resumes the listing after the last execution of the previous page
+	// (ExecutionListResponse.NextPageToken). Cannot be combined with Offset.
+	PageToken string
+	// CommandContains matches a substring of the command line, case-insensitively
+	CommandContains string
+	ExitCode        *int
+	Status          models.ExecutionStatus
+	CreatedAfter    *time.Time // inclusive
+	CreatedBefore   *time.Time // exclusive
+	UserID          string
+	// Metadata matches executions whose metadata holds all of these key/value pairs
+	Metadata map[string]string
+}
 
-	if !exists {
-		return nil, fmt.Errorf("execution not found")
+// executionFilter returns the database filter of the options
+func (opts ListExecutionsOptions) executionFilter(envID string) database.ExecutionListFilter {
+	return database.ExecutionListFilter{
+		EnvironmentID:   envID,
+		CommandContains: opts.CommandContains,
+		ExitCode:        opts.ExitCode,
+		Status:          opts.Status,
+		CreatedAfter:    opts.CreatedAfter,
+		CreatedBefore:   opts.CreatedBefore,
+		UserID:          opts.UserID,
+		Metadata:        opts.Metadata,
+	}
+}
+
+// matchesExecutionFilter reports whether exec matches filter (the in-memory ListExecutionsFiltered)
+func matchesExecutionFilter(exec *models.Execution, filter database.ExecutionListFilter) bool {
+	switch {
+	case filter.EnvironmentID != "" && exec.EnvironmentID != filter.EnvironmentID:
+		return false
+	case filter.CommandContains != "" &&
+		!strings.Contains(strings.ToLower(strings.Join(exec.Command, " ")), strings.ToLower(filter.CommandContains)):
+		return false
+	case filter.ExitCode != nil && (exec.ExitCode == nil || *exec.ExitCode != *filter.ExitCode):
+		return false
+	case filter.Status != "" && exec.Status != filter.Status:
+		return false
+	case filter.CreatedAfter != nil && exec.CreatedAt.Before(*filter.CreatedAfter):
+		return false
+	case filter.CreatedBefore != nil && !exec.CreatedAt.Before(*filter.CreatedBefore):
+		return false
+	case filter.UserID != "" && exec.UserID != filter.UserID:
+		return false
+	case !matchesMetadata(exec.Metadata, filter.Metadata):
+		return false
 	}
+	return true
+}
 
-	// Return a copy
-	execCopy := *exec
-	return &execCopy, nil
+// matchesMetadata reports whether metadata holds every key/value pair of match
+func matchesMetadata(metadata, match map[string]string) bool {
+	for k, v := range match {
+		if value, ok := metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
 }
 
 // ListExecutions lists executions for an environment
 func (o *Orchestrator) ListExecutions(ctx context.Context, envID string, limit int) (*models.ExecutionListResponse, error) {
+	return o.ListExecutionsWithOptions(ctx, envID, ListExecutionsOptions{Limit: limit})
+}
+
+// ListExecutionsWithOptions lists executions for an environment matching the options' filters,
+// newest first, one page at a time. Total counts all matching executions.
+func (o *Orchestrator) ListExecutionsWithOptions(ctx context.Context, envID string, opts ListExecutionsOptions) (*models.ExecutionListResponse, error) {
+	limit := opts.Limit
 	if limit <= 0 {
 		limit = 100
 	}
 	if limit > 1000 {
 		limit = 1000
 	}
+	offset := opts.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	cursor, err := models.ParsePageToken(opts.PageToken)
+	if err != nil {
+		return nil, apierrors.Wrap(apierrors.ValidationFailed, apierrors.CodeBadRequest, err, "invalid page_token")
+	}
+	if cursor != nil && offset > 0 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "page_token cannot be combined with offset")
+	}
 
-	// Try database first (for persistence across restarts)
-	var execs []*models.Execution
-	var err error
+	filter := opts.executionFilter(envID)
+
+	// Try database first (for persistence across restarts); one extra row tells whether there is a next page
 	if o.db != nil {
-		execs, err = o.db.ListExecutions(ctx, envID, limit)
+		execs, err := o.db.ListExecutionsPage(ctx, filter, cursor, offset, limit+1)
+		var total int
+		if err == nil {
+			total, err = o.db.CountExecutions(ctx, filter)
+		}
 		if err == nil {
-			// Update in-memory cache
+			// Cache the rows not in memory yet; a cached record is authoritative (the stored row
+			// can lag behind it), so the page holds copies of those instead
 			o.execMutex.Lock()
-			for _, exec := range execs {
-				o.executions[exec.ID] = exec
-			}
-			o.execMutex.Unlock()
-
-			// Convert to response format
-			executions := make([]models.ExecutionResponse, len(execs))
 			for i, exec := range execs {
-				executions[i] = models.ExecutionResponse{
-					ID:            exec.ID,
-					EnvironmentID: exec.EnvironmentID,
-					Status:        exec.Status,
-					CreatedAt:     exec.CreatedAt,
-					StartedAt:     exec.StartedAt,
-					CompletedAt:   exec.CompletedAt,
-					ExitCode:      exec.ExitCode,
-					Stdout:        exec.Stdout,
-					Stderr:        exec.Stderr,
-					Error:         exec.Error,
-					DurationMs:    exec.DurationMs,
+				if cached, exists := o.executions[exec.ID]; exists {
+					execs[i] = cached.DeepCopy()
+					continue
 				}
+				o.executions[exec.ID] = exec
+				execs[i] = exec.DeepCopy()
 			}
+			o.execMutex.Unlock()
 
 			o.logger.Debug("listing executions from database",
 				zap.String("environment_id", envID),
-				zap.Int("count", len(executions)),
+				zap.Int("count", len(execs)),
 				zap.Int("limit", limit),
 			)
-
-			return &models.ExecutionListResponse{
-				Executions: executions,
-				Total:      len(executions),
-			}, nil
+			return executionListPage(execs, limit, offset, total), nil
 		}
 		// Fall through to in-memory if database query fails
 		o.logger.Warn("failed to list executions from database, falling back to in-memory", zap.Error(err))
@@ -1464,86 +3032,207 @@ func (o *Orchestrator) ListExecutions(ctx context.Context, envID string, limit i
 
 	// Fallback to in-memory
 	o.execMutex.RLock()
-	var executions []models.ExecutionResponse
+	var execs []*models.Execution
 	totalInMap := len(o.executions)
+	total := 0
 	for _, exec := range o.executions {
-		if envID != "" && exec.EnvironmentID != envID {
+		if !matchesExecutionFilter(exec, filter) {
 			continue
 		}
-		executions = append(executions, models.ExecutionResponse{
-			ID:            exec.ID,
-			EnvironmentID: exec.EnvironmentID,
-			Status:        exec.Status,
-			CreatedAt:     exec.CreatedAt,
-			StartedAt:     exec.StartedAt,
-			CompletedAt:   exec.CompletedAt,
-			ExitCode:      exec.ExitCode,
-			Stdout:        exec.Stdout,
-			Stderr:        exec.Stderr,
-			Error:         exec.Error,
-			DurationMs:    exec.DurationMs,
-		})
+		total++
+		if !cursor.Precedes(exec.CreatedAt, exec.ID) {
+			continue
+		}
+		execs = append(execs, exec.DeepCopy())
 	}
 	o.execMutex.RUnlock()
 
-	// Sort by creation time (newest first)
-	sort.Slice(executions, func(i, j int) bool {
-		return executions[i].CreatedAt.After(executions[j].CreatedAt)
+	// Sort by creation time (newest first), then ID, matching the database order
+	sort.Slice(execs, func(i, j int) bool {
+		if !execs[i].CreatedAt.Equal(execs[j].CreatedAt) {
+			return execs[i].CreatedAt.After(execs[j].CreatedAt)
+		}
+		return execs[i].ID > execs[j].ID
 	})
-
-	// Apply limit
-	if len(executions) > limit {
-		executions = executions[:limit]
+	if offset < len(execs) {
+		execs = execs[offset:]
+	} else {
+		execs = nil
 	}
 
 	o.logger.Debug("listing executions from memory",
 		zap.String("environment_id", envID),
 		zap.Int("total_in_map", totalInMap),
-		zap.Int("matched", len(executions)),
+		zap.Int("matched", len(execs)),
 		zap.Int("limit", limit),
 	)
 
+	return executionListPage(execs, limit, offset, total), nil
+}
+
+// executionListPage builds the response for the first limit of execs (sorted newest first, from
+// offset on); when there are more, NextPageToken resumes after the last one returned. total is
+// the number of matching executions across all pages.
+func executionListPage(execs []*models.Execution, limit, offset, total int) *models.ExecutionListResponse {
+	var nextPageToken string
+	if len(execs) > limit {
+		execs = execs[:limit]
+		last := execs[limit-1]
+		nextPageToken = (&models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}).Token()
+	}
+
+	executions := make([]models.ExecutionResponse, len(execs))
+	for i, exec := range execs {
+		executions[i] = models.NewExecutionResponse(exec)
+	}
+
 	return &models.ExecutionListResponse{
-		Executions: executions,
-		Total:      len(executions),
-	}, nil
+		Executions:    executions,
+		Total:         total,
+		Limit:         limit,
+		Offset:        offset,
+		NextPageToken: nextPageToken,
+	}
+}
+
+// UpdateExecution applies a PATCH /executions/{id}: the execution's metadata is replaced. Any
+// execution can be updated, including finished ones.
+func (o *Orchestrator) UpdateExecution(ctx context.Context, execID string, patch *models.UpdateExecutionRequest) (*models.Execution, error) {
+	// Load the execution into memory if only the database has it
+	if _, err := o.GetExecution(ctx, execID); err != nil {
+		return nil, err
+	}
+
+	o.execMutex.Lock()
+	exec, exists := o.executions[execID]
+	if !exists {
+		o.execMutex.Unlock()
+		return nil, errExecutionNotFound
+	}
+	if patch.Metadata != nil {
+		exec.Metadata = nil
+		if len(*patch.Metadata) > 0 {
+			exec.Metadata = *patch.Metadata
+		}
+	}
+	execCopy := exec.DeepCopy()
+	o.execMutex.Unlock()
+
+	if o.db != nil && patch.Metadata != nil {
+		if err := o.db.UpdateExecutionMetadata(ctx, execID, execCopy.Metadata); err != nil {
+			o.logger.Error("failed to save execution metadata to database", zap.Error(err), zap.String("execution_id", execID))
+			return nil, fmt.Errorf("failed to persist update: %w", err)
+		}
+	}
+	return execCopy, nil
 }
 
-// CancelExecution cancels a running or queued execution
+// CancelExecution cancels a running or queued execution. Executions only in the database (e.g.
+// submitted before a restart) are loaded first.
 func (o *Orchestrator) CancelExecution(ctx context.Context, execID string) error {
+	if _, err := o.GetExecution(ctx, execID); err != nil {
+		return err
+	}
+	return o.cancelExecution(ctx, execID, "canceled by user")
+}
+
+// canceledExecution is an execution markExecutionCanceledLocked marked canceled, with what
+// finishCanceledExecution needs to stop it
+type canceledExecution struct {
+	// exec is a copy of the canceled execution, safe to use without o.execMutex
+	exec      *models.Execution
+	previous  models.ExecutionStatus
+	namespace string
+	// podName is the execution's own pod, empty when it had none or ran in the main pod
+	podName   string
+	inMainPod bool
+}
+
+// cancelExecution marks a pending, queued or running execution as canceled with the given reason
+// and deletes its pod (if any). An execution running in the main pod has its command killed
+// instead, leaving the environment's pod alone.
+func (o *Orchestrator) cancelExecution(ctx context.Context, execID, reason string) error {
 	o.execMutex.Lock()
 	exec, exists := o.executions[execID]
 	if !exists {
 		o.execMutex.Unlock()
-		return fmt.Errorf("execution not found")
+		return errExecutionNotFound
 	}
+	c, err := markExecutionCanceledLocked(exec, reason, o.clock.Now())
+	o.execMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	o.finishCanceledExecution(ctx, c, reason)
+	return nil
+}
 
+// markExecutionCanceledLocked marks a pending, queued or running execution as canceled with the
+// given reason at now. o.execMutex must be held.
+func markExecutionCanceledLocked(exec *models.Execution, reason string, now time.Time) (canceledExecution, error) {
 	// Can only cancel pending, queued, or running executions
 	if exec.Status != models.ExecutionStatusPending &&
 		exec.Status != models.ExecutionStatusQueued &&
 		exec.Status != models.ExecutionStatusRunning {
-		o.execMutex.Unlock()
-		return fmt.Errorf("execution cannot be canceled (status: %s)", exec.Status)
+		return canceledExecution{}, apierrors.New(apierrors.Conflict, apierrors.CodeExecutionNotCancelable, "execution cannot be canceled (status: %s)", exec.Status)
 	}
 
+	c := canceledExecution{
+		previous:  exec.Status,
+		namespace: exec.Namespace,
+		podName:   exec.PodName,
+		inMainPod: exec.Mode == models.ExecutionModeMainFallback,
+	}
+	if exec.Status == models.ExecutionStatusRunning {
+		addExecutionEvent(exec, now, models.ExecutionEventKilled, reason)
+	}
 	exec.Status = models.ExecutionStatusCanceled
-	now := time.Now()
 	exec.CompletedAt = &now
-	exec.Error = "canceled by user"
-	namespace := exec.Namespace
-	podName := exec.PodName
-	o.execMutex.Unlock()
+	exec.Error = reason
+	if c.inMainPod {
+		// The main pod is the environment's, not the execution's: only the command is stopped
+		c.podName = ""
+	}
+	c.exec = exec.DeepCopy()
+	return c, nil
+}
+
+// finishCanceledExecution saves an execution marked canceled and stops its command or deletes
+// its pod
+func (o *Orchestrator) finishCanceledExecution(ctx context.Context, c canceledExecution, reason string) {
+	execID := c.exec.ID
+	envID := c.exec.EnvironmentID
 
 	// Save to database
 	if o.db != nil {
-		if err := o.db.SaveExecution(ctx, exec); err != nil {
+		if err := o.db.SaveExecution(ctx, c.exec); err != nil {
 			o.logger.Error("failed to save canceled execution to database", zap.Error(err), zap.String("execution_id", execID))
 		}
 	}
+	o.notifyExecutionDone(execID)
+
+	if c.inMainPod && c.namespace != "" {
+		client, err := o.clientForEnvironmentID(ctx, envID)
+		if err == nil {
+			err = o.killExecTree(ctx, client, execID, c.namespace, "main", execUserCancelReason)
+		} else {
+			o.logger.Warn("failed to stop command of canceled execution",
+				zap.String("exec_id", execID),
+				zap.Error(err),
+			)
+		}
+		if err != nil {
+			o.recordKillFailed(execID, err)
+		}
+	}
 
 	// Try to delete the pod if it exists
-	if podName != "" && namespace != "" {
-		if err := o.k8sClient.DeletePod(ctx, namespace, podName, true); err != nil {
+	if c.podName != "" && c.namespace != "" {
+		client, err := o.clientForEnvironmentID(ctx, envID)
+		if err == nil {
+			err = client.DeletePod(ctx, c.namespace, c.podName, true)
+		}
+		if err != nil {
 			o.logger.Warn("failed to delete pod for canceled execution",
 				zap.String("exec_id", execID),
 				zap.Error(err),
@@ -1553,9 +3242,8 @@ func (o *Orchestrator) CancelExecution(ctx context.Context, execID string) error
 
 	o.logger.Info("execution canceled",
 		zap.String("exec_id", execID),
+		zap.String("reason", reason),
 	)
-
-	return nil
 }
 
 // updateExecutionStatus updates the status of an execution
@@ -1563,8 +3251,11 @@ func (o *Orchestrator) updateExecutionStatus(execID string, status models.Execut
 	o.execMutex.Lock()
 	var exec *models.Execution
 	var exists bool
-	if exec, exists = o.executions[execID]; exists {
+	if exec, exists = o.executions[execID]; exists && exec.Status != models.ExecutionStatusCanceled {
 		exec.Status = status
+		if status == models.ExecutionStatusQueued {
+			addExecutionEvent(exec, o.clock.Now(), models.ExecutionEventQueued, "")
+		}
 		if timestamp != nil {
 			switch status {
 			case models.ExecutionStatusQueued:
@@ -1576,6 +3267,9 @@ func (o *Orchestrator) updateExecutionStatus(execID string, status models.Execut
 			}
 		}
 	}
+	if exists {
+		exec = exec.DeepCopy()
+	}
 	o.execMutex.Unlock()
 
 	// Save to database
@@ -1585,18 +3279,31 @@ func (o *Orchestrator) updateExecutionStatus(execID string, status models.Execut
 			o.logger.Error("failed to update execution status in database", zap.Error(err), zap.String("execution_id", execID))
 		}
 	}
+	if exists && status.IsTerminal() {
+		o.notifyExecutionDone(execID)
+	}
 }
 
 // updateExecutionError marks an execution as failed with an error message
 func (o *Orchestrator) updateExecutionError(execID string, errMsg string) {
-	now := time.Now()
+	o.updateExecutionErrorCode(execID, "", errMsg)
+}
+
+// updateExecutionErrorCode marks an execution as failed with errMsg, classified by code (an
+// apierrors code; "" for none)
+func (o *Orchestrator) updateExecutionErrorCode(execID, code, errMsg string) {
+	now := o.clock.Now()
 	o.execMutex.Lock()
 	var exec *models.Execution
 	var exists bool
-	if exec, exists = o.executions[execID]; exists {
+	if exec, exists = o.executions[execID]; exists && exec.Status != models.ExecutionStatusCanceled {
 		exec.Status = models.ExecutionStatusFailed
 		exec.CompletedAt = &now
 		exec.Error = errMsg
+		exec.ErrorCode = code
+	}
+	if exists {
+		exec = exec.DeepCopy()
 	}
 	o.execMutex.Unlock()
 
@@ -1607,22 +3314,66 @@ func (o *Orchestrator) updateExecutionError(execID string, errMsg string) {
 			o.logger.Error("failed to update execution error in database", zap.Error(err), zap.String("execution_id", execID))
 		}
 	}
+	if exists {
+		o.notifyExecutionDone(execID)
+	}
+}
+
+// execTimedOutError is the error of executions stopped at their timeout
+const execTimedOutError = "timed out"
+
+// failExecutionTimedOut marks an execution stopped at its timeout as failed (CodeExecTimedOut)
+// without an exit code, keeping the output it produced until then; setOutput copies that output
+// into the record. Callers stop the command first.
+func (o *Orchestrator) failExecutionTimedOut(execID string, duration time.Duration, setOutput func(exec *models.Execution)) {
+	now := o.clock.Now()
+	durationMs := duration.Milliseconds()
+	o.execMutex.Lock()
+	var exec *models.Execution
+	var exists bool
+	if exec, exists = o.executions[execID]; exists && exec.Status != models.ExecutionStatusCanceled {
+		exec.Status = models.ExecutionStatusFailed
+		exec.CompletedAt = &now
+		exec.Error = execTimedOutError
+		exec.ErrorCode = apierrors.CodeExecTimedOut
+		exec.DurationMs = &durationMs
+		addExecutionEvent(exec, now, models.ExecutionEventKilled, execTimedOutError)
+		setOutput(exec)
+	}
+	if exists {
+		exec = exec.DeepCopy()
+	}
+	o.execMutex.Unlock()
+
+	if exists && o.db != nil {
+		if err := o.db.SaveExecution(context.Background(), exec); err != nil {
+			o.logger.Error("failed to save timed out execution", zap.Error(err), zap.String("execution_id", execID))
+		}
+	}
+	if exists {
+		o.notifyExecutionDone(execID)
+	}
 }
 
 // ========== Standby Pod Pool Management ==========
 
-// runPoolReplenishment runs in the background to maintain the standby pod pool
+// standbyCreateTimeout bounds creating one standby pod, including waiting for it to run
+const standbyCreateTimeout = 30 * time.Second
+
+// runPoolReplenishment is the single worker that maintains the standby pod pools. It replenishes
+// on a timer and whenever triggerReplenish is called; running all passes on one goroutine keeps
+// concurrent passes from each seeing the same shortfall and overshooting the target.
 func (o *Orchestrator) runPoolReplenishment() {
 	o.logger.Info("starting standby pod pool replenishment",
-		zap.Int("target_size", o.config.Pool.Size),
-		zap.String("default_image", o.config.Pool.DefaultImage),
+		zap.Int("target_size", o.cfg().Pool.Size),
+		zap.String("default_image", o.cfg().Pool.DefaultImage),
 	)
 
 	// Initial pool creation
 	o.replenishPool()
 
 	// Periodic check to maintain pool size
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := o.clock.NewTicker(o.poolInterval)
 	defer ticker.Stop()
 
 	for {
@@ -1631,163 +3382,302 @@ func (o *Orchestrator) runPoolReplenishment() {
 			o.logger.Info("stopping standby pod pool replenishment")
 			o.cleanupPool()
 			return
-		case <-ticker.C:
+		case <-ticker.C():
+			o.replenishPool()
+		case <-o.poolTrigger:
 			o.replenishPool()
 		}
 	}
 }
 
-// replenishPool ensures each environment with pool enabled has the target number of standby pods
-func (o *Orchestrator) replenishPool() {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// triggerReplenish asks the replenishment worker for a pass without blocking; requests made
+// while one is already pending are merged into it
+func (o *Orchestrator) triggerReplenish() {
+	select {
+	case o.poolTrigger <- struct{}{}:
+	default:
+	}
+}
 
+// replenishPool starts creating the standby pods each environment with pool enabled is missing.
+// Pods still being created count towards the target, so needed = target - current - in flight.
+// Cordoned environments are skipped until uncordoned. Only called from the replenishment worker.
+func (o *Orchestrator) replenishPool() {
 	o.envMutex.RLock()
 	envsToReplenish := make([]*models.Environment, 0, len(o.environments))
 	for _, env := range o.environments {
-		if env.Pool != nil && env.Pool.Enabled && env.Status == models.StatusRunning {
-			envsToReplenish = append(envsToReplenish, env)
+		if env.Pool != nil && env.Pool.Enabled && env.Status == models.StatusRunning && !env.Cordoned && o.clusters.Reachable(env.Cluster) {
+			envsToReplenish = append(envsToReplenish, env.DeepCopy())
 		}
 	}
 	o.envMutex.RUnlock()
 
 	for _, env := range envsToReplenish {
-		envLock := o.replenishLockForEnv(env.ID)
-		envLock.Lock()
-		poolSize := env.Pool.Size
-		if poolSize <= 0 {
-			poolSize = 2
-		}
+		poolSize := poolTargetSize(env.Pool)
 		o.standbyPoolMutex.Lock()
 		current := len(o.standbyPool[env.ID])
-		needed := poolSize - current
+		inflight := o.poolInflight[env.ID]
+		needed := poolSize - current - inflight
+		if o.poolDrained[env.ID] {
+			needed = 0
+		}
+		generation := o.poolGeneration[env.ID]
+		if needed > 0 {
+			o.poolInflight[env.ID] += needed
+		}
 		o.standbyPoolMutex.Unlock()
 
 		if needed <= 0 {
-			envLock.Unlock()
 			continue
 		}
 
 		o.logger.Debug("replenishing standby pool",
 			zap.String("environment_id", env.ID),
 			zap.Int("current", current),
+			zap.Int("in_flight", inflight),
 			zap.Int("target", poolSize),
 			zap.Int("creating", needed),
 		)
 
 		for i := 0; i < needed; i++ {
-			if err := o.createStandbyPod(ctx, env); err != nil {
-				o.logger.Warn("failed to create standby pod",
-					zap.String("environment_id", env.ID),
-					zap.Error(err),
-				)
-			}
+			go o.replenishOne(env, generation)
+		}
+	}
+}
+
+// prewarmStandbyPool starts creating the standby pods of an environment that is still being
+// provisioned (pool.prewarm_on_create), at most as many as the namespace quota has room for.
+// Pods that fail to start are left to the replenishment worker once the environment runs.
+func (o *Orchestrator) prewarmStandbyPool(envID string) {
+	o.envMutex.RLock()
+	stored, exists := o.environments[envID]
+	var env *models.Environment
+	if exists {
+		env = stored.DeepCopy()
+	}
+	o.envMutex.RUnlock()
+	if env == nil || env.Pool == nil || env.Cordoned {
+		return
+	}
+
+	// The quota reserves the main pod, one exec pod and one slot per configured pool pod
+	target := min(poolTargetSize(env.Pool), quotaMultiplier(env.Pool)-2)
+
+	o.standbyPoolMutex.Lock()
+	needed := target - len(o.standbyPool[envID]) - o.poolInflight[envID]
+	if o.poolDrained[envID] {
+		needed = 0
+	}
+	generation := o.poolGeneration[envID]
+	if needed > 0 {
+		o.poolInflight[envID] += needed
+	}
+	o.standbyPoolMutex.Unlock()
+
+	if needed <= 0 {
+		return
+	}
+	o.logger.Debug("prewarming standby pool",
+		zap.String("environment_id", envID),
+		zap.Int("creating", needed),
+	)
+	for i := 0; i < needed; i++ {
+		go o.replenishOne(env, generation)
+	}
+}
+
+// poolTargetSize is the number of standby pods an environment's pool holds
+func poolTargetSize(pool *models.PoolConfig) int {
+	if pool.Size <= 0 {
+		return 2
+	}
+	return pool.Size
+}
+
+// poolMinReady is the number of standby pods an environment's pool needs to be ready
+// (pool.min_ready, or the whole pool when unset)
+func poolMinReady(pool *models.PoolConfig) int {
+	if pool.MinReady > 0 {
+		return pool.MinReady
+	}
+	return poolTargetSize(pool)
+}
+
+// replenishOne creates one standby pod for the environment and adds it to the pool, releasing
+// its in-flight slot in the same step so the pod is never counted twice or not at all. The pod
+// is deleted instead when the pool was refreshed or drained since generation, or the environment
+// is gone.
+func (o *Orchestrator) replenishOne(env *models.Environment, generation int) {
+	ctx, cancel := context.WithTimeout(context.Background(), standbyCreateTimeout)
+	defer cancel()
+
+	pod, err := o.createStandbyPod(ctx, env)
+	if err != nil {
+		o.logger.Warn("failed to create standby pod",
+			zap.String("environment_id", env.ID),
+			zap.Error(err),
+		)
+	}
+
+	o.standbyPoolMutex.Lock()
+	if o.poolInflight[env.ID] > 1 {
+		o.poolInflight[env.ID]--
+	} else {
+		delete(o.poolInflight, env.ID)
+	}
+	// The environment may have been deleted since createStandbyPod checked; checking under
+	// standbyPoolMutex keeps the pod out of a pool that was already drained
+	o.envMutex.RLock()
+	_, exists := o.environments[env.ID]
+	o.envMutex.RUnlock()
+	stale := o.poolGeneration[env.ID] != generation || !exists
+	var becameReady bool
+	poolPods := 0
+	if pod != nil && !stale {
+		o.standbyPool[env.ID] = append(o.standbyPool[env.ID], pod)
+		poolPods = len(o.standbyPool[env.ID])
+		if !o.poolReadyReached[env.ID] && poolPods >= poolMinReady(env.Pool) {
+			o.poolReadyReached[env.ID] = true
+			becameReady = true
 		}
-		envLock.Unlock()
+	}
+	o.standbyPoolMutex.Unlock()
+
+	if pod != nil && stale {
+		o.deleteStandbyPods(ctx, env.ID, []*StandbyPod{pod})
+		o.triggerReplenish()
+	}
+	if becameReady {
+		sinceCreation := o.clock.Now().Sub(env.CreatedAt).Round(time.Millisecond)
+		o.logger.Info("standby pool ready",
+			zap.String("environment_id", env.ID),
+			zap.Int("pods", poolPods),
+			zap.Duration("since_creation", sinceCreation),
+			zap.Bool("prewarmed", env.Pool.PrewarmOnCreate),
+		)
+		o.logReconciliationEvent(env.ID, "pool_ready", "Standby pool ready",
+			fmt.Sprintf("%d standby pods ready %s after creation", poolPods, sinceCreation))
 	}
 }
 
-// replenishLockForEnv returns the per-env mutex for replenishment (so we don't over-create from concurrent replenishPool calls).
-func (o *Orchestrator) replenishLockForEnv(envID string) *sync.Mutex {
-	o.replenishEnvMutex.Lock()
-	defer o.replenishEnvMutex.Unlock()
-	if o.replenishEnvLocks[envID] == nil {
-		o.replenishEnvLocks[envID] = &sync.Mutex{}
+// setPoolReady fills in env.PoolReady from the environment's current standby pool; nil for
+// cordoned environments, whose pool is not replenished and may run empty on purpose
+func (o *Orchestrator) setPoolReady(env *models.Environment) {
+	if env.Pool == nil || !env.Pool.Enabled || env.Cordoned {
+		env.PoolReady = nil
+		return
 	}
-	return o.replenishEnvLocks[envID]
+	o.standbyPoolMutex.Lock()
+	ready := len(o.standbyPool[env.ID]) >= poolMinReady(env.Pool)
+	o.standbyPoolMutex.Unlock()
+	env.PoolReady = &ready
 }
 
-// createStandbyPod creates one standby pod in the environment's namespace with a unique name
-func (o *Orchestrator) createStandbyPod(ctx context.Context, env *models.Environment) error {
-	podName := "standby-" + uuid.New().String()[:8]
+// createStandbyPod creates one standby pod in the environment's namespace with a unique name and
+// waits for it to run; returns nil (and no error) when the environment went away meanwhile
+func (o *Orchestrator) createStandbyPod(ctx context.Context, env *models.Environment) (*StandbyPod, error) {
+	client, err := o.clientFor(env)
+	if err != nil {
+		return nil, err
+	}
+	podName := newPodName("standby")
 
-	runtimeClass := o.config.Kubernetes.RuntimeClass
+	runtimeClass := o.cfg().Kubernetes.RuntimeClass
 	if env.Isolation != nil && env.Isolation.RuntimeClass != "" {
 		runtimeClass = env.Isolation.RuntimeClass
 	}
 	var securityContext *k8s.SecurityContext
-	if env.Isolation != nil && env.Isolation.SecurityContext != nil {
-		securityContext = &k8s.SecurityContext{
-			RunAsUser:                env.Isolation.SecurityContext.RunAsUser,
-			RunAsGroup:               env.Isolation.SecurityContext.RunAsGroup,
-			RunAsNonRoot:             env.Isolation.SecurityContext.RunAsNonRoot,
-			ReadOnlyRootFilesystem:   env.Isolation.SecurityContext.ReadOnlyRootFilesystem,
-			AllowPrivilegeEscalation: env.Isolation.SecurityContext.AllowPrivilegeEscalation,
-		}
-	}
-	var k8sTolerations []k8s.Toleration
-	for _, t := range env.Tolerations {
-		k8sTolerations = append(k8sTolerations, k8s.Toleration{
-			Key:               t.Key,
-			Operator:          t.Operator,
-			Value:             t.Value,
-			Effect:            t.Effect,
-			TolerationSeconds: t.TolerationSeconds,
-		})
+	if env.Isolation != nil {
+		securityContext = toK8sSecurityContext(env.Isolation.SecurityContext)
 	}
+	k8sTolerations := toK8sTolerations(env.Tolerations)
 
-	labels := map[string]string{
+	labels := podLabels(map[string]string{
 		"app":            "agentbox",
 		"managed-by":     "agentbox",
 		"type":           "standby",
 		"environment-id": env.ID,
-	}
-	for k, v := range env.Labels {
-		labels[k] = v
-	}
+	}, env.Labels)
 
 	cpu := env.Resources.CPU
 	mem := env.Resources.Memory
+	pool := o.cfg().Pool
 	if cpu == "" {
-		cpu = o.config.Pool.DefaultCPU
+		cpu = pool.DefaultCPU
 	}
 	if mem == "" {
-		mem = o.config.Pool.DefaultMemory
+		mem = pool.DefaultMemory
 	}
 
 	podSpec := &k8s.PodSpec{
-		Name:            podName,
-		Namespace:       env.Namespace,
-		Image:           env.Image,
-		Command:         []string{"/bin/sh", "-c", "trap 'exit 0' TERM; while true; do sleep 1; done"},
-		CPU:             cpu,
-		Memory:          mem,
-		Storage:         env.Resources.Storage,
-		RuntimeClass:    runtimeClass,
-		Labels:          labels,
-		NodeSelector:    env.NodeSelector,
-		Tolerations:     k8sTolerations,
-		SecurityContext: securityContext,
-	}
-
-	if err := o.k8sClient.CreatePod(ctx, podSpec); err != nil {
-		return fmt.Errorf("create standby pod: %w", err)
-	}
-
-	if err := o.k8sClient.WaitForPodRunning(ctx, env.Namespace, podName); err != nil {
-		if delErr := o.k8sClient.DeletePod(ctx, env.Namespace, podName, true); delErr != nil {
+		Name:                         podName,
+		Namespace:                    env.Namespace,
+		Image:                        env.Image,
+		Command:                      []string{"/bin/sh", "-c", "trap 'exit 0' TERM; while true; do sleep 1; done"},
+		Env:                          o.buildPodEnv(env, "", env.UserID, o.environmentTokenTTL(env), "", env.Env),
+		CPU:                          cpu,
+		Memory:                       mem,
+		Storage:                      env.Resources.Storage,
+		RuntimeClass:                 runtimeClass,
+		PriorityClassName:            o.priorityClassFor(env.Isolation, podTypeStandby),
+		ServiceAccountName:           serviceAccountName(env.Isolation),
+		AutomountServiceAccountToken: automountServiceAccountToken(env.Isolation),
+		Labels:                       labels,
+		NodeSelector:                 env.NodeSelector,
+		Tolerations:                  k8sTolerations,
+		Affinity:                     toK8sAffinity(env.Affinity),
+		SecurityContext:              securityContext,
+		DNS:                          toK8sDNS(env.Isolation),
+	}
+
+	if err := o.createPodWithUniqueName(ctx, client, podSpec, "standby"); err != nil {
+		return nil, fmt.Errorf("create standby pod: %w", err)
+	}
+	podName = podSpec.Name
+
+	if err := client.WaitForPodRunning(ctx, env.Namespace, podName); err != nil {
+		if delErr := client.DeletePod(ctx, env.Namespace, podName, true); delErr != nil {
 			o.logger.Warn("failed to delete standby pod after start failure", zap.Error(delErr), zap.String("pod", podName), zap.String("namespace", env.Namespace))
 		}
-		return fmt.Errorf("standby pod failed to start: %w", err)
+		return nil, fmt.Errorf("standby pod failed to start: %w", err)
+	}
+
+	if env.ReadinessCheck != nil {
+		if output, err := o.waitForReady(ctx, client, env.Namespace, podName, env.ReadinessCheck); err != nil {
+			if delErr := client.DeletePod(ctx, env.Namespace, podName, true); delErr != nil {
+				o.logger.Warn("failed to delete standby pod after readiness failure", zap.Error(delErr), zap.String("pod", podName), zap.String("namespace", env.Namespace))
+			}
+			return nil, fmt.Errorf("standby pod failed readiness check: %w (%s)", err, output)
+		}
 	}
 
 	standbyPod := &StandbyPod{
 		Name:      podName,
 		Namespace: env.Namespace,
+		Cluster:   env.Cluster,
 		Image:     env.Image,
-		CreatedAt: time.Now(),
+		CreatedAt: o.clock.Now(),
 	}
 
-	o.standbyPoolMutex.Lock()
-	o.standbyPool[env.ID] = append(o.standbyPool[env.ID], standbyPod)
-	o.standbyPoolMutex.Unlock()
+	// The environment may have been deleted while the pod was starting; prewarmed pods start
+	// while it is still pending
+	o.envMutex.RLock()
+	current, exists := o.environments[env.ID]
+	stillWanted := exists && (current.Status == models.StatusRunning || current.Status == models.StatusPending)
+	o.envMutex.RUnlock()
+	if !stillWanted {
+		if delErr := client.DeletePod(ctx, env.Namespace, podName, true); delErr != nil {
+			o.logger.Debug("delete standby pod of removed environment (best effort)", zap.String("pod", podName), zap.Error(delErr))
+		}
+		return nil, nil
+	}
 
 	o.logger.Debug("created standby pod",
 		zap.String("pod", podName),
 		zap.String("namespace", env.Namespace),
 		zap.String("environment_id", env.ID),
 	)
-	return nil
+	return standbyPod, nil
 }
 
 // claimStandbyPod takes one standby pod from the pool for the environment; returns nil if none available
@@ -1810,10 +3700,27 @@ func (o *Orchestrator) claimStandbyPod(envID string) *StandbyPod {
 		zap.Int("remaining", len(o.standbyPool[envID])),
 	)
 
-	go o.replenishPool()
+	o.triggerReplenish()
 	return pod
 }
 
+// drainStandbyPool drops the standby pool entries of an environment that is being deleted
+// (its pods go away with the namespace)
+func (o *Orchestrator) drainStandbyPool(envID string) {
+	o.standbyPoolMutex.Lock()
+	drained := len(o.standbyPool[envID])
+	delete(o.standbyPool, envID)
+	delete(o.poolDrained, envID)
+	delete(o.poolReadyReached, envID)
+	// Pods still starting are deleted rather than added (see replenishOne)
+	o.poolGeneration[envID]++
+	o.standbyPoolMutex.Unlock()
+
+	if drained > 0 {
+		o.logger.Debug("drained standby pool", zap.String("environment_id", envID), zap.Int("pods", drained))
+	}
+}
+
 // cleanupPool removes all standby pods (called on shutdown)
 func (o *Orchestrator) cleanupPool() {
 	o.standbyPoolMutex.Lock()
@@ -1824,7 +3731,11 @@ func (o *Orchestrator) cleanupPool() {
 
 	for envID, pods := range o.standbyPool {
 		for _, pod := range pods {
-			if err := o.k8sClient.DeletePod(ctx, pod.Namespace, pod.Name, true); err != nil {
+			client, err := o.clusters.Get(pod.Cluster)
+			if err == nil {
+				err = client.DeletePod(ctx, pod.Namespace, pod.Name, true)
+			}
+			if err != nil {
 				o.logger.Warn("failed to delete standby pod",
 					zap.String("pod", pod.Name),
 					zap.String("environment_id", envID),
@@ -1838,7 +3749,8 @@ func (o *Orchestrator) cleanupPool() {
 	o.logger.Info("cleaned up standby pod pool")
 }
 
-// GetPoolStatus returns per-environment standby pool counts (key = environment ID)
+// GetPoolStatus returns per-environment standby pool counts (key = environment ID); drained
+// pools are reported with 0 pods (see DrainedPools)
 func (o *Orchestrator) GetPoolStatus() map[string]int {
 	o.standbyPoolMutex.Lock()
 	defer o.standbyPoolMutex.Unlock()
@@ -1847,6 +3759,9 @@ func (o *Orchestrator) GetPoolStatus() map[string]int {
 	for envID, pods := range o.standbyPool {
 		status[envID] = len(pods)
 	}
+	for envID := range o.poolDrained {
+		status[envID] = len(o.standbyPool[envID])
+	}
 	return status
 }
 
@@ -1854,16 +3769,13 @@ func (o *Orchestrator) GetPoolStatus() map[string]int {
 
 // runReconciliationLoop runs periodically to reconcile pending/failed environments and restore missing pods
 func (o *Orchestrator) runReconciliationLoop() {
-	interval := time.Duration(o.config.Reconciliation.IntervalSeconds) * time.Second
-	if interval < 10*time.Second {
-		interval = 10 * time.Second
-	}
-	ticker := time.NewTicker(interval)
+	interval := o.reconciliationInterval()
+	ticker := o.clock.NewTicker(interval)
 	defer ticker.Stop()
 
 	o.logger.Info("reconciliation loop started",
 		zap.Duration("interval", interval),
-		zap.Int("max_retries", o.config.Reconciliation.MaxRetries),
+		zap.Int("max_retries", o.cfg().Reconciliation.EffectiveMaxRetries()),
 	)
 
 	for {
@@ -1871,14 +3783,30 @@ func (o *Orchestrator) runReconciliationLoop() {
 		case <-o.reconciliationStopChan:
 			o.logger.Info("reconciliation loop stopped")
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			o.logger.Info("reconciliation cycle starting")
 			o.reconcileAll()
 			o.logger.Info("reconciliation cycle completed")
+
+			// Pick up interval changes from a configuration reload
+			if next := o.reconciliationInterval(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+				o.logger.Info("reconciliation interval changed", zap.Duration("interval", interval))
+			}
 		}
 	}
 }
 
+// reconciliationInterval returns the configured reconciliation interval (at least 10s)
+func (o *Orchestrator) reconciliationInterval() time.Duration {
+	interval := time.Duration(o.cfg().Reconciliation.IntervalSeconds) * time.Second
+	if interval < 10*time.Second {
+		interval = 10 * time.Second
+	}
+	return interval
+}
+
 // reconcileAll iterates over environments and reconciles those that need it.
 // Only reconciles envs that still exist in the DB (so deleted envs are skipped on all replicas).
 func (o *Orchestrator) reconcileAll() {
@@ -1899,6 +3827,14 @@ func (o *Orchestrator) reconcileAll() {
 		}
 	}
 
+	// Refresh cluster reachability; environments on unreachable clusters are reported as degraded
+	// and left alone (no retries are consumed) until their cluster comes back
+	for _, name := range o.clusters.Names() {
+		if err := o.clusters.CheckHealth(ctx, name); err != nil {
+			o.logger.Warn("reconciliation: cluster unreachable", zap.String("cluster", name), zap.Error(err))
+		}
+	}
+
 	o.envMutex.RLock()
 	envList := make([]*models.Environment, 0, len(o.environments))
 	for _, env := range o.environments {
@@ -1910,8 +3846,10 @@ func (o *Orchestrator) reconcileAll() {
 		if env.Status == models.StatusTerminating || env.Status == models.StatusTerminated {
 			continue
 		}
-		envCopy := *env
-		envList = append(envList, &envCopy)
+		if !o.clusters.Reachable(env.Cluster) {
+			continue
+		}
+		envList = append(envList, env.DeepCopy())
 	}
 	o.envMutex.RUnlock()
 
@@ -1920,15 +3858,24 @@ func (o *Orchestrator) reconcileAll() {
 		zap.Int("total_in_memory", len(o.environments)),
 	)
 
-	maxRetries := o.config.Reconciliation.MaxRetries
-	if maxRetries < 0 {
-		maxRetries = 0
-	}
+	maxRetries := o.cfg().Reconciliation.EffectiveMaxRetries()
 
 	for _, env := range envList {
+		// Environments deleted by another replica during this pass are evicted from the cache by
+		// the cache sync; stop reconciling them
+		if !o.isCached(env.ID) {
+			continue
+		}
+
+		// A completed oneshot environment is never started again, nor is the pod of a running one
+		// recreated (that would run its command twice)
+		if env.IsOneShot() && (env.CompletedAt != nil || env.Status == models.StatusRunning) {
+			continue
+		}
+
 		// Pending or Failed: retry provisioning if retries left
 		if env.Status == models.StatusPending || env.Status == models.StatusFailed {
-			if env.ReconciliationRetryCount >= maxRetries {
+			if maxRetries >= 0 && env.ReconciliationRetryCount >= maxRetries {
 				continue // Already exceeded retries; user can use "Retry" button to reset
 			}
 			o.reconcilePendingOrFailed(ctx, env)
@@ -1941,22 +3888,46 @@ func (o *Orchestrator) reconcileAll() {
 		}
 	}
 
+	// Delete oneshot environments whose retention period has passed
+	o.deleteExpiredOneShots(ctx)
+
+	// Delete namespaces whose environment is gone (e.g. the delete failed on the cluster side)
+	o.collectOrphanNamespacesIfEnabled(ctx)
+
 	// Replenish standby pools so Running envs with pool enabled get standby pods
 	// even if the pool ticker hasn't run yet or replenishment previously failed
-	o.replenishPool()
+	// (cordoned envs are left with whatever pool they have)
+	o.triggerReplenish()
 }
 
 // reconcilePendingOrFailed retries provisioning for a pending or failed environment
 func (o *Orchestrator) reconcilePendingOrFailed(ctx context.Context, env *models.Environment) {
 	envID := env.ID
 	envNamespace := env.Namespace
-	maxRetries := o.config.Reconciliation.MaxRetries
+	maxRetries := o.cfg().Reconciliation.EffectiveMaxRetries()
 	retryCount := env.ReconciliationRetryCount
 
-	o.logReconciliationEvent(envID, "reconciliation_start", "Reconciliation attempt started", fmt.Sprintf("attempt %d of %d", retryCount+1, maxRetries))
+	attempt := fmt.Sprintf("attempt %d of %d", retryCount+1, maxRetries)
+	if maxRetries < 0 {
+		attempt = fmt.Sprintf("attempt %d (unlimited retries)", retryCount+1)
+	}
+	o.logReconciliationEvent(envID, "reconciliation_start", "Reconciliation attempt started", attempt)
+
+	client, err := o.clientFor(env)
+	if err != nil {
+		o.logReconciliationEvent(envID, "reconciliation_failure", "Reconciliation failed", err.Error())
+		return
+	}
+
+	// A main pod that failed because it was evicted or preempted says why in its status
+	if pod, err := client.GetPod(ctx, envNamespace, mainPodName); err == nil {
+		if reason, message, evicted := podEvictionReason(pod); evicted {
+			o.recordPodEviction(env, reason, message)
+		}
+	}
 
 	// Delete main pod if it exists (e.g. stuck Pending/Failed) so provisionEnvironment can recreate
-	if errDel := o.k8sClient.DeletePod(ctx, envNamespace, "main", true); errDel != nil {
+	if errDel := o.replaceMainPod(ctx, client, envNamespace, env.Lifecycle.DeepCopy()); errDel != nil {
 		o.logger.Debug("delete pod before reconciliation (best-effort)", zap.String("namespace", envNamespace), zap.Error(errDel))
 	}
 
@@ -1968,12 +3939,12 @@ func (o *Orchestrator) reconcilePendingOrFailed(ctx context.Context, env *models
 		return
 	}
 
-	provisionCtx, cancel := context.WithTimeout(context.Background(), time.Duration(o.config.Timeouts.StartupTimeout)*time.Second)
+	provisionCtx, cancel := context.WithTimeout(context.Background(), o.provisionTimeout(envToProvision))
 	defer cancel()
 
 	// Try provisioning (reuses existing namespace/quota/network if present)
 	if err := o.provisionEnvironment(provisionCtx, envToProvision); err != nil {
-		now := time.Now()
+		now := o.clock.Now()
 		newCount := envToProvision.ReconciliationRetryCount + 1
 		errMsg := err.Error()
 
@@ -1993,11 +3964,20 @@ func (o *Orchestrator) reconcilePendingOrFailed(ctx context.Context, env *models
 
 		o.logReconciliationEvent(envID, "reconciliation_failure", "Reconciliation failed", errMsg)
 
-		if newCount >= maxRetries {
+		if maxRetries >= 0 && newCount >= maxRetries {
 			o.updateEnvironmentStatus(envID, models.StatusFailed)
 			o.logReconciliationEvent(envID, "reconciliation_max_retries",
 				"Max reconciliation retries exceeded; use Retry button to try again",
 				fmt.Sprintf("attempts: %d", newCount))
+			o.notifyCritical(notify.Event{
+				Kind:            notify.EventEnvironmentFailed,
+				Key:             envID,
+				UserID:          envToProvision.UserID,
+				EnvironmentID:   envID,
+				EnvironmentName: envToProvision.Name,
+				Error:           errMsg,
+				Attempts:        newCount,
+			})
 		}
 		return
 	}
@@ -2022,13 +4002,26 @@ func (o *Orchestrator) reconcilePendingOrFailed(ctx context.Context, env *models
 
 // reconcileRunning ensures the main pod exists for a running environment; recreates if missing
 func (o *Orchestrator) reconcileRunning(ctx context.Context, env *models.Environment) {
-	_, err := o.k8sClient.GetPod(ctx, env.Namespace, "main")
+	client, err := o.clientFor(env)
+	if err != nil {
+		return
+	}
+	pod, err := client.GetPod(ctx, env.Namespace, "main")
 	if err == nil {
-		return // Pod exists
+		// An evicted or preempted pod is replaced like a missing one
+		reason, message, evicted := podEvictionReason(pod)
+		if !evicted {
+			return // Pod exists
+		}
+		o.recordPodEviction(env, reason, message)
+		if err := o.replaceMainPod(ctx, client, env.Namespace, env.Lifecycle.DeepCopy()); err != nil {
+			o.logReconciliationEvent(env.ID, "reconciliation_failure", "Failed to delete evicted main pod", err.Error())
+			return
+		}
+	} else {
+		o.logReconciliationEvent(env.ID, "reconciliation_pod_missing", "Main pod not found; recreating", "")
 	}
 
-	o.logReconciliationEvent(env.ID, "reconciliation_pod_missing", "Main pod not found; recreating", "")
-
 	o.envMutex.RLock()
 	envCurrent, exists := o.environments[env.ID]
 	o.envMutex.RUnlock()
@@ -2046,6 +4039,10 @@ func (o *Orchestrator) reconcileRunning(ctx context.Context, env *models.Environ
 
 // ensureMainPod creates the main pod in an existing namespace and waits for running (used when pod is missing)
 func (o *Orchestrator) ensureMainPod(ctx context.Context, env *models.Environment) error {
+	client, err := o.clientFor(env)
+	if err != nil {
+		return err
+	}
 	envNamespace := env.Namespace
 	envImage := env.Image
 	envCommand := env.Command
@@ -2053,70 +4050,68 @@ func (o *Orchestrator) ensureMainPod(ctx context.Context, env *models.Environmen
 		envCommand = []string{"/bin/sh", "-c", "sleep infinity"}
 	}
 	envResources := env.Resources
-	envEnvVars := env.Env
+	envEnvVars := o.mainPodEnv(ctx, env)
 	envLabels := env.Labels
 	envNodeSelector := env.NodeSelector
 	envTolerations := env.Tolerations
+	envAffinity := env.Affinity
 	envIsolation := env.Isolation
 
-	labels := map[string]string{"app": "agentbox", "env-id": env.ID, "managed-by": "agentbox"}
-	for k, v := range envLabels {
-		labels[k] = v
-	}
+	labels := podLabels(map[string]string{"app": "agentbox", "env-id": env.ID, "managed-by": "agentbox"}, envLabels)
 
-	var k8sTolerations []k8s.Toleration
-	for _, t := range envTolerations {
-		k8sTolerations = append(k8sTolerations, k8s.Toleration{
-			Key:               t.Key,
-			Operator:          t.Operator,
-			Value:             t.Value,
-			Effect:            t.Effect,
-			TolerationSeconds: t.TolerationSeconds,
-		})
-	}
+	k8sTolerations := toK8sTolerations(envTolerations)
 
-	runtimeClass := o.config.Kubernetes.RuntimeClass
+	runtimeClass := o.cfg().Kubernetes.RuntimeClass
 	if envIsolation != nil && envIsolation.RuntimeClass != "" {
 		runtimeClass = envIsolation.RuntimeClass
 	}
 	var securityContext *k8s.SecurityContext
-	if envIsolation != nil && envIsolation.SecurityContext != nil {
-		securityContext = &k8s.SecurityContext{
-			RunAsUser:                envIsolation.SecurityContext.RunAsUser,
-			RunAsGroup:               envIsolation.SecurityContext.RunAsGroup,
-			RunAsNonRoot:             envIsolation.SecurityContext.RunAsNonRoot,
-			ReadOnlyRootFilesystem:   envIsolation.SecurityContext.ReadOnlyRootFilesystem,
-			AllowPrivilegeEscalation: envIsolation.SecurityContext.AllowPrivilegeEscalation,
-		}
+	if envIsolation != nil {
+		securityContext = toK8sSecurityContext(envIsolation.SecurityContext)
 	}
 
 	podSpec := &k8s.PodSpec{
-		Name:            "main",
-		Namespace:       envNamespace,
-		Image:           envImage,
-		Command:         envCommand,
-		Env:             envEnvVars,
-		CPU:             envResources.CPU,
-		Memory:          envResources.Memory,
-		Storage:         envResources.Storage,
-		RuntimeClass:    runtimeClass,
-		Labels:          labels,
-		NodeSelector:    envNodeSelector,
-		Tolerations:     k8sTolerations,
-		SecurityContext: securityContext,
-	}
-
-	if err := o.k8sClient.CreatePod(ctx, podSpec); err != nil {
+		Name:                         "main",
+		Namespace:                    envNamespace,
+		Image:                        envImage,
+		Command:                      envCommand,
+		Env:                          envEnvVars,
+		CPU:                          envResources.CPU,
+		Memory:                       envResources.Memory,
+		Storage:                      envResources.Storage,
+		RuntimeClass:                 runtimeClass,
+		PriorityClassName:            o.priorityClassFor(envIsolation, podTypeMain),
+		ServiceAccountName:           serviceAccountName(envIsolation),
+		AutomountServiceAccountToken: automountServiceAccountToken(envIsolation),
+		Labels:                       labels,
+		NodeSelector:                 envNodeSelector,
+		Tolerations:                  k8sTolerations,
+		Affinity:                     toK8sAffinity(envAffinity),
+		SecurityContext:              securityContext,
+		DNS:                          toK8sDNS(envIsolation),
+	}
+	applyLifecycle(podSpec, env.Lifecycle)
+
+	if err := client.CreatePod(ctx, podSpec); err != nil {
 		return fmt.Errorf("create pod: %w", err)
 	}
 
-	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(o.config.Timeouts.StartupTimeout)*time.Second)
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(o.cfg().Timeouts.StartupTimeout)*time.Second)
 	defer cancel()
 
-	if err := o.k8sClient.WaitForPodRunning(waitCtx, envNamespace, "main"); err != nil {
+	if err := client.WaitForPodRunning(waitCtx, envNamespace, "main"); err != nil {
 		return fmt.Errorf("pod failed to start: %w", err)
 	}
 
+	// Put the workspace back before the pod is checked for readiness and used again
+	o.restoreLatestSnapshot(waitCtx, client, env)
+
+	if env.ReadinessCheck != nil {
+		if output, err := o.waitForReady(waitCtx, client, envNamespace, "main", env.ReadinessCheck); err != nil {
+			return fmt.Errorf("pod failed readiness check: %w (%s)", err, output)
+		}
+	}
+
 	return nil
 }
 
@@ -2137,7 +4132,7 @@ func (o *Orchestrator) RetryReconciliation(ctx context.Context, envID string) er
 	env, exists := o.environments[envID]
 	if !exists {
 		o.envMutex.Unlock()
-		return fmt.Errorf("environment not found")
+		return errEnvironmentNotFound
 	}
 	env.ReconciliationRetryCount = 0
 	env.LastReconciliationError = ""
@@ -2154,7 +4149,7 @@ func (o *Orchestrator) RetryReconciliation(ctx context.Context, envID string) er
 
 	// Trigger one reconciliation attempt in background
 	go func() {
-		rctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.config.Timeouts.StartupTimeout)*time.Second)
+		rctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.cfg().Timeouts.StartupTimeout)*time.Second)
 		defer cancel()
 		o.envMutex.RLock()
 		envForReconcile, ok := o.environments[envID]
@@ -2162,9 +4157,9 @@ func (o *Orchestrator) RetryReconciliation(ctx context.Context, envID string) er
 			o.envMutex.RUnlock()
 			return
 		}
-		envCopy := *envForReconcile
+		envCopy := envForReconcile.DeepCopy()
 		o.envMutex.RUnlock()
-		o.reconcilePendingOrFailed(rctx, &envCopy)
+		o.reconcilePendingOrFailed(rctx, envCopy)
 	}()
 
 	return nil
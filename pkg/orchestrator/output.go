@@ -0,0 +1,28 @@
+package orchestrator
+
+import (
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Output ==========
+
+// maxOutputBytes is the current per-stream output cap for executions (0 = unlimited)
+func (o *Orchestrator) maxOutputBytes() int64 {
+	return o.cfg().Executions.MaxOutputBytes
+}
+
+// newOutputBuffers returns the capped stdout and stderr buffers for one execution
+func (o *Orchestrator) newOutputBuffers() (stdout, stderr *k8s.LimitedBuffer) {
+	limit := o.maxOutputBytes()
+	return k8s.NewLimitedBuffer(limit), k8s.NewLimitedBuffer(limit)
+}
+
+// setExecutionOutput stores captured output and its size accounting on exec
+func setExecutionOutput(exec *models.Execution, stdout, stderr *k8s.LimitedBuffer) {
+	exec.Stdout = stdout.String()
+	exec.Stderr = stderr.String()
+	exec.StdoutBytesTotal = stdout.Total()
+	exec.StderrBytesTotal = stderr.Total()
+	exec.Truncated = stdout.Truncated() || stderr.Truncated()
+}
@@ -0,0 +1,76 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// AuditActionOwnershipTransferred is the audit log action of an environment changing owner
+const AuditActionOwnershipTransferred = "environment.ownership_transferred"
+
+// TransferEnvironmentOwnership makes toUserID the owner of an environment: its user ID and the
+// owner permission grant move to toUserID (see database.TransferEnvironmentOwnership)
+func (o *Orchestrator) TransferEnvironmentOwnership(ctx context.Context, envID, toUserID, actorID string) (*models.Environment, error) {
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+	from := env.UserID
+	if o.db != nil {
+		if from, err = o.db.TransferEnvironmentOwnership(ctx, envID, toUserID, actorID); err != nil {
+			return nil, err
+		}
+	}
+	o.EnvironmentsTransferred(ctx, []string{envID}, from, toUserID, actorID)
+	return o.GetEnvironment(ctx, envID)
+}
+
+// EnvironmentsTransferred records environments that changed owner from fromUserID to toUserID
+// in the database: the cached environments get the new owner, so owner filters see the transfer
+// immediately, and every transfer is written to the audit log
+func (o *Orchestrator) EnvironmentsTransferred(ctx context.Context, envIDs []string, fromUserID, toUserID, actorID string) {
+	o.envMutex.Lock()
+	for _, id := range envIDs {
+		if env, ok := o.environments[id]; ok {
+			env.UserID = toUserID
+		}
+	}
+	o.envMutex.Unlock()
+
+	for _, id := range envIDs {
+		o.logger.Info("environment ownership transferred",
+			zap.String("environment_id", id),
+			zap.String("from_user_id", fromUserID),
+			zap.String("to_user_id", toUserID),
+			zap.String("actor_id", actorID),
+		)
+		if o.db == nil {
+			continue
+		}
+		if err := o.db.SaveAuditEntry(ctx, &models.AuditEntry{
+			Action:       AuditActionOwnershipTransferred,
+			ActorID:      actorID,
+			ResourceType: "environment",
+			ResourceID:   id,
+			Message:      fmt.Sprintf("Ownership of environment %s transferred from user %s to user %s", id, fromUserID, toUserID),
+		}); err != nil {
+			o.logger.Warn("failed to write audit entry for ownership transfer", zap.String("environment_id", id), zap.Error(err))
+		}
+	}
+}
+
+// TeamDeleted records a team deleted from the database (see teams.Service.DeleteTeam): its
+// cached environments no longer belong to a team, so saving them does not restore the team ID
+func (o *Orchestrator) TeamDeleted(teamID string) {
+	o.envMutex.Lock()
+	defer o.envMutex.Unlock()
+	for _, env := range o.environments {
+		if env.TeamID == teamID {
+			env.TeamID = ""
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Provisioning Phases ==========
+
+// phasePollInterval is how often a starting pod is inspected for image pull / container start progress
+const phasePollInterval = 500 * time.Millisecond
+
+// phaseOrder ranks provisioning phases so a phase never moves backwards within one attempt
+var phaseOrder = map[models.EnvironmentPhase]int{
+	models.PhaseQueued:                      0,
+	models.PhaseBuilding:                    1,
+	models.PhaseWaitingForPreviousNamespace: 2,
+	models.PhaseCreatingNamespace:           3,
+	models.PhaseApplyingQuota:               4,
+	models.PhaseApplyingNetworkPolicy:       5,
+	models.PhaseCreatingPod:                 6,
+	models.PhasePullingImage:                7,
+	models.PhaseStarting:                    8,
+	models.PhaseWaitingReady:                9,
+	models.PhaseReady:                       10,
+}
+
+// setEnvironmentPhase records a provisioning phase in memory and the database, and logs a
+// "provisioning_phase" event so the time spent in each phase can be reconstructed
+func (o *Orchestrator) setEnvironmentPhase(envID string, phase models.EnvironmentPhase) {
+	o.envMutex.Lock()
+	env, exists := o.environments[envID]
+	if !exists || env.Phase == phase {
+		o.envMutex.Unlock()
+		return
+	}
+	env.Phase = phase
+	createdAt := env.CreatedAt
+	o.envMutex.Unlock()
+
+	if o.db == nil {
+		return
+	}
+	ctx := context.Background()
+	if err := o.db.UpdateEnvironmentPhase(ctx, envID, phase); err != nil {
+		o.logger.Warn("failed to update environment phase", zap.String("environment_id", envID), zap.Error(err))
+	}
+	sinceCreation := fmt.Sprintf("%s since creation", o.clock.Now().Sub(createdAt).Round(time.Millisecond))
+	o.logReconciliationEvent(envID, eventTypeProvisioningPhase, "Provisioning phase: "+string(phase), sinceCreation)
+	if phase == models.PhaseReady {
+		o.logReconciliationEvent(envID, eventTypeProvisioned, "Environment provisioned", sinceCreation)
+	}
+}
+
+// advanceEnvironmentPhase moves the environment to phase only if it is later than the current one
+func (o *Orchestrator) advanceEnvironmentPhase(envID string, phase models.EnvironmentPhase) {
+	o.envMutex.RLock()
+	env, exists := o.environments[envID]
+	advance := exists && phaseOrder[phase] > phaseOrder[env.Phase]
+	o.envMutex.RUnlock()
+	if advance {
+		o.setEnvironmentPhase(envID, phase)
+	}
+}
+
+// watchPodStartup polls the pod until ctx is done and advances the environment to the
+// pulling_image / starting phases based on its container statuses
+func (o *Orchestrator) watchPodStartup(ctx context.Context, client k8s.ClientInterface, envID, namespace, podName string) {
+	ticker := time.NewTicker(phasePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pod, err := client.GetPod(ctx, namespace, podName)
+		if err != nil {
+			continue
+		}
+		if phase := podStartupPhase(pod); phase != "" {
+			o.advanceEnvironmentPhase(envID, phase)
+		}
+	}
+}
+
+// podStartupPhase derives the provisioning phase of a starting pod from its container waiting
+// reasons; returns "" when nothing can be inferred yet (e.g. not scheduled)
+func podStartupPhase(pod *corev1.Pod) models.EnvironmentPhase {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Running != nil {
+			return models.PhaseStarting
+		}
+		if w := cs.State.Waiting; w != nil {
+			switch w.Reason {
+			case "ErrImagePull", "ImagePullBackOff":
+				return models.PhasePullingImage
+			case "ContainerCreating":
+				// The image ID is only reported once the image is present on the node
+				if cs.ImageID != "" {
+					return models.PhaseStarting
+				}
+				return models.PhasePullingImage
+			case "PodInitializing":
+				return models.PhaseStarting
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,469 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// ========== Pipelines ==========
+
+// DefaultPipelineParallel is the number of independent steps a pipeline runs at once when the
+// request does not set max_parallel
+const DefaultPipelineParallel = 4
+
+// pipelineStepWait is how long a pipeline blocks on a step's execution before checking again
+const pipelineStepWait = time.Minute
+
+// pipelineRun is a pipeline being run by this server
+type pipelineRun struct {
+	// pipeline is the live state (guarded by pipelineMutex)
+	pipeline *models.Pipeline
+	// cancel stops the pipeline: its running steps are canceled and pending ones never start
+	cancel context.CancelFunc
+	// done is closed once the pipeline reached a terminal state
+	done chan struct{}
+}
+
+// stepResult is the outcome of a step's execution, reported by its watcher
+type stepResult struct {
+	index int
+	exec  *models.Execution
+	err   error
+}
+
+// SubmitPipeline validates a pipeline and starts running its steps as async executions of the
+// environment: a step starts once all its dependencies completed, at most MaxParallel at a time,
+// and is skipped when one of them did not complete. Commands are checked against the command
+// policy up front unless skipCommandPolicy is set (admins).
+func (o *Orchestrator) SubmitPipeline(ctx context.Context, envID string, req *models.CreatePipelineRequest, userID string, skipCommandPolicy bool) (*models.Pipeline, error) {
+	if errs := validator.ValidatePipelineGraph(req.Steps); len(errs) > 0 {
+		return nil, apierrors.Wrap(apierrors.ValidationFailed, apierrors.CodeBadRequest, errs, "invalid pipeline")
+	}
+	if len(req.Steps) == 0 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "at least one step is required")
+	}
+
+	env, err := o.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+	if env.Status != models.StatusRunning {
+		return nil, EnvironmentNotRunningError(env)
+	}
+	if err := checkCordoned(env); err != nil {
+		return nil, err
+	}
+	if !skipCommandPolicy {
+		for _, step := range req.Steps {
+			if err := o.checkCommandPolicy(ctx, env, step.Command, userID); err != nil {
+				return nil, apierrors.Wrap(apierrors.Forbidden, apierrors.CodeCommandRejected, err, "step %q: command rejected by policy", step.Name)
+			}
+		}
+	}
+
+	maxParallel := req.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = DefaultPipelineParallel
+	}
+	pipeline := &models.Pipeline{
+		ID:            "pipe-" + uuid.New().String()[:8],
+		EnvironmentID: envID,
+		UserID:        userID,
+		Status:        models.PipelineRunning,
+		MaxParallel:   maxParallel,
+		Steps:         make([]models.PipelineStep, len(req.Steps)),
+		CreatedAt:     o.clock.Now(),
+	}
+	for i, step := range req.Steps {
+		pipeline.Steps[i] = models.PipelineStep{
+			Name:      step.Name,
+			Command:   step.Command,
+			Env:       step.Env,
+			DependsOn: step.DependsOn,
+			Timeout:   step.Timeout,
+			Status:    models.StepPending,
+		}
+	}
+
+	// Register the run before persisting it: a stored running pipeline this server does not know
+	// is taken for one interrupted by a restart
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	run := &pipelineRun{pipeline: pipeline, cancel: cancel, done: make(chan struct{})}
+	o.pipelineMutex.Lock()
+	o.pipelines[pipeline.ID] = run
+	result := pipeline.DeepCopy()
+	o.pipelineMutex.Unlock()
+	if o.db != nil {
+		if err := o.db.SavePipeline(ctx, pipeline); err != nil {
+			o.pipelineMutex.Lock()
+			delete(o.pipelines, pipeline.ID)
+			o.pipelineMutex.Unlock()
+			cancel()
+			return nil, err
+		}
+	}
+
+	o.logger.Info("pipeline submitted",
+		zap.String("pipeline_id", pipeline.ID),
+		zap.String("environment_id", envID),
+		zap.Int("steps", len(pipeline.Steps)),
+		zap.Int("max_parallel", maxParallel),
+		zap.String("user_id", userID),
+	)
+	go o.runPipeline(runCtx, run, skipCommandPolicy)
+	return result, nil
+}
+
+// GetPipeline returns a pipeline with the state of its steps. A pipeline the database reports
+// as running that this server is not running was interrupted by a restart; it is marked failed.
+func (o *Orchestrator) GetPipeline(ctx context.Context, id string) (*models.Pipeline, error) {
+	o.pipelineMutex.Lock()
+	if run, ok := o.pipelines[id]; ok {
+		pipeline := run.pipeline.DeepCopy()
+		o.pipelineMutex.Unlock()
+		return pipeline, nil
+	}
+	o.pipelineMutex.Unlock()
+
+	if o.db == nil {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodePipelineNotFound, "pipeline not found: %s", id)
+	}
+	pipeline, err := o.db.GetPipeline(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !pipeline.Status.IsTerminal() {
+		// Runs are only dropped from memory after their final state is stored
+		finishInterruptedPipeline(pipeline, o.clock.Now())
+		if err := o.db.SavePipeline(ctx, pipeline); err != nil {
+			o.logger.Error("failed to save interrupted pipeline", zap.Error(err), zap.String("pipeline_id", id))
+		}
+	}
+	return pipeline, nil
+}
+
+// finishInterruptedPipeline marks a pipeline whose run was lost (server restart) as failed:
+// steps that had not started are skipped, submitted ones keep their execution IDs
+func finishInterruptedPipeline(pipeline *models.Pipeline, now time.Time) {
+	for i := range pipeline.Steps {
+		if pipeline.Steps[i].Status == models.StepPending {
+			pipeline.Steps[i].Status = models.StepSkipped
+		}
+	}
+	pipeline.Status = models.PipelineFailed
+	pipeline.Error = "pipeline was interrupted by a server restart"
+	pipeline.CompletedAt = &now
+}
+
+// CancelPipeline cancels a running pipeline: its running steps' executions are canceled and
+// pending steps never start. It returns the pipeline once it has stopped.
+func (o *Orchestrator) CancelPipeline(ctx context.Context, id string) (*models.Pipeline, error) {
+	o.pipelineMutex.Lock()
+	run, ok := o.pipelines[id]
+	var status models.PipelineStatus
+	if ok {
+		status = run.pipeline.Status
+	}
+	o.pipelineMutex.Unlock()
+
+	if !ok {
+		pipeline, err := o.GetPipeline(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		status = pipeline.Status
+	}
+	if !ok || status.IsTerminal() {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodePipelineNotCancelable, "pipeline cannot be canceled (status: %s)", status)
+	}
+
+	run.cancel()
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return o.GetPipeline(ctx, id)
+}
+
+// runPipeline starts the pipeline's steps as their dependencies complete until every step is
+// finished or skipped, or ctx is canceled
+func (o *Orchestrator) runPipeline(ctx context.Context, run *pipelineRun, skipCommandPolicy bool) {
+	defer run.cancel()
+	defer close(run.done)
+
+	o.pipelineMutex.Lock()
+	pipeline := run.pipeline
+	envID := pipeline.EnvironmentID
+	userID := pipeline.UserID
+	maxParallel := pipeline.MaxParallel
+	index := make(map[string]int, len(pipeline.Steps))
+	for i, step := range pipeline.Steps {
+		index[step.Name] = i
+	}
+	o.pipelineMutex.Unlock()
+
+	results := make(chan stepResult, len(pipeline.Steps))
+	running := make(map[int]string) // step index -> execution ID
+	for {
+		if ctx.Err() != nil {
+			o.cancelPipelineSteps(run, running)
+			return
+		}
+
+		o.pipelineMutex.Lock()
+		skipBlockedSteps(pipeline, index, o.clock.Now())
+		var ready []int
+		for i, step := range pipeline.Steps {
+			if len(running)+len(ready) >= maxParallel {
+				break
+			}
+			if step.Status == models.StepPending && dependenciesCompleted(pipeline, index, i) {
+				ready = append(ready, i)
+			}
+		}
+		o.pipelineMutex.Unlock()
+
+		for _, i := range ready {
+			o.pipelineMutex.Lock()
+			step := pipeline.Steps[i]
+			o.pipelineMutex.Unlock()
+
+			exec, err := o.SubmitExecution(ctx, &EphemeralExecRequest{
+				EnvironmentID:     envID,
+				Command:           step.Command,
+				Env:               step.Env,
+				Timeout:           step.Timeout,
+				SkipCommandPolicy: skipCommandPolicy,
+			}, userID)
+			if err != nil && ctx.Err() != nil {
+				// Canceled while submitting: the step never ran
+				break
+			}
+
+			now := o.clock.Now()
+			o.pipelineMutex.Lock()
+			s := &pipeline.Steps[i]
+			s.StartedAt = &now
+			if err != nil {
+				s.Status = models.StepFailed
+				s.Error = "failed to submit execution: " + err.Error()
+				s.CompletedAt = &now
+			} else {
+				s.Status = models.StepRunning
+				s.ExecutionID = exec.ID
+				running[i] = exec.ID
+			}
+			o.pipelineMutex.Unlock()
+			if err == nil {
+				go o.watchPipelineStep(ctx, i, exec.ID, results)
+			}
+		}
+		if len(ready) > 0 {
+			o.savePipeline(run)
+		}
+
+		if len(running) == 0 {
+			o.pipelineMutex.Lock()
+			pending := hasPendingSteps(pipeline)
+			o.pipelineMutex.Unlock()
+			if !pending {
+				break
+			}
+			// Steps submitted this round failed; skip their dependents or start others
+			continue
+		}
+
+		select {
+		case result := <-results:
+			delete(running, result.index)
+			o.pipelineMutex.Lock()
+			finishPipelineStep(&pipeline.Steps[result.index], result.exec, result.err, o.clock.Now())
+			o.pipelineMutex.Unlock()
+			o.savePipeline(run)
+		case <-ctx.Done():
+			o.cancelPipelineSteps(run, running)
+			return
+		}
+	}
+
+	now := o.clock.Now()
+	o.pipelineMutex.Lock()
+	final := pipeline.DeepCopy()
+	o.pipelineMutex.Unlock()
+	final.Status = models.PipelineCompleted
+	for _, step := range final.Steps {
+		if step.Status != models.StepCompleted {
+			final.Status = models.PipelineFailed
+		}
+	}
+	final.CompletedAt = &now
+	o.finishPipeline(run, final)
+}
+
+// cancelPipelineSteps cancels the executions of a canceled pipeline's running steps and marks
+// its unfinished steps canceled
+func (o *Orchestrator) cancelPipelineSteps(run *pipelineRun, running map[int]string) {
+	ctx := context.Background()
+	for _, execID := range running {
+		if err := o.cancelExecution(ctx, execID, "pipeline canceled"); err != nil && apierrors.KindOf(err) != apierrors.Conflict {
+			o.logger.Warn("failed to cancel pipeline step", zap.String("exec_id", execID), zap.Error(err))
+		}
+	}
+
+	now := o.clock.Now()
+	o.pipelineMutex.Lock()
+	final := run.pipeline.DeepCopy()
+	o.pipelineMutex.Unlock()
+	for i := range final.Steps {
+		step := &final.Steps[i]
+		if _, ok := running[i]; ok {
+			// The execution may have finished just before it could be canceled
+			exec, err := o.GetExecution(ctx, step.ExecutionID)
+			if err == nil && exec.Status != models.ExecutionStatusCanceled {
+				finishPipelineStep(step, exec, nil, o.clock.Now())
+				continue
+			}
+		}
+		if !step.Status.IsTerminal() {
+			step.Status = models.StepCanceled
+			step.CompletedAt = &now
+		}
+	}
+	final.Status = models.PipelineCanceled
+	final.Error = "canceled by user"
+	final.CompletedAt = &now
+	o.finishPipeline(run, final)
+}
+
+// watchPipelineStep waits for a step's execution to finish and reports it on results
+func (o *Orchestrator) watchPipelineStep(ctx context.Context, index int, execID string, results chan<- stepResult) {
+	for {
+		exec, done, err := o.WaitForExecution(ctx, execID, pipelineStepWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				// The pipeline was canceled; it cancels the execution itself
+				return
+			}
+			results <- stepResult{index: index, err: err}
+			return
+		}
+		if done {
+			results <- stepResult{index: index, exec: exec}
+			return
+		}
+	}
+}
+
+// finishPipelineStep records the outcome of a step's execution: it completed only when the
+// execution completed with exit code 0
+func finishPipelineStep(step *models.PipelineStep, exec *models.Execution, err error, now time.Time) {
+	step.CompletedAt = &now
+	if err != nil {
+		step.Status = models.StepFailed
+		step.Error = err.Error()
+		return
+	}
+	if exec.CompletedAt != nil {
+		step.CompletedAt = exec.CompletedAt
+	}
+	step.ExitCode = exec.ExitCode
+	step.Error = exec.Error
+	switch {
+	case exec.Status == models.ExecutionStatusCanceled:
+		step.Status = models.StepCanceled
+	case exec.Status == models.ExecutionStatusCompleted && (exec.ExitCode == nil || *exec.ExitCode == 0):
+		step.Status = models.StepCompleted
+	default:
+		step.Status = models.StepFailed
+	}
+}
+
+// skipBlockedSteps marks pending steps whose dependencies did not complete as skipped (and
+// so on down the graph); call with pipelineMutex held
+func skipBlockedSteps(pipeline *models.Pipeline, index map[string]int, now time.Time) {
+	for changed := true; changed; {
+		changed = false
+		for i := range pipeline.Steps {
+			step := &pipeline.Steps[i]
+			if step.Status != models.StepPending {
+				continue
+			}
+			for _, dep := range step.DependsOn {
+				depStatus := pipeline.Steps[index[dep]].Status
+				if depStatus.IsTerminal() && depStatus != models.StepCompleted {
+					step.Status = models.StepSkipped
+					step.Error = "dependency " + dep + " " + string(depStatus)
+					step.CompletedAt = &now
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// dependenciesCompleted reports whether every dependency of step i completed; call with
+// pipelineMutex held
+func dependenciesCompleted(pipeline *models.Pipeline, index map[string]int, i int) bool {
+	for _, dep := range pipeline.Steps[i].DependsOn {
+		if pipeline.Steps[index[dep]].Status != models.StepCompleted {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPendingSteps reports whether a step has not started yet; call with pipelineMutex held
+func hasPendingSteps(pipeline *models.Pipeline) bool {
+	for _, step := range pipeline.Steps {
+		if step.Status == models.StepPending {
+			return true
+		}
+	}
+	return false
+}
+
+// savePipeline persists the pipeline's current state
+func (o *Orchestrator) savePipeline(run *pipelineRun) {
+	if o.db == nil {
+		return
+	}
+	o.pipelineMutex.Lock()
+	pipeline := run.pipeline.DeepCopy()
+	o.pipelineMutex.Unlock()
+	if err := o.db.SavePipeline(context.Background(), pipeline); err != nil {
+		o.logger.Error("failed to save pipeline", zap.Error(err), zap.String("pipeline_id", pipeline.ID))
+	}
+}
+
+// finishPipeline records a pipeline's final state, a copy of the run's pipeline with its
+// terminal status: it is persisted before the run shows it, so a pipeline seen finished is
+// finished in the database too. When the database holds it, the run is dropped from memory.
+func (o *Orchestrator) finishPipeline(run *pipelineRun, final *models.Pipeline) {
+	if o.db != nil {
+		if err := o.db.SavePipeline(context.Background(), final); err != nil {
+			o.logger.Error("failed to save pipeline", zap.Error(err), zap.String("pipeline_id", final.ID))
+		}
+	}
+
+	o.pipelineMutex.Lock()
+	run.pipeline = final
+	if o.db != nil {
+		delete(o.pipelines, final.ID)
+	}
+	o.pipelineMutex.Unlock()
+
+	o.logger.Info("pipeline finished",
+		zap.String("pipeline_id", final.ID),
+		zap.String("environment_id", final.EnvironmentID),
+		zap.String("status", string(final.Status)),
+	)
+}
@@ -0,0 +1,245 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Pod Metadata Environment ==========
+
+// Standard variables injected into every environment pod (main, standby and ephemeral)
+const (
+	EnvVarEnvironmentID = "AGENTBOX_ENVIRONMENT_ID"
+	EnvVarExecutionID   = "AGENTBOX_EXECUTION_ID"
+	EnvVarAPIURL        = "AGENTBOX_API_URL"
+	EnvVarUserID        = "AGENTBOX_USER_ID"
+	EnvVarCallbackToken = "AGENTBOX_CALLBACK_TOKEN"
+	EnvVarToken         = "AGENTBOX_TOKEN"
+)
+
+// callbackTokenGrace is added to the execution timeout so a result can still be reported as
+// the execution is being torn down
+const callbackTokenGrace = 5 * time.Minute
+
+// templateRegex matches ${NAME} references in user-provided environment variable values
+var templateRegex = regexp.MustCompile(`\$\{([A-Z_]+)\}`)
+
+// CallbackTokenIssuer mints the short-lived callback tokens handed to pods as
+// AGENTBOX_CALLBACK_TOKEN (implemented by auth.Service)
+type CallbackTokenIssuer interface {
+	GenerateCallbackToken(envID, execID, userID string, ttl time.Duration) (string, error)
+}
+
+// SetCallbackTokenIssuer enables AGENTBOX_CALLBACK_TOKEN for pods created from now on
+func (o *Orchestrator) SetCallbackTokenIssuer(issuer CallbackTokenIssuer) {
+	if issuer == nil {
+		o.callbackIssuer.Store(nil)
+		return
+	}
+	o.callbackIssuer.Store(&issuer)
+}
+
+// EnvironmentTokenIssuer mints the environment-scoped API tokens handed to main pods as
+// AGENTBOX_TOKEN and revokes them when the environment is deleted (implemented by auth.Service)
+type EnvironmentTokenIssuer interface {
+	// IssueEnvironmentToken returns a token valid until revoked, replacing the one of the
+	// environment's previous main pod
+	IssueEnvironmentToken(ctx context.Context, envID, userID string) (string, error)
+	RevokeEnvironmentTokens(ctx context.Context, envID string) error
+}
+
+// SetEnvironmentTokenIssuer enables AGENTBOX_TOKEN for main pods created from now on
+func (o *Orchestrator) SetEnvironmentTokenIssuer(issuer EnvironmentTokenIssuer) {
+	if issuer == nil {
+		o.envTokenIssuer.Store(nil)
+		return
+	}
+	o.envTokenIssuer.Store(&issuer)
+}
+
+// podEnvTemplateVars are the values of the ${NAME} templates available in user-provided
+// environment variables. Names without a value in the current context expand to "".
+func podEnvTemplateVars(env *models.Environment, execID, userID, apiURL string) map[string]string {
+	return map[string]string{
+		"ENV_ID":       env.ID,
+		"ENV_NAME":     env.Name,
+		"NAMESPACE":    env.Namespace,
+		"EXECUTION_ID": execID,
+		"USER_ID":      userID,
+		"API_URL":      apiURL,
+	}
+}
+
+// expandEnvTemplate replaces the known ${NAME} templates in value; unknown names are left as is
+// so shell-style references to the pod's own variables keep working
+func expandEnvTemplate(value string, vars map[string]string) string {
+	return templateRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		if v, ok := vars[ref[2:len(ref)-1]]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// mainPodEnv returns the environment of an environment's main pod (see buildPodEnv), with an
+// environment token as AGENTBOX_TOKEN when they are enabled
+func (o *Orchestrator) mainPodEnv(ctx context.Context, env *models.Environment) map[string]string {
+	envToken := ""
+	if issuer := o.envTokenIssuer.Load(); issuer != nil {
+		token, err := (*issuer).IssueEnvironmentToken(ctx, env.ID, env.UserID)
+		if err != nil {
+			o.logger.Warn("failed to issue environment token", zap.String("environment_id", env.ID), zap.Error(err))
+		} else {
+			envToken = token
+		}
+	}
+	return o.buildPodEnv(env, "", env.UserID, o.environmentTokenTTL(env), envToken, env.Env)
+}
+
+// revokeEnvironmentTokens revokes the tokens of a deleted environment, including its main pod's
+func (o *Orchestrator) revokeEnvironmentTokens(ctx context.Context, envID string) {
+	if issuer := o.envTokenIssuer.Load(); issuer != nil {
+		if err := (*issuer).RevokeEnvironmentTokens(ctx, envID); err != nil {
+			o.logger.Warn("failed to revoke environment tokens", zap.String("environment_id", envID), zap.Error(err))
+		}
+	}
+}
+
+// buildPodEnv returns the environment of a pod: the standard AGENTBOX_* metadata variables plus
+// the user-provided variables (environment first, then per-execution overrides) with templates
+// expanded. execID is empty for main and standby pods; envToken, when set, becomes
+// AGENTBOX_TOKEN. A user variable with the same name as a metadata variable wins; the collision
+// is logged and recorded as an environment event.
+func (o *Orchestrator) buildPodEnv(env *models.Environment, execID, userID string, tokenTTL time.Duration, envToken string, user ...map[string]string) map[string]string {
+	apiURL := o.cfg().Server.PublicURL
+	metadata := map[string]string{
+		EnvVarEnvironmentID: env.ID,
+		EnvVarUserID:        userID,
+	}
+	if execID != "" {
+		metadata[EnvVarExecutionID] = execID
+	}
+	if apiURL != "" {
+		metadata[EnvVarAPIURL] = apiURL
+	}
+	if issuer := o.callbackIssuer.Load(); issuer != nil {
+		token, err := (*issuer).GenerateCallbackToken(env.ID, execID, userID, tokenTTL)
+		if err != nil {
+			o.logger.Warn("failed to issue callback token", zap.String("environment_id", env.ID), zap.String("exec_id", execID), zap.Error(err))
+		} else {
+			metadata[EnvVarCallbackToken] = token
+		}
+	}
+	if envToken != "" {
+		metadata[EnvVarToken] = envToken
+	}
+
+	vars := podEnvTemplateVars(env, execID, userID, apiURL)
+	merged := make(map[string]string, len(metadata))
+	for _, m := range user {
+		for k, v := range m {
+			merged[k] = expandEnvTemplate(v, vars)
+		}
+	}
+
+	var overridden []string
+	for k, v := range metadata {
+		if _, ok := merged[k]; ok {
+			overridden = append(overridden, k)
+			continue
+		}
+		merged[k] = v
+	}
+	if len(overridden) > 0 {
+		sort.Strings(overridden)
+		o.logger.Warn("user environment variables override agentbox metadata variables",
+			zap.String("environment_id", env.ID),
+			zap.String("exec_id", execID),
+			zap.Strings("variables", overridden),
+		)
+		o.logReconciliationEvent(env.ID, "env_var_override",
+			fmt.Sprintf("User-provided variables override agentbox metadata variables: %v", overridden), "")
+	}
+	return merged
+}
+
+// execEnvScript reads "set -- 'NAME=value'... \"$@\"" from stdin and runs its arguments under
+// env(1) with those assignments; the command's own stdin is empty, as in an execution pod
+const execEnvScript = `eval "$(cat)" && exec env -- "$@" </dev/null`
+
+// withExecEnv wraps a command run in an existing pod (a claimed standby pod) so it sees vars in
+// its environment, as an execution pod does from its spec. The assignments are passed on the
+// returned stdin rather than in the command, which the exec request carries in its URL (and the
+// API server may log); each is a single-quoted shell word, so any name and value is safe.
+func withExecEnv(vars map[string]string, command []string) ([]string, io.Reader) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var script strings.Builder
+	script.WriteString("set --")
+	for _, name := range names {
+		script.WriteString(" '")
+		script.WriteString(strings.ReplaceAll(name+"="+vars[name], "'", `'\''`))
+		script.WriteString("'")
+	}
+	script.WriteString(` "$@"`)
+	return append([]string{"/bin/sh", "-c", execEnvScript, "sh"}, command...), strings.NewReader(script.String())
+}
+
+// mergedEnvCount is the number of distinct user-provided variables of a pod running with base
+// and overrides (as merged by buildPodEnv)
+func mergedEnvCount(base, overrides map[string]string) int {
+	n := len(base)
+	for k := range overrides {
+		if _, ok := base[k]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// environmentTokenTTL is the callback token lifetime for an environment's long-lived pods
+func (o *Orchestrator) environmentTokenTTL(env *models.Environment) time.Duration {
+	seconds := env.Timeout
+	if seconds <= 0 {
+		seconds = o.cfg().Timeouts.DefaultTimeout
+	}
+	return time.Duration(seconds)*time.Second + callbackTokenGrace
+}
+
+// Execution timeouts (seconds): the default of executions that set none, and the longest any
+// runs for when timeouts.max_timeout is not configured
+const (
+	defaultExecutionTimeout = 300
+	maxExecutionTimeout     = 3600
+)
+
+// executionTimeout is the timeout in seconds an execution that requested timeout runs with,
+// capped at timeouts.max_timeout
+func (o *Orchestrator) executionTimeout(timeout int) int {
+	limit := o.cfg().Timeouts.MaxTimeout
+	if limit <= 0 {
+		limit = maxExecutionTimeout
+	}
+	if timeout <= 0 {
+		timeout = defaultExecutionTimeout
+	}
+	return min(timeout, limit)
+}
+
+// executionTokenTTL is the callback token lifetime of an execution that requested timeout: the
+// timeout it runs with plus a grace period
+func (o *Orchestrator) executionTokenTTL(timeout int) time.Duration {
+	return time.Duration(o.executionTimeout(timeout))*time.Second + callbackTokenGrace
+}
@@ -0,0 +1,255 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+const (
+	// managedPodSelector selects the pods AgentBox creates
+	managedPodSelector = "managed-by=agentbox"
+	// mainPodName is the name of every environment's main pod
+	mainPodName = "main"
+	// podWatchMinBackoff and podWatchMaxBackoff bound the delay before a failed pod watch is retried
+	podWatchMinBackoff = time.Second
+	podWatchMaxBackoff = 30 * time.Second
+	// podWatchForbiddenRecheck is how often a pod watch that was denied tries again, in case
+	// the missing RBAC permission was granted
+	podWatchForbiddenRecheck = 5 * time.Minute
+	// podWatchDisabledRecheck is how often a disabled pod watch checks whether a configuration
+	// reload enabled it
+	podWatchDisabledRecheck = 30 * time.Second
+)
+
+// errMainPodNotFound is returned by mainPodPhase when a synced pod watch has not seen the pod
+var errMainPodNotFound = errors.New("main pod not found")
+
+// podWatchState holds the main pod phases one cluster's pod watch has seen
+type podWatchState struct {
+	// cluster is the name of the watched cluster
+	cluster string
+	mu      sync.RWMutex
+	// synced is set while the watch is running and phases is complete
+	synced bool
+	// phases holds the main pod phase per namespace
+	phases map[string]corev1.PodPhase
+	// nodes holds the node of every scheduled managed pod, keyed by namespace/name, so each pod
+	// is counted once in the per-node churn; nodesSeeded is set by the first listing, whose pods
+	// were scheduled before the watch started and are not counted
+	nodes       map[string]string
+	nodesSeeded bool
+}
+
+// phase returns the watched phase of the main pod in namespace; ok is false while the watch is
+// not synced and the caller has to ask the API server
+func (s *podWatchState) phase(namespace string) (phase corev1.PodPhase, found, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.synced {
+		return "", false, false
+	}
+	phase, found = s.phases[namespace]
+	return phase, found, true
+}
+
+// podStatusCacheEntry is a main pod phase read from the Kubernetes API
+type podStatusCacheEntry struct {
+	phase     corev1.PodPhase
+	fetchedAt time.Time
+}
+
+// mainPodPhase returns the phase of an environment's main pod: from the cluster's pod watch
+// while it is synced, otherwise from the status cache or, once that expired, the API server
+func (o *Orchestrator) mainPodPhase(ctx context.Context, client k8s.ClientInterface, env *models.Environment) (corev1.PodPhase, error) {
+	cluster := env.Cluster
+	if cluster == "" {
+		cluster = o.clusters.DefaultName()
+	}
+	if state, ok := o.podWatches[cluster]; ok {
+		if phase, found, synced := state.phase(env.Namespace); synced {
+			if !found {
+				return "", errMainPodNotFound
+			}
+			return phase, nil
+		}
+	}
+
+	key := cluster + "/" + env.Namespace
+	ttl := time.Duration(o.cfg().Reconciliation.StatusCacheSeconds) * time.Second
+	if ttl > 0 {
+		o.podStatusCacheMutex.Lock()
+		entry, ok := o.podStatusCache[key]
+		o.podStatusCacheMutex.Unlock()
+		if ok && o.clock.Now().Sub(entry.fetchedAt) < ttl {
+			return entry.phase, nil
+		}
+	}
+
+	pod, err := client.GetPod(ctx, env.Namespace, mainPodName)
+	if err != nil {
+		return "", err
+	}
+	if ttl > 0 {
+		now := o.clock.Now()
+		o.podStatusCacheMutex.Lock()
+		for k, entry := range o.podStatusCache {
+			if now.Sub(entry.fetchedAt) >= ttl {
+				delete(o.podStatusCache, k)
+			}
+		}
+		o.podStatusCache[key] = &podStatusCacheEntry{phase: pod.Status.Phase, fetchedAt: now}
+		o.podStatusCacheMutex.Unlock()
+	}
+	return pod.Status.Phase, nil
+}
+
+// runPodWatch keeps a cluster's pod watch state current while the pod watch is enabled,
+// watching again after failures; while it is not synced, reads fall back to the status cache
+func (o *Orchestrator) runPodWatch(cluster string, client k8s.ClientInterface) {
+	state := o.podWatches[cluster]
+	log := o.logger.With(zap.String("cluster", cluster))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-o.podWatchStopChan
+		cancel()
+	}()
+
+	backoff := podWatchMinBackoff
+	for {
+		wait := podWatchDisabledRecheck
+		if o.cfg().Reconciliation.PodWatch {
+			err := client.WatchPods(ctx, managedPodSelector,
+				func(events []k8s.PodEvent) {
+					o.applyPodList(state, events)
+					backoff = podWatchMinBackoff
+					log.Debug("pod watch synced", zap.Int("pods", len(events)))
+				},
+				func(event k8s.PodEvent) { o.applyPodEvent(state, event) })
+			state.mu.Lock()
+			state.synced = false
+			state.mu.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case k8serrors.IsForbidden(err):
+				log.Warn("not allowed to watch pods, reading pod status from the API server instead", zap.Error(err))
+				wait = podWatchForbiddenRecheck
+			case errors.Is(err, k8s.ErrWatchClosed):
+				// The API server ends watches routinely; resume right away
+				wait = 0
+			default:
+				log.Warn("pod watch failed, retrying", zap.Error(err), zap.Duration("backoff", backoff))
+				wait = backoff
+				backoff = min(backoff*2, podWatchMaxBackoff)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// applyPodList replaces a cluster's watched main pod phases with a complete listing
+func (o *Orchestrator) applyPodList(state *podWatchState, events []k8s.PodEvent) {
+	phases := make(map[string]corev1.PodPhase, len(events))
+	nodes := make(map[string]string)
+	for _, event := range events {
+		if event.Name == mainPodName {
+			phases[event.Namespace] = event.Phase
+		}
+		if event.NodeName != "" {
+			nodes[event.Namespace+"/"+event.Name] = event.NodeName
+		}
+	}
+	state.mu.Lock()
+	previous := state.phases
+	state.phases = phases
+	state.synced = true
+	if state.nodesSeeded {
+		// Pods scheduled while the watch was down
+		for key, node := range nodes {
+			if _, seen := state.nodes[key]; !seen {
+				o.countScheduledPod(state.cluster, node)
+			}
+		}
+	}
+	state.nodes = nodes
+	state.nodesSeeded = true
+	state.mu.Unlock()
+
+	// Changes missed while the watch was down are applied like the ones it reports
+	for _, event := range events {
+		if event.Name == mainPodName && previous[event.Namespace] != event.Phase {
+			o.applyMainPodPhase(event.Labels["env-id"])
+		}
+	}
+}
+
+// applyPodEvent records a watched change to a main pod and applies it to its environment
+func (o *Orchestrator) applyPodEvent(state *podWatchState, event k8s.PodEvent) {
+	o.trackPodNode(state, event)
+	if event.Name != mainPodName {
+		return
+	}
+	state.mu.Lock()
+	previous, existed := state.phases[event.Namespace]
+	if event.Deleted {
+		delete(state.phases, event.Namespace)
+	} else {
+		state.phases[event.Namespace] = event.Phase
+	}
+	state.mu.Unlock()
+
+	if !event.Deleted && (!existed || previous != event.Phase) {
+		o.applyMainPodPhase(event.Labels["env-id"])
+	}
+}
+
+// trackPodNode counts a managed pod in its node's churn the first time it is seen scheduled
+func (o *Orchestrator) trackPodNode(state *podWatchState, event k8s.PodEvent) {
+	key := event.Namespace + "/" + event.Name
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.nodes == nil {
+		state.nodes = make(map[string]string)
+	}
+	if event.Deleted {
+		delete(state.nodes, key)
+		return
+	}
+	if _, seen := state.nodes[key]; seen || event.NodeName == "" {
+		return
+	}
+	state.nodes[key] = event.NodeName
+	o.countScheduledPod(state.cluster, event.NodeName)
+}
+
+// applyMainPodPhase updates an environment's status from its watched main pod phase, the way
+// reading the environment would
+func (o *Orchestrator) applyMainPodPhase(envID string) {
+	if envID == "" {
+		return
+	}
+	o.envMutex.RLock()
+	env, ok := o.environments[envID]
+	o.envMutex.RUnlock()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	o.refreshEnvironmentStatusFromK8s(ctx, envID, env, o.db != nil)
+}
@@ -0,0 +1,113 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+)
+
+// ========== Pod Names and Labels ==========
+
+// maxNameLength is the longest pod name (a DNS label, as the pod's hostname) and label value
+// Kubernetes accepts
+const maxNameLength = 63
+
+// podNameAttempts is how many names a pod is created under before a name collision is reported
+const podNameAttempts = 3
+
+// nameHashLength is the length of the hash suffix that keeps shortened names and values distinct
+const nameHashLength = 8
+
+var (
+	labelValueRegex   = regexp.MustCompile(`^(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?$`)
+	labelInvalidChars = regexp.MustCompile(`[^-A-Za-z0-9_.]`)
+	nameInvalidChars  = regexp.MustCompile(`[^-a-z0-9]`)
+)
+
+// newPodName returns a pod name that is unique in practice: prefix followed by a full UUID
+func newPodName(prefix string) string {
+	return sanitizePodName(prefix + "-" + uuid.New().String())
+}
+
+// sanitizePodName makes name a valid pod name: lower case, only alphanumerics and '-', starting
+// and ending with an alphanumeric, at most 63 characters. A name that has to change is shortened
+// as needed and suffixed with a hash of the original, so distinct names stay distinct.
+func sanitizePodName(name string) string {
+	if len(name) <= maxNameLength && name == strings.ToLower(name) && !nameInvalidChars.MatchString(name) &&
+		labelValueRegex.MatchString(name) {
+		return name
+	}
+	cleaned := nameInvalidChars.ReplaceAllString(strings.ToLower(name), "-")
+	return withHashSuffix(cleaned, name, "-")
+}
+
+// sanitizeLabelValue makes value a valid label value: only alphanumerics, '-', '_' and '.',
+// starting and ending with an alphanumeric, at most 63 characters. A value that has to change is
+// shortened as needed and suffixed with a hash of the original, so distinct values stay distinct.
+func sanitizeLabelValue(value string) string {
+	if len(value) <= maxNameLength && labelValueRegex.MatchString(value) {
+		return value
+	}
+	cleaned := labelInvalidChars.ReplaceAllString(value, "-")
+	return withHashSuffix(cleaned, value, "-._")
+}
+
+// withHashSuffix shortens cleaned so that it fits 63 characters with a hash of original appended,
+// trimming the separators (cutset) a name must not start or end with
+func withHashSuffix(cleaned, original, cutset string) string {
+	sum := sha256.Sum256([]byte(original))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+	cleaned = strings.Trim(cleaned, cutset)
+	if max := maxNameLength - nameHashLength - 1; len(cleaned) > max {
+		cleaned = strings.TrimRight(cleaned[:max], cutset)
+	}
+	if cleaned == "" {
+		return hash
+	}
+	return cleaned + "-" + hash
+}
+
+// podLabels returns the labels of an environment pod: the agentbox labels in base overlaid with
+// the environment's labels, all values sanitized
+func podLabels(base, envLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(base)+len(envLabels))
+	for k, v := range base {
+		labels[k] = sanitizeLabelValue(v)
+	}
+	for k, v := range envLabels {
+		labels[k] = sanitizeLabelValue(v)
+	}
+	return labels
+}
+
+// createPodWithUniqueName creates the pod under spec.Name and, when that name is already taken,
+// under a fresh name from newPodName(prefix), up to podNameAttempts names in total. spec.Name is
+// the name the pod was created under on return.
+func (o *Orchestrator) createPodWithUniqueName(ctx context.Context, client k8s.ClientInterface, spec *k8s.PodSpec, prefix string) error {
+	var err error
+	for attempt := 1; attempt <= podNameAttempts; attempt++ {
+		if err = client.CreatePod(ctx, spec); err == nil || !errors.Is(err, apierrors.Conflict) {
+			return err
+		}
+		if attempt == podNameAttempts {
+			break
+		}
+		name := newPodName(prefix)
+		o.logger.Warn("pod name already taken; retrying under a new name",
+			zap.String("pod", spec.Name),
+			zap.String("new_pod", name),
+			zap.String("namespace", spec.Namespace),
+		)
+		spec.Name = name
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+)
+
+// ========== Standby Pool Administration ==========
+
+// PoolActionResult reports what a pool refresh or drain did
+type PoolActionResult struct {
+	EnvironmentID string `json:"environment_id"`
+	// PodsDeleted is the number of idle standby pods removed; pods claimed by running
+	// executions are left alone and deleted when their execution finishes
+	PodsDeleted int `json:"pods_deleted"`
+	// Drained is true while replenishment is disabled for the environment
+	Drained bool `json:"drained"`
+}
+
+// RefreshStandbyPool replaces an environment's standby pods, e.g. after a new image was pushed
+// under the same tag: idle pods are deleted, pods being created are discarded when they are
+// ready, and replenishment starts right away. It also re-enables a drained pool.
+func (o *Orchestrator) RefreshStandbyPool(ctx context.Context, envID string) (*PoolActionResult, error) {
+	if err := o.checkPoolEnabled(envID); err != nil {
+		return nil, err
+	}
+
+	o.standbyPoolMutex.Lock()
+	pods := o.standbyPool[envID]
+	delete(o.standbyPool, envID)
+	o.poolGeneration[envID]++
+	wasDrained := o.poolDrained[envID]
+	delete(o.poolDrained, envID)
+	o.standbyPoolMutex.Unlock()
+
+	deleted := o.deleteStandbyPods(ctx, envID, pods)
+	details := fmt.Sprintf("%d standby pods deleted", deleted)
+	if wasDrained {
+		details += "; replenishment re-enabled"
+	}
+	o.logReconciliationEvent(envID, "pool_refresh", "Standby pool refreshed", details)
+	o.logger.Info("standby pool refreshed", zap.String("environment_id", envID), zap.Int("pods_deleted", deleted))
+
+	o.triggerReplenish()
+	return &PoolActionResult{EnvironmentID: envID, PodsDeleted: deleted}, nil
+}
+
+// DrainStandbyPool deletes an environment's idle standby pods and stops replenishing its pool
+// until RefreshStandbyPool is called. Executions then run in new pods.
+func (o *Orchestrator) DrainStandbyPool(ctx context.Context, envID string) (*PoolActionResult, error) {
+	if err := o.checkPoolEnabled(envID); err != nil {
+		return nil, err
+	}
+
+	o.standbyPoolMutex.Lock()
+	pods := o.standbyPool[envID]
+	delete(o.standbyPool, envID)
+	o.poolGeneration[envID]++
+	o.poolDrained[envID] = true
+	o.standbyPoolMutex.Unlock()
+
+	deleted := o.deleteStandbyPods(ctx, envID, pods)
+	o.logReconciliationEvent(envID, "pool_drain", "Standby pool drained; replenishment disabled",
+		fmt.Sprintf("%d standby pods deleted", deleted))
+	o.logger.Info("standby pool drained", zap.String("environment_id", envID), zap.Int("pods_deleted", deleted))
+
+	return &PoolActionResult{EnvironmentID: envID, PodsDeleted: deleted, Drained: true}, nil
+}
+
+// discardStandbyPool deletes the standby pods of an environment whose provisioning failed after
+// its pool was prewarmed; pods still being created are discarded when they are ready
+func (o *Orchestrator) discardStandbyPool(envID string) {
+	o.standbyPoolMutex.Lock()
+	pods := o.standbyPool[envID]
+	delete(o.standbyPool, envID)
+	delete(o.poolReadyReached, envID)
+	o.poolGeneration[envID]++
+	o.standbyPoolMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), standbyCreateTimeout)
+	defer cancel()
+	if deleted := o.deleteStandbyPods(ctx, envID, pods); deleted > 0 {
+		o.logger.Info("deleted prewarmed standby pods of failed environment",
+			zap.String("environment_id", envID), zap.Int("pods_deleted", deleted))
+	}
+}
+
+// DrainedPools returns the IDs of the environments whose standby pool is drained, sorted
+func (o *Orchestrator) DrainedPools() []string {
+	o.standbyPoolMutex.Lock()
+	defer o.standbyPoolMutex.Unlock()
+
+	drained := make([]string, 0, len(o.poolDrained))
+	for envID := range o.poolDrained {
+		drained = append(drained, envID)
+	}
+	sort.Strings(drained)
+	return drained
+}
+
+// checkPoolEnabled returns an error unless the environment exists and has a standby pool
+func (o *Orchestrator) checkPoolEnabled(envID string) error {
+	o.envMutex.RLock()
+	defer o.envMutex.RUnlock()
+	env, exists := o.environments[envID]
+	if !exists {
+		return errEnvironmentNotFound
+	}
+	if env.Pool == nil || !env.Pool.Enabled {
+		return apierrors.New(apierrors.Conflict, apierrors.CodePoolNotEnabled, "environment %s has no standby pool", envID)
+	}
+	return nil
+}
+
+// deleteStandbyPods deletes standby pods that were taken out of the pool (best effort) and
+// returns how many were deleted
+func (o *Orchestrator) deleteStandbyPods(ctx context.Context, envID string, pods []*StandbyPod) int {
+	deleted := 0
+	for _, pod := range pods {
+		client, err := o.clusters.Get(pod.Cluster)
+		if err == nil {
+			err = client.DeletePod(ctx, pod.Namespace, pod.Name, true)
+		}
+		if err != nil {
+			o.logger.Warn("failed to delete standby pod",
+				zap.String("pod", pod.Name),
+				zap.String("environment_id", envID),
+				zap.Error(err),
+			)
+			continue
+		}
+		deleted++
+	}
+	return deleted
+}
@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Priority classes ==========
+
+// podType names the kinds of pods agentbox creates, for their default PriorityClass
+type podType int
+
+const (
+	podTypeMain podType = iota
+	podTypeStandby
+	podTypeEphemeral
+)
+
+// evictionReasons are the pod status reasons of a failed pod the kubelet evicted or preempted
+// (a pod whose command failed has no reason)
+var evictionReasons = []string{"Evicted", "Preempting", "Shutdown", "NodeShutdown", "Terminated"}
+
+// checkPriorityClass fails with ValidationFailed when isolation requests a PriorityClass that is
+// not in kubernetes.priority_classes.allowed
+func (o *Orchestrator) checkPriorityClass(isolation *models.IsolationConfig) error {
+	if isolation == nil || isolation.PriorityClassName == "" {
+		return nil
+	}
+	allowed := o.cfg().Kubernetes.PriorityClasses.Allowed
+	if slices.Contains(allowed, isolation.PriorityClassName) {
+		return nil
+	}
+	if len(allowed) == 0 {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodePriorityClassNotAllowed,
+			"priority class %q is not allowed (no priority classes may be requested on this server)", isolation.PriorityClassName)
+	}
+	return apierrors.New(apierrors.ValidationFailed, apierrors.CodePriorityClassNotAllowed,
+		"priority class %q is not allowed (allowed: %s)", isolation.PriorityClassName, strings.Join(allowed, ", "))
+}
+
+// priorityClassFor returns the PriorityClass a pod of the given type runs with: the one the
+// isolation requests, otherwise the configured default of the pod type
+func (o *Orchestrator) priorityClassFor(isolation *models.IsolationConfig, typ podType) string {
+	if isolation != nil && isolation.PriorityClassName != "" {
+		return isolation.PriorityClassName
+	}
+	defaults := o.cfg().Kubernetes.PriorityClasses
+	switch typ {
+	case podTypeStandby:
+		return defaults.Standby
+	case podTypeEphemeral:
+		return defaults.Ephemeral
+	default:
+		return defaults.Main
+	}
+}
+
+// podEvictionReason returns why the pod was evicted or preempted, from its DisruptionTarget
+// condition or the reason of its failed status; ok is false when the pod was not
+func podEvictionReason(pod *corev1.Pod) (reason, message string, ok bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.DisruptionTarget && cond.Status == corev1.ConditionTrue {
+			return cond.Reason, cond.Message, true
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed && slices.Contains(evictionReasons, pod.Status.Reason) {
+		return pod.Status.Reason, pod.Status.Message, true
+	}
+	return "", "", false
+}
+
+// recordPodEviction records that an environment's main pod was evicted or preempted and is
+// about to be replaced
+func (o *Orchestrator) recordPodEviction(env *models.Environment, reason, message string) {
+	o.logger.Warn("main pod evicted",
+		zap.String("environment_id", env.ID),
+		zap.String("reason", reason),
+		zap.String("message", message),
+	)
+	o.logReconciliationEvent(env.ID, "pod_evicted",
+		fmt.Sprintf("Main pod was evicted (%s); recreating", reason), message)
+}
@@ -0,0 +1,228 @@
+package orchestrator
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ========== Provisioning and Execution Queues ==========
+
+// queueStatsWindow is how far back the average wait and hold times of a queue look
+const queueStatsWindow = 5 * time.Minute
+
+// maxQueueSamples bounds the samples kept per queue within queueStatsWindow
+const maxQueueSamples = 10000
+
+// Names of the orchestrator's queues
+const (
+	QueueProvisioning = "provisioning"
+	QueueExecutions   = "executions"
+)
+
+// queueSample is one acquisition of a slot: how long it waited for the slot, and once released,
+// how long it held it
+type queueSample struct {
+	at   time.Time
+	wait time.Duration
+}
+
+// slotQueue is a counting semaphore that keeps track of who holds and who waits for its slots,
+// so the backlog behind it can be reported. Slots are taken with acquire, never directly.
+type slotQueue struct {
+	name  string
+	slots chan struct{}
+
+	mu       sync.Mutex
+	waiting  int
+	inFlight int
+	// per key (environment ID); keys with nothing waiting or in flight are removed
+	waitingByKey  map[string]int
+	inFlightByKey map[string]int
+	waits         []queueSample
+	holds         []queueSample
+	// clock times the waits and holds
+	clock Clock
+}
+
+// newSlotQueue creates a queue with capacity slots
+func newSlotQueue(name string, capacity int, clock Clock) *slotQueue {
+	return &slotQueue{
+		name:          name,
+		clock:         clock,
+		slots:         make(chan struct{}, capacity),
+		waitingByKey:  make(map[string]int),
+		inFlightByKey: make(map[string]int),
+	}
+}
+
+// acquire waits for a slot until ctx is done and returns the function releasing it. key (e.g.
+// the environment ID, may be empty) attributes the wait and the slot in QueueStatus.
+func (q *slotQueue) acquire(ctx context.Context, key string) (func(), error) {
+	start := q.clock.Now()
+	q.mu.Lock()
+	q.waiting++
+	q.adjust(q.waitingByKey, key, 1)
+	q.mu.Unlock()
+
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		q.mu.Lock()
+		q.waiting--
+		q.adjust(q.waitingByKey, key, -1)
+		q.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	acquired := q.clock.Now()
+	q.mu.Lock()
+	q.waiting--
+	q.adjust(q.waitingByKey, key, -1)
+	q.inFlight++
+	q.adjust(q.inFlightByKey, key, 1)
+	q.waits = appendSample(q.waits, queueSample{at: acquired, wait: acquired.Sub(start)})
+	q.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			released := q.clock.Now()
+			q.mu.Lock()
+			q.inFlight--
+			q.adjust(q.inFlightByKey, key, -1)
+			q.holds = appendSample(q.holds, queueSample{at: released, wait: released.Sub(acquired)})
+			q.mu.Unlock()
+			<-q.slots
+		})
+	}, nil
+}
+
+// adjust adds delta to counts[key] (guarded by mu), dropping keys that reach zero
+func (q *slotQueue) adjust(counts map[string]int, key string, delta int) {
+	if key == "" {
+		return
+	}
+	counts[key] += delta
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// appendSample appends s, dropping samples older than queueStatsWindow and beyond maxQueueSamples
+func appendSample(samples []queueSample, s queueSample) []queueSample {
+	samples = pruneSamples(samples, s.at)
+	if len(samples) >= maxQueueSamples {
+		samples = samples[len(samples)-maxQueueSamples+1:]
+	}
+	return append(samples, s)
+}
+
+// pruneSamples drops the samples older than queueStatsWindow at now
+func pruneSamples(samples []queueSample, now time.Time) []queueSample {
+	cutoff := now.Add(-queueStatsWindow)
+	i := sort.Search(len(samples), func(i int) bool { return !samples[i].at.Before(cutoff) })
+	return samples[i:]
+}
+
+// averageSeconds returns the average duration of the samples in seconds (0 without samples)
+func averageSeconds(samples []queueSample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, s := range samples {
+		total += s.wait
+	}
+	return (total / time.Duration(len(samples))).Seconds()
+}
+
+// QueueStatus is a snapshot of a provisioning or execution queue
+type QueueStatus struct {
+	Name string `json:"name"`
+	// Capacity is how many environments are provisioned (executions run) at once
+	Capacity int `json:"capacity"`
+	InFlight int `json:"in_flight"`
+	// Waiting is how many are waiting for a slot
+	Waiting int `json:"waiting"`
+	// AvgWaitSeconds is the average time slots were waited for over the last 5 minutes
+	AvgWaitSeconds float64 `json:"avg_wait_seconds"`
+	// AvgHoldSeconds is the average time slots were held over the last 5 minutes
+	AvgHoldSeconds float64 `json:"avg_hold_seconds"`
+	// Acquired is how many slots were acquired over the last 5 minutes
+	Acquired int `json:"acquired_last_5m"`
+	// ByEnvironment breaks InFlight and Waiting down per environment (environments with neither
+	// are left out)
+	ByEnvironment map[string]*EnvironmentQueueStatus `json:"by_environment,omitempty"`
+}
+
+// EnvironmentQueueStatus is an environment's share of a queue
+type EnvironmentQueueStatus struct {
+	InFlight int `json:"in_flight"`
+	Waiting  int `json:"waiting"`
+}
+
+// QueuesStatus is the status of the orchestrator's queues
+type QueuesStatus struct {
+	Provisioning *QueueStatus `json:"provisioning"`
+	Executions   *QueueStatus `json:"executions"`
+}
+
+// status returns a snapshot of the queue
+func (q *slotQueue) status() *QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.clock.Now()
+	q.waits = pruneSamples(q.waits, now)
+	q.holds = pruneSamples(q.holds, now)
+	status := &QueueStatus{
+		Name:           q.name,
+		Capacity:       cap(q.slots),
+		InFlight:       q.inFlight,
+		Waiting:        q.waiting,
+		AvgWaitSeconds: averageSeconds(q.waits),
+		AvgHoldSeconds: averageSeconds(q.holds),
+		Acquired:       len(q.waits),
+	}
+	for key, n := range q.inFlightByKey {
+		status.environment(key).InFlight = n
+	}
+	for key, n := range q.waitingByKey {
+		status.environment(key).Waiting = n
+	}
+	return status
+}
+
+// environment returns the entry of an environment in ByEnvironment, adding it when missing
+func (s *QueueStatus) environment(envID string) *EnvironmentQueueStatus {
+	if s.ByEnvironment == nil {
+		s.ByEnvironment = make(map[string]*EnvironmentQueueStatus)
+	}
+	if s.ByEnvironment[envID] == nil {
+		s.ByEnvironment[envID] = &EnvironmentQueueStatus{}
+	}
+	return s.ByEnvironment[envID]
+}
+
+// estimatedStart estimates when something queued now gets a slot: nil while a slot is free (or
+// nothing is known about how long slots are held). Everyone ahead is served capacity at a time,
+// each batch taking the recent average hold time.
+func (q *slotQueue) estimatedStart() *time.Time {
+	status := q.status()
+	if status.InFlight+status.Waiting < status.Capacity || status.AvgHoldSeconds == 0 {
+		return nil
+	}
+	batches := math.Ceil(float64(status.Waiting+1) / float64(status.Capacity))
+	start := q.clock.Now().Add(time.Duration(batches * status.AvgHoldSeconds * float64(time.Second))).UTC()
+	return &start
+}
+
+// QueueStatus returns the status of the provisioning and execution queues
+func (o *Orchestrator) QueueStatus() *QueuesStatus {
+	return &QueuesStatus{
+		Provisioning: o.provisionSlots.status(),
+		Executions:   o.execSlots.status(),
+	}
+}
@@ -0,0 +1,127 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Readiness Checks ==========
+
+// Readiness check defaults, used when the corresponding ReadinessCheck field is zero
+const (
+	defaultReadinessInterval = 2 * time.Second
+	defaultReadinessTimeout  = 5 * time.Second
+)
+
+// maxReadinessOutput bounds the probe output kept in an environment's status message
+const maxReadinessOutput = 1024
+
+// probeReadiness runs one attempt of check against the pod. It returns the probe output (command
+// output, HTTP status and body, or an error description) and a non-nil error when the pod is not ready.
+func probeReadiness(ctx context.Context, client k8s.ClientInterface, namespace, podName string, check *models.ReadinessCheck) (string, error) {
+	switch {
+	case len(check.Exec) > 0:
+		output, err := execProbe(ctx, client, namespace, podName, check.Exec)
+		if err != nil {
+			return output, fmt.Errorf("command %v failed: %w", check.Exec, err)
+		}
+		return output, nil
+	case check.HTTPGet != nil:
+		path := check.HTTPGet.Path
+		if path == "" {
+			path = "/"
+		}
+		status, body, err := client.ProbeHTTPGet(ctx, namespace, podName, check.HTTPGet.Port, path)
+		if err != nil {
+			return "", fmt.Errorf("GET :%d%s failed: %w", check.HTTPGet.Port, path, err)
+		}
+		output := fmt.Sprintf("HTTP %d: %s", status, body)
+		if status < 200 || status >= 400 {
+			return output, fmt.Errorf("GET :%d%s returned HTTP %d", check.HTTPGet.Port, path, status)
+		}
+		return output, nil
+	case check.FileExists != "":
+		// Pass the path as a positional argument so it is never interpreted by the shell
+		cmd := []string{"/bin/sh", "-c", `test -e "$1"`, "sh", check.FileExists}
+		output, err := execProbe(ctx, client, namespace, podName, cmd)
+		if err != nil {
+			return output, fmt.Errorf("file %s does not exist", check.FileExists)
+		}
+		return output, nil
+	}
+	return "", nil
+}
+
+// execProbe runs a probe command in the pod and returns its combined stdout and stderr
+func execProbe(ctx context.Context, client k8s.ClientInterface, namespace, podName string, command []string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := client.ExecInPod(ctx, namespace, podName, command, nil, &stdout, &stderr)
+	return stdout.String() + stderr.String(), err
+}
+
+// waitForReady runs check against the pod every interval until it passes, FailureThreshold
+// consecutive attempts fail, or ctx is done. On failure it returns the output of the last attempt.
+func (o *Orchestrator) waitForReady(ctx context.Context, client k8s.ClientInterface, namespace, podName string, check *models.ReadinessCheck) (string, error) {
+	interval := defaultReadinessInterval
+	if check.IntervalSeconds > 0 {
+		interval = time.Duration(check.IntervalSeconds) * time.Second
+	}
+	timeout := defaultReadinessTimeout
+	if check.TimeoutSeconds > 0 {
+		timeout = time.Duration(check.TimeoutSeconds) * time.Second
+	}
+
+	failures := 0
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		output, err := probeReadiness(attemptCtx, client, namespace, podName, check)
+		cancel()
+		if err == nil {
+			return output, nil
+		}
+
+		failures++
+		output = describeProbeFailure(output, err)
+		o.logger.Debug("readiness check failed",
+			zap.String("namespace", namespace),
+			zap.String("pod", podName),
+			zap.Int("failures", failures),
+			zap.Error(err),
+		)
+		if check.FailureThreshold > 0 && failures >= check.FailureThreshold {
+			return output, fmt.Errorf("readiness check failed %d times: %w", failures, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return output, fmt.Errorf("pod not ready before startup timeout: %w", err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// describeProbeFailure combines a failed probe's output and error into a bounded status message
+func describeProbeFailure(output string, err error) string {
+	msg := err.Error()
+	if out := strings.TrimSpace(output); out != "" {
+		msg += ": " + out
+	}
+	if len(msg) > maxReadinessOutput {
+		// Cut at a rune boundary so the status message stays valid UTF-8
+		cut := maxReadinessOutput
+		for cut > 0 && !utf8.RuneStart(msg[cut]) {
+			cut--
+		}
+		msg = msg[:cut] + "..."
+	}
+	return msg
+}
@@ -0,0 +1,623 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Capacity Reservations ==========
+
+const (
+	// reservationCheckInterval is how often reservations are checked for placeholder pods to
+	// create (their lead time started) or delete (their window ended)
+	reservationCheckInterval = 30 * time.Second
+	// placeholderPodPrefix names the placeholder pods: hold-<slot>, one per reserved environment
+	placeholderPodPrefix = "hold-"
+	// reservationIDLabel marks a reservation's namespace and placeholder pods. Reservation
+	// namespaces carry no env-id label, so namespace GC leaves them alone.
+	reservationIDLabel = "reservation-id"
+)
+
+// CreateReservation validates and stores a reservation. Open reservations of the same owner
+// (the team for a team reservation, the user otherwise) may hold at most
+// reservations.max_environments_per_user environments together, and a team reservation at most
+// teamLimit (the team's environment quota, 0 = unlimited). Placeholder pods are created by the
+// reservation loop once the lead time before the window starts.
+func (o *Orchestrator) CreateReservation(ctx context.Context, req *models.CreateReservationRequest, userID string, teamLimit int) (*models.Reservation, error) {
+	cfg := o.reservationSettings()
+	now := o.clock.Now()
+
+	if req.Name == "" {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "name is required")
+	}
+	if req.Environments < 1 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "environments must be at least 1")
+	}
+	if req.StartsAt.IsZero() || req.EndsAt.IsZero() {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "starts_at and ends_at are required")
+	}
+	if !req.EndsAt.After(req.StartsAt) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "ends_at must be after starts_at")
+	}
+	if !req.EndsAt.After(now) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "ends_at must be in the future")
+	}
+	if maxDuration := time.Duration(cfg.MaxDurationHours) * time.Hour; req.EndsAt.Sub(req.StartsAt) > maxDuration {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "the window must be at most %d hours long", cfg.MaxDurationHours)
+	}
+	if req.StartsAt.After(now.AddDate(0, 0, cfg.MaxAdvanceDays)) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "the window must start within %d days", cfg.MaxAdvanceDays)
+	}
+	cluster := req.Cluster
+	if cluster == "" {
+		cluster = o.clusters.DefaultName()
+	}
+	if !o.clusters.Has(cluster) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeUnknownCluster, "unknown cluster %q (configured: %s)", cluster, strings.Join(o.clusters.Names(), ", "))
+	}
+
+	id := "rsv-" + uuid.New().String()[:8]
+	rsv := &models.Reservation{
+		ID:           id,
+		Name:         req.Name,
+		UserID:       userID,
+		TeamID:       req.TeamID,
+		Cluster:      cluster,
+		Namespace:    k8s.NamespaceName(o.namespacePrefix, id),
+		StartsAt:     req.StartsAt.UTC(),
+		EndsAt:       req.EndsAt.UTC(),
+		Environments: req.Environments,
+		Resources:    req.Resources,
+		NodeSelector: req.NodeSelector,
+		Status:       models.ReservationScheduled,
+		CreatedAt:    now.UTC(),
+	}
+
+	// The quota check and the insert are serialized so concurrent requests cannot both fit
+	o.reservationMutex.Lock()
+	defer o.reservationMutex.Unlock()
+
+	open, err := o.loadReservations(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	reserved := rsv.Environments
+	for _, other := range open {
+		if (rsv.TeamID != "" && other.TeamID == rsv.TeamID) || (rsv.TeamID == "" && other.TeamID == "" && other.UserID == userID) {
+			reserved += other.Environments - other.Used
+		}
+	}
+	owner := "user"
+	if rsv.TeamID != "" {
+		owner = "team"
+	}
+	if cfg.MaxEnvironmentsPerUser > 0 && reserved > cfg.MaxEnvironmentsPerUser {
+		return nil, apierrors.New(apierrors.QuotaExceeded, apierrors.CodeReservationQuotaExceeded,
+			"reservation quota exceeded: the %s would hold %d reserved environments (max %d)", owner, reserved, cfg.MaxEnvironmentsPerUser)
+	}
+	if teamLimit > 0 && reserved > teamLimit {
+		return nil, apierrors.New(apierrors.QuotaExceeded, apierrors.CodeReservationQuotaExceeded,
+			"reservation quota exceeded: the team would hold %d reserved environments (max %d)", reserved, teamLimit)
+	}
+
+	if o.db != nil {
+		if err := o.db.SaveReservation(ctx, rsv); err != nil {
+			return nil, err
+		}
+	}
+	o.reservations[rsv.ID] = rsv
+
+	o.logger.Info("reservation created",
+		zap.String("reservation_id", rsv.ID),
+		zap.String("user_id", userID),
+		zap.Int("environments", rsv.Environments),
+		zap.Time("starts_at", rsv.StartsAt),
+		zap.Time("ends_at", rsv.EndsAt),
+	)
+	rsvCopy := *rsv
+	return &rsvCopy, nil
+}
+
+// GetReservation returns a reservation
+func (o *Orchestrator) GetReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	o.reservationMutex.Lock()
+	defer o.reservationMutex.Unlock()
+	return o.loadReservation(ctx, id)
+}
+
+// ListReservations returns all reservations, newest first
+func (o *Orchestrator) ListReservations(ctx context.Context) (*models.ListReservationsResponse, error) {
+	o.reservationMutex.Lock()
+	reservations, err := o.loadReservations(ctx, false)
+	o.reservationMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	resp := &models.ListReservationsResponse{Reservations: make([]models.Reservation, 0, len(reservations))}
+	for _, rsv := range reservations {
+		resp.Reservations = append(resp.Reservations, *rsv)
+	}
+	resp.Total = len(resp.Reservations)
+	return resp, nil
+}
+
+// CancelReservation ends a reservation before its window does: its placeholder pods are
+// deleted and no more environments can be created with it. Environments already created with
+// it are not affected.
+func (o *Orchestrator) CancelReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	o.reservationMutex.Lock()
+	rsv, err := o.loadReservation(ctx, id)
+	o.reservationMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !rsv.Open() {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeReservationNotActive, "reservation %s is already %s", id, rsv.Status)
+	}
+	if err := o.closeReservation(ctx, rsv, models.ReservationCanceled); err != nil {
+		return nil, err
+	}
+	return rsv, nil
+}
+
+// runReservationLoop periodically creates and deletes the placeholder pods of reservations
+func (o *Orchestrator) runReservationLoop() {
+	ticker := o.clock.NewTicker(reservationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.reservationStopChan:
+			return
+		case <-ticker.C():
+			o.RunReservationPass(context.Background(), o.clock.Now())
+		}
+	}
+}
+
+// RunReservationPass runs one reservation pass as of now: reservations whose window ended are
+// expired and their placeholder pods deleted; reservations within their lead time or window hold
+// one placeholder pod per unused environment. Returns the IDs of the reservations it changed the
+// placeholders of.
+func (o *Orchestrator) RunReservationPass(ctx context.Context, now time.Time) []string {
+	o.reservationMutex.Lock()
+	open, err := o.loadReservations(ctx, true)
+	o.reservationMutex.Unlock()
+	if err != nil {
+		o.logger.Warn("failed to list reservations", zap.Error(err))
+		return nil
+	}
+
+	lead := time.Duration(o.reservationSettings().LeadTimeSeconds) * time.Second
+	var changed []string
+	for _, rsv := range open {
+		if !o.clusters.Reachable(rsv.Cluster) {
+			continue
+		}
+		switch {
+		case !now.Before(rsv.EndsAt):
+			if err := o.closeReservation(ctx, rsv, models.ReservationExpired); err != nil {
+				o.logger.Warn("failed to expire reservation", zap.String("reservation_id", rsv.ID), zap.Error(err))
+				continue
+			}
+			changed = append(changed, rsv.ID)
+		case !now.Before(rsv.StartsAt.Add(-lead)):
+			updated, err := o.holdReservation(ctx, rsv)
+			if err != nil {
+				o.logger.Warn("failed to hold reservation capacity", zap.String("reservation_id", rsv.ID), zap.Error(err))
+			}
+			if updated {
+				changed = append(changed, rsv.ID)
+			}
+		}
+	}
+	return changed
+}
+
+// holdReservation makes the reservation's namespace hold placeholder pods hold-<slot> for its
+// free slots and none for the taken ones, and marks it holding. Reports whether any pod was
+// created or deleted.
+func (o *Orchestrator) holdReservation(ctx context.Context, rsv *models.Reservation) (bool, error) {
+	client, err := o.clusters.Get(rsv.Cluster)
+	if err != nil {
+		return false, err
+	}
+	exists, err := client.NamespaceExists(ctx, rsv.Namespace)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		if err := client.CreateNamespace(ctx, rsv.Namespace, map[string]string{
+			"app":              "agentbox",
+			"managed-by":       "agentbox",
+			reservationIDLabel: rsv.ID,
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	pods, err := client.ListPods(ctx, rsv.Namespace, reservationIDLabel+"="+rsv.ID)
+	if err != nil {
+		return false, err
+	}
+	existing := make(map[int]bool, len(pods.Items))
+	for _, pod := range pods.Items {
+		if slot, ok := placeholderSlot(pod.Name); ok && pod.DeletionTimestamp == nil {
+			existing[slot] = true
+		}
+	}
+	held := heldSlots(rsv)
+
+	updated := false
+	var errs []error
+	for slot := 0; slot < rsv.Environments; slot++ {
+		name := placeholderPodName(slot)
+		switch {
+		case !held[slot] && existing[slot]:
+			// Taken by an environment whose provisioning has not deleted it yet, or left behind
+			if err := client.DeletePod(ctx, rsv.Namespace, name, true); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			updated = true
+		case held[slot] && !existing[slot]:
+			if err := client.CreatePod(ctx, o.placeholderPodSpec(rsv, name)); err != nil && apierrors.CodeOf(err) != apierrors.CodePodAlreadyExists {
+				errs = append(errs, err)
+				continue
+			}
+			updated = true
+		}
+	}
+
+	if rsv.Status == models.ReservationScheduled {
+		rsv.Status = models.ReservationHolding
+		o.saveReservation(ctx, rsv)
+		o.logger.Info("reservation holding capacity",
+			zap.String("reservation_id", rsv.ID),
+			zap.String("namespace", rsv.Namespace),
+			zap.Int("placeholders", rsv.Environments-rsv.Used),
+		)
+	}
+	return updated, errors.Join(errs...)
+}
+
+// closeReservation deletes the reservation's namespace (and with it the placeholder pods) and
+// stores its final status
+func (o *Orchestrator) closeReservation(ctx context.Context, rsv *models.Reservation, status models.ReservationStatus) error {
+	if rsv.Status == models.ReservationHolding {
+		client, err := o.clusters.Get(rsv.Cluster)
+		if err != nil {
+			return err
+		}
+		if err := client.DeleteNamespace(ctx, rsv.Namespace); err != nil {
+			return fmt.Errorf("failed to delete reservation namespace: %w", err)
+		}
+	}
+	rsv.Status = status
+	o.saveReservation(ctx, rsv)
+	o.logger.Info("reservation closed",
+		zap.String("reservation_id", rsv.ID),
+		zap.String("status", string(status)),
+		zap.Int("used", rsv.Used),
+	)
+	return nil
+}
+
+// placeholderPodSpec returns a pause pod requesting the resources of one reserved environment
+// on the nodes the reservation selects
+func (o *Orchestrator) placeholderPodSpec(rsv *models.Reservation, name string) *k8s.PodSpec {
+	return &k8s.PodSpec{
+		Name:         name,
+		Namespace:    rsv.Namespace,
+		Image:        o.reservationSettings().PlaceholderImage,
+		Command:      []string{"/pause"},
+		CPU:          rsv.Resources.CPU,
+		Memory:       rsv.Resources.Memory,
+		Storage:      rsv.Resources.Storage,
+		RuntimeClass: o.cfg().Kubernetes.RuntimeClass,
+		Labels: map[string]string{
+			"app":              "agentbox",
+			"managed-by":       "agentbox",
+			reservationIDLabel: rsv.ID,
+		},
+		NodeSelector:      rsv.NodeSelector,
+		PriorityClassName: o.reservationSettings().PlaceholderPriorityClass,
+	}
+}
+
+// claimReservation takes the lowest free slot of the reservation for the environment envID
+// being created and returns the reservation and the slot. The reservation must belong to the
+// user (or the request's team), be within its lead time or window, and be on the environment's
+// cluster, and the environment must fit in the reserved resources.
+func (o *Orchestrator) claimReservation(ctx context.Context, req *models.CreateEnvironmentRequest, userID, envID string) (*models.Reservation, int, error) {
+	o.reservationMutex.Lock()
+	defer o.reservationMutex.Unlock()
+
+	rsv, err := o.loadReservation(ctx, req.ReservationID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rsv.TeamID != "" {
+		if req.TeamID != rsv.TeamID {
+			return nil, 0, apierrors.New(apierrors.Forbidden, "", "reservation %s belongs to team %s; create the environment in that team", rsv.ID, rsv.TeamID)
+		}
+	} else if rsv.UserID != userID {
+		return nil, 0, apierrors.New(apierrors.Forbidden, "", "reservation %s belongs to another user", rsv.ID)
+	}
+	if req.Cluster != "" && req.Cluster != rsv.Cluster {
+		return nil, 0, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "reservation %s is on cluster %s", rsv.ID, rsv.Cluster)
+	}
+	now := o.clock.Now()
+	lead := time.Duration(o.reservationSettings().LeadTimeSeconds) * time.Second
+	if !rsv.Open() || now.Before(rsv.StartsAt.Add(-lead)) || !now.Before(rsv.EndsAt) {
+		return nil, 0, apierrors.New(apierrors.Conflict, apierrors.CodeReservationNotActive,
+			"reservation %s is not active (status %s, window %s to %s)", rsv.ID, rsv.Status,
+			rsv.StartsAt.Format(time.RFC3339), rsv.EndsAt.Format(time.RFC3339))
+	}
+	if err := fitsReservation(req.Resources, rsv.Resources); err != nil {
+		return nil, 0, err
+	}
+
+	slot := -1
+	if o.db != nil {
+		var ok bool
+		if slot, ok, err = o.db.ClaimReservation(ctx, rsv.ID, envID); err != nil {
+			return nil, 0, err
+		} else if !ok {
+			slot = -1
+		}
+	} else if rsv.Used < rsv.Environments {
+		slot = lowestFreeSlot(rsv)
+	}
+	if slot < 0 {
+		return nil, 0, apierrors.New(apierrors.Conflict, apierrors.CodeReservationExhausted, "all %d environments of reservation %s are used", rsv.Environments, rsv.ID)
+	}
+	if cached, ok := o.reservations[rsv.ID]; ok {
+		if cached.Slots == nil {
+			cached.Slots = make(map[int]string)
+		}
+		cached.Slots[slot] = envID
+		cached.Used++
+	}
+	if rsv.Slots == nil {
+		rsv.Slots = make(map[int]string)
+	}
+	rsv.Slots[slot] = envID
+	rsv.Used++
+	return rsv, slot, nil
+}
+
+// releaseReservation gives back the slot the environment envID claimed when it was not created,
+// and puts its placeholder pod back right away while the reservation holds capacity
+func (o *Orchestrator) releaseReservation(ctx context.Context, id, envID string) {
+	o.reservationMutex.Lock()
+	delete(o.placeholderSlots, envID)
+	slot, released := -1, false
+	if cached, ok := o.reservations[id]; ok {
+		for s, owner := range cached.Slots {
+			if owner == envID {
+				slot, released = s, true
+				delete(cached.Slots, s)
+				cached.Used--
+				break
+			}
+		}
+	}
+	if o.db != nil {
+		var err error
+		if slot, released, err = o.db.ReleaseReservation(ctx, id, envID); err != nil {
+			o.logger.Warn("failed to release reservation", zap.String("reservation_id", id), zap.Error(err))
+		}
+	}
+	var rsv *models.Reservation
+	var err error
+	if released {
+		rsv, err = o.loadReservation(ctx, id)
+	}
+	o.reservationMutex.Unlock()
+	if !released {
+		return
+	}
+	if err != nil {
+		o.logger.Warn("failed to get reservation", zap.String("reservation_id", id), zap.Error(err))
+		return
+	}
+	if rsv.Status != models.ReservationHolding || !heldSlots(rsv)[slot] {
+		return
+	}
+	client, err := o.clusters.Get(rsv.Cluster)
+	if err != nil {
+		return
+	}
+	name := placeholderPodName(slot)
+	if err := client.CreatePod(ctx, o.placeholderPodSpec(rsv, name)); err != nil && apierrors.CodeOf(err) != apierrors.CodePodAlreadyExists {
+		// The reservation loop creates it on its next pass
+		o.logger.Warn("failed to restore placeholder pod",
+			zap.String("reservation_id", id),
+			zap.String("pod", name),
+			zap.Error(err),
+		)
+	}
+}
+
+// takePlaceholder deletes the placeholder pod an environment of a reservation takes the place
+// of, right before its main pod is created, so the capacity it held goes to the main pod. It
+// does nothing for other environments and once the placeholder was taken.
+func (o *Orchestrator) takePlaceholder(ctx context.Context, envID, reservationID string) {
+	if reservationID == "" {
+		return
+	}
+	o.reservationMutex.Lock()
+	slot, ok := o.placeholderSlots[envID]
+	delete(o.placeholderSlots, envID)
+	var rsv *models.Reservation
+	var err error
+	if ok {
+		rsv, err = o.loadReservation(ctx, reservationID)
+	}
+	o.reservationMutex.Unlock()
+	if !ok {
+		return
+	}
+	if err != nil {
+		o.logger.Warn("failed to get reservation", zap.String("reservation_id", reservationID), zap.Error(err))
+		return
+	}
+	if rsv.Status != models.ReservationHolding {
+		return
+	}
+	client, err := o.clusters.Get(rsv.Cluster)
+	if err != nil {
+		return
+	}
+	name := placeholderPodName(slot)
+	if err := client.DeletePod(ctx, rsv.Namespace, name, true); err != nil {
+		o.logger.Warn("failed to delete placeholder pod",
+			zap.String("environment_id", envID),
+			zap.String("reservation_id", rsv.ID),
+			zap.String("pod", name),
+			zap.Error(err),
+		)
+	}
+}
+
+// fitsReservation checks that an environment's resources are at most the reserved ones
+func fitsReservation(requested, reserved models.ResourceSpec) error {
+	checks := []struct{ name, requested, reserved string }{
+		{"cpu", requested.CPU, reserved.CPU},
+		{"memory", requested.Memory, reserved.Memory},
+		{"storage", requested.Storage, reserved.Storage},
+	}
+	for _, c := range checks {
+		if c.requested == "" || c.reserved == "" {
+			continue
+		}
+		requested, err1 := resource.ParseQuantity(c.requested)
+		reserved, err2 := resource.ParseQuantity(c.reserved)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if requested.Cmp(reserved) > 0 {
+			return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+				"%s %s exceeds the %s reserved per environment", c.name, c.requested, c.reserved)
+		}
+	}
+	return nil
+}
+
+// loadReservation returns a copy of the reservation from the database (or memory without one);
+// callers hold reservationMutex
+func (o *Orchestrator) loadReservation(ctx context.Context, id string) (*models.Reservation, error) {
+	if o.db != nil {
+		return o.db.GetReservation(ctx, id)
+	}
+	rsv, ok := o.reservations[id]
+	if !ok {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeReservationNotFound, "reservation not found: %s", id)
+	}
+	rsvCopy := *rsv
+	rsvCopy.Slots = maps.Clone(rsv.Slots)
+	return &rsvCopy, nil
+}
+
+// loadReservations returns copies of the reservations (only the open ones with openOnly),
+// newest first; callers hold reservationMutex
+func (o *Orchestrator) loadReservations(ctx context.Context, openOnly bool) ([]*models.Reservation, error) {
+	if o.db != nil {
+		return o.db.ListReservations(ctx, openOnly)
+	}
+	var reservations []*models.Reservation
+	for _, rsv := range o.reservations {
+		if openOnly && !rsv.Open() {
+			continue
+		}
+		rsvCopy := *rsv
+		rsvCopy.Slots = maps.Clone(rsv.Slots)
+		reservations = append(reservations, &rsvCopy)
+	}
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].CreatedAt.After(reservations[j].CreatedAt) })
+	return reservations, nil
+}
+
+// saveReservation stores a reservation's status
+func (o *Orchestrator) saveReservation(ctx context.Context, rsv *models.Reservation) {
+	o.reservationMutex.Lock()
+	defer o.reservationMutex.Unlock()
+	if cached, ok := o.reservations[rsv.ID]; ok {
+		cached.Status = rsv.Status
+		if !cached.Open() {
+			cached.Slots = nil
+		}
+	}
+	if o.db != nil {
+		if err := o.db.SaveReservation(ctx, rsv); err != nil {
+			o.logger.Warn("failed to save reservation", zap.String("reservation_id", rsv.ID), zap.Error(err))
+		}
+	}
+}
+
+// reservationSettings returns the reservation settings with the defaults of those left unset
+func (o *Orchestrator) reservationSettings() config.ReservationsConfig {
+	settings := o.cfg().Reservations
+	if settings.MaxDurationHours <= 0 {
+		settings.MaxDurationHours = 24
+	}
+	if settings.MaxAdvanceDays <= 0 {
+		settings.MaxAdvanceDays = 30
+	}
+	if settings.PlaceholderImage == "" {
+		settings.PlaceholderImage = "registry.k8s.io/pause:3.9"
+	}
+	return settings
+}
+
+// heldSlots returns the slots that hold a placeholder pod: the lowest free ones, as many as the
+// reservation has unused environments
+func heldSlots(rsv *models.Reservation) map[int]bool {
+	held := make(map[int]bool, rsv.Environments-rsv.Used)
+	for slot := 0; slot < rsv.Environments && len(held) < rsv.Environments-rsv.Used; slot++ {
+		if _, taken := rsv.Slots[slot]; !taken {
+			held[slot] = true
+		}
+	}
+	return held
+}
+
+// lowestFreeSlot returns the lowest slot no environment took, or -1 when every slot is taken
+func lowestFreeSlot(rsv *models.Reservation) int {
+	for slot := 0; slot < rsv.Environments; slot++ {
+		if _, taken := rsv.Slots[slot]; !taken {
+			return slot
+		}
+	}
+	return -1
+}
+
+// placeholderPodName returns the name of the placeholder pod of a slot
+func placeholderPodName(slot int) string {
+	return placeholderPodPrefix + strconv.Itoa(slot)
+}
+
+// placeholderSlot returns the slot of a placeholder pod name
+func placeholderSlot(name string) (int, bool) {
+	if !strings.HasPrefix(name, placeholderPodPrefix) {
+		return 0, false
+	}
+	slot, err := strconv.Atoi(strings.TrimPrefix(name, placeholderPodPrefix))
+	return slot, err == nil
+}
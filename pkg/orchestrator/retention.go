@@ -0,0 +1,254 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Retention ==========
+
+// failureEventTypes are the event types recording why an environment failed; event pruning keeps
+// the newest of them for every failed environment
+var failureEventTypes = []string{"reconciliation_failure", "reconciliation_max_retries", "readiness_failed", "build_failed"}
+
+// runRetentionLoop periodically purges finished executions and environment events that fall
+// outside the retention policy. The loop always runs so limits enabled by a configuration reload
+// take effect; while no limits are configured enforceRetention only drops expired result cache
+// entries.
+func (o *Orchestrator) runRetentionLoop() {
+	interval := o.retentionInterval()
+	ticker := o.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	retention := o.cfg().Retention
+	if retention.KeepLastPerEnvironment > 0 || retention.MaxAgeDays > 0 ||
+		retention.Events.MaxPerEnvironment > 0 || retention.Events.MaxAgeDays > 0 {
+		o.logger.Info("retention janitor started",
+			zap.Duration("interval", interval),
+			zap.Int("keep_last_per_environment", retention.KeepLastPerEnvironment),
+			zap.Int("max_age_days", retention.MaxAgeDays),
+			zap.Int("events_max_per_environment", retention.Events.MaxPerEnvironment),
+			zap.Int("events_max_age_days", retention.Events.MaxAgeDays),
+		)
+	}
+
+	for {
+		select {
+		case <-o.retentionStopChan:
+			o.logger.Info("retention janitor stopped")
+			return
+		case <-ticker.C():
+			o.enforceRetention()
+
+			// Pick up interval changes from a configuration reload
+			if next := o.retentionInterval(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		}
+	}
+}
+
+// retentionInterval returns the configured retention janitor interval (at least 1 minute)
+func (o *Orchestrator) retentionInterval() time.Duration {
+	interval := time.Duration(o.cfg().Retention.IntervalSeconds) * time.Second
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// enforceRetention applies the configured retention policy once and drops expired result cache
+// entries
+func (o *Orchestrator) enforceRetention() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	o.deleteExpiredExecutionCache(ctx)
+
+	retention := o.cfg().Retention
+	keepLast := retention.KeepLastPerEnvironment
+	maxAgeDays := retention.MaxAgeDays
+
+	var purged []string
+	if maxAgeDays > 0 {
+		cutoff := o.clock.Now().Add(-time.Duration(maxAgeDays) * 24 * time.Hour)
+		ids, err := o.purgeExecutions(ctx, "", cutoff)
+		if err != nil {
+			o.logger.Warn("retention: failed to purge expired executions", zap.Error(err))
+		}
+		purged = append(purged, ids...)
+	}
+	if keepLast > 0 {
+		ids, err := o.purgeExecutionsBeyondLimit(ctx, keepLast)
+		if err != nil {
+			o.logger.Warn("retention: failed to purge executions beyond limit", zap.Error(err))
+		}
+		purged = append(purged, ids...)
+	}
+
+	if len(purged) > 0 {
+		o.logger.Info("retention: purged executions", zap.Int("count", len(purged)))
+	}
+
+	o.pruneEnvironmentEvents(ctx)
+}
+
+// pruneEnvironmentEvents deletes the environment events that fall outside the event retention
+// policy, keeping the newest failure event of every failed environment
+func (o *Orchestrator) pruneEnvironmentEvents(ctx context.Context) {
+	if o.db == nil {
+		return
+	}
+	retention := o.cfg().Retention.Events
+
+	var pruned int64
+	if retention.MaxAgeDays > 0 {
+		cutoff := o.clock.Now().Add(-time.Duration(retention.MaxAgeDays) * 24 * time.Hour)
+		n, err := o.db.DeleteEnvironmentEventsBefore(ctx, cutoff, failureEventTypes)
+		if err != nil {
+			o.logger.Warn("retention: failed to prune expired environment events", zap.Error(err))
+		}
+		pruned += n
+	}
+	if retention.MaxPerEnvironment > 0 {
+		n, err := o.db.DeleteEnvironmentEventsBeyondLimit(ctx, retention.MaxPerEnvironment, failureEventTypes)
+		if err != nil {
+			o.logger.Warn("retention: failed to prune environment events beyond limit", zap.Error(err))
+		}
+		pruned += n
+	}
+
+	if pruned > 0 {
+		o.logger.Info("retention: pruned environment events", zap.Int64("count", pruned))
+	}
+}
+
+// PurgeExecutions deletes finished executions of an environment created before the given time.
+// Pending, queued and running executions are never deleted. Returns the number of executions removed.
+func (o *Orchestrator) PurgeExecutions(ctx context.Context, envID string, before time.Time) (int, error) {
+	if _, err := o.GetEnvironment(ctx, envID); err != nil {
+		return 0, err
+	}
+
+	ids, err := o.purgeExecutions(ctx, envID, before)
+	if err != nil {
+		return 0, err
+	}
+
+	o.logger.Info("purged executions",
+		zap.String("environment_id", envID),
+		zap.Time("before", before),
+		zap.Int("count", len(ids)),
+	)
+
+	return len(ids), nil
+}
+
+// PurgedExecutionsTotal returns the number of executions removed by retention or explicit purges since startup
+func (o *Orchestrator) PurgedExecutionsTotal() int64 {
+	return o.purgedExecutions.Load()
+}
+
+// purgeExecutions removes finished executions created before the cutoff (all environments when envID is empty)
+func (o *Orchestrator) purgeExecutions(ctx context.Context, envID string, before time.Time) ([]string, error) {
+	if o.db != nil {
+		ids, err := o.db.DeleteExecutionsBefore(ctx, envID, before)
+		if err != nil {
+			return nil, fmt.Errorf("failed to purge executions: %w", err)
+		}
+		o.evictExecutions(ids)
+		return ids, nil
+	}
+
+	// No DB: apply the cutoff to the in-memory map only
+	steps := o.pipelineStepExecutions()
+	o.execMutex.Lock()
+	var ids []string
+	for id, exec := range o.executions {
+		if envID != "" && exec.EnvironmentID != envID {
+			continue
+		}
+		if exec.Status.IsTerminal() && exec.CreatedAt.Before(before) && !steps[id] {
+			delete(o.executions, id)
+			ids = append(ids, id)
+		}
+	}
+	o.execMutex.Unlock()
+
+	o.purgedExecutions.Add(int64(len(ids)))
+	return ids, nil
+}
+
+// purgeExecutionsBeyondLimit keeps the newest keep executions per environment and removes older finished ones
+func (o *Orchestrator) purgeExecutionsBeyondLimit(ctx context.Context, keep int) ([]string, error) {
+	if o.db != nil {
+		ids, err := o.db.DeleteExecutionsBeyondLimit(ctx, keep)
+		if err != nil {
+			return nil, fmt.Errorf("failed to purge executions: %w", err)
+		}
+		o.evictExecutions(ids)
+		return ids, nil
+	}
+
+	steps := o.pipelineStepExecutions()
+	o.execMutex.Lock()
+	byEnv := make(map[string][]*models.Execution)
+	for _, exec := range o.executions {
+		byEnv[exec.EnvironmentID] = append(byEnv[exec.EnvironmentID], exec)
+	}
+	var ids []string
+	for _, execs := range byEnv {
+		if len(execs) <= keep {
+			continue
+		}
+		sort.Slice(execs, func(i, j int) bool {
+			return execs[i].CreatedAt.After(execs[j].CreatedAt)
+		})
+		for _, exec := range execs[keep:] {
+			if exec.Status.IsTerminal() && !steps[exec.ID] {
+				delete(o.executions, exec.ID)
+				ids = append(ids, exec.ID)
+			}
+		}
+	}
+	o.execMutex.Unlock()
+
+	o.purgedExecutions.Add(int64(len(ids)))
+	return ids, nil
+}
+
+// pipelineStepExecutions returns the IDs of the executions running the steps of the pipelines
+// held in memory; retention keeps them so the pipelines' step execution IDs stay valid
+func (o *Orchestrator) pipelineStepExecutions() map[string]bool {
+	o.pipelineMutex.Lock()
+	defer o.pipelineMutex.Unlock()
+	ids := make(map[string]bool)
+	for _, run := range o.pipelines {
+		for _, step := range run.pipeline.Steps {
+			if step.ExecutionID != "" {
+				ids[step.ExecutionID] = true
+			}
+		}
+	}
+	return ids
+}
+
+// evictExecutions drops purged executions from the in-memory cache and updates the purge counter
+func (o *Orchestrator) evictExecutions(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	o.execMutex.Lock()
+	for _, id := range ids {
+		delete(o.executions, id)
+	}
+	o.execMutex.Unlock()
+	o.purgedExecutions.Add(int64(len(ids)))
+}
@@ -0,0 +1,157 @@
+package orchestrator
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Search ==========
+
+// Search query limits: shorter queries match nearly everything, longer ones are not what the
+// search is for
+const (
+	searchMinQueryLength = 2
+	searchMaxQueryLength = 100
+)
+
+// Hits returned per type by default and at most
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+// errSearchNeedsDatabase is returned for searches on a server without a database
+var errSearchNeedsDatabase = apierrors.New(apierrors.Unavailable, apierrors.CodeSearchUnavailable,
+	"search requires a database")
+
+// SearchOptions holds the query and scope of Search
+type SearchOptions struct {
+	Query string
+	// Types are the hit types searched: "environments" and/or "executions" (default: both)
+	Types []string
+	// Limit caps the hits of each type (default 20, max 100)
+	Limit int
+	// ViewerID restricts the hits to the environments the user may view and their executions;
+	// "" searches all of them
+	ViewerID string
+}
+
+// Search finds the environments whose name, image, labels, metadata or owner's username contain
+// the query or whose ID starts with it, and the executions whose command line contains it. Each
+// hit says which fields matched.
+func (o *Orchestrator) Search(ctx context.Context, opts SearchOptions) (*models.SearchResponse, error) {
+	query := strings.TrimSpace(opts.Query)
+	if n := utf8.RuneCountInString(query); n < searchMinQueryLength || n > searchMaxQueryLength {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"q must be %d to %d characters long", searchMinQueryLength, searchMaxQueryLength)
+	}
+	searchEnvironments, searchExecutions := len(opts.Types) == 0, len(opts.Types) == 0
+	for _, t := range opts.Types {
+		switch strings.TrimSuffix(strings.TrimSpace(t), "s") {
+		case models.SearchTypeEnvironment:
+			searchEnvironments = true
+		case models.SearchTypeExecution:
+			searchExecutions = true
+		default:
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+				"types must be environments and/or executions (got %q)", t)
+		}
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+	if o.db == nil {
+		return nil, errSearchNeedsDatabase
+	}
+
+	filter := database.SearchFilter{Query: query, ViewerID: opts.ViewerID}
+	lowered := strings.ToLower(query)
+	resp := &models.SearchResponse{Hits: []models.SearchHit{}}
+	if searchEnvironments {
+		environments, owners, err := o.db.SearchEnvironments(ctx, filter, limit+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(environments) > limit {
+			environments, resp.Truncated = environments[:limit], true
+		}
+		for i, env := range environments {
+			resp.Hits = append(resp.Hits, models.SearchHit{
+				Type:          models.SearchTypeEnvironment,
+				ID:            env.ID,
+				EnvironmentID: env.ID,
+				MatchedFields: environmentMatches(env, owners[i], lowered),
+				Name:          env.Name,
+				Image:         env.Image,
+				Owner:         owners[i],
+				Status:        string(env.Status),
+				CreatedAt:     env.CreatedAt,
+			})
+		}
+	}
+	if searchExecutions {
+		executions, err := o.db.SearchExecutions(ctx, filter, limit+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(executions) > limit {
+			executions, resp.Truncated = executions[:limit], true
+		}
+		for _, exec := range executions {
+			resp.Hits = append(resp.Hits, models.SearchHit{
+				Type:          models.SearchTypeExecution,
+				ID:            exec.ID,
+				EnvironmentID: exec.EnvironmentID,
+				MatchedFields: []string{"command"},
+				Command:       strings.Join(exec.Command, " "),
+				Status:        string(exec.Status),
+				CreatedAt:     exec.CreatedAt,
+			})
+		}
+	}
+	return resp, nil
+}
+
+// environmentMatches returns the fields of an environment holding the (lowercase) query
+func environmentMatches(env *models.Environment, owner, query string) []string {
+	contains := func(s string) bool { return strings.Contains(strings.ToLower(s), query) }
+	var fields []string
+	if strings.HasPrefix(strings.ToLower(env.ID), query) {
+		fields = append(fields, "id")
+	}
+	if contains(env.Name) {
+		fields = append(fields, "name")
+	}
+	if contains(env.Image) {
+		fields = append(fields, "image")
+	}
+	if mapContains(env.Labels, contains) {
+		fields = append(fields, "labels")
+	}
+	if mapContains(env.Metadata, contains) {
+		fields = append(fields, "metadata")
+	}
+	if contains(owner) {
+		fields = append(fields, "owner")
+	}
+	return fields
+}
+
+// mapContains reports whether a key or value of m matches
+func mapContains(m map[string]string, match func(string) bool) bool {
+	for k, v := range m {
+		if match(k) || match(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package orchestrator
+
+import (
+	"context"
+	"regexp"
+	"sort"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Service accounts ==========
+
+// checkServiceAccount fails with ValidationFailed when isolation requests a ServiceAccount while
+// kubernetes.service_accounts is disabled, or with an annotation that no
+// kubernetes.service_accounts.allowed_annotations entry allows
+func (o *Orchestrator) checkServiceAccount(isolation *models.IsolationConfig) error {
+	if isolation == nil || isolation.ServiceAccount == nil {
+		return nil
+	}
+	cfg := o.cfg().Kubernetes.ServiceAccounts
+	if !cfg.Enabled {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeServiceAccountNotAllowed,
+			"service accounts are disabled on this server")
+	}
+	keys := make([]string, 0, len(isolation.ServiceAccount.Annotations))
+	for key := range isolation.ServiceAccount.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !annotationAllowed(cfg.AllowedAnnotations, key, isolation.ServiceAccount.Annotations[key]) {
+			return apierrors.New(apierrors.ValidationFailed, apierrors.CodeServiceAccountNotAllowed,
+				"service account annotation %q is not allowed with value %q", key, isolation.ServiceAccount.Annotations[key])
+		}
+	}
+	return nil
+}
+
+// annotationAllowed reports whether an allowlist entry for key matches the whole value
+func annotationAllowed(allowed []config.AllowedAnnotation, key, value string) bool {
+	for _, a := range allowed {
+		if a.Key != key {
+			continue
+		}
+		// Patterns are validated when the config is loaded
+		re, err := regexp.Compile(`^(?:` + a.ValuePattern + `)$`)
+		if err == nil && re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceAccountName returns the ServiceAccount pods of the isolation run with (empty = the
+// namespace's default)
+func serviceAccountName(isolation *models.IsolationConfig) string {
+	if isolation == nil || isolation.ServiceAccount == nil {
+		return ""
+	}
+	return isolation.ServiceAccount.Name
+}
+
+// automountServiceAccountToken returns whether pods of the isolation mount their ServiceAccount's
+// token: only when the requested ServiceAccount asks for it. Pods without one keep the cluster's
+// behavior.
+func automountServiceAccountToken(isolation *models.IsolationConfig) *bool {
+	if isolation == nil || isolation.ServiceAccount == nil {
+		return nil
+	}
+	automount := isolation.ServiceAccount.AutomountToken
+	return &automount
+}
+
+// applyServiceAccount creates or updates the ServiceAccount the isolation requests in the
+// environment's namespace
+func (o *Orchestrator) applyServiceAccount(ctx context.Context, client k8s.ClientInterface, namespace string, isolation *models.IsolationConfig) error {
+	if isolation == nil || isolation.ServiceAccount == nil {
+		return nil
+	}
+	return client.ApplyServiceAccount(ctx, namespace, isolation.ServiceAccount.Name, isolation.ServiceAccount.Annotations)
+}
@@ -0,0 +1,450 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// ========== Workspace Snapshots ==========
+
+const (
+	// snapshotCheckInterval is how often the scheduler looks for environments due a snapshot
+	snapshotCheckInterval = time.Minute
+	// snapshotTimeout bounds one scheduled snapshot or automatic restore
+	snapshotTimeout = 10 * time.Minute
+	// maxSnapshotStderr is how much of tar's error output is kept for the error message
+	maxSnapshotStderr = 512
+)
+
+// errSnapshotTooLarge is returned while archiving a workspace larger than snapshots.max_bytes
+var errSnapshotTooLarge = errors.New("snapshot exceeds snapshots.max_bytes")
+
+// checkWorkspaceSnapshots rejects workspace snapshot settings this server cannot honour: snapshots
+// are indexed in the database and stored in the storage backend or snapshots.directory
+func (o *Orchestrator) checkWorkspaceSnapshots(spec *models.WorkspaceSnapshotConfig) error {
+	if spec.IsEmpty() {
+		return nil
+	}
+	if o.db == nil || o.snapshotStore() == nil {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeSnapshotsNotEnabled, "workspace snapshots are not available on this server")
+	}
+	return nil
+}
+
+// snapshotInterval returns how often an environment is snapshotted: its own interval, else
+// snapshots.default_interval_seconds, else an hour
+func (o *Orchestrator) snapshotInterval(spec *models.WorkspaceSnapshotConfig) time.Duration {
+	seconds := spec.IntervalSeconds
+	if seconds <= 0 {
+		seconds = o.cfg().Snapshots.DefaultIntervalSeconds
+	}
+	if seconds <= 0 {
+		seconds = 3600
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// snapshotKeep returns how many snapshots of an environment are kept: its own count, else
+// snapshots.default_keep, else 3
+func (o *Orchestrator) snapshotKeep(spec *models.WorkspaceSnapshotConfig) int {
+	if spec.Keep > 0 {
+		return spec.Keep
+	}
+	if keep := o.cfg().Snapshots.DefaultKeep; keep > 0 {
+		return keep
+	}
+	return 3
+}
+
+// SnapshotsPrefix is the key prefix of snapshot archives in the storage backend
+const SnapshotsPrefix = "snapshots/"
+
+// snapshotStore returns where snapshot archives are stored: the storage backend, else
+// snapshots.directory; nil when there is neither
+func (o *Orchestrator) snapshotStore() storage.Backend {
+	if o.storage != nil {
+		return storage.WithPrefix(o.storage, SnapshotsPrefix)
+	}
+	store, err := storage.NewLocal(o.cfg().Snapshots.Directory)
+	if err != nil {
+		return nil
+	}
+	return store
+}
+
+// snapshotKey returns the key of a snapshot's archive: <env>/<id>.tar
+func snapshotKey(envID, snapshotID string) string {
+	return envID + "/" + snapshotID + ".tar"
+}
+
+// snapshotEnvironment returns a copy of an environment that has workspace snapshots configured
+func (o *Orchestrator) snapshotEnvironment(envID string) (*models.Environment, error) {
+	o.envMutex.RLock()
+	env, exists := o.environments[envID]
+	var envCopy *models.Environment
+	if exists {
+		envCopy = env.DeepCopy()
+	}
+	o.envMutex.RUnlock()
+	if !exists {
+		return nil, errEnvironmentNotFound
+	}
+	if o.db == nil || o.snapshotStore() == nil {
+		return nil, apierrors.New(apierrors.Unavailable, apierrors.CodeSnapshotsNotEnabled, "workspace snapshots are not available on this server")
+	}
+	if envCopy.WorkspaceSnapshots.IsEmpty() {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeSnapshotsNotEnabled,
+			"environment has no workspace_snapshots path configured")
+	}
+	return envCopy, nil
+}
+
+// CreateSnapshot archives the configured workspace directory of a running environment's main
+// pod now (a manual snapshot). Older snapshots beyond the environment's keep count are deleted.
+func (o *Orchestrator) CreateSnapshot(ctx context.Context, envID string) (*models.WorkspaceSnapshot, error) {
+	env, err := o.snapshotEnvironment(envID)
+	if err != nil {
+		return nil, err
+	}
+	if env.Status != models.StatusRunning {
+		return nil, EnvironmentNotRunningError(env)
+	}
+	return o.takeSnapshot(ctx, env, models.SnapshotTriggerManual)
+}
+
+// ListSnapshots returns an environment's stored snapshots, newest first
+func (o *Orchestrator) ListSnapshots(ctx context.Context, envID string) ([]*models.WorkspaceSnapshot, error) {
+	if _, err := o.GetEnvironment(ctx, envID); err != nil {
+		return nil, err
+	}
+	if o.db == nil {
+		return []*models.WorkspaceSnapshot{}, nil
+	}
+	return o.db.ListWorkspaceSnapshots(ctx, envID)
+}
+
+// RestoreSnapshot extracts a stored snapshot into the running main pod, over the directory it was
+// taken of. Files created since the snapshot are left in place.
+func (o *Orchestrator) RestoreSnapshot(ctx context.Context, envID, snapshotID string) (*models.RestoreSnapshotResponse, error) {
+	env, err := o.snapshotEnvironment(envID)
+	if err != nil {
+		return nil, err
+	}
+	if env.Status != models.StatusRunning {
+		return nil, EnvironmentNotRunningError(env)
+	}
+	snap, err := o.db.GetWorkspaceSnapshot(ctx, envID, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	client, err := o.clientFor(env)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.restoreSnapshot(ctx, client, env, snap); err != nil {
+		return nil, err
+	}
+	return &models.RestoreSnapshotResponse{
+		EnvironmentID: envID,
+		SnapshotID:    snap.ID,
+		Path:          snap.Path,
+		SizeBytes:     snap.SizeBytes,
+	}, nil
+}
+
+// runSnapshotLoop periodically snapshots the environments that are due one
+func (o *Orchestrator) runSnapshotLoop() {
+	ticker := o.clock.NewTicker(snapshotCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.snapshotStopChan:
+			return
+		case <-ticker.C():
+			o.RunScheduledSnapshots(context.Background(), o.clock.Now())
+		}
+	}
+}
+
+// RunScheduledSnapshots runs one scheduler pass as of now: every running environment with
+// workspace snapshots whose newest snapshot (or start, when it has none) is at least its interval
+// old is snapshotted. Returns the IDs of the environments snapshotted successfully.
+func (o *Orchestrator) RunScheduledSnapshots(ctx context.Context, now time.Time) []string {
+	if o.db == nil || o.snapshotStore() == nil {
+		return nil
+	}
+
+	o.envMutex.RLock()
+	var candidates []*models.Environment
+	for _, env := range o.environments {
+		if env.Status == models.StatusRunning && !env.IsOneShot() && !env.WorkspaceSnapshots.IsEmpty() &&
+			o.clusters.Reachable(env.Cluster) {
+			candidates = append(candidates, env.DeepCopy())
+		}
+	}
+	o.envMutex.RUnlock()
+
+	var snapshotted []string
+	for _, env := range candidates {
+		last := env.CreatedAt
+		if env.StartedAt != nil {
+			last = *env.StartedAt
+		}
+		snapshots, err := o.db.ListWorkspaceSnapshots(ctx, env.ID)
+		if err != nil {
+			o.logger.Warn("failed to list workspace snapshots", zap.String("environment_id", env.ID), zap.Error(err))
+			continue
+		}
+		if len(snapshots) > 0 {
+			last = snapshots[0].CreatedAt
+		}
+		if now.Sub(last) < o.snapshotInterval(env.WorkspaceSnapshots) {
+			continue
+		}
+
+		snapCtx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+		_, err = o.takeSnapshot(snapCtx, env, models.SnapshotTriggerScheduled)
+		cancel()
+		if err == nil {
+			snapshotted = append(snapshotted, env.ID)
+		}
+	}
+	return snapshotted
+}
+
+// takeSnapshot archives the workspace directory of env's main pod into a new snapshot object,
+// indexes it and deletes the snapshots beyond the keep count. Failures are logged as
+// snapshot_failed events.
+func (o *Orchestrator) takeSnapshot(ctx context.Context, env *models.Environment, trigger string) (*models.WorkspaceSnapshot, error) {
+	spec := env.WorkspaceSnapshots
+	snap := &models.WorkspaceSnapshot{
+		ID:            uuid.New().String(),
+		EnvironmentID: env.ID,
+		Path:          spec.Path,
+		Trigger:       trigger,
+	}
+
+	store := o.snapshotStore()
+	size, err := o.archiveWorkspace(ctx, env, spec.Path, store, snapshotKey(env.ID, snap.ID))
+	if err != nil {
+		o.logReconciliationEvent(env.ID, "snapshot_failed", "Workspace snapshot failed", err.Error())
+		o.logger.Warn("workspace snapshot failed",
+			zap.String("environment_id", env.ID),
+			zap.String("trigger", trigger),
+			zap.Error(err),
+		)
+		if errors.Is(err, errSnapshotTooLarge) {
+			return nil, apierrors.Wrap(apierrors.PayloadTooLarge, apierrors.CodeSnapshotTooLarge, err,
+				"workspace %s is larger than %d bytes", spec.Path, o.cfg().Snapshots.MaxBytes)
+		}
+		return nil, err
+	}
+	snap.SizeBytes = size
+	snap.CreatedAt = o.clock.Now().UTC()
+
+	if err := o.db.SaveWorkspaceSnapshot(ctx, snap); err != nil {
+		//nolint:errcheck // Best effort; the snapshot is not indexed
+		store.Delete(context.WithoutCancel(ctx), snapshotKey(env.ID, snap.ID))
+		return nil, err
+	}
+	o.logReconciliationEvent(env.ID, "snapshot_created", "Workspace snapshot created",
+		fmt.Sprintf("%s snapshot %s of %s (%d bytes)", trigger, snap.ID, snap.Path, size))
+	o.logger.Info("workspace snapshot created",
+		zap.String("environment_id", env.ID),
+		zap.String("snapshot_id", snap.ID),
+		zap.String("trigger", trigger),
+		zap.Int64("size_bytes", size),
+	)
+
+	o.pruneSnapshots(ctx, env.ID, o.snapshotKeep(spec))
+	return snap, nil
+}
+
+// archiveWorkspace streams a tar archive of dir in env's main pod into the object key of store,
+// stopping at snapshots.max_bytes. Returns the archive size; a failed archive leaves no object.
+func (o *Orchestrator) archiveWorkspace(ctx context.Context, env *models.Environment, dir string, store storage.Backend, key string) (int64, error) {
+	client, err := o.clientFor(env)
+	if err != nil {
+		return 0, err
+	}
+
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := store.Put(ctx, key, pr, "application/x-tar")
+		// Fails the writes to the pipe when Put gave up before the end of the archive
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	out := &cappedWriter{w: pw, limit: o.cfg().Snapshots.MaxBytes}
+	if out.limit <= 0 {
+		out.limit = 1 << 30
+	}
+	var stderr bytes.Buffer
+	cmd := []string{"tar", "-cf", "-", "-C", dir, "."}
+	execErr := client.ExecInPod(ctx, env.Namespace, "main", cmd, nil, out, &stderr)
+	switch {
+	case out.exceeded:
+		pw.CloseWithError(errSnapshotTooLarge)
+	case execErr != nil:
+		pw.CloseWithError(execErr)
+	default:
+		pw.Close()
+	}
+	putErr := <-uploaded
+
+	if out.exceeded {
+		return 0, errSnapshotTooLarge
+	}
+	if execErr != nil {
+		return 0, fmt.Errorf("failed to archive %s: %w%s", dir, execErr, stderrSuffix(&stderr))
+	}
+	if putErr != nil {
+		return 0, fmt.Errorf("failed to store snapshot: %w", putErr)
+	}
+	return out.written, nil
+}
+
+// restoreSnapshot extracts a snapshot into env's main pod, logging a snapshot_restored or
+// snapshot_restore_failed event
+func (o *Orchestrator) restoreSnapshot(ctx context.Context, client k8s.ClientInterface, env *models.Environment, snap *models.WorkspaceSnapshot) error {
+	err := o.extractSnapshot(ctx, client, env, snap)
+	if err != nil {
+		o.logReconciliationEvent(env.ID, "snapshot_restore_failed", "Workspace snapshot restore failed",
+			fmt.Sprintf("snapshot %s: %v", snap.ID, err))
+		o.logger.Warn("workspace snapshot restore failed",
+			zap.String("environment_id", env.ID),
+			zap.String("snapshot_id", snap.ID),
+			zap.Error(err),
+		)
+		return err
+	}
+	o.logReconciliationEvent(env.ID, "snapshot_restored", "Workspace snapshot restored",
+		fmt.Sprintf("snapshot %s of %s (%d bytes) taken %s", snap.ID, snap.Path, snap.SizeBytes, snap.CreatedAt.Format(time.RFC3339)))
+	o.logger.Info("workspace snapshot restored",
+		zap.String("environment_id", env.ID),
+		zap.String("snapshot_id", snap.ID),
+	)
+	return nil
+}
+
+// extractSnapshot streams a snapshot archive into tar in env's main pod
+func (o *Orchestrator) extractSnapshot(ctx context.Context, client k8s.ClientInterface, env *models.Environment, snap *models.WorkspaceSnapshot) error {
+	store := o.snapshotStore()
+	if store == nil {
+		return apierrors.New(apierrors.Unavailable, apierrors.CodeSnapshotsNotEnabled, "workspace snapshots are not available on this server")
+	}
+	f, err := store.Get(ctx, snapshotKey(env.ID, snap.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot archive: %w", err)
+	}
+	defer f.Close()
+
+	var stderr bytes.Buffer
+	cmd := []string{"/bin/sh", "-c", `mkdir -p "$0" && tar -xf - -C "$0"`, snap.Path}
+	if err := client.ExecInPod(ctx, env.Namespace, "main", cmd, f, io.Discard, &stderr); err != nil {
+		return fmt.Errorf("failed to extract into %s: %w%s", snap.Path, err, stderrSuffix(&stderr))
+	}
+	return nil
+}
+
+// restoreLatestSnapshot restores the newest snapshot of an environment into its recreated main
+// pod. A failed restore is logged and the pod is used anyway, with the image's workspace.
+func (o *Orchestrator) restoreLatestSnapshot(ctx context.Context, client k8s.ClientInterface, env *models.Environment) {
+	o.envMutex.RLock()
+	enabled := !env.WorkspaceSnapshots.IsEmpty()
+	o.envMutex.RUnlock()
+	if !enabled || o.db == nil || o.snapshotStore() == nil {
+		return
+	}
+	snapshots, err := o.db.ListWorkspaceSnapshots(ctx, env.ID)
+	if err != nil {
+		o.logger.Warn("failed to list workspace snapshots", zap.String("environment_id", env.ID), zap.Error(err))
+		return
+	}
+	if len(snapshots) == 0 {
+		return
+	}
+	restoreCtx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	//nolint:errcheck // Logged as a snapshot_restore_failed event
+	o.restoreSnapshot(restoreCtx, client, env, snapshots[0])
+}
+
+// pruneSnapshots deletes an environment's snapshots beyond the newest keep
+func (o *Orchestrator) pruneSnapshots(ctx context.Context, envID string, keep int) {
+	store := o.snapshotStore()
+	snapshots, err := o.db.ListWorkspaceSnapshots(ctx, envID)
+	if err != nil {
+		o.logger.Warn("failed to list workspace snapshots", zap.String("environment_id", envID), zap.Error(err))
+		return
+	}
+	for i := keep; i < len(snapshots); i++ {
+		if err := o.db.DeleteWorkspaceSnapshot(ctx, snapshots[i].ID); err != nil {
+			o.logger.Warn("failed to delete workspace snapshot", zap.String("snapshot_id", snapshots[i].ID), zap.Error(err))
+			continue
+		}
+		if err := store.Delete(ctx, snapshotKey(envID, snapshots[i].ID)); err != nil {
+			o.logger.Warn("failed to delete snapshot archive", zap.String("snapshot_id", snapshots[i].ID), zap.Error(err))
+		}
+	}
+}
+
+// deleteSnapshots removes all snapshots of a deleted environment (best effort)
+func (o *Orchestrator) deleteSnapshots(ctx context.Context, envID string) {
+	store := o.snapshotStore()
+	if o.db == nil || store == nil {
+		return
+	}
+	if err := o.db.DeleteWorkspaceSnapshots(ctx, envID); err != nil {
+		o.logger.Warn("failed to delete workspace snapshots", zap.String("environment_id", envID), zap.Error(err))
+	}
+	if err := storage.DeletePrefix(ctx, store, envID+"/"); err != nil {
+		o.logger.Warn("failed to delete snapshot archives", zap.String("environment_id", envID), zap.Error(err))
+	}
+}
+
+// cappedWriter writes up to limit bytes, then fails every write
+type cappedWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if c.written+int64(len(p)) > c.limit {
+		c.exceeded = true
+		return 0, errSnapshotTooLarge
+	}
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// stderrSuffix formats the start of a command's error output for an error message
+func stderrSuffix(stderr *bytes.Buffer) string {
+	msg := strings.TrimSpace(stderr.String())
+	if msg == "" {
+		return ""
+	}
+	if len(msg) > maxSnapshotStderr {
+		msg = msg[:maxSnapshotStderr] + "..."
+	}
+	return ": " + msg
+}
@@ -0,0 +1,116 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Events and Soft Timeouts ==========
+
+// softTimeoutSignalTimeout bounds sending the soft timeout signal into the pod
+const softTimeoutSignalTimeout = 15 * time.Second
+
+// addExecutionEvent appends an event that happened at to an execution's record; callers hold
+// execMutex and save the record
+func addExecutionEvent(exec *models.Execution, at time.Time, eventType, message string) {
+	exec.Events = append(exec.Events, models.ExecutionEvent{Type: eventType, At: at, Message: message})
+}
+
+// signalChildrenScript sends the signal $1 to the children of the PID in the file $0: the command
+// run by killable, not its wrapping shell
+const signalChildrenScript = `pid=$(cat "$0" 2>/dev/null) || exit 1
+for s in /proc/[0-9]*/stat; do
+  read -r p c st pp rest < "$s" 2>/dev/null && [ "$pp" = "$pid" ] && kill -s "$1" "$p" 2>/dev/null
+done
+exit 0`
+
+// scheduleSoftTimeout arranges for a started execution's command to be sent the configured soft
+// timeout signal once soft_timeout_percent of its timeout has passed (counted from submission, like
+// the timeout itself), so it can checkpoint before it is killed at deadline. It returns a function
+// that cancels the warning; call it when the execution is over so fast ones are never signaled.
+// Returns nil when there is nothing to schedule: the warning is disabled, skipped by the request,
+// or already due.
+func (o *Orchestrator) scheduleSoftTimeout(execID string, env *models.Environment, req *EphemeralExecRequest, timeout int, deadline time.Time) func() {
+	cfg := o.cfg().Executions
+	if cfg.SoftTimeoutPercent <= 0 || req.SkipSoftTimeout {
+		return nil
+	}
+	// The warning leaves the command the rest of the timeout to checkpoint
+	grace := time.Duration(timeout) * time.Second * time.Duration(100-cfg.SoftTimeoutPercent) / 100
+	delay := time.Until(deadline.Add(-grace))
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.AfterFunc(delay, func() { o.sendSoftTimeout(execID, env, cfg.SoftTimeoutSignal, grace) })
+	return func() { timer.Stop() }
+}
+
+// sendSoftTimeout signals a running execution's command that its timeout is near and records the
+// soft_timeout_warned event. Commands in their own pod run as PID 1 and get the signal there; in
+// standby and main pods it goes to the command started by killable.
+func (o *Orchestrator) sendSoftTimeout(execID string, env *models.Environment, signal string, grace time.Duration) {
+	o.execMutex.RLock()
+	exec, exists := o.executions[execID]
+	var mode, namespace, podName string
+	if exists && exec.Status == models.ExecutionStatusRunning {
+		mode, namespace, podName = exec.Mode, exec.Namespace, exec.PodName
+	}
+	o.execMutex.RUnlock()
+	// Not started in a pod yet, or already over
+	if mode == "" || podName == "" {
+		return
+	}
+	if namespace == "" || mode == models.ExecutionModeMainFallback {
+		namespace = env.Namespace
+	}
+
+	client, err := o.clientFor(env)
+	if err != nil {
+		o.logger.Warn("failed to send soft timeout signal", zap.String("exec_id", execID), zap.Error(err))
+		return
+	}
+	command := []string{"/bin/sh", "-c", `kill -s "$0" 1`, signal}
+	if mode != models.ExecutionModeEphemeral {
+		command = []string{"/bin/sh", "-c", signalChildrenScript, execPIDFile(execID), signal}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), softTimeoutSignalTimeout)
+	defer cancel()
+	if err := client.ExecInPod(ctx, namespace, podName, command, nil, io.Discard, io.Discard); err != nil {
+		o.logger.Warn("failed to send soft timeout signal",
+			zap.String("exec_id", execID),
+			zap.String("pod", podName),
+			zap.Error(err),
+		)
+		return
+	}
+
+	o.execMutex.Lock()
+	exec, exists = o.executions[execID]
+	if exists && exec.Status == models.ExecutionStatusRunning {
+		addExecutionEvent(exec, o.clock.Now(), models.ExecutionEventSoftTimeoutWarned,
+			fmt.Sprintf("sent SIG%s; the command is killed in %s", signal, grace.Round(time.Second)))
+		exec = exec.DeepCopy()
+	} else {
+		exists = false
+	}
+	o.execMutex.Unlock()
+	if !exists {
+		return
+	}
+	o.logger.Info("sent soft timeout signal",
+		zap.String("exec_id", execID),
+		zap.String("pod", podName),
+		zap.String("signal", signal),
+	)
+	if o.db != nil {
+		if err := o.db.SaveExecution(context.Background(), exec); err != nil {
+			o.logger.Error("failed to save soft timeout event", zap.Error(err), zap.String("execution_id", execID))
+		}
+	}
+}
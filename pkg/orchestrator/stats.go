@@ -0,0 +1,238 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ========== Execution Statistics ==========
+
+// executionStatsCacheTTL is how long computed statistics are served from cache
+const executionStatsCacheTTL = 30 * time.Second
+
+// executionStatsSampleSize bounds the number of recent durations used for percentiles
+const executionStatsSampleSize = 1000
+
+// executionStatsCacheEntry is a cached statistics result
+type executionStatsCacheEntry struct {
+	stats     *models.ExecutionStats
+	expiresAt time.Time
+}
+
+// GetExecutionStats returns execution statistics for an environment, optionally limited to
+// executions created in [from, to). Results are cached for executionStatsCacheTTL; the shipping
+// of the environment's log is always reported as it is now.
+func (o *Orchestrator) GetExecutionStats(ctx context.Context, envID string, from, to *time.Time) (*models.ExecutionStats, error) {
+	if _, err := o.GetEnvironment(ctx, envID); err != nil {
+		return nil, err
+	}
+
+	key := executionStatsCacheKey(envID, from, to)
+	now := o.clock.Now()
+
+	o.statsCacheMutex.Lock()
+	if entry, ok := o.statsCache[key]; ok && now.Before(entry.expiresAt) {
+		o.statsCacheMutex.Unlock()
+		statsCopy := *entry.stats
+		statsCopy.LogShipping = o.logShippingStats(envID)
+		return &statsCopy, nil
+	}
+	o.statsCacheMutex.Unlock()
+
+	var stats *models.ExecutionStats
+	var durations []int64
+	var timings *database.ExecutionTimings
+	if o.db != nil {
+		filter := database.ExecutionStatsFilter{
+			EnvironmentID: envID,
+			From:          from,
+			To:            to,
+			SampleLimit:   executionStatsSampleSize,
+		}
+		var err error
+		stats, durations, err = o.db.GetExecutionStats(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get execution stats: %w", err)
+		}
+		timings, err = o.db.GetExecutionTimings(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get execution stats: %w", err)
+		}
+	} else {
+		stats, durations, timings = o.executionStatsFromMemory(envID, from, to)
+	}
+
+	finalizeExecutionStats(stats, durations, timings)
+	stats.From = from
+	stats.To = to
+	stats.GeneratedAt = now
+
+	o.statsCacheMutex.Lock()
+	for k, entry := range o.statsCache {
+		if now.After(entry.expiresAt) {
+			delete(o.statsCache, k)
+		}
+	}
+	o.statsCache[key] = &executionStatsCacheEntry{stats: stats, expiresAt: now.Add(executionStatsCacheTTL)}
+	o.statsCacheMutex.Unlock()
+
+	statsCopy := *stats
+	statsCopy.LogShipping = o.logShippingStats(envID)
+	return &statsCopy, nil
+}
+
+// executionStatsFromMemory aggregates in-memory executions (used when no database is configured)
+func (o *Orchestrator) executionStatsFromMemory(envID string, from, to *time.Time) (*models.ExecutionStats, []int64, *database.ExecutionTimings) {
+	stats := &models.ExecutionStats{
+		EnvironmentID: envID,
+		ByStatus:      make(map[string]int),
+		ByMode:        make(map[string]int),
+	}
+
+	o.execMutex.RLock()
+	defer o.execMutex.RUnlock()
+
+	var matched []*models.Execution
+	var totalDurationMs int64
+	for _, exec := range o.executions {
+		if exec.EnvironmentID != envID {
+			continue
+		}
+		if from != nil && exec.CreatedAt.Before(*from) {
+			continue
+		}
+		if to != nil && !exec.CreatedAt.Before(*to) {
+			continue
+		}
+		matched = append(matched, exec)
+		stats.Total++
+		stats.ByStatus[string(exec.Status)]++
+		if exec.StartedAt != nil {
+			stats.Started++
+		}
+		if exec.ServedFromPool {
+			stats.PoolHits++
+		}
+		if exec.CacheEnabled {
+			stats.CacheLookups++
+		}
+		if exec.Cached {
+			stats.CacheHits++
+		}
+		if exec.Mode != "" {
+			stats.ByMode[exec.Mode]++
+		}
+		if exec.DurationMs != nil {
+			totalDurationMs += *exec.DurationMs
+		}
+		if stats.LastExecutionAt == nil || exec.CreatedAt.After(*stats.LastExecutionAt) {
+			createdAt := exec.CreatedAt
+			stats.LastExecutionAt = &createdAt
+		}
+	}
+	stats.TotalExecSeconds = float64(totalDurationMs) / 1000
+
+	// Most recent first, same sample as the database path
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+	var durations []int64
+	for _, exec := range matched {
+		if exec.DurationMs == nil {
+			continue
+		}
+		durations = append(durations, *exec.DurationMs)
+		if len(durations) >= executionStatsSampleSize {
+			break
+		}
+	}
+	stats.MainFallbacks = stats.ByMode[models.ExecutionModeMainFallback]
+
+	timings := &database.ExecutionTimings{}
+	for _, exec := range matched {
+		if exec.StartedAt == nil {
+			continue
+		}
+		timings.QueueMs = append(timings.QueueMs, nonNegativeMs(exec.StartedAt.Sub(exec.CreatedAt)))
+		if exec.PodStartedAt != nil {
+			timings.PodStartupMs = append(timings.PodStartupMs, nonNegativeMs(exec.PodStartedAt.Sub(*exec.StartedAt)))
+		}
+		if len(timings.QueueMs) >= executionStatsSampleSize {
+			break
+		}
+	}
+
+	return stats, durations, timings
+}
+
+// nonNegativeMs converts d to milliseconds, clamping clock skew to 0
+func nonNegativeMs(d time.Duration) int64 {
+	if d < 0 {
+		return 0
+	}
+	return d.Milliseconds()
+}
+
+// finalizeExecutionStats fills in rates and duration, queue and pod startup percentiles
+func finalizeExecutionStats(stats *models.ExecutionStats, durations []int64, timings *database.ExecutionTimings) {
+	completed := stats.ByStatus[string(models.ExecutionStatusCompleted)]
+	failed := stats.ByStatus[string(models.ExecutionStatusFailed)]
+	if completed+failed > 0 {
+		stats.FailureRate = float64(failed) / float64(completed+failed)
+	}
+	if stats.Started > 0 {
+		stats.PoolHitRate = float64(stats.PoolHits) / float64(stats.Started)
+	}
+	if stats.CacheLookups > 0 {
+		stats.CacheHitRate = float64(stats.CacheHits) / float64(stats.CacheLookups)
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	stats.DurationSampleSize = len(durations)
+	stats.DurationP50Ms = percentile(durations, 50)
+	stats.DurationP95Ms = percentile(durations, 95)
+
+	queue := sortedCopy(timings.QueueMs)
+	podStartup := sortedCopy(timings.PodStartupMs)
+	stats.TimingSampleSize = len(queue)
+	stats.QueueP50Ms = percentile(queue, 50)
+	stats.QueueP95Ms = percentile(queue, 95)
+	stats.PodStartupP50Ms = percentile(podStartup, 50)
+	stats.PodStartupP95Ms = percentile(podStartup, 95)
+}
+
+// sortedCopy returns values sorted ascending
+func sortedCopy(values []int64) []int64 {
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the nearest-rank percentile of sorted values (0 when empty)
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// executionStatsCacheKey builds the cache key for an environment and time range
+func executionStatsCacheKey(envID string, from, to *time.Time) string {
+	key := envID
+	for _, t := range []*time.Time{from, to} {
+		key += "|"
+		if t != nil {
+			key += t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return key
+}
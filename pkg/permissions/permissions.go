@@ -10,6 +10,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/roles"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
@@ -162,6 +163,11 @@ func (s *Service) GrantPermission(ctx context.Context, userID, environmentID, pe
 		zap.String("environment_id", environmentID),
 		zap.String("permission", permission),
 	)
+	// Shown in the environment's activity feed
+	if _, err := s.db.SaveEnvironmentEventBy(ctx, environmentID, grantedByUserID, "permission_granted",
+		fmt.Sprintf("Permission %s granted to user %s", permission, userID), ""); err != nil {
+		s.logger.Warn("failed to save permission event", zap.String("environment_id", environmentID), zap.Error(err))
+	}
 
 	return s.GetUserPermission(ctx, userID, environmentID)
 }
@@ -228,10 +234,12 @@ func (s *Service) RevokePermission(ctx context.Context, userID, environmentID st
 
 // CheckAccess verifies if a user has at least the required permission level for an environment
 // Returns true if the user has access, false otherwise
-// Super admins always have access
+// Roles with environments.write_all have any access, roles with environments.read_all viewer access
 func (s *Service) CheckAccess(ctx context.Context, user *users.User, environmentID string, requiredPermission string) (bool, error) {
-	// Super admins have access to everything
-	if user.Role == users.RoleSuperAdmin {
+	if roles.Has(ctx, user, roles.CapEnvironmentsWriteAll) {
+		return true, nil
+	}
+	if requiredPermission == PermissionViewer && roles.Has(ctx, user, roles.CapEnvironmentsReadAll) {
 		return true, nil
 	}
 
@@ -240,15 +248,64 @@ func (s *Service) CheckAccess(ctx context.Context, user *users.User, environment
 		return false, err
 	}
 
-	if perm == nil {
-		return false, nil
+	userLevel := 0
+	if perm != nil {
+		userLevel = PermissionLevel(perm.Permission)
+	}
+
+	// Team membership grants the member's team role on every environment of the team
+	teamRole, err := s.getTeamRoleForEnvironment(ctx, user.ID, environmentID)
+	if err != nil {
+		return false, err
+	}
+	if teamLevel := PermissionLevel(teamRole); teamLevel > userLevel {
+		userLevel = teamLevel
 	}
 
 	// Check if user's permission level is >= required level
-	userLevel := PermissionLevel(perm.Permission)
 	requiredLevel := PermissionLevel(requiredPermission)
 
-	return userLevel >= requiredLevel, nil
+	return userLevel > 0 && userLevel >= requiredLevel, nil
+}
+
+// CheckTeamAccess verifies if a user has at least the required role in a team
+// Roles with environments.write_all always have access
+func (s *Service) CheckTeamAccess(ctx context.Context, user *users.User, teamID string, requiredPermission string) (bool, error) {
+	if roles.Has(ctx, user, roles.CapEnvironmentsWriteAll) {
+		return true, nil
+	}
+
+	var role string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT role FROM team_members
+		WHERE team_id = $1 AND user_id = $2
+	`, teamID, user.ID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get team membership: %w", err)
+	}
+
+	return PermissionLevel(role) >= PermissionLevel(requiredPermission), nil
+}
+
+// getTeamRoleForEnvironment returns the user's role in the team owning the environment ("" if none)
+func (s *Service) getTeamRoleForEnvironment(ctx context.Context, userID, environmentID string) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT m.role
+		FROM team_members m
+		JOIN environments e ON e.team_id = m.team_id
+		WHERE e.id = $1 AND m.user_id = $2
+	`, environmentID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get team role: %w", err)
+	}
+	return role, nil
 }
 
 // ListEnvironmentPermissions returns all permissions for an environment
@@ -437,3 +494,13 @@ func (s *Service) CheckAPIKeyAccess(ctx context.Context, apiKeyID, environmentID
 
 	return keyLevel >= requiredLevel, nil
 }
+
+// CheckScopedAccess verifies that a request limited to scopeEnvironmentID with scopePermission
+// (an environment token) may act on environmentID with the required permission. Like an API key
+// permission, the scope only narrows what its user can do; it never grants access the user lacks.
+func CheckScopedAccess(scopeEnvironmentID, scopePermission, environmentID, requiredPermission string) bool {
+	if scopeEnvironmentID != environmentID {
+		return false
+	}
+	return PermissionLevel(scopePermission) >= PermissionLevel(requiredPermission)
+}
@@ -0,0 +1,123 @@
+// Package preferences stores user preferences and resolves the preferences in effect for a user:
+// the user's own settings, then the organization defaults admins manage through the API, then
+// the preferences section of the server configuration.
+package preferences
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// AuditActionDefaultsUpdated is the audit log action of a change to the organization defaults
+const AuditActionDefaultsUpdated = "preferences.defaults_updated"
+
+// Service reads and writes user preferences and the organization defaults
+type Service struct {
+	db     *database.DB
+	cfg    atomic.Pointer[config.Config]
+	logger *zap.Logger
+}
+
+// NewService creates a preferences service; cfg supplies the resource profiles and the
+// configured defaults (see UpdateConfig)
+func NewService(db *database.DB, cfg *config.Config, logger *zap.Logger) *Service {
+	s := &Service{db: db, logger: logger}
+	s.cfg.Store(cfg)
+	return s
+}
+
+// UpdateConfig applies a reloaded configuration (resource profiles and preference defaults)
+func (s *Service) UpdateConfig(cfg *config.Config) {
+	s.cfg.Store(cfg)
+}
+
+// ConfigDefaults returns the preferences of the server configuration, the last fallback of
+// unset preferences
+func ConfigDefaults(cfg config.PreferencesConfig) models.EffectivePreferences {
+	return models.EffectivePreferences{
+		DefaultProfile:            cfg.DefaultProfile,
+		NotifyOnEnvironmentFailed: cfg.NotifyOnEnvironmentFailed,
+		NotifyOnExecutionFailed:   cfg.NotifyOnExecutionFailed,
+		EmailCriticalAlerts:       cfg.EmailCriticalAlerts,
+		Timezone:                  cfg.Timezone,
+	}
+}
+
+// Profiles returns the configured resource profiles
+func (s *Service) Profiles() map[string]config.ResourceProfileConfig {
+	return s.cfg.Load().Resources.Profiles
+}
+
+// Profile returns the resources of a configured resource profile
+func (s *Service) Profile(name string) (models.ResourceSpec, bool) {
+	p, ok := s.Profiles()[name]
+	if !ok {
+		return models.ResourceSpec{}, false
+	}
+	return models.ResourceSpec{CPU: p.CPU, Memory: p.Memory, Storage: p.Storage}, true
+}
+
+// Get returns a user's preferences and the preferences in effect for them
+func (s *Service) Get(ctx context.Context, userID string) (*models.PreferencesResponse, error) {
+	prefs, err := s.db.GetUserPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := s.Defaults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &models.PreferencesResponse{Preferences: *prefs, Effective: prefs.Apply(defaults.Effective)}, nil
+}
+
+// Set replaces a user's preferences (validate them with validator.ValidateUserPreferences first);
+// nil fields fall back to the organization defaults
+func (s *Service) Set(ctx context.Context, userID string, prefs *models.UserPreferences) (*models.PreferencesResponse, error) {
+	if err := s.db.SaveUserPreferences(ctx, userID, prefs); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, userID)
+}
+
+// Effective returns the preferences in effect for a user
+func (s *Service) Effective(ctx context.Context, userID string) (models.EffectivePreferences, error) {
+	resp, err := s.Get(ctx, userID)
+	if err != nil {
+		return models.EffectivePreferences{}, err
+	}
+	return resp.Effective, nil
+}
+
+// Defaults returns the organization defaults and the defaults in effect (with the configured
+// defaults applied to the unset ones)
+func (s *Service) Defaults(ctx context.Context) (*models.PreferencesResponse, error) {
+	prefs, err := s.db.GetOrgPreferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configured := ConfigDefaults(s.cfg.Load().Preferences)
+	return &models.PreferencesResponse{Preferences: *prefs, Effective: prefs.Apply(configured)}, nil
+}
+
+// SetDefaults replaces the organization defaults (validate them with
+// validator.ValidateUserPreferences first); nil fields fall back to the configured defaults
+func (s *Service) SetDefaults(ctx context.Context, prefs *models.UserPreferences, actorID string) (*models.PreferencesResponse, error) {
+	if err := s.db.SaveOrgPreferences(ctx, prefs); err != nil {
+		return nil, err
+	}
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       AuditActionDefaultsUpdated,
+		ActorID:      actorID,
+		ResourceType: "preferences",
+		Message:      "organization preference defaults updated",
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry", zap.String("action", AuditActionDefaultsUpdated), zap.Error(err))
+	}
+	return s.Defaults(ctx)
+}
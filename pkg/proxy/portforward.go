@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/k8s"
+)
+
+// ErrPortForwardLimit is returned when an environment already has the maximum number of
+// forwarded connections
+var ErrPortForwardLimit = errors.New("too many port forwards to this environment")
+
+// PortForwarder bridges WebSocket connections to pod ports. Each WebSocket carries one TCP
+// connection: binary messages hold the bytes sent in either direction, and closing the WebSocket
+// closes the connection (a close frame with a reason reports why the server ended it).
+type PortForwarder struct {
+	logger   *logger.Logger
+	upgrader websocket.Upgrader
+	cfg      atomic.Pointer[config.PortForwardConfig]
+	mu       sync.Mutex
+	active   map[string]int // environment ID -> forwarded connections
+}
+
+// NewPortForwarder creates a port forwarder enforcing cfg (see UpdateConfig)
+func NewPortForwarder(log *logger.Logger, allowedOrigins []string, cfg config.PortForwardConfig) *PortForwarder {
+	f := &PortForwarder{
+		logger:   log,
+		upgrader: NewUpgrader(allowedOrigins),
+		active:   make(map[string]int),
+	}
+	// Raw bytes do not compress well enough to be worth it
+	f.upgrader.EnableCompression = false
+	f.cfg.Store(&cfg)
+	return f
+}
+
+// UpdateConfig applies reloaded port forwarding limits to new connections
+func (f *PortForwarder) UpdateConfig(cfg config.PortForwardConfig) {
+	f.cfg.Store(&cfg)
+}
+
+// PortAllowed reports whether a pod port may be forwarded
+func (f *PortForwarder) PortAllowed(port int) bool {
+	return f.cfg.Load().AllowsPort(port)
+}
+
+// AllowedPorts returns the ports that may be forwarded, as configured
+func (f *PortForwarder) AllowedPorts() []string {
+	return f.cfg.Load().AllowedPorts
+}
+
+// Active returns the number of connections forwarded to an environment
+func (f *PortForwarder) Active(envID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active[envID]
+}
+
+// acquire reserves one of an environment's forwarded connections
+func (f *PortForwarder) acquire(envID string) (release func(), err error) {
+	limit := f.cfg.Load().MaxPerEnvironment
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active[envID] >= limit {
+		return nil, fmt.Errorf("%w (%d)", ErrPortForwardLimit, limit)
+	}
+	f.active[envID]++
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.active[envID]--; f.active[envID] <= 0 {
+			delete(f.active, envID)
+		}
+	}, nil
+}
+
+// HandlePortForward upgrades the request to a WebSocket and forwards it to port of the pod until
+// either side closes the connection or it sits idle for the configured idle timeout (closed with
+// the reason "idle timeout"). It returns ErrPortForwardLimit, before upgrading, when the
+// environment has too many forwarded connections; other errors before the upgrade have already
+// been answered.
+func (f *PortForwarder) HandlePortForward(
+	w http.ResponseWriter, r *http.Request, client k8s.ClientInterface, envID, namespace, podName string, port int,
+) error {
+	release, err := f.acquire(envID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade connection: %w", err)
+	}
+	stream := newWSStream(conn)
+	defer stream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client closing the WebSocket ends the forward
+	stream.onClose = cancel
+	if idle := time.Duration(f.cfg.Load().IdleTimeoutSeconds) * time.Second; idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			stream.closeWith(websocket.CloseNormalClosure, "idle timeout")
+			cancel()
+		})
+		defer timer.Stop()
+		stream.onActivity = func() { timer.Reset(idle) }
+	}
+
+	fields := []zap.Field{zap.String("environment_id", envID), zap.Int("port", port)}
+	f.logger.Info("port forward started", fields...)
+	err = client.PortForward(ctx, namespace, podName, port, stream)
+	// Errors after the client left or the connection idled out are only the fallout
+	if err != nil && ctx.Err() == nil {
+		f.logger.Warn("port forward failed", append(fields, zap.Error(err))...)
+		stream.closeWith(websocket.CloseInternalServerErr, err.Error())
+	}
+	f.logger.Info("port forward ended", fields...)
+	return nil
+}
+
+// wsStream adapts a WebSocket carrying a forwarded connection (binary messages) to a byte
+// stream. It is a net.Conn so clients can use it in place of a TCP connection.
+type wsStream struct {
+	conn    *websocket.Conn
+	reader  io.Reader
+	writeMu sync.Mutex
+
+	// onActivity is called whenever bytes pass in either direction (optional)
+	onActivity func()
+	// onClose is called once when the peer closes the WebSocket or it fails (optional)
+	onClose func()
+
+	closeOnce sync.Once
+}
+
+var _ net.Conn = (*wsStream)(nil)
+
+func newWSStream(conn *websocket.Conn) *wsStream {
+	return &wsStream{conn: conn}
+}
+
+// Read reads the bytes of the next binary messages until the WebSocket is closed (see readFailed)
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.reader == nil {
+			msgType, reader, err := s.conn.NextReader()
+			if err != nil {
+				return 0, s.readFailed(err)
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			s.reader = reader
+		}
+		n, err := s.reader.Read(p)
+		if err == io.EOF {
+			s.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		if n > 0 {
+			s.activity()
+		}
+		return n, err
+	}
+}
+
+// readFailed reports the end of the WebSocket: a close with a reason becomes an error with that
+// reason, and a normal close without one io.EOF
+func (s *wsStream) readFailed(err error) error {
+	if s.onClose != nil {
+		s.onClose()
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		if closeErr.Text != "" {
+			return errors.New(closeErr.Text)
+		}
+		if closeErr.Code == websocket.CloseNormalClosure || closeErr.Code == websocket.CloseGoingAway {
+			return io.EOF
+		}
+	}
+	return err
+}
+
+// Write sends p as one binary message
+func (s *wsStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	s.activity()
+	return len(p), nil
+}
+
+func (s *wsStream) activity() {
+	if s.onActivity != nil {
+		s.onActivity()
+	}
+}
+
+// closeWith sends a close frame with code and reason (best effort) and closes the connection
+func (s *wsStream) closeWith(code int, reason string) {
+	s.closeOnce.Do(func() {
+		// Close frame payloads are limited to 125 bytes, two of them the code
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		//nolint:errcheck // Best effort close message, connection will be closed anyway
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		s.conn.Close()
+	})
+}
+
+// Close closes the WebSocket normally
+func (s *wsStream) Close() error {
+	s.closeWith(websocket.CloseNormalClosure, "")
+	return nil
+}
+
+func (s *wsStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *wsStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *wsStream) SetDeadline(t time.Time) error {
+	if err := s.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *wsStream) SetReadDeadline(t time.Time) error  { return s.conn.SetReadDeadline(t) }
+func (s *wsStream) SetWriteDeadline(t time.Time) error { return s.conn.SetWriteDeadline(t) }
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// PortForwardDialer is the client side of port forwarding: it forwards connections to a port of
+// an environment's main pod through the port-forward endpoint of an AgentBox server
+type PortForwardDialer struct {
+	// BaseURL is the server URL, e.g. "https://agentbox.example.com" (http(s) or ws(s))
+	BaseURL string
+	// Token authenticates the requests: a session token, API key or environment token
+	Token string
+	// Dialer is the WebSocket dialer (nil = websocket.DefaultDialer)
+	Dialer *websocket.Dialer
+}
+
+// URL returns the WebSocket URL of a port forward to port of an environment
+func (d *PortForwardDialer) URL(envID string, port int) (string, error) {
+	u, err := url.Parse(d.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("invalid base URL %q: must be an http(s) or ws(s) URL", d.BaseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/environments/" + url.PathEscape(envID) + "/port-forward"
+	u.RawPath = ""
+	u.RawQuery = url.Values{"port": {strconv.Itoa(port)}}.Encode()
+	return u.String(), nil
+}
+
+// Dial forwards one connection to port of an environment. Closing the returned connection closes
+// the forwarded one; reads fail with the server's reason when it ends the forward (e.g. "idle
+// timeout").
+func (d *PortForwardDialer) Dial(ctx context.Context, envID string, port int) (net.Conn, error) {
+	target, err := d.URL(envID, port)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if d.Token != "" {
+		header.Set("Authorization", "Bearer "+d.Token)
+	}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, target, header)
+	if err != nil {
+		if resp != nil {
+			return nil, refusedError(resp)
+		}
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	return newWSStream(conn), nil
+}
+
+// refusedError describes a port forward the server refused, using its error response when it
+// sent one
+func refusedError(resp *http.Response) error {
+	defer resp.Body.Close()
+	var errResp models.ErrorResponse
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, &errResp) == nil && errResp.Message != "" {
+		return fmt.Errorf("port forward refused (%s): %s", resp.Status, errResp.Message)
+	}
+	return fmt.Errorf("port forward refused (%s)", resp.Status)
+}
+
+// Listen listens on the local address addr (e.g. "127.0.0.1:8888", or "127.0.0.1:0" for any free
+// port) and forwards every connection accepted there to port of an environment, like kubectl
+// port-forward. The returned listener serves in the background until it is closed or ctx is
+// canceled: use its Addr to connect (its Accept only returns once it is closed). Connections that
+// cannot be forwarded are closed right away.
+func (d *PortForwardDialer) Listen(ctx context.Context, addr, envID string, port int) (net.Listener, error) {
+	if _, err := d.URL(envID, port); err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	fl := &forwardListener{Listener: l, cancel: cancel, done: make(chan struct{})}
+	context.AfterFunc(ctx, func() { fl.Close() }) //nolint:errcheck // nothing to report to
+	go fl.serve(ctx, d, envID, port)
+	return fl, nil
+}
+
+// forwardListener is a local listener whose connections are forwarded by serve
+type forwardListener struct {
+	net.Listener
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *forwardListener) serve(ctx context.Context, d *PortForwardDialer, envID string, port int) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer l.Close()
+	for {
+		local, err := l.Listener.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer local.Close()
+			remote, err := d.Dial(ctx, envID, port)
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+			pipe(ctx, local, remote)
+		}()
+	}
+}
+
+// pipe copies between two connections until either side is done or ctx is canceled
+func pipe(ctx context.Context, a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b) //nolint:errcheck // either side failing ends the connection
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a) //nolint:errcheck // either side failing ends the connection
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Accept blocks until the listener is closed: its connections are forwarded, not handed out
+func (l *forwardListener) Accept() (net.Conn, error) {
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+// Close stops forwarding: it closes the local listener and every forwarded connection
+func (l *forwardListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.cancel()
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
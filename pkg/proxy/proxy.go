@@ -56,12 +56,21 @@ type Proxy struct {
 	maxSessions int
 }
 
+// Recorder receives the stdin and output of a session (see pkg/recording). stream is "stdin",
+// "stdout" or "stderr".
+type Recorder interface {
+	Record(stream string, data []byte)
+	Close() error
+}
+
 // Session represents an active WebSocket session
 type Session struct {
 	ID        string
 	Namespace string
 	PodName   string
 	Conn      *websocket.Conn
+	client    k8s.ClientInterface
+	recorder  Recorder
 	stdin     io.WriteCloser
 	stdout    io.ReadCloser
 	stderr    io.ReadCloser
@@ -94,18 +103,36 @@ func NewProxyWithConfig(k8sClient k8s.ClientInterface, log *logger.Logger, allow
 
 // HandleWebSocket handles WebSocket upgrade and connection
 func (p *Proxy) HandleWebSocket(w http.ResponseWriter, r *http.Request, namespace, podName string) error {
+	return p.HandleWebSocketWithClient(w, r, p.k8sClient, namespace, podName)
+}
+
+// HandleWebSocketWithClient is HandleWebSocket for a pod on a specific cluster
+func (p *Proxy) HandleWebSocketWithClient(
+	w http.ResponseWriter, r *http.Request, client k8s.ClientInterface, namespace, podName string,
+) error {
+	return p.HandleWebSocketWithRecorder(w, r, client, namespace, podName, nil)
+}
+
+// HandleWebSocketWithRecorder is HandleWebSocketWithClient with the session recorded by rec
+// (optional). The proxy takes ownership of rec and closes it when the session ends, or right
+// away when the session cannot be started.
+func (p *Proxy) HandleWebSocketWithRecorder(
+	w http.ResponseWriter, r *http.Request, client k8s.ClientInterface, namespace, podName string, rec Recorder,
+) error {
 	// Check session limit
 	p.mu.RLock()
 	sessionCount := len(p.sessions)
 	p.mu.RUnlock()
 
 	if sessionCount >= p.maxSessions {
+		p.closeRecorder(rec)
 		return fmt.Errorf("maximum session limit reached (%d)", p.maxSessions)
 	}
 
 	// Upgrade HTTP connection to WebSocket
 	conn, err := p.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		p.closeRecorder(rec)
 		return fmt.Errorf("failed to upgrade connection: %w", err)
 	}
 
@@ -118,6 +145,8 @@ func (p *Proxy) HandleWebSocket(w http.ResponseWriter, r *http.Request, namespac
 		Namespace: namespace,
 		PodName:   podName,
 		Conn:      conn,
+		client:    client,
+		recorder:  rec,
 		cancel:    cancel,
 	}
 
@@ -153,7 +182,7 @@ func (p *Proxy) handleSession(ctx context.Context, session *Session) {
 
 	// Start pod exec in background
 	go func() {
-		err := p.k8sClient.ExecInPod(
+		err := session.client.ExecInPod(
 			ctx,
 			session.Namespace,
 			session.PodName,
@@ -171,14 +200,22 @@ func (p *Proxy) handleSession(ctx context.Context, session *Session) {
 		session.Close()
 	}()
 
-	// Handle stdout
-	go p.streamOutput(session, stdoutReader, "stdout")
-
-	// Handle stderr
-	go p.streamOutput(session, stderrReader, "stderr")
+	// Handle stdout and stderr
+	var streams sync.WaitGroup
+	for stream, reader := range map[string]io.Reader{"stdout": stdoutReader, "stderr": stderrReader} {
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			p.streamOutput(session, reader, stream)
+		}()
+	}
 
 	// Handle stdin (WebSocket messages)
 	p.handleInput(session)
+
+	// Let the output streams finish (closing the session ends them) so the recording is complete
+	session.Close()
+	streams.Wait()
 }
 
 // handleInput reads from WebSocket and writes to pod stdin
@@ -200,7 +237,11 @@ func (p *Proxy) handleInput(session *Session) {
 		}
 
 		if msg.Type == "stdin" {
-			_, err := session.stdin.Write([]byte(msg.Data))
+			data := []byte(msg.Data)
+			if session.recorder != nil {
+				session.recorder.Record("stdin", data)
+			}
+			_, err := session.stdin.Write(data)
 			if err != nil {
 				p.logger.Error("failed to write to stdin",
 					zap.String("session_id", session.ID),
@@ -233,6 +274,10 @@ func (p *Proxy) streamOutput(session *Session, reader io.Reader, streamType stri
 		}
 
 		if n > 0 {
+			if session.recorder != nil {
+				session.recorder.Record(streamType, buf[:n])
+			}
+
 			// Reuse timestamp for batch operations
 			msg := models.WebSocketMessage{
 				Type:      streamType,
@@ -274,9 +319,21 @@ func (p *Proxy) cleanup(session *Session) {
 	delete(p.sessions, session.ID)
 	p.mu.Unlock()
 
+	p.closeRecorder(session.recorder)
+
 	p.logger.Info("websocket session ended", zap.String("session_id", session.ID))
 }
 
+// closeRecorder finishes a session's recording, if it has one
+func (p *Proxy) closeRecorder(rec Recorder) {
+	if rec == nil {
+		return
+	}
+	if err := rec.Close(); err != nil {
+		p.logger.Error("failed to finish session recording", zap.Error(err))
+	}
+}
+
 // Close closes a session
 func (s *Session) Close() {
 	s.mu.Lock()
@@ -0,0 +1,395 @@
+// Package recording records interactive attach sessions as asciicast v2 files
+// (https://docs.asciinema.org/manual/asciicast/v2/) so they can be replayed when reviewing what
+// happened in an environment. Recording is opt-in per environment; every recording is capped in
+// size and text matching the configured secret patterns is masked before it is written.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// StoragePrefix is the key prefix of recordings in the shared storage backend
+const StoragePrefix = "recordings/"
+
+// ContentType is the media type recordings are served with
+const ContentType = "application/x-asciicast"
+
+// Redacted replaces text matching a redaction pattern
+const Redacted = "[REDACTED]"
+
+// maxPendingLine is how much of an unterminated line is buffered (so it can be redacted as a
+// whole) before it is written anyway
+const maxPendingLine = 4096
+
+// storeTimeout bounds storing a finished recording and updating its index entry
+const storeTimeout = time.Minute
+
+// Terminal size written to the recording header; the attach protocol does not report one
+const (
+	terminalWidth  = 80
+	terminalHeight = 24
+)
+
+// Recording is the index entry of one recorded attach session
+type Recording struct {
+	ID            string     `json:"id"`
+	EnvironmentID string     `json:"environment_id"`
+	UserID        string     `json:"user_id,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	EndedAt       *time.Time `json:"ended_at,omitempty"`
+	SizeBytes     int64      `json:"size_bytes"`
+	// Truncated is true when the session outgrew recording.max_bytes
+	Truncated bool `json:"truncated"`
+	// DownloadURL downloads the recording straight from the storage backend, when it hands out
+	// presigned URLs (listings only; it expires after storage.presign_expiry_seconds)
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// Service starts recordings and serves them back
+type Service struct {
+	db            *database.DB
+	store         storage.Backend
+	presignExpiry time.Duration
+	maxBytes      int64
+	redact        []*regexp.Regexp
+	logger        *zap.Logger
+}
+
+// NewService creates a recording service storing recordings in the storage backend store (under
+// recordings/), or in cfg.Directory when store is nil. presignExpiry is the validity of the
+// download URLs of listed recordings.
+func NewService(db *database.DB, cfg config.RecordingConfig, store storage.Backend, presignExpiry time.Duration, logger *zap.Logger) (*Service, error) {
+	redact := make([]*regexp.Regexp, 0, len(cfg.RedactPatterns))
+	for i, p := range cfg.RedactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording redact pattern %d: %w", i, err)
+		}
+		redact = append(redact, re)
+	}
+	if store != nil {
+		store = storage.WithPrefix(store, StoragePrefix)
+	} else {
+		if err := os.MkdirAll(cfg.Directory, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create recording directory: %w", err)
+		}
+		local, err := storage.NewLocal(cfg.Directory)
+		if err != nil {
+			return nil, err
+		}
+		store = local
+	}
+	return &Service{
+		db:            db,
+		store:         store,
+		presignExpiry: presignExpiry,
+		maxBytes:      cfg.MaxBytes,
+		redact:        redact,
+		logger:        logger,
+	}, nil
+}
+
+// Start begins recording a session of userID attached to an environment. The returned recorder
+// must be closed when the session ends.
+func (s *Service) Start(ctx context.Context, envID, userID string) (*Recorder, error) {
+	now := time.Now().UTC()
+	rec := &Recording{
+		ID:            uuid.New().String(),
+		EnvironmentID: envID,
+		UserID:        userID,
+		StartedAt:     now,
+	}
+
+	// The session is spooled to a temporary file and stored when it ends
+	f, err := os.CreateTemp("", "agentbox-recording-*.cast")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO session_recordings (id, environment_id, user_id, started_at)
+		VALUES ($1, $2, $3, $4)
+	`, rec.ID, envID, nullIfEmpty(userID), now); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to save session recording: %w", err)
+	}
+
+	r := &Recorder{
+		service:   s,
+		recording: rec,
+		start:     time.Now(),
+		file:      f,
+		out:       bufio.NewWriter(f),
+		pending:   make(map[string][]byte),
+	}
+	header, err := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     terminalWidth,
+		"height":    terminalHeight,
+		"timestamp": now.Unix(),
+		"title":     envID,
+		"env":       map[string]string{"SHELL": "/bin/sh"},
+	})
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to encode recording header: %w", err)
+	}
+	r.write(header)
+	return r, nil
+}
+
+// List returns the recordings of an environment, newest first. Finished recordings carry a
+// download URL when the storage backend hands out presigned URLs.
+func (s *Service) List(ctx context.Context, envID string) ([]*Recording, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, environment_id, user_id, started_at, ended_at, size_bytes, truncated
+		FROM session_recordings
+		WHERE environment_id = $1
+		ORDER BY started_at DESC
+	`, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list session recordings: %w", err)
+	}
+	defer rows.Close()
+
+	recordings := []*Recording{}
+	for rows.Next() {
+		rec, err := scanRecording(rows)
+		if err != nil {
+			return nil, err
+		}
+		recordings = append(recordings, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, rec := range recordings {
+		if rec.EndedAt == nil || s.presignExpiry <= 0 {
+			continue
+		}
+		url, err := s.store.PresignGet(ctx, key(rec.ID), s.presignExpiry)
+		if errors.Is(err, storage.ErrPresignNotSupported) {
+			break
+		}
+		if err != nil {
+			s.logger.Warn("failed to presign session recording", zap.String("recording_id", rec.ID), zap.Error(err))
+			continue
+		}
+		rec.DownloadURL = url
+	}
+	return recordings, nil
+}
+
+// Get returns a recording's index entry
+func (s *Service) Get(ctx context.Context, id string) (*Recording, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, environment_id, user_id, started_at, ended_at, size_bytes, truncated
+		FROM session_recordings
+		WHERE id = $1
+	`, id)
+	rec, err := scanRecording(row)
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeSessionRecordingNotFound, "session recording not found")
+	}
+	return rec, err
+}
+
+// Open returns the content of a finished session's recording. The caller must close it.
+func (s *Service) Open(ctx context.Context, id string) (*Recording, io.ReadCloser, error) {
+	rec, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := s.store.Get(ctx, key(rec.ID))
+	if errors.Is(err, storage.ErrNotFound) {
+		if rec.EndedAt == nil {
+			return nil, nil, apierrors.New(apierrors.Conflict, apierrors.CodeSessionRecordingNotFound, "session recording is still in progress")
+		}
+		return nil, nil, apierrors.Wrap(apierrors.NotFound, apierrors.CodeSessionRecordingNotFound, err, "session recording file is missing")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open session recording: %w", err)
+	}
+	return rec, f, nil
+}
+
+// key returns the object key a recording is stored under
+func key(id string) string {
+	return id + ".cast"
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecording(row rowScanner) (*Recording, error) {
+	var rec Recording
+	var userID sql.NullString
+	var endedAt sql.NullTime
+	if err := row.Scan(&rec.ID, &rec.EnvironmentID, &userID, &rec.StartedAt, &endedAt, &rec.SizeBytes, &rec.Truncated); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan session recording: %w", err)
+	}
+	rec.UserID = userID.String
+	if endedAt.Valid {
+		rec.EndedAt = &endedAt.Time
+	}
+	return &rec, nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Recorder writes one session to its recording (implements proxy.Recorder). Output is buffered
+// per stream up to the end of the line so that secrets split across reads are still redacted.
+type Recorder struct {
+	service   *Service
+	recording *Recording
+	start     time.Time
+
+	mu        sync.Mutex
+	file      *os.File
+	out       *bufio.Writer
+	pending   map[string][]byte
+	size      int64
+	truncated bool
+	closed    bool
+}
+
+// ID returns the recording ID
+func (r *Recorder) ID() string {
+	return r.recording.ID
+}
+
+// Record adds data read from or written to the session: stream is "stdin", "stdout" or "stderr"
+func (r *Recorder) Record(stream string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.truncated {
+		return
+	}
+
+	buf := append(r.pending[stream], data...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		r.event(stream, buf[:i+1])
+		buf = buf[i+1:]
+	}
+	if len(buf) >= maxPendingLine {
+		r.event(stream, buf)
+		buf = nil
+	}
+	r.pending[stream] = append([]byte(nil), buf...)
+}
+
+// Close stores the recording and records its final size
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	for _, stream := range []string{"stdin", "stdout", "stderr"} {
+		if len(r.pending[stream]) > 0 {
+			r.event(stream, r.pending[stream])
+		}
+	}
+	r.closed = true
+	storeErr := r.out.Flush()
+	size, truncated := r.size, r.truncated
+	r.mu.Unlock()
+
+	// The session's request context is gone by now
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if storeErr == nil {
+		if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+			storeErr = err
+		} else {
+			storeErr = r.service.store.Put(ctx, key(r.recording.ID), r.file, ContentType)
+		}
+	}
+	r.file.Close()
+	os.Remove(r.file.Name())
+
+	if _, err := r.service.db.ExecContext(ctx, `
+		UPDATE session_recordings SET ended_at = $1, size_bytes = $2, truncated = $3 WHERE id = $4
+	`, time.Now().UTC(), size, truncated, r.recording.ID); err != nil {
+		return fmt.Errorf("failed to update session recording: %w", err)
+	}
+	if storeErr != nil {
+		return fmt.Errorf("failed to store session recording: %w", storeErr)
+	}
+	return nil
+}
+
+// event writes one asciicast event; the caller holds r.mu
+func (r *Recorder) event(stream string, data []byte) {
+	code := "o"
+	if stream == "stdin" {
+		code = "i"
+	}
+	text := string(data)
+	for _, re := range r.service.redact {
+		text = re.ReplaceAllString(text, Redacted)
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, code, text})
+	if err != nil {
+		return
+	}
+	r.write(line)
+}
+
+// write appends a line to the recording unless that would exceed the size cap, after which the
+// rest of the session is not recorded; the caller holds r.mu (or owns r exclusively)
+func (r *Recorder) write(line []byte) {
+	if r.truncated {
+		return
+	}
+	if r.size+int64(len(line))+1 > r.service.maxBytes {
+		r.truncated = true
+		r.service.logger.Warn("session recording reached its size limit",
+			zap.String("recording_id", r.recording.ID),
+			zap.String("environment_id", r.recording.EnvironmentID),
+			zap.Int64("max_bytes", r.service.maxBytes),
+		)
+		return
+	}
+	if _, err := r.out.Write(append(line, '\n')); err != nil {
+		r.service.logger.Error("failed to write session recording", zap.String("recording_id", r.recording.ID), zap.Error(err))
+		r.truncated = true
+		return
+	}
+	r.size += int64(len(line)) + 1
+}
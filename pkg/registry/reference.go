@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DockerHub is the registry of image references without a registry host
+	DockerHub = "docker.io"
+	// dockerHubAPIHost serves the registry API for docker.io
+	dockerHubAPIHost = "registry-1.docker.io"
+	// defaultTag is used when a reference has neither a tag nor a digest
+	defaultTag = "latest"
+)
+
+var (
+	repositoryRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRegex        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRegex     = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+)
+
+// Reference is a parsed image reference such as "ghcr.io/org/app:1.2" or "python:3.11-slim"
+type Reference struct {
+	// Registry is the registry host ("docker.io" for Docker Hub)
+	Registry string
+	// Repository is the repository path; Docker Hub official images are under "library/"
+	Repository string
+	// Tag is the tag, "latest" when the reference has neither a tag nor a digest
+	Tag string
+	// Digest pins the reference to a manifest, e.g. "sha256:..."
+	Digest string
+}
+
+// ParseReference parses and normalizes an image reference the way Docker does: a first path
+// component containing '.' or ':' (or "localhost") is the registry host, anything else is a
+// Docker Hub repository
+func ParseReference(image string) (Reference, error) {
+	var ref Reference
+	if image == "" || strings.TrimSpace(image) != image {
+		return ref, fmt.Errorf("invalid image reference %q", image)
+	}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRegex.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest %q in image reference %q", ref.Digest, image)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegex.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag %q in image reference %q", ref.Tag, image)
+		}
+	}
+
+	ref.Registry = DockerHub
+	ref.Repository = name
+	if i := strings.Index(name, "/"); i >= 0 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = normalizeRegistry(host)
+			ref.Repository = name[i+1:]
+		}
+	}
+	if ref.Registry == DockerHub && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if !repositoryRegex.MatchString(ref.Repository) {
+		return ref, fmt.Errorf("invalid repository %q in image reference %q: must be lowercase letters, digits and separators", ref.Repository, image)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// Name returns the registry and repository, e.g. "docker.io/library/python"
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the normalized reference, e.g. "docker.io/library/python:3.11"
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// manifestReference is the tag or digest the manifest is fetched by; the digest wins
+func (r Reference) manifestReference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// apiHost is the host serving the registry API for the reference
+func (r Reference) apiHost() string {
+	if r.Registry == DockerHub {
+		return dockerHubAPIHost
+	}
+	return r.Registry
+}
+
+// Allowed reports whether the reference is under one of the allowlist prefixes. A prefix without
+// a '/' is a registry host and matches every repository of that registry; otherwise it matches
+// the repository it names and the repositories below it. An empty allowlist allows everything.
+func (r Reference) Allowed(prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	name := r.Name()
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(prefix)), "/")
+		host, path, hasPath := strings.Cut(prefix, "/")
+		host = normalizeRegistry(host)
+		if !hasPath {
+			if r.Registry == host {
+				return true
+			}
+			continue
+		}
+		prefix = host + "/" + path
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRegistry maps the aliases of Docker Hub to "docker.io" and lowercases the host
+func normalizeRegistry(host string) string {
+	host = strings.ToLower(host)
+	switch host {
+	case "index.docker.io", dockerHubAPIHost:
+		return DockerHub
+	}
+	return host
+}
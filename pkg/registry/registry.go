@@ -0,0 +1,590 @@
+// Package registry inspects container images through the registry HTTP API v2
+// (https://distribution.github.io/distribution/spec/api/) without pulling them: it resolves the
+// manifest (or manifest list) of a reference and reads the image config for its creation date
+// and entrypoint. Docker Hub, GHCR and private registries are supported with anonymous or
+// configured credentials, using bearer token or basic authentication as the registry asks.
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+)
+
+// Manifest media types
+const (
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+const (
+	// maxDocumentBytes caps the manifests, image configs and token responses read from a registry
+	maxDocumentBytes = 4 * 1024 * 1024
+	// maxCacheEntries bounds the inspection cache
+	maxCacheEntries = 1024
+	// requestTimeout bounds one registry request
+	requestTimeout = 30 * time.Second
+)
+
+// ImageInfo is the metadata of an image as reported by its registry
+type ImageInfo struct {
+	// Image is the normalized reference, e.g. "docker.io/library/python:3.11"
+	Image      string `json:"image"`
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	// Digest is the digest of the manifest (or manifest list) the reference resolves to
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	// Platforms lists the platforms the image is built for
+	Platforms []Platform `json:"platforms"`
+	// Platform is the platform Size, Created, Entrypoint and Cmd describe: linux/amd64 when the
+	// image has it, otherwise the first listed platform
+	Platform   string     `json:"platform,omitempty"`
+	Size       int64      `json:"size"`
+	Created    *time.Time `json:"created,omitempty"`
+	Entrypoint []string   `json:"entrypoint,omitempty"`
+	Cmd        []string   `json:"cmd,omitempty"`
+	// InspectedAt is when the registry was queried; older than the request when cached
+	InspectedAt time.Time `json:"inspected_at"`
+}
+
+// Platform is one platform of a multi-platform image
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	// Digest and Size identify the platform's manifest (set for manifest lists only)
+	Digest string `json:"digest,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// String returns the platform as os/architecture[/variant]
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Client inspects images, caching results for the configured time
+type Client struct {
+	httpClient  *http.Client
+	credentials map[string]config.RegistryCredentialConfig
+	cacheTTL    time.Duration
+	logger      *zap.Logger
+
+	mu    sync.Mutex
+	cache map[string]cachedImage
+}
+
+// cachedImage is an inspection result and when it expires
+type cachedImage struct {
+	info      *ImageInfo
+	expiresAt time.Time
+}
+
+// NewClient creates a client using the credentials of cfg.Registries
+func NewClient(cfg config.ImagesConfig, logger *zap.Logger) *Client {
+	credentials := make(map[string]config.RegistryCredentialConfig, len(cfg.Registries))
+	for _, reg := range cfg.Registries {
+		credentials[normalizeRegistry(reg.Host)] = reg
+	}
+	return &Client{
+		httpClient:  &http.Client{Timeout: requestTimeout},
+		credentials: credentials,
+		cacheTTL:    time.Duration(cfg.InspectCacheSeconds) * time.Second,
+		logger:      logger,
+		cache:       make(map[string]cachedImage),
+	}
+}
+
+// SetHTTPClient replaces the HTTP client used to reach registries (e.g. to trust a private CA)
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// Inspect returns the metadata of the image ref. Errors carry an apierrors kind: NotFound
+// (IMAGE_NOT_FOUND) when the repository or tag does not exist, BadGateway
+// (REGISTRY_AUTH_FAILED) when the registry rejects the credentials, RateLimited
+// (REGISTRY_RATE_LIMITED, see RetryAfter) and BadGateway (REGISTRY_UNAVAILABLE) otherwise.
+func (c *Client) Inspect(ctx context.Context, ref Reference) (*ImageInfo, error) {
+	key := ref.String()
+	if info := c.cached(key); info != nil {
+		return info, nil
+	}
+
+	s := &session{client: c, ref: ref}
+	info, err := s.inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, info)
+	return copyImageInfo(info), nil
+}
+
+// cached returns a copy of the unexpired cache entry for key, or nil
+func (c *Client) cached(key string) *ImageInfo {
+	if c.cacheTTL <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.cache, key)
+		return nil
+	}
+	return copyImageInfo(entry.info)
+}
+
+// store caches info under key, evicting expired entries (or, if none, any entry) when full
+func (c *Client) store(key string, info *ImageInfo) {
+	if c.cacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.cache) >= maxCacheEntries {
+		for k, entry := range c.cache {
+			if now.After(entry.expiresAt) {
+				delete(c.cache, k)
+			}
+		}
+		for k := range c.cache {
+			if len(c.cache) < maxCacheEntries {
+				break
+			}
+			delete(c.cache, k)
+		}
+	}
+	c.cache[key] = cachedImage{info: info, expiresAt: now.Add(c.cacheTTL)}
+}
+
+// copyImageInfo returns a copy of info that shares no slices with it
+func copyImageInfo(info *ImageInfo) *ImageInfo {
+	cp := *info
+	cp.Platforms = append([]Platform{}, info.Platforms...)
+	cp.Entrypoint = append([]string(nil), info.Entrypoint...)
+	cp.Cmd = append([]string(nil), info.Cmd...)
+	if info.Created != nil {
+		created := *info.Created
+		cp.Created = &created
+	}
+	return &cp
+}
+
+// rateLimitError records how long the registry asked us to wait
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("rate limited, retry after %s", e.retryAfter)
+	}
+	return "rate limited"
+}
+
+// RetryAfter returns how long a rate-limited registry asked clients to wait, or 0 when err is not
+// a rate limit error or the registry did not say
+func RetryAfter(err error) time.Duration {
+	var rl *rateLimitError
+	if errors.As(err, &rl) {
+		return rl.retryAfter
+	}
+	return 0
+}
+
+// manifest is the union of the image manifest and image index (manifest list) documents
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// descriptor points to a manifest, config or layer
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+// imageConfig holds the fields of the image config blob we report
+type imageConfig struct {
+	Created      *time.Time `json:"created"`
+	OS           string     `json:"os"`
+	Architecture string     `json:"architecture"`
+	Variant      string     `json:"variant"`
+	Config       struct {
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+	} `json:"config"`
+}
+
+// session performs the requests of one inspection, reusing the credentials the registry granted
+type session struct {
+	client *Client
+	ref    Reference
+	// authorization is the Authorization header obtained from the registry's challenge
+	authorization string
+}
+
+// inspect resolves the reference, descending into the preferred platform of a manifest list
+func (s *session) inspect(ctx context.Context) (*ImageInfo, error) {
+	m, mediaType, digest, err := s.fetchManifest(ctx, s.ref.manifestReference())
+	if err != nil {
+		return nil, err
+	}
+	info := &ImageInfo{
+		Image:       s.ref.String(),
+		Registry:    s.ref.Registry,
+		Repository:  s.ref.Repository,
+		Tag:         s.ref.Tag,
+		Digest:      digest,
+		MediaType:   mediaType,
+		Platforms:   []Platform{},
+		InspectedAt: time.Now().UTC(),
+	}
+
+	if isIndex(mediaType) {
+		var chosen *descriptor
+		preferred := false
+		for i := range m.Manifests {
+			d := &m.Manifests[i]
+			// Attestation manifests (buildx provenance, SBOMs) are listed as unknown/unknown
+			if d.Platform == nil || d.Platform.OS == "unknown" {
+				continue
+			}
+			p := Platform{
+				OS:           d.Platform.OS,
+				Architecture: d.Platform.Architecture,
+				Variant:      d.Platform.Variant,
+				Digest:       d.Digest,
+				Size:         d.Size,
+			}
+			info.Platforms = append(info.Platforms, p)
+			if chosen == nil || (p.OS == "linux" && p.Architecture == "amd64" && !preferred) {
+				chosen = d
+				preferred = p.OS == "linux" && p.Architecture == "amd64"
+			}
+		}
+		if chosen == nil {
+			return info, nil
+		}
+		info.Platform = Platform{OS: chosen.Platform.OS, Architecture: chosen.Platform.Architecture, Variant: chosen.Platform.Variant}.String()
+		m, mediaType, _, err = s.fetchManifest(ctx, chosen.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if isIndex(mediaType) {
+			return nil, apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryUnavailable,
+				"registry %s returned a nested manifest list for %s", s.ref.Registry, s.ref)
+		}
+	}
+
+	info.Size = m.Config.Size
+	for _, layer := range m.Layers {
+		info.Size += layer.Size
+	}
+
+	cfg, err := s.fetchConfig(ctx, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	info.Created = cfg.Created
+	info.Entrypoint = cfg.Config.Entrypoint
+	info.Cmd = cfg.Config.Cmd
+	if !isIndex(info.MediaType) {
+		p := Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}
+		info.Platforms = append(info.Platforms, p)
+		info.Platform = p.String()
+	}
+	return info, nil
+}
+
+// fetchManifest fetches the manifest or manifest list for a tag or digest and returns it with
+// its media type and digest
+func (s *session) fetchManifest(ctx context.Context, reference string) (*manifest, string, string, error) {
+	accept := strings.Join([]string{MediaTypeOCIIndex, MediaTypeDockerManifestList, MediaTypeOCIManifest, MediaTypeDockerManifest}, ", ")
+	body, header, err := s.get(ctx, "/manifests/"+reference, accept)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, "", "", apierrors.Wrap(apierrors.BadGateway, apierrors.CodeRegistryUnavailable, err,
+			"registry %s returned an invalid manifest for %s", s.ref.Registry, s.ref)
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/json" || mediaType == "application/octet-stream" {
+		mediaType = m.MediaType
+	}
+	if mediaType == "" && len(m.Manifests) > 0 {
+		mediaType = MediaTypeOCIIndex
+	}
+	switch mediaType {
+	case MediaTypeOCIIndex, MediaTypeDockerManifestList, MediaTypeOCIManifest, MediaTypeDockerManifest:
+	case "":
+		mediaType = MediaTypeOCIManifest
+	default:
+		return nil, "", "", apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryUnavailable,
+			"registry %s returned unsupported manifest type %q for %s", s.ref.Registry, mediaType, s.ref)
+	}
+
+	digest := header.Get("Docker-Content-Digest")
+	if digest == "" {
+		sum := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return &m, mediaType, digest, nil
+}
+
+// fetchConfig fetches and decodes the image config blob
+func (s *session) fetchConfig(ctx context.Context, digest string) (*imageConfig, error) {
+	if digest == "" {
+		return nil, apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryUnavailable,
+			"registry %s returned a manifest without a config for %s", s.ref.Registry, s.ref)
+	}
+	body, _, err := s.get(ctx, "/blobs/"+digest, "application/json, */*")
+	if err != nil {
+		return nil, err
+	}
+	var cfg imageConfig
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return nil, apierrors.Wrap(apierrors.BadGateway, apierrors.CodeRegistryUnavailable, err,
+			"registry %s returned an invalid image config for %s", s.ref.Registry, s.ref)
+	}
+	return &cfg, nil
+}
+
+// get requests path below the repository, answering one authentication challenge
+func (s *session) get(ctx context.Context, path, accept string) ([]byte, http.Header, error) {
+	target := "https://" + s.ref.apiHost() + "/v2/" + s.ref.Repository + path
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Accept", accept)
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		resp, err := s.client.httpClient.Do(req)
+		if err != nil {
+			return nil, nil, s.unreachable(err)
+		}
+		body, err := readBody(resp)
+		if err != nil {
+			return nil, nil, s.unreachable(err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			if err := s.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, s.statusError(resp)
+		}
+		return body, resp.Header, nil
+	}
+}
+
+// authenticate answers a WWW-Authenticate challenge: Bearer challenges are exchanged for a token
+// at the realm (with the configured credentials, if any), Basic challenges use the credentials
+func (s *session) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	cred, hasCred := s.client.credentials[s.ref.Registry]
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		token, err := s.fetchToken(ctx, params, cred, hasCred)
+		if err != nil {
+			return err
+		}
+		s.authorization = "Bearer " + token
+		return nil
+	case "basic":
+		if !hasCred {
+			return s.authFailed(false)
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(cred.Username, cred.Password)
+		s.authorization = req.Header.Get("Authorization")
+		return nil
+	}
+	return apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryAuthFailed,
+		"registry %s requested unsupported authentication %q", s.ref.Registry, scheme)
+}
+
+// fetchToken requests a pull token from the realm of a Bearer challenge
+func (s *session) fetchToken(ctx context.Context, params map[string]string, cred config.RegistryCredentialConfig, hasCred bool) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme != "https" || realm.Host == "" {
+		return "", apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryAuthFailed,
+			"registry %s sent an invalid token realm %q", s.ref.Registry, params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + s.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCred {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	resp, err := s.client.httpClient.Do(req)
+	if err != nil {
+		return "", s.unreachable(err)
+	}
+	body, err := readBody(resp)
+	if err != nil {
+		return "", s.unreachable(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return "", s.authFailed(hasCred)
+		}
+		return "", s.statusError(resp)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || (token.Token == "" && token.AccessToken == "") {
+		return "", apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryAuthFailed,
+			"registry %s returned no token", s.ref.Registry)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// statusError maps an unsuccessful registry response to an error
+func (s *session) statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		_, hasCred := s.client.credentials[s.ref.Registry]
+		return s.authFailed(hasCred)
+	case http.StatusNotFound:
+		return apierrors.New(apierrors.NotFound, apierrors.CodeImageNotFound, "image %s not found", s.ref)
+	case http.StatusTooManyRequests:
+		rl := &rateLimitError{}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			rl.retryAfter = time.Duration(secs) * time.Second
+		}
+		return apierrors.Wrap(apierrors.RateLimited, apierrors.CodeRegistryRateLimited, rl,
+			"registry %s rate limit exceeded", s.ref.Registry)
+	}
+	return apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryUnavailable,
+		"registry %s returned status %d for %s", s.ref.Registry, resp.StatusCode, s.ref)
+}
+
+// authFailed reports that the registry denied access. Registries commonly deny anonymous access
+// to repositories that do not exist, so without credentials the image may simply be missing.
+func (s *session) authFailed(hasCred bool) error {
+	if hasCred {
+		return apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryAuthFailed,
+			"registry %s rejected the configured credentials for %s", s.ref.Registry, s.ref.Name())
+	}
+	return apierrors.New(apierrors.BadGateway, apierrors.CodeRegistryAuthFailed,
+		"registry %s denied anonymous access to %s (the repository does not exist or requires credentials)", s.ref.Registry, s.ref.Name())
+}
+
+// unreachable reports a transport failure
+func (s *session) unreachable(err error) error {
+	s.client.logger.Debug("registry request failed", zap.String("registry", s.ref.Registry), zap.Error(err))
+	return apierrors.Wrap(apierrors.BadGateway, apierrors.CodeRegistryUnavailable, err,
+		"registry %s is unreachable", s.ref.Registry)
+}
+
+// readBody reads and closes a response body of at most maxDocumentBytes
+func readBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDocumentBytes {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxDocumentBytes)
+	}
+	return body, nil
+}
+
+// isIndex reports whether mediaType is a manifest list
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"` into its scheme
+// and parameters
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[key] = b.String()
+			rest = value[min(i+1, len(value)):]
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(value)
+	}
+	return scheme, params
+}
@@ -0,0 +1,74 @@
+package roles
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+type contextKey struct{}
+
+// requestCapabilities caches the capabilities of the roles looked up during one request, so
+// handlers can check capabilities repeatedly without a query per check
+type requestCapabilities struct {
+	service *Service
+	mu      sync.Mutex
+	byRole  map[string][]string
+}
+
+// Middleware makes Has resolve capabilities through the service, once per role and request
+func (s *Service) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cache := &requestCapabilities{service: s, byRole: make(map[string][]string)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, cache)))
+	})
+}
+
+// capabilities returns the role's capabilities, looking them up on first use
+func (c *requestCapabilities) capabilities(ctx context.Context, role string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if caps, ok := c.byRole[role]; ok {
+		return caps
+	}
+	caps, err := c.service.RoleCapabilities(ctx, role)
+	if err != nil {
+		// Fall back to the built-in roles rather than failing the request
+		c.service.logger.Error("failed to resolve role capabilities", zap.String("role", role), zap.Error(err))
+		caps = builtinCapabilities[role]
+	}
+	c.byRole[role] = caps
+	return caps
+}
+
+// Has reports whether the user's role grants capability. Roles are resolved through the
+// service installed by Middleware; without it only the built-in roles grant capabilities.
+func Has(ctx context.Context, user *users.User, capability string) bool {
+	if user == nil {
+		return false
+	}
+	caps := builtinCapabilities[user.Role]
+	if cache, ok := ctx.Value(contextKey{}).(*requestCapabilities); ok {
+		caps = cache.capabilities(ctx, user.Role)
+	}
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAny reports whether the user's role grants at least one of the capabilities
+func HasAny(ctx context.Context, user *users.User, capabilities ...string) bool {
+	for _, capability := range capabilities {
+		if Has(ctx, user, capability) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package roles
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// Capabilities granted by roles, on top of the per-environment permissions every user has
+const (
+	// CapEnvironmentsReadAll reads every environment and its executions, operations and teams
+	CapEnvironmentsReadAll = "environments.read_all"
+	// CapEnvironmentsWriteAll edits and deletes every environment, bypassing command policies
+	CapEnvironmentsWriteAll = "environments.write_all"
+	// CapUsersManage manages users, their roles and environment permissions, and team quotas
+	CapUsersManage = "users.manage"
+	// CapAPIKeysManage lists and revokes other users' API keys
+	CapAPIKeysManage = "api_keys.manage"
+	// CapMetricsRead reads platform-wide metrics
+	CapMetricsRead = "metrics.read"
+	// CapAuditRead reads the audit log and the effective configuration
+	CapAuditRead = "audit.read"
+	// CapPlatformAdmin administers the platform as the admin role always has: it bypasses command
+	// policies, sets unrestricted policies and security context inheritance, sees every team,
+	// group, operation and reservation and the queues and namespace collector. Unlike
+	// environments.read_all and write_all it grants no access to environments themselves.
+	CapPlatformAdmin = "platform.admin"
+)
+
+// AllCapabilities lists every capability
+var AllCapabilities = []string{
+	CapEnvironmentsReadAll,
+	CapEnvironmentsWriteAll,
+	CapUsersManage,
+	CapAPIKeysManage,
+	CapMetricsRead,
+	CapAuditRead,
+	CapPlatformAdmin,
+}
+
+// builtinCapabilities are the capabilities of the built-in roles, as seeded into the roles
+// table. They apply when roles cannot be looked up (e.g. the router has no role service).
+var builtinCapabilities = map[string][]string{
+	users.RoleUser:       {},
+	users.RoleAdmin:      {CapUsersManage, CapAPIKeysManage, CapMetricsRead, CapAuditRead, CapPlatformAdmin},
+	users.RoleSuperAdmin: AllCapabilities,
+}
+
+// ValidCapability reports whether capability is a known capability
+func ValidCapability(capability string) bool {
+	for _, c := range AllCapabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// BuiltinCapabilities returns the capabilities of a built-in role (none for other roles)
+func BuiltinCapabilities(name string) []string {
+	return builtinCapabilities[name]
+}
+
+// IsBuiltin reports whether name is one of the built-in roles (user, admin, super_admin)
+func IsBuiltin(name string) bool {
+	_, ok := builtinCapabilities[name]
+	return ok
+}
+
+var nameRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// Role is a named set of capabilities; users.User.Role holds the name of the user's role
+type Role struct {
+	Name         string    `json:"name"`
+	Description  string    `json:"description,omitempty"`
+	Capabilities []string  `json:"capabilities"`
+	BuiltIn      bool      `json:"built_in"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CreateRoleRequest is the request to create a custom role
+type CreateRoleRequest struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Service handles role operations
+type Service struct {
+	db     *database.DB
+	logger *zap.Logger
+}
+
+// NewService creates a new role service
+func NewService(db *database.DB, logger *zap.Logger) *Service {
+	return &Service{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// ListRoles returns all roles, built-in roles first
+func (s *Service) ListRoles(ctx context.Context) ([]*Role, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, description, capabilities, built_in, created_at
+		FROM roles
+		ORDER BY built_in DESC, name ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	return roles, nil
+}
+
+// GetRole returns a role by name
+func (s *Service) GetRole(ctx context.Context, name string) (*Role, error) {
+	role, err := scanRole(s.db.QueryRowContext(ctx, `
+		SELECT name, description, capabilities, built_in, created_at
+		FROM roles
+		WHERE name = $1
+	`, name))
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeRoleNotFound, "role not found: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// CreateRole creates a custom role; actorID is recorded in the audit log
+func (s *Service) CreateRole(ctx context.Context, req *CreateRoleRequest, actorID string) (*Role, error) {
+	if !nameRegex.MatchString(req.Name) || len(req.Name) > 50 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest,
+			"role name must start with a letter and contain only lowercase letters, digits, - and _ (at most 50 characters)")
+	}
+	capabilities, err := normalizeCapabilities(req.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.GetRole(ctx, req.Name); err == nil {
+		return nil, apierrors.New(apierrors.Conflict, apierrors.CodeBadRequest, "role already exists: %s", req.Name)
+	}
+
+	encoded, err := json.Marshal(capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode capabilities: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO roles (name, description, capabilities, built_in, created_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+	`, req.Name, nullString(req.Description), string(encoded), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create role: %w", err)
+	}
+
+	s.logger.Info("role created", zap.String("role", req.Name), zap.Strings("capabilities", capabilities))
+	s.audit(ctx, "role.created", actorID, req.Name, "role created with capabilities: "+strings.Join(capabilities, ", "))
+
+	return s.GetRole(ctx, req.Name)
+}
+
+// DeleteRole deletes a custom role. Built-in roles and roles assigned to users cannot be deleted.
+func (s *Service) DeleteRole(ctx context.Context, name, actorID string) error {
+	role, err := s.GetRole(ctx, name)
+	if err != nil {
+		return err
+	}
+	if role.BuiltIn {
+		return apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "built-in role %s cannot be deleted", name)
+	}
+
+	var assigned int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE role = $1", name).Scan(&assigned); err != nil {
+		return fmt.Errorf("failed to count role users: %w", err)
+	}
+	if assigned > 0 {
+		return apierrors.New(apierrors.Conflict, apierrors.CodeRoleInUse, "role %s is assigned to %d users", name, assigned)
+	}
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM roles WHERE name = $1", name); err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+
+	s.logger.Info("role deleted", zap.String("role", name))
+	s.audit(ctx, "role.deleted", actorID, name, "role deleted")
+
+	return nil
+}
+
+// RecordAssignment writes the assignment of a role to a user to the audit log
+func (s *Service) RecordAssignment(ctx context.Context, userID, role, actorID string) {
+	s.audit(ctx, "user.role_assigned", actorID, role, fmt.Sprintf("role %s assigned to user %s", role, userID))
+}
+
+// audit writes an audit log entry about a role; failures are only logged
+func (s *Service) audit(ctx context.Context, action, actorID, role, message string) {
+	if err := s.db.SaveAuditEntry(ctx, &models.AuditEntry{
+		Action:       action,
+		ActorID:      actorID,
+		ResourceType: "role",
+		ResourceID:   role,
+		Message:      message,
+	}); err != nil {
+		s.logger.Warn("failed to write audit entry", zap.String("action", action), zap.Error(err))
+	}
+}
+
+// RoleCapabilities returns the capabilities of the named role (none for unknown roles)
+func (s *Service) RoleCapabilities(ctx context.Context, name string) ([]string, error) {
+	role, err := s.GetRole(ctx, name)
+	if apierrors.KindOf(err) == apierrors.NotFound {
+		return builtinCapabilities[name], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role.Capabilities, nil
+}
+
+// normalizeCapabilities validates capabilities and returns them sorted without duplicates
+func normalizeCapabilities(capabilities []string) ([]string, error) {
+	seen := make(map[string]bool, len(capabilities))
+	normalized := []string{}
+	for _, c := range capabilities {
+		if !ValidCapability(c) {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "unknown capability: %s", c)
+		}
+		if !seen[c] {
+			seen[c] = true
+			normalized = append(normalized, c)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRole(row rowScanner) (*Role, error) {
+	var role Role
+	var description sql.NullString
+	var capabilities string
+	if err := row.Scan(&role.Name, &description, &capabilities, &role.BuiltIn, &role.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan role: %w", err)
+	}
+	role.Description = description.String
+	if err := json.Unmarshal([]byte(capabilities), &role.Capabilities); err != nil {
+		return nil, fmt.Errorf("failed to decode role capabilities: %w", err)
+	}
+	return &role, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
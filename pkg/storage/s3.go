@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sciffer/agentbox/internal/config"
+)
+
+// maxPresignExpiry is the longest validity SigV4 allows a presigned URL
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// S3 stores objects in an S3-compatible bucket, under the configured prefix. Requests are
+// signed with AWS Signature Version 4.
+type S3 struct {
+	cfg      config.ExportS3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 creates a backend storing objects in the bucket of cfg, sending requests with client
+func NewS3(cfg config.ExportS3Config, client *http.Client) (*S3, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+	return &S3{cfg: cfg, endpoint: u, client: client}, nil
+}
+
+// location returns the host and the escaped path of key (of the bucket when key is empty)
+func (s *S3) location(key string) (host, path string) {
+	host = s.endpoint.Host
+	path = "/"
+	if key != "" {
+		path += uriEncode(s.cfg.Prefix+key, false)
+	}
+	if s.cfg.PathStyle {
+		bucket := "/" + uriEncode(s.cfg.Bucket, true)
+		if key == "" {
+			return host, bucket
+		}
+		return host, bucket + path
+	}
+	return s.cfg.Bucket + "." + host, path
+}
+
+// Put uploads the object with a signed payload. A reader that cannot seek is spooled to a
+// temporary file first, since the payload is hashed before it is sent.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		spool, err := os.CreateTemp("", "agentbox-upload-*")
+		if err != nil {
+			return fmt.Errorf("failed to spool object %s: %w", key, err)
+		}
+		defer func() {
+			_ = spool.Close()
+			_ = os.Remove(spool.Name())
+		}()
+		if _, err := io.Copy(spool, r); err != nil {
+			return fmt.Errorf("failed to spool object %s: %w", key, err)
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to spool object %s: %w", key, err)
+		}
+		body = spool
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, body)
+	if err != nil {
+		return fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+
+	host, path := s.location(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint.Scheme+"://"+host+path, io.NopCloser(body))
+	if err != nil {
+		return fmt.Errorf("failed to build S3 request: %w", err)
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, host, path, "", hex.EncodeToString(hash.Sum(nil)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("S3 upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "upload")
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("S3 download failed: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if err := checkResponse(resp, "download"); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete deletes the object; S3 answers 204 for missing objects too
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return fmt.Errorf("S3 delete failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return checkResponse(resp, "delete")
+}
+
+// listResult is the part of a ListObjectsV2 response List reads
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query)
+		if err != nil {
+			return nil, fmt.Errorf("S3 list failed: %w", err)
+		}
+		if err := checkResponse(resp, "list"); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode S3 list response: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, Object{
+				Key:          strings.TrimPrefix(c.Key, s.cfg.Prefix),
+				Size:         c.Size,
+				LastModified: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// PresignGet returns a GET URL signed in its query string
+func (s *S3) PresignGet(_ context.Context, key string, expiry time.Duration) (string, error) {
+	if err := CheckKey(key); err != nil {
+		return "", err
+	}
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return "", fmt.Errorf("presigned URL expiry must be between 1s and %s", maxPresignExpiry)
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+	host, path := s.location(key)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.cfg.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalQuery := canonicalQueryString(query)
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet, path, canonicalQuery, "host:" + host + "\n", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature := s.signature(now, canonicalRequest)
+	return s.endpoint.Scheme + "://" + host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+// do sends a signed request without body for key (the bucket when key is empty)
+func (s *S3) do(ctx context.Context, method, key string, query url.Values) (*http.Response, error) {
+	host, path := s.location(key)
+	target := s.endpoint.Scheme + "://" + host + path
+	canonicalQuery := canonicalQueryString(query)
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, host, path, canonicalQuery, sha256Hex(nil))
+	return s.client.Do(req)
+}
+
+// sign adds the SigV4 authorization of req to its headers
+func (s *S3) sign(req *http.Request, host, path, canonicalQuery, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var canonicalHeaders, signedHeaders string
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		canonicalHeaders = "content-type:" + contentType + "\n"
+		signedHeaders = "content-type;"
+	}
+	canonicalHeaders += "host:" + host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders += "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, canonicalQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, s.scope(now), signedHeaders, s.signature(now, canonicalRequest)))
+}
+
+// scope returns the credential scope of a request signed at now
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with the key derived for the day of now
+func (s *S3) signature(now time.Time, canonicalRequest string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + s.scope(now) + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// checkResponse returns an error carrying the start of the body for a non-2xx response
+func checkResponse(resp *http.Response, operation string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %s returned status %d: %s", operation, resp.StatusCode, strings.TrimSpace(string(detail)))
+}
+
+// canonicalQueryString encodes query sorted by name, as SigV4 requires
+func canonicalQueryString(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes s as SigV4 requires: everything but unreserved characters, and
+// '/' too when encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
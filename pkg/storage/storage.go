@@ -0,0 +1,127 @@
+// Package storage stores the server's artifacts (session recordings, workspace snapshots,
+// stored environment archives and exports) in one backend: a local directory or an
+// S3-compatible bucket, selected in the storage settings. Objects are addressed by
+// slash-separated keys and streamed in and out; the S3 backend can also hand out presigned
+// download URLs so large artifacts bypass the server.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sciffer/agentbox/internal/config"
+)
+
+// ErrNotFound is returned by Get for a key that has no object
+var ErrNotFound = errors.New("object not found")
+
+// ErrPresignNotSupported is returned by PresignGet of backends that cannot hand out URLs
+var ErrPresignNotSupported = errors.New("presigned URLs are not supported by this storage backend")
+
+// Object describes a stored object
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Backend stores objects by key
+type Backend interface {
+	// Put stores the content read from r under key, replacing any object with that key. The
+	// object only becomes visible once r is read to the end; a failed Put leaves no object.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Get opens the object stored under key; it returns ErrNotFound when there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete deletes the object stored under key; deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns the objects whose keys start with prefix, ordered by key
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// PresignGet returns a URL the object can be downloaded from without credentials until
+	// expiry passes; it returns ErrPresignNotSupported when the backend cannot
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// New creates the backend configured in cfg; it returns nil when no backend is configured
+func New(cfg config.StorageConfig) (Backend, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case config.StorageBackendLocal:
+		return NewLocal(cfg.Directory)
+	case config.StorageBackendS3:
+		// No overall timeout: objects are streamed and can be large; requests end with their context
+		return NewS3(cfg.S3, &http.Client{})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.Backend)
+	}
+}
+
+// CheckKey reports whether key can name an object: a relative, slash-separated path without
+// empty, "." or ".." segments
+func CheckKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || path.Clean(key) != key ||
+		key == "." || key == ".." || strings.HasPrefix(key, "../") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid object key %q", key)
+	}
+	return nil
+}
+
+// ========== Prefixed backend ==========
+
+// WithPrefix returns a view of b that stores every key under prefix (e.g. "snapshots/"), so
+// several features can share one backend. The keys it lists are relative to prefix.
+func WithPrefix(b Backend, prefix string) Backend {
+	if prefix == "" {
+		return b
+	}
+	return &prefixed{backend: b, prefix: prefix}
+}
+
+type prefixed struct {
+	backend Backend
+	prefix  string
+}
+
+func (p *prefixed) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	return p.backend.Put(ctx, p.prefix+key, r, contentType)
+}
+
+func (p *prefixed) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return p.backend.Get(ctx, p.prefix+key)
+}
+
+func (p *prefixed) Delete(ctx context.Context, key string) error {
+	return p.backend.Delete(ctx, p.prefix+key)
+}
+
+func (p *prefixed) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := p.backend.List(ctx, p.prefix+prefix)
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, p.prefix)
+	}
+	return objects, err
+}
+
+func (p *prefixed) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return p.backend.PresignGet(ctx, p.prefix+key, expiry)
+}
+
+// DeletePrefix deletes every object whose key starts with prefix
+func DeletePrefix(ctx context.Context, b Backend, prefix string) error {
+	objects, err := b.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := b.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
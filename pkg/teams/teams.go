@@ -0,0 +1,381 @@
+package teams
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/permissions"
+)
+
+// Team is a group of users that share ownership of environments
+type Team struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description,omitempty"`
+	Personal        bool      `json:"personal"`
+	OwnerID         string    `json:"owner_id,omitempty"`
+	MaxEnvironments int       `json:"max_environments"` // 0 = unlimited
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Member is a user's membership in a team; Role is a permission level (viewer, editor, owner)
+// applied to every environment of the team
+type Member struct {
+	TeamID  string    `json:"team_id"`
+	UserID  string    `json:"user_id"`
+	Role    string    `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// CreateTeamRequest is the request to create a team
+type CreateTeamRequest struct {
+	Name            string `json:"name"`
+	Description     string `json:"description,omitempty"`
+	MaxEnvironments int    `json:"max_environments,omitempty"`
+}
+
+// UpdateTeamRequest is the request to update a team (only non-nil fields are applied)
+type UpdateTeamRequest struct {
+	Name            *string `json:"name,omitempty"`
+	Description     *string `json:"description,omitempty"`
+	MaxEnvironments *int    `json:"max_environments,omitempty"`
+}
+
+// Service handles team operations
+type Service struct {
+	db     *database.DB
+	logger *zap.Logger
+}
+
+// NewService creates a new team service
+func NewService(db *database.DB, logger *zap.Logger) *Service {
+	return &Service{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// CreateTeam creates a team and adds the creator as its owner
+func (s *Service) CreateTeam(ctx context.Context, req *CreateTeamRequest, ownerID string) (*Team, error) {
+	if req.Name == "" {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "team name is required")
+	}
+	if req.MaxEnvironments < 0 {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "max_environments must be >= 0")
+	}
+	if err := s.checkNameFree(ctx, req.Name, ""); err != nil {
+		return nil, err
+	}
+
+	id := uuid.New().String()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			//nolint:errcheck // Best effort rollback on error path, error is already being returned
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO teams (id, name, description, personal, owner_id, max_environments, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
+	`, id, req.Name, nullString(req.Description), false, nullString(ownerID), req.MaxEnvironments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create team: %w", err)
+	}
+
+	if ownerID != "" {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO team_members (id, team_id, user_id, role, added_at)
+			VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		`, uuid.New().String(), id, ownerID, permissions.PermissionOwner)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add team owner: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.logger.Info("team created", zap.String("team_id", id), zap.String("name", req.Name), zap.String("owner_id", ownerID))
+
+	return s.GetTeam(ctx, id)
+}
+
+// GetTeam returns a team by ID
+func (s *Service) GetTeam(ctx context.Context, id string) (*Team, error) {
+	team, err := scanTeam(s.db.QueryRowContext(ctx, `
+		SELECT id, name, description, personal, owner_id, max_environments, created_at
+		FROM teams
+		WHERE id = $1
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, apierrors.New(apierrors.NotFound, apierrors.CodeTeamNotFound, "team not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get team: %w", err)
+	}
+	return team, nil
+}
+
+// ListTeams returns all teams
+func (s *Service) ListTeams(ctx context.Context) ([]*Team, error) {
+	return s.queryTeams(ctx, `
+		SELECT id, name, description, personal, owner_id, max_environments, created_at
+		FROM teams
+		ORDER BY name ASC
+	`)
+}
+
+// ListUserTeams returns the teams a user is a member of
+func (s *Service) ListUserTeams(ctx context.Context, userID string) ([]*Team, error) {
+	return s.queryTeams(ctx, `
+		SELECT t.id, t.name, t.description, t.personal, t.owner_id, t.max_environments, t.created_at
+		FROM teams t
+		JOIN team_members m ON m.team_id = t.id
+		WHERE m.user_id = $1
+		ORDER BY t.name ASC
+	`, userID)
+}
+
+// checkNameFree returns a Conflict error when a team other than exceptID is named name
+func (s *Service) checkNameFree(ctx context.Context, name, exceptID string) error {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM teams WHERE name = $1`, name).Scan(&id)
+	if err == sql.ErrNoRows || (err == nil && id == exceptID) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check team name: %w", err)
+	}
+	return apierrors.New(apierrors.Conflict, apierrors.CodeTeamNameTaken, "team name already exists")
+}
+
+// UpdateTeam applies a partial update to a team
+func (s *Service) UpdateTeam(ctx context.Context, id string, req *UpdateTeamRequest) (*Team, error) {
+	team, err := s.GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "team name is required")
+		}
+		if err := s.checkNameFree(ctx, *req.Name, id); err != nil {
+			return nil, err
+		}
+		team.Name = *req.Name
+	}
+	if req.Description != nil {
+		team.Description = *req.Description
+	}
+	if req.MaxEnvironments != nil {
+		if *req.MaxEnvironments < 0 {
+			return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "max_environments must be >= 0")
+		}
+		team.MaxEnvironments = *req.MaxEnvironments
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE teams SET name = $1, description = $2, max_environments = $3
+		WHERE id = $4
+	`, team.Name, nullString(team.Description), team.MaxEnvironments, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update team: %w", err)
+	}
+
+	s.logger.Info("team updated", zap.String("team_id", id))
+
+	return team, nil
+}
+
+// DeleteTeam deletes a team; its environments are kept but no longer belong to a team
+func (s *Service) DeleteTeam(ctx context.Context, id string) error {
+	if _, err := s.GetTeam(ctx, id); err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE environments SET team_id = NULL, version = version + 1, updated_at = $1 WHERE team_id = $2",
+		time.Now().UTC(), id); err != nil {
+		return fmt.Errorf("failed to detach team environments: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM teams WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete team: %w", err)
+	}
+
+	s.logger.Info("team deleted", zap.String("team_id", id))
+
+	return nil
+}
+
+// ListMembers returns the members of a team
+func (s *Service) ListMembers(ctx context.Context, teamID string) ([]*Member, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT team_id, user_id, role, added_at
+		FROM team_members
+		WHERE team_id = $1
+		ORDER BY added_at ASC
+	`, teamID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list team members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []*Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.TeamID, &m.UserID, &m.Role, &m.AddedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan team member: %w", err)
+		}
+		members = append(members, &m)
+	}
+
+	return members, rows.Err()
+}
+
+// AddMember adds a user to a team or changes their role if already a member
+func (s *Service) AddMember(ctx context.Context, teamID, userID, role string) (*Member, error) {
+	if !permissions.ValidatePermission(role) {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "invalid team role: %s", role)
+	}
+	if _, err := s.GetTeam(ctx, teamID); err != nil {
+		return nil, err
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO team_members (id, team_id, user_id, role, added_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		ON CONFLICT (team_id, user_id) DO UPDATE SET
+			role = EXCLUDED.role
+	`, uuid.New().String(), teamID, userID, role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add team member: %w", err)
+	}
+
+	s.logger.Info("team member added",
+		zap.String("team_id", teamID),
+		zap.String("user_id", userID),
+		zap.String("role", role),
+	)
+
+	return s.GetMember(ctx, teamID, userID)
+}
+
+// GetMember returns a user's membership in a team, or nil if the user is not a member
+func (s *Service) GetMember(ctx context.Context, teamID, userID string) (*Member, error) {
+	var m Member
+	err := s.db.QueryRowContext(ctx, `
+		SELECT team_id, user_id, role, added_at
+		FROM team_members
+		WHERE team_id = $1 AND user_id = $2
+	`, teamID, userID).Scan(&m.TeamID, &m.UserID, &m.Role, &m.AddedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get team member: %w", err)
+	}
+	return &m, nil
+}
+
+// RemoveMember removes a user from a team
+func (s *Service) RemoveMember(ctx context.Context, teamID, userID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM team_members
+		WHERE team_id = $1 AND user_id = $2
+	`, teamID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove team member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return apierrors.New(apierrors.NotFound, apierrors.CodeTeamMemberNotFound, "team member not found")
+	}
+
+	s.logger.Info("team member removed", zap.String("team_id", teamID), zap.String("user_id", userID))
+
+	return nil
+}
+
+// CheckQuota returns an error when the team has reached its environment limit
+func (s *Service) CheckQuota(ctx context.Context, teamID string) error {
+	team, err := s.GetTeam(ctx, teamID)
+	if err != nil {
+		return err
+	}
+	if team.MaxEnvironments <= 0 {
+		return nil
+	}
+
+	count, err := s.db.CountEnvironmentsByTeam(ctx, teamID)
+	if err != nil {
+		return err
+	}
+	if count >= team.MaxEnvironments {
+		return apierrors.New(apierrors.QuotaExceeded, apierrors.CodeTeamQuotaExceeded, "team environment quota exceeded (%d/%d)", count, team.MaxEnvironments)
+	}
+
+	return nil
+}
+
+// queryTeams runs a team SELECT and scans all rows
+func (s *Service) queryTeams(ctx context.Context, query string, args ...interface{}) ([]*Team, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list teams: %w", err)
+	}
+	defer rows.Close()
+
+	var teams []*Team
+	for rows.Next() {
+		team, err := scanTeam(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan team: %w", err)
+		}
+		teams = append(teams, team)
+	}
+
+	return teams, rows.Err()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTeam scans a single team row
+func scanTeam(row rowScanner) (*Team, error) {
+	var team Team
+	var description, ownerID sql.NullString
+
+	if err := row.Scan(&team.ID, &team.Name, &description, &team.Personal, &ownerID, &team.MaxEnvironments, &team.CreatedAt); err != nil {
+		return nil, err
+	}
+	team.Description = description.String
+	team.OwnerID = ownerID.String
+
+	return &team, nil
+}
+
+// nullString converts an empty string to SQL NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,32 @@
+package users
+
+import "strings"
+
+// commonPasswords are the most frequent passwords of public breach corpora (lowercase). Only
+// passwords a length policy of 8 lets through are worth listing.
+var commonPasswords = map[string]struct{}{}
+
+func init() {
+	for _, p := range strings.Fields(`
+		password password1 password12 password123 password1234 passw0rd p@ssw0rd p@ssword
+		12345678 123456789 1234567890 12341234 11111111 00000000 88888888 87654321 11223344
+		123123123 1q2w3e4r 1q2w3e4r5t 1qaz2wsx qwertyuiop qwerty123 qwerty12 qwertyui
+		asdfghjk asdfghjkl zxcvbnm1 abcd1234 abc12345 abcdefgh aa123456 a1234567 q1w2e3r4
+		iloveyou iloveyou1 sunshine princess football baseball basketball superman batman12
+		trustno1 welcome1 welcome123 letmein1 letmein123 monkey123 dragon123 master123
+		admin123 administrator adminadmin changeme changeme123 default1 secret123 test1234
+		testtest computer internet starwars whatever michelle jennifer jordan23 charlie1
+		shadow12 freedom1 mustang1 liverpool chelsea1 arsenal1 samsung1 zaq12wsx 1qazxsw2
+		qazwsxedc qweasdzxc 123qweasd 123abc123 987654321 666666666 999999999 555555555
+		loveyou1 lovelove babygirl1 pokemon1 minecraft letmein! welcome! password!
+		agentbox agentbox1 agentbox123 kubernetes
+	`) {
+		commonPasswords[p] = struct{}{}
+	}
+}
+
+// isCommonPassword reports whether password (in any letter case) is a well-known password
+func isCommonPassword(password string) bool {
+	_, ok := commonPasswords[strings.ToLower(password)]
+	return ok
+}
@@ -1,7 +1,14 @@
 package users
 
 import (
+	"fmt"
+	"strings"
+	"unicode"
+
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/validator"
 )
 
 const (
@@ -9,6 +16,12 @@ const (
 	DefaultCost = 10
 )
 
+// DefaultPasswordMinLength is the minimum password length enforced until SetPasswordPolicy is called
+const DefaultPasswordMinLength = 8
+
+// maxPasswordBytes is the longest password bcrypt hashes without truncating it
+const maxPasswordBytes = 72
+
 // hashPassword hashes a password using bcrypt
 func hashPassword(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), DefaultCost)
@@ -23,3 +36,73 @@ func VerifyPassword(hash, password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// SetPasswordPolicy sets the policy passwords must satisfy when they are set (existing passwords
+// keep working)
+func (s *Service) SetPasswordPolicy(policy config.PasswordPolicyConfig) {
+	s.passwordPolicy = policy
+}
+
+// CheckPassword reports every way password violates the password policy as validation errors
+// on field; username is the user the password is for
+func (s *Service) CheckPassword(field, username, password string) error {
+	policy := s.passwordPolicy
+	var errs validator.ValidationErrors
+	add := func(code, format string, args ...interface{}) {
+		errs = append(errs, validator.ValidationError{Field: field, Code: code, Message: field + ": " + fmt.Sprintf(format, args...)})
+	}
+
+	if password == "" {
+		add(validator.CodeRequired, "is required")
+		return errs
+	}
+	if n := len([]rune(password)); n < policy.MinLength {
+		add(validator.CodeTooShort, "must be at least %d characters, got %d", policy.MinLength, n)
+	}
+	if len(password) > maxPasswordBytes {
+		add(validator.CodeTooLong, "must be at most %d bytes", maxPasswordBytes)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	var missing []string
+	if policy.RequireUppercase && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if policy.RequireLowercase && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		missing = append(missing, "a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		add(validator.CodeInvalidFormat, "must contain %s", strings.Join(missing, ", "))
+	}
+
+	if policy.RejectCommon {
+		if username != "" && strings.EqualFold(password, username) {
+			add(validator.CodeInvalidValue, "must not be the username")
+		} else if isCommonPassword(password) {
+			add(validator.CodeInvalidValue, "is too common")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -10,9 +11,17 @@ import (
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/database"
 )
 
+// ErrUserNotFound is returned by lookups that match no user
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrInvalidRole is returned when a user is given a role that does not exist
+var ErrInvalidRole = errors.New("invalid role")
+
 // User status constants
 const (
 	StatusActive   = "active"
@@ -30,13 +39,18 @@ const (
 type Service struct {
 	db     *database.DB
 	logger *zap.Logger
+
+	// passwordPolicy is enforced whenever a password is set (see SetPasswordPolicy)
+	passwordPolicy config.PasswordPolicyConfig
 }
 
-// NewService creates a new user service
+// NewService creates a new user service. Passwords only need DefaultPasswordMinLength characters
+// until the configured policy is installed with SetPasswordPolicy.
 func NewService(db *database.DB, logger *zap.Logger) *Service {
 	return &Service{
-		db:     db,
-		logger: logger,
+		db:             db,
+		logger:         logger,
+		passwordPolicy: config.PasswordPolicyConfig{MinLength: DefaultPasswordMinLength},
 	}
 }
 
@@ -60,6 +74,8 @@ type CreateUserRequest struct {
 	Password string
 	Role     string
 	Status   string
+	// ExternalID is the identity provider subject of SSO users
+	ExternalID string
 }
 
 // EnsureDefaultAdmin ensures the default admin user exists
@@ -84,7 +100,12 @@ func (s *Service) EnsureDefaultAdmin(ctx context.Context) error {
 
 	if !exists {
 		s.logger.Info("creating default admin user", zap.String("username", adminUsername))
-		_, err := s.CreateUser(ctx, &CreateUserRequest{
+		// The operator chose this password, so it is created even when it violates the policy
+		if err := s.CheckPassword("password", adminUsername, adminPassword); err != nil {
+			s.logger.Warn("default admin password does not satisfy the password policy; change it after the first login",
+				zap.String("username", adminUsername), zap.Error(err))
+		}
+		_, err := s.insertUser(ctx, &CreateUserRequest{
 			Username: adminUsername,
 			Email:    adminEmail,
 			Password: adminPassword,
@@ -110,8 +131,37 @@ func (s *Service) userExists(ctx context.Context, username string) (bool, error)
 	return count > 0, nil
 }
 
-// CreateUser creates a new user
+// CreateUser creates a new user. A password, when given, must satisfy the password policy
+// (validator.ValidationErrors otherwise); single sign-on users have none.
 func (s *Service) CreateUser(ctx context.Context, req *CreateUserRequest) (*User, error) {
+	if err := s.validateRole(ctx, req.Role); err != nil {
+		return nil, err
+	}
+	if req.Password != "" {
+		if err := s.CheckPassword("password", req.Username, req.Password); err != nil {
+			return nil, err
+		}
+	}
+	return s.insertUser(ctx, req)
+}
+
+// validateRole checks that role is a built-in role or one of the roles created by admins
+func (s *Service) validateRole(ctx context.Context, role string) error {
+	if role == RoleUser || role == RoleAdmin || role == RoleSuperAdmin {
+		return nil
+	}
+	var count int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM roles WHERE name = $1", role).Scan(&count); err != nil {
+		return fmt.Errorf("failed to check role: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidRole, role)
+	}
+	return nil
+}
+
+// insertUser stores a new user without checking its password against the policy
+func (s *Service) insertUser(ctx context.Context, req *CreateUserRequest) (*User, error) {
 	id := uuid.New().String()
 
 	var passwordHash sql.NullString
@@ -127,11 +177,15 @@ func (s *Service) CreateUser(ctx context.Context, req *CreateUserRequest) (*User
 	if req.Email != "" {
 		email = sql.NullString{String: req.Email, Valid: true}
 	}
+	var externalID sql.NullString
+	if req.ExternalID != "" {
+		externalID = sql.NullString{String: req.ExternalID, Valid: true}
+	}
 
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO users (id, username, email, password_hash, role, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-	`, id, req.Username, email, passwordHash, req.Role, req.Status)
+		INSERT INTO users (id, username, email, password_hash, role, status, external_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`, id, req.Username, email, passwordHash, req.Role, req.Status, externalID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
@@ -155,7 +209,7 @@ func (s *Service) GetUserByID(ctx context.Context, id string) (*User, error) {
 		&dbUser.UpdatedAt, &lastLogin,
 	)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
@@ -199,7 +253,7 @@ func (s *Service) GetUserByUsername(ctx context.Context, username string) (*User
 		&dbUser.UpdatedAt, &lastLogin,
 	)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
@@ -227,6 +281,63 @@ func (s *Service) GetUserByUsername(ctx context.Context, username string) (*User
 	return user, nil
 }
 
+// GetUserByExternalID retrieves the user linked to an identity provider subject
+func (s *Service) GetUserByExternalID(ctx context.Context, externalID string) (*User, error) {
+	return s.getUserWhere(ctx, "external_id", externalID)
+}
+
+// GetUserByEmail retrieves a user by email address
+func (s *Service) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.getUserWhere(ctx, "email", email)
+}
+
+// getUserWhere looks up the ID of the user whose column equals value and loads that user
+func (s *Service) getUserWhere(ctx context.Context, column, value string) (*User, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE "+column+" = $1", value).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return s.GetUserByID(ctx, id)
+}
+
+// GetExternalID returns the identity provider subject linked to a user ("" if none)
+func (s *Service) GetExternalID(ctx context.Context, userID string) (string, error) {
+	var externalID sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT external_id FROM users WHERE id = $1", userID).Scan(&externalID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user: %w", err)
+	}
+	return externalID.String, nil
+}
+
+// HasPassword reports whether a user can log in with a local password, i.e. was not created
+// by single sign-on
+func (s *Service) HasPassword(ctx context.Context, userID string) (bool, error) {
+	var passwordHash sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = $1", userID).Scan(&passwordHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to get user: %w", err)
+	}
+	return passwordHash.Valid && passwordHash.String != "", nil
+}
+
+// SetExternalID links a user to an identity provider subject
+func (s *Service) SetExternalID(ctx context.Context, userID, externalID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET external_id = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, userID, externalID)
+	if err != nil {
+		return fmt.Errorf("failed to link external identity: %w", err)
+	}
+	return nil
+}
+
 // GetUserWithPassword retrieves a user with password hash for authentication
 func (s *Service) GetUserWithPassword(ctx context.Context, username string) (*User, string, error) {
 	var dbUser database.User
@@ -243,7 +354,7 @@ func (s *Service) GetUserWithPassword(ctx context.Context, username string) (*Us
 		&dbUser.UpdatedAt, &lastLogin,
 	)
 	if err == sql.ErrNoRows {
-		return nil, "", fmt.Errorf("user not found")
+		return nil, "", ErrUserNotFound
 	}
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to get user: %w", err)
@@ -339,8 +450,17 @@ func (s *Service) ListUsers(ctx context.Context, limit, offset int) ([]*User, er
 	return users, nil
 }
 
-// UpdatePassword updates a user's password
+// UpdatePassword updates a user's password; it must satisfy the password policy
+// (validator.ValidationErrors otherwise)
 func (s *Service) UpdatePassword(ctx context.Context, userID, newPassword string) error {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.CheckPassword("password", user.Username, newPassword); err != nil {
+		return err
+	}
+
 	hash, err := hashPassword(newPassword)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
@@ -367,14 +487,25 @@ type UpdateUserRequest struct {
 	Password *string `json:"password,omitempty"`
 }
 
-// UpdateUser updates a user's information
+// UpdateUser updates a user's information. A new password must satisfy the password policy
+// (validator.ValidationErrors otherwise).
 func (s *Service) UpdateUser(ctx context.Context, userID string, req *UpdateUserRequest) (*User, error) {
 	// Verify user exists
-	_, err := s.GetUserByID(ctx, userID)
+	existing, err := s.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
+	if req.Password != nil && *req.Password != "" {
+		username := existing.Username
+		if req.Username != nil {
+			username = *req.Username
+		}
+		if err := s.CheckPassword("password", username, *req.Password); err != nil {
+			return nil, err
+		}
+	}
+
 	// Build dynamic update query
 	updates := []string{}
 	args := []interface{}{}
@@ -398,9 +529,8 @@ func (s *Service) UpdateUser(ctx context.Context, userID string, req *UpdateUser
 	}
 
 	if req.Role != nil {
-		// Validate role
-		if *req.Role != RoleUser && *req.Role != RoleAdmin && *req.Role != RoleSuperAdmin {
-			return nil, fmt.Errorf("invalid role: %s", *req.Role)
+		if err := s.validateRole(ctx, *req.Role); err != nil {
+			return nil, err
 		}
 		updates = append(updates, fmt.Sprintf("role = $%d", argIdx))
 		args = append(args, *req.Role)
@@ -449,29 +579,73 @@ func (s *Service) UpdateUser(ctx context.Context, userID string, req *UpdateUser
 
 // DeleteUser deletes a user by ID
 // Note: This will cascade delete all related records (API keys, permissions)
-func (s *Service) DeleteUser(ctx context.Context, userID string) error {
+// A user who still owns environments is only deleted with transferTo, the user who becomes their
+// owner; the environments are reassigned in the same transaction, with deletedBy granting the
+// new owner's permissions. Returns the transferred environment IDs.
+func (s *Service) DeleteUser(ctx context.Context, userID, transferTo, deletedBy string) (transferred []string, err error) {
 	// Verify user exists
-	_, err := s.GetUserByID(ctx, userID)
+	if _, err := s.GetUserByID(ctx, userID); err != nil {
+		return nil, err
+	}
+	if transferTo == userID {
+		return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeBadRequest, "cannot transfer environments to the deleted user")
+	}
+	if transferTo != "" {
+		if _, err := s.GetUserByID(ctx, transferTo); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				return nil, apierrors.New(apierrors.ValidationFailed, apierrors.CodeUserNotFound, "transfer_to user %s not found", transferTo)
+			}
+			return nil, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			//nolint:errcheck // Best effort rollback on error path, error is already being returned
+			tx.Rollback()
+		}
+	}()
 
-	result, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+	owned, err := database.ListEnvironmentIDsByOwnerTx(ctx, tx, userID)
 	if err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
+		return nil, err
+	}
+	if len(owned) > 0 {
+		if transferTo == "" {
+			err = apierrors.New(apierrors.Conflict, apierrors.CodeUserOwnsEnvironments,
+				"user owns %d environments (%s); delete them or pass transfer_to", len(owned), joinStrings(owned, ", "))
+			return nil, err
+		}
+		if err = database.TransferEnvironmentsTx(ctx, tx, owned, userID, transferTo, deletedBy); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete user: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("user not found")
+		err = ErrUserNotFound
+		return nil, err
 	}
 
-	s.logger.Info("user deleted", zap.String("user_id", userID))
-	return nil
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.logger.Info("user deleted", zap.String("user_id", userID), zap.Int("environments_transferred", len(owned)))
+	return owned, nil
 }
 
 // GetUserCount returns the total number of users
@@ -0,0 +1,129 @@
+package validator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+var (
+	// labelNameRegex is the name part of a Kubernetes label key (after the optional "prefix/")
+	labelNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	// labelPrefixRegex is the DNS subdomain prefix of a Kubernetes label key
+	labelPrefixRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// maxAffinityTerms bounds each list of node terms; the scheduler evaluates all of them per node
+const maxAffinityTerms = 10
+
+// ValidateAffinity validates an environment affinity.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateAffinity(affinity *models.Affinity) error {
+	var errs ValidationErrors
+	validateAffinity(&errs, affinity)
+	return errs.err()
+}
+
+// validateAffinity validates node terms (operators, label keys and values, weights) and the pod
+// anti-affinity
+func validateAffinity(errs *ValidationErrors, affinity *models.Affinity) {
+	if len(affinity.RequiredNodeTerms) > maxAffinityTerms {
+		errs.add("affinity.required_node_terms", CodeOutOfRange, "affinity.required_node_terms must have %d terms or less", maxAffinityTerms)
+	}
+	for i, term := range affinity.RequiredNodeTerms {
+		validateNodeSelectorRequirements(errs, fmt.Sprintf("affinity.required_node_terms[%d]", i), term.MatchExpressions)
+	}
+
+	if len(affinity.PreferredNodeTerms) > maxAffinityTerms {
+		errs.add("affinity.preferred_node_terms", CodeOutOfRange, "affinity.preferred_node_terms must have %d terms or less", maxAffinityTerms)
+	}
+	for i, term := range affinity.PreferredNodeTerms {
+		prefix := fmt.Sprintf("affinity.preferred_node_terms[%d]", i)
+		if term.Weight < 1 || term.Weight > 100 {
+			errs.add(prefix+".weight", CodeOutOfRange, "%s.weight must be between 1 and 100", prefix)
+		}
+		validateNodeSelectorRequirements(errs, prefix, term.MatchExpressions)
+	}
+
+	if anti := affinity.PodAntiAffinity; anti != nil {
+		for _, k := range sortedKeys(anti.MatchLabels) {
+			field := "affinity.pod_anti_affinity.match_labels." + k
+			if msg := labelKeyError(k); msg != "" {
+				errs.add(field, CodeInvalidFormat, "%s: %s", field, msg)
+			}
+			if msg := labelValueError(anti.MatchLabels[k]); msg != "" {
+				errs.add(field, CodeInvalidFormat, "%s: %s", field, msg)
+			}
+		}
+		if anti.TopologyKey != "" {
+			if msg := labelKeyError(anti.TopologyKey); msg != "" {
+				errs.add("affinity.pod_anti_affinity.topology_key", CodeInvalidFormat, "affinity.pod_anti_affinity.topology_key: %s", msg)
+			}
+		}
+		if anti.Weight != 0 && anti.Required {
+			errs.add("affinity.pod_anti_affinity.weight", CodeInvalidValue, "affinity.pod_anti_affinity.weight cannot be set when required is true")
+		} else if anti.Weight < 0 || anti.Weight > 100 {
+			errs.add("affinity.pod_anti_affinity.weight", CodeOutOfRange, "affinity.pod_anti_affinity.weight must be between 1 and 100")
+		}
+	}
+}
+
+// validateNodeSelectorRequirements validates the match expressions of a node term
+func validateNodeSelectorRequirements(errs *ValidationErrors, prefix string, reqs []models.NodeSelectorRequirement) {
+	if len(reqs) == 0 {
+		errs.add(prefix+".match_expressions", CodeRequired, "%s.match_expressions cannot be empty", prefix)
+		return
+	}
+	for i, req := range reqs {
+		field := fmt.Sprintf("%s.match_expressions[%d]", prefix, i)
+		if msg := labelKeyError(req.Key); msg != "" {
+			errs.add(field+".key", CodeInvalidFormat, "%s.key: %s", field, msg)
+		}
+		switch req.Operator {
+		case models.NodeSelectorOpIn, models.NodeSelectorOpNotIn:
+			if len(req.Values) == 0 {
+				errs.add(field+".values", CodeRequired, "%s.values cannot be empty with operator '%s'", field, req.Operator)
+			}
+		case models.NodeSelectorOpExists:
+			if len(req.Values) > 0 {
+				errs.add(field+".values", CodeInvalidValue, "%s.values must be empty with operator 'Exists'", field)
+			}
+		default:
+			errs.add(field+".operator", CodeInvalidValue, "%s.operator must be 'In', 'NotIn' or 'Exists'", field)
+		}
+		for _, value := range req.Values {
+			if msg := labelValueError(value); msg != "" {
+				errs.add(field+".values", CodeInvalidFormat, "%s.values: %s", field, msg)
+			}
+		}
+	}
+}
+
+// labelKeyError describes why key is not a valid Kubernetes label key ("" when it is)
+func labelKeyError(key string) string {
+	if key == "" {
+		return "label key cannot be empty"
+	}
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if prefix == "" || len(prefix) > 253 || !labelPrefixRegex.MatchString(prefix) {
+			return fmt.Sprintf("invalid label key prefix '%s'", prefix)
+		}
+	}
+	if len(name) > 63 || !labelNameRegex.MatchString(name) {
+		return fmt.Sprintf("invalid label key '%s'", key)
+	}
+	return ""
+}
+
+// labelValueError describes why value is not a valid Kubernetes label value ("" when it is)
+func labelValueError(value string) string {
+	if value != "" && (len(value) > 63 || !labelNameRegex.MatchString(value)) {
+		return fmt.Sprintf("invalid label value '%s'", value)
+	}
+	return ""
+}
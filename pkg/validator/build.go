@@ -0,0 +1,58 @@
+package validator
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// maxDockerfileBytes caps the Dockerfile of a build section
+const maxDockerfileBytes = 64 * 1024
+
+// gitRefRegex matches refs (refs/heads/main) and commit SHAs, without anything the build
+// context URL would interpret
+var gitRefRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// validateBuild validates the build section of an environment creation request
+func validateBuild(errs *ValidationErrors, build *models.BuildSpec) {
+	switch {
+	case build.Dockerfile != "" && build.GitURL != "":
+		errs.add("build", CodeInvalidValue, "build must specify exactly one of dockerfile or git_url")
+	case build.Dockerfile != "":
+		if len(build.Dockerfile) > maxDockerfileBytes {
+			errs.add("build.dockerfile", CodeTooLong, "build.dockerfile must be %d bytes or less", maxDockerfileBytes)
+		}
+		for _, f := range []struct{ name, value string }{
+			{"git_ref", build.GitRef}, {"context_path", build.ContextPath}, {"dockerfile_path", build.DockerfilePath},
+		} {
+			if f.value != "" {
+				errs.add("build."+f.name, CodeInvalidValue, "build.%s is only supported with git_url", f.name)
+			}
+		}
+	case build.GitURL != "":
+		if u, err := url.Parse(build.GitURL); err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			errs.add("build.git_url", CodeInvalidFormat, "build.git_url must be an https URL without credentials, query or fragment")
+		}
+		if build.GitRef != "" && (!gitRefRegex.MatchString(build.GitRef) || strings.Contains(build.GitRef, "..")) {
+			errs.add("build.git_ref", CodeInvalidFormat, "build.git_ref must be a ref such as refs/heads/main or a commit SHA")
+		}
+		validateBuildPath(errs, "build.context_path", build.ContextPath)
+		validateBuildPath(errs, "build.dockerfile_path", build.DockerfilePath)
+	default:
+		errs.add("build", CodeRequired, "build must specify exactly one of dockerfile or git_url")
+	}
+}
+
+// validateBuildPath checks that p is a relative path that stays inside the build context
+func validateBuildPath(errs *ValidationErrors, field, p string) {
+	if p == "" {
+		return
+	}
+	clean := path.Clean(p)
+	if path.IsAbs(p) || clean == ".." || strings.HasPrefix(clean, "../") || strings.ContainsAny(p, "#?\\") {
+		errs.add(field, CodeInvalidFormat, "%s must be a relative path inside the repository", field)
+	}
+}
@@ -0,0 +1,320 @@
+package validator
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// Command policy rules reported in a CommandPolicyViolation
+const (
+	PolicyRuleDenyPattern      = "deny_pattern"
+	PolicyRuleBinaryNotAllowed = "binary_not_allowed"
+	PolicyRuleArgTooLong       = "argument_too_long"
+	PolicyRuleInvalidArgument  = "invalid_argument"
+)
+
+// CommandPolicyViolation is returned when a command is rejected by a command policy
+type CommandPolicyViolation struct {
+	Rule    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *CommandPolicyViolation) Error() string {
+	return e.Message
+}
+
+var (
+	// patternCache holds compiled deny patterns keyed by their source
+	patternCache sync.Map
+
+	escapeRegex     = regexp.MustCompile(`\\(x[0-9a-fA-F]{2}|u[0-9a-fA-F]{4}|[0-7]{3})`)
+	ifsRegex        = regexp.MustCompile(`\$\{?IFS\}?`)
+	emptyParamRegex = regexp.MustCompile(`\$\{?[@*]\}?`)
+	spaceRegex      = regexp.MustCompile(`\s+`)
+	assignmentRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+)
+
+// shells are programs whose -c argument is a script of further commands
+var shells = map[string]bool{"sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true, "ash": true}
+
+// wrappers are programs that run their first non-option argument as a command
+var wrappers = map[string]bool{
+	"env": true, "exec": true, "nohup": true, "nice": true, "timeout": true, "xargs": true,
+	"sudo": true, "command": true, "stdbuf": true, "time": true,
+}
+
+// shellKeywords may precede a command in a script without being one
+var shellKeywords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true, "do": true, "done": true,
+	"while": true, "until": true, "for": true, "in": true, "case": true, "esac": true, "!": true,
+}
+
+// ValidateCommandPolicy validates an environment command policy.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateCommandPolicy(policy *models.CommandPolicy) error {
+	var errs ValidationErrors
+	validateCommandPolicy(&errs, policy)
+	return errs.err()
+}
+
+// validateCommandPolicy validates deny patterns, allowed binaries and the argument limit
+func validateCommandPolicy(errs *ValidationErrors, policy *models.CommandPolicy) {
+	for i, p := range policy.DenyPatterns {
+		if _, err := compilePattern(p); err != nil {
+			errs.add(fmt.Sprintf("command_policy.deny_patterns[%d]", i), CodeInvalidFormat, "invalid deny pattern %q: %v", p, err)
+		}
+	}
+	for i, b := range policy.AllowedBinaries {
+		if strings.TrimSpace(b) == "" {
+			errs.add(fmt.Sprintf("command_policy.allowed_binaries[%d]", i), CodeInvalidValue, "allowed binary cannot be empty")
+		}
+	}
+	if policy.MaxArgLength < 0 {
+		errs.add("command_policy.max_arg_length", CodeOutOfRange, "max_arg_length cannot be negative")
+	}
+}
+
+// EvaluateCommandPolicy checks command against the server-wide policy combined with the
+// environment's policy (either may be nil). Deny patterns of both apply, the environment's
+// allowed binaries replace the global ones, and the smaller non-zero argument limit wins; an
+// unrestricted environment skips all checks. The returned error is a *CommandPolicyViolation.
+//
+// Deny patterns are matched against the command line as given and against a normalized form
+// with shell quoting, escapes ($'\x72m', \162) and $IFS / $@ tricks removed, so trivially
+// obfuscated variants of a denied command are caught too.
+func EvaluateCommandPolicy(command []string, global, env *models.CommandPolicy) error {
+	if env != nil && env.Unrestricted {
+		return nil
+	}
+	policy := mergeCommandPolicies(global, env)
+
+	for i, arg := range command {
+		if strings.ContainsRune(arg, 0) {
+			return &CommandPolicyViolation{
+				Rule:    PolicyRuleInvalidArgument,
+				Message: fmt.Sprintf("argument %d contains a NUL byte", i),
+			}
+		}
+		if policy.MaxArgLength > 0 && len(arg) > policy.MaxArgLength {
+			return &CommandPolicyViolation{
+				Rule:    PolicyRuleArgTooLong,
+				Message: fmt.Sprintf("argument %d is %d bytes long, the limit is %d", i, len(arg), policy.MaxArgLength),
+			}
+		}
+	}
+
+	if len(policy.DenyPatterns) > 0 {
+		raw := strings.Join(command, " ")
+		variants := []string{raw}
+		if normalized := normalizeCommandLine(raw); normalized != raw {
+			variants = append(variants, normalized)
+		}
+		for _, p := range policy.DenyPatterns {
+			re, err := compilePattern(p)
+			if err != nil {
+				// Fail closed: a policy that cannot be evaluated must not let commands through
+				return &CommandPolicyViolation{Rule: PolicyRuleDenyPattern, Message: fmt.Sprintf("invalid deny pattern %q", p)}
+			}
+			for _, s := range variants {
+				if re.MatchString(s) {
+					return &CommandPolicyViolation{
+						Rule:    PolicyRuleDenyPattern,
+						Message: fmt.Sprintf("command matches denied pattern %q", p),
+					}
+				}
+			}
+		}
+	}
+
+	if len(policy.AllowedBinaries) > 0 {
+		allowed := make(map[string]bool, len(policy.AllowedBinaries))
+		for _, b := range policy.AllowedBinaries {
+			allowed[path.Base(strings.TrimSpace(b))] = true
+		}
+		for _, b := range commandBinaries(command, 0) {
+			if !allowed[b] {
+				return &CommandPolicyViolation{
+					Rule:    PolicyRuleBinaryNotAllowed,
+					Message: fmt.Sprintf("binary %q is not in the allowed list", b),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeCommandPolicies combines the server-wide and environment policies into one
+func mergeCommandPolicies(global, env *models.CommandPolicy) models.CommandPolicy {
+	var merged models.CommandPolicy
+	for _, p := range []*models.CommandPolicy{global, env} {
+		if p == nil {
+			continue
+		}
+		merged.DenyPatterns = append(merged.DenyPatterns, p.DenyPatterns...)
+		if len(p.AllowedBinaries) > 0 {
+			merged.AllowedBinaries = p.AllowedBinaries
+		}
+		if p.MaxArgLength > 0 && (merged.MaxArgLength == 0 || p.MaxArgLength < merged.MaxArgLength) {
+			merged.MaxArgLength = p.MaxArgLength
+		}
+	}
+	return merged
+}
+
+// compilePattern compiles a deny pattern, caching the result
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if re, ok := patternCache.Load(p); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+	patternCache.Store(p, re)
+	return re, nil
+}
+
+// normalizeCommandLine undoes common shell obfuscation: escape sequences are decoded, quotes
+// and backslashes dropped, $IFS turned into a space, empty $@ / $* removed and whitespace collapsed
+func normalizeCommandLine(s string) string {
+	s = strings.NewReplacer(`$'`, `'`, `$"`, `"`).Replace(s)
+	s = escapeRegex.ReplaceAllStringFunc(s, decodeEscape)
+	s = ifsRegex.ReplaceAllString(s, " ")
+	s = emptyParamRegex.ReplaceAllString(s, "")
+	s = strings.NewReplacer(`'`, "", `"`, "", `\`, "", "`", " ").Replace(s)
+	return strings.TrimSpace(spaceRegex.ReplaceAllString(s, " "))
+}
+
+// decodeEscape decodes one \xHH, \uHHHH or \NNN (octal) escape sequence
+func decodeEscape(seq string) string {
+	var code uint64
+	var err error
+	switch seq[1] {
+	case 'x', 'u':
+		code, err = strconv.ParseUint(seq[2:], 16, 32)
+	default:
+		code, err = strconv.ParseUint(seq[1:], 8, 32)
+	}
+	if err != nil {
+		return seq
+	}
+	return string(rune(code))
+}
+
+// maxScriptDepth bounds recursion into nested shell scripts (bash -c "sh -c '...'")
+const maxScriptDepth = 4
+
+// commandBinaries returns the base names of every program the command would run: the program
+// itself, commands started through wrappers such as env or sudo, and each command of a shell -c
+// script
+func commandBinaries(argv []string, depth int) []string {
+	if len(argv) == 0 {
+		return nil
+	}
+	bin := path.Base(argv[0])
+	binaries := []string{bin}
+	if depth >= maxScriptDepth {
+		return binaries
+	}
+
+	if wrappers[bin] {
+		rest := argv[1:]
+		for len(rest) > 0 && (strings.HasPrefix(rest[0], "-") || assignmentRegex.MatchString(rest[0])) {
+			rest = rest[1:]
+		}
+		// timeout takes a duration before the command
+		if bin == "timeout" && len(rest) > 0 {
+			rest = rest[1:]
+		}
+		return append(binaries, commandBinaries(rest, depth+1)...)
+	}
+
+	if shells[bin] {
+		for i := 1; i < len(argv)-1; i++ {
+			flag := argv[i]
+			if strings.HasPrefix(flag, "-") && !strings.HasPrefix(flag, "--") && strings.Contains(flag, "c") {
+				binaries = append(binaries, scriptBinaries(argv[i+1], depth+1)...)
+				break
+			}
+		}
+	}
+	return binaries
+}
+
+// scriptBinaries returns the programs run by each simple command of a shell script
+func scriptBinaries(script string, depth int) []string {
+	var binaries []string
+	for _, segment := range splitScript(script) {
+		words := strings.Fields(normalizeCommandLine(segment))
+		for len(words) > 0 && (shellKeywords[words[0]] || assignmentRegex.MatchString(words[0])) {
+			words = words[1:]
+		}
+		binaries = append(binaries, commandBinaries(words, depth)...)
+	}
+	return binaries
+}
+
+// splitScript splits a shell script into simple commands at unquoted separators (; & | newline,
+// parentheses, braces) and at command substitutions, which also run inside double quotes
+func splitScript(script string) []string {
+	var segments []string
+	var cur strings.Builder
+	var quote rune
+	escaped := false
+	substitutions := 0 // open $( ) inside double quotes
+
+	split := func() {
+		segments = append(segments, cur.String())
+		cur.Reset()
+	}
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if !escaped && quote != '\'' && r == '$' && i+1 < len(runes) && runes[i+1] == '(' {
+			if quote == '"' {
+				substitutions++
+			}
+			split()
+			i++
+			continue
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote == '\'':
+			if r == quote {
+				quote = 0
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '`':
+				split()
+				continue
+			case r == ')' && substitutions > 0:
+				substitutions--
+				split()
+				continue
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case strings.ContainsRune(";&|\n(){}`", r):
+			split()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	split()
+	return segments
+}
@@ -0,0 +1,63 @@
+package validator
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// Kubernetes limits of PodDNSConfig
+const (
+	maxDNSNameservers    = 3
+	maxDNSSearches       = 32
+	maxDNSSearchListSize = 2048
+)
+
+// dnsSearchRegex is a DNS subdomain (an optional trailing dot is allowed)
+var dnsSearchRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*\.?$`)
+
+// validateDNSConfig validates the DNS policy, resolver IPs, search domains and options
+func validateDNSConfig(errs *ValidationErrors, dns *models.DNSConfig) {
+	switch dns.Policy {
+	case "", models.DNSPolicyClusterFirst:
+	case models.DNSPolicyNone:
+		if len(dns.Nameservers) == 0 {
+			errs.add("isolation.dns.nameservers", CodeRequired, "isolation.dns.nameservers cannot be empty with policy 'None'")
+		}
+	default:
+		errs.add("isolation.dns.policy", CodeInvalidValue, "isolation.dns.policy must be 'ClusterFirst' or 'None'")
+	}
+
+	if len(dns.Nameservers) > maxDNSNameservers {
+		errs.add("isolation.dns.nameservers", CodeOutOfRange, "isolation.dns.nameservers must have %d entries or less", maxDNSNameservers)
+	}
+	for i, server := range dns.Nameservers {
+		if net.ParseIP(server) == nil {
+			field := fmt.Sprintf("isolation.dns.nameservers[%d]", i)
+			errs.add(field, CodeInvalidFormat, "%s: invalid IP address '%s'", field, server)
+		}
+	}
+
+	if len(dns.Searches) > maxDNSSearches {
+		errs.add("isolation.dns.searches", CodeOutOfRange, "isolation.dns.searches must have %d entries or less", maxDNSSearches)
+	}
+	if len(strings.Join(dns.Searches, " ")) > maxDNSSearchListSize {
+		errs.add("isolation.dns.searches", CodeTooLong, "isolation.dns.searches must be %d characters or less in total", maxDNSSearchListSize)
+	}
+	for i, search := range dns.Searches {
+		if len(search) > 253 || !dnsSearchRegex.MatchString(search) {
+			field := fmt.Sprintf("isolation.dns.searches[%d]", i)
+			errs.add(field, CodeInvalidFormat, "%s: invalid search domain '%s'", field, search)
+		}
+	}
+
+	for i, option := range dns.Options {
+		if option.Name == "" {
+			field := fmt.Sprintf("isolation.dns.options[%d].name", i)
+			errs.add(field, CodeRequired, "%s cannot be empty", field)
+		}
+	}
+}
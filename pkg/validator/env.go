@@ -0,0 +1,81 @@
+package validator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Limits on the command and environment variables of environments and executions
+const (
+	// MaxEnvVars is the most environment variables a request may set; for executions it also caps
+	// the environment's variables merged with the execution's
+	MaxEnvVars = 256
+	// MaxEnvValueBytes is the longest environment variable value
+	MaxEnvValueBytes = 32 << 10
+	// MaxCommandBytes caps a command's total size: its arguments plus one separator each
+	MaxCommandBytes = 128 << 10
+)
+
+var (
+	// envNameRegex matches portable variable names (C identifiers), which every shell can read
+	envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// relaxedEnvNameRegex matches the names Kubernetes accepts, which may also contain '.' and '-'
+	relaxedEnvNameRegex = regexp.MustCompile(`^[-._a-zA-Z][-._a-zA-Z0-9]*$`)
+)
+
+// SetRelaxedEnvNames allows environment variable names with '.' and '-' (as Kubernetes does)
+// instead of only C identifiers
+func (v *Validator) SetRelaxedEnvNames(relaxed bool) {
+	v.relaxedEnvNames.Store(relaxed)
+}
+
+// validateEnv adds the problems of the environment variables env to errs under field: names must
+// be valid, values short and free of NUL bytes, and there may be at most MaxEnvVars of them
+func (v *Validator) validateEnv(errs *ValidationErrors, field string, env map[string]string) {
+	if len(env) > MaxEnvVars {
+		errs.add(field, CodeOutOfRange, "at most %d environment variables are allowed, got %d", MaxEnvVars, len(env))
+	}
+	nameRegex, rule := envNameRegex, "letters, digits and '_', not starting with a digit"
+	if v.relaxedEnvNames.Load() {
+		nameRegex, rule = relaxedEnvNameRegex, "letters, digits, '_', '.' and '-', not starting with a digit"
+	}
+	for _, k := range sortedKeys(env) {
+		if k == "" {
+			errs.add(field, CodeInvalidValue, "environment variable name cannot be empty")
+			continue
+		}
+		keyField := field + "." + k
+		if !nameRegex.MatchString(k) {
+			errs.add(keyField, CodeInvalidFormat, "environment variable name %q may only contain %s", k, rule)
+		}
+		if value := env[k]; len(value) > MaxEnvValueBytes {
+			errs.add(keyField, CodeTooLong, "environment variable %q is %d bytes, exceeding the maximum of %d bytes", k, len(value), MaxEnvValueBytes)
+		} else if strings.ContainsRune(value, 0) {
+			errs.add(keyField, CodeInvalidValue, "environment variable %q cannot contain NUL bytes", k)
+		}
+	}
+}
+
+// validateCommand adds the problems of command to errs under field: arguments must be non-empty
+// and free of NUL bytes, the executable cannot be padded with whitespace and the whole command must
+// fit MaxCommandBytes. An empty command is left to the caller.
+func validateCommand(errs *ValidationErrors, field string, command []string) {
+	total := 0
+	for i, arg := range command {
+		argField := fmt.Sprintf("%s[%d]", field, i)
+		total += len(arg) + 1
+		switch {
+		case arg == "":
+			errs.add(argField, CodeInvalidValue, "command arguments cannot be empty")
+		// NUL bytes cannot be passed to exec and are only used to smuggle arguments past checks
+		case strings.ContainsRune(arg, 0):
+			errs.add(argField, CodeInvalidValue, "command arguments cannot contain NUL bytes")
+		case i == 0 && strings.TrimSpace(arg) != arg:
+			errs.add(argField, CodeInvalidValue, "the executable %q cannot be blank or start or end with whitespace", arg)
+		}
+	}
+	if total > MaxCommandBytes {
+		errs.add(field, CodeTooLong, "command is %d bytes, exceeding the maximum of %d bytes", total, MaxCommandBytes)
+	}
+}
@@ -0,0 +1,63 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Validation error codes
+const (
+	CodeRequired      = "required"
+	CodeInvalidFormat = "invalid_format"
+	CodeInvalidValue  = "invalid_value"
+	CodeTooLong       = "too_long"
+	CodeTooShort      = "too_short"
+	CodeOutOfRange    = "out_of_range"
+)
+
+// ValidationError describes a single invalid field in a request
+type ValidationError struct {
+	// Field is the JSON path of the offending field (e.g. "resources.cpu", "tolerations[1].effect")
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// ValidationErrors is the set of all violations found while validating a request
+type ValidationErrors []ValidationError
+
+// Error joins all violation messages
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ve := range e {
+		msgs[i] = ve.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap exposes the individual violations so errors.As can extract a single ValidationError
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, ve := range e {
+		errs[i] = ve
+	}
+	return errs
+}
+
+// add records a violation
+func (e *ValidationErrors) add(field, code, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns nil when there are no violations (avoids a typed nil error)
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
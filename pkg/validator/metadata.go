@@ -0,0 +1,43 @@
+package validator
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ValidateMetadata validates freeform environment or execution metadata: at most
+// models.MaxMetadataKeys keys, each non-empty and at most models.MaxMetadataKeyLength
+// characters, with values of at most models.MaxMetadataValueBytes bytes.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateMetadata(metadata map[string]string) error {
+	var errs ValidationErrors
+	validateMetadata(&errs, "metadata", metadata)
+	return errs.err()
+}
+
+// validateMetadata checks metadata against the size limits. Unlike labels, keys and values may
+// hold any text: metadata is never sent to the cluster.
+func validateMetadata(errs *ValidationErrors, field string, metadata map[string]string) {
+	if len(metadata) > models.MaxMetadataKeys {
+		errs.add(field, CodeOutOfRange, "%s has %d keys, exceeding the maximum of %d", field, len(metadata), models.MaxMetadataKeys)
+	}
+	for _, k := range sortedKeys(metadata) {
+		keyField := field + "." + k
+		switch {
+		case strings.TrimSpace(k) == "":
+			errs.add(field, CodeInvalidValue, "metadata key cannot be empty")
+			continue
+		case strings.ContainsRune(k, 0):
+			errs.add(keyField, CodeInvalidFormat, "metadata key cannot contain NUL")
+		case utf8.RuneCountInString(k) > models.MaxMetadataKeyLength:
+			errs.add(keyField, CodeTooLong, "metadata key must be %d characters or less", models.MaxMetadataKeyLength)
+		}
+		if strings.ContainsRune(metadata[k], 0) {
+			errs.add(keyField, CodeInvalidFormat, "metadata value cannot contain NUL")
+		} else if len(metadata[k]) > models.MaxMetadataValueBytes {
+			errs.add(keyField, CodeTooLong, "metadata value must be %d bytes or less", models.MaxMetadataValueBytes)
+		}
+	}
+}
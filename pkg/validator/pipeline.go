@@ -0,0 +1,145 @@
+package validator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+const (
+	// MaxPipelineSteps is the largest number of steps in a pipeline
+	MaxPipelineSteps = 100
+	// MaxPipelineParallel is the largest max_parallel of a pipeline
+	MaxPipelineParallel = 20
+	// maxPipelineStepNameLength is the longest step name
+	maxPipelineStepNameLength = 63
+)
+
+// pipelineStepNameRegex matches step names: letters, digits, '.', '_' and '-'
+var pipelineStepNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// ValidateCreatePipelineRequest validates a pipeline: every step's command, env and timeout,
+// unique step names, dependencies on existing steps and the absence of dependency cycles.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateCreatePipelineRequest(req *models.CreatePipelineRequest) error {
+	var errs ValidationErrors
+	if len(req.Steps) == 0 {
+		errs.add("steps", CodeRequired, "at least one step is required")
+	}
+	if len(req.Steps) > MaxPipelineSteps {
+		errs.add("steps", CodeOutOfRange, "a pipeline has at most %d steps", MaxPipelineSteps)
+	}
+	if req.MaxParallel < 0 || req.MaxParallel > MaxPipelineParallel {
+		errs.add("max_parallel", CodeOutOfRange, "max_parallel must be between 1 and %d (0 for the default)", MaxPipelineParallel)
+	}
+
+	for i, step := range req.Steps {
+		prefix := fmt.Sprintf("steps[%d]", i)
+		if err := v.ValidateExecRequest(&models.ExecRequest{Command: step.Command, Timeout: step.Timeout}); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				e.Field = prefix + "." + e.Field
+				errs = append(errs, e)
+			}
+		}
+		v.validateEnv(&errs, prefix+".env", step.Env)
+	}
+
+	errs = append(errs, ValidatePipelineGraph(req.Steps)...)
+	return errs.err()
+}
+
+// ValidatePipelineGraph checks the names and dependencies of pipeline steps: names must be
+// valid and unique, dependencies must name other steps and must not form a cycle
+func ValidatePipelineGraph(steps []models.PipelineStepRequest) ValidationErrors {
+	var errs ValidationErrors
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		field := fmt.Sprintf("steps[%d].name", i)
+		switch {
+		case step.Name == "":
+			errs.add(field, CodeRequired, "step name is required")
+		case len(step.Name) > maxPipelineStepNameLength:
+			errs.add(field, CodeTooLong, "step name must be at most %d characters", maxPipelineStepNameLength)
+		case !pipelineStepNameRegex.MatchString(step.Name):
+			errs.add(field, CodeInvalidFormat, "step name %q may only contain letters, digits, '.', '_' and '-'", step.Name)
+		}
+		if _, dup := index[step.Name]; dup {
+			errs.add(field, CodeInvalidValue, "duplicate step name %q", step.Name)
+			continue
+		}
+		index[step.Name] = i
+	}
+
+	for i, step := range steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := index[dep]; !ok {
+				errs.add(fmt.Sprintf("steps[%d].depends_on", i), CodeInvalidValue, "step %q depends on unknown step %q", step.Name, dep)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		// A cycle is only meaningful between well-defined steps
+		return errs
+	}
+
+	if cycle := PipelineCycle(steps); cycle != nil {
+		errs.add(fmt.Sprintf("steps[%d].depends_on", index[cycle[0]]), CodeInvalidValue,
+			"dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return errs
+}
+
+// PipelineCycle returns a dependency cycle among the steps as the step names along it, starting
+// and ending with the same step (e.g. [build test build]), or nil when there is none. Unknown
+// dependencies are ignored.
+func PipelineCycle(steps []models.PipelineStepRequest) []string {
+	deps := make(map[string][]string, len(steps))
+	for _, step := range steps {
+		deps[step.Name] = step.DependsOn
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(steps))
+	var path []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; !ok {
+				continue
+			}
+			switch state[dep] {
+			case visiting:
+				// The cycle is the part of the path from dep back to dep
+				for i, n := range path {
+					if n == dep {
+						return append(append([]string{}, path[i:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, step := range steps {
+		if state[step.Name] == unvisited {
+			if cycle := visit(step.Name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package validator
+
+import (
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ValidateUserPreferences validates user preferences (or organization defaults): the default
+// profile must be one of profiles and the time zone an IANA name. Unset (nil) fields are valid.
+// All violations are reported; the returned error is a ValidationErrors.
+func ValidateUserPreferences(prefs *models.UserPreferences, profiles map[string]config.ResourceProfileConfig) error {
+	var errs ValidationErrors
+
+	if p := prefs.DefaultProfile; p != nil {
+		if *p == "" {
+			errs.add("default_profile", CodeInvalidValue, "default_profile cannot be empty (use null to unset it)")
+		} else if _, ok := profiles[*p]; !ok {
+			errs.add("default_profile", CodeInvalidValue, "unknown resource profile %q (expected one of %v)", *p, sortedKeys(profiles))
+		}
+	}
+
+	if tz := prefs.Timezone; tz != nil {
+		if _, err := config.LoadTimezone(*tz); err != nil {
+			errs.add("timezone", CodeInvalidValue, "timezone must be an IANA time zone name such as \"Europe/Berlin\": %v", err)
+		}
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,41 @@
+package validator
+
+import (
+	"path"
+	"strings"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+// ValidateWorkspaceSnapshots validates an environment's workspace snapshot settings; an empty
+// path (which turns snapshots off in a PATCH) is accepted.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateWorkspaceSnapshots(spec *models.WorkspaceSnapshotConfig) error {
+	var errs ValidationErrors
+	if !spec.IsEmpty() {
+		validateWorkspaceSnapshots(&errs, spec)
+	}
+	return errs.err()
+}
+
+// validateWorkspaceSnapshots checks the snapshot directory (an absolute path other than the root)
+// and the interval and keep count
+func validateWorkspaceSnapshots(errs *ValidationErrors, spec *models.WorkspaceSnapshotConfig) {
+	switch {
+	case spec.Path == "":
+		errs.add("workspace_snapshots.path", CodeRequired, "workspace_snapshots.path is required")
+	case !strings.HasPrefix(spec.Path, "/"):
+		errs.add("workspace_snapshots.path", CodeInvalidFormat, "workspace_snapshots.path must be an absolute path")
+	case path.Clean(spec.Path) == "/":
+		errs.add("workspace_snapshots.path", CodeInvalidValue, "workspace_snapshots.path cannot be the root directory")
+	case strings.ContainsRune(spec.Path, 0):
+		errs.add("workspace_snapshots.path", CodeInvalidFormat, "workspace_snapshots.path cannot contain NUL")
+	}
+	if spec.IntervalSeconds < 0 || (spec.IntervalSeconds > 0 && spec.IntervalSeconds < models.MinSnapshotIntervalSeconds) {
+		errs.add("workspace_snapshots.interval_seconds", CodeOutOfRange,
+			"workspace_snapshots.interval_seconds must be 0 (the server default) or at least %d", models.MinSnapshotIntervalSeconds)
+	}
+	if spec.Keep < 0 || spec.Keep > models.MaxSnapshotKeep {
+		errs.add("workspace_snapshots.keep", CodeOutOfRange, "workspace_snapshots.keep must be between 0 and %d", models.MaxSnapshotKeep)
+	}
+}
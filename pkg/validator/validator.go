@@ -2,11 +2,16 @@ package validator
 
 import (
 	"fmt"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/registry"
 )
 
 var (
@@ -15,10 +20,25 @@ var (
 	memoryRegex  = regexp.MustCompile(`^(\d+)(Mi|Gi|M|G|Ki|K)?$`)
 	storageRegex = regexp.MustCompile(`^(\d+)(Mi|Gi|Ti|M|G|T|Ki|K)?$`)
 	nameRegex    = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	cidrRegex    = regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}/\d{1,2}$`)
+	// capabilityRegex matches Linux capability names as written in Kubernetes (without CAP_)
+	capabilityRegex = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
 )
 
 // Validator handles input validation
 type Validator struct {
+	// limits is swapped atomically when the configuration is reloaded
+	limits atomic.Pointer[limits]
+	// allowedRegistries is the image allowlist (nil or empty = every registry)
+	allowedRegistries atomic.Pointer[[]string]
+	// maxExecFilesBytes caps the total size of an execution's input files (0 = none allowed)
+	maxExecFilesBytes atomic.Int64
+	// relaxedEnvNames accepts environment variable names with '.' and '-' (see SetRelaxedEnvNames)
+	relaxedEnvNames atomic.Bool
+}
+
+// limits are the maxima a request may ask for
+type limits struct {
 	maxCPU     int64
 	maxMemory  int64
 	maxStorage int64
@@ -27,295 +47,694 @@ type Validator struct {
 
 // New creates a new validator with resource limits
 func New(maxCPU, maxMemory, maxStorage int64, maxTimeout int) *Validator {
-	return &Validator{
+	v := &Validator{}
+	v.limits.Store(&limits{
 		maxCPU:     maxCPU,
 		maxMemory:  maxMemory,
 		maxStorage: maxStorage,
 		maxTimeout: maxTimeout,
+	})
+	v.maxExecFilesBytes.Store(config.DefaultExecMaxFilesBytes)
+	return v
+}
+
+// SetLimits replaces the resource and timeout maxima; cpu, memory and storage use the same
+// formats as requests (e.g. "10000m", "10Gi", "100Gi"). Requests validated afterwards use the
+// new limits.
+func (v *Validator) SetLimits(maxCPU, maxMemory, maxStorage string, maxTimeout int) error {
+	cpu, err := parseCPU(maxCPU)
+	if err != nil {
+		return fmt.Errorf("invalid max cpu: %w", err)
+	}
+	memory, err := parseMemory(maxMemory)
+	if err != nil {
+		return fmt.Errorf("invalid max memory: %w", err)
+	}
+	storage, err := parseStorage(maxStorage)
+	if err != nil {
+		return fmt.Errorf("invalid max storage: %w", err)
+	}
+	v.limits.Store(&limits{
+		maxCPU:     cpu,
+		maxMemory:  memory,
+		maxStorage: storage,
+		maxTimeout: maxTimeout,
+	})
+	return nil
+}
+
+// SetAllowedRegistries sets the image allowlist: images must be under one of the registry (or
+// registry/repository) prefixes. An empty list allows every image.
+func (v *Validator) SetAllowedRegistries(prefixes []string) {
+	prefixes = append([]string{}, prefixes...)
+	v.allowedRegistries.Store(&prefixes)
+}
+
+// SetMaxExecFilesBytes sets the total size execution input files may have; 0 rejects them
+func (v *Validator) SetMaxExecFilesBytes(n int64) {
+	v.maxExecFilesBytes.Store(n)
+}
+
+// ImageAllowed reports whether the image reference ref is allowed by the image allowlist
+func (v *Validator) ImageAllowed(ref registry.Reference) bool {
+	if allowed := v.allowedRegistries.Load(); allowed != nil {
+		return ref.Allowed(*allowed)
 	}
+	return true
 }
 
-// ValidateCreateRequest validates an environment creation request
+// ValidateImage checks that image is a valid reference allowed by the image allowlist.
+// The returned error is a ValidationErrors.
+func (v *Validator) ValidateImage(image string) error {
+	var errs ValidationErrors
+	v.validateImage(&errs, "image", image)
+	return errs.err()
+}
+
+// validateImage adds the problems of image to errs under field
+func (v *Validator) validateImage(errs *ValidationErrors, field, image string) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		errs.add(field, CodeInvalidFormat, "%s", err.Error())
+		return
+	}
+	if !v.ImageAllowed(ref) {
+		errs.add(field, CodeInvalidValue, "image %s is not from an allowed registry", ref.Name())
+	}
+}
+
+// ValidateCreateRequest validates an environment creation request.
+// All violations are reported; the returned error is a ValidationErrors.
 func (v *Validator) ValidateCreateRequest(req *models.CreateEnvironmentRequest) error {
+	var errs ValidationErrors
+
 	if req.Name == "" {
-		return fmt.Errorf("name is required")
+		errs.add("name", CodeRequired, "name is required")
+	} else if !nameRegex.MatchString(req.Name) {
+		errs.add("name", CodeInvalidFormat, "name must be lowercase alphanumeric with hyphens")
+	} else if len(req.Name) > 63 {
+		errs.add("name", CodeTooLong, "name must be 63 characters or less")
+	}
+
+	switch {
+	case req.Build != nil:
+		validateBuild(&errs, req.Build)
+		if req.Image != "" {
+			errs.add("image", CodeInvalidValue, "image cannot be combined with build (the built image is used)")
+		}
+	case req.Image == "":
+		errs.add("image", CodeRequired, "image is required")
+	default:
+		v.validateImage(&errs, "image", req.Image)
 	}
 
-	if !nameRegex.MatchString(req.Name) {
-		return fmt.Errorf("name must be lowercase alphanumeric with hyphens")
+	for _, e := range v.validateResourceSpec(&req.Resources) {
+		e.Field = "resources." + e.Field
+		e.Message = "invalid resources: " + e.Message
+		errs = append(errs, e)
 	}
 
-	if len(req.Name) > 63 {
-		return fmt.Errorf("name must be 63 characters or less")
+	if maxTimeout := v.limits.Load().maxTimeout; req.Timeout > maxTimeout {
+		errs.add("timeout", CodeOutOfRange, "timeout exceeds maximum allowed (%d seconds)", maxTimeout)
 	}
 
-	if req.Image == "" {
-		return fmt.Errorf("image is required")
+	if req.Timeout < 0 {
+		errs.add("timeout", CodeOutOfRange, "timeout cannot be negative")
 	}
 
-	if err := v.ValidateResourceSpec(&req.Resources); err != nil {
-		return fmt.Errorf("invalid resources: %w", err)
+	if req.IdleTimeout < 0 {
+		errs.add("idle_timeout", CodeOutOfRange, "idle_timeout cannot be negative")
 	}
 
-	if req.Timeout > v.maxTimeout {
-		return fmt.Errorf("timeout exceeds maximum allowed (%d seconds)", v.maxTimeout)
+	if !ValidExecMode(req.ExecMode) {
+		errs.add("exec_mode", CodeInvalidValue, "exec_mode must be %q or %q", models.ExecModeSerialized, models.ExecModeParallel)
 	}
 
-	if req.Timeout < 0 {
-		return fmt.Errorf("timeout cannot be negative")
-	}
+	validateEnvironmentMode(&errs, req)
 
-	// Validate environment variables
-	for k := range req.Env {
-		if k == "" {
-			return fmt.Errorf("environment variable name cannot be empty")
+	if req.LogShipping != nil && !req.LogShipping.Disabled {
+		switch req.LogShipping.Sink {
+		case config.LogSinkLoki, config.LogSinkS3, config.LogSinkWebhook:
+		case "":
+			errs.add("log_shipping.sink", CodeRequired, "log_shipping.sink is required")
+		default:
+			errs.add("log_shipping.sink", CodeInvalidValue, "log_shipping.sink must be %q, %q or %q", config.LogSinkLoki, config.LogSinkS3, config.LogSinkWebhook)
+		}
+		if req.LogShipping.Credentials == "" {
+			errs.add("log_shipping.credentials", CodeRequired, "log_shipping.credentials is required")
 		}
 	}
 
+	// Validate command and environment variables
+	validateCommand(&errs, "command", req.Command)
+	v.validateEnv(&errs, "env", req.Env)
+
 	// Validate labels
-	for k, v := range req.Labels {
+	for _, k := range sortedKeys(req.Labels) {
+		field := "labels." + k
 		if k == "" {
-			return fmt.Errorf("label key cannot be empty")
+			errs.add("labels", CodeInvalidValue, "label key cannot be empty")
+			continue
 		}
 		if len(k) > 63 {
-			return fmt.Errorf("label key must be 63 characters or less")
+			errs.add(field, CodeTooLong, "label key must be 63 characters or less")
 		}
-		if len(v) > 63 {
-			return fmt.Errorf("label value must be 63 characters or less")
+		if len(req.Labels[k]) > 63 {
+			errs.add(field, CodeTooLong, "label value must be 63 characters or less")
 		}
 	}
 
+	validateMetadata(&errs, "metadata", req.Metadata)
+
 	// Validate node selector
-	for k, v := range req.NodeSelector {
+	for _, k := range sortedKeys(req.NodeSelector) {
+		field := "node_selector." + k
 		if k == "" {
-			return fmt.Errorf("node selector key cannot be empty")
+			errs.add("node_selector", CodeInvalidValue, "node selector key cannot be empty")
+			continue
 		}
 		if len(k) > 253 {
-			return fmt.Errorf("node selector key must be 253 characters or less")
+			errs.add(field, CodeTooLong, "node selector key must be 253 characters or less")
 		}
-		if len(v) > 63 {
-			return fmt.Errorf("node selector value must be 63 characters or less")
+		if len(req.NodeSelector[k]) > 63 {
+			errs.add(field, CodeTooLong, "node selector value must be 63 characters or less")
 		}
 	}
 
 	// Validate tolerations
-	for i, t := range req.Tolerations {
-		if err := validateToleration(&t, i); err != nil {
-			return err
-		}
+	for i := range req.Tolerations {
+		validateToleration(&errs, &req.Tolerations[i], i)
+	}
+
+	// Validate affinity
+	if req.Affinity != nil {
+		validateAffinity(&errs, req.Affinity)
 	}
 
 	// Validate isolation config
 	if req.Isolation != nil {
-		if err := validateIsolationConfig(req.Isolation); err != nil {
-			return err
-		}
+		validateIsolationConfig(&errs, req.Isolation)
 	}
 
 	// Validate pool config
 	if req.Pool != nil {
-		if err := validatePoolConfig(req.Pool); err != nil {
-			return err
+		validatePoolConfig(&errs, req.Pool)
+	}
+
+	// Validate command policy
+	if req.CommandPolicy != nil {
+		validateCommandPolicy(&errs, req.CommandPolicy)
+	}
+
+	// Validate readiness check
+	if req.ReadinessCheck != nil {
+		validateReadinessCheck(&errs, req.ReadinessCheck)
+	}
+
+	if req.Lifecycle != nil {
+		validateLifecycle(&errs, req.Lifecycle)
+	}
+
+	if req.WorkspaceSnapshots != nil {
+		validateWorkspaceSnapshots(&errs, req.WorkspaceSnapshots)
+	}
+
+	return errs.err()
+}
+
+// ValidExecMode reports whether mode is an exec mode (empty selects the default)
+func ValidExecMode(mode string) bool {
+	return mode == "" || mode == models.ExecModeSerialized || mode == models.ExecModeParallel
+}
+
+// validateEnvironmentMode validates the mode of a new environment. A oneshot environment runs
+// its command to completion, so it needs one and cannot have standby pods or a readiness check.
+func validateEnvironmentMode(errs *ValidationErrors, req *models.CreateEnvironmentRequest) {
+	if req.RetentionSeconds < 0 {
+		errs.add("retention_seconds", CodeOutOfRange, "retention_seconds cannot be negative")
+	}
+	switch req.Mode {
+	case "", models.EnvironmentModeInteractive:
+		if req.RetentionSeconds != 0 {
+			errs.add("retention_seconds", CodeInvalidValue, "retention_seconds is only supported in %s mode", models.EnvironmentModeOneShot)
+		}
+	case models.EnvironmentModeOneShot:
+		if len(req.Command) == 0 {
+			errs.add("command", CodeRequired, "command is required in %s mode", models.EnvironmentModeOneShot)
+		}
+		if req.Pool != nil && req.Pool.Enabled {
+			errs.add("pool", CodeInvalidValue, "pool is not supported in %s mode", models.EnvironmentModeOneShot)
+		}
+		if req.ReadinessCheck != nil {
+			errs.add("readiness_check", CodeInvalidValue, "readiness_check is not supported in %s mode", models.EnvironmentModeOneShot)
+		}
+		if !req.WorkspaceSnapshots.IsEmpty() {
+			errs.add("workspace_snapshots", CodeInvalidValue, "workspace_snapshots is not supported in %s mode", models.EnvironmentModeOneShot)
 		}
+	default:
+		errs.add("mode", CodeInvalidValue, "mode must be %q or %q", models.EnvironmentModeInteractive, models.EnvironmentModeOneShot)
 	}
+}
 
-	return nil
+// ValidateReadinessCheck validates an environment readiness check.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateReadinessCheck(check *models.ReadinessCheck) error {
+	var errs ValidationErrors
+	validateReadinessCheck(&errs, check)
+	return errs.err()
+}
+
+// validateReadinessCheck validates an environment readiness check: exactly one probe type with
+// sane timing settings
+func validateReadinessCheck(errs *ValidationErrors, check *models.ReadinessCheck) {
+	probes := 0
+	if len(check.Exec) > 0 {
+		probes++
+		if strings.TrimSpace(check.Exec[0]) == "" {
+			errs.add("readiness_check.exec[0]", CodeRequired, "readiness_check.exec command cannot be empty")
+		}
+	}
+	if check.HTTPGet != nil {
+		probes++
+		if check.HTTPGet.Port < 1 || check.HTTPGet.Port > 65535 {
+			errs.add("readiness_check.http_get.port", CodeOutOfRange, "readiness_check.http_get.port must be between 1 and 65535")
+		}
+		if check.HTTPGet.Path != "" && !strings.HasPrefix(check.HTTPGet.Path, "/") {
+			errs.add("readiness_check.http_get.path", CodeInvalidFormat, "readiness_check.http_get.path must start with /")
+		}
+	}
+	if check.FileExists != "" {
+		probes++
+		if !strings.HasPrefix(check.FileExists, "/") {
+			errs.add("readiness_check.file_exists", CodeInvalidFormat, "readiness_check.file_exists must be an absolute path")
+		}
+	}
+	if probes != 1 {
+		errs.add("readiness_check", CodeInvalidValue, "readiness_check must specify exactly one of exec, http_get or file_exists")
+	}
+
+	if check.IntervalSeconds < 0 {
+		errs.add("readiness_check.interval_seconds", CodeOutOfRange, "readiness_check.interval_seconds cannot be negative")
+	}
+	if check.TimeoutSeconds < 0 {
+		errs.add("readiness_check.timeout_seconds", CodeOutOfRange, "readiness_check.timeout_seconds cannot be negative")
+	}
+	if check.FailureThreshold < 0 {
+		errs.add("readiness_check.failure_threshold", CodeOutOfRange, "readiness_check.failure_threshold cannot be negative")
+	}
+}
+
+// ValidateLifecycle validates the lifecycle settings of an environment.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateLifecycle(lifecycle *models.LifecycleConfig) error {
+	var errs ValidationErrors
+	validateLifecycle(&errs, lifecycle)
+	return errs.err()
+}
+
+// validateLifecycle validates lifecycle settings: a pre-stop command that names a program and a
+// grace period that is not negative (the server caps it with timeouts.max_termination_grace_period)
+func validateLifecycle(errs *ValidationErrors, lifecycle *models.LifecycleConfig) {
+	if len(lifecycle.PreStop) > 0 && strings.TrimSpace(lifecycle.PreStop[0]) == "" {
+		errs.add("lifecycle.pre_stop[0]", CodeRequired, "lifecycle.pre_stop command cannot be empty")
+	}
+	if grace := lifecycle.TerminationGracePeriodSeconds; grace != nil && *grace < 0 {
+		errs.add("lifecycle.termination_grace_period_seconds", CodeOutOfRange, "lifecycle.termination_grace_period_seconds cannot be negative")
+	}
 }
 
 // validatePoolConfig validates standby pod pool configuration
-func validatePoolConfig(pool *models.PoolConfig) error {
+func validatePoolConfig(errs *ValidationErrors, pool *models.PoolConfig) {
 	// Pool size must be positive if enabled
 	if pool.Enabled && pool.Size < 0 {
-		return fmt.Errorf("pool.size must be non-negative")
+		errs.add("pool.size", CodeOutOfRange, "pool.size must be non-negative")
 	}
 
 	// Pool size has a reasonable upper limit
 	if pool.Size > 20 {
-		return fmt.Errorf("pool.size must be 20 or less")
+		errs.add("pool.size", CodeOutOfRange, "pool.size must be 20 or less")
 	}
 
 	// MinReady must be non-negative
 	if pool.MinReady < 0 {
-		return fmt.Errorf("pool.min_ready must be non-negative")
+		errs.add("pool.min_ready", CodeOutOfRange, "pool.min_ready must be non-negative")
 	}
 
 	// MinReady cannot exceed pool size
 	if pool.MinReady > pool.Size && pool.Size > 0 {
-		return fmt.Errorf("pool.min_ready cannot exceed pool.size")
+		errs.add("pool.min_ready", CodeOutOfRange, "pool.min_ready cannot exceed pool.size")
 	}
 
-	return nil
+	// Prewarming needs a pool to prewarm
+	if pool.PrewarmOnCreate && !pool.Enabled {
+		errs.add("pool.prewarm_on_create", CodeInvalidValue, "pool.prewarm_on_create requires pool.enabled")
+	}
+}
+
+// ValidateIsolation validates an isolation config (e.g. of an environment update).
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateIsolation(isolation *models.IsolationConfig) error {
+	var errs ValidationErrors
+	validateIsolationConfig(&errs, isolation)
+	return errs.err()
 }
 
 // validateIsolationConfig validates isolation configuration
-func validateIsolationConfig(isolation *models.IsolationConfig) error {
+func validateIsolationConfig(errs *ValidationErrors, isolation *models.IsolationConfig) {
 	// Validate runtime class (if specified)
 	if isolation.RuntimeClass != "" {
 		// Runtime class names follow DNS-1123 label convention
 		if !nameRegex.MatchString(isolation.RuntimeClass) {
-			return fmt.Errorf("isolation.runtime_class must be lowercase alphanumeric with hyphens")
+			errs.add("isolation.runtime_class", CodeInvalidFormat, "isolation.runtime_class must be lowercase alphanumeric with hyphens")
 		}
 		if len(isolation.RuntimeClass) > 63 {
-			return fmt.Errorf("isolation.runtime_class must be 63 characters or less")
+			errs.add("isolation.runtime_class", CodeTooLong, "isolation.runtime_class must be 63 characters or less")
 		}
 	}
 
 	// Validate network policy config
 	if isolation.NetworkPolicy != nil {
-		if err := validateNetworkPolicyConfig(isolation.NetworkPolicy); err != nil {
-			return err
-		}
+		validateNetworkPolicyConfig(errs, isolation.NetworkPolicy)
 	}
 
 	// Validate security context config
 	if isolation.SecurityContext != nil {
-		if err := validateSecurityContextConfig(isolation.SecurityContext); err != nil {
-			return err
-		}
+		validateSecurityContextConfig(errs, isolation.SecurityContext)
 	}
 
-	return nil
+	// Validate DNS config
+	if isolation.DNS != nil {
+		validateDNSConfig(errs, isolation.DNS)
+	}
+
+	// Validate service account config
+	if isolation.ServiceAccount != nil {
+		validateServiceAccountConfig(errs, isolation.ServiceAccount)
+	}
+}
+
+// validateServiceAccountConfig validates the requested ServiceAccount. Which annotations may be
+// set is server configuration, checked by the orchestrator.
+func validateServiceAccountConfig(errs *ValidationErrors, sa *models.ServiceAccountConfig) {
+	switch {
+	case sa.Name == "":
+		errs.add("isolation.service_account.name", CodeRequired, "isolation.service_account.name is required")
+	case len(sa.Name) > 63:
+		errs.add("isolation.service_account.name", CodeTooLong, "isolation.service_account.name must be 63 characters or less")
+	case !nameRegex.MatchString(sa.Name):
+		errs.add("isolation.service_account.name", CodeInvalidFormat, "isolation.service_account.name must be lowercase alphanumeric with hyphens")
+	case sa.Name == "default":
+		errs.add("isolation.service_account.name", CodeInvalidValue, "isolation.service_account.name cannot be the namespace's default service account")
+	}
+	for key := range sa.Annotations {
+		if key == "" {
+			errs.add("isolation.service_account.annotations", CodeInvalidValue, "isolation.service_account.annotations keys cannot be empty")
+			break
+		}
+	}
 }
 
 // validateNetworkPolicyConfig validates network policy configuration
-func validateNetworkPolicyConfig(np *models.NetworkPolicyConfig) error {
+func validateNetworkPolicyConfig(errs *ValidationErrors, np *models.NetworkPolicyConfig) {
 	// Validate CIDR blocks
-	cidrRegex := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}/\d{1,2}$`)
 	for i, cidr := range np.AllowedEgressCIDRs {
 		if cidr == "" {
 			continue
 		}
 		if !cidrRegex.MatchString(cidr) {
-			return fmt.Errorf("isolation.network_policy.allowed_egress_cidrs[%d]: invalid CIDR format '%s'", i, cidr)
+			field := fmt.Sprintf("isolation.network_policy.allowed_egress_cidrs[%d]", i)
+			errs.add(field, CodeInvalidFormat, "%s: invalid CIDR format '%s'", field, cidr)
 		}
 	}
 
 	// Validate ports
 	for i, port := range np.AllowedIngressPorts {
 		if port < 1 || port > 65535 {
-			return fmt.Errorf("isolation.network_policy.allowed_ingress_ports[%d]: port must be between 1 and 65535", i)
+			field := fmt.Sprintf("isolation.network_policy.allowed_ingress_ports[%d]", i)
+			errs.add(field, CodeOutOfRange, "%s: port must be between 1 and 65535", field)
 		}
 	}
-
-	return nil
 }
 
 // validateSecurityContextConfig validates security context configuration
-func validateSecurityContextConfig(sc *models.SecurityContextConfig) error {
+func validateSecurityContextConfig(errs *ValidationErrors, sc *models.SecurityContextConfig) {
 	// Validate run_as_user (must be non-negative if specified)
 	if sc.RunAsUser != nil && *sc.RunAsUser < 0 {
-		return fmt.Errorf("isolation.security_context.run_as_user must be non-negative")
+		errs.add("isolation.security_context.run_as_user", CodeOutOfRange, "isolation.security_context.run_as_user must be non-negative")
 	}
 
 	// Validate run_as_group (must be non-negative if specified)
 	if sc.RunAsGroup != nil && *sc.RunAsGroup < 0 {
-		return fmt.Errorf("isolation.security_context.run_as_group must be non-negative")
+		errs.add("isolation.security_context.run_as_group", CodeOutOfRange, "isolation.security_context.run_as_group must be non-negative")
+	}
+
+	// Validate capability names (e.g. NET_ADMIN, ALL; without the CAP_ prefix)
+	if sc.Capabilities != nil {
+		for _, list := range []struct {
+			kind  string
+			names []string
+		}{{"add", sc.Capabilities.Add}, {"drop", sc.Capabilities.Drop}} {
+			for i, name := range list.names {
+				if !capabilityRegex.MatchString(name) {
+					field := fmt.Sprintf("isolation.security_context.capabilities.%s[%d]", list.kind, i)
+					errs.add(field, CodeInvalidFormat, "%s: invalid capability '%s' (expected e.g. NET_BIND_SERVICE)", field, name)
+				}
+			}
+		}
 	}
 
-	return nil
+	// Validate seccomp profile
+	switch sc.SeccompProfile {
+	case "", models.SeccompRuntimeDefault, models.SeccompUnconfined:
+	default:
+		errs.add("isolation.security_context.seccomp_profile", CodeInvalidValue, "isolation.security_context.seccomp_profile must be RuntimeDefault or Unconfined")
+	}
 }
 
 // validateToleration validates a single toleration
-func validateToleration(t *models.Toleration, index int) error {
+func validateToleration(errs *ValidationErrors, t *models.Toleration, index int) {
+	prefix := fmt.Sprintf("tolerations[%d]", index)
+
 	// Validate operator
 	if t.Operator != "" && t.Operator != "Exists" && t.Operator != "Equal" {
-		return fmt.Errorf("toleration[%d]: operator must be 'Exists' or 'Equal'", index)
+		errs.add(prefix+".operator", CodeInvalidValue, "toleration[%d]: operator must be 'Exists' or 'Equal'", index)
 	}
 
 	// Validate effect
 	if t.Effect != "" && t.Effect != "NoSchedule" && t.Effect != "PreferNoSchedule" && t.Effect != "NoExecute" {
-		return fmt.Errorf("toleration[%d]: effect must be 'NoSchedule', 'PreferNoSchedule', or 'NoExecute'", index)
+		errs.add(prefix+".effect", CodeInvalidValue, "toleration[%d]: effect must be 'NoSchedule', 'PreferNoSchedule', or 'NoExecute'", index)
 	}
 
 	// If operator is "Exists", value should be empty
 	if t.Operator == "Exists" && t.Value != "" {
-		return fmt.Errorf("toleration[%d]: value must be empty when operator is 'Exists'", index)
+		errs.add(prefix+".value", CodeInvalidValue, "toleration[%d]: value must be empty when operator is 'Exists'", index)
 	}
 
 	// tolerationSeconds only makes sense with NoExecute effect
 	if t.TolerationSeconds != nil && t.Effect != "NoExecute" {
-		return fmt.Errorf("toleration[%d]: tolerationSeconds can only be set when effect is 'NoExecute'", index)
+		errs.add(prefix+".tolerationSeconds", CodeInvalidValue, "toleration[%d]: tolerationSeconds can only be set when effect is 'NoExecute'", index)
 	}
 
 	// Validate key length
 	if len(t.Key) > 253 {
-		return fmt.Errorf("toleration[%d]: key must be 253 characters or less", index)
+		errs.add(prefix+".key", CodeTooLong, "toleration[%d]: key must be 253 characters or less", index)
 	}
-
-	return nil
 }
 
-// ValidateResourceSpec validates resource specifications
+// ValidateResourceSpec validates resource specifications.
+// All violations are reported; the returned error is a ValidationErrors.
 func (v *Validator) ValidateResourceSpec(spec *models.ResourceSpec) error {
+	return v.validateResourceSpec(spec).err()
+}
+
+// validateResourceSpec collects resource violations with field paths relative to the spec
+func (v *Validator) validateResourceSpec(spec *models.ResourceSpec) ValidationErrors {
+	var errs ValidationErrors
+	l := v.limits.Load()
+
 	if spec.CPU == "" {
-		return fmt.Errorf("cpu is required")
+		errs.add("cpu", CodeRequired, "cpu is required")
+	} else if cpu, err := parseCPU(spec.CPU); err != nil {
+		errs.add("cpu", CodeInvalidFormat, "invalid cpu format: %v", err)
+	} else if cpu > l.maxCPU {
+		errs.add("cpu", CodeOutOfRange, "cpu exceeds maximum allowed (%dm)", l.maxCPU)
+	} else if cpu <= 0 {
+		errs.add("cpu", CodeOutOfRange, "cpu must be positive")
 	}
 
-	cpu, err := parseCPU(spec.CPU)
-	if err != nil {
-		return fmt.Errorf("invalid cpu format: %w", err)
+	if spec.Memory == "" {
+		errs.add("memory", CodeRequired, "memory is required")
+	} else if memory, err := parseMemory(spec.Memory); err != nil {
+		errs.add("memory", CodeInvalidFormat, "invalid memory format: %v", err)
+	} else if memory > l.maxMemory {
+		errs.add("memory", CodeOutOfRange, "memory exceeds maximum allowed (%d bytes)", l.maxMemory)
+	} else if memory <= 0 {
+		errs.add("memory", CodeOutOfRange, "memory must be positive")
 	}
 
-	if cpu > v.maxCPU {
-		return fmt.Errorf("cpu exceeds maximum allowed (%dm)", v.maxCPU)
+	if spec.Storage == "" {
+		errs.add("storage", CodeRequired, "storage is required")
+	} else if storage, err := parseStorage(spec.Storage); err != nil {
+		errs.add("storage", CodeInvalidFormat, "invalid storage format: %v", err)
+	} else if storage > l.maxStorage {
+		errs.add("storage", CodeOutOfRange, "storage exceeds maximum allowed (%d bytes)", l.maxStorage)
+	} else if storage <= 0 {
+		errs.add("storage", CodeOutOfRange, "storage must be positive")
 	}
 
-	if cpu <= 0 {
-		return fmt.Errorf("cpu must be positive")
+	return errs
+}
+
+// ValidateExecRequest validates a command execution request.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateExecRequest(req *models.ExecRequest) error {
+	var errs ValidationErrors
+
+	if len(req.Command) == 0 {
+		errs.add("command", CodeRequired, "command is required")
 	}
+	validateCommand(&errs, "command", req.Command)
 
-	if spec.Memory == "" {
-		return fmt.Errorf("memory is required")
+	if req.Timeout < 0 {
+		errs.add("timeout", CodeOutOfRange, "timeout cannot be negative")
 	}
 
-	memory, err := parseMemory(spec.Memory)
-	if err != nil {
-		return fmt.Errorf("invalid memory format: %w", err)
+	if maxTimeout := v.limits.Load().maxTimeout; req.Timeout > maxTimeout {
+		errs.add("timeout", CodeOutOfRange, "timeout exceeds maximum allowed (%d seconds)", maxTimeout)
 	}
 
-	if memory > v.maxMemory {
-		return fmt.Errorf("memory exceeds maximum allowed (%d bytes)", v.maxMemory)
+	return errs.err()
+}
+
+// ValidateEphemeralExecRequest validates an async execution request, including its image,
+// resource and isolation overrides. Resource fields may be omitted to keep the environment's
+// values; the network policy applies to the whole environment and cannot be overridden.
+// All violations are reported; the returned error is a ValidationErrors.
+func (v *Validator) ValidateEphemeralExecRequest(req *models.EphemeralExecRequest) error {
+	var errs ValidationErrors
+	if err := v.ValidateExecRequest(&models.ExecRequest{Command: req.Command, Timeout: req.Timeout}); err != nil {
+		errs = append(errs, err.(ValidationErrors)...)
 	}
 
-	if memory <= 0 {
-		return fmt.Errorf("memory must be positive")
+	v.validateEnv(&errs, "env", req.Env)
+
+	if len(req.Files) > 0 {
+		v.validateExecFiles(&errs, req.Files)
 	}
 
-	if spec.Storage == "" {
-		return fmt.Errorf("storage is required")
+	validateMetadata(&errs, "metadata", req.Metadata)
+
+	if req.CacheTTL < 0 || req.CacheTTL > models.MaxExecutionCacheTTL {
+		errs.add("cache_ttl", CodeOutOfRange, "cache_ttl must be between 0 and %d seconds", models.MaxExecutionCacheTTL)
+	} else if req.CacheTTL > 0 && !req.Cache {
+		errs.add("cache_ttl", CodeInvalidValue, "cache_ttl requires cache: true")
 	}
 
-	storage, err := parseStorage(spec.Storage)
-	if err != nil {
-		return fmt.Errorf("invalid storage format: %w", err)
+	if req.Image != "" {
+		v.validateImage(&errs, "image", req.Image)
 	}
 
-	if storage > v.maxStorage {
-		return fmt.Errorf("storage exceeds maximum allowed (%d bytes)", v.maxStorage)
+	if req.Resources != nil {
+		for _, e := range v.validateResourceSpec(req.Resources) {
+			if e.Code == CodeRequired {
+				continue
+			}
+			e.Field = "resources." + e.Field
+			e.Message = "invalid resources: " + e.Message
+			errs = append(errs, e)
+		}
 	}
 
-	if storage <= 0 {
-		return fmt.Errorf("storage must be positive")
+	if req.Isolation != nil {
+		validateIsolationConfig(&errs, req.Isolation)
+		if req.Isolation.NetworkPolicy != nil {
+			errs.add("isolation.network_policy", CodeInvalidValue, "isolation.network_policy applies to the whole environment and cannot be overridden per execution")
+		}
+		if req.Isolation.DNS != nil {
+			errs.add("isolation.dns", CodeInvalidValue, "isolation.dns applies to the whole environment and cannot be overridden per execution")
+		}
+		if req.Isolation.ExecInheritSecurityContext {
+			errs.add("isolation.exec_inherit_security_context", CodeInvalidValue, "isolation.exec_inherit_security_context applies to the whole environment and cannot be overridden per execution")
+		}
+		if req.Isolation.ServiceAccount != nil {
+			errs.add("isolation.service_account", CodeInvalidValue, "isolation.service_account applies to the whole environment and cannot be overridden per execution")
+		}
 	}
 
-	return nil
+	return errs.err()
 }
 
-// ValidateExecRequest validates a command execution request
-func (v *Validator) ValidateExecRequest(req *models.ExecRequest) error {
-	if len(req.Command) == 0 {
-		return fmt.Errorf("command is required")
+// validateExecFiles checks that input file paths are clean relative paths that stay inside the
+// working directory and that the files fit the size cap
+func (v *Validator) validateExecFiles(errs *ValidationErrors, files map[string][]byte) {
+	var total int64
+	for _, p := range sortedKeys(files) {
+		field := "files." + p
+		total += int64(len(files[p]))
+		switch {
+		case p == "":
+			errs.add("files", CodeInvalidValue, "file path cannot be empty")
+		case strings.ContainsRune(p, 0):
+			errs.add(field, CodeInvalidFormat, "file path cannot contain NUL")
+		case path.IsAbs(p):
+			errs.add(field, CodeInvalidFormat, "file path '%s' must be relative to the working directory", p)
+		case path.Clean(p) != p || p == "." || p == ".." || strings.HasPrefix(p, "../"):
+			errs.add(field, CodeInvalidFormat, "file path '%s' must be a clean path inside the working directory", p)
+		case p == models.ExecFilesReadyMarker:
+			errs.add(field, CodeInvalidValue, "file path '%s' is reserved", p)
+		default:
+			for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+				if _, ok := files[dir]; ok {
+					errs.add(field, CodeInvalidValue, "file path '%s' is inside '%s', which is a file", p, dir)
+					break
+				}
+			}
+		}
 	}
-
-	if req.Timeout < 0 {
-		return fmt.Errorf("timeout cannot be negative")
+	if max := v.maxExecFilesBytes.Load(); total > max {
+		errs.add("files", CodeOutOfRange, "input files total %d bytes, exceeding the maximum of %d bytes", total, max)
 	}
+}
 
-	if req.Timeout > v.maxTimeout {
-		return fmt.Errorf("timeout exceeds maximum allowed (%d seconds)", v.maxTimeout)
+// ValidateLabelsUpdate validates a labels update: keys and values must be valid Kubernetes labels
+// and reserved agentbox labels cannot be added or removed
+func (v *Validator) ValidateLabelsUpdate(req *models.UpdateLabelsRequest) error {
+	var errs ValidationErrors
+	if len(req.Add) == 0 && len(req.Remove) == 0 {
+		errs.add("add", CodeRequired, "at least one label must be added or removed")
+	}
+	for _, k := range sortedKeys(req.Add) {
+		field := "add." + k
+		if msg := labelKeyError(k); msg != "" {
+			errs.add(field, CodeInvalidFormat, "%s: %s", field, msg)
+		} else if models.ReservedLabels[k] {
+			errs.add(field, CodeInvalidValue, "label '%s' is reserved", k)
+		}
+		if msg := labelValueError(req.Add[k]); msg != "" {
+			errs.add(field, CodeInvalidFormat, "%s: %s", field, msg)
+		}
+	}
+	for i, k := range req.Remove {
+		field := fmt.Sprintf("remove[%d]", i)
+		if msg := labelKeyError(k); msg != "" {
+			errs.add(field, CodeInvalidFormat, "%s: %s", field, msg)
+		} else if models.ReservedLabels[k] {
+			errs.add(field, CodeInvalidValue, "label '%s' is reserved", k)
+		} else if _, added := req.Add[k]; added {
+			errs.add(field, CodeInvalidValue, "label '%s' cannot be both added and removed", k)
+		}
 	}
+	return errs.err()
+}
 
-	return nil
+// sortedKeys returns map keys in a stable order so violations are reported deterministically
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // parseCPU parses CPU resource string to millicores
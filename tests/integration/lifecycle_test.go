@@ -106,7 +106,8 @@ func TestEnvironmentLifecycle(t *testing.T) {
 		execResp, err := orch.ExecuteCommand(ctx, env.ID, []string{"echo", "hello world"}, 30)
 		require.NoError(t, err)
 		assert.Contains(t, execResp.Stdout, "hello world")
-		assert.Equal(t, 0, execResp.ExitCode)
+		require.NotNil(t, execResp.ExitCode)
+		assert.Equal(t, 0, *execResp.ExitCode)
 
 		// Step 4: Delete environment
 		err = orch.DeleteEnvironment(ctx, env.ID, false)
@@ -196,14 +197,16 @@ func TestCommandExecution(t *testing.T) {
 		resp, err := orch.ExecuteCommand(ctx, env.ID, []string{"echo", "test"}, 30)
 		require.NoError(t, err)
 		assert.Contains(t, resp.Stdout, "test")
-		assert.Equal(t, 0, resp.ExitCode)
+		require.NotNil(t, resp.ExitCode)
+		assert.Equal(t, 0, *resp.ExitCode)
 	})
 
 	t.Run("execute command that fails", func(t *testing.T) {
 		resp, err := orch.ExecuteCommand(ctx, env.ID, []string{"false"}, 30)
 		// May or may not error depending on implementation
 		if err == nil {
-			assert.NotEqual(t, 0, resp.ExitCode)
+			require.NotNil(t, resp.ExitCode)
+			assert.NotEqual(t, 0, *resp.ExitCode)
 		}
 	})
 
@@ -303,7 +306,8 @@ func TestIsolation(t *testing.T) {
 		resp, err := orch.ExecuteCommand(ctx, env2.ID, []string{"ls", "/tmp/test-file"}, 30)
 		// Should fail as file doesn't exist
 		if err == nil {
-			assert.NotEqual(t, 0, resp.ExitCode)
+			require.NotNil(t, resp.ExitCode)
+			assert.NotEqual(t, 0, *resp.ExitCode)
 		}
 	})
 }
@@ -0,0 +1,158 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/storage"
+)
+
+// minioStorage connects to the MinIO server of `make test-storage-integration` (or the one named
+// by AGENTBOX_TEST_S3_ENDPOINT and AGENTBOX_TEST_S3_BUCKET), under a prefix of its own
+func minioStorage(t *testing.T) storage.Backend {
+	endpoint := envOr("AGENTBOX_TEST_S3_ENDPOINT", "http://localhost:9000")
+	u, err := url.Parse(endpoint)
+	require.NoError(t, err)
+	conn, err := net.DialTimeout("tcp", u.Host, 2*time.Second)
+	if err != nil {
+		t.Skipf("MinIO is not reachable at %s: %v", endpoint, err)
+	}
+	conn.Close()
+
+	store, err := storage.New(config.StorageConfig{
+		Backend: config.StorageBackendS3,
+		S3: config.ExportS3Config{
+			Endpoint:        endpoint,
+			Region:          envOr("AGENTBOX_TEST_S3_REGION", "us-east-1"),
+			Bucket:          envOr("AGENTBOX_TEST_S3_BUCKET", "agentbox-test"),
+			Prefix:          fmt.Sprintf("it-%d/", time.Now().UnixNano()),
+			AccessKeyID:     envOr("AGENTBOX_TEST_S3_ACCESS_KEY_ID", "minioadmin"),
+			SecretAccessKey: envOr("AGENTBOX_TEST_S3_SECRET_ACCESS_KEY", "minioadmin"),
+			PathStyle:       true,
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = storage.DeletePrefix(context.Background(), store, "")
+	})
+	return store
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func TestMinIOStorage(t *testing.T) {
+	store := minioStorage(t)
+	ctx := context.Background()
+
+	// Keys that need escaping survive the round trip
+	keys := []string{"env-1/a.txt", "env-1/b c.txt", "env-1/dt=2026-03-04/d+e.ndjson", "env-2/f.txt"}
+	for _, key := range keys {
+		require.NoError(t, store.Put(ctx, key, strings.NewReader("content of "+key), "text/plain"))
+	}
+	for _, key := range keys {
+		rc, err := store.Get(ctx, key)
+		require.NoError(t, err, key)
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+key, string(data))
+	}
+
+	objects, err := store.List(ctx, "env-1/")
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+	assert.Equal(t, "env-1/a.txt", objects[0].Key)
+	assert.Equal(t, int64(len("content of env-1/a.txt")), objects[0].Size)
+	assert.WithinDuration(t, time.Now(), objects[0].LastModified, time.Hour)
+
+	_, err = store.Get(ctx, "env-1/missing.txt")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Presigned URLs download without credentials
+	presigned, err := store.PresignGet(ctx, "env-1/b c.txt", time.Minute)
+	require.NoError(t, err)
+	resp, err := http.Get(presigned)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(data))
+	assert.Equal(t, "content of env-1/b c.txt", string(data))
+
+	require.NoError(t, store.Delete(ctx, "env-1/a.txt"))
+	require.NoError(t, store.Delete(ctx, "env-1/a.txt"))
+	require.NoError(t, storage.DeletePrefix(ctx, store, "env-1/"))
+	objects, err = store.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "env-2/f.txt", objects[0].Key)
+}
+
+func TestMinIOStorageStreaming(t *testing.T) {
+	store := minioStorage(t)
+	ctx := context.Background()
+
+	// A large object streamed from a pipe, as snapshots and archives are written
+	payload := make([]byte, 12<<20)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+	pr, pw := io.Pipe()
+	go func() {
+		for chunk := payload; len(chunk) > 0; {
+			n := min(len(chunk), 64<<10)
+			if _, err := pw.Write(chunk[:n]); err != nil {
+				return
+			}
+			chunk = chunk[n:]
+		}
+		pw.Close()
+	}()
+	require.NoError(t, store.Put(ctx, "snapshots/env-1/large.tar", pr, "application/x-tar"))
+
+	rc, err := store.Get(ctx, "snapshots/env-1/large.tar")
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(payload, data))
+
+	// A stream that fails leaves no object
+	pr, pw = io.Pipe()
+	go func() {
+		_, _ = pw.Write(payload[:1<<20])
+		pw.CloseWithError(fmt.Errorf("workspace archive failed"))
+	}()
+	require.Error(t, store.Put(ctx, "snapshots/env-1/partial.tar", pr, "application/x-tar"))
+	_, err = store.Get(ctx, "snapshots/env-1/partial.tar")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Listing pages through more keys than one ListObjectsV2 response holds
+	for i := 0; i < 1005; i++ {
+		require.NoError(t, store.Put(ctx, fmt.Sprintf("many/%04d", i), strings.NewReader("x"), ""))
+	}
+	objects, err := store.List(ctx, "many/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1005)
+	assert.Equal(t, "many/1004", objects[1004].Key)
+}
@@ -0,0 +1,122 @@
+package mocks
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// Ensure FakeClock implements orchestrator.Clock
+var _ orchestrator.Clock = (*FakeClock)(nil)
+
+// FakeClock is a manually advanced clock for driving the orchestrator's background loops in tests.
+// Its tickers deliver ticks synchronously: Advance returns once every due ticker's loop has
+// received its tick, so advancing twice guarantees the pass started by the first tick finished.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// fakeTicker is a ticker of a FakeClock; next is the time of its next tick
+type fakeTicker struct {
+	clock   *FakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewFakeClock creates a fake clock reading now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the fake time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker creates a ticker that ticks every d of fake time
+func (c *FakeClock) NewTicker(d time.Duration) orchestrator.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock:   c,
+		c:       make(chan time.Time),
+		period:  d,
+		next:    c.now.Add(d),
+		stopped: make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// BlockUntil waits until n tickers are active, i.e. the loops under test have started
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.tickers) < n {
+		c.cond.Wait()
+	}
+}
+
+// Advance moves the clock forward by d and delivers one tick to every ticker that became due,
+// earliest first. Like a time.Ticker, a ticker that became due several times ticks once.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakeTicker
+	for _, t := range c.tickers {
+		if !t.next.After(now) {
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].next.Before(due[j].next) })
+	for _, t := range due {
+		for !t.next.After(now) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, t := range due {
+		select {
+		case t.c <- now:
+		case <-t.stopped:
+		}
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.period = d
+	t.next = t.clock.now.Add(d)
+}
+
+func (t *fakeTicker) Stop() {
+	t.once.Do(func() {
+		close(t.stopped)
+		t.clock.mu.Lock()
+		defer t.clock.mu.Unlock()
+		for i, other := range t.clock.tickers {
+			if other == t {
+				t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+				break
+			}
+		}
+	})
+}
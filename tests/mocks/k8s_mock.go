@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
@@ -21,24 +27,126 @@ var _ k8s.ClientInterface = (*MockK8sClient)(nil)
 // It implements all methods of k8s.Client for testing purposes
 type MockK8sClient struct {
 	namespaces       map[string]bool
+	namespaceLabels  map[string]map[string]string // namespace -> its current labels
+	namespaceCreated map[string]time.Time         // namespace -> creation time
+	terminating      map[string]bool              // namespaces being deleted, until nsDeletionDelay has passed
+	nsDeletionDelay  time.Duration                // how long a deleted namespace stays Terminating
 	pods             map[string]map[string]*corev1.Pod
 	quotas           map[string]bool
+	serviceAccounts  map[string]map[string]map[string]string // namespace -> service account -> its annotations
 	policies         map[string]bool
-	podLogs          map[string]map[string]string // namespace -> pod -> logs
+	policyConfigs    map[string]*k8s.NetworkPolicyConfig // namespace -> config the policy was created with
+	podLogs          map[string]map[string]string        // namespace -> pod -> logs
+	createdPods      map[string][]string                 // namespace -> names of every pod created, in order
+	podSpecs         map[string]map[string]*k8s.PodSpec  // namespace -> pod -> spec it was created from
+	deleteGrace      map[string]map[string]*int64        // namespace -> pod -> grace period of its last deletion (nil = the pod's own)
 	healthCheckError bool
+	holdCompletion   bool // WaitForPodCompletion blocks until the pod is deleted
+	holdRunning      bool // WaitForPodRunning blocks until the pod is set running
+	execHandler      func(namespace, podName string, command []string) (string, error)
+	execStream       func(ctx context.Context, command []string, stdout, stderr io.Writer) error // writes output itself and may block
+	noShell          bool                                                                        // pods have no /bin/sh
+	execStdin        map[string]map[string][][]byte                                              // namespace -> pod -> buffered stdin of each exec that had one
+	httpGetHandler   func(namespace, podName string, port int, path string) (int, string, error)
+	portForward      func(ctx context.Context, port int, conn io.ReadWriter) error // serves forwarded connections instead of echoing
+	logSource        func(namespace, podName string) io.Reader                     // streams completion logs instead of podLogs
+	completion       func(spec *k8s.PodSpec) int                                   // runs (and may block) before a pod completes; returns its exit code
+	nodes            []k8s.NodeAllocatable                                         // returned by GetNodeAllocatable
+	podWatches       map[*mockPodWatch]struct{}                                    // open WatchPods calls
 	mu               sync.RWMutex
+
+	// Failure injection, guarded by faultMu so it works inside both read- and write-locked methods
+	faultMu  sync.Mutex
+	failures map[string][]error // method -> errors returned by its next calls, in order
+	calls    map[string]int     // method -> number of calls
+	faults   *k8s.FaultInjector // latency and error rates, consulted after failures
 }
 
 // NewMockK8sClient creates a new mock Kubernetes client
 func NewMockK8sClient() *MockK8sClient {
 	return &MockK8sClient{
 		namespaces:       make(map[string]bool),
+		namespaceLabels:  make(map[string]map[string]string),
+		namespaceCreated: make(map[string]time.Time),
+		terminating:      make(map[string]bool),
 		pods:             make(map[string]map[string]*corev1.Pod),
 		quotas:           make(map[string]bool),
+		serviceAccounts:  make(map[string]map[string]map[string]string),
 		policies:         make(map[string]bool),
+		policyConfigs:    make(map[string]*k8s.NetworkPolicyConfig),
 		podLogs:          make(map[string]map[string]string),
+		createdPods:      make(map[string][]string),
+		podSpecs:         make(map[string]map[string]*k8s.PodSpec),
+		deleteGrace:      make(map[string]map[string]*int64),
+		execStdin:        make(map[string]map[string][][]byte),
+		podWatches:       make(map[*mockPodWatch]struct{}),
 		healthCheckError: false,
+		failures:         make(map[string][]error),
+		calls:            make(map[string]int),
+	}
+}
+
+// FailNext makes the next `times` calls of method (e.g. "CreatePod") return err before touching
+// any mock state, so callers can exercise their retry and error paths
+func (m *MockK8sClient) FailNext(method string, times int, err error) {
+	m.faultMu.Lock()
+	defer m.faultMu.Unlock()
+	for i := 0; i < times; i++ {
+		m.failures[method] = append(m.failures[method], err)
+	}
+}
+
+// CallCount returns how many times method has been called, including injected failures
+func (m *MockK8sClient) CallCount(method string) int {
+	m.faultMu.Lock()
+	defer m.faultMu.Unlock()
+	return m.calls[method]
+}
+
+// SetFault adds a fault (latency, error rate, error kind) to the calls of fault.Method, as the
+// fault-injecting client would in a real cluster. Error rates are drawn from a fixed seed, so a
+// test sees the same failures on every run.
+func (m *MockK8sClient) SetFault(fault k8s.Fault) error {
+	m.faultMu.Lock()
+	if m.faults == nil {
+		m.faults = k8s.NewFaultInjector(1)
 	}
+	faults := m.faults
+	m.faultMu.Unlock()
+	return faults.Set(fault)
+}
+
+// SetFaultInjector makes the mock consult faults, e.g. one shared with the admin fault endpoint
+func (m *MockK8sClient) SetFaultInjector(faults *k8s.FaultInjector) {
+	m.faultMu.Lock()
+	defer m.faultMu.Unlock()
+	m.faults = faults
+}
+
+// ClearFaults removes the faults added with SetFault
+func (m *MockK8sClient) ClearFaults() {
+	m.faultMu.Lock()
+	defer m.faultMu.Unlock()
+	m.faults = nil
+}
+
+// injectedFailure records a call of method and returns the next injected error for it, if any:
+// errors queued with FailNext come first, then the faults set with SetFault (whose latency is
+// waited out here, outside the mock's locks)
+func (m *MockK8sClient) injectedFailure(ctx context.Context, method string) error {
+	m.faultMu.Lock()
+	m.calls[method]++
+	if errs := m.failures[method]; len(errs) > 0 {
+		m.failures[method] = errs[1:]
+		m.faultMu.Unlock()
+		return errs[0]
+	}
+	faults := m.faults
+	m.faultMu.Unlock()
+	if faults == nil {
+		return nil
+	}
+	return faults.Inject(ctx, method)
 }
 
 // Clientset returns nil for mock (not needed for unit tests)
@@ -73,32 +181,184 @@ func (m *MockK8sClient) GetClusterCapacity(ctx context.Context) (int, string, st
 	return 3, "50000m", "100Gi", nil
 }
 
+// GetNodeAllocatable returns the nodes set with SetNodes (none by default), ignoring the
+// selector and tolerations
+func (m *MockK8sClient) GetNodeAllocatable(ctx context.Context, nodeSelector map[string]string, tolerations []k8s.Toleration) ([]k8s.NodeAllocatable, error) {
+	if err := m.injectedFailure(ctx, "GetNodeAllocatable"); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]k8s.NodeAllocatable(nil), m.nodes...), nil
+}
+
+// SetNodes sets the nodes returned by GetNodeAllocatable
+func (m *MockK8sClient) SetNodes(nodes []k8s.NodeAllocatable) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes = nodes
+}
+
 // CreateNamespace creates a mock namespace
 func (m *MockK8sClient) CreateNamespace(ctx context.Context, name string, labels map[string]string) error {
+	if err := m.injectedFailure(ctx, "CreateNamespace"); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.terminating[name] {
+		return fmt.Errorf("namespace %s is being terminated", name)
+	}
 	if m.namespaces[name] {
 		return fmt.Errorf("namespace already exists")
 	}
 
 	m.namespaces[name] = true
+	m.namespaceLabels[name] = copyLabels(labels)
+	m.namespaceCreated[name] = time.Now()
 	m.pods[name] = make(map[string]*corev1.Pod)
 	return nil
 }
 
+// ListNamespaces lists the mock namespaces matching labelSelector
+func (m *MockK8sClient) ListNamespaces(ctx context.Context, labelSelector string) (*corev1.NamespaceList, error) {
+	if err := m.injectedFailure(ctx, "ListNamespaces"); err != nil {
+		return nil, err
+	}
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := &corev1.NamespaceList{}
+	for name := range m.namespaces {
+		if !selector.Matches(labels.Set(m.namespaceLabels[name])) {
+			continue
+		}
+		list.Items = append(list.Items, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            copyLabels(m.namespaceLabels[name]),
+			CreationTimestamp: metav1.NewTime(m.namespaceCreated[name]),
+		}})
+	}
+	return list, nil
+}
+
+// SetNamespaceCreated changes the creation time of a namespace (for age-based checks)
+func (m *MockK8sClient) SetNamespaceCreated(name string, created time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.namespaceCreated[name] = created
+}
+
+// UpdateNamespaceLabels sets and removes labels on a mock namespace
+func (m *MockK8sClient) UpdateNamespaceLabels(ctx context.Context, name string, add map[string]string, remove []string) error {
+	if err := m.injectedFailure(ctx, "UpdateNamespaceLabels"); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.namespaces[name] {
+		return fmt.Errorf("namespace not found")
+	}
+	m.namespaceLabels[name] = patchLabels(m.namespaceLabels[name], add, remove)
+	return nil
+}
+
+// NamespaceLabels returns the current labels of a namespace
+func (m *MockK8sClient) NamespaceLabels(name string) map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyLabels(m.namespaceLabels[name])
+}
+
+// SetNamespaceDeletionDelay makes deleted namespaces stay Terminating for d before they are gone,
+// like namespaces whose finalizers take a while. DeleteNamespace then returns right away, as when
+// its caller stops waiting for the deletion.
+func (m *MockK8sClient) SetNamespaceDeletionDelay(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nsDeletionDelay = d
+}
+
 // DeleteNamespace deletes a mock namespace
 func (m *MockK8sClient) DeleteNamespace(ctx context.Context, name string) error {
+	if err := m.injectedFailure(ctx, "DeleteNamespace"); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.nsDeletionDelay > 0 && m.namespaces[name] {
+		if m.terminating[name] {
+			return nil
+		}
+		// The namespace's content goes first; the namespace itself once the delay has passed
+		m.terminating[name] = true
+		for podName, pod := range m.pods[name] {
+			m.notifyPodLocked(name, podName, pod, true)
+		}
+		m.pods[name] = make(map[string]*corev1.Pod)
+		time.AfterFunc(m.nsDeletionDelay, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.terminating[name] {
+				m.removeNamespaceLocked(name)
+			}
+		})
+		return nil
+	}
+	m.removeNamespaceLocked(name)
+	return nil
+}
+
+// removeNamespaceLocked removes a namespace and everything in it. Callers hold m.mu.
+func (m *MockK8sClient) removeNamespaceLocked(name string) {
 	delete(m.namespaces, name)
+	delete(m.terminating, name)
+	delete(m.namespaceLabels, name)
+	delete(m.namespaceCreated, name)
+	for podName, pod := range m.pods[name] {
+		m.notifyPodLocked(name, podName, pod, true)
+	}
 	delete(m.pods, name)
-	return nil
+	delete(m.serviceAccounts, name)
+}
+
+// GetNamespace returns a mock namespace, with phase Terminating while it is being deleted, or nil
+func (m *MockK8sClient) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	if err := m.injectedFailure(ctx, "GetNamespace"); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.namespaces[name] {
+		return nil, nil
+	}
+	phase := corev1.NamespaceActive
+	if m.terminating[name] {
+		phase = corev1.NamespaceTerminating
+	}
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            copyLabels(m.namespaceLabels[name]),
+			CreationTimestamp: metav1.NewTime(m.namespaceCreated[name]),
+		},
+		Status: corev1.NamespaceStatus{Phase: phase},
+	}, nil
 }
 
 // NamespaceExists checks if a namespace exists
 func (m *MockK8sClient) NamespaceExists(ctx context.Context, name string) (bool, error) {
+	if err := m.injectedFailure(ctx, "NamespaceExists"); err != nil {
+		return false, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return m.namespaces[name], nil
@@ -106,6 +366,9 @@ func (m *MockK8sClient) NamespaceExists(ctx context.Context, name string) (bool,
 
 // CreateResourceQuota creates a mock resource quota
 func (m *MockK8sClient) CreateResourceQuota(ctx context.Context, namespace, cpu, memory, storage string) error {
+	if err := m.injectedFailure(ctx, "CreateResourceQuota"); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -124,6 +387,9 @@ func (m *MockK8sClient) CreateNetworkPolicy(ctx context.Context, namespace strin
 
 // CreateNetworkPolicyWithConfig creates a mock network policy with config
 func (m *MockK8sClient) CreateNetworkPolicyWithConfig(ctx context.Context, namespace string, config *k8s.NetworkPolicyConfig) error {
+	if err := m.injectedFailure(ctx, "CreateNetworkPolicyWithConfig"); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -132,11 +398,49 @@ func (m *MockK8sClient) CreateNetworkPolicyWithConfig(ctx context.Context, names
 	}
 
 	m.policies[namespace] = true
+	m.policyConfigs[namespace] = config
+	return nil
+}
+
+// NetworkPolicyConfig returns the config the namespace's network policy was created with (nil
+// for the default policy)
+func (m *MockK8sClient) NetworkPolicyConfig(namespace string) *k8s.NetworkPolicyConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.policyConfigs[namespace]
+}
+
+// ApplyServiceAccount creates or updates a mock service account
+func (m *MockK8sClient) ApplyServiceAccount(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	if err := m.injectedFailure(ctx, "ApplyServiceAccount"); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.namespaces[namespace] {
+		return fmt.Errorf("namespace not found")
+	}
+	if m.serviceAccounts[namespace] == nil {
+		m.serviceAccounts[namespace] = make(map[string]map[string]string)
+	}
+	m.serviceAccounts[namespace][name] = maps.Clone(annotations)
 	return nil
 }
 
+// ServiceAccount returns the annotations of a service account and whether it exists
+func (m *MockK8sClient) ServiceAccount(namespace, name string) (map[string]string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	annotations, ok := m.serviceAccounts[namespace][name]
+	return annotations, ok
+}
+
 // CreatePod creates a mock pod
 func (m *MockK8sClient) CreatePod(ctx context.Context, spec *k8s.PodSpec) error {
+	if err := m.injectedFailure(ctx, "CreatePod"); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -149,23 +453,36 @@ func (m *MockK8sClient) CreatePod(ctx context.Context, spec *k8s.PodSpec) error
 			Phase: corev1.PodPending,
 		},
 	}
+	pod.Name = spec.Name
+	pod.Namespace = spec.Namespace
+	pod.Labels = copyLabels(spec.Labels)
 
 	if m.pods[spec.Namespace] == nil {
 		m.pods[spec.Namespace] = make(map[string]*corev1.Pod)
 	}
 
 	m.pods[spec.Namespace][spec.Name] = pod
+	m.notifyPodLocked(spec.Namespace, spec.Name, pod, false)
+	m.createdPods[spec.Namespace] = append(m.createdPods[spec.Namespace], spec.Name)
+	if m.podSpecs[spec.Namespace] == nil {
+		m.podSpecs[spec.Namespace] = make(map[string]*k8s.PodSpec)
+	}
+	m.podSpecs[spec.Namespace][spec.Name] = spec
 	return nil
 }
 
 // GetPod retrieves a mock pod
 func (m *MockK8sClient) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	if err := m.injectedFailure(ctx, "GetPod"); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	if pods, ok := m.pods[namespace]; ok {
 		if pod, ok := pods[name]; ok {
-			return pod, nil
+			// A copy, like the API server returns: the mock keeps updating its own pod
+			return pod.DeepCopy(), nil
 		}
 	}
 
@@ -174,10 +491,37 @@ func (m *MockK8sClient) GetPod(ctx context.Context, namespace, name string) (*co
 
 // DeletePod deletes a mock pod
 func (m *MockK8sClient) DeletePod(ctx context.Context, namespace, name string, force bool) error {
+	if err := m.injectedFailure(ctx, "DeletePod"); err != nil {
+		return err
+	}
+	var grace *int64
+	if force {
+		grace = new(int64)
+	}
+	return m.deletePod(namespace, name, grace)
+}
+
+// DeletePodWithGracePeriod deletes a mock pod, recording the grace period it was given
+func (m *MockK8sClient) DeletePodWithGracePeriod(ctx context.Context, namespace, name string, gracePeriodSeconds int64) error {
+	if err := m.injectedFailure(ctx, "DeletePodWithGracePeriod"); err != nil {
+		return err
+	}
+	return m.deletePod(namespace, name, &gracePeriodSeconds)
+}
+
+// deletePod removes a mock pod at once, whatever its grace period
+func (m *MockK8sClient) deletePod(namespace, name string, grace *int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.deleteGrace[namespace] == nil {
+		m.deleteGrace[namespace] = make(map[string]*int64)
+	}
+	m.deleteGrace[namespace][name] = grace
 	if pods, ok := m.pods[namespace]; ok {
+		if pod, ok := pods[name]; ok {
+			m.notifyPodLocked(namespace, name, pod, true)
+		}
 		delete(pods, name)
 		return nil
 	}
@@ -185,8 +529,64 @@ func (m *MockK8sClient) DeletePod(ctx context.Context, namespace, name string, f
 	return fmt.Errorf("pod not found")
 }
 
+// DeleteGracePeriod returns the grace period the last deletion of a pod was given (nil = the
+// pod's own) and whether it was deleted at all
+func (m *MockK8sClient) DeleteGracePeriod(namespace, name string) (*int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	grace, ok := m.deleteGrace[namespace][name]
+	return grace, ok
+}
+
+// PatchPodLabels sets and removes labels on a mock pod
+func (m *MockK8sClient) PatchPodLabels(ctx context.Context, namespace, name string, add map[string]string, remove []string) error {
+	if err := m.injectedFailure(ctx, "PatchPodLabels"); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pod, ok := m.pods[namespace][name]
+	if !ok {
+		return fmt.Errorf("pod not found")
+	}
+	pod.Labels = patchLabels(pod.Labels, add, remove)
+	return nil
+}
+
+// copyLabels returns a copy of labels
+func copyLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+// patchLabels returns a copy of labels with add set and remove deleted
+func patchLabels(labels, add map[string]string, remove []string) map[string]string {
+	out := copyLabels(labels)
+	for _, k := range remove {
+		delete(out, k)
+	}
+	for k, v := range add {
+		out[k] = v
+	}
+	return out
+}
+
 // WaitForPodRunning simulates waiting for a pod to be running
 func (m *MockK8sClient) WaitForPodRunning(ctx context.Context, namespace, name string) error {
+	if err := m.injectedFailure(ctx, "WaitForPodRunning"); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	hold := m.holdRunning
+	m.mu.RUnlock()
+	if hold {
+		return m.waitForPodPhase(ctx, namespace, name, corev1.PodRunning)
+	}
+
 	// In mock, immediately mark as running
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -194,6 +594,7 @@ func (m *MockK8sClient) WaitForPodRunning(ctx context.Context, namespace, name s
 	if pods, ok := m.pods[namespace]; ok {
 		if pod, ok := pods[name]; ok {
 			pod.Status.Phase = corev1.PodRunning
+			m.notifyPodLocked(namespace, name, pod, false)
 			return nil
 		}
 	}
@@ -202,7 +603,26 @@ func (m *MockK8sClient) WaitForPodRunning(ctx context.Context, namespace, name s
 }
 
 // WaitForPodCompletion simulates waiting for a pod to complete
-func (m *MockK8sClient) WaitForPodCompletion(ctx context.Context, namespace, name string) (*k8s.PodCompletionResult, error) {
+func (m *MockK8sClient) WaitForPodCompletion(ctx context.Context, namespace, name string, maxLogBytes int64) (*k8s.PodCompletionResult, error) {
+	if err := m.injectedFailure(ctx, "WaitForPodCompletion"); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	hold := m.holdCompletion
+	m.mu.RUnlock()
+	if hold {
+		return m.waitForPodDeleted(ctx, namespace, name)
+	}
+
+	exitCode := 0
+	m.mu.RLock()
+	completion := m.completion
+	spec := m.podSpecs[namespace][name]
+	m.mu.RUnlock()
+	if completion != nil && spec != nil {
+		exitCode = completion(spec)
+	}
+
 	// In mock, immediately mark as succeeded and return
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -210,37 +630,152 @@ func (m *MockK8sClient) WaitForPodCompletion(ctx context.Context, namespace, nam
 	if pods, ok := m.pods[namespace]; ok {
 		if pod, ok := pods[name]; ok {
 			pod.Status.Phase = corev1.PodSucceeded
+			m.notifyPodLocked(namespace, name, pod, false)
 
-			// Get logs if available
-			logs := "mock execution output\n"
+			// Get logs if available, capped like the real client
+			var source io.Reader = strings.NewReader("mock execution output\n")
 			if podLogs, ok := m.podLogs[namespace]; ok {
 				if logContent, ok := podLogs[name]; ok {
-					logs = logContent
+					source = strings.NewReader(logContent)
 				}
 			}
+			if m.logSource != nil {
+				source = m.logSource(namespace, name)
+			}
+			logs := k8s.NewLimitedBuffer(maxLogBytes)
+			if _, err := io.Copy(logs, source); err != nil {
+				return nil, err
+			}
 
-			return &k8s.PodCompletionResult{
-				Phase:    corev1.PodSucceeded,
-				ExitCode: 0,
-				Logs:     logs,
-			}, nil
+			now := time.Now()
+			result := &k8s.PodCompletionResult{
+				Phase:         corev1.PodSucceeded,
+				ExitCode:      exitCode,
+				Logs:          logs.String(),
+				LogBytesTotal: logs.Total(),
+				LogsTruncated: logs.Truncated(),
+				ScheduledAt:   &now,
+				StartedAt:     &now,
+			}
+			// Like the real client, read the wrapper's result off a wrapped pod's log
+			if spec != nil && spec.Wrapper != nil {
+				result.TakeWrapperFooter()
+			}
+			return result, nil
 		}
 	}
 
 	return nil, fmt.Errorf("pod not found")
 }
 
+// waitForPodDeleted simulates a long-running pod: blocks until it is deleted or ctx is done
+func (m *MockK8sClient) waitForPodDeleted(ctx context.Context, namespace, name string) (*k8s.PodCompletionResult, error) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m.mu.RLock()
+		_, exists := m.pods[namespace][name]
+		m.mu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("pod %s/%s was deleted", namespace, name)
+		}
+		select {
+		case <-ctx.Done():
+			// Like the real client, report the logs written so far
+			m.mu.RLock()
+			logs := m.podLogs[namespace][name]
+			m.mu.RUnlock()
+			return &k8s.PodCompletionResult{
+				Phase:         corev1.PodRunning,
+				Logs:          logs,
+				LogBytesTotal: int64(len(logs)),
+			}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForPodPhase blocks until the pod reaches phase, is deleted, or ctx is done
+func (m *MockK8sClient) waitForPodPhase(ctx context.Context, namespace, name string, phase corev1.PodPhase) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m.mu.RLock()
+		pod, exists := m.pods[namespace][name]
+		reached := exists && pod.Status.Phase == phase
+		m.mu.RUnlock()
+		if !exists {
+			return fmt.Errorf("pod not found")
+		}
+		if reached {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 // ExecInPod simulates command execution in a pod
 func (m *MockK8sClient) ExecInPod(ctx context.Context,
 	namespace, podName string,
 	command []string,
 	stdin io.Reader,
 	stdout, stderr io.Writer) error {
+	// The orchestrator's shell probe is answered before injected failures and handlers, which
+	// only see the commands themselves
+	m.mu.RLock()
+	noShell := m.noShell
+	m.mu.RUnlock()
+	if noShell && len(command) > 0 && command[0] == "/bin/sh" {
+		return fmt.Errorf(`exec: "/bin/sh": stat /bin/sh: no such file or directory`)
+	}
+	if slices.Equal(command, k8s.ShellProbeCommand) {
+		return nil
+	}
+	if err := m.injectedFailure(ctx, "ExecInPod"); err != nil {
+		return err
+	}
+	// Buffered stdin (e.g. an upload) and files (e.g. a restored snapshot) are recorded;
+	// streaming stdin (attach) is left unread
+	_, buffered := stdin.(interface{ Len() int })
+	_, file := stdin.(*os.File)
+	if buffered || file {
+		input, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		if m.execStdin[namespace] == nil {
+			m.execStdin[namespace] = make(map[string][][]byte)
+		}
+		m.execStdin[namespace][podName] = append(m.execStdin[namespace][podName], input)
+		m.mu.Unlock()
+	}
+
+	m.mu.RLock()
+	stream := m.execStream
+	_, found := m.pods[namespace][podName]
+	m.mu.RUnlock()
+	if stream != nil && found {
+		// Called unlocked so a blocking handler does not hold up other calls
+		return stream(ctx, command, stdout, stderr)
+	}
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	if pods, ok := m.pods[namespace]; ok {
 		if _, ok := pods[podName]; ok {
+			if m.execHandler != nil {
+				out, err := m.execHandler(namespace, podName, command)
+				if stdout != nil {
+					stdout.Write([]byte(out))
+				}
+				return err
+			}
 			// Simulate successful execution
 			if stdout != nil {
 				stdout.Write([]byte("mock output\n"))
@@ -252,8 +787,89 @@ func (m *MockK8sClient) ExecInPod(ctx context.Context,
 	return fmt.Errorf("pod not found")
 }
 
+// ExecStdin returns the buffered stdin of every exec into the pod that was given one, in order
+func (m *MockK8sClient) ExecStdin(namespace, podName string) [][]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([][]byte(nil), m.execStdin[namespace][podName]...)
+}
+
+// SetExecHandler makes ExecInPod return the handler's output and error (nil restores the default)
+func (m *MockK8sClient) SetExecHandler(handler func(namespace, podName string, command []string) (string, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.execHandler = handler
+}
+
+// ProbeHTTPGet simulates an HTTP GET against a pod port (200 "ok" unless a handler is set)
+func (m *MockK8sClient) ProbeHTTPGet(ctx context.Context, namespace, podName string, port int, path string) (int, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.pods[namespace][podName]; !ok {
+		return 0, "", fmt.Errorf("pod not found")
+	}
+	if m.httpGetHandler != nil {
+		return m.httpGetHandler(namespace, podName, port, path)
+	}
+	return 200, "ok", nil
+}
+
+// SetNoShell makes pods behave like images without /bin/sh: execs of it fail (false restores
+// the default)
+func (m *MockK8sClient) SetNoShell(noShell bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.noShell = noShell
+}
+
+// SetExecStreamHandler makes ExecInPod call handler with the exec's context and output writers,
+// e.g. to write some output and then block past the deadline (nil restores the default)
+func (m *MockK8sClient) SetExecStreamHandler(handler func(ctx context.Context, command []string, stdout, stderr io.Writer) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.execStream = handler
+}
+
+// SetHTTPGetHandler makes ProbeHTTPGet return the handler's response (nil restores the default)
+func (m *MockK8sClient) SetHTTPGetHandler(handler func(namespace, podName string, port int, path string) (int, string, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.httpGetHandler = handler
+}
+
+// PortForward simulates forwarding a connection to a pod port: the bytes sent are echoed back
+// until conn is drained, unless a handler is set
+func (m *MockK8sClient) PortForward(ctx context.Context, namespace, podName string, port int, conn io.ReadWriter) error {
+	if err := m.injectedFailure(ctx, "PortForward"); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	handler := m.portForward
+	_, found := m.pods[namespace][podName]
+	m.mu.RUnlock()
+	if !found {
+		return fmt.Errorf("pod not found")
+	}
+	if handler != nil {
+		// Called unlocked so a blocking handler does not hold up other calls
+		return handler(ctx, port, conn)
+	}
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+// SetPortForwardHandler makes PortForward call handler with each forwarded connection (nil
+// restores the echo)
+func (m *MockK8sClient) SetPortForwardHandler(handler func(ctx context.Context, port int, conn io.ReadWriter) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.portForward = handler
+}
+
 // GetPodLogs simulates retrieving pod logs
-func (m *MockK8sClient) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64) (string, error) {
+// Custom logs set via SetPodLogs are returned verbatim (include timestamps in the fixture if needed).
+func (m *MockK8sClient) GetPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, timestamps bool) (string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -267,7 +883,7 @@ func (m *MockK8sClient) GetPodLogs(ctx context.Context, namespace, podName strin
 	// Default: check if pod exists
 	if pods, ok := m.pods[namespace]; ok {
 		if _, ok := pods[podName]; ok {
-			return "mock log output\n", nil
+			return defaultMockLogs(timestamps), nil
 		}
 	}
 
@@ -275,7 +891,7 @@ func (m *MockK8sClient) GetPodLogs(ctx context.Context, namespace, podName strin
 }
 
 // StreamPodLogs simulates streaming pod logs
-func (m *MockK8sClient) StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow bool) (io.ReadCloser, error) {
+func (m *MockK8sClient) StreamPodLogs(ctx context.Context, namespace, podName string, tailLines *int64, follow, timestamps bool) (io.ReadCloser, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -291,7 +907,7 @@ func (m *MockK8sClient) StreamPodLogs(ctx context.Context, namespace, podName st
 	if logContent == "" {
 		if pods, ok := m.pods[namespace]; ok {
 			if _, ok := pods[podName]; ok {
-				logContent = "mock log output\n"
+				logContent = defaultMockLogs(timestamps)
 			}
 		}
 	}
@@ -305,8 +921,19 @@ func (m *MockK8sClient) StreamPodLogs(ctx context.Context, namespace, podName st
 	return io.NopCloser(strings.NewReader(logContent)), nil
 }
 
+// defaultMockLogs returns the log output of a pod without custom logs
+func defaultMockLogs(timestamps bool) string {
+	if timestamps {
+		return time.Now().UTC().Format(time.RFC3339Nano) + " mock log output\n"
+	}
+	return "mock log output\n"
+}
+
 // ListPods lists mock pods in a namespace
 func (m *MockK8sClient) ListPods(ctx context.Context, namespace, labelSelector string) (*corev1.PodList, error) {
+	if err := m.injectedFailure(ctx, "ListPods"); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -323,6 +950,102 @@ func (m *MockK8sClient) ListPods(ctx context.Context, namespace, labelSelector s
 	return podList, nil
 }
 
+// mockPodWatch is an open WatchPods call: changes to matching pods queue up in events until the
+// call delivers them
+type mockPodWatch struct {
+	selector labels.Selector
+	events   []k8s.PodEvent
+	wake     chan struct{}
+	closed   bool
+}
+
+// WatchPods reports the mock pods matching labelSelector in all namespaces, then their changes,
+// until ctx is canceled or CloseWatches is called (returning k8s.ErrWatchClosed)
+func (m *MockK8sClient) WatchPods(ctx context.Context, labelSelector string, onList func([]k8s.PodEvent), onEvent func(k8s.PodEvent)) error {
+	if err := m.injectedFailure(ctx, "WatchPods"); err != nil {
+		return err
+	}
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return err
+	}
+	w := &mockPodWatch{selector: selector, wake: make(chan struct{}, 1)}
+	m.mu.Lock()
+	var listed []k8s.PodEvent
+	for namespace, pods := range m.pods {
+		for name, pod := range pods {
+			if selector.Matches(labels.Set(pod.Labels)) {
+				listed = append(listed, mockPodEvent(namespace, name, pod, false))
+			}
+		}
+	}
+	m.podWatches[w] = struct{}{}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.podWatches, w)
+		m.mu.Unlock()
+	}()
+
+	onList(listed)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.wake:
+		}
+		m.mu.Lock()
+		events, closed := w.events, w.closed
+		w.events = nil
+		m.mu.Unlock()
+		for _, event := range events {
+			onEvent(event)
+		}
+		if closed {
+			return k8s.ErrWatchClosed
+		}
+	}
+}
+
+// CloseWatches ends every open WatchPods call, like the API server dropping the watches
+func (m *MockK8sClient) CloseWatches() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for w := range m.podWatches {
+		w.closed = true
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// PodWatchCount returns the number of open WatchPods calls
+func (m *MockK8sClient) PodWatchCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.podWatches)
+}
+
+// notifyPodLocked queues a pod change for the watches it matches; callers hold m.mu
+func (m *MockK8sClient) notifyPodLocked(namespace, name string, pod *corev1.Pod, deleted bool) {
+	for w := range m.podWatches {
+		if w.closed || !w.selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		w.events = append(w.events, mockPodEvent(namespace, name, pod, deleted))
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func mockPodEvent(namespace, name string, pod *corev1.Pod, deleted bool) k8s.PodEvent {
+	return k8s.PodEvent{Namespace: namespace, Name: name, Labels: copyLabels(pod.Labels), Phase: pod.Status.Phase,
+		NodeName: pod.Spec.NodeName, Deleted: deleted}
+}
+
 // SetPodRunning manually sets a pod to running state (for testing)
 func (m *MockK8sClient) SetPodRunning(namespace, name string) {
 	m.mu.Lock()
@@ -331,6 +1054,7 @@ func (m *MockK8sClient) SetPodRunning(namespace, name string) {
 	if pods, ok := m.pods[namespace]; ok {
 		if pod, ok := pods[name]; ok {
 			pod.Status.Phase = corev1.PodRunning
+			m.notifyPodLocked(namespace, name, pod, false)
 		}
 	}
 }
@@ -343,6 +1067,35 @@ func (m *MockK8sClient) SetPodFailed(namespace, name string) {
 	if pods, ok := m.pods[namespace]; ok {
 		if pod, ok := pods[name]; ok {
 			pod.Status.Phase = corev1.PodFailed
+			m.notifyPodLocked(namespace, name, pod, false)
+		}
+	}
+}
+
+// SetPodEvicted fails a pod the way the kubelet does when it evicts it (for testing)
+func (m *MockK8sClient) SetPodEvicted(namespace, name, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pods, ok := m.pods[namespace]; ok {
+		if pod, ok := pods[name]; ok {
+			pod.Status.Phase = corev1.PodFailed
+			pod.Status.Reason = "Evicted"
+			pod.Status.Message = message
+			m.notifyPodLocked(namespace, name, pod, false)
+		}
+	}
+}
+
+// SetPodNode schedules a pod on a node (for testing per-node pod churn)
+func (m *MockK8sClient) SetPodNode(namespace, name, node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pods, ok := m.pods[namespace]; ok {
+		if pod, ok := pods[name]; ok {
+			pod.Spec.NodeName = node
+			m.notifyPodLocked(namespace, name, pod, false)
 		}
 	}
 }
@@ -355,6 +1108,7 @@ func (m *MockK8sClient) SetPodPending(namespace, name string) {
 	if pods, ok := m.pods[namespace]; ok {
 		if pod, ok := pods[name]; ok {
 			pod.Status.Phase = corev1.PodPending
+			m.notifyPodLocked(namespace, name, pod, false)
 		}
 	}
 }
@@ -370,17 +1124,52 @@ func (m *MockK8sClient) GetPodCount(namespace string) int {
 	return 0
 }
 
+// CreatedPodNames returns the names of all pods ever created in a namespace (including deleted
+// ones), in creation order
+func (m *MockK8sClient) CreatedPodNames(namespace string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string{}, m.createdPods[namespace]...)
+}
+
+// CreatedPodSpec returns the spec a pod was created from (also after it was deleted), or nil
+func (m *MockK8sClient) CreatedPodSpec(namespace, name string) *k8s.PodSpec {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.podSpecs[namespace][name]
+}
+
 // Reset clears all mock data
 func (m *MockK8sClient) Reset() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	m.namespaces = make(map[string]bool)
+	m.namespaceLabels = make(map[string]map[string]string)
+	m.namespaceCreated = make(map[string]time.Time)
+	m.terminating = make(map[string]bool)
+	m.nsDeletionDelay = 0
 	m.pods = make(map[string]map[string]*corev1.Pod)
 	m.quotas = make(map[string]bool)
+	m.serviceAccounts = make(map[string]map[string]map[string]string)
 	m.policies = make(map[string]bool)
+	m.policyConfigs = make(map[string]*k8s.NetworkPolicyConfig)
 	m.podLogs = make(map[string]map[string]string)
+	m.createdPods = make(map[string][]string)
+	m.podSpecs = make(map[string]map[string]*k8s.PodSpec)
+	m.deleteGrace = make(map[string]map[string]*int64)
+	m.execStdin = make(map[string]map[string][][]byte)
+	m.execHandler = nil
+	m.execStream = nil
+	m.logSource = nil
+	m.httpGetHandler = nil
 	m.healthCheckError = false
+
+	m.faultMu.Lock()
+	m.failures = make(map[string][]error)
+	m.calls = make(map[string]int)
+	m.faults = nil
+	m.faultMu.Unlock()
 }
 
 // SetHealthCheckError sets whether health check should fail
@@ -390,6 +1179,36 @@ func (m *MockK8sClient) SetHealthCheckError(fail bool) {
 	m.healthCheckError = fail
 }
 
+// SetHoldPodCompletion makes WaitForPodCompletion block until the pod is deleted (long-running executions)
+func (m *MockK8sClient) SetHoldPodCompletion(hold bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.holdCompletion = hold
+}
+
+// SetHoldPodRunning makes WaitForPodRunning block until SetPodRunning is called for the pod
+func (m *MockK8sClient) SetHoldPodRunning(hold bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.holdRunning = hold
+}
+
+// SetContainerWaiting marks the pod's container as waiting with the given reason (e.g. "ContainerCreating")
+func (m *MockK8sClient) SetContainerWaiting(namespace, name, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pod, ok := m.pods[namespace][name]; ok {
+		// Replace rather than mutate so pods already handed out by GetPod stay unchanged
+		updated := pod.DeepCopy()
+		updated.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "main",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+		}}
+		m.pods[namespace][name] = updated
+	}
+}
+
 // SetPodLogs sets custom logs for a pod
 func (m *MockK8sClient) SetPodLogs(namespace, podName, logs string) {
 	m.mu.Lock()
@@ -401,6 +1220,23 @@ func (m *MockK8sClient) SetPodLogs(namespace, podName, logs string) {
 	m.podLogs[namespace][podName] = logs
 }
 
+// SetCompletionLogSource makes WaitForPodCompletion read every completed pod's log from the
+// reader returned by source, so tests can stream large logs without holding them in memory
+// (nil restores the default)
+func (m *MockK8sClient) SetCompletionLogSource(source func(namespace, podName string) io.Reader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logSource = source
+}
+
+// SetCompletionHandler makes WaitForPodCompletion call handler with the pod's spec before the
+// pod completes; the handler may block and returns the pod's exit code (nil restores exit code 0)
+func (m *MockK8sClient) SetCompletionHandler(handler func(spec *k8s.PodSpec) int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.completion = handler
+}
+
 // PodSpec is a helper type for creating pods in tests
 type PodSpec struct {
 	Name      string
@@ -0,0 +1,198 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// activityFeed returns the whole feed of an environment, read page by page
+func activityFeed(t *testing.T, orch *orchestrator.Orchestrator, envID string, pageSize int) []models.ActivityItem {
+	t.Helper()
+	var items []models.ActivityItem
+	opts := orchestrator.ActivityFeedOptions{Limit: pageSize}
+	for {
+		resp, err := orch.ActivityFeed(context.Background(), envID, opts)
+		require.NoError(t, err)
+		items = append(items, resp.Items...)
+		if resp.NextPageToken == "" {
+			return items
+		}
+		opts.PageToken = resp.NextPageToken
+	}
+}
+
+// waitForActivity waits until the feed of an environment has an item with the given action
+// (e.g. "provisioned", which is written after the environment is seen running)
+func waitForActivity(t *testing.T, orch *orchestrator.Orchestrator, envID, action string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		_, ok := activityByAction(activityFeed(t, orch, envID, 100))[action]
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func activityByAction(items []models.ActivityItem) map[string]models.ActivityItem {
+	byAction := make(map[string]models.ActivityItem)
+	for _, item := range items {
+		byAction[item.Action] = item
+	}
+	return byAction
+}
+
+func TestActivityFeedMergesSources(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "activity"})
+	waitForActivity(t, orch, env.ID, "provisioned")
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"echo", "hello"},
+	}, "user-123")
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	image := "python:3.12-slim"
+	orch.EnvironmentUpdated(ctx, env.ID, "user-456", &models.UpdateEnvironmentRequest{
+		Image:  &image,
+		Labels: &map[string]string{"team": "data"},
+	})
+	userService := users.NewService(db, zap.NewNop())
+	owner := createUserForTest(t, userService, "activity-owner", "password123", users.RoleUser)
+	viewer := createUserForTest(t, userService, "activity-viewer", "password123", users.RoleUser)
+	_, err = permissions.NewService(db, zap.NewNop()).GrantPermission(ctx, viewer.ID, env.ID, permissions.PermissionViewer, owner.ID)
+	require.NoError(t, err)
+
+	items := activityFeed(t, orch, env.ID, 100)
+	byAction := activityByAction(items)
+	assert.Equal(t, "user-123", byAction["created"].ActorID)
+	assert.Contains(t, byAction, "provisioned")
+	assert.NotContains(t, byAction, "provisioning_phase")
+
+	assert.Equal(t, "Configuration updated: image, labels", byAction["updated"].Summary)
+	assert.Equal(t, "user-456", byAction["updated"].ActorID)
+	assert.Equal(t, "Permission viewer granted to user "+viewer.ID, byAction["permission_granted"].Summary)
+	assert.Equal(t, owner.ID, byAction["permission_granted"].ActorID)
+
+	submitted := byAction["execution.submitted"]
+	assert.Equal(t, "execution", submitted.Source)
+	assert.Equal(t, "Execution submitted: echo hello", submitted.Summary)
+	assert.Equal(t, "/api/v1/executions/"+exec.ID, submitted.Link)
+	assert.Equal(t, "user-123", submitted.ActorID)
+	completed := byAction["execution.completed"]
+	assert.Equal(t, "Execution completed with exit code 0", completed.Summary)
+	assert.Equal(t, "/api/v1/executions/"+exec.ID, completed.Link)
+
+	// Newest first
+	for i := 1; i < len(items); i++ {
+		assert.False(t, items[i].Timestamp.After(items[i-1].Timestamp), "items %d and %d out of order", i-1, i)
+	}
+}
+
+func TestActivityFeedPagination(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "activity-pages"})
+	// Every page size must walk the same feed: nothing may be added while it is read
+	waitForActivity(t, orch, env.ID, "provisioned")
+	// Audit entries and an execution sharing one timestamp, newer than everything else
+	at := time.Now().Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.SaveAuditEntry(ctx, &models.AuditEntry{
+			Action:       "environment.test",
+			ResourceType: "environment",
+			ResourceID:   env.ID,
+			Message:      "same timestamp",
+			CreatedAt:    at,
+		}))
+	}
+	completedAt := at
+	exitCode := 0
+	require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+		ID:            "exec-same-timestamp",
+		EnvironmentID: env.ID,
+		Command:       []string{"true"},
+		Status:        models.ExecutionStatusCompleted,
+		CreatedAt:     at,
+		CompletedAt:   &completedAt,
+		ExitCode:      &exitCode,
+	}))
+
+	all := activityFeed(t, orch, env.ID, 1000)
+	require.GreaterOrEqual(t, len(all), 7)
+	// Items with the same timestamp are ordered by ID, descending
+	for i := 1; i < 7; i++ {
+		assert.True(t, all[i].Timestamp.Equal(at))
+		assert.Greater(t, all[i-1].ID, all[i].ID)
+	}
+	assert.Equal(t, "execution.submitted:exec-same-timestamp", all[0].ID)
+	assert.Equal(t, "execution.completed:exec-same-timestamp", all[1].ID)
+
+	// Every page size walks the same feed, without gaps or repeats
+	for _, size := range []int{1, 2, 3} {
+		assert.Equal(t, all, activityFeed(t, orch, env.ID, size), "page size %d", size)
+	}
+
+	// since returns only the newer items
+	before := at.Add(-time.Nanosecond)
+	resp, err := orch.ActivityFeed(ctx, env.ID, orchestrator.ActivityFeedOptions{Since: &before})
+	require.NoError(t, err)
+	assert.Equal(t, all[:7], resp.Items)
+	resp, err = orch.ActivityFeed(ctx, env.ID, orchestrator.ActivityFeedOptions{Since: &at})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Items)
+
+	_, err = orch.ActivityFeed(ctx, env.ID, orchestrator.ActivityFeedOptions{PageToken: "not-a-token"})
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+}
+
+func TestActivityFeedOfDeletedEnvironment(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "activity-deleted"})
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	orch.EnvironmentDeleted(ctx, env.ID, "user-123", false)
+
+	// The events are gone with the environment; the audit log keeps the deletion
+	items := activityFeed(t, orch, env.ID, 100)
+	require.Len(t, items, 1)
+	assert.Equal(t, orchestrator.AuditActionEnvironmentDeleted, items[0].Action)
+	assert.Equal(t, "user-123", items[0].ActorID)
+
+	_, err := orch.ActivityFeed(ctx, "env-missing", orchestrator.ActivityFeedOptions{})
+	assert.ErrorIs(t, err, apierrors.NotFound)
+}
+
+func TestActivityAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	// The feed needs a database
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/env-1/activity", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), apierrors.CodeActivityUnavailable)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/env-1/activity?since=yesterday", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,193 @@
+package unit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// spotAffinity prefers spot nodes, keeps pods off arm64 and spreads them across zones
+func spotAffinity() *models.Affinity {
+	return &models.Affinity{
+		RequiredNodeTerms: []models.NodeSelectorTerm{{
+			MatchExpressions: []models.NodeSelectorRequirement{
+				{Key: "kubernetes.io/arch", Operator: models.NodeSelectorOpNotIn, Values: []string{"arm64"}},
+			},
+		}},
+		PreferredNodeTerms: []models.PreferredNodeTerm{{
+			Weight: 80,
+			MatchExpressions: []models.NodeSelectorRequirement{
+				{Key: "node.kubernetes.io/lifecycle", Operator: models.NodeSelectorOpIn, Values: []string{"spot"}},
+			},
+		}},
+		PodAntiAffinity: &models.PodAntiAffinity{TopologyKey: "topology.kubernetes.io/zone"},
+	}
+}
+
+func TestValidateAffinity(t *testing.T) {
+	v := validator.New(10000, 64*1024*1024*1024, 100*1024*1024*1024, 86400)
+	require.NoError(t, v.ValidateAffinity(spotAffinity()))
+	require.NoError(t, v.ValidateAffinity(&models.Affinity{
+		RequiredNodeTerms: []models.NodeSelectorTerm{{
+			MatchExpressions: []models.NodeSelectorRequirement{{Key: "gpu", Operator: models.NodeSelectorOpExists}},
+		}},
+		PodAntiAffinity: &models.PodAntiAffinity{MatchLabels: map[string]string{"team": "ml"}, Required: true},
+	}))
+
+	expr := func(key, op string, values ...string) []models.NodeSelectorTerm {
+		return []models.NodeSelectorTerm{{MatchExpressions: []models.NodeSelectorRequirement{{Key: key, Operator: op, Values: values}}}}
+	}
+	for name, tc := range map[string]struct {
+		affinity *models.Affinity
+		field    string
+	}{
+		"unknown operator":  {&models.Affinity{RequiredNodeTerms: expr("zone", "Gt", "1")}, "affinity.required_node_terms[0].match_expressions[0].operator"},
+		"in without values": {&models.Affinity{RequiredNodeTerms: expr("zone", "In")}, "affinity.required_node_terms[0].match_expressions[0].values"},
+		"exists with value": {&models.Affinity{RequiredNodeTerms: expr("gpu", "Exists", "true")}, "affinity.required_node_terms[0].match_expressions[0].values"},
+		"invalid key":       {&models.Affinity{RequiredNodeTerms: expr("bad key", "Exists")}, "affinity.required_node_terms[0].match_expressions[0].key"},
+		"invalid prefix":    {&models.Affinity{RequiredNodeTerms: expr("Example.COM/zone", "Exists")}, "affinity.required_node_terms[0].match_expressions[0].key"},
+		"invalid value":     {&models.Affinity{RequiredNodeTerms: expr("zone", "In", "us east")}, "affinity.required_node_terms[0].match_expressions[0].values"},
+		"empty term":        {&models.Affinity{RequiredNodeTerms: []models.NodeSelectorTerm{{}}}, "affinity.required_node_terms[0].match_expressions"},
+		"weight out of range": {&models.Affinity{PreferredNodeTerms: []models.PreferredNodeTerm{{
+			Weight: 101, MatchExpressions: expr("zone", "Exists")[0].MatchExpressions,
+		}}}, "affinity.preferred_node_terms[0].weight"},
+		"missing weight": {&models.Affinity{PreferredNodeTerms: []models.PreferredNodeTerm{{
+			MatchExpressions: expr("zone", "Exists")[0].MatchExpressions,
+		}}}, "affinity.preferred_node_terms[0].weight"},
+		"invalid topology key":  {&models.Affinity{PodAntiAffinity: &models.PodAntiAffinity{TopologyKey: "/zone"}}, "affinity.pod_anti_affinity.topology_key"},
+		"invalid match label":   {&models.Affinity{PodAntiAffinity: &models.PodAntiAffinity{MatchLabels: map[string]string{"app": "-x"}}}, "affinity.pod_anti_affinity.match_labels.app"},
+		"weight of required":    {&models.Affinity{PodAntiAffinity: &models.PodAntiAffinity{Required: true, Weight: 10}}, "affinity.pod_anti_affinity.weight"},
+		"anti weight too large": {&models.Affinity{PodAntiAffinity: &models.PodAntiAffinity{Weight: 500}}, "affinity.pod_anti_affinity.weight"},
+	} {
+		err := v.ValidateAffinity(tc.affinity)
+		require.Error(t, err, name)
+		var verrs validator.ValidationErrors
+		require.ErrorAs(t, err, &verrs, name)
+		assert.Equal(t, tc.field, verrs[0].Field, name)
+	}
+
+	// Create requests are checked too
+	err := v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name:      "affinity-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Affinity:  &models.Affinity{RequiredNodeTerms: expr("zone", "Gt", "1")},
+	})
+	assert.Error(t, err)
+}
+
+func TestToCoreAffinityMergesNodeSelector(t *testing.T) {
+	affinity := k8s.ToCoreAffinity(&k8s.Affinity{
+		RequiredNodeTerms: []k8s.NodeSelectorTerm{
+			{MatchExpressions: []k8s.NodeSelectorRequirement{{Key: "zone", Operator: "In", Values: []string{"a"}}}},
+			{MatchExpressions: []k8s.NodeSelectorRequirement{{Key: "gpu", Operator: "Exists"}}},
+		},
+		PreferredNodeTerms: []k8s.PreferredNodeTerm{
+			{Weight: 50, MatchExpressions: []k8s.NodeSelectorRequirement{{Key: "spot", Operator: "NotIn", Values: []string{"false"}}}},
+		},
+		PodAntiAffinity: &k8s.PodAntiAffinity{MatchLabels: map[string]string{"app": "agentbox"}},
+	}, map[string]string{"pool": "agents", "disk": "ssd"})
+	require.NotNil(t, affinity)
+
+	// Every required term also carries the node selector, or the terms (ORed) would escape it
+	terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	require.Len(t, terms, 2)
+	selector := []corev1.NodeSelectorRequirement{
+		{Key: "disk", Operator: corev1.NodeSelectorOpIn, Values: []string{"ssd"}},
+		{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"agents"}},
+	}
+	assert.Equal(t, append([]corev1.NodeSelectorRequirement{
+		{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}},
+	}, selector...), terms[0].MatchExpressions)
+	assert.Equal(t, append([]corev1.NodeSelectorRequirement{
+		{Key: "gpu", Operator: corev1.NodeSelectorOpExists},
+	}, selector...), terms[1].MatchExpressions)
+
+	preferred := affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	require.Len(t, preferred, 1)
+	assert.EqualValues(t, 50, preferred[0].Weight)
+	assert.Equal(t, corev1.NodeSelectorOpNotIn, preferred[0].Preference.MatchExpressions[0].Operator)
+
+	anti := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	require.Len(t, anti, 1)
+	assert.EqualValues(t, 100, anti[0].Weight)
+	assert.Equal(t, "kubernetes.io/hostname", anti[0].PodAffinityTerm.TopologyKey)
+	assert.Equal(t, map[string]string{"app": "agentbox"}, anti[0].PodAffinityTerm.LabelSelector.MatchLabels)
+	assert.Nil(t, affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+
+	assert.Nil(t, k8s.ToCoreAffinity(nil, map[string]string{"pool": "agents"}))
+	assert.Nil(t, k8s.ToCoreAffinity(&k8s.Affinity{}, nil))
+}
+
+func TestEnvironmentAffinityInheritedByAllPods(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:         "affinity-env",
+		NodeSelector: map[string]string{"pool": "agents"},
+		Affinity:     spotAffinity(),
+		Pool:         &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	assertAffinity := func(spec *k8s.PodSpec, name string) {
+		require.NotNil(t, spec, name)
+		assert.Equal(t, map[string]string{"pool": "agents"}, spec.NodeSelector, name)
+		require.NotNil(t, spec.Affinity, name)
+		require.Len(t, spec.Affinity.RequiredNodeTerms, 1, name)
+		assert.Equal(t, "kubernetes.io/arch", spec.Affinity.RequiredNodeTerms[0].MatchExpressions[0].Key, name)
+		require.Len(t, spec.Affinity.PreferredNodeTerms, 1, name)
+		assert.EqualValues(t, 80, spec.Affinity.PreferredNodeTerms[0].Weight, name)
+		require.NotNil(t, spec.Affinity.PodAntiAffinity, name)
+		assert.Equal(t, "topology.kubernetes.io/zone", spec.Affinity.PodAntiAffinity.TopologyKey, name)
+		assert.Equal(t, map[string]string{"app": "agentbox"}, spec.Affinity.PodAntiAffinity.MatchLabels, name)
+	}
+	assertAffinity(mockK8s.CreatedPodSpec(env.Namespace, "main"), "main pod")
+	var standby string
+	for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+		if strings.HasPrefix(name, "standby-") {
+			standby = name
+		}
+	}
+	require.NotEmpty(t, standby)
+	assertAffinity(mockK8s.CreatedPodSpec(env.Namespace, standby), "standby pod")
+
+	// An execution that cannot use the pool runs in its own pod with the same affinity
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	var spec *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		spec = mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+		return spec != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assertAffinity(spec, "execution pod")
+
+	// The affinity is persisted and can be removed with an empty object
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, spotAffinity(), stored.Affinity)
+	assert.Equal(t, spotAffinity(), orchestrator.EnvironmentSpec(stored).Affinity)
+
+	updated, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{Affinity: &models.Affinity{}})
+	require.NoError(t, err)
+	assert.Nil(t, updated.Affinity)
+	stored, err = db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Affinity)
+}
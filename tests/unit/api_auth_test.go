@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/internal/logger"
 	"github.com/sciffer/agentbox/pkg/api"
 	"github.com/sciffer/agentbox/pkg/auth"
@@ -87,6 +88,9 @@ func setupFullAPITest(t *testing.T) (*mux.Router, *database.DB, *auth.Service, *
 	authHandler := api.NewAuthHandler(authService, userService, log)
 	userHandler := api.NewUserHandler(userService, authService, log)
 	apiKeyHandler := api.NewAPIKeyHandler(authService, permissionService, log)
+	configHandler := api.NewConfigHandler(config.NewStore("", &config.Config{
+		Auth: config.AuthConfig{Enabled: true, Secret: "super-secret-value"},
+	}), log)
 
 	// Create router with auth routes
 	router := mux.NewRouter()
@@ -110,11 +114,16 @@ func setupFullAPITest(t *testing.T) (*mux.Router, *database.DB, *auth.Service, *
 	protected.HandleFunc("/users", userHandler.ListUsers).Methods("GET")
 	protected.HandleFunc("/users", userHandler.CreateUser).Methods("POST")
 	protected.HandleFunc("/users/{id}", userHandler.GetUser).Methods("GET")
+	protected.HandleFunc("/users/{id}/unlock", userHandler.UnlockUser).Methods("POST")
 
 	// API key routes
 	protected.HandleFunc("/api-keys", apiKeyHandler.ListAPIKeys).Methods("GET")
 	protected.HandleFunc("/api-keys", apiKeyHandler.CreateAPIKey).Methods("POST")
 	protected.HandleFunc("/api-keys/{id}", apiKeyHandler.RevokeAPIKey).Methods("DELETE")
+	protected.HandleFunc("/api-keys/{id}/rotate", apiKeyHandler.RotateAPIKey).Methods("POST")
+
+	// Admin routes
+	protected.HandleFunc("/admin/config", configHandler.GetConfig).Methods("GET")
 
 	return router, db, authService, userService
 }
@@ -429,3 +438,38 @@ func TestChangePasswordAPIWithRouter(t *testing.T) {
 		assert.Equal(t, http.StatusUnauthorized, rr.Code)
 	})
 }
+
+func TestAdminConfigAPI(t *testing.T) {
+	router, _, _, userService := setupFullAPITest(t)
+
+	createUserForTest(t, userService, "configadmin", "password123", users.RoleAdmin)
+	createUserForTest(t, userService, "testuser", "password123", users.RoleUser)
+
+	t.Run("admin sees effective config with secrets redacted", func(t *testing.T) {
+		token := getTokenForUser(t, router, "configadmin", "password123")
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/config", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.NotContains(t, rr.Body.String(), "super-secret-value")
+
+		var resp map[string]interface{}
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		authCfg := resp["config"].(map[string]interface{})["auth"].(map[string]interface{})
+		assert.Equal(t, "[REDACTED]", authCfg["secret"])
+		assert.Equal(t, float64(0), resp["reload_count"])
+		assert.Contains(t, resp["hot_reloadable"], "reconciliation")
+	})
+
+	t.Run("non-admin is forbidden", func(t *testing.T) {
+		token := getTokenForUser(t, router, "testuser", "password123")
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/config", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+}
@@ -2,9 +2,13 @@ package unit
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,8 +20,7 @@ import (
 func TestCreateEnvironmentLargeBody(t *testing.T) {
 	_, router := setupAPITest(t)
 
-	// Create a request with very large body (should be rejected or return 400)
-	// Note: MaxBytesReader returns 400 Bad Request, not 413
+	// A body over the environments limit (1 MiB) is rejected with a structured 413
 	largeBody := make([]byte, 2*1024*1024) // 2MB
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(largeBody))
 	req.Header.Set("Content-Type", "application/json")
@@ -25,9 +28,125 @@ func TestCreateEnvironmentLargeBody(t *testing.T) {
 
 	router.ServeHTTP(rr, req)
 
-	// MaxBytesReader returns 400 Bad Request when limit exceeded
-	assert.True(t, rr.Code == http.StatusBadRequest || rr.Code == http.StatusRequestEntityTooLarge,
-		"Expected 400 or 413, got %d", rr.Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, "PAYLOAD_TOO_LARGE", errResp.Code)
+	assert.Contains(t, errResp.Error, "1048576 bytes")
+}
+
+func TestRequestBodyLimitsPerRouteGroup(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	// Exec requests have a smaller limit than environment definitions
+	body := `{"command":["echo","` + strings.Repeat("a", 70*1024) + `"]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/env-1/exec", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Contains(t, rr.Body.String(), "65536 bytes")
+
+	// The same payload fits the environments limit (and fails validation instead)
+	body = `{"name":"big","image":"python:3.11","env":{"DATA":"` + strings.Repeat("a", 70*1024) + `"}}`
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/environments", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.NotEqual(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestGzipRequestBodies(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	gzipped := func(data []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return &buf
+	}
+	post := func(path string, body io.Reader, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, body)
+		req.Header.Set("Content-Type", "application/yaml")
+		req.Header.Set("Content-Encoding", encoding)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("gzip import is decompressed", func(t *testing.T) {
+		doc := "name: gz-env\nimage: python:3.11\nresources:\n  cpu: 500m\n  memory: 512Mi\n  storage: 1Gi\n"
+		rr := post("/api/v1/environments/import?dry_run=true", gzipped([]byte(doc)), "gzip")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp models.ImportEnvironmentsResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		require.Len(t, resp.Results, 1)
+		assert.Equal(t, models.ApplyCreated, resp.Results[0].Action)
+	})
+
+	t.Run("decompressed size is limited", func(t *testing.T) {
+		// 8 MiB of zeros compresses to a few KiB but exceeds the 4 MiB import limit
+		bomb := gzipped(make([]byte, 8*1024*1024))
+		require.Less(t, bomb.Len(), 64*1024)
+		rr := post("/api/v1/environments/import", bomb, "gzip")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	})
+
+	t.Run("invalid gzip", func(t *testing.T) {
+		rr := post("/api/v1/environments/import", strings.NewReader("not gzip"), "gzip")
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		rr := post("/api/v1/environments/import", strings.NewReader("name: x"), "br")
+		assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+	})
+}
+
+func TestGzipResponseCompression(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	for i := 0; i < 10; i++ {
+		body := fmt.Sprintf(`{"name":"env-%d","image":"python:3.11","resources":{"cpu":"500m","memory":"512Mi","storage":"1Gi"}}`, i)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	plain := get("/api/v1/environments", "")
+	require.Equal(t, http.StatusOK, plain.Code)
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+
+	compressed := get("/api/v1/environments", "br, gzip;q=0.8")
+	require.Equal(t, http.StatusOK, compressed.Code)
+	assert.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"))
+	assert.Contains(t, compressed.Header().Get("Vary"), "Accept-Encoding")
+	assert.Less(t, compressed.Body.Len(), plain.Body.Len())
+	zr, err := gzip.NewReader(compressed.Body)
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	var resp models.ListEnvironmentsResponse
+	require.NoError(t, json.Unmarshal(decompressed, &resp))
+	assert.Equal(t, 10, resp.Total)
+
+	// Small responses and clients that refuse gzip get identity encoding
+	assert.Empty(t, get("/api/v1/health", "gzip").Header().Get("Content-Encoding"))
+	assert.Empty(t, get("/api/v1/environments", "gzip;q=0").Header().Get("Content-Encoding"))
 }
 
 func TestListEnvironmentsInvalidPagination(t *testing.T) {
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/internal/logger"
 	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/k8s"
 	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/orchestrator"
@@ -47,7 +49,7 @@ func setupAPITestWithMock(t *testing.T) (*api.Handler, *mocks.MockK8sClient, *mu
 
 	val := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
 
-	handler := api.NewHandler(orch, val, log, nil)
+	handler := api.NewHandler(orch, val, log, nil, nil)
 	router := api.NewRouter(handler, nil) // nil proxy for unit tests
 
 	return handler, mockK8s, router
@@ -127,6 +129,39 @@ func TestCreateEnvironmentAPI(t *testing.T) {
 	}
 }
 
+func TestCreateEnvironmentValidationDetailsAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	body, err := json.Marshal(models.CreateEnvironmentRequest{
+		Name:      "Bad Name",
+		Resources: models.ResourceSpec{CPU: "invalid", Memory: "512Mi", Storage: "1Gi"},
+		Tolerations: []models.Toleration{
+			{Key: "a", Operator: "Exists"},
+			{Key: "b", Operator: "Equal", Effect: "Never"},
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, "validation failed", errResp.Error)
+	assert.Equal(t, "VALIDATION_FAILED", errResp.Code)
+
+	var fields []string
+	for _, d := range errResp.Details {
+		fields = append(fields, d.Field)
+		assert.NotEmpty(t, d.Code)
+		assert.NotEmpty(t, d.Message)
+	}
+	assert.ElementsMatch(t, []string{"name", "image", "resources.cpu", "tolerations[1].effect"}, fields)
+}
+
 func TestGetEnvironmentAPI(t *testing.T) {
 	_, router := setupAPITest(t)
 
@@ -318,7 +353,8 @@ func TestExecuteCommandAPIErrorResponses(t *testing.T) {
 		var errResp models.ErrorResponse
 		err := json.NewDecoder(rr.Body).Decode(&errResp)
 		require.NoError(t, err)
-		assert.Equal(t, http.StatusNotFound, errResp.Code)
+		assert.Equal(t, http.StatusNotFound, errResp.Status)
+		assert.Equal(t, apierrors.CodeEnvironmentNotFound, errResp.Code)
 		assert.NotEmpty(t, errResp.Error)
 		assert.NotEmpty(t, errResp.Message, "message should contain underlying error for debugging")
 	})
@@ -394,12 +430,91 @@ func TestExecuteCommandAPIErrorResponses(t *testing.T) {
 		var errResp models.ErrorResponse
 		err = json.NewDecoder(rr.Body).Decode(&errResp)
 		require.NoError(t, err)
-		assert.Equal(t, http.StatusBadRequest, errResp.Code)
+		assert.Equal(t, http.StatusBadRequest, errResp.Status)
+		assert.Equal(t, apierrors.CodeEnvironmentNotRunning, errResp.Code)
 		assert.Contains(t, errResp.Error, "not running")
 		assert.NotEmpty(t, errResp.Message)
 	})
 }
 
+func TestExecuteCommandStreamAPI(t *testing.T) {
+	_, _, router := setupAPITestWithMock(t)
+
+	createReq := models.CreateEnvironmentRequest{
+		Name:  "stream-env",
+		Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{
+			CPU:     "500m",
+			Memory:  "512Mi",
+			Storage: "1Gi",
+		},
+	}
+	body, _ := json.Marshal(createReq)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+
+	var gotRunning bool
+	for i := 0; i < 40; i++ {
+		getReq := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID, nil)
+		getRr := httptest.NewRecorder()
+		router.ServeHTTP(getRr, getReq)
+		var getEnv models.Environment
+		if getRr.Code == http.StatusOK && json.NewDecoder(getRr.Body).Decode(&getEnv) == nil && getEnv.Status == models.StatusRunning {
+			gotRunning = true
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.True(t, gotRunning, "environment should report status running (poll 2s)")
+
+	execBody, _ := json.Marshal(models.ExecRequest{Command: []string{"echo", "hello"}})
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		accept string
+	}{
+		{"stream query parameter", "/exec?stream=true", ""},
+		{"accept header", "/exec", "text/event-stream"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+tc.path, bytes.NewReader(execBody))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+			assert.Empty(t, rr.Header().Get("Content-Encoding"), "event streams are never compressed")
+			out := rr.Body.String()
+			assert.Contains(t, out, "event: stdout\n")
+			assert.Contains(t, out, `"message":"mock output"`)
+			assert.Contains(t, out, "event: exit\n")
+			assert.Contains(t, out, `"exit_code":0`)
+			assert.Less(t, strings.Index(out, "event: stdout"), strings.Index(out, "event: exit"))
+		})
+	}
+
+	t.Run("non-existent environment returns JSON 404", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/non-existent/exec?stream=true", bytes.NewReader(execBody))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	})
+}
+
 func TestDeleteEnvironmentAPI(t *testing.T) {
 	_, router := setupAPITest(t)
 
@@ -567,6 +682,193 @@ func TestRetryReconciliationAPI(t *testing.T) {
 	})
 }
 
+func TestPurgeExecutionsAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	createReq := models.CreateEnvironmentRequest{
+		Name:  "purge-me",
+		Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{
+			CPU:     "500m",
+			Memory:  "512Mi",
+			Storage: "1Gi",
+		},
+	}
+	body, _ := json.Marshal(createReq)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var created models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+
+	t.Run("missing before returns 400", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/environments/"+created.ID+"/executions", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("invalid before returns 400", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/environments/"+created.ID+"/executions?before=yesterday", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("valid before returns deleted count", func(t *testing.T) {
+		before := time.Now().UTC().Format(time.RFC3339)
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/environments/"+created.ID+"/executions?before="+before, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var resp map[string]int
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Equal(t, 0, resp["deleted"])
+	})
+
+	t.Run("non-existent environment returns 404", func(t *testing.T) {
+		before := time.Now().UTC().Format(time.RFC3339)
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/environments/non-existent/executions?before="+before, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestListExecutionsFiltersAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	body, _ := json.Marshal(models.CreateEnvironmentRequest{
+		Name:      "filter-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var env models.Environment
+		return json.NewDecoder(rr.Body).Decode(&env) == nil && env.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	for _, command := range [][]string{{"pytest", "-k", "smoke"}, {"pytest", "tests/"}, {"echo", "hi"}} {
+		body, _ := json.Marshal(map[string]interface{}{"command": command, "wait_seconds": 10})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+created.ID+"/run", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID+"/executions?"+query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("filters combine and total counts all pages", func(t *testing.T) {
+		rr := list("command_contains=PYTEST&exit_code=0&status=completed&limit=1")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp models.ExecutionListResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Len(t, resp.Executions, 1)
+		assert.Equal(t, 2, resp.Total)
+		assert.NotEmpty(t, resp.NextPageToken)
+
+		rr = list("command_contains=pytest&exit_code=1")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Empty(t, resp.Executions)
+		assert.Zero(t, resp.Total)
+	})
+
+	t.Run("invalid filters return 400", func(t *testing.T) {
+		for _, query := range []string{"exit_code=zero", "status=done", "created_after=yesterday", "created_before=2024-01-01"} {
+			assert.Equal(t, http.StatusBadRequest, list(query).Code, query)
+		}
+	})
+
+	t.Run("user_id requires an admin", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, list("user_id=user-123").Code)
+	})
+}
+
+func TestExecutionStatsAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	createReq := models.CreateEnvironmentRequest{
+		Name:  "stats-env",
+		Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{
+			CPU:     "500m",
+			Memory:  "512Mi",
+			Storage: "1Gi",
+		},
+	}
+	body, _ := json.Marshal(createReq)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var created models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+
+	t.Run("returns stats for environment", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID+"/stats", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var stats models.ExecutionStats
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+		assert.Equal(t, created.ID, stats.EnvironmentID)
+		assert.Equal(t, 0, stats.Total)
+		assert.NotNil(t, stats.ByStatus)
+	})
+
+	t.Run("accepts time range", func(t *testing.T) {
+		from := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+		to := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID+"/stats?from="+from+"&to="+to, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var stats models.ExecutionStats
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+		require.NotNil(t, stats.From)
+		require.NotNil(t, stats.To)
+	})
+
+	t.Run("invalid range returns 400", func(t *testing.T) {
+		for _, q := range []string{"from=yesterday", "from=2026-01-02T00:00:00Z&to=2026-01-01T00:00:00Z"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID+"/stats?"+q, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code, q)
+		}
+	})
+
+	t.Run("non-existent environment returns 404", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/non-existent/stats", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
 func TestHealthCheckAPI(t *testing.T) {
 	_, router := setupAPITest(t)
 
@@ -687,6 +989,32 @@ func TestGetLogsAPI(t *testing.T) {
 		assert.Contains(t, rr.Body.String(), "data:")
 	})
 
+	t.Run("streamed logs carry kubernetes timestamps", func(t *testing.T) {
+		mockK8s.SetPodLogs(env.Namespace, "main", "2026-01-22T10:00:01Z first\ncontinued\n2026-01-22T10:00:05Z second\n")
+		defer mockK8s.SetPodLogs(env.Namespace, "main", "")
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/logs?follow=true", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var entries []models.LogEntry
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var entry models.LogEntry
+				require.NoError(t, json.Unmarshal([]byte(data), &entry))
+				entries = append(entries, entry)
+			}
+		}
+		require.Len(t, entries, 3)
+		assert.Equal(t, "first", entries[0].Message)
+		assert.Equal(t, time.Date(2026, 1, 22, 10, 0, 1, 0, time.UTC), entries[0].Timestamp)
+		assert.Equal(t, "continued", entries[1].Message)
+		assert.Equal(t, entries[0].Timestamp, entries[1].Timestamp)
+		assert.Equal(t, "second", entries[2].Message)
+		assert.Equal(t, time.Date(2026, 1, 22, 10, 0, 5, 0, time.UTC), entries[2].Timestamp)
+	})
+
 	t.Run("get logs for non-existent environment", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/non-existent/logs", nil)
 		rr := httptest.NewRecorder()
@@ -927,3 +1255,345 @@ func TestGetEnvironmentWithPoolAPI(t *testing.T) {
 		assert.Equal(t, 4, env.Pool.Size)
 	})
 }
+
+func TestSubmitExecutionWaitAPI(t *testing.T) {
+	_, mockK8s, router := setupAPITestWithMock(t)
+
+	createReq := models.CreateEnvironmentRequest{
+		Name:      "wait-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}
+	body, _ := json.Marshal(createReq)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var env models.Environment
+		return json.NewDecoder(rr.Body).Decode(&env) == nil && env.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	run := func(ctx context.Context, path string, payload map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	runPath := "/api/v1/environments/" + created.ID + "/run"
+
+	t.Run("finished within wait returns 200 with result", func(t *testing.T) {
+		rr := run(context.Background(), runPath, map[string]interface{}{
+			"command": []string{"echo", "hi"}, "wait_seconds": 10,
+		})
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp models.ExecutionResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Equal(t, models.ExecutionStatusCompleted, resp.Status)
+		require.NotNil(t, resp.ExitCode)
+		assert.Equal(t, 0, *resp.ExitCode)
+		assert.NotEmpty(t, resp.Stdout)
+		assert.NotNil(t, resp.CompletedAt)
+	})
+
+	t.Run("invalid wait_seconds returns 400", func(t *testing.T) {
+		rr := run(context.Background(), runPath, map[string]interface{}{
+			"command": []string{"echo", "hi"}, "wait_seconds": orchestrator.MaxExecutionWaitSeconds + 1,
+		})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		rr = run(context.Background(), runPath+"?wait_seconds=soon", map[string]interface{}{
+			"command": []string{"echo", "hi"},
+		})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	mockK8s.SetHoldPodCompletion(true)
+
+	t.Run("still running after wait returns 202", func(t *testing.T) {
+		start := time.Now()
+		rr := run(context.Background(), runPath+"?wait_seconds=1", map[string]interface{}{
+			"command": []string{"sleep", "3600"},
+		})
+		require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+		var resp models.ExecutionResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.False(t, resp.Status.IsTerminal())
+		assert.Nil(t, resp.ExitCode)
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/executions/"+resp.ID, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	t.Run("client disconnect stops waiting", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		rr := run(ctx, runPath, map[string]interface{}{
+			"command": []string{"sleep", "3600"}, "wait_seconds": 30,
+		})
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Empty(t, rr.Body.String())
+	})
+}
+
+func TestCommandPolicyAPI(t *testing.T) {
+	_, _, router := setupAPITestWithMock(t)
+
+	send := func(method, path string, payload interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Only admins may create unrestricted environments
+	createReq := models.CreateEnvironmentRequest{
+		Name:          "policy-env",
+		Image:         "python:3.11-slim",
+		Resources:     models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		CommandPolicy: &models.CommandPolicy{Unrestricted: true},
+	}
+	rr := send(http.MethodPost, "/api/v1/environments", createReq)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Readiness check commands are held to the same policy as exec
+	createReq.CommandPolicy = &models.CommandPolicy{AllowedBinaries: []string{"python"}}
+	createReq.ReadinessCheck = &models.ReadinessCheck{Exec: []string{"curl", "-sf", "http://localhost:8000/health"}}
+	rr = send(http.MethodPost, "/api/v1/environments", createReq)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), apierrors.CodeCommandRejected)
+
+	createReq.ReadinessCheck = nil
+	rr = send(http.MethodPost, "/api/v1/environments", createReq)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var created models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+	require.NotNil(t, created.CommandPolicy)
+
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+created.ID, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var env models.Environment
+		return json.NewDecoder(rr.Body).Decode(&env) == nil && env.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	envPath := "/api/v1/environments/" + created.ID
+
+	rr = send(http.MethodPost, envPath+"/exec", models.ExecRequest{Command: []string{"ls", "/"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, "command rejected by policy", errResp.Error)
+	assert.Equal(t, apierrors.CodeCommandRejected, errResp.Code)
+	assert.Contains(t, errResp.Message, `"ls"`)
+
+	rr = send(http.MethodPost, envPath+"/exec?stream=true", models.ExecRequest{Command: []string{"sh", "-c", "python a.py"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = send(http.MethodPost, envPath+"/exec", models.ExecRequest{Command: []string{"python", "-V"}})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = send(http.MethodPost, envPath+"/run", models.EphemeralExecRequest{Command: []string{"curl", "http://example.com"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Policies are validated on update and unrestricted stays admin-only
+	rr = send(http.MethodPatch, envPath, models.UpdateEnvironmentRequest{
+		CommandPolicy: &models.CommandPolicy{DenyPatterns: []string{"(unclosed"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = send(http.MethodPatch, envPath, models.UpdateEnvironmentRequest{
+		CommandPolicy: &models.CommandPolicy{Unrestricted: true},
+	})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = send(http.MethodPatch, envPath, models.UpdateEnvironmentRequest{
+		CommandPolicy: &models.CommandPolicy{AllowedBinaries: []string{"ls"}},
+	})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = send(http.MethodPost, envPath+"/exec", models.ExecRequest{Command: []string{"ls", "/"}})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// A readiness check added later runs under the environment's current policy
+	rr = send(http.MethodPatch, envPath, models.UpdateEnvironmentRequest{
+		ReadinessCheck: &models.ReadinessCheck{Exec: []string{"python", "-c", "import app"}},
+	})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = send(http.MethodPatch, envPath, models.UpdateEnvironmentRequest{
+		CommandPolicy:  &models.CommandPolicy{AllowedBinaries: []string{"python"}},
+		ReadinessCheck: &models.ReadinessCheck{Exec: []string{"python", "-c", "import app"}},
+	})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
+
+func TestPrivilegedSecurityContextAdminOnly(t *testing.T) {
+	_, _, router := setupAPITestWithMock(t)
+
+	send := func(method, path string, payload interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	isolation := func(sc *models.SecurityContextConfig) *models.IsolationConfig {
+		return &models.IsolationConfig{SecurityContext: sc}
+	}
+	sysAdmin := isolation(&models.SecurityContextConfig{Capabilities: &models.CapabilitiesConfig{Add: []string{"SYS_ADMIN"}}})
+	unconfined := isolation(&models.SecurityContextConfig{SeccompProfile: models.SeccompUnconfined})
+
+	createReq := models.CreateEnvironmentRequest{
+		Name:      "privileged-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}
+	for _, iso := range []*models.IsolationConfig{sysAdmin, unconfined} {
+		createReq.Isolation = iso
+		rr := send(http.MethodPost, "/api/v1/environments", createReq)
+		assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+		assert.Contains(t, rr.Body.String(), "only admins can set isolation.security_context")
+
+		rr = send(http.MethodPost, "/api/v1/environment-groups", models.CreateEnvironmentGroupRequest{
+			Name: "privileged-group", Replicas: 1, Template: createReq,
+		})
+		assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	}
+
+	// Capabilities the runtime grants anyway need no admin
+	createReq.Isolation = isolation(&models.SecurityContextConfig{
+		Capabilities:   &models.CapabilitiesConfig{Add: []string{"NET_BIND_SERVICE"}, Drop: []string{"ALL"}},
+		SeccompProfile: models.SeccompRuntimeDefault,
+	})
+	rr := send(http.MethodPost, "/api/v1/environments", createReq)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var created models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+
+	for _, iso := range []*models.IsolationConfig{sysAdmin, unconfined} {
+		rr = send(http.MethodPatch, "/api/v1/environments/"+created.ID, models.UpdateEnvironmentRequest{Isolation: iso})
+		assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/import", strings.NewReader(`
+name: privileged-import
+image: python:3.11-slim
+resources: {cpu: 500m, memory: 512Mi, storage: 1Gi}
+isolation:
+  security_context:
+    capabilities: {add: [SYS_ADMIN]}
+`))
+	req.Header.Set("Content-Type", "application/yaml")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var imported models.ImportEnvironmentsResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&imported))
+	require.Len(t, imported.Results, 1)
+	assert.Equal(t, models.ApplyError, imported.Results[0].Action)
+	assert.Contains(t, imported.Results[0].Error, "only admins can set isolation.security_context.capabilities.add SYS_ADMIN")
+}
+
+func TestEnvironmentExportImport(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	importDocs := func(t *testing.T, body string, dryRun bool) models.ImportEnvironmentsResponse {
+		url := "/api/v1/environments/import"
+		if dryRun {
+			url += "?dry_run=true"
+		}
+		req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/yaml")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp models.ImportEnvironmentsResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+	actions := func(resp models.ImportEnvironmentsResponse) []models.ApplyAction {
+		var out []models.ApplyAction
+		for _, r := range resp.Results {
+			out = append(out, r.Action)
+		}
+		return out
+	}
+
+	docs := `
+name: gitops-web
+image: python:3.11-slim
+resources: {cpu: 500m, memory: 512Mi, storage: 1Gi}
+labels:
+  team: platform
+---
+name: gitops-worker
+image: node:20-slim
+resources: {cpu: 250m, memory: 256Mi, storage: 1Gi}
+env:
+  MODE: "worker"
+`
+	// A dry run reports the creations without creating anything
+	resp := importDocs(t, docs, true)
+	assert.True(t, resp.DryRun)
+	assert.Equal(t, []models.ApplyAction{models.ApplyCreated, models.ApplyCreated}, actions(resp))
+	assert.Empty(t, resp.Results[0].EnvironmentID)
+
+	resp = importDocs(t, docs, false)
+	require.Equal(t, []models.ApplyAction{models.ApplyCreated, models.ApplyCreated}, actions(resp))
+	webID := resp.Results[0].EnvironmentID
+	require.NotEmpty(t, webID)
+
+	// Applying the same documents again is a no-op
+	resp = importDocs(t, docs, false)
+	assert.Equal(t, []models.ApplyAction{models.ApplyUnchanged, models.ApplyUnchanged}, actions(resp))
+	assert.Equal(t, webID, resp.Results[0].EnvironmentID)
+
+	// A changed spec is patched in place
+	changed := strings.Replace(docs, "python:3.11-slim", "python:3.12-slim", 1)
+	resp = importDocs(t, changed, true)
+	assert.Equal(t, []models.ApplyAction{models.ApplyUpdated, models.ApplyUnchanged}, actions(resp))
+	assert.Equal(t, []string{"image"}, resp.Results[0].Changes)
+	resp = importDocs(t, changed, false)
+	assert.Equal(t, []models.ApplyAction{models.ApplyUpdated, models.ApplyUnchanged}, actions(resp))
+
+	// Export returns a clean, re-importable document
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+webID+"/export", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+	exported := w.Body.String()
+	assert.Contains(t, exported, "name: gitops-web\n")
+	assert.Contains(t, exported, "image: python:3.12-slim\n")
+	for _, runtimeField := range []string{"id:", "status:", "namespace:", "created_at:"} {
+		assert.NotContains(t, exported, runtimeField)
+	}
+	resp = importDocs(t, exported, false)
+	assert.Equal(t, []models.ApplyAction{models.ApplyUnchanged}, actions(resp))
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+webID+"/export?format=json", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var spec models.CreateEnvironmentRequest
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&spec))
+	assert.Equal(t, "gitops-web", spec.Name)
+	assert.Equal(t, map[string]string{"team": "platform"}, spec.Labels)
+
+	// Invalid documents are reported per document; the others are still applied
+	resp = importDocs(t, `[{"name": "gitops-bad", "image": "x", "status": "running"}, {"name": "gitops-web", "image": "python:3.12-slim", "resources": {"cpu": "500m", "memory": "512Mi", "storage": "1Gi"}, "labels": {"team": "platform"}}]`, false)
+	require.Len(t, resp.Results, 2)
+	assert.Equal(t, models.ApplyError, resp.Results[0].Action)
+	assert.Contains(t, resp.Results[0].Error, "status")
+	assert.Equal(t, models.ApplyUnchanged, resp.Results[1].Action)
+}
@@ -0,0 +1,45 @@
+package unit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+)
+
+func TestAPIErrorsKinds(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("submit: %w", apierrors.Wrap(apierrors.NotRunning, apierrors.CodeEnvironmentNotRunning, cause, "environment is not running"))
+
+	assert.True(t, errors.Is(err, apierrors.NotRunning))
+	assert.False(t, errors.Is(err, apierrors.NotFound))
+	assert.True(t, errors.Is(err, cause), "the cause stays reachable")
+	assert.Equal(t, apierrors.NotRunning, apierrors.KindOf(err))
+	assert.Equal(t, http.StatusBadRequest, apierrors.HTTPStatus(err))
+	assert.Equal(t, apierrors.CodeEnvironmentNotRunning, apierrors.CodeOf(err))
+	assert.Equal(t, "environment is not running", apierrors.MessageOf(err))
+	assert.Equal(t, "submit: environment is not running: connection refused", err.Error())
+
+	// Without a specific code the kind's code is used
+	conflict := apierrors.New(apierrors.Conflict, "", "already exists")
+	assert.Equal(t, "CONFLICT", apierrors.CodeOf(conflict))
+	assert.Equal(t, http.StatusConflict, apierrors.HTTPStatus(conflict))
+
+	// The outermost code wins when kinded errors are nested
+	nested := apierrors.Wrap(apierrors.Forbidden, apierrors.CodeCommandRejected, apierrors.New(apierrors.NotFound, "", "inner"), "outer")
+	assert.Equal(t, apierrors.CodeCommandRejected, apierrors.CodeOf(nested))
+	assert.Equal(t, http.StatusForbidden, apierrors.HTTPStatus(nested))
+
+	plain := errors.New("boom")
+	assert.Nil(t, apierrors.KindOf(plain))
+	assert.Equal(t, http.StatusInternalServerError, apierrors.HTTPStatus(plain))
+	assert.Empty(t, apierrors.CodeOf(plain))
+
+	assert.Equal(t, "NOT_FOUND", apierrors.StatusCode(http.StatusNotFound))
+	assert.Equal(t, apierrors.CodeBadRequest, apierrors.StatusCode(http.StatusBadRequest))
+	assert.Equal(t, apierrors.CodeInternal, apierrors.StatusCode(http.StatusBadGateway))
+}
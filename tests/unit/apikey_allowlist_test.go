@@ -0,0 +1,190 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func TestParseAllowedCIDRs(t *testing.T) {
+	cidrs, err := auth.ParseAllowedCIDRs([]string{"10.0.0.0/8", " 192.168.1.7 ", "10.1.2.3/16", "2001:db8::/32", "::ffff:1.2.3.4"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.7/32", "10.1.0.0/16", "2001:db8::/32", "1.2.3.4/32"}, cidrs)
+
+	for _, invalid := range []string{"", "10.0.0.0/33", "not-an-ip", "10.0.0.1:80"} {
+		_, err := auth.ParseAllowedCIDRs([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+	_, err = auth.ParseAllowedCIDRs(make([]string, 33))
+	assert.Error(t, err)
+}
+
+func TestAPIKeyNameAndPrefix(t *testing.T) {
+	authService, userService, _ := setupAuthTest(t)
+	ctx := context.Background()
+	user := createUserForTest(t, userService, "keyowner", "password123", users.RoleUser)
+
+	first, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, Name: "ci-deploy"})
+	require.NoError(t, err)
+	second, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, Name: "laptop"})
+	require.NoError(t, err)
+
+	// The prefix is the configured prefix plus the start of the secret, so keys can be told apart
+	assert.Equal(t, "ci-deploy", first.Name)
+	assert.Len(t, first.KeyPrefix, len("ak_live_")+8)
+	assert.True(t, strings.HasPrefix(first.Key, first.KeyPrefix))
+	assert.NotEqual(t, first.KeyPrefix, second.KeyPrefix)
+
+	keys, err := authService.ListAPIKeys(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	byName := map[string]*auth.APIKeyInfo{}
+	for _, key := range keys {
+		byName[key.Name] = key
+	}
+	assert.Equal(t, first.KeyPrefix, byName["ci-deploy"].KeyPrefix)
+	assert.Equal(t, second.KeyPrefix, byName["laptop"].KeyPrefix)
+
+	// Listings never include the secret
+	data, err := json.Marshal(keys)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), first.Key)
+	assert.NotContains(t, string(data), `"key"`)
+}
+
+func TestAPIKeyIPAllowlist(t *testing.T) {
+	authService, userService, db := setupAuthTest(t)
+	ctx := context.Background()
+	user := createUserForTest(t, userService, "allowlisted", "password123", users.RoleUser)
+
+	cidrs, err := auth.ParseAllowedCIDRs([]string{"203.0.113.0/24", "2001:db8::1"})
+	require.NoError(t, err)
+	key, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, Name: "office", AllowedCIDRs: cidrs})
+	require.NoError(t, err)
+	assert.Equal(t, cidrs, key.AllowedCIDRs)
+
+	for _, ip := range []string{"203.0.113.7", "2001:db8::1"} {
+		got, err := authService.ValidateAPIKey(clientip.WithClientIP(ctx, ip), key.Key)
+		require.NoError(t, err, ip)
+		assert.Equal(t, user.ID, got.ID)
+	}
+	keys, err := authService.ListAPIKeys(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "2001:db8::1", keys[0].LastUsedIP)
+	assert.NotNil(t, keys[0].LastUsed)
+	assert.Equal(t, cidrs, keys[0].AllowedCIDRs)
+
+	// Other and unknown addresses are refused and audited as IP denials
+	for _, ctx := range []context.Context{clientip.WithClientIP(ctx, "198.51.100.1"), ctx} {
+		_, err = authService.ValidateAPIKey(ctx, key.Key)
+		assert.True(t, errors.Is(err, auth.ErrAPIKeyIPNotAllowed))
+	}
+	denied, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionAPIKeyIPDenied})
+	require.NoError(t, err)
+	require.Len(t, denied, 2)
+	assert.Equal(t, key.ID, denied[0].ResourceID)
+	var ips []string
+	for _, entry := range denied {
+		ips = append(ips, entry.ClientIP)
+	}
+	assert.Contains(t, ips, "198.51.100.1")
+
+	// A revoked key is audited as a rejected key, not as an IP denial
+	require.NoError(t, authService.RevokeAPIKey(ctx, key.ID, user.ID))
+	_, err = authService.ValidateAPIKey(clientip.WithClientIP(ctx, "203.0.113.7"), key.Key)
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, auth.ErrAPIKeyIPNotAllowed))
+	rejected, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionAPIKeyRejected})
+	require.NoError(t, err)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, key.ID, rejected[0].ResourceID)
+
+	// Keys without an allowlist work from anywhere
+	open, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID})
+	require.NoError(t, err)
+	_, err = authService.ValidateAPIKey(clientip.WithClientIP(ctx, "198.51.100.1"), open.Key)
+	require.NoError(t, err)
+
+	// Rotation keeps the name and the allowlist
+	limited, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, Name: "office", AllowedCIDRs: cidrs})
+	require.NoError(t, err)
+	rotated, err := authService.RotateAPIKey(ctx, limited.ID, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "office", rotated.Name)
+	assert.Equal(t, cidrs, rotated.AllowedCIDRs)
+	_, err = authService.ValidateAPIKey(clientip.WithClientIP(ctx, "198.51.100.1"), rotated.Key)
+	assert.True(t, errors.Is(err, auth.ErrAPIKeyIPNotAllowed))
+}
+
+func TestAPIKeyIPAllowlistAPI(t *testing.T) {
+	router, _, _, userService := setupFullAPITest(t)
+	createUserForTest(t, userService, "testuser", "password123", users.RoleUser)
+	token := getTokenForUser(t, router, "testuser", "password123")
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/api-keys", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := create(`{"name": "ci", "allowed_cidrs": ["10.0.0.0/8"]}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var key auth.APIKeyResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&key))
+	assert.Equal(t, "ci", key.Name)
+	assert.Equal(t, []string{"10.0.0.0/8"}, key.AllowedCIDRs)
+
+	useKey := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/api-keys", nil)
+		req.Header.Set("X-API-Key", key.Key)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, useKey("10.1.2.3:4567").Code)
+	rr = useKey("192.0.2.1:4567")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), apierrors.CodeAPIKeyIPNotAllowed)
+
+	// The listing shows the name, the prefix and where the key was last used, never the secret
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), key.Key)
+	var list struct {
+		APIKeys []*auth.APIKeyInfo `json:"api_keys"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	require.Len(t, list.APIKeys, 1)
+	assert.Equal(t, "ci", list.APIKeys[0].Name)
+	assert.Equal(t, key.KeyPrefix, list.APIKeys[0].KeyPrefix)
+	assert.Equal(t, "10.1.2.3", list.APIKeys[0].LastUsedIP)
+
+	assert.Equal(t, http.StatusBadRequest, create(`{"allowed_cidrs": ["10.0.0.0/40"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"name": "`+strings.Repeat("x", 101)+`"}`).Code)
+	// The limit counts characters, not bytes: 100 three-byte characters fit
+	rr = create(`{"name": "` + strings.Repeat("日", 100) + `"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusBadRequest, create(`{"name": "`+strings.Repeat("日", 101)+`"}`).Code)
+}
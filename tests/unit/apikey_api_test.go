@@ -205,6 +205,74 @@ func TestRevokeAPIKeyAPIRoute(t *testing.T) {
 	})
 }
 
+func TestRotateAPIKeyAPIRoute(t *testing.T) {
+	router, _, _, userService := setupFullAPITest(t)
+
+	createUserForTest(t, userService, "testuser", "password123", users.RoleUser)
+	token := getTokenForUser(t, router, "testuser", "password123")
+
+	body, _ := json.Marshal(map[string]interface{}{"description": "CI key", "expires_in": 30})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/api-keys", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var oldKey auth.APIKeyResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&oldKey))
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/api-keys/"+oldKey.ID+"/rotate", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var newKey auth.APIKeyResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&newKey))
+	assert.NotEmpty(t, newKey.Key)
+	assert.Equal(t, oldKey.ID, newKey.RotatedFrom)
+	assert.NotNil(t, newKey.PreviousKeyRevokesAt)
+
+	t.Run("rotating again conflicts", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/api-keys/"+oldKey.ID+"/rotate", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/api-keys/non-existent-id/rotate", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("list reports status", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/api-keys", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var resp struct {
+			APIKeys []*auth.APIKeyInfo `json:"api_keys"`
+		}
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		require.Len(t, resp.APIKeys, 2)
+		for _, k := range resp.APIKeys {
+			assert.NotNil(t, k.ExpiresAt)
+			if k.ID == oldKey.ID {
+				assert.Equal(t, auth.APIKeyStatusExpiring, k.Status)
+			} else {
+				assert.Equal(t, auth.APIKeyStatusActive, k.Status)
+			}
+		}
+	})
+}
+
 func TestAPIKeyAuthenticationRoute(t *testing.T) {
 	router, _, _, userService := setupFullAPITest(t)
 
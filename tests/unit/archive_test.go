@@ -0,0 +1,105 @@
+package unit
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// readArchive unzips an archive response into file name → contents
+func readArchive(t *testing.T, body []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestEnvironmentArchive(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler, nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "archived-env"})
+	mockK8s.SetPodLogs(env.Namespace, "main", "2024-01-15T10:30:00Z booted\n2024-01-15T10:30:01Z serving\n")
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"echo", "hi"},
+	}, "user-123")
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archive", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), env.ID+".zip")
+
+	files := readArchive(t, w.Body.Bytes())
+	var archived models.Environment
+	require.NoError(t, json.Unmarshal([]byte(files["environment.json"]), &archived))
+	assert.Equal(t, env.ID, archived.ID)
+	var spec models.CreateEnvironmentRequest
+	require.NoError(t, json.Unmarshal([]byte(files["spec.json"]), &spec))
+	assert.Equal(t, "archived-env", spec.Name)
+	assert.Contains(t, files["events.jsonl"], `"event_type":"provisioning_phase"`)
+	assert.Equal(t, "2024-01-15T10:30:00Z booted\n2024-01-15T10:30:01Z serving\n", files["logs/main.log"])
+
+	var archivedExec models.Execution
+	require.NoError(t, json.Unmarshal([]byte(files["executions/"+exec.ID+".json"]), &archivedExec))
+	assert.Equal(t, []string{"echo", "hi"}, archivedExec.Command)
+	assert.NotEmpty(t, archivedExec.Stdout)
+
+	var manifest models.ArchiveManifest
+	require.NoError(t, json.Unmarshal([]byte(files["manifest.json"]), &manifest))
+	assert.Equal(t, env.ID, manifest.EnvironmentID)
+	assert.Equal(t, 1, manifest.Executions)
+	assert.Equal(t, strings.Count(files["events.jsonl"], "\n"), manifest.Events)
+	assert.True(t, manifest.Logs)
+	assert.Empty(t, manifest.Warnings)
+	assert.False(t, manifest.Deleted)
+
+	// The POST variant deletes the environment once the archive is written
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/archive", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	files = readArchive(t, w.Body.Bytes())
+	require.NoError(t, json.Unmarshal([]byte(files["manifest.json"]), &manifest))
+	assert.True(t, manifest.Deleted)
+	assert.Contains(t, files, "executions/"+exec.ID+".json")
+	_, err = orch.GetEnvironment(ctx, env.ID)
+	assert.Error(t, err)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archive", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -3,16 +3,24 @@ package unit
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/auth"
 	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
 	"github.com/sciffer/agentbox/pkg/users"
 )
 
@@ -134,6 +142,172 @@ func TestValidateJWTInvalidToken(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestCallbackToken(t *testing.T) {
+	authService, userService, _ := setupAuthTest(t)
+	ctx := context.Background()
+
+	user, err := userService.CreateUser(ctx, &users.CreateUserRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+		Role:     "user",
+		Status:   "active",
+	})
+	require.NoError(t, err)
+
+	token, err := authService.GenerateCallbackToken("env-1", "exec-1", user.ID, time.Minute)
+	require.NoError(t, err)
+
+	claims, err := authService.ValidateCallbackToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, auth.CallbackTokenScope, claims.Scope)
+	assert.Equal(t, "env-1", claims.EnvironmentID)
+	assert.Equal(t, "exec-1", claims.ExecutionID)
+	assert.Equal(t, user.ID, claims.UserID)
+
+	// A callback token must not authenticate as its user
+	_, err = authService.ValidateJWT(ctx, token)
+	assert.Error(t, err)
+
+	// A user token is not a callback token
+	resp, err := authService.Login(ctx, &auth.LoginRequest{Username: "testuser", Password: "password123"})
+	require.NoError(t, err)
+	_, err = authService.ValidateCallbackToken(resp.Token)
+	assert.Error(t, err)
+
+	// Expired tokens are rejected
+	expired, err := authService.GenerateCallbackToken("env-1", "", user.ID, time.Nanosecond)
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	_, err = authService.ValidateCallbackToken(expired)
+	assert.Error(t, err)
+
+	_, err = authService.GenerateCallbackToken("", "", user.ID, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestExecutionReportCallbackToken(t *testing.T) {
+	cfg := testOrchestratorConfig()
+	cfg.Timeouts.MaxTimeout = 600
+	a := setupAPIRouterTest(t, withAPIConfig(cfg), withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		a.orch.SetCallbackTokenIssuer(a.auth)
+		a.handler.SetCallbackVerifier(a.auth)
+	}))
+	ctx := context.Background()
+
+	createUserForTest(t, a.users, "report-user", "password123", users.RoleUser)
+	userJWT := getTokenForUser(t, a.router, "report-user", "password123")
+	env := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "report-env"})
+	submit := func() (*models.Execution, string) {
+		exec, err := a.orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID,
+			Command:       []string{"echo", "hi"},
+			Timeout:       7200,
+		}, "user-456")
+		require.NoError(t, err)
+		var spec *k8s.PodSpec
+		require.Eventually(t, func() bool {
+			spec = a.mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+			return spec != nil
+		}, 5*time.Second, 20*time.Millisecond)
+		return exec, spec.Env[orchestrator.EnvVarCallbackToken]
+	}
+	exec, token := submit()
+	other, otherToken := submit()
+	report := map[string]interface{}{"metadata": map[string]string{"result": "passed"}}
+
+	// The token lives for the execution's timeout (capped at max_timeout) plus a grace period
+	claims, err := a.auth.ValidateCallbackToken(token)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), claims.ExpiresAt.Time, time.Minute)
+
+	rr := a.do(t, http.MethodPost, "/api/v1/executions/"+exec.ID+"/report", token, report)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	got, err := a.orch.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "passed", got.Metadata["result"])
+
+	// Another execution's token, the environment's own token, user tokens and garbage are refused
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/executions/"+exec.ID+"/report", otherToken, report).Code)
+	envToken := a.mockK8s.CreatedPodSpec(env.Namespace, "main").Env[orchestrator.EnvVarCallbackToken]
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/executions/"+exec.ID+"/report", envToken, report).Code)
+	assert.Equal(t, http.StatusUnauthorized, a.do(t, http.MethodPost, "/api/v1/executions/"+exec.ID+"/report", userJWT, report).Code)
+	assert.Equal(t, http.StatusUnauthorized, a.do(t, http.MethodPost, "/api/v1/executions/"+exec.ID+"/report", "not-a-token", report).Code)
+	got, err = a.orch.GetExecution(ctx, other.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, got.Metadata, "result")
+}
+
+func TestJWTSigningKeyRotation(t *testing.T) {
+	authService, userService, _ := setupAuthTest(t)
+	ctx := context.Background()
+
+	_, err := userService.CreateUser(ctx, &users.CreateUserRequest{
+		Username: "testuser",
+		Password: "password123",
+		Role:     "user",
+		Status:   "active",
+	})
+	require.NoError(t, err)
+	login := func() string {
+		resp, err := authService.Login(ctx, &auth.LoginRequest{Username: "testuser", Password: "password123"})
+		require.NoError(t, err)
+		return resp.Token
+	}
+	kid := func(token string) string {
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+		require.NoError(t, err)
+		return parsed.Header["kid"].(string)
+	}
+
+	oldKey := auth.SigningKey{ID: "2026-09", Secret: []byte("old-secret-0123456789abcdefghijklmnop")}
+	newKey := auth.SigningKey{ID: "2026-10", Secret: []byte("new-secret-0123456789abcdefghijklmnop")}
+
+	require.NoError(t, authService.SetSigningKeys([]auth.SigningKey{oldKey}))
+	oldToken := login()
+	assert.Equal(t, "2026-09", kid(oldToken))
+
+	// After rotation new tokens use the new key and old ones keep working until the old key retires
+	oldKey.RetireAt = time.Now().Add(time.Hour)
+	require.NoError(t, authService.SetSigningKeys([]auth.SigningKey{newKey, oldKey}))
+	newToken := login()
+	assert.Equal(t, "2026-10", kid(newToken))
+	_, err = authService.ValidateJWT(ctx, oldToken)
+	require.NoError(t, err)
+	_, err = authService.ValidateJWT(ctx, newToken)
+	require.NoError(t, err)
+
+	oldKey.RetireAt = time.Now().Add(-time.Second)
+	require.NoError(t, authService.SetSigningKeys([]auth.SigningKey{newKey, oldKey}))
+	_, err = authService.ValidateJWT(ctx, oldToken)
+	assert.Error(t, err)
+	_, err = authService.ValidateJWT(ctx, newToken)
+	require.NoError(t, err)
+
+	// A token claiming a known kid but signed with another secret is rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &auth.Claims{
+		UserID:           "someone",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	forged.Header["kid"] = "2026-10"
+	forgedToken, err := forged.SignedString([]byte("change-me-in-production"))
+	require.NoError(t, err)
+	_, err = authService.ValidateJWT(ctx, forgedToken)
+	assert.Error(t, err)
+}
+
+func TestSetSigningKeysValidation(t *testing.T) {
+	authService, _, _ := setupAuthTest(t)
+
+	assert.Error(t, authService.SetSigningKeys(nil))
+	assert.ErrorContains(t, authService.SetSigningKeys([]auth.SigningKey{{ID: "default", Secret: []byte("change-me-in-production")}}), "insecure")
+	assert.ErrorContains(t, authService.SetSigningKeys([]auth.SigningKey{{ID: "default", Secret: []byte("too-short")}}), "at least 32")
+	long := []byte("a-secret-that-is-long-enough-0123456789")
+	assert.ErrorContains(t, authService.SetSigningKeys([]auth.SigningKey{{ID: "a", Secret: long}, {ID: "a", Secret: long}}), "duplicate")
+	assert.ErrorContains(t, authService.SetSigningKeys([]auth.SigningKey{{ID: "a", Secret: long, RetireAt: time.Now().Add(time.Hour)}}), "cannot retire")
+	assert.NoError(t, authService.SetSigningKeys([]auth.SigningKey{{ID: "a", Secret: long}}))
+}
+
 func TestCreateAPIKey(t *testing.T) {
 	authService, userService, _ := setupAuthTest(t)
 	ctx := context.Background()
@@ -293,3 +467,144 @@ func TestAPIKeyExpiration(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "expired")
 }
+
+func TestRotateAPIKey(t *testing.T) {
+	authService, userService, db := setupAuthTest(t)
+	ctx := context.Background()
+
+	user, err := userService.CreateUser(ctx, &users.CreateUserRequest{
+		Username: "rotator",
+		Password: "password123",
+		Role:     "user",
+		Status:   "active",
+	})
+	require.NoError(t, err)
+
+	expiresAt := time.Now().Add(30 * 24 * time.Hour)
+	oldKey, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{
+		UserID:      user.ID,
+		Description: "CI key",
+		ExpiresAt:   &expiresAt,
+	})
+	require.NoError(t, err)
+
+	permService := permissions.NewService(db, zap.NewNop())
+	_, err = permService.GrantAPIKeyPermission(ctx, oldKey.ID, "env-a", permissions.PermissionEditor)
+	require.NoError(t, err)
+	_, err = permService.GrantAPIKeyPermission(ctx, oldKey.ID, "env-b", permissions.PermissionViewer)
+	require.NoError(t, err)
+
+	newKey, err := authService.RotateAPIKey(ctx, oldKey.ID, user.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, oldKey.ID, newKey.ID)
+	assert.NotEqual(t, oldKey.Key, newKey.Key)
+	assert.Equal(t, "CI key", newKey.Description)
+	assert.Equal(t, oldKey.ID, newKey.RotatedFrom)
+	require.NotNil(t, newKey.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), *newKey.ExpiresAt, time.Minute)
+	require.NotNil(t, newKey.PreviousKeyRevokesAt)
+	assert.WithinDuration(t, time.Now().Add(auth.DefaultAPIKeyRotationGracePeriod), *newKey.PreviousKeyRevokesAt, time.Minute)
+
+	// Permissions are copied to the new key
+	assert.Len(t, newKey.Permissions, 2)
+	perms, err := permService.ListAPIKeyPermissions(ctx, newKey.ID)
+	require.NoError(t, err)
+	assert.Len(t, perms, 2)
+
+	// Both keys work during the grace period
+	_, err = authService.ValidateAPIKey(ctx, oldKey.Key)
+	assert.NoError(t, err)
+	_, err = authService.ValidateAPIKey(ctx, newKey.Key)
+	assert.NoError(t, err)
+
+	// A key can only be rotated once
+	_, err = authService.RotateAPIKey(ctx, oldKey.ID, user.ID)
+	assert.ErrorIs(t, err, apierrors.Conflict)
+	assert.Contains(t, err.Error(), "already been rotated")
+
+	_, err = authService.RotateAPIKey(ctx, oldKey.ID, "someone-else")
+	assert.ErrorIs(t, err, apierrors.NotFound)
+
+	keys, err := authService.ListAPIKeys(ctx, user.ID)
+	require.NoError(t, err)
+	statuses := map[string]string{}
+	for _, k := range keys {
+		statuses[k.ID] = k.Status
+	}
+	assert.Equal(t, auth.APIKeyStatusExpiring, statuses[oldKey.ID])
+	assert.Equal(t, auth.APIKeyStatusActive, statuses[newKey.ID])
+
+	entries, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionAPIKeyRotated})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, oldKey.ID, entries[0].ResourceID)
+
+	// With no grace period the old key stops working immediately
+	authService.SetAPIKeyLifecycle(0, 0)
+	rotated, err := authService.RotateAPIKey(ctx, newKey.ID, user.ID)
+	require.NoError(t, err)
+	_, err = authService.ValidateAPIKey(ctx, newKey.Key)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "revoked")
+	_, err = authService.ValidateAPIKey(ctx, rotated.Key)
+	assert.NoError(t, err)
+
+	// Expired keys cannot be rotated into a fresh one
+	_, err = db.ExecContext(ctx, "UPDATE api_keys SET expires_at = $1 WHERE id = $2", time.Now().Add(-time.Minute), rotated.ID)
+	require.NoError(t, err)
+	_, err = authService.RotateAPIKey(ctx, rotated.ID, user.ID)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+}
+
+func TestNotifyExpiringAPIKeys(t *testing.T) {
+	authService, userService, db := setupAuthTest(t)
+	ctx := context.Background()
+
+	user, err := userService.CreateUser(ctx, &users.CreateUserRequest{
+		Username: "expiring",
+		Password: "password123",
+		Role:     "user",
+		Status:   "active",
+	})
+	require.NoError(t, err)
+
+	soon := time.Now().Add(2 * 24 * time.Hour)
+	later := time.Now().Add(60 * 24 * time.Hour)
+	past := time.Now().Add(-time.Hour)
+	expiringKey, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, ExpiresAt: &soon})
+	require.NoError(t, err)
+	laterKey, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, ExpiresAt: &later})
+	require.NoError(t, err)
+	expiredKey, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID, ExpiresAt: &past})
+	require.NoError(t, err)
+	revokedKey, err := authService.CreateAPIKey(ctx, &auth.CreateAPIKeyRequest{UserID: user.ID})
+	require.NoError(t, err)
+	require.NoError(t, authService.RevokeAPIKey(ctx, revokedKey.ID, user.ID))
+
+	n, err := authService.NotifyExpiringAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Already notified keys are not reported again
+	n, err = authService.NotifyExpiringAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	entries, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionAPIKeyExpiring})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, expiringKey.ID, entries[0].ResourceID)
+	assert.Equal(t, user.ID, entries[0].ActorID)
+
+	keys, err := authService.ListAPIKeys(ctx, user.ID)
+	require.NoError(t, err)
+	statuses := map[string]string{}
+	for _, k := range keys {
+		statuses[k.ID] = k.Status
+	}
+	assert.Equal(t, auth.APIKeyStatusExpiring, statuses[expiringKey.ID])
+	assert.Equal(t, auth.APIKeyStatusActive, statuses[laterKey.ID])
+	assert.Equal(t, auth.APIKeyStatusExpired, statuses[expiredKey.ID])
+	assert.Equal(t, auth.APIKeyStatusRevoked, statuses[revokedKey.ID])
+}
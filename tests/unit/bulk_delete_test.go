@@ -0,0 +1,170 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// waitForOperationDone polls an operation until it is no longer running
+func waitForOperationDone(t *testing.T, orch *orchestrator.Orchestrator, id string) *models.Operation {
+	var op *models.Operation
+	require.Eventually(t, func() bool {
+		var err error
+		op, err = orch.GetOperation(context.Background(), id)
+		require.NoError(t, err)
+		return op.Status != models.OperationRunning
+	}, 10*time.Second, 20*time.Millisecond)
+	return op
+}
+
+func TestDeleteEnvironmentsOperation(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "bulk-env"})
+
+	op, err := orch.DeleteEnvironments(ctx, []string{env.ID, "env-missing"}, false, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, models.OperationDeleteEnvironments, op.Type)
+	assert.Equal(t, 2, op.Total)
+
+	done := waitForOperationDone(t, orch, op.ID)
+	assert.Equal(t, models.OperationFailed, done.Status)
+	assert.Equal(t, 1, done.Succeeded)
+	assert.Equal(t, 1, done.Failed)
+	assert.Equal(t, models.OperationResultSucceeded, done.Results[0].Status)
+	assert.Equal(t, models.OperationResultFailed, done.Results[1].Status)
+	assert.Contains(t, done.Results[1].Error, "not found")
+	assert.NotNil(t, done.CompletedAt)
+	_, err = orch.GetEnvironment(ctx, env.ID)
+	assert.Error(t, err)
+
+	// A running operation this server does not know was interrupted by a restart
+	require.NoError(t, db.SaveOperation(ctx, &models.Operation{
+		ID: "op-lost", Type: models.OperationDeleteEnvironments, Status: models.OperationRunning, CreatedAt: time.Now(),
+		Results: []models.OperationResult{{EnvironmentID: "env-1", Status: models.OperationResultPending}},
+	}))
+	lost, err := orch.GetOperation(ctx, "op-lost")
+	require.NoError(t, err)
+	assert.Equal(t, models.OperationFailed, lost.Status)
+	assert.Equal(t, 1, lost.Failed)
+	assert.NotEmpty(t, lost.Error)
+
+	_, err = orch.GetOperation(ctx, "op-missing")
+	assert.Error(t, err)
+}
+
+func TestDeleteEnvironmentsAPI(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler)
+
+	run := map[string]string{"run-id": "abc123"}
+	first := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "run-env-1", Labels: run})
+	second := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "run-env-2", Labels: run})
+	other := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "other-env", Labels: map[string]string{"run-id": "def456"}})
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/api/v1/environments?label=run-id%3Dabc123").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/api/v1/environments?confirm=true").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/api/v1/environments?label=run-id%3Dabc123&confirm=maybe").Code)
+
+	rr := do(http.MethodDelete, "/api/v1/environments?label=run-id%3Dabc123&dry_run=true")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var dryRun models.BulkDeleteDryRunResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&dryRun))
+	assert.ElementsMatch(t, []string{first.ID, second.ID}, dryRun.EnvironmentIDs)
+	assert.Equal(t, 2, dryRun.Total)
+	_, err = orch.GetEnvironment(context.Background(), first.ID)
+	require.NoError(t, err, "dry run must not delete")
+
+	rr = do(http.MethodDelete, "/api/v1/environments?label=run-id%3Dabc123&confirm=true")
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var op models.Operation
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&op))
+	assert.Equal(t, 2, op.Total)
+
+	waitForOperationDone(t, orch, op.ID)
+	rr = do(http.MethodGet, "/api/v1/operations/"+op.ID)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var done models.Operation
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&done))
+	assert.Equal(t, models.OperationCompleted, done.Status)
+	assert.Equal(t, 2, done.Succeeded)
+
+	list, err := orch.ListEnvironments(context.Background(), nil, "", 100, 0)
+	require.NoError(t, err)
+	require.Len(t, list.Environments, 1)
+	assert.Equal(t, other.ID, list.Environments[0].ID)
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/v1/operations/op-missing").Code)
+}
+
+func TestDeleteEnvironmentsPermissions(t *testing.T) {
+	a := setupEnvTokenAPITest(t)
+	ctx := context.Background()
+
+	owner := createUserForTest(t, a.users, "bulk-owner", "password123", users.RoleUser)
+	createUserForTest(t, a.users, "bulk-admin", "password123", users.RoleAdmin)
+	run := map[string]string{"run-id": "abc123"}
+	mine := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "mine", Labels: run})
+	theirs := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "theirs", Labels: run})
+	_, err := a.permissions.GrantPermission(ctx, owner.ID, mine.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+	_, err = a.permissions.GrantPermission(ctx, owner.ID, theirs.ID, permissions.PermissionEditor, "")
+	require.NoError(t, err)
+	ownerJWT := getTokenForUser(t, a.router, "bulk-owner", "password123")
+	adminJWT := getTokenForUser(t, a.router, "bulk-admin", "password123")
+
+	dryRun := func(token string) []string {
+		rr := a.do(t, http.MethodDelete, "/api/v1/environments?label=run-id%3Dabc123&dry_run=true", token, nil)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp models.BulkDeleteDryRunResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		return resp.EnvironmentIDs
+	}
+	// Non-admins only match environments they own
+	assert.Equal(t, []string{mine.ID}, dryRun(ownerJWT))
+	assert.ElementsMatch(t, []string{mine.ID, theirs.ID}, dryRun(adminJWT))
+
+	rr := a.do(t, http.MethodDelete, "/api/v1/environments?label=run-id%3Dabc123&confirm=true", ownerJWT, nil)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var op models.Operation
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&op))
+	require.Len(t, op.Results, 1)
+	assert.Equal(t, mine.ID, op.Results[0].EnvironmentID)
+	waitForOperationDone(t, a.orch, op.ID)
+	_, err = a.orch.GetEnvironment(ctx, theirs.ID)
+	assert.NoError(t, err)
+
+	// Operations are visible to their creator and admins only
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/operations/"+op.ID, ownerJWT, nil).Code)
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/operations/"+op.ID, adminJWT, nil).Code)
+	createUserForTest(t, a.users, "bulk-other", "password123", users.RoleUser)
+	otherJWT := getTokenForUser(t, a.router, "bulk-other", "password123")
+	assert.Equal(t, http.StatusNotFound, a.do(t, http.MethodGet, "/api/v1/operations/"+op.ID, otherJWT, nil).Code)
+}
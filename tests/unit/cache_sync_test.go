@@ -0,0 +1,56 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+func TestEnvironmentCacheSyncAcrossReplicas(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	replicaA, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	env := createRunningEnv(t, replicaA, &models.CreateEnvironmentRequest{Name: "shared-env"})
+
+	// Replica B starts after the environment exists and caches it
+	replicaB, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	health, err := replicaB.GetHealthInfo(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, health.Cache)
+	assert.Equal(t, 1, health.Cache.Environments)
+	require.NotNil(t, health.Cache.LastSyncAt)
+
+	// A change made by replica A reaches replica B's cache on the next sync
+	require.NoError(t, db.UpdateEnvironmentStatus(ctx, env.ID, models.StatusFailed, nil))
+	row, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Greater(t, row.Version, env.Version)
+	require.NotNil(t, row.UpdatedAt)
+
+	require.NoError(t, replicaB.SyncEnvironmentCache(ctx))
+	listed, err := replicaB.ListEnvironments(ctx, nil, "", 10, 0)
+	require.NoError(t, err)
+	require.Len(t, listed.Environments, 1)
+	assert.Equal(t, models.StatusFailed, listed.Environments[0].Status)
+
+	// A deletion on replica A evicts the environment from replica B
+	require.NoError(t, replicaA.DeleteEnvironment(ctx, env.ID, false))
+	require.NoError(t, replicaB.SyncEnvironmentCache(ctx))
+	health, err = replicaB.GetHealthInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, health.Cache.Environments)
+	assert.EqualValues(t, 1, health.Cache.Refreshed)
+	assert.EqualValues(t, 1, health.Cache.Evicted)
+	assert.Less(t, health.Cache.StalenessSeconds, 5.0)
+	assert.WithinDuration(t, time.Now(), *health.Cache.LastSyncAt, 5*time.Second)
+
+	// Tombstones are kept for replicas that have not synced yet
+	ids, err := db.ListEnvironmentTombstonesSince(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []string{env.ID}, ids)
+}
@@ -0,0 +1,168 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// capacityConfig checks requests against the free capacity of the cluster's nodes
+func capacityConfig() *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Resources.CapacityCheck = true
+	return cfg
+}
+
+// capacityCluster is a mock cluster of two nodes, node-a partly allocated
+func capacityCluster() *mocks.MockK8sClient {
+	mockK8s := mocks.NewMockK8sClient()
+	mockK8s.SetNodes([]k8s.NodeAllocatable{
+		{Name: "node-b", CPUMillicores: 8000, MemoryBytes: 8 << 30},
+		{Name: "node-a", CPUMillicores: 4000, MemoryBytes: 16 << 30, FreeCPUMillicores: 1000, FreeMemoryBytes: 2 << 30},
+	})
+	return mockK8s
+}
+
+func capacityRequest(name, cpu, memory string) *models.CreateEnvironmentRequest {
+	return &models.CreateEnvironmentRequest{
+		Name:      name,
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: cpu, Memory: memory, Storage: "1Gi"},
+	}
+}
+
+func TestSchedulableNodes(t *testing.T) {
+	ready := corev1.NodeStatus{
+		Allocatable: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("4"),
+			corev1.ResourceMemory: resource.MustParse("16Gi"),
+		},
+		Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+	}
+	big := *ready.DeepCopy()
+	big.Allocatable[corev1.ResourceCPU] = resource.MustParse("32")
+	notReady := *ready.DeepCopy()
+	notReady.Conditions[0].Status = corev1.ConditionFalse
+
+	nodes := []corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "small", Labels: map[string]string{"pool": "agents"}}, Status: ready},
+		{ObjectMeta: metav1.ObjectMeta{Name: "gpu", Labels: map[string]string{"pool": "agents"}}, Status: big,
+			Spec: corev1.NodeSpec{Taints: []corev1.Taint{{Key: "gpu", Value: "true", Effect: corev1.TaintEffectNoSchedule}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cordoned", Labels: map[string]string{"pool": "agents"}}, Status: big,
+			Spec: corev1.NodeSpec{Unschedulable: true}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "down", Labels: map[string]string{"pool": "agents"}}, Status: notReady},
+		{ObjectMeta: metav1.ObjectMeta{Name: "system", Labels: map[string]string{"pool": "system"}}, Status: big},
+	}
+	pods := []corev1.Pod{
+		{Spec: corev1.PodSpec{NodeName: "small", Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1500m"), corev1.ResourceMemory: resource.MustParse("4Gi")},
+		}}}}},
+		// Finished pods no longer hold their requests
+		{Spec: corev1.PodSpec{NodeName: "small", Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+		}}}}, Status: corev1.PodStatus{Phase: corev1.PodSucceeded}},
+	}
+
+	got := k8s.SchedulableNodes(nodes, pods, map[string]string{"pool": "agents"}, nil)
+	require.Len(t, got, 1)
+	assert.Equal(t, k8s.NodeAllocatable{
+		Name:              "small",
+		CPUMillicores:     4000,
+		MemoryBytes:       16 << 30,
+		FreeCPUMillicores: 2500,
+		FreeMemoryBytes:   12 << 30,
+	}, got[0])
+
+	// Tolerating the taint makes the larger node available, and it sorts first
+	got = k8s.SchedulableNodes(nodes, pods, map[string]string{"pool": "agents"}, []k8s.Toleration{{Key: "gpu", Operator: "Exists", Effect: "NoSchedule"}})
+	require.Len(t, got, 2)
+	assert.Equal(t, "gpu", got[0].Name)
+	assert.Equal(t, "small", got[1].Name)
+}
+
+func TestCapacityCheckRejectsRequestsNoNodeFits(t *testing.T) {
+	orch := setupOrchestratorOnCluster(t, capacityCluster(), capacityConfig(), nil)
+	ctx := context.Background()
+
+	_, err := orch.CreateEnvironment(ctx, capacityRequest("huge", "8", "32Gi"), "user-123")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, apierrors.Unschedulable)
+	assert.Equal(t, apierrors.CodeExceedsNodeCapacity, apierrors.CodeOf(err))
+	assert.Contains(t, err.Error(), "largest available node (node-b) has 8 CPU and 8Gi memory")
+
+	// 6 CPU fits node-b and 12Gi fits node-a, but no node has both
+	_, err = orch.CreateEnvironment(ctx, capacityRequest("lopsided", "6", "12Gi"), "user-123")
+	assert.ErrorIs(t, err, apierrors.Unschedulable)
+
+	env, err := orch.CreateEnvironment(ctx, capacityRequest("fits", "500m", "512Mi"), "user-123")
+	require.NoError(t, err)
+	assert.Empty(t, env.SchedulingWarning)
+}
+
+func TestCapacityCheckWarnsWhenClusterIsFull(t *testing.T) {
+	mockK8s := capacityCluster()
+	orch := setupOrchestratorOnCluster(t, mockK8s, capacityConfig(), nil)
+	ctx := context.Background()
+
+	// node-a has free room for two 500m pods; the main pod plus a pool of two needs three
+	req := capacityRequest("pooled", "500m", "512Mi")
+	req.Pool = &models.PoolConfig{Enabled: true, Size: 2}
+	env, err := orch.CreateEnvironment(ctx, req, "user-123")
+	require.NoError(t, err)
+	assert.Contains(t, env.SchedulingWarning, "free capacity for 2 of the 3 pods")
+
+	// Capacity is cached: the nodes were read once for both requests
+	_, err = orch.CreateEnvironment(ctx, capacityRequest("cached", "500m", "512Mi"), "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, 1, mockK8s.CallCount("GetNodeAllocatable"))
+}
+
+func TestCapacityCheckAcceptsWhenCapacityUnavailable(t *testing.T) {
+	mockK8s := capacityCluster()
+	orch := setupOrchestratorOnCluster(t, mockK8s, capacityConfig(), nil)
+	mockK8s.FailNext("GetNodeAllocatable", 1, errors.New("nodes is forbidden"))
+
+	env, err := orch.CreateEnvironment(context.Background(), capacityRequest("huge", "8", "32Gi"), "user-123")
+	require.NoError(t, err)
+	assert.Empty(t, env.SchedulingWarning)
+}
+
+func TestCapacityCheckAPI(t *testing.T) {
+	orch := setupOrchestratorOnCluster(t, capacityCluster(), capacityConfig(), nil)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	val := validator.New(10000, 64*1024*1024*1024, 100*1024*1024*1024, 86400)
+	router := api.NewRouter(api.NewHandler(orch, val, log, nil, nil), nil)
+
+	body, err := json.Marshal(capacityRequest("huge", "8", "32Gi"))
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, apierrors.CodeExceedsNodeCapacity, errResp.Code)
+	assert.Contains(t, errResp.Error, "node-b")
+}
@@ -0,0 +1,182 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.10"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{
+			name:       "untrusted peer without headers",
+			remoteAddr: "203.0.113.5:41000",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "untrusted peer spoofing X-Forwarded-For",
+			remoteAddr: "203.0.113.5:41000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "untrusted peer spoofing X-Real-IP",
+			remoteAddr: "203.0.113.5:41000",
+			headers:    map[string][]string{"X-Real-IP": {"1.2.3.4"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.9.9.9, 192.0.2.10"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "client-supplied entries left of the client are ignored",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.9.9.9"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "chain split over several headers",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7", "10.9.9.9"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "only trusted proxies in the chain",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.5.5.5, 10.9.9.9"}},
+			want:       "10.5.5.5",
+		},
+		{
+			name:       "malformed entry stops at the last good hop",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7, not-an-ip, 10.9.9.9"}},
+			want:       "10.9.9.9",
+		},
+		{
+			name:       "X-Real-IP from a trusted proxy",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.8"}},
+			want:       "198.51.100.8",
+		},
+		{
+			name:       "trusted IPv6 proxy forwarding an IPv6 client",
+			remoteAddr: "[2001:db8:ffff::1]:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"2001:DB8:1::abcd, 2001:db8:ffff::2"}},
+			want:       "2001:db8:1::abcd",
+		},
+		{
+			name:       "bracketed IPv6 entry with port",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"[2001:db8:2::1]:8443"}},
+			want:       "2001:db8:2::1",
+		},
+		{
+			name:       "untrusted IPv6 peer",
+			remoteAddr: "[2001:db8:2::1]:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "2001:db8:2::1",
+		},
+		{
+			name:       "IPv4-mapped IPv6 peer matches an IPv4 range",
+			remoteAddr: "[::ffff:10.1.2.3]:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			assert.Equal(t, tt.want, resolver.Resolve(req))
+		})
+	}
+
+	// Without trusted proxies forwarding headers are never used
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:5000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	var none *clientip.Resolver
+	assert.Equal(t, "10.1.2.3", none.Resolve(req))
+
+	_, err = clientip.NewResolver([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = clientip.NewResolver([]string{"ingress"})
+	assert.Error(t, err)
+}
+
+func TestClientIPMiddlewareFeedsAuditAndLockout(t *testing.T) {
+	router, db, authService, userService := setupFullAPITest(t)
+	authService.SetLoginLockout(config.LoginLockoutConfig{Enabled: true, MaxFailures: 10, MaxFailuresPerIP: 2, LockoutSeconds: 300})
+	createUserForTest(t, userService, "erin", "password123", users.RoleUser)
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	handler := resolver.Middleware(router)
+
+	login := func(remoteAddr, forwardedFor string) int {
+		body, _ := json.Marshal(auth.LoginRequest{Username: "erin", Password: "wrong"})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Behind the ingress the per-address limit applies to the real client, not the ingress
+	assert.Equal(t, http.StatusUnauthorized, login("10.0.0.2:5000", "198.51.100.7"))
+	assert.Equal(t, http.StatusUnauthorized, login("10.0.0.3:5000", "198.51.100.7, 10.0.0.2"))
+	entries, err := db.ListAuditEntries(context.Background(), database.AuditFilter{Action: auth.AuditActionLoginLocked})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "client_address", entries[0].ResourceType)
+	assert.Equal(t, "198.51.100.7", entries[0].ResourceID)
+	assert.Equal(t, "198.51.100.7", entries[0].ClientIP)
+
+	// A direct client cannot dodge the limit by spoofing the header
+	assert.Equal(t, http.StatusUnauthorized, login("203.0.113.5:41000", "198.51.100.99"))
+	assert.Equal(t, http.StatusUnauthorized, login("203.0.113.5:41000", "198.51.100.100"))
+	assert.Equal(t, http.StatusTooManyRequests, login("203.0.113.5:41000", "198.51.100.101"))
+
+	// Audit entries written while handling a request record its client address
+	ctx := clientip.WithClientIP(context.Background(), "2001:db8::7")
+	require.NoError(t, db.SaveAuditEntry(ctx, &models.AuditEntry{Action: "test.client_ip", Message: "test"}))
+	entries, err = db.ListAuditEntries(context.Background(), database.AuditFilter{Action: "test.client_ip"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "2001:db8::7", entries[0].ClientIP)
+}
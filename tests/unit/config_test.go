@@ -1,8 +1,11 @@
 package unit
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -63,9 +66,11 @@ func TestLoadConfig(t *testing.T) {
 	t.Run("validation error - auth enabled without secret", func(t *testing.T) {
 		os.Setenv("AGENTBOX_AUTH_ENABLED", "true")
 		os.Setenv("AGENTBOX_AUTH_SECRET", "")
+		os.Setenv("AGENTBOX_JWT_SECRET", "")
 		defer func() {
 			os.Unsetenv("AGENTBOX_AUTH_ENABLED")
 			os.Unsetenv("AGENTBOX_AUTH_SECRET")
+			os.Unsetenv("AGENTBOX_JWT_SECRET")
 		}()
 
 		_, err := config.Load("")
@@ -189,24 +194,938 @@ reconciliation:
 	assert.Equal(t, 3, cfg.Reconciliation.MaxRetries)
 }
 
-func TestConfigReconciliationValidationNegativeRetries(t *testing.T) {
+func TestConfigReconciliationMaxRetries(t *testing.T) {
+	load := func(t *testing.T, yamlContent string) *config.Config {
+		tmpfile, err := os.CreateTemp("", "config-recon-retries-*.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		_, err = tmpfile.Write([]byte(yamlContent))
+		require.NoError(t, err)
+		tmpfile.Close()
+		cfg, err := config.Load(tmpfile.Name())
+		require.NoError(t, err)
+		return cfg
+	}
+
+	// Missing and 0 both mean the default; negative means unlimited (-1)
+	cfg := load(t, "auth:\n  enabled: false\n")
+	assert.Equal(t, config.DefaultReconciliationMaxRetries, cfg.Reconciliation.MaxRetries)
+	cfg = load(t, "auth:\n  enabled: false\nreconciliation:\n  interval_seconds: 60\n")
+	assert.Equal(t, config.DefaultReconciliationMaxRetries, cfg.Reconciliation.MaxRetries)
+	cfg = load(t, "auth:\n  enabled: false\nreconciliation:\n  max_retries: 0\n")
+	assert.Equal(t, config.DefaultReconciliationMaxRetries, cfg.Reconciliation.MaxRetries)
+	cfg = load(t, "auth:\n  enabled: false\nreconciliation:\n  max_retries: -3\n")
+	assert.Equal(t, -1, cfg.Reconciliation.MaxRetries)
+
+	t.Setenv("AGENTBOX_RECONCILIATION_MAX_RETRIES", "-1")
+	cfg = load(t, "auth:\n  enabled: false\n")
+	assert.Equal(t, -1, cfg.Reconciliation.MaxRetries)
+
+	assert.Equal(t, config.DefaultReconciliationMaxRetries, config.ReconciliationConfig{}.EffectiveMaxRetries())
+	assert.Equal(t, 2, config.ReconciliationConfig{MaxRetries: 2}.EffectiveMaxRetries())
+	assert.Equal(t, -1, config.ReconciliationConfig{MaxRetries: -7}.EffectiveMaxRetries())
+}
+
+func TestConfigKubernetesClientFromYAML(t *testing.T) {
+	load := func(t *testing.T, yamlContent string) (*config.Config, error) {
+		tmpfile, err := os.CreateTemp("", "config-k8s-client-*.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		_, err = tmpfile.Write([]byte(yamlContent))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return config.Load(tmpfile.Name())
+	}
+
+	cfg, err := load(t, "auth:\n  enabled: false\n")
+	require.NoError(t, err)
+	assert.Equal(t, float32(50), cfg.Kubernetes.QPS)
+	assert.Equal(t, 100, cfg.Kubernetes.Burst)
+	assert.Equal(t, 3, cfg.Kubernetes.Retry.MaxAttempts)
+
+	cfg, err = load(t, `
+auth:
+  enabled: false
+kubernetes:
+  qps: 20
+  burst: 40
+  retry:
+    max_attempts: 5
+    initial_backoff_ms: 100
+    max_backoff_ms: 2000
+`)
+	require.NoError(t, err)
+	assert.Equal(t, float32(20), cfg.Kubernetes.QPS)
+	assert.Equal(t, 40, cfg.Kubernetes.Burst)
+	assert.Equal(t, config.KubernetesRetryConfig{MaxAttempts: 5, InitialBackoffMs: 100, MaxBackoffMs: 2000}, cfg.Kubernetes.Retry)
+
+	_, err = load(t, "auth:\n  enabled: false\nkubernetes:\n  retry:\n    max_attempts: 0\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "max_attempts")
+}
+
+func TestConfigRetentionFromYAML(t *testing.T) {
 	yamlContent := `
 server:
   port: 8080
 auth:
   enabled: false
-reconciliation:
-  interval_seconds: 60
-  max_retries: -1
+retention:
+  keep_last_per_environment: 50
+  max_age_days: 7
+  interval_seconds: 600
+  events:
+    max_per_environment: 1000
+    max_age_days: 30
 `
-	tmpfile, err := os.CreateTemp("", "config-recon-neg-*.yaml")
+	tmpfile, err := os.CreateTemp("", "config-retention-*.yaml")
 	require.NoError(t, err)
 	defer os.Remove(tmpfile.Name())
 	_, err = tmpfile.Write([]byte(yamlContent))
 	require.NoError(t, err)
 	tmpfile.Close()
 
-	_, err = config.Load(tmpfile.Name())
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "max_retries")
+	cfg, err := config.Load(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 50, cfg.Retention.KeepLastPerEnvironment)
+	assert.Equal(t, 7, cfg.Retention.MaxAgeDays)
+	assert.Equal(t, 600, cfg.Retention.IntervalSeconds)
+	assert.Equal(t, 1000, cfg.Retention.Events.MaxPerEnvironment)
+	assert.Equal(t, 30, cfg.Retention.Events.MaxAgeDays)
+}
+
+func TestConfigExecutionsFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-executions-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024), cfg.Executions.MaxOutputBytes)
+	assert.Equal(t, 32, cfg.Executions.MaxQueueDepth)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nexecutions:\n  max_output_bytes: 65536\n  max_queue_depth: 4\n"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(65536), cfg.Executions.MaxOutputBytes)
+	assert.Equal(t, 4, cfg.Executions.MaxQueueDepth)
+
+	_, err = config.Load(write("auth:\n  enabled: false\nexecutions:\n  max_output_bytes: 10\n"))
+	assert.ErrorContains(t, err, "max_output_bytes")
+
+	_, err = config.Load(write("auth:\n  enabled: false\nexecutions:\n  max_queue_depth: 0\n"))
+	assert.ErrorContains(t, err, "max_queue_depth")
+}
+
+func TestConfigExecutionCallbacksFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-callbacks-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	callbacks := cfg.Executions.Callbacks
+	assert.Equal(t, []string{"https"}, callbacks.AllowedSchemes)
+	assert.Empty(t, callbacks.AllowedHosts)
+	assert.False(t, callbacks.AllowPrivateNetworks, "internal addresses are blocked by default")
+	assert.Equal(t, 5, callbacks.MaxAttempts)
+
+	cfg, err = config.Load(write(`
+auth:
+  enabled: false
+executions:
+  callbacks:
+    allowed_schemes: [http, https]
+    allowed_hosts: ["hooks.example.com", "*.agents.example.com"]
+    max_attempts: 2
+`))
+	require.NoError(t, err)
+	callbacks = cfg.Executions.Callbacks
+	assert.Equal(t, []string{"http", "https"}, callbacks.AllowedSchemes)
+	assert.Equal(t, []string{"hooks.example.com", "*.agents.example.com"}, callbacks.AllowedHosts)
+	assert.Equal(t, 2, callbacks.MaxAttempts)
+
+	_, err = config.Load(write("auth:\n  enabled: false\nexecutions:\n  callbacks:\n    allowed_schemes: [ftp]\n"))
+	assert.ErrorContains(t, err, "allowed_schemes")
+	_, err = config.Load(write("auth:\n  enabled: false\nexecutions:\n  callbacks:\n    allowed_hosts: ['*.*.example.com']\n"))
+	assert.ErrorContains(t, err, "allowed_hosts[0]")
+	_, err = config.Load(write("auth:\n  enabled: false\nexecutions:\n  callbacks:\n    max_attempts: 0\n"))
+	assert.ErrorContains(t, err, "max_attempts")
+}
+
+func TestConfigBodyLimitsFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-body-limits-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, config.BodyLimitsConfig{Environments: 1 << 20, Import: 4 << 20, Exec: 64 << 10, Default: 8 << 10}, cfg.Server.BodyLimits)
+	assert.False(t, cfg.Server.DisableCompression)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nserver:\n  disable_compression: true\n  body_limits:\n    environments: 4194304\n"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4<<20), cfg.Server.BodyLimits.Environments)
+	assert.Equal(t, int64(64<<10), cfg.Server.BodyLimits.Exec, "unset limits keep their default")
+	assert.True(t, cfg.Server.DisableCompression)
+
+	_, err = config.Load(write("auth:\n  enabled: false\nserver:\n  body_limits:\n    exec: 100\n"))
+	assert.ErrorContains(t, err, "body_limits.exec")
+}
+
+func TestConfigTrustedProxies(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-trusted-proxies-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Server.TrustedProxies)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nserver:\n  trusted_proxies: [\"10.0.0.0/8\", \"fd00::/8\", \"192.0.2.10\"]\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "fd00::/8", "192.0.2.10"}, cfg.Server.TrustedProxies)
+
+	t.Setenv("AGENTBOX_TRUSTED_PROXIES", "172.16.0.0/12,::1")
+	cfg, err = config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"172.16.0.0/12", "::1"}, cfg.Server.TrustedProxies)
+
+	t.Setenv("AGENTBOX_TRUSTED_PROXIES", "")
+	_, err = config.Load(write("auth:\n  enabled: false\nserver:\n  trusted_proxies: [\"ingress.local\"]\n"))
+	assert.ErrorContains(t, err, "trusted_proxies")
+}
+
+func TestConfigIdleFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-idle-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, config.IdleConfig{TimeoutSeconds: 0, WarningSeconds: 3600, IntervalSeconds: 300}, cfg.Idle)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nidle:\n  timeout_seconds: 86400\n  webhook_url: https://hooks.example.com/idle\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 86400, cfg.Idle.TimeoutSeconds)
+	assert.Equal(t, 3600, cfg.Idle.WarningSeconds)
+	assert.Equal(t, "https://hooks.example.com/idle", cfg.Idle.WebhookURL)
+
+	_, err = config.Load(write("auth:\n  enabled: false\nidle:\n  webhook_url: hooks.example.com\n"))
+	assert.ErrorContains(t, err, "idle webhook_url")
+}
+
+func TestConfigJWTKeysFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-jwt-keys-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	// auth.secret (or AGENTBOX_JWT_SECRET) is the only key when no key set is configured
+	t.Setenv("AGENTBOX_JWT_SECRET", "env-secret-0123456789abcdefghijklmnop")
+	cfg, err := config.Load(write("auth:\n  enabled: true\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []config.JWTKeyConfig{{ID: "default", Secret: "env-secret-0123456789abcdefghijklmnop"}}, cfg.Auth.EffectiveJWTKeys())
+	t.Setenv("AGENTBOX_JWT_SECRET", "")
+
+	cfg, err = config.Load(write(`auth:
+  enabled: true
+  jwt_keys:
+    - id: "2026-10"
+      secret: new-secret-0123456789abcdefghijklmnop
+    - id: "2026-09"
+      secret: old-secret-0123456789abcdefghijklmnop
+      retire_at: "2026-11-01T00:00:00Z"
+`))
+	require.NoError(t, err)
+	keys := cfg.Auth.EffectiveJWTKeys()
+	require.Len(t, keys, 2)
+	assert.Equal(t, "2026-10", keys[0].ID)
+	redacted, err := cfg.Redacted()
+	require.NoError(t, err)
+	assert.NotContains(t, fmt.Sprint(redacted), "old-secret")
+
+	// The sample secret, short secrets, duplicate IDs and a retiring signing key are rejected
+	_, err = config.Load(write("auth:\n  enabled: false\n  secret: change-me-in-production\n"))
+	assert.ErrorContains(t, err, "insecure sample secret")
+	_, err = config.Load(write("auth:\n  enabled: true\n  secret: short\n"))
+	assert.ErrorContains(t, err, "at least 32 characters")
+	_, err = config.Load(write("auth:\n  jwt_keys:\n    - {id: a, secret: a-secret-that-is-long-enough-0123456789}\n    - {id: a, secret: a-secret-that-is-long-enough-0123456789}\n"))
+	assert.ErrorContains(t, err, "more than once")
+	_, err = config.Load(write("auth:\n  jwt_keys:\n    - {id: a, secret: a-secret-that-is-long-enough-0123456789, retire_at: '2026-11-01T00:00:00Z'}\n"))
+	assert.ErrorContains(t, err, "cannot have retire_at")
+
+	// AGENTBOX_JWT_KEYS replaces the configured keys; invalid JSON fails the load instead of
+	// leaving the file's keys in place
+	t.Setenv("AGENTBOX_JWT_KEYS", `[{"id": "env", "secret": "env-key-secret-0123456789abcdefghijkl"}]`)
+	cfg, err = config.Load(write("auth:\n  enabled: true\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "env", cfg.Auth.EffectiveJWTKeys()[0].ID)
+	t.Setenv("AGENTBOX_JWT_KEYS", `[{"id": "env", "secret": "env-key-secret-0123456789abcdefghijkl"`)
+	_, err = config.Load(write("auth:\n  enabled: true\n  secret: file-secret-0123456789abcdefghijklmn\n"))
+	var validationErr *config.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.ErrorContains(t, err, "AGENTBOX_JWT_KEYS must be a JSON array")
+	t.Setenv("AGENTBOX_JWT_KEYS", "")
+
+	// Insecure dev mode allows running without any secret
+	cfg, err = config.Load(write("auth:\n  enabled: true\n  insecure_dev_mode: true\n"))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Auth.EffectiveJWTKeys())
+}
+
+func TestConfigRecordingFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-recording-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "./recordings", cfg.Recording.Directory)
+	assert.Equal(t, int64(10<<20), cfg.Recording.MaxBytes)
+	assert.Equal(t, config.DefaultRecordingRedactPatterns, cfg.Recording.RedactPatterns)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nrecording:\n  max_bytes: 4096\n  redact_patterns:\n    - 'secret-\\d+'\n"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4096), cfg.Recording.MaxBytes)
+	assert.Equal(t, []string{`secret-\d+`}, cfg.Recording.RedactPatterns, "configured patterns replace the defaults")
+
+	_, err = config.Load(write("auth:\n  enabled: false\nrecording:\n  max_bytes: 10\n"))
+	assert.ErrorContains(t, err, "recording max_bytes")
+	_, err = config.Load(write("auth:\n  enabled: false\nrecording:\n  redact_patterns: ['(']\n"))
+	assert.ErrorContains(t, err, "redact_patterns[0]")
+}
+
+func TestConfigSnapshotsFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-snapshots-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "./snapshots", cfg.Snapshots.Directory)
+	assert.Equal(t, int64(1<<30), cfg.Snapshots.MaxBytes)
+	assert.Equal(t, 3600, cfg.Snapshots.DefaultIntervalSeconds)
+	assert.Equal(t, 3, cfg.Snapshots.DefaultKeep)
+
+	_, err = config.Load(write("auth:\n  enabled: false\nsnapshots:\n  default_interval_seconds: 10\n"))
+	assert.ErrorContains(t, err, "snapshots default_interval_seconds")
+	_, err = config.Load(write("auth:\n  enabled: false\nsnapshots:\n  default_keep: -1\n"))
+	assert.ErrorContains(t, err, "snapshots default_keep")
+
+	t.Setenv("AGENTBOX_SNAPSHOT_KEEP", "7")
+	cfg, err = config.Load(write("auth:\n  enabled: false\nsnapshots:\n  directory: /var/lib/agentbox/snapshots\n  default_interval_seconds: 600\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/agentbox/snapshots", cfg.Snapshots.Directory)
+	assert.Equal(t, 600, cfg.Snapshots.DefaultIntervalSeconds)
+	assert.Equal(t, 7, cfg.Snapshots.DefaultKeep)
+}
+
+func TestConfigTracingFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-tracing-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.False(t, cfg.Tracing.Enabled, "tracing is off by default")
+	assert.Equal(t, "localhost:4318", cfg.Tracing.Endpoint)
+	assert.Equal(t, 1.0, cfg.Tracing.SampleRatio)
+	assert.Equal(t, "agentbox", cfg.Tracing.ServiceName)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\ntracing:\n  enabled: true\n  endpoint: otel-collector:4318\n  insecure: true\n  sample_ratio: 0.25\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.Tracing.Enabled)
+	assert.Equal(t, "otel-collector:4318", cfg.Tracing.Endpoint)
+	assert.True(t, cfg.Tracing.Insecure)
+	assert.Equal(t, 0.25, cfg.Tracing.SampleRatio)
+
+	_, err = config.Load(write("auth:\n  enabled: false\ntracing:\n  sample_ratio: 1.5\n"))
+	assert.ErrorContains(t, err, "tracing sample_ratio")
+	_, err = config.Load(write("auth:\n  enabled: false\ntracing:\n  enabled: true\n  endpoint: http://collector:4318\n"))
+	assert.ErrorContains(t, err, "tracing endpoint")
+}
+
+func TestConfigImagesFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-images-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Images.AllowedRegistries, "every registry is allowed by default")
+	assert.Equal(t, 300, cfg.Images.InspectCacheSeconds)
+
+	cfg, err = config.Load(write(`
+auth:
+  enabled: false
+images:
+  allowed_registries: [ghcr.io/acme, docker.io/library]
+  inspect_cache_seconds: 60
+  registries:
+    - host: ghcr.io
+      username: acme-bot
+      password: ghp_secret
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ghcr.io/acme", "docker.io/library"}, cfg.Images.AllowedRegistries)
+	assert.Equal(t, 60, cfg.Images.InspectCacheSeconds)
+	require.Len(t, cfg.Images.Registries, 1)
+	redacted, err := cfg.Redacted()
+	require.NoError(t, err)
+	registries := redacted["images"].(map[string]interface{})["registries"].([]interface{})
+	assert.NotEqual(t, "ghp_secret", registries[0].(map[string]interface{})["password"])
+
+	_, err = config.Load(write("auth:\n  enabled: false\nimages:\n  allowed_registries: [\"https://ghcr.io\"]\n"))
+	assert.ErrorContains(t, err, "allowed_registries")
+	_, err = config.Load(write("auth:\n  enabled: false\nimages:\n  registries:\n    - host: ghcr.io\n      username: bot\n"))
+	assert.ErrorContains(t, err, "password")
+}
+
+func TestConfigOrphanGCFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-orphan-gc-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.Reconciliation.OrphanGC.Enabled)
+	assert.False(t, cfg.Reconciliation.OrphanGC.DryRun)
+	assert.Equal(t, 3600, cfg.Reconciliation.OrphanGC.MinAgeSeconds)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nreconciliation:\n  orphan_gc:\n    dry_run: true\n    min_age_seconds: 600\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.Reconciliation.OrphanGC.DryRun)
+	assert.Equal(t, 600, cfg.Reconciliation.OrphanGC.MinAgeSeconds)
+
+	t.Setenv("AGENTBOX_ORPHAN_GC_ENABLED", "false")
+	t.Setenv("AGENTBOX_ORPHAN_GC_MIN_AGE_SECONDS", "60")
+	cfg, err = config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.False(t, cfg.Reconciliation.OrphanGC.Enabled)
+	assert.Equal(t, 60, cfg.Reconciliation.OrphanGC.MinAgeSeconds)
+
+	t.Setenv("AGENTBOX_ORPHAN_GC_MIN_AGE_SECONDS", "")
+	_, err = config.Load(write("auth:\n  enabled: false\nreconciliation:\n  orphan_gc:\n    min_age_seconds: -1\n"))
+	assert.ErrorContains(t, err, "min_age_seconds")
+}
+
+func TestConfigPortForwardFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-port-forward-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, config.PortForwardConfig{AllowedPorts: []string{"1024-65535"}, IdleTimeoutSeconds: 300, MaxPerEnvironment: 8}, cfg.PortForward)
+	assert.False(t, cfg.PortForward.AllowsPort(22))
+	assert.True(t, cfg.PortForward.AllowsPort(8888))
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\nport_forward:\n  allowed_ports: [\"8888\", \"9000-9010\"]\n  max_per_environment: 2\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.PortForward.AllowsPort(8888))
+	assert.True(t, cfg.PortForward.AllowsPort(9010))
+	assert.False(t, cfg.PortForward.AllowsPort(8889))
+	assert.Equal(t, 2, cfg.PortForward.MaxPerEnvironment)
+
+	// Set but empty disables port forwarding
+	t.Setenv("AGENTBOX_PORT_FORWARD_ALLOWED_PORTS", "")
+	cfg, err = config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.PortForward.AllowedPorts)
+
+	t.Setenv("AGENTBOX_PORT_FORWARD_ALLOWED_PORTS", "9000-8000")
+	_, err = config.Load(write("auth:\n  enabled: false\n"))
+	assert.ErrorContains(t, err, "port_forward allowed_ports")
+}
+
+func TestConfigLoginSecurityFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-login-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, config.PasswordPolicyConfig{MinLength: 8, RejectCommon: true}, cfg.Auth.PasswordPolicy)
+	assert.Equal(t, config.LoginLockoutConfig{Enabled: true, MaxFailures: 5, MaxFailuresPerIP: 20, BaseDelayMs: 1000, LockoutSeconds: 900}, cfg.Auth.LoginLockout)
+
+	cfg, err = config.Load(write("auth:\n  enabled: false\n  password_policy:\n    min_length: 12\n    require_digit: true\n  login_lockout:\n    max_failures: 3\n    lockout_seconds: 60\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 12, cfg.Auth.PasswordPolicy.MinLength)
+	assert.True(t, cfg.Auth.PasswordPolicy.RequireDigit)
+	assert.Equal(t, 3, cfg.Auth.LoginLockout.MaxFailures)
+	assert.Equal(t, 60, cfg.Auth.LoginLockout.LockoutSeconds)
+
+	t.Setenv("AGENTBOX_PASSWORD_REQUIRE_CLASSES", "upper, symbol")
+	t.Setenv("AGENTBOX_LOGIN_LOCKOUT_MAX_FAILURES", "7")
+	cfg, err = config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.Auth.PasswordPolicy.RequireUppercase)
+	assert.True(t, cfg.Auth.PasswordPolicy.RequireSymbol)
+	assert.False(t, cfg.Auth.PasswordPolicy.RequireDigit)
+	assert.Equal(t, 7, cfg.Auth.LoginLockout.MaxFailures)
+
+	_, err = config.Load(write("auth:\n  enabled: false\n  password_policy:\n    min_length: 0\n"))
+	assert.ErrorContains(t, err, "password_policy.min_length")
+	t.Setenv("AGENTBOX_LOGIN_LOCKOUT_MAX_FAILURES", "0")
+	_, err = config.Load(write("auth:\n  enabled: false\n"))
+	assert.ErrorContains(t, err, "login_lockout.max_failures")
+}
+
+func TestConfigOIDCFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-oidc-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write(`
+auth:
+  enabled: true
+  secret: test-secret-at-least-32-characters
+  disable_password_login: true
+  oidc:
+    enabled: true
+    issuer_url: https://idp.example.com
+    client_id: agentbox
+    client_secret: s3cret
+    redirect_url: https://agentbox.example.com/api/v1/auth/oidc/callback
+    role_mapping:
+      platform-admins: admin
+`))
+	require.NoError(t, err)
+	assert.True(t, cfg.Auth.DisablePasswordLogin)
+	assert.Equal(t, "https://idp.example.com", cfg.Auth.OIDC.IssuerURL)
+	assert.Equal(t, []string{"email", "profile"}, cfg.Auth.OIDC.Scopes)
+	assert.Equal(t, "groups", cfg.Auth.OIDC.GroupsClaim)
+	assert.Equal(t, "user", cfg.Auth.OIDC.DefaultRole)
+	assert.Equal(t, "admin", cfg.Auth.OIDC.RoleMapping["platform-admins"])
+	redacted, err := cfg.Redacted()
+	require.NoError(t, err)
+	assert.NotEqual(t, "s3cret", redacted["auth"].(map[string]interface{})["oidc"].(map[string]interface{})["client_secret"])
+
+	_, err = config.Load(write("auth:\n  enabled: true\n  secret: test-secret-at-least-32-characters\n  disable_password_login: true\n"))
+	assert.ErrorContains(t, err, "disable_password_login")
+
+	_, err = config.Load(write("auth:\n  enabled: true\n  secret: test-secret-at-least-32-characters\n  oidc:\n    enabled: true\n    issuer_url: https://idp.example.com\n"))
+	assert.ErrorContains(t, err, "client_id")
+
+	_, err = config.Load(write(`
+auth:
+  enabled: true
+  secret: test-secret-at-least-32-characters
+  oidc:
+    enabled: true
+    issuer_url: https://idp.example.com
+    client_id: agentbox
+    redirect_url: https://agentbox.example.com/callback
+    role_mapping:
+      ops: super_admin
+`))
+	assert.ErrorContains(t, err, "role_mapping")
+}
+
+func TestConfigClustersFromYAML(t *testing.T) {
+	load := func(t *testing.T, yamlContent string) (*config.Config, error) {
+		tmpfile, err := os.CreateTemp("", "config-clusters-*.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		_, err = tmpfile.Write([]byte(yamlContent))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return config.Load(tmpfile.Name())
+	}
+
+	t.Run("legacy kubeconfig becomes the default cluster", func(t *testing.T) {
+		cfg, err := load(t, `
+auth:
+  enabled: false
+kubernetes:
+  kubeconfig: /tmp/kubeconfig
+`)
+		require.NoError(t, err)
+		clusters := cfg.Kubernetes.EffectiveClusters()
+		require.Len(t, clusters, 1)
+		assert.Equal(t, "default", clusters[0].Name)
+		assert.Equal(t, "/tmp/kubeconfig", clusters[0].Kubeconfig)
+		assert.Equal(t, "default", cfg.Kubernetes.EffectiveDefaultCluster())
+	})
+
+	t.Run("named clusters", func(t *testing.T) {
+		cfg, err := load(t, `
+auth:
+  enabled: false
+kubernetes:
+  clusters:
+    - name: us-east
+      kubeconfig: /tmp/kubeconfig
+      context: us-east-prod
+    - name: eu-west
+      kubeconfig: /tmp/kubeconfig
+      context: eu-west-prod
+  default_cluster: eu-west
+`)
+		require.NoError(t, err)
+		require.Len(t, cfg.Kubernetes.EffectiveClusters(), 2)
+		assert.Equal(t, "us-east-prod", cfg.Kubernetes.Clusters[0].Context)
+		assert.Equal(t, "eu-west", cfg.Kubernetes.EffectiveDefaultCluster())
+	})
+
+	t.Run("unknown default cluster", func(t *testing.T) {
+		_, err := load(t, `
+auth:
+  enabled: false
+kubernetes:
+  clusters:
+    - name: us-east
+  default_cluster: eu-west
+`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "default_cluster")
+	})
+
+	t.Run("duplicate cluster names", func(t *testing.T) {
+		_, err := load(t, `
+auth:
+  enabled: false
+kubernetes:
+  clusters:
+    - name: us-east
+    - name: us-east
+`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "duplicate cluster name")
+	})
+}
+
+func TestConfigStrictValidation(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-strict-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	// Every problem is reported at once, naming the file and the key
+	path := write("auth:\n  enabled: false\nserver:\n  prot: 80\n  log_level: loud\ntimeouts:\n  max_timeout: 0\n" +
+		"kubernetes:\n  clusters:\n    - name: a\n      kubecfg: /etc/kube\nreconcilation:\n  interval_seconds: 30\n")
+	_, err := config.Load(path)
+	var validationErr *config.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, path, validationErr.Path)
+	assert.ElementsMatch(t, []string{
+		"server.prot: unknown key (line 4)",
+		"kubernetes.clusters[0].kubecfg: unknown key (line 11)",
+		"reconcilation: unknown key (line 12)",
+		`server log_level must be debug, info, warn or error, got "loud"`,
+		"timeouts max_timeout must be at least 1 second, got 0",
+		"max timeout cannot be less than default timeout",
+	}, validationErr.Problems)
+	assert.Contains(t, err.Error(), "invalid configuration in "+path+" (6 problems):")
+
+	_, err = config.Load(write("auth:\n  enabled: false\npool:\n  enabled: true\n  size: 0\n"))
+	assert.ErrorContains(t, err, "pool size")
+	_, err = config.Load(write("auth:\n  enabled: false\nserver: [8080]\n"))
+	assert.ErrorContains(t, err, "failed to parse config file")
+
+	// Settings neither the file nor the environment set are reported as defaulted
+	t.Setenv("AGENTBOX_NAMESPACE_PREFIX", "sandbox-")
+	cfg, err := config.Load(write("auth:\n  enabled: false\nserver:\n  port: 9000\n"))
+	require.NoError(t, err)
+	assert.Contains(t, cfg.DefaultedKeys, "server.host")
+	assert.Contains(t, cfg.DefaultedKeys, "timeouts.max_timeout")
+	assert.NotContains(t, cfg.DefaultedKeys, "server.port")
+	assert.NotContains(t, cfg.DefaultedKeys, "auth.enabled")
+	assert.NotContains(t, cfg.DefaultedKeys, "kubernetes.namespace_prefix")
+
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	cfg, err = config.Load(write(""))
+	require.NoError(t, err)
+	assert.Contains(t, cfg.DefaultedKeys, "server.port")
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	write := func(t *testing.T, path, content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	path := t.TempDir() + "/config.yaml"
+	write(t, path, `
+server:
+  port: 8080
+auth:
+  enabled: true
+  secret: first-secret-at-least-32-characters
+reconciliation:
+  interval_seconds: 60
+resources:
+  max_cpu: "4000m"
+`)
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	store := config.NewStore(path, cfg)
+
+	changed, err := store.Changed()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Hot-reloadable and restart-only settings change together
+	write(t, path, `
+server:
+  port: 9090
+auth:
+  enabled: true
+  secret: second-secret-at-least-32-characters
+reconciliation:
+  interval_seconds: 30
+resources:
+  max_cpu: "8000m"
+`)
+	changed, err = store.Changed()
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	reloaded, err := store.Reload()
+	require.NoError(t, err)
+	assert.Same(t, reloaded, store.Current())
+	assert.Equal(t, 30, store.Current().Reconciliation.IntervalSeconds)
+	assert.Equal(t, "8000m", store.Current().Resources.MaxCPU)
+	// Restart-only settings keep their startup values and are reported as pending restart
+	assert.Equal(t, 8080, store.Current().Server.Port)
+	assert.Equal(t, "first-secret-at-least-32-characters", store.Current().Auth.Secret)
+
+	status := store.Status()
+	assert.Equal(t, int64(1), status.ReloadCount)
+	assert.NotNil(t, status.LastReloadAt)
+	assert.ElementsMatch(t, []string{"server.port", "auth.secret"}, status.PendingRestart)
+
+	changed, err = store.Changed()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// An invalid file is rejected and the previous configuration stays in effect
+	write(t, path, `
+auth:
+  enabled: true
+  secret: first-secret-at-least-32-characters
+reconciliation:
+  interval_seconds: 5
+`)
+	_, err = store.Reload()
+	require.Error(t, err)
+	assert.Equal(t, 30, store.Current().Reconciliation.IntervalSeconds)
+	assert.Equal(t, int64(1), store.Status().ReloadCount)
+	assert.Equal(t, int64(1), store.Status().ReloadFailures)
+	assert.Contains(t, store.Status().LastError, "interval_seconds")
+
+	redacted, err := store.Current().Redacted()
+	require.NoError(t, err)
+	assert.Equal(t, "[REDACTED]", redacted["auth"].(map[string]interface{})["secret"])
+}
+
+func TestConfigStoreReloadKeepsEmailSettings(t *testing.T) {
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	write := func(t *testing.T, path, webhook, host string) {
+		content := "notifications:\n  webhook_url: " + webhook + "\n  email:\n    enabled: true\n    host: " + host +
+			"\n    port: 587\n    from: agentbox@example.com\n"
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	path := t.TempDir() + "/config.yaml"
+	write(t, path, "https://hooks.example.com/first", "smtp-first.example.com")
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	store := config.NewStore(path, cfg)
+
+	// The webhook is reloaded; the notifier keeps its SMTP settings until a restart
+	write(t, path, "https://hooks.example.com/second", "smtp-second.example.com")
+	_, err = store.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, "https://hooks.example.com/second", store.Current().Notifications.WebhookURL)
+	assert.Equal(t, "smtp-first.example.com", store.Current().Notifications.Email.Host)
+	assert.Equal(t, []string{"notifications.email"}, store.Status().PendingRestart)
+}
+
+func TestConfigRedactsWebhookURLs(t *testing.T) {
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	path := t.TempDir() + "/config.yaml"
+	require.NoError(t, os.WriteFile(path, []byte(`
+idle:
+  webhook_url: https://hooks.slack.com/services/T000/B000/idle-token
+notifications:
+  webhook_url: https://hooks.slack.com/services/T000/B000/notify-token
+`), 0o600))
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+
+	redacted, err := cfg.Redacted()
+	require.NoError(t, err)
+	assert.NotContains(t, fmt.Sprint(redacted), "idle-token")
+	assert.NotContains(t, fmt.Sprint(redacted), "notify-token")
+	assert.Equal(t, "[REDACTED]", redacted["idle"].(map[string]interface{})["webhook_url"])
+	assert.Equal(t, "[REDACTED]", redacted["notifications"].(map[string]interface{})["webhook_url"])
+	// Redaction works on a copy
+	assert.Equal(t, "https://hooks.slack.com/services/T000/B000/idle-token", cfg.Idle.WebhookURL)
+}
+
+func TestConfigStoreWatchSeesRenamedFile(t *testing.T) {
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	dir := t.TempDir()
+	path := dir + "/config.yaml"
+	require.NoError(t, os.WriteFile(path, []byte("reconciliation:\n  interval_seconds: 60\n"), 0o600))
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	store := config.NewStore(path, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	// A poll interval this long means only file notifications can trigger the reload in time
+	go store.Watch(ctx, time.Hour, func() {
+		if _, err := store.Reload(); err == nil {
+			changes <- struct{}{}
+		}
+	})
+	time.Sleep(100 * time.Millisecond) // let the watcher start
+
+	// Replace the file atomically, the way editors and ConfigMap updates do
+	tmp := dir + "/config.yaml.tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("reconciliation:\n  interval_seconds: 30\n"), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change was not noticed")
+	}
+	assert.Equal(t, 30, store.Current().Reconciliation.IntervalSeconds)
+}
+
+func TestConfigLogShippingFromYAML(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-log-shipping-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.False(t, cfg.LogShipping.Enabled)
+	assert.Equal(t, 1000, cfg.LogShipping.BatchLines)
+	assert.Equal(t, 5, cfg.LogShipping.MaxAttempts)
+
+	cfg, err = config.Load(write(`auth:
+  enabled: false
+log_shipping:
+  enabled: true
+  default_sink: loki
+  default_credentials: loki-main
+  credentials:
+    loki-main:
+      url: http://loki:3100/loki/api/v1/push
+      password: loki-password
+    archive:
+      s3: {region: us-east-1, bucket: logs, secret_access_key: s3-secret}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "http://loki:3100/loki/api/v1/push", cfg.LogShipping.Credentials["loki-main"].URL)
+	assert.NoError(t, cfg.LogShipping.Credentials["archive"].CheckSink(config.LogSinkS3))
+	assert.Error(t, cfg.LogShipping.Credentials["archive"].CheckSink(config.LogSinkLoki))
+	redacted, err := cfg.Redacted()
+	require.NoError(t, err)
+	assert.NotContains(t, fmt.Sprint(redacted), "loki-password")
+	assert.NotContains(t, fmt.Sprint(redacted), "s3-secret")
+
+	// The default sink must fit its credentials; credentials need an endpoint
+	_, err = config.Load(write("auth:\n  enabled: false\nlog_shipping:\n  enabled: true\n  default_sink: loki\n  default_credentials: missing\n"))
+	assert.ErrorContains(t, err, "default_credentials")
+	_, err = config.Load(write("auth:\n  enabled: false\nlog_shipping:\n  enabled: true\n  default_sink: s3\n  default_credentials: hook\n  credentials:\n    hook: {url: 'https://logs.example.com'}\n"))
+	assert.ErrorContains(t, err, "s3 bucket")
+	_, err = config.Load(write("auth:\n  enabled: false\nlog_shipping:\n  credentials:\n    empty: {headers: {X-Key: abc}}\n"))
+	assert.ErrorContains(t, err, "a url or an s3 bucket is required")
 }
@@ -0,0 +1,185 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+func TestCordonEnvironment(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "cordon-env",
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	// An execution that is running when the environment is cordoned runs to completion (it
+	// blocks in the standby pod until released)
+	release := make(chan struct{})
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		if strings.Contains(strings.Join(command, " "), "sleep") {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	running, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"sleep", "10"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := orch.GetExecution(ctx, running.ID)
+		return err == nil && got.Status == models.ExecutionStatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	cordoned, err := orch.CordonEnvironment(ctx, env.ID, "maintenance")
+	require.NoError(t, err)
+	assert.True(t, cordoned.Cordoned)
+	assert.Equal(t, "maintenance", cordoned.CordonReason)
+	require.NotNil(t, cordoned.CordonedAt)
+	assert.Nil(t, cordoned.PoolReady)
+
+	// New execs and executions are refused with the reason
+	_, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, apierrors.Locked))
+	assert.Equal(t, apierrors.CodeEnvironmentCordoned, apierrors.CodeOf(err))
+	assert.Contains(t, err.Error(), "maintenance")
+	_, err = orch.ExecuteCommand(ctx, env.ID, []string{"ls"}, 0)
+	assert.Equal(t, apierrors.CodeEnvironmentCordoned, apierrors.CodeOf(err))
+	assert.Equal(t, http.StatusLocked, apierrors.HTTPStatus(err))
+
+	close(release)
+	done := waitForExecutionDone(t, orch, running.ID)
+	assert.Equal(t, models.ExecutionStatusCompleted, done.Status)
+
+	// The pool is not replenished while cordoned, even when refreshed
+	_, err = orch.RefreshStandbyPool(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Never(t, func() bool { return orch.GetPoolStatus()[env.ID] != 0 }, 300*time.Millisecond, 20*time.Millisecond)
+
+	// The cordon is stored: a new server loading the same database keeps rejecting executions
+	restarted, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	reloaded, err := restarted.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.True(t, reloaded.Cordoned)
+	assert.Equal(t, "maintenance", reloaded.CordonReason)
+	require.NotNil(t, reloaded.CordonedAt)
+	assert.WithinDuration(t, *cordoned.CordonedAt, *reloaded.CordonedAt, time.Second)
+
+	// Uncordoning accepts executions again and refills the pool
+	uncordoned, err := orch.UncordonEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.False(t, uncordoned.Cordoned)
+	assert.Empty(t, uncordoned.CordonReason)
+	assert.Nil(t, uncordoned.CordonedAt)
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+	_, err = orch.ExecuteCommand(ctx, env.ID, []string{"ls"}, 0)
+	require.NoError(t, err)
+
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.False(t, stored.Cordoned)
+	assert.Nil(t, stored.CordonedAt)
+
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 50)
+	require.NoError(t, err)
+	var types []string
+	for _, e := range events {
+		types = append(types, e.EventType)
+	}
+	assert.Contains(t, types, "cordon")
+	assert.Contains(t, types, "uncordon")
+
+	_, err = orch.CordonEnvironment(ctx, "missing", "")
+	assert.True(t, errors.Is(err, apierrors.NotFound))
+}
+
+func TestCordonAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	body, _ := json.Marshal(models.CreateEnvironmentRequest{
+		Name: "cordon-api-env", Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&env))
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID, nil))
+		var got models.Environment
+		return json.NewDecoder(w.Body).Decode(&got) == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/cordon",
+		bytes.NewReader([]byte(`{"reason": "draining node"}`)))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var cordoned models.Environment
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&cordoned))
+	assert.True(t, cordoned.Cordoned)
+	assert.Equal(t, "draining node", cordoned.CordonReason)
+
+	execBody, _ := json.Marshal(models.ExecRequest{Command: []string{"ls"}})
+	for _, path := range []string{"/exec", "/run"} {
+		req = httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+path, bytes.NewReader(execBody))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusLocked, w.Code, path)
+		assert.Contains(t, w.Body.String(), apierrors.CodeEnvironmentCordoned, path)
+		assert.Contains(t, w.Body.String(), "draining node", path)
+	}
+
+	// Reads keep working
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The cordon body is optional
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/uncordon", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/cordon", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/uncordon", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/exec", bytes.NewReader(execBody))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments/missing/cordon", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -137,6 +137,88 @@ func TestDatabaseListEnvironments(t *testing.T) {
 	assert.Equal(t, "list-env-c", list[0].ID)
 }
 
+func TestDatabaseListEnvironmentsAfter(t *testing.T) {
+	db := setupDBForEnvironments(t)
+	ctx := context.Background()
+
+	// Two environments share a creation time: the ID breaks the tie
+	now := time.Now().Truncate(time.Millisecond)
+	created := map[string]time.Time{
+		"keyset-a": now,
+		"keyset-b": now.Add(time.Second),
+		"keyset-c": now.Add(time.Second),
+		"keyset-d": now.Add(2 * time.Second),
+	}
+	for id, at := range created {
+		require.NoError(t, db.SaveEnvironment(ctx, &models.Environment{
+			ID:        id,
+			Name:      "env-" + id,
+			Status:    models.StatusRunning,
+			Image:     "busybox",
+			CreatedAt: at,
+			Namespace: "ns-" + id,
+			Resources: models.ResourceSpec{CPU: "100m", Memory: "128Mi", Storage: "1Gi"},
+		}))
+	}
+
+	var ids []string
+	var after *models.PageCursor
+	for {
+		page, err := db.ListEnvironmentsAfter(ctx, after, 2)
+		require.NoError(t, err)
+		for _, env := range page {
+			ids = append(ids, env.ID)
+		}
+		if len(page) < 2 {
+			break
+		}
+		last := page[len(page)-1]
+		after = &models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+	assert.Equal(t, []string{"keyset-d", "keyset-c", "keyset-b", "keyset-a"}, ids)
+}
+
+func TestDatabaseListEnvironmentsPage(t *testing.T) {
+	db := setupDBForEnvironments(t)
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Millisecond)
+	for i, id := range []string{"page-a", "page-b", "page-c", "page-d", "page-e"} {
+		teamID := "team-page"
+		if id == "page-c" {
+			teamID = "team-other"
+		}
+		require.NoError(t, db.SaveEnvironment(ctx, &models.Environment{
+			ID:        id,
+			Name:      "env-" + id,
+			Status:    models.StatusRunning,
+			Image:     "busybox",
+			CreatedAt: now.Add(time.Duration(i) * time.Second),
+			Namespace: "ns-" + id,
+			TeamID:    teamID,
+			Resources: models.ResourceSpec{CPU: "100m", Memory: "128Mi", Storage: "1Gi"},
+		}))
+	}
+	filter := database.EnvironmentListFilter{TeamID: "team-page"}
+
+	count, err := db.CountEnvironments(ctx, filter)
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	// The filter, the cursor and the offset are all applied in the query
+	page, err := db.ListEnvironmentsPage(ctx, filter, nil, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, "page-d", page[0].ID)
+	assert.Equal(t, "page-b", page[1].ID)
+
+	after := &models.PageCursor{CreatedAt: page[1].CreatedAt, ID: page[1].ID}
+	page, err = db.ListEnvironmentsPage(ctx, filter, after, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, "page-a", page[0].ID)
+}
+
 func TestDatabaseDeleteEnvironment(t *testing.T) {
 	db := setupDBForEnvironments(t)
 	ctx := context.Background()
@@ -2,6 +2,7 @@ package unit
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -154,6 +155,116 @@ func TestDatabaseListExecutions(t *testing.T) {
 	assert.Equal(t, "list-exec-c", list[0].ID)
 }
 
+func TestDatabaseListExecutionsAfter(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-keyset")
+
+	now := time.Now().Truncate(time.Millisecond)
+	for i, id := range []string{"keyset-exec-a", "keyset-exec-b", "keyset-exec-c"} {
+		require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+			ID:            id,
+			EnvironmentID: "env-keyset",
+			UserID:        "user-1",
+			Command:       []string{"true"},
+			Status:        models.ExecutionStatusCompleted,
+			CreatedAt:     now.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	first, err := db.ListExecutionsAfter(ctx, "env-keyset", nil, 2)
+	require.NoError(t, err)
+	require.Len(t, first, 2)
+	assert.Equal(t, "keyset-exec-c", first[0].ID)
+
+	// A newer execution does not shift the next page
+	require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+		ID:            "keyset-exec-d",
+		EnvironmentID: "env-keyset",
+		UserID:        "user-1",
+		Command:       []string{"true"},
+		Status:        models.ExecutionStatusCompleted,
+		CreatedAt:     now.Add(3 * time.Second),
+	}))
+	token := (&models.PageCursor{CreatedAt: first[1].CreatedAt, ID: first[1].ID}).Token()
+	cursor, err := models.ParsePageToken(token)
+	require.NoError(t, err)
+	second, err := db.ListExecutionsAfter(ctx, "env-keyset", cursor, 2)
+	require.NoError(t, err)
+	require.Len(t, second, 1)
+	assert.Equal(t, "keyset-exec-a", second[0].ID)
+}
+
+func TestDatabaseListExecutionsFiltered(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-filter")
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i, tc := range []struct {
+		id      string
+		command []string
+		exit    *int
+		status  models.ExecutionStatus
+		user    string
+	}{
+		{"filter-a", []string{"pytest", "-k", "Smoke"}, intPtr(0), models.ExecutionStatusCompleted, "user-1"},
+		{"filter-b", []string{"pytest", "tests/"}, intPtr(1), models.ExecutionStatusFailed, "user-1"},
+		{"filter-c", []string{"pytest", "-k", "smoke"}, intPtr(1), models.ExecutionStatusFailed, "user-2"},
+		{"filter-d", []string{"grep", "100%", "log"}, intPtr(1), models.ExecutionStatusFailed, "user-1"},
+		{"filter-e", []string{"sleep", "60"}, nil, models.ExecutionStatusRunning, "user-1"},
+	} {
+		require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+			ID:            tc.id,
+			EnvironmentID: "env-filter",
+			UserID:        tc.user,
+			Command:       tc.command,
+			Status:        tc.status,
+			ExitCode:      tc.exit,
+			CreatedAt:     now.Add(time.Duration(i) * time.Minute),
+		}))
+	}
+
+	ids := func(filter database.ExecutionListFilter) []string {
+		filter.EnvironmentID = "env-filter"
+		execs, err := db.ListExecutionsFiltered(ctx, filter, nil, 10)
+		require.NoError(t, err)
+		out := make([]string, len(execs))
+		for i, e := range execs {
+			out[i] = e.ID
+		}
+		count, err := db.CountExecutions(ctx, filter)
+		require.NoError(t, err)
+		assert.Equal(t, len(out), count)
+		return out
+	}
+
+	// Substring match is case-insensitive and spans arguments
+	assert.Equal(t, []string{"filter-c", "filter-a"}, ids(database.ExecutionListFilter{CommandContains: "-k SMOKE"}))
+	// Combined filters are ANDed
+	assert.Equal(t, []string{"filter-c", "filter-b"}, ids(database.ExecutionListFilter{CommandContains: "pytest", ExitCode: intPtr(1)}))
+	assert.Equal(t, []string{"filter-b"}, ids(database.ExecutionListFilter{
+		CommandContains: "pytest", Status: models.ExecutionStatusFailed, UserID: "user-1",
+	}))
+	// LIKE wildcards in the search text are literal
+	assert.Equal(t, []string{"filter-d"}, ids(database.ExecutionListFilter{CommandContains: "100%"}))
+	assert.Empty(t, ids(database.ExecutionListFilter{CommandContains: "py_est"}))
+	// The time range is [created_after, created_before)
+	after, before := now.Add(time.Minute), now.Add(3*time.Minute)
+	assert.Equal(t, []string{"filter-c", "filter-b"}, ids(database.ExecutionListFilter{CreatedAfter: &after, CreatedBefore: &before}))
+	assert.Equal(t, []string{"filter-a"}, ids(database.ExecutionListFilter{ExitCode: intPtr(0)}))
+
+	// Pages keep the filter
+	filter := database.ExecutionListFilter{EnvironmentID: "env-filter", ExitCode: intPtr(1)}
+	first, err := db.ListExecutionsFiltered(ctx, filter, nil, 2)
+	require.NoError(t, err)
+	require.Len(t, first, 2)
+	second, err := db.ListExecutionsFiltered(ctx, filter, &models.PageCursor{CreatedAt: first[1].CreatedAt, ID: first[1].ID}, 2)
+	require.NoError(t, err)
+	require.Len(t, second, 1)
+	assert.Equal(t, "filter-b", second[0].ID)
+}
+
 func TestDatabaseListExecutionsOtherEnv(t *testing.T) {
 	db := setupDBForExecutions(t)
 	ctx := context.Background()
@@ -229,6 +340,182 @@ func TestDatabaseLoadAllExecutions(t *testing.T) {
 	assert.GreaterOrEqual(t, len(all), 1)
 }
 
+func TestDatabaseDeleteExecutionsBefore(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-1")
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	execs := []*models.Execution{
+		{ID: "exec-old-done", Status: models.ExecutionStatusCompleted, CreatedAt: now.Add(-48 * time.Hour)},
+		{ID: "exec-old-running", Status: models.ExecutionStatusRunning, CreatedAt: now.Add(-48 * time.Hour)},
+		{ID: "exec-new-done", Status: models.ExecutionStatusFailed, CreatedAt: now},
+	}
+	for _, e := range execs {
+		e.EnvironmentID = "env-1"
+		e.Command = []string{"true"}
+		require.NoError(t, db.SaveExecution(ctx, e))
+	}
+
+	ids, err := db.DeleteExecutionsBefore(ctx, "env-1", now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"exec-old-done"}, ids)
+
+	_, err = db.GetExecution(ctx, "exec-old-running")
+	assert.NoError(t, err, "running executions must not be purged")
+	_, err = db.GetExecution(ctx, "exec-new-done")
+	assert.NoError(t, err)
+}
+
+func TestDatabaseDeleteExecutionsBeyondLimit(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-1")
+	ensureEnvironmentForExecutions(t, db, ctx, "env-2")
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+			ID:            fmt.Sprintf("exec-env1-%d", i),
+			EnvironmentID: "env-1",
+			Command:       []string{"true"},
+			Status:        models.ExecutionStatusCompleted,
+			CreatedAt:     now.Add(time.Duration(i) * time.Minute),
+		}))
+	}
+	require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+		ID:            "exec-env2-0",
+		EnvironmentID: "env-2",
+		Command:       []string{"true"},
+		Status:        models.ExecutionStatusCompleted,
+		CreatedAt:     now.Add(-time.Hour),
+	}))
+
+	ids, err := db.DeleteExecutionsBeyondLimit(ctx, 2)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"exec-env1-0", "exec-env1-1"}, ids)
+
+	remaining, err := db.ListExecutions(ctx, "env-1", 10)
+	require.NoError(t, err)
+	require.Len(t, remaining, 2)
+	assert.Equal(t, "exec-env1-3", remaining[0].ID)
+
+	other, err := db.ListExecutions(ctx, "env-2", 10)
+	require.NoError(t, err)
+	assert.Len(t, other, 1, "other environments keep their own history")
+}
+
+func TestDatabaseRetentionKeepsPipelineSteps(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-1")
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i, id := range []string{"exec-step", "exec-plain", "exec-newest"} {
+		require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+			ID:            id,
+			EnvironmentID: "env-1",
+			Command:       []string{"true"},
+			Status:        models.ExecutionStatusCompleted,
+			CreatedAt:     now.Add(time.Duration(i-3) * 24 * time.Hour),
+		}))
+	}
+	completed := now
+	require.NoError(t, db.SavePipeline(ctx, &models.Pipeline{
+		ID:            "pipeline-1",
+		EnvironmentID: "env-1",
+		Status:        models.PipelineCompleted,
+		MaxParallel:   1,
+		Steps: []models.PipelineStep{
+			{Name: "build", Command: []string{"true"}, Status: models.StepCompleted, ExecutionID: "exec-step"},
+		},
+		CreatedAt:   now.Add(-3 * 24 * time.Hour),
+		CompletedAt: &completed,
+	}))
+
+	ids, err := db.DeleteExecutionsBeyondLimit(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"exec-plain"}, ids)
+
+	ids, err = db.DeleteExecutionsBefore(ctx, "", now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"exec-newest"}, ids)
+
+	_, err = db.GetExecution(ctx, "exec-step")
+	assert.NoError(t, err, "executions of pipeline steps must not be purged")
+}
+
+func TestDatabaseGetExecutionStats(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-1")
+	ensureEnvironmentForExecutions(t, db, ctx, "env-2")
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	started := now
+	for i, e := range []struct {
+		status   models.ExecutionStatus
+		duration int64
+		pool     bool
+		age      time.Duration
+	}{
+		{models.ExecutionStatusCompleted, 100, true, time.Minute},
+		{models.ExecutionStatusCompleted, 200, false, 2 * time.Minute},
+		{models.ExecutionStatusCompleted, 300, true, 3 * time.Minute},
+		{models.ExecutionStatusFailed, 400, false, 4 * time.Minute},
+		{models.ExecutionStatusCompleted, 5000, false, 48 * time.Hour},
+	} {
+		d := e.duration
+		require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+			ID:             fmt.Sprintf("exec-%d", i),
+			EnvironmentID:  "env-1",
+			Command:        []string{"true"},
+			Status:         e.status,
+			CreatedAt:      now.Add(-e.age),
+			StartedAt:      &started,
+			DurationMs:     &d,
+			ServedFromPool: e.pool,
+		}))
+	}
+	require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+		ID: "exec-pending", EnvironmentID: "env-1", Command: []string{"true"},
+		Status: models.ExecutionStatusPending, CreatedAt: now,
+	}))
+	require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+		ID: "exec-other", EnvironmentID: "env-2", Command: []string{"true"},
+		Status: models.ExecutionStatusFailed, CreatedAt: now,
+	}))
+
+	got, err := db.GetExecution(ctx, "exec-0")
+	require.NoError(t, err)
+	assert.True(t, got.ServedFromPool)
+
+	stats, durations, err := db.GetExecutionStats(ctx, database.ExecutionStatsFilter{EnvironmentID: "env-1"})
+	require.NoError(t, err)
+	assert.Equal(t, 6, stats.Total)
+	assert.Equal(t, 4, stats.ByStatus["completed"])
+	assert.Equal(t, 1, stats.ByStatus["failed"])
+	assert.Equal(t, 1, stats.ByStatus["pending"])
+	assert.Equal(t, 5, stats.Started)
+	assert.Equal(t, 2, stats.PoolHits)
+	assert.InDelta(t, 6.0, stats.TotalExecSeconds, 0.001)
+	require.NotNil(t, stats.LastExecutionAt)
+	assert.WithinDuration(t, now, *stats.LastExecutionAt, time.Second)
+	assert.Len(t, durations, 5)
+
+	from := now.Add(-time.Hour)
+	stats, durations, err = db.GetExecutionStats(ctx, database.ExecutionStatsFilter{EnvironmentID: "env-1", From: &from, SampleLimit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.Total)
+	assert.InDelta(t, 1.0, stats.TotalExecSeconds, 0.001)
+	assert.Equal(t, []int64{100, 200}, durations, "sample holds the most recent durations")
+
+	to := now.Add(-time.Hour)
+	stats, _, err = db.GetExecutionStats(ctx, database.ExecutionStatsFilter{EnvironmentID: "env-1", To: &to})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Total)
+}
+
 func intPtr(i int) *int {
 	return &i
 }
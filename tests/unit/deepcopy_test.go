@@ -0,0 +1,171 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+func TestEnvironmentDeepCopy(t *testing.T) {
+	now := time.Now()
+	seconds := int64(30)
+	runAsUser := int64(1000)
+	env := &models.Environment{
+		ID:           "env-1",
+		StartedAt:    &now,
+		Env:          map[string]string{"A": "1"},
+		Command:      []string{"sleep", "infinity"},
+		Labels:       map[string]string{"team": "ml"},
+		NodeSelector: map[string]string{"pool": "agents"},
+		Tolerations:  []models.Toleration{{Key: "gpu", Operator: "Exists", TolerationSeconds: &seconds}},
+		Affinity:     spotAffinity(),
+		Isolation: &models.IsolationConfig{
+			NetworkPolicy:   &models.NetworkPolicyConfig{AllowedEgressCIDRs: []string{"10.0.0.0/8"}},
+			SecurityContext: &models.SecurityContextConfig{RunAsUser: &runAsUser},
+		},
+		Pool:           &models.PoolConfig{Enabled: true, Size: 2},
+		CommandPolicy:  &models.CommandPolicy{DenyPatterns: []string{"rm -rf"}},
+		ReadinessCheck: &models.ReadinessCheck{Exec: []string{"true"}, HTTPGet: &models.HTTPGetCheck{Port: 8080}},
+	}
+	c := env.DeepCopy()
+	assert.Equal(t, env, c)
+
+	// Changing the copy leaves the original alone
+	*c.StartedAt = now.Add(time.Hour)
+	c.Env["A"] = "2"
+	c.Command[0] = "bash"
+	c.Labels["team"] = "web"
+	c.NodeSelector["pool"] = "other"
+	c.Tolerations[0].Key = "spot"
+	*c.Tolerations[0].TolerationSeconds = 60
+	c.Affinity.RequiredNodeTerms[0].MatchExpressions[0].Values[0] = "amd64"
+	c.Affinity.PodAntiAffinity.TopologyKey = "kubernetes.io/hostname"
+	c.Isolation.NetworkPolicy.AllowedEgressCIDRs[0] = "0.0.0.0/0"
+	*c.Isolation.SecurityContext.RunAsUser = 0
+	c.Pool.Size = 5
+	c.CommandPolicy.DenyPatterns[0] = ""
+	c.ReadinessCheck.Exec[0] = "false"
+	c.ReadinessCheck.HTTPGet.Port = 9090
+
+	assert.Equal(t, now, *env.StartedAt)
+	assert.Equal(t, map[string]string{"A": "1"}, env.Env)
+	assert.Equal(t, []string{"sleep", "infinity"}, env.Command)
+	assert.Equal(t, map[string]string{"team": "ml"}, env.Labels)
+	assert.Equal(t, map[string]string{"pool": "agents"}, env.NodeSelector)
+	assert.Equal(t, "gpu", env.Tolerations[0].Key)
+	assert.Equal(t, int64(30), *env.Tolerations[0].TolerationSeconds)
+	assert.Equal(t, spotAffinity(), env.Affinity)
+	assert.Equal(t, []string{"10.0.0.0/8"}, env.Isolation.NetworkPolicy.AllowedEgressCIDRs)
+	assert.Equal(t, int64(1000), *env.Isolation.SecurityContext.RunAsUser)
+	assert.Equal(t, 2, env.Pool.Size)
+	assert.Equal(t, []string{"rm -rf"}, env.CommandPolicy.DenyPatterns)
+	assert.Equal(t, []string{"true"}, env.ReadinessCheck.Exec)
+	assert.Equal(t, 8080, env.ReadinessCheck.HTTPGet.Port)
+
+	var nilEnv *models.Environment
+	assert.Nil(t, nilEnv.DeepCopy())
+}
+
+func TestExecutionDeepCopy(t *testing.T) {
+	now := time.Now()
+	exitCode := 0
+	exec := &models.Execution{
+		ID:                 "exec-1",
+		Command:            []string{"ls", "-la"},
+		Env:                map[string]string{"A": "1"},
+		StartedAt:          &now,
+		ExitCode:           &exitCode,
+		EffectiveResources: &models.ResourceSpec{CPU: "500m"},
+		Callback:           &models.ExecutionCallback{URL: "https://example.com/hook", LastAttemptAt: &now},
+	}
+	c := exec.DeepCopy()
+	assert.Equal(t, exec, c)
+
+	c.Command[0] = "rm"
+	c.Env["A"] = "2"
+	*c.StartedAt = now.Add(time.Hour)
+	*c.ExitCode = 1
+	c.EffectiveResources.CPU = "2"
+	c.Callback.Status = "delivered"
+	*c.Callback.LastAttemptAt = now.Add(time.Hour)
+
+	assert.Equal(t, []string{"ls", "-la"}, exec.Command)
+	assert.Equal(t, map[string]string{"A": "1"}, exec.Env)
+	assert.Equal(t, now, *exec.StartedAt)
+	assert.Equal(t, 0, *exec.ExitCode)
+	assert.Equal(t, "500m", exec.EffectiveResources.CPU)
+	assert.Empty(t, exec.Callback.Status)
+	assert.Equal(t, now, *exec.Callback.LastAttemptAt)
+}
+
+// TestReturnedEnvironmentsAreDetached mutates the environments returned by the orchestrator while
+// provisioning and reconciliation read the stored ones; run with -race to catch shared state
+func TestReturnedEnvironmentsAreDetached(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	ids := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+				Name:         fmt.Sprintf("detached-%d", i),
+				Image:        "python:3.11-slim",
+				Resources:    models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+				Env:          map[string]string{"MODE": "test"},
+				Labels:       map[string]string{"suite": "deepcopy"},
+				NodeSelector: map[string]string{"pool": "agents"},
+				Tolerations:  []models.Toleration{{Key: "dedicated", Operator: "Exists", Effect: "NoSchedule"}},
+			}, "user-123")
+			if !assert.NoError(t, err) {
+				return
+			}
+			ids <- env.ID
+			// Provisioning builds the pod from the stored environment meanwhile
+			for j := 0; j < 50; j++ {
+				env.Env["MODE"] = fmt.Sprintf("mutated-%d", j)
+				env.Labels["suite"] = "mutated"
+				env.NodeSelector["pool"] = "mutated"
+				env.Tolerations[0].Key = "mutated"
+
+				got, err := orch.GetEnvironment(ctx, env.ID)
+				if assert.NoError(t, err) {
+					got.Labels["suite"] = "mutated"
+					got.Env["MODE"] = "mutated"
+				}
+				list, err := orch.ListEnvironments(ctx, nil, "", 100, 0)
+				if assert.NoError(t, err) {
+					for _, e := range list.Environments {
+						e.Labels["seen"] = "true"
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	for id := range ids {
+		require.Eventually(t, func() bool {
+			got, err := orch.GetEnvironment(ctx, id)
+			return err == nil && got.Status == models.StatusRunning
+		}, 5*time.Second, 20*time.Millisecond)
+		got, err := orch.GetEnvironment(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"MODE": "test"}, got.Env)
+		assert.Equal(t, map[string]string{"suite": "deepcopy"}, got.Labels)
+		assert.Equal(t, map[string]string{"pool": "agents"}, got.NodeSelector)
+		assert.Equal(t, "dedicated", got.Tolerations[0].Key)
+		assert.Equal(t, map[string]string{"suite": "deepcopy"}, orchestrator.EnvironmentSpec(got).Labels)
+	}
+}
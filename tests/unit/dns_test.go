@@ -0,0 +1,144 @@
+package unit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func TestValidateDNSConfig(t *testing.T) {
+	v := validator.New(10000, 64*1024*1024*1024, 100*1024*1024*1024, 86400)
+	require.NoError(t, v.ValidateIsolation(&models.IsolationConfig{DNS: &models.DNSConfig{
+		Policy:      models.DNSPolicyNone,
+		Nameservers: []string{"10.0.0.53", "fd00::53"},
+		Searches:    []string{"agents.svc.cluster.local", "example.com."},
+		Options:     []models.DNSOption{{Name: "ndots", Value: "2"}, {Name: "edns0"}},
+	}}))
+	require.NoError(t, v.ValidateIsolation(&models.IsolationConfig{DNS: &models.DNSConfig{Searches: []string{"example.com"}}}))
+
+	for name, tc := range map[string]struct {
+		dns   *models.DNSConfig
+		field string
+	}{
+		"none without nameservers": {&models.DNSConfig{Policy: "None"}, "isolation.dns.nameservers"},
+		"unknown policy":           {&models.DNSConfig{Policy: "Default"}, "isolation.dns.policy"},
+		"too many nameservers":     {&models.DNSConfig{Nameservers: []string{"1.1.1.1", "1.0.0.1", "8.8.8.8", "8.8.4.4"}}, "isolation.dns.nameservers"},
+		"invalid nameserver":       {&models.DNSConfig{Nameservers: []string{"resolver.local"}}, "isolation.dns.nameservers[0]"},
+		"nameserver with cidr":     {&models.DNSConfig{Nameservers: []string{"10.0.0.0/8"}}, "isolation.dns.nameservers[0]"},
+		"invalid search":           {&models.DNSConfig{Searches: []string{"bad domain"}}, "isolation.dns.searches[0]"},
+		"option without name":      {&models.DNSConfig{Options: []models.DNSOption{{Value: "2"}}}, "isolation.dns.options[0].name"},
+	} {
+		err := v.ValidateIsolation(&models.IsolationConfig{DNS: tc.dns})
+		require.Error(t, err, name)
+		var verrs validator.ValidationErrors
+		require.ErrorAs(t, err, &verrs, name)
+		assert.Equal(t, tc.field, verrs[0].Field, name)
+	}
+
+	// DNS cannot be overridden per execution
+	err := v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command:   []string{"ls"},
+		Isolation: &models.IsolationConfig{DNS: &models.DNSConfig{Nameservers: []string{"1.1.1.1"}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestToCoreDNS(t *testing.T) {
+	policy, config := k8s.ToCoreDNS(&k8s.DNSConfig{
+		Policy:      "None",
+		Nameservers: []string{"10.0.0.53"},
+		Searches:    []string{"example.com"},
+		Options:     []k8s.DNSOption{{Name: "ndots", Value: "2"}, {Name: "edns0"}},
+	})
+	assert.Equal(t, corev1.DNSNone, policy)
+	require.NotNil(t, config)
+	assert.Equal(t, []string{"10.0.0.53"}, config.Nameservers)
+	assert.Equal(t, []string{"example.com"}, config.Searches)
+	require.Len(t, config.Options, 2)
+	require.NotNil(t, config.Options[0].Value)
+	assert.Equal(t, "2", *config.Options[0].Value)
+	assert.Nil(t, config.Options[1].Value)
+
+	policy, config = k8s.ToCoreDNS(&k8s.DNSConfig{})
+	assert.Equal(t, corev1.DNSClusterFirst, policy)
+	assert.Nil(t, config)
+
+	policy, config = k8s.ToCoreDNS(nil)
+	assert.Empty(t, policy)
+	assert.Nil(t, config)
+}
+
+func TestEnvironmentDNSInheritedByAllPods(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	dns := &models.DNSConfig{
+		Policy:      models.DNSPolicyNone,
+		Nameservers: []string{"10.0.0.53", "10.0.1.53"},
+		Options:     []models.DNSOption{{Name: "ndots", Value: "1"}},
+	}
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:      "dns-env",
+		Isolation: &models.IsolationConfig{DNS: dns},
+		Pool:      &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	assertDNS := func(spec *k8s.PodSpec, name string) {
+		require.NotNil(t, spec, name)
+		require.NotNil(t, spec.DNS, name)
+		assert.Equal(t, "None", spec.DNS.Policy, name)
+		assert.Equal(t, []string{"10.0.0.53", "10.0.1.53"}, spec.DNS.Nameservers, name)
+		assert.Equal(t, []k8s.DNSOption{{Name: "ndots", Value: "1"}}, spec.DNS.Options, name)
+	}
+	assertDNS(mockK8s.CreatedPodSpec(env.Namespace, "main"), "main pod")
+	for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+		if strings.HasPrefix(name, "standby-") {
+			assertDNS(mockK8s.CreatedPodSpec(env.Namespace, name), "standby pod")
+		}
+	}
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	var spec *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		spec = mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+		return spec != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assertDNS(spec, "execution pod")
+
+	// The network policy lets the pods reach the resolvers but not the cluster DNS
+	np := mockK8s.NetworkPolicyConfig(env.Namespace)
+	require.NotNil(t, np)
+	assert.Equal(t, []string{"10.0.0.53", "10.0.1.53"}, np.DNSServers)
+	assert.True(t, np.DenyClusterDNS)
+
+	// The response and the stored environment echo the DNS config; the policy defaults to ClusterFirst
+	assert.Equal(t, dns, env.Isolation.DNS)
+	plain := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:      "dns-search-env",
+		Isolation: &models.IsolationConfig{DNS: &models.DNSConfig{Nameservers: []string{"10.0.0.53"}}},
+	})
+	assert.Equal(t, models.DNSPolicyClusterFirst, plain.Isolation.DNS.Policy)
+	stored, err := db.GetEnvironment(ctx, plain.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.DNSPolicyClusterFirst, stored.Isolation.DNS.Policy)
+	np = mockK8s.NetworkPolicyConfig(plain.Namespace)
+	require.NotNil(t, np)
+	assert.False(t, np.DenyClusterDNS)
+}
@@ -0,0 +1,353 @@
+package unit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/notify"
+	"github.com/sciffer/agentbox/pkg/preferences"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// sentEmail is an email recorded by fakeSender
+type sentEmail struct {
+	to  string
+	msg *notify.Message
+}
+
+// fakeSender records the emails sent, failing with err when set
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []sentEmail
+	err  error
+}
+
+func (f *fakeSender) Send(_ context.Context, to string, msg *notify.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, sentEmail{to: to, msg: msg})
+	return nil
+}
+
+func (f *fakeSender) emails() []sentEmail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentEmail(nil), f.sent...)
+}
+
+// fakeClusters fails the health check of the clusters in failing
+type fakeClusters struct {
+	failing map[string]bool
+}
+
+func (f *fakeClusters) Names() []string { return []string{"east", "west"} }
+
+func (f *fakeClusters) CheckHealth(_ context.Context, name string) error {
+	if f.failing[name] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// fakeErrorCounter reports a settable database error count
+type fakeErrorCounter struct {
+	count int64
+}
+
+func (f *fakeErrorCounter) ErrorCount() int64 { return f.count }
+
+var testEmailConfig = config.EmailConfig{
+	Enabled: true, Host: "127.0.0.1", Port: 25, From: "agentbox@example.com", TLS: "none",
+	CooldownMinutes: 60, MaxPerHour: 4, ClusterUnhealthyMinutes: 5,
+	DBErrorThreshold: 20, DBErrorWindowMinutes: 5,
+}
+
+// createEmailUser creates an active user with an email address, opted in to critical event
+// emails when optIn, with the time zone tz
+func createEmailUser(t *testing.T, userService *users.Service, prefs *preferences.Service, name, role string, optIn bool, tz string) *users.User {
+	ctx := context.Background()
+	user, err := userService.CreateUser(ctx, &users.CreateUserRequest{
+		Username: name, Email: name + "@example.com", Password: "password123", Role: role, Status: users.StatusActive,
+	})
+	require.NoError(t, err)
+	_, err = prefs.Set(ctx, user.ID, &models.UserPreferences{EmailCriticalAlerts: &optIn, Timezone: &tz})
+	require.NoError(t, err)
+	return user
+}
+
+func TestCriticalEventEmails(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	prefs := preferences.NewService(db, &config.Config{Preferences: config.PreferencesConfig{Timezone: "UTC"}}, zap.NewNop())
+
+	owner := createEmailUser(t, userService, prefs, "owner", users.RoleUser, true, "Europe/Berlin")
+	quiet := createEmailUser(t, userService, prefs, "quiet", users.RoleUser, false, "UTC")
+	createEmailUser(t, userService, prefs, "oncall", users.RoleAdmin, true, "UTC")
+	createEmailUser(t, userService, prefs, "busy-admin", users.RoleAdmin, false, "UTC")
+
+	notifier := notify.NewService(testEmailConfig, userService, prefs, zap.NewNop())
+	sender := &fakeSender{}
+	notifier.SetSender(sender)
+	notifier.Start(ctx, nil, nil)
+	t.Cleanup(notifier.Stop)
+	waitForEmails := func(n int) []sentEmail {
+		require.Eventually(t, func() bool { return len(sender.emails()) >= n }, 5*time.Second, 10*time.Millisecond)
+		return sender.emails()
+	}
+
+	// Environment failures go to the opted-in owner, in their time zone
+	occurred := time.Date(2026, 1, 22, 10, 0, 0, 0, time.UTC)
+	failed := notify.Event{
+		Kind: notify.EventEnvironmentFailed, Key: "env-1", UserID: owner.ID, EnvironmentID: "env-1",
+		EnvironmentName: "training", Error: "quota exceeded", Attempts: 3, OccurredAt: occurred,
+	}
+	notifier.Notify(failed)
+	sent := waitForEmails(1)
+	assert.Equal(t, "owner@example.com", sent[0].to)
+	assert.Equal(t, "[agentbox] Environment training failed after 3 attempts", sent[0].msg.Subject)
+	assert.Contains(t, sent[0].msg.Body, "Last error: quota exceeded")
+	assert.Contains(t, sent[0].msg.Body, "2026-01-22 11:00:00 CET")
+
+	// The same event is not repeated within the cooldown, and users who did not opt in get none
+	notifier.Notify(failed)
+	notifier.Notify(notify.Event{Kind: notify.EventEnvironmentFailed, Key: "env-2", UserID: quiet.ID, EnvironmentName: "quiet"})
+	failed.Key, failed.EnvironmentName = "env-3", "serving"
+	notifier.Notify(failed)
+	sent = waitForEmails(2)
+	require.Len(t, sent, 2)
+	assert.Contains(t, sent[1].msg.Subject, "serving")
+
+	// A cluster failing its health check is reported once it has failed for 5 minutes, once per
+	// outage, to the opted-in users who can read platform metrics
+	clusters := &fakeClusters{failing: map[string]bool{"west": true}}
+	notifier.CheckPlatform(ctx, clusters, nil, occurred)
+	notifier.CheckPlatform(ctx, clusters, nil, occurred.Add(4*time.Minute))
+	notifier.CheckPlatform(ctx, clusters, nil, occurred.Add(5*time.Minute))
+	notifier.CheckPlatform(ctx, clusters, nil, occurred.Add(6*time.Minute))
+	sent = waitForEmails(3)
+	assert.Equal(t, "oncall@example.com", sent[2].to)
+	assert.Equal(t, "[agentbox] Kubernetes cluster west is failing its health check", sent[2].msg.Subject)
+	assert.Contains(t, sent[2].msg.Body, "for 5m0s")
+
+	// Database errors reaching the threshold within the window are a spike
+	counter := &fakeErrorCounter{count: 100}
+	notifier.CheckPlatform(ctx, nil, counter, occurred)
+	counter.count = 110
+	notifier.CheckPlatform(ctx, nil, counter, occurred.Add(time.Minute))
+	counter.count = 125
+	notifier.CheckPlatform(ctx, nil, counter, occurred.Add(2*time.Minute))
+	sent = waitForEmails(4)
+	assert.Equal(t, "[agentbox] Database errors are spiking", sent[3].msg.Subject)
+	assert.Contains(t, sent[3].msg.Body, "25 database errors within the last 5m0s")
+
+	// The hourly cap (4) drops further emails
+	failed.Key = "env-4"
+	notifier.Notify(failed)
+	require.Never(t, func() bool { return len(sender.emails()) > 4 }, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestCriticalEmailOnMaxRetries(t *testing.T) {
+	db := setupTestDB(t)
+	cfg := testOrchestratorConfig()
+	cfg.Reconciliation.MaxRetries = 1
+	orch, mockK8s := setupConfiguredOrchestrator(t, cfg, db)
+	ctx := context.Background()
+
+	events := make(chan notify.Event, 4)
+	orch.SetCriticalNotifier(notifierFunc(func(ev notify.Event) { events <- ev }))
+
+	mockK8s.FailNext("CreateNamespace", 2, apierrors.New(apierrors.Unavailable, "", "api server unavailable"))
+	env, err := orch.CreateEnvironment(ctx, waitEnvRequest, "user-123")
+	require.NoError(t, err)
+	_, settled, err := orch.WaitForEnvironment(ctx, env.ID, 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, settled)
+	require.NoError(t, orch.RetryReconciliation(ctx, env.ID))
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, notify.EventEnvironmentFailed, ev.Kind)
+		assert.Equal(t, env.ID, ev.Key)
+		assert.Equal(t, "user-123", ev.UserID)
+		assert.Equal(t, env.Name, ev.EnvironmentName)
+		assert.Equal(t, 1, ev.Attempts)
+		assert.Contains(t, ev.Error, "api server unavailable")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no critical event for the environment that ran out of retries")
+	}
+}
+
+// notifierFunc adapts a function to orchestrator.CriticalNotifier
+type notifierFunc func(ev notify.Event)
+
+func (f notifierFunc) Notify(ev notify.Event) { f(ev) }
+
+// fakeSMTPServer accepts one SMTP session and records the message data
+func fakeSMTPServer(t *testing.T) (port int, data <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var b strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					b.WriteString(l)
+				}
+				received <- b.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestSMTPSender(t *testing.T) {
+	port, data := fakeSMTPServer(t)
+	cfg := testEmailConfig
+	cfg.Port = port
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := notify.NewSMTPSender(cfg).Send(ctx, "oncall@example.com", &notify.Message{
+		Subject: "Cluster west is down", Body: "line one\nline two\n",
+	})
+	require.NoError(t, err)
+	msg := <-data
+	assert.Contains(t, msg, "From: <agentbox@example.com>\r\n")
+	assert.Contains(t, msg, "To: <oncall@example.com>\r\n")
+	assert.Contains(t, msg, "Subject: Cluster west is down\r\n")
+	assert.True(t, strings.HasSuffix(msg, "\r\n\r\nline one\r\nline two\r\n"), msg)
+
+	// STARTTLS is required unless tls is none
+	port, _ = fakeSMTPServer(t)
+	cfg.Port, cfg.TLS = port, "starttls"
+	err = notify.NewSMTPSender(cfg).Send(ctx, "oncall@example.com", &notify.Message{Subject: "s", Body: "b"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "STARTTLS")
+}
+
+func TestTestEmailEndpoint(t *testing.T) {
+	var notifier *notify.Service
+	a := setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		prefs := preferences.NewService(a.db, &config.Config{}, zap.NewNop())
+		notifier = notify.NewService(config.EmailConfig{}, a.users, prefs, zap.NewNop())
+		rc.NotificationHandler = api.NewNotificationHandler(notifier, a.log)
+	}))
+	router, userService := a.router, a.users
+	do := func(token string, body interface{}) *httptest.ResponseRecorder {
+		var payload string
+		if body != nil {
+			data, err := json.Marshal(body)
+			require.NoError(t, err)
+			payload = string(data)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/notifications/email/test", strings.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	_, err := userService.CreateUser(context.Background(), &users.CreateUserRequest{
+		Username: "mail-admin", Email: "mail-admin@example.com", Password: "password123", Role: users.RoleAdmin, Status: users.StatusActive,
+	})
+	require.NoError(t, err)
+	createUserForTest(t, userService, "mail-user", "password123", users.RoleUser)
+	adminJWT := getTokenForUser(t, router, "mail-admin", "password123")
+	userJWT := getTokenForUser(t, router, "mail-user", "password123")
+
+	assert.Equal(t, http.StatusForbidden, do(userJWT, nil).Code)
+
+	// Not configured
+	rr := do(adminJWT, nil)
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code, rr.Body.String())
+	assert.Equal(t, apierrors.CodeEmailNotConfigured, errorCode(t, rr.Body.Bytes()))
+
+	// Sent to the caller by default, or to the given address
+	sender := &fakeSender{}
+	notifier.SetSender(sender)
+	rr = do(adminJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(adminJWT, map[string]string{"to": "ops@example.com"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	sent := sender.emails()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "mail-admin@example.com", sent[0].to)
+	assert.Equal(t, "ops@example.com", sent[1].to)
+	assert.Equal(t, "[agentbox] Test email", sent[0].msg.Subject)
+
+	assert.Equal(t, http.StatusBadRequest, do(adminJWT, map[string]string{"to": "not an address"}).Code)
+
+	// SMTP failures are reported as a bad gateway
+	sender.err = errors.New("530 authentication required")
+	rr = do(adminJWT, nil)
+	require.Equal(t, http.StatusBadGateway, rr.Code, rr.Body.String())
+	assert.Equal(t, apierrors.CodeEmailSendFailed, errorCode(t, rr.Body.Bytes()))
+	assert.Contains(t, rr.Body.String(), "530 authentication required")
+}
+
+func TestEmailConfigValidation(t *testing.T) {
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	t.Setenv("AGENTBOX_EMAIL_NOTIFICATIONS_ENABLED", "true")
+	_, err := config.Load("")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "notifications email host is required")
+
+	t.Setenv("AGENTBOX_SMTP_HOST", "smtp.example.com")
+	t.Setenv("AGENTBOX_SMTP_FROM", "agentbox@example.com")
+	t.Setenv("AGENTBOX_SMTP_PORT", strconv.Itoa(465))
+	t.Setenv("AGENTBOX_SMTP_TLS", "tls")
+	cfg, err := config.Load("")
+	require.NoError(t, err)
+	assert.Equal(t, 465, cfg.Notifications.Email.Port)
+	assert.Equal(t, 30, cfg.Notifications.Email.MaxPerHour)
+}
@@ -0,0 +1,128 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func TestEnvironmentURLs(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "urls-env"})
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler)
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	get := func(h http.Handler, path, remoteAddr string, headers map[string]string) models.Environment {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments"+path, nil)
+		req.Host = "agentbox.internal:8080"
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		if path != "" {
+			var got models.Environment
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&got))
+			return got
+		}
+		var list models.ListEnvironmentsResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+		require.Len(t, list.Environments, 1)
+		return list.Environments[0]
+	}
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "agentbox.example.com"}
+
+	t.Run("request host", func(t *testing.T) {
+		got := get(router, "/"+env.ID, "203.0.113.5:4000", nil)
+		assert.Equal(t, "http://agentbox.internal:8080/api/v1/environments/"+env.ID, got.APIURL)
+		assert.Equal(t, "ws://agentbox.internal:8080/api/v1/environments/"+env.ID+"/attach", got.AttachURL)
+		assert.Equal(t, got.AttachURL, got.Endpoint)
+
+		// Forwarding headers of untrusted peers are ignored
+		got = get(resolver.Middleware(router), "/"+env.ID, "203.0.113.5:4000", forwarded)
+		assert.Equal(t, "http://agentbox.internal:8080/api/v1/environments/"+env.ID, got.APIURL)
+	})
+
+	t.Run("trusted proxy", func(t *testing.T) {
+		got := get(resolver.Middleware(router), "/"+env.ID, "10.1.2.3:4000", forwarded)
+		assert.Equal(t, "https://agentbox.example.com/api/v1/environments/"+env.ID, got.APIURL)
+		assert.Equal(t, "wss://agentbox.example.com/api/v1/environments/"+env.ID+"/attach", got.AttachURL)
+
+		// A malformed forwarded host is not used
+		got = get(resolver.Middleware(router), "/"+env.ID, "10.1.2.3:4000", map[string]string{"X-Forwarded-Host": "evil.example.com/x"})
+		assert.Equal(t, "http://agentbox.internal:8080/api/v1/environments/"+env.ID, got.APIURL)
+	})
+
+	t.Run("external url", func(t *testing.T) {
+		externalURL, err := url.Parse("https://sandbox.example.com/agentbox/")
+		require.NoError(t, err)
+		handler.SetExternalURL(externalURL, "")
+		defer handler.SetExternalURL(nil, "")
+
+		got := get(resolver.Middleware(router), "", "10.1.2.3:4000", forwarded)
+		assert.Equal(t, "https://sandbox.example.com/agentbox/api/v1/environments/"+env.ID, got.APIURL)
+		assert.Equal(t, "wss://sandbox.example.com/agentbox/api/v1/environments/"+env.ID+"/attach", got.AttachURL)
+
+		handler.SetExternalURL(externalURL, "ws")
+		got = get(router, "/"+env.ID, "203.0.113.5:4000", nil)
+		assert.Equal(t, "ws://sandbox.example.com/agentbox/api/v1/environments/"+env.ID+"/attach", got.AttachURL)
+	})
+
+	t.Run("stored endpoint is ignored", func(t *testing.T) {
+		_, err := db.ExecContext(context.Background(), "UPDATE environments SET endpoint = $1 WHERE id = $2",
+			"ws://localhost:8080/api/v1/environments/"+env.ID+"/attach", env.ID)
+		require.NoError(t, err)
+		stored, err := db.GetEnvironment(context.Background(), env.ID)
+		require.NoError(t, err)
+		assert.Empty(t, stored.Endpoint)
+	})
+}
+
+func TestConfigExternalURL(t *testing.T) {
+	write := func(content string) string {
+		tmpfile, err := os.CreateTemp("", "config-external-url-*.yaml")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		_, err = tmpfile.Write([]byte(content))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return tmpfile.Name()
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\nserver:\n  external_url: https://agentbox.example.com\n  ws_scheme: wss\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://agentbox.example.com", cfg.Server.ExternalURL)
+	assert.Equal(t, "wss", cfg.Server.WSScheme)
+
+	t.Setenv("AGENTBOX_EXTERNAL_URL", "http://10.0.0.1:8080")
+	cfg, err = config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://10.0.0.1:8080", cfg.Server.ExternalURL)
+
+	t.Setenv("AGENTBOX_EXTERNAL_URL", "")
+	_, err = config.Load(write("auth:\n  enabled: false\nserver:\n  external_url: agentbox.example.com\n"))
+	assert.ErrorContains(t, err, "external_url")
+	_, err = config.Load(write("auth:\n  enabled: false\nserver:\n  ws_scheme: https\n"))
+	assert.ErrorContains(t, err, "ws_scheme")
+}
@@ -0,0 +1,248 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// insertEnvironmentEvent stores an event with the given creation time
+func insertEnvironmentEvent(t *testing.T, db *database.DB, envID, id, eventType string, at time.Time) {
+	t.Helper()
+	_, err := db.ExecContext(context.Background(),
+		`INSERT INTO environment_events (id, environment_id, event_type, message, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		id, envID, eventType, "event "+id, at.Local())
+	require.NoError(t, err)
+}
+
+func saveEnvironmentWithStatus(t *testing.T, db *database.DB, id string, status models.EnvironmentStatus) {
+	t.Helper()
+	require.NoError(t, db.SaveEnvironment(context.Background(), &models.Environment{
+		ID:        id,
+		Name:      id,
+		Status:    status,
+		Image:     "busybox",
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+		Namespace: "ns-" + id,
+		Resources: models.ResourceSpec{CPU: "100m", Memory: "128Mi", Storage: "1Gi"},
+	}))
+}
+
+func eventIDs(events []*models.EnvironmentEvent) []string {
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func TestDatabaseListEnvironmentEventsBetween(t *testing.T) {
+	db := setupDBForEnvironments(t)
+	ctx := context.Background()
+	saveEnvironmentWithStatus(t, db, "env-range", models.StatusRunning)
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		insertEnvironmentEvent(t, db, "env-range", fmt.Sprintf("ev-%d", i), "pool_refresh", base.Add(time.Duration(i)*time.Minute))
+	}
+
+	// The newest events are kept, listed oldest first
+	events, err := db.ListEnvironmentEvents(ctx, "env-range", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ev-2", "ev-3", "ev-4"}, eventIDs(events))
+
+	from, to := base.Add(time.Minute), base.Add(3*time.Minute)
+	events, err = db.ListEnvironmentEventsBetween(ctx, "env-range", &from, &to, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ev-1", "ev-2", "ev-3"}, eventIDs(events))
+
+	events, err = db.ListEnvironmentEventsBetween(ctx, "env-range", &from, nil, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ev-3", "ev-4"}, eventIDs(events))
+}
+
+func TestDatabasePruneEnvironmentEvents(t *testing.T) {
+	db := setupDBForEnvironments(t)
+	ctx := context.Background()
+	saveEnvironmentWithStatus(t, db, "env-failed", models.StatusFailed)
+	saveEnvironmentWithStatus(t, db, "env-running", models.StatusRunning)
+	failureTypes := []string{"reconciliation_failure", "reconciliation_max_retries"}
+
+	now := time.Now().Truncate(time.Second)
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	insertEnvironmentEvent(t, db, "env-failed", "failed-start", "reconciliation_start", days(12))
+	insertEnvironmentEvent(t, db, "env-failed", "failed-cause-old", "reconciliation_failure", days(11))
+	insertEnvironmentEvent(t, db, "env-failed", "failed-cause", "reconciliation_max_retries", days(10))
+	insertEnvironmentEvent(t, db, "env-failed", "failed-retry", "reconciliation_retry", days(9))
+	insertEnvironmentEvent(t, db, "env-failed", "failed-recent-1", "pool_refresh", days(1))
+	insertEnvironmentEvent(t, db, "env-failed", "failed-recent-2", "pool_refresh", now)
+	insertEnvironmentEvent(t, db, "env-running", "running-failure", "reconciliation_failure", days(10))
+	insertEnvironmentEvent(t, db, "env-running", "running-recent", "pool_refresh", days(1))
+
+	// Expired events go, except the newest failure event of the failed environment
+	n, err := db.DeleteEnvironmentEventsBefore(ctx, days(7), failureTypes)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	events, err := db.ListEnvironmentEvents(ctx, "env-failed", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"failed-cause", "failed-recent-1", "failed-recent-2"}, eventIDs(events))
+	events, err = db.ListEnvironmentEvents(ctx, "env-running", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"running-recent"}, eventIDs(events))
+
+	// The limit keeps the newest events, and the cause of the failure
+	n, err = db.DeleteEnvironmentEventsBeyondLimit(ctx, 1, failureTypes)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	events, err = db.ListEnvironmentEvents(ctx, "env-failed", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"failed-cause", "failed-recent-2"}, eventIDs(events))
+
+	// Without failure types nothing is kept back
+	n, err = db.DeleteEnvironmentEventsBeyondLimit(ctx, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	events, err = db.ListEnvironmentEvents(ctx, "env-failed", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"failed-recent-2"}, eventIDs(events))
+}
+
+func TestListEvents(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "events"})
+
+	base := time.Now().Add(time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		insertEnvironmentEvent(t, db, env.ID, fmt.Sprintf("ev-%d", i), "pool_refresh", base.Add(time.Duration(i)*time.Minute))
+	}
+	// Events sharing a timestamp are not skipped or repeated across pages
+	insertEnvironmentEvent(t, db, env.ID, "ev-3b", "pool_refresh", base.Add(3*time.Minute))
+
+	since := base.Add(-time.Second)
+	var ids []string
+	opts := orchestrator.EventListOptions{Limit: 2, Since: &since}
+	for {
+		resp, err := orch.ListEvents(ctx, env.ID, opts)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(resp.Events), 2)
+		ids = append(ids, eventIDs(resp.Events)...)
+		if resp.NextPageToken == "" {
+			break
+		}
+		opts.PageToken = resp.NextPageToken
+	}
+	assert.Equal(t, []string{"ev-4", "ev-3b", "ev-3", "ev-2", "ev-1", "ev-0"}, ids)
+
+	until := base.Add(time.Minute)
+	resp, err := orch.ListEvents(ctx, env.ID, orchestrator.EventListOptions{Since: &since, Until: &until})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ev-1", "ev-0"}, eventIDs(resp.Events))
+	assert.Empty(t, resp.NextPageToken)
+
+	// Without a time filter the environment's own lifecycle events are listed too
+	resp, err = orch.ListEvents(ctx, env.ID, orchestrator.EventListOptions{})
+	require.NoError(t, err)
+	assert.Greater(t, len(resp.Events), 6)
+
+	_, err = orch.ListEvents(ctx, "env-missing", orchestrator.EventListOptions{})
+	assert.Error(t, err)
+	_, err = orch.ListEvents(ctx, env.ID, orchestrator.EventListOptions{PageToken: "not-a-token"})
+	assert.Error(t, err)
+}
+
+func TestEventsAPI(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler, nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "events-api"})
+
+	base := time.Now().Add(time.Hour).Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		insertEnvironmentEvent(t, db, env.ID, fmt.Sprintf("ev-%d", i), "pool_refresh", base.Add(time.Duration(i)*time.Minute))
+	}
+
+	get := func(query url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/events?"+query.Encode(), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(url.Values{"since": {base.Add(-time.Second).Format(time.RFC3339)}, "limit": {"2"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var page models.EnvironmentEventsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, []string{"ev-2", "ev-1"}, eventIDs(page.Events))
+	require.NotEmpty(t, page.NextPageToken)
+
+	w = get(url.Values{"since": {base.Add(-time.Second).Format(time.RFC3339)}, "page_token": {page.NextPageToken}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	page = models.EnvironmentEventsResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, []string{"ev-0"}, eventIDs(page.Events))
+	assert.Empty(t, page.NextPageToken)
+
+	w = get(url.Values{"until": {"yesterday"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/env-missing/events", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetLogsMergesEventsOfTheLogWindow(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "logs-window"})
+
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	insertEnvironmentEvent(t, db, env.ID, "ev-before", "pool_refresh", start.Add(-time.Minute))
+	insertEnvironmentEvent(t, db, env.ID, "ev-during", "pool_refresh", start.Add(30*time.Second))
+	mockK8s.SetPodLogs(env.Namespace, "main",
+		"continued line without a timestamp\n"+
+			start.Format(time.RFC3339)+" first\n"+
+			start.Add(time.Minute).Format(time.RFC3339)+" second\n")
+
+	messages := func(resp *models.LogsResponse) []string {
+		var out []string
+		for _, e := range resp.Logs {
+			out = append(out, e.Message)
+		}
+		return out
+	}
+
+	// A tail of the log only gets the events from its first line on
+	tail := int64(3)
+	resp, err := orch.GetLogs(ctx, env.ID, &tail)
+	require.NoError(t, err)
+	assert.Contains(t, messages(resp), "[pool_refresh] event ev-during")
+	assert.NotContains(t, messages(resp), "[pool_refresh] event ev-before")
+
+	// The whole log gets every event
+	resp, err = orch.GetLogs(ctx, env.ID, nil)
+	require.NoError(t, err)
+	assert.Contains(t, messages(resp), "[pool_refresh] event ev-during")
+	assert.Contains(t, messages(resp), "[pool_refresh] event ev-before")
+}
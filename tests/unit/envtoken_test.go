@@ -0,0 +1,190 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func TestEnvironmentTokenLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	authService := auth.NewService(db, userService, zap.NewNop())
+	authService.SetEnvironmentTokenMaxTTL(time.Hour)
+	user := createUserForTest(t, userService, "agent-owner", "password123", users.RoleUser)
+
+	// TTLs above the maximum are capped
+	token, err := authService.CreateEnvironmentToken(ctx, "env-a1b2c3d4", user.ID, permissions.PermissionViewer, "ci", 48*time.Hour)
+	require.NoError(t, err)
+	assert.Contains(t, token.Token, auth.EnvironmentTokenPrefix)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.ExpiresAt, time.Minute)
+
+	got, scope, err := authService.ValidateEnvironmentToken(ctx, token.Token)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, got.ID)
+	assert.Equal(t, &auth.EnvironmentScope{TokenID: token.ID, EnvironmentID: "env-a1b2c3d4", Permission: permissions.PermissionViewer}, scope)
+
+	_, err = authService.CreateEnvironmentToken(ctx, "env-a1b2c3d4", user.ID, "admin", "", 0)
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+
+	// Revoked tokens are rejected but still listed
+	require.NoError(t, authService.RevokeEnvironmentToken(ctx, "env-a1b2c3d4", token.ID))
+	_, _, err = authService.ValidateEnvironmentToken(ctx, token.Token)
+	assert.Error(t, err)
+	assert.ErrorIs(t, authService.RevokeEnvironmentToken(ctx, "env-a1b2c3d4", token.ID), apierrors.NotFound)
+
+	tokens, err := authService.ListEnvironmentTokens(ctx, "env-a1b2c3d4")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].RevokedAt)
+	assert.Empty(t, tokens[0].Token)
+
+	// Expired tokens are rejected
+	short, err := authService.CreateEnvironmentToken(ctx, "env-a1b2c3d4", user.ID, permissions.PermissionEditor, "", time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, _, err = authService.ValidateEnvironmentToken(ctx, short.Token)
+	assert.Error(t, err)
+}
+
+func setupEnvTokenAPITest(t *testing.T) *apiTest {
+	return setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		rc.EnvTokenHandler = api.NewEnvironmentTokenHandler(a.auth, a.permissions, a.orch, a.log)
+	}))
+}
+
+func TestEnvironmentTokenAPI(t *testing.T) {
+	a := setupEnvTokenAPITest(t)
+	ctx := context.Background()
+
+	owner := createUserForTest(t, a.users, "env-owner", "password123", users.RoleUser)
+	viewer := createUserForTest(t, a.users, "env-viewer", "password123", users.RoleUser)
+	env := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "scoped-env"})
+	other := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "other-env"})
+	_, err := a.permissions.GrantPermission(ctx, owner.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+	_, err = a.permissions.GrantPermission(ctx, viewer.ID, env.ID, permissions.PermissionViewer, "")
+	require.NoError(t, err)
+	ownerJWT := getTokenForUser(t, a.router, "env-owner", "password123")
+	viewerJWT := getTokenForUser(t, a.router, "env-viewer", "password123")
+
+	// Tokens cannot exceed their creator's permission
+	rr := a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/tokens", viewerJWT, map[string]interface{}{"permission": "editor"})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+
+	rr = a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/tokens", ownerJWT, map[string]interface{}{"ttl_seconds": 600, "description": "agent"})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var created auth.EnvironmentToken
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+	assert.Equal(t, permissions.PermissionEditor, created.Permission)
+	assert.NotEmpty(t, created.Token)
+
+	// The token works on its own environment only
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID, created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/environments/"+other.ID, created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/environments", created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/api-keys", created.Token, nil).Code)
+	// nor on the account of its creator
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/auth/me", created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/auth/change-password", created.Token,
+		map[string]interface{}{"current_password": "password123", "new_password": "password456"}).Code)
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/auth/me", ownerJWT, nil).Code)
+
+	// Editor tokens can run executions, and read them back, but not delete the environment or mint tokens
+	rr = a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/run", created.Token, map[string]interface{}{"command": []string{"ls"}})
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var exec models.ExecutionResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&exec))
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/executions/"+exec.ID, created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodDelete, "/api/v1/environments/"+env.ID, created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/tokens", created.Token, map[string]interface{}{}).Code)
+
+	rr = a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID+"/tokens", ownerJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var list struct {
+		Tokens []auth.EnvironmentToken `json:"tokens"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	require.Len(t, list.Tokens, 1)
+	assert.NotNil(t, list.Tokens[0].LastUsed)
+
+	// Revoked tokens stop working
+	assert.Equal(t, http.StatusNoContent, a.do(t, http.MethodDelete, "/api/v1/environments/"+env.ID+"/tokens/"+created.ID, ownerJWT, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID, created.Token, nil).Code)
+	assert.Equal(t, http.StatusNotFound, a.do(t, http.MethodDelete, "/api/v1/environments/"+env.ID+"/tokens/"+created.ID, ownerJWT, nil).Code)
+}
+
+func TestEnvironmentTokenInjectedIntoPods(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	authService := auth.NewService(db, userService, zap.NewNop())
+	user := createUserForTest(t, userService, "pod-owner", "password123", users.RoleUser)
+
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	orch.SetEnvironmentTokenIssuer(authService)
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "token-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, user.ID)
+	require.NoError(t, err)
+
+	var main *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		main = mockK8s.CreatedPodSpec(env.Namespace, "main")
+		return main != nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	podToken := main.Env[orchestrator.EnvVarToken]
+	got, scope, err := authService.ValidateEnvironmentToken(ctx, podToken)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, got.ID)
+	assert.Equal(t, env.ID, scope.EnvironmentID)
+	assert.Equal(t, permissions.PermissionEditor, scope.Permission)
+
+	// The main pod's token lives as long as the environment, beyond the maximum TTL of created tokens
+	tokens, err := authService.ListEnvironmentTokens(ctx, env.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.True(t, tokens[0].ExpiresAt.After(time.Now().Add(auth.DefaultEnvironmentTokenMaxTTL)))
+
+	// Execution pods get no token of their own
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{EnvironmentID: env.ID, Command: []string{"echo", "hi"}}, user.ID)
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, exec.ID)
+	tokens, err = authService.ListEnvironmentTokens(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Len(t, tokens, 1)
+
+	// A recreated main pod's token replaces the previous one
+	replacement, err := authService.IssueEnvironmentToken(ctx, env.ID, user.ID)
+	require.NoError(t, err)
+	_, _, err = authService.ValidateEnvironmentToken(ctx, podToken)
+	assert.ErrorContains(t, err, "revoked")
+	_, _, err = authService.ValidateEnvironmentToken(ctx, replacement)
+	require.NoError(t, err)
+
+	// Deleting the environment revokes its tokens
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	_, _, err = authService.ValidateEnvironmentToken(ctx, replacement)
+	assert.ErrorContains(t, err, "revoked")
+}
@@ -0,0 +1,201 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+var waitEnvRequest = &models.CreateEnvironmentRequest{
+	Name:      "wait-env",
+	Image:     "python:3.11-slim",
+	Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+}
+
+func TestWaitForEnvironment(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	mockK8s.SetHoldPodRunning(true)
+
+	env, err := orch.CreateEnvironment(ctx, waitEnvRequest, "user-123")
+	require.NoError(t, err)
+
+	// Still provisioning when the wait elapses
+	got, settled, err := orch.WaitForEnvironment(ctx, env.ID, 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, settled)
+	assert.Equal(t, models.StatusPending, got.Status)
+
+	require.Eventually(t, func() bool { return mockK8s.GetPodCount(env.Namespace) == 1 }, 5*time.Second, 20*time.Millisecond)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		mockK8s.SetPodRunning(env.Namespace, "main")
+	}()
+	start := time.Now()
+	got, settled, err = orch.WaitForEnvironment(ctx, env.ID, 10*time.Second)
+	require.NoError(t, err)
+	assert.True(t, settled)
+	assert.Equal(t, models.StatusRunning, got.Status)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Zero(t, orch.EnvironmentWatcherCount())
+
+	// A canceled wait unsubscribes
+	mockK8s.SetHoldPodRunning(true)
+	pending, err := orch.CreateEnvironment(ctx, waitEnvRequest, "user-123")
+	require.NoError(t, err)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err = orch.WaitForEnvironment(cancelCtx, pending.ID, 10*time.Second)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, orch.EnvironmentWatcherCount())
+
+	_, _, err = orch.WaitForEnvironment(ctx, "env-missing", time.Second)
+	assert.Error(t, err)
+}
+
+func TestWatchEnvironmentStatusFromReconciliation(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	mockK8s.FailNext("CreateNamespace", 1, apierrors.New(apierrors.Unavailable, "", "api server unavailable"))
+	env, err := orch.CreateEnvironment(ctx, waitEnvRequest, "user-123")
+	require.NoError(t, err)
+	got, settled, err := orch.WaitForEnvironment(ctx, env.ID, 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, settled)
+	require.Equal(t, models.StatusFailed, got.Status)
+
+	changed, release := orch.WatchEnvironmentStatus(env.ID)
+	defer release()
+	require.NoError(t, orch.RetryReconciliation(ctx, env.ID))
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconciliation did not signal the status change")
+	}
+	got, err = orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusRunning, got.Status)
+
+	release()
+	assert.Zero(t, orch.EnvironmentWatcherCount())
+}
+
+func TestWaitForEnvironmentAPI(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler)
+
+	create := func(query string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(waitEnvRequest)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments"+query, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("create with wait_seconds returns the running environment", func(t *testing.T) {
+		rr := create("?wait_seconds=10")
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var env models.Environment
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+		assert.Equal(t, models.StatusRunning, env.Status)
+
+		for _, query := range []string{"?wait_seconds=soon", "?wait_seconds=301", "?wait_seconds=-1"} {
+			assert.Equal(t, http.StatusBadRequest, create(query).Code, query)
+		}
+	})
+
+	mockK8s.SetHoldPodRunning(true)
+	rr := create("")
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+	require.Eventually(t, func() bool { return mockK8s.GetPodCount(env.Namespace) == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	wait := func(query, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/wait"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("wait times out with 202", func(t *testing.T) {
+		rr := wait("?timeout=0", "")
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		var got models.Environment
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&got))
+		assert.Equal(t, models.StatusPending, got.Status)
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, wait("?timeout=forever", "").Code)
+		assert.Equal(t, http.StatusBadRequest, wait("?timeout=3600", "").Code)
+	})
+
+	t.Run("stream timeout event", func(t *testing.T) {
+		rr := wait("?stream=true&timeout=0", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		out := rr.Body.String()
+		assert.Contains(t, out, "event: status\n")
+		assert.Contains(t, out, "event: timeout\n")
+	})
+
+	t.Run("stream status transitions", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			mockK8s.SetPodRunning(env.Namespace, "main")
+		}()
+		rr := wait("?timeout=10", "text/event-stream")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+		out := rr.Body.String()
+		pending := strings.Index(out, `"status":"pending"`)
+		running := strings.Index(out, `"status":"running"`)
+		require.GreaterOrEqual(t, pending, 0, out)
+		assert.Greater(t, running, pending, out)
+		assert.NotContains(t, out, "event: timeout")
+	})
+
+	t.Run("wait on a running environment returns 200", func(t *testing.T) {
+		rr := wait("", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var got models.Environment
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&got))
+		assert.Equal(t, models.StatusRunning, got.Status)
+	})
+
+	t.Run("unknown environment", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/env-missing/wait", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	assert.Zero(t, orch.EnvironmentWatcherCount())
+}
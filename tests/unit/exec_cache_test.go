@@ -0,0 +1,106 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func TestExecutionResultCache(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "cache-env", Env: map[string]string{"SEED": "1"}})
+
+	submit := func(req *orchestrator.EphemeralExecRequest) *models.Execution {
+		req.EnvironmentID = env.ID
+		exec, err := orch.SubmitExecution(ctx, req, "user-123")
+		require.NoError(t, err)
+		return exec
+	}
+
+	// The first run misses and runs in its own pod
+	first := submit(&orchestrator.EphemeralExecRequest{Command: []string{"python", "eval.py"}, Cache: true})
+	done := waitForExecutionDone(t, orch, first.ID)
+	require.Equal(t, models.ExecutionStatusCompleted, done.Status)
+	assert.False(t, done.Cached)
+	assert.True(t, done.CacheEnabled)
+
+	// An identical execution is answered from the cache without a pod
+	hit := submit(&orchestrator.EphemeralExecRequest{Command: []string{"python", "eval.py"}, Cache: true})
+	assert.Equal(t, models.ExecutionStatusCompleted, hit.Status)
+	assert.True(t, hit.Cached)
+	assert.Equal(t, first.ID, hit.CachedFrom)
+	assert.Equal(t, *done.ExitCode, *hit.ExitCode)
+	assert.Equal(t, done.Stdout, hit.Stdout)
+	assert.NotContains(t, mockK8s.CreatedPodNames(env.Namespace), hit.ID)
+	stored, err := db.GetExecution(ctx, hit.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Cached)
+	assert.Equal(t, first.ID, stored.CachedFrom)
+
+	// Other inputs, or not asking for the cache, run the command
+	other := submit(&orchestrator.EphemeralExecRequest{Command: []string{"python", "eval.py"}, Env: map[string]string{"SEED": "2"}, Cache: true})
+	assert.False(t, other.Cached)
+	uncached := submit(&orchestrator.EphemeralExecRequest{Command: []string{"python", "eval.py"}})
+	assert.False(t, uncached.Cached)
+	waitForExecutionDone(t, orch, other.ID)
+	waitForExecutionDone(t, orch, uncached.ID)
+
+	// Changing the environment's env invalidates its cached results
+	newEnv := map[string]string{"SEED": "3"}
+	_, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{Env: &newEnv})
+	require.NoError(t, err)
+	rerun := submit(&orchestrator.EphemeralExecRequest{Command: []string{"python", "eval.py"}, Cache: true})
+	assert.False(t, rerun.Cached)
+	waitForExecutionDone(t, orch, rerun.ID)
+
+	assert.Equal(t, int64(1), orch.ExecutionCacheHitsTotal())
+	assert.Equal(t, int64(3), orch.ExecutionCacheMissesTotal())
+
+	stats, err := orch.GetExecutionStats(ctx, env.ID, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, stats.CacheLookups)
+	assert.Equal(t, 1, stats.CacheHits)
+	assert.InDelta(t, 0.25, stats.CacheHitRate, 0.001)
+}
+
+func TestExecutionResultCacheExpires(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "cache-ttl-env"})
+
+	req := func() *orchestrator.EphemeralExecRequest {
+		return &orchestrator.EphemeralExecRequest{EnvironmentID: env.ID, Command: []string{"date"}, Cache: true, CacheTTL: 1}
+	}
+	first, err := orch.SubmitExecution(ctx, req(), "user-123")
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, first.ID)
+
+	time.Sleep(1100 * time.Millisecond)
+	second, err := orch.SubmitExecution(ctx, req(), "user-123")
+	require.NoError(t, err)
+	assert.False(t, second.Cached, "expired entries are not served")
+}
+
+func TestExecutionCacheValidation(t *testing.T) {
+	v := validator.New(10000, 64*1024*1024*1024, 100*1024*1024*1024, 86400)
+	validate := func(req *models.EphemeralExecRequest) error {
+		req.Command = []string{"ls"}
+		return v.ValidateEphemeralExecRequest(req)
+	}
+
+	assert.NoError(t, validate(&models.EphemeralExecRequest{Cache: true}))
+	assert.NoError(t, validate(&models.EphemeralExecRequest{Cache: true, CacheTTL: 600}))
+	assert.Error(t, validate(&models.EphemeralExecRequest{CacheTTL: 600}), "cache_ttl requires cache")
+	assert.Error(t, validate(&models.EphemeralExecRequest{Cache: true, CacheTTL: -1}))
+	assert.Error(t, validate(&models.EphemeralExecRequest{Cache: true, CacheTTL: models.MaxExecutionCacheTTL + 1}))
+}
@@ -0,0 +1,227 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// callbackConfig delivers execution callbacks with the given settings
+func callbackConfig(callbacks config.ExecutionCallbackConfig) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Executions = config.ExecutionConfig{MaxOutputBytes: 1024 * 1024, Callbacks: callbacks}
+	return cfg
+}
+
+// callbackReceiver records the callback requests it receives and answers them with statuses,
+// then 200
+type callbackReceiver struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newCallbackReceiver(t *testing.T, statuses ...int) *callbackReceiver {
+	rcv := &callbackReceiver{statuses: statuses}
+	rcv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, r)
+		rcv.bodies = append(rcv.bodies, body)
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rcv.server.Close)
+	return rcv
+}
+
+func waitForCallbackState(t *testing.T, orch *orchestrator.Orchestrator, execID, status string) *models.ExecutionCallback {
+	var callback *models.ExecutionCallback
+	require.Eventually(t, func() bool {
+		exec, err := orch.GetExecution(context.Background(), execID)
+		if err != nil || exec.Callback == nil {
+			return false
+		}
+		callback = exec.Callback
+		return callback.Status == status
+	}, 5*time.Second, 20*time.Millisecond)
+	return callback
+}
+
+func TestExecutionCallbackDeliveredWithRetryAndSignature(t *testing.T) {
+	db := setupTestDB(t)
+	rcv := newCallbackReceiver(t, http.StatusServiceUnavailable)
+	orch, _ := setupConfiguredOrchestrator(t, callbackConfig(config.ExecutionCallbackConfig{
+		AllowedSchemes:       []string{"http"},
+		AllowPrivateNetworks: true,
+		MaxAttempts:          3,
+		InitialBackoffMs:     10,
+		TimeoutSeconds:       5,
+	}), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "callback-env"})
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID:   env.ID,
+		Command:         []string{"echo", "hi"},
+		CallbackURL:     rcv.server.URL + "/hooks/exec",
+		CallbackHeaders: map[string]string{"authorization": "Bearer agent-token"},
+		CallbackSecret:  "callback-secret",
+	}, "user-123")
+	require.NoError(t, err)
+	require.NotNil(t, exec.Callback)
+	assert.Equal(t, models.CallbackStatusPending, exec.Callback.Status)
+
+	callback := waitForCallbackState(t, orch, exec.ID, models.CallbackStatusDelivered)
+	assert.Equal(t, 2, callback.Attempts, "the 503 is retried")
+	assert.NotNil(t, callback.DeliveredAt)
+	assert.Empty(t, callback.LastError)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	require.Len(t, rcv.requests, 2)
+	req, body := rcv.requests[1], rcv.bodies[1]
+	assert.Equal(t, "/hooks/exec", req.URL.Path)
+	assert.Equal(t, "Bearer agent-token", req.Header.Get("Authorization"))
+	assert.Equal(t, exec.ID, req.Header.Get(orchestrator.CallbackExecutionIDHeader))
+	timestamp := req.Header.Get(orchestrator.CallbackTimestampHeader)
+	require.NotEmpty(t, timestamp)
+	assert.Equal(t, orchestrator.SignCallback("callback-secret", timestamp, body), req.Header.Get(orchestrator.CallbackSignatureHeader))
+
+	var result models.ExecutionResponse
+	require.NoError(t, json.Unmarshal(body, &result))
+	assert.Equal(t, exec.ID, result.ID)
+	assert.Equal(t, models.ExecutionStatusCompleted, result.Status)
+	assert.Nil(t, result.Callback)
+
+	// The delivery state is persisted; the headers and secret are not stored or returned
+	stored, err := db.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.Callback)
+	assert.Equal(t, models.CallbackStatusDelivered, stored.Callback.Status)
+	data, err := json.Marshal(models.NewExecutionResponse(stored))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "agent-token")
+	assert.NotContains(t, string(data), "callback-secret")
+}
+
+func TestExecutionCallbackFailures(t *testing.T) {
+	rcv := newCallbackReceiver(t, http.StatusBadRequest, http.StatusBadGateway, http.StatusBadGateway)
+	orch, _ := setupConfiguredOrchestrator(t, callbackConfig(config.ExecutionCallbackConfig{
+		AllowedSchemes:       []string{"http"},
+		AllowPrivateNetworks: true,
+		MaxAttempts:          2,
+		InitialBackoffMs:     10,
+		TimeoutSeconds:       5,
+	}), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "callback-fail-env"})
+
+	// A client error is not retried
+	rejected, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"}, CallbackURL: rcv.server.URL,
+	}, "user-123")
+	require.NoError(t, err)
+	callback := waitForCallbackState(t, orch, rejected.ID, models.CallbackStatusFailed)
+	assert.Equal(t, 1, callback.Attempts)
+	assert.Contains(t, callback.LastError, "HTTP 400")
+
+	// Server errors are retried up to max_attempts
+	unavailable, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"}, CallbackURL: rcv.server.URL,
+	}, "user-123")
+	require.NoError(t, err)
+	callback = waitForCallbackState(t, orch, unavailable.ID, models.CallbackStatusFailed)
+	assert.Equal(t, 2, callback.Attempts)
+	assert.Contains(t, callback.LastError, "HTTP 502")
+	assert.Nil(t, callback.DeliveredAt)
+}
+
+func TestExecutionCallbackURLValidation(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, callbackConfig(config.ExecutionCallbackConfig{
+		AllowedSchemes: []string{"https"},
+		AllowedHosts:   []string{"hooks.example.com", "*.agents.example.com"},
+		MaxAttempts:    1,
+	}), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "callback-validation-env"})
+
+	for name, req := range map[string]orchestrator.EphemeralExecRequest{
+		"scheme not allowed":    {CallbackURL: "http://hooks.example.com/done"},
+		"host not allowed":      {CallbackURL: "https://evil.example.org/done"},
+		"bare wildcard domain":  {CallbackURL: "https://agents.example.com/done"},
+		"relative":              {CallbackURL: "/done"},
+		"credentials in url":    {CallbackURL: "https://user:pw@hooks.example.com/done"},
+		"reserved header":       {CallbackURL: "https://hooks.example.com/done", CallbackHeaders: map[string]string{"Content-Type": "text/plain"}},
+		"server header":         {CallbackURL: "https://hooks.example.com/done", CallbackHeaders: map[string]string{"X-AgentBox-Signature": "forged"}},
+		"header injection":      {CallbackURL: "https://hooks.example.com/done", CallbackHeaders: map[string]string{"X-Token": "a\r\nHost: internal"}},
+		"secret without url":    {CallbackSecret: "s3cret"},
+		"headers without url":   {CallbackHeaders: map[string]string{"X-Token": "t"}},
+		"invalid header name":   {CallbackURL: "https://hooks.example.com/done", CallbackHeaders: map[string]string{"Bad Header": "t"}},
+		"too long url":          {CallbackURL: "https://hooks.example.com/" + string(make([]byte, 2100))},
+		"internal ip allowlist": {CallbackURL: "https://10.0.0.1/done"},
+	} {
+		req.EnvironmentID = env.ID
+		req.Command = []string{"ls"}
+		_, err := orch.SubmitExecution(ctx, &req, "user-123")
+		require.Error(t, err, name)
+		assert.ErrorIs(t, err, apierrors.ValidationFailed, name)
+		assert.Equal(t, apierrors.CodeCallbackRejected, apierrors.CodeOf(err), name)
+	}
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"}, CallbackURL: "https://ci.agents.example.com/done",
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ci.agents.example.com/done", exec.Callback.URL)
+}
+
+func TestExecutionCallbackBlocksInternalAddresses(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, callbackConfig(config.ExecutionCallbackConfig{
+		AllowedSchemes: []string{"http", "https"},
+		MaxAttempts:    1,
+	}), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "callback-ssrf-env"})
+
+	for _, callbackURL := range []string{
+		"http://127.0.0.1:8080/",
+		"http://localhost/",
+		"http://api.localhost/",
+		"https://10.96.0.1/",
+		"https://172.16.4.2/",
+		"https://192.168.1.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.64.0.1/",
+		"http://0.0.0.0/",
+		"http://[::1]/",
+		"http://[fd00::1]/",
+		"http://[fe80::1]/",
+		"http://[::ffff:127.0.0.1]/",
+	} {
+		_, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"ls"}, CallbackURL: callbackURL,
+		}, "user-123")
+		require.Error(t, err, callbackURL)
+		assert.Equal(t, apierrors.CodeCallbackRejected, apierrors.CodeOf(err), callbackURL)
+	}
+}
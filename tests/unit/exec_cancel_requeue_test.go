@@ -0,0 +1,154 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// saveStoredExecution writes an execution to the database only, as one left by a previous run
+func saveStoredExecution(t *testing.T, db *database.DB, exec *models.Execution) {
+	t.Helper()
+	if exec.Command == nil {
+		exec.Command = []string{"ls"}
+	}
+	exec.CreatedAt = time.Now()
+	require.NoError(t, db.SaveExecution(context.Background(), exec))
+}
+
+func TestCancelAllExecutionsInDatabase(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "bulk-cancel"})
+
+	for _, exec := range []*models.Execution{
+		{ID: "exec-pending", Status: models.ExecutionStatusPending},
+		{ID: "exec-queued-1", Status: models.ExecutionStatusQueued},
+		{ID: "exec-queued-2", Status: models.ExecutionStatusQueued},
+		{ID: "exec-running", Status: models.ExecutionStatusRunning, PodName: "exec-running", Namespace: env.Namespace},
+		{ID: "exec-completed", Status: models.ExecutionStatusCompleted},
+	} {
+		exec.EnvironmentID = env.ID
+		saveStoredExecution(t, db, exec)
+	}
+	saveStoredExecution(t, db, &models.Execution{ID: "exec-other-env", EnvironmentID: "env-other", Status: models.ExecutionStatusQueued})
+
+	// The status filter is validated
+	_, err := orch.CancelAllExecutions(ctx, env.ID, "user-123", []models.ExecutionStatus{models.ExecutionStatusCompleted})
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	_, err = orch.CancelAllExecutions(ctx, "env-missing", "user-123", nil)
+	assert.ErrorIs(t, err, apierrors.NotFound)
+
+	deletes := mockK8s.CallCount("DeletePod")
+	result, err := orch.CancelAllExecutions(ctx, env.ID, "user-123", []models.ExecutionStatus{models.ExecutionStatusQueued})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Canceled)
+	assert.Equal(t, map[models.ExecutionStatus]int{models.ExecutionStatusQueued: 2}, result.ByStatus)
+
+	result, err = orch.CancelAllExecutions(ctx, env.ID, "user-123", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Canceled)
+	assert.Equal(t, map[models.ExecutionStatus]int{models.ExecutionStatusPending: 1, models.ExecutionStatusRunning: 1}, result.ByStatus)
+	assert.Equal(t, deletes+1, mockK8s.CallCount("DeletePod"))
+
+	for id, want := range map[string]models.ExecutionStatus{
+		"exec-pending":   models.ExecutionStatusCanceled,
+		"exec-queued-1":  models.ExecutionStatusCanceled,
+		"exec-running":   models.ExecutionStatusCanceled,
+		"exec-completed": models.ExecutionStatusCompleted,
+		"exec-other-env": models.ExecutionStatusQueued,
+	} {
+		stored, err := db.GetExecution(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, want, stored.Status, id)
+	}
+
+	// One audit entry per bulk cancellation
+	entries, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: orchestrator.AuditActionExecutionsCanceled})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, env.ID, entries[0].ResourceID)
+	assert.Equal(t, "user-123", entries[0].ActorID)
+	assert.Contains(t, entries[0].Details, "exec-running")
+}
+
+func TestCancelExecutionInDatabase(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "cancel-stored"})
+	saveStoredExecution(t, db, &models.Execution{ID: "exec-stored", EnvironmentID: env.ID, Status: models.ExecutionStatusQueued})
+
+	require.NoError(t, orch.CancelExecution(ctx, "exec-stored"))
+	stored, err := db.GetExecution(ctx, "exec-stored")
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusCanceled, stored.Status)
+}
+
+func TestRequeueExecution(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "requeue"})
+
+	// The submission is kept with the execution
+	submitted, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Timeout:       30,
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, submitted.ID)
+	stored, err := db.GetExecution(ctx, submitted.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.Submission)
+	assert.Equal(t, "python:3.12-slim", stored.Submission.Image)
+	assert.Equal(t, 30, stored.Submission.Timeout)
+
+	saveStoredExecution(t, db, &models.Execution{
+		ID:            "exec-failed",
+		EnvironmentID: env.ID,
+		Command:       []string{"make", "test"},
+		Env:           map[string]string{"CI": "1"},
+		Status:        models.ExecutionStatusFailed,
+		Metadata:      map[string]string{"run": "42"},
+		Submission:    &models.ExecutionSubmission{Image: "python:3.12-slim", Timeout: 30},
+	})
+	requeued, err := orch.RequeueExecution(ctx, "exec-failed", "user-456", false)
+	require.NoError(t, err)
+	assert.NotEqual(t, "exec-failed", requeued.ID)
+	assert.Equal(t, "exec-failed", requeued.RequeuedFrom)
+	done := waitForExecutionDone(t, orch, requeued.ID)
+	assert.Equal(t, []string{"make", "test"}, done.Command)
+	assert.Equal(t, "python:3.12-slim", done.EffectiveImage)
+	assert.Equal(t, "user-456", done.UserID)
+	assert.Equal(t, map[string]string{"run": "42"}, done.Metadata)
+	stored, err = db.GetExecution(ctx, requeued.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "exec-failed", stored.RequeuedFrom)
+
+	for id, exec := range map[string]*models.Execution{
+		"exec-completed": {Status: models.ExecutionStatusCompleted, Submission: &models.ExecutionSubmission{}},
+		"exec-queued":    {Status: models.ExecutionStatusQueued, Submission: &models.ExecutionSubmission{}},
+		"exec-files": {Status: models.ExecutionStatusFailed, Submission: &models.ExecutionSubmission{},
+			Files: []models.ExecutionFile{{Path: "input.txt", Size: 3}}},
+		"exec-unrecorded": {Status: models.ExecutionStatusFailed},
+	} {
+		exec.ID = id
+		exec.EnvironmentID = env.ID
+		saveStoredExecution(t, db, exec)
+		_, err := orch.RequeueExecution(ctx, id, "user-456", false)
+		assert.ErrorIs(t, err, apierrors.Conflict, id)
+		assert.Equal(t, apierrors.CodeExecutionNotRequeueable, apierrors.CodeOf(err), id)
+	}
+}
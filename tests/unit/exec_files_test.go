@@ -0,0 +1,201 @@
+package unit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+var inputFiles = map[string][]byte{
+	"main.py":            []byte("print('hi')\n"),
+	"fixtures/data.json": []byte(`{"n": 1}`),
+}
+
+// tarContents returns the regular files of a tar archive by name
+func tarContents(t *testing.T, archive []byte) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			content, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(content)
+		}
+	}
+}
+
+func TestValidateExecFiles(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	validate := func(files map[string][]byte) error {
+		return v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+			EnvironmentID: "env-1", Command: []string{"python", "main.py"}, Files: files,
+		})
+	}
+
+	assert.NoError(t, validate(inputFiles))
+
+	for _, p := range []string{"/etc/passwd", "../escape", "a/../../b", "a//b", "./a", ".", models.ExecFilesReadyMarker} {
+		err := validate(map[string][]byte{p: []byte("x")})
+		assert.Error(t, err, p)
+	}
+	err := validate(map[string][]byte{"lib": []byte("x"), "lib/util.py": []byte("y")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "which is a file")
+
+	v.SetMaxExecFilesBytes(8)
+	err = validate(inputFiles)
+	require.Error(t, err)
+	var verrs validator.ValidationErrors
+	require.ErrorAs(t, err, &verrs)
+	assert.Equal(t, "files", verrs[0].Field)
+	assert.Equal(t, validator.CodeOutOfRange, verrs[0].Code)
+
+	// 0 disables input files
+	v.SetMaxExecFilesBytes(0)
+	assert.Error(t, validate(map[string][]byte{"a": []byte("x")}))
+	assert.NoError(t, validate(nil))
+}
+
+func TestExecutionInputFiles(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	wantFiles := []models.ExecutionFile{{Path: "fixtures/data.json", Size: 8}, {Path: "main.py", Size: 12}}
+
+	t.Run("standby pod", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+			Name: "files-standby-env",
+			Pool: &models.PoolConfig{Enabled: true, Size: 1},
+		})
+		require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+		var mu sync.Mutex
+		var commands [][]string
+		mockK8s.SetExecHandler(func(_, _ string, command []string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			commands = append(commands, command)
+			return "ok\n", nil
+		})
+		defer mockK8s.SetExecHandler(nil)
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "main.py"}, Files: inputFiles,
+		}, "user-123")
+		require.NoError(t, err)
+		assert.Equal(t, wantFiles, exec.Files)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		require.Equal(t, models.ExecutionStatusCompleted, done.Status, done.Error)
+		assert.Equal(t, models.ExecutionModeStandby, done.Mode)
+
+		// The files are uploaded first; the second exec reads the execution env from stdin
+		stdin := mockK8s.ExecStdin(done.Namespace, done.PodName)
+		require.Len(t, stdin, 2)
+		assert.Equal(t, map[string]string{"main.py": "print('hi')\n", "fixtures/data.json": `{"n": 1}`}, tarContents(t, stdin[0]))
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, commands, 2)
+		assert.Equal(t, []string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, "/workspace", "python", "main.py"}, commands[1][8:])
+	})
+
+	t.Run("execution pod", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "files-pod-env"})
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "main.py"}, Files: inputFiles,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		require.Equal(t, models.ExecutionStatusCompleted, done.Status, done.Error)
+		assert.Equal(t, models.ExecutionModeEphemeral, done.Mode)
+
+		// The pod waits for the files before running the command in the working directory
+		spec := mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+		require.NotNil(t, spec)
+		require.Len(t, spec.Command, 6)
+		assert.Contains(t, spec.Command[2], models.ExecFilesReadyMarker)
+		assert.Equal(t, []string{"/workspace", "python", "main.py"}, spec.Command[3:])
+		stdin := mockK8s.ExecStdin(env.Namespace, exec.ID)
+		require.Len(t, stdin, 1)
+		assert.Len(t, tarContents(t, stdin[0]), 2)
+
+		stored, err := db.GetExecution(ctx, exec.ID)
+		require.NoError(t, err)
+		assert.Equal(t, wantFiles, stored.Files)
+	})
+
+	t.Run("write failure", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "files-fail-env"})
+		mockK8s.FailNext("ExecInPod", 1, errors.New("tar: not found"))
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "main.py"}, Files: inputFiles,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionStatusFailed, done.Status)
+		assert.Equal(t, apierrors.CodeExecFilesFailed, done.ErrorCode)
+		assert.Contains(t, done.Error, "failed to write input files: tar: not found")
+		assert.Nil(t, done.ExitCode)
+		require.Eventually(t, func() bool { return mockK8s.GetPodCount(env.Namespace) == 1 }, 5*time.Second, 20*time.Millisecond)
+
+		stored, err := db.GetExecution(ctx, exec.ID)
+		require.NoError(t, err)
+		assert.Equal(t, apierrors.CodeExecFilesFailed, stored.ErrorCode)
+	})
+}
+
+func TestSubmitExecutionFilesAPI(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "files-api-env"})
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler)
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/run", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Contents are base64 in JSON
+	rr := submit(`{"command": ["python", "main.py"], "files": {"main.py": "cHJpbnQoJ2hpJykK"}}`)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var got models.ExecutionResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&got))
+	done := waitForExecutionDone(t, orch, got.ID)
+	assert.Equal(t, []models.ExecutionFile{{Path: "main.py", Size: 12}}, done.Files)
+
+	rr = submit(`{"command": ["python", "main.py"], "files": {"../main.py": "cHJpbnQoJ2hpJykK"}}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "files.../main.py")
+}
@@ -0,0 +1,173 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	utilexec "k8s.io/client-go/util/exec"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+func TestExecutionModeRecorded(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "mode-env",
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	submit := func(image string) *models.Execution {
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"ls"}, Image: image,
+		}, "user-123")
+		require.NoError(t, err)
+		return waitForExecutionDone(t, orch, exec.ID)
+	}
+
+	// A warm standby pod serves the first execution
+	standby := submit("")
+	assert.Equal(t, models.ExecutionModeStandby, standby.Mode)
+	assert.True(t, standby.ServedFromPool)
+	assert.Nil(t, standby.PodStartedAt)
+
+	// An overridden image needs a pod of its own
+	ephemeral := submit("python:3.12-slim")
+	assert.Equal(t, models.ExecutionModeEphemeral, ephemeral.Mode)
+	assert.Equal(t, ephemeral.ID, ephemeral.PodName)
+	require.NotNil(t, ephemeral.PodScheduledAt)
+	require.NotNil(t, ephemeral.PodStartedAt)
+	assert.False(t, ephemeral.PodStartedAt.Before(*ephemeral.StartedAt))
+
+	// When the quota refuses the execution pod, the main pod runs it and the response says so
+	plain := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "fallback-env"})
+	// Let the pool refill first so the injected failure hits the execution pod
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+	mockK8s.FailNext("CreatePod", 1, apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota"))
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: plain.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	fallback := waitForExecutionDone(t, orch, exec.ID)
+	assert.Equal(t, models.ExecutionStatusCompleted, fallback.Status)
+	assert.Equal(t, models.ExecutionModeMainFallback, fallback.Mode)
+	assert.Equal(t, "main", fallback.PodName)
+	assert.Equal(t, models.MainFallbackWarning, models.NewExecutionResponse(fallback).Warning)
+	assert.Empty(t, models.NewExecutionResponse(ephemeral).Warning)
+
+	// The mode and pod timestamps are persisted
+	stored, err := db.GetExecution(ctx, ephemeral.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionModeEphemeral, stored.Mode)
+	require.NotNil(t, stored.PodStartedAt)
+	assert.WithinDuration(t, *ephemeral.PodStartedAt, *stored.PodStartedAt, time.Millisecond)
+
+	stats, err := orch.GetExecutionStats(ctx, env.ID, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{models.ExecutionModeStandby: 1, models.ExecutionModeEphemeral: 1}, stats.ByMode)
+	assert.Zero(t, stats.MainFallbacks)
+	assert.Equal(t, 2, stats.TimingSampleSize)
+	assert.GreaterOrEqual(t, stats.QueueP95Ms, stats.QueueP50Ms)
+
+	stats, err = orch.GetExecutionStats(ctx, plain.ID, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{models.ExecutionModeMainFallback: 1}, stats.ByMode)
+	assert.Equal(t, 1, stats.MainFallbacks)
+}
+
+func TestMainFallbackExecution(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "main-fallback-env"})
+	quota := apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota")
+	submit := func(command ...string) *models.Execution {
+		mockK8s.FailNext("CreatePod", 1, quota)
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: command,
+		}, "user-123")
+		require.NoError(t, err)
+		return exec
+	}
+
+	t.Run("exit code and stderr", func(t *testing.T) {
+		mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+			_, _ = io.WriteString(stderr, "no such file\n")
+			return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}
+		})
+		defer mockK8s.SetExecStreamHandler(nil)
+
+		done := waitForExecutionDone(t, orch, submit("cat", "missing").ID)
+		assert.Equal(t, models.ExecutionModeMainFallback, done.Mode)
+		assert.Equal(t, models.ExecutionStatusCompleted, done.Status)
+		require.NotNil(t, done.ExitCode)
+		assert.Equal(t, 2, *done.ExitCode)
+		assert.Equal(t, "no such file\n", done.Stderr)
+		assert.Empty(t, done.Error)
+	})
+
+	t.Run("cancel kills the command, not the main pod", func(t *testing.T) {
+		started := make(chan struct{})
+		killedCh := make(chan struct{})
+		var once sync.Once
+		var mu sync.Mutex
+		var killed []string
+		mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+			if isKillCommand(command) {
+				mu.Lock()
+				killed = append(killed, command[3])
+				mu.Unlock()
+				once.Do(func() { close(killedCh) })
+				return nil
+			}
+			close(started)
+			select {
+			case <-killedCh:
+				return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 143"), Code: 143}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		defer mockK8s.SetExecStreamHandler(nil)
+
+		exec := submit("sleep", "600")
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("command did not start")
+		}
+		require.NoError(t, orch.CancelExecution(ctx, exec.ID))
+
+		got, err := orch.GetExecution(ctx, exec.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.ExecutionStatusCanceled, got.Status)
+		assert.Equal(t, models.ExecutionModeMainFallback, got.Mode)
+		mu.Lock()
+		assert.Equal(t, []string{"/.agentbox-exec/" + exec.ID + ".pid"}, killed)
+		mu.Unlock()
+
+		// The environment and its main pod are untouched
+		_, err = mockK8s.GetPod(ctx, env.Namespace, "main")
+		require.NoError(t, err)
+		current, err := orch.GetEnvironment(ctx, env.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.StatusRunning, current.Status)
+
+		// The killed command's exit does not overwrite the cancellation
+		time.Sleep(50 * time.Millisecond)
+		got, err = orch.GetExecution(ctx, exec.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.ExecutionStatusCanceled, got.Status)
+		assert.Nil(t, got.ExitCode)
+	})
+}
@@ -0,0 +1,230 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func waitForExecutionDone(t *testing.T, orch *orchestrator.Orchestrator, execID string) *models.Execution {
+	t.Helper()
+	exec, done, err := orch.WaitForExecution(context.Background(), execID, 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, done, "execution %s did not finish", execID)
+	return exec
+}
+
+func TestExecutionOverridesRunInNewPod(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	// The standby pool must not serve overridden executions
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "override-env",
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"python", "train.py"},
+		Image:         "python:3.12-slim",
+		Resources:     &models.ResourceSpec{Memory: "1Gi"},
+		Isolation:     &models.IsolationConfig{RuntimeClass: "kata"},
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "python:3.12-slim", exec.EffectiveImage)
+	assert.Equal(t, &models.ResourceSpec{CPU: "500m", Memory: "1Gi", Storage: "1Gi"}, exec.EffectiveResources)
+
+	var spec *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		spec = mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+		return spec != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "python:3.12-slim", spec.Image)
+	assert.Equal(t, "500m", spec.CPU)
+	assert.Equal(t, "1Gi", spec.Memory)
+	assert.Equal(t, "kata", spec.RuntimeClass)
+
+	done := waitForExecutionDone(t, orch, exec.ID)
+	assert.False(t, done.ServedFromPool)
+	assert.Equal(t, 1, orch.GetPoolStatus()[env.ID])
+
+	// Without overrides the environment's values are recorded
+	plain, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{EnvironmentID: env.ID, Command: []string{"ls"}}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "python:3.11-slim", plain.EffectiveImage)
+	assert.Equal(t, &env.Resources, plain.EffectiveResources)
+}
+
+func TestExecutionOverrideQuota(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "quota-env"})
+
+	// The quota holds the main pod and one more 512Mi pod
+	_, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Resources:     &models.ResourceSpec{Memory: "2Gi"},
+	}, "user-123")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, apierrors.Unschedulable)
+	assert.Equal(t, apierrors.CodeExceedsEnvironmentQuota, apierrors.CodeOf(err))
+
+	// A pod refused by the quota at run time fails the execution instead of using the main pod
+	mockK8s.FailNext("CreatePod", 1, apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota"))
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	done := waitForExecutionDone(t, orch, exec.ID)
+	assert.Equal(t, models.ExecutionStatusFailed, done.Status)
+	assert.Contains(t, done.Error, "failed to create pod")
+}
+
+func TestExecutionOverridesPersisted(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "persist-env"})
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+		Resources:     &models.ResourceSpec{CPU: "250m"},
+	}, "user-123")
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	stored, err := db.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "python:3.12-slim", stored.EffectiveImage)
+	assert.Equal(t, &models.ResourceSpec{CPU: "250m", Memory: "512Mi", Storage: "1Gi"}, stored.EffectiveResources)
+}
+
+func TestExecutionEnvMergedWithEnvironmentIsCapped(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	envVars := make(map[string]string, validator.MaxEnvVars)
+	for i := 0; i < validator.MaxEnvVars; i++ {
+		envVars[fmt.Sprintf("ENV_%d", i)] = "x"
+	}
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "full-env", Env: envVars})
+
+	// Overriding an existing variable keeps the count; adding one exceeds the cap
+	_, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Env:           map[string]string{"ENV_0": "y"},
+	}, "user-123")
+	require.NoError(t, err)
+	_, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Env:           map[string]string{"EXTRA": "y"},
+	}, "user-123")
+	require.Error(t, err)
+	assert.Equal(t, apierrors.ValidationFailed, apierrors.KindOf(err))
+}
+
+func TestStandbyExecutionEnvMatchesExecutionPod(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("requires a POSIX shell")
+	}
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "pooled-env",
+		Env:  map[string]string{"SHARED": "from-env", "OVERRIDDEN": "from-env"},
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	var mu sync.Mutex
+	var pooledCommand []string
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		if command[len(command)-1] == "env" {
+			mu.Lock()
+			pooledCommand = command
+			mu.Unlock()
+		}
+		return nil
+	})
+	vars := map[string]string{"OVERRIDDEN": "from-exec", "QUOTED": "it's $HOME \"x\"\nsecond line"}
+
+	// A pooled execution and one in its own pod (resource overrides skip the pool)
+	pooled, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"env"}, Env: vars,
+	}, "user-123")
+	require.NoError(t, err)
+	pooledDone := waitForExecutionDone(t, orch, pooled.ID)
+	require.True(t, pooledDone.ServedFromPool)
+	ephemeral, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"env"}, Env: vars,
+		Resources: &models.ResourceSpec{Memory: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.False(t, waitForExecutionDone(t, orch, ephemeral.ID).ServedFromPool)
+	spec := mockK8s.CreatedPodSpec(env.Namespace, ephemeral.ID)
+	require.NotNil(t, spec)
+
+	// Run the pooled command as the pod would, with the stdin it was given, and read its env
+	mu.Lock()
+	command := pooledCommand
+	mu.Unlock()
+	require.NotEmpty(t, command)
+	stdin := mockK8s.ExecStdin(env.Namespace, pooledDone.PodName)
+	require.Len(t, stdin, 1)
+	assert.NotContains(t, strings.Join(command, " "), "from-exec", "values must not be part of the exec request")
+	run := exec.Command(command[0], command[1:]...)
+	run.Stdin = bytes.NewReader(stdin[0])
+	out, err := run.Output()
+	require.NoError(t, err)
+	observed := parseEnvOutput(string(out))
+
+	for name, value := range spec.Env {
+		if name == orchestrator.EnvVarExecutionID {
+			continue
+		}
+		assert.Equal(t, value, observed[name], name)
+	}
+	assert.Equal(t, pooled.ID, observed[orchestrator.EnvVarExecutionID])
+	assert.Equal(t, "from-exec", observed["OVERRIDDEN"])
+	assert.Equal(t, "from-env", observed["SHARED"])
+	assert.Equal(t, vars["QUOTED"], observed["QUOTED"])
+}
+
+// parseEnvOutput reads env(1) output, where a line without '=' continues the previous value
+func parseEnvOutput(out string) map[string]string {
+	vars := make(map[string]string)
+	var last string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if name, value, ok := strings.Cut(line, "="); ok && !strings.ContainsAny(name, " \"'") {
+			vars[name] = value
+			last = name
+		} else if last != "" {
+			vars[last] += "\n" + line
+		}
+	}
+	return vars
+}
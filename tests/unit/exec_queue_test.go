@@ -0,0 +1,282 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// gatedExecs makes the mock's execs block until released, recording the order they start in
+type gatedExecs struct {
+	mu      sync.Mutex
+	started []string
+	active  int
+	peak    int
+	release chan struct{}
+}
+
+func newGatedExecs(mockK8s *mocks.MockK8sClient) *gatedExecs {
+	g := &gatedExecs{release: make(chan struct{})}
+	mockK8s.SetExecHandler(func(_, _ string, command []string) (string, error) {
+		name := strings.Join(userCommand(command), " ")
+		g.mu.Lock()
+		g.started = append(g.started, name)
+		g.active++
+		g.peak = max(g.peak, g.active)
+		g.mu.Unlock()
+
+		<-g.release
+
+		g.mu.Lock()
+		g.active--
+		g.mu.Unlock()
+		return name, nil
+	})
+	return g
+}
+
+// userCommand strips the wrapper that records a command's PID (see isKillCommand)
+func userCommand(command []string) []string {
+	if len(command) > 4 && command[0] == "/bin/sh" && strings.HasPrefix(command[3], "/.agentbox-exec/") {
+		return command[4:]
+	}
+	return command
+}
+
+func (g *gatedExecs) startedCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.started)
+}
+
+func waitForQueued(t *testing.T, orch *orchestrator.Orchestrator, envID string, queued int) {
+	require.Eventually(t, func() bool {
+		stats, err := orch.ExecQueueStats(context.Background(), envID)
+		return err == nil && stats.Queued == queued
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestSerializedExecsRunInArrivalOrder(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "serial-env"})
+	assert.Equal(t, models.ExecModeSerialized, env.ExecMode)
+	gate := newGatedExecs(mockK8s)
+
+	// Each exec is submitted once the previous one is running or queued
+	commands := []string{"first", "second", "third", "fourth", "fifth"}
+	responses := make([]*models.ExecResponse, len(commands))
+	var wg sync.WaitGroup
+	for i, command := range commands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := orch.ExecuteCommand(ctx, env.ID, []string{command}, 30)
+			assert.NoError(t, err)
+			responses[i] = resp
+		}()
+		if i == 0 {
+			require.Eventually(t, func() bool { return gate.startedCount() == 1 }, 5*time.Second, 5*time.Millisecond)
+		} else {
+			waitForQueued(t, orch, env.ID, i)
+		}
+	}
+
+	stats, err := orch.ExecQueueStats(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Running)
+	assert.Equal(t, len(commands)-1, stats.Queued)
+	assert.Equal(t, 1, gate.startedCount(), "queued execs must not start while one is running")
+
+	close(gate.release)
+	wg.Wait()
+
+	assert.Equal(t, commands, gate.started)
+	assert.Equal(t, 1, gate.peak)
+	for i, resp := range responses {
+		require.NotNil(t, resp)
+		assert.Equal(t, commands[i], resp.Stdout)
+		assert.Equal(t, i, resp.QueuePosition)
+	}
+
+	stats, err = orch.ExecQueueStats(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Running)
+	assert.Zero(t, stats.Queued)
+}
+
+func TestParallelExecMode(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "parallel-env", ExecMode: models.ExecModeParallel})
+	gate := newGatedExecs(mockK8s)
+
+	var wg sync.WaitGroup
+	for _, command := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := orch.ExecuteCommand(ctx, env.ID, []string{command}, 30)
+			assert.NoError(t, err)
+		}()
+	}
+	require.Eventually(t, func() bool { return gate.startedCount() == 3 }, 5*time.Second, 5*time.Millisecond)
+	stats, err := orch.ExecQueueStats(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecModeParallel, stats.ExecMode)
+	assert.Equal(t, 3, stats.Running)
+	assert.Zero(t, stats.Queued)
+
+	close(gate.release)
+	wg.Wait()
+	assert.Equal(t, 3, gate.peak)
+}
+
+func TestExecQueueTimeoutAndDepth(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "queue-env"})
+	orch.UpdateConfig(&config.Config{
+		Kubernetes: config.KubernetesConfig{NamespacePrefix: "test-", RuntimeClass: "gvisor"},
+		Timeouts:   config.TimeoutConfig{DefaultTimeout: 60, MaxTimeout: 3600, StartupTimeout: 60},
+		Executions: config.ExecutionConfig{MaxQueueDepth: 1},
+	})
+	gate := newGatedExecs(mockK8s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := orch.ExecuteCommand(ctx, env.ID, []string{"long"}, 30)
+		assert.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool { return gate.startedCount() == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	// A queued exec gives up when its own timeout expires
+	start := time.Now()
+	_, err := orch.ExecuteCommand(ctx, env.ID, []string{"waits"}, 1)
+	require.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	var queueErr *orchestrator.ExecQueueError
+	require.True(t, errors.As(err, &queueErr))
+	assert.False(t, queueErr.Full)
+	assert.Equal(t, 1, queueErr.Ahead)
+	assert.Equal(t, http.StatusRequestTimeout, apierrors.HTTPStatus(err))
+	assert.Equal(t, apierrors.CodeExecQueueTimeout, apierrors.CodeOf(err))
+
+	// The queue holds one waiting exec; the next one is turned away
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := orch.ExecuteCommand(ctx, env.ID, []string{"queued"}, 30)
+		waiting <- err
+	}()
+	waitForQueued(t, orch, env.ID, 1)
+	_, err = orch.ExecuteCommand(ctx, env.ID, []string{"rejected"}, 30)
+	require.True(t, errors.As(err, &queueErr))
+	assert.True(t, queueErr.Full)
+	assert.Equal(t, http.StatusTooManyRequests, apierrors.HTTPStatus(err))
+	assert.Equal(t, apierrors.CodeExecQueueFull, apierrors.CodeOf(err))
+
+	close(gate.release)
+	<-done
+	assert.NoError(t, <-waiting)
+	assert.Equal(t, []string{"long", "queued"}, gate.started)
+}
+
+func TestExecModeValidationAndUpdate(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	err := v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name:      "bad-mode",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		ExecMode:  "sometimes",
+	})
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+	require.Len(t, verrs, 1)
+	assert.Equal(t, "exec_mode", verrs[0].Field)
+
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "mode-env"})
+
+	bad := "sometimes"
+	_, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{ExecMode: &bad})
+	assert.Equal(t, http.StatusBadRequest, apierrors.HTTPStatus(err))
+
+	parallel := models.ExecModeParallel
+	updated, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{ExecMode: &parallel})
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecModeParallel, updated.ExecMode)
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecModeParallel, stored.ExecMode)
+
+	// An empty mode restores the default
+	reset := ""
+	updated, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{ExecMode: &reset})
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecModeSerialized, updated.ExecMode)
+}
+
+func TestExecQueueAPI(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "api-queue-env"})
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	gate := newGatedExecs(mockK8s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := orch.ExecuteCommand(ctx, env.ID, []string{"long"}, 30)
+		assert.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool { return gate.startedCount() == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/exec",
+		strings.NewReader(`{"command": ["waits"], "timeout": 1}`))
+	req = mux.SetURLVars(req, map[string]string{"id": env.ID})
+	rr := httptest.NewRecorder()
+	handler.ExecuteCommand(rr, req)
+	require.Equal(t, http.StatusRequestTimeout, rr.Code, rr.Body.String())
+	assert.Equal(t, "1", rr.Header().Get("X-Exec-Queue-Ahead"))
+	assert.Equal(t, "0", rr.Header().Get("X-Exec-Queue-Length"))
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apierrors.CodeExecQueueTimeout, errResp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/exec/queue", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": env.ID})
+	rr = httptest.NewRecorder()
+	handler.GetExecQueue(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stats models.ExecQueueStats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+	assert.Equal(t, models.ExecModeSerialized, stats.ExecMode)
+	assert.Equal(t, 1, stats.Running)
+
+	close(gate.release)
+	<-done
+}
@@ -0,0 +1,147 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// execSecurityConfig hardens execution pods
+func execSecurityConfig() *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.ExecSecurity = config.ExecSecurityConfig{
+		Enabled:                true,
+		DropCapabilities:       []string{"ALL"},
+		RunAsNonRoot:           true,
+		RunAsUser:              65534,
+		ReadOnlyRootFilesystem: true,
+		ScratchPath:            "/tmp",
+		SeccompProfile:         models.SeccompRuntimeDefault,
+	}
+	return cfg
+}
+
+func execPodSpec(t *testing.T, orch *orchestrator.Orchestrator, mockK8s *mocks.MockK8sClient, env *models.Environment, req *orchestrator.EphemeralExecRequest) *k8s.PodSpec {
+	req.EnvironmentID = env.ID
+	req.Command = []string{"ls"}
+	exec, err := orch.SubmitExecution(context.Background(), req, "user-123")
+	require.NoError(t, err)
+	var spec *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		spec = mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+		return spec != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	return spec
+}
+
+func TestExecutionPodsGetStricterSecurityContext(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, execSecurityConfig(), nil)
+	uid := int64(0)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "exec-security-env",
+		Isolation: &models.IsolationConfig{SecurityContext: &models.SecurityContextConfig{
+			RunAsUser:    &uid,
+			Capabilities: &models.CapabilitiesConfig{Add: []string{"NET_ADMIN"}},
+		}},
+	})
+
+	// The main pod keeps the environment's security context
+	main := mockK8s.CreatedPodSpec(env.Namespace, "main")
+	require.NotNil(t, main)
+	require.NotNil(t, main.SecurityContext)
+	assert.Equal(t, []string{"NET_ADMIN"}, main.SecurityContext.Capabilities.Add)
+	assert.Empty(t, main.ScratchDirs)
+
+	spec := execPodSpec(t, orch, mockK8s, env, &orchestrator.EphemeralExecRequest{})
+	sc := spec.SecurityContext
+	require.NotNil(t, sc)
+	require.NotNil(t, sc.Capabilities)
+	assert.Empty(t, sc.Capabilities.Add)
+	assert.Equal(t, []string{"ALL"}, sc.Capabilities.Drop)
+	require.NotNil(t, sc.RunAsNonRoot)
+	assert.True(t, *sc.RunAsNonRoot)
+	require.NotNil(t, sc.RunAsUser)
+	assert.EqualValues(t, 65534, *sc.RunAsUser)
+	require.NotNil(t, sc.ReadOnlyRootFilesystem)
+	assert.True(t, *sc.ReadOnlyRootFilesystem)
+	assert.Equal(t, models.SeccompRuntimeDefault, sc.SeccompProfile)
+	assert.Equal(t, []string{"/tmp", "/workspace"}, spec.ScratchDirs)
+}
+
+func TestExecutionPodsInheritSecurityContext(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, execSecurityConfig(), nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:      "exec-inherit-env",
+		Isolation: &models.IsolationConfig{ExecInheritSecurityContext: true},
+	})
+
+	spec := execPodSpec(t, orch, mockK8s, env, &orchestrator.EphemeralExecRequest{})
+	assert.Nil(t, spec.SecurityContext)
+	assert.Empty(t, spec.ScratchDirs)
+}
+
+func TestExecutionSecurityContextCannotEscalate(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, execSecurityConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "exec-escalate-env"})
+
+	root := int64(0)
+	escalate := true
+	for name, sc := range map[string]*models.SecurityContextConfig{
+		"root user":      {RunAsUser: &root},
+		"escalation":     {AllowPrivilegeEscalation: &escalate},
+		"capability add": {Capabilities: &models.CapabilitiesConfig{Add: []string{"SYS_ADMIN"}}},
+		"unconfined":     {SeccompProfile: models.SeccompUnconfined},
+	} {
+		_, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID,
+			Command:       []string{"ls"},
+			Isolation:     &models.IsolationConfig{SecurityContext: sc},
+		}, "user-123")
+		require.Error(t, err, name)
+		assert.Equal(t, apierrors.ValidationFailed, apierrors.KindOf(err), name)
+	}
+
+	// Tightening the context is allowed and merged with the environment's
+	uid := int64(1000)
+	spec := execPodSpec(t, orch, mockK8s, env, &orchestrator.EphemeralExecRequest{
+		Isolation: &models.IsolationConfig{SecurityContext: &models.SecurityContextConfig{RunAsUser: &uid}},
+	})
+	require.NotNil(t, spec.SecurityContext.RunAsUser)
+	assert.EqualValues(t, 1000, *spec.SecurityContext.RunAsUser)
+}
+
+func TestValidateExecSecurityFields(t *testing.T) {
+	v := validator.New(10000, 64*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	require.NoError(t, v.ValidateIsolation(&models.IsolationConfig{SecurityContext: &models.SecurityContextConfig{
+		Capabilities:   &models.CapabilitiesConfig{Add: []string{"NET_BIND_SERVICE"}, Drop: []string{"ALL"}},
+		SeccompProfile: models.SeccompRuntimeDefault,
+	}}))
+
+	for name, tc := range map[string]struct {
+		sc    *models.SecurityContextConfig
+		field string
+	}{
+		"bad capability": {&models.SecurityContextConfig{Capabilities: &models.CapabilitiesConfig{Add: []string{"net admin"}}},
+			"isolation.security_context.capabilities.add[0]"},
+		"bad seccomp": {&models.SecurityContextConfig{SeccompProfile: "Localhost"}, "isolation.security_context.seccomp_profile"},
+	} {
+		err := v.ValidateIsolation(&models.IsolationConfig{SecurityContext: tc.sc})
+		require.Error(t, err, name)
+		var verrs validator.ValidationErrors
+		require.ErrorAs(t, err, &verrs, name)
+		assert.Equal(t, tc.field, verrs[0].Field, name)
+	}
+}
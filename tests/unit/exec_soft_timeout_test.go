@@ -0,0 +1,167 @@
+package unit
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// softTimeoutConfig sends SIGUSR1 to commands halfway through their timeout
+func softTimeoutConfig() *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Executions = config.ExecutionConfig{SoftTimeoutPercent: 50, SoftTimeoutSignal: "USR1"}
+	return cfg
+}
+
+// isSoftTimeoutCommand reports whether command is the orchestrator's soft timeout signal
+func isSoftTimeoutCommand(command []string) bool {
+	return len(command) >= 3 && command[0] == "/bin/sh" && strings.Contains(command[2], `kill -s "$`)
+}
+
+// eventTypes returns the types of an execution's events, in order
+func eventTypes(exec *models.Execution) []string {
+	var types []string
+	for _, e := range exec.Events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestExecutionSoftTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, softTimeoutConfig(), db)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var signals [][]string
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		if isSoftTimeoutCommand(command) {
+			mu.Lock()
+			signals = append(signals, command)
+			mu.Unlock()
+			return nil
+		}
+		return writeThenBlock(ctx, command, stdout, stderr)
+	})
+	defer mockK8s.SetExecStreamHandler(nil)
+	takeSignals := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := signals
+		signals = nil
+		return got
+	}
+
+	t.Run("main pod commands are signaled before they are killed", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "soft-main-env"})
+		mockK8s.FailNext("CreatePod", 1, apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota"))
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "train.py"}, Timeout: 2,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, apierrors.CodeExecTimedOut, done.ErrorCode)
+		assert.Equal(t, []string{
+			models.ExecutionEventQueued, models.ExecutionEventStarted,
+			models.ExecutionEventSoftTimeoutWarned, models.ExecutionEventKilled,
+		}, eventTypes(done))
+		assert.Contains(t, done.Events[2].Message, "SIGUSR1")
+		assert.Equal(t, "timed out", done.Events[3].Message)
+		assert.False(t, done.Events[2].At.Before(done.Events[1].At.Add(900*time.Millisecond)))
+
+		// The command run by the PID-recording shell gets the signal
+		got := takeSignals()
+		require.Len(t, got, 1)
+		assert.Equal(t, []string{"/.agentbox-exec/" + exec.ID + ".pid", "USR1"}, got[0][3:])
+	})
+
+	t.Run("execution pods are signaled at PID 1", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "soft-pod-env"})
+		mockK8s.SetHoldPodCompletion(true)
+		defer mockK8s.SetHoldPodCompletion(false)
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "train.py"}, Timeout: 2,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionModeEphemeral, done.Mode)
+		assert.Contains(t, eventTypes(done), models.ExecutionEventSoftTimeoutWarned)
+		got := takeSignals()
+		require.Len(t, got, 1)
+		assert.Equal(t, []string{"/bin/sh", "-c", `kill -s "$0" 1`, "USR1"}, got[0])
+
+		// The events are persisted
+		stored, err := db.GetExecution(ctx, exec.ID)
+		require.NoError(t, err)
+		assert.Equal(t, eventTypes(done), eventTypes(stored))
+	})
+
+	t.Run("requests can skip the soft timeout", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "soft-skip-env"})
+		mockK8s.FailNext("CreatePod", 1, apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota"))
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "train.py"}, Timeout: 2, SkipSoftTimeout: true,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, []string{
+			models.ExecutionEventQueued, models.ExecutionEventStarted, models.ExecutionEventKilled,
+		}, eventTypes(done))
+		assert.Empty(t, takeSignals())
+	})
+
+	t.Run("executions that finish in time are never signaled", func(t *testing.T) {
+		mockK8s.SetExecStreamHandler(nil)
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "soft-fast-env"})
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"echo", "hi"}, Timeout: 2,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionStatusCompleted, done.Status)
+		// Past the point the warning was due
+		time.Sleep(1500 * time.Millisecond)
+		got, err := orch.GetExecution(ctx, exec.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{models.ExecutionEventQueued, models.ExecutionEventStarted}, eventTypes(got))
+	})
+}
+
+func TestSoftTimeoutConfigValidation(t *testing.T) {
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	t.Setenv("AGENTBOX_EXEC_SOFT_TIMEOUT_PERCENT", "100")
+	_, err := config.Load("")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "soft_timeout_percent must be between 0 and 99")
+
+	t.Setenv("AGENTBOX_EXEC_SOFT_TIMEOUT_PERCENT", "80")
+	t.Setenv("AGENTBOX_EXEC_SOFT_TIMEOUT_SIGNAL", "KILL")
+	_, err = config.Load("")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "soft_timeout_signal must be one of")
+
+	t.Setenv("AGENTBOX_EXEC_SOFT_TIMEOUT_SIGNAL", "INT")
+	cfg, err := config.Load("")
+	require.NoError(t, err)
+	assert.Equal(t, 80, cfg.Executions.SoftTimeoutPercent)
+	assert.Equal(t, "INT", cfg.Executions.SoftTimeoutSignal)
+}
@@ -0,0 +1,396 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	utilexec "k8s.io/client-go/util/exec"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// isKillCommand reports whether command is the orchestrator's kill of a timed-out command
+func isKillCommand(command []string) bool {
+	return len(command) == 4 && strings.Contains(command[2], "kill -KILL")
+}
+
+// writeThenBlock writes partial output and then hangs until the exec deadline passes; kills of
+// timed-out commands return at once
+func writeThenBlock(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+	if isKillCommand(command) {
+		return nil
+	}
+	_, _ = io.WriteString(stdout, "partial\n")
+	_, _ = io.WriteString(stderr, "warming up\n")
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestExecuteCommandTimeoutReturnsPartialOutput(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "timeout-env"})
+	var mu sync.Mutex
+	var commands [][]string
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		mu.Lock()
+		commands = append(commands, command)
+		mu.Unlock()
+		return writeThenBlock(ctx, command, stdout, stderr)
+	})
+	// takeCommands returns the commands run since the last call
+	takeCommands := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := commands
+		commands = nil
+		return got
+	}
+
+	resp, err := orch.ExecuteCommand(context.Background(), env.ID, []string{"python", "loop.py"}, 1)
+	require.NoError(t, err)
+	assert.True(t, resp.TimedOut)
+	assert.Nil(t, resp.ExitCode)
+	assert.Equal(t, "partial\n", resp.Stdout)
+	assert.Equal(t, "warming up\n", resp.Stderr)
+	assert.GreaterOrEqual(t, resp.DurationMs, int64(1000))
+
+	// The timed-out command is killed before the next exec's turn
+	got := takeCommands()
+	require.Len(t, got, 2)
+	assert.True(t, isKillCommand(got[1]))
+	assert.Equal(t, got[0][3], got[1][3])
+
+	t.Run("streaming", func(t *testing.T) {
+		var stdout bytes.Buffer
+		resp, err := orch.ExecuteCommandStream(context.Background(), env.ID, []string{"python", "loop.py"}, 1, &stdout, io.Discard)
+		require.NoError(t, err)
+		assert.True(t, resp.TimedOut)
+		assert.Nil(t, resp.ExitCode)
+		assert.Equal(t, "partial\n", stdout.String())
+
+		got := takeCommands()
+		require.Len(t, got, 2)
+		assert.Equal(t, []string{"python", "loop.py"}, got[0][4:])
+		assert.True(t, isKillCommand(got[1]))
+		assert.Equal(t, got[0][3], got[1][3])
+	})
+
+	t.Run("API responds 200 with timed_out", func(t *testing.T) {
+		log, err := logger.NewDevelopment()
+		require.NoError(t, err)
+		handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+		router := api.NewRouter(handler)
+
+		body, _ := json.Marshal(models.ExecRequest{Command: []string{"python", "loop.py"}, Timeout: 1})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/exec", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var got map[string]interface{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+		assert.Equal(t, true, got["timed_out"])
+		assert.Contains(t, got, "exit_code")
+		assert.Nil(t, got["exit_code"])
+		assert.Equal(t, "partial\n", got["stdout"])
+	})
+}
+
+func TestExecutionTimeoutKeepsPartialOutput(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	t.Run("standby pod", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+			Name: "timeout-standby-env",
+			Pool: &models.PoolConfig{Enabled: true, Size: 1},
+		})
+		require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+		var mu sync.Mutex
+		var commands [][]string
+		mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+			mu.Lock()
+			commands = append(commands, command)
+			mu.Unlock()
+			return writeThenBlock(ctx, command, stdout, stderr)
+		})
+		defer mockK8s.SetExecStreamHandler(nil)
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "loop.py"}, Timeout: 1,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionStatusFailed, done.Status)
+		assert.Equal(t, "timed out", done.Error)
+		assert.Equal(t, apierrors.CodeExecTimedOut, done.ErrorCode)
+		assert.Equal(t, models.ExecutionModeStandby, done.Mode)
+		assert.Equal(t, "partial\n", done.Stdout)
+		assert.Equal(t, "warming up\n", done.Stderr)
+		assert.Nil(t, done.ExitCode)
+		assert.NotNil(t, done.CompletedAt)
+
+		// The command (inside the wrapper applying the execution's variables) records its PID and
+		// is killed through it before the pod is deleted
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, commands, 2)
+		pidFile := "/.agentbox-exec/" + exec.ID + ".pid"
+		killable := commands[0][4:]
+		assert.Equal(t, pidFile, killable[3])
+		assert.Equal(t, []string{"python", "loop.py"}, killable[4:])
+		assert.True(t, isKillCommand(commands[1]))
+		assert.Equal(t, pidFile, commands[1][3])
+	})
+
+	t.Run("main pod fallback", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "timeout-main-env"})
+		var mu sync.Mutex
+		var killed []string
+		mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+			if isKillCommand(command) {
+				mu.Lock()
+				killed = append(killed, command[3])
+				mu.Unlock()
+			}
+			return writeThenBlock(ctx, command, stdout, stderr)
+		})
+		defer mockK8s.SetExecStreamHandler(nil)
+		mockK8s.FailNext("CreatePod", 1, apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota"))
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "loop.py"}, Timeout: 1,
+		}, "user-123")
+		require.NoError(t, err)
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionModeMainFallback, done.Mode)
+		assert.Equal(t, apierrors.CodeExecTimedOut, done.ErrorCode)
+		assert.Equal(t, "partial\n", done.Stdout)
+		// The shared main pod stays, with the command killed
+		assert.Equal(t, 1, mockK8s.GetPodCount(env.Namespace))
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []string{"/.agentbox-exec/" + exec.ID + ".pid"}, killed)
+	})
+
+	t.Run("execution pod", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "timeout-pod-env"})
+		mockK8s.SetHoldPodCompletion(true)
+		defer mockK8s.SetHoldPodCompletion(false)
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "loop.py"}, Timeout: 1,
+		}, "user-123")
+		require.NoError(t, err)
+		mockK8s.SetPodLogs(env.Namespace, exec.ID, "epoch 1\n")
+
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionStatusFailed, done.Status)
+		assert.Equal(t, "timed out", done.Error)
+		assert.Equal(t, apierrors.CodeExecTimedOut, done.ErrorCode)
+		assert.Equal(t, "epoch 1\n", done.Stdout)
+		assert.Nil(t, done.ExitCode)
+		// The execution pod is deleted by the time the timeout is recorded; the main pod remains
+		assert.Equal(t, 1, mockK8s.GetPodCount(env.Namespace))
+	})
+}
+
+func TestTimedOutCommandsThatCannotBeKilled(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	t.Run("images without a shell run the command directly", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "noshell-env", Image: "gcr.io/distroless/static"})
+		var mu sync.Mutex
+		var commands [][]string
+		mockK8s.SetNoShell(true)
+		defer mockK8s.SetNoShell(false)
+		mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+			mu.Lock()
+			commands = append(commands, command)
+			mu.Unlock()
+			return writeThenBlock(ctx, command, stdout, stderr)
+		})
+		defer mockK8s.SetExecStreamHandler(nil)
+
+		resp, err := orch.ExecuteCommand(ctx, env.ID, []string{"/app/server"}, 1)
+		require.NoError(t, err)
+		assert.True(t, resp.TimedOut)
+		assert.True(t, resp.StillRunning, "the kill cannot be delivered without a shell")
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, [][]string{{"/app/server"}}, commands)
+	})
+
+	t.Run("a missing PID is reported on the execution", func(t *testing.T) {
+		env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "nopid-env"})
+		mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+			if isKillCommand(command) {
+				return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 3"), Code: 3}
+			}
+			return writeThenBlock(ctx, command, stdout, stderr)
+		})
+		defer mockK8s.SetExecStreamHandler(nil)
+		mockK8s.FailNext("CreatePod", 1, apierrors.New(apierrors.QuotaExceeded, apierrors.CodePodQuotaExceeded, "exceeded quota"))
+
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"python", "loop.py"}, Timeout: 1,
+		}, "user-123")
+		require.NoError(t, err)
+		assert.Equal(t, models.ExecutionModeMainFallback, waitForExecutionDone(t, orch, exec.ID).Mode)
+
+		var events []string
+		require.Eventually(t, func() bool {
+			got, err := orch.GetExecution(ctx, exec.ID)
+			require.NoError(t, err)
+			events = events[:0]
+			for _, e := range got.Events {
+				events = append(events, e.Type)
+			}
+			return slices.Contains(events, models.ExecutionEventKillFailed)
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, models.ExecutionEventKilled, events[len(events)-2])
+	})
+}
+
+func TestExecuteCommandStopsWhenClientDisconnects(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "disconnect-env"})
+
+	started := make(chan struct{})
+	execCanceled := make(chan error, 1)
+	var mu sync.Mutex
+	var commands [][]string
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		mu.Lock()
+		commands = append(commands, command)
+		mu.Unlock()
+		if isKillCommand(command) {
+			return nil
+		}
+		_, _ = io.WriteString(stdout, "working\n")
+		close(started)
+		<-ctx.Done()
+		execCanceled <- ctx.Err()
+		return ctx.Err()
+	})
+
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, _ := json.Marshal(models.ExecRequest{Command: []string{"python", "serve.py"}, Timeout: 600})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/exec", bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		router.ServeHTTP(rr, req)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not start")
+	}
+	cancel()
+
+	// The remote exec sees the cancellation, not the 600s deadline
+	select {
+	case err := <-execCanceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ExecInPod was not canceled")
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client disconnected")
+	}
+
+	// The command was started through its PID file and killed through it
+	mu.Lock()
+	require.Len(t, commands, 2)
+	assert.Equal(t, []string{"python", "serve.py"}, commands[0][4:])
+	assert.True(t, isKillCommand(commands[1]))
+	assert.Equal(t, commands[0][3], commands[1][3])
+	mu.Unlock()
+
+	entries, err := db.ListAuditEntries(context.Background(), database.AuditFilter{Action: orchestrator.AuditActionExecCanceled})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, env.ID, entries[0].ResourceID)
+	assert.Equal(t, `["python","serve.py"]`, entries[0].Details)
+
+	// The environment's exec queue is free again
+	stats, err := orch.ExecQueueStats(context.Background(), env.ID)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Running)
+}
+
+func TestExecuteCommandStreamStopsWhenClientDisconnects(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "stream-disconnect-env"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	var commands [][]string
+	mockK8s.SetExecStreamHandler(func(execCtx context.Context, command []string, stdout, stderr io.Writer) error {
+		mu.Lock()
+		commands = append(commands, command)
+		mu.Unlock()
+		if isKillCommand(command) {
+			return nil
+		}
+		_, _ = io.WriteString(stdout, "working\n")
+		cancel()
+		<-execCtx.Done()
+		return execCtx.Err()
+	})
+
+	var stdout bytes.Buffer
+	_, err := orch.ExecuteCommandStream(ctx, env.ID, []string{"python", "serve.py"}, 600, &stdout, io.Discard)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "working\n", stdout.String())
+
+	// The command was started through its PID file and killed through it
+	mu.Lock()
+	require.Len(t, commands, 2)
+	assert.Equal(t, []string{"python", "serve.py"}, commands[0][4:])
+	assert.True(t, isKillCommand(commands[1]))
+	assert.Equal(t, commands[0][3], commands[1][3])
+	mu.Unlock()
+
+	entries, err := db.ListAuditEntries(context.Background(), database.AuditFilter{Action: orchestrator.AuditActionExecCanceled})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, `["python","serve.py"]`, entries[0].Details)
+}
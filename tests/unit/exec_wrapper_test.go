@@ -0,0 +1,130 @@
+package unit
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/execwrapper"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+func TestExecWrapperFooter(t *testing.T) {
+	result := &execwrapper.Result{
+		ExitCode:       3,
+		StartedAt:      time.Date(2026, 1, 22, 10, 0, 0, 0, time.UTC),
+		FinishedAt:     time.Date(2026, 1, 22, 10, 0, 2, 0, time.UTC),
+		CPUSeconds:     1.25,
+		MaxMemoryBytes: 64 << 20,
+	}
+	footer, err := execwrapper.Footer(result)
+	require.NoError(t, err)
+
+	for _, output := range []string{"", "hello\n", "no trailing newline", "noisy\n" + execwrapper.FooterMarker + " nonsense\n"} {
+		rest, parsed, ok := execwrapper.ParseFooter(output + string(footer))
+		require.True(t, ok, output)
+		assert.Equal(t, output, rest)
+		assert.Equal(t, result, parsed)
+	}
+
+	// A TTY turns newlines into CRLF
+	crlf := strings.ReplaceAll("hello\n"+string(footer), "\n", "\r\n")
+	rest, parsed, ok := execwrapper.ParseFooter(crlf)
+	require.True(t, ok)
+	assert.Equal(t, "hello\r\n", rest)
+	assert.Equal(t, 3, parsed.ExitCode)
+
+	// Output after the footer, or a footer that is not a line of its own, is no result
+	for _, logs := range []string{
+		"hello\n",
+		string(footer) + "more output\n",
+		"hello " + strings.TrimPrefix(string(footer), "\n"),
+		"\n" + execwrapper.FooterMarker + " {not json\n",
+	} {
+		rest, parsed, ok := execwrapper.ParseFooter(logs)
+		assert.False(t, ok, logs)
+		assert.Nil(t, parsed)
+		assert.Equal(t, logs, rest)
+	}
+}
+
+func TestExecWrapperExecution(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	orch.UpdateConfig(&config.Config{
+		Kubernetes: config.KubernetesConfig{NamespacePrefix: "test-", RuntimeClass: "gvisor"},
+		Timeouts:   config.TimeoutConfig{DefaultTimeout: 60, MaxTimeout: 3600, StartupTimeout: 60},
+		Executions: config.ExecutionConfig{Wrapper: config.ExecWrapperConfig{
+			Enabled: true, Image: "agentbox:latest", Path: "/app/agentbox-wrapper",
+		}},
+	})
+
+	// Every pod prints what the wrapper would: the command's output, then the footer
+	footer, err := execwrapper.Footer(&execwrapper.Result{ExitCode: 2, CPUSeconds: 0.5, MaxMemoryBytes: 1 << 20})
+	require.NoError(t, err)
+	mockK8s.SetCompletionLogSource(func(string, string) io.Reader {
+		return strings.NewReader("computing\n" + string(footer))
+	})
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "wrapped-env"})
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"python", "job.py"},
+	}, "user-123")
+	require.NoError(t, err)
+	done := waitForExecutionDone(t, orch, exec.ID)
+
+	spec := mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+	require.NotNil(t, spec)
+	require.NotNil(t, spec.Wrapper)
+	assert.Equal(t, "agentbox:latest", spec.Wrapper.Image)
+	assert.Equal(t, []string{"python", "job.py"}, spec.Command)
+
+	require.NotNil(t, done.ExitCode)
+	assert.Equal(t, 2, *done.ExitCode)
+	assert.Equal(t, "computing\n", done.Stdout)
+	assert.Equal(t, int64(len("computing\n")), done.StdoutBytesTotal)
+	require.NotNil(t, done.CPUSeconds)
+	assert.Equal(t, 0.5, *done.CPUSeconds)
+	require.NotNil(t, done.MaxMemoryBytes)
+	assert.Equal(t, int64(1<<20), *done.MaxMemoryBytes)
+	resp := models.NewExecutionResponse(done)
+	assert.Equal(t, done.CPUSeconds, resp.CPUSeconds)
+	assert.Equal(t, done.MaxMemoryBytes, resp.MaxMemoryBytes)
+
+	// Environments whose image cannot run the wrapper opt out
+	plain := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:      "plain-env",
+		Isolation: &models.IsolationConfig{DisableExecWrapper: true},
+	})
+	exec, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: plain.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	done = waitForExecutionDone(t, orch, exec.ID)
+	spec = mockK8s.CreatedPodSpec(plain.Namespace, exec.ID)
+	require.NotNil(t, spec)
+	assert.Nil(t, spec.Wrapper)
+	assert.Nil(t, done.CPUSeconds)
+	assert.Nil(t, done.MaxMemoryBytes)
+}
+
+func TestExecWrapperConfigValidation(t *testing.T) {
+	t.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	t.Setenv("AGENTBOX_EXEC_WRAPPER_ENABLED", "true")
+	_, err := config.Load("")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wrapper needs exactly one of image and config_map")
+
+	t.Setenv("AGENTBOX_EXEC_WRAPPER_IMAGE", "agentbox:latest")
+	cfg, err := config.Load("")
+	require.NoError(t, err)
+	assert.True(t, cfg.Executions.Wrapper.Enabled)
+	assert.Equal(t, "/app/agentbox-wrapper", cfg.Executions.Wrapper.Path)
+}
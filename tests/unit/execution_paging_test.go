@@ -0,0 +1,164 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+const pagingExecutionCount = 150
+
+func TestDatabaseListExecutionsPage(t *testing.T) {
+	db := setupDBForExecutions(t)
+	ctx := context.Background()
+	ensureEnvironmentForExecutions(t, db, ctx, "env-paging")
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i := 0; i < pagingExecutionCount; i++ {
+		require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+			ID:            fmt.Sprintf("paging-exec-%03d", i),
+			EnvironmentID: "env-paging",
+			UserID:        "user-1",
+			Command:       []string{"true"},
+			Status:        models.ExecutionStatusCompleted,
+			// Pairs share a timestamp so the id tie-break is exercised
+			CreatedAt: now.Add(time.Duration(i/2) * time.Second),
+		}))
+	}
+	filter := database.ExecutionListFilter{EnvironmentID: "env-paging"}
+
+	total, err := db.CountExecutions(ctx, filter)
+	require.NoError(t, err)
+	assert.Equal(t, pagingExecutionCount, total)
+
+	var byOffset []string
+	for offset := 0; offset < pagingExecutionCount+40; offset += 40 {
+		page, err := db.ListExecutionsPage(ctx, filter, nil, offset, 40)
+		require.NoError(t, err)
+		for _, e := range page {
+			byOffset = append(byOffset, e.ID)
+		}
+	}
+
+	var byCursor []string
+	var cursor *models.PageCursor
+	for {
+		page, err := db.ListExecutionsPage(ctx, filter, cursor, 0, 40)
+		require.NoError(t, err)
+		for _, e := range page {
+			byCursor = append(byCursor, e.ID)
+		}
+		if len(page) < 40 {
+			break
+		}
+		last := page[len(page)-1]
+		cursor = &models.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	require.Len(t, byOffset, pagingExecutionCount)
+	assert.Equal(t, "paging-exec-149", byOffset[0])
+	assert.Equal(t, "paging-exec-000", byOffset[pagingExecutionCount-1])
+	assert.Equal(t, byOffset, byCursor)
+}
+
+func TestListExecutionsPaging(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		db   bool
+	}{{"database", true}, {"in-memory", false}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var db *database.DB
+			if tc.db {
+				db = setupTestDB(t)
+			}
+			orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+			ctx := context.Background()
+			env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "paging-env"})
+
+			for i := 0; i < pagingExecutionCount; i++ {
+				_, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+					EnvironmentID: env.ID,
+					Command:       []string{"echo", fmt.Sprint(i)},
+				}, "user-123")
+				require.NoError(t, err)
+			}
+
+			var byToken []string
+			token := ""
+			for {
+				page, err := orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{Limit: 40, PageToken: token})
+				require.NoError(t, err)
+				assert.Equal(t, pagingExecutionCount, page.Total)
+				assert.Equal(t, 40, page.Limit)
+				for _, e := range page.Executions {
+					byToken = append(byToken, e.ID)
+				}
+				if page.NextPageToken == "" {
+					break
+				}
+				token = page.NextPageToken
+			}
+
+			var byOffset []string
+			for offset := 0; offset < pagingExecutionCount; offset += 40 {
+				page, err := orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{Limit: 40, Offset: offset})
+				require.NoError(t, err)
+				assert.Equal(t, pagingExecutionCount, page.Total)
+				assert.Equal(t, offset, page.Offset)
+				for _, e := range page.Executions {
+					byOffset = append(byOffset, e.ID)
+				}
+			}
+
+			// Both walks see every execution once, newest first
+			require.Len(t, byToken, pagingExecutionCount)
+			assert.Equal(t, byToken, byOffset)
+			newest, err := orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{Limit: 1})
+			require.NoError(t, err)
+			assert.Equal(t, byToken[0], newest.Executions[0].ID)
+
+			past, err := orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{Limit: 40, Offset: pagingExecutionCount})
+			require.NoError(t, err)
+			assert.Empty(t, past.Executions)
+			assert.Empty(t, past.NextPageToken)
+
+			_, err = orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{Limit: 40, Offset: 40, PageToken: token})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestListExecutionsKeepsCachedRecords(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "paging-cached-env"})
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"echo", "hello"},
+	}, "user-123")
+	require.NoError(t, err)
+
+	// A stored row older than the cached record does not replace it
+	stale, err := orch.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	stale.Error = "stale row"
+	require.NoError(t, db.SaveExecution(ctx, stale))
+
+	page, err := orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{})
+	require.NoError(t, err)
+	require.Len(t, page.Executions, 1)
+	assert.NotEqual(t, "stale row", page.Executions[0].Error)
+	got, err := orch.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, "stale row", got.Error)
+}
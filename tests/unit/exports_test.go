@@ -0,0 +1,456 @@
+package unit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/exports"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// exportWebhook records the batches POSTed to it; failNext makes the next requests fail and
+// failBatch fails the first delivery of that batch number
+type exportWebhook struct {
+	mu        sync.Mutex
+	batches   []exportDelivery
+	failNext  int
+	failBatch string
+}
+
+type exportDelivery struct {
+	header http.Header
+	ids    []string
+}
+
+func (h *exportWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failNext > 0 || (h.failBatch != "" && r.Header.Get(exports.BatchHeader) == h.failBatch) {
+		if h.failNext > 0 {
+			h.failNext--
+		}
+		h.failBatch = ""
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	var ids []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var rec struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+			ids = append(ids, rec.ID)
+		}
+	}
+	if secret := r.Header.Get(orchestrator.CallbackSignatureHeader); secret != "" &&
+		secret != orchestrator.SignCallback("export-secret", r.Header.Get(orchestrator.CallbackTimestampHeader), body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.batches = append(h.batches, exportDelivery{header: r.Header.Clone(), ids: ids})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *exportWebhook) deliveries() []exportDelivery {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]exportDelivery{}, h.batches...)
+}
+
+func exportTestConfig() config.ExportConfig {
+	return config.ExportConfig{
+		DailyAt:          "02:00",
+		Datasets:         append([]string{}, config.ExportDatasets...),
+		BatchSize:        2,
+		MaxBatchBytes:    1 << 20,
+		MaxAttempts:      3,
+		InitialBackoffMs: 0,
+		TimeoutSeconds:   5,
+	}
+}
+
+// insertAuditEntries inserts n audit entries created one second apart from start
+func insertAuditEntries(t *testing.T, db *database.DB, start time.Time, n int, message string) []string {
+	t.Helper()
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		entry := &models.AuditEntry{
+			Action:    "test.action",
+			Message:   message,
+			CreatedAt: start.Add(time.Duration(i) * time.Second),
+		}
+		require.NoError(t, db.SaveAuditEntry(context.Background(), entry))
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func waitForExportJob(t *testing.T, svc *exports.Service, id string, status models.ExportJobStatus) *models.ExportJob {
+	t.Helper()
+	var job *models.ExportJob
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = svc.GetJob(context.Background(), id)
+		require.NoError(t, err)
+		return job.Status == status
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestExportsWebhook(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+
+	t.Run("records are exported in signed batches", func(t *testing.T) {
+		db := setupTestDB(t)
+		ids := insertAuditEntries(t, db, start, 5, "in range")
+		insertAuditEntries(t, db, start.Add(-time.Hour), 1, "before range")
+
+		hook := &exportWebhook{}
+		server := httptest.NewServer(hook)
+		defer server.Close()
+		cfg := exportTestConfig()
+		cfg.Sink = config.ExportSinkWebhook
+		cfg.Webhook = config.ExportWebhookConfig{URL: server.URL, Secret: "export-secret", Headers: map[string]string{"X-Tenant": "acme"}}
+		svc, err := exports.NewService(db, cfg, nil, zap.NewNop())
+		require.NoError(t, err)
+
+		job, err := svc.CreateJob(ctx, &models.CreateExportRequest{
+			From: start, To: start.Add(time.Hour), Datasets: []string{config.ExportDatasetAuditLog},
+		}, "admin-1")
+		require.NoError(t, err)
+		assert.Equal(t, models.ExportJobPending, job.Status)
+
+		svc.Start(ctx)
+		defer svc.Stop()
+
+		job = waitForExportJob(t, svc, job.ID, models.ExportJobSucceeded)
+		cp := job.Progress[config.ExportDatasetAuditLog]
+		require.NotNil(t, cp)
+		assert.True(t, cp.Done)
+		assert.Equal(t, int64(5), cp.Records)
+		assert.Equal(t, 3, cp.Batches)
+		assert.NotNil(t, job.CompletedAt)
+
+		var exported []string
+		for i, d := range hook.deliveries() {
+			assert.Equal(t, job.ID, d.header.Get(exports.JobIDHeader))
+			assert.Equal(t, config.ExportDatasetAuditLog, d.header.Get(exports.DatasetHeader))
+			assert.Equal(t, fmt.Sprint(i+1), d.header.Get(exports.BatchHeader))
+			assert.Equal(t, exports.ContentType, d.header.Get("Content-Type"))
+			assert.Equal(t, "acme", d.header.Get("X-Tenant"))
+			assert.NotEmpty(t, d.header.Get(orchestrator.CallbackSignatureHeader))
+			exported = append(exported, d.ids...)
+		}
+		assert.Equal(t, ids, exported)
+	})
+
+	t.Run("failed attempts are retried from the checkpoint", func(t *testing.T) {
+		db := setupTestDB(t)
+		ids := insertAuditEntries(t, db, start, 5, "in range")
+
+		// The second batch fails once: the retry starts at that batch
+		hook := &exportWebhook{failBatch: "2"}
+		server := httptest.NewServer(hook)
+		defer server.Close()
+		cfg := exportTestConfig()
+		cfg.Sink = config.ExportSinkWebhook
+		cfg.Webhook.URL = server.URL
+		svc, err := exports.NewService(db, cfg, nil, zap.NewNop())
+		require.NoError(t, err)
+		svc.Start(ctx)
+		defer svc.Stop()
+
+		job, err := svc.CreateJob(ctx, &models.CreateExportRequest{
+			From: start, To: start.Add(time.Hour), Datasets: []string{config.ExportDatasetAuditLog, config.ExportDatasetAuditLog},
+		}, "admin-1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{config.ExportDatasetAuditLog}, job.Datasets)
+
+		job = waitForExportJob(t, svc, job.ID, models.ExportJobSucceeded)
+		assert.Equal(t, 2, job.Attempts)
+		assert.Empty(t, job.Error)
+		var exported []string
+		for _, d := range hook.deliveries() {
+			exported = append(exported, d.ids...)
+		}
+		assert.Equal(t, ids, exported, "every record is delivered exactly once")
+	})
+
+	t.Run("jobs fail after max attempts and can be retried", func(t *testing.T) {
+		db := setupTestDB(t)
+		insertAuditEntries(t, db, start, 3, "in range")
+
+		hook := &exportWebhook{failNext: 2}
+		server := httptest.NewServer(hook)
+		defer server.Close()
+		cfg := exportTestConfig()
+		cfg.Sink = config.ExportSinkWebhook
+		cfg.Webhook.URL = server.URL
+		cfg.MaxAttempts = 2
+		svc, err := exports.NewService(db, cfg, nil, zap.NewNop())
+		require.NoError(t, err)
+		svc.Start(ctx)
+		defer svc.Stop()
+
+		job, err := svc.CreateJob(ctx, &models.CreateExportRequest{
+			From: start, To: start.Add(time.Hour), Datasets: []string{config.ExportDatasetAuditLog},
+		}, "admin-1")
+		require.NoError(t, err)
+		job = waitForExportJob(t, svc, job.ID, models.ExportJobFailed)
+		assert.Equal(t, 2, job.Attempts)
+		assert.Contains(t, job.Error, "status 502")
+
+		failed, err := svc.ListJobs(ctx, models.ExportJobFailed, 0)
+		require.NoError(t, err)
+		require.Len(t, failed, 1)
+
+		_, err = svc.RetryJob(ctx, job.ID, "admin-1")
+		require.NoError(t, err)
+		job = waitForExportJob(t, svc, job.ID, models.ExportJobSucceeded)
+		assert.Equal(t, int64(3), job.Progress[config.ExportDatasetAuditLog].Records)
+
+		_, err = svc.RetryJob(ctx, job.ID, "admin-1")
+		assert.Error(t, err, "only failed jobs can be retried")
+	})
+
+	t.Run("batches end early at max_batch_bytes", func(t *testing.T) {
+		db := setupTestDB(t)
+		insertAuditEntries(t, db, start, 4, strings.Repeat("x", 700))
+
+		hook := &exportWebhook{}
+		server := httptest.NewServer(hook)
+		defer server.Close()
+		cfg := exportTestConfig()
+		cfg.Sink = config.ExportSinkWebhook
+		cfg.Webhook.URL = server.URL
+		cfg.BatchSize = 10
+		cfg.MaxBatchBytes = 1024
+		svc, err := exports.NewService(db, cfg, nil, zap.NewNop())
+		require.NoError(t, err)
+		svc.Start(ctx)
+		defer svc.Stop()
+
+		job, err := svc.CreateJob(ctx, &models.CreateExportRequest{
+			From: start, To: start.Add(time.Hour), Datasets: []string{config.ExportDatasetAuditLog},
+		}, "")
+		require.NoError(t, err)
+		job = waitForExportJob(t, svc, job.ID, models.ExportJobSucceeded)
+		assert.Equal(t, 4, job.Progress[config.ExportDatasetAuditLog].Batches)
+		for _, d := range hook.deliveries() {
+			assert.Len(t, d.ids, 1)
+		}
+	})
+
+	t.Run("nightly export of the previous day", func(t *testing.T) {
+		db := setupTestDB(t)
+		hook := &exportWebhook{}
+		server := httptest.NewServer(hook)
+		defer server.Close()
+		cfg := exportTestConfig()
+		cfg.Enabled = true
+		cfg.DailyAt = "00:00"
+		cfg.Sink = config.ExportSinkWebhook
+		cfg.Webhook.URL = server.URL
+		svc, err := exports.NewService(db, cfg, nil, zap.NewNop())
+		require.NoError(t, err)
+		svc.Start(ctx)
+
+		var jobs []*models.ExportJob
+		require.Eventually(t, func() bool {
+			jobs, err = svc.ListJobs(ctx, models.ExportJobSucceeded, 0)
+			require.NoError(t, err)
+			return len(jobs) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		svc.Stop()
+
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		assert.Equal(t, models.ExportTriggerScheduled, jobs[0].Trigger)
+		assert.True(t, jobs[0].From.Equal(today.Add(-24*time.Hour)))
+		assert.True(t, jobs[0].To.Equal(today))
+		assert.Equal(t, config.ExportDatasets, jobs[0].Datasets)
+
+		// A restart does not schedule the same day again
+		svc, err = exports.NewService(db, cfg, nil, zap.NewNop())
+		require.NoError(t, err)
+		svc.Start(ctx)
+		time.Sleep(100 * time.Millisecond)
+		svc.Stop()
+		all, err := svc.ListJobs(ctx, "", 0)
+		require.NoError(t, err)
+		assert.Len(t, all, 1)
+	})
+}
+
+func TestExportsS3Sink(t *testing.T) {
+	type upload struct {
+		method, path, auth, payloadHash, bodyHash string
+	}
+	var mu sync.Mutex
+	var uploads []upload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		mu.Lock()
+		uploads = append(uploads, upload{
+			method:      r.Method,
+			path:        r.URL.EscapedPath(),
+			auth:        r.Header.Get("Authorization"),
+			payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+			bodyHash:    hex.EncodeToString(sum[:]),
+		})
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := exportTestConfig()
+	cfg.Sink = config.ExportSinkS3
+	cfg.S3 = config.ExportS3Config{
+		Endpoint:        server.URL,
+		Region:          "eu-west-1",
+		Bucket:          "audit-bucket",
+		Prefix:          "agentbox/",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	}
+	sink, err := exports.NewSink(cfg, nil)
+	require.NoError(t, err)
+
+	from := time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC)
+	batch := &exports.Batch{JobID: "export-1", Dataset: config.ExportDatasetExecutions, Seq: 7, From: from, Records: 1, Body: []byte("{\"id\":\"a\"}\n")}
+	require.NoError(t, sink.Write(context.Background(), batch))
+	// Re-writing a batch targets the same object
+	require.NoError(t, sink.Write(context.Background(), batch))
+
+	assert.Equal(t, "agentbox/executions/dt=2026-03-04/export-1-000007.ndjson", exports.ObjectKey(cfg.S3.Prefix, batch))
+	require.Len(t, uploads, 2)
+	assert.Equal(t, uploads[0].path, uploads[1].path)
+	u := uploads[0]
+	assert.Equal(t, http.MethodPut, u.method)
+	assert.Equal(t, "/audit-bucket/agentbox/executions/dt%3D2026-03-04/export-1-000007.ndjson", u.path)
+	assert.True(t, strings.HasPrefix(u.auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), u.auth)
+	assert.Contains(t, u.auth, "/eu-west-1/s3/aws4_request")
+	assert.Equal(t, u.bodyHash, u.payloadHash)
+
+	// Error responses fail the write
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+	}))
+	defer failing.Close()
+	cfg.S3.Endpoint = failing.URL
+	sink, err = exports.NewSink(cfg, nil)
+	require.NoError(t, err)
+	err = sink.Write(context.Background(), batch)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+}
+
+func TestExportsAPI(t *testing.T) {
+	db := setupTestDB(t)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+
+	hook := &exportWebhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	cfg := exportTestConfig()
+	cfg.Sink = config.ExportSinkWebhook
+	cfg.Webhook.URL = server.URL
+	svc, err := exports.NewService(db, cfg, nil, zap.NewNop())
+	require.NoError(t, err)
+	handler := api.NewExportJobHandler(svc, log)
+
+	unconfigured, err := exports.NewService(db, exportTestConfig(), nil, zap.NewNop())
+	require.NoError(t, err)
+	unconfiguredHandler := api.NewExportJobHandler(unconfigured, log)
+
+	do := func(h *api.ExportJobHandler, method, path, body, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.UserContextKey, &users.User{ID: "u1", Role: role}))
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/admin/exports", h.ListExports).Methods("GET")
+		router.HandleFunc("/api/v1/admin/exports", h.CreateExport).Methods("POST")
+		router.HandleFunc("/api/v1/admin/exports/{id}", h.GetExport).Methods("GET")
+		router.HandleFunc("/api/v1/admin/exports/{id}/retry", h.RetryExport).Methods("POST")
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	to := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	body := fmt.Sprintf(`{"from":%q,"to":%q,"datasets":["executions","audit_log"]}`,
+		to.Add(-24*time.Hour).Format(time.RFC3339), to.Format(time.RFC3339))
+
+	assert.Equal(t, http.StatusForbidden, do(handler, http.MethodPost, "/api/v1/admin/exports", body, users.RoleUser).Code)
+	assert.Equal(t, http.StatusForbidden, do(handler, http.MethodGet, "/api/v1/admin/exports", "", users.RoleUser).Code)
+	// Admins do not see every environment's executions
+	assert.Equal(t, http.StatusForbidden, do(handler, http.MethodPost, "/api/v1/admin/exports", body, users.RoleAdmin).Code)
+
+	rr := do(handler, http.MethodPost, "/api/v1/admin/exports", body, users.RoleSuperAdmin)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var job models.ExportJob
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&job))
+	assert.Equal(t, models.ExportJobPending, job.Status)
+	assert.Equal(t, models.ExportTriggerManual, job.Trigger)
+	assert.Equal(t, []string{"executions", "audit_log"}, job.Datasets)
+	assert.Equal(t, "u1", job.CreatedBy)
+
+	rr = do(handler, http.MethodGet, "/api/v1/admin/exports/"+job.ID, "", users.RoleSuperAdmin)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(handler, http.MethodGet, "/api/v1/admin/exports?status=pending", "", users.RoleSuperAdmin)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var list struct {
+		Exports    []*models.ExportJob `json:"exports"`
+		Total      int                 `json:"total"`
+		Configured bool                `json:"configured"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&list))
+	assert.Equal(t, 1, list.Total)
+	assert.True(t, list.Configured)
+
+	rr = do(handler, http.MethodGet, "/api/v1/admin/exports/export-missing", "", users.RoleSuperAdmin)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "EXPORT_NOT_FOUND")
+	assert.Equal(t, http.StatusBadRequest, do(handler, http.MethodGet, "/api/v1/admin/exports?status=done", "", users.RoleSuperAdmin).Code)
+	assert.Equal(t, http.StatusConflict, do(handler, http.MethodPost, "/api/v1/admin/exports/"+job.ID+"/retry", "", users.RoleSuperAdmin).Code)
+
+	for _, bad := range []string{
+		fmt.Sprintf(`{"from":%q,"to":%q}`, to.Format(time.RFC3339), to.Add(-time.Hour).Format(time.RFC3339)),
+		fmt.Sprintf(`{"from":%q,"to":%q,"datasets":["metrics"]}`, to.Add(-time.Hour).Format(time.RFC3339), to.Format(time.RFC3339)),
+		fmt.Sprintf(`{"from":%q,"to":%q}`, to.Format(time.RFC3339), to.Add(48*time.Hour).Format(time.RFC3339)),
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(handler, http.MethodPost, "/api/v1/admin/exports", bad, users.RoleSuperAdmin).Code, bad)
+	}
+
+	rr = do(unconfiguredHandler, http.MethodPost, "/api/v1/admin/exports", body, users.RoleSuperAdmin)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "EXPORTS_NOT_CONFIGURED")
+}
@@ -0,0 +1,217 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+func TestFaultInjectingClient(t *testing.T) {
+	ctx := context.Background()
+	mockK8s := mocks.NewMockK8sClient()
+	faults := k8s.NewFaultInjector(1)
+	client := k8s.WithFaults(mockK8s, faults)
+	require.NoError(t, client.CreateNamespace(ctx, "faults-ns", nil))
+
+	// Faults are checked against the interface's methods
+	assert.ErrorContains(t, faults.Set(k8s.Fault{Method: "CreatePods", ErrorRate: 1}), `unknown method "CreatePods"`)
+	assert.Error(t, faults.Set(k8s.Fault{Method: "CreatePod", ErrorRate: 1.5}))
+	assert.Error(t, faults.Set(k8s.Fault{Method: "CreatePod"}))
+
+	// CreatePod errors are classified like the real client's
+	require.NoError(t, faults.Set(k8s.Fault{Method: "CreatePod", ErrorRate: 1, Error: k8s.FaultQuotaExceeded}))
+	err := client.CreatePod(ctx, &k8s.PodSpec{Name: "main", Namespace: "faults-ns", Image: "python:3.11-slim"})
+	assert.Equal(t, apierrors.QuotaExceeded, apierrors.KindOf(err))
+	assert.Equal(t, apierrors.CodePodQuotaExceeded, apierrors.CodeOf(err))
+	require.NoError(t, faults.Set(k8s.Fault{Method: "CreatePod", ErrorRate: 1, Error: k8s.FaultForbidden}))
+	err = client.CreatePod(ctx, &k8s.PodSpec{Name: "main", Namespace: "faults-ns", Image: "python:3.11-slim"})
+	assert.Equal(t, apierrors.CodePodForbidden, apierrors.CodeOf(err))
+	assert.Zero(t, mockK8s.CallCount("CreatePod"), "failed calls never reach the wrapped client")
+
+	// Other methods return the API error itself; "*" covers methods without a fault of their own
+	require.NoError(t, faults.Set(k8s.Fault{Method: k8s.FaultAllMethods, ErrorRate: 1, Error: k8s.FaultNotFound}))
+	_, err = client.GetPod(ctx, "faults-ns", "main")
+	assert.True(t, k8serrors.IsNotFound(err))
+	err = client.WaitForPodRunning(ctx, "faults-ns", "main")
+	assert.True(t, k8serrors.IsNotFound(err))
+	require.NoError(t, faults.Set(k8s.Fault{Method: "WaitForPodRunning", ErrorRate: 1, Error: k8s.FaultDeadlineExceeded}))
+	assert.ErrorIs(t, client.WaitForPodRunning(ctx, "faults-ns", "main"), context.DeadlineExceeded)
+	faults.Clear()
+	assert.NoError(t, client.CreatePod(ctx, &k8s.PodSpec{Name: "main", Namespace: "faults-ns", Image: "python:3.11-slim"}))
+
+	// A limited fault is used up, after which it is removed
+	require.NoError(t, faults.Set(k8s.Fault{Method: "ListPods", ErrorRate: 1, Error: k8s.FaultConflict, Times: 2}))
+	for i := 0; i < 2; i++ {
+		_, err = client.ListPods(ctx, "faults-ns", "")
+		assert.True(t, k8serrors.IsConflict(err))
+	}
+	_, err = client.ListPods(ctx, "faults-ns", "")
+	assert.NoError(t, err)
+	assert.Empty(t, faults.List())
+
+	// Injected transient errors are retried like real ones
+	retrying := k8s.WithRetry(client, k8s.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}, nil)
+	require.NoError(t, faults.Set(k8s.Fault{Method: "GetPod", ErrorRate: 1, Error: k8s.FaultUnavailable, Times: 2}))
+	_, err = retrying.GetPod(ctx, "faults-ns", "main")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, mockK8s.CallCount("GetPod"))
+
+	// Latency delays calls, but not past their context
+	require.NoError(t, faults.Set(k8s.Fault{Method: "NamespaceExists", LatencyMs: 50}))
+	start := time.Now()
+	exists, err := client.NamespaceExists(ctx, "faults-ns")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	shortCtx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	_, err = client.NamespaceExists(shortCtx, "faults-ns")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, faults.List(), 1, "latency faults are not used up")
+}
+
+func TestFaultErrorRateIsSeeded(t *testing.T) {
+	draw := func() []bool {
+		faults := k8s.NewFaultInjector(42)
+		require.NoError(t, faults.Set(k8s.Fault{Method: "GetPod", ErrorRate: 0.5}))
+		failed := make([]bool, 200)
+		for i := range failed {
+			failed[i] = faults.Inject(context.Background(), "GetPod") != nil
+		}
+		return failed
+	}
+	first := draw()
+	assert.Equal(t, first, draw())
+
+	var failures int
+	for _, failed := range first {
+		if failed {
+			failures++
+		}
+	}
+	assert.InDelta(t, 100, failures, 40)
+}
+
+func TestMockFaultsDriveQuotaFallback(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "fault-fallback-env"})
+	require.NoError(t, mockK8s.SetFault(k8s.Fault{Method: "CreatePod", ErrorRate: 1, Error: k8s.FaultQuotaExceeded, Times: 1}))
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	done := waitForExecutionDone(t, orch, exec.ID)
+	assert.Equal(t, models.ExecutionStatusCompleted, done.Status)
+	assert.Equal(t, models.ExecutionModeMainFallback, done.Mode)
+
+	// Once the fault is used up, executions get pods of their own again
+	exec, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionModeEphemeral, waitForExecutionDone(t, orch, exec.ID).Mode)
+}
+
+func TestMockFaultsFailPoolReplenishment(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "fault-pool-env",
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	// The execution claims the standby pod; its replacement fails to start
+	waits := mockK8s.CallCount("WaitForPodRunning")
+	require.NoError(t, mockK8s.SetFault(k8s.Fault{Method: "WaitForPodRunning", ErrorRate: 1, Error: k8s.FaultDeadlineExceeded, Times: 1}))
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionModeStandby, waitForExecutionDone(t, orch, exec.ID).Mode)
+	require.Eventually(t, func() bool { return mockK8s.CallCount("WaitForPodRunning") > waits }, 5*time.Second, 20*time.Millisecond)
+	assert.Zero(t, orch.GetPoolStatus()[env.ID])
+
+	// A refresh replenishes the pool once the fault is gone
+	_, err = orch.RefreshStandbyPool(ctx, env.ID)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestFaultAdminAPI(t *testing.T) {
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	faults := k8s.NewFaultInjector(1)
+	mockK8s := mocks.NewMockK8sClient()
+	mockK8s.SetFaultInjector(faults)
+	handler := api.NewFaultHandler(faults, log)
+
+	do := func(role, method, body string, serve http.HandlerFunc, vars map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/admin/faults", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.UserContextKey, &users.User{ID: "u1", Role: role}))
+		if vars != nil {
+			req = mux.SetURLVars(req, vars)
+		}
+		rr := httptest.NewRecorder()
+		serve(rr, req)
+		return rr
+	}
+
+	rr := do(users.RoleAdmin, http.MethodPut, `{"method":"CreatePod","error_rate":1}`, handler.SetFault, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = do(users.RoleSuperAdmin, http.MethodPut, `{"method":"Nope","error_rate":1}`, handler.SetFault, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = do(users.RoleSuperAdmin, http.MethodPut, `{"method":"CreateNamespace","error_rate":1,"error":"forbidden"}`, handler.SetFault, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	err = mockK8s.CreateNamespace(context.Background(), "admin-faults-ns", nil)
+	assert.True(t, k8serrors.IsForbidden(err))
+
+	rr = do(users.RoleSuperAdmin, http.MethodGet, "", handler.ListFaults, nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp api.FaultsResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	require.Len(t, resp.Faults, 1)
+	assert.Equal(t, k8s.Fault{Method: "CreateNamespace", ErrorRate: 1, Error: k8s.FaultForbidden, Injected: 1}, resp.Faults[0])
+
+	rr = do(users.RoleSuperAdmin, http.MethodDelete, "", handler.DeleteFault, map[string]string{"method": "CreateNamespace"})
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = do(users.RoleSuperAdmin, http.MethodDelete, "", handler.DeleteFault, map[string]string{"method": "CreateNamespace"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NoError(t, mockK8s.CreateNamespace(context.Background(), "admin-faults-ns", nil))
+
+	// FailNext errors come before faults
+	require.NoError(t, faults.Set(k8s.Fault{Method: "GetPod", ErrorRate: 1, Error: k8s.FaultNotFound}))
+	mockK8s.FailNext("GetPod", 1, errors.New("queued"))
+	_, err = mockK8s.GetPod(context.Background(), "admin-faults-ns", "main")
+	assert.EqualError(t, err, "queued")
+	rr = do(users.RoleSuperAdmin, http.MethodDelete, "", handler.ClearFaults, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, faults.List())
+}
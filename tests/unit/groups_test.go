@@ -0,0 +1,202 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+func groupTemplate() models.CreateEnvironmentRequest {
+	return models.CreateEnvironmentRequest{
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Labels:    map[string]string{"suite": "eval"},
+	}
+}
+
+func waitForGroupStatus(t *testing.T, orch *orchestrator.Orchestrator, id string, status models.EnvironmentGroupStatus) *models.EnvironmentGroup {
+	var group *models.EnvironmentGroup
+	require.Eventually(t, func() bool {
+		var err error
+		group, err = orch.GetEnvironmentGroup(context.Background(), id)
+		return err == nil && group.Status == status
+	}, 5*time.Second, 20*time.Millisecond)
+	return group
+}
+
+func TestEnvironmentGroupLifecycle(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	group, err := orch.CreateEnvironmentGroup(ctx, &models.CreateEnvironmentGroupRequest{
+		Name:     "eval",
+		Replicas: 4,
+		Template: groupTemplate(),
+	}, "user-123", nil)
+	require.NoError(t, err)
+	assert.Empty(t, group.Errors)
+	assert.Len(t, group.EnvironmentIDs, 4)
+
+	group = waitForGroupStatus(t, orch, group.ID, models.GroupReady)
+	assert.Equal(t, 4, group.ReadyReplicas)
+	assert.Equal(t, map[models.EnvironmentStatus]int{models.StatusRunning: 4}, group.StatusCounts)
+
+	// Replicas are ordinary environments, named after the group and listed with ?group=
+	list, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{GroupID: group.ID})
+	require.NoError(t, err)
+	require.Len(t, list.Environments, 4)
+	var names []string
+	for _, env := range list.Environments {
+		assert.Equal(t, group.ID, env.GroupID)
+		assert.Equal(t, "eval", env.Labels["suite"])
+		names = append(names, env.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"eval-1", "eval-2", "eval-3", "eval-4"}, names)
+
+	// Scale down, then back up: freed names are reused
+	group, err = orch.ScaleEnvironmentGroup(ctx, group.ID, 2, nil)
+	require.NoError(t, err)
+	assert.Len(t, group.EnvironmentIDs, 2)
+	group, err = orch.ScaleEnvironmentGroup(ctx, group.ID, 3, nil)
+	require.NoError(t, err)
+	assert.Len(t, group.EnvironmentIDs, 3)
+	group = waitForGroupStatus(t, orch, group.ID, models.GroupReady)
+	assert.Equal(t, 3, group.ReadyReplicas)
+
+	_, err = orch.ScaleEnvironmentGroup(ctx, group.ID, orchestrator.MaxGroupReplicas+1, nil)
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+
+	require.NoError(t, orch.DeleteEnvironmentGroup(ctx, group.ID, true))
+	_, err = orch.GetEnvironmentGroup(ctx, group.ID)
+	assert.ErrorIs(t, err, apierrors.NotFound)
+	list, err = orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{GroupID: group.ID})
+	require.NoError(t, err)
+	assert.Empty(t, list.Environments)
+}
+
+func TestEnvironmentGroupPartialCreation(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+
+	// The quota admits two replicas out of five
+	admitted := 0
+	admit := func(ctx context.Context) error {
+		if admitted == 2 {
+			return errors.New("team quota exceeded")
+		}
+		admitted++
+		return nil
+	}
+
+	group, err := orch.CreateEnvironmentGroup(ctx, &models.CreateEnvironmentGroupRequest{
+		Name:     "quota",
+		Replicas: 5,
+		Template: groupTemplate(),
+	}, "user-123", admit)
+	require.NoError(t, err)
+	require.Len(t, group.Errors, 1)
+	assert.Contains(t, group.Errors[0], "team quota exceeded")
+	assert.Contains(t, group.Errors[0], "3 replicas not created")
+
+	group = waitForGroupStatus(t, orch, group.ID, models.GroupPartial)
+	assert.Equal(t, 5, group.Replicas)
+	assert.Equal(t, 2, group.ReadyReplicas)
+}
+
+func TestEnvironmentGroupPersistence(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	group, err := orch.CreateEnvironmentGroup(ctx, &models.CreateEnvironmentGroupRequest{
+		Name:     "stored",
+		Replicas: 2,
+		Template: groupTemplate(),
+	}, "user-123", nil)
+	require.NoError(t, err)
+
+	stored, err := db.GetEnvironmentGroup(ctx, group.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "stored", stored.Name)
+	assert.Equal(t, 2, stored.Replicas)
+	assert.Equal(t, "python:3.11-slim", stored.Template.Image)
+
+	for _, id := range group.EnvironmentIDs {
+		env, err := db.GetEnvironment(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, group.ID, env.GroupID)
+	}
+
+	groups, err := orch.ListEnvironmentGroups(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, groups.Total)
+	assert.Equal(t, group.ID, groups.Groups[0].ID)
+
+	waitForGroupStatus(t, orch, group.ID, models.GroupReady)
+	require.NoError(t, orch.DeleteEnvironmentGroup(ctx, group.ID, true))
+	_, err = db.GetEnvironmentGroup(ctx, group.ID)
+	assert.ErrorIs(t, err, apierrors.NotFound)
+}
+
+func TestEnvironmentGroupAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	body, err := json.Marshal(models.CreateEnvironmentGroupRequest{Name: "api-group", Replicas: 3, Template: groupTemplate()})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environment-groups", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var group models.EnvironmentGroup
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&group))
+	assert.Equal(t, 3, group.Replicas)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments?group="+group.ID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list models.ListEnvironmentsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Equal(t, 3, list.Total)
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/v1/environment-groups/"+group.ID, bytes.NewReader([]byte(`{"replicas": 1}`)))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&group))
+	assert.Len(t, group.EnvironmentIDs, 1)
+
+	// A group without replicas is rejected
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/environment-groups", bytes.NewReader([]byte(`{"name": "empty", "replicas": 0, "template": {"image": "busybox", "resources": {"cpu": "100m", "memory": "128Mi", "storage": "1Gi"}}}`)))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/environment-groups/"+group.ID+"?force=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environment-groups/"+group.ID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
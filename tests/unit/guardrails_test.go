@@ -0,0 +1,210 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/metrics"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// guardrailConfig applies guardrails, watching pods when podWatch is set
+func guardrailConfig(guardrails config.GuardrailsConfig, podWatch bool) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Reconciliation.PodWatch = podWatch
+	cfg.Guardrails = guardrails
+	return cfg
+}
+
+func guardrailRequest(name string) *models.CreateEnvironmentRequest {
+	return &models.CreateEnvironmentRequest{
+		Name:      name,
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}
+}
+
+func TestCreationRateGuardrail(t *testing.T) {
+	clock := mocks.NewFakeClock(time.Now())
+	orch, _ := setupConfiguredOrchestrator(t, guardrailConfig(config.GuardrailsConfig{MaxEnvironmentsPerHour: 2}, false), nil,
+		orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	for _, name := range []string{"rate-1", "rate-2"} {
+		env, err := orch.CreateEnvironment(ctx, guardrailRequest(name), "user-123")
+		require.NoError(t, err)
+		<-orch.ProvisioningDone(env.ID)
+		clock.Advance(20 * time.Minute)
+	}
+
+	_, err := orch.CreateEnvironment(ctx, guardrailRequest("rate-3"), "user-123")
+	require.Error(t, err)
+	assert.Equal(t, apierrors.CodeCreationRateLimited, apierrors.CodeOf(err))
+	assert.Equal(t, http.StatusTooManyRequests, apierrors.HTTPStatus(err))
+	assert.Contains(t, err.Error(), "retry in 20m0s")
+	status := orch.GuardrailStatus()
+	assert.Equal(t, 2, status.EnvironmentsCreatedLastHour)
+	assert.Equal(t, 2, status.MaxEnvironmentsPerHour)
+	assert.True(t, status.LimitReached)
+
+	// The window slides: an hour after the first creation there is room for one more
+	clock.Advance(20 * time.Minute)
+	_, err = orch.CreateEnvironment(ctx, guardrailRequest("rate-3"), "user-123")
+	require.NoError(t, err)
+	_, err = orch.CreateEnvironment(ctx, guardrailRequest("rate-4"), "user-123")
+	assert.Equal(t, apierrors.CodeCreationRateLimited, apierrors.CodeOf(err))
+}
+
+func TestNamespaceGuardrail(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, guardrailConfig(config.GuardrailsConfig{MaxNamespaces: 2}, false), nil)
+	ctx := context.Background()
+
+	first := createRunningEnv(t, orch, guardrailRequest("ns-1"))
+	createRunningEnv(t, orch, guardrailRequest("ns-2"))
+	_, err := orch.CreateEnvironment(ctx, guardrailRequest("ns-3"), "user-123")
+	require.Error(t, err)
+	assert.Equal(t, apierrors.CodeNamespaceLimitReached, apierrors.CodeOf(err))
+	assert.Equal(t, http.StatusTooManyRequests, apierrors.HTTPStatus(err))
+
+	health, err := orch.GetHealthInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, models.GuardrailStatus{
+		ManagedNamespaces:           2,
+		MaxNamespaces:               2,
+		EnvironmentsCreatedLastHour: 2,
+		LimitReached:                true,
+	}, health.Guardrails)
+
+	// Deleting an environment frees its namespace
+	require.NoError(t, orch.DeleteEnvironment(ctx, first.ID, false))
+	createRunningEnv(t, orch, guardrailRequest("ns-3"))
+	assert.Equal(t, int64(3), orch.NamespacesCreatedTotal())
+	assert.Equal(t, int64(1), orch.NamespacesDeletedTotal())
+}
+
+func TestBulkDeleteBatchesNamespaceDeletions(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, guardrailConfig(config.GuardrailsConfig{
+		NamespaceDeleteBatchSize:       2,
+		NamespaceDeleteBatchIntervalMs: 100,
+	}, false), nil)
+	ctx := context.Background()
+
+	envs := createRunningEnvs(t, orch, 5)
+	ids := make([]string, len(envs))
+	for i, env := range envs {
+		ids[i] = env.ID
+	}
+
+	start := time.Now()
+	op, err := orch.DeleteEnvironments(ctx, ids, false, "user-123")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := orch.GetOperation(ctx, op.ID)
+		return err == nil && got.Status != models.OperationRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	elapsed := time.Since(start)
+
+	got, err := orch.GetOperation(ctx, op.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.OperationCompleted, got.Status)
+	assert.Equal(t, 5, got.Succeeded)
+	// Three batches (2, 2, 1) with a pause between each
+	assert.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+	assert.Equal(t, 5, mockK8s.CallCount("DeleteNamespace"))
+	assert.Equal(t, int64(5), orch.NamespacesDeletedTotal())
+}
+
+func TestChurnReport(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, guardrailConfig(config.GuardrailsConfig{MaxNamespaces: 10}, true), db)
+	ctx := context.Background()
+	require.Eventually(t, func() bool { return mockK8s.PodWatchCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	collector := metrics.NewCollector(db, orch, nil, log.Logger)
+
+	kept := createRunningEnv(t, orch, guardrailRequest("churn-1"))
+	deleted := createRunningEnv(t, orch, guardrailRequest("churn-2"))
+	mockK8s.SetPodNode(kept.Namespace, "main", "node-a")
+	mockK8s.SetPodNode(deleted.Namespace, "main", "node-b")
+	require.NoError(t, orch.DeleteEnvironment(ctx, deleted.ID, false))
+
+	// Pods are counted once, when first seen scheduled, even across a restarted watch
+	mockK8s.CloseWatches()
+	mockK8s.SetPodNode(kept.Namespace, "main", "node-a")
+
+	var report *metrics.ChurnReport
+	require.Eventually(t, func() bool {
+		collector.CollectChurn(ctx)
+		report, err = metrics.GetChurnReport(ctx, db, time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		return report.PodsCreated == 2 && mockK8s.PodWatchCount() == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	collector.CollectChurn(ctx)
+	report, err = metrics.GetChurnReport(ctx, db, time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(2), report.NamespacesCreated)
+	assert.Equal(t, int64(1), report.NamespacesDeleted)
+	assert.Equal(t, int64(2), report.PodsCreated)
+	assert.ElementsMatch(t, []metrics.NodeChurn{
+		{Cluster: "default", Node: "node-a", PodsCreated: 1},
+		{Cluster: "default", Node: "node-b", PodsCreated: 1},
+	}, report.Nodes)
+	require.NotEmpty(t, report.Hours)
+	var hourly int64
+	for _, h := range report.Hours {
+		hourly += h.NamespacesCreated
+	}
+	assert.Equal(t, int64(2), hourly)
+
+	// The churn report and the guardrails are served to metrics readers
+	handler := api.NewMetricsHandler(db, log)
+	handler.SetOrchestrator(orch)
+	get := func(path, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.UserContextKey, &users.User{ID: "u1", Role: role}))
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/metrics/churn", handler.GetChurnReport)
+		router.HandleFunc("/api/v1/metrics/summary", handler.GetMetricsSummary)
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("/api/v1/metrics/churn", users.RoleUser).Code)
+	rr := get("/api/v1/metrics/churn", users.RoleAdmin)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var served metrics.ChurnReport
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&served))
+	assert.Equal(t, int64(2), served.NamespacesCreated)
+	assert.GreaterOrEqual(t, len(served.Hours), 24)
+	assert.Len(t, served.Nodes, 2)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/metrics/churn?from=yesterday", users.RoleAdmin).Code)
+
+	rr = get("/api/v1/metrics/summary", users.RoleAdmin)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var summary struct {
+		Guardrails models.GuardrailStatus `json:"guardrails"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&summary))
+	assert.Equal(t, 1, summary.Guardrails.ManagedNamespaces)
+	assert.Equal(t, 10, summary.Guardrails.MaxNamespaces)
+}
@@ -0,0 +1,237 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// idleWebhook records the notices POSTed to it
+type idleWebhook struct {
+	server  *httptest.Server
+	mu      sync.Mutex
+	notices []orchestrator.IdleNotice
+}
+
+func newIdleWebhook(t *testing.T) *idleWebhook {
+	hook := &idleWebhook{}
+	hook.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notice orchestrator.IdleNotice
+		if err := json.NewDecoder(r.Body).Decode(&notice); err == nil {
+			hook.mu.Lock()
+			hook.notices = append(hook.notices, notice)
+			hook.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(hook.server.Close)
+	return hook
+}
+
+func (h *idleWebhook) events() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make([]string, 0, len(h.notices))
+	for _, n := range h.notices {
+		events = append(events, n.Event)
+	}
+	return events
+}
+
+// idleConfig terminates environments idle for an hour, warning webhookURL ten minutes before
+func idleConfig(webhookURL string) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Idle = config.IdleConfig{
+		TimeoutSeconds:  3600,
+		WarningSeconds:  600,
+		IntervalSeconds: 300,
+		WebhookURL:      webhookURL,
+	}
+	return cfg
+}
+
+func createRunningEnv(t *testing.T, orch *orchestrator.Orchestrator, req *models.CreateEnvironmentRequest) *models.Environment {
+	ctx := context.Background()
+	if req.Image == "" {
+		req.Image = "python:3.11-slim"
+	}
+	req.Resources = models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"}
+	env, err := orch.CreateEnvironment(ctx, req, "user-123")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.LastActivityAt)
+	return got
+}
+
+func TestIdleReaperWarnsThenTerminates(t *testing.T) {
+	hook := newIdleWebhook(t)
+	orch, _ := setupConfiguredOrchestrator(t, idleConfig(hook.server.URL), nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "idle-env"})
+	last := *env.LastActivityAt
+
+	// Not yet within the warning period
+	assert.Empty(t, orch.ReapIdleEnvironments(ctx, last.Add(30*time.Minute)))
+
+	// Within the warning period: one warning, not repeated on the next pass
+	assert.Empty(t, orch.ReapIdleEnvironments(ctx, last.Add(51*time.Minute)))
+	assert.Empty(t, orch.ReapIdleEnvironments(ctx, last.Add(52*time.Minute)))
+	require.Eventually(t, func() bool { return len(hook.events()) == 1 }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{orchestrator.IdleWarningEvent}, hook.events())
+
+	// Past the deadline: terminated
+	terminated := orch.ReapIdleEnvironments(ctx, last.Add(61*time.Minute))
+	assert.Equal(t, []string{env.ID}, terminated)
+	require.Eventually(t, func() bool { return len(hook.events()) == 2 }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, orchestrator.IdleTerminatedEvent, hook.events()[1])
+
+	hook.mu.Lock()
+	notice := hook.notices[1]
+	hook.mu.Unlock()
+	assert.Equal(t, env.ID, notice.EnvironmentID)
+	assert.Equal(t, "idle-env", notice.Name)
+	assert.True(t, notice.LastActivityAt.Equal(last))
+	assert.Equal(t, int64(61*60), notice.IdleSeconds)
+
+	_, err := orch.GetEnvironment(ctx, env.ID)
+	assert.Error(t, err)
+}
+
+func TestIdleReaperExemptionsAndPerEnvironmentTimeout(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, idleConfig(""), nil)
+	ctx := context.Background()
+
+	kept := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:   "kept-env",
+		Labels: map[string]string{orchestrator.KeepLabel: "true"},
+	})
+	short := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "short-env", IdleTimeout: 60})
+	attached := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "attached-env"})
+
+	done := orch.TrackSession(ctx, attached.ID)
+
+	// Two minutes idle: only the environment with its own one-minute timeout is reaped
+	terminated := orch.ReapIdleEnvironments(ctx, short.LastActivityAt.Add(2*time.Minute))
+	assert.Equal(t, []string{short.ID}, terminated)
+
+	// Days later the kept environment and the attached one are still exempt
+	assert.Empty(t, orch.ReapIdleEnvironments(ctx, time.Now().Add(72*time.Hour)))
+
+	// Once the session ends the attached environment is reaped like any other
+	done()
+	assert.Equal(t, []string{attached.ID}, orch.ReapIdleEnvironments(ctx, time.Now().Add(72*time.Hour)))
+
+	_, err := orch.GetEnvironment(ctx, kept.ID)
+	assert.NoError(t, err)
+}
+
+func TestIdleTimeoutValidationAndUpdate(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, idleConfig(""), nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "patch-env"})
+
+	negative := -1
+	_, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{IdleTimeout: &negative})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+
+	// A longer per-environment timeout overrides the server default
+	day := 86400
+	updated, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{IdleTimeout: &day})
+	require.NoError(t, err)
+	assert.Equal(t, day, updated.IdleTimeout)
+	assert.Empty(t, orch.ReapIdleEnvironments(ctx, env.LastActivityAt.Add(2*time.Hour)))
+}
+
+func TestActivityResetsIdleTimerAndSortsList(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, idleConfig(""), nil)
+	ctx := context.Background()
+
+	first := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "first-env"})
+	second := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "second-env"})
+
+	time.Sleep(10 * time.Millisecond)
+	_, err := orch.ExecuteCommand(ctx, first.ID, []string{"echo", "hi"}, 10)
+	require.NoError(t, err)
+
+	got, err := orch.GetEnvironment(ctx, first.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.LastActivityAt)
+	assert.True(t, got.LastActivityAt.After(*first.LastActivityAt))
+
+	// Least recently used first
+	list, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Sort: "last_activity_at"})
+	require.NoError(t, err)
+	require.Len(t, list.Environments, 2)
+	assert.Equal(t, second.ID, list.Environments[0].ID)
+	assert.Equal(t, first.ID, list.Environments[1].ID)
+
+	list, err = orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Sort: "-last_activity_at"})
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, list.Environments[0].ID)
+
+	_, err = orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Sort: "name"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+}
+
+func TestActivityIsStampedWithOrchestratorClock(t *testing.T) {
+	cfg := testOrchestratorConfig()
+	cfg.Idle = config.IdleConfig{TimeoutSeconds: 3600, IntervalSeconds: 300}
+	clock := mocks.NewFakeClock(time.Now().Add(-48 * time.Hour))
+	orch, _ := setupConfiguredOrchestrator(t, cfg, nil, orchestrator.WithClock(clock))
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "clock-env"})
+	clock.Advance(time.Minute)
+	orch.RecordActivity(ctx, env.ID)
+
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.LastActivityAt)
+	assert.True(t, got.LastActivityAt.Equal(clock.Now()))
+}
+
+func TestIdleWarningEventAndPersistedActivity(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, idleConfig(""), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "db-idle-env"})
+
+	later := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	require.NoError(t, db.UpdateEnvironmentActivity(ctx, env.ID, later))
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.LastActivityAt)
+	assert.True(t, stored.LastActivityAt.Equal(later))
+
+	assert.Empty(t, orch.ReapIdleEnvironments(ctx, env.LastActivityAt.Add(55*time.Minute)))
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 10)
+	require.NoError(t, err)
+	var warned bool
+	for _, e := range events {
+		warned = warned || e.EventType == "idle_warning"
+	}
+	assert.True(t, warned, "expected an idle_warning event")
+}
@@ -0,0 +1,174 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func setupImpersonationTest(t *testing.T) *ownershipTest {
+	return &ownershipTest{setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		rc.UserHandler.SetOrchestrator(a.orch)
+		rc.AuditHandler = api.NewAuditHandler(a.db, a.log)
+		rc.ImpersonationHandler = api.NewImpersonationHandler(a.auth, a.log)
+		rc.EnvTokenHandler = api.NewEnvironmentTokenHandler(a.auth, a.permissions, a.orch, a.log)
+	}))}
+}
+
+// impersonate starts impersonating userID with the admin's token and returns the response
+func (a *ownershipTest) impersonate(t *testing.T, adminJWT, userID string) *auth.ImpersonationResponse {
+	rr := a.do(t, http.MethodPost, "/api/v1/admin/impersonate/"+userID, adminJWT, map[string]interface{}{"reason": "ticket 4711"})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var resp auth.ImpersonationResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	return &resp
+}
+
+func errorCode(t *testing.T, body []byte) string {
+	var errResp models.ErrorResponse
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	return errResp.Code
+}
+
+func TestImpersonation(t *testing.T) {
+	a := setupImpersonationTest(t)
+	ctx := context.Background()
+
+	root := createUserForTest(t, a.users, "root", "password123", users.RoleSuperAdmin)
+	createUserForTest(t, a.users, "admin", "password123", users.RoleAdmin)
+	alice := createUserForTest(t, a.users, "alice", "password123", users.RoleUser)
+	bob := createUserForTest(t, a.users, "bob", "password123", users.RoleUser)
+	rootJWT := getTokenForUser(t, a.router, "root", "password123")
+	adminJWT := getTokenForUser(t, a.router, "admin", "password123")
+
+	env := a.createEnv(t, "alice-env", alice.ID)
+	_, err := a.permissions.GrantPermission(ctx, alice.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+
+	// Only super admins impersonate, and never themselves
+	rr := a.do(t, http.MethodPost, "/api/v1/admin/impersonate/"+alice.ID, adminJWT, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, "/api/v1/admin/impersonate/"+root.ID, rootJWT, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, "/api/v1/admin/impersonate/no-such-user", rootJWT, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	imp := a.impersonate(t, rootJWT, alice.ID)
+	assert.Equal(t, alice.ID, imp.User.ID)
+	assert.Equal(t, root.ID, imp.Session.AdminID)
+	assert.Equal(t, "ticket 4711", imp.Session.Reason)
+	assert.WithinDuration(t, imp.Session.CreatedAt.Add(auth.DefaultImpersonationTTL), imp.ExpiresAt, 0)
+
+	// The token sees what alice sees
+	rr = a.do(t, http.MethodGet, "/api/v1/auth/me", imp.Token, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var me struct {
+		ID            string                     `json:"id"`
+		Impersonation *auth.ImpersonationSession `json:"impersonation"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&me))
+	assert.Equal(t, alice.ID, me.ID)
+	require.NotNil(t, me.Impersonation)
+	assert.Equal(t, root.ID, me.Impersonation.AdminID)
+
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID, imp.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/users", imp.Token, nil).Code)
+
+	// Credentials and the account stay alice's own business
+	rr = a.do(t, http.MethodPost, "/api/v1/auth/change-password", imp.Token, map[string]string{
+		"current_password": "password123", "new_password": "Another-password-1",
+	})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	assert.Equal(t, apierrors.CodeImpersonationForbidden, errorCode(t, rr.Body.Bytes()))
+	rr = a.do(t, http.MethodPut, "/api/v1/users/"+alice.ID, imp.Token, map[string]string{"password": "Another-password-1"})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, "/api/v1/api-keys", imp.Token, map[string]string{"description": "backdoor"})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, "/api/v1/admin/impersonate/"+bob.ID, imp.Token, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/tokens", imp.Token, map[string]string{"permission": "viewer"})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	assert.Equal(t, apierrors.CodeImpersonationForbidden, errorCode(t, rr.Body.Bytes()))
+
+	// Audit entries written while impersonating name both identities
+	rr = a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/transfer-ownership", imp.Token, map[string]string{"user_id": bob.ID})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	entries, err := a.db.ListAuditEntries(ctx, database.AuditFilter{Action: orchestrator.AuditActionOwnershipTransferred})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, alice.ID, entries[0].ActorID)
+	assert.Equal(t, root.ID, entries[0].ImpersonatorID)
+	entries, err = a.db.ListAuditEntries(ctx, database.AuditFilter{ImpersonatorID: root.ID})
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	entries, err = a.db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionImpersonationStarted})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, root.ID, entries[0].ActorID)
+	assert.Equal(t, alice.ID, entries[0].ResourceID)
+
+	// Sessions are listed and revocable; a revoked token is rejected
+	rr = a.do(t, http.MethodGet, "/api/v1/admin/impersonations?active=true", rootJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var sessions struct {
+		Sessions []auth.ImpersonationSession `json:"sessions"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&sessions))
+	require.Len(t, sessions.Sessions, 1)
+	assert.Equal(t, imp.Session.ID, sessions.Sessions[0].ID)
+	assert.True(t, sessions.Sessions[0].Active)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/admin/impersonations", imp.Token, nil).Code)
+
+	rr = a.do(t, http.MethodDelete, "/api/v1/admin/impersonations/"+imp.Session.ID, rootJWT, nil)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, a.do(t, http.MethodGet, "/api/v1/auth/me", imp.Token, nil).Code)
+	assert.Equal(t, http.StatusNotFound, a.do(t, http.MethodDelete, "/api/v1/admin/impersonations/"+imp.Session.ID, rootJWT, nil).Code)
+
+	rr = a.do(t, http.MethodGet, "/api/v1/admin/impersonations", rootJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&sessions))
+	require.Len(t, sessions.Sessions, 1)
+	assert.False(t, sessions.Sessions[0].Active)
+	assert.Equal(t, root.ID, sessions.Sessions[0].RevokedBy)
+}
+
+func TestImpersonationEndsOwnSession(t *testing.T) {
+	a := setupImpersonationTest(t)
+
+	createUserForTest(t, a.users, "root", "password123", users.RoleSuperAdmin)
+	alice := createUserForTest(t, a.users, "alice", "password123", users.RoleUser)
+	bob := createUserForTest(t, a.users, "bob", "password123", users.RoleUser)
+	rootJWT := getTokenForUser(t, a.router, "root", "password123")
+
+	asAlice := a.impersonate(t, rootJWT, alice.ID)
+	asBob := a.impersonate(t, rootJWT, bob.ID)
+
+	// An impersonated request ends its own session only
+	rr := a.do(t, http.MethodDelete, "/api/v1/admin/impersonations/"+asBob.Session.ID, asAlice.Token, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodDelete, "/api/v1/admin/impersonations/"+asAlice.Session.ID, asAlice.Token, nil)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, a.do(t, http.MethodGet, "/api/v1/auth/me", asAlice.Token, nil).Code)
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/auth/me", asBob.Token, nil).Code)
+
+	// Demoting the admin invalidates their sessions
+	root, err := a.users.GetUserByUsername(context.Background(), "root")
+	require.NoError(t, err)
+	role := users.RoleAdmin
+	_, err = a.users.UpdateUser(context.Background(), root.ID, &users.UpdateUserRequest{Role: &role})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, a.do(t, http.MethodGet, "/api/v1/auth/me", asBob.Token, nil).Code)
+}
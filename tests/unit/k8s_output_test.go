@@ -0,0 +1,131 @@
+package unit
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+)
+
+// repeatingReader yields n bytes of numbered lines without holding them in memory
+type repeatingReader struct {
+	remaining int64
+	line      int
+	pending   []byte
+}
+
+func newRepeatingReader(n int64) *repeatingReader {
+	return &repeatingReader{remaining: n}
+}
+
+func (r *repeatingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && r.remaining > 0 {
+		if len(r.pending) == 0 {
+			r.line++
+			r.pending = []byte(fmt.Sprintf("line %d\n", r.line))
+		}
+		c := copy(p[n:], r.pending)
+		if int64(c) > r.remaining {
+			c = int(r.remaining)
+		}
+		r.pending = r.pending[c:]
+		r.remaining -= int64(c)
+		n += c
+	}
+	return n, nil
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	t.Run("under the limit keeps everything", func(t *testing.T) {
+		buf := k8s.NewLimitedBuffer(16)
+		_, _ = buf.Write([]byte("hello "))
+		_, _ = buf.Write([]byte("world"))
+		assert.Equal(t, "hello world", buf.String())
+		assert.Equal(t, int64(11), buf.Total())
+		assert.False(t, buf.Truncated())
+	})
+
+	t.Run("over the limit keeps head and tail", func(t *testing.T) {
+		buf := k8s.NewLimitedBuffer(8)
+		for _, chunk := range []string{"abc", "defgh", "ijk", "lmnop", "q"} {
+			n, err := buf.Write([]byte(chunk))
+			require.NoError(t, err)
+			assert.Equal(t, len(chunk), n)
+		}
+		assert.True(t, buf.Truncated())
+		assert.Equal(t, int64(17), buf.Total())
+		assert.Equal(t, "abcd"+k8s.TruncationMarker(9)+"nopq", buf.String())
+	})
+
+	t.Run("large single write", func(t *testing.T) {
+		buf := k8s.NewLimitedBuffer(6)
+		_, _ = buf.Write([]byte("0123456789"))
+		assert.Equal(t, "012"+k8s.TruncationMarker(4)+"789", buf.String())
+	})
+
+	t.Run("characters split by the cut are dropped whole", func(t *testing.T) {
+		buf := k8s.NewLimitedBuffer(6)
+		_, _ = buf.Write([]byte("é€xyz€9"))
+		out := buf.String()
+		assert.True(t, utf8.ValidString(out), "%q", out)
+		assert.Equal(t, "é"+k8s.TruncationMarker(9)+"9", out)
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		buf := k8s.NewLimitedBuffer(0)
+		_, _ = buf.Write([]byte(strings.Repeat("x", 4096)))
+		assert.Len(t, buf.String(), 4096)
+		assert.False(t, buf.Truncated())
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		buf := k8s.NewLimitedBuffer(64)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					_, _ = buf.Write([]byte("0123456789"))
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(8000), buf.Total())
+		assert.True(t, buf.Truncated())
+	})
+
+	t.Run("memory stays bounded", func(t *testing.T) {
+		const logSize = 64 << 20 // 64 MiB
+		const limit = 64 << 10   // 64 KiB
+		buf := k8s.NewLimitedBuffer(limit)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		_, err := io.Copy(buf, newRepeatingReader(logSize))
+		require.NoError(t, err)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+
+		assert.Equal(t, int64(logSize), buf.Total())
+		assert.True(t, buf.Truncated())
+		assert.Less(t, after.HeapAlloc, before.HeapAlloc+8<<20, "buffer must not retain the whole log")
+		out := buf.String()
+		assert.LessOrEqual(t, len(out), limit+len(k8s.TruncationMarker(logSize)))
+		assert.True(t, strings.HasPrefix(out, "line 1\nline 2\n"))
+		assert.Contains(t, out, "bytes truncated]")
+	})
+}
@@ -0,0 +1,93 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+var testRetryPolicy = k8s.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     50 * time.Millisecond,
+}
+
+func TestIsTransientError(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"throttled", k8serrors.NewTooManyRequests("slow down", 1), true},
+		{"service unavailable", k8serrors.NewServiceUnavailable("etcd leader changed"), true},
+		{"internal error", k8serrors.NewInternalError(fmt.Errorf("boom")), true},
+		{"server timeout", k8serrors.NewServerTimeout(pods, "create", 1), true},
+		{"connection refused", fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED), true},
+		{"not found", k8serrors.NewNotFound(pods, "main"), false},
+		{"already exists", k8serrors.NewAlreadyExists(pods, "main"), false},
+		{"conflict", k8serrors.NewConflict(pods, "main", fmt.Errorf("stale")), false},
+		{"forbidden", k8serrors.NewForbidden(pods, "main", fmt.Errorf("exceeded quota")), false},
+		{"canceled", context.Canceled, false},
+		{"plain error", fmt.Errorf("namespace not found"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.transient, k8s.IsTransientError(tt.err))
+		})
+	}
+}
+
+func TestRetryingClient(t *testing.T) {
+	ctx := context.Background()
+	mockK8s := mocks.NewMockK8sClient()
+	client := k8s.WithRetry(mockK8s, testRetryPolicy, zap.NewNop())
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		mockK8s.Reset()
+		mockK8s.FailNext("CreateNamespace", 2, k8serrors.NewServiceUnavailable("apiserver restarting"))
+		require.NoError(t, client.CreateNamespace(ctx, "ns-retry", nil))
+		assert.Equal(t, 3, mockK8s.CallCount("CreateNamespace"))
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		mockK8s.Reset()
+		mockK8s.FailNext("CreateNamespace", 5, k8serrors.NewTooManyRequests("slow down", 0))
+		err := client.CreateNamespace(ctx, "ns-exhausted", nil)
+		require.Error(t, err)
+		assert.True(t, k8serrors.IsTooManyRequests(err))
+		assert.Equal(t, 3, mockK8s.CallCount("CreateNamespace"))
+	})
+
+	t.Run("semantic errors are not retried", func(t *testing.T) {
+		mockK8s.Reset()
+		mockK8s.FailNext("GetPod", 1, k8serrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "main"))
+		_, err := client.GetPod(ctx, "ns", "main")
+		require.Error(t, err)
+		assert.True(t, k8serrors.IsNotFound(err))
+		assert.Equal(t, 1, mockK8s.CallCount("GetPod"))
+	})
+
+	t.Run("retries stop at the context deadline", func(t *testing.T) {
+		mockK8s.Reset()
+		slow := k8s.WithRetry(mockK8s, k8s.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Second}, zap.NewNop())
+		mockK8s.FailNext("DeletePod", 5, k8serrors.NewServiceUnavailable("unavailable"))
+		deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		require.Error(t, slow.DeletePod(deadlineCtx, "ns", "main", true))
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		assert.Equal(t, 1, mockK8s.CallCount("DeletePod"))
+	})
+}
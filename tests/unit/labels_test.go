@@ -0,0 +1,131 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func TestUpdateEnvironmentLabels(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:   "labels-env",
+		Labels: map[string]string{"stage": "dev", "team": "a"},
+	})
+	// A label set on the namespace by another controller
+	require.NoError(t, mockK8s.UpdateNamespaceLabels(ctx, env.Namespace, map[string]string{"example.com/owner": "ops"}, nil))
+
+	updated, err := orch.UpdateEnvironmentLabels(ctx, env.ID, &models.UpdateLabelsRequest{
+		Add:    map[string]string{"team": "b", "tier": "web"},
+		Remove: []string{"stage", "missing"},
+	})
+	require.NoError(t, err)
+	want := map[string]string{"team": "b", "tier": "web"}
+	assert.Equal(t, want, updated.Labels)
+
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, want, stored.Labels)
+
+	// The namespace and main pod get the change; other labels on them are kept
+	nsLabels := mockK8s.NamespaceLabels(env.Namespace)
+	assert.Equal(t, "b", nsLabels["team"])
+	assert.Equal(t, "web", nsLabels["tier"])
+	assert.NotContains(t, nsLabels, "stage")
+	assert.Equal(t, "ops", nsLabels["example.com/owner"])
+	assert.Equal(t, env.ID, nsLabels["env-id"])
+	pod, err := mockK8s.GetPod(ctx, env.Namespace, "main")
+	require.NoError(t, err)
+	assert.Equal(t, "web", pod.Labels["tier"])
+	assert.NotContains(t, pod.Labels, "stage")
+	assert.Equal(t, "agentbox", pod.Labels["managed-by"])
+
+	// Removing the last labels leaves none
+	updated, err = orch.UpdateEnvironmentLabels(ctx, env.ID, &models.UpdateLabelsRequest{Remove: []string{"team", "tier"}})
+	require.NoError(t, err)
+	assert.Empty(t, updated.Labels)
+
+	_, err = orch.UpdateEnvironmentLabels(ctx, "env-missing", &models.UpdateLabelsRequest{Remove: []string{"team"}})
+	assert.True(t, errors.Is(err, apierrors.NotFound))
+}
+
+func TestValidateLabelsUpdate(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	assert.NoError(t, v.ValidateLabelsUpdate(&models.UpdateLabelsRequest{
+		Add:    map[string]string{"example.com/owner": "ops", "empty": ""},
+		Remove: []string{"stage"},
+	}))
+
+	err := v.ValidateLabelsUpdate(&models.UpdateLabelsRequest{})
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+	assert.Equal(t, validator.CodeRequired, verrs[0].Code)
+
+	err = v.ValidateLabelsUpdate(&models.UpdateLabelsRequest{
+		Add:    map[string]string{"env-id": "other", "bad key": "v", "team": "not valid!", "tier": "web"},
+		Remove: []string{"managed-by", "tier", "-bad"},
+	})
+	require.True(t, errors.As(err, &verrs))
+	fields := make(map[string]string)
+	for _, ve := range verrs {
+		fields[ve.Field] = ve.Code
+	}
+	assert.Equal(t, map[string]string{
+		"add.bad key": validator.CodeInvalidFormat,
+		"add.env-id":  validator.CodeInvalidValue,
+		"add.team":    validator.CodeInvalidFormat,
+		"remove[0]":   validator.CodeInvalidValue,
+		"remove[1]":   validator.CodeInvalidValue,
+		"remove[2]":   validator.CodeInvalidFormat,
+	}, fields)
+}
+
+func TestUpdateEnvironmentLabelsAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	post := func(envID string, req models.UpdateLabelsRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+envID+"/labels", bytes.NewReader(body)))
+		return rr
+	}
+
+	body, _ := json.Marshal(models.CreateEnvironmentRequest{
+		Name:      "labels-api-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Labels:    map[string]string{"stage": "dev"},
+	})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body)))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+
+	rr = post(env.ID, models.UpdateLabelsRequest{Add: map[string]string{"team": "backend"}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+	assert.Equal(t, map[string]string{"stage": "dev", "team": "backend"}, env.Labels)
+
+	// Reserved labels are refused
+	rr = post(env.ID, models.UpdateLabelsRequest{Remove: []string{"env-id"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "remove[0]")
+
+	assert.Equal(t, http.StatusNotFound, post("env-missing", models.UpdateLabelsRequest{Add: map[string]string{"team": "x"}}).Code)
+}
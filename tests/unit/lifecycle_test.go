@@ -0,0 +1,153 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// lifecycleConfig lets lifecycle hooks ask for termination grace periods of up to 300 seconds
+func lifecycleConfig() *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Timeouts.MaxTerminationGracePeriod = 300
+	return cfg
+}
+
+func flushLifecycle(grace int) *models.LifecycleConfig {
+	return &models.LifecycleConfig{
+		PreStop:                       []string{"/bin/sh", "-c", "agent flush"},
+		TerminationGracePeriodSeconds: &grace,
+	}
+}
+
+func TestLifecycleOfMainPod(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, lifecycleConfig(), nil, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "flushing", Lifecycle: flushLifecycle(90)})
+	spec := waitForPodSpec(t, mockK8s, env.Namespace, "main")
+	assert.Equal(t, []string{"/bin/sh", "-c", "agent flush"}, spec.PreStop)
+	require.NotNil(t, spec.TerminationGracePeriodSeconds)
+	assert.Equal(t, int64(90), *spec.TerminationGracePeriodSeconds)
+
+	// Execution pods stop at once
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	execSpec := waitForPodSpec(t, mockK8s, env.Namespace, exec.ID)
+	assert.Empty(t, execSpec.PreStop)
+	assert.Nil(t, execSpec.TerminationGracePeriodSeconds)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	plain := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "plain"})
+	spec = waitForPodSpec(t, mockK8s, plain.Namespace, "main")
+	assert.Empty(t, spec.PreStop)
+	assert.Nil(t, spec.TerminationGracePeriodSeconds)
+}
+
+func TestDeleteEnvironmentGracePeriod(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, lifecycleConfig(), nil, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	// The main pod gets the configured grace period
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "graceful", Lifecycle: flushLifecycle(90)})
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	grace, deleted := mockK8s.DeleteGracePeriod(env.Namespace, "main")
+	require.True(t, deleted)
+	require.NotNil(t, grace)
+	assert.Equal(t, int64(90), *grace)
+
+	// force still kills it at once
+	env = createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "forced", Lifecycle: flushLifecycle(90)})
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, true))
+	grace, deleted = mockK8s.DeleteGracePeriod(env.Namespace, "main")
+	require.True(t, deleted)
+	require.NotNil(t, grace)
+	assert.Equal(t, int64(0), *grace)
+
+	// Without lifecycle settings the pod keeps its own grace period
+	env = createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "default"})
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	grace, deleted = mockK8s.DeleteGracePeriod(env.Namespace, "main")
+	require.True(t, deleted)
+	assert.Nil(t, grace)
+}
+
+func TestEvictedMainPodGracePeriod(t *testing.T) {
+	clock := mocks.NewFakeClock(time.Now())
+	orch, mockK8s := setupConfiguredOrchestrator(t, lifecycleConfig(), setupTestDB(t), orchestrator.WithClock(clock))
+	ctx := context.Background()
+	// Pool, reconciliation, retention, idle reaper, snapshot scheduler, reservation loop and cache sync
+	clock.BlockUntil(7)
+
+	// The evicted pod is given its grace period and replaced with the same settings
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "evicted", Lifecycle: flushLifecycle(45)})
+	mockK8s.SetPodEvicted(env.Namespace, "main", "The node was low on resource: memory.")
+	require.Eventually(t, func() bool {
+		clock.Advance(10 * time.Second)
+		pod, err := mockK8s.GetPod(ctx, env.Namespace, "main")
+		return err == nil && pod.Status.Phase == corev1.PodRunning
+	}, 10*time.Second, 50*time.Millisecond)
+	grace, deleted := mockK8s.DeleteGracePeriod(env.Namespace, "main")
+	require.True(t, deleted)
+	require.NotNil(t, grace)
+	assert.Equal(t, int64(45), *grace)
+	spec := mockK8s.CreatedPodSpec(env.Namespace, "main")
+	require.NotNil(t, spec.TerminationGracePeriodSeconds)
+	assert.Equal(t, int64(45), *spec.TerminationGracePeriodSeconds)
+	assert.Equal(t, []string{"/bin/sh", "-c", "agent flush"}, spec.PreStop)
+}
+
+func TestLifecycleLimits(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, lifecycleConfig(), nil, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	_, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "too-long",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Lifecycle: flushLifecycle(301),
+	}, "user-123")
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+
+	// An update applies to the main pods created from then on; {} removes the settings
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "updated"})
+	_, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{Lifecycle: flushLifecycle(301)})
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	updated, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{Lifecycle: flushLifecycle(120)})
+	require.NoError(t, err)
+	require.NotNil(t, updated.Lifecycle)
+	assert.Equal(t, 120, *updated.Lifecycle.TerminationGracePeriodSeconds)
+	updated, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{Lifecycle: &models.LifecycleConfig{}})
+	require.NoError(t, err)
+	assert.Nil(t, updated.Lifecycle)
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	grace, _ := mockK8s.DeleteGracePeriod(env.Namespace, "main")
+	assert.Nil(t, grace)
+
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	require.NoError(t, v.ValidateLifecycle(flushLifecycle(0)))
+	for name, lifecycle := range map[string]*models.LifecycleConfig{
+		"empty command":  {PreStop: []string{" "}},
+		"negative grace": flushLifecycle(-1),
+	} {
+		err := v.ValidateLifecycle(lifecycle)
+		var verrs validator.ValidationErrors
+		require.ErrorAs(t, err, &verrs, name)
+		assert.Contains(t, verrs[0].Field, "lifecycle.", name)
+	}
+}
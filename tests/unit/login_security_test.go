@@ -0,0 +1,251 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// passwordErrorCodes returns the validation codes of a password policy violation
+func passwordErrorCodes(t *testing.T, err error) []string {
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs), "%v", err)
+	codes := make([]string, len(verrs))
+	for i, ve := range verrs {
+		assert.Equal(t, "password", ve.Field)
+		codes[i] = ve.Code
+	}
+	return codes
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	_, userService, _ := setupAuthTest(t)
+	ctx := context.Background()
+
+	// Until a policy is installed only the minimum length applies
+	assert.NoError(t, userService.CheckPassword("password", "alice", "password123"))
+	assert.Equal(t, []string{validator.CodeTooShort}, passwordErrorCodes(t, userService.CheckPassword("password", "alice", "short")))
+
+	userService.SetPasswordPolicy(config.PasswordPolicyConfig{
+		MinLength:        10,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	})
+	assert.NoError(t, userService.CheckPassword("password", "alice", "Correct-Horse-42"))
+	assert.Equal(t, []string{validator.CodeTooShort, validator.CodeInvalidFormat},
+		passwordErrorCodes(t, userService.CheckPassword("password", "alice", "abc")))
+	assert.Equal(t, []string{validator.CodeRequired}, passwordErrorCodes(t, userService.CheckPassword("password", "alice", "")))
+
+	userService.SetPasswordPolicy(config.PasswordPolicyConfig{MinLength: 8, RejectCommon: true})
+	assert.Equal(t, []string{validator.CodeInvalidValue}, passwordErrorCodes(t, userService.CheckPassword("password", "alice", "Password123")))
+	assert.Equal(t, []string{validator.CodeInvalidValue}, passwordErrorCodes(t, userService.CheckPassword("password", "Alice-Admin", "alice-admin")))
+
+	// Setting a password enforces the policy; SSO users have none
+	_, err := userService.CreateUser(ctx, &users.CreateUserRequest{Username: "bob", Password: "qwerty123", Role: users.RoleUser, Status: users.StatusActive})
+	assert.Equal(t, []string{validator.CodeInvalidValue}, passwordErrorCodes(t, err))
+	user, err := userService.CreateUser(ctx, &users.CreateUserRequest{Username: "bob", Password: "Correct-Horse-42", Role: users.RoleUser, Status: users.StatusActive})
+	require.NoError(t, err)
+	_, err = userService.CreateUser(ctx, &users.CreateUserRequest{Username: "sso-user", ExternalID: "sub-1", Role: users.RoleUser, Status: users.StatusActive})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{validator.CodeTooShort, validator.CodeInvalidValue}, passwordErrorCodes(t, userService.UpdatePassword(ctx, user.ID, "bob")))
+	weak := "letmein1"
+	_, err = userService.UpdateUser(ctx, user.ID, &users.UpdateUserRequest{Password: &weak})
+	assert.Equal(t, []string{validator.CodeInvalidValue}, passwordErrorCodes(t, err))
+	require.NoError(t, userService.UpdatePassword(ctx, user.ID, "Battery-Staple-7"))
+
+	// The operator-chosen default admin password is accepted with a warning
+	t.Setenv("AGENTBOX_ADMIN_USERNAME", "root-admin")
+	t.Setenv("AGENTBOX_ADMIN_PASSWORD", "admin")
+	require.NoError(t, userService.EnsureDefaultAdmin(ctx))
+	_, err = userService.GetUserByUsername(ctx, "root-admin")
+	assert.NoError(t, err)
+}
+
+// setupLockoutTest returns an auth service throttling logins with lockout and a user "carol"
+func setupLockoutTest(t *testing.T, lockout config.LoginLockoutConfig) (*auth.Service, *users.Service, *database.DB) {
+	authService, userService, db := setupAuthTest(t)
+	authService.SetLoginLockout(lockout)
+	_, err := userService.CreateUser(context.Background(), &users.CreateUserRequest{
+		Username: "carol", Password: "Correct-Horse-42", Role: users.RoleUser, Status: users.StatusActive,
+	})
+	require.NoError(t, err)
+	return authService, userService, db
+}
+
+func TestLoginLockout(t *testing.T) {
+	lockout := config.LoginLockoutConfig{Enabled: true, MaxFailures: 3, LockoutSeconds: 600}
+	authService, userService, db := setupLockoutTest(t, lockout)
+	ctx := context.Background()
+	login := func(password string) error {
+		_, err := authService.Login(ctx, &auth.LoginRequest{Username: "carol", Password: password, ClientIP: "10.0.0.1"})
+		return err
+	}
+
+	// A successful login resets the count
+	require.Error(t, login("wrong-password"))
+	require.Error(t, login("wrong-password"))
+	require.NoError(t, login("Correct-Horse-42"))
+	require.Error(t, login("wrong-password"))
+	require.Error(t, login("wrong-password"))
+	require.NoError(t, login("Correct-Horse-42"))
+
+	for i := 0; i < 3; i++ {
+		require.Error(t, login("wrong-password"))
+	}
+	err := login("Correct-Horse-42")
+	var locked *auth.LoginLockedError
+	require.True(t, errors.As(err, &locked), "%v", err)
+	assert.InDelta(t, 600, locked.RetryAfter.Seconds(), 5)
+	assert.Equal(t, apierrors.CodeLoginLocked, apierrors.CodeOf(err))
+	assert.Equal(t, http.StatusTooManyRequests, apierrors.HTTPStatus(err))
+
+	entries, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionLoginLocked})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "carol", entries[0].ResourceID)
+
+	// The lockout is stored, so it survives a restart
+	restarted := auth.NewService(db, userService, zap.NewNop())
+	restarted.SetLoginLockout(lockout)
+	_, err = restarted.Login(ctx, &auth.LoginRequest{Username: "carol", Password: "Correct-Horse-42"})
+	assert.True(t, errors.As(err, &locked))
+
+	// An admin unlock lets the user in again
+	unlocked, err := authService.UnlockLogin(ctx, "carol", "admin-1")
+	require.NoError(t, err)
+	assert.True(t, unlocked)
+	require.NoError(t, login("Correct-Horse-42"))
+	unlocked, err = authService.UnlockLogin(ctx, "carol", "admin-1")
+	require.NoError(t, err)
+	assert.False(t, unlocked)
+	entries, err = db.ListAuditEntries(ctx, database.AuditFilter{Action: auth.AuditActionLoginUnlocked})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "admin-1", entries[0].ActorID)
+}
+
+func TestLoginThrottleDelaysAndClientAddress(t *testing.T) {
+	authService, _, _ := setupLockoutTest(t, config.LoginLockoutConfig{
+		Enabled: true, MaxFailures: 10, MaxFailuresPerIP: 2, BaseDelayMs: 60000, LockoutSeconds: 600,
+	})
+	ctx := context.Background()
+
+	// Each failure blocks the next attempt for a growing delay, even with the right password
+	_, err := authService.Login(ctx, &auth.LoginRequest{Username: "carol", Password: "wrong-password", ClientIP: "10.0.0.1"})
+	require.Error(t, err)
+	_, err = authService.Login(ctx, &auth.LoginRequest{Username: "carol", Password: "Correct-Horse-42", ClientIP: "10.0.0.2"})
+	var locked *auth.LoginLockedError
+	require.True(t, errors.As(err, &locked), "%v", err)
+	assert.InDelta(t, 60, locked.RetryAfter.Seconds(), 5)
+
+	// Unknown usernames count too, and an address trying many usernames is locked out
+	authService.SetLoginLockout(config.LoginLockoutConfig{Enabled: true, MaxFailures: 10, MaxFailuresPerIP: 2, LockoutSeconds: 600})
+	_, err = authService.Login(ctx, &auth.LoginRequest{Username: "nobody", Password: "guess-1", ClientIP: "10.0.0.3"})
+	require.Error(t, err)
+	_, err = authService.Login(ctx, &auth.LoginRequest{Username: "somebody", Password: "guess-2", ClientIP: "10.0.0.3"})
+	require.Error(t, err)
+	_, err = authService.Login(ctx, &auth.LoginRequest{Username: "anybody", Password: "guess-3", ClientIP: "10.0.0.3"})
+	require.True(t, errors.As(err, &locked), "%v", err)
+	assert.InDelta(t, 600, locked.RetryAfter.Seconds(), 5)
+	_, err = authService.Login(ctx, &auth.LoginRequest{Username: "anybody", Password: "guess-3", ClientIP: "10.0.0.4"})
+	assert.False(t, errors.As(err, &locked))
+}
+
+func TestLoginLockoutAPI(t *testing.T) {
+	router, db, authService, userService := setupFullAPITest(t)
+	authService.SetLoginLockout(config.LoginLockoutConfig{Enabled: true, MaxFailures: 2, MaxFailuresPerIP: 100, LockoutSeconds: 300})
+	createUserForTest(t, userService, "admin", "password123", users.RoleAdmin)
+	dave := createUserForTest(t, userService, "dave", "password123", users.RoleUser)
+	adminToken := getTokenForUser(t, router, "admin", "password123")
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(auth.LoginRequest{Username: "dave", Password: password})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+		req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.7")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	assert.Equal(t, http.StatusUnauthorized, login("wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, login("wrong").Code)
+	rr := login("password123")
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "300", rr.Header().Get("Retry-After"))
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apierrors.CodeLoginLocked, errResp.Code)
+
+	entries, err := db.ListAuditEntries(context.Background(), database.AuditFilter{Action: auth.AuditActionLoginLocked})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	// The router trusts no proxy, so the forwarded address is ignored
+	assert.Equal(t, "192.0.2.1", entries[0].ClientIP)
+
+	unlock := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/users/"+dave.ID+"/unlock", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr = unlock(adminToken)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"failures_cleared":true`)
+	assert.Equal(t, http.StatusOK, login("password123").Code)
+
+	daveToken := getTokenForUser(t, router, "dave", "password123")
+	assert.Equal(t, http.StatusForbidden, unlock(daveToken).Code)
+}
+
+func TestPasswordPolicyAPI(t *testing.T) {
+	router, _, _, userService := setupFullAPITest(t)
+	userService.SetPasswordPolicy(config.PasswordPolicyConfig{MinLength: 12, RejectCommon: true})
+	createUserForTest(t, userService, "erin", "Correct-Horse-42", users.RoleAdmin)
+	token := getTokenForUser(t, router, "erin", "Correct-Horse-42")
+
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("/api/v1/users", map[string]string{"username": "frank", "password": "short"})
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apierrors.ValidationFailed.Code(), errResp.Code)
+	require.Len(t, errResp.Details, 1)
+	assert.Equal(t, models.ErrorDetail{Field: "password", Code: validator.CodeTooShort, Message: "password: must be at least 12 characters, got 5"}, errResp.Details[0])
+
+	rr = post("/api/v1/auth/change-password", map[string]string{"current_password": "Correct-Horse-42", "new_password": "password1234"})
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	errResp = models.ErrorResponse{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	require.Len(t, errResp.Details, 1)
+	assert.Equal(t, "new_password", errResp.Details[0].Field)
+	assert.Equal(t, validator.CodeInvalidValue, errResp.Details[0].Code)
+
+	rr = post("/api/v1/auth/change-password", map[string]string{"current_password": "Correct-Horse-42", "new_password": "Battery-Staple-7"})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
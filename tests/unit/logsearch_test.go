@@ -0,0 +1,242 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// syntheticLog returns a pod log of n timestamped lines, one second apart from base, where every
+// 1000th line is an error
+func syntheticLog(base time.Time, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf("request %d handled in %dms by worker-%d", i, i%250, i%8)
+		if i%1000 == 999 {
+			msg = fmt.Sprintf("ERROR request %d failed: connection reset", i)
+		}
+		fmt.Fprintf(&b, "%s %s\n", base.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano), msg)
+	}
+	return b.String()
+}
+
+func TestLogFilterValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter orchestrator.LogFilter
+	}{
+		{"invalid regex", orchestrator.LogFilter{Grep: "(unclosed", Regex: true}},
+		{"backreference", orchestrator.LogFilter{Grep: `(a)\1`, Regex: true}},
+		{"pattern too long", orchestrator.LogFilter{Grep: strings.Repeat("a", orchestrator.MaxLogSearchPatternLength+1)}},
+		{"unknown stream", orchestrator.LogFilter{Streams: []string{"stdin"}}},
+		{"too much context", orchestrator.LogFilter{Before: orchestrator.MaxLogSearchContextLines + 1}},
+		{"negative context", orchestrator.LogFilter{After: -1}},
+		{"until before since", orchestrator.LogFilter{Since: time.Now(), Until: time.Now().Add(-time.Hour)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.filter.Compile(), apierrors.ValidationFailed)
+		})
+	}
+
+	// Substring patterns are not interpreted
+	f := orchestrator.LogFilter{Grep: "(unclosed"}
+	assert.NoError(t, f.Compile())
+}
+
+func TestSearchLogsLargeLog(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "search-env"})
+
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	logs := syntheticLog(base, 80000)
+	require.Greater(t, len(logs), 4<<20)
+	mockK8s.SetPodLogs(env.Namespace, "main", logs)
+
+	t.Run("substring with context", func(t *testing.T) {
+		filter := &orchestrator.LogFilter{Grep: "ERROR", Before: 2, After: 1}
+		require.NoError(t, filter.Compile())
+		resp, err := orch.SearchLogs(ctx, env.ID, nil, filter)
+		require.NoError(t, err)
+		assert.False(t, resp.Truncated)
+		// The last error is the last line, so it has no trailing context
+		require.Len(t, resp.Logs, 80*4-1)
+
+		assert.True(t, resp.Logs[0].Context)
+		assert.Equal(t, "request 997 handled in 247ms by worker-5", resp.Logs[0].Message)
+		assert.True(t, resp.Logs[1].Context)
+		assert.False(t, resp.Logs[2].Context)
+		assert.Equal(t, "ERROR request 999 failed: connection reset", resp.Logs[2].Message)
+		assert.Equal(t, base.Add(999*time.Second), resp.Logs[2].Timestamp)
+		assert.Equal(t, "stdout", resp.Logs[2].Stream)
+		assert.True(t, resp.Logs[3].Context)
+		assert.Equal(t, "request 1000 handled in 0ms by worker-0", resp.Logs[3].Message)
+	})
+
+	t.Run("regex within a time window", func(t *testing.T) {
+		filter := &orchestrator.LogFilter{
+			Grep:  `^ERROR request \d+5999 `,
+			Regex: true,
+			Since: base.Add(10000 * time.Second),
+			Until: base.Add(40000 * time.Second),
+		}
+		require.NoError(t, filter.Compile())
+		resp, err := orch.SearchLogs(ctx, env.ID, nil, filter)
+		require.NoError(t, err)
+		require.Len(t, resp.Logs, 3)
+		assert.Equal(t, "ERROR request 15999 failed: connection reset", resp.Logs[0].Message)
+		assert.Equal(t, "ERROR request 35999 failed: connection reset", resp.Logs[2].Message)
+	})
+
+	t.Run("results are capped", func(t *testing.T) {
+		filter := &orchestrator.LogFilter{Grep: "request"}
+		require.NoError(t, filter.Compile())
+		resp, err := orch.SearchLogs(ctx, env.ID, nil, filter)
+		require.NoError(t, err)
+		assert.True(t, resp.Truncated)
+		assert.Len(t, resp.Logs, 10000)
+	})
+
+	t.Run("searches that run out of time are truncated", func(t *testing.T) {
+		filter := &orchestrator.LogFilter{Grep: `(worker-\d+\s*)+$`, Regex: true, Timeout: time.Nanosecond}
+		require.NoError(t, filter.Compile())
+		resp, err := orch.SearchLogs(ctx, env.ID, nil, filter)
+		require.NoError(t, err)
+		assert.True(t, resp.Truncated)
+		assert.Less(t, len(resp.Logs), 80000)
+	})
+
+	t.Run("pathological patterns run in linear time", func(t *testing.T) {
+		mockK8s.SetPodLogs(env.Namespace, "main", strings.Repeat(base.Format(time.RFC3339)+" "+strings.Repeat("a", 4096)+"!\n", 500))
+		filter := &orchestrator.LogFilter{Grep: `^(a+)+$`, Regex: true, Timeout: 10 * time.Second}
+		require.NoError(t, filter.Compile())
+		start := time.Now()
+		resp, err := orch.SearchLogs(ctx, env.ID, nil, filter)
+		require.NoError(t, err)
+		assert.False(t, resp.Truncated)
+		assert.Empty(t, resp.Logs)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
+
+func TestSearchLogsStreams(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), setupTestDB(t))
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "streams-env"})
+	mockK8s.SetPodLogs(env.Namespace, "main", "2026-03-01T12:00:00Z pod output\n")
+
+	filter := &orchestrator.LogFilter{Streams: []string{"reconciliation"}}
+	require.NoError(t, filter.Compile())
+	resp, err := orch.SearchLogs(ctx, env.ID, nil, filter)
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.Logs)
+	for _, e := range resp.Logs {
+		assert.Equal(t, "reconciliation", e.Stream)
+	}
+
+	filter = &orchestrator.LogFilter{Streams: []string{"stdout"}}
+	require.NoError(t, filter.Compile())
+	resp, err = orch.SearchLogs(ctx, env.ID, nil, filter)
+	require.NoError(t, err)
+	require.Len(t, resp.Logs, 1)
+	assert.Equal(t, "pod output", resp.Logs[0].Message)
+}
+
+func TestLogSearchAPI(t *testing.T) {
+	_, mockK8s, router := setupAPITestWithMock(t)
+	ctx := context.Background()
+
+	body, _ := json.Marshal(models.CreateEnvironmentRequest{
+		Name:      "search-api-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+	require.Eventually(t, func() bool {
+		pod, err := mockK8s.GetPod(ctx, env.Namespace, "main")
+		return err == nil && pod != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	mockK8s.SetPodLogs(env.Namespace, "main",
+		"2026-03-01T12:00:00Z starting\n2026-03-01T12:00:01Z loading model\n2026-03-01T12:00:02Z Traceback (most recent call last)\n"+
+			"2026-03-01T12:00:03Z ValueError: bad input\n2026-03-01T12:00:04Z retrying\n2026-03-01T12:00:05Z Traceback again\n")
+
+	get := func(query url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/logs?"+query.Encode(), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	messages := func(entries []models.LogEntry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Message)
+		}
+		return out
+	}
+
+	t.Run("grep with context", func(t *testing.T) {
+		rr := get(url.Values{"grep": {"Traceback"}, "after": {"1"}, "stream": {"stdout"}})
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp models.LogsResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Equal(t, []string{"Traceback (most recent call last)", "ValueError: bad input", "Traceback again"}, messages(resp.Logs))
+		assert.True(t, resp.Logs[1].Context)
+	})
+
+	t.Run("time window", func(t *testing.T) {
+		rr := get(url.Values{"since": {"2026-03-01T12:00:01Z"}, "until": {"2026-03-01T12:00:02Z"}, "stream": {"stdout"}})
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp models.LogsResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Equal(t, []string{"loading model", "Traceback (most recent call last)"}, messages(resp.Logs))
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, q := range []url.Values{
+			{"grep": {"[a-"}, "regex": {"true"}},
+			{"since": {"yesterday"}},
+			{"before": {"many"}},
+			{"stream": {"stdin"}},
+		} {
+			rr := get(q)
+			assert.Equal(t, http.StatusBadRequest, rr.Code, q.Encode())
+		}
+	})
+
+	t.Run("follow mode applies the filter", func(t *testing.T) {
+		rr := get(url.Values{"follow": {"true"}, "grep": {`^Traceback`}, "regex": {"true"}, "before": {"1"}})
+		require.Equal(t, http.StatusOK, rr.Code)
+		var entries []models.LogEntry
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var entry models.LogEntry
+				require.NoError(t, json.Unmarshal([]byte(data), &entry))
+				entries = append(entries, entry)
+			}
+		}
+		assert.Equal(t, []string{"loading model", "Traceback (most recent call last)", "retrying", "Traceback again"}, messages(entries))
+		assert.True(t, entries[0].Context)
+		assert.False(t, entries[1].Context)
+	})
+}
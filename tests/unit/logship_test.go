@@ -0,0 +1,258 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/logship"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// lokiReceiver records the lines pushed to a fake Loki push API
+type lokiReceiver struct {
+	mu     sync.Mutex
+	lines  []string
+	labels map[string]string
+	tenant string
+}
+
+func (l *lokiReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tenant = r.Header.Get("X-Scope-OrgID")
+	for _, stream := range push.Streams {
+		l.labels = stream.Stream
+		for _, v := range stream.Values {
+			l.lines = append(l.lines, v[1])
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received returns the lines pushed, without the mock's default log line (which the follower
+// may read before a test sets the pod's log)
+func (l *lokiReceiver) received() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for _, line := range l.lines {
+		if line != "mock log output" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// logAt returns a log line with a Kubernetes timestamp offset from now (later than the mock's
+// default log line)
+func logAt(offset time.Duration, text string) string {
+	return time.Now().Add(offset).UTC().Format(time.RFC3339Nano) + " " + text + "\n"
+}
+
+// logShipConfig completes shipping with small, fast batches and retries
+func logShipConfig(shipping config.LogShippingConfig) *config.Config {
+	shipping.BatchLines = 100
+	shipping.BatchBytes = 1024 * 1024
+	shipping.FlushIntervalMs = 20
+	shipping.InitialBackoffMs = 10
+	shipping.TimeoutSeconds = 5
+	if shipping.MaxAttempts == 0 {
+		shipping.MaxAttempts = 3
+	}
+	cfg := testOrchestratorConfig()
+	cfg.LogShipping = shipping
+	return cfg
+}
+
+func logShippingStats(t *testing.T, orch *orchestrator.Orchestrator, envID string) *models.LogShippingStats {
+	stats, err := orch.GetExecutionStats(context.Background(), envID, nil, nil)
+	require.NoError(t, err)
+	return stats.LogShipping
+}
+
+func TestLogShippingToLoki(t *testing.T) {
+	loki := &lokiReceiver{}
+	server := httptest.NewServer(loki)
+	defer server.Close()
+	orch, mockK8s := setupConfiguredOrchestrator(t, logShipConfig(config.LogShippingConfig{
+		Credentials: map[string]config.LogShippingCredentials{
+			"loki-main": {URL: server.URL + "/loki/api/v1/push", TenantID: "team-a"},
+		},
+	}), nil)
+	orch.SetLogSinkFactory(logship.NewSink)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:        "shipped-env",
+		LogShipping: &models.LogShippingSpec{Sink: config.LogSinkLoki, Credentials: "loki-main"},
+	})
+	mockK8s.SetPodLogs(env.Namespace, "main", logAt(time.Minute, "booted")+logAt(2*time.Minute, "serving"))
+	require.Eventually(t, func() bool { return len(loki.received()) >= 2 }, 5*time.Second, 20*time.Millisecond)
+
+	// The mock log ends after every read; following it again ships no line twice
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, []string{"booted", "serving"}, loki.received())
+	loki.mu.Lock()
+	assert.Equal(t, env.ID, loki.labels["environment_id"])
+	assert.Equal(t, "main", loki.labels["pod"])
+	assert.Equal(t, "team-a", loki.tenant)
+	loki.mu.Unlock()
+
+	// A recreated pod's log is followed from its start
+	mockK8s.SetPodLogs(env.Namespace, "main", logAt(time.Hour, "restarted"))
+	require.Eventually(t, func() bool { return len(loki.received()) == 3 }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "restarted", loki.received()[2])
+
+	stats := logShippingStats(t, orch, env.ID)
+	require.NotNil(t, stats)
+	assert.Equal(t, config.LogSinkLoki, stats.Sink)
+	assert.Equal(t, "loki-main", stats.Credentials)
+	loki.mu.Lock()
+	var shippedBytes int
+	for _, line := range loki.lines {
+		shippedBytes += len(line)
+	}
+	assert.Equal(t, int64(len(loki.lines)), stats.ShippedLines)
+	loki.mu.Unlock()
+	assert.Equal(t, int64(shippedBytes), stats.ShippedBytes)
+	assert.NotNil(t, stats.LastShippedAt)
+	assert.Empty(t, stats.LastError)
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, true))
+	_, err := orch.GetExecutionStats(ctx, env.ID, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestLogShippingDropsRejectedBatches(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		headers = r.Header.Clone()
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	orch, mockK8s := setupConfiguredOrchestrator(t, logShipConfig(config.LogShippingConfig{
+		MaxAttempts: 2,
+		Credentials: map[string]config.LogShippingCredentials{
+			"hook": {URL: server.URL, Secret: "s3cret"},
+		},
+	}), nil)
+	orch.SetLogSinkFactory(logship.NewSink)
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:        "rejected-env",
+		LogShipping: &models.LogShippingSpec{Sink: config.LogSinkWebhook, Credentials: "hook"},
+	})
+	mockK8s.SetPodLogs(env.Namespace, "main", logAt(time.Minute, "one")+logAt(2*time.Minute, "two"))
+
+	// The mock's default log line may have been dropped first
+	require.Eventually(t, func() bool {
+		stats := logShippingStats(t, orch, env.ID)
+		return stats != nil && stats.DroppedLines >= 2
+	}, 5*time.Second, 20*time.Millisecond)
+	stats := logShippingStats(t, orch, env.ID)
+	assert.Zero(t, stats.ShippedLines)
+	assert.Contains(t, stats.LastError, "status 503")
+	assert.NotNil(t, stats.LastErrorAt)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Every batch is pushed max_attempts times
+	assert.Equal(t, 0, requests%2)
+	assert.Equal(t, env.ID, headers.Get(logship.EnvironmentIDHeader))
+	assert.NotEmpty(t, headers.Get(logship.BatchHeader))
+	assert.NotEmpty(t, headers.Get(orchestrator.CallbackSignatureHeader))
+}
+
+func TestLogShippingDefault(t *testing.T) {
+	loki := &lokiReceiver{}
+	server := httptest.NewServer(loki)
+	defer server.Close()
+	orch, _ := setupConfiguredOrchestrator(t, logShipConfig(config.LogShippingConfig{
+		Enabled:            true,
+		DefaultSink:        config.LogSinkLoki,
+		DefaultCredentials: "loki-main",
+		Credentials: map[string]config.LogShippingCredentials{
+			"loki-main": {URL: server.URL},
+		},
+	}), nil)
+	orch.SetLogSinkFactory(logship.NewSink)
+
+	// Every environment ships its log unless it opts out
+	shipped := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "default-shipped"})
+	optedOut := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:        "opted-out",
+		LogShipping: &models.LogShippingSpec{Disabled: true},
+	})
+	require.Eventually(t, func() bool {
+		stats := logShippingStats(t, orch, shipped.ID)
+		return stats != nil && stats.ShippedLines > 0
+	}, 5*time.Second, 20*time.Millisecond)
+	stats := logShippingStats(t, orch, shipped.ID)
+	require.NotNil(t, stats)
+	assert.Equal(t, "loki-main", stats.Credentials)
+	assert.Nil(t, logShippingStats(t, orch, optedOut.ID))
+}
+
+func TestLogShippingValidation(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, logShipConfig(config.LogShippingConfig{
+		Credentials: map[string]config.LogShippingCredentials{
+			"hook": {URL: "https://logs.example.com/ingest"},
+		},
+	}), nil)
+	orch.SetLogSinkFactory(logship.NewSink)
+	ctx := context.Background()
+
+	for _, spec := range []*models.LogShippingSpec{
+		{Sink: config.LogSinkLoki, Credentials: "missing"},
+		{Sink: config.LogSinkS3, Credentials: "hook"}, // no bucket
+	} {
+		_, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+			Name:        "bad-shipping",
+			Image:       "python:3.11-slim",
+			Resources:   models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+			LogShipping: spec,
+		}, "user-123")
+		var apiErr *apierrors.Error
+		require.True(t, errors.As(err, &apiErr), "spec %+v", spec)
+		assert.Equal(t, apierrors.CodeLogShippingNotConfigured, apiErr.Code)
+	}
+
+	val := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	err := val.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name:        "bad-shipping",
+		Image:       "python:3.11-slim",
+		Resources:   models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		LogShipping: &models.LogShippingSpec{Sink: "syslog"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "log_shipping.sink")
+	assert.Contains(t, err.Error(), "log_shipping.credentials")
+}
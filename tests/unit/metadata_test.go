@@ -0,0 +1,273 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func TestEnvironmentMetadata(t *testing.T) {
+	for _, withDB := range []bool{true, false} {
+		name := "memory"
+		if withDB {
+			name = "database"
+		}
+		t.Run(name, func(t *testing.T) {
+			var db *database.DB
+			if withDB {
+				db = setupTestDB(t)
+			}
+			orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+			ctx := context.Background()
+
+			// Values no Kubernetes label could hold
+			runURL := "https://ci.example.com/runs/8841?attempt=2"
+			first := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+				Name:     "meta-a",
+				Metadata: map[string]string{"run url": runURL, "config": `{"shards": 4}`},
+			})
+			second := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+				Name:     "meta-b",
+				Metadata: map[string]string{"run url": "https://ci.example.com/runs/9000"},
+			})
+			assert.Equal(t, runURL, first.Metadata["run url"])
+
+			if withDB {
+				stored, err := db.GetEnvironment(ctx, first.ID)
+				require.NoError(t, err)
+				assert.Equal(t, first.Metadata, stored.Metadata)
+			}
+
+			// Metadata never reaches the cluster
+			for _, labels := range []map[string]string{mockK8s.NamespaceLabels(first.Namespace), mockK8s.CreatedPodSpec(first.Namespace, "main").Labels} {
+				assert.NotContains(t, labels, "run url")
+				assert.NotContains(t, labels, "config")
+			}
+
+			list := func(match map[string]string) []string {
+				resp, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Metadata: match})
+				require.NoError(t, err)
+				ids := make([]string, 0, len(resp.Environments))
+				for _, env := range resp.Environments {
+					ids = append(ids, env.ID)
+				}
+				return ids
+			}
+			assert.Equal(t, []string{first.ID}, list(map[string]string{"run url": runURL}))
+			assert.Equal(t, []string{first.ID}, list(map[string]string{"run url": runURL, "config": `{"shards": 4}`}))
+			assert.Empty(t, list(map[string]string{"run url": runURL, "config": "other"}))
+			assert.Empty(t, list(map[string]string{"missing": ""}))
+			assert.Len(t, list(nil), 2)
+
+			// PATCH replaces the metadata; an empty map removes it
+			replaced := map[string]string{"run url": "https://ci.example.com/runs/9000", "verdict": "flaky"}
+			updated, err := orch.UpdateEnvironment(ctx, first.ID, &models.UpdateEnvironmentRequest{Metadata: &replaced})
+			require.NoError(t, err)
+			assert.Equal(t, replaced, updated.Metadata)
+			assert.ElementsMatch(t, []string{first.ID, second.ID}, list(map[string]string{"run url": "https://ci.example.com/runs/9000"}))
+
+			empty := map[string]string{}
+			updated, err = orch.UpdateEnvironment(ctx, first.ID, &models.UpdateEnvironmentRequest{Metadata: &empty})
+			require.NoError(t, err)
+			assert.Nil(t, updated.Metadata)
+			if withDB {
+				stored, err := db.GetEnvironment(ctx, first.ID)
+				require.NoError(t, err)
+				assert.Nil(t, stored.Metadata)
+			}
+		})
+	}
+}
+
+func TestExecutionMetadata(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "exec-meta-env"})
+
+	submit := func(metadata map[string]string) *models.Execution {
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"pytest"}, Metadata: metadata,
+		}, "user-123")
+		require.NoError(t, err)
+		return waitForExecutionDone(t, orch, exec.ID)
+	}
+	tagged := submit(map[string]string{"job": "nightly/2026-01-22", "attempt": "2"})
+	other := submit(map[string]string{"job": "nightly/2026-01-21"})
+	assert.Equal(t, "nightly/2026-01-22", tagged.Metadata["job"])
+	assert.Equal(t, tagged.Metadata, models.NewExecutionResponse(tagged).Metadata)
+
+	spec := mockK8s.CreatedPodSpec(env.Namespace, tagged.ID)
+	require.NotNil(t, spec)
+	assert.NotContains(t, spec.Labels, "job")
+	assert.NotContains(t, spec.Env, "job")
+
+	list := func(match map[string]string) []string {
+		resp, err := orch.ListExecutionsWithOptions(ctx, env.ID, orchestrator.ListExecutionsOptions{Metadata: match})
+		require.NoError(t, err)
+		ids := make([]string, 0, len(resp.Executions))
+		for _, exec := range resp.Executions {
+			ids = append(ids, exec.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{tagged.ID}, list(map[string]string{"job": "nightly/2026-01-22"}))
+	assert.Equal(t, []string{tagged.ID}, list(map[string]string{"job": "nightly/2026-01-22", "attempt": "2"}))
+	assert.Empty(t, list(map[string]string{"attempt": "3"}))
+	count, err := db.CountExecutions(ctx, database.ExecutionListFilter{EnvironmentID: env.ID, Metadata: map[string]string{"job": "nightly/2026-01-21"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Finished executions can be tagged afterwards
+	verdict := map[string]string{"job": "nightly/2026-01-21", "verdict": "flaky"}
+	updated, err := orch.UpdateExecution(ctx, other.ID, &models.UpdateExecutionRequest{Metadata: &verdict})
+	require.NoError(t, err)
+	assert.Equal(t, verdict, updated.Metadata)
+	stored, err := db.GetExecution(ctx, other.ID)
+	require.NoError(t, err)
+	assert.Equal(t, verdict, stored.Metadata)
+	assert.Equal(t, models.ExecutionStatusCompleted, stored.Status)
+	assert.Equal(t, []string{other.ID}, list(map[string]string{"verdict": "flaky"}))
+
+	_, err = orch.UpdateExecution(ctx, "exec-missing", &models.UpdateExecutionRequest{Metadata: &verdict})
+	assert.Error(t, err)
+}
+
+func TestValidateMetadata(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	assert.NoError(t, v.ValidateMetadata(map[string]string{
+		"pr":     "https://github.com/acme/app/pull/17",
+		"config": `{"shards": 4, "retry": true}`,
+		"empty":  "",
+	}))
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= models.MaxMetadataKeys; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	fieldCodes := func(err error) map[string]string {
+		var verrs validator.ValidationErrors
+		require.True(t, errors.As(err, &verrs))
+		fields := make(map[string]string)
+		for _, ve := range verrs {
+			fields[ve.Field] = ve.Code
+		}
+		return fields
+	}
+	assert.Equal(t, validator.CodeOutOfRange, fieldCodes(v.ValidateMetadata(tooMany))["metadata"])
+
+	longKey := strings.Repeat("k", models.MaxMetadataKeyLength+1)
+	assert.Equal(t, map[string]string{
+		"metadata":            validator.CodeInvalidValue,
+		"metadata." + longKey: validator.CodeTooLong,
+		"metadata.big":        validator.CodeTooLong,
+		"metadata.nul":        validator.CodeInvalidFormat,
+	}, fieldCodes(v.ValidateMetadata(map[string]string{
+		"":      "v",
+		longKey: "v",
+		"big":   strings.Repeat("x", models.MaxMetadataValueBytes+1),
+		"nul":   "a\x00b",
+	})))
+
+	// Create and submit requests are checked too
+	err := v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name: "meta", Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Metadata:  map[string]string{"big": strings.Repeat("x", models.MaxMetadataValueBytes+1)},
+	})
+	assert.Equal(t, validator.CodeTooLong, fieldCodes(err)["metadata.big"])
+	err = v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		EnvironmentID: "env-1", Command: []string{"ls"}, Metadata: map[string]string{"": "v"},
+	})
+	assert.Equal(t, validator.CodeInvalidValue, fieldCodes(err)["metadata"])
+}
+
+func TestMetadataAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, reader))
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/api/v1/environments", models.CreateEnvironmentRequest{
+		Name:      "meta-api-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Metadata:  map[string]string{"run_id": "gh-8841/2026-01-22T10:00:00Z"},
+	})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+	assert.Equal(t, "gh-8841/2026-01-22T10:00:00Z", env.Metadata["run_id"])
+	require.Eventually(t, func() bool {
+		rr := do(http.MethodGet, "/api/v1/environments/"+env.ID, nil)
+		var got models.Environment
+		return rr.Code == http.StatusOK && json.NewDecoder(rr.Body).Decode(&got) == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	rr = do(http.MethodGet, "/api/v1/environments?"+url.Values{"metadata.run_id": {"gh-8841/2026-01-22T10:00:00Z"}}.Encode(), nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var envs models.ListEnvironmentsResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&envs))
+	require.Len(t, envs.Environments, 1)
+	assert.Equal(t, env.ID, envs.Environments[0].ID)
+
+	rr = do(http.MethodGet, "/api/v1/environments?metadata.run_id=other", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&envs))
+	assert.Empty(t, envs.Environments)
+
+	tooBig := map[string]string{"notes": strings.Repeat("x", models.MaxMetadataValueBytes+1)}
+	rr = do(http.MethodPatch, "/api/v1/environments/"+env.ID, models.UpdateEnvironmentRequest{Metadata: &tooBig})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "metadata.notes")
+
+	// Executions take metadata at submit and can be patched later
+	rr = do(http.MethodPost, "/api/v1/environments/"+env.ID+"/run", models.EphemeralExecRequest{
+		Command: []string{"ls"}, Metadata: map[string]string{"step": "lint"},
+	})
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var exec models.ExecutionResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&exec))
+	assert.Equal(t, map[string]string{"step": "lint"}, exec.Metadata)
+
+	patched := map[string]string{"step": "lint", "owner": "ci@example.com"}
+	rr = do(http.MethodPatch, "/api/v1/executions/"+exec.ID, models.UpdateExecutionRequest{Metadata: &patched})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&exec))
+	assert.Equal(t, patched, exec.Metadata)
+
+	rr = do(http.MethodGet, "/api/v1/environments/"+env.ID+"/executions?metadata.owner=ci%40example.com", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var execs models.ExecutionListResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&execs))
+	require.Len(t, execs.Executions, 1)
+	assert.Equal(t, exec.ID, execs.Executions[0].ID)
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPatch, "/api/v1/executions/exec-missing", models.UpdateExecutionRequest{Metadata: &patched}).Code)
+}
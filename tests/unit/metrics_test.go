@@ -2,17 +2,25 @@ package unit
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/auth"
 	"github.com/sciffer/agentbox/pkg/database"
 	"github.com/sciffer/agentbox/pkg/metrics"
+	"github.com/sciffer/agentbox/pkg/users"
 )
 
 func setupMetricsTest(t *testing.T) (*database.DB, *metrics.Collector) {
@@ -269,3 +277,180 @@ func TestMetricsFilterByEnvironment(t *testing.T) {
 	assert.Equal(t, 200.0, metricList[0].Value)
 	assert.Equal(t, "env-2", *metricList[0].EnvironmentID)
 }
+
+// insertSamples stores one cpu_usage and memory_usage sample per interval between from and to,
+// in a single transaction
+func insertSamples(t *testing.T, db *database.DB, envID string, from, to time.Time, interval time.Duration, cpu func(time.Time) float64) int {
+	var env interface{}
+	if envID != "" {
+		env = envID
+	}
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback() //nolint:errcheck // Only rolls back when a check fails before Commit
+	stmt, err := tx.Prepare(`INSERT INTO metrics (id, environment_id, metric_type, value, timestamp) VALUES ($1, $2, $3, $4, $5)`)
+	require.NoError(t, err)
+	defer stmt.Close()
+	n := 0
+	for ts := from; ts.Before(to); ts = ts.Add(interval) {
+		for _, metricType := range []string{"cpu_usage", "memory_usage"} {
+			_, err := stmt.Exec(fmt.Sprintf("%s-%s-%d", envID, metricType, ts.UnixNano()), env, metricType, cpu(ts), ts.UTC())
+			require.NoError(t, err)
+		}
+		n++
+	}
+	require.NoError(t, tx.Commit())
+	return n
+}
+
+func TestMetricsRollupAndRetention(t *testing.T) {
+	db, collector := setupMetricsTest(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	// Three days of samples every minute; cpu is the minute of the hour
+	insertSamples(t, db, "env-rollup", now.Add(-72*time.Hour), now.Add(7*time.Minute), time.Minute,
+		func(ts time.Time) float64 { return float64(ts.Minute()) })
+
+	n, err := collector.Rollup(ctx, now.Add(7*time.Minute))
+	require.NoError(t, err)
+	// 72 hours plus the one completed bucket of the current hour, two metric types
+	assert.Equal(t, (72*12+1)*2, n)
+
+	var bucket struct {
+		sum   float64
+		count int
+		max   float64
+	}
+	require.NoError(t, db.QueryRow(`SELECT value_sum, value_count, value_max FROM metric_rollups
+		WHERE environment_id = 'env-rollup' AND metric_type = 'cpu_usage' AND bucket_start = $1`, now.Add(-time.Hour+10*time.Minute)).
+		Scan(&bucket.sum, &bucket.count, &bucket.max))
+	assert.Equal(t, 5, bucket.count)
+	assert.Equal(t, float64(10+11+12+13+14), bucket.sum)
+	assert.Equal(t, float64(14), bucket.max)
+
+	// Raw samples past the raw retention are gone; the open bucket's samples are kept
+	var oldest time.Time
+	require.NoError(t, db.QueryRow(`SELECT timestamp FROM metrics ORDER BY timestamp ASC LIMIT 1`).Scan(&oldest))
+	assert.False(t, oldest.Before(now.Add(7*time.Minute-metrics.DefaultRawRetention)))
+
+	// Running again only rolls up newly completed buckets
+	n, err = collector.Rollup(ctx, now.Add(7*time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	insertSamples(t, db, "env-rollup", now.Add(7*time.Minute), now.Add(12*time.Minute), time.Minute,
+		func(time.Time) float64 { return 1 })
+	n, err = collector.Rollup(ctx, now.Add(12*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// Rollups past their retention are deleted
+	_, err = collector.Rollup(ctx, now.Add(metrics.DefaultRollupRetention-24*time.Hour))
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM metric_rollups WHERE bucket_start < $1`,
+		now.Add(-24*time.Hour).UTC()).Scan(&count))
+	assert.Zero(t, count)
+}
+
+func TestMetricsHistoryDownsampling(t *testing.T) {
+	db, collector := setupMetricsTest(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	insertSamples(t, db, "env-history", now.Add(-48*time.Hour), now, time.Minute,
+		func(ts time.Time) float64 { return float64(ts.Minute()) })
+	insertSamples(t, db, "env-other", now.Add(-48*time.Hour), now, time.Minute, func(time.Time) float64 { return 999 })
+	_, err := collector.Rollup(ctx, now)
+	require.NoError(t, err)
+
+	t.Run("hourly buckets across rollups and raw samples", func(t *testing.T) {
+		history, err := metrics.GetHistory(ctx, db, "env-history", now.Add(-48*time.Hour), now.Add(-time.Second), time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3600), history.StepSeconds)
+		require.Len(t, history.Timestamps, 48)
+		assert.Equal(t, now.Add(-48*time.Hour), history.Timestamps[0])
+		cpu := history.Series["cpu_usage"]
+		require.Len(t, cpu.Avg, 48)
+		for i := range history.Timestamps {
+			require.NotNil(t, cpu.Avg[i])
+			assert.InDelta(t, 29.5, *cpu.Avg[i], 0.001)
+			assert.Equal(t, float64(59), *cpu.Max[i])
+		}
+		assert.Nil(t, history.Series["running_sandboxes"].Avg[0])
+	})
+
+	t.Run("fine steps use raw samples", func(t *testing.T) {
+		history, err := metrics.GetHistory(ctx, db, "env-history", now.Add(-10*time.Minute), now.Add(-time.Second), time.Minute)
+		require.NoError(t, err)
+		require.Len(t, history.Timestamps, 10)
+		assert.Equal(t, float64(50), *history.Series["cpu_usage"].Avg[0])
+	})
+
+	t.Run("responses are capped", func(t *testing.T) {
+		history, err := metrics.GetHistory(ctx, db, "env-history", now.Add(-48*time.Hour), now, time.Second)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(history.Timestamps), metrics.MaxHistoryPoints)
+		assert.GreaterOrEqual(t, history.StepSeconds, int64(48*3600/metrics.MaxHistoryPoints))
+	})
+
+	t.Run("top environments", func(t *testing.T) {
+		top, err := metrics.TopEnvironments(ctx, db, now.Add(-48*time.Hour), now, 10)
+		require.NoError(t, err)
+		require.Len(t, top, 2)
+		assert.Equal(t, "env-other", top[0].EnvironmentID)
+		assert.Equal(t, float64(999), top[0].CPUAvg)
+		assert.InDelta(t, 29.5, top[1].CPUAvg, 0.001)
+		assert.Equal(t, int64(48*60), top[1].Samples)
+	})
+}
+
+func TestMetricsHistoryAPI(t *testing.T) {
+	db, collector := setupMetricsTest(t)
+	now := time.Now().UTC().Truncate(time.Minute)
+	insertSamples(t, db, "env-api", now.Add(-2*time.Hour), now, time.Minute, func(time.Time) float64 { return 100 })
+	insertSamples(t, db, "", now.Add(-2*time.Hour), now, time.Minute, func(time.Time) float64 { return 100 })
+	_, err := collector.Rollup(context.Background(), now)
+	require.NoError(t, err)
+
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewMetricsHandler(db, log)
+	get := func(path string, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.UserContextKey, &users.User{ID: "u1", Role: role}))
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/environments/{id}/metrics/history", handler.GetEnvironmentMetricsHistory)
+		router.HandleFunc("/api/v1/metrics/summary", handler.GetMetricsSummary)
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/api/v1/environments/env-api/metrics/history?step=10m&from="+now.Add(-2*time.Hour).Format(time.RFC3339), users.RoleUser)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var history metrics.History
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&history))
+	assert.Equal(t, int64(600), history.StepSeconds)
+	assert.NotEmpty(t, history.Timestamps)
+	for _, metricType := range []string{"cpu_usage", "memory_usage", "running_sandboxes"} {
+		require.Contains(t, history.Series, metricType)
+		assert.Len(t, history.Series[metricType].Avg, len(history.Timestamps))
+		assert.Len(t, history.Series[metricType].Max, len(history.Timestamps))
+	}
+
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/environments/env-api/metrics/history?step=-5", users.RoleUser).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/environments/env-api/metrics/history?from=yesterday", users.RoleUser).Code)
+
+	assert.Equal(t, http.StatusForbidden, get("/api/v1/metrics/summary", users.RoleUser).Code)
+	rr = get("/api/v1/metrics/summary?limit=5", users.RoleAdmin)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var summary struct {
+		History         metrics.History            `json:"history"`
+		TopEnvironments []metrics.EnvironmentUsage `json:"top_environments"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&summary))
+	assert.NotEmpty(t, summary.History.Timestamps)
+	require.Len(t, summary.TopEnvironments, 1)
+	assert.Equal(t, "env-api", summary.TopEnvironments[0].EnvironmentID)
+}
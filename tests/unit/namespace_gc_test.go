@@ -0,0 +1,145 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func TestCollectOrphanNamespaces(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	live := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "live-env"})
+	gone := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "gone-env"})
+	young := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "young-env"})
+
+	// The namespace deletions fail, so the namespaces outlive their environments
+	mockK8s.FailNext("DeleteNamespace", 2, errors.New("api server unavailable"))
+	require.NoError(t, orch.DeleteEnvironment(ctx, gone.ID, true))
+	require.NoError(t, orch.DeleteEnvironment(ctx, young.ID, true))
+	exists, _ := mockK8s.NamespaceExists(ctx, gone.Namespace)
+	require.True(t, exists)
+	mockK8s.SetNamespaceCreated(gone.Namespace, time.Now().Add(-2*time.Hour))
+	mockK8s.SetNamespaceCreated(live.Namespace, time.Now().Add(-2*time.Hour))
+
+	// Namespaces of another installation are ignored
+	require.NoError(t, mockK8s.CreateNamespace(ctx, "other-env-1", map[string]string{"managed-by": "agentbox", "env-id": "env-1"}))
+	mockK8s.SetNamespaceCreated("other-env-1", time.Now().Add(-2*time.Hour))
+
+	cfg := &config.Config{
+		Kubernetes:     config.KubernetesConfig{NamespacePrefix: "test-", RuntimeClass: "gvisor"},
+		Timeouts:       config.TimeoutConfig{DefaultTimeout: 60, MaxTimeout: 3600, StartupTimeout: 60},
+		Reconciliation: config.ReconciliationConfig{OrphanGC: config.OrphanGCConfig{Enabled: true, MinAgeSeconds: 3600}},
+	}
+	orch.UpdateConfig(cfg)
+
+	// A dry run only reports
+	report, err := orch.CollectOrphanNamespaces(ctx, true)
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Zero(t, report.Deleted)
+	actions := make(map[string]string)
+	for _, orphan := range report.Orphans {
+		actions[orphan.EnvironmentID] = orphan.Action
+	}
+	assert.Equal(t, map[string]string{
+		gone.ID:  orchestrator.OrphanWouldDelete,
+		young.ID: orchestrator.OrphanTooNew,
+	}, actions)
+	exists, _ = mockK8s.NamespaceExists(ctx, gone.Namespace)
+	assert.True(t, exists)
+
+	// A real pass deletes the old orphan only
+	report, err = orch.CollectOrphanNamespaces(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	for _, ns := range []struct {
+		name string
+		want bool
+	}{{gone.Namespace, false}, {young.Namespace, true}, {live.Namespace, true}, {"other-env-1", true}} {
+		exists, _ := mockK8s.NamespaceExists(ctx, ns.name)
+		assert.Equal(t, ns.want, exists, ns.name)
+	}
+
+	status := orch.NamespaceGCStatus()
+	assert.True(t, status.Enabled)
+	assert.EqualValues(t, 1, status.TotalDeleted)
+	require.NotNil(t, status.LastRun)
+	assert.False(t, status.LastRun.DryRun)
+
+	entries, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: orchestrator.AuditActionNamespaceCollected})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, gone.Namespace, entries[0].ResourceID)
+	entries, err = db.ListAuditEntries(ctx, database.AuditFilter{Action: orchestrator.AuditActionNamespaceOrphaned})
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Clusters that cannot be listed are reported and left alone
+	mockK8s.FailNext("ListNamespaces", 1, errors.New("forbidden"))
+	report, err = orch.CollectOrphanNamespaces(ctx, false)
+	require.NoError(t, err)
+	assert.Len(t, report.Errors, 1)
+	assert.Zero(t, report.Scanned)
+}
+
+func TestCollectOrphanNamespacesNeedsDatabase(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	_, err := orch.CollectOrphanNamespaces(context.Background(), true)
+	assert.Equal(t, apierrors.CodeNamespaceGCUnavailable, apierrors.CodeOf(err))
+	assert.False(t, orch.NamespaceGCStatus().Enabled)
+}
+
+func TestNamespaceGCAPI(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+
+	call := func(method, target, role string, fn http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.UserContextKey, &users.User{ID: "u1", Role: role}))
+		rr := httptest.NewRecorder()
+		fn(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/api/v1/admin/namespace-gc", users.RoleUser, handler.RunNamespaceGC).Code)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/api/v1/admin/namespace-gc?dry_run=maybe", users.RoleAdmin, handler.RunNamespaceGC).Code)
+
+	rr := call(http.MethodPost, "/api/v1/admin/namespace-gc?dry_run=true", users.RoleAdmin, handler.RunNamespaceGC)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var report orchestrator.NamespaceGCReport
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+	assert.True(t, report.DryRun)
+	assert.Empty(t, report.Orphans)
+
+	rr = call(http.MethodGet, "/api/v1/admin/namespace-gc", users.RoleAdmin, handler.GetNamespaceGC)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status orchestrator.NamespaceGCStatus
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	require.NotNil(t, status.LastRun)
+	assert.True(t, status.LastRun.DryRun)
+}
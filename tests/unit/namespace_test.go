@@ -0,0 +1,134 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+func TestNamespaceName(t *testing.T) {
+	assert.Equal(t, "agentbox-env-a1b2c3d4", k8s.NamespaceName("agentbox-", "env-a1b2c3d4"))
+
+	prefix := strings.Repeat("team-sandboxes-", 4)
+	a := k8s.NamespaceName(prefix, "env-a1b2c3d4")
+	b := k8s.NamespaceName(prefix, "env-e5f6a7b8")
+	assert.LessOrEqual(t, len(a), 63)
+	assert.NoError(t, k8s.ValidateNamespaceName(a))
+	assert.NotEqual(t, a, b)
+	assert.True(t, strings.HasPrefix(a, prefix[:40]))
+	// Shortened names are deterministic
+	assert.Equal(t, a, k8s.NamespaceName(prefix, "env-a1b2c3d4"))
+
+	assert.Error(t, k8s.ValidateNamespaceName("Agentbox-env-a1b2c3d4"))
+	assert.Error(t, k8s.ValidateNamespaceName("agent_box-env-a1b2c3d4"))
+}
+
+func TestConfigNamespacePrefixValidation(t *testing.T) {
+	os.Setenv("AGENTBOX_AUTH_ENABLED", "false")
+	defer os.Unsetenv("AGENTBOX_AUTH_ENABLED")
+
+	for name, tc := range map[string]struct {
+		prefix string
+		valid  bool
+	}{
+		"default":    {"agentbox-", true},
+		"52 chars":   {strings.Repeat("a", 51) + "-", true},
+		"uppercase":  {"AgentBox-", false},
+		"underscore": {"agent_box-", false},
+		"leading -":  {"-agentbox", false},
+		"too long":   {strings.Repeat("a", 60) + "-", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("AGENTBOX_NAMESPACE_PREFIX", tc.prefix)
+			defer os.Unsetenv("AGENTBOX_NAMESPACE_PREFIX")
+
+			_, err := config.Load("")
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "namespace_prefix")
+			}
+		})
+	}
+}
+
+// prefixConfig names environment namespaces with prefix
+func prefixConfig(prefix string) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Kubernetes.NamespacePrefix = prefix
+	return cfg
+}
+
+func TestCreateEnvironmentLongNamespacePrefix(t *testing.T) {
+	prefix := strings.Repeat("a", 51) + "-"
+	orch, mockK8s := setupConfiguredOrchestrator(t, prefixConfig(prefix), nil)
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "long-prefix"})
+	assert.LessOrEqual(t, len(env.Namespace), 63)
+	assert.True(t, strings.HasPrefix(env.Namespace, prefix))
+	exists, err := mockK8s.NamespaceExists(context.Background(), env.Namespace)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestCreateEnvironmentInvalidNamespacePrefix(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, prefixConfig("Agent_Box-"), db)
+	ctx := context.Background()
+
+	_, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "bad-prefix",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	assert.Equal(t, apierrors.CodeInvalidNamespace, apierrors.CodeOf(err))
+
+	// Nothing was persisted or created
+	envs, err := db.LoadAllEnvironments(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, envs)
+	assert.Equal(t, 0, mockK8s.CallCount("CreateNamespace"))
+}
+
+func TestLegacyNamespacesStillResolve(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	// An environment created under the old scheme with a prefix that would now be shortened
+	legacyNamespace := strings.Repeat("b", 52) + "-env-a1b2c3d4"
+	require.NoError(t, db.SaveEnvironment(ctx, &models.Environment{
+		ID:        "env-a1b2c3d4",
+		Name:      "legacy",
+		Status:    models.StatusRunning,
+		Image:     "python:3.11-slim",
+		Namespace: legacyNamespace,
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		CreatedAt: time.Now(),
+		UserID:    "user-123",
+	}))
+
+	orch, mockK8s := setupConfiguredOrchestrator(t, prefixConfig(strings.Repeat("b", 52)+"-"), db)
+	require.NoError(t, mockK8s.CreateNamespace(ctx, legacyNamespace, nil))
+
+	env, err := orch.GetEnvironment(ctx, "env-a1b2c3d4")
+	require.NoError(t, err)
+	assert.Equal(t, legacyNamespace, env.Namespace)
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, "env-a1b2c3d4", false))
+	exists, err := mockK8s.NamespaceExists(ctx, legacyNamespace)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,143 @@
+package unit
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// namespaceWaitConfig waits up to terminationTimeout seconds for a previous namespace to go
+func namespaceWaitConfig(terminationTimeout int) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Timeouts.NamespaceTerminationTimeout = terminationTimeout
+	return cfg
+}
+
+// provisioningPhases returns the phases the environment went through, in order
+func provisioningPhases(t *testing.T, db *database.DB, envID string) []string {
+	t.Helper()
+	events, err := db.ListEnvironmentEvents(context.Background(), envID, 0)
+	require.NoError(t, err)
+	var phases []string
+	for _, e := range events {
+		if e.EventType == "provisioning_phase" {
+			phases = append(phases, e.Message)
+		}
+	}
+	return phases
+}
+
+func TestMockNamespaceDeletionDelay(t *testing.T) {
+	mockK8s := mocks.NewMockK8sClient()
+	ctx := context.Background()
+	require.NoError(t, mockK8s.CreateNamespace(ctx, "slow", nil))
+	mockK8s.SetNamespaceDeletionDelay(200 * time.Millisecond)
+	require.NoError(t, mockK8s.DeleteNamespace(ctx, "slow"))
+
+	ns, err := mockK8s.GetNamespace(ctx, "slow")
+	require.NoError(t, err)
+	require.NotNil(t, ns)
+	assert.Equal(t, corev1.NamespaceTerminating, ns.Status.Phase)
+	assert.Error(t, mockK8s.CreateNamespace(ctx, "slow", nil))
+
+	require.Eventually(t, func() bool {
+		ns, err := mockK8s.GetNamespace(ctx, "slow")
+		return err == nil && ns == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.NoError(t, mockK8s.CreateNamespace(ctx, "slow", nil))
+}
+
+func TestProvisioningWaitsForPreviousNamespace(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, namespaceWaitConfig(30), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	// The environment's namespace is deleted and still terminating when it is provisioned again
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "recreated"})
+	mockK8s.SetNamespaceDeletionDelay(1500 * time.Millisecond)
+	require.NoError(t, mockK8s.DeleteNamespace(ctx, env.Namespace))
+	require.NoError(t, orch.RetryReconciliation(ctx, env.ID))
+
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Phase == models.PhaseWaitingForPreviousNamespace
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Provisioning goes on once the old namespace is gone
+	require.Eventually(t, func() bool {
+		_, err := mockK8s.GetPod(ctx, env.Namespace, "main")
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning && got.Phase == models.PhaseReady
+	}, 5*time.Second, 20*time.Millisecond)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Empty(t, got.LastReconciliationError)
+
+	phases := provisioningPhases(t, db, env.ID)
+	waiting := "Provisioning phase: " + string(models.PhaseWaitingForPreviousNamespace)
+	require.Contains(t, phases, waiting)
+	assert.Contains(t, phases[slices.Index(phases, waiting):], "Provisioning phase: "+string(models.PhaseCreatingNamespace))
+}
+
+func TestProvisioningGivesUpOnTerminatingNamespace(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, namespaceWaitConfig(1), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "stuck"})
+	mockK8s.SetNamespaceDeletionDelay(time.Minute)
+	require.NoError(t, mockK8s.DeleteNamespace(ctx, env.Namespace))
+	require.NoError(t, orch.RetryReconciliation(ctx, env.ID))
+
+	// The attempt fails with the reason, not a generic conflict; the namespace is left alone
+	var got *models.Environment
+	require.Eventually(t, func() bool {
+		var err error
+		got, err = orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.LastReconciliationError != ""
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Contains(t, got.LastReconciliationError, "namespace "+env.Namespace+" of a previous environment is still being deleted")
+	assert.Equal(t, 1, mockK8s.CallCount("CreateNamespace"))
+}
+
+func TestPreviousNamespaceWaitFollowsClock(t *testing.T) {
+	db := setupTestDB(t)
+	clock := mocks.NewFakeClock(time.Now())
+	orch, mockK8s := setupConfiguredOrchestrator(t, namespaceWaitConfig(120), db, orchestrator.WithoutBackgroundLoops(), orchestrator.WithClock(clock))
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "clocked"})
+	mockK8s.SetNamespaceDeletionDelay(time.Hour)
+	require.NoError(t, mockK8s.DeleteNamespace(ctx, env.Namespace))
+	require.NoError(t, orch.RetryReconciliation(ctx, env.ID))
+
+	// The wait polls on the orchestrator's clock and gives up once the timeout passed on it,
+	// although the startup timeout (60s) is shorter
+	clock.BlockUntil(1)
+	clock.Advance(119 * time.Second)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PhaseWaitingForPreviousNamespace, got.Phase)
+	assert.Empty(t, got.LastReconciliationError)
+
+	clock.Advance(time.Second)
+	require.Eventually(t, func() bool {
+		got, err = orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.LastReconciliationError != ""
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Contains(t, got.LastReconciliationError, "still being deleted after 2m0s")
+}
@@ -0,0 +1,229 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func networkPresetConfig() *config.Config {
+	presets := config.DefaultNetworkPresets()
+	presets["partner-api"] = config.NetworkPresetConfig{
+		Description:        "Only the partner API",
+		AllowedEgressCIDRs: []string{"203.0.113.0/24"},
+	}
+	cfg := testOrchestratorConfig()
+	cfg.Kubernetes.RuntimeClass = "gvisor"
+	cfg.Network.Presets = presets
+	return cfg
+}
+
+func TestExpandNetworkPreset(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, networkPresetConfig(), nil)
+
+	tests := []struct {
+		name      string
+		isolation *models.IsolationConfig
+		want      *models.NetworkPolicyConfig
+	}{
+		{
+			name:      "preset alone",
+			isolation: &models.IsolationConfig{NetworkPreset: "cluster-only"},
+			want:      &models.NetworkPolicyConfig{AllowClusterInternal: true},
+		},
+		{
+			name: "explicit flags are added",
+			isolation: &models.IsolationConfig{
+				NetworkPreset: "internet-only",
+				NetworkPolicy: &models.NetworkPolicyConfig{AllowClusterInternal: true, AllowedIngressPorts: []int32{8080}},
+			},
+			want: &models.NetworkPolicyConfig{AllowInternet: true, AllowClusterInternal: true, AllowedIngressPorts: []int32{8080}},
+		},
+		{
+			name: "explicit lists replace the preset's",
+			isolation: &models.IsolationConfig{
+				NetworkPreset: "partner-api",
+				NetworkPolicy: &models.NetworkPolicyConfig{AllowedEgressCIDRs: []string{"198.51.100.0/24"}},
+			},
+			want: &models.NetworkPolicyConfig{AllowedEgressCIDRs: []string{"198.51.100.0/24"}},
+		},
+		{
+			name: "false cannot turn off what the preset allows",
+			isolation: &models.IsolationConfig{
+				NetworkPreset: "unrestricted",
+				NetworkPolicy: &models.NetworkPolicyConfig{AllowInternet: false},
+			},
+			want: &models.NetworkPolicyConfig{AllowInternet: true, AllowClusterInternal: true},
+		},
+		{
+			name:      "no preset keeps the explicit policy",
+			isolation: &models.IsolationConfig{NetworkPolicy: &models.NetworkPolicyConfig{AllowInternet: true}},
+			want:      &models.NetworkPolicyConfig{AllowInternet: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, orch.ExpandNetworkPreset(tt.isolation))
+			assert.Equal(t, tt.want, tt.isolation.NetworkPolicy)
+
+			// Expanding again (e.g. in the handler and the orchestrator) changes nothing
+			require.NoError(t, orch.ExpandNetworkPreset(tt.isolation))
+			assert.Equal(t, tt.want, tt.isolation.NetworkPolicy)
+		})
+	}
+
+	err := orch.ExpandNetworkPreset(&models.IsolationConfig{NetworkPreset: "no-such-preset"})
+	require.Error(t, err)
+	assert.Equal(t, apierrors.CodeUnknownNetworkPreset, apierrors.CodeOf(err))
+	assert.Equal(t, http.StatusBadRequest, apierrors.HTTPStatus(err))
+	assert.Contains(t, err.Error(), "cluster-only, internet-only, no-network, partner-api, unrestricted")
+	assert.NoError(t, orch.ExpandNetworkPreset(nil))
+}
+
+func TestEnvironmentKeepsResolvedNetworkPreset(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, networkPresetConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "preset-env",
+		Isolation: &models.IsolationConfig{
+			NetworkPreset: "internet-only",
+			NetworkPolicy: &models.NetworkPolicyConfig{AllowedIngressPorts: []int32{8080}},
+		},
+	})
+	want := &models.NetworkPolicyConfig{AllowInternet: true, AllowedIngressPorts: []int32{8080}}
+	assert.Equal(t, "internet-only", env.Isolation.NetworkPreset)
+	assert.Equal(t, want, env.Isolation.NetworkPolicy)
+	applied := mockK8s.NetworkPolicyConfig(env.Namespace)
+	require.NotNil(t, applied)
+	assert.True(t, applied.AllowInternet)
+	assert.Equal(t, []int32{8080}, applied.AllowedIngressPorts)
+
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 50)
+	require.NoError(t, err)
+	var resolved *models.EnvironmentEvent
+	for _, ev := range events {
+		if ev.EventType == "network_preset_resolved" {
+			resolved = ev
+		}
+	}
+	require.NotNil(t, resolved)
+	var details models.NetworkPolicyConfig
+	require.NoError(t, json.Unmarshal([]byte(resolved.Details), &details))
+	assert.Equal(t, *want, details)
+
+	// Redefining the preset leaves the environment's policy alone
+	cfg := networkPresetConfig()
+	cfg.Network.Presets["internet-only"] = config.NetworkPresetConfig{AllowedEgressCIDRs: []string{"192.0.2.0/24"}}
+	orch.UpdateConfig(cfg)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, want, got.Isolation.NetworkPolicy)
+
+	// An update resolves the preset again, with its new definition
+	updated, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{
+		Isolation: &models.IsolationConfig{NetworkPreset: "internet-only"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &models.NetworkPolicyConfig{AllowedEgressCIDRs: []string{"192.0.2.0/24"}}, updated.Isolation.NetworkPolicy)
+
+	_, err = orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name: "bad-preset", Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Isolation: &models.IsolationConfig{NetworkPreset: "no-such-preset"},
+	}, "user-123")
+	assert.Equal(t, apierrors.CodeUnknownNetworkPreset, apierrors.CodeOf(err))
+}
+
+func TestNetworkPresetsAPI(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, networkPresetConfig(), nil)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/policies/network", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp struct {
+		Presets []models.NetworkPreset `json:"presets"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	names := make([]string, len(resp.Presets))
+	for i, p := range resp.Presets {
+		names[i] = p.Name
+	}
+	assert.Equal(t, []string{"cluster-only", "internet-only", "no-network", "partner-api", "unrestricted"}, names)
+	assert.Equal(t, models.NetworkPreset{
+		Name:        "partner-api",
+		Description: "Only the partner API",
+		Policy:      models.NetworkPolicyConfig{AllowedEgressCIDRs: []string{"203.0.113.0/24"}},
+		Rules:       []string{"egress to the cluster DNS on port 53", "egress to 203.0.113.0/24"},
+	}, resp.Presets[3])
+	assert.Equal(t, []string{"egress to the cluster DNS on port 53"}, resp.Presets[2].Rules)
+
+	create := func(isolation *models.IsolationConfig) *httptest.ResponseRecorder {
+		body, err := json.Marshal(models.CreateEnvironmentRequest{
+			Name: "preset-api-env", Image: "python:3.11-slim",
+			Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+			Isolation: isolation,
+		})
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body)))
+		return rr
+	}
+
+	rr = create(&models.IsolationConfig{NetworkPreset: "no-such-preset"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), apierrors.CodeUnknownNetworkPreset)
+
+	rr = create(&models.IsolationConfig{NetworkPreset: "cluster-only"})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+	assert.Equal(t, "cluster-only", env.Isolation.NetworkPreset)
+	assert.Equal(t, &models.NetworkPolicyConfig{AllowClusterInternal: true}, env.Isolation.NetworkPolicy)
+}
+
+func TestNetworkPresetsConfig(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	cfg, err := config.Load(write("auth:\n  enabled: false\n"))
+	require.NoError(t, err)
+	assert.Equal(t, config.DefaultNetworkPresets(), cfg.Network.Presets)
+
+	// Presets in the file are added to the built-in ones, replacing those of the same name
+	cfg, err = config.Load(write("auth:\n  enabled: false\nnetwork:\n  presets:\n    internet-only:\n      allowed_egress_cidrs: [10.0.0.0/8]\n    partner-api:\n      allowed_egress_cidrs: [203.0.113.0/24]\n"))
+	require.NoError(t, err)
+	assert.Len(t, cfg.Network.Presets, 5)
+	assert.Equal(t, config.NetworkPresetConfig{AllowedEgressCIDRs: []string{"10.0.0.0/8"}}, cfg.Network.Presets["internet-only"])
+	assert.True(t, cfg.Network.Presets["unrestricted"].AllowInternet)
+
+	_, err = config.Load(write("auth:\n  enabled: false\nnetwork:\n  presets:\n    Bad_Name:\n      allowed_egress_cidrs: [10.0.0.0/33]\n      allowed_ingress_ports: [0]\n"))
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `invalid name "Bad_Name"`)
+	assert.ErrorContains(t, err, `invalid CIDR "10.0.0.0/33"`)
+	assert.ErrorContains(t, err, "port must be between 1 and 65535")
+}
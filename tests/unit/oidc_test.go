@@ -0,0 +1,316 @@
+package unit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/clientip"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// fakeOIDCProvider is a minimal OpenID Connect provider: discovery, JWKS and a token endpoint
+// that returns an ID token with the claims registered for the code
+type fakeOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]jwt.MapClaims // code -> ID token claims
+	// signWith overrides the signing key (to simulate a forged token)
+	signWith *rsa.PrivateKey
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &fakeOIDCProvider{key: key, claims: map[string]jwt.MapClaims{}}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	r.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	r.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, ok := r.BasicAuth()
+		if !ok || clientID != "agentbox" || secret != "client-secret" || r.FormValue("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		p.mu.Lock()
+		claims, found := p.claims[r.FormValue("code")]
+		signWith := p.signWith
+		p.mu.Unlock()
+		if !found {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		if signWith == nil {
+			signWith = key
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-key"
+		idToken, err := token.SignedString(signWith)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "access_token": "unused"})
+	}).Methods("POST")
+	p.server = httptest.NewServer(r)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// issueCode registers an authorization code whose ID token carries claims (plus iss/aud/exp)
+func (p *fakeOIDCProvider) issueCode(code, nonce string, claims jwt.MapClaims) {
+	claims["iss"] = p.server.URL
+	claims["aud"] = "agentbox"
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	claims["iat"] = time.Now().Unix()
+	claims["nonce"] = nonce
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims[code] = claims
+}
+
+func setupOIDCTest(t *testing.T, passwordLogin bool) (*mux.Router, *fakeOIDCProvider, *auth.Service, *users.Service) {
+	authService, userService, _ := setupAuthTest(t)
+	provider := newFakeOIDCProvider(t)
+	authService.SetOIDC(auth.NewOIDCProvider(config.OIDCConfig{
+		Enabled:      true,
+		IssuerURL:    provider.server.URL,
+		ClientID:     "agentbox",
+		ClientSecret: "client-secret",
+		RedirectURL:  "https://agentbox.example.com/api/v1/auth/oidc/callback",
+		Scopes:       []string{"email", "profile"},
+		GroupsClaim:  "groups",
+		RoleMapping:  map[string]string{"platform-admins": "admin", "developers": "user"},
+		DefaultRole:  "user",
+	}, provider.server.Client()), passwordLogin)
+
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	authHandler := api.NewAuthHandler(authService, userService, log)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/auth/login", authHandler.Login).Methods("POST")
+	router.HandleFunc("/api/v1/auth/oidc/login", authHandler.OIDCLogin).Methods("GET")
+	router.HandleFunc("/api/v1/auth/oidc/callback", authHandler.OIDCCallback).Methods("GET")
+	return router, provider, authService, userService
+}
+
+// startOIDCLogin calls /auth/oidc/login and returns the state cookie and the authorization request
+func startOIDCLogin(t *testing.T, router *mux.Router) (*http.Cookie, url.Values) {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/auth/oidc/login", nil))
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	location, err := url.Parse(rr.Header().Get("Location"))
+	require.NoError(t, err)
+	cookies := rr.Result().Cookies()
+	require.Len(t, cookies, 1)
+	return cookies[0], location.Query()
+}
+
+// finishOIDCLogin calls /auth/oidc/callback as the browser would after the provider login
+func finishOIDCLogin(router *mux.Router, cookie *http.Cookie, code, state string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestOIDCLoginProvisionsAndLinksUsers(t *testing.T) {
+	router, provider, authService, userService := setupOIDCTest(t, true)
+	ctx := context.Background()
+
+	// The login redirect carries the client, state, nonce and PKCE challenge
+	cookie, authReq := startOIDCLogin(t, router)
+	assert.Equal(t, "agentbox", authReq.Get("client_id"))
+	assert.Equal(t, "code", authReq.Get("response_type"))
+	assert.Equal(t, "openid email profile", authReq.Get("scope"))
+	assert.Equal(t, "S256", authReq.Get("code_challenge_method"))
+	assert.NotEmpty(t, authReq.Get("code_challenge"))
+	assert.True(t, cookie.HttpOnly)
+
+	// A new identity is provisioned with the role mapped from its groups
+	provider.issueCode("code-new", authReq.Get("nonce"), jwt.MapClaims{
+		"sub":                "subject-alice",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+		"groups":             []string{"developers", "platform-admins"},
+	})
+	rr := finishOIDCLogin(router, cookie, "code-new", authReq.Get("state"))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp auth.LoginResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, "alice", resp.User.Username)
+	assert.Equal(t, users.RoleAdmin, resp.User.Role)
+	user, err := authService.ValidateJWT(ctx, resp.Token)
+	require.NoError(t, err, "the callback issues a regular agentbox token")
+	assert.Equal(t, resp.User.ID, user.ID)
+
+	// Logging in again maps to the same user and re-applies the role mapping
+	cookie, authReq = startOIDCLogin(t, router)
+	provider.issueCode("code-again", authReq.Get("nonce"), jwt.MapClaims{
+		"sub":    "subject-alice",
+		"email":  "alice@example.com",
+		"groups": []string{"developers"},
+	})
+	rr = finishOIDCLogin(router, cookie, "code-again", authReq.Get("state"))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, user.ID, resp.User.ID)
+	assert.Equal(t, users.RoleUser, resp.User.Role)
+
+	// An existing local user with the same verified email is linked rather than duplicated
+	local, err := userService.CreateUser(ctx, &users.CreateUserRequest{
+		Username: "bob", Email: "bob@example.com", Password: "password123", Role: users.RoleUser, Status: users.StatusActive,
+	})
+	require.NoError(t, err)
+	cookie, authReq = startOIDCLogin(t, router)
+	provider.issueCode("code-bob", authReq.Get("nonce"), jwt.MapClaims{
+		"sub": "subject-bob", "email": "bob@example.com", "email_verified": true, "preferred_username": "robert",
+	})
+	rr = finishOIDCLogin(router, cookie, "code-bob", authReq.Get("state"))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, local.ID, resp.User.ID)
+	externalID, err := userService.GetExternalID(ctx, local.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "subject-bob", externalID)
+
+	// Password login keeps working alongside SSO
+	_, err = authService.Login(ctx, &auth.LoginRequest{Username: "bob", Password: "password123"})
+	assert.NoError(t, err)
+
+	// The mapping may promote a linked local account but never demotes it
+	login := func(code string, groups []string) *users.User {
+		cookie, authReq := startOIDCLogin(t, router)
+		provider.issueCode(code, authReq.Get("nonce"), jwt.MapClaims{"sub": "subject-bob", "groups": groups})
+		rr := finishOIDCLogin(router, cookie, code, authReq.Get("state"))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp auth.LoginResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		return resp.User
+	}
+	assert.Equal(t, users.RoleAdmin, login("code-bob-admin", []string{"platform-admins"}).Role)
+	assert.Equal(t, users.RoleAdmin, login("code-bob-dev", []string{"developers"}).Role)
+}
+
+func TestOIDCStateCookieSecureOnlyBehindTrustedProxy(t *testing.T) {
+	router, _, _, _ := setupOIDCTest(t, true)
+	cookieSecure := func(handler http.Handler) bool {
+		req := httptest.NewRequest("GET", "/api/v1/auth/oidc/login", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+		cookies := rr.Result().Cookies()
+		require.Len(t, cookies, 1)
+		return cookies[0].Secure
+	}
+
+	// Anyone can send X-Forwarded-Proto; it only counts from a trusted proxy
+	untrusted, err := clientip.NewResolver(nil)
+	require.NoError(t, err)
+	assert.False(t, cookieSecure(untrusted.Middleware(router)))
+
+	// httptest requests come from 192.0.2.1
+	trusted, err := clientip.NewResolver([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	assert.True(t, cookieSecure(trusted.Middleware(router)))
+}
+
+func TestOIDCCallbackRejectsInvalidLogins(t *testing.T) {
+	router, provider, _, _ := setupOIDCTest(t, true)
+
+	claims := func() jwt.MapClaims { return jwt.MapClaims{"sub": "subject-mallory", "email": "m@example.com"} }
+
+	// State that does not match the login session
+	cookie, authReq := startOIDCLogin(t, router)
+	provider.issueCode("code-state", authReq.Get("nonce"), claims())
+	rr := finishOIDCLogin(router, cookie, "code-state", "forged-state")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Missing login session cookie
+	rr = finishOIDCLogin(router, nil, "code-state", authReq.Get("state"))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// ID token issued for another login (nonce mismatch)
+	cookie, authReq = startOIDCLogin(t, router)
+	provider.issueCode("code-nonce", "other-nonce", claims())
+	rr = finishOIDCLogin(router, cookie, "code-nonce", authReq.Get("state"))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "nonce")
+
+	// ID token not signed by the provider
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider.mu.Lock()
+	provider.signWith = forger
+	provider.mu.Unlock()
+	cookie, authReq = startOIDCLogin(t, router)
+	provider.issueCode("code-forged", authReq.Get("nonce"), claims())
+	rr = finishOIDCLogin(router, cookie, "code-forged", authReq.Get("state"))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Provider-reported errors are passed on
+	req := httptest.NewRequest("GET", "/api/v1/auth/oidc/callback?error=access_denied&error_description=user+declined", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "user declined")
+}
+
+func TestOIDCPasswordLoginCanBeDisabled(t *testing.T) {
+	router, _, _, userService := setupOIDCTest(t, false)
+	_, err := userService.CreateUser(context.Background(), &users.CreateUserRequest{
+		Username: "carol", Password: "password123", Role: users.RoleUser, Status: users.StatusActive,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"username":"carol","password":"password123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "password login is disabled")
+}
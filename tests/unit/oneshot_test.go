@@ -0,0 +1,156 @@
+package unit
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// waitForOneShotDone polls a oneshot environment until its command has completed
+func waitForOneShotDone(t *testing.T, orch *orchestrator.Orchestrator, envID string) *models.Environment {
+	var env *models.Environment
+	require.Eventually(t, func() bool {
+		var err error
+		env, err = orch.GetEnvironment(context.Background(), envID)
+		require.NoError(t, err)
+		return env.CompletedAt != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	return env
+}
+
+func createOneShotEnv(t *testing.T, orch *orchestrator.Orchestrator, name string, retention int) *models.Environment {
+	env, err := orch.CreateEnvironment(context.Background(), &models.CreateEnvironmentRequest{
+		Name:             name,
+		Image:            "python:3.11-slim",
+		Resources:        models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Command:          []string{"python", "train.py"},
+		Mode:             models.EnvironmentModeOneShot,
+		RetentionSeconds: retention,
+	}, "user-123")
+	require.NoError(t, err)
+	return env
+}
+
+func TestOneShotEnvironmentRecordsResult(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	mockK8s.SetCompletionLogSource(func(namespace, podName string) io.Reader {
+		return strings.NewReader("epoch 1 done\n")
+	})
+
+	env := createOneShotEnv(t, orch, "oneshot-ok", 0)
+	done := waitForOneShotDone(t, orch, env.ID)
+	assert.Equal(t, models.EnvironmentModeOneShot, done.Mode)
+	assert.Equal(t, models.StatusTerminated, done.Status)
+	require.NotNil(t, done.ExitCode)
+	assert.Equal(t, 0, *done.ExitCode)
+	assert.Equal(t, "epoch 1 done\n", done.Output)
+
+	// The user's command runs as-is instead of sleep infinity
+	spec := mockK8s.CreatedPodSpec(done.Namespace, "main")
+	require.NotNil(t, spec)
+	assert.Equal(t, []string{"python", "train.py"}, spec.Command)
+
+	// The result survives a restart
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.ExitCode)
+	assert.Equal(t, 0, *stored.ExitCode)
+	assert.Equal(t, "epoch 1 done\n", stored.Output)
+	assert.NotNil(t, stored.CompletedAt)
+
+	// Commands are rejected once the command has completed
+	_, err = orch.ExecuteCommand(ctx, env.ID, []string{"ls"}, 10)
+	require.Error(t, err)
+	assert.Equal(t, apierrors.Conflict, apierrors.KindOf(err))
+	assert.Equal(t, apierrors.CodeEnvironmentCompleted, apierrors.CodeOf(err))
+	_, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{EnvironmentID: env.ID, Command: []string{"ls"}}, "user-123")
+	assert.Equal(t, apierrors.CodeEnvironmentCompleted, apierrors.CodeOf(err))
+}
+
+func TestOneShotEnvironmentFailsOnNonzeroExit(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	mockK8s.SetCompletionHandler(func(spec *k8s.PodSpec) int { return 3 })
+
+	env := createOneShotEnv(t, orch, "oneshot-fail", 0)
+	done := waitForOneShotDone(t, orch, env.ID)
+	assert.Equal(t, models.StatusFailed, done.Status)
+	require.NotNil(t, done.ExitCode)
+	assert.Equal(t, 3, *done.ExitCode)
+	assert.Contains(t, done.StatusMessage, "exited with code 3")
+}
+
+func TestOneShotEnvironmentDeleteWhileRunning(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	mockK8s.SetHoldPodCompletion(true)
+	ctx := context.Background()
+
+	env := createOneShotEnv(t, orch, "oneshot-held", 0)
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, true))
+	_, err := orch.GetEnvironment(ctx, env.ID)
+	assert.Error(t, err)
+}
+
+func TestOneShotValidation(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	base := func() *models.CreateEnvironmentRequest {
+		return &models.CreateEnvironmentRequest{
+			Name:      "oneshot",
+			Image:     "python:3.11-slim",
+			Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+			Command:   []string{"python", "train.py"},
+			Mode:      models.EnvironmentModeOneShot,
+		}
+	}
+	require.NoError(t, v.ValidateCreateRequest(base()))
+
+	tests := []struct {
+		name   string
+		modify func(*models.CreateEnvironmentRequest)
+		errMsg string
+	}{
+		{"unknown mode", func(r *models.CreateEnvironmentRequest) { r.Mode = "batch" }, "mode must be"},
+		{"no command", func(r *models.CreateEnvironmentRequest) { r.Command = nil }, "command is required"},
+		{"pool", func(r *models.CreateEnvironmentRequest) { r.Pool = &models.PoolConfig{Enabled: true, Size: 1} }, "pool is not supported"},
+		{"readiness check", func(r *models.CreateEnvironmentRequest) {
+			r.ReadinessCheck = &models.ReadinessCheck{FileExists: "/tmp/ready"}
+		}, "readiness_check is not supported"},
+		{"negative retention", func(r *models.CreateEnvironmentRequest) { r.RetentionSeconds = -1 }, "retention_seconds cannot be negative"},
+		{"retention when interactive", func(r *models.CreateEnvironmentRequest) {
+			r.Mode = models.EnvironmentModeInteractive
+			r.RetentionSeconds = 60
+		}, "retention_seconds is only supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base()
+			tt.modify(req)
+			err := v.ValidateCreateRequest(req)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+
+	// The mode of an existing environment cannot be changed by an import
+	env := &models.Environment{ID: "env-1", Name: "oneshot", Mode: models.EnvironmentModeInteractive}
+	_, _, err := orchestrator.PlanEnvironmentUpdate(env, base())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mode cannot be changed")
+}
@@ -2,14 +2,14 @@ package unit
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
-	"github.com/sciffer/agentbox/internal/config"
-	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/apierrors"
 	"github.com/sciffer/agentbox/pkg/k8s"
 	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/orchestrator"
@@ -18,25 +18,9 @@ import (
 
 // setupOrchestratorForOptimization creates an orchestrator for optimization tests
 func setupOrchestratorForOptimization(t *testing.T) (*orchestrator.Orchestrator, *mocks.MockK8sClient) {
-	cfg := &config.Config{
-		Kubernetes: config.KubernetesConfig{
-			NamespacePrefix: "test-",
-			RuntimeClass:    "gvisor",
-		},
-		Timeouts: config.TimeoutConfig{
-			StartupTimeout: 60,
-			DefaultTimeout: 3600,
-			MaxTimeout:     86400,
-		},
-	}
-
-	log, err := logger.NewDevelopment()
-	require.NoError(t, err)
-
-	mockK8s := mocks.NewMockK8sClient()
-	orch := orchestrator.New(mockK8s, cfg, log, nil)
-
-	return orch, mockK8s
+	cfg := testOrchestratorConfig()
+	cfg.Timeouts.DefaultTimeout, cfg.Timeouts.MaxTimeout = 3600, 86400
+	return setupConfiguredOrchestrator(t, cfg, nil)
 }
 
 func TestListEnvironmentsPagination(t *testing.T) {
@@ -85,6 +69,88 @@ func TestListEnvironmentsPagination(t *testing.T) {
 	}
 }
 
+func TestListEnvironmentsPageToken(t *testing.T) {
+	orch, _ := setupOrchestratorForOptimization(t)
+	ctx := context.Background()
+
+	for i := 0; i < 7; i++ {
+		_, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+			Name:      fmt.Sprintf("page-env-%d", i),
+			Image:     "python:3.11-slim",
+			Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		}, "user-123")
+		require.NoError(t, err)
+	}
+
+	first, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, first.Environments, 3)
+	require.NotEmpty(t, first.NextPageToken)
+
+	// Deleting an environment already listed must not make the next page skip one
+	require.NoError(t, orch.DeleteEnvironment(ctx, first.Environments[0].ID, true))
+
+	seen := map[string]bool{}
+	for _, env := range first.Environments {
+		seen[env.ID] = true
+	}
+	token := first.NextPageToken
+	for token != "" {
+		page, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Limit: 3, PageToken: token})
+		require.NoError(t, err)
+		for _, env := range page.Environments {
+			assert.False(t, seen[env.ID], "environment %s listed twice", env.ID)
+			seen[env.ID] = true
+		}
+		token = page.NextPageToken
+	}
+	assert.Len(t, seen, 7)
+
+	_, err = orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{PageToken: "not-a-token"})
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	_, err = orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{PageToken: first.NextPageToken, Offset: 3})
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+}
+
+func TestListEnvironmentsPageTokenDatabase(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), setupTestDB(t))
+	ctx := context.Background()
+
+	for i := 0; i < 7; i++ {
+		req := &models.CreateEnvironmentRequest{Name: fmt.Sprintf("db-page-env-%d", i)}
+		if i%2 == 0 {
+			req.Metadata = map[string]string{"tier": "even"}
+		}
+		createRunningEnv(t, orch, req)
+	}
+
+	// Pages are read from the database one at a time; the filters apply before paging
+	var ids []string
+	token := ""
+	for {
+		page, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{
+			Limit: 3, PageToken: token, Metadata: map[string]string{"tier": "even"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 4, page.Total)
+		for _, env := range page.Environments {
+			assert.Equal(t, models.StatusRunning, env.Status)
+			ids = append(ids, env.ID)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	assert.Len(t, ids, 4)
+
+	page, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{Limit: 3, Offset: 6})
+	require.NoError(t, err)
+	assert.Equal(t, 7, page.Total)
+	assert.Len(t, page.Environments, 1)
+	assert.Empty(t, page.NextPageToken)
+}
+
 func TestListEnvironmentsEmptyResult(t *testing.T) {
 	orch, _ := setupOrchestratorForOptimization(t)
 	ctx := context.Background()
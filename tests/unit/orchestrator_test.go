@@ -1,22 +1,40 @@
 package unit
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/database"
 	"github.com/sciffer/agentbox/pkg/k8s"
 	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/pkg/validator"
 	"github.com/sciffer/agentbox/tests/mocks"
 )
 
-func setupOrchestrator(t *testing.T) (*orchestrator.Orchestrator, *mocks.MockK8sClient) {
+func setupOrchestrator(t *testing.T, opts ...orchestrator.Option) (*orchestrator.Orchestrator, *mocks.MockK8sClient) {
 	cfg := &config.Config{
 		Kubernetes: config.KubernetesConfig{
 			NamespacePrefix: "test-",
@@ -31,11 +49,133 @@ func setupOrchestrator(t *testing.T) (*orchestrator.Orchestrator, *mocks.MockK8s
 	require.NoError(t, err)
 
 	mockK8s := mocks.NewMockK8sClient()
-	orch := orchestrator.New(mockK8s, cfg, log, nil)
+	orch := orchestrator.New(mockK8s, cfg, log, nil, opts...)
+	t.Cleanup(orch.Stop)
 
 	return orch, mockK8s
 }
 
+// testOrchestratorConfig returns the configuration orchestrator tests start from
+func testOrchestratorConfig() *config.Config {
+	return &config.Config{
+		Kubernetes: config.KubernetesConfig{NamespacePrefix: "test-"},
+		Timeouts:   config.TimeoutConfig{DefaultTimeout: 60, MaxTimeout: 3600, StartupTimeout: 60},
+	}
+}
+
+// setupConfiguredOrchestrator creates an orchestrator with cfg, db (may be nil) and opts on a mock
+// cluster, stopped when the test ends
+func setupConfiguredOrchestrator(t *testing.T, cfg *config.Config, db *database.DB, opts ...orchestrator.Option) (*orchestrator.Orchestrator, *mocks.MockK8sClient) {
+	mockK8s := mocks.NewMockK8sClient()
+	return setupOrchestratorOnCluster(t, mockK8s, cfg, db, opts...), mockK8s
+}
+
+// setupOrchestratorOnCluster is setupConfiguredOrchestrator on a mock cluster the test prepared
+// (e.g. with nodes or failures its background loops must see from the start)
+func setupOrchestratorOnCluster(t *testing.T, mockK8s *mocks.MockK8sClient, cfg *config.Config, db *database.DB, opts ...orchestrator.Option) *orchestrator.Orchestrator {
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	orch := orchestrator.New(mockK8s, cfg, log, db, opts...)
+	t.Cleanup(orch.Stop)
+	return orch
+}
+
+// apiTest is an orchestrator on a mock cluster behind the authenticated API router
+type apiTest struct {
+	router      *mux.Router
+	orch        *orchestrator.Orchestrator
+	mockK8s     *mocks.MockK8sClient
+	db          *database.DB
+	log         *logger.Logger
+	handler     *api.Handler
+	auth        *auth.Service
+	permissions *permissions.Service
+	users       *users.Service
+}
+
+type apiTestOptions struct {
+	cfg    *config.Config
+	routes []func(*apiTest, *api.RouterConfig)
+}
+
+// apiTestOption customizes setupAPIRouterTest
+type apiTestOption func(*apiTestOptions)
+
+// withAPIConfig runs the orchestrator with cfg instead of testOrchestratorConfig
+func withAPIConfig(cfg *config.Config) apiTestOption {
+	return func(o *apiTestOptions) { o.cfg = cfg }
+}
+
+// withRoutes adjusts the services or router config before the router is built
+func withRoutes(fn func(a *apiTest, rc *api.RouterConfig)) apiTestOption {
+	return func(o *apiTestOptions) { o.routes = append(o.routes, fn) }
+}
+
+// setupAPIRouterTest builds the database, user, auth and permission services, an orchestrator
+// and the authenticated router with the auth, user, API key and config handlers
+func setupAPIRouterTest(t *testing.T, opts ...apiTestOption) *apiTest {
+	t.Setenv("AGENTBOX_JWT_EXPIRY", "1h")
+	o := &apiTestOptions{cfg: testOrchestratorConfig()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+
+	a := &apiTest{db: setupTestDB(t), log: log}
+	a.users = users.NewService(a.db, zap.NewNop())
+	a.auth = auth.NewService(a.db, a.users, zap.NewNop())
+	a.permissions = permissions.NewService(a.db, zap.NewNop())
+	a.orch, a.mockK8s = setupConfiguredOrchestrator(t, o.cfg, a.db)
+	a.handler = api.NewHandler(a.orch, validator.New(10000, 64*1024*1024*1024, 100*1024*1024*1024, 86400), log, a.permissions, nil)
+
+	rc := &api.RouterConfig{
+		Handler:       a.handler,
+		AuthHandler:   api.NewAuthHandler(a.auth, a.users, log),
+		UserHandler:   api.NewUserHandler(a.users, a.auth, log),
+		APIKeyHandler: api.NewAPIKeyHandler(a.auth, a.permissions, log),
+		ConfigHandler: api.NewConfigHandler(config.NewStore("", &config.Config{}), log),
+		AuthService:   a.auth,
+	}
+	for _, fn := range o.routes {
+		fn(a, rc)
+	}
+	a.router = api.NewRouter(rc)
+	return a
+}
+
+// do sends an authenticated JSON request through the router
+func (a *apiTest) do(t *testing.T, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	a.router.ServeHTTP(rr, req)
+	return rr
+}
+
+// waitForProvisioning blocks until the environment's provisioning goroutine has exited and
+// returns the environment as it left it
+func waitForProvisioning(t *testing.T, orch *orchestrator.Orchestrator, envID string) *models.Environment {
+	t.Helper()
+	select {
+	case <-orch.ProvisioningDone(envID):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("provisioning of environment %s did not finish", envID)
+	}
+	env, err := orch.GetEnvironment(context.Background(), envID)
+	require.NoError(t, err)
+	return env
+}
+
 func TestCreateEnvironment(t *testing.T) {
 	orch, mockK8s := setupOrchestrator(t)
 	ctx := context.Background()
@@ -68,7 +208,7 @@ func TestCreateEnvironment(t *testing.T) {
 	assert.NotZero(t, env.CreatedAt)
 
 	// Verify namespace was created
-	time.Sleep(100 * time.Millisecond) // Give goroutine time to execute
+	assert.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
 	exists, _ := mockK8s.NamespaceExists(ctx, env.Namespace)
 	assert.True(t, exists)
 }
@@ -173,33 +313,18 @@ func TestDeleteEnvironment(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for async pod creation to complete before deletion
-	time.Sleep(150 * time.Millisecond)
-
-	// Ensure pod exists before deletion (for proper cleanup)
-	pod, _ := mockK8s.GetPod(ctx, env.Namespace, "main")
-	if pod == nil {
-		// Create pod if async creation hasn't completed
-		_ = mockK8s.CreatePod(ctx, &k8s.PodSpec{ // Ignore errors in tests
-			Name:      "main",
-			Namespace: env.Namespace,
-			Image:     "python:3.11-slim",
-		})
-	}
+	waitForProvisioning(t, orch, env.ID)
+	pod, err := mockK8s.GetPod(ctx, env.Namespace, "main")
+	require.NoError(t, err)
+	require.NotNil(t, pod)
 
 	// Delete environment
 	err = orch.DeleteEnvironment(ctx, env.ID, false)
 	require.NoError(t, err)
 
-	// Verify namespace was deleted (retry a few times for async operations)
-	var exists bool
-	for i := 0; i < 5; i++ {
-		time.Sleep(50 * time.Millisecond)
-		exists, err = mockK8s.NamespaceExists(ctx, env.Namespace)
-		require.NoError(t, err)
-		if !exists {
-			break
-		}
-	}
+	// Verify namespace was deleted
+	exists, err := mockK8s.NamespaceExists(ctx, env.Namespace)
+	require.NoError(t, err)
 	assert.False(t, exists, "namespace should be deleted")
 
 	// Verify environment is removed from memory
@@ -212,7 +337,7 @@ func TestDeleteEnvironment(t *testing.T) {
 }
 
 func TestExecuteCommand(t *testing.T) {
-	orch, mockK8s := setupOrchestrator(t)
+	orch, _ := setupOrchestrator(t)
 	ctx := context.Background()
 
 	// Create environment
@@ -230,19 +355,16 @@ func TestExecuteCommand(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for environment to be running
-	time.Sleep(100 * time.Millisecond)
-	mockK8s.SetPodRunning(env.Namespace, "main")
-
-	// Update status to running
-	retrieved, _ := orch.GetEnvironment(ctx, env.ID)
-	retrieved.Status = models.StatusRunning
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
 
 	// Execute command
 	resp, err := orch.ExecuteCommand(ctx, env.ID, []string{"echo", "hello"}, 30)
 	require.NoError(t, err)
 
-	assert.NotNil(t, resp)
-	assert.Equal(t, 0, resp.ExitCode)
+	require.NotNil(t, resp)
+	require.NotNil(t, resp.ExitCode)
+	assert.Equal(t, 0, *resp.ExitCode)
+	assert.False(t, resp.TimedOut)
 
 	// Try to execute in non-existent environment
 	_, err = orch.ExecuteCommand(ctx, "non-existent", []string{"ls"}, 30)
@@ -317,19 +439,10 @@ func TestGetLogs(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for async pod creation
-	time.Sleep(100 * time.Millisecond)
-
-	// Ensure pod exists in mock (the async creation should have done this, but verify)
-	// If pod doesn't exist, create it manually for the test
+	waitForProvisioning(t, orch, env.ID)
 	pod, err := mockK8s.GetPod(ctx, env.Namespace, "main")
-	if err != nil || pod == nil {
-		// Create pod manually if async creation hasn't completed
-		_ = mockK8s.CreatePod(ctx, &k8s.PodSpec{ // Ignore errors in tests
-			Name:      "main",
-			Namespace: env.Namespace,
-			Image:     "python:3.11-slim",
-		})
-	}
+	require.NoError(t, err)
+	require.NotNil(t, pod)
 
 	t.Run("get logs successfully", func(t *testing.T) {
 		logsResp, err := orch.GetLogs(ctx, env.ID, nil)
@@ -359,6 +472,61 @@ func TestGetLogs(t *testing.T) {
 	})
 }
 
+func TestParseLogLine(t *testing.T) {
+	ts, msg, ok := k8s.ParseLogLine("2026-01-22T10:00:01.123456789Z hello world")
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2026, 1, 22, 10, 0, 1, 123456789, time.UTC), ts)
+	assert.Equal(t, "hello world", msg)
+
+	ts, msg, ok = k8s.ParseLogLine("2026-01-22T10:00:02Z ")
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2026, 1, 22, 10, 0, 2, 0, time.UTC), ts)
+	assert.Empty(t, msg)
+
+	_, msg, ok = k8s.ParseLogLine("  at com.example.Main(Main.java:10)")
+	assert.False(t, ok)
+	assert.Equal(t, "  at com.example.Main(Main.java:10)", msg)
+
+	_, msg, ok = k8s.ParseLogLine("not-a-time message")
+	assert.False(t, ok)
+	assert.Equal(t, "not-a-time message", msg)
+}
+
+func TestGetLogsUsesKubernetesTimestamps(t *testing.T) {
+	orch, mockK8s := setupOrchestrator(t)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:  "ts-env",
+		Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{
+			CPU:     "500m",
+			Memory:  "512Mi",
+			Storage: "1Gi",
+		},
+	}, "user-123")
+	require.NoError(t, err)
+	waitForProvisioning(t, orch, env.ID)
+
+	mockK8s.SetPodLogs(env.Namespace, "main", "2026-01-22T10:00:01Z starting\n"+
+		"2026-01-22T10:00:02.5Z Traceback (most recent call last):\n"+
+		"  File \"main.py\", line 1\n"+
+		"2026-01-22T10:00:03Z done\n")
+
+	logsResp, err := orch.GetLogs(ctx, env.ID, nil)
+	require.NoError(t, err)
+	require.Len(t, logsResp.Logs, 4)
+
+	assert.Equal(t, "starting", logsResp.Logs[0].Message)
+	assert.Equal(t, time.Date(2026, 1, 22, 10, 0, 1, 0, time.UTC), logsResp.Logs[0].Timestamp)
+	assert.Equal(t, "Traceback (most recent call last):", logsResp.Logs[1].Message)
+	// Continuation line without a timestamp keeps the previous line's time and position
+	assert.Equal(t, `  File "main.py", line 1`, logsResp.Logs[2].Message)
+	assert.Equal(t, logsResp.Logs[1].Timestamp, logsResp.Logs[2].Timestamp)
+	assert.Equal(t, "done", logsResp.Logs[3].Message)
+	assert.Equal(t, time.Date(2026, 1, 22, 10, 0, 3, 0, time.UTC), logsResp.Logs[3].Timestamp)
+}
+
 func TestGetHealthInfo(t *testing.T) {
 	orch, _ := setupOrchestrator(t)
 	ctx := context.Background()
@@ -451,6 +619,37 @@ func TestListEnvironmentsWithLabelSelector(t *testing.T) {
 	})
 }
 
+func TestListEnvironmentsWithTeamFilter(t *testing.T) {
+	orch, _ := setupOrchestrator(t)
+	ctx := context.Background()
+
+	for i, teamID := range []string{"team-a", "team-b", "team-a", ""} {
+		req := &models.CreateEnvironmentRequest{
+			Name:  fmt.Sprintf("team-env-%d", i),
+			Image: "python:3.11-slim",
+			Resources: models.ResourceSpec{
+				CPU:     "500m",
+				Memory:  "512Mi",
+				Storage: "1Gi",
+			},
+			TeamID: teamID,
+		}
+		_, err := orch.CreateEnvironment(ctx, req, "user-123")
+		require.NoError(t, err)
+	}
+
+	resp, err := orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{TeamID: "team-a"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp.Total)
+	for _, env := range resp.Environments {
+		assert.Equal(t, "team-a", env.TeamID)
+	}
+
+	resp, err = orch.ListEnvironmentsWithOptions(ctx, orchestrator.ListEnvironmentsOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, resp.Total)
+}
+
 func TestCreateEnvironmentWithNodeSelector(t *testing.T) {
 	orch, mockK8s := setupOrchestrator(t)
 	ctx := context.Background()
@@ -482,7 +681,7 @@ func TestCreateEnvironmentWithNodeSelector(t *testing.T) {
 	assert.Equal(t, "compute", env.NodeSelector["node-type"])
 
 	// Wait for async namespace creation
-	time.Sleep(100 * time.Millisecond)
+	waitForProvisioning(t, orch, env.ID)
 	exists, _ := mockK8s.NamespaceExists(ctx, env.Namespace)
 	assert.True(t, exists)
 }
@@ -541,7 +740,7 @@ func TestCreateEnvironmentWithTolerations(t *testing.T) {
 	assert.Equal(t, int64(300), *env.Tolerations[1].TolerationSeconds)
 
 	// Wait for async namespace creation
-	time.Sleep(100 * time.Millisecond)
+	waitForProvisioning(t, orch, env.ID)
 	exists, _ := mockK8s.NamespaceExists(ctx, env.Namespace)
 	assert.True(t, exists)
 }
@@ -604,30 +803,19 @@ func TestDeleteEnvironmentCleansUpNamespace(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for async pod creation to complete
-	time.Sleep(150 * time.Millisecond)
+	waitForProvisioning(t, orch, env.ID)
 
-	// Verify namespace exists
+	// Verify namespace and pod exist
 	exists, err := mockK8s.NamespaceExists(ctx, env.Namespace)
 	require.NoError(t, err)
 	assert.True(t, exists, "namespace should exist before deletion")
-
-	// Ensure pod exists
 	pod, _ := mockK8s.GetPod(ctx, env.Namespace, "main")
-	if pod == nil {
-		_ = mockK8s.CreatePod(ctx, &k8s.PodSpec{
-			Name:      "main",
-			Namespace: env.Namespace,
-			Image:     "python:3.11-slim",
-		})
-	}
+	require.NotNil(t, pod)
 
-	// Delete environment
+	// Delete environment (the namespace is deleted before it returns)
 	err = orch.DeleteEnvironment(ctx, env.ID, false)
 	require.NoError(t, err)
 
-	// Wait for async deletion
-	time.Sleep(100 * time.Millisecond)
-
 	// Verify namespace is deleted
 	exists, err = mockK8s.NamespaceExists(ctx, env.Namespace)
 	require.NoError(t, err)
@@ -657,22 +845,12 @@ func TestDeleteEnvironmentForce(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for async creation
-	time.Sleep(150 * time.Millisecond)
-
-	// Ensure pod exists
-	_ = mockK8s.CreatePod(ctx, &k8s.PodSpec{
-		Name:      "main",
-		Namespace: env.Namespace,
-		Image:     "python:3.11-slim",
-	})
+	waitForProvisioning(t, orch, env.ID)
 
 	// Force delete
 	err = orch.DeleteEnvironment(ctx, env.ID, true)
 	require.NoError(t, err)
 
-	// Wait for async deletion
-	time.Sleep(100 * time.Millisecond)
-
 	// Verify cleanup
 	exists, _ := mockK8s.NamespaceExists(ctx, env.Namespace)
 	assert.False(t, exists, "namespace should be deleted with force flag")
@@ -1127,12 +1305,7 @@ func TestSubmitExecutionCleansUpPod(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for environment to be running
-	time.Sleep(150 * time.Millisecond)
-	mockK8s.SetPodRunning(env.Namespace, "main")
-
-	// Update environment status to running
-	retrieved, _ := orch.GetEnvironment(ctx, env.ID)
-	retrieved.Status = models.StatusRunning
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
 
 	// Submit an execution
 	execReq := &orchestrator.EphemeralExecRequest{
@@ -1145,23 +1318,66 @@ func TestSubmitExecutionCleansUpPod(t *testing.T) {
 	require.NotNil(t, exec)
 
 	// Wait for execution to complete and cleanup
-	time.Sleep(500 * time.Millisecond)
+	finalExec := waitForExecutionDone(t, orch, exec.ID)
+	assert.Equal(t, models.ExecutionStatusCompleted, finalExec.Status)
 
-	// Verify execution completed
-	finalExec, err := orch.GetExecution(ctx, exec.ID)
+	// The ephemeral pod is deleted before the execution is reported done
+	pod, _ := mockK8s.GetPod(ctx, env.Namespace, exec.PodName)
+	assert.Nil(t, pod, "Ephemeral pod should be deleted after execution")
+}
+
+func TestGetExecutionStatsCachesResults(t *testing.T) {
+	orch, _ := setupOrchestrator(t)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:  "test-env-stats",
+		Image: "python:3.11-slim",
+		Resources: models.ResourceSpec{
+			CPU:     "500m",
+			Memory:  "512Mi",
+			Storage: "1Gi",
+		},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+
+	submit := func() string {
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID,
+			Command:       []string{"echo", "test"},
+		}, "user-123")
+		require.NoError(t, err)
+		return exec.ID
+	}
+
+	waitForExecutionDone(t, orch, submit())
+
+	stats, err := orch.GetExecutionStats(ctx, env.ID, nil, nil)
 	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Total)
+	assert.Equal(t, env.ID, stats.EnvironmentID)
+	require.NotNil(t, stats.LastExecutionAt)
 
-	// Execution should be completed (or at least started)
-	assert.NotEqual(t, models.ExecutionStatusPending, finalExec.Status,
-		"Execution should have progressed from pending")
+	// A second request within the cache TTL returns the cached result
+	submit()
+	cached, err := orch.GetExecutionStats(ctx, env.ID, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cached.Total)
+	assert.Equal(t, stats.GeneratedAt, cached.GeneratedAt)
 
-	// The ephemeral pod should be cleaned up after execution
-	// (The mock may or may not reflect this depending on timing)
-	t.Logf("Execution status: %s", finalExec.Status)
+	// A different range is computed separately
+	from := time.Now().Add(-time.Hour)
+	fresh, err := orch.GetExecutionStats(ctx, env.ID, &from, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fresh.Total)
+
+	_, err = orch.GetExecutionStats(ctx, "non-existent", nil, nil)
+	assert.Error(t, err)
 }
 
 func TestExecutionIsolation(t *testing.T) {
-	orch, mockK8s := setupOrchestrator(t)
+	orch, _ := setupOrchestrator(t)
 	ctx := context.Background()
 
 	// Create environment
@@ -1179,12 +1395,7 @@ func TestExecutionIsolation(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for environment to be running
-	time.Sleep(150 * time.Millisecond)
-	mockK8s.SetPodRunning(env.Namespace, "main")
-
-	// Update environment status to running
-	retrieved, _ := orch.GetEnvironment(ctx, env.ID)
-	retrieved.Status = models.StatusRunning
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
 
 	// Submit multiple executions
 	execReq1 := &orchestrator.EphemeralExecRequest{
@@ -1217,7 +1428,7 @@ func TestExecutionIsolation(t *testing.T) {
 }
 
 func TestCancelExecutionCleansUpPod(t *testing.T) {
-	orch, mockK8s := setupOrchestrator(t)
+	orch, _ := setupOrchestrator(t)
 	ctx := context.Background()
 
 	// Create environment
@@ -1235,12 +1446,7 @@ func TestCancelExecutionCleansUpPod(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for environment to be running
-	time.Sleep(150 * time.Millisecond)
-	mockK8s.SetPodRunning(env.Namespace, "main")
-
-	// Update environment status to running
-	retrieved, _ := orch.GetEnvironment(ctx, env.ID)
-	retrieved.Status = models.StatusRunning
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
 
 	// Submit an execution
 	execReq := &orchestrator.EphemeralExecRequest{
@@ -1285,12 +1491,7 @@ func TestEphemeralPodCleanupAfterExecution(t *testing.T) {
 	require.NoError(t, err)
 
 	// Wait for environment to be running
-	time.Sleep(150 * time.Millisecond)
-	mockK8s.SetPodRunning(env.Namespace, "main")
-
-	// Update environment status to running
-	retrieved, _ := orch.GetEnvironment(ctx, env.ID)
-	retrieved.Status = models.StatusRunning
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
 
 	// Submit an execution
 	execReq := &orchestrator.EphemeralExecRequest{
@@ -1306,15 +1507,831 @@ func TestEphemeralPodCleanupAfterExecution(t *testing.T) {
 	podName := exec.PodName
 
 	// Wait for execution to complete
-	time.Sleep(300 * time.Millisecond)
-
-	// Verify execution completed
-	finalExec, err := orch.GetExecution(ctx, exec.ID)
-	require.NoError(t, err)
+	finalExec := waitForExecutionDone(t, orch, exec.ID)
 	assert.Equal(t, models.ExecutionStatusCompleted, finalExec.Status)
 
 	// Verify the ephemeral pod was deleted (cleaned up)
-	// The mock should show the pod as deleted
-	pod, _ := mockK8s.GetPod(ctx, "test-ephemeral", podName)
+	pod, _ := mockK8s.GetPod(ctx, env.Namespace, podName)
 	assert.Nil(t, pod, "Ephemeral pod should be deleted after execution")
 }
+
+func setupMultiClusterOrchestrator(t *testing.T) (*orchestrator.Orchestrator, *mocks.MockK8sClient, *mocks.MockK8sClient) {
+	cfg := &config.Config{
+		Kubernetes: config.KubernetesConfig{
+			NamespacePrefix: "test-",
+			RuntimeClass:    "gvisor",
+		},
+		Timeouts: config.TimeoutConfig{
+			StartupTimeout: 60,
+			DefaultTimeout: 60,
+			MaxTimeout:     3600,
+		},
+	}
+
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+
+	primary := mocks.NewMockK8sClient()
+	secondary := mocks.NewMockK8sClient()
+	clusters, err := k8s.NewClusters("primary", map[string]k8s.ClientInterface{
+		"primary":   primary,
+		"secondary": secondary,
+	})
+	require.NoError(t, err)
+
+	orch := orchestrator.NewWithClusters(clusters, cfg, log, nil)
+	t.Cleanup(orch.Stop)
+	return orch, primary, secondary
+}
+
+func TestCreateEnvironmentOnCluster(t *testing.T) {
+	orch, primary, secondary := setupMultiClusterOrchestrator(t)
+	ctx := context.Background()
+
+	newReq := func(cluster string) *models.CreateEnvironmentRequest {
+		return &models.CreateEnvironmentRequest{
+			Name:      "test-env",
+			Image:     "python:3.11-slim",
+			Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+			Cluster:   cluster,
+		}
+	}
+
+	onSecondary, err := orch.CreateEnvironment(ctx, newReq("secondary"), "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "secondary", onSecondary.Cluster)
+
+	onDefault, err := orch.CreateEnvironment(ctx, newReq(""), "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "primary", onDefault.Cluster)
+
+	require.Eventually(t, func() bool {
+		a, _ := orch.GetEnvironment(ctx, onSecondary.ID)
+		b, _ := orch.GetEnvironment(ctx, onDefault.ID)
+		return a.Status == models.StatusRunning && b.Status == models.StatusRunning
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Each environment's resources live only on its own cluster
+	exists, _ := secondary.NamespaceExists(ctx, onSecondary.Namespace)
+	assert.True(t, exists)
+	exists, _ = primary.NamespaceExists(ctx, onSecondary.Namespace)
+	assert.False(t, exists)
+	exists, _ = primary.NamespaceExists(ctx, onDefault.Namespace)
+	assert.True(t, exists)
+
+	// Commands run on the environment's cluster
+	_, err = orch.ExecuteCommand(ctx, onSecondary.ID, []string{"echo", "hi"}, 10)
+	require.NoError(t, err)
+
+	// Deletion cleans up on the environment's cluster
+	require.NoError(t, orch.DeleteEnvironment(ctx, onSecondary.ID, false))
+	exists, _ = secondary.NamespaceExists(ctx, onSecondary.Namespace)
+	assert.False(t, exists)
+
+	_, err = orch.CreateEnvironment(ctx, newReq("nowhere"), "user-123")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown cluster")
+}
+
+func TestEnvironmentDegradedWhenClusterUnreachable(t *testing.T) {
+	orch, _, secondary := setupMultiClusterOrchestrator(t)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Cluster:   "secondary",
+	}, "user-123")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, _ := orch.GetEnvironment(ctx, env.ID)
+		return got.Status == models.StatusRunning
+	}, 5*time.Second, 50*time.Millisecond)
+
+	secondary.SetHealthCheckError(true)
+
+	health, err := orch.GetHealthInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "degraded", health.Status)
+	assert.True(t, health.Kubernetes.Connected)
+	require.Len(t, health.Clusters, 2)
+	assert.Equal(t, "primary", health.Clusters[0].Name)
+	assert.True(t, health.Clusters[0].Default)
+	assert.True(t, health.Clusters[0].Connected)
+	assert.Equal(t, "secondary", health.Clusters[1].Name)
+	assert.False(t, health.Clusters[1].Connected)
+	assert.NotEmpty(t, health.Clusters[1].Error)
+
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusDegraded, got.Status)
+
+	list, err := orch.ListEnvironments(ctx, nil, "", 10, 0)
+	require.NoError(t, err)
+	require.Len(t, list.Environments, 1)
+	assert.Equal(t, models.StatusDegraded, list.Environments[0].Status)
+
+	_, err = orch.ExecuteCommand(ctx, env.ID, []string{"echo", "hi"}, 10)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "degraded")
+
+	// Once the cluster is reachable again the environment recovers
+	secondary.SetHealthCheckError(false)
+	_, err = orch.GetHealthInfo(ctx)
+	require.NoError(t, err)
+	got, err = orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusRunning, got.Status)
+}
+
+func TestDeleteEnvironmentCancelsRunningExecutions(t *testing.T) {
+	db := setupTestDB(t)
+	mockK8s := mocks.NewMockK8sClient()
+	mockK8s.SetHoldPodCompletion(true)
+	orch := setupOrchestratorOnCluster(t, mockK8s, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-delete-midflight",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"sleep", "3600"},
+	}, "user-123")
+	require.NoError(t, err)
+
+	// Wait until the execution pod is up and the execution is running
+	require.Eventually(t, func() bool {
+		got, err := orch.GetExecution(ctx, exec.ID)
+		return err == nil && got.Status == models.ExecutionStatusRunning && mockK8s.GetPodCount(env.Namespace) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+
+	// The execution is canceled (not failed by the namespace going away) and its pod is gone
+	got, err := orch.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusCanceled, got.Status)
+	assert.Equal(t, "environment deleted", got.Error)
+	assert.NotNil(t, got.CompletedAt)
+	exists, _ := mockK8s.NamespaceExists(ctx, env.Namespace)
+	assert.False(t, exists)
+
+	// The execution goroutine finishing afterwards (it releases its execution slot last) must not
+	// overwrite the canceled state
+	require.Eventually(t, func() bool {
+		return orch.QueueStatus().Executions.InFlight == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	got, err = orch.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusCanceled, got.Status)
+
+	// History is kept for the deleted environment
+	list, err := orch.ListExecutions(ctx, env.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, list.Executions, 1)
+	assert.Equal(t, exec.ID, list.Executions[0].ID)
+	assert.Equal(t, models.ExecutionStatusCanceled, list.Executions[0].Status)
+
+	_, err = orch.GetEnvironment(ctx, env.ID)
+	assert.Error(t, err)
+}
+
+func TestDeleteEnvironmentCancelsPersistedExecutions(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "test-env-delete-persisted"})
+
+	// An execution another replica queued: only the database knows it
+	require.NoError(t, db.SaveExecution(ctx, &models.Execution{
+		ID:            "exec-other-replica",
+		EnvironmentID: env.ID,
+		Command:       []string{"sleep", "60"},
+		Status:        models.ExecutionStatusQueued,
+		CreatedAt:     time.Now(),
+	}))
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+
+	stored, err := db.GetExecution(ctx, "exec-other-replica")
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusCanceled, stored.Status)
+	assert.Equal(t, "environment deleted", stored.Error)
+	assert.NotNil(t, stored.CompletedAt)
+}
+
+func TestDeleteEnvironmentDatabaseFailureKeepsEnvironment(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "test-env-delete-db-failure"})
+
+	_, err := db.ExecContext(ctx, `CREATE TRIGGER fail_env_delete BEFORE DELETE ON environments
+		BEGIN SELECT RAISE(ABORT, 'database unavailable'); END`)
+	require.NoError(t, err)
+
+	err = orch.DeleteEnvironment(ctx, env.ID, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "database unavailable")
+
+	// The environment is not left terminating and its pod is untouched
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusRunning, got.Status)
+	exists, _ := mockK8s.NamespaceExists(ctx, env.Namespace)
+	assert.True(t, exists)
+
+	// The delete succeeds once the database does
+	_, err = db.ExecContext(ctx, `DROP TRIGGER fail_env_delete`)
+	require.NoError(t, err)
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	_, err = orch.GetEnvironment(ctx, env.ID)
+	assert.Error(t, err)
+}
+
+func TestProvisioningPhases(t *testing.T) {
+	db := setupTestDB(t)
+	mockK8s := mocks.NewMockK8sClient()
+	mockK8s.SetHoldPodRunning(true)
+	orch := setupOrchestratorOnCluster(t, mockK8s, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-phases",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, models.PhaseQueued, env.Phase)
+
+	phaseIs := func(phase models.EnvironmentPhase) func() bool {
+		return func() bool {
+			got, err := orch.GetEnvironment(ctx, env.ID)
+			return err == nil && got.Phase == phase
+		}
+	}
+	require.Eventually(t, phaseIs(models.PhaseCreatingPod), 5*time.Second, 20*time.Millisecond)
+
+	// Image not yet on the node
+	mockK8s.SetContainerWaiting(env.Namespace, "main", "ContainerCreating")
+	require.Eventually(t, phaseIs(models.PhasePullingImage), 5*time.Second, 20*time.Millisecond)
+
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPending, got.Status)
+
+	mockK8s.SetPodRunning(env.Namespace, "main")
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning && got.Phase == models.PhaseReady
+	}, 5*time.Second, 20*time.Millisecond)
+
+	list, err := orch.ListEnvironments(ctx, nil, "", 10, 0)
+	require.NoError(t, err)
+	require.Len(t, list.Environments, 1)
+	assert.Equal(t, models.PhaseReady, list.Environments[0].Phase)
+
+	stored, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PhaseReady, stored.Phase)
+
+	// Every phase transition is recorded with a timestamp
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 0)
+	require.NoError(t, err)
+	var phases []string
+	for _, e := range events {
+		if e.EventType == "provisioning_phase" {
+			phases = append(phases, e.Message)
+		}
+	}
+	for _, phase := range []models.EnvironmentPhase{
+		models.PhaseQueued, models.PhaseCreatingNamespace, models.PhaseApplyingQuota,
+		models.PhaseApplyingNetworkPolicy, models.PhaseCreatingPod, models.PhasePullingImage, models.PhaseReady,
+	} {
+		assert.Contains(t, phases, "Provisioning phase: "+string(phase))
+	}
+}
+
+func TestWaitForExecution(t *testing.T) {
+	orch, mockK8s := setupOrchestrator(t)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-wait",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+
+	mockK8s.SetHoldPodCompletion(true)
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"sleep", "3600"},
+	}, "user-123")
+	require.NoError(t, err)
+
+	// Timing out leaves the execution running and releases the waiter
+	got, done, err := orch.WaitForExecution(ctx, exec.ID, 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.False(t, got.Status.IsTerminal())
+	assert.Equal(t, 0, orch.ExecutionWaiterCount())
+
+	// A disconnected client stops waiting with the context error
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		// Disconnect once the waiter is registered
+		assert.Eventually(t, func() bool { return orch.ExecutionWaiterCount() == 1 }, 5*time.Second, time.Millisecond)
+		cancel()
+	}()
+	_, _, err = orch.WaitForExecution(cancelCtx, exec.ID, 10*time.Second)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, orch.ExecutionWaiterCount())
+
+	// Waiters are woken as soon as the execution finishes rather than at the deadline
+	type result struct {
+		exec *models.Execution
+		done bool
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			got, done, err := orch.WaitForExecution(ctx, exec.ID, 10*time.Second)
+			assert.NoError(t, err)
+			results <- result{got, done}
+		}()
+	}
+	require.Eventually(t, func() bool { return orch.ExecutionWaiterCount() == 1 }, time.Second, 5*time.Millisecond)
+	start := time.Now()
+	require.NoError(t, orch.CancelExecution(ctx, exec.ID))
+	for i := 0; i < 2; i++ {
+		r := <-results
+		assert.True(t, r.done)
+		assert.Equal(t, models.ExecutionStatusCanceled, r.exec.Status)
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 0, orch.ExecutionWaiterCount())
+
+	// Already finished executions return immediately
+	got, done, err = orch.WaitForExecution(ctx, exec.ID, 10*time.Second)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, models.ExecutionStatusCanceled, got.Status)
+}
+
+func TestCommandPolicyEnforcement(t *testing.T) {
+	cfg := testOrchestratorConfig()
+	cfg.CommandPolicy = config.CommandPolicyConfig{DenyPatterns: config.DefaultCommandDenyPatterns}
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, cfg, db)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:          "test-env-policy",
+		Image:         "python:3.11-slim",
+		Resources:     models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		CommandPolicy: &models.CommandPolicy{AllowedBinaries: []string{"python", "rm"}},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+
+	// The policy survives the database round trip
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.CommandPolicy)
+	assert.Equal(t, []string{"python", "rm"}, got.CommandPolicy.AllowedBinaries)
+
+	// A denied command is rejected before any pod is created and audited with the full command
+	_, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"rm", "-rf", "/"},
+	}, "user-123")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rejected by policy")
+	assert.Equal(t, 1, mockK8s.GetPodCount(env.Namespace))
+
+	err = orch.CheckCommandPolicy(ctx, env.ID, []string{"curl", "http://example.com"}, "user-456")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not in the allowed list")
+
+	entries, err := db.ListAuditEntries(ctx, database.AuditFilter{Action: orchestrator.AuditActionCommandDenied})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	byActor := map[string]*models.AuditEntry{}
+	for _, e := range entries {
+		byActor[e.ActorID] = e
+		assert.Equal(t, env.ID, e.ResourceID)
+	}
+	require.Contains(t, byActor, "user-123")
+	assert.Equal(t, `["rm","-rf","/"]`, byActor["user-123"].Details)
+	assert.Contains(t, byActor["user-123"].Message, "deny_pattern")
+	require.Contains(t, byActor, "user-456")
+	assert.Equal(t, `["curl","http://example.com"]`, byActor["user-456"].Details)
+
+	// Allowed commands and admin submissions go through
+	assert.NoError(t, orch.CheckCommandPolicy(ctx, env.ID, []string{"python", "-c", "print(1)"}, "user-123"))
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID:     env.ID,
+		Command:           []string{"curl", "http://example.com"},
+		SkipCommandPolicy: true,
+	}, "admin-1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, exec.ID)
+
+	// Unrestricted environments skip the server-wide policy too
+	_, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{
+		CommandPolicy: &models.CommandPolicy{Unrestricted: true},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, orch.CheckCommandPolicy(ctx, env.ID, []string{"rm", "-rf", "/"}, "user-123"))
+}
+
+func TestStandbyPoolReplenishmentDoesNotOvershoot(t *testing.T) {
+	clock := mocks.NewFakeClock(time.Now())
+	orch, mockK8s := setupOrchestrator(t, orchestrator.WithClock(clock), orchestrator.WithPoolTicker(time.Minute))
+	ctx := context.Background()
+	// Pool, reconciliation, retention, idle reaper, snapshot scheduler and reservation loop (no cache sync without a database)
+	clock.BlockUntil(6)
+	poolPass := func() {
+		// The second tick is only received once the pass started by the first has finished
+		clock.Advance(time.Minute)
+		clock.Advance(time.Minute)
+	}
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-pool-burst",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Pool:      &models.PoolConfig{Enabled: true, Size: 2},
+	}, "user-123")
+	require.NoError(t, err)
+
+	standbyCreated := func() []string {
+		var names []string
+		for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+			if strings.HasPrefix(name, "standby-") {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	require.Eventually(t, func() bool {
+		return orch.GetPoolStatus()[env.ID] == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Len(t, standbyCreated(), 2)
+
+	// Keep replacement pods starting while the burst hits the pool
+	mockK8s.SetHoldPodRunning(true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+				EnvironmentID: env.ID,
+				Command:       []string{"echo", "hi"},
+			}, "user-123")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// The two claimed pods are replaced exactly once, however many claims triggered replenishment
+	require.Eventually(t, func() bool {
+		return len(standbyCreated()) == 4
+	}, 5*time.Second, 20*time.Millisecond)
+	poolPass()
+	assert.Len(t, standbyCreated(), 4)
+
+	// Let the pending pods start; the pool settles at its target
+	mockK8s.SetHoldPodRunning(false)
+	for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+		mockK8s.SetPodRunning(env.Namespace, name)
+	}
+	require.Eventually(t, func() bool {
+		return orch.GetPoolStatus()[env.ID] == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	poolPass()
+	assert.Equal(t, 2, orch.GetPoolStatus()[env.ID])
+	assert.Len(t, standbyCreated(), 4)
+}
+
+func TestPodMetadataEnvironment(t *testing.T) {
+	cfg := testOrchestratorConfig()
+	cfg.Server.PublicURL = "http://agentbox-api.agentbox.svc:8080"
+	cfg.Timeouts.DefaultTimeout, cfg.Timeouts.MaxTimeout = 3600, 7200
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, cfg, db)
+
+	t.Setenv("AGENTBOX_JWT_SECRET", "test-secret-key")
+	authService := auth.NewService(db, nil, zap.NewNop())
+	orch.SetCallbackTokenIssuer(authService)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-metadata",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Env: map[string]string{
+			"RESULTS_URL":      "${API_URL}/api/v1/environments/${ENV_ID}",
+			"RUN_ID":           "${EXECUTION_ID}",
+			"SHELL_REF":        "${HOME}/work",
+			"AGENTBOX_USER_ID": "custom-user",
+		},
+	}, "user-123")
+	require.NoError(t, err)
+
+	var main *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		main = mockK8s.CreatedPodSpec(env.Namespace, "main")
+		return main != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, env.ID, main.Env[orchestrator.EnvVarEnvironmentID])
+	assert.Equal(t, "http://agentbox-api.agentbox.svc:8080", main.Env[orchestrator.EnvVarAPIURL])
+	assert.NotContains(t, main.Env, orchestrator.EnvVarExecutionID)
+	assert.Equal(t, "http://agentbox-api.agentbox.svc:8080/api/v1/environments/"+env.ID, main.Env["RESULTS_URL"])
+	assert.Equal(t, "", main.Env["RUN_ID"])
+	assert.Equal(t, "${HOME}/work", main.Env["SHELL_REF"], "unknown templates are left alone")
+	// The user's value wins over the metadata variable, and the collision is recorded
+	assert.Equal(t, "custom-user", main.Env[orchestrator.EnvVarUserID])
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 0)
+	require.NoError(t, err)
+	var overrideEvents int
+	for _, e := range events {
+		if e.EventType == "env_var_override" {
+			overrideEvents++
+			assert.Contains(t, e.Message, orchestrator.EnvVarUserID)
+		}
+	}
+	assert.Positive(t, overrideEvents)
+
+	claims, err := authService.ValidateCallbackToken(main.Env[orchestrator.EnvVarCallbackToken])
+	require.NoError(t, err)
+	assert.Equal(t, env.ID, claims.EnvironmentID)
+	assert.Empty(t, claims.ExecutionID)
+
+	// Ephemeral pods also carry the execution ID, with per-execution variables layered on top
+	mockK8s.SetPodRunning(env.Namespace, "main")
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"echo", "hi"},
+		Env:           map[string]string{"RUN_ID": "run-${EXECUTION_ID}"},
+	}, "user-456")
+	require.NoError(t, err)
+
+	var ephemeral *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		ephemeral = mockK8s.CreatedPodSpec(env.Namespace, exec.ID)
+		return ephemeral != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, exec.ID, ephemeral.Env[orchestrator.EnvVarExecutionID])
+	assert.Equal(t, "run-"+exec.ID, ephemeral.Env["RUN_ID"])
+	claims, err = authService.ValidateCallbackToken(ephemeral.Env[orchestrator.EnvVarCallbackToken])
+	require.NoError(t, err)
+	assert.Equal(t, exec.ID, claims.ExecutionID)
+	assert.Equal(t, "user-456", claims.UserID)
+}
+
+func TestReadinessCheckGatesRunning(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	ready := false
+	mockK8s.SetExecHandler(func(namespace, podName string, command []string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !ready {
+			return "server not listening yet", fmt.Errorf("exit code 1")
+		}
+		return "", nil
+	})
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-readiness",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		ReadinessCheck: &models.ReadinessCheck{
+			Exec:            []string{"curl", "-sf", "http://localhost:8000/health"},
+			IntervalSeconds: 1,
+		},
+	}, "user-123")
+	require.NoError(t, err)
+
+	// The pod is running but the check fails: the environment stays Pending
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Phase == models.PhaseWaitingReady
+	}, 5*time.Second, 20*time.Millisecond)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPending, got.Status)
+
+	mu.Lock()
+	ready = true
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning && got.Phase == models.PhaseReady
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Persistent failure marks the environment Failed with the probe output
+	mockK8s.SetHTTPGetHandler(func(namespace, podName string, port int, path string) (int, string, error) {
+		return 503, "warming up " + strings.Repeat("é", 600), nil
+	})
+	failing, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-readiness-failing",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		ReadinessCheck: &models.ReadinessCheck{
+			HTTPGet:          &models.HTTPGetCheck{Port: 8000, Path: "/health"},
+			IntervalSeconds:  1,
+			FailureThreshold: 2,
+		},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusFailed, waitForProvisioning(t, orch, failing.ID).Status)
+
+	stored, err := db.GetEnvironment(ctx, failing.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusFailed, stored.Status)
+	assert.Contains(t, stored.StatusMessage, "readiness check failed")
+	assert.Contains(t, stored.StatusMessage, "HTTP 503: warming up")
+	// Long output is truncated without splitting a multi-byte character
+	assert.True(t, strings.HasSuffix(stored.StatusMessage, "..."))
+	assert.True(t, utf8.ValidString(stored.StatusMessage), "status message must stay valid UTF-8")
+	require.NotNil(t, stored.ReadinessCheck)
+	assert.Equal(t, 8000, stored.ReadinessCheck.HTTPGet.Port)
+}
+
+func TestFakeClockDrivesReconciliation(t *testing.T) {
+	clock := mocks.NewFakeClock(time.Now())
+	orch, mockK8s := setupOrchestrator(t, orchestrator.WithClock(clock))
+	ctx := context.Background()
+	clock.BlockUntil(6)
+
+	mockK8s.FailNext("CreateNamespace", 1, fmt.Errorf("admission webhook denied the request"))
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-reconcile-tick",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusFailed, waitForProvisioning(t, orch, env.ID).Status)
+
+	// Nothing is retried until the reconciliation interval (10s minimum) has passed
+	clock.Advance(5 * time.Second)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusFailed, got.Status)
+	assert.Equal(t, 1, mockK8s.CallCount("CreateNamespace"))
+
+	// The second tick is only received once the pass started by the first has finished
+	clock.Advance(5 * time.Second)
+	clock.Advance(10 * time.Second)
+	got, err = orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusRunning, got.Status, got.LastReconciliationError)
+	assert.Equal(t, 2, mockK8s.CallCount("CreateNamespace"))
+}
+
+func TestOrchestratorOptions(t *testing.T) {
+	ctx := context.Background()
+
+	limited, _ := setupOrchestrator(t, orchestrator.WithProvisionConcurrency(2))
+	assert.Equal(t, 2, limited.QueueStatus().Provisioning.Capacity)
+	defaults, _ := setupOrchestrator(t)
+	assert.Equal(t, orchestrator.MaxConcurrentProvisions, defaults.QueueStatus().Provisioning.Capacity)
+
+	// Without background loops nothing ticks and the standby pool is never replenished
+	clock := mocks.NewFakeClock(time.Now())
+	orch, _ := setupOrchestrator(t, orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-no-loops",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Pool:      &models.PoolConfig{Enabled: true, Size: 2},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+	clock.Advance(time.Hour)
+	assert.Zero(t, orch.GetPoolStatus()[env.ID])
+
+	// ProvisioningDone is closed for environments that are not being provisioned
+	select {
+	case <-orch.ProvisioningDone("non-existent"):
+	default:
+		t.Fatal("ProvisioningDone should be closed when nothing is being provisioned")
+	}
+}
+
+func TestProvisioningRetriesTransientK8sErrors(t *testing.T) {
+	cfg := &config.Config{
+		Kubernetes: config.KubernetesConfig{NamespacePrefix: "test-", RuntimeClass: "gvisor"},
+		Timeouts:   config.TimeoutConfig{DefaultTimeout: 60, MaxTimeout: 3600, StartupTimeout: 60},
+	}
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	mockK8s := mocks.NewMockK8sClient()
+	client := k8s.WithRetry(mockK8s, k8s.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, log.Logger)
+	orch := orchestrator.New(client, cfg, log, nil)
+	t.Cleanup(orch.Stop)
+	ctx := context.Background()
+
+	// An API server hiccup during namespace and pod creation no longer fails the environment
+	mockK8s.FailNext("CreateNamespace", 1, k8serrors.NewServiceUnavailable("apiserver restarting"))
+	mockK8s.FailNext("CreatePod", 2, k8serrors.NewTooManyRequests("slow down", 0))
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-retry",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+	assert.Equal(t, 2, mockK8s.CallCount("CreateNamespace"))
+	assert.Equal(t, 3, mockK8s.CallCount("CreatePod"))
+
+	// Non-transient errors still fail provisioning on the first attempt
+	mockK8s.FailNext("CreateResourceQuota", 1, k8serrors.NewForbidden(schema.GroupResource{Resource: "resourcequotas"}, "quota", fmt.Errorf("denied")))
+	failing, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-retry-forbidden",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusFailed, waitForProvisioning(t, orch, failing.ID).Status)
+	assert.Equal(t, 2, mockK8s.CallCount("CreateResourceQuota"))
+}
+
+func TestExecutionOutputIsCapped(t *testing.T) {
+	const limit = 16 << 10
+	cfg := testOrchestratorConfig()
+	cfg.Executions.MaxOutputBytes = limit
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, cfg, db)
+	ctx := context.Background()
+
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "test-env-output",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, "user-123")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusRunning, waitForProvisioning(t, orch, env.ID).Status)
+
+	// An ephemeral execution printing 32 MiB keeps only the head and tail of its log
+	const logSize = 32 << 20
+	mockK8s.SetCompletionLogSource(func(namespace, podName string) io.Reader {
+		return newRepeatingReader(logSize)
+	})
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"yes"},
+	}, "user-123")
+	require.NoError(t, err)
+	got, done, err := orch.WaitForExecution(ctx, exec.ID, 10*time.Second)
+	require.NoError(t, err)
+	require.True(t, done)
+	assert.True(t, got.Truncated)
+	assert.Equal(t, int64(logSize), got.StdoutBytesTotal)
+	assert.LessOrEqual(t, len(got.Stdout), limit+len(k8s.TruncationMarker(logSize)))
+	assert.True(t, strings.HasPrefix(got.Stdout, "line 1\n"))
+	assert.Contains(t, got.Stdout, "bytes truncated]")
+
+	// The size accounting is persisted
+	stored, err := db.GetExecution(ctx, exec.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Truncated)
+	assert.Equal(t, int64(logSize), stored.StdoutBytesTotal)
+	assert.Equal(t, got.Stdout, stored.Stdout)
+
+	// The synchronous exec path applies the same cap
+	mockK8s.SetExecHandler(func(namespace, podName string, command []string) (string, error) {
+		return strings.Repeat("y\n", limit), nil
+	})
+	resp, err := orch.ExecuteCommand(ctx, env.ID, []string{"yes"}, 10)
+	require.NoError(t, err)
+	assert.True(t, resp.Truncated)
+	assert.Equal(t, int64(2*limit), resp.StdoutBytesTotal)
+	assert.Equal(t, models.TruncatedOutputNote, resp.OutputNote)
+	assert.LessOrEqual(t, len(resp.Stdout), limit+len(k8s.TruncationMarker(limit)))
+
+	// Output under the cap is returned as is
+	mockK8s.SetExecHandler(nil)
+	resp, err = orch.ExecuteCommand(ctx, env.ID, []string{"echo"}, 10)
+	require.NoError(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Empty(t, resp.OutputNote)
+	assert.Equal(t, "mock output\n", resp.Stdout)
+}
@@ -0,0 +1,141 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+type ownershipTest struct {
+	*apiTest
+}
+
+func setupOwnershipTest(t *testing.T) *ownershipTest {
+	return &ownershipTest{setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		rc.UserHandler.SetOrchestrator(a.orch)
+	}))}
+}
+
+func (a *ownershipTest) createEnv(t *testing.T, name, userID string) *models.Environment {
+	env, err := a.orch.CreateEnvironment(context.Background(), &models.CreateEnvironmentRequest{
+		Name:      name,
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}, userID)
+	require.NoError(t, err)
+	return env
+}
+
+func (a *ownershipTest) ownedBy(t *testing.T, userID string) []string {
+	resp, err := a.orch.ListEnvironmentsWithOptions(context.Background(), orchestrator.ListEnvironmentsOptions{UserID: userID})
+	require.NoError(t, err)
+	ids := make([]string, 0, len(resp.Environments))
+	for _, env := range resp.Environments {
+		ids = append(ids, env.ID)
+	}
+	return ids
+}
+
+func TestTransferEnvironmentOwnership(t *testing.T) {
+	a := setupOwnershipTest(t)
+	ctx := context.Background()
+
+	alice := createUserForTest(t, a.users, "alice", "password123", users.RoleUser)
+	bob := createUserForTest(t, a.users, "bob", "password123", users.RoleUser)
+	env := a.createEnv(t, "alice-env", alice.ID)
+	_, err := a.permissions.GrantPermission(ctx, alice.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+	aliceJWT := getTokenForUser(t, a.router, "alice", "password123")
+	bobJWT := getTokenForUser(t, a.router, "bob", "password123")
+
+	// Only the owner (or an admin) can transfer
+	path := "/api/v1/environments/" + env.ID + "/transfer-ownership"
+	rr := a.do(t, http.MethodPost, path, bobJWT, map[string]string{"user_id": bob.ID})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, path, aliceJWT, map[string]string{"user_id": "no-such-user"})
+	assert.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPost, path, aliceJWT, map[string]string{})
+	assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	rr = a.do(t, http.MethodPost, path, aliceJWT, map[string]string{"user_id": bob.ID})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var updated models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&updated))
+	assert.Equal(t, bob.ID, updated.UserID)
+
+	// The owner grant moved and the owner filter sees the transfer
+	perm, err := a.permissions.GetUserPermission(ctx, alice.ID, env.ID)
+	require.NoError(t, err)
+	assert.Nil(t, perm)
+	perm, err = a.permissions.GetUserPermission(ctx, bob.ID, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, perm)
+	assert.Equal(t, permissions.PermissionOwner, perm.Permission)
+	assert.Equal(t, []string{env.ID}, a.ownedBy(t, bob.ID))
+	assert.Empty(t, a.ownedBy(t, alice.ID))
+
+	entries, err := a.db.ListAuditEntries(ctx, database.AuditFilter{Action: orchestrator.AuditActionOwnershipTransferred})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, alice.ID, entries[0].ActorID)
+	assert.Equal(t, env.ID, entries[0].ResourceID)
+
+	// Alice no longer owns it
+	rr = a.do(t, http.MethodPost, path, aliceJWT, map[string]string{"user_id": alice.ID})
+	assert.Equal(t, http.StatusForbidden, rr.Code, rr.Body.String())
+}
+
+func TestDeleteUserWithEnvironments(t *testing.T) {
+	a := setupOwnershipTest(t)
+	ctx := context.Background()
+
+	createUserForTest(t, a.users, "admin-user", "password123", users.RoleAdmin)
+	leaver := createUserForTest(t, a.users, "leaver", "password123", users.RoleUser)
+	heir := createUserForTest(t, a.users, "heir", "password123", users.RoleUser)
+	first := a.createEnv(t, "first-env", leaver.ID)
+	second := a.createEnv(t, "second-env", leaver.ID)
+	adminJWT := getTokenForUser(t, a.router, "admin-user", "password123")
+
+	// Blocked while the user owns environments
+	rr := a.do(t, http.MethodDelete, "/api/v1/users/"+leaver.ID, adminJWT, nil)
+	require.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apierrors.CodeUserOwnsEnvironments, errResp.Code)
+	assert.Contains(t, errResp.Error, first.ID)
+	assert.Contains(t, errResp.Error, second.ID)
+	_, err := a.users.GetUserByID(ctx, leaver.ID)
+	require.NoError(t, err)
+
+	rr = a.do(t, http.MethodDelete, "/api/v1/users/"+leaver.ID+"?transfer_to=no-such-user", adminJWT, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	// transfer_to reassigns everything and deletes the user
+	rr = a.do(t, http.MethodDelete, "/api/v1/users/"+leaver.ID+"?transfer_to="+heir.ID, adminJWT, nil)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	_, err = a.users.GetUserByID(ctx, leaver.ID)
+	assert.ErrorIs(t, err, users.ErrUserNotFound)
+	assert.ElementsMatch(t, []string{first.ID, second.ID}, a.ownedBy(t, heir.ID))
+	assert.Empty(t, a.ownedBy(t, leaver.ID))
+	perm, err := a.permissions.GetUserPermission(ctx, heir.ID, first.ID)
+	require.NoError(t, err)
+	require.NotNil(t, perm)
+	assert.Equal(t, permissions.PermissionOwner, perm.Permission)
+
+	// Users without environments are deleted as before
+	idle := createUserForTest(t, a.users, "idle", "password123", users.RoleUser)
+	_, err = a.users.DeleteUser(ctx, idle.ID, "", "")
+	require.NoError(t, err)
+}
@@ -0,0 +1,417 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+func waitForPipelineDone(t *testing.T, orch *orchestrator.Orchestrator, id string) *models.Pipeline {
+	var pipeline *models.Pipeline
+	require.Eventually(t, func() bool {
+		var err error
+		pipeline, err = orch.GetPipeline(context.Background(), id)
+		return err == nil && pipeline.Status.IsTerminal()
+	}, 5*time.Second, 10*time.Millisecond)
+	return pipeline
+}
+
+func pipelineStep(pipeline *models.Pipeline, name string) models.PipelineStep {
+	for _, step := range pipeline.Steps {
+		if step.Name == name {
+			return step
+		}
+	}
+	return models.PipelineStep{}
+}
+
+func TestPipelineRunsStepsInDependencyOrder(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-env"})
+
+	var mu sync.Mutex
+	var order []string
+	mockK8s.SetCompletionHandler(func(spec *k8s.PodSpec) int {
+		mu.Lock()
+		order = append(order, spec.Command[0])
+		mu.Unlock()
+		return 0
+	})
+
+	submitted, err := orch.SubmitPipeline(ctx, env.ID, &models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+		{Name: "package", Command: []string{"package"}, DependsOn: []string{"unit", "lint"}},
+		{Name: "unit", Command: []string{"unit"}, DependsOn: []string{"build"}},
+		{Name: "lint", Command: []string{"lint"}, DependsOn: []string{"build"}},
+		{Name: "build", Command: []string{"build"}, Env: map[string]string{"GOOS": "linux"}},
+	}}, "user-123", false)
+	require.NoError(t, err)
+	assert.Equal(t, models.PipelineRunning, submitted.Status)
+	assert.Equal(t, orchestrator.DefaultPipelineParallel, submitted.MaxParallel)
+
+	pipeline := waitForPipelineDone(t, orch, submitted.ID)
+	assert.Equal(t, models.PipelineCompleted, pipeline.Status)
+	require.NotNil(t, pipeline.CompletedAt)
+	for _, step := range pipeline.Steps {
+		assert.Equal(t, models.StepCompleted, step.Status, step.Name)
+		require.NotEmpty(t, step.ExecutionID, step.Name)
+		exec, err := orch.GetExecution(ctx, step.ExecutionID)
+		require.NoError(t, err)
+		assert.Equal(t, step.Command, exec.Command)
+	}
+	build, err := orch.GetExecution(ctx, pipelineStep(pipeline, "build").ExecutionID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"GOOS": "linux"}, build.Env)
+
+	mu.Lock()
+	require.Len(t, order, 4)
+	assert.Equal(t, "build", order[0])
+	assert.ElementsMatch(t, []string{"unit", "lint"}, order[1:3])
+	assert.Equal(t, "package", order[3])
+	mu.Unlock()
+
+	stored, err := db.GetPipeline(ctx, submitted.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PipelineCompleted, stored.Status)
+	assert.Equal(t, pipelineStep(pipeline, "unit").ExecutionID, pipelineStep(stored, "unit").ExecutionID)
+}
+
+func TestPipelineFailureSkipsDependents(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-fail-env"})
+	mockK8s.SetCompletionHandler(func(spec *k8s.PodSpec) int {
+		if spec.Command[0] == "test" {
+			return 2
+		}
+		return 0
+	})
+
+	submitted, err := orch.SubmitPipeline(ctx, env.ID, &models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+		{Name: "build", Command: []string{"build"}},
+		{Name: "test", Command: []string{"test"}, DependsOn: []string{"build"}},
+		{Name: "package", Command: []string{"package"}, DependsOn: []string{"test"}},
+		{Name: "publish", Command: []string{"publish"}, DependsOn: []string{"package"}},
+		{Name: "docs", Command: []string{"docs"}, DependsOn: []string{"build"}},
+	}}, "user-123", false)
+	require.NoError(t, err)
+
+	pipeline := waitForPipelineDone(t, orch, submitted.ID)
+	assert.Equal(t, models.PipelineFailed, pipeline.Status)
+
+	test := pipelineStep(pipeline, "test")
+	assert.Equal(t, models.StepFailed, test.Status)
+	require.NotNil(t, test.ExitCode)
+	assert.Equal(t, 2, *test.ExitCode)
+
+	// Downstream steps never run; independent branches do
+	for _, name := range []string{"package", "publish"} {
+		step := pipelineStep(pipeline, name)
+		assert.Equal(t, models.StepSkipped, step.Status, name)
+		assert.Empty(t, step.ExecutionID, name)
+	}
+	assert.Contains(t, pipelineStep(pipeline, "package").Error, "test")
+	assert.Equal(t, models.StepCompleted, pipelineStep(pipeline, "docs").Status)
+}
+
+func TestPipelineStepsExemptFromRetention(t *testing.T) {
+	for _, withDB := range []bool{true, false} {
+		name := "in memory"
+		if withDB {
+			name = "database"
+		}
+		t.Run(name, func(t *testing.T) {
+			var db *database.DB
+			if withDB {
+				db = setupTestDB(t)
+			}
+			orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+			ctx := context.Background()
+			env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-retention-env"})
+
+			submitted, err := orch.SubmitPipeline(ctx, env.ID, &models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+				{Name: "build", Command: []string{"build"}},
+				{Name: "test", Command: []string{"test"}, DependsOn: []string{"build"}},
+			}}, "user-123", false)
+			require.NoError(t, err)
+			pipeline := waitForPipelineDone(t, orch, submitted.ID)
+			require.Equal(t, models.PipelineCompleted, pipeline.Status)
+
+			standalone, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+				EnvironmentID: env.ID,
+				Command:       []string{"echo", "hi"},
+			}, "user-123")
+			require.NoError(t, err)
+			waitForExecutionDone(t, orch, standalone.ID)
+
+			// Purging everything finished removes the standalone execution but not the steps
+			purged, err := orch.PurgeExecutions(ctx, env.ID, time.Now().Add(time.Hour))
+			require.NoError(t, err)
+			assert.Equal(t, 1, purged)
+			_, err = orch.GetExecution(ctx, standalone.ID)
+			assert.Error(t, err)
+
+			pipeline, err = orch.GetPipeline(ctx, submitted.ID)
+			require.NoError(t, err)
+			for _, step := range pipeline.Steps {
+				require.NotEmpty(t, step.ExecutionID, step.Name)
+				_, err := orch.GetExecution(ctx, step.ExecutionID)
+				assert.NoError(t, err, step.Name)
+			}
+		})
+	}
+}
+
+func TestPipelineMaxParallel(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-parallel-env"})
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	started, active, peak := 0, 0, 0
+	mockK8s.SetCompletionHandler(func(*k8s.PodSpec) int {
+		mu.Lock()
+		started++
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return 0
+	})
+	startedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return started
+	}
+
+	var steps []models.PipelineStepRequest
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		steps = append(steps, models.PipelineStepRequest{Name: name, Command: []string{name}})
+	}
+	submitted, err := orch.SubmitPipeline(ctx, env.ID, &models.CreatePipelineRequest{Steps: steps, MaxParallel: 2}, "user-123", false)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return startedCount() == 2 }, 5*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, startedCount(), "independent steps beyond max_parallel must wait")
+	pipeline, err := orch.GetPipeline(ctx, submitted.ID)
+	require.NoError(t, err)
+	pending := 0
+	for _, step := range pipeline.Steps {
+		if step.Status == models.StepPending {
+			pending++
+		}
+	}
+	assert.Equal(t, 3, pending)
+
+	close(release)
+	pipeline = waitForPipelineDone(t, orch, submitted.ID)
+	assert.Equal(t, models.PipelineCompleted, pipeline.Status)
+	assert.Equal(t, 5, startedCount())
+	assert.Equal(t, 2, peak)
+}
+
+func TestPipelineCancelPropagates(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-cancel-env"})
+	mockK8s.SetHoldPodCompletion(true)
+
+	submitted, err := orch.SubmitPipeline(ctx, env.ID, &models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+		{Name: "train", Command: []string{"train"}},
+		{Name: "eval", Command: []string{"eval"}, DependsOn: []string{"train"}},
+	}}, "user-123", false)
+	require.NoError(t, err)
+
+	var execID string
+	require.Eventually(t, func() bool {
+		pipeline, err := orch.GetPipeline(ctx, submitted.ID)
+		if err != nil || pipeline.Steps[0].ExecutionID == "" {
+			return false
+		}
+		execID = pipeline.Steps[0].ExecutionID
+		exec, err := orch.GetExecution(ctx, execID)
+		return err == nil && exec.Status == models.ExecutionStatusRunning
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pipeline, err := orch.CancelPipeline(ctx, submitted.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.PipelineCanceled, pipeline.Status)
+	assert.Equal(t, models.StepCanceled, pipelineStep(pipeline, "train").Status)
+	assert.Equal(t, models.StepCanceled, pipelineStep(pipeline, "eval").Status)
+	assert.Empty(t, pipelineStep(pipeline, "eval").ExecutionID)
+
+	exec, err := orch.GetExecution(ctx, execID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusCanceled, exec.Status)
+
+	// A finished pipeline cannot be canceled again
+	_, err = orch.CancelPipeline(ctx, submitted.ID)
+	assert.Equal(t, http.StatusConflict, apierrors.HTTPStatus(err))
+	assert.Equal(t, apierrors.CodePipelineNotCancelable, apierrors.CodeOf(err))
+}
+
+func TestPipelineCyclesAndGraphValidation(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	err := v.ValidateCreatePipelineRequest(&models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+		{Name: "setup", Command: []string{"setup"}},
+		{Name: "build", Command: []string{"build"}, DependsOn: []string{"setup", "package"}},
+		{Name: "test", Command: []string{"test"}, DependsOn: []string{"build"}},
+		{Name: "package", Command: []string{"package"}, DependsOn: []string{"test"}},
+	}})
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+	require.Len(t, verrs, 1)
+	assert.Equal(t, "steps[1].depends_on", verrs[0].Field)
+	assert.Equal(t, "dependency cycle: build -> package -> test -> build", verrs[0].Message)
+
+	assert.Equal(t, []string{"loop", "loop"}, validator.PipelineCycle([]models.PipelineStepRequest{
+		{Name: "loop", Command: []string{"true"}, DependsOn: []string{"loop"}},
+	}))
+
+	err = v.ValidateCreatePipelineRequest(&models.CreatePipelineRequest{
+		MaxParallel: validator.MaxPipelineParallel + 1,
+		Steps: []models.PipelineStepRequest{
+			{Name: "build", Command: []string{"build"}},
+			{Name: "build", Command: []string{"again"}},
+			{Name: "bad name", Command: []string{"x"}},
+			{Name: "test", DependsOn: []string{"missing"}},
+		},
+	})
+	require.True(t, errors.As(err, &verrs))
+	fields := make([]string, len(verrs))
+	for i, e := range verrs {
+		fields[i] = e.Field
+	}
+	assert.ElementsMatch(t, []string{"max_parallel", "steps[3].command", "steps[1].name", "steps[2].name", "steps[3].depends_on"}, fields)
+
+	// The orchestrator refuses cycles even when called directly
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-cycle-env"})
+	_, err = orch.SubmitPipeline(context.Background(), env.ID, &models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+		{Name: "a", Command: []string{"a"}, DependsOn: []string{"b"}},
+		{Name: "b", Command: []string{"b"}, DependsOn: []string{"a"}},
+	}}, "user-123", false)
+	assert.Equal(t, http.StatusBadRequest, apierrors.HTTPStatus(err))
+	assert.Contains(t, err.Error(), "dependency cycle: a -> b -> a")
+}
+
+func TestPipelineInterruptedByRestart(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	// A pipeline stored as running that this server is not running
+	require.NoError(t, db.SavePipeline(ctx, &models.Pipeline{
+		ID:            "pipe-lost",
+		EnvironmentID: "env-1",
+		Status:        models.PipelineRunning,
+		MaxParallel:   1,
+		Steps: []models.PipelineStep{
+			{Name: "first", Command: []string{"first"}, Status: models.StepRunning, ExecutionID: "exec-1"},
+			{Name: "second", Command: []string{"second"}, DependsOn: []string{"first"}, Status: models.StepPending},
+		},
+		CreatedAt: time.Now(),
+	}))
+
+	pipeline, err := orch.GetPipeline(ctx, "pipe-lost")
+	require.NoError(t, err)
+	assert.Equal(t, models.PipelineFailed, pipeline.Status)
+	assert.Contains(t, pipeline.Error, "restart")
+	assert.Equal(t, "exec-1", pipeline.Steps[0].ExecutionID)
+	assert.Equal(t, models.StepSkipped, pipeline.Steps[1].Status)
+
+	stored, err := db.GetPipeline(ctx, "pipe-lost")
+	require.NoError(t, err)
+	assert.Equal(t, models.PipelineFailed, stored.Status)
+
+	_, err = orch.GetPipeline(ctx, "pipe-missing")
+	assert.Equal(t, http.StatusNotFound, apierrors.HTTPStatus(err))
+}
+
+func TestPipelineAPI(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pipeline-api-env"})
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/pipelines", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": env.ID})
+		rr := httptest.NewRecorder()
+		handler.SubmitPipeline(rr, req)
+		return rr
+	}
+
+	rr := submit(`{"steps": [
+		{"name": "build", "command": ["make"], "depends_on": ["test"]},
+		{"name": "test", "command": ["make", "test"], "depends_on": ["build"]}
+	]}`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	var errResp models.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	require.Len(t, errResp.Details, 1)
+	assert.Equal(t, "dependency cycle: build -> test -> build", errResp.Details[0].Message)
+
+	rr = submit(`{"steps": [
+		{"name": "build", "command": ["make"]},
+		{"name": "test", "command": ["make", "test"], "depends_on": ["build"], "env": {"CI": "1"}}
+	], "max_parallel": 1}`)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	var submitted models.Pipeline
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&submitted))
+	assert.Equal(t, env.ID, submitted.EnvironmentID)
+	assert.Equal(t, 1, submitted.MaxParallel)
+	waitForPipelineDone(t, orch, submitted.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pipelines/"+submitted.ID, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": submitted.ID})
+	rr = httptest.NewRecorder()
+	handler.GetPipeline(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var pipeline models.Pipeline
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&pipeline))
+	assert.Equal(t, models.PipelineCompleted, pipeline.Status)
+	require.Len(t, pipeline.Steps, 2)
+	assert.NotEmpty(t, pipeline.Steps[1].ExecutionID)
+	assert.Equal(t, models.StepCompleted, pipeline.Steps[1].Status)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/pipelines/"+submitted.ID, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": submitted.ID})
+	rr = httptest.NewRecorder()
+	handler.CancelPipeline(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/pipelines/pipe-missing", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pipe-missing"})
+	rr = httptest.NewRecorder()
+	handler.GetPipeline(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
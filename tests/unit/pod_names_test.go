@@ -0,0 +1,92 @@
+package unit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+func podAlreadyExists() error {
+	return apierrors.New(apierrors.Conflict, apierrors.CodePodAlreadyExists, "pods \"taken\" already exists")
+}
+
+func TestEphemeralPodNameCollisionRetried(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:   "collide-env",
+		Labels: map[string]string{"team": "ml/platform"},
+	})
+
+	// The first name is taken; the pod is created under a new one and the execution records it
+	mockK8s.FailNext("CreatePod", 1, podAlreadyExists())
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	done := waitForExecutionDone(t, orch, exec.ID)
+	require.Equal(t, models.ExecutionStatusCompleted, done.Status, done.Error)
+	assert.Equal(t, models.ExecutionModeEphemeral, done.Mode)
+	assert.NotEqual(t, exec.ID, done.PodName)
+	assert.True(t, strings.HasPrefix(done.PodName, "exec-"), done.PodName)
+	assert.LessOrEqual(t, len(done.PodName), 63)
+	assert.Nil(t, mockK8s.CreatedPodSpec(env.Namespace, exec.ID))
+
+	spec := mockK8s.CreatedPodSpec(env.Namespace, done.PodName)
+	require.NotNil(t, spec)
+	assert.Equal(t, exec.ID, spec.Labels["exec-id"])
+	// Label values are sanitized and stay distinct
+	assert.Regexp(t, `^ml-platform-[0-9a-f]{8}$`, spec.Labels["team"])
+
+	// A name that stays taken fails the execution with the conflict
+	mockK8s.FailNext("CreatePod", 3, podAlreadyExists())
+	exec, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	done = waitForExecutionDone(t, orch, exec.ID)
+	assert.Equal(t, models.ExecutionStatusFailed, done.Status)
+	assert.Contains(t, done.Error, "already exists")
+}
+
+func TestStandbyPodNameCollisionRetried(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "collide-pool-env",
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	// Claiming the standby pod refills the pool; the refill's first name is taken
+	mockK8s.FailNext("CreatePod", 1, podAlreadyExists())
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID, Command: []string{"ls"},
+	}, "user-123")
+	require.NoError(t, err)
+	done := waitForExecutionDone(t, orch, exec.ID)
+	require.Equal(t, models.ExecutionModeStandby, done.Mode)
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+
+	var standby []string
+	for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+		if strings.HasPrefix(name, "standby-") {
+			standby = append(standby, name)
+			assert.LessOrEqual(t, len(name), 63)
+		}
+	}
+	require.Len(t, standby, 2)
+	assert.NotEqual(t, standby[0], standby[1])
+}
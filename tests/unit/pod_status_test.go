@@ -0,0 +1,108 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// podStatusConfig watches pods when podWatch is set and caches pod reads for cacheSeconds
+func podStatusConfig(podWatch bool, cacheSeconds int) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Reconciliation = config.ReconciliationConfig{PodWatch: podWatch, StatusCacheSeconds: cacheSeconds}
+	return cfg
+}
+
+// pollEnvironments reads every environment rounds times, like a dashboard polling them, and
+// returns the number of GetPod calls it caused
+func pollEnvironments(t *testing.T, orch *orchestrator.Orchestrator, mockK8s *mocks.MockK8sClient, envs []*models.Environment, rounds int) int {
+	ctx := context.Background()
+	before := mockK8s.CallCount("GetPod")
+	for i := 0; i < rounds; i++ {
+		for _, env := range envs {
+			got, err := orch.GetEnvironment(ctx, env.ID)
+			require.NoError(t, err)
+			require.Equal(t, models.StatusRunning, got.Status)
+		}
+	}
+	return mockK8s.CallCount("GetPod") - before
+}
+
+func createRunningEnvs(t *testing.T, orch *orchestrator.Orchestrator, count int) []*models.Environment {
+	envs := make([]*models.Environment, 0, count)
+	for i := 0; i < count; i++ {
+		envs = append(envs, createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: fmt.Sprintf("poll-env-%d", i)}))
+	}
+	return envs
+}
+
+func TestEnvironmentReadsGetPodLoad(t *testing.T) {
+	const envCount, rounds = 20, 5
+
+	// Without the watch or the cache every read is an API call
+	uncachedK8s := mocks.NewMockK8sClient()
+	uncached := setupOrchestratorOnCluster(t, uncachedK8s, podStatusConfig(false, 0), nil)
+	uncachedCalls := pollEnvironments(t, uncached, uncachedK8s, createRunningEnvs(t, uncached, envCount), rounds)
+	assert.Equal(t, envCount*rounds, uncachedCalls)
+
+	// The status cache serves repeated reads within its TTL
+	cachedK8s := mocks.NewMockK8sClient()
+	cached := setupOrchestratorOnCluster(t, cachedK8s, podStatusConfig(false, 10), nil)
+	cachedCalls := pollEnvironments(t, cached, cachedK8s, createRunningEnvs(t, cached, envCount), rounds)
+	assert.LessOrEqual(t, cachedCalls, envCount)
+
+	// With the pod watch reads make no API calls at all
+	watchedK8s := mocks.NewMockK8sClient()
+	watched := setupOrchestratorOnCluster(t, watchedK8s, podStatusConfig(true, 10), nil)
+	require.Eventually(t, func() bool { return watchedK8s.PodWatchCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	watchedCalls := pollEnvironments(t, watched, watchedK8s, createRunningEnvs(t, watched, envCount), rounds)
+	assert.Zero(t, watchedCalls)
+
+	t.Logf("GetPod calls for %d reads: uncached %d, cached %d, watched %d", envCount*rounds, uncachedCalls, cachedCalls, watchedCalls)
+}
+
+func TestPodWatchPushesStatusChanges(t *testing.T) {
+	mockK8s := mocks.NewMockK8sClient()
+	orch := setupOrchestratorOnCluster(t, mockK8s, podStatusConfig(true, 0), nil)
+	require.Eventually(t, func() bool { return mockK8s.PodWatchCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "watched-env"})
+
+	// The failure reaches the cached environment without anyone reading it
+	mockK8s.SetPodFailed(env.Namespace, "main")
+	require.Eventually(t, func() bool {
+		listed, err := orch.ListEnvironments(context.Background(), nil, "", 10, 0)
+		return err == nil && len(listed.Environments) == 1 && listed.Environments[0].Status == models.StatusFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, mockK8s.CallCount("GetPod"))
+
+	// A dropped watch is resumed, and changes made meanwhile are picked up from the new listing
+	mockK8s.CloseWatches()
+	mockK8s.SetPodRunning(env.Namespace, "main")
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(context.Background(), env.ID)
+		return err == nil && got.Status == models.StatusRunning && mockK8s.PodWatchCount() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPodWatchForbiddenFallsBackToStatusCache(t *testing.T) {
+	mockK8s := mocks.NewMockK8sClient()
+	forbidden := k8serrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", fmt.Errorf("cannot watch pods"))
+	mockK8s.FailNext("WatchPods", 1, forbidden)
+	orch := setupOrchestratorOnCluster(t, mockK8s, podStatusConfig(true, 10), nil)
+	require.Eventually(t, func() bool { return mockK8s.CallCount("WatchPods") == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, mockK8s.PodWatchCount())
+
+	envs := createRunningEnvs(t, orch, 3)
+	assert.LessOrEqual(t, pollEnvironments(t, orch, mockK8s, envs, 5), len(envs))
+}
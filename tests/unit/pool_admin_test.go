@@ -0,0 +1,168 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+)
+
+func TestStandbyPoolRefreshAndDrain(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "pool-admin-env",
+		Pool: &models.PoolConfig{Enabled: true, Size: 2},
+	})
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 2 }, 5*time.Second, 20*time.Millisecond)
+
+	// standbyPods lists the standby pods that still exist
+	standbyPods := func() []string {
+		var names []string
+		for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+			if _, err := mockK8s.GetPod(ctx, env.Namespace, name); err == nil && strings.HasPrefix(name, "standby-") {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	before := standbyPods()
+	require.Len(t, before, 2)
+
+	// A refresh replaces the idle pods with new ones
+	result, err := orch.RefreshStandbyPool(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.PodsDeleted)
+	assert.False(t, result.Drained)
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 2 }, 5*time.Second, 20*time.Millisecond)
+	after := standbyPods()
+	require.Len(t, after, 2)
+	for _, name := range before {
+		assert.NotContains(t, after, name)
+	}
+
+	// A drain empties the pool and keeps it empty
+	result, err = orch.DrainStandbyPool(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.PodsDeleted)
+	assert.True(t, result.Drained)
+	assert.Equal(t, []string{env.ID}, orch.DrainedPools())
+	assert.Never(t, func() bool { return orch.GetPoolStatus()[env.ID] != 0 }, 300*time.Millisecond, 20*time.Millisecond)
+	assert.Empty(t, standbyPods())
+
+	// Refreshing a drained pool re-enables it
+	_, err = orch.RefreshStandbyPool(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Empty(t, orch.DrainedPools())
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 2 }, 5*time.Second, 20*time.Millisecond)
+
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 50)
+	require.NoError(t, err)
+	var types []string
+	for _, e := range events {
+		types = append(types, e.EventType)
+	}
+	assert.Contains(t, types, "pool_refresh")
+	assert.Contains(t, types, "pool_drain")
+
+	// Environments without a pool are refused
+	plain := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "no-pool-env"})
+	_, err = orch.DrainStandbyPool(ctx, plain.ID)
+	assert.Equal(t, apierrors.CodePoolNotEnabled, apierrors.CodeOf(err))
+	assert.True(t, errors.Is(err, apierrors.Conflict))
+	_, err = orch.RefreshStandbyPool(ctx, "missing")
+	assert.True(t, errors.Is(err, apierrors.NotFound))
+}
+
+func TestStandbyPoolPrewarmOnCreate(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	mockK8s.SetHoldPodRunning(true)
+
+	create := func(name string) *models.Environment {
+		env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+			Name:      name,
+			Image:     "python:3.11-slim",
+			Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+			Pool:      &models.PoolConfig{Enabled: true, Size: 2, MinReady: 1, PrewarmOnCreate: true},
+		}, "user-123")
+		require.NoError(t, err)
+		return env
+	}
+	standbyPods := func(namespace string) []string {
+		var names []string
+		for _, name := range mockK8s.CreatedPodNames(namespace) {
+			if strings.HasPrefix(name, "standby-") {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	// The standby pods are created while the main pod is still starting
+	env := create("prewarm-env")
+	require.Eventually(t, func() bool { return len(standbyPods(env.Namespace)) == 2 }, 5*time.Second, 20*time.Millisecond)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPending, got.Status)
+	require.NotNil(t, got.PoolReady)
+	assert.False(t, *got.PoolReady)
+
+	// A standby pod that fails to start does not fail the environment
+	prewarmed := standbyPods(env.Namespace)
+	require.NoError(t, mockK8s.DeletePod(ctx, env.Namespace, prewarmed[0], true))
+	mockK8s.SetPodRunning(env.Namespace, prewarmed[1])
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+	got, err = orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPending, got.Status)
+	assert.True(t, *got.PoolReady)
+
+	// Once the environment runs, replenishment replaces the failed pod
+	mockK8s.SetHoldPodRunning(false)
+	mockK8s.SetPodRunning(env.Namespace, "main")
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 2 }, 5*time.Second, 20*time.Millisecond)
+
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 50)
+	require.NoError(t, err)
+	var readyEvents int
+	for _, e := range events {
+		if e.EventType == "pool_ready" {
+			readyEvents++
+		}
+	}
+	assert.Equal(t, 1, readyEvents)
+
+	// Prewarmed pods of an environment that fails to provision are deleted
+	mockK8s.SetHoldPodRunning(true)
+	failing := create("prewarm-failing-env")
+	require.Eventually(t, func() bool { return len(standbyPods(failing.Namespace)) == 2 }, 5*time.Second, 20*time.Millisecond)
+	for _, name := range standbyPods(failing.Namespace) {
+		mockK8s.SetPodRunning(failing.Namespace, name)
+	}
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[failing.ID] == 2 }, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, mockK8s.DeletePod(ctx, failing.Namespace, "main", true))
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, failing.ID)
+		return err == nil && got.Status == models.StatusFailed
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 0, orch.GetPoolStatus()[failing.ID])
+	for _, name := range standbyPods(failing.Namespace) {
+		_, err := mockK8s.GetPod(ctx, failing.Namespace, name)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,130 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/proxy"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// echoOver writes msg to conn and reads back as many bytes
+func echoOver(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	return string(buf)
+}
+
+func TestPortForwardAPI(t *testing.T) {
+	ctx := context.Background()
+	var forwarder *proxy.PortForwarder
+	a := setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		forwarder = proxy.NewPortForwarder(a.log, nil, config.PortForwardConfig{
+			AllowedPorts:       []string{"8000-8999"},
+			IdleTimeoutSeconds: 60,
+			MaxPerEnvironment:  1,
+		})
+		rc.PortForwarder = forwarder
+	}))
+	orch, mockK8s, router := a.orch, a.mockK8s, a.router
+	userService, permissionService := a.users, a.permissions
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	editor := createUserForTest(t, userService, "pf-editor", "password123", users.RoleUser)
+	viewer := createUserForTest(t, userService, "pf-viewer", "password123", users.RoleUser)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "pf-env"})
+	_, err := permissionService.GrantPermission(ctx, editor.ID, env.ID, permissions.PermissionEditor, "")
+	require.NoError(t, err)
+	_, err = permissionService.GrantPermission(ctx, viewer.ID, env.ID, permissions.PermissionViewer, "")
+	require.NoError(t, err)
+	editorDialer := &proxy.PortForwardDialer{BaseURL: server.URL, Token: getTokenForUser(t, router, "pf-editor", "password123")}
+	viewerDialer := &proxy.PortForwardDialer{BaseURL: server.URL, Token: getTokenForUser(t, router, "pf-viewer", "password123")}
+
+	t.Run("viewers cannot forward", func(t *testing.T) {
+		_, err := viewerDialer.Dial(ctx, env.ID, 8888)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "403")
+	})
+
+	t.Run("ports outside the allowed ranges are refused", func(t *testing.T) {
+		_, err := editorDialer.Dial(ctx, env.ID, 22)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "port 22 may not be forwarded (allowed ports: 8000-8999)")
+	})
+
+	t.Run("bytes reach the pod port and come back", func(t *testing.T) {
+		conn, err := editorDialer.Dial(ctx, env.ID, 8888)
+		require.NoError(t, err)
+		assert.Equal(t, "hello jupyter", echoOver(t, conn, "hello jupyter"))
+
+		// One forward per environment at a time
+		_, err = editorDialer.Dial(ctx, env.ID, 8888)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "429")
+
+		require.NoError(t, conn.Close())
+		require.Eventually(t, func() bool { return forwarder.Active(env.ID) == 0 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("listener forwards local connections", func(t *testing.T) {
+		l, err := editorDialer.Listen(ctx, "127.0.0.1:0", env.ID, 8080)
+		require.NoError(t, err)
+		defer l.Close()
+
+		local, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer local.Close()
+		assert.Equal(t, "ping", echoOver(t, local, "ping"))
+	})
+
+	t.Run("pod errors close the connection with their reason", func(t *testing.T) {
+		require.Eventually(t, func() bool { return forwarder.Active(env.ID) == 0 }, 5*time.Second, 10*time.Millisecond)
+		var forwarded int
+		mockK8s.SetPortForwardHandler(func(ctx context.Context, port int, conn io.ReadWriter) error {
+			forwarded = port
+			return errors.New("connection refused")
+		})
+		defer mockK8s.SetPortForwardHandler(nil)
+
+		conn, err := editorDialer.Dial(ctx, env.ID, 8501)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+		assert.Equal(t, 8501, forwarded)
+	})
+
+	t.Run("idle connections are closed", func(t *testing.T) {
+		require.Eventually(t, func() bool { return forwarder.Active(env.ID) == 0 }, 5*time.Second, 10*time.Millisecond)
+		forwarder.UpdateConfig(config.PortForwardConfig{AllowedPorts: []string{"8888"}, IdleTimeoutSeconds: 1, MaxPerEnvironment: 1})
+
+		conn, err := editorDialer.Dial(ctx, env.ID, 8888)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "idle timeout")
+		require.Eventually(t, func() bool { return forwarder.Active(env.ID) == 0 }, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,225 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/preferences"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// failureWebhook records the failure notices POSTed to it
+type failureWebhook struct {
+	server  *httptest.Server
+	mu      sync.Mutex
+	notices []orchestrator.FailureNotice
+}
+
+func newFailureWebhook(t *testing.T) *failureWebhook {
+	hook := &failureWebhook{}
+	hook.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notice orchestrator.FailureNotice
+		if err := json.NewDecoder(r.Body).Decode(&notice); err == nil {
+			hook.mu.Lock()
+			hook.notices = append(hook.notices, notice)
+			hook.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(hook.server.Close)
+	return hook
+}
+
+func (h *failureWebhook) received() []orchestrator.FailureNotice {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]orchestrator.FailureNotice(nil), h.notices...)
+}
+
+type preferencesTest struct {
+	*apiTest
+	preferences *preferences.Service
+	hook        *failureWebhook
+}
+
+func setupPreferencesTest(t *testing.T) *preferencesTest {
+	hook := newFailureWebhook(t)
+	cfg := testOrchestratorConfig()
+	cfg.Resources.Profiles = map[string]config.ResourceProfileConfig{
+		"small": {CPU: "250m", Memory: "256Mi", Storage: "1Gi"},
+		"large": {CPU: "2000m", Memory: "4Gi", Storage: "20Gi"},
+	}
+	cfg.Preferences = config.PreferencesConfig{NotifyOnEnvironmentFailed: true, Timezone: "UTC"}
+	cfg.Notifications.WebhookURL = hook.server.URL
+
+	var preferenceService *preferences.Service
+	a := setupAPIRouterTest(t, withAPIConfig(cfg), withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		preferenceService = preferences.NewService(a.db, cfg, zap.NewNop())
+		a.orch.SetPreferences(preferenceService)
+		a.handler.SetPreferencesService(preferenceService)
+		rc.AuthHandler.SetPreferencesService(preferenceService)
+		rc.PreferencesHandler = api.NewPreferencesHandler(preferenceService, a.log)
+	}))
+	return &preferencesTest{apiTest: a, preferences: preferenceService, hook: hook}
+}
+
+func decodePreferences(t *testing.T, rr *httptest.ResponseRecorder) models.PreferencesResponse {
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp models.PreferencesResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestUserPreferencesAPI(t *testing.T) {
+	a := setupPreferencesTest(t)
+	createUserForTest(t, a.users, "alice", "password123", users.RoleUser)
+	createUserForTest(t, a.users, "root", "password123", users.RoleSuperAdmin)
+	aliceJWT := getTokenForUser(t, a.router, "alice", "password123")
+	rootJWT := getTokenForUser(t, a.router, "root", "password123")
+
+	// Nothing set: the configured defaults apply
+	resp := decodePreferences(t, a.do(t, http.MethodGet, "/api/v1/users/me/preferences", aliceJWT, nil))
+	assert.Nil(t, resp.Preferences.Timezone)
+	assert.Nil(t, resp.Preferences.UpdatedAt)
+	assert.Equal(t, models.EffectivePreferences{NotifyOnEnvironmentFailed: true, Timezone: "UTC"}, resp.Effective)
+
+	// Invalid values are reported per field
+	rr := a.do(t, http.MethodPut, "/api/v1/users/me/preferences", aliceJWT, map[string]interface{}{
+		"default_profile": "huge",
+		"timezone":        "Mars/Olympus_Mons",
+	})
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+	var errResp models.ErrorResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &errResp))
+	fields := []string{}
+	for _, d := range errResp.Details {
+		fields = append(fields, d.Field)
+	}
+	assert.Equal(t, []string{"default_profile", "timezone"}, fields)
+	rr = a.do(t, http.MethodPut, "/api/v1/users/me/preferences", aliceJWT, map[string]interface{}{"notify_on_everything": true})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Organization defaults are admin-managed and apply to unset preferences
+	orgDefaults := map[string]interface{}{"default_profile": "small", "notify_on_execution_failed": true}
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPut, "/api/v1/admin/preferences", aliceJWT, orgDefaults).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/admin/preferences", aliceJWT, nil).Code)
+	resp = decodePreferences(t, a.do(t, http.MethodPut, "/api/v1/admin/preferences", rootJWT, orgDefaults))
+	assert.Equal(t, models.EffectivePreferences{
+		DefaultProfile: "small", NotifyOnEnvironmentFailed: true, NotifyOnExecutionFailed: true, Timezone: "UTC",
+	}, resp.Effective)
+
+	// The user's own preferences win over the organization defaults
+	resp = decodePreferences(t, a.do(t, http.MethodPut, "/api/v1/users/me/preferences", aliceJWT, map[string]interface{}{
+		"timezone":                   "Europe/Berlin",
+		"notify_on_execution_failed": false,
+	}))
+	require.NotNil(t, resp.Preferences.Timezone)
+	assert.Nil(t, resp.Preferences.DefaultProfile)
+	assert.NotNil(t, resp.Preferences.UpdatedAt)
+	assert.Equal(t, models.EffectivePreferences{
+		DefaultProfile: "small", NotifyOnEnvironmentFailed: true, NotifyOnExecutionFailed: false, Timezone: "Europe/Berlin",
+	}, resp.Effective)
+
+	// /auth/me carries the preferences
+	rr = a.do(t, http.MethodGet, "/api/v1/auth/me", aliceJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var me struct {
+		Username    string                      `json:"username"`
+		Preferences *models.PreferencesResponse `json:"preferences"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &me))
+	assert.Equal(t, "alice", me.Username)
+	require.NotNil(t, me.Preferences)
+	assert.Equal(t, "Europe/Berlin", me.Preferences.Effective.Timezone)
+
+	// Environments created without resources get the default profile's
+	rr = a.do(t, http.MethodPost, "/api/v1/environments", aliceJWT, map[string]interface{}{
+		"name":  "profiled-env",
+		"image": "python:3.11-slim",
+	})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var env models.Environment
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &env))
+	assert.Equal(t, models.ResourceSpec{CPU: "250m", Memory: "256Mi", Storage: "1Gi"}, env.Resources)
+}
+
+func TestFailureNotificationsFollowPreferences(t *testing.T) {
+	a := setupPreferencesTest(t)
+	ctx := context.Background()
+	alice := createUserForTest(t, a.users, "alice", "password123", users.RoleUser)
+	bob := createUserForTest(t, a.users, "bob", "password123", users.RoleUser)
+	off, on := false, true
+	tokyo := "Asia/Tokyo"
+	_, err := a.preferences.Set(ctx, alice.ID, &models.UserPreferences{NotifyOnEnvironmentFailed: &off})
+	require.NoError(t, err)
+	_, err = a.preferences.Set(ctx, bob.ID, &models.UserPreferences{NotifyOnExecutionFailed: &on, Timezone: &tokyo})
+	require.NoError(t, err)
+
+	failEnvironment := func(name, userID string) {
+		a.mockK8s.FailNext("CreateNamespace", 1, apierrors.New(apierrors.Unavailable, "", "api server unavailable"))
+		env, err := a.orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+			Name: name, Image: "python:3.11-slim", Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		}, userID)
+		require.NoError(t, err)
+		got, settled, err := a.orch.WaitForEnvironment(ctx, env.ID, 5*time.Second)
+		require.NoError(t, err)
+		require.True(t, settled)
+		require.Equal(t, models.StatusFailed, got.Status)
+	}
+
+	// Alice opted out of environment failures; bob gets them from the configured default
+	failEnvironment("alice-broken", alice.ID)
+	assert.Never(t, func() bool { return len(a.hook.received()) > 0 }, 200*time.Millisecond, 20*time.Millisecond)
+	failEnvironment("bob-broken", bob.ID)
+	require.Eventually(t, func() bool { return len(a.hook.received()) == 1 }, 5*time.Second, 20*time.Millisecond)
+	notice := a.hook.received()[0]
+	assert.Equal(t, orchestrator.EnvironmentFailedEvent, notice.Event)
+	assert.Equal(t, bob.ID, notice.UserID)
+	assert.Equal(t, "bob-broken", notice.Name)
+
+	// Execution failures (here non-zero exits) are off by default; bob opted in, in his time zone
+	a.mockK8s.SetCompletionHandler(func(*k8s.PodSpec) int { return 3 })
+	runFailing := func(name, userID string) {
+		env, err := a.orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+			Name: name, Image: "python:3.11-slim", Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		}, userID)
+		require.NoError(t, err)
+		_, settled, err := a.orch.WaitForEnvironment(ctx, env.ID, 5*time.Second)
+		require.NoError(t, err)
+		require.True(t, settled)
+		exec, err := a.orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{EnvironmentID: env.ID, Command: []string{"false"}}, userID)
+		require.NoError(t, err)
+		done := waitForExecutionDone(t, a.orch, exec.ID)
+		require.NotNil(t, done.ExitCode)
+		require.Equal(t, 3, *done.ExitCode)
+	}
+	runFailing("alice-runs", alice.ID)
+	assert.Never(t, func() bool { return len(a.hook.received()) > 1 }, 200*time.Millisecond, 20*time.Millisecond)
+	runFailing("bob-runs", bob.ID)
+	require.Eventually(t, func() bool { return len(a.hook.received()) == 2 }, 5*time.Second, 20*time.Millisecond)
+	notice = a.hook.received()[1]
+	assert.Equal(t, orchestrator.ExecutionFailedEvent, notice.Event)
+	assert.Equal(t, bob.ID, notice.UserID)
+	assert.Equal(t, "bob-runs", notice.Name)
+	assert.NotEmpty(t, notice.ExecutionID)
+	require.NotNil(t, notice.ExitCode)
+	assert.Equal(t, 3, *notice.ExitCode)
+	assert.Equal(t, "Asia/Tokyo", notice.Timezone)
+	_, offset := notice.OccurredAt.Zone()
+	assert.Equal(t, 9*60*60, offset)
+}
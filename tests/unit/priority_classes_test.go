@@ -0,0 +1,170 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// priorityClassConfig allows two priority classes and sets the default of each kind of pod
+func priorityClassConfig() *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Kubernetes.PriorityClasses = config.PriorityClassesConfig{
+		Allowed:   []string{"agentbox-critical", "agentbox-preemptible"},
+		Main:      "agentbox-default",
+		Standby:   "agentbox-standby",
+		Ephemeral: "agentbox-batch",
+	}
+	return cfg
+}
+
+func waitForPodSpec(t *testing.T, mockK8s *mocks.MockK8sClient, namespace, name string) *k8s.PodSpec {
+	t.Helper()
+	var spec *k8s.PodSpec
+	require.Eventually(t, func() bool {
+		spec = mockK8s.CreatedPodSpec(namespace, name)
+		return spec != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	return spec
+}
+
+func TestPriorityClassDefaultsPerPodType(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, priorityClassConfig(), nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "defaults",
+		Pool: &models.PoolConfig{Enabled: true, Size: 1},
+	})
+	assert.Equal(t, "agentbox-default", waitForPodSpec(t, mockK8s, env.Namespace, "main").PriorityClassName)
+	require.Eventually(t, func() bool { return orch.GetPoolStatus()[env.ID] == 1 }, 5*time.Second, 20*time.Millisecond)
+	for _, name := range mockK8s.CreatedPodNames(env.Namespace) {
+		if name != "main" {
+			assert.Equal(t, "agentbox-standby", mockK8s.CreatedPodSpec(env.Namespace, name).PriorityClassName)
+		}
+	}
+
+	// Executions with overrides run in an ephemeral pod, with their own class or the default
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "agentbox-batch", waitForPodSpec(t, mockK8s, env.Namespace, exec.ID).PriorityClassName)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	exec, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Isolation:     &models.IsolationConfig{PriorityClassName: "agentbox-preemptible"},
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "agentbox-preemptible", waitForPodSpec(t, mockK8s, env.Namespace, exec.ID).PriorityClassName)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	_, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Isolation:     &models.IsolationConfig{PriorityClassName: "system-cluster-critical"},
+	}, "user-123")
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	assert.Equal(t, apierrors.CodePriorityClassNotAllowed, apierrors.CodeOf(err))
+}
+
+func TestPriorityClassOfEnvironment(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, priorityClassConfig(), nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:      "critical",
+		Isolation: &models.IsolationConfig{PriorityClassName: "agentbox-critical"},
+	})
+	assert.Equal(t, "agentbox-critical", waitForPodSpec(t, mockK8s, env.Namespace, "main").PriorityClassName)
+
+	// Executions in their own pod inherit the environment's class
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "agentbox-critical", waitForPodSpec(t, mockK8s, env.Namespace, exec.ID).PriorityClassName)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	_, err = orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "not-allowed",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Isolation: &models.IsolationConfig{PriorityClassName: "system-node-critical"},
+	}, "user-123")
+	assert.Equal(t, apierrors.CodePriorityClassNotAllowed, apierrors.CodeOf(err))
+
+	_, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{
+		Isolation: &models.IsolationConfig{PriorityClassName: "system-node-critical"},
+	})
+	assert.Equal(t, apierrors.CodePriorityClassNotAllowed, apierrors.CodeOf(err))
+}
+
+func TestEvictedMainPodIsRecreated(t *testing.T) {
+	db := setupTestDB(t)
+	clock := mocks.NewFakeClock(time.Now())
+	orch, mockK8s := setupConfiguredOrchestrator(t, priorityClassConfig(), db, orchestrator.WithClock(clock))
+	ctx := context.Background()
+	// Pool, reconciliation, retention, idle reaper, snapshot scheduler, reservation loop and cache sync
+	clock.BlockUntil(7)
+
+	// The main pod of a Running environment is replaced
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "evicted"})
+	mockK8s.SetPodEvicted(env.Namespace, "main", "The node was low on resource: memory.")
+	require.Eventually(t, func() bool {
+		clock.Advance(10 * time.Second)
+		pod, err := mockK8s.GetPod(ctx, env.Namespace, "main")
+		return err == nil && pod.Status.Phase == corev1.PodRunning
+	}, 10*time.Second, 50*time.Millisecond)
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusRunning, got.Status)
+	assert.Equal(t, "agentbox-default", mockK8s.CreatedPodSpec(env.Namespace, "main").PriorityClassName)
+	assert.Equal(t, []string{"The node was low on resource: memory."}, evictionEvents(t, db, env.ID))
+
+	// An environment marked Failed by a read of its evicted pod is reprovisioned; the eviction is
+	// recorded all the same
+	failed := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "evicted-failed"})
+	mockK8s.SetPodEvicted(failed.Namespace, "main", "The node was low on resource: ephemeral-storage.")
+	got, err = orch.GetEnvironment(ctx, failed.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.StatusFailed, got.Status)
+	require.Eventually(t, func() bool {
+		clock.Advance(10 * time.Second)
+		return len(evictionEvents(t, db, failed.ID)) > 0
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []string{"The node was low on resource: ephemeral-storage."}, evictionEvents(t, db, failed.ID))
+}
+
+// evictionEvents returns the details of the environment's pod_evicted events
+func evictionEvents(t *testing.T, db *database.DB, envID string) []string {
+	t.Helper()
+	events, err := db.ListEnvironmentEvents(context.Background(), envID, 100)
+	require.NoError(t, err)
+	var details []string
+	for _, event := range events {
+		if event.EventType == "pod_evicted" {
+			assert.Equal(t, "Main pod was evicted (Evicted); recreating", event.Message)
+			details = append(details, event.Details)
+		}
+	}
+	return details
+}
@@ -0,0 +1,112 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func TestExecutionQueueStatus(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "queue-env"})
+
+	submit := func() *models.Execution {
+		exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+			EnvironmentID: env.ID, Command: []string{"ls"},
+		}, "user-123")
+		require.NoError(t, err)
+		return exec
+	}
+
+	// A few quick executions give the queue a recent hold time; a free slot means no estimate
+	for i := 0; i < 3; i++ {
+		exec := submit()
+		assert.Nil(t, exec.EstimatedStart)
+		waitForExecutionDone(t, orch, exec.ID)
+	}
+
+	// Fill every slot and queue two more behind them
+	release := make(chan struct{})
+	mockK8s.SetCompletionHandler(func(*k8s.PodSpec) int {
+		<-release
+		return 0
+	})
+	var execs []*models.Execution
+	for i := 0; i < orchestrator.MaxConcurrentExecutions+2; i++ {
+		execs = append(execs, submit())
+	}
+	require.Eventually(t, func() bool {
+		q := orch.QueueStatus().Executions
+		return q.InFlight == orchestrator.MaxConcurrentExecutions && q.Waiting == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	q := orch.QueueStatus().Executions
+	assert.Equal(t, orchestrator.QueueExecutions, q.Name)
+	assert.Equal(t, orchestrator.MaxConcurrentExecutions, q.Capacity)
+	assert.Greater(t, q.AvgHoldSeconds, 0.0)
+	assert.GreaterOrEqual(t, q.Acquired, 3+orchestrator.MaxConcurrentExecutions)
+	require.Contains(t, q.ByEnvironment, env.ID)
+	assert.Equal(t, orchestrator.MaxConcurrentExecutions, q.ByEnvironment[env.ID].InFlight)
+	assert.Equal(t, 2, q.ByEnvironment[env.ID].Waiting)
+	assert.Equal(t, 0, orch.QueueStatus().Provisioning.InFlight)
+
+	// A submission behind a full queue is told when it is expected to start
+	submittedAt := time.Now()
+	late := submit()
+	require.NotNil(t, late.EstimatedStart)
+	assert.False(t, late.EstimatedStart.Before(submittedAt))
+
+	close(release)
+	for _, exec := range append(execs, late) {
+		done := waitForExecutionDone(t, orch, exec.ID)
+		assert.Equal(t, models.ExecutionStatusCompleted, done.Status, done.Error)
+	}
+	require.Eventually(t, func() bool {
+		q := orch.QueueStatus().Executions
+		return q.InFlight == 0 && q.Waiting == 0 && len(q.ByEnvironment) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Greater(t, orch.QueueStatus().Executions.AvgWaitSeconds, 0.0)
+}
+
+func TestQueueEndpoints(t *testing.T) {
+	a := setupEnvTokenAPITest(t)
+	createUserForTest(t, a.users, "queue-admin", "password123", users.RoleAdmin)
+	createUserForTest(t, a.users, "queue-user", "password123", users.RoleUser)
+	adminJWT := getTokenForUser(t, a.router, "queue-admin", "password123")
+	userJWT := getTokenForUser(t, a.router, "queue-user", "password123")
+
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/admin/queues", userJWT, nil).Code)
+	rr := a.do(t, http.MethodGet, "/api/v1/admin/queues", adminJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"provisioning"`)
+	assert.Contains(t, rr.Body.String(), `"executions"`)
+
+	// The Prometheus endpoint needs no credentials
+	rr = httptest.NewRecorder()
+	a.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "# TYPE agentbox_queue_waiting gauge")
+	assert.Contains(t, rr.Body.String(), `agentbox_queue_capacity{queue="executions"} 20`)
+	assert.Contains(t, rr.Body.String(), `agentbox_queue_in_flight{queue="provisioning"} 0`)
+	assert.NotContains(t, rr.Body.String(), "agentbox_config_reloads_total", "no config store, no reload counters")
+
+	// The config reload counters are exported once the handler has the config store
+	a.handler.SetConfigStore(config.NewStore("", testOrchestratorConfig()))
+	rr = httptest.NewRecorder()
+	a.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), "# TYPE agentbox_config_reloads_total counter")
+	assert.Contains(t, rr.Body.String(), `agentbox_config_reloads_total{result="failure"} 0`)
+}
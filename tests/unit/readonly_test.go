@@ -0,0 +1,199 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/auth"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func setupReadOnlyTest(t *testing.T) *apiTest {
+	return setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		a.handler.SetBadgeSigner(a.auth)
+	}))
+}
+
+func TestReadOnlyAPIKey(t *testing.T) {
+	a := setupReadOnlyTest(t)
+	ctx := context.Background()
+
+	owner := createUserForTest(t, a.users, "ro-owner", "password123", users.RoleUser)
+	ownerJWT := getTokenForUser(t, a.router, "ro-owner", "password123")
+	env := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "ro-env"})
+	_, err := a.permissions.GrantPermission(ctx, owner.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+
+	rr := a.do(t, http.MethodPost, "/api/v1/api-keys", ownerJWT, map[string]interface{}{"description": "portal", "read_only": true})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var key auth.APIKeyResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&key))
+	assert.True(t, key.ReadOnly)
+
+	// Reads work, and the key says it is read-only
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID, key.Key, nil).Code)
+	rr = a.do(t, http.MethodGet, "/api/v1/auth/me", key.Key, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var me struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&me))
+	assert.True(t, me.ReadOnly)
+
+	// Changes are refused though the owner could make them
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/environments/" + env.ID + "/run"},
+		{http.MethodPatch, "/api/v1/environments/" + env.ID},
+		{http.MethodDelete, "/api/v1/environments/" + env.ID},
+		{http.MethodPost, "/api/v1/api-keys"},
+		{http.MethodPost, "/api/v1/auth/change-password"},
+	} {
+		rr = a.do(t, req.method, req.path, key.Key, map[string]interface{}{})
+		assert.Equal(t, http.StatusForbidden, rr.Code, req.path)
+		assert.Equal(t, apierrors.CodeReadOnlyAPIKey, errorCode(t, rr.Body.Bytes()), req.path)
+	}
+	_, err = a.orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+
+	// The X-API-Key header is held to the same rule, and WebSocket upgrades are not reads
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/environments/"+env.ID, nil)
+	req.Header.Set("X-API-Key", key.Key)
+	rr = httptest.NewRecorder()
+	a.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID, nil)
+	req.Header.Set("X-API-Key", key.Key)
+	req.Header.Set("Upgrade", "websocket")
+	rr = httptest.NewRecorder()
+	a.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Rotation keeps the key read-only
+	rr = a.do(t, http.MethodPost, "/api/v1/api-keys/"+key.ID+"/rotate", ownerJWT, nil)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var rotated auth.APIKeyResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&rotated))
+	assert.True(t, rotated.ReadOnly)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/environments/"+env.ID+"/run", rotated.Key, map[string]interface{}{}).Code)
+}
+
+func TestEnvironmentBadge(t *testing.T) {
+	a := setupReadOnlyTest(t)
+	ctx := context.Background()
+
+	owner := createUserForTest(t, a.users, "badge-owner", "password123", users.RoleUser)
+	viewer := createUserForTest(t, a.users, "badge-viewer", "password123", users.RoleUser)
+	ownerJWT := getTokenForUser(t, a.router, "badge-owner", "password123")
+	viewerJWT := getTokenForUser(t, a.router, "badge-viewer", "password123")
+	env := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "badge-env"})
+	_, err := a.permissions.GrantPermission(ctx, owner.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+	_, err = a.permissions.GrantPermission(ctx, viewer.ID, env.ID, permissions.PermissionViewer, "")
+	require.NoError(t, err)
+
+	badgeURL := func(method, path string) *api.BadgeURLResponse {
+		rr := a.do(t, method, "/api/v1/environments/"+env.ID+path, ownerJWT, nil)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp api.BadgeURLResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		return &resp
+	}
+	// fetch requests a badge URL without credentials
+	fetch := func(rawURL string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		rr := httptest.NewRecorder()
+		a.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID+"/badge/url", viewerJWT, nil).Code)
+	urls := badgeURL(http.MethodGet, "/badge/url")
+	assert.Equal(t, urls.BadgeURL, badgeURL(http.MethodGet, "/badge/url").BadgeURL)
+
+	rr := fetch(urls.BadgeURL)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var badge api.EnvironmentBadge
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&badge))
+	assert.Equal(t, env.ID, badge.EnvironmentID)
+	assert.Equal(t, "badge-env", badge.Name)
+	assert.Equal(t, models.StatusRunning, badge.Status)
+
+	rr = fetch(urls.SVGURL)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "image/svg+xml", rr.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(rr.Body.String(), "<svg"))
+	assert.Contains(t, rr.Body.String(), "running")
+
+	// Without a valid signature there is no badge
+	assert.Equal(t, http.StatusForbidden, fetch("/api/v1/environments/"+env.ID+"/badge").Code)
+	assert.Equal(t, http.StatusForbidden, fetch("/api/v1/environments/"+env.ID+"/badge?sig=deadbeef").Code)
+
+	// Rotating the secret revokes the URLs handed out before
+	rotated := badgeURL(http.MethodPost, "/badge/rotate")
+	assert.NotEqual(t, urls.BadgeURL, rotated.BadgeURL)
+	rr = fetch(urls.BadgeURL)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, apierrors.CodeBadgeSignatureInvalid, errorCode(t, rr.Body.Bytes()))
+	assert.Equal(t, http.StatusOK, fetch(rotated.BadgeURL).Code)
+}
+
+func TestEnvironmentBadgeNonASCIIName(t *testing.T) {
+	a := setupReadOnlyTest(t)
+	ctx := context.Background()
+
+	owner := createUserForTest(t, a.users, "badge-utf8-owner", "password123", users.RoleUser)
+	ownerJWT := getTokenForUser(t, a.router, "badge-utf8-owner", "password123")
+	name := strings.Repeat("é", 45)
+	env := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: name})
+	_, err := a.permissions.GrantPermission(ctx, owner.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+
+	rr := a.do(t, http.MethodGet, "/api/v1/environments/"+env.ID+"/badge/url", ownerJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var urls api.BadgeURLResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&urls))
+
+	req := httptest.NewRequest(http.MethodGet, urls.SVGURL, nil)
+	rr = httptest.NewRecorder()
+	a.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	svg := rr.Body.String()
+	// The name is cut to 40 characters, not bytes, and sized by characters
+	assert.True(t, utf8.ValidString(svg))
+	assert.Contains(t, svg, ">"+strings.Repeat("é", 40)+"<")
+	assert.NotContains(t, svg, strings.Repeat("é", 41))
+	assert.Contains(t, svg, `<rect width="290" height="20" fill="#555"/>`)
+}
+
+func TestEnvironmentBadgeSecretDeletedWithEnvironment(t *testing.T) {
+	db := setupTestDB(t)
+	authService := auth.NewService(db, users.NewService(db, zap.NewNop()), zap.NewNop())
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "badge-deleted-env"})
+	signature, err := authService.BadgeSignature(ctx, env.ID)
+	require.NoError(t, err)
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, true))
+	var secrets int
+	require.NoError(t, db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM environment_badge_secrets WHERE environment_id = $1", env.ID).Scan(&secrets))
+	assert.Zero(t, secrets)
+	valid, err := authService.VerifyBadgeSignature(ctx, env.ID, signature)
+	require.NoError(t, err)
+	assert.False(t, valid)
+}
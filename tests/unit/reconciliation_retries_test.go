@@ -0,0 +1,80 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+)
+
+// failedRetryEnvironment creates an environment whose provisioning fails, then has one manual
+// retry fail as well, and returns the environment once that retry is recorded
+func failedRetryEnvironment(t *testing.T, maxRetries int) (*orchestrator.Orchestrator, *models.Environment, []*models.EnvironmentEvent) {
+	db := setupTestDB(t)
+	cfg := testOrchestratorConfig()
+	cfg.Reconciliation.MaxRetries = maxRetries
+	orch, mockK8s := setupConfiguredOrchestrator(t, cfg, db)
+	ctx := context.Background()
+
+	unavailable := apierrors.New(apierrors.Unavailable, "", "api server unavailable")
+	mockK8s.FailNext("CreateNamespace", 2, unavailable)
+	env, err := orch.CreateEnvironment(ctx, waitEnvRequest, "user-123")
+	require.NoError(t, err)
+	_, settled, err := orch.WaitForEnvironment(ctx, env.ID, 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, settled)
+
+	require.NoError(t, orch.RetryReconciliation(ctx, env.ID))
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.ReconciliationRetryCount == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	got, err := orch.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 100)
+	require.NoError(t, err)
+	return orch, got, events
+}
+
+func hasEvent(events []*models.EnvironmentEvent, eventType string) bool {
+	for _, e := range events {
+		if e.EventType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReconciliationRetriesLeft(t *testing.T) {
+	t.Run("unset uses the default", func(t *testing.T) {
+		_, env, events := failedRetryEnvironment(t, 0)
+		assert.Equal(t, config.DefaultReconciliationMaxRetries-1, env.ReconciliationRetriesLeft)
+		assert.False(t, hasEvent(events, "reconciliation_max_retries"))
+	})
+
+	t.Run("negative is unlimited", func(t *testing.T) {
+		orch, env, events := failedRetryEnvironment(t, -1)
+		assert.Equal(t, -1, env.ReconciliationRetriesLeft)
+		assert.False(t, hasEvent(events, "reconciliation_max_retries"))
+
+		list, err := orch.ListEnvironments(context.Background(), nil, "", 10, 0)
+		require.NoError(t, err)
+		require.Len(t, list.Environments, 1)
+		assert.Equal(t, -1, list.Environments[0].ReconciliationRetriesLeft)
+	})
+
+	t.Run("exhausted retries fail the environment", func(t *testing.T) {
+		_, env, events := failedRetryEnvironment(t, 1)
+		assert.Equal(t, 0, env.ReconciliationRetriesLeft)
+		assert.Equal(t, models.StatusFailed, env.Status)
+		assert.True(t, hasEvent(events, "reconciliation_max_retries"))
+	})
+}
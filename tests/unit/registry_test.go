@@ -0,0 +1,330 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/registry"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+const (
+	fakeConfigDigest   = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	fakeAMD64Digest    = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	fakeARM64Digest    = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	fakeIndexDigest    = "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+	fakeAttestDigest   = "sha256:5555555555555555555555555555555555555555555555555555555555555555"
+	fakeRegistryToken  = "pull-token"
+	fakeRegistryUser   = "bot"
+	fakeRegistrySecret = "s3cret"
+)
+
+// fakeRegistry serves a token endpoint and the manifests and config blob of team/app (a
+// two-platform image with an attestation), team/single (a single-platform image) and
+// team/limited (always rate limited). With requireCredentials, tokens are only issued for the
+// bot user.
+type fakeRegistry struct {
+	server             *httptest.Server
+	requireCredentials atomic.Bool
+	manifestRequests   atomic.Int32
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	f := &fakeRegistry{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if f.requireCredentials.Load() && (!ok || user != fakeRegistryUser || pass != fakeRegistrySecret) {
+			http.Error(w, `{"errors":[{"code":"UNAUTHORIZED"}]}`, http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": fakeRegistryToken})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeRegistryToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry",scope="repository:team/app:pull"`, f.server.URL))
+			http.Error(w, `{"errors":[{"code":"UNAUTHORIZED"}]}`, http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		if strings.Contains(path, "/manifests/") {
+			f.manifestRequests.Add(1)
+		}
+		switch path {
+		case "team/app/manifests/1.0":
+			w.Header().Set("Content-Type", registry.MediaTypeOCIIndex)
+			w.Header().Set("Docker-Content-Digest", fakeIndexDigest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     registry.MediaTypeOCIIndex,
+				"manifests": []map[string]interface{}{
+					{"mediaType": registry.MediaTypeOCIManifest, "digest": fakeARM64Digest, "size": 500,
+						"platform": map[string]string{"os": "linux", "architecture": "arm64", "variant": "v8"}},
+					{"mediaType": registry.MediaTypeOCIManifest, "digest": fakeAMD64Digest, "size": 600,
+						"platform": map[string]string{"os": "linux", "architecture": "amd64"}},
+					{"mediaType": registry.MediaTypeOCIManifest, "digest": fakeAttestDigest, "size": 700,
+						"platform": map[string]string{"os": "unknown", "architecture": "unknown"}},
+				},
+			})
+		case "team/app/manifests/" + fakeAMD64Digest, "team/single/manifests/latest":
+			w.Header().Set("Content-Type", registry.MediaTypeDockerManifest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     registry.MediaTypeDockerManifest,
+				"config":        map[string]interface{}{"digest": fakeConfigDigest, "size": 100},
+				"layers": []map[string]interface{}{
+					{"digest": "sha256:aa", "size": 1000},
+					{"digest": "sha256:bb", "size": 2000},
+				},
+			})
+		case "team/app/blobs/" + fakeConfigDigest, "team/single/blobs/" + fakeConfigDigest:
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"created":      "2026-01-02T03:04:05Z",
+				"os":           "linux",
+				"architecture": "amd64",
+				"config": map[string]interface{}{
+					"Entrypoint": []string{"/docker-entrypoint.sh"},
+					"Cmd":        []string{"python3"},
+				},
+			})
+		case "team/limited/manifests/latest":
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, `{"errors":[{"code":"TOOMANYREQUESTS"}]}`, http.StatusTooManyRequests)
+		default:
+			http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+		}
+	})
+	f.server = httptest.NewTLSServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// host is the registry host image references use
+func (f *fakeRegistry) host() string {
+	return strings.TrimPrefix(f.server.URL, "https://")
+}
+
+// client returns a registry client for the fake registry with the given config
+func (f *fakeRegistry) client(cfg config.ImagesConfig) *registry.Client {
+	c := registry.NewClient(cfg, zap.NewNop())
+	c.SetHTTPClient(f.server.Client())
+	return c
+}
+
+func mustParseReference(t *testing.T, image string) registry.Reference {
+	ref, err := registry.ParseReference(image)
+	require.NoError(t, err)
+	return ref
+}
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"python", "docker.io/library/python:latest"},
+		{"python:3.11-slim", "docker.io/library/python:3.11-slim"},
+		{"acme/tool:v1", "docker.io/acme/tool:v1"},
+		{"index.docker.io/acme/tool:v1", "docker.io/acme/tool:v1"},
+		{"ghcr.io/acme/app", "ghcr.io/acme/app:latest"},
+		{"localhost/app:dev", "localhost/app:dev"},
+		{"registry.example.com:5000/team/app@" + fakeIndexDigest, "registry.example.com:5000/team/app@" + fakeIndexDigest},
+		{"ghcr.io/acme/app:1.0@" + fakeIndexDigest, "ghcr.io/acme/app:1.0@" + fakeIndexDigest},
+	}
+	for _, tt := range tests {
+		ref, err := registry.ParseReference(tt.image)
+		require.NoError(t, err, tt.image)
+		assert.Equal(t, tt.expected, ref.String(), tt.image)
+	}
+
+	for _, image := range []string{"", "Python", "python:", "ghcr.io/acme/app@sha256:xyz", " python", "acme//tool"} {
+		_, err := registry.ParseReference(image)
+		assert.Error(t, err, image)
+	}
+}
+
+func TestImageReferenceAllowed(t *testing.T) {
+	allowed := []string{"ghcr.io/acme", "docker.io/library", "registry.example.com:5000"}
+
+	assert.True(t, mustParseReference(t, "python:3.11").Allowed(allowed))
+	assert.True(t, mustParseReference(t, "ghcr.io/acme/app:1").Allowed(allowed))
+	assert.True(t, mustParseReference(t, "registry.example.com:5000/any/thing").Allowed(allowed))
+	assert.False(t, mustParseReference(t, "ghcr.io/acme-evil/app").Allowed(allowed), "prefixes match whole path components")
+	assert.False(t, mustParseReference(t, "ghcr.io/other/app").Allowed(allowed))
+	assert.False(t, mustParseReference(t, "acme/tool").Allowed(allowed), "docker.io/acme is not under docker.io/library")
+	assert.True(t, mustParseReference(t, "acme/tool").Allowed(nil), "an empty allowlist allows everything")
+	assert.True(t, mustParseReference(t, "acme/tool").Allowed([]string{"index.docker.io"}), "Docker Hub aliases are normalized")
+}
+
+func TestRegistryInspectMultiPlatformImage(t *testing.T) {
+	f := newFakeRegistry(t)
+	client := f.client(config.ImagesConfig{InspectCacheSeconds: 300})
+
+	info, err := client.Inspect(context.Background(), mustParseReference(t, f.host()+"/team/app:1.0"))
+	require.NoError(t, err)
+	assert.Equal(t, f.host()+"/team/app:1.0", info.Image)
+	assert.Equal(t, fakeIndexDigest, info.Digest)
+	assert.Equal(t, registry.MediaTypeOCIIndex, info.MediaType)
+	require.Len(t, info.Platforms, 2, "attestation manifests are not platforms")
+	assert.Equal(t, "linux/arm64/v8", info.Platforms[0].String())
+	assert.Equal(t, fakeAMD64Digest, info.Platforms[1].Digest)
+	assert.Equal(t, "linux/amd64", info.Platform, "linux/amd64 is preferred over the first listed platform")
+	assert.Equal(t, int64(3100), info.Size, "config and layers of the described platform")
+	require.NotNil(t, info.Created)
+	assert.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), info.Created.UTC())
+	assert.Equal(t, []string{"/docker-entrypoint.sh"}, info.Entrypoint)
+	assert.Equal(t, []string{"python3"}, info.Cmd)
+	assert.Equal(t, int32(2), f.manifestRequests.Load())
+
+	// The second inspection is served from the cache
+	info.Cmd[0] = "modified"
+	cached, err := client.Inspect(context.Background(), mustParseReference(t, f.host()+"/team/app:1.0"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), f.manifestRequests.Load())
+	assert.Equal(t, []string{"python3"}, cached.Cmd, "cached results are copies")
+}
+
+func TestRegistryInspectSingleManifestWithoutCache(t *testing.T) {
+	f := newFakeRegistry(t)
+	client := f.client(config.ImagesConfig{})
+
+	info, err := client.Inspect(context.Background(), mustParseReference(t, f.host()+"/team/single"))
+	require.NoError(t, err)
+	assert.Equal(t, "latest", info.Tag)
+	assert.True(t, strings.HasPrefix(info.Digest, "sha256:"), "digest computed from the manifest body")
+	assert.Equal(t, registry.MediaTypeDockerManifest, info.MediaType)
+	require.Len(t, info.Platforms, 1)
+	assert.Equal(t, "linux/amd64", info.Platform)
+	assert.Equal(t, int64(3100), info.Size)
+
+	_, err = client.Inspect(context.Background(), mustParseReference(t, f.host()+"/team/single"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), f.manifestRequests.Load(), "inspect_cache_seconds 0 disables the cache")
+}
+
+func TestRegistryInspectErrors(t *testing.T) {
+	f := newFakeRegistry(t)
+	client := f.client(config.ImagesConfig{})
+	ctx := context.Background()
+
+	_, err := client.Inspect(ctx, mustParseReference(t, f.host()+"/team/app:missing"))
+	assert.ErrorIs(t, err, apierrors.NotFound)
+	assert.Equal(t, apierrors.CodeImageNotFound, apierrors.CodeOf(err))
+
+	_, err = client.Inspect(ctx, mustParseReference(t, f.host()+"/team/limited"))
+	assert.ErrorIs(t, err, apierrors.RateLimited)
+	assert.Equal(t, apierrors.CodeRegistryRateLimited, apierrors.CodeOf(err))
+	assert.Equal(t, 30*time.Second, registry.RetryAfter(err))
+
+	f.requireCredentials.Store(true)
+	_, err = client.Inspect(ctx, mustParseReference(t, f.host()+"/team/app:1.0"))
+	assert.ErrorIs(t, err, apierrors.BadGateway)
+	assert.Equal(t, apierrors.CodeRegistryAuthFailed, apierrors.CodeOf(err))
+	assert.Contains(t, err.Error(), "anonymous")
+
+	wrong := f.client(config.ImagesConfig{Registries: []config.RegistryCredentialConfig{
+		{Host: f.host(), Username: fakeRegistryUser, Password: "wrong"},
+	}})
+	_, err = wrong.Inspect(ctx, mustParseReference(t, f.host()+"/team/app:1.0"))
+	assert.Equal(t, apierrors.CodeRegistryAuthFailed, apierrors.CodeOf(err))
+	assert.Contains(t, err.Error(), "rejected the configured credentials")
+
+	authorized := f.client(config.ImagesConfig{Registries: []config.RegistryCredentialConfig{
+		{Host: f.host(), Username: fakeRegistryUser, Password: fakeRegistrySecret},
+	}})
+	_, err = authorized.Inspect(ctx, mustParseReference(t, f.host()+"/team/app:1.0"))
+	assert.NoError(t, err)
+
+	unreachable := registry.NewClient(config.ImagesConfig{}, zap.NewNop())
+	_, err = unreachable.Inspect(ctx, mustParseReference(t, "127.0.0.1:1/team/app"))
+	assert.ErrorIs(t, err, apierrors.BadGateway)
+	assert.Equal(t, apierrors.CodeRegistryUnavailable, apierrors.CodeOf(err))
+}
+
+func TestValidatorImageAllowlist(t *testing.T) {
+	val := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	val.SetAllowedRegistries([]string{"ghcr.io/acme"})
+
+	req := &models.CreateEnvironmentRequest{
+		Name:      "allowlist",
+		Image:     "python:3.11",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	}
+	err := val.ValidateCreateRequest(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not from an allowed registry")
+
+	req.Image = "ghcr.io/acme/python:3.11"
+	assert.NoError(t, val.ValidateCreateRequest(req))
+
+	err = val.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{Command: []string{"true"}, Image: "docker.io/evil/miner"})
+	assert.ErrorContains(t, err, "not from an allowed registry")
+	assert.ErrorContains(t, val.ValidateImage("Not A Reference"), "invalid")
+}
+
+func TestAPIInspectImage(t *testing.T) {
+	f := newFakeRegistry(t)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	val := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	val.SetAllowedRegistries([]string{f.host() + "/team"})
+	handler := api.NewHandler(nil, val, log, nil, nil)
+	handler.SetRegistryClient(f.client(config.ImagesConfig{InspectCacheSeconds: 300}))
+	router := api.NewRouter(handler)
+
+	inspect := func(image string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/images/inspect?image="+image, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	errorCode := func(rec *httptest.ResponseRecorder) string {
+		var resp models.ErrorResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Code
+	}
+
+	rec := inspect(f.host() + "/team/app:1.0")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var info registry.ImageInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, fakeIndexDigest, info.Digest)
+	assert.Len(t, info.Platforms, 2)
+
+	rec = inspect("python:3.11")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, apierrors.CodeImageNotAllowed, errorCode(rec))
+	rec = inspect(f.host() + "/other/app")
+	assert.Equal(t, http.StatusForbidden, rec.Code, "disallowed repositories are not probed")
+	assert.Equal(t, int32(2), f.manifestRequests.Load())
+
+	rec = inspect(f.host() + "/team/app:missing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, apierrors.CodeImageNotFound, errorCode(rec))
+
+	rec = inspect(f.host() + "/team/limited")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, apierrors.CodeRegistryRateLimited, errorCode(rec))
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+	rec = inspect("")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = inspect("Not%20An%20Image")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
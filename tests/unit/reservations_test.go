@@ -0,0 +1,452 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/teams"
+	"github.com/sciffer/agentbox/pkg/users"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// reservationConfig allows reservations and one environment created per hour
+func reservationConfig() *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Guardrails.MaxEnvironmentsPerHour = 1
+	cfg.Reservations = config.ReservationsConfig{
+		MaxEnvironmentsPerUser:   5,
+		LeadTimeSeconds:          300,
+		MaxDurationHours:         4,
+		MaxAdvanceDays:           7,
+		PlaceholderImage:         "registry.k8s.io/pause:3.9",
+		PlaceholderPriorityClass: "agentbox-placeholder",
+	}
+	return cfg
+}
+
+func reservationRequest(name string, startsAt time.Time, environments int) *models.CreateReservationRequest {
+	return &models.CreateReservationRequest{
+		Name:         name,
+		StartsAt:     startsAt,
+		EndsAt:       startsAt.Add(2 * time.Hour),
+		Environments: environments,
+		Resources:    models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		NodeSelector: map[string]string{"pool": "batch"},
+	}
+}
+
+func reservedEnvironmentRequest(name, reservationID string) *models.CreateEnvironmentRequest {
+	req := guardrailRequest(name)
+	req.ReservationID = reservationID
+	return req
+}
+
+func TestReservationLifecycle(t *testing.T) {
+	for _, withDB := range []bool{false, true} {
+		name := "memory"
+		var db *database.DB
+		if withDB {
+			name = "database"
+			db = setupTestDB(t)
+		}
+		t.Run(name, func(t *testing.T) {
+			start := time.Now().Add(time.Hour).Truncate(time.Second)
+			clock := mocks.NewFakeClock(start.Add(-time.Hour))
+			orch, mockK8s := setupConfiguredOrchestrator(t, reservationConfig(), db, orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+			ctx := context.Background()
+
+			rsv, err := orch.CreateReservation(ctx, reservationRequest("nightly", start, 2), "user-123", 0)
+			require.NoError(t, err)
+			assert.Equal(t, models.ReservationScheduled, rsv.Status)
+			assert.Equal(t, "test-"+rsv.ID, rsv.Namespace)
+
+			// Before the lead time nothing is held and the reservation cannot be used
+			assert.Empty(t, orch.RunReservationPass(ctx, clock.Now()))
+			exists, err := mockK8s.NamespaceExists(ctx, rsv.Namespace)
+			require.NoError(t, err)
+			assert.False(t, exists)
+			_, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("early", rsv.ID), "user-123")
+			assert.Equal(t, apierrors.CodeReservationNotActive, apierrors.CodeOf(err))
+
+			// Within the lead time one placeholder pod per environment holds the capacity
+			clock.Advance(56 * time.Minute)
+			assert.Equal(t, []string{rsv.ID}, orch.RunReservationPass(ctx, clock.Now()))
+			assert.ElementsMatch(t, []string{"hold-0", "hold-1"}, mockK8s.CreatedPodNames(rsv.Namespace))
+			spec := mockK8s.CreatedPodSpec(rsv.Namespace, "hold-0")
+			require.NotNil(t, spec)
+			assert.Equal(t, "registry.k8s.io/pause:3.9", spec.Image)
+			assert.Equal(t, "500m", spec.CPU)
+			assert.Equal(t, "agentbox-placeholder", spec.PriorityClassName)
+			assert.Equal(t, map[string]string{"pool": "batch"}, spec.NodeSelector)
+			assert.Equal(t, rsv.ID, mockK8s.NamespaceLabels(rsv.Namespace)["reservation-id"])
+			rsv, err = orch.GetReservation(ctx, rsv.ID)
+			require.NoError(t, err)
+			assert.Equal(t, models.ReservationHolding, rsv.Status)
+			// Another pass changes nothing
+			assert.Empty(t, orch.RunReservationPass(ctx, clock.Now()))
+
+			// The creation rate limit is reached by an unreserved environment...
+			plain, err := orch.CreateEnvironment(ctx, guardrailRequest("plain"), "user-123")
+			require.NoError(t, err)
+			<-orch.ProvisioningDone(plain.ID)
+			_, err = orch.CreateEnvironment(ctx, guardrailRequest("limited"), "user-123")
+			assert.Equal(t, apierrors.CodeCreationRateLimited, apierrors.CodeOf(err))
+
+			// ...but environments of the reservation skip it and take the place of a placeholder
+			env, err := orch.CreateEnvironment(ctx, reservedEnvironmentRequest("reserved-1", rsv.ID), "user-123")
+			require.NoError(t, err)
+			assert.Equal(t, rsv.ID, env.ReservationID)
+			assert.Equal(t, map[string]string{"pool": "batch"}, env.NodeSelector)
+			<-orch.ProvisioningDone(env.ID)
+			assert.Equal(t, 1, mockK8s.GetPodCount(rsv.Namespace))
+			assert.Equal(t, 1, mockK8s.GetPodCount(env.Namespace))
+			assert.Equal(t, 1, orch.GuardrailStatus().EnvironmentsCreatedLastHour)
+			if withDB {
+				stored, err := db.GetEnvironment(ctx, env.ID)
+				require.NoError(t, err)
+				assert.Equal(t, rsv.ID, stored.ReservationID)
+			}
+
+			env, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("reserved-2", rsv.ID), "user-123")
+			require.NoError(t, err)
+			<-orch.ProvisioningDone(env.ID)
+			assert.Equal(t, 0, mockK8s.GetPodCount(rsv.Namespace))
+
+			_, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("reserved-3", rsv.ID), "user-123")
+			assert.Equal(t, apierrors.CodeReservationExhausted, apierrors.CodeOf(err))
+			rsv, err = orch.GetReservation(ctx, rsv.ID)
+			require.NoError(t, err)
+			assert.Equal(t, 2, rsv.Used)
+
+			// At the end of the window the reservation expires and its namespace is deleted
+			clock.Advance(2*time.Hour + 4*time.Minute)
+			assert.Equal(t, []string{rsv.ID}, orch.RunReservationPass(ctx, clock.Now()))
+			exists, err = mockK8s.NamespaceExists(ctx, rsv.Namespace)
+			require.NoError(t, err)
+			assert.False(t, exists)
+			rsv, err = orch.GetReservation(ctx, rsv.ID)
+			require.NoError(t, err)
+			assert.Equal(t, models.ReservationExpired, rsv.Status)
+			_, err = orch.CancelReservation(ctx, rsv.ID)
+			assert.Equal(t, apierrors.CodeReservationNotActive, apierrors.CodeOf(err))
+		})
+	}
+}
+
+func TestReservationPassRestoresPlaceholders(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	clock := mocks.NewFakeClock(start)
+	orch, mockK8s := setupConfiguredOrchestrator(t, reservationConfig(), nil, orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	rsv, err := orch.CreateReservation(ctx, reservationRequest("restore", start, 3), "user-123", 0)
+	require.NoError(t, err)
+	orch.RunReservationPass(ctx, clock.Now())
+	require.Equal(t, 3, mockK8s.GetPodCount(rsv.Namespace))
+
+	// A lost placeholder is recreated
+	require.NoError(t, mockK8s.DeletePod(ctx, rsv.Namespace, "hold-2", true))
+	assert.Equal(t, []string{rsv.ID}, orch.RunReservationPass(ctx, clock.Now()))
+	assert.Equal(t, 3, mockK8s.GetPodCount(rsv.Namespace))
+
+	// An environment whose placeholder could not be deleted leaves it to the next pass
+	mockK8s.FailNext("DeletePod", 1, assert.AnError)
+	env, err := orch.CreateEnvironment(ctx, reservedEnvironmentRequest("reserved", rsv.ID), "user-123")
+	require.NoError(t, err)
+	<-orch.ProvisioningDone(env.ID)
+	assert.Equal(t, 3, mockK8s.GetPodCount(rsv.Namespace))
+	orch.RunReservationPass(ctx, clock.Now())
+	assert.Equal(t, 2, mockK8s.GetPodCount(rsv.Namespace))
+	_, err = mockK8s.GetPod(ctx, rsv.Namespace, "hold-0")
+	assert.Error(t, err)
+
+	// Canceling deletes the remaining placeholders; the environment keeps running
+	rsv, err = orch.CancelReservation(ctx, rsv.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ReservationCanceled, rsv.Status)
+	assert.Equal(t, 0, mockK8s.GetPodCount(rsv.Namespace))
+	assert.Equal(t, 1, mockK8s.GetPodCount(env.Namespace))
+	_, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("late", rsv.ID), "user-123")
+	assert.Equal(t, apierrors.CodeReservationNotActive, apierrors.CodeOf(err))
+}
+
+func TestReservationSlotOwnership(t *testing.T) {
+	db := setupTestDB(t)
+	start := time.Now().Truncate(time.Second)
+	clock := mocks.NewFakeClock(start)
+	orch, _ := setupConfiguredOrchestrator(t, reservationConfig(), db, orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+
+	rsv, err := orch.CreateReservation(ctx, reservationRequest("slots", start, 2), "user-123", 0)
+	require.NoError(t, err)
+
+	// A released slot goes to the next environment; the other keeps its owner
+	slot, ok, err := db.ClaimReservation(ctx, rsv.ID, "env-a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 0, slot)
+	slot, ok, err = db.ClaimReservation(ctx, rsv.ID, "env-b")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 1, slot)
+	_, ok, err = db.ClaimReservation(ctx, rsv.ID, "env-c")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	slot, ok, err = db.ReleaseReservation(ctx, rsv.ID, "env-a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 0, slot)
+	_, ok, err = db.ReleaseReservation(ctx, rsv.ID, "env-a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	slot, ok, err = db.ClaimReservation(ctx, rsv.ID, "env-c")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 0, slot)
+	stored, err := db.GetReservation(ctx, rsv.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stored.Used)
+	assert.Equal(t, map[int]string{0: "env-c", 1: "env-b"}, stored.Slots)
+
+	// Closing the reservation frees its slots and keeps the count
+	_, err = orch.CancelReservation(ctx, rsv.ID)
+	require.NoError(t, err)
+	stored, err = db.GetReservation(ctx, rsv.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stored.Used)
+	assert.Empty(t, stored.Slots)
+}
+
+func TestReservationReleaseRestoresPlaceholder(t *testing.T) {
+	for _, withDB := range []bool{false, true} {
+		name := "memory"
+		var db *database.DB
+		if withDB {
+			name = "database"
+			db = setupTestDB(t)
+		}
+		t.Run(name, func(t *testing.T) {
+			start := time.Now().Truncate(time.Second)
+			clock := mocks.NewFakeClock(start)
+			orch, mockK8s := setupConfiguredOrchestrator(t, reservationConfig(), db, orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+			ctx := context.Background()
+
+			rsv, err := orch.CreateReservation(ctx, reservationRequest("release", start, 2), "user-123", 0)
+			require.NoError(t, err)
+			orch.RunReservationPass(ctx, clock.Now())
+			require.NoError(t, mockK8s.DeletePod(ctx, rsv.Namespace, "hold-0", true))
+
+			// An environment that is not created gives its slot back and the placeholder returns
+			failing := reservedEnvironmentRequest("no-builds", rsv.ID)
+			failing.Build = &models.BuildSpec{}
+			_, err = orch.CreateEnvironment(ctx, failing, "user-123")
+			require.Error(t, err)
+			_, err = mockK8s.GetPod(ctx, rsv.Namespace, "hold-0")
+			require.NoError(t, err)
+			rsv, err = orch.GetReservation(ctx, rsv.ID)
+			require.NoError(t, err)
+			assert.Equal(t, 0, rsv.Used)
+
+			// Each environment then takes its own placeholder
+			first, err := orch.CreateEnvironment(ctx, reservedEnvironmentRequest("first", rsv.ID), "user-123")
+			require.NoError(t, err)
+			<-orch.ProvisioningDone(first.ID)
+			second, err := orch.CreateEnvironment(ctx, reservedEnvironmentRequest("second", rsv.ID), "user-123")
+			require.NoError(t, err)
+			<-orch.ProvisioningDone(second.ID)
+			assert.Equal(t, 0, mockK8s.GetPodCount(rsv.Namespace))
+			assert.Empty(t, orch.RunReservationPass(ctx, clock.Now()))
+		})
+	}
+}
+
+func TestReservationValidationAndQuota(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	clock := mocks.NewFakeClock(now)
+	orch, _ := setupConfiguredOrchestrator(t, reservationConfig(), nil, orchestrator.WithClock(clock), orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	start := now.Add(time.Hour)
+
+	invalid := map[string]func(req *models.CreateReservationRequest){
+		"no name":           func(req *models.CreateReservationRequest) { req.Name = "" },
+		"no environments":   func(req *models.CreateReservationRequest) { req.Environments = 0 },
+		"ends before start": func(req *models.CreateReservationRequest) { req.EndsAt = req.StartsAt.Add(-time.Minute) },
+		"window too long":   func(req *models.CreateReservationRequest) { req.EndsAt = req.StartsAt.Add(5 * time.Hour) },
+		"starts too far ahead": func(req *models.CreateReservationRequest) {
+			req.StartsAt = now.AddDate(0, 0, 8)
+			req.EndsAt = req.StartsAt.Add(time.Hour)
+		},
+		"ended":           func(req *models.CreateReservationRequest) { req.StartsAt = now.Add(-2 * time.Hour); req.EndsAt = now },
+		"unknown cluster": func(req *models.CreateReservationRequest) { req.Cluster = "nope" },
+	}
+	for name, mutate := range invalid {
+		req := reservationRequest("invalid", start, 1)
+		mutate(req)
+		_, err := orch.CreateReservation(ctx, req, "user-123", 0)
+		assert.ErrorIs(t, err, apierrors.ValidationFailed, name)
+	}
+
+	// Open reservations of a user hold at most 5 environments together
+	mine, err := orch.CreateReservation(ctx, reservationRequest("first", start, 3), "user-123", 0)
+	require.NoError(t, err)
+	_, err = orch.CreateReservation(ctx, reservationRequest("second", start, 3), "user-123", 0)
+	assert.Equal(t, apierrors.CodeReservationQuotaExceeded, apierrors.CodeOf(err))
+	_, err = orch.CreateReservation(ctx, reservationRequest("second", start, 2), "user-123", 0)
+	require.NoError(t, err)
+	_, err = orch.CreateReservation(ctx, reservationRequest("other-user", start, 3), "user-456", 0)
+	require.NoError(t, err)
+
+	// Team reservations count per team and stay within the team's quota
+	teamReq := reservationRequest("team", start, 3)
+	teamReq.TeamID = "team-1"
+	_, err = orch.CreateReservation(ctx, teamReq, "user-123", 2)
+	assert.Equal(t, apierrors.CodeReservationQuotaExceeded, apierrors.CodeOf(err))
+	team, err := orch.CreateReservation(ctx, teamReq, "user-123", 0)
+	require.NoError(t, err)
+
+	list, err := orch.ListReservations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, list.Total)
+
+	// Reservations can only be used by their owner, for environments that fit them
+	clock.Advance(time.Hour)
+	_, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("not-in-team", team.ID), "user-123")
+	assert.ErrorIs(t, err, apierrors.Forbidden)
+	_, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("stranger", mine.ID), "user-456")
+	assert.ErrorIs(t, err, apierrors.Forbidden)
+	tooBig := reservedEnvironmentRequest("too-big", mine.ID)
+	tooBig.Resources.Memory = "1Gi"
+	_, err = orch.CreateEnvironment(ctx, tooBig, "user-123")
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	_, err = orch.CreateEnvironment(ctx, reservedEnvironmentRequest("missing", "rsv-missing"), "user-123")
+	assert.Equal(t, apierrors.CodeReservationNotFound, apierrors.CodeOf(err))
+
+	// A refused environment gives its reservation slot back
+	mine2, err := orch.GetReservation(ctx, mine.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, mine2.Used)
+}
+
+func TestReservationAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			var err error
+			data, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	now := time.Now()
+	w := do(http.MethodPost, "/api/v1/reservations", reservationRequest("api", now, 2))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var rsv models.Reservation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rsv))
+	assert.Equal(t, 2, rsv.Environments)
+
+	// Unknown profiles and invalid resources are rejected
+	req := reservationRequest("profile", now, 1)
+	req.Resources = models.ResourceSpec{}
+	req.Profile = "small"
+	w = do(http.MethodPost, "/api/v1/reservations", req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	req = reservationRequest("invalid", now, 1)
+	req.Resources.CPU = "lots"
+	w = do(http.MethodPost, "/api/v1/reservations", req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	create := reservedEnvironmentRequest("api-env", rsv.ID)
+	w = do(http.MethodPost, "/api/v1/environments", create)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&env))
+	assert.Equal(t, rsv.ID, env.ReservationID)
+
+	w = do(http.MethodGet, "/api/v1/reservations/"+rsv.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rsv))
+	assert.Equal(t, 1, rsv.Used)
+
+	w = do(http.MethodGet, "/api/v1/reservations", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list models.ListReservationsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Equal(t, 1, list.Total)
+
+	w = do(http.MethodDelete, "/api/v1/reservations/"+rsv.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rsv))
+	assert.Equal(t, models.ReservationCanceled, rsv.Status)
+
+	w = do(http.MethodGet, "/api/v1/reservations/rsv-missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestReservationAPIVisibility(t *testing.T) {
+	a := setupAPIRouterTest(t)
+	ctx := context.Background()
+	creator := createUserForTest(t, a.users, "rsv-creator", "password123", users.RoleUser)
+	member := createUserForTest(t, a.users, "rsv-member", "password123", users.RoleUser)
+	createUserForTest(t, a.users, "rsv-other", "password123", users.RoleUser)
+	createUserForTest(t, a.users, "rsv-admin", "password123", users.RoleAdmin)
+	team, err := teams.NewService(a.db, zap.NewNop()).CreateTeam(ctx, &teams.CreateTeamRequest{Name: "nightly"}, member.ID)
+	require.NoError(t, err)
+
+	now := time.Now()
+	own, err := a.orch.CreateReservation(ctx, reservationRequest("own", now, 1), creator.ID, 0)
+	require.NoError(t, err)
+	teamReq := reservationRequest("team", now, 1)
+	teamReq.TeamID = team.ID
+	teamRsv, err := a.orch.CreateReservation(ctx, teamReq, creator.ID, 0)
+	require.NoError(t, err)
+
+	listed := func(token string) []string {
+		w := a.do(t, http.MethodGet, "/api/v1/reservations", token, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var list models.ListReservationsResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+		assert.Equal(t, len(list.Reservations), list.Total)
+		ids := make([]string, 0, len(list.Reservations))
+		for _, rsv := range list.Reservations {
+			ids = append(ids, rsv.ID)
+		}
+		return ids
+	}
+
+	creatorJWT := getTokenForUser(t, a.router, "rsv-creator", "password123")
+	memberJWT := getTokenForUser(t, a.router, "rsv-member", "password123")
+	otherJWT := getTokenForUser(t, a.router, "rsv-other", "password123")
+	adminJWT := getTokenForUser(t, a.router, "rsv-admin", "password123")
+	assert.ElementsMatch(t, []string{own.ID, teamRsv.ID}, listed(creatorJWT))
+	assert.ElementsMatch(t, []string{own.ID, teamRsv.ID}, listed(adminJWT))
+	assert.Equal(t, []string{teamRsv.ID}, listed(memberJWT))
+	assert.Empty(t, listed(otherJWT))
+
+	// Reservations the caller may not see are not found
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/reservations/"+teamRsv.ID, memberJWT, nil).Code)
+	assert.Equal(t, http.StatusNotFound, a.do(t, http.MethodGet, "/api/v1/reservations/"+own.ID, memberJWT, nil).Code)
+	assert.Equal(t, http.StatusNotFound, a.do(t, http.MethodGet, "/api/v1/reservations/"+teamRsv.ID, otherJWT, nil).Code)
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/reservations/"+own.ID, adminJWT, nil).Code)
+}
@@ -0,0 +1,195 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/roles"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func setupRolesAPITest(t *testing.T) (*apiTest, *roles.Service) {
+	var roleService *roles.Service
+	a := setupAPIRouterTest(t, withRoutes(func(a *apiTest, rc *api.RouterConfig) {
+		roleService = roles.NewService(a.db, zap.NewNop())
+		rc.UserHandler.SetRoleService(roleService)
+		rc.RoleHandler = api.NewRoleHandler(roleService, a.log)
+		rc.AuditHandler = api.NewAuditHandler(a.db, a.log)
+		rc.RoleService = roleService
+	}))
+	return a, roleService
+}
+
+func TestRolesSeededForBuiltinRoles(t *testing.T) {
+	_, roleService := setupRolesAPITest(t)
+	ctx := context.Background()
+
+	list, err := roleService.ListRoles(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	for _, role := range list {
+		assert.True(t, role.BuiltIn, role.Name)
+	}
+
+	// Admins get no access to every environment, as before roles
+	admin, err := roleService.GetRole(ctx, users.RoleAdmin)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{roles.CapUsersManage, roles.CapAPIKeysManage, roles.CapMetricsRead,
+		roles.CapAuditRead, roles.CapPlatformAdmin}, admin.Capabilities)
+	assert.ElementsMatch(t, roles.BuiltinCapabilities(users.RoleAdmin), admin.Capabilities)
+	superAdmin, err := roleService.GetRole(ctx, users.RoleSuperAdmin)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, roles.AllCapabilities, superAdmin.Capabilities)
+	user, err := roleService.GetRole(ctx, users.RoleUser)
+	require.NoError(t, err)
+	assert.Empty(t, user.Capabilities)
+
+	assert.Error(t, roleService.DeleteRole(ctx, users.RoleAdmin, ""), "built-in roles cannot be deleted")
+}
+
+func TestCustomRolesAPI(t *testing.T) {
+	a, _ := setupRolesAPITest(t)
+	ctx := context.Background()
+
+	createUserForTest(t, a.users, "roles-admin", "password123", users.RoleSuperAdmin)
+	createUserForTest(t, a.users, "plain-admin", "password123", users.RoleAdmin)
+	owner := createUserForTest(t, a.users, "env-owner", "password123", users.RoleUser)
+	operator := createUserForTest(t, a.users, "ops", "password123", users.RoleUser)
+	auditor := createUserForTest(t, a.users, "auditor", "password123", users.RoleUser)
+	adminJWT := getTokenForUser(t, a.router, "roles-admin", "password123")
+	ownerJWT := getTokenForUser(t, a.router, "env-owner", "password123")
+	plainAdminJWT := getTokenForUser(t, a.router, "plain-admin", "password123")
+
+	// Roles are managed by users with users.manage
+	operatorRole := map[string]interface{}{
+		"name":         "operator",
+		"description":  "Manages environments",
+		"capabilities": []string{roles.CapEnvironmentsReadAll, roles.CapEnvironmentsWriteAll},
+	}
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/admin/roles", ownerJWT, operatorRole).Code)
+	// Admins have no access to every environment, so they cannot grant it
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/admin/roles", plainAdminJWT, operatorRole).Code)
+	rr := a.do(t, http.MethodPost, "/api/v1/admin/roles", adminJWT, operatorRole)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var created roles.Role
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+	assert.False(t, created.BuiltIn)
+	assert.Equal(t, []string{roles.CapEnvironmentsReadAll, roles.CapEnvironmentsWriteAll}, created.Capabilities)
+
+	assert.Equal(t, http.StatusConflict, a.do(t, http.MethodPost, "/api/v1/admin/roles", adminJWT, operatorRole).Code)
+	assert.Equal(t, http.StatusBadRequest, a.do(t, http.MethodPost, "/api/v1/admin/roles", adminJWT, map[string]interface{}{
+		"name": "broken", "capabilities": []string{"environments.destroy_all"},
+	}).Code)
+	require.Equal(t, http.StatusCreated, a.do(t, http.MethodPost, "/api/v1/admin/roles", adminJWT, map[string]interface{}{
+		"name": "auditor", "capabilities": []string{roles.CapEnvironmentsReadAll, roles.CapAuditRead, roles.CapMetricsRead},
+	}).Code)
+
+	// Assigning roles
+	assert.Equal(t, http.StatusBadRequest, a.do(t, http.MethodPut, "/api/v1/users/"+operator.ID+"/role", adminJWT, map[string]string{"role": "missing"}).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPut, "/api/v1/users/"+operator.ID+"/role", ownerJWT, map[string]string{"role": "operator"}).Code)
+	rr = a.do(t, http.MethodPut, "/api/v1/users/"+operator.ID+"/role", adminJWT, map[string]string{"role": "operator"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = a.do(t, http.MethodPut, "/api/v1/users/"+auditor.ID+"/role", adminJWT, map[string]string{"role": "auditor"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	operatorJWT := getTokenForUser(t, a.router, "ops", "password123")
+	auditorJWT := getTokenForUser(t, a.router, "auditor", "password123")
+
+	env := createRunningEnv(t, a.orch, &models.CreateEnvironmentRequest{Name: "owned-env"})
+	_, err := a.permissions.GrantPermission(ctx, owner.ID, env.ID, permissions.PermissionOwner, "")
+	require.NoError(t, err)
+	patch := map[string]interface{}{"labels": map[string]string{"touched": "yes"}}
+
+	// The operator manages every environment but not users
+	rr = a.do(t, http.MethodPatch, "/api/v1/environments/"+env.ID, operatorJWT, patch)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/users", operatorJWT, nil).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/admin/audit-log", operatorJWT, nil).Code)
+
+	// The auditor reads everything but changes nothing
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPatch, "/api/v1/environments/"+env.ID, auditorJWT, patch).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/admin/roles", auditorJWT, operatorRole).Code)
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/admin/config", auditorJWT, nil).Code)
+	assert.Equal(t, http.StatusOK, a.do(t, http.MethodGet, "/api/v1/admin/roles", auditorJWT, nil).Code)
+	rr = a.do(t, http.MethodGet, "/api/v1/admin/audit-log?resource_type=role", auditorJWT, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var audit struct {
+		Entries []models.AuditEntry `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&audit))
+	actions := map[string]int{}
+	for _, e := range audit.Entries {
+		actions[e.Action]++
+	}
+	assert.Equal(t, 2, actions["role.created"])
+	assert.Equal(t, 2, actions["user.role_assigned"])
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodGet, "/api/v1/admin/audit-log", ownerJWT, nil).Code)
+
+	// Roles in use cannot be deleted
+	rr = a.do(t, http.MethodDelete, "/api/v1/admin/roles/operator", adminJWT, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusBadRequest, a.do(t, http.MethodDelete, "/api/v1/admin/roles/admin", adminJWT, nil).Code)
+	require.Equal(t, http.StatusOK, a.do(t, http.MethodPut, "/api/v1/users/"+operator.ID+"/role", adminJWT, map[string]string{"role": "user"}).Code)
+	assert.Equal(t, http.StatusNoContent, a.do(t, http.MethodDelete, "/api/v1/admin/roles/operator", adminJWT, nil).Code)
+	assert.Equal(t, http.StatusNotFound, a.do(t, http.MethodGet, "/api/v1/admin/roles/operator", adminJWT, nil).Code)
+}
+
+func TestRoleAssignmentCannotEscalate(t *testing.T) {
+	a, roleService := setupRolesAPITest(t)
+	ctx := context.Background()
+
+	_, err := roleService.CreateRole(ctx, &roles.CreateRoleRequest{Name: "user-manager", Capabilities: []string{roles.CapUsersManage}}, "")
+	require.NoError(t, err)
+	createUserForTest(t, a.users, "manager", "password123", "user-manager")
+	target := createUserForTest(t, a.users, "target", "password123", users.RoleUser)
+	managerJWT := getTokenForUser(t, a.router, "manager", "password123")
+
+	// Managing users does not allow handing out capabilities the manager lacks
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPut, "/api/v1/users/"+target.ID+"/role", managerJWT, map[string]string{"role": users.RoleAdmin}).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/admin/roles", managerJWT, map[string]interface{}{
+		"name": "sneaky", "capabilities": []string{roles.CapEnvironmentsWriteAll},
+	}).Code)
+	assert.Equal(t, http.StatusForbidden, a.do(t, http.MethodPost, "/api/v1/users", managerJWT, map[string]interface{}{
+		"username": "new-admin", "password": "password123", "role": users.RoleAdmin,
+	}).Code)
+	rr := a.do(t, http.MethodPut, "/api/v1/users/"+target.ID+"/role", managerJWT, map[string]string{"role": "user-manager"})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
+
+func TestRoleCapabilitiesCachedPerRequest(t *testing.T) {
+	db := setupTestDB(t)
+	roleService := roles.NewService(db, zap.NewNop())
+	ctx := context.Background()
+	_, err := roleService.CreateRole(ctx, &roles.CreateRoleRequest{Name: "reader", Capabilities: []string{roles.CapMetricsRead}}, "")
+	require.NoError(t, err)
+	user := &users.User{ID: "user-1", Role: "reader"}
+
+	var during, after bool
+	handler := roleService.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, roles.Has(r.Context(), user, roles.CapMetricsRead))
+		// Changes made during the request are not seen by it
+		_, err := db.ExecContext(ctx, "UPDATE roles SET capabilities = '[]' WHERE name = 'reader'")
+		require.NoError(t, err)
+		during = roles.Has(r.Context(), user, roles.CapMetricsRead)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, during)
+
+	roleService.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after = roles.Has(r.Context(), user, roles.CapMetricsRead)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.False(t, after)
+
+	// Without the middleware only the built-in roles grant capabilities
+	assert.False(t, roles.Has(ctx, user, roles.CapMetricsRead))
+	assert.True(t, roles.Has(ctx, &users.User{Role: users.RoleAdmin}, roles.CapMetricsRead))
+}
@@ -0,0 +1,179 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/teams"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+// createOwnedEnv creates a running environment owned by userID
+func createOwnedEnv(t *testing.T, orch *orchestrator.Orchestrator, req *models.CreateEnvironmentRequest, userID string) *models.Environment {
+	t.Helper()
+	ctx := context.Background()
+	req.Resources = models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"}
+	env, err := orch.CreateEnvironment(ctx, req, userID)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(ctx, env.ID)
+		return err == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+	return env
+}
+
+// searchHits returns the type:id of the hits of a search, in order
+func searchHits(t *testing.T, orch *orchestrator.Orchestrator, opts orchestrator.SearchOptions) []string {
+	t.Helper()
+	resp, err := orch.Search(context.Background(), opts)
+	require.NoError(t, err)
+	hits := make([]string, 0, len(resp.Hits))
+	for _, hit := range resp.Hits {
+		hits = append(hits, hit.Type+":"+hit.ID)
+	}
+	return hits
+}
+
+func TestSearchEnvironmentsAndExecutions(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	alice := createTeamTestUser(t, userService, "alice")
+	bob := createTeamTestUser(t, userService, "bob")
+
+	training := createOwnedEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:     "training",
+		Image:    "tensorflow/tensorflow:2.16.1",
+		Labels:   map[string]string{"team": "ml-research"},
+		Metadata: map[string]string{"ticket": "OPS-4242"},
+	}, alice.ID)
+	web := createOwnedEnv(t, orch, &models.CreateEnvironmentRequest{Name: "web", Image: "nginx:1.27"}, bob.ID)
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: training.ID,
+		Command:       []string{"python", "-c", "import tensorflow"},
+	}, alice.ID)
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	// Each hit says which fields matched
+	resp, err := orch.Search(ctx, orchestrator.SearchOptions{Query: "TensorFlow"})
+	require.NoError(t, err)
+	require.Len(t, resp.Hits, 2)
+	assert.Equal(t, models.SearchHit{
+		Type:          models.SearchTypeEnvironment,
+		ID:            training.ID,
+		EnvironmentID: training.ID,
+		MatchedFields: []string{"image"},
+		Name:          "training",
+		Image:         "tensorflow/tensorflow:2.16.1",
+		Owner:         "alice",
+		Status:        string(models.StatusRunning),
+		CreatedAt:     resp.Hits[0].CreatedAt,
+	}, resp.Hits[0])
+	assert.Equal(t, models.SearchTypeExecution, resp.Hits[1].Type)
+	assert.Equal(t, exec.ID, resp.Hits[1].ID)
+	assert.Equal(t, training.ID, resp.Hits[1].EnvironmentID)
+	assert.Equal(t, []string{"command"}, resp.Hits[1].MatchedFields)
+	assert.Equal(t, "python -c import tensorflow", resp.Hits[1].Command)
+	assert.False(t, resp.Truncated)
+
+	for query, fields := range map[string][]string{
+		"ml-res":        {"labels"},
+		"ops-42":        {"metadata"},
+		"ALICE":         {"owner"},
+		training.ID:     {"id"},
+		"ticket":        {"metadata"},
+		"train":         {"name"},
+		training.ID[4:]: nil,
+	} {
+		resp, err := orch.Search(ctx, orchestrator.SearchOptions{Query: query, Types: []string{"environments"}})
+		require.NoError(t, err, query)
+		if fields == nil {
+			// IDs match by prefix only
+			assert.Empty(t, resp.Hits, query)
+			continue
+		}
+		require.Len(t, resp.Hits, 1, query)
+		assert.Equal(t, fields, resp.Hits[0].MatchedFields, query)
+	}
+
+	// Types and limit; LIKE wildcards in the query are matched literally
+	assert.Equal(t, []string{"execution:" + exec.ID}, searchHits(t, orch, orchestrator.SearchOptions{Query: "tensorflow", Types: []string{"executions"}}))
+	assert.Empty(t, searchHits(t, orch, orchestrator.SearchOptions{Query: "%%"}))
+	assert.Equal(t, []string{"environment:" + web.ID, "environment:" + training.ID},
+		searchHits(t, orch, orchestrator.SearchOptions{Query: "in"}))
+	resp, err = orch.Search(ctx, orchestrator.SearchOptions{Query: "in", Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, resp.Hits, 1)
+	assert.True(t, resp.Truncated)
+
+	for _, opts := range []orchestrator.SearchOptions{
+		{Query: "a"},
+		{Query: strings.Repeat("a", 101)},
+		{Query: "tensorflow", Types: []string{"pipelines"}},
+	} {
+		_, err := orch.Search(ctx, opts)
+		assert.ErrorIs(t, err, apierrors.ValidationFailed, opts.Query)
+	}
+}
+
+func TestSearchOnlyViewableEnvironments(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db, orchestrator.WithoutBackgroundLoops())
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	owner := createTeamTestUser(t, userService, "owner")
+	member := createTeamTestUser(t, userService, "member")
+	grantee := createTeamTestUser(t, userService, "grantee")
+	team, err := teams.NewService(db, zap.NewNop()).CreateTeam(ctx, &teams.CreateTeamRequest{Name: "ml"}, member.ID)
+	require.NoError(t, err)
+
+	teamEnv := createOwnedEnv(t, orch, &models.CreateEnvironmentRequest{Name: "team-gpu", Image: "python:3.11-slim", TeamID: team.ID}, owner.ID)
+	granted := createOwnedEnv(t, orch, &models.CreateEnvironmentRequest{Name: "granted-gpu", Image: "python:3.11-slim"}, owner.ID)
+	hidden := createOwnedEnv(t, orch, &models.CreateEnvironmentRequest{Name: "hidden-gpu", Image: "python:3.11-slim"}, owner.ID)
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{EnvironmentID: hidden.ID, Command: []string{"gpu-burn", "60"}}, owner.ID)
+	require.NoError(t, err)
+	waitForExecutionDone(t, orch, exec.ID)
+	_, err = permissions.NewService(db, zap.NewNop()).GrantPermission(ctx, grantee.ID, granted.ID, permissions.PermissionViewer, owner.ID)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"environment:" + hidden.ID, "environment:" + granted.ID, "environment:" + teamEnv.ID, "execution:" + exec.ID},
+		searchHits(t, orch, orchestrator.SearchOptions{Query: "gpu"}))
+	assert.Equal(t, []string{"environment:" + teamEnv.ID},
+		searchHits(t, orch, orchestrator.SearchOptions{Query: "gpu", ViewerID: member.ID}))
+	assert.Equal(t, []string{"environment:" + granted.ID},
+		searchHits(t, orch, orchestrator.SearchOptions{Query: "gpu", ViewerID: grantee.ID}))
+	// The owner has no permission on the environments (as CheckAccess)
+	assert.Empty(t, searchHits(t, orch, orchestrator.SearchOptions{Query: "gpu", ViewerID: owner.ID}))
+}
+
+func TestSearchAPI(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	// Search needs a database; the query is validated first
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/search?q=tensorflow&types=environments,executions", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), apierrors.CodeSearchUnavailable)
+
+	for _, query := range []string{"q=x", "q=tensorflow&types=images"} {
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/search?"+query, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
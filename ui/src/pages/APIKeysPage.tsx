@@ -65,7 +65,7 @@ export default function APIKeysPage() {
 
   const { data: environmentsData } = useQuery({
     queryKey: ['environments'],
-    queryFn: () => environmentsAPI.list({ limit: 100 }),
+    queryFn: () => environmentsAPI.listAll(),
     enabled: scopePermissions,
   })
 
@@ -80,7 +80,7 @@ export default function UsersPage() {
 
   const { data: environmentsData } = useQuery({
     queryKey: ['environments'],
-    queryFn: () => environmentsAPI.list({ limit: 100 }),
+    queryFn: () => environmentsAPI.listAll(),
   })
 
   const { data: permissionsData, refetch: refetchPermissions } = useQuery({
@@ -5,11 +5,32 @@ import {
   CreateUserData, 
   UpdateUserData, 
   GrantPermissionData,
+  Role,
+  CreateRoleData,
+  ExportJob,
+  ExportJobStatus,
+  CreateExportData,
+  ExportJobListResponse,
   CreateAPIKeyData,
   APIKeyPermission,
   SubmitExecutionData,
   Execution,
-  ExecutionListResponse
+  ExecutionListResponse,
+  ExecutionListParams,
+  ExecQueueStats,
+  ExecResponse,
+  Pipeline,
+  SubmitPipelineData,
+  Operation,
+  BulkDeleteFilters,
+  ImageInfo,
+  NetworkPreset,
+  Environment,
+  ListEnvironmentsResponse,
+  ErrorDetail,
+  ErrorResponse,
+  UserPreferences,
+  PreferencesResponse
 } from '../types'
 
 // Runtime config from window.AGENTBOX_CONFIG (set by Docker entrypoint)
@@ -60,15 +81,34 @@ apiClient.interceptors.request.use(
   }
 )
 
+// APIError is thrown for API error responses. code is the machine-readable error code
+// (e.g. "ENV_NOT_RUNNING"); response is kept for callers reading the raw body.
+export class APIError extends Error {
+  status: number
+  code: string
+  details?: ErrorDetail[]
+  response?: AxiosError<ErrorResponse>['response']
+
+  constructor(error: AxiosError<ErrorResponse>) {
+    const body = error.response?.data
+    super(body?.message || body?.error || error.message)
+    this.name = 'APIError'
+    this.status = error.response?.status ?? 0
+    this.code = body?.code || (error.response ? 'UNKNOWN' : 'NETWORK_ERROR')
+    this.details = body?.details
+    this.response = error.response
+  }
+}
+
 // Response interceptor to handle auth errors
 apiClient.interceptors.response.use(
   (response) => response,
-  (error: AxiosError) => {
+  (error: AxiosError<ErrorResponse>) => {
     if (error.response?.status === 401) {
       useAuthStore.getState().clearAuth()
       window.location.href = '/login'
     }
-    return Promise.reject(error)
+    return Promise.reject(new APIError(error))
   }
 )
 
@@ -95,10 +135,25 @@ export const authAPI = {
 
 // Environments API
 export const environmentsAPI = {
-  list: async (params?: { status?: string; limit?: number; offset?: number }) => {
+  // One page; pass the previous response's next_page_token as page_token for the next
+  // (offset is deprecated)
+  list: async (params?: { status?: string; user_id?: string; limit?: number; offset?: number; page_token?: string }) => {
     const response = await apiClient.get('/environments', { params })
     return response.data
   },
+  // Every environment, following next_page_token across pages
+  listAll: async (params?: { status?: string; user_id?: string }): Promise<ListEnvironmentsResponse> => {
+    const environments: Environment[] = []
+    let pageToken: string | undefined
+    let total = 0
+    do {
+      const page: ListEnvironmentsResponse = await environmentsAPI.list({ ...params, limit: 1000, page_token: pageToken })
+      environments.push(...(page.environments || []))
+      total = page.total
+      pageToken = page.next_page_token
+    } while (pageToken)
+    return { environments, total, limit: environments.length, offset: 0 }
+  },
   get: async (id: string) => {
     const response = await apiClient.get(`/environments/${id}`)
     return response.data
@@ -110,13 +165,37 @@ export const environmentsAPI = {
   delete: async (id: string, force?: boolean) => {
     await apiClient.delete(`/environments/${id}`, { params: { force } })
   },
-  exec: async (id: string, command: string[], timeout?: number) => {
+  // Make another user the owner (owner or environments.write_all)
+  transferOwnership: async (id: string, userId: string): Promise<Environment> => {
+    const response = await apiClient.post(`/environments/${id}/transfer-ownership`, { user_id: userId })
+    return response.data
+  },
+  // Environment IDs a bulk delete with these filters would delete
+  bulkDeleteDryRun: async (filters: BulkDeleteFilters): Promise<string[]> => {
+    const response = await apiClient.delete('/environments', { params: { ...filters, dry_run: true } })
+    return response.data.environment_ids
+  },
+  // Delete every matching environment in the background; poll the operation for progress
+  bulkDelete: async (filters: BulkDeleteFilters, force?: boolean): Promise<Operation> => {
+    const response = await apiClient.delete('/environments', { params: { ...filters, confirm: true, force } })
+    return response.data
+  },
+  // Block until the environment is running or failed (settled: true) or timeout seconds pass
+  wait: async (id: string, timeout?: number): Promise<{ environment: Environment; settled: boolean }> => {
+    const response = await apiClient.get(`/environments/${id}/wait`, { params: { timeout } })
+    return { environment: response.data, settled: response.status === 200 }
+  },
+  exec: async (id: string, command: string[], timeout?: number): Promise<ExecResponse> => {
     const response = await apiClient.post(`/environments/${id}/exec`, {
       command,
       timeout,
     })
     return response.data
   },
+  getExecQueue: async (id: string): Promise<ExecQueueStats> => {
+    const response = await apiClient.get(`/environments/${id}/exec/queue`)
+    return response.data
+  },
   getLogs: async (id: string, params?: { tail?: number; follow?: boolean; timestamps?: boolean }) => {
     const response = await apiClient.get(`/environments/${id}/logs`, { params })
     return response.data
@@ -135,17 +214,74 @@ export const executionsAPI = {
     const response = await apiClient.get(`/executions/${id}`)
     return response.data
   },
-  // List executions for an environment
-  list: async (environmentId: string, params?: { limit?: number }): Promise<ExecutionListResponse> => {
+  // List executions for an environment, newest first (one page; see listAll)
+  list: async (environmentId: string, params?: ExecutionListParams): Promise<ExecutionListResponse> => {
     const response = await apiClient.get(`/environments/${environmentId}/executions`, { params })
     return response.data
   },
+  // Every execution of an environment, following next_page_token across pages
+  listAll: async (environmentId: string): Promise<ExecutionListResponse> => {
+    const executions: Execution[] = []
+    let pageToken: string | undefined
+    do {
+      const page: ExecutionListResponse = await executionsAPI.list(environmentId, { limit: 1000, page_token: pageToken })
+      executions.push(...page.executions)
+      pageToken = page.next_page_token
+    } while (pageToken)
+    return { executions, total: executions.length }
+  },
   // Cancel an execution
   cancel: async (id: string): Promise<void> => {
     await apiClient.delete(`/executions/${id}`)
   },
 }
 
+// Pipelines API (steps run as executions in dependency order)
+export const pipelinesAPI = {
+  // Submit a pipeline (returns immediately; dependency cycles are rejected with 400)
+  submit: async (environmentId: string, data: SubmitPipelineData): Promise<Pipeline> => {
+    const response = await apiClient.post(`/environments/${environmentId}/pipelines`, data)
+    return response.data
+  },
+  // Get the pipeline with each step's status and execution ID
+  get: async (id: string): Promise<Pipeline> => {
+    const response = await apiClient.get(`/pipelines/${id}`)
+    return response.data
+  },
+  // Cancel running and pending steps; returns the stopped pipeline
+  cancel: async (id: string): Promise<Pipeline> => {
+    const response = await apiClient.delete(`/pipelines/${id}`)
+    return response.data
+  },
+}
+
+// Operations API (bulk requests)
+export const operationsAPI = {
+  // Progress and per-environment results of an operation
+  get: async (id: string): Promise<Operation> => {
+    const response = await apiClient.get(`/operations/${id}`)
+    return response.data
+  },
+}
+
+// Images API
+export const imagesAPI = {
+  // Look up an image in its registry (403 IMAGE_NOT_ALLOWED outside the image allowlist)
+  inspect: async (image: string): Promise<ImageInfo> => {
+    const response = await apiClient.get('/images/inspect', { params: { image } })
+    return response.data
+  },
+}
+
+// Policies API
+export const policiesAPI = {
+  // Network presets environments can pick with isolation.network_preset
+  networkPresets: async (): Promise<NetworkPreset[]> => {
+    const response = await apiClient.get('/policies/network')
+    return response.data.presets
+  },
+}
+
 // Users API
 export const usersAPI = {
   list: async (params?: { limit?: number; offset?: number }) => {
@@ -164,8 +300,17 @@ export const usersAPI = {
     const response = await apiClient.put(`/users/${id}`, data)
     return response.data
   },
-  delete: async (id: string) => {
-    await apiClient.delete(`/users/${id}`)
+  // Users who own environments are only deleted with transferTo, their new owner (409 otherwise)
+  delete: async (id: string, transferTo?: string) => {
+    await apiClient.delete(`/users/${id}`, { params: { transfer_to: transferTo } })
+  },
+  unlock: async (id: string) => {
+    const response = await apiClient.post(`/users/${id}/unlock`)
+    return response.data
+  },
+  assignRole: async (id: string, role: string) => {
+    const response = await apiClient.put(`/users/${id}/role`, { role })
+    return response.data
   },
   // Permission methods
   listPermissions: async (userId: string) => {
@@ -183,6 +328,66 @@ export const usersAPI = {
   revokePermission: async (userId: string, envId: string) => {
     await apiClient.delete(`/users/${userId}/permissions/${envId}`)
   },
+  // Preference methods (the signed-in user's own); unset fields fall back to the organization defaults
+  getPreferences: async (): Promise<PreferencesResponse> => {
+    const response = await apiClient.get('/users/me/preferences')
+    return response.data
+  },
+  updatePreferences: async (data: UserPreferences): Promise<PreferencesResponse> => {
+    const response = await apiClient.put('/users/me/preferences', data)
+    return response.data
+  },
+}
+
+// Preference defaults API (users.manage)
+export const preferencesAPI = {
+  getDefaults: async (): Promise<PreferencesResponse> => {
+    const response = await apiClient.get('/admin/preferences')
+    return response.data
+  },
+  updateDefaults: async (data: UserPreferences): Promise<PreferencesResponse> => {
+    const response = await apiClient.put('/admin/preferences', data)
+    return response.data
+  },
+}
+
+// Roles API
+export const rolesAPI = {
+  list: async () => {
+    const response = await apiClient.get('/admin/roles')
+    return response.data
+  },
+  get: async (name: string): Promise<Role> => {
+    const response = await apiClient.get(`/admin/roles/${name}`)
+    return response.data
+  },
+  create: async (data: CreateRoleData): Promise<Role> => {
+    const response = await apiClient.post('/admin/roles', data)
+    return response.data
+  },
+  delete: async (name: string) => {
+    await apiClient.delete(`/admin/roles/${name}`)
+  },
+}
+
+// Data Exports API
+export const exportsAPI = {
+  list: async (params?: { status?: ExportJobStatus; limit?: number }): Promise<ExportJobListResponse> => {
+    const response = await apiClient.get('/admin/exports', { params })
+    return response.data
+  },
+  get: async (id: string): Promise<ExportJob> => {
+    const response = await apiClient.get(`/admin/exports/${id}`)
+    return response.data
+  },
+  create: async (data: CreateExportData): Promise<ExportJob> => {
+    const response = await apiClient.post('/admin/exports', data)
+    return response.data
+  },
+  retry: async (id: string): Promise<ExportJob> => {
+    const response = await apiClient.post(`/admin/exports/${id}/retry`)
+    return response.data
+  },
 }
 
 // API Keys API
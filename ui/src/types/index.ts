@@ -7,6 +7,95 @@ export interface User {
   created_at: string
   updated_at: string
   last_login?: string
+  // Only returned by /auth/me
+  preferences?: PreferencesResponse
+}
+
+// Preferences (null = unset, falling back to the organization defaults)
+export interface UserPreferences {
+  default_profile?: string | null
+  notify_on_environment_failed?: boolean | null
+  notify_on_execution_failed?: boolean | null
+  email_critical_alerts?: boolean | null
+  timezone?: string | null
+  updated_at?: string
+}
+
+export interface EffectivePreferences {
+  default_profile: string
+  notify_on_environment_failed: boolean
+  notify_on_execution_failed: boolean
+  email_critical_alerts: boolean
+  timezone: string
+}
+
+export interface PreferencesResponse {
+  preferences: UserPreferences
+  effective: EffectivePreferences
+}
+
+export type Capability =
+  | 'environments.read_all'
+  | 'environments.write_all'
+  | 'users.manage'
+  | 'api_keys.manage'
+  | 'metrics.read'
+  | 'audit.read'
+
+export interface Role {
+  name: string
+  description?: string
+  capabilities: Capability[]
+  built_in: boolean
+  created_at: string
+}
+
+export interface CreateRoleData {
+  name: string
+  description?: string
+  capabilities: Capability[]
+}
+
+export type ExportDataset = 'executions' | 'environment_events' | 'audit_log'
+
+export type ExportJobStatus = 'pending' | 'running' | 'succeeded' | 'failed'
+
+export interface ExportCheckpoint {
+  records: number
+  batches: number
+  last_created_at?: string
+  last_id?: string
+  done: boolean
+}
+
+export interface ExportJob {
+  id: string
+  trigger: 'scheduled' | 'manual'
+  datasets: ExportDataset[]
+  from: string
+  to: string
+  sink: 's3' | 'webhook'
+  status: ExportJobStatus
+  attempts: number
+  next_attempt_at?: string
+  progress: Partial<Record<ExportDataset, ExportCheckpoint>>
+  error?: string
+  created_by?: string
+  created_at: string
+  started_at?: string
+  completed_at?: string
+}
+
+export interface CreateExportData {
+  from: string
+  to: string
+  datasets?: ExportDataset[]
+}
+
+export interface ExportJobListResponse {
+  exports: ExportJob[]
+  total: number
+  configured: boolean
 }
 
 export interface Toleration {
@@ -17,6 +106,33 @@ export interface Toleration {
   tolerationSeconds?: number
 }
 
+export interface NodeSelectorRequirement {
+  key: string
+  operator: 'In' | 'NotIn' | 'Exists'
+  values?: string[]
+}
+
+export interface NodeSelectorTerm {
+  match_expressions: NodeSelectorRequirement[]
+}
+
+export interface PreferredNodeTerm extends NodeSelectorTerm {
+  weight: number
+}
+
+export interface PodAntiAffinity {
+  match_labels?: Record<string, string>
+  topology_key?: string
+  required?: boolean
+  weight?: number
+}
+
+export interface Affinity {
+  required_node_terms?: NodeSelectorTerm[]
+  preferred_node_terms?: PreferredNodeTerm[]
+  pod_anti_affinity?: PodAntiAffinity
+}
+
 export interface NetworkPolicyConfig {
   allow_internet?: boolean
   allowed_egress_cidrs?: string[]
@@ -24,24 +140,45 @@ export interface NetworkPolicyConfig {
   allow_cluster_internal?: boolean
 }
 
+// Network policy preset from GET /policies/network
+export interface NetworkPreset {
+  name: string
+  description?: string
+  policy: NetworkPolicyConfig
+  rules: string[]  // the traffic the policy allows
+}
+
 export interface SecurityContextConfig {
   run_as_user?: number
   run_as_group?: number
   run_as_non_root?: boolean
   read_only_root_filesystem?: boolean
   allow_privilege_escalation?: boolean
+  capabilities?: { add?: string[]; drop?: string[] }
+  seccomp_profile?: 'RuntimeDefault' | 'Unconfined'
+}
+
+export interface DNSConfig {
+  policy?: 'ClusterFirst' | 'None'  // None requires nameservers
+  nameservers?: string[]  // at most 3 IPs
+  searches?: string[]
+  options?: { name: string; value?: string }[]
 }
 
 export interface IsolationConfig {
   runtime_class?: string  // e.g., "gvisor", "kata", "runc"
+  network_preset?: string  // e.g., "internet-only"; resolved into network_policy on create/update
   network_policy?: NetworkPolicyConfig
   security_context?: SecurityContextConfig
+  dns?: DNSConfig
+  exec_inherit_security_context?: boolean  // admin-only: execution pods keep the environment's security context
 }
 
 export interface PoolConfig {
   enabled?: boolean
   size?: number
   min_ready?: number
+  prewarm_on_create?: boolean
 }
 
 export interface Environment {
@@ -59,8 +196,85 @@ export interface Environment {
   terminated_at?: string
   node_selector?: Record<string, string>
   tolerations?: Toleration[]
+  affinity?: Affinity
   isolation?: IsolationConfig
   pool?: PoolConfig
+  pool_ready?: boolean
+  record_sessions?: boolean
+  // Freeform key/value data; not applied to the cluster
+  metadata?: Record<string, string>
+  // Cordoned environments accept no new executions
+  cordoned?: boolean
+  cordon_reason?: string
+  cordoned_at?: string
+  workspace_snapshots?: WorkspaceSnapshotConfig
+  exec_mode?: ExecMode
+  mode?: EnvironmentMode
+  retention_seconds?: number
+  exit_code?: number
+  output?: string
+  output_truncated?: boolean
+  completed_at?: string
+  updated_at?: string
+  api_url?: string
+  attach_url?: string
+}
+
+// How sync execs share an environment's main pod
+export type ExecMode = 'serialized' | 'parallel'
+
+// interactive keeps the main pod running; oneshot runs its command to completion
+export type EnvironmentMode = 'interactive' | 'oneshot'
+
+// Result of a sync exec (POST /environments/{id}/exec); exit_code is null when it timed out
+export interface ExecResponse {
+  stdout: string
+  stderr: string
+  exit_code: number | null
+  timed_out: boolean
+  duration_ms: number
+  stdout_bytes_total?: number
+  stderr_bytes_total?: number
+  truncated?: boolean
+  queue_position?: number
+  queue_wait_ms?: number
+}
+
+// Running and queued sync execs of an environment (GET /environments/{id}/exec/queue)
+export interface ExecQueueStats {
+  environment_id: string
+  exec_mode: ExecMode
+  running: number
+  queued: number
+  max_queued?: number
+}
+
+// Recorded attach session (asciicast v2, fetched from /sessions/{id}/recording)
+export interface SessionRecording {
+  id: string
+  environment_id: string
+  user_id?: string
+  started_at: string
+  ended_at?: string
+  size_bytes: number
+  truncated: boolean
+}
+
+// Periodic snapshots of a main pod directory, restored when the main pod is recreated
+export interface WorkspaceSnapshotConfig {
+  path: string
+  interval_seconds?: number  // 0 = server default
+  keep?: number  // 0 = server default
+}
+
+// Stored workspace snapshot (GET /environments/{id}/snapshots)
+export interface WorkspaceSnapshot {
+  id: string
+  environment_id: string
+  path: string
+  size_bytes: number
+  trigger: 'scheduled' | 'manual'
+  created_at: string
 }
 
 export interface EnvironmentPermission {
@@ -83,15 +297,34 @@ export interface APIKeyPermission {
 export interface APIKey {
   id: string
   key?: string // Only returned on creation
+  name?: string
+  // Non-secret start of the key, e.g. "ak_live_1a2b3c4d"
   key_prefix: string
   description?: string
+  // Client addresses the key works from; unset allows any
+  allowed_cidrs?: string[]
   created_at: string
   last_used?: string
+  last_used_ip?: string
   expires_at?: string
   revoked_at?: string
   permissions?: APIKeyPermission[]
 }
 
+// Short-lived token scoped to a single environment
+export interface EnvironmentToken {
+  id: string
+  environment_id: string
+  user_id: string
+  permission: 'viewer' | 'editor' | 'owner'
+  description?: string
+  token?: string // Only returned on creation
+  created_at: string
+  expires_at: string
+  revoked_at?: string
+  last_used?: string
+}
+
 export interface Metric {
   id: string
   environment_id?: string
@@ -100,9 +333,48 @@ export interface Metric {
   timestamp: string
 }
 
+export interface MetricSeries {
+  avg: (number | null)[]
+  max: (number | null)[]
+}
+
+export interface MetricsHistory {
+  environment_id?: string
+  from: string
+  to: string
+  step_seconds: number
+  timestamps: string[]
+  series: Record<string, MetricSeries>
+}
+
+export interface EnvironmentUsage {
+  environment_id: string
+  cpu_avg: number
+  cpu_max: number
+  memory_avg: number
+  memory_max: number
+  samples: number
+}
+
+export interface GuardrailStatus {
+  managed_namespaces: number
+  max_namespaces: number
+  environments_created_last_hour: number
+  max_environments_per_hour: number
+  limit_reached: boolean
+}
+
+export interface MetricsSummary {
+  history: MetricsHistory
+  top_environments: EnvironmentUsage[]
+  guardrails?: GuardrailStatus
+}
+
 export interface LogEntry {
   message: string
   timestamp?: string
+  stream?: 'stdout' | 'stderr' | 'reconciliation'
+  context?: boolean
 }
 
 // Execution types for async isolated execution
@@ -120,18 +392,201 @@ export interface Execution {
   stdout?: string
   stderr?: string
   error?: string
+  // Classifies error, e.g. EXEC_FILES_FAILED when the input files could not be written
+  error_code?: string
   duration_ms?: number
+  // Input files written before the command ran (contents are not kept)
+  files?: ExecutionFile[]
+  effective_image?: string
+  effective_resources?: {
+    cpu: string
+    memory: string
+    storage: string
+  }
+  mode?: ExecutionMode
+  pod_name?: string
+  pod_scheduled_at?: string
+  pod_started_at?: string
+  // Set when the execution was not isolated (main_fallback mode)
+  warning?: string
+  callback?: ExecutionCallback
+  // Set when the result was served from the result cache; cached_from is the execution that
+  // produced it
+  cached?: boolean
+  cached_from?: string
+  // Steps of the execution's life, oldest first
+  events?: ExecutionEvent[]
+  metadata?: Record<string, string>
+}
+
+export interface ExecutionEvent {
+  type: 'queued' | 'started' | 'soft_timeout_warned' | 'killed'
+  at: string
+  message?: string
+}
+
+export interface ExecutionFile {
+  path: string
+  size: number
+}
+
+// Where an execution ran
+export type ExecutionMode = 'standby' | 'ephemeral' | 'main_fallback'
+
+export interface ExecutionCallback {
+  url: string
+  status: 'pending' | 'delivering' | 'delivered' | 'failed'
+  attempts: number
+  last_attempt_at?: string
+  last_error?: string
+  delivered_at?: string
 }
 
 export interface ExecutionListResponse {
   executions: Execution[]
+  total: number // matching executions across all pages
+  next_page_token?: string
+}
+
+// Filters of GET /environments/{id}/executions; user_id is admin-only
+export interface ExecutionListParams {
+  limit?: number
+  page_token?: string
+  command_contains?: string
+  exit_code?: number
+  status?: ExecutionStatus
+  created_after?: string // RFC3339
+  created_before?: string // RFC3339
+  user_id?: string
+}
+
+export interface ListEnvironmentsResponse {
+  environments: Environment[]
   total: number
+  limit: number
+  offset: number
+  next_page_token?: string
 }
 
 export interface SubmitExecutionData {
   command: string[]
   timeout?: number
   env?: Record<string, string>
+  // Per-execution overrides of the environment's image, resources and isolation
+  image?: string
+  resources?: {
+    cpu?: string
+    memory?: string
+    storage?: string
+  }
+  isolation?: IsolationConfig
+  // POST the result to callback_url when the execution finishes
+  callback_url?: string
+  callback_headers?: Record<string, string>
+  callback_secret?: string
+  // Files written into the working directory before the command runs: path -> base64 content
+  files?: Record<string, string>
+  // Reuse the result of an identical earlier execution; cache_ttl is in seconds (default 3600)
+  cache?: boolean
+  cache_ttl?: number
+  // Only kill the command at its timeout, without the soft timeout signal before it
+  skip_soft_timeout?: boolean
+}
+
+// Pipelines: steps run as async executions in dependency order
+export type PipelineStatus = 'running' | 'completed' | 'failed' | 'canceled'
+export type PipelineStepStatus = 'pending' | 'running' | 'completed' | 'failed' | 'canceled' | 'skipped'
+
+export interface PipelineStepData {
+  name: string
+  command: string[]
+  env?: Record<string, string>
+  depends_on?: string[]
+  timeout?: number
+}
+
+export interface SubmitPipelineData {
+  steps: PipelineStepData[]
+  // Independent steps running at once (default 4)
+  max_parallel?: number
+}
+
+export interface PipelineStep extends PipelineStepData {
+  status: PipelineStepStatus
+  execution_id?: string
+  exit_code?: number
+  error?: string
+  started_at?: string
+  completed_at?: string
+}
+
+export interface Pipeline {
+  id: string
+  environment_id: string
+  user_id?: string
+  status: PipelineStatus
+  max_parallel: number
+  steps: PipelineStep[]
+  error?: string
+  created_at: string
+  completed_at?: string
+}
+
+// Bulk request carried out in the background (GET /operations/{id})
+export type OperationStatus = 'running' | 'completed' | 'failed'
+
+export interface OperationResult {
+  environment_id: string
+  status: 'pending' | 'succeeded' | 'failed'
+  error?: string
+}
+
+export interface Operation {
+  id: string
+  type: 'delete_environments'
+  user_id?: string
+  status: OperationStatus
+  total: number
+  succeeded: number
+  failed: number
+  results: OperationResult[]
+  error?: string
+  created_at: string
+  completed_at?: string
+}
+
+// Filters of a bulk delete (DELETE /environments); at least one is required
+export interface BulkDeleteFilters {
+  label?: string
+  status?: string
+  team?: string
+  group?: string
+}
+
+// Image metadata from GET /images/inspect
+export interface ImagePlatform {
+  os: string
+  architecture: string
+  variant?: string
+  digest?: string
+  size?: number
+}
+
+export interface ImageInfo {
+  image: string
+  registry: string
+  repository: string
+  tag?: string
+  digest: string
+  media_type: string
+  platforms: ImagePlatform[]
+  // Platform that size, created, entrypoint and cmd describe (linux/amd64 when available)
+  platform?: string
+  size: number
+  created?: string
+  entrypoint?: string[]
+  cmd?: string[]
+  inspected_at: string
 }
 
 export interface CreateEnvironmentData {
@@ -148,8 +603,12 @@ export interface CreateEnvironmentData {
   timeout?: number
   node_selector?: Record<string, string>
   tolerations?: Toleration[]
+  affinity?: Affinity
   isolation?: IsolationConfig
   pool?: PoolConfig
+  exec_mode?: ExecMode
+  mode?: EnvironmentMode
+  retention_seconds?: number
 }
 
 export interface CreateUserData {
@@ -178,3 +637,17 @@ export interface CreateAPIKeyData {
   expires_in?: number
   permissions?: APIKeyPermission[]
 }
+
+export interface ErrorDetail {
+  field: string
+  code: string
+  message: string
+}
+
+export interface ErrorResponse {
+  error: string
+  message: string
+  code: string // machine-readable, e.g. "ENV_NOT_RUNNING"
+  status: number
+  details?: ErrorDetail[]
+}